@@ -5,11 +5,15 @@
 
 use std::hint::black_box;
 use std::io::Cursor;
-use std::{mem, vec};
+use std::{fs, mem, vec};
 
 use criterion::{BenchmarkId, Criterion, Throughput, criterion_group, criterion_main};
 use edit::helpers::*;
 use edit::simd::MemsetSafe;
+use edit::syntax::{
+    Grammar, IncrementalHighlighter, IncrementalLexer, Language, Lexer, LexerRegistry,
+    SyntaxHighlighter, Theme,
+};
 use edit::{buffer, glob, hash, json, oklab, simd, unicode};
 use stdext::arena::{self, Arena, scratch_arena};
 
@@ -247,6 +251,94 @@ fn bench_simd_memset<T: MemsetSafe + Copy + Default>(c: &mut Criterion) {
     }
 }
 
+fn bench_syntax_lexers(c: &mut Criterion) {
+    let mut group = c.benchmark_group("syntax::Lexer");
+
+    // Every language with a fixture, which is named after one of its extensions.
+    let fixtures = concat!(env!("CARGO_MANIFEST_DIR"), "/../../syntax-tests");
+    for &language in Language::ALL {
+        let Some(text) = language
+            .extensions()
+            .iter()
+            .find_map(|ext| fs::read(format!("{fixtures}/test_syntax.{ext}")).ok())
+        else {
+            continue;
+        };
+        let lexer = LexerRegistry::get_lexer(language);
+        group
+            .throughput(Throughput::Bytes(text.len() as u64))
+            .bench_function(language.id(), |b| b.iter(|| lexer.tokenize(black_box(&text))));
+    }
+
+    // Go at its most demanding: lines of 10k columns, and nothing but tiny tokens.
+    let go = LexerRegistry::get_lexer(Language::Go);
+    let long_line = [b"x := ".as_slice(), &b"f(a, \"b\", 1.5) + ".repeat(600), b"0\n"].concat();
+    let inputs =
+        [("go/long_lines", long_line.repeat(100)), ("go/small_tokens", b"a+b;".repeat(MEBI / 4))];
+    for (name, text) in &inputs {
+        group
+            .throughput(Throughput::Bytes(text.len() as u64))
+            .bench_function(*name, |b| b.iter(|| go.tokenize(black_box(text))));
+    }
+}
+
+fn bench_syntax_incremental(c: &mut Criterion) {
+    let grammar = Grammar::parse(include_str!("../tests/grammars/go.tmLanguage.json")).unwrap();
+    // About 20k lines of Go.
+    let text = include_str!("../../../syntax-tests/test_syntax.go").repeat(32);
+    let lines: Vec<&str> = text.split('\n').collect();
+    let middle = lines.len() / 2;
+    let edited = format!("{} // edited", lines[middle]);
+
+    let mut highlighter = IncrementalHighlighter::new(&grammar);
+    highlighter.highlight(text.as_bytes());
+
+    // Typing in the middle of the document, compared to tokenizing all of it again.
+    c.benchmark_group("syntax::IncrementalHighlighter")
+        .bench_function("full", |b| b.iter(|| grammar.tokenize(black_box(text.as_bytes()))))
+        .bench_function("edit", |b| {
+            b.iter(|| {
+                highlighter.edit(middle, middle + 1, &[black_box(edited.as_bytes())]);
+                highlighter.edit(middle, middle + 1, &[black_box(lines[middle].as_bytes())]);
+            })
+        });
+
+    // The same with our own lexer, which lexes from the line that's typed in.
+    let lexer = LexerRegistry::get_lexer(Language::Go);
+    let end = lines[..=middle].iter().map(|line| line.len() + 1).sum::<usize>() - 1;
+    let mut incremental = IncrementalLexer::new(LexerRegistry::get_lexer(Language::Go));
+    incremental.highlight(text.as_bytes());
+    c.benchmark_group("syntax::IncrementalLexer")
+        .bench_function("full", |b| b.iter(|| lexer.tokenize(black_box(text.as_bytes()))))
+        .bench_function("edit", |b| {
+            b.iter(|| {
+                incremental.edit(end..end, black_box(b" // edited"));
+                incremental.edit(end..end + 10, b"");
+            })
+        });
+
+    // And through the highlighter, whose filters only run over the lines around the edit
+    // where they don't need the rest, like for SQL.
+    let text = include_str!("../../../syntax-tests/test_syntax_postgres.sql").repeat(600);
+    let end = text[..text.len() / 2].rfind('\n').unwrap();
+    let edited = format!("{} -- edited{}", &text[..end], &text[end..]);
+    let mut highlighter = SyntaxHighlighter::new(Language::Sql, Theme::default());
+    highlighter.update(text.as_bytes(), true);
+    c.benchmark_group("syntax::SyntaxHighlighter")
+        .bench_function("full", |b| {
+            b.iter(|| {
+                let mut highlighter = SyntaxHighlighter::new(Language::Sql, Theme::default());
+                highlighter.update(black_box(text.as_bytes()), true);
+            })
+        })
+        .bench_function("edit", |b| {
+            b.iter(|| {
+                highlighter.update(black_box(edited.as_bytes()), true);
+                highlighter.update(black_box(text.as_bytes()), true);
+            })
+        });
+}
+
 fn bench_unicode(c: &mut Criterion) {
     let reference = concat!(
         "In the quiet twilight, dreams unfold, soft whispers of a story untold.\n",
@@ -291,6 +383,8 @@ fn bench(c: &mut Criterion) {
     bench_simd_memchr2(c);
     bench_simd_memset::<u32>(c);
     bench_simd_memset::<u8>(c);
+    bench_syntax_lexers(c);
+    bench_syntax_incremental(c);
     bench_unicode(c);
 }
 
@@ -1,10 +1,10 @@
 // Copyright (c) Microsoft Corporation.
 // Licensed under the MIT License.
 
+use edit::framebuffer::IndexedColor;
 use edit::helpers::*;
 use edit::input::{kbmod, vk};
 use edit::tui::*;
-use edit::framebuffer::IndexedColor;
 use stdext::arena_format;
 
 use crate::localization::*;
@@ -189,22 +189,26 @@ pub fn draw_dialog_settings(ctx: &mut Context, state: &mut State) {
         // Initialize input fields only once when dialog is opened
         if !state.settings_dialog_initialized {
             state.settings_dialog_initialized = true;
-            
+
             // Initialize with current colors if set, otherwise leave empty
             if let Some(color) = state.settings.titlebar_color {
-                state.settings_titlebar_color_input = crate::settings::Settings::color_to_hex_pub(color);
+                state.settings_titlebar_color_input =
+                    crate::settings::Settings::color_to_hex_pub(color);
             }
             if let Some(color) = state.settings.selection_color {
-                state.settings_selection_color_input = crate::settings::Settings::color_to_hex_pub(color);
+                state.settings_selection_color_input =
+                    crate::settings::Settings::color_to_hex_pub(color);
             }
             if let Some(color) = state.settings.line_number_color {
-                state.settings_line_number_color_input = crate::settings::Settings::color_to_hex_pub(color);
+                state.settings_line_number_color_input =
+                    crate::settings::Settings::color_to_hex_pub(color);
             }
             if let Some(color) = state.settings.line_separator_color {
-                state.settings_line_separator_color_input = crate::settings::Settings::color_to_hex_pub(color);
+                state.settings_line_separator_color_input =
+                    crate::settings::Settings::color_to_hex_pub(color);
             }
         }
-        
+
         ctx.block_begin("content");
         ctx.inherit_focus();
         ctx.attr_padding(Rect::three(1, 2, 1));
@@ -252,7 +256,10 @@ pub fn draw_dialog_settings(ctx: &mut Context, state: &mut State) {
             ctx.attr_overflow(Overflow::TruncateTail);
 
             // Line separator color input field
-            ctx.editline("line-separator-color-input", &mut state.settings_line_separator_color_input);
+            ctx.editline(
+                "line-separator-color-input",
+                &mut state.settings_line_separator_color_input,
+            );
             ctx.inherit_focus();
             ctx.attr_intrinsic_size(Size { width: 200, height: 1 });
 
@@ -270,41 +277,49 @@ pub fn draw_dialog_settings(ctx: &mut Context, state: &mut State) {
                     let old_selection_color = state.settings.selection_color;
                     let old_line_number_color = state.settings.line_number_color;
                     let old_line_separator_color = state.settings.line_separator_color;
-                    
+
                     // Try to parse and save titlebar color (empty or "#" = default)
                     let titlebar_input = state.settings_titlebar_color_input.trim();
                     if titlebar_input.is_empty() || titlebar_input == "#" {
                         state.settings.titlebar_color = None;
-                    } else if let Some(color) = crate::settings::Settings::parse_color_pub(titlebar_input) {
+                    } else if let Some(color) =
+                        crate::settings::Settings::parse_color_pub(titlebar_input)
+                    {
                         state.settings.titlebar_color = Some(color);
                     }
-                    
+
                     // Try to parse and save selection color (empty or "#" = default)
                     let selection_input = state.settings_selection_color_input.trim();
                     if selection_input.is_empty() || selection_input == "#" {
                         state.settings.selection_color = None;
-                    } else if let Some(color) = crate::settings::Settings::parse_color_pub(selection_input) {
+                    } else if let Some(color) =
+                        crate::settings::Settings::parse_color_pub(selection_input)
+                    {
                         state.settings.selection_color = Some(color);
                     }
-                    
+
                     // Try to parse and save line number color (empty or "#" = default)
                     let line_number_input = state.settings_line_number_color_input.trim();
                     if line_number_input.is_empty() || line_number_input == "#" {
                         state.settings.line_number_color = None;
-                    } else if let Some(color) = crate::settings::Settings::parse_color_pub(line_number_input) {
+                    } else if let Some(color) =
+                        crate::settings::Settings::parse_color_pub(line_number_input)
+                    {
                         state.settings.line_number_color = Some(color);
                     }
-                    
+
                     // Try to parse and save line separator color (empty or "#" = default)
                     let line_separator_input = state.settings_line_separator_color_input.trim();
                     if line_separator_input.is_empty() || line_separator_input == "#" {
                         state.settings.line_separator_color = None;
-                    } else if let Some(color) = crate::settings::Settings::parse_color_pub(line_separator_input) {
+                    } else if let Some(color) =
+                        crate::settings::Settings::parse_color_pub(line_separator_input)
+                    {
                         state.settings.line_separator_color = Some(color);
                     }
-                    
+
                     let _ = state.settings.save();
-                    
+
                     // Apply the colors immediately
                     state.menubar_color_bg = state.settings.titlebar_color.unwrap_or_else(|| {
                         ctx.indexed(IndexedColor::Background).oklab_blend(ctx.indexed_alpha(
@@ -314,23 +329,24 @@ pub fn draw_dialog_settings(ctx: &mut Context, state: &mut State) {
                         ))
                     });
                     state.menubar_color_fg = ctx.contrasted(state.menubar_color_bg);
-                    
-                    state.selection_color_bg = state.settings.selection_color.unwrap_or_else(|| {
-                        ctx.indexed(IndexedColor::Green)
-                    });
-                    
+
+                    state.selection_color_bg = state
+                        .settings
+                        .selection_color
+                        .unwrap_or_else(|| ctx.indexed(IndexedColor::Green));
+
                     state.line_number_color = state.settings.line_number_color;
                     state.line_separator_color = state.settings.line_separator_color;
-                    
+
                     // Check if any colors requiring restart changed
                     let needs_restart = old_selection_color != state.settings.selection_color
                         || old_line_number_color != state.settings.line_number_color
                         || old_line_separator_color != state.settings.line_separator_color;
-                    
+
                     if needs_restart {
                         state.wants_restart_warning = true;
                     }
-                    
+
                     state.wants_settings = false;
                     state.settings_dialog_initialized = false;
                     state.settings_titlebar_color_input.clear();
@@ -96,16 +96,15 @@ fn run() -> apperr::Result<()> {
         ))
     });
     state.menubar_color_fg = tui.contrasted(state.menubar_color_bg);
-    
+
     // Use custom selection color from settings if configured, otherwise use default green
-    state.selection_color_bg = state.settings.selection_color.unwrap_or_else(|| {
-        tui.indexed(IndexedColor::Green)
-    });
-    
+    state.selection_color_bg =
+        state.settings.selection_color.unwrap_or_else(|| tui.indexed(IndexedColor::Green));
+
     // Set line number and separator colors from settings (no defaults, buffer will use defaults if None)
     state.line_number_color = state.settings.line_number_color;
     state.line_separator_color = state.settings.line_separator_color;
-    
+
     let floater_bg = tui
         .indexed_alpha(IndexedColor::Background, 2, 3)
         .oklab_blend(tui.indexed_alpha(IndexedColor::Foreground, 1, 3));
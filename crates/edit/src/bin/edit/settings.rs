@@ -4,8 +4,8 @@
 use std::fs;
 use std::path::PathBuf;
 
-use edit::oklab::StraightRgba;
 use edit::json;
+use edit::oklab::StraightRgba;
 use stdext::arena::scratch_arena;
 
 use crate::apperr;
@@ -42,7 +42,7 @@ impl Settings {
     /// Load settings from the config file
     pub fn load() -> apperr::Result<Self> {
         let config_path = Self::config_path()?;
-        
+
         if !config_path.exists() {
             return Ok(Self::default());
         }
@@ -103,11 +103,7 @@ impl Settings {
         let r = u32::from_str_radix(&hex[0..2], 16).ok()?;
         let g = u32::from_str_radix(&hex[2..4], 16).ok()?;
         let b = u32::from_str_radix(&hex[4..6], 16).ok()?;
-        let a = if len == 8 {
-            u32::from_str_radix(&hex[6..8], 16).ok()?
-        } else {
-            255
-        };
+        let a = if len == 8 { u32::from_str_radix(&hex[6..8], 16).ok()? } else { 255 };
 
         // StraightRgba stores colors as 0xAABBGGRR (little-endian)
         Some(StraightRgba::from_le(r | (g << 8) | (b << 16) | (a << 24)))
@@ -116,7 +112,7 @@ impl Settings {
     /// Save settings to the config file
     pub fn save(&self) -> apperr::Result<()> {
         let config_path = Self::config_path()?;
-        
+
         // Create config directory if it doesn't exist
         if let Some(parent) = config_path.parent() {
             fs::create_dir_all(parent)?;
@@ -179,7 +175,7 @@ impl Settings {
         let g = color.green();
         let b = color.blue();
         let a = color.alpha();
-        
+
         if a == 255 {
             format!("#{:02X}{:02X}{:02X}", r, g, b)
         } else {
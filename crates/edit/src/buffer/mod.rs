@@ -375,11 +375,8 @@ impl TextBuffer {
 
     /// Enable syntax highlighting for the given language.
     pub fn set_syntax_language(&mut self, language: Language) {
-        let theme = self.syntax_highlighter
-            .as_ref()
-            .map(|h| h.theme().clone())
-            .unwrap_or_default();
-        
+        let theme = self.syntax_highlighter.as_ref().map(|h| h.theme().clone()).unwrap_or_default();
+
         self.syntax_highlighter = Some(SyntaxHighlighter::new(language, theme));
         self.update_syntax_highlighting();
     }
@@ -2051,7 +2048,7 @@ impl TextBuffer {
                     };
                     fb.blend_fg(line_number_rect, color);
                 }
-                
+
                 // Apply separator color (the "│" character)
                 if let Some(color) = fb.line_separator_color {
                     let separator_rect = Rect {
@@ -2067,35 +2064,38 @@ impl TextBuffer {
             // Apply syntax highlighting colors to the rendered line
             // Collect tokens first to avoid borrow checker issues
             let syntax_tokens: Vec<_> = if let Some(highlighter) = &self.syntax_highlighter {
-                highlighter.get_tokens_in_range(cursor_beg.offset..cursor_end.offset)
+                let theme = highlighter.theme();
+                highlighter
+                    .get_tokens_in_range(cursor_beg.offset..cursor_end.offset)
                     .iter()
-                    .map(|t| (t.kind, t.span.clone()))
+                    .map(|t| (theme.token_style(t), t.span.clone()))
                     .collect()
             } else {
                 Vec::new()
             };
-            
+
             if !syntax_tokens.is_empty() {
-                let theme = self.syntax_highlighter.as_ref().unwrap().theme().clone();
-                
-                for (kind, span) in syntax_tokens {
-                    let style = theme.get_style(kind);
-                    
+                for (style, span) in syntax_tokens {
                     // Calculate visual position for this token
                     let token_start = span.start.max(cursor_beg.offset);
                     let token_end = span.end.min(cursor_end.offset);
-                    
+
                     if token_start < token_end {
                         // Find the visual position of the token start
-                        let cursor_token_start = self.cursor_move_to_offset_internal(cursor_beg, token_start);
-                        let cursor_token_end = self.cursor_move_to_offset_internal(cursor_token_start, token_end);
-                        
+                        let cursor_token_start =
+                            self.cursor_move_to_offset_internal(cursor_beg, token_start);
+                        let cursor_token_end =
+                            self.cursor_move_to_offset_internal(cursor_token_start, token_end);
+
                         if cursor_token_start.visual_pos.y == visual_line {
-                            let left = destination.left + self.margin_width + 
-                                (cursor_token_start.visual_pos.x - origin.x).max(0);
-                            let right = (destination.left + self.margin_width + 
-                                (cursor_token_end.visual_pos.x - origin.x)).min(destination.right);
-                            
+                            let left = destination.left
+                                + self.margin_width
+                                + (cursor_token_start.visual_pos.x - origin.x).max(0);
+                            let right = (destination.left
+                                + self.margin_width
+                                + (cursor_token_end.visual_pos.x - origin.x))
+                                .min(destination.right);
+
                             if left < right {
                                 let rect = Rect {
                                     left,
@@ -2103,10 +2103,10 @@ impl TextBuffer {
                                     right,
                                     bottom: destination.top + y + 1,
                                 };
-                                
+
                                 // Apply the token's foreground color
                                 fb.blend_fg(rect, style.fg);
-                                
+
                                 // Apply background color if specified
                                 if let Some(bg) = style.bg {
                                     fb.blend_bg(rect, bg);
@@ -109,6 +109,11 @@ unsafe impl MemsetSafe for StraightRgba {}
 pub struct Oklab([f32; 4]);
 
 impl Oklab {
+    #[inline]
+    pub const fn new(lightness: f32, a: f32, b: f32, alpha: f32) -> Self {
+        Oklab([lightness, a, b, alpha])
+    }
+
     #[inline]
     pub const fn lightness(self) -> f32 {
         self.0[0]
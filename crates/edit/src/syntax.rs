@@ -8,20 +8,134 @@
 //!
 //! # Architecture
 //!
-//! - **Lexers**: Fast, hand-written lexers for each language
+//! - **Lexers**: Fast, hand-written lexers for each language, which lex again from the line
+//!   an edit is on, see [`IncrementalLexer`]
 //! - **Token Cache**: Incremental caching for performance
 //! - **Themes**: Configurable color schemes for different token types
 //! - **Lazy Evaluation**: Only highlights visible portions of the document
+//! - **Filters**: Optional post-processing of the token stream (rainbow brackets, links, colors, ...),
+//!   see [`HighlightOptions`]
+//! - **Embedded Regions**: Lexers delegate parts of a document to other lexers
+//!   (code fences, `<script>` elements, ...), see [`EmbeddedRegion`], and tokens are lexed
+//!   again with another language after the fact, see [`Injections`]
+//! - **TextMate Grammars**: Grammars from other editors as a lexer backend, see [`Grammar`],
+//!   which can be tokenized again line by line after an edit, see [`IncrementalHighlighter`],
+//!   or as they're read from a file too large to keep in memory, see [`highlight_reader`]
+//! - **Detection**: The language of a file by its name, `#!` line, modeline or content,
+//!   see [`detect_language`]
+//! - **Batches**: Many files highlighted on a pool of threads, see [`highlight_all`]
+//! - **Semantic Tokens**: The token stream encoded for LSP clients, see [`encode_semantic_tokens`]
+//! - **Grammar Metadata**: Static per-language facts (brackets, folding, indentation, ...),
+//!   see [`GrammarMetadata`]
+//!
+//! Text is highlighted as it is and never Unicode-normalized. Composed and decomposed
+//! forms of the same text, like `é` and `e\u{301}`, lex to the same kinds of tokens,
+//! whose spans cover the bytes actually in the document.
 
+mod autoclose;
+mod balance;
+mod batch;
+mod bidi;
+mod brackets;
+mod colors;
+mod comments;
+mod controls;
+mod coverage;
+mod detect;
+mod diagnostics;
+mod embedded;
+mod escapes;
+mod folding;
+mod functions;
+mod grammar;
+mod inactive;
+mod incremental;
+mod indent;
+mod injection;
 mod lexer;
+mod lines;
+mod links;
+mod long_lines;
+mod markers;
+mod metadata;
+mod occurrences;
+mod outline;
+mod scopes;
+mod selection;
+mod semantic_tokens;
+mod spelling;
+mod stream;
+mod textmate;
 mod theme;
 mod token;
+mod transcode;
+mod whitespace;
 
-pub use lexer::{Lexer, LexerRegistry, Language};
-pub use theme::{Theme, TokenStyle};
-pub use token::{Token, TokenKind, TokenSpan};
-
+use std::cell::OnceCell;
+use std::io::{self, BufRead};
 use std::ops::Range;
+use std::sync::atomic::AtomicBool;
+
+pub use autoclose::{cursor_context, should_auto_close, surround_pair};
+pub use balance::{Problem, ProblemKind, balance_problems};
+pub use batch::{FileError, FileInput, FileResult, HighlightAllError, highlight_all};
+pub use bidi::{bidi_problems, flag_bidi_controls, is_bidi_control};
+pub use brackets::{BracketMatch, BracketMatcher, BracketPair, rainbow_brackets};
+pub use colors::{detect_colors, parse_color};
+pub use comments::toggle_comments;
+pub use controls::{flag_control_characters, is_control_character};
+pub use coverage::{Coverage, RARE_HITS, RuleHits, ScopeHits};
+pub use detect::{DetectedBy, Detection, detect_language};
+pub use diagnostics::{
+    DiagnosticHook, DiagnosticOptions, flag_diagnostics, javascript_diagnostics, json_diagnostics,
+    python_diagnostics, yaml_diagnostics,
+};
+pub use embedded::{EmbeddedRegion, MAX_EMBED_DEPTH, RegionEnd};
+pub use escapes::split_escapes;
+pub use folding::{FoldKind, FoldingHook, FoldingRange, folding_ranges, indentation_folds};
+pub use functions::classify_functions;
+pub use grammar::{
+    ExportedGrammar, Grammar, GrammarProblem, GrammarProblemKind, LineState, MAX_RULE_DEPTH,
+    export_grammar, validate_grammar,
+};
+pub use inactive::mark_inactive_code;
+pub use incremental::{IncrementalHighlighter, IncrementalLexer};
+use incremental::{shift_tokens, splice_tokens};
+pub use indent::{IndentHint, IndentHook, indent_guides, indent_hint, indent_width, yaml_indent};
+pub use injection::{Injection, Injections};
+pub use lexer::{
+    Checkpoint, Language, Lexer, LexerRegistry, MAX_INTERPOLATION_DEPTH, MAX_NESTING_DEPTH,
+    ReportCheckpoint, SqlDialect, UNTERMINATED_COMMENT_LINES,
+};
+pub use lines::{Columns, LineIndex};
+pub use links::{detect_links, parse_file_link};
+pub use long_lines::tokenize_long_lines;
+pub use markers::{DEFAULT_COMMENT_KEYWORDS, mark_comment_keywords};
+pub use metadata::{
+    AutoClosePair, CommentSyntax, DEFAULT_BRACKETS, EscapeRules, FoldingRules, FunctionRules,
+    GrammarMetadata, IndentRules, KeywordPair,
+};
+pub use occurrences::{OccurrenceOptions, occurrences};
+pub use outline::{
+    OutlineHook, Symbol, SymbolKind, css_outline, go_outline, markdown_outline, outline,
+};
+pub use scopes::{Scope, ScopeIndex, ScopeKind};
+pub use selection::{SelectionHook, markdown_selection, selection_ranges};
+pub use semantic_tokens::{
+    Legend, SemanticTokensDelta, SemanticTokensEdit, encode_semantic_tokens,
+    encode_semantic_tokens_range,
+};
+pub use spelling::spell_check_regions;
+pub use stream::{LineTokens, StreamOptions, highlight_reader};
+pub use textmate::{TextMateTheme, scope_stack, token_scopes};
+pub use theme::{Theme, ThemeEntry, TokenStyle};
+pub use token::{
+    Container, DocMarkup, ScopeStack, Token, TokenKind, TokenPayload, TokenSpan, WhitespacePosition,
+};
+pub use transcode::{
+    OffsetMap, SourceEncoding, Transcoded, detect_encoding, transcode, transcode_legacy,
+};
+pub use whitespace::split_whitespace;
 
 /// A cached syntax highlighting result for a document.
 pub struct SyntaxHighlighter {
@@ -35,6 +149,61 @@ pub struct SyntaxHighlighter {
     theme: Theme,
     /// Document length at last tokenization
     doc_len: usize,
+    /// Which post-processing filters to run
+    options: HighlightOptions,
+    /// Scopes for breadcrumbs, computed on demand from the cached tokens
+    scopes: OnceCell<ScopeIndex>,
+    /// What went wrong with the options at the last update
+    warnings: Vec<String>,
+    /// The lexer with the text and tokens of the last update, until the options change
+    lexer: Option<IncrementalLexer>,
+}
+
+/// Optional post-processing of the token stream.
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub struct HighlightOptions {
+    /// Annotate brackets with their nesting depth, see [`rainbow_brackets`].
+    pub rainbow_brackets: bool,
+    /// Mark URLs in comments and strings, see [`detect_links`].
+    pub links: bool,
+    /// Also mark file paths when marking links.
+    pub file_paths: bool,
+    /// The action markers to mark in comments, like [`DEFAULT_COMMENT_KEYWORDS`].
+    /// Empty marks none, see [`mark_comment_keywords`].
+    pub comment_keywords: Vec<String>,
+    /// Attach the values of color literals, see [`detect_colors`].
+    pub colors: bool,
+    /// Also recognize hex colors in string literals when recognizing colors.
+    pub string_colors: bool,
+    /// Split whitespace into runs of spaces, tabs and newlines and mark indentation
+    /// and trailing whitespace, see [`split_whitespace`].
+    pub whitespace: bool,
+    /// Opt-in checks for discouraged constructs, see [`flag_diagnostics`].
+    pub diagnostics: DiagnosticOptions,
+    /// Split escape sequences out of string literals, see [`split_escapes`].
+    pub escapes: bool,
+    /// Dim `#if 0` blocks in C and C++, see [`mark_inactive_code`].
+    pub inactive_code: bool,
+    /// The dialect of SQL, unless the text names one. `None` is [`SqlDialect::Ansi`].
+    pub sql_dialect: Option<SqlDialect>,
+    /// The version of the language, like `1.17` for Go, see [`LexerRegistry::versions`].
+    /// `None` is the latest.
+    pub language_version: Option<String>,
+    /// Only lex lines up to this many bytes, and the rest of them as plain text,
+    /// see [`tokenize_long_lines`].
+    pub max_line_length: Option<usize>,
+    /// How deeply brackets may nest before Go's lexer only counts them.
+    /// `None` is [`MAX_NESTING_DEPTH`].
+    pub max_nesting_depth: Option<usize>,
+    /// How many lines a block comment that's never closed may span before lexers end it.
+    /// `None` is [`UNTERMINATED_COMMENT_LINES`].
+    pub unterminated_comment_lines: Option<usize>,
+    /// Lex the content of some tokens with another language, like the command of
+    /// `//go:generate` as shell, see [`Injections::builtin`].
+    pub injections: bool,
+    /// Lex the strings assigned to variables whose names end with a suffix as its language,
+    /// like `("Query", Language::Sql)`, see [`Injections::register_string_suffix`].
+    pub string_injections: Vec<(String, Language)>,
 }
 
 impl SyntaxHighlighter {
@@ -46,6 +215,10 @@ impl SyntaxHighlighter {
             dirty_range: Some(0..usize::MAX),
             theme,
             doc_len: 0,
+            options: HighlightOptions::default(),
+            scopes: OnceCell::new(),
+            warnings: Vec::new(),
+            lexer: None,
         }
     }
 
@@ -61,18 +234,186 @@ impl SyntaxHighlighter {
 
     /// Update the highlighting for the document.
     ///
-    /// This is an incremental operation that only re-tokenizes dirty regions.
+    /// The lexer picks up from the line where the text starts to differ from the one
+    /// of the last update, see [`IncrementalLexer`]. If the highlighter
+    /// [`streams`](Self::streams), the filters only run over the lines whose tokens
+    /// changed, to and from lines the lexer can pick up at, and otherwise over all of it.
     pub fn update(&mut self, text: &[u8], force: bool) {
         if !force && self.dirty_range.is_none() && text.len() == self.doc_len {
             return;
         }
 
-        // For now, we re-tokenize the entire document.
-        // Future optimization: incremental tokenization.
-        let lexer = LexerRegistry::get_lexer(self.language);
-        self.tokens = lexer.tokenize(text);
+        let tokens = match self.options.max_line_length {
+            Some(max) => {
+                self.lexer = None;
+                Some(tokenize_long_lines(&*self.make_lexer(), text, max))
+            }
+            None => {
+                let local = self.lexer.is_some() && self.streams();
+                let lexer = match &mut self.lexer {
+                    Some(lexer) => lexer,
+                    None => {
+                        let lexer = IncrementalLexer::new(self.make_lexer());
+                        self.lexer.insert(lexer)
+                    }
+                };
+                let changed = lexer.update(text);
+                if local {
+                    let lines = lexer.lines_around(changed);
+                    let first = lexer.tokens().partition_point(|t| t.span.start < lines.start);
+                    let last = lexer.tokens().partition_point(|t| t.span.start < lines.end);
+                    let mut tokens = lexer.tokens()[first..last].to_vec();
+                    shift_tokens(&mut tokens, |pos| pos - lines.start);
+                    self.filter(&text[lines.clone()], &mut tokens);
+                    shift_tokens(&mut tokens, |pos| pos + lines.start);
+                    let old_end = lines.end + self.doc_len - text.len();
+                    let moved = |pos: usize| pos + text.len() - self.doc_len;
+                    splice_tokens(&mut self.tokens, lines.start..old_end, tokens, moved);
+                    None
+                } else {
+                    Some(lexer.tokens().to_vec())
+                }
+            }
+        };
+        if let Some(mut tokens) = tokens {
+            self.filter(text, &mut tokens);
+            self.tokens = tokens;
+        }
         self.dirty_range = None;
         self.doc_len = text.len();
+        self.scopes = OnceCell::new();
+    }
+
+    /// Highlight what `reader` reads, like [`update`](Self::update) would all of it, and
+    /// pass each line to `emit`, like [`highlight_reader`] does with a grammar.
+    ///
+    /// If the highlighter [`streams`](Self::streams), only a section of lines is kept,
+    /// which the lexer picks up at where the one before ended. Otherwise all of it is read
+    /// first. Either way, the lexer starts over after a line longer than
+    /// [`StreamOptions::max_line_length`], whose rest is plain text, see
+    /// [`tokenize_long_lines`]. The highlighter's own tokens are left as they are.
+    pub fn highlight_reader(
+        &mut self,
+        mut reader: impl BufRead,
+        options: &StreamOptions,
+        cancel: &AtomicBool,
+        mut emit: impl FnMut(LineTokens) -> io::Result<()>,
+    ) -> io::Result<()> {
+        if !self.streams() {
+            let mut text = Vec::new();
+            reader.read_to_end(&mut text)?;
+            let lexer = self.make_lexer();
+            let mut tokens = tokenize_long_lines(&*lexer, &text, options.max_line_length);
+            self.filter(&text, &mut tokens);
+            return stream::emit_lines(&text, &tokens, 0, false, cancel, &mut emit).map(drop);
+        }
+
+        // A `-- dialect:` comment is only at the top, but SQL's lexer looks for it
+        // at the top of the text it's given, which is that of a section.
+        let lexer = match self.language {
+            Language::Sql => {
+                let hint = SqlDialect::from_hint(reader.fill_buf()?);
+                let mut lexer = LexerRegistry::get_pinned_sql_lexer(
+                    hint.or(self.options.sql_dialect).unwrap_or_default(),
+                );
+                if let Some(lines) = self.options.unterminated_comment_lines {
+                    lexer.set_unterminated_comment_lines(lines);
+                }
+                lexer
+            }
+            _ => self.make_lexer(),
+        };
+        stream::lex_reader(
+            &*lexer,
+            reader,
+            options,
+            cancel,
+            |text, tokens| self.filter(text, tokens),
+            emit,
+        )
+    }
+
+    /// Whether [`highlight_reader`](Self::highlight_reader) can highlight a section of lines
+    /// at a time and still give the tokens of [`update`](Self::update). It can't if the
+    /// lexer or one of the filters needs all of the text, like to find the declarations
+    /// below doc comments, the definitions of functions or how deeply brackets nest.
+    pub fn streams(&self) -> bool {
+        let metadata = self.language.metadata();
+        let functions = &metadata.functions;
+        let options = &self.options;
+        let injections = options.injections && Injections::builtin().applies_to(self.language);
+        !LexerRegistry::get_lexer(self.language).needs_whole_text()
+            && functions.keywords.is_empty()
+            && !functions.body_follows
+            && !functions.calls
+            && metadata.diagnostics.is_none()
+            && !options.rainbow_brackets
+            && !(options.inactive_code && matches!(self.language, Language::C | Language::Cpp))
+            && !(options.colors && self.language == Language::Css)
+            && !injections
+            && options.string_injections.is_empty()
+    }
+
+    /// Run the filters of the options over the `tokens` of `text`.
+    fn filter(&self, text: &[u8], tokens: &mut Vec<Token>) {
+        if self.options.injections || !self.options.string_injections.is_empty() {
+            let mut injections =
+                if self.options.injections { Injections::builtin() } else { Injections::new() };
+            for (suffix, target) in &self.options.string_injections {
+                injections.register_string_suffix(suffix.clone(), *target);
+            }
+            injections.apply(self.language, text, tokens);
+        }
+        if self.options.inactive_code {
+            mark_inactive_code(self.language, text, tokens);
+        }
+        classify_functions(self.language, text, tokens);
+        flag_diagnostics(self.language, text, tokens, self.options.diagnostics);
+        if self.options.escapes {
+            split_escapes(self.language, text, tokens);
+        }
+        flag_bidi_controls(text, tokens);
+        flag_control_characters(text, tokens);
+        if self.options.whitespace {
+            split_whitespace(text, tokens);
+        }
+        if self.options.rainbow_brackets {
+            rainbow_brackets(self.language, text, tokens, self.theme.bracket_cycle());
+        }
+        if !self.options.comment_keywords.is_empty() {
+            mark_comment_keywords(text, tokens, &self.options.comment_keywords);
+        }
+        if self.options.links {
+            detect_links(text, tokens, self.options.file_paths);
+        }
+        if self.options.colors {
+            detect_colors(self.language, text, tokens, self.options.string_colors);
+        }
+    }
+
+    /// Make the lexer for the language and options, noting what's wrong with the options.
+    fn make_lexer(&mut self) -> Box<dyn Lexer> {
+        self.warnings.clear();
+        let version = &self.options.language_version;
+        let mut lexer = match (self.language, self.options.sql_dialect, version) {
+            (Language::Sql, Some(dialect), _) => LexerRegistry::get_sql_lexer(dialect),
+            (Language::Go, _, version) => {
+                let depth = self.options.max_nesting_depth.unwrap_or(MAX_NESTING_DEPTH);
+                let (lexer, warning) = LexerRegistry::get_go_lexer(version.as_deref(), depth);
+                self.warnings.extend(warning);
+                lexer
+            }
+            (_, _, Some(version)) => {
+                let (lexer, warning) = LexerRegistry::get_versioned_lexer(self.language, version);
+                self.warnings.extend(warning);
+                lexer
+            }
+            _ => LexerRegistry::get_lexer(self.language),
+        };
+        if let Some(lines) = self.options.unterminated_comment_lines {
+            lexer.set_unterminated_comment_lines(lines);
+        }
+        lexer
     }
 
     /// Get the style for a given byte offset in the document.
@@ -89,7 +430,7 @@ impl SyntaxHighlighter {
         });
 
         match idx {
-            Ok(i) => Some(self.theme.get_style(self.tokens[i].kind)),
+            Ok(i) => Some(self.theme.token_style(&self.tokens[i])),
             Err(_) => None,
         }
     }
@@ -101,6 +442,84 @@ impl SyntaxHighlighter {
         &self.tokens[start_idx..end_idx]
     }
 
+    /// Get all cached tokens, e.g. to build a [`BracketMatcher`].
+    pub fn tokens(&self) -> &[Token] {
+        &self.tokens
+    }
+
+    /// Get the number of indentation guides for each line, see [`indent_guides`].
+    pub fn indent_guides(&self, text: &[u8]) -> Vec<usize> {
+        indent_guides(self.language, text, &self.tokens)
+    }
+
+    /// Determine how to indent a new line created at `offset`, see [`indent_hint`].
+    pub fn indent_hint(&self, text: &[u8], offset: usize) -> IndentHint {
+        indent_hint(self.language, text, &self.tokens, offset)
+    }
+
+    /// Decide whether typing `ch` at `offset` should also insert a closing character,
+    /// and return it. See [`should_auto_close`].
+    pub fn should_auto_close(&self, text: &[u8], offset: usize, ch: u8) -> Option<u8> {
+        let context = cursor_context(text, &self.tokens, offset);
+        let line_start = text[..offset].iter().rposition(|&b| b == b'\n').map_or(0, |i| i + 1);
+        should_auto_close(self.language, ch, context, &text[line_start..offset])
+    }
+
+    /// Comment or uncomment the lines in `selection`, see [`toggle_comments`].
+    pub fn toggle_comments(
+        &self,
+        text: &[u8],
+        selection: Range<usize>,
+    ) -> Option<(Vec<u8>, Range<usize>)> {
+        toggle_comments(self.language, text, &self.tokens, selection)
+    }
+
+    /// Get all occurrences of the word at `offset`, see [`occurrences`].
+    pub fn occurrences(
+        &self,
+        text: &[u8],
+        offset: usize,
+        options: OccurrenceOptions,
+    ) -> Vec<Range<usize>> {
+        occurrences(text, &self.tokens, offset, options)
+    }
+
+    /// Get the unclosed brackets, stray closers and unterminated constructs,
+    /// see [`balance_problems`].
+    pub fn balance_problems(&self, text: &[u8]) -> Vec<Problem> {
+        balance_problems(self.language, text, &self.tokens)
+    }
+
+    /// Get the bidirectional control characters, see [`bidi_problems`].
+    pub fn bidi_problems(&self, text: &[u8]) -> Vec<Problem> {
+        bidi_problems(text, &self.tokens)
+    }
+
+    /// Get the symbol outline, see [`outline`].
+    pub fn outline(&self, text: &[u8]) -> Vec<Symbol> {
+        outline(self.language, text, &self.tokens)
+    }
+
+    /// Get the scopes containing `offset`, outermost first, see [`ScopeIndex::enclosing`].
+    ///
+    /// The scopes are indexed on the first call after an [`update`](Self::update),
+    /// so that repeated calls while scrolling are cheap.
+    pub fn enclosing_scopes(&self, text: &[u8], offset: usize, blocks: bool) -> Vec<&Scope> {
+        self.scopes
+            .get_or_init(|| ScopeIndex::new(self.language, text, &self.tokens))
+            .enclosing(offset, blocks)
+    }
+
+    /// Get the ranges "expand selection" steps through from `offset`, see [`selection_ranges`].
+    pub fn selection_ranges(&self, text: &[u8], offset: usize) -> Vec<Range<usize>> {
+        selection_ranges(self.language, text, &self.tokens, offset)
+    }
+
+    /// Get the ranges of `text` worth spell checking, see [`spell_check_regions`].
+    pub fn spell_check_regions(&self, text: &[u8], split_identifiers: bool) -> Vec<Range<usize>> {
+        spell_check_regions(self.language, text, &self.tokens, split_identifiers)
+    }
+
     /// Get the theme.
     pub fn theme(&self) -> &Theme {
         &self.theme
@@ -109,12 +528,37 @@ impl SyntaxHighlighter {
     /// Set a new theme.
     pub fn set_theme(&mut self, theme: Theme) {
         self.theme = theme;
+        if self.options.rainbow_brackets {
+            // The depths are stored modulo the theme's cycle length.
+            self.mark_dirty(0..usize::MAX);
+        }
+    }
+
+    /// Get the post-processing options.
+    pub fn options(&self) -> &HighlightOptions {
+        &self.options
+    }
+
+    /// Set the post-processing options.
+    pub fn set_options(&mut self, options: HighlightOptions) {
+        if self.options != options {
+            self.options = options;
+            self.lexer = None;
+            self.mark_dirty(0..usize::MAX);
+        }
     }
 
     /// Get the current language.
     pub fn language(&self) -> Language {
         self.language
     }
+
+    /// Get the warnings about the options from the last [`update`](Self::update), like a
+    /// [`language_version`](HighlightOptions::language_version) the lexer doesn't know.
+    /// They don't keep the text from being highlighted.
+    pub fn warnings(&self) -> &[String] {
+        &self.warnings
+    }
 }
 
 #[cfg(test)]
@@ -125,10 +569,186 @@ mod tests {
     fn test_highlighter_basic() {
         let theme = Theme::default();
         let mut highlighter = SyntaxHighlighter::new(Language::Json, theme);
-        
+
         let text = b"{\"key\": \"value\"}";
         highlighter.update(text, false);
-        
+
         assert!(!highlighter.tokens.is_empty());
     }
+
+    #[test]
+    fn test_edits_match_fresh_highlighting() {
+        // Typing a file byte by byte passes through unterminated raw strings, char literals,
+        // dollar-quoted strings, comments and half-indented block scalars, whose tokens must
+        // end up the same as when highlighting from scratch.
+        let fixtures: [(Language, &[u8]); 3] = [
+            (Language::Rust, include_bytes!("../../../syntax-tests/test_syntax.rs")),
+            (Language::Sql, include_bytes!("../../../syntax-tests/test_syntax_postgres.sql")),
+            (
+                Language::Yaml,
+                include_bytes!("../../../syntax-tests/test_syntax_block_scalars.yaml"),
+            ),
+        ];
+        for (language, text) in fixtures {
+            let mut highlighter = SyntaxHighlighter::new(language, Theme::default());
+            highlighter.update(b"", true);
+            for len in 1..=text.len() {
+                highlighter.mark_dirty(len - 1..len);
+                highlighter.update(&text[..len], false);
+
+                let mut fresh = SyntaxHighlighter::new(language, Theme::default());
+                fresh.update(&text[..len], true);
+                assert_eq!(highlighter.tokens(), fresh.tokens(), "{language:?} after {len} bytes");
+            }
+        }
+    }
+
+    #[test]
+    fn test_edits_refilter_changed_lines() {
+        // Where the filters only need the lines whose tokens changed, the rest keep theirs
+        // from before, and they all end up the same as when highlighting from scratch.
+        let fixtures: [(Language, &[u8]); 5] = [
+            (Language::Sql, include_bytes!("../../../syntax-tests/test_syntax_postgres.sql")),
+            (Language::Css, include_bytes!("../../../syntax-tests/test_syntax.css")),
+            (Language::Markdown, include_bytes!("../../../syntax-tests/test_syntax.md")),
+            (Language::Html, include_bytes!("../../../syntax-tests/test_syntax.html")),
+            (Language::Toml, include_bytes!("../../../syntax-tests/test_syntax.toml")),
+        ];
+        let options = HighlightOptions {
+            links: true,
+            file_paths: true,
+            comment_keywords: DEFAULT_COMMENT_KEYWORDS.iter().map(|k| k.to_string()).collect(),
+            string_colors: true,
+            whitespace: true,
+            escapes: true,
+            ..Default::default()
+        };
+        let typed: [&[u8]; 12] = [
+            b"\"", b"'", b"/*", b"*/", b"{", b"}", b"\n", b"  ", b"<!--", b"-->", b"TODO: ",
+            b"\r\n",
+        ];
+        for (language, text) in fixtures {
+            let mut highlighter = SyntaxHighlighter::new(language, Theme::default());
+            highlighter.set_options(options.clone());
+            assert!(highlighter.streams(), "{language:?}");
+            let mut text = text.to_vec();
+            highlighter.update(&text, true);
+
+            let mut seed = 0x2545_F491u32;
+            let mut next = |n: usize| {
+                seed ^= seed << 13;
+                seed ^= seed >> 17;
+                seed ^= seed << 5;
+                seed as usize % n.max(1)
+            };
+            for i in 0..200 {
+                let pos = next(text.len() + 1);
+                if i % 2 == 0 {
+                    text.splice(pos..pos, typed[next(typed.len())].iter().copied());
+                } else {
+                    text.drain(pos..(pos + next(12)).min(text.len()));
+                }
+                highlighter.mark_dirty(pos..pos);
+                highlighter.update(&text, false);
+
+                let mut fresh = SyntaxHighlighter::new(language, Theme::default());
+                fresh.set_options(options.clone());
+                fresh.update(&text, true);
+                assert!(highlighter.tokens() == fresh.tokens(), "{language:?} after {i} edits");
+            }
+        }
+    }
+
+    #[test]
+    fn test_highlight_reader() {
+        // A file several sections long is highlighted like all of it at once, filters and
+        // all, with the `-- dialect:` at the top of SQL. Where the filters or the lexer need
+        // all of the text, it's read as a whole instead.
+        let fixtures: [(Language, &[u8]); 7] = [
+            (Language::C, include_bytes!("../../../syntax-tests/test_syntax_preprocessor.c")),
+            (Language::Go, include_bytes!("../../../syntax-tests/test_syntax.go")),
+            (Language::Python, include_bytes!("../../../syntax-tests/test_syntax.py")),
+            (Language::Sql, include_bytes!("../../../syntax-tests/test_syntax_postgres.sql")),
+            (Language::Css, include_bytes!("../../../syntax-tests/test_syntax.css")),
+            (Language::Markdown, include_bytes!("../../../syntax-tests/test_syntax.md")),
+            (Language::Html, include_bytes!("../../../syntax-tests/test_syntax.html")),
+        ];
+        let local = HighlightOptions {
+            links: true,
+            file_paths: true,
+            comment_keywords: DEFAULT_COMMENT_KEYWORDS.iter().map(|k| k.to_string()).collect(),
+            colors: true,
+            string_colors: true,
+            whitespace: true,
+            escapes: true,
+            inactive_code: true,
+            injections: true,
+            ..Default::default()
+        };
+        let all = HighlightOptions {
+            rainbow_brackets: true,
+            diagnostics: DiagnosticOptions { javascript_var: true, strict_json: true },
+            string_injections: vec![("Query".to_string(), Language::Sql)],
+            ..local.clone()
+        };
+        // The kind and payload of the token at each byte.
+        let at_bytes = |tokens: &[Token], offset: usize, bytes: &mut Vec<_>| {
+            for token in tokens {
+                bytes.extend(
+                    token.span.clone().map(|i| (offset + i, token.kind, token.payload.clone())),
+                );
+            }
+        };
+        for (language, text) in fixtures {
+            let text = text.repeat(3 * 64 * 1024 / text.len() + 1);
+            for options in [&local, &all] {
+                let mut highlighter = SyntaxHighlighter::new(language, Theme::default());
+                highlighter.set_options(options.clone());
+                let streams = !matches!(language, Language::C | Language::Go | Language::Python)
+                    && !(language == Language::Css && options.colors)
+                    && options == &local;
+                assert_eq!(highlighter.streams(), streams, "{language:?}");
+
+                highlighter.update(&text, true);
+                let mut expected = Vec::new();
+                at_bytes(highlighter.tokens(), 0, &mut expected);
+
+                let (mut streamed, mut offset) = (Vec::new(), 0);
+                let cancel = AtomicBool::new(false);
+                highlighter
+                    .highlight_reader(&text[..], &StreamOptions::default(), &cancel, |line| {
+                        at_bytes(line.tokens, offset, &mut streamed);
+                        offset += line.text.len();
+                        Ok(())
+                    })
+                    .unwrap();
+                assert!(streamed == expected, "{language:?} streams: {streams}");
+            }
+        }
+    }
+
+    #[test]
+    fn test_yaml_dedent_ends_block_scalar() {
+        let kinds = |highlighter: &SyntaxHighlighter, text: &[u8], word: &[u8]| -> Vec<TokenKind> {
+            let pos = text.windows(word.len()).position(|w| w == word).unwrap();
+            highlighter.tokens().iter().filter(|t| t.span.contains(&pos)).map(|t| t.kind).collect()
+        };
+        let before = b"run: |\n  make\n  name: tests\n\n  more\nnext: 1\n";
+        let mut highlighter = SyntaxHighlighter::new(Language::Yaml, Theme::default());
+        highlighter.update(before, true);
+        assert_eq!(kinds(&highlighter, before, b"name"), [TokenKind::String]);
+        assert_eq!(kinds(&highlighter, before, b"more"), [TokenKind::String]);
+
+        // Dedenting a line in the middle ends the scalar there, and the rest are keys again.
+        let after = b"run: |\n  make\nname: tests\n\n  more\nnext: 1\n";
+        highlighter.mark_dirty(14..16);
+        highlighter.update(after, false);
+        assert_eq!(kinds(&highlighter, after, b"make"), [TokenKind::String]);
+        assert_eq!(kinds(&highlighter, after, b"name"), [TokenKind::Identifier]);
+        assert_eq!(kinds(&highlighter, after, b"more"), [TokenKind::Identifier]);
+
+        let mut fresh = SyntaxHighlighter::new(Language::Yaml, Theme::default());
+        fresh.update(after, true);
+        assert_eq!(highlighter.tokens(), fresh.tokens());
+    }
 }
@@ -0,0 +1,164 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//! Auto-closing pairs and "surround selection with" pairs.
+//!
+//! The pairs are declared per language in [`GrammarMetadata`](crate::syntax::GrammarMetadata).
+//! Whether a pair is closed depends on the token kind at the cursor, which the
+//! highlighter already knows, and the text right before the cursor.
+
+use crate::syntax::{Language, Token, TokenKind};
+
+/// Decide whether typing `ch` should also insert its closing character, and return it.
+///
+/// `context` is the kind of token the cursor is in (see [`cursor_context`]) and `before`
+/// is the text before the cursor, of which only the end of the current line is looked at.
+/// A pair isn't closed if `context` is one of its `not_in` kinds or `before` ends with one of
+/// its `not_after` bytes. Quotes additionally aren't closed directly after a word, unless
+/// that word is one of the pair's string prefixes.
+pub fn should_auto_close(
+    language: Language,
+    ch: u8,
+    context: TokenKind,
+    before: &[u8],
+) -> Option<u8> {
+    let pair = language.metadata().auto_close.iter().find(|pair| pair.open == ch)?;
+    if pair.not_in.contains(&context) {
+        return None;
+    }
+    if before.last().is_some_and(|b| pair.not_after.contains(b)) {
+        return None;
+    }
+
+    if pair.open == pair.close {
+        let word_len = before.iter().rev().take_while(|&&b| is_word_byte(b)).count();
+        let word = &before[before.len() - word_len..];
+        if !word.is_empty()
+            && !pair.prefixes.iter().any(|p| p.as_bytes().eq_ignore_ascii_case(word))
+        {
+            return None;
+        }
+    }
+
+    Some(pair.close)
+}
+
+/// Returns the pair to surround a selection with when typing `ch`,
+/// which may be either the opening or the closing character of the pair.
+pub fn surround_pair(language: Language, ch: u8) -> Option<(u8, u8)> {
+    language.metadata().surround.iter().copied().find(|&(open, close)| open == ch || close == ch)
+}
+
+/// Returns the kind of token the cursor at `offset` is in, or [`TokenKind::Whitespace`].
+///
+/// A cursor right after a token is still in it if the token is left open, like a line
+/// comment at the end of a line or a string that's missing its closing quote.
+pub fn cursor_context(text: &[u8], tokens: &[Token], offset: usize) -> TokenKind {
+    let idx = tokens.partition_point(|t| t.span.end <= offset);
+    if let Some(token) = tokens.get(idx).filter(|t| t.span.start < offset) {
+        return token.kind;
+    }
+    match idx.checked_sub(1).map(|i| &tokens[i]) {
+        Some(token) if token.span.end == offset && is_open_ended(text, token) => token.kind,
+        _ => TokenKind::Whitespace,
+    }
+}
+
+fn is_open_ended(text: &[u8], token: &Token) -> bool {
+    let s = &text[token.span.clone()];
+    match token.kind {
+        TokenKind::Comment | TokenKind::DocComment => !s.ends_with(b"*/") && !s.ends_with(b"-->"),
+        TokenKind::String | TokenKind::DocString | TokenKind::Char => {
+            // Skip prefixes like `f"` or `@"`.
+            match s.iter().position(|&b| matches!(b, b'"' | b'\'' | b'`')) {
+                Some(quote) => s.len() == quote + 1 || s[s.len() - 1] != s[quote],
+                None => false,
+            }
+        }
+        _ => false,
+    }
+}
+
+fn is_word_byte(b: u8) -> bool {
+    b.is_ascii_alphanumeric() || b == b'_' || b >= 0x80
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::syntax::LexerRegistry;
+
+    /// Types `ch` at the end of `text`.
+    fn close(language: Language, text: &str, ch: char) -> Option<char> {
+        let tokens = LexerRegistry::get_lexer(language).tokenize(text.as_bytes());
+        let context = cursor_context(text.as_bytes(), &tokens, text.len());
+        should_auto_close(language, ch as u8, context, text.as_bytes()).map(char::from)
+    }
+
+    #[test]
+    fn test_auto_close_brackets() {
+        for &language in Language::ALL {
+            assert_eq!(close(language, "x = ", '('), Some(')'), "{language:?}");
+        }
+        // Brackets close in strings and comments, too.
+        assert_eq!(close(Language::Go, "s := \"a ", '['), Some(']'));
+        assert_eq!(close(Language::Go, "// a ", '{'), Some('}'));
+    }
+
+    #[test]
+    fn test_auto_close_quotes_in_context() {
+        assert_eq!(close(Language::Rust, "let s = ", '"'), Some('"'));
+        assert_eq!(close(Language::Rust, "let s = \"a ", '"'), None);
+        assert_eq!(close(Language::Rust, "// it", '\''), None);
+        assert_eq!(close(Language::Rust, "// say ", '\''), None);
+        assert_eq!(close(Language::Rust, "/* say */ f(", '\''), Some('\''));
+        assert_eq!(close(Language::Python, "s = \"it", '\''), None);
+        assert_eq!(close(Language::Yaml, "title: don", '\''), None);
+    }
+
+    #[test]
+    fn test_auto_close_rust_lifetimes() {
+        assert_eq!(close(Language::Rust, "let c = ", '\''), Some('\''));
+        assert_eq!(close(Language::Rust, "fn f(s: &", '\''), None);
+        assert_eq!(close(Language::Rust, "struct S<", '\''), None);
+        assert_eq!(close(Language::Rust, "let c = b", '\''), Some('\''));
+        assert_eq!(close(Language::Rust, "let s = br", '"'), Some('"'));
+        assert_eq!(close(Language::Rust, "let s = foo", '"'), None);
+    }
+
+    #[test]
+    fn test_auto_close_per_language() {
+        assert_eq!(close(Language::Go, "s := ", '`'), Some('`'));
+        assert_eq!(close(Language::JavaScript, "s = ", '`'), Some('`'));
+        assert_eq!(close(Language::Shell, "x=", '`'), None);
+        assert_eq!(close(Language::Markdown, "It", '\''), None);
+        assert_eq!(close(Language::Markdown, "Use ", '`'), Some('`'));
+        assert_eq!(close(Language::Json, "{", '\''), None);
+        assert_eq!(close(Language::Python, "s = f", '"'), Some('"'));
+        assert_eq!(close(Language::Python, "s = RB", '\''), Some('\''));
+        assert_eq!(close(Language::Cpp, "auto s = u8", '"'), Some('"'));
+        assert_eq!(close(Language::CSharp, "var s = $", '"'), Some('"'));
+        assert_eq!(close(Language::Go, "r := ", '\''), Some('\''));
+        assert_eq!(close(Language::Go, "r := 'a", '\''), None);
+    }
+
+    #[test]
+    fn test_cursor_context() {
+        let text = b"x := \"ab\" // c\n/* d */";
+        let tokens = LexerRegistry::get_lexer(Language::Go).tokenize(text);
+        assert_eq!(cursor_context(text, &tokens, 5), TokenKind::Whitespace);
+        assert_eq!(cursor_context(text, &tokens, 7), TokenKind::String);
+        assert_eq!(cursor_context(text, &tokens, 9), TokenKind::Whitespace);
+        assert_eq!(cursor_context(text, &tokens, 14), TokenKind::Comment);
+        assert_eq!(cursor_context(text, &tokens, text.len()), TokenKind::Whitespace);
+    }
+
+    #[test]
+    fn test_surround_pair() {
+        assert_eq!(surround_pair(Language::Rust, b')'), Some((b'(', b')')));
+        assert_eq!(surround_pair(Language::Go, b'`'), Some((b'`', b'`')));
+        assert_eq!(surround_pair(Language::Rust, b'`'), None);
+        assert_eq!(surround_pair(Language::Markdown, b'*'), Some((b'*', b'*')));
+        assert_eq!(surround_pair(Language::Html, b'<'), Some((b'<', b'>')));
+    }
+}
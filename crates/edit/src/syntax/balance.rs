@@ -0,0 +1,227 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//! Problems with the balance of a document's delimiters, for a problems panel.
+//!
+//! Unclosed and stray brackets come from the [`BracketMatcher`]. A string or comment
+//! that is still open when the document ends is the last token, since lexers let
+//! unterminated constructs run until the end of the text. The exceptions are `/* */`
+//! comments, which lexers cut short, see [`UNTERMINATED_COMMENT_LINES`].
+//!
+//! [`UNTERMINATED_COMMENT_LINES`]: crate::syntax::UNTERMINATED_COMMENT_LINES
+
+use std::ops::Range;
+
+use crate::syntax::{BracketMatcher, Language, Token, TokenKind, TokenPayload};
+
+/// What a [`Problem`] is about.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum ProblemKind {
+    /// An opening bracket or keyword without a closer.
+    UnclosedBracket,
+    /// A closing bracket or middle keyword without an opener.
+    StrayCloser,
+    /// A string or comment that runs until the end of the document.
+    Unterminated,
+    /// A bidirectional control character, see [`bidi_problems`](crate::syntax::bidi_problems).
+    BidiControl,
+    /// A bidirectional embedding, override or isolate which is never terminated.
+    UnterminatedBidiControl,
+}
+
+/// A problem with the balance of delimiters.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Problem {
+    pub kind: ProblemKind,
+    /// The offending delimiter, or for unterminated constructs where they start.
+    pub range: Range<usize>,
+    /// A description of the problem, e.g. "`{` is never closed".
+    pub message: String,
+}
+
+/// Find the unclosed brackets, stray closers and unterminated constructs in `tokens`,
+/// which must be the tokens of `text` in `language`. The problems are ordered by offset.
+pub fn balance_problems(language: Language, text: &[u8], tokens: &[Token]) -> Vec<Problem> {
+    let matcher = BracketMatcher::new(language, text, tokens);
+    let quoted = |range: &Range<usize>| String::from_utf8_lossy(&text[range.clone()]).into_owned();
+
+    let mut problems: Vec<Problem> = matcher
+        .unclosed()
+        .map(|range| Problem {
+            kind: ProblemKind::UnclosedBracket,
+            message: format!("`{}` is never closed", quoted(&range)),
+            range,
+        })
+        .chain(matcher.stray().map(|range| Problem {
+            kind: ProblemKind::StrayCloser,
+            message: format!("`{}` has no matching opener", quoted(&range)),
+            range,
+        }))
+        .collect();
+
+    if let Some((start, what)) = unterminated(text, tokens) {
+        problems.push(Problem {
+            kind: ProblemKind::Unterminated,
+            range: start..start,
+            message: format!("unterminated {what}"),
+        });
+    }
+
+    problems.sort_by_key(|p| p.range.start);
+    problems
+}
+
+/// Returns the start of the construct the document ends in and what it is,
+/// if it's an unterminated string or comment.
+fn unterminated(text: &[u8], tokens: &[Token]) -> Option<(usize, &'static str)> {
+    // Since no `*/` follows a comment that was cut short, it's the first one.
+    let cut = tokens.iter().find(|t| {
+        t.kind.is_comment()
+            && t.payload == Some(TokenPayload::Invalid)
+            && text[t.span.clone()].starts_with(b"/*")
+    });
+    if let Some(comment) = cut {
+        return Some((comment.span.start, "comment"));
+    }
+
+    let last = tokens.last().filter(|t| t.span.end == text.len() && !t.is_empty())?;
+    let s = &text[last.span.clone()];
+
+    match last.kind {
+        TokenKind::Comment => {
+            let open = (s.starts_with(b"/*") && (s.len() < 4 || !s.ends_with(b"*/")))
+                || (s.starts_with(b"<!--") && (s.len() < 7 || !s.ends_with(b"-->")));
+            open.then_some((last.span.start, "comment"))
+        }
+        TokenKind::String | TokenKind::DocString | TokenKind::Char => {
+            // Skip prefixes like `f"` or `@"`, and the `#` of Rust's raw strings (`r#"..."#`).
+            let q = s.iter().position(|&b| matches!(b, b'"' | b'\'' | b'`'))?;
+            let hashes = s[..q].iter().rev().take_while(|&&b| b == b'#').count();
+            let tail = s.iter().rev().take_while(|&&b| b == b'#').count();
+            let s = &s[..s.len() - hashes.min(tail)];
+            // Backslashes don't escape anything in raw strings like `r"\"`, `R"(\)"` or `@"\"`.
+            let raw = s[..q].iter().any(|&b| matches!(b, b'r' | b'R' | b'@'));
+            let quote = s[q];
+            let run = s[q..].iter().take_while(|&&b| b == quote).count();
+            // Two quotes are an empty string, three or more open a triple-quoted one.
+            let delimiter = if run == 2 { 1 } else { run.min(3) };
+            let body = &s[q + delimiter..];
+            let escaped = |body: &[u8]| {
+                let body = &body[..body.len() - delimiter];
+                !raw && body.iter().rev().take_while(|&&b| b == b'\\').count() % 2 == 1
+            };
+            let closed = body.len() >= delimiter
+                && hashes <= tail
+                && body.ends_with(&s[q..q + delimiter])
+                && !escaped(body);
+            let what = if last.kind == TokenKind::Char { "character literal" } else { "string" };
+            (!closed).then_some((last.span.start, what))
+        }
+        _ => None,
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::syntax::LexerRegistry;
+
+    fn problems(language: Language, text: &[u8]) -> Vec<Problem> {
+        let tokens = LexerRegistry::get_lexer(language).tokenize(text);
+        balance_problems(language, text, &tokens)
+    }
+
+    fn kinds(language: Language, text: &[u8]) -> Vec<(ProblemKind, usize)> {
+        problems(language, text).into_iter().map(|p| (p.kind, p.range.start)).collect()
+    }
+
+    #[test]
+    fn test_brackets() {
+        use ProblemKind::{StrayCloser, UnclosedBracket};
+
+        assert_eq!(
+            kinds(Language::Go, b"func f() {\n\tx := []int{1, 2}\n"),
+            [(UnclosedBracket, 9)]
+        );
+        assert_eq!(kinds(Language::Go, b"f(x))"), [(StrayCloser, 4)]);
+        assert_eq!(kinds(Language::Go, b"{ f(x }"), [(UnclosedBracket, 3)]);
+        assert_eq!(kinds(Language::Shell, b"if true; then\n  echo\n"), [(UnclosedBracket, 0)]);
+        assert_eq!(kinds(Language::Shell, b"echo\nfi\n"), [(StrayCloser, 5)]);
+
+        let found = problems(Language::Go, b"{ f(x }");
+        assert_eq!(found[0].message, "`(` is never closed");
+    }
+
+    #[test]
+    fn test_unterminated() {
+        use ProblemKind::Unterminated;
+
+        assert_eq!(kinds(Language::C, b"int x; /* never closed\n"), [(Unterminated, 7)]);
+        assert_eq!(kinds(Language::C, b"int x; /**/"), []);
+        // The comment is cut short, but still reported where it starts.
+        assert_eq!(kinds(Language::Go, b"/* open\nx := 1\n"), [(Unterminated, 0)]);
+        assert_eq!(kinds(Language::Go, b"/* doc\nfunc f() {}\n"), [(Unterminated, 0)]);
+        assert_eq!(kinds(Language::Go, b"s := \"abc"), [(Unterminated, 5)]);
+        assert_eq!(kinds(Language::Go, b"s := \"abc\\\""), [(Unterminated, 5)]);
+        assert_eq!(kinds(Language::Go, b"s := \"abc\\\\\""), []);
+        assert_eq!(kinds(Language::Go, b"s := \"\""), []);
+        assert_eq!(kinds(Language::Go, b"s := `raw\n"), [(Unterminated, 5)]);
+        assert_eq!(kinds(Language::Python, b"x = \"\"\"doc\n\"\""), [(Unterminated, 4)]);
+        assert_eq!(kinds(Language::Python, b"x = \"\"\"doc\n\"\"\""), []);
+        assert_eq!(kinds(Language::Html, b"<p>text</p>\n<!-- todo"), [(Unterminated, 12)]);
+        assert_eq!(kinds(Language::Rust, br##"let s = r#"a "b" c\"#"##), []);
+        assert_eq!(kinds(Language::Rust, br##"let s = r#"a "b" c""##), [(Unterminated, 8)]);
+        assert_eq!(kinds(Language::Cpp, br#"auto s = R"x(a)" \b)x""#), []);
+        assert_eq!(kinds(Language::Cpp, br#"auto s = R"x(a)" b)"#), [(Unterminated, 9)]);
+
+        let found = problems(Language::Go, b"s := \"abc");
+        assert_eq!(found[0].message, "unterminated string");
+    }
+
+    /// Deleting a single delimiter from a balanced fixture must produce exactly one problem.
+    #[test]
+    fn test_deleted_delimiters() {
+        let fixtures: &[(Language, &[u8])] = &[
+            (Language::Go, include_bytes!("../../../../syntax-tests/test_syntax.go")),
+            (Language::Rust, include_bytes!("../../../../syntax-tests/test_syntax.rs")),
+            (Language::JavaScript, include_bytes!("../../../../syntax-tests/test_syntax.js")),
+            (Language::C, include_bytes!("../../../../syntax-tests/test_syntax.c")),
+        ];
+
+        for &(language, text) in fixtures {
+            assert_eq!(problems(language, text), [], "{language:?}");
+
+            let tokens = LexerRegistry::get_lexer(language).tokenize(text);
+            let matcher = BracketMatcher::new(language, text, &tokens);
+            for pair in matcher.all_pairs() {
+                let mut mutated = text.to_vec();
+                mutated.drain(pair.close.clone());
+                let found = problems(language, &mutated);
+                assert!(
+                    found.len() == 1 && found[0].kind == ProblemKind::UnclosedBracket,
+                    "{language:?}: deleting the closer at {:?} found {found:?}",
+                    pair.close
+                );
+            }
+        }
+
+        // Cutting a document off inside a string or comment leaves it unterminated.
+        let text = include_bytes!("../../../../syntax-tests/test_syntax.go");
+        let tokens = LexerRegistry::get_lexer(Language::Go).tokenize(text);
+        // Directive arguments like the command of `//go:generate` are strings without quotes,
+        // and the values of struct tags like `json:"name"` end inside the tag's raw string.
+        let quoted = |t: &&Token| {
+            t.kind == TokenKind::String
+                && t.len() > 2
+                && matches!(text[t.span.start], b'"' | b'`')
+                && text[t.span.start - 1] != b':'
+        };
+        for token in tokens.iter().filter(quoted) {
+            let found = problems(Language::Go, &text[..token.span.end - 1]);
+            let unterminated: Vec<_> =
+                found.iter().filter(|p| p.kind == ProblemKind::Unterminated).collect();
+            assert_eq!(unterminated.len(), 1, "{found:?}");
+            assert_eq!(unterminated[0].range.start, token.span.start);
+        }
+    }
+}
@@ -0,0 +1,297 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//! Highlighting many files at once, like all of a repository for a code search index.
+//!
+//! The files are spread over a pool of threads. Lexers don't keep state between
+//! documents, so the workers share them, and each has a [`SyntaxHighlighter`] of its own.
+
+use std::panic::{self, AssertUnwindSafe};
+use std::path::PathBuf;
+use std::sync::Mutex;
+use std::sync::atomic::{AtomicBool, AtomicUsize, Ordering};
+use std::{fmt, io, thread};
+
+use crate::syntax::{
+    HighlightOptions, Language, SyntaxHighlighter, Theme, Token, detect_language, transcode,
+};
+
+/// A file for [`highlight_all`].
+#[derive(Debug, Clone, Default)]
+pub struct FileInput {
+    /// The path, whose extension is the language's, if it has one of ours.
+    pub path: PathBuf,
+    /// The text, if it's already been read. Otherwise, it's read from `path`.
+    pub text: Option<Vec<u8>>,
+    /// The language, if it's already known. Otherwise, it's detected.
+    pub language: Option<Language>,
+    /// The options for this file, like a SQL dialect by its extension,
+    /// instead of the ones for all files.
+    pub options: Option<HighlightOptions>,
+}
+
+/// A file that [`highlight_all`] highlighted.
+#[derive(Debug, Clone)]
+pub struct FileResult {
+    /// The index of the file in the input.
+    pub index: usize,
+    /// The language, by the file name or else by the content, see [`detect_language`].
+    pub language: Language,
+    /// The text, transcoded to UTF-8 like [`transcode`] does.
+    pub text: Vec<u8>,
+    /// The tokens, in the order of the text, like [`SyntaxHighlighter::tokens`].
+    pub tokens: Vec<Token>,
+    /// What was wrong with the options, like [`SyntaxHighlighter::warnings`].
+    pub warnings: Vec<String>,
+}
+
+/// A file that [`highlight_all`] couldn't highlight.
+#[derive(Debug)]
+pub struct FileError {
+    /// The index of the file in the input.
+    pub index: usize,
+    pub path: PathBuf,
+    pub error: io::Error,
+}
+
+/// The files that [`highlight_all`] couldn't highlight, by their index.
+#[derive(Debug, Default)]
+pub struct HighlightAllError {
+    pub files: Vec<FileError>,
+    /// Whether it stopped early because it was cancelled.
+    pub cancelled: bool,
+}
+
+impl fmt::Display for HighlightAllError {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        if self.cancelled {
+            write!(f, "highlighting was cancelled")?;
+            if !self.files.is_empty() {
+                write!(f, ", and ")?;
+            }
+        }
+        match &self.files[..] {
+            [] => Ok(()),
+            [file] => write!(f, "{}: {}", file.path.display(), file.error),
+            files => {
+                write!(f, "{} files couldn't be highlighted", files.len())?;
+                for file in files {
+                    write!(f, "\n{}: {}", file.path.display(), file.error)?;
+                }
+                Ok(())
+            }
+        }
+    }
+}
+
+impl std::error::Error for HighlightAllError {}
+
+/// Highlight `files` on `workers` threads, or as many as there are cores if 0, and pass
+/// each to `sink` on the thread that highlighted it, as soon as it's done.
+///
+/// A file that can't be read, or whose lexer panics, doesn't stop the others: they're
+/// all returned together once the rest are done. Once `cancel` is set, no more files
+/// are started, and the error says so.
+pub fn highlight_all(
+    files: &[FileInput],
+    workers: usize,
+    theme: &Theme,
+    options: &HighlightOptions,
+    cancel: &AtomicBool,
+    sink: impl Fn(FileResult) + Sync,
+) -> Result<(), HighlightAllError> {
+    let workers = match workers {
+        0 => thread::available_parallelism().map_or(1, |n| n.get()),
+        n => n,
+    };
+    // Each worker takes the next file until there are none left.
+    let next = AtomicUsize::new(0);
+    let errors = Mutex::new(Vec::new());
+
+    thread::scope(|scope| {
+        for _ in 0..workers.min(files.len()) {
+            scope.spawn(|| {
+                while !cancel.load(Ordering::Relaxed) {
+                    let index = next.fetch_add(1, Ordering::Relaxed);
+                    let Some(file) = files.get(index) else { break };
+                    match highlight_file(file, index, theme, options) {
+                        Ok(result) => sink(result),
+                        Err(error) => {
+                            let path = file.path.clone();
+                            errors.lock().unwrap().push(FileError { index, path, error });
+                        }
+                    }
+                }
+            });
+        }
+    });
+
+    // Whether there are files left that no worker started.
+    let cancelled = next.load(Ordering::Relaxed) < files.len();
+    let mut files = errors.into_inner().unwrap();
+    files.sort_by_key(|file| file.index);
+    if files.is_empty() && !cancelled {
+        Ok(())
+    } else {
+        Err(HighlightAllError { files, cancelled })
+    }
+}
+
+fn highlight_file(
+    file: &FileInput,
+    index: usize,
+    theme: &Theme,
+    options: &HighlightOptions,
+) -> io::Result<FileResult> {
+    let text = match &file.text {
+        Some(text) => transcode(text).text,
+        None => transcode(&std::fs::read(&file.path)?).text,
+    };
+    let language = file.language.unwrap_or_else(|| {
+        let name = file.path.file_name().and_then(|name| name.to_str()).unwrap_or_default();
+        detect_language(name, &text).language
+    });
+    let options = file.options.as_ref().unwrap_or(options);
+
+    let (tokens, warnings) = panic::catch_unwind(AssertUnwindSafe(|| {
+        let mut highlighter = SyntaxHighlighter::new(language, theme.clone());
+        highlighter.set_options(options.clone());
+        highlighter.update(&text, true);
+        (highlighter.tokens().to_vec(), highlighter.warnings().to_vec())
+    }))
+    .map_err(|_| io::Error::other(format!("the {} lexer panicked", language.name())))?;
+    Ok(FileResult { index, language, text, tokens, warnings })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn corpus() -> Vec<FileInput> {
+        let dir = concat!(env!("CARGO_MANIFEST_DIR"), "/../../syntax-tests");
+        let mut files: Vec<_> = std::fs::read_dir(dir)
+            .unwrap()
+            .map(|entry| FileInput { path: entry.unwrap().path(), ..Default::default() })
+            .collect();
+        files.sort_by(|a, b| a.path.cmp(&b.path));
+        files
+    }
+
+    #[test]
+    fn test_workers() {
+        // Eight workers give the same tokens as highlighting one file after another.
+        let files = corpus();
+        let theme = Theme::default();
+        let options = HighlightOptions { rainbow_brackets: true, ..Default::default() };
+        let results = Mutex::new(Vec::new());
+        highlight_all(&files, 8, &theme, &options, &AtomicBool::new(false), |result| {
+            results.lock().unwrap().push(result)
+        })
+        .unwrap();
+
+        let mut results = results.into_inner().unwrap();
+        results.sort_by_key(|result| result.index);
+        assert_eq!(results.len(), files.len());
+        for (file, result) in files.iter().zip(&results) {
+            let text = transcode(&std::fs::read(&file.path).unwrap()).text;
+            let name = file.path.file_name().unwrap().to_str().unwrap();
+            let language = detect_language(name, &text).language;
+            let mut highlighter = SyntaxHighlighter::new(language, theme.clone());
+            highlighter.set_options(options.clone());
+            highlighter.update(&text, true);
+            assert_eq!(result.language, language);
+            assert_eq!(result.text, text);
+            assert!(result.tokens == highlighter.tokens(), "{}", file.path.display());
+        }
+    }
+
+    #[test]
+    fn test_errors() {
+        let mut files = corpus();
+        files.truncate(3);
+        files.insert(1, FileInput { path: "missing.go".into(), ..Default::default() });
+        files.push(FileInput {
+            path: "in-memory".into(),
+            text: Some(b"#!/bin/sh\necho".to_vec()),
+            ..Default::default()
+        });
+        files.push(FileInput { path: "missing.rs".into(), ..Default::default() });
+
+        // The files that can't be read don't stop the others.
+        let done = Mutex::new(Vec::new());
+        let err = highlight_all(
+            &files,
+            2,
+            &Theme::default(),
+            &HighlightOptions::default(),
+            &AtomicBool::new(false),
+            |result| done.lock().unwrap().push((result.index, result.language)),
+        )
+        .unwrap_err();
+        let mut done = done.into_inner().unwrap();
+        done.sort_by_key(|&(i, _)| i);
+        assert_eq!(done.iter().map(|&(i, _)| i).collect::<Vec<_>>(), [0, 2, 3, 4]);
+        assert_eq!(done[3].1, Language::Shell);
+        assert!(!err.cancelled);
+        assert_eq!(err.files.iter().map(|f| f.index).collect::<Vec<_>>(), [1, 5]);
+        assert_eq!(err.files[0].error.kind(), io::ErrorKind::NotFound);
+        assert!(err.to_string().starts_with("2 files couldn't be highlighted\nmissing.go: "));
+
+        // Cancelling stops the workers before their next file.
+        let cancel = AtomicBool::new(false);
+        let count = AtomicUsize::new(0);
+        let files = corpus();
+        let err = highlight_all(
+            &files,
+            1,
+            &Theme::default(),
+            &HighlightOptions::default(),
+            &cancel,
+            |_| {
+                count.fetch_add(1, Ordering::Relaxed);
+                cancel.store(true, Ordering::Relaxed);
+            },
+        )
+        .unwrap_err();
+        assert!(err.cancelled && err.files.is_empty());
+        assert_eq!(count.into_inner(), 1);
+        assert_eq!(err.to_string(), "highlighting was cancelled");
+    }
+
+    #[test]
+    fn test_overrides() {
+        // The language and options of a file win, and the text is transcoded first.
+        let mut utf16 = vec![0xFF, 0xFE];
+        utf16.extend("package main".encode_utf16().flat_map(u16::to_le_bytes));
+        let go = HighlightOptions { language_version: Some("banana".into()), ..Default::default() };
+        let files = [
+            FileInput { path: "main.txt".into(), text: Some(utf16), ..Default::default() },
+            FileInput {
+                path: "main.txt".into(),
+                text: Some(b"package main".to_vec()),
+                language: Some(Language::Go),
+                options: Some(go),
+            },
+        ];
+        let results = Mutex::new(Vec::new());
+        highlight_all(
+            &files,
+            2,
+            &Theme::default(),
+            &HighlightOptions::default(),
+            &AtomicBool::new(false),
+            |result| results.lock().unwrap().push(result),
+        )
+        .unwrap();
+
+        let mut results = results.into_inner().unwrap();
+        results.sort_by_key(|result| result.index);
+        assert_eq!(results[0].language, Language::PlainText);
+        assert_eq!(results[0].text, b"package main");
+        assert!(results[0].warnings.is_empty());
+        assert_eq!(results[1].language, Language::Go);
+        assert_eq!(results[1].tokens[0].kind, crate::syntax::TokenKind::Keyword);
+        assert_eq!(results[1].warnings.len(), 1);
+        assert!(results[1].warnings[0].starts_with("unknown Go version 'banana'"));
+    }
+}
@@ -0,0 +1,265 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//! Bidirectional control characters, as used in "Trojan Source" attacks.
+//!
+//! The embedding, override and isolate controls (U+202A..=U+202E and U+2066..=U+2069)
+//! are invisible, but reorder the text around them. Inside a string or comment they
+//! can make code render differently from how it compiles. [`flag_bidi_controls`] splits
+//! each of them into a token of its own, so that the theme can make them visible.
+//! Right-to-left text without controls, like Hebrew or Arabic strings, isn't affected.
+
+use std::ops::Range;
+
+use crate::syntax::{Problem, ProblemKind, Token, TokenPayload};
+
+/// Whether `ch` is a bidirectional embedding, override or isolate control
+/// (including the ones which terminate them).
+pub fn is_bidi_control(ch: char) -> bool {
+    matches!(ch, '\u{202A}'..='\u{202E}' | '\u{2066}'..='\u{2069}')
+}
+
+/// Split every bidirectional control out of the token it's in and attach a
+/// [`TokenPayload::BidiControl`] to it. The rest of the token keeps its kind and payload.
+///
+/// An embedding, override or isolate is unterminated if the token or line ends before
+/// its terminator, and then reorders the code that follows.
+pub fn flag_bidi_controls(text: &[u8], tokens: &mut Vec<Token>) {
+    let mut result: Option<Vec<Token>> = None;
+
+    for (i, token) in tokens.iter().enumerate() {
+        let controls = find_controls(text, token.span.clone());
+        if controls.is_empty() {
+            if let Some(result) = &mut result {
+                result.push(token.clone());
+            }
+            continue;
+        }
+
+        // Only copy the token stream once the first control shows up.
+        let result = result.get_or_insert_with(|| {
+            let mut v = Vec::with_capacity(tokens.len() + 2 * controls.len());
+            v.extend_from_slice(&tokens[..i]);
+            v
+        });
+        let rest = |range: Range<usize>| Token { span: range, ..token.clone() };
+        let mut pos = token.span.start;
+        for (range, unterminated) in controls {
+            if pos < range.start {
+                result.push(rest(pos..range.start));
+            }
+            pos = range.end;
+            let payload = TokenPayload::BidiControl { unterminated };
+            result.push(rest(range).with_payload(payload));
+        }
+        if pos < token.span.end {
+            result.push(rest(pos..token.span.end));
+        }
+    }
+
+    if let Some(result) = result {
+        *tokens = result;
+    }
+}
+
+/// Summarize the bidirectional controls in `tokens`, which [`flag_bidi_controls`]
+/// must have run on, as problems for hosts that warn about them.
+pub fn bidi_problems(text: &[u8], tokens: &[Token]) -> Vec<Problem> {
+    tokens
+        .iter()
+        .filter_map(|token| {
+            let Some(TokenPayload::BidiControl { unterminated }) = token.payload else {
+                return None;
+            };
+            let ch = str::from_utf8(&text[token.span.clone()]).ok()?.chars().next()?;
+            let (kind, message) = if unterminated {
+                (
+                    ProblemKind::UnterminatedBidiControl,
+                    format!("unterminated {}, which reorders the code after it", name(ch)),
+                )
+            } else {
+                (ProblemKind::BidiControl, format!("invisible {}", name(ch)))
+            };
+            Some(Problem { kind, range: token.span.clone(), message })
+        })
+        .collect()
+}
+
+/// Find the controls in `range` and whether each of them is unterminated.
+///
+/// This follows the Unicode Bidirectional Algorithm: a PDF terminates the innermost
+/// embedding or override unless an isolate was opened after it, and a PDI terminates
+/// the innermost isolate along with everything opened inside of it.
+fn find_controls(text: &[u8], range: Range<usize>) -> Vec<(Range<usize>, bool)> {
+    // Controls are encoded as E2 80 AA..=AE and E2 81 A6..=A9.
+    if !text[range.clone()].contains(&0xE2) {
+        return Vec::new();
+    }
+    let Ok(s) = str::from_utf8(&text[range.clone()]) else {
+        return Vec::new();
+    };
+
+    let mut controls = Vec::new();
+    // The indices into `controls` of the open embeddings, overrides and isolates.
+    let mut open: Vec<usize> = Vec::new();
+    // The end of a token or line terminates everything that's still open.
+    let close_all = |controls: &mut Vec<(Range<usize>, bool)>, open: &mut Vec<usize>| {
+        for i in open.drain(..) {
+            controls[i].1 = true;
+        }
+    };
+
+    for (i, ch) in s.char_indices() {
+        let start = range.start + i;
+        match ch {
+            '\n' | '\r' | '\u{2029}' => close_all(&mut controls, &mut open),
+            '\u{202A}' | '\u{202B}' | '\u{202D}' | '\u{202E}' | '\u{2066}'..='\u{2068}' => {
+                open.push(controls.len());
+                controls.push((start..start + ch.len_utf8(), false));
+            }
+            // PDF
+            '\u{202C}' => {
+                if let Some(&last) = open.last()
+                    && !is_isolate(text, &controls[last].0)
+                {
+                    open.pop();
+                }
+                controls.push((start..start + ch.len_utf8(), false));
+            }
+            // PDI
+            '\u{2069}' => {
+                if let Some(n) = open.iter().rposition(|&o| is_isolate(text, &controls[o].0)) {
+                    open.truncate(n);
+                }
+                controls.push((start..start + ch.len_utf8(), false));
+            }
+            _ => {}
+        }
+    }
+
+    close_all(&mut controls, &mut open);
+    controls
+}
+
+fn is_isolate(text: &[u8], range: &Range<usize>) -> bool {
+    matches!(&text[range.clone()], [0xE2, 0x81, 0xA6..=0xA8])
+}
+
+fn name(ch: char) -> &'static str {
+    match ch {
+        '\u{202A}' => "left-to-right embedding (U+202A)",
+        '\u{202B}' => "right-to-left embedding (U+202B)",
+        '\u{202C}' => "pop directional formatting (U+202C)",
+        '\u{202D}' => "left-to-right override (U+202D)",
+        '\u{202E}' => "right-to-left override (U+202E)",
+        '\u{2066}' => "left-to-right isolate (U+2066)",
+        '\u{2067}' => "right-to-left isolate (U+2067)",
+        '\u{2068}' => "first strong isolate (U+2068)",
+        '\u{2069}' => "pop directional isolate (U+2069)",
+        _ => "bidirectional control",
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::syntax::{Language, LexerRegistry, TokenKind};
+
+    /// Returns the flagged controls as `(kind of the token, code point, unterminated)`.
+    fn flagged(language: Language, text: &str) -> Vec<(TokenKind, char, bool)> {
+        let mut tokens = LexerRegistry::get_lexer(language).tokenize(text.as_bytes());
+        flag_bidi_controls(text.as_bytes(), &mut tokens);
+
+        // The tokens still cover the text without gaps.
+        assert!(tokens.windows(2).all(|w| w[0].span.end == w[1].span.start));
+        assert_eq!(tokens.last().map(|t| t.span.end), Some(text.len()));
+
+        tokens
+            .iter()
+            .filter_map(|t| match t.payload {
+                Some(TokenPayload::BidiControl { unterminated }) => {
+                    Some((t.kind, text[t.span.clone()].chars().next()?, unterminated))
+                }
+                _ => None,
+            })
+            .collect()
+    }
+
+    #[test]
+    fn test_stretched_string() {
+        // Renders as `if accessLevel != "user" { // Check if admin`.
+        let text =
+            "if accessLevel != \"user\u{202E} \u{2066}// Check if admin\u{2069} \u{2066}\" {\n";
+        assert_eq!(
+            flagged(Language::Go, text),
+            [
+                (TokenKind::String, '\u{202E}', true),
+                (TokenKind::String, '\u{2066}', false),
+                (TokenKind::String, '\u{2069}', false),
+                (TokenKind::String, '\u{2066}', true),
+            ]
+        );
+    }
+
+    #[test]
+    fn test_commenting_out() {
+        // Renders as `/* begin admins only */ if (isAdmin) {`.
+        let text = "/*\u{202E} } \u{2066}if (isAdmin)\u{2069} \u{2066} begin admins only */\n\
+                    console.log(\"You are an admin.\");\n";
+        let flags = flagged(Language::JavaScript, text);
+        assert_eq!(flags.len(), 4);
+        assert!(flags.iter().all(|&(kind, ..)| kind == TokenKind::Comment));
+        assert_eq!(flags.iter().filter(|&&(.., unterminated)| unterminated).count(), 2);
+
+        // The early return variant spreads the controls over a comment and a string.
+        let text = "var accessLevel = \"user\";\n\
+                    if (accessLevel != \"user\u{202E} \u{2066}// Check if admin\u{2069} \u{2066}\") {\n\
+                    /*\u{202E} return \u{2066}*/ x = 1;\n";
+        let flags = flagged(Language::JavaScript, text);
+        assert_eq!(flags.len(), 6);
+        assert_eq!(flags[4], (TokenKind::Comment, '\u{202E}', true));
+    }
+
+    #[test]
+    fn test_legitimate_bidi_text() {
+        // Right-to-left text without controls isn't flagged.
+        assert_eq!(flagged(Language::Go, "s := \"שלום עולם\" // مرحبا\n"), []);
+
+        // Terminated controls are flagged, but not as unterminated.
+        let text = "s := \"\u{202B}שלום\u{202C} \u{2067}עולם\u{2069}\"\n";
+        assert!(flagged(Language::Go, text).iter().all(|&(.., unterminated)| !unterminated));
+        // A PDF doesn't terminate an embedding from outside of an isolate.
+        let text = "s := \"\u{202B}\u{2067}a\u{202C}\u{2069}\"\n";
+        let flags = flagged(Language::Go, text);
+        assert_eq!(flags.iter().map(|f| f.2).collect::<Vec<_>>(), [true, false, false, false]);
+
+        let fixture = include_bytes!("../../../../syntax-tests/test_syntax.go");
+        let mut tokens = LexerRegistry::get_lexer(Language::Go).tokenize(fixture);
+        let before = tokens.clone();
+        flag_bidi_controls(fixture, &mut tokens);
+        assert_eq!(tokens, before);
+    }
+
+    #[test]
+    fn test_bidi_problems() {
+        let text = "s := \"a\u{202E}b\" + \"\u{202A}c\u{202C}\"\n";
+        let mut tokens = LexerRegistry::get_lexer(Language::Go).tokenize(text.as_bytes());
+        flag_bidi_controls(text.as_bytes(), &mut tokens);
+        let problems = bidi_problems(text.as_bytes(), &tokens);
+
+        let kinds: Vec<_> = problems.iter().map(|p| p.kind).collect();
+        assert_eq!(
+            kinds,
+            [
+                ProblemKind::UnterminatedBidiControl,
+                ProblemKind::BidiControl,
+                ProblemKind::BidiControl
+            ]
+        );
+        assert_eq!(&text[problems[0].range.clone()], "\u{202E}");
+        assert_eq!(
+            problems[0].message,
+            "unterminated right-to-left override (U+202E), which reorders the code after it"
+        );
+    }
+}
@@ -0,0 +1,417 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//! Bracket pair matching on top of the token stream.
+//!
+//! Brackets are taken from the lexer's tokens rather than the raw text, which means
+//! that a `(` inside of a string, comment or character literal is never mistaken
+//! for a real one. The pairs themselves come from [`GrammarMetadata::brackets`].
+//!
+//! Languages which delimit blocks with keywords (`if ... fi`) declare them in
+//! [`GrammarMetadata::keyword_pairs`]. These are treated just like brackets, except that
+//! they may have middle keywords (`else`), and only keyword tokens count, so `$done` or
+//! `echo "fi"` never match.
+
+use std::ops::Range;
+
+use crate::syntax::{GrammarMetadata, Language, Token, TokenKind, TokenPayload};
+
+/// A matched pair of brackets.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct BracketPair {
+    /// The range of the opening bracket.
+    pub open: Range<usize>,
+    /// The range of the closing bracket.
+    pub close: Range<usize>,
+    /// The ranges of the middle keywords of a keyword pair, e.g. `else`.
+    pub middle: Vec<Range<usize>>,
+    /// The nesting depth of the pair, starting at 0 for the outermost pairs.
+    pub depth: usize,
+}
+
+/// The result of [`BracketMatcher::match_at`].
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum BracketMatch {
+    /// The bracket has a partner at the given range.
+    Matched(Range<usize>),
+    /// The bracket has no partner.
+    Unbalanced,
+}
+
+#[derive(Debug, Clone)]
+struct Bracket {
+    span: Range<usize>,
+    /// Whether this is an opening bracket, as opposed to a closing or middle one.
+    open: bool,
+    /// Whether this is a closing bracket or middle keyword that no opener was found for.
+    stray: bool,
+    /// Where [`BracketMatcher::match_at`] jumps to. For keyword pairs with middle keywords
+    /// this cycles through them: `if` -> `else` -> `fi` -> `if`.
+    partner: Option<usize>,
+}
+
+/// The role of a bracket token. Pairs are identified by their closing byte,
+/// keyword pairs by 256 + their index in [`GrammarMetadata::keyword_pairs`].
+#[derive(Debug, Clone, Copy)]
+enum Delimiter {
+    Open(usize),
+    Middle(usize),
+    Close(usize),
+}
+
+struct Open {
+    idx: usize,
+    pair: usize,
+    middle: Vec<usize>,
+}
+
+/// Indexes all brackets in a document and answers which ones belong together.
+#[derive(Debug, Clone, Default)]
+pub struct BracketMatcher {
+    /// All brackets in document order.
+    brackets: Vec<Bracket>,
+    /// All matched pairs, ordered by their opening bracket.
+    pairs: Vec<BracketPair>,
+}
+
+impl BracketMatcher {
+    /// Index the brackets in `tokens`, which must be the tokens of `text` in `language`.
+    pub fn new(language: Language, text: &[u8], tokens: &[Token]) -> Self {
+        let metadata = language.metadata();
+        let mut brackets: Vec<Bracket> = Vec::new();
+        let mut pairs = Vec::new();
+        // The currently open brackets, innermost last.
+        let mut stack: Vec<Open> = Vec::new();
+
+        for token in tokens {
+            let Some(delimiter) = delimiter(metadata, text, token) else {
+                continue;
+            };
+            let idx = brackets.len();
+            brackets.push(Bracket {
+                span: token.span.clone(),
+                open: matches!(delimiter, Delimiter::Open(_)),
+                stray: false,
+                partner: None,
+            });
+
+            // A closer that doesn't match the innermost opener closes the nearest
+            // opener it does match, leaving everything in between unbalanced.
+            // If there's no such opener the closer itself is unbalanced.
+            // The same goes for middle keywords.
+            let (pair, close) = match delimiter {
+                Delimiter::Open(pair) => {
+                    stack.push(Open { idx, pair, middle: Vec::new() });
+                    continue;
+                }
+                Delimiter::Middle(pair) => (pair, false),
+                Delimiter::Close(pair) => (pair, true),
+            };
+            let Some(pos) = stack.iter().rposition(|open| open.pair == pair) else {
+                brackets[idx].stray = true;
+                continue;
+            };
+            stack.truncate(pos + 1);
+            if !close {
+                stack[pos].middle.push(idx);
+                continue;
+            }
+
+            let open = stack.pop().unwrap();
+            let mut prev = open.idx;
+            for &next in open.middle.iter().chain([&idx]) {
+                brackets[prev].partner = Some(next);
+                prev = next;
+            }
+            brackets[idx].partner = Some(open.idx);
+            pairs.push(BracketPair {
+                open: brackets[open.idx].span.clone(),
+                close: token.span.clone(),
+                middle: open.middle.iter().map(|&i| brackets[i].span.clone()).collect(),
+                depth: stack.len(),
+            });
+        }
+
+        pairs.sort_unstable_by_key(|pair| pair.open.start);
+        Self { brackets, pairs }
+    }
+
+    /// Find the partner of the bracket at `offset`.
+    ///
+    /// The partner of a keyword with middle keywords is the next keyword of its pair,
+    /// so that jumping repeatedly cycles through `if`, `elif`, `else` and `fi`.
+    ///
+    /// A bracket is "at" an offset if it either contains it or ends right before it,
+    /// so that both sides of a cursor are considered. The former takes precedence.
+    /// Returns `None` if there's no bracket at `offset`.
+    pub fn match_at(&self, offset: usize) -> Option<BracketMatch> {
+        let idx = self.brackets.partition_point(|b| b.span.end <= offset);
+        let bracket = self
+            .brackets
+            .get(idx)
+            .filter(|b| b.span.start <= offset)
+            .or_else(|| self.brackets[..idx].last().filter(|b| b.span.end == offset))?;
+
+        Some(match bracket.partner {
+            Some(partner) => BracketMatch::Matched(self.brackets[partner].span.clone()),
+            None => BracketMatch::Unbalanced,
+        })
+    }
+
+    /// All matched pairs, ordered by the position of their opening bracket.
+    pub fn all_pairs(&self) -> &[BracketPair] {
+        &self.pairs
+    }
+
+    /// The ranges of all brackets without a partner, in document order.
+    pub fn unbalanced(&self) -> impl Iterator<Item = Range<usize>> + '_ {
+        self.brackets.iter().filter(|b| b.partner.is_none()).map(|b| b.span.clone())
+    }
+
+    /// The ranges of all opening brackets which are never closed, in document order.
+    ///
+    /// Together with [`stray`](Self::stray) these are the [`unbalanced`](Self::unbalanced)
+    /// brackets, except for the middle keywords of unclosed keyword pairs.
+    pub fn unclosed(&self) -> impl Iterator<Item = Range<usize>> + '_ {
+        self.brackets.iter().filter(|b| b.open && b.partner.is_none()).map(|b| b.span.clone())
+    }
+
+    /// The ranges of all closing brackets and middle keywords without an opener, in document order.
+    pub fn stray(&self) -> impl Iterator<Item = Range<usize>> + '_ {
+        self.brackets.iter().filter(|b| b.stray).map(|b| b.span.clone())
+    }
+}
+
+/// Annotate the bracket tokens in `tokens` for rainbow rendering.
+///
+/// Matched brackets get a [`TokenPayload::BracketDepth`] of their nesting depth modulo
+/// `cycle`, unbalanced ones a [`TokenPayload::UnbalancedBracket`]. All pair types share
+/// one depth counter, just like they share the stack in the [`BracketMatcher`].
+pub fn rainbow_brackets(language: Language, text: &[u8], tokens: &mut [Token], cycle: usize) {
+    let metadata = language.metadata();
+    let matcher = BracketMatcher::new(language, text, tokens);
+    let cycle = cycle.clamp(1, u8::MAX as usize + 1);
+    // Several tokens may start at the bracket, like zero-length ones,
+    // so look for the one that the matcher took it from.
+    let mut annotate = |span: &Range<usize>, payload| {
+        let idx = tokens.partition_point(|t| t.span.start < span.start);
+        if let Some(token) = tokens[idx..]
+            .iter_mut()
+            .take_while(|t| t.span.start == span.start)
+            .find(|t| t.span == *span && delimiter(metadata, text, t).is_some())
+        {
+            token.payload = Some(payload);
+        }
+    };
+
+    for pair in matcher.all_pairs() {
+        let payload = TokenPayload::BracketDepth((pair.depth % cycle) as u8);
+        annotate(&pair.open, payload);
+        for middle in &pair.middle {
+            annotate(middle, payload);
+        }
+        annotate(&pair.close, payload);
+    }
+    for span in matcher.unbalanced() {
+        annotate(&span, TokenPayload::UnbalancedBracket);
+    }
+}
+
+fn delimiter(metadata: &GrammarMetadata, text: &[u8], token: &Token) -> Option<Delimiter> {
+    if let Some(b) = bracket_byte(metadata, text, token) {
+        return Some(match metadata.closer_of(b) {
+            Some(close) => Delimiter::Open(close as usize),
+            None => Delimiter::Close(b as usize),
+        });
+    }
+    if metadata.keyword_pairs.is_empty() || !token.kind.is_keyword() {
+        return None;
+    }
+
+    let word = &text[token.span.clone()];
+    let is = |s: &&str| metadata.is_keyword(word, s);
+    metadata.keyword_pairs.iter().enumerate().find_map(|(i, pair)| {
+        let id = 256 + i;
+        if pair.open.iter().any(is) {
+            Some(Delimiter::Open(id))
+        } else if pair.middle.iter().any(is) {
+            Some(Delimiter::Middle(id))
+        } else if is(&pair.close) {
+            Some(Delimiter::Close(id))
+        } else {
+            None
+        }
+    })
+}
+
+/// Returns the bracket byte if `token` is a bracket in the given grammar.
+pub(crate) fn bracket_byte(metadata: &GrammarMetadata, text: &[u8], token: &Token) -> Option<u8> {
+    if token.len() != 1
+        || !matches!(
+            token.kind,
+            TokenKind::Operator
+                | TokenKind::Punctuation
+                | TokenKind::Delimiter
+                | TokenKind::JsonBrace
+                | TokenKind::JsonBracket
+        )
+    {
+        return None;
+    }
+    let b = *text.get(token.span.start)?;
+    (metadata.closer_of(b).is_some() || metadata.is_closer(b)).then_some(b)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::syntax::LexerRegistry;
+
+    fn matcher(language: Language, text: &[u8]) -> BracketMatcher {
+        let tokens = LexerRegistry::get_lexer(language).tokenize(text);
+        BracketMatcher::new(language, text, &tokens)
+    }
+
+    fn find(text: &[u8], needle: &[u8]) -> usize {
+        text.windows(needle.len()).position(|w| w == needle).unwrap()
+    }
+
+    #[test]
+    fn test_brackets_go_fixture() {
+        let text = include_bytes!("../../../../syntax-tests/test_syntax.go");
+        let m = matcher(Language::Go, text);
+
+        // The lone `(` in the raw string and the `'('` rune must be ignored.
+        assert_eq!(m.unbalanced().count(), 0);
+        assert_eq!(m.match_at(find(text, b"a lone (") + 7), None);
+        assert_eq!(m.match_at(find(text, b"'('") + 1), None);
+
+        let open = find(text, b"func main() {") + 12;
+        let close = find(text, b"\n}\n\n// Exported function") + 1;
+        assert_eq!(m.match_at(open), Some(BracketMatch::Matched(close..close + 1)));
+        assert_eq!(m.match_at(close + 1), Some(BracketMatch::Matched(open..open + 1)));
+    }
+
+    #[test]
+    fn test_brackets_unbalanced() {
+        let text = b"f(a[0)]}";
+        let m = matcher(Language::Rust, text);
+        assert_eq!(m.match_at(1), Some(BracketMatch::Matched(5..6)));
+        assert_eq!(m.match_at(3), Some(BracketMatch::Unbalanced));
+        assert_eq!(m.unbalanced().collect::<Vec<_>>(), vec![3..4, 6..7, 7..8]);
+    }
+
+    fn depths(language: Language, text: &[u8], cycle: usize) -> String {
+        let mut tokens = LexerRegistry::get_lexer(language).tokenize(text);
+        rainbow_brackets(language, text, &mut tokens, cycle);
+        tokens
+            .iter()
+            .filter_map(|t| match t.payload? {
+                TokenPayload::BracketDepth(depth) => Some((b'0' + depth) as char),
+                TokenPayload::UnbalancedBracket => Some('!'),
+                _ => None,
+            })
+            .collect()
+    }
+
+    #[test]
+    fn test_rainbow_deep_nesting() {
+        let text = b"((((((((x))))))))";
+        assert_eq!(depths(Language::Rust, text, 8), "0123456776543210");
+        assert_eq!(depths(Language::Rust, text, 3), "0120120110210210");
+    }
+
+    #[test]
+    fn test_rainbow_interleaved_pairs() {
+        let text = b"f(a[b{c}], {d: [e]}) ; g(\"(\")";
+        assert_eq!(depths(Language::JavaScript, text, 3), "012211221000");
+    }
+
+    #[test]
+    fn test_rainbow_go() {
+        // Instantiations, array lengths and slice expressions count like any other bracket.
+        let text = b"x := f(Map[int](xs)[0])\nvar a = [...]int{1, 2}\ny := s[1:len(s)]\n";
+        assert_eq!(depths(Language::Go, text, 6), "0111111000000110");
+        // Brackets in strings, runes and comments don't.
+        let text = b"f(\"(\", ')', `[`, /* { */ g[i]) // )\n";
+        assert_eq!(depths(Language::Go, text, 6), "0110");
+    }
+
+    #[test]
+    fn test_rainbow_unbalanced() {
+        let text = b"fn f() {\n    g(x]);\n}\n}\n";
+        assert_eq!(depths(Language::Rust, text, 3), "0001!10!");
+    }
+
+    #[test]
+    fn test_rainbow_zero_length_token() {
+        // An empty token in front of a bracket mustn't get the bracket's payload.
+        let text = b"f(x)";
+        let mut tokens = LexerRegistry::get_lexer(Language::Rust).tokenize(text);
+        let open = tokens.iter().position(|t| t.span == (1..2)).unwrap();
+        tokens.insert(open, Token::new(TokenKind::Error, 1..1));
+        rainbow_brackets(Language::Rust, text, &mut tokens, 3);
+        assert_eq!(tokens[open].payload, None);
+        assert_eq!(tokens[open + 1].payload, Some(TokenPayload::BracketDepth(0)));
+    }
+
+    #[test]
+    fn test_brackets_all_pairs() {
+        let text = b"{\"a\": [1, {\"b\": 2}]}";
+        let m = matcher(Language::Json, text);
+        let pairs: Vec<_> =
+            m.all_pairs().iter().map(|p| (p.open.start, p.close.start, p.depth)).collect();
+        assert_eq!(pairs, vec![(0, 19, 0), (6, 18, 1), (10, 17, 2)]);
+    }
+
+    #[test]
+    fn test_keyword_pairs_shell_fixture() {
+        let text = include_bytes!("../../../../syntax-tests/test_syntax.sh");
+        let m = matcher(Language::Shell, text);
+        let keywords: Vec<_> =
+            m.unbalanced().filter(|r| text[r.clone()][0].is_ascii_alphabetic()).collect();
+        assert_eq!(keywords, vec![]);
+
+        // `if` -> `elif` -> `else` -> `fi` -> `if`, skipping the `then`s in between.
+        let at = |needle: &[u8]| find(text, needle);
+        let chain = [
+            at(b"if [ $COUNT"),
+            at(b"then\n    echo \"Count is"),
+            at(b"elif"),
+            at(b"then\n    echo \"Count equals"),
+            at(b"else"),
+            at(b"fi\n\n# Loops"),
+        ];
+        for (i, &start) in chain.iter().enumerate() {
+            let next = chain[(i + 1) % chain.len()];
+            let len = |offset: usize| {
+                text[offset..].iter().take_while(|b| b.is_ascii_alphabetic()).count()
+            };
+            assert_eq!(m.match_at(start), Some(BracketMatch::Matched(next..next + len(next))));
+        }
+
+        let case = at(b"case");
+        assert_eq!(m.match_at(case), Some(BracketMatch::Matched(at(b"esac")..at(b"esac") + 4)));
+    }
+
+    #[test]
+    fn test_keyword_pairs_nested_unbalanced() {
+        let text = b"for x in a; do\n  if true; then\n    echo \"fi\" $done\n  fi\n  while y; do\n    z\ndone\n";
+        let m = matcher(Language::Shell, text);
+        let pairs: Vec<_> = m
+            .all_pairs()
+            .iter()
+            .map(|p| (&text[p.open.clone()], p.middle.len(), p.close.start, p.depth))
+            .collect();
+        // The only `done` closes the innermost `do`, which leaves the outer one unbalanced.
+        // `"fi"` and `$done` aren't keywords.
+        assert_eq!(pairs, vec![(&b"if"[..], 1, 53, 1), (&b"do"[..], 0, 76, 1)]);
+        assert_eq!(m.unbalanced().collect::<Vec<_>>(), vec![12..14]);
+    }
+
+    #[test]
+    fn test_rainbow_keyword_pairs() {
+        let text = b"if a; then\n  for x in (1); do\n    b\n  done\nelse\n  c\nfi\n";
+        assert_eq!(depths(Language::Shell, text, 3), "00111100");
+    }
+}
@@ -0,0 +1,346 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//! Recognition of color literals.
+//!
+//! Colors are attached to their tokens as a [`TokenPayload::Color`], so editors can draw
+//! swatches next to them. In CSS, hex colors, functional notations (`rgb()`, `hsl()`,
+//! `hwb()`, `oklch()`, ...) and named colors are recognized in value position.
+//! Other languages only get hex colors in string literals, and only if asked for.
+
+use crate::oklab::{Oklab, StraightRgba};
+use crate::syntax::{Language, Token, TokenKind, TokenPayload};
+
+/// Attach the values of color literals to their tokens.
+///
+/// If `strings` is set, string literals which contain nothing but a hex color
+/// (like `"#ff8800"`) are recognized in all languages.
+pub fn detect_colors(language: Language, text: &[u8], tokens: &mut [Token], strings: bool) {
+    if language == Language::Css {
+        detect_css_colors(text, tokens);
+    }
+    if strings {
+        for token in
+            tokens.iter_mut().filter(|t| t.kind == TokenKind::String && t.payload.is_none())
+        {
+            let literal = &text[token.span.clone()];
+            let content = match literal {
+                [q, content @ .., e] if q == e && matches!(q, b'"' | b'\'' | b'`') => content,
+                _ => continue,
+            };
+            if content.first() == Some(&b'#')
+                && let Some(color) = parse_hex(&content[1..])
+            {
+                token.payload = Some(TokenPayload::Color(color));
+            }
+        }
+    }
+}
+
+fn detect_css_colors(text: &[u8], tokens: &mut [Token]) {
+    // Values are what follows a `:` up to the next `;`, `{` or `}`.
+    // The `{` is for selectors with pseudo-classes like `a:hover {`.
+    let mut in_value = false;
+
+    for i in 0..tokens.len() {
+        let token = &tokens[i];
+        let literal = &text[token.span.clone()];
+        match (token.kind, literal) {
+            (TokenKind::Operator, b":") => in_value = true,
+            (TokenKind::Operator, b";" | b"{" | b"}") => in_value = false,
+            _ if !in_value || token.payload.is_some() => {}
+            (_, [b'#', hex @ ..]) => {
+                if let Some(color) = parse_hex(hex) {
+                    tokens[i].payload = Some(TokenPayload::Color(color));
+                }
+            }
+            (TokenKind::Identifier | TokenKind::Keyword, _) => {
+                let next_is_paren =
+                    tokens.get(i + 1).is_some_and(|t| &text[t.span.clone()] == b"(");
+                let color = if next_is_paren {
+                    // Parse everything up to the closing parenthesis.
+                    tokens[i + 1..]
+                        .iter()
+                        .find(|t| t.kind == TokenKind::Operator && &text[t.span.clone()] == b")")
+                        .and_then(|close| parse_color(&text[token.span.start..close.span.end]))
+                } else {
+                    parse_named(literal)
+                };
+                if let Some(color) = color {
+                    tokens[i].payload = Some(TokenPayload::Color(color));
+                }
+            }
+            _ => {}
+        }
+    }
+}
+
+/// Parse a CSS color: `#rgb`, `#rgba`, `#rrggbb`, `#rrggbbaa`, a functional notation
+/// (`rgb()`, `rgba()`, `hsl()`, `hsla()`, `hwb()`, `oklab()`, `oklch()`) or a named color.
+pub fn parse_color(literal: &[u8]) -> Option<StraightRgba> {
+    if let [b'#', hex @ ..] = literal {
+        return parse_hex(hex);
+    }
+    if let Some(open) = literal.iter().position(|&b| b == b'(') {
+        return parse_function(&literal[..open], literal[open + 1..].strip_suffix(b")")?);
+    }
+    parse_named(literal)
+}
+
+fn parse_hex(hex: &[u8]) -> Option<StraightRgba> {
+    let digit = |i: usize| (hex[i] as char).to_digit(16);
+    if !hex.iter().all(u8::is_ascii_hexdigit) {
+        return None;
+    }
+    let (r, g, b, a) = match hex.len() {
+        3 | 4 => {
+            let short = |i| digit(i).map(|d| d * 17);
+            let a = if hex.len() == 4 { short(3)? } else { 255 };
+            (short(0)?, short(1)?, short(2)?, a)
+        }
+        6 | 8 => {
+            let long = |i| Some(digit(i)? * 16 + digit(i + 1)?);
+            let a = if hex.len() == 8 { long(6)? } else { 255 };
+            (long(0)?, long(2)?, long(4)?, a)
+        }
+        _ => return None,
+    };
+    Some(rgba(r, g, b, a))
+}
+
+/// Best-effort parsing of the functional notations.
+fn parse_function(name: &[u8], args: &[u8]) -> Option<StraightRgba> {
+    let args: Vec<&[u8]> = args
+        .split(|&b| b == b',' || b == b'/' || b.is_ascii_whitespace())
+        .filter(|arg| !arg.is_empty())
+        .collect();
+    let (values, alpha) = match args.as_slice() {
+        [x, y, z] => ([*x, *y, *z], 1.0),
+        [x, y, z, a] => ([*x, *y, *z], fraction(a, 1.0)?),
+        _ => return None,
+    };
+    let alpha = alpha.clamp(0.0, 1.0);
+
+    let color = match name.to_ascii_lowercase().as_slice() {
+        b"rgb" | b"rgba" => {
+            let channel = |arg| fraction(arg, 255.0);
+            [channel(values[0])?, channel(values[1])?, channel(values[2])?]
+        }
+        b"hsl" | b"hsla" => {
+            hsl_to_rgb(hue(values[0])?, fraction(values[1], 100.0)?, fraction(values[2], 100.0)?)
+        }
+        b"hwb" => {
+            let white = fraction(values[1], 100.0)?;
+            let black = fraction(values[2], 100.0)?;
+            if white + black >= 1.0 {
+                [white / (white + black); 3]
+            } else {
+                hsl_to_rgb(hue(values[0])?, 1.0, 0.5).map(|c| c * (1.0 - white - black) + white)
+            }
+        }
+        b"oklab" | b"oklch" => {
+            let lightness = fraction(values[0], 1.0)?;
+            let (a, b) = if name.eq_ignore_ascii_case(b"oklab") {
+                (percentage(values[1], 0.4)?, percentage(values[2], 0.4)?)
+            } else {
+                let chroma = percentage(values[1], 0.4)?;
+                let hue = hue(values[2])?.to_radians();
+                (chroma * hue.cos(), chroma * hue.sin())
+            };
+            let color = Oklab::new(lightness, a, b, alpha).as_rgba();
+            return Some(color);
+        }
+        _ => return None,
+    };
+
+    let channel = |c: f32| (c.clamp(0.0, 1.0) * 255.0).round() as u32;
+    Some(rgba(channel(color[0]), channel(color[1]), channel(color[2]), channel(alpha)))
+}
+
+/// Parse a number or a percentage into the 0-1 range, where a plain number is relative to `max`.
+fn fraction(arg: &[u8], max: f32) -> Option<f32> {
+    match arg.strip_suffix(b"%") {
+        Some(pct) => Some(number(pct)? / 100.0),
+        None => Some(number(arg)? / max),
+    }
+}
+
+/// Parse a number, where a percentage is relative to `max`.
+fn percentage(arg: &[u8], max: f32) -> Option<f32> {
+    match arg.strip_suffix(b"%") {
+        Some(pct) => Some(number(pct)? / 100.0 * max),
+        None => number(arg),
+    }
+}
+
+/// Parse a hue in degrees.
+fn hue(arg: &[u8]) -> Option<f32> {
+    let (value, scale) = if let Some(v) = arg.strip_suffix(b"deg") {
+        (v, 1.0)
+    } else if let Some(v) = arg.strip_suffix(b"turn") {
+        (v, 360.0)
+    } else if let Some(v) = arg.strip_suffix(b"rad") {
+        (v, 180.0 / std::f32::consts::PI)
+    } else {
+        (arg, 1.0)
+    };
+    Some((number(value)? * scale).rem_euclid(360.0))
+}
+
+fn number(arg: &[u8]) -> Option<f32> {
+    if arg.eq_ignore_ascii_case(b"none") {
+        return Some(0.0);
+    }
+    std::str::from_utf8(arg).ok()?.parse().ok()
+}
+
+fn hsl_to_rgb(hue: f32, saturation: f32, lightness: f32) -> [f32; 3] {
+    let saturation = saturation.clamp(0.0, 1.0);
+    let lightness = lightness.clamp(0.0, 1.0);
+    let f = |n: f32| {
+        let k = (n + hue / 30.0) % 12.0;
+        let a = saturation * lightness.min(1.0 - lightness);
+        lightness - a * (k - 3.0).min(9.0 - k).clamp(-1.0, 1.0)
+    };
+    [f(0.0), f(8.0), f(4.0)]
+}
+
+fn parse_named(name: &[u8]) -> Option<StraightRgba> {
+    if name.eq_ignore_ascii_case(b"transparent") {
+        return Some(rgba(0, 0, 0, 0));
+    }
+    let name = name.to_ascii_lowercase();
+    let idx = NAMED_COLORS.binary_search_by(|&(n, _)| n.as_bytes().cmp(&name)).ok()?;
+    let hex = NAMED_COLORS[idx].1;
+    Some(rgba(hex >> 16, (hex >> 8) & 0xff, hex & 0xff, 255))
+}
+
+const fn rgba(r: u32, g: u32, b: u32, a: u32) -> StraightRgba {
+    StraightRgba::from_le(r | (g << 8) | (b << 16) | (a << 24))
+}
+
+/// The CSS named colors, sorted by name.
+#[rustfmt::skip]
+const NAMED_COLORS: &[(&str, u32)] = &[
+    ("aliceblue", 0xF0F8FF), ("antiquewhite", 0xFAEBD7), ("aqua", 0x00FFFF),
+    ("aquamarine", 0x7FFFD4), ("azure", 0xF0FFFF), ("beige", 0xF5F5DC),
+    ("bisque", 0xFFE4C4), ("black", 0x000000), ("blanchedalmond", 0xFFEBCD),
+    ("blue", 0x0000FF), ("blueviolet", 0x8A2BE2), ("brown", 0xA52A2A),
+    ("burlywood", 0xDEB887), ("cadetblue", 0x5F9EA0), ("chartreuse", 0x7FFF00),
+    ("chocolate", 0xD2691E), ("coral", 0xFF7F50), ("cornflowerblue", 0x6495ED),
+    ("cornsilk", 0xFFF8DC), ("crimson", 0xDC143C), ("cyan", 0x00FFFF),
+    ("darkblue", 0x00008B), ("darkcyan", 0x008B8B), ("darkgoldenrod", 0xB8860B),
+    ("darkgray", 0xA9A9A9), ("darkgreen", 0x006400), ("darkgrey", 0xA9A9A9),
+    ("darkkhaki", 0xBDB76B), ("darkmagenta", 0x8B008B), ("darkolivegreen", 0x556B2F),
+    ("darkorange", 0xFF8C00), ("darkorchid", 0x9932CC), ("darkred", 0x8B0000),
+    ("darksalmon", 0xE9967A), ("darkseagreen", 0x8FBC8F), ("darkslateblue", 0x483D8B),
+    ("darkslategray", 0x2F4F4F), ("darkslategrey", 0x2F4F4F), ("darkturquoise", 0x00CED1),
+    ("darkviolet", 0x9400D3), ("deeppink", 0xFF1493), ("deepskyblue", 0x00BFFF),
+    ("dimgray", 0x696969), ("dimgrey", 0x696969), ("dodgerblue", 0x1E90FF),
+    ("firebrick", 0xB22222), ("floralwhite", 0xFFFAF0), ("forestgreen", 0x228B22),
+    ("fuchsia", 0xFF00FF), ("gainsboro", 0xDCDCDC), ("ghostwhite", 0xF8F8FF),
+    ("gold", 0xFFD700), ("goldenrod", 0xDAA520), ("gray", 0x808080),
+    ("green", 0x008000), ("greenyellow", 0xADFF2F), ("grey", 0x808080),
+    ("honeydew", 0xF0FFF0), ("hotpink", 0xFF69B4), ("indianred", 0xCD5C5C),
+    ("indigo", 0x4B0082), ("ivory", 0xFFFFF0), ("khaki", 0xF0E68C),
+    ("lavender", 0xE6E6FA), ("lavenderblush", 0xFFF0F5), ("lawngreen", 0x7CFC00),
+    ("lemonchiffon", 0xFFFACD), ("lightblue", 0xADD8E6), ("lightcoral", 0xF08080),
+    ("lightcyan", 0xE0FFFF), ("lightgoldenrodyellow", 0xFAFAD2), ("lightgray", 0xD3D3D3),
+    ("lightgreen", 0x90EE90), ("lightgrey", 0xD3D3D3), ("lightpink", 0xFFB6C1),
+    ("lightsalmon", 0xFFA07A), ("lightseagreen", 0x20B2AA), ("lightskyblue", 0x87CEFA),
+    ("lightslategray", 0x778899), ("lightslategrey", 0x778899), ("lightsteelblue", 0xB0C4DE),
+    ("lightyellow", 0xFFFFE0), ("lime", 0x00FF00), ("limegreen", 0x32CD32),
+    ("linen", 0xFAF0E6), ("magenta", 0xFF00FF), ("maroon", 0x800000),
+    ("mediumaquamarine", 0x66CDAA), ("mediumblue", 0x0000CD), ("mediumorchid", 0xBA55D3),
+    ("mediumpurple", 0x9370DB), ("mediumseagreen", 0x3CB371), ("mediumslateblue", 0x7B68EE),
+    ("mediumspringgreen", 0x00FA9A), ("mediumturquoise", 0x48D1CC), ("mediumvioletred", 0xC71585),
+    ("midnightblue", 0x191970), ("mintcream", 0xF5FFFA), ("mistyrose", 0xFFE4E1),
+    ("moccasin", 0xFFE4B5), ("navajowhite", 0xFFDEAD), ("navy", 0x000080),
+    ("oldlace", 0xFDF5E6), ("olive", 0x808000), ("olivedrab", 0x6B8E23),
+    ("orange", 0xFFA500), ("orangered", 0xFF4500), ("orchid", 0xDA70D6),
+    ("palegoldenrod", 0xEEE8AA), ("palegreen", 0x98FB98), ("paleturquoise", 0xAFEEEE),
+    ("palevioletred", 0xDB7093), ("papayawhip", 0xFFEFD5), ("peachpuff", 0xFFDAB9),
+    ("peru", 0xCD853F), ("pink", 0xFFC0CB), ("plum", 0xDDA0DD),
+    ("powderblue", 0xB0E0E6), ("purple", 0x800080), ("rebeccapurple", 0x663399),
+    ("red", 0xFF0000), ("rosybrown", 0xBC8F8F), ("royalblue", 0x4169E1),
+    ("saddlebrown", 0x8B4513), ("salmon", 0xFA8072), ("sandybrown", 0xF4A460),
+    ("seagreen", 0x2E8B57), ("seashell", 0xFFF5EE), ("sienna", 0xA0522D),
+    ("silver", 0xC0C0C0), ("skyblue", 0x87CEEB), ("slateblue", 0x6A5ACD),
+    ("slategray", 0x708090), ("slategrey", 0x708090), ("snow", 0xFFFAFA),
+    ("springgreen", 0x00FF7F), ("steelblue", 0x4682B4), ("tan", 0xD2B48C),
+    ("teal", 0x008080), ("thistle", 0xD8BFD8), ("tomato", 0xFF6347),
+    ("turquoise", 0x40E0D0), ("violet", 0xEE82EE), ("wheat", 0xF5DEB3),
+    ("white", 0xFFFFFF), ("whitesmoke", 0xF5F5F5), ("yellow", 0xFFFF00),
+    ("yellowgreen", 0x9ACD32),
+];
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::syntax::LexerRegistry;
+
+    fn colors(language: Language, text: &str, strings: bool) -> Vec<(&str, u32)> {
+        let mut tokens = LexerRegistry::get_lexer(language).tokenize(text.as_bytes());
+        detect_colors(language, text.as_bytes(), &mut tokens, strings);
+        tokens
+            .iter()
+            .filter_map(|t| match t.payload? {
+                TokenPayload::Color(c) => Some((&text[t.span.clone()], c.to_be())),
+                _ => None,
+            })
+            .collect()
+    }
+
+    #[test]
+    fn test_named_colors_sorted() {
+        assert!(NAMED_COLORS.windows(2).all(|w| w[0].0 < w[1].0));
+    }
+
+    #[test]
+    fn test_parse_color_table() {
+        // Expected values are 0xRRGGBBAA.
+        let table: &[(&str, u32)] = &[
+            ("#f80", 0xFF8800FF),
+            ("#f808", 0xFF880088),
+            ("#3498db", 0x3498DBFF),
+            ("#3498DB80", 0x3498DB80),
+            ("rgb(255, 136, 0)", 0xFF8800FF),
+            ("rgba(255, 136, 0, 0.5)", 0xFF880080),
+            ("rgb(100% 0% 0% / 50%)", 0xFF000080),
+            ("hsl(120, 100%, 25%)", 0x008000FF),
+            ("hsl(0deg 100% 50% / 0.5)", 0xFF000080),
+            ("hwb(0 0% 0%)", 0xFF0000FF),
+            ("hwb(0 50% 50%)", 0x808080FF),
+            ("oklch(1 0 0)", 0xFFFFFFFF),
+            ("oklch(0 0 0)", 0x000000FF),
+            ("rebeccapurple", 0x663399FF),
+            ("Red", 0xFF0000FF),
+            ("transparent", 0x00000000),
+        ];
+        for &(literal, expected) in table {
+            let color = parse_color(literal.as_bytes()).unwrap_or_else(|| panic!("{literal}"));
+            assert_eq!(color.to_be(), expected, "{literal}");
+        }
+
+        for invalid in ["#ggg", "#12345", "#", "rgb(1, 2)", "hsl(a, b, c)", "notacolor"] {
+            assert_eq!(parse_color(invalid.as_bytes()), None, "{invalid}");
+        }
+    }
+
+    #[test]
+    fn test_css_colors() {
+        let text =
+            "red, #add { color: red; background: rgb(0 0 255) #ggg; }\na:hover { color: #fff }";
+        assert_eq!(
+            colors(Language::Css, text, false),
+            vec![("red", 0xFF0000FF), ("rgb", 0x0000FFFF), ("#fff", 0xFFFFFFFF)]
+        );
+    }
+
+    #[test]
+    fn test_string_colors() {
+        let text = r##"const accent = "#ff8800" // not "#ggg""##;
+        assert_eq!(colors(Language::Go, text, false), vec![]);
+        assert_eq!(colors(Language::Go, text, true), vec![("\"#ff8800\"", 0xFF8800FF)]);
+    }
+}
@@ -0,0 +1,378 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//! Toggling comments on a selection.
+//!
+//! The comment syntax of each language is declared in
+//! [`GrammarMetadata::comments`](crate::syntax::GrammarMetadata::comments).
+//! Tokens decide what is already commented, so that a `// ...` line inside of
+//! a multi-line string is commented like any other line.
+
+use std::ops::Range;
+
+use crate::syntax::{CommentSyntax, Language, Token};
+
+/// A replacement of `range` in the original text.
+struct Edit {
+    range: Range<usize>,
+    insert: Vec<u8>,
+}
+
+/// Comment or uncomment the lines in `selection`, given the `tokens` of `text` in `language`.
+///
+/// Returns the new text and the new selection, or `None` if the language has no comments
+/// or the selection only contains blank lines. The rules are, in order:
+/// * A selection within a block comment removes that block comment.
+/// * A selection which starts or ends in the middle of a line is wrapped in a block comment.
+/// * If all non-blank lines are line comments, they are uncommented. Otherwise the rest
+///   are commented, with the leader aligned to the least indented line.
+/// * Languages without line comments use a single block comment around the lines instead,
+///   or one per line if they contain block comments that can't be nested.
+pub fn toggle_comments(
+    language: Language,
+    text: &[u8],
+    tokens: &[Token],
+    selection: Range<usize>,
+) -> Option<(Vec<u8>, Range<usize>)> {
+    let syntax = &language.metadata().comments;
+    let end = selection.end.min(text.len());
+    let selection = selection.start.min(end)..end;
+
+    let mut edits = block_edits(syntax, text, tokens, &selection);
+    if edits.is_empty() {
+        edits = line_edits(syntax, text, tokens, &selection);
+    }
+    if edits.is_empty() {
+        return None;
+    }
+
+    let mut result = Vec::with_capacity(text.len() + 16 * edits.len());
+    let mut pos = 0;
+    for edit in &edits {
+        result.extend_from_slice(&text[pos..edit.range.start]);
+        result.extend_from_slice(&edit.insert);
+        pos = edit.range.end;
+    }
+    result.extend_from_slice(&text[pos..]);
+
+    let start = map_offset(&edits, selection.start, false);
+    let end = if selection.is_empty() { start } else { map_offset(&edits, selection.end, true) };
+    Some((result, start..end))
+}
+
+/// Handles selections within a block comment and selections starting or ending mid-line.
+fn block_edits(
+    syntax: &CommentSyntax,
+    text: &[u8],
+    tokens: &[Token],
+    selection: &Range<usize>,
+) -> Vec<Edit> {
+    let Some((open, close)) = syntax.block else {
+        return Vec::new();
+    };
+    if selection.is_empty() {
+        return Vec::new();
+    }
+    let trimmed = trim(text, selection.clone());
+    if trimmed.is_empty() {
+        return Vec::new();
+    }
+
+    if let Some(token) = tokens.iter().find(|t| {
+        t.span.start <= trimmed.start && trimmed.end <= t.span.end && is_block(syntax, text, t)
+    }) {
+        return unwrap(text, token.span.clone(), open, close);
+    }
+
+    let mid_line = !trim(text, line_start(text, trimmed.start)..trimmed.start).is_empty()
+        || !trim(text, trimmed.end..line_end(text, trimmed.end)).is_empty();
+    if mid_line && (syntax.nested || !contains(&text[trimmed.clone()], close.as_bytes())) {
+        return wrap(trimmed, open, close);
+    }
+    Vec::new()
+}
+
+/// Handles everything else, line by line.
+fn line_edits(
+    syntax: &CommentSyntax,
+    text: &[u8],
+    tokens: &[Token],
+    selection: &Range<usize>,
+) -> Vec<Edit> {
+    // A selection that ends at the start of a line doesn't include that line.
+    let mut end = selection.end;
+    if end > selection.start && line_start(text, end) == end {
+        end -= 1;
+    }
+    let mut lines = Vec::new();
+    let mut pos = line_start(text, selection.start);
+    loop {
+        let line_end = line_end(text, pos);
+        let content = trim(text, pos..line_end);
+        if !content.is_empty() {
+            lines.push(content);
+        }
+        if line_end >= end || line_end >= text.len() {
+            break;
+        }
+        pos = line_end + 1;
+    }
+    if lines.is_empty() {
+        return Vec::new();
+    }
+
+    if let Some(leader) = syntax.line {
+        let is_commented = |line: &Range<usize>| {
+            token_at(tokens, line.start).is_some_and(|t| {
+                t.kind.is_comment()
+                    && t.span.start == line.start
+                    && text[line.clone()].starts_with(leader.as_bytes())
+            })
+        };
+
+        if lines.iter().all(is_commented) {
+            return lines
+                .iter()
+                .map(|line| {
+                    let mut end = line.start + leader.len();
+                    if text.get(end) == Some(&b' ') {
+                        end += 1;
+                    }
+                    Edit { range: line.start..end, insert: Vec::new() }
+                })
+                .collect();
+        }
+
+        let indent = lines.iter().map(|line| line.start - line_start(text, line.start)).min();
+        let indent = indent.unwrap_or(0);
+        let insert = format!("{leader} ").into_bytes();
+        return lines
+            .iter()
+            .filter(|line| !is_commented(line))
+            .map(|line| {
+                let at = line_start(text, line.start) + indent;
+                Edit { range: at..at, insert: insert.clone() }
+            })
+            .collect();
+    }
+
+    let Some((open, close)) = syntax.block else {
+        return Vec::new();
+    };
+    let whole = lines[0].start..lines[lines.len() - 1].end;
+    let comment =
+        |range: &Range<usize>| tokens.iter().any(|t| t.span == *range && is_block(syntax, text, t));
+
+    if comment(&whole) {
+        return unwrap(text, whole, open, close);
+    }
+    if lines.iter().all(comment) {
+        return lines.iter().flat_map(|line| unwrap(text, line.clone(), open, close)).collect();
+    }
+    if syntax.nested || !contains(&text[whole.clone()], close.as_bytes()) {
+        return wrap(whole, open, close);
+    }
+    lines
+        .iter()
+        .filter(|line| !comment(line))
+        .flat_map(|line| wrap(line.clone(), open, close))
+        .collect()
+}
+
+fn wrap(range: Range<usize>, open: &str, close: &str) -> Vec<Edit> {
+    vec![
+        Edit { range: range.start..range.start, insert: format!("{open} ").into_bytes() },
+        Edit { range: range.end..range.end, insert: format!(" {close}").into_bytes() },
+    ]
+}
+
+/// Removes the delimiters of the block comment at `range`, and a space inside each of them.
+fn unwrap(text: &[u8], range: Range<usize>, open: &str, close: &str) -> Vec<Edit> {
+    let mut open_end = range.start + open.len();
+    let mut close_start = range.end - close.len();
+    if open_end < close_start && text[open_end] == b' ' {
+        open_end += 1;
+    }
+    if open_end < close_start && text[close_start - 1] == b' ' {
+        close_start -= 1;
+    }
+    vec![
+        Edit { range: range.start..open_end, insert: Vec::new() },
+        Edit { range: close_start..range.end, insert: Vec::new() },
+    ]
+}
+
+/// Maps an offset in the original text to the edited one. `end_bias` decides
+/// whether text inserted right at `offset` ends up before it or after it.
+fn map_offset(edits: &[Edit], offset: usize, end_bias: bool) -> usize {
+    let mut delta = 0isize;
+    for edit in edits {
+        let Range { start, end } = edit.range;
+        let inserted = edit.insert.len() as isize;
+        if offset > end || (offset == end && start == end && end_bias) {
+            delta += inserted - (end - start) as isize;
+        } else if offset > start {
+            let inserted = if end_bias { inserted } else { 0 };
+            return (start as isize + delta + inserted) as usize;
+        } else {
+            break;
+        }
+    }
+    (offset as isize + delta) as usize
+}
+
+/// Checks whether `token` is a complete block comment.
+fn is_block(syntax: &CommentSyntax, text: &[u8], token: &Token) -> bool {
+    let Some((open, close)) = syntax.block else {
+        return false;
+    };
+    let s = &text[token.span.clone()];
+    token.kind.is_comment()
+        && s.len() >= open.len() + close.len()
+        && s.starts_with(open.as_bytes())
+        && s.ends_with(close.as_bytes())
+}
+
+fn token_at(tokens: &[Token], offset: usize) -> Option<&Token> {
+    tokens.get(tokens.partition_point(|t| t.span.end <= offset)).filter(|t| t.span.start <= offset)
+}
+
+fn trim(text: &[u8], range: Range<usize>) -> Range<usize> {
+    let mut start = range.start;
+    let mut end = range.end;
+    while start < end && text[start].is_ascii_whitespace() {
+        start += 1;
+    }
+    while end > start && text[end - 1].is_ascii_whitespace() {
+        end -= 1;
+    }
+    start..end
+}
+
+fn line_start(text: &[u8], offset: usize) -> usize {
+    text[..offset].iter().rposition(|&b| b == b'\n').map_or(0, |i| i + 1)
+}
+
+fn line_end(text: &[u8], offset: usize) -> usize {
+    text[offset..].iter().position(|&b| b == b'\n').map_or(text.len(), |i| offset + i)
+}
+
+fn contains(haystack: &[u8], needle: &[u8]) -> bool {
+    haystack.windows(needle.len()).any(|w| w == needle)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::syntax::LexerRegistry;
+
+    /// Toggles the selection marked with `«` and `»` in `input`.
+    fn toggle(language: Language, input: &str) -> String {
+        let start = input.find('«').unwrap();
+        let end = input.find('»').unwrap() - '«'.len_utf8();
+        let text = input.replace(['«', '»'], "");
+        let tokens = LexerRegistry::get_lexer(language).tokenize(text.as_bytes());
+        let (result, selection) =
+            toggle_comments(language, text.as_bytes(), &tokens, start..end).unwrap();
+        let mut result = String::from_utf8(result).unwrap();
+        result.insert(selection.end, '»');
+        result.insert(selection.start, '«');
+        result
+    }
+
+    /// Each case is toggled in both directions.
+    fn check(language: Language, cases: &[(&str, &str)]) {
+        for &(before, after) in cases {
+            assert_eq!(toggle(language, before), after, "commenting {before:?}");
+            assert_eq!(toggle(language, after), before, "uncommenting {after:?}");
+        }
+    }
+
+    #[test]
+    fn test_toggle_go() {
+        check(
+            Language::Go,
+            &[
+                // Indentation is preserved and the leaders are aligned.
+                (
+                    "func f() {\n\t«x := 1\n\t\ty := 2»\n}\n",
+                    "func f() {\n\t«// x := 1\n\t// \ty := 2»\n}\n",
+                ),
+                // Blank lines are left alone.
+                ("«a()\n\nb()\n»", "«// a()\n\n// b()\n»"),
+                // A cursor toggles its line.
+                ("\tfoo()«»\n", "\t// foo()«»\n"),
+                // Selections starting or ending mid-line use block comments.
+                ("x := «a + b»\n", "x := «/* a + b */»\n"),
+                ("«x := a» + b\n", "«/* x := a */» + b\n"),
+            ],
+        );
+    }
+
+    #[test]
+    fn test_toggle_go_one_way() {
+        // Mixed lines are completed, not commented twice.
+        assert_eq!(toggle(Language::Go, "«// a\nb»\n"), "«// a\n// b»\n");
+        // A line that only looks like a comment is inside of a raw string.
+        assert_eq!(
+            toggle(Language::Go, "s := `\n«// not a comment»\n`\n"),
+            "s := `\n«// // not a comment»\n`\n"
+        );
+        // Uncommenting doesn't require a space after the leader.
+        assert_eq!(toggle(Language::Go, "«//a»\n"), "«a»\n");
+        // A selection within a block comment removes it.
+        assert_eq!(toggle(Language::Go, "x := /* a «+» b */\n"), "x := a «+» b\n");
+    }
+
+    #[test]
+    fn test_toggle_python_hash() {
+        check(
+            Language::Python,
+            &[
+                ("«if x:\n    y = 1»\n", "«# if x:\n#     y = 1»\n"),
+                ("def f():\n    «return 1»\n", "def f():\n    «# return 1»\n"),
+            ],
+        );
+        // Python has no block comments, so a mid-line selection comments the line.
+        assert_eq!(toggle(Language::Python, "x = «1»\n"), "# x = «1»\n");
+        assert_eq!(toggle(Language::Yaml, "«a: 1»\n"), "«# a: 1»\n");
+    }
+
+    #[test]
+    fn test_toggle_css_blocks() {
+        check(
+            Language::Css,
+            &[
+                ("«a { color: red; }»\n", "«/* a { color: red; } */»\n"),
+                ("«a {\n  color: red;\n}»\n", "«/* a {\n  color: red;\n} */»\n"),
+            ],
+        );
+        // Comments can't be nested, so each line is commented on its own.
+        assert_eq!(
+            toggle(Language::Css, "«a {\n  /* x */\n  color: red;\n}»\n"),
+            "«/* a { */\n  /* x */\n  /* color: red; */\n/* } */»\n"
+        );
+        assert_eq!(toggle(Language::Css, "a { «color: red;» }\n"), "a { «/* color: red; */» }\n");
+    }
+
+    #[test]
+    fn test_toggle_html() {
+        check(
+            Language::Html,
+            &[
+                ("«<p>Hi</p>»\n", "«<!-- <p>Hi</p> -->»\n"),
+                ("<div>\n  «<p>Hi</p>»\n</div>\n", "<div>\n  «<!-- <p>Hi</p> -->»\n</div>\n"),
+                ("<p>«Hi»</p>\n", "<p>«<!-- Hi -->»</p>\n"),
+            ],
+        );
+    }
+
+    #[test]
+    fn test_toggle_unsupported() {
+        let text = b"{\"a\": 1}";
+        let tokens = LexerRegistry::get_lexer(Language::Json).tokenize(text);
+        assert!(toggle_comments(Language::Json, text, &tokens, 0..text.len()).is_none());
+        let tokens = LexerRegistry::get_lexer(Language::Go).tokenize(b"\n\n");
+        assert!(toggle_comments(Language::Go, b"\n\n", &tokens, 0..2).is_none());
+    }
+}
@@ -0,0 +1,106 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//! Stray C0 control characters, like NUL or the ESC of text copied from a terminal.
+//!
+//! Lexers treat them as part of whatever token they're in. [`flag_control_characters`]
+//! splits each of them into a single-byte token, so that the theme can make them stand
+//! out. The renderer never prints them raw either, see `TextBuffer::render`.
+
+use crate::syntax::{Token, TokenPayload};
+
+/// Whether `b` is a C0 control character other than a tab, newline or carriage return.
+pub fn is_control_character(b: u8) -> bool {
+    b < 0x20 && !matches!(b, b'\t' | b'\n' | b'\r')
+}
+
+/// Split every C0 control character other than tabs, newlines and carriage returns out
+/// of the token it's in and attach a [`TokenPayload::ControlCharacter`] to it.
+/// The rest of the token keeps its kind and payload.
+pub fn flag_control_characters(text: &[u8], tokens: &mut Vec<Token>) {
+    let mut result: Option<Vec<Token>> = None;
+
+    for (i, token) in tokens.iter().enumerate() {
+        let s = &text[token.span.clone()];
+        if !s.iter().any(|&b| is_control_character(b)) {
+            if let Some(result) = &mut result {
+                result.push(token.clone());
+            }
+            continue;
+        }
+
+        // Only copy the token stream once the first control character shows up.
+        let result = result.get_or_insert_with(|| {
+            let mut v = Vec::with_capacity(tokens.len() + 4);
+            v.extend_from_slice(&tokens[..i]);
+            v
+        });
+        let rest = |start: usize, end: usize| Token { span: start..end, ..token.clone() };
+        let mut pos = token.span.start;
+        for (j, &b) in s.iter().enumerate() {
+            if !is_control_character(b) {
+                continue;
+            }
+            let start = token.span.start + j;
+            if pos < start {
+                result.push(rest(pos, start));
+            }
+            pos = start + 1;
+            let payload = TokenPayload::ControlCharacter;
+            result.push(rest(start, pos).with_payload(payload));
+        }
+        if pos < token.span.end {
+            result.push(rest(pos, token.span.end));
+        }
+    }
+
+    if let Some(result) = result {
+        *tokens = result;
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::syntax::{Language, LexerRegistry, TokenKind};
+
+    fn flagged(language: Language, text: &[u8]) -> Vec<(TokenKind, usize)> {
+        let mut tokens = LexerRegistry::get_lexer(language).tokenize(text);
+        flag_control_characters(text, &mut tokens);
+        assert!(tokens.windows(2).all(|w| w[0].span.end == w[1].span.start));
+        tokens
+            .iter()
+            .filter(|t| t.payload == Some(TokenPayload::ControlCharacter))
+            .map(|t| {
+                assert_eq!(t.len(), 1);
+                (t.kind, t.span.start)
+            })
+            .collect()
+    }
+
+    #[test]
+    fn test_terminal_escape_sequence() {
+        // Output copied from a terminal, with an OSC sequence setting the window title.
+        let text = b"// log: \x1b]0;pwned\x07 done\ns := \"\x1b[31mred\x1b[0m\"\n";
+        assert_eq!(
+            flagged(Language::Go, text),
+            [
+                (TokenKind::Comment, 8),
+                (TokenKind::Comment, 17),
+                (TokenKind::String, 30),
+                (TokenKind::String, 38),
+            ]
+        );
+    }
+
+    #[test]
+    fn test_stray_controls() {
+        let text = b"x\x00 = 1\x0b\ty\t= 2\r\n";
+        let flags = flagged(Language::Python, text);
+        assert_eq!(flags.iter().map(|f| f.1).collect::<Vec<_>>(), [1, 6]);
+
+        // Tabs, newlines and carriage returns are left alone.
+        let fixture = include_bytes!("../../../../syntax-tests/test_syntax.go");
+        assert_eq!(flagged(Language::Go, fixture), []);
+    }
+}
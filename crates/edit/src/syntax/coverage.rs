@@ -0,0 +1,252 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//! How much of a lexer the fixtures exercise, for finding what no test covers.
+//!
+//! The lexers are code rather than rules, so the rules counted here are the ones a language
+//! declares: its comments from the [`GrammarMetadata`](crate::syntax::GrammarMetadata), and for
+//! lexers that can be [exported](crate::syntax::export_grammar) their strings, escapes, numbers,
+//! operators and every word of their word lists. A rule is hit by a token the lexer made of it,
+//! so `len` in Go is only hit where it's highlighted as a builtin, not where it's a variable.
+//!
+//! Every token is also counted under its innermost TextMate scope, see [`scope_stack`]. Scopes
+//! with at most [`RARE_HITS`] hits remember the lines they were hit on, since a regression in
+//! one of those is only caught by those lines.
+//!
+//! Nothing here runs while highlighting. A [`Coverage`] is given the tokens afterwards, so only
+//! the tools that ask for it pay for it.
+
+use crate::syntax::lexer::export_rules;
+use crate::syntax::{Language, LineIndex, Token, TokenKind, scope_stack, token_scopes};
+
+/// Scopes with at most this many hits are rare, and remember where they were hit.
+pub const RARE_HITS: usize = 3;
+
+/// What a token must look like to hit a rule.
+#[derive(Debug, Clone, Copy)]
+enum Pattern {
+    /// A comment starting with this.
+    Comment(&'static str),
+    /// A string or character literal starting with this.
+    String(&'static str),
+    /// Any token of this kind.
+    Kind(TokenKind),
+    /// This word, highlighted as anything but a name, a string or a comment.
+    Word(&'static str),
+}
+
+impl Pattern {
+    fn matches(self, text: &[u8], token: &Token) -> bool {
+        let kind = token.kind;
+        let s = &text[token.span.clone()];
+        match self {
+            Pattern::Comment(open) => kind.is_comment() && s.starts_with(open.as_bytes()),
+            Pattern::String(open) => {
+                (kind.is_string() || kind == TokenKind::Char) && s.starts_with(open.as_bytes())
+            }
+            Pattern::Kind(k) => kind == k,
+            Pattern::Word(word) => {
+                s == word.as_bytes()
+                    && !matches!(
+                        kind,
+                        TokenKind::Identifier
+                            | TokenKind::VariableName
+                            | TokenKind::PropertyName
+                            | TokenKind::ParameterName
+                            | TokenKind::Char
+                    )
+                    && !kind.is_string()
+                    && !kind.is_comment()
+            }
+        }
+    }
+}
+
+/// A rule of a lexer and how many tokens hit it.
+#[derive(Debug, Clone)]
+pub struct RuleHits {
+    /// The rule's scope, and for words the word, like `keyword.control fallthrough`.
+    pub name: String,
+    pub hits: usize,
+    pattern: Pattern,
+}
+
+/// A scope and how many tokens had it.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct ScopeHits {
+    /// The scope with the language's suffix, like `string.quoted.double.go`.
+    pub scope: String,
+    pub hits: usize,
+    /// Where the scope was hit, as indices into [`Coverage::files`] and 0-based lines,
+    /// for the first [`RARE_HITS`] hits.
+    pub lines: Vec<(usize, usize)>,
+}
+
+/// The rules and scopes of one language's lexer that the recorded texts hit.
+#[derive(Debug, Clone)]
+pub struct Coverage {
+    pub language: Language,
+    /// The names of the recorded texts, in order.
+    pub files: Vec<String>,
+    /// The lexer's rules, in the order they're declared.
+    pub rules: Vec<RuleHits>,
+    /// The scopes that were hit, ordered by name.
+    pub scopes: Vec<ScopeHits>,
+}
+
+impl Coverage {
+    /// Start counting for the lexer of `language`, with none of its rules hit.
+    pub fn new(language: Language) -> Self {
+        let mut rules = Vec::new();
+        let mut rule = |name: String, pattern| rules.push(RuleHits { name, hits: 0, pattern });
+
+        let comments = language.metadata().comments;
+        if let Some(open) = comments.line {
+            rule("comment.line".to_string(), Pattern::Comment(open));
+        }
+        if let Some((open, _)) = comments.block {
+            rule("comment.block".to_string(), Pattern::Comment(open));
+        }
+        if let Some(export) = export_rules(language) {
+            for string in export.strings {
+                rule(string.scope.to_string(), Pattern::String(string.open));
+            }
+            if !export.escapes.is_empty() {
+                rule("constant.character.escape".to_string(), Pattern::Kind(TokenKind::Escape));
+            }
+            if export.strings.iter().any(|string| string.verbs) {
+                let pattern = Pattern::Kind(TokenKind::FormatSpecifier);
+                rule("constant.other.placeholder".to_string(), pattern);
+            }
+            if !export.numbers.is_empty() {
+                rule("constant.numeric".to_string(), Pattern::Kind(TokenKind::Number));
+            }
+            if !export.operators.is_empty() {
+                rule("keyword.operator".to_string(), Pattern::Kind(TokenKind::Operator));
+            }
+            for &(scope, _, words) in export.words {
+                for &word in words {
+                    rule(format!("{scope} {word}"), Pattern::Word(word));
+                }
+            }
+        }
+
+        Self { language, files: Vec::new(), rules, scopes: Vec::new() }
+    }
+
+    /// Count the `tokens` of `text`, the file called `file`, which the lexer of the
+    /// language made and the highlighter post-processed.
+    pub fn record(&mut self, file: &str, text: &[u8], tokens: &[Token]) {
+        let index = self.files.len();
+        self.files.push(file.to_string());
+        let lines = LineIndex::new(text);
+
+        for token in tokens {
+            for rule in &mut self.rules {
+                if rule.pattern.matches(text, token) {
+                    rule.hits += 1;
+                }
+            }
+
+            // Tokens that grammars leave unscoped, like plain identifiers, only have the
+            // scopes of what they're in, which the tokens of that account for.
+            if token_scopes(token.kind).is_empty() {
+                continue;
+            }
+            let Some(scope) = scope_stack(self.language, token).pop() else { continue };
+            let i = match self.scopes.binary_search_by(|s| s.scope.cmp(&scope)) {
+                Ok(i) => i,
+                Err(i) => {
+                    self.scopes.insert(i, ScopeHits { scope, hits: 0, lines: Vec::new() });
+                    i
+                }
+            };
+            let hits = &mut self.scopes[i];
+            hits.hits += 1;
+            if hits.lines.len() < RARE_HITS {
+                hits.lines.push((index, lines.line_of(token.span.start)));
+            }
+        }
+    }
+
+    /// The number of rules with at least one hit.
+    pub fn rules_hit(&self) -> usize {
+        self.rules.iter().filter(|rule| rule.hits > 0).count()
+    }
+
+    /// The rules without any hits.
+    pub fn missed_rules(&self) -> impl Iterator<Item = &RuleHits> {
+        self.rules.iter().filter(|rule| rule.hits == 0)
+    }
+
+    /// The scopes with at most [`RARE_HITS`] hits.
+    pub fn rare_scopes(&self) -> impl Iterator<Item = &ScopeHits> {
+        self.scopes.iter().filter(|scope| scope.hits <= RARE_HITS)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::syntax::LexerRegistry;
+
+    fn coverage(language: Language, text: &str) -> Coverage {
+        let tokens = LexerRegistry::get_lexer(language).tokenize(text.as_bytes());
+        let mut coverage = Coverage::new(language);
+        coverage.record("test", text.as_bytes(), &tokens);
+        coverage
+    }
+
+    fn hits(coverage: &Coverage, name: &str) -> usize {
+        coverage.rules.iter().find(|rule| rule.name == name).unwrap().hits
+    }
+
+    #[test]
+    fn test_rules() {
+        let text = "// a\nfunc f() { return len(`x`) + 1 }\nfunc g() { len := 2; _ = len }\n";
+        let go = coverage(Language::Go, text);
+        assert_eq!(hits(&go, "comment.line"), 1);
+        assert_eq!(hits(&go, "comment.block"), 0);
+        assert_eq!(hits(&go, "string.quoted.raw"), 1);
+        assert_eq!(hits(&go, "string.quoted.double"), 0);
+        assert_eq!(hits(&go, "constant.numeric"), 2);
+        assert_eq!(hits(&go, "keyword.control return"), 1);
+        // Only the call of the builtin, not the variable named like it.
+        assert_eq!(hits(&go, "support.function.builtin len"), 1);
+        assert_eq!(go.rules_hit() + go.missed_rules().count(), go.rules.len());
+
+        // Lexers that can't be exported only declare their comments.
+        let python = coverage(Language::Python, "# a\nx = 1\n");
+        let names: Vec<_> = python.rules.iter().map(|rule| rule.name.as_str()).collect();
+        assert_eq!(names, ["comment.line"]);
+        assert_eq!(python.rules_hit(), 1);
+    }
+
+    #[test]
+    fn test_scopes() {
+        let mut go = coverage(Language::Go, "package a\n\nvar x = 1 + 2\n");
+        let scopes: Vec<_> = go.scopes.iter().map(|s| (s.scope.as_str(), s.hits)).collect();
+        assert_eq!(
+            scopes,
+            [("constant.numeric.go", 2), ("keyword.operator.go", 2), ("keyword.other.go", 2)]
+        );
+
+        // A second file adds to the counts, and only the first hits remember their lines.
+        go.record(
+            "second",
+            b"var y = 3\n",
+            &LexerRegistry::get_lexer(Language::Go).tokenize(b"var y = 3\n"),
+        );
+        let numbers = &go.scopes[0];
+        assert_eq!(numbers.hits, 3);
+        assert_eq!(numbers.lines, [(0, 2), (0, 2), (1, 0)]);
+        assert_eq!(go.rare_scopes().count(), 3);
+        go.record(
+            "third",
+            b"var z = 4\n",
+            &LexerRegistry::get_lexer(Language::Go).tokenize(b"var z = 4\n"),
+        );
+        assert_eq!(go.scopes[0].lines.len(), RARE_HITS);
+        assert!(go.rare_scopes().all(|s| s.scope != "constant.numeric.go"));
+    }
+}
@@ -0,0 +1,411 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//! Which language a file is in, from its name and its content.
+//!
+//! [`detect_language`] goes by the first of these that knows:
+//!
+//! 1. The file name, for files like `Cargo.lock` whose extension doesn't say, and
+//!    compound extensions like `.d.ts`. Files in languages we don't lex, like `Makefile`,
+//!    are plain text, so that the later steps don't guess at them.
+//! 2. The extension, see [`Language::extensions`]. The extensions of several languages,
+//!    like `.h` of C and C++, are decided by the content.
+//! 3. The interpreter of a `#!` line, like `#!/usr/bin/env python3`.
+//! 4. A modeline in the first or last lines, like Emacs' `-*- mode: go -*-` or Vim's
+//!    `vim: ft=yaml`.
+//! 5. Cheap guesses from the start of the content, like `package main` and `func` for Go.
+
+use crate::syntax::Language;
+
+/// What [`detect_language`] went by, from the most to the least reliable.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum DetectedBy {
+    FileName,
+    Extension,
+    Shebang,
+    Modeline,
+    Content,
+    /// Nothing said, and the language is [`Language::PlainText`].
+    Nothing,
+}
+
+impl DetectedBy {
+    /// How likely the language is to be right, from 0 to 1.
+    pub fn confidence(self) -> f32 {
+        match self {
+            DetectedBy::FileName => 1.0,
+            DetectedBy::Extension => 0.9,
+            DetectedBy::Shebang => 0.9,
+            DetectedBy::Modeline => 0.8,
+            DetectedBy::Content => 0.5,
+            DetectedBy::Nothing => 0.0,
+        }
+    }
+}
+
+/// The language of a file, see [`detect_language`].
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct Detection {
+    pub language: Language,
+    pub by: DetectedBy,
+}
+
+/// Files whose names say what's in them, including the ones in languages we don't lex.
+const FILE_NAMES: &[(&str, Language)] = &[
+    (".bash_aliases", Language::Shell),
+    (".bash_logout", Language::Shell),
+    (".bash_profile", Language::Shell),
+    (".bashrc", Language::Shell),
+    (".envrc", Language::Shell),
+    (".profile", Language::Shell),
+    (".zprofile", Language::Shell),
+    (".zshenv", Language::Shell),
+    (".zshrc", Language::Shell),
+    ("APKBUILD", Language::Shell),
+    ("PKGBUILD", Language::Shell),
+    (".babelrc", Language::Json),
+    (".jshintrc", Language::Json),
+    ("composer.lock", Language::Json),
+    ("flake.lock", Language::Json),
+    ("Cargo.lock", Language::Toml),
+    ("Pipfile", Language::Toml),
+    ("poetry.lock", Language::Toml),
+    ("uv.lock", Language::Toml),
+    (".clang-format", Language::Yaml),
+    (".clang-tidy", Language::Yaml),
+    (".clangd", Language::Yaml),
+    ("CMakeLists.txt", Language::PlainText),
+    ("Dockerfile", Language::PlainText),
+    ("GNUmakefile", Language::PlainText),
+    ("Makefile", Language::PlainText),
+    ("go.mod", Language::PlainText),
+    ("go.sum", Language::PlainText),
+    ("go.work", Language::PlainText),
+    ("makefile", Language::PlainText),
+];
+
+/// Extensions of more than one dot, or whose language isn't the one of their last part,
+/// in lowercase.
+const SUFFIXES: &[(&str, Language)] = &[
+    (".d.ts", Language::TypeScript),
+    (".tmlanguage.json", Language::Json),
+    (".code-workspace", Language::Json),
+    (".tmlanguage", Language::Xml),
+    (".tmtheme", Language::Xml),
+    (".plist", Language::Xml),
+    (".csproj", Language::Xml),
+    (".props", Language::Xml),
+    (".targets", Language::Xml),
+];
+
+/// How many lines at the start and the end of the text may have a modeline.
+const MODELINE_LINES: usize = 5;
+/// How much of the start of the text the guesses look at.
+const GUESS_LEN: usize = 8 * 1024;
+
+/// Detect the language of the file named `file_name`, which may be a path or empty,
+/// from its name and from `text`, see the [module docs](self).
+pub fn detect_language(file_name: &str, text: &[u8]) -> Detection {
+    let detection = |language, by| Detection { language, by };
+    let text = text.strip_prefix("\u{feff}".as_bytes()).unwrap_or(text);
+    let name = file_name.rsplit(['/', '\\']).next().unwrap_or_default();
+
+    if let Some(&(_, language)) = FILE_NAMES.iter().find(|&&(n, _)| n == name) {
+        return detection(language, DetectedBy::FileName);
+    }
+    let lower = name.to_ascii_lowercase();
+    if let Some(&(_, language)) = SUFFIXES.iter().find(|&&(suffix, _)| lower.ends_with(suffix)) {
+        return detection(language, DetectedBy::FileName);
+    }
+    if let Some((stem, ext)) = name.rsplit_once('.')
+        && !stem.is_empty()
+    {
+        match Language::from_extension(ext) {
+            // `.txt` says it's plain text, an unknown extension doesn't.
+            Language::PlainText if !ext.eq_ignore_ascii_case("txt") => {}
+            Language::C | Language::Cpp if ext.eq_ignore_ascii_case("h") => {
+                let language = if is_cpp(&text[..text.len().min(GUESS_LEN)]) {
+                    Language::Cpp
+                } else {
+                    Language::C
+                };
+                return detection(language, DetectedBy::Extension);
+            }
+            language => return detection(language, DetectedBy::Extension),
+        }
+    }
+
+    if let Some(line) = text.strip_prefix(b"#!") {
+        let line = &line[..line.iter().position(|&b| b == b'\n').unwrap_or(line.len())];
+        // Rust's inner attributes look like a shebang.
+        if line.starts_with(b"[") {
+            return detection(Language::Rust, DetectedBy::Content);
+        }
+        return detection(shebang(line), DetectedBy::Shebang);
+    }
+    if let Some(language) = modeline(text) {
+        return detection(language, DetectedBy::Modeline);
+    }
+    match guess(&text[..text.len().min(GUESS_LEN)]) {
+        Some(language) => detection(language, DetectedBy::Content),
+        None => detection(Language::PlainText, DetectedBy::Nothing),
+    }
+}
+
+/// The language of the interpreter of a `#!` line, without the `#!`.
+fn shebang(line: &[u8]) -> Language {
+    let line = String::from_utf8_lossy(line);
+    let mut words = line.split_whitespace().map(|w| w.rsplit('/').next().unwrap_or(w));
+    let mut interpreter = words.next().unwrap_or_default();
+    if interpreter == "env" {
+        interpreter = words.find(|w| !w.starts_with('-')).unwrap_or_default();
+    }
+    // `python3.12` is `python`.
+    let name = interpreter.trim_end_matches(|c: char| c.is_ascii_digit() || c == '.');
+    match name {
+        "sh" | "ash" | "dash" | "ksh" => Language::Shell,
+        _ => Language::from_name(name),
+    }
+}
+
+/// The language of an Emacs or Vim modeline in the first or last lines, if it names one
+/// we know.
+fn modeline(text: &[u8]) -> Option<Language> {
+    let lines: Vec<&[u8]> = text.split(|&b| b == b'\n').collect();
+    let last = lines.len().saturating_sub(MODELINE_LINES).max(MODELINE_LINES.min(lines.len()));
+    let candidates = lines[..MODELINE_LINES.min(lines.len())].iter().chain(&lines[last..]);
+    candidates.filter_map(|line| std::str::from_utf8(line).ok()).find_map(|line| {
+        let name = emacs_mode(line).or_else(|| vim_filetype(line))?;
+        match Language::from_name(name) {
+            Language::PlainText => None,
+            language => Some(language),
+        }
+    })
+}
+
+/// The mode of `-*- mode: go -*-`, or of `-*- go -*-`.
+fn emacs_mode(line: &str) -> Option<&str> {
+    let (_, rest) = line.split_once("-*-")?;
+    let (vars, _) = rest.split_once("-*-")?;
+    let mode = match vars.split(';').find_map(|var| {
+        let (key, value) = var.split_once(':')?;
+        key.trim().eq_ignore_ascii_case("mode").then_some(value)
+    }) {
+        Some(mode) => mode,
+        None if !vars.contains(':') => vars,
+        None => return None,
+    };
+    let mode = mode.trim();
+    let mode = mode.strip_suffix("-mode").unwrap_or(mode);
+    Some(if mode == "shell-script" { "sh" } else { mode })
+}
+
+/// The file type of `vim: ft=yaml`, `vim: set filetype=yaml:` and the like.
+fn vim_filetype(line: &str) -> Option<&str> {
+    let start = ["vim:", "vi:", "ex:"].iter().find_map(|marker| {
+        let i = line.find(marker)?;
+        // `vi:` isn't the end of a word, like in `navi:`.
+        let after_word = line[..i].chars().next_back().is_none_or(|c| !c.is_alphanumeric());
+        after_word.then_some(i + marker.len())
+    })?;
+    line[start..].split([' ', '\t', ':']).find_map(|option| {
+        let (key, value) = option.split_once('=')?;
+        matches!(key, "ft" | "filetype" | "syntax" | "syn").then_some(value)
+    })
+}
+
+/// A guess from the start of the text, where `Some(PlainText)` is one of the languages we
+/// don't lex.
+fn guess(head: &[u8]) -> Option<Language> {
+    let start = head.iter().position(|b| !b.is_ascii_whitespace()).unwrap_or(head.len());
+    let trimmed = &head[start..];
+    let starts_with =
+        |p: &[u8]| trimmed.len() >= p.len() && trimmed[..p.len()].eq_ignore_ascii_case(p);
+    if starts_with(b"<?xml") {
+        return Some(Language::Xml);
+    } else if starts_with(b"<!doctype html") || starts_with(b"<html") {
+        return Some(Language::Html);
+    } else if starts_with(b"<?php") {
+        return Some(Language::PlainText);
+    } else if starts_with(b"{")
+        && matches!(trimmed[1..].iter().find(|b| !b.is_ascii_whitespace()), Some(b'"' | b'}'))
+    {
+        return Some(Language::Json);
+    } else if head.starts_with(b"---\n") || head.starts_with(b"%YAML") {
+        return Some(Language::Yaml);
+    } else if trimmed.starts_with(b"= ") {
+        // The document title.
+        return Some(Language::AsciiDoc);
+    }
+
+    let text = String::from_utf8_lossy(head);
+    let lines: Vec<&str> = text.lines().map(str::trim).collect();
+    // Code fences are all but certain to be Markdown, whatever code is in them.
+    if lines.iter().any(|l| l.starts_with("```")) && lines.iter().any(|l| l.starts_with('#')) {
+        return Some(Language::Markdown);
+    }
+    let any = |f: &dyn Fn(&str) -> bool| lines.iter().any(|line| f(line));
+    let first_word = lines.iter().find(|line| !line.is_empty() && !line.starts_with("--"));
+    let first_word = first_word.and_then(|line| line.split_whitespace().next()).unwrap_or("");
+
+    if any(&|l| l.starts_with("package ") && !l.ends_with(';'))
+        && any(&|l| l.starts_with("func ") || l.starts_with("import "))
+    {
+        Some(Language::Go)
+    } else if any(&|l| {
+        l.starts_with("using System") || l.starts_with("namespace ") && l.ends_with(';')
+    }) {
+        Some(Language::CSharp)
+    } else if any(&|l| {
+        l.starts_with("package ") && l.ends_with(';')
+            || l.starts_with("import java.")
+            || l.starts_with("import javax.")
+    }) {
+        Some(Language::Java)
+    } else if any(&|l| l.starts_with("#include")) {
+        Some(if is_cpp(head) { Language::Cpp } else { Language::C })
+    } else if any(&|l| {
+        l.starts_with("fn ")
+            || l.starts_with("pub fn ")
+            || l.starts_with("impl ")
+            || l.starts_with("#[derive(")
+    }) {
+        Some(Language::Rust)
+    } else if any(&|l| {
+        (l.starts_with("import ") || l.starts_with("export ")) && l.contains(" from ")
+            || l.contains("require(") && l.ends_with(';')
+    }) {
+        Some(Language::JavaScript)
+    } else if any(&|l| {
+        l.starts_with("def ") && l.ends_with(':')
+            || l.starts_with("from ") && l.contains(" import ")
+            || l.starts_with("if __name__ ==")
+    }) {
+        Some(Language::Python)
+    } else if ["select", "create", "insert", "with", "update", "delete", "alter"]
+        .iter()
+        .any(|w| first_word.eq_ignore_ascii_case(w))
+        && any(&|l| l.ends_with(';'))
+    {
+        Some(Language::Sql)
+    } else {
+        None
+    }
+}
+
+/// Whether C-like text uses C++, like a header that could be either.
+fn is_cpp(head: &[u8]) -> bool {
+    let text = String::from_utf8_lossy(head);
+    text.lines().map(str::trim_start).any(|l| {
+        ["namespace ", "class ", "template<", "template <", "using namespace ", "public:", "private:"]
+            .iter()
+            .any(|p| l.starts_with(p))
+            // Standard headers without an extension, like `<iostream>`.
+            || l.strip_prefix("#include <")
+                .and_then(|h| h.split_once('>'))
+                .is_some_and(|(header, _)| !header.contains('.'))
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_detect_language() {
+        use DetectedBy::*;
+        use Language::*;
+
+        let cases: &[(&str, &str, Language, DetectedBy)] = &[
+            // Names and extensions.
+            ("main.go", "", Go, Extension),
+            ("src/lib.rs", "", Rust, Extension),
+            ("C:\\code\\App.CS", "", CSharp, Extension),
+            ("index.d.ts", "", TypeScript, FileName),
+            ("go.tmLanguage.json", "", Json, FileName),
+            ("Go.tmLanguage", "", Xml, FileName),
+            ("Cargo.lock", "", Toml, FileName),
+            ("Pipfile", "", Toml, FileName),
+            (".bashrc", "", Shell, FileName),
+            ("PKGBUILD", "pkgname=edit\n", Shell, FileName),
+            (".clang-format", "", Yaml, FileName),
+            ("Makefile", "#!/bin/sh\n", PlainText, FileName),
+            ("Dockerfile", "FROM alpine\nRUN apk add go\n", PlainText, FileName),
+            ("go.mod", "module example.com/m\n", PlainText, FileName),
+            ("notes.txt", "", PlainText, Extension),
+            // `.h` is C unless it looks like C++.
+            ("util.h", "#include <stdio.h>\nint f(void);\n", C, Extension),
+            ("util.h", "#include <vector>\nint f();\n", Cpp, Extension),
+            ("util.h", "namespace util {\nint f();\n}\n", Cpp, Extension),
+            ("util.h", "class Widget {\npublic:\n};\n", Cpp, Extension),
+            // `.m` is Objective-C or MATLAB, neither of which we lex.
+            ("plot.m", "x = linspace(0, 1);\n", PlainText, Nothing),
+            // Shebangs.
+            ("run", "#!/usr/bin/env python3\nprint(1)\n", Python, Shebang),
+            ("build", "#!/bin/bash\nset -e\n", Shell, Shebang),
+            ("serve", "#!/usr/bin/env -S node --no-warnings\n", JavaScript, Shebang),
+            ("script", "#!/usr/bin/perl\n", PlainText, Shebang),
+            ("main", "#![allow(dead_code)]\nfn main() {}\n", Rust, Content),
+            // Modelines.
+            ("config", "# -*- mode: yaml -*-\nkey: value\n", Yaml, Modeline),
+            ("script", "/* -*- go -*- */\nx := 1\n", Go, Modeline),
+            ("tool", "; -*- mode: shell-script; indent-tabs-mode: nil -*-\n", Shell, Modeline),
+            ("deploy", "steps:\n  - run\n\n# vim: ft=yaml\n", Yaml, Modeline),
+            ("x", "a\nb\nc\nd\ne\nf\ng\nh\n// vim: set filetype=cpp ts=4 :\n", Cpp, Modeline),
+            ("x", "/* vi: syntax=javascript */\n", JavaScript, Modeline),
+            ("x", "navi: ft=python\n", PlainText, Nothing),
+            ("x", "# vim: ft=klingon\n", PlainText, Nothing),
+            // Guesses from the content.
+            ("", "package main\n\nimport \"fmt\"\n\nfunc main() {}\n", Go, Content),
+            ("", "package com.example;\n\npublic class App {}\n", Java, Content),
+            ("", "using System;\n\npublic class App {}\n", CSharp, Content),
+            ("", "#include <stdio.h>\n\nint main(void) {}\n", C, Content),
+            ("", "#include <iostream>\n\nint main() {}\n", Cpp, Content),
+            ("", "use std::io;\n\nfn main() {}\n", Rust, Content),
+            ("", "import React from 'react';\n", JavaScript, Content),
+            ("", "import os\n\ndef main():\n    pass\n", Python, Content),
+            ("", "SELECT id\nFROM users;\n", Sql, Content),
+            ("", "---\nkey: value\n", Yaml, Content),
+            ("", "= Title\nJane Doe\n\n----\nfn main() {}\n----\n", AsciiDoc, Content),
+            ("", "# Title\n\n```rust\nfn main() {}\n```\n", Markdown, Content),
+            ("", "<?php echo 1;\n", PlainText, Content),
+            ("", "\u{feff}<?xml version=\"1.0\"?>\n<a/>\n", Xml, Content),
+            ("", "<!DOCTYPE html>\n<html></html>\n", Html, Content),
+            ("", "{\n  \"name\": \"edit\"\n}\n", Json, Content),
+            ("", "{ foo }\n", PlainText, Nothing),
+            ("", "", PlainText, Nothing),
+        ];
+        for &(name, text, language, by) in cases {
+            let detection = detect_language(name, text.as_bytes());
+            assert_eq!(detection, Detection { language, by }, "{name:?}: {text:?}");
+        }
+        assert!(cases.len() >= 40);
+        assert!(Detection { language: Go, by: Extension }.by.confidence() > Content.confidence());
+    }
+
+    #[test]
+    fn test_fixtures() {
+        // Every fixture is detected by its extension, and the guesses from its content are
+        // either right or none at all.
+        let dir = concat!(env!("CARGO_MANIFEST_DIR"), "/../../syntax-tests");
+        for entry in std::fs::read_dir(dir).unwrap() {
+            let path = entry.unwrap().path();
+            let name = path.file_name().unwrap().to_str().unwrap();
+            let text = std::fs::read(&path).unwrap();
+            let language = Language::from_extension(name.rsplit('.').next().unwrap());
+            // Like `.tokens` files of the expected tokens, or PowerShell, which we don't lex.
+            if language == Language::PlainText {
+                continue;
+            }
+            let detection = detect_language(name, &text);
+            assert_eq!(detection, Detection { language, by: DetectedBy::Extension }, "{name}");
+
+            let guess = detect_language("", &text);
+            assert!(
+                guess.language == language || guess.by == DetectedBy::Nothing,
+                "{name} looks like {:?}",
+                guess.language,
+            );
+        }
+    }
+}
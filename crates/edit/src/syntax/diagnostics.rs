@@ -0,0 +1,206 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//! Constructs which are lexically recognizable as invalid or deprecated.
+//!
+//! Only what can be detected reliably from the tokens is flagged, by attaching a
+//! [`TokenPayload::Invalid`] or [`TokenPayload::Deprecated`]. Checks which flag valid
+//! but discouraged code are opt-in through [`DiagnosticOptions`], so that the default
+//! output stays neutral. Which languages are checked is declared in
+//! [`GrammarMetadata::diagnostics`](crate::syntax::GrammarMetadata::diagnostics).
+
+use crate::syntax::{Language, Token, TokenKind, TokenPayload};
+
+/// Opt-in checks for constructs which are valid, but discouraged.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub struct DiagnosticOptions {
+    /// Flag JavaScript's `var` declarations as deprecated, since `let` and `const` replace them.
+    pub javascript_var: bool,
+    /// Treat JSON as strict JSON and flag trailing commas as invalid. They're allowed in
+    /// JSON with comments, which many configuration files use.
+    pub strict_json: bool,
+}
+
+/// Flags invalid and deprecated constructs in `tokens`. See [`GrammarMetadata::diagnostics`].
+///
+/// [`GrammarMetadata::diagnostics`]: crate::syntax::GrammarMetadata::diagnostics
+pub type DiagnosticHook = fn(text: &[u8], tokens: &mut [Token], options: DiagnosticOptions);
+
+/// Flag the invalid and deprecated constructs in `tokens`, which must be the tokens of `text`
+/// in `language`. Tokens which already carry a payload aren't flagged.
+pub fn flag_diagnostics(
+    language: Language,
+    text: &[u8],
+    tokens: &mut [Token],
+    options: DiagnosticOptions,
+) {
+    if let Some(hook) = language.metadata().diagnostics {
+        hook(text, tokens, options);
+    }
+}
+
+/// Diagnostic hook for Python: Python 2 `print` statements like `print "hello"`.
+pub fn python_diagnostics(text: &[u8], tokens: &mut [Token], _options: DiagnosticOptions) {
+    let significant = significant(tokens);
+    for (n, &i) in significant.iter().enumerate() {
+        if &text[tokens[i].span.clone()] != b"print" || tokens[i].payload.is_some() {
+            continue;
+        }
+        // The statement starts a line, or follows a `:` or `;` on the same line.
+        let starts_statement = n.checked_sub(1).is_none_or(|p| {
+            let prev = &tokens[significant[p]];
+            has_newline(text, prev.span.end, tokens[i].span.start)
+                || matches!(&text[prev.span.clone()], b":" | b";")
+        });
+        let operand = significant.get(n + 1).is_some_and(|&j| {
+            let next = &tokens[j];
+            !has_newline(text, tokens[i].span.end, next.span.start)
+                && (next.kind.is_literal() || next.kind.is_identifier())
+        });
+        if starts_statement && operand {
+            tokens[i].payload = Some(TokenPayload::Deprecated);
+        }
+    }
+}
+
+/// Diagnostic hook for YAML: tabs in indentation, which YAML doesn't allow.
+///
+/// The lines of block scalars (`|` and `>`) are inside their string token,
+/// so tabs after their indentation aren't looked at.
+pub fn yaml_diagnostics(text: &[u8], tokens: &mut [Token], _options: DiagnosticOptions) {
+    for i in 0..tokens.len() {
+        let span = tokens[i].span.clone();
+        if span.start != 0 && text[span.start - 1] != b'\n' {
+            continue;
+        }
+        // Blank lines may be indented with anything.
+        if tokens.get(i + 1).is_none_or(|t| text[t.span.clone()].starts_with(b"\n")) {
+            continue;
+        }
+        if tokens[i].kind == TokenKind::Whitespace
+            && text[span].contains(&b'\t')
+            && tokens[i].payload.is_none()
+        {
+            tokens[i].payload = Some(TokenPayload::Invalid);
+        }
+    }
+}
+
+/// Diagnostic hook for JSON: trailing commas, if [`DiagnosticOptions::strict_json`] is set.
+pub fn json_diagnostics(text: &[u8], tokens: &mut [Token], options: DiagnosticOptions) {
+    if !options.strict_json {
+        return;
+    }
+    let significant = significant(tokens);
+    for pair in significant.windows(2) {
+        let (comma, next) = (pair[0], pair[1]);
+        if tokens[comma].kind == TokenKind::JsonComma
+            && matches!(&text[tokens[next].span.clone()], b"}" | b"]")
+            && tokens[comma].payload.is_none()
+        {
+            tokens[comma].payload = Some(TokenPayload::Invalid);
+        }
+    }
+}
+
+/// Diagnostic hook for JavaScript: `var`, if [`DiagnosticOptions::javascript_var`] is set.
+pub fn javascript_diagnostics(text: &[u8], tokens: &mut [Token], options: DiagnosticOptions) {
+    if !options.javascript_var {
+        return;
+    }
+    for token in tokens.iter_mut() {
+        if token.kind == TokenKind::KeywordStorage
+            && &text[token.span.clone()] == b"var"
+            && token.payload.is_none()
+        {
+            token.payload = Some(TokenPayload::Deprecated);
+        }
+    }
+}
+
+/// The indices of the tokens which aren't whitespace or comments.
+fn significant(tokens: &[Token]) -> Vec<usize> {
+    (0..tokens.len()).filter(|&i| !tokens[i].kind.is_trivia() && !tokens[i].is_empty()).collect()
+}
+
+fn has_newline(text: &[u8], start: usize, end: usize) -> bool {
+    text[start..end].contains(&b'\n')
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::syntax::LexerRegistry;
+
+    /// Returns the text of the flagged tokens, prefixed with `!` if invalid and `~` if deprecated.
+    fn flagged(language: Language, text: &[u8], options: DiagnosticOptions) -> Vec<String> {
+        let mut tokens = LexerRegistry::get_lexer(language).tokenize(text);
+        flag_diagnostics(language, text, &mut tokens, options);
+        tokens
+            .iter()
+            .filter_map(|t| {
+                let prefix = match t.payload {
+                    Some(TokenPayload::Invalid) => '!',
+                    Some(TokenPayload::Deprecated) => '~',
+                    _ => return None,
+                };
+                Some(format!("{prefix}{}", String::from_utf8_lossy(&text[t.span.clone()])))
+            })
+            .collect()
+    }
+
+    const ALL: DiagnosticOptions = DiagnosticOptions { javascript_var: true, strict_json: true };
+
+    #[test]
+    fn test_fixtures_are_neutral() {
+        let fixtures: &[(Language, &[u8])] = &[
+            (Language::Python, include_bytes!("../../../../syntax-tests/test_syntax.py")),
+            (Language::Yaml, include_bytes!("../../../../syntax-tests/test_syntax.yaml")),
+            (Language::Json, include_bytes!("../../../../syntax-tests/test_syntax.json")),
+            (Language::JavaScript, include_bytes!("../../../../syntax-tests/test_syntax.js")),
+        ];
+        for &(language, text) in fixtures {
+            let options = DiagnosticOptions::default();
+            assert_eq!(flagged(language, text, options), Vec::<String>::new(), "{language:?}");
+        }
+    }
+
+    #[test]
+    fn test_python_print() {
+        let text = b"print \"hello\"\nif x: print x\nprint(x)\nprint\nprint = 1\nf.print \"x\"\n# print x\n";
+        assert_eq!(flagged(Language::Python, text, ALL), ["~print", "~print"]);
+    }
+
+    #[test]
+    fn test_yaml_tabs() {
+        let text = b"a:\n\tb: 1\nc:\n  d: 1\n  \te: 2\nf:\tg\n";
+        assert_eq!(flagged(Language::Yaml, text, ALL), ["!\t", "!  \t"]);
+
+        // Tabs after the indentation of a block scalar are content.
+        let text = b"script: |\n  echo\n  \tindented\nnext:\n\tx: 1\n";
+        assert_eq!(flagged(Language::Yaml, text, ALL), ["!\t"]);
+        let text = b"script: >-\n    a\n    \tb\n";
+        assert_eq!(flagged(Language::Yaml, text, ALL), Vec::<String>::new());
+    }
+
+    #[test]
+    fn test_json_trailing_commas() {
+        let text = b"{\"a\": [1, 2,], \"b\": {\"c\": 1, /* c */ }, \"d\": 3}";
+        assert_eq!(flagged(Language::Json, text, ALL), ["!,", "!,"]);
+        assert_eq!(
+            flagged(Language::Json, text, DiagnosticOptions::default()),
+            Vec::<String>::new()
+        );
+        let text = include_bytes!("../../../../syntax-tests/test_syntax.json");
+        assert_eq!(flagged(Language::Json, text, ALL), Vec::<String>::new());
+    }
+
+    #[test]
+    fn test_javascript_var() {
+        let text = include_bytes!("../../../../syntax-tests/test_syntax.js");
+        let flags = flagged(Language::JavaScript, text, ALL);
+        assert!(!flags.is_empty() && flags.iter().all(|f| f == "~var"), "{flags:?}");
+        let text = b"let variable = 1; const v = 'var';";
+        assert_eq!(flagged(Language::JavaScript, text, ALL), Vec::<String>::new());
+    }
+}
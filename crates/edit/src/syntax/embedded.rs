@@ -0,0 +1,362 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//! Embedded regions: lexing a part of a document with another language.
+//!
+//! Markdown code fences, HTML `<script>` and `<style>` elements, heredocs,
+//! front matter and template overlays are all the same problem: a slice of
+//! the document has to be handed to a different lexer and its tokens spliced
+//! back into the host's token stream. Grammars describe such a slice with an
+//! [`EmbeddedRegion`] and let it do the rest:
+//!
+//! ```ignore
+//! let region = EmbeddedRegion::new(Language::JavaScript, pos, RegionEnd::Before(b"</script"));
+//! pos = region.tokenize(text, &mut tokens);
+//! ```
+//!
+//! The region takes care of
+//! - finding where it ends: at a fixed offset, before a terminator, or before a terminator line,
+//! - stripping a per-line prefix (`> ` in block quotes, `//` in comments) so the inner lexer never sees it,
+//! - carving out interpolations (`{{ ... }}`, `${ ... }`) which the host tokenizes itself,
+//! - mapping the inner tokens back into document offsets, and
+//! - limiting how deeply regions may nest ([`MAX_EMBED_DEPTH`]).
+//!
+//! Lexers always see the whole region at once, so multi-line constructs inside of it
+//! (block comments, template literals, ...) work just like they do at the top level.
+
+use std::cell::Cell;
+use std::ops::Range;
+
+use crate::syntax::{Language, LexerRegistry, Token, TokenKind};
+
+/// How deeply embedded regions may nest before they're emitted as plain fallback tokens.
+pub const MAX_EMBED_DEPTH: usize = 4;
+
+thread_local! {
+    static DEPTH: Cell<usize> = const { Cell::new(0) };
+}
+
+/// Where an [`EmbeddedRegion`] ends.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum RegionEnd<'a> {
+    /// At a fixed byte offset.
+    At(usize),
+    /// Right before the first occurrence of the terminator (ASCII case-insensitive).
+    Before(&'a [u8]),
+    /// At the start of the first line that begins with the terminator.
+    /// Leading whitespace and the line prefix (if any) are ignored.
+    BeforeLine(&'a [u8]),
+}
+
+/// A part of a document that is lexed with another language.
+#[derive(Debug, Clone)]
+pub struct EmbeddedRegion<'a> {
+    language: Language,
+    start: usize,
+    end: RegionEnd<'a>,
+    fallback: TokenKind,
+    line_prefix: Option<(&'a [u8], TokenKind)>,
+    interpolation: Option<(&'a [u8], InterpolationEnd<'a>)>,
+}
+
+/// Where an interpolation ends.
+#[derive(Debug, Clone, Copy)]
+enum InterpolationEnd<'a> {
+    /// Right after the first occurrence of the delimiter, or at the end of the region.
+    After(&'a [u8]),
+    /// Where the function says, given the text, the start of the interpolation and the end of the region.
+    Find(fn(&[u8], usize, usize) -> usize),
+}
+
+/// A piece of the region in document coordinates.
+enum Piece {
+    /// Text seen by the inner lexer. `inner` is the offset in the inner text.
+    Inner { range: Range<usize>, inner: usize },
+    /// A stripped line prefix.
+    Prefix(Range<usize>),
+    /// An interpolation, including its delimiters.
+    Interpolation(Range<usize>),
+}
+
+impl<'a> EmbeddedRegion<'a> {
+    /// Create a region of `language` that starts at byte offset `start`.
+    pub fn new(language: Language, start: usize, end: RegionEnd<'a>) -> Self {
+        Self {
+            language,
+            start,
+            end,
+            fallback: TokenKind::Identifier,
+            line_prefix: None,
+            interpolation: None,
+        }
+    }
+
+    /// Set the token kind used for the region if it can't be lexed, which is the case
+    /// for plain text and once [`MAX_EMBED_DEPTH`] is reached. Defaults to [`TokenKind::Identifier`].
+    pub fn fallback(mut self, kind: TokenKind) -> Self {
+        self.fallback = kind;
+        self
+    }
+
+    /// Strip `prefix` from the start of every line after the first one.
+    /// Each stripped prefix is emitted as a token of the given kind.
+    pub fn line_prefix(mut self, prefix: &'a [u8], kind: TokenKind) -> Self {
+        self.line_prefix = Some((prefix, kind));
+        self
+    }
+
+    /// Carve out interpolations which start with `open` and end with `close`.
+    /// They're hidden from the inner lexer and tokenized by the host instead.
+    pub fn interpolation(mut self, open: &'a [u8], close: &'a [u8]) -> Self {
+        self.interpolation = Some((open, InterpolationEnd::After(close)));
+        self
+    }
+
+    /// Like [`EmbeddedRegion::interpolation`], for interpolations whose end depends on
+    /// what's in them, like strings containing the closing delimiter. `end` is called
+    /// with the text, the offset of `open` and the end of the region, and returns the
+    /// end of the interpolation, which is clamped to the region.
+    pub fn interpolation_with(
+        mut self,
+        open: &'a [u8],
+        end: fn(text: &[u8], start: usize, limit: usize) -> usize,
+    ) -> Self {
+        self.interpolation = Some((open, InterpolationEnd::Find(end)));
+        self
+    }
+
+    /// The language of the region.
+    pub fn language(&self) -> Language {
+        self.language
+    }
+
+    /// Compute the byte range the region covers in `text`.
+    pub fn range(&self, text: &[u8]) -> Range<usize> {
+        let start = self.start.min(text.len());
+        let end = match self.end {
+            RegionEnd::At(end) => end.clamp(start, text.len()),
+            RegionEnd::Before(terminator) => find_ignore_ascii_case(text, start, terminator),
+            RegionEnd::BeforeLine(terminator) => self.find_terminator_line(text, start, terminator),
+        };
+        start..end
+    }
+
+    /// Tokenize the region, append the tokens to `tokens` and return the offset at which it ends.
+    ///
+    /// Interpolations are emitted as a single [`TokenKind::Escape`] token each.
+    /// Use [`EmbeddedRegion::tokenize_with`] to tokenize them yourself.
+    pub fn tokenize(&self, text: &[u8], tokens: &mut Vec<Token>) -> usize {
+        self.tokenize_with(text, tokens, |range, tokens| {
+            tokens.push(Token::new(TokenKind::Escape, range));
+        })
+    }
+
+    /// Same as [`EmbeddedRegion::tokenize`], but calls `interpolation` with the
+    /// range of each interpolation (including its delimiters) so the host can tokenize it.
+    pub fn tokenize_with(
+        &self,
+        text: &[u8],
+        tokens: &mut Vec<Token>,
+        mut interpolation: impl FnMut(Range<usize>, &mut Vec<Token>),
+    ) -> usize {
+        let range = self.range(text);
+        if range.is_empty() {
+            return range.end;
+        }
+
+        let pieces = self.split(text, range.clone());
+        let depth = DEPTH.get();
+        let lexable = self.language != Language::PlainText && depth < MAX_EMBED_DEPTH;
+
+        // Collect the text the inner lexer gets to see. In the common case of a region
+        // without prefixes and interpolations that's simply a slice of the document.
+        let mut inner_tokens = Vec::new();
+        if lexable {
+            let lexer = LexerRegistry::get_lexer(self.language);
+            DEPTH.set(depth + 1);
+            inner_tokens = match pieces.as_slice() {
+                [Piece::Inner { range, .. }] => lexer.tokenize(&text[range.clone()]),
+                _ => {
+                    let mut inner_text = Vec::with_capacity(range.len());
+                    for piece in &pieces {
+                        if let Piece::Inner { range, .. } = piece {
+                            inner_text.extend_from_slice(&text[range.clone()]);
+                        }
+                    }
+                    lexer.tokenize(&inner_text)
+                }
+            };
+            DEPTH.set(depth);
+        }
+
+        let mut next = 0;
+        for piece in pieces {
+            match piece {
+                Piece::Inner { range, inner } if lexable => {
+                    // Map the inner tokens back into document coordinates. Tokens that
+                    // span across a stripped prefix or interpolation are split in two.
+                    let inner_end = inner + range.len();
+                    while next < inner_tokens.len() && inner_tokens[next].span.end <= inner {
+                        next += 1;
+                    }
+                    while next < inner_tokens.len() && inner_tokens[next].span.start < inner_end {
+                        let token = &inner_tokens[next];
+                        let beg = token.span.start.max(inner) - inner + range.start;
+                        let end = token.span.end.min(inner_end) - inner + range.start;
+                        tokens.push(Token {
+                            kind: token.kind,
+                            span: beg..end,
+                            payload: token.payload,
+                            scopes: token.scopes,
+                        });
+                        if token.span.end > inner_end {
+                            break;
+                        }
+                        next += 1;
+                    }
+                }
+                Piece::Inner { range, .. } => tokens.push(Token::new(self.fallback, range)),
+                Piece::Prefix(range) => {
+                    let kind = self.line_prefix.map_or(self.fallback, |(_, kind)| kind);
+                    tokens.push(Token::new(kind, range));
+                }
+                Piece::Interpolation(range) => interpolation(range, tokens),
+            }
+        }
+
+        range.end
+    }
+
+    /// Split the region into the pieces the inner lexer sees and the ones it doesn't.
+    fn split(&self, text: &[u8], range: Range<usize>) -> Vec<Piece> {
+        let mut pieces = Vec::new();
+        let mut inner = 0;
+        let mut beg = range.start;
+        let mut pos = range.start;
+
+        let mut push_inner = |pieces: &mut Vec<Piece>, beg: usize, end: usize| {
+            if beg < end {
+                pieces.push(Piece::Inner { range: beg..end, inner });
+                inner += end - beg;
+            }
+        };
+
+        while pos < range.end {
+            let rest = &text[pos..range.end];
+
+            if let Some((prefix, _)) = self.line_prefix
+                && pos > range.start
+                && text[pos - 1] == b'\n'
+                && !prefix.is_empty()
+                && rest.starts_with(prefix)
+            {
+                push_inner(&mut pieces, beg, pos);
+                pieces.push(Piece::Prefix(pos..pos + prefix.len()));
+                pos += prefix.len();
+                beg = pos;
+                continue;
+            }
+
+            if let Some((open, close)) = self.interpolation
+                && !open.is_empty()
+                && rest.starts_with(open)
+            {
+                push_inner(&mut pieces, beg, pos);
+                let body = pos + open.len();
+                let end = match close {
+                    InterpolationEnd::After(close) => text[body..range.end]
+                        .windows(close.len().max(1))
+                        .position(|w| w == close)
+                        .map_or(range.end, |i| body + i + close.len()),
+                    InterpolationEnd::Find(find) => {
+                        find(text, pos, range.end).clamp(body, range.end)
+                    }
+                };
+                pieces.push(Piece::Interpolation(pos..end));
+                pos = end;
+                beg = pos;
+                continue;
+            }
+
+            pos += 1;
+        }
+
+        push_inner(&mut pieces, beg, range.end);
+        pieces
+    }
+
+    /// Find the start of the first line at or after `start` which begins with `terminator`.
+    fn find_terminator_line(&self, text: &[u8], start: usize, terminator: &[u8]) -> usize {
+        let mut line = start;
+
+        while line < text.len() {
+            if line == 0 || text[line - 1] == b'\n' {
+                let mut pos = line;
+                if let Some((prefix, _)) = self.line_prefix
+                    && text[pos..].starts_with(prefix)
+                {
+                    pos += prefix.len();
+                }
+                while pos < text.len() && matches!(text[pos], b' ' | b'\t') {
+                    pos += 1;
+                }
+                if text[pos..].starts_with(terminator) {
+                    return line;
+                }
+            }
+
+            match text[line..].iter().position(|&b| b == b'\n') {
+                Some(i) => line += i + 1,
+                None => break,
+            }
+        }
+
+        text.len()
+    }
+}
+
+/// Find `needle` in `text` starting at `start`, ignoring ASCII case.
+/// Returns `text.len()` if it isn't found.
+fn find_ignore_ascii_case(text: &[u8], start: usize, needle: &[u8]) -> usize {
+    if needle.is_empty() {
+        return start;
+    }
+    text[start..]
+        .windows(needle.len())
+        .position(|w| w.eq_ignore_ascii_case(needle))
+        .map_or(text.len(), |i| start + i)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_region_end_before() {
+        let text = b"<script>let x;</SCRIPT>";
+        let region = EmbeddedRegion::new(Language::JavaScript, 8, RegionEnd::Before(b"</script"));
+        assert_eq!(region.range(text), 8..14);
+    }
+
+    #[test]
+    fn test_region_end_before_line() {
+        let text = b"```go\nx := \"```\"\n  ```\nafter";
+        let region = EmbeddedRegion::new(Language::Go, 6, RegionEnd::BeforeLine(b"```"));
+        assert_eq!(region.range(text), 6..17);
+
+        // Unterminated regions extend to the end of the document.
+        let region = EmbeddedRegion::new(Language::Go, 6, RegionEnd::BeforeLine(b"~~~"));
+        assert_eq!(region.range(text), 6..text.len());
+    }
+
+    #[test]
+    fn test_region_plain_text_fallback() {
+        let text = b"hello";
+        let mut tokens = Vec::new();
+        let end = EmbeddedRegion::new(Language::PlainText, 0, RegionEnd::At(5))
+            .fallback(TokenKind::MarkdownCode)
+            .tokenize(text, &mut tokens);
+        assert_eq!(end, 5);
+        assert_eq!(tokens, vec![Token::new(TokenKind::MarkdownCode, 0..5)]);
+    }
+}
@@ -0,0 +1,439 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//! Escape sequences inside string and character literals.
+//!
+//! The lexers produce a single token per literal. [`split_escapes`] splits the escape
+//! sequences out of them as [`TokenKind::Escape`] tokens, while the text around them stays
+//! a token of the literal's kind. Which literals have escapes is declared in
+//! [`GrammarMetadata::escapes`](crate::syntax::GrammarMetadata::escapes).
+//!
+//! In languages with format verbs, like Go, the verbs in string literals are split out the
+//! same way, as [`TokenKind::FormatSpecifier`] tokens.
+
+use std::ops::Range;
+
+use crate::syntax::lexer::char_len;
+use crate::syntax::{Language, Token, TokenKind, TokenPayload};
+
+/// Split the escape sequences out of the string and character literals in `tokens`.
+///
+/// An escape is a backslash followed by a single character, or by a code point like
+/// `\x41`, `\u00e9`, `\U0001F600`, `\u{1F600}`, `\N{DASH}` or `\101`. Raw strings are skipped.
+/// If the language only accepts some escapes, see
+/// [`EscapeRules::single`](crate::syntax::EscapeRules::single), the others, like `\q` or `\x4`,
+/// get a [`TokenPayload::Invalid`].
+///
+/// Format verbs like `%d`, `%-8.2f`, `%[1]v` and the literal percent `%%` are split out of
+/// string literals if [`EscapeRules::format_verbs`](crate::syntax::EscapeRules::format_verbs)
+/// is set. A `%` followed by a letter that isn't a verb, like `%y`, gets a
+/// [`TokenPayload::Invalid`]. A `%` that isn't followed by a letter at all stays text.
+pub fn split_escapes(language: Language, text: &[u8], tokens: &mut Vec<Token>) {
+    let Some(rules) = language.metadata().escapes else {
+        return;
+    };
+    let mut result: Option<Vec<Token>> = None;
+    // Whether the last literal is raw, and each one whose interpolation is open, so that
+    // the rest of a raw literal after an interpolation, like in `rf"\d{n}\d"`, is raw too.
+    let mut raw = false;
+    let mut interrupted = Vec::new();
+    let closes = |t: &Token| {
+        t.kind == TokenKind::Interpolation && matches!(text[t.span.end - 1], b'}' | b')')
+    };
+
+    for (i, token) in tokens.iter().enumerate() {
+        if token.kind == TokenKind::Interpolation {
+            if closes(token) {
+                raw = interrupted.pop().unwrap_or_default();
+            } else {
+                interrupted.push(raw);
+            }
+        }
+        let escapes = match token.kind {
+            TokenKind::String | TokenKind::Char if token.payload.is_none() => {
+                // Some lexers emit prefixes like Python's `r` as a token of their own.
+                let start = match i.checked_sub(1).map(|p| &tokens[p]) {
+                    Some(prev)
+                        if prev.span.end == token.span.start
+                            && text[prev.span.clone()].iter().all(u8::is_ascii_alphanumeric) =>
+                    {
+                        prev.span.start
+                    }
+                    _ => token.span.start,
+                };
+                let s = &text[start..token.span.end];
+                if !i.checked_sub(1).is_some_and(|p| closes(&tokens[p])) {
+                    raw = rules.raw.iter().any(|p| {
+                        s.len() >= p.len() && s[..p.len()].eq_ignore_ascii_case(p.as_bytes())
+                    });
+                }
+                let verbs = rules.format_verbs && token.kind == TokenKind::String;
+                if raw {
+                    Vec::new()
+                } else {
+                    find_escapes(text, token.span.clone(), rules.single, verbs)
+                }
+            }
+            _ => Vec::new(),
+        };
+        if escapes.is_empty() {
+            if let Some(result) = &mut result {
+                result.push(token.clone());
+            }
+            continue;
+        }
+
+        // Only copy the token stream once the first escape shows up.
+        let result = result.get_or_insert_with(|| {
+            let mut v = Vec::with_capacity(tokens.len() + 2 * escapes.len());
+            v.extend_from_slice(&tokens[..i]);
+            v
+        });
+        let rest = |range: Range<usize>| Token::new(token.kind, range).with_scopes(token.scopes);
+        let mut pos = token.span.start;
+        for escape in escapes {
+            if pos < escape.span.start {
+                result.push(rest(pos..escape.span.start));
+            }
+            pos = escape.span.end;
+            result.push(escape.with_scopes(token.scopes));
+        }
+        if pos < token.span.end {
+            result.push(rest(pos..token.span.end));
+        }
+    }
+
+    if let Some(result) = result {
+        *tokens = result;
+    }
+}
+
+/// The escape sequences in the string or character `literal` of `language`, relative to it,
+/// with the characters they stand for. Empty for raw strings and languages without escapes.
+///
+/// Escapes of bytes beyond ASCII, like `\xff`, and of names, like `\N{DASH}`, stand for `�`.
+pub(crate) fn decode_escapes(language: Language, literal: &[u8]) -> Vec<(Range<usize>, char)> {
+    let Some(rules) = language.metadata().escapes else {
+        return Vec::new();
+    };
+    let raw = rules
+        .raw
+        .iter()
+        .any(|p| literal.len() >= p.len() && literal[..p.len()].eq_ignore_ascii_case(p.as_bytes()));
+    if raw {
+        return Vec::new();
+    }
+
+    let code_point = |digits: &[u8], radix| {
+        let digits = std::str::from_utf8(digits).unwrap_or_default();
+        u32::from_str_radix(digits, radix).ok().and_then(char::from_u32)
+    };
+    find_escapes(literal, 0..literal.len(), None, false)
+        .into_iter()
+        .map(|escape| {
+            let body = &literal[escape.span.start + 1..escape.span.end];
+            let ch = match body {
+                [b'x', digits @ ..] => code_point(digits, 16).filter(char::is_ascii),
+                [b'0'..=b'7', ..] => code_point(body, 8).filter(char::is_ascii),
+                [b'N', b'{', ..] => None,
+                [b'u' | b'U', b'{', digits @ .., b'}'] => code_point(digits, 16),
+                [b'u' | b'U', digits @ ..] => code_point(digits, 16),
+                b"n" => Some('\n'),
+                b"t" => Some('\t'),
+                b"r" => Some('\r'),
+                b"a" => Some('\x07'),
+                b"b" => Some('\x08'),
+                b"f" => Some('\x0c'),
+                b"v" => Some('\x0b'),
+                b"\r\n" | b"\n" => Some('\n'),
+                s => std::str::from_utf8(s).ok().and_then(|s| s.chars().next()),
+            };
+            (escape.span, ch.unwrap_or(char::REPLACEMENT_CHARACTER))
+        })
+        .collect()
+}
+
+/// Find the escape sequences in `range`, and the format verbs if `verbs` is set, in order.
+fn find_escapes(text: &[u8], range: Range<usize>, single: Option<&str>, verbs: bool) -> Vec<Token> {
+    let mut escapes = Vec::new();
+    let mut pos = range.start;
+    while let Some(i) =
+        text[pos..range.end].iter().position(|&b| b == b'\\' || (verbs && b == b'%'))
+    {
+        let start = pos + i;
+        let rest = &text[start + 1..range.end];
+        pos = start + 1;
+        if text[start] == b'\\' {
+            pos = (pos + escape_len(rest)).min(range.end);
+            let escape = Token::new(TokenKind::Escape, start..pos);
+            let valid = single.is_none_or(|single| is_valid_escape(&text[start + 1..pos], single));
+            escapes.push(if valid { escape } else { escape.with_payload(TokenPayload::Invalid) });
+        } else if let Some((len, valid)) = verb_len(rest) {
+            pos += len;
+            let verb = Token::new(TokenKind::FormatSpecifier, start..pos);
+            escapes.push(if valid { verb } else { verb.with_payload(TokenPayload::Invalid) });
+        }
+    }
+    escapes
+}
+
+/// Returns the length of the format verb at the start of `s`, after its `%`, and whether
+/// it's one of the verbs of Go's `fmt`. `None` if there's no verb letter after the flags,
+/// argument indexes, width and precision.
+fn verb_len(s: &[u8]) -> Option<(usize, bool)> {
+    if s.first() == Some(&b'%') {
+        return Some((1, true));
+    }
+    // An argument index like `[1]`.
+    let index = |len: usize| match s.get(len..) {
+        Some([b'[', rest @ ..]) => {
+            let digits = rest.iter().take_while(|b| b.is_ascii_digit()).count();
+            if rest.get(digits) == Some(&b']') { 2 + digits } else { 0 }
+        }
+        _ => 0,
+    };
+    // A width or precision, which is a number or a `*` with an optional index.
+    let number = |len: usize| {
+        let len = len + index(len);
+        match s.get(len) {
+            Some(b'*') => len + 1,
+            _ => len + s[len.min(s.len())..].iter().take_while(|b| b.is_ascii_digit()).count(),
+        }
+    };
+
+    let mut len = s.iter().take_while(|&&b| matches!(b, b'+' | b'-' | b'#' | b' ' | b'0')).count();
+    len = number(len);
+    if s.get(len) == Some(&b'.') {
+        len = number(len + 1);
+    }
+    len += index(len);
+    let verb = *s.get(len).filter(|b| b.is_ascii_alphabetic())?;
+    Some((len + 1, b"vTtbcdoOqxXUeEfFgGspw".contains(&verb)))
+}
+
+/// Returns the length of the escape sequence at the start of `s`, after its backslash.
+fn escape_len(s: &[u8]) -> usize {
+    let digits = |from: usize, max: usize, f: fn(&u8) -> bool| {
+        from + s.get(from..).unwrap_or_default().iter().take(max).take_while(|b| f(b)).count()
+    };
+    match s {
+        [] => 0,
+        [b'u' | b'N', b'{', rest @ ..] => {
+            let name = rest.iter().take_while(|&&b| b.is_ascii_alphanumeric() || b == b' ');
+            let len = 2 + name.count();
+            len + (s.get(len) == Some(&b'}')) as usize
+        }
+        [b'u', ..] => digits(1, 4, u8::is_ascii_hexdigit),
+        [b'U', ..] => digits(1, 8, u8::is_ascii_hexdigit),
+        [b'x', ..] => digits(1, 2, u8::is_ascii_hexdigit),
+        [b'0'..=b'7', ..] => digits(0, 3, |b| matches!(b, b'0'..=b'7')),
+        [b'\r', b'\n', ..] => 2,
+        _ => char_len(s, 0),
+    }
+}
+
+/// Whether the escape `s`, after its backslash, is valid in a language whose
+/// single-character escapes are `single`.
+fn is_valid_escape(s: &[u8], single: &str) -> bool {
+    let code_point = |digits: &[u8]| {
+        let digits = std::str::from_utf8(digits).unwrap_or_default();
+        u32::from_str_radix(digits, 16).ok().and_then(char::from_u32).is_some()
+    };
+    match s {
+        [b'x', digits @ ..] => digits.len() == 2,
+        [b'u', digits @ ..] => digits.len() == 4 && code_point(digits),
+        [b'U', digits @ ..] => digits.len() == 8 && code_point(digits),
+        // Octal escapes are bytes, so `\377` is the largest.
+        [b'0'..=b'3', ..] => s.len() == 3,
+        [b'4'..=b'7', ..] => false,
+        &[b] => single.as_bytes().contains(&b),
+        _ => false,
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::syntax::LexerRegistry;
+
+    /// Returns the text of the tokens of `text`, with escapes wrapped in `[...]` and format
+    /// verbs in `{...}`. Invalid ones start with a `!`, like `[!\q]`.
+    fn split(language: Language, text: &str) -> Vec<String> {
+        let mut tokens = LexerRegistry::get_lexer(language).tokenize(text.as_bytes());
+        split_escapes(language, text.as_bytes(), &mut tokens);
+        tokens
+            .iter()
+            .filter(|t| t.kind != TokenKind::Whitespace)
+            .map(|t| match t.kind {
+                TokenKind::Escape if t.payload == Some(TokenPayload::Invalid) => {
+                    format!("[!{}]", &text[t.span.clone()])
+                }
+                TokenKind::Escape => format!("[{}]", &text[t.span.clone()]),
+                TokenKind::FormatSpecifier if t.payload == Some(TokenPayload::Invalid) => {
+                    format!("{{!{}}}", &text[t.span.clone()])
+                }
+                TokenKind::FormatSpecifier => format!("{{{}}}", &text[t.span.clone()]),
+                _ => text[t.span.clone()].to_string(),
+            })
+            .collect()
+    }
+
+    #[test]
+    fn test_go_escapes() {
+        assert_eq!(
+            split(Language::Go, r#"s := "😀\U0001F600\u263A\x41\101\n\"""#),
+            [
+                "s",
+                ":=",
+                "\"😀",
+                r"[\U0001F600]",
+                r"[\u263A]",
+                r"[\x41]",
+                r"[\101]",
+                r"[\n]",
+                r#"[\"]"#,
+                "\""
+            ]
+        );
+        assert_eq!(
+            split(Language::Go, r"r := '\U0001F600'"),
+            ["r", ":=", "'", r"[\U0001F600]", "'"]
+        );
+        // Raw strings don't have escapes.
+        assert_eq!(split(Language::Go, r"s := `\n`"), ["s", ":=", r"`\n`"]);
+        // Unknown escapes, missing digits and values that aren't code points are invalid,
+        // but the string goes on after them.
+        assert_eq!(
+            split(Language::Go, r#""\q\x4g\400\0\uD800\U00110000\a\'""#),
+            [
+                "\"",
+                r"[!\q]",
+                r"[!\x4]",
+                "g",
+                r"[!\400]",
+                r"[!\0]",
+                r"[!\uD800]",
+                r"[!\U00110000]",
+                r"[\a]",
+                r"[\']",
+                "\""
+            ]
+        );
+        // Other languages accept any escape.
+        assert_eq!(split(Language::C, r#""\q\0""#), ["\"", r"[\q]", r"[\0]", "\""]);
+    }
+
+    #[test]
+    fn test_go_format_verbs() {
+        assert_eq!(
+            split(Language::Go, r#""open %q: %w\n""#),
+            ["\"open ", "{%q}", ": ", "{%w}", r"[\n]", "\""]
+        );
+        assert_eq!(
+            split(Language::Go, r#""%+v %#v %08.2f %-*d %[2]*[1]d %.[3]s""#),
+            [
+                "\"",
+                "{%+v}",
+                " ",
+                "{%#v}",
+                " ",
+                "{%08.2f}",
+                " ",
+                "{%-*d}",
+                " ",
+                "{%[2]*[1]d}",
+                " ",
+                "{%.[3]s}",
+                "\""
+            ]
+        );
+        // `%%` is a literal percent sign, and `%y` isn't a verb of `fmt`.
+        assert_eq!(split(Language::Go, r#""100%% %y""#), ["\"100", "{%%}", " ", "{!%y}", "\""]);
+        // A `%` that isn't followed by a letter isn't a verb.
+        assert_eq!(split(Language::Go, r#""50%, 1%""#), [r#""50%, 1%""#]);
+        // Raw strings, runes and other languages don't have verbs.
+        assert_eq!(split(Language::Go, r"s := `%d`"), ["s", ":=", "`%d`"]);
+        assert_eq!(split(Language::Go, "r := '%'"), ["r", ":=", "'%'"]);
+        assert_eq!(split(Language::C, r#""%d\n""#), ["\"%d", r"[\n]", "\""]);
+    }
+
+    #[test]
+    fn test_go_fixture_verbs() {
+        let text = include_str!("../../../../syntax-tests/test_syntax.go");
+        let mut tokens = LexerRegistry::get_lexer(Language::Go).tokenize(text.as_bytes());
+        split_escapes(Language::Go, text.as_bytes(), &mut tokens);
+        let start = text.find("func report(").unwrap();
+        let verbs: Vec<_> = tokens
+            .iter()
+            .filter(|t| t.kind == TokenKind::FormatSpecifier && t.span.start > start)
+            .map(|t| (&text[t.span.clone()], t.payload == Some(TokenPayload::Invalid)))
+            .collect();
+
+        let valid = |v| (v, false);
+        assert_eq!(
+            verbs,
+            [
+                valid("%+v"),
+                valid("%#v"),
+                valid("%T"),
+                valid("%08.2f"),
+                valid("%%"),
+                valid("%-*d"),
+                valid("%[2]s"),
+                valid("%[1]q"),
+                valid("%6.[3]*[1]f"),
+                ("%y", true),
+                valid("%q"),
+                valid("%w"),
+            ]
+        );
+    }
+
+    #[test]
+    fn test_javascript_escapes() {
+        assert_eq!(
+            split(Language::JavaScript, r"'\u{1F600}\uD83D\uDE00\u{1F60'"),
+            ["'", r"[\u{1F600}]", r"[\uD83D]", r"[\uDE00]", r"[\u{1F60]", "'"]
+        );
+        // An escaped emoji is a single escape, not split in the middle of the character.
+        assert_eq!(split(Language::JavaScript, "`\\😀`"), ["`", "[\\😀]", "`"]);
+    }
+
+    #[test]
+    fn test_raw_strings() {
+        assert_eq!(
+            split(Language::Python, r#"b"\N{DASH}" r'\n' Rb"\n""#),
+            ["b", "\"", r"[\N{DASH}]", "\"", "r", r"'\n'", "Rb", r#""\n""#]
+        );
+        assert_eq!(
+            split(Language::Rust, r#"r"\n" '\u{1F600}'"#),
+            [r#"r"\n""#, "'", r"[\u{1F600}]", "'"]
+        );
+        assert_eq!(split(Language::CSharp, r#"@"C:\n""#), [r#"@"C:\n""#]);
+        assert_eq!(split(Language::Toml, r#"a = 'C:\n'"#), ["a", "=", r"'C:\n'"]);
+    }
+
+    #[test]
+    fn test_decode_escapes() {
+        let decode = |language, literal: &'static str| -> Vec<_> {
+            decode_escapes(language, literal.as_bytes())
+                .into_iter()
+                .map(|(span, ch)| (&literal[span], ch))
+                .collect()
+        };
+        assert_eq!(
+            decode(Language::Go, r#""\"\x41\101☺\n\xff\q""#),
+            [
+                (r#"\""#, '"'),
+                (r"\x41", 'A'),
+                (r"\101", 'A'),
+                (r"\n", '\n'),
+                (r"\xff", char::REPLACEMENT_CHARACTER),
+                (r"\q", 'q'),
+            ]
+        );
+        assert_eq!(decode(Language::Rust, r"'\u{1F600}'"), [(r"\u{1F600}", '😀')]);
+        assert_eq!(decode(Language::Python, r#"r"\n""#), []);
+        assert_eq!(decode(Language::Go, r"`\n`"), []);
+    }
+}
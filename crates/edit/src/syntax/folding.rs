@@ -0,0 +1,406 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//! Folding ranges computed from the token stream.
+//!
+//! There's no parser involved: brackets come from the [`BracketMatcher`], comments and
+//! strings are multi-line tokens, and everything else is line based. Which of these fold
+//! is declared per language in [`FoldingRules`], with a hook for languages like Python
+//! and YAML where structure is expressed through indentation.
+
+use crate::helpers::CoordType;
+use crate::syntax::lines::LineIndex;
+use crate::syntax::{BracketMatcher, FoldingRules, Language, Token, TokenKind, indent_width};
+
+/// What a [`FoldingRange`] folds.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum FoldKind {
+    /// A block, a multi-line string, a section or an explicit region.
+    Region,
+    /// A multi-line comment or a run of line comments.
+    Comment,
+    /// A run of import lines or an import block.
+    Imports,
+}
+
+impl FoldKind {
+    /// The name of the kind in the Language Server Protocol's `FoldingRangeKind`.
+    pub fn name(self) -> &'static str {
+        match self {
+            Self::Region => "region",
+            Self::Comment => "comment",
+            Self::Imports => "imports",
+        }
+    }
+}
+
+/// A range of lines that can be folded.
+///
+/// Lines are 0-based and inclusive. When folded, `start_line` stays visible
+/// and the lines after it up to and including `end_line` are hidden.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct FoldingRange {
+    pub start_line: usize,
+    pub end_line: usize,
+    pub kind: FoldKind,
+}
+
+/// Computes additional folding ranges for a language. See [`FoldingRules::hook`].
+pub type FoldingHook = fn(text: &[u8], tokens: &[Token], ranges: &mut Vec<FoldingRange>);
+
+/// Compute the folding ranges of `text`, given its `tokens` in `language`.
+///
+/// The ranges are sorted by their start line and nest properly:
+/// no two ranges start on the same line and no two ranges partially overlap.
+pub fn folding_ranges(language: Language, text: &[u8], tokens: &[Token]) -> Vec<FoldingRange> {
+    let rules = &language.metadata().folding;
+    let lines = LineIndex::new(text);
+    let mut ranges = Vec::new();
+    let push = |ranges: &mut Vec<FoldingRange>, start_line, end_line, kind| {
+        if end_line > start_line {
+            ranges.push(FoldingRange { start_line, end_line, kind });
+        }
+    };
+
+    if rules.brackets {
+        let matcher = BracketMatcher::new(language, text, tokens);
+        for pair in matcher.all_pairs() {
+            // Middle keywords split a pair into sections that fold separately, like `if`/`else`.
+            let mut open = &pair.open;
+            for close in pair.middle.iter().chain([&pair.close]) {
+                let start = lines.line_of(open.start);
+                let end = lines.line_of(close.start).saturating_sub(1);
+                let kind = if is_import_line(rules, text, tokens, &lines, start) {
+                    FoldKind::Imports
+                } else {
+                    FoldKind::Region
+                };
+                push(&mut ranges, start, end, kind);
+                open = close;
+            }
+        }
+    }
+
+    if rules.comments {
+        // Runs of comments which are alone on their line. Adjacent comment tokens, like a
+        // comment split around a link, form a single comment.
+        let mut run: Option<(usize, usize)> = None;
+        let mut i = 0;
+        while i < tokens.len() {
+            if !tokens[i].kind.is_comment() || tokens[i].is_empty() {
+                i += 1;
+                continue;
+            }
+            let span_start = tokens[i].span.start;
+            let mut span_end = tokens[i].span.end;
+            i += 1;
+            while i < tokens.len()
+                && tokens[i].kind.is_comment()
+                && tokens[i].span.start == span_end
+            {
+                span_end = tokens[i].span.end;
+                i += 1;
+            }
+            let start = lines.line_of(span_start);
+            let end = lines.line_of(span_end - 1);
+            if start != end {
+                push(&mut ranges, start, end, FoldKind::Comment);
+                continue;
+            }
+
+            let line = lines.range(start);
+            let alone = is_blank(&text[line.start..span_start])
+                && is_blank(&text[span_end..line.end])
+                && region_marker(rules, text, tokens, &lines, start).is_none();
+            match run {
+                Some((first, last)) if alone && last + 1 == start => run = Some((first, start)),
+                _ => {
+                    if let Some((first, last)) = run.take() {
+                        push(&mut ranges, first, last, FoldKind::Comment);
+                    }
+                    if alone {
+                        run = Some((start, start));
+                    }
+                }
+            }
+        }
+        if let Some((first, last)) = run {
+            push(&mut ranges, first, last, FoldKind::Comment);
+        }
+    }
+
+    if rules.strings {
+        // Adjacent string tokens (e.g. a string split around an escape) form a single string.
+        let mut i = 0;
+        while i < tokens.len() {
+            if !tokens[i].kind.is_string() || tokens[i].is_empty() {
+                i += 1;
+                continue;
+            }
+            let start = tokens[i].span.start;
+            let mut end = tokens[i].span.end;
+            i += 1;
+            while i < tokens.len() && tokens[i].kind.is_string() && tokens[i].span.start == end {
+                end = tokens[i].span.end;
+                i += 1;
+            }
+            push(&mut ranges, lines.line_of(start), lines.line_of(end - 1), FoldKind::Region);
+        }
+    }
+
+    if !rules.imports.is_empty() {
+        let mut line = 0;
+        while line < lines.count() {
+            if !is_import_line(rules, text, tokens, &lines, line) {
+                line += 1;
+                continue;
+            }
+            let first = line;
+            while line + 1 < lines.count() && is_import_line(rules, text, tokens, &lines, line + 1)
+            {
+                line += 1;
+            }
+            push(&mut ranges, first, line, FoldKind::Imports);
+            line += 1;
+        }
+    }
+
+    if rules.region_markers.is_some() {
+        let mut open = Vec::new();
+        for line in 0..lines.count() {
+            match region_marker(rules, text, tokens, &lines, line) {
+                Some(true) => open.push(line),
+                Some(false) => {
+                    if let Some(start) = open.pop() {
+                        push(&mut ranges, start, line, FoldKind::Region);
+                    }
+                }
+                None => {}
+            }
+        }
+    }
+
+    if rules.headings {
+        let headings: Vec<_> = tokens
+            .iter()
+            .filter(|t| t.kind == TokenKind::MarkdownHeading)
+            .map(|t| {
+                let level = text[t.span.clone()].iter().take_while(|&&b| b == b'#').count();
+                (lines.line_of(t.span.start), level)
+            })
+            .collect();
+        for (i, &(start, level)) in headings.iter().enumerate() {
+            let mut end = headings[i + 1..]
+                .iter()
+                .find(|&&(_, l)| l <= level)
+                .map_or(lines.count(), |&(line, _)| line)
+                - 1;
+            while end > start && is_blank(&text[lines.range(end)]) {
+                end -= 1;
+            }
+            push(&mut ranges, start, end, FoldKind::Region);
+        }
+    }
+
+    if let Some(hook) = rules.hook {
+        hook(text, tokens, &mut ranges);
+    }
+
+    normalize(ranges)
+}
+
+/// Folding hook for languages whose blocks are defined by indentation.
+///
+/// A line folds everything after it that is indented deeper, ignoring blank lines
+/// and the continuation lines of multi-line strings and comments.
+pub fn indentation_folds(text: &[u8], tokens: &[Token], ranges: &mut Vec<FoldingRange>) {
+    let lines = LineIndex::new(text);
+    let mut token = 0;
+    let indents: Vec<Option<CoordType>> = (0..lines.count())
+        .map(|line| {
+            let range = lines.range(line);
+            while token < tokens.len() && tokens[token].span.end <= range.start {
+                token += 1;
+            }
+            let continued = tokens.get(token).is_some_and(|t| t.span.start < range.start);
+            if continued || is_blank(&text[range.clone()]) {
+                return None;
+            }
+            // Python compares indentation with tab stops every 8 columns,
+            // no matter how wide the editor draws tabs.
+            Some(indent_width(&text[range], 8))
+        })
+        .collect();
+
+    for (start, &indent) in indents.iter().enumerate() {
+        let Some(indent) = indent else {
+            continue;
+        };
+        let mut end = start;
+        for (line, &other) in indents.iter().enumerate().skip(start + 1) {
+            match other {
+                Some(other) if other > indent => end = line,
+                Some(_) => break,
+                None => {}
+            }
+        }
+        if end > start {
+            ranges.push(FoldingRange { start_line: start, end_line: end, kind: FoldKind::Region });
+        }
+    }
+}
+
+/// Sort the ranges and drop the ones that would break the nesting.
+fn normalize(mut ranges: Vec<FoldingRange>) -> Vec<FoldingRange> {
+    ranges.sort_by(|a, b| a.start_line.cmp(&b.start_line).then(b.end_line.cmp(&a.end_line)));
+    ranges.dedup_by_key(|r| r.start_line);
+
+    let mut result: Vec<FoldingRange> = Vec::with_capacity(ranges.len());
+    let mut stack: Vec<usize> = Vec::new();
+    for range in ranges {
+        while stack.last().is_some_and(|&end| end < range.start_line) {
+            stack.pop();
+        }
+        if stack.last().is_some_and(|&end| range.end_line > end) {
+            continue;
+        }
+        stack.push(range.end_line);
+        result.push(range);
+    }
+    result
+}
+
+/// Returns the offset of the first non-whitespace byte on `line` and the token starting there.
+fn first_token<'a>(
+    text: &[u8],
+    tokens: &'a [Token],
+    lines: &LineIndex,
+    line: usize,
+) -> Option<(usize, &'a Token)> {
+    let range = lines.range(line);
+    let offset = range.start + text[range.clone()].iter().position(|b| !b.is_ascii_whitespace())?;
+    let idx = tokens.partition_point(|t| t.span.end <= offset);
+    tokens.get(idx).filter(|t| t.span.start == offset).map(|t| (offset, t))
+}
+
+/// Returns true if `line` starts with one of the import keywords.
+fn is_import_line(
+    rules: &FoldingRules,
+    text: &[u8],
+    tokens: &[Token],
+    lines: &LineIndex,
+    line: usize,
+) -> bool {
+    let Some((offset, token)) = first_token(text, tokens, lines, line) else {
+        return false;
+    };
+    if token.kind.is_comment() || token.kind.is_string() {
+        return false;
+    }
+    let rest = &text[offset..lines.range(line).end];
+    rules.imports.iter().any(|keyword| {
+        rest.starts_with(keyword.as_bytes())
+            && rest.get(keyword.len()).is_none_or(|&b| !b.is_ascii_alphanumeric() && b != b'_')
+    })
+}
+
+/// Returns `Some(true)` if `line` is a region start marker and `Some(false)` if it's an end marker.
+fn region_marker(
+    rules: &FoldingRules,
+    text: &[u8],
+    tokens: &[Token],
+    lines: &LineIndex,
+    line: usize,
+) -> Option<bool> {
+    let (start, end) = rules.region_markers?;
+    let (offset, token) = first_token(text, tokens, lines, line)?;
+    if token.kind.is_string() {
+        return None;
+    }
+    let rest = &text[offset..lines.range(line).end];
+    if starts_with_ignoring_whitespace(rest, start.as_bytes()) {
+        Some(true)
+    } else if starts_with_ignoring_whitespace(rest, end.as_bytes()) {
+        Some(false)
+    } else {
+        None
+    }
+}
+
+fn starts_with_ignoring_whitespace(text: &[u8], prefix: &[u8]) -> bool {
+    let mut text = text.iter().filter(|b| !b.is_ascii_whitespace());
+    prefix.iter().filter(|b| !b.is_ascii_whitespace()).all(|b| text.next() == Some(b))
+}
+
+fn is_blank(text: &[u8]) -> bool {
+    text.iter().all(|b| b.is_ascii_whitespace())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::FoldKind::*;
+    use super::*;
+    use crate::syntax::LexerRegistry;
+
+    fn folds(language: Language, text: &[u8]) -> Vec<(usize, usize, FoldKind)> {
+        let tokens = LexerRegistry::get_lexer(language).tokenize(text);
+        folding_ranges(language, text, &tokens)
+            .into_iter()
+            .map(|r| (r.start_line, r.end_line, r.kind))
+            .collect()
+    }
+
+    #[test]
+    fn test_folding_go() {
+        // The folds of `syntax-tests/test_syntax.go` are in its `.folds` golden.
+        let text = b"import (\n\t\"fmt\"\n\t\"os\"\n)\n\nconst (\n\tA = 1\n\tB = 2\n)\n\nvar (\n\tx int\n)\n\nvar s = []string{\n\t\"a\", \"{\",\n\t`b\n\tc`,\n}\n\n/* a\n{ b */\nvar m = map[int]int{1: 2}\n\nfunc f() { return }\n";
+        assert_eq!(
+            folds(Language::Go, text),
+            vec![
+                (0, 2, Imports),
+                (5, 7, Region),
+                (10, 11, Region),
+                (14, 17, Region),
+                (16, 17, Region),
+                (20, 21, Comment),
+            ]
+        );
+    }
+
+    #[test]
+    fn test_folding_python_indentation() {
+        let text =
+            b"import os\nimport sys\n\ndef f():\n    x = 1\n\n    if x:\n        pass\n\nprint()\n";
+        assert_eq!(
+            folds(Language::Python, text),
+            vec![(0, 1, FoldKind::Imports), (3, 7, FoldKind::Region), (6, 7, FoldKind::Region)]
+        );
+    }
+
+    #[test]
+    fn test_folding_markdown_sections() {
+        let text = b"# A\ntext\n## B\ntext\n\n# C\ntext\n";
+        assert_eq!(
+            folds(Language::Markdown, text),
+            vec![(0, 3, FoldKind::Region), (2, 3, FoldKind::Region), (5, 6, FoldKind::Region)]
+        );
+    }
+
+    #[test]
+    fn test_folding_shell_keyword_pairs() {
+        let text = b"if a; then\n  b\n  c\nelse\n  d\nfi\nfor x in y; do\n  z\ndone\n";
+        assert_eq!(
+            folds(Language::Shell, text),
+            vec![(0, 2, FoldKind::Region), (3, 4, FoldKind::Region), (6, 7, FoldKind::Region)]
+        );
+    }
+
+    #[test]
+    fn test_folding_c_pragma_region() {
+        let text = b"#include <a.h>\n#include <b.h>\n#pragma region X\nint x;\n#pragma endregion\n";
+        assert_eq!(
+            folds(Language::C, text),
+            vec![(0, 1, FoldKind::Imports), (2, 4, FoldKind::Region)]
+        );
+    }
+}
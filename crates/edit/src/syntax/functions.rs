@@ -0,0 +1,269 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//! Telling function definitions and function calls apart.
+//!
+//! Lexers emit the names of functions as plain identifiers. [`classify_functions`]
+//! looks at what surrounds them, following the language's [`FunctionRules`], so that
+//! themes can style a definition differently than a call.
+
+use std::ops::Range;
+
+use crate::syntax::{
+    BracketMatch, BracketMatcher, Language, Symbol, SymbolKind, Token, TokenKind, outline,
+};
+
+/// Turn the identifiers naming functions into [`TokenKind::FunctionDefinition`]
+/// and [`TokenKind::FunctionCall`] tokens.
+///
+/// An identifier is a definition if
+/// - it follows one of the [`FunctionRules::keywords`], like `def name`,
+/// - it follows a function keyword and a parenthesized receiver, like Go's `func (p *T) name(`,
+/// - it's followed by a parenthesized list and a body, like `name(int a) {`,
+///   if [`FunctionRules::body_follows`] is set, or
+/// - the language's outline declares a function or method of that name there.
+///
+/// Otherwise it's a call if it's directly followed by `(`, which includes method calls like
+/// `fmt.Println(`. This is purely lexical, so Go's conversions to user-defined types
+/// (`Celsius(f)`) are calls, too, just like invoking a function-typed variable is.
+/// C's function prototypes (`int f(int);`) are classified as calls.
+pub fn classify_functions(language: Language, text: &[u8], tokens: &mut [Token]) {
+    let metadata = language.metadata();
+    let rules = &metadata.functions;
+    if rules.keywords.is_empty() && !rules.body_follows && !rules.calls {
+        return;
+    }
+
+    let mut definitions = Vec::new();
+    collect_definitions(outline(language, text, tokens), &mut definitions);
+    definitions.sort_unstable_by_key(|r| r.start);
+    let matcher = BracketMatcher::new(language, text, tokens);
+
+    let significant: Vec<usize> = tokens
+        .iter()
+        .enumerate()
+        .filter(|(_, t)| !t.kind.is_trivia() && !t.is_empty())
+        .map(|(i, _)| i)
+        .collect();
+    let text_of = |n: Option<&usize>| n.map_or(&b""[..], |&i| &text[tokens[i].span.clone()]);
+    // The index into `significant` of the first token at or after `offset`.
+    let after = |offset: usize| significant.partition_point(|&i| tokens[i].span.start < offset);
+    let partner = |i: usize| match matcher.match_at(tokens[i].span.start) {
+        Some(BracketMatch::Matched(range)) => Some(range),
+        _ => None,
+    };
+    let is_function_keyword = |n: Option<&usize>| {
+        n.is_some_and(|&i| {
+            tokens[i].kind.is_keyword()
+                && rules
+                    .keywords
+                    .iter()
+                    .any(|k| metadata.is_keyword(&text[tokens[i].span.clone()], k))
+        })
+    };
+
+    let mut kinds = Vec::new();
+    for n in 0..significant.len() {
+        let i = significant[n];
+        if tokens[i].kind != TokenKind::Identifier {
+            continue;
+        }
+        let span = tokens[i].span.clone();
+        let prev = n.checked_sub(1).map(|p| &significant[p]);
+        let next = significant.get(n + 1);
+        let next_is_paren = text_of(next) == b"(";
+
+        let receiver = || {
+            text_of(prev) == b")"
+                && matches!(text_of(next), b"(" | b"[")
+                && partner(*prev.unwrap()).is_some_and(|open| {
+                    let before = after(open.start).checked_sub(1);
+                    is_function_keyword(before.map(|p| &significant[p]))
+                })
+        };
+        let body = || {
+            rules.body_follows
+                && next_is_paren
+                && partner(*next.unwrap())
+                    .is_some_and(|close| text_of(significant.get(after(close.end))) == b"{")
+        };
+        let declared = || definitions.binary_search_by_key(&span.start, |r| r.start).is_ok();
+        // `Map[int, string](xs)` calls an instantiation of a generic function. Starting
+        // with a type tells the type arguments apart from an index, as in `handlers[i](x)`.
+        let instantiated = || {
+            let Some(&open) = next else {
+                return false;
+            };
+            text_of(next) == b"["
+                && tokens[open].span.start == span.end
+                && significant.get(n + 2).is_some_and(|&i| tokens[i].kind == TokenKind::TypeName)
+                && partner(open).is_some_and(|close| {
+                    let paren = significant.get(after(close.end));
+                    text_of(paren) == b"(" && tokens[*paren.unwrap()].span.start == close.end
+                })
+        };
+
+        if is_function_keyword(prev) || receiver() || body() || declared() {
+            kinds.push((i, TokenKind::FunctionDefinition));
+        } else if rules.calls
+            && ((next_is_paren && tokens[*next.unwrap()].span.start == span.end) || instantiated())
+        {
+            kinds.push((i, TokenKind::FunctionCall));
+        }
+    }
+
+    for (i, kind) in kinds {
+        tokens[i].kind = kind;
+    }
+}
+
+fn collect_definitions(symbols: Vec<Symbol>, definitions: &mut Vec<Range<usize>>) {
+    for symbol in symbols {
+        if matches!(symbol.kind, SymbolKind::Function | SymbolKind::Method) {
+            definitions.push(symbol.selection);
+        }
+        collect_definitions(symbol.children, definitions);
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::syntax::LexerRegistry;
+
+    fn classify(language: Language, text: &[u8]) -> Vec<Token> {
+        let mut tokens = LexerRegistry::get_lexer(language).tokenize(text);
+        classify_functions(language, text, &mut tokens);
+        tokens
+    }
+
+    /// Asserts the kind of the token at the caret in `marked`, which is `text` with a `^`
+    /// inserted before the token.
+    #[track_caller]
+    fn assert_kind_at(language: Language, marked: &str, kind: TokenKind) {
+        let caret = marked.find('^').expect("missing caret");
+        let text = marked.replacen('^', "", 1);
+        let tokens = classify(language, text.as_bytes());
+        let token = tokens.iter().find(|t| t.span.start == caret).expect("no token at caret");
+        assert_eq!(token.kind, kind, "{marked}");
+    }
+
+    #[test]
+    fn test_go_functions() {
+        use TokenKind::{FunctionCall as Call, FunctionDefinition as Def};
+        let go = |marked, kind| assert_kind_at(Language::Go, marked, kind);
+
+        go("func ^main() {}", Def);
+        go("func (r Rectangle) ^Area() float64 {", Def);
+        go("func (s *Stack[T]) ^Push(v T) {", Def);
+        go("func ^Map[T, U any](s []T) []U {", Def);
+        go("type Shape interface {\n\t^Area() float64\n}", Def);
+        go("x := ^divide(10, 2)", Call);
+        go("x := ^Map[int, string](xs, f)", Call);
+        go("x := ^handlers[i](req)", TokenKind::Identifier);
+        go("fmt.^Println(x)", Call);
+        go("return ^Celsius(f)", Call);
+        go("adder := makeAdder(10)\n^adder(5)", Call);
+        go("func main() {\n\tf := func(x int) ^Stack {", TokenKind::Identifier);
+        go("if ^ok {", TokenKind::Identifier);
+        // Tests are ordinary functions, see `syntax-tests/test_syntax_test.go`.
+        go("func ^TestDivide(t *testing.T) {", Def);
+        go("t.^Run(tt.name, func(t *testing.T) {", Call);
+    }
+
+    #[test]
+    fn test_c_like_functions() {
+        use TokenKind::{FunctionCall as Call, FunctionDefinition as Def};
+
+        assert_kind_at(Language::C, "int ^main(void)\n{\n", Def);
+        assert_kind_at(Language::C, "if (^check(x)) {", Call);
+        assert_kind_at(Language::Java, "public void ^run() {", Def);
+        assert_kind_at(Language::Java, "list.^add(x);", Call);
+        assert_kind_at(Language::JavaScript, "function ^area(r) {", Def);
+        assert_kind_at(Language::JavaScript, "class C { ^area() {", Def);
+        assert_kind_at(Language::JavaScript, "const a = ^area(2);", Call);
+        assert_kind_at(Language::Shell, "^greet() {", Def);
+        assert_kind_at(Language::Shell, "function ^greet {", Def);
+    }
+
+    #[test]
+    fn test_keyword_functions() {
+        use TokenKind::{FunctionCall as Call, FunctionDefinition as Def};
+
+        assert_kind_at(Language::Python, "def ^area(self):", Def);
+        assert_kind_at(Language::Python, "print(self.^area())", Call);
+        assert_kind_at(Language::Rust, "fn ^area<T>(x: T) {", Def);
+        assert_kind_at(Language::Rust, "let a = ^area(2);", Call);
+    }
+
+    #[test]
+    fn test_go_fixture() {
+        let text = include_bytes!("../../../../syntax-tests/test_syntax.go");
+        let tokens = classify(Language::Go, text);
+        let names = |kind| {
+            let mut names: Vec<_> = tokens
+                .iter()
+                .filter(|t| t.kind == kind)
+                .map(|t| std::str::from_utf8(&text[t.span.clone()]).unwrap())
+                .collect();
+            names.sort_unstable();
+            names.dedup();
+            names
+        };
+
+        assert_eq!(
+            names(TokenKind::FunctionDefinition),
+            [
+                "All",
+                "Area",
+                "Close",
+                "GetInfo",
+                "Map",
+                "Perimeter",
+                "ProcessData",
+                "Push",
+                "UpdateAge",
+                "apply",
+                "divide",
+                "escapes",
+                "find",
+                "helperFunction",
+                "iterate",
+                "main",
+                "makeAdder",
+                "markers",
+                "nanotime",
+                "report",
+                "shadowing",
+                "sum",
+                "swap",
+            ]
+        );
+        // `fn` and `yield` are function-typed parameters of `apply` and `All`, and `new`
+        // is a variable in `shadowing`, rather than the built-in.
+        assert_eq!(
+            names(TokenKind::FunctionCall),
+            [
+                "Add",
+                "After",
+                "All",
+                "Done",
+                "Errorf",
+                "Lock",
+                "Print",
+                "Printf",
+                "Println",
+                "Sleep",
+                "Sprintf",
+                "Unlock",
+                "Wait",
+                "adder",
+                "divide",
+                "fn",
+                "makeAdder",
+                "new",
+                "yield",
+            ]
+        );
+    }
+}
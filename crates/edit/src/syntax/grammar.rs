@@ -0,0 +1,1027 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//! TextMate grammars as a lexer backend.
+//!
+//! Editors like VS Code and Sublime Text highlight with TextMate grammars, so there's one
+//! for nearly every language. [`Grammar::parse`] loads one from its JSON form (a
+//! `.tmLanguage.json` file) and the result is a [`Lexer`] like any other.
+//!
+//! A grammar is a list of `patterns`, each of which is a rule:
+//!
+//! - `match` rules scope a single match, and its `captures`,
+//! - `begin`/`end` rules scope everything from a match of `begin` to the next match of
+//!   `end`, with their own `patterns` in between, `contentName` for the text between the
+//!   two and `beginCaptures`/`endCaptures` (or `captures` for both),
+//! - `begin`/`while` rules scope lines as long as each starts with a match of `while`,
+//!   like Markdown's block quotes,
+//! - rules with just `patterns` group other rules, and `include` refers to an entry of a
+//!   `repository` (`#name`) or to the whole grammar (`$self`, `$base`).
+//!
+//! Captures can have `patterns` of their own, which tokenize the captured text, and
+//! `name`s can refer to captured text as `$1` or `${1:/downcase}`. `end` and `while`
+//! patterns can refer to what `begin` captured as `\1`, like the delimiter of a heredoc.
+//!
+//! The regexes are Oniguruma's, of which [`regex`] implements what grammars actually use;
+//! a grammar using anything else fails to load rather than highlighting wrongly. Loading
+//! also fails for grammars that include other grammars (`source.js`) and for the older
+//! XML property list format, which needs converting to JSON first.
+//!
+//! Tokenizing works like in `vscode-textmate`: line by line, each with a `\n` at its end,
+//! where the earliest match of the current rule's patterns (or its `end`) wins and ties
+//! go to the pattern listed first. A grammar scopes text with names like
+//! `string.quoted.double.go` rather than [`TokenKind`]s, and the innermost scope we have
+//! a kind for decides a token's kind, see [`scope_kind`].
+
+mod export;
+mod lint;
+mod regex;
+mod state;
+#[cfg(test)]
+mod tests;
+
+use std::collections::HashMap;
+use std::ops::Range;
+use std::sync::OnceLock;
+
+use stdext::arena::scratch_arena;
+
+pub(crate) use self::export::{ExportRules, StringRule};
+pub use self::export::{ExportedGrammar, export_grammar};
+pub use self::lint::{GrammarProblem, GrammarProblemKind, validate_grammar};
+use self::regex::{Context, Regex};
+use crate::hash;
+use crate::json::{self, Object, Value};
+use crate::syntax::lexer::is_whitespace;
+use crate::syntax::{Lexer, Token, TokenKind};
+
+/// How many matches a single line may take, after which the rest of the line keeps the
+/// scopes it has. This is a backstop for grammars that loop without getting anywhere.
+const MAX_LINE_STEPS: usize = 4096;
+
+/// How many `begin` rules may be open at once, after which further ones scope what they
+/// match but aren't entered. This keeps a [`LineState`] small, whatever the text.
+pub const MAX_RULE_DEPTH: usize = 64;
+
+/// A TextMate grammar, loaded from its JSON form.
+pub struct Grammar {
+    name: String,
+    scope_name: String,
+    file_types: Vec<String>,
+    rules: Vec<Rule>,
+    /// The flattened patterns of each rule, computed on first use, see [`Grammar::patterns`].
+    flattened: Vec<OnceLock<Vec<usize>>>,
+    /// A hash of the JSON, which the states of lines refer to their grammar by.
+    fingerprint: u64,
+}
+
+struct Rule {
+    /// The scope of everything the rule matches, possibly with `$1` references.
+    name: Option<String>,
+    kind: RuleKind,
+}
+
+enum RuleKind {
+    /// A placeholder while the rule is loaded, so that it can include itself.
+    Loading,
+    /// Just `patterns`, or the whole grammar.
+    Group {
+        patterns: Vec<usize>,
+    },
+    Match {
+        regex: Regex,
+        captures: Captures,
+    },
+    Begin {
+        begin: Regex,
+        begin_captures: Captures,
+        /// The `end` or `while` pattern.
+        end: EndPattern,
+        end_captures: Captures,
+        /// Whether `end` is a `while`.
+        is_while: bool,
+        content_name: Option<String>,
+        patterns: Vec<usize>,
+        apply_end_pattern_last: bool,
+    },
+}
+
+enum EndPattern {
+    Static(Regex),
+    /// A pattern with backreferences to what `begin` captured, compiled once it has.
+    Dynamic(String),
+}
+
+/// The captures of a rule by group, `None` for groups without any.
+type Captures = Vec<Option<Capture>>;
+
+struct Capture {
+    name: Option<String>,
+    /// The group rule of the capture's `patterns`, if it has any.
+    patterns: Option<usize>,
+}
+
+impl Grammar {
+    /// Load a grammar from its JSON form, or explain why it can't be.
+    pub fn parse(json: &str) -> Result<Self, String> {
+        if json.trim_start().starts_with('<') {
+            return Err(
+                "grammars in the XML property list format aren't supported, convert them to JSON"
+                    .to_string(),
+            );
+        }
+        let arena = scratch_arena(None);
+        let root = json::parse(&arena, json).map_err(|e| e.to_string())?;
+        let object = root.as_object().ok_or("a grammar must be an object")?;
+        let scope_name = object.get_str("scopeName").ok_or("a grammar must have a scopeName")?;
+
+        let mut loader = Loader { rules: Vec::new(), ids: HashMap::new(), scope_name };
+        // The grammar itself is rule 0, so that `$self` can refer to it.
+        loader.load_rule(&root, &[], "grammar")?;
+
+        let file_types = match object.get("fileTypes") {
+            Some(Value::Array(types)) => {
+                types.iter().filter_map(Value::as_str).map(str::to_string).collect()
+            }
+            _ => Vec::new(),
+        };
+        let rules = loader.rules;
+        Ok(Self {
+            name: object.get_str("name").unwrap_or(scope_name).to_string(),
+            scope_name: scope_name.to_string(),
+            file_types,
+            flattened: rules.iter().map(|_| OnceLock::new()).collect(),
+            rules,
+            fingerprint: hash::hash_str(0, json),
+        })
+    }
+
+    /// The grammar's display name, or its scope name if it doesn't have one.
+    pub fn name(&self) -> &str {
+        &self.name
+    }
+
+    /// The grammar's root scope, like `source.go`.
+    pub fn scope_name(&self) -> &str {
+        &self.scope_name
+    }
+
+    /// The file extensions the grammar is for, without their dots.
+    pub fn file_types(&self) -> &[String] {
+        &self.file_types
+    }
+
+    /// The state before the first line of a document.
+    pub fn initial_state(&self) -> LineState {
+        LineState {
+            stack: vec![Frame::new(0, vec![self.scope_name.clone()], Vec::new())],
+            first_line: true,
+            grammar: self.fingerprint,
+        }
+    }
+
+    /// Tokenize a single line of a document, given the state before it, which is updated
+    /// to the state after it. The line includes its `\n`, unless it's the last one, and the
+    /// spans of the tokens are relative to its start.
+    ///
+    /// Tokenizing a document line by line gives the same tokens as [`Lexer::tokenize`].
+    pub fn tokenize_line(&self, line: &[u8], state: &mut LineState) -> Vec<Token> {
+        line_tokens(line, self.line_spans(line, state))
+    }
+
+    /// Tokenize `text` into spans with the scopes of each, outermost first. The spans tile
+    /// the text like tokens do, but aren't split or merged by kind.
+    #[cfg(test)]
+    fn scoped_spans(&self, text: &[u8]) -> Vec<(Range<usize>, Vec<String>)> {
+        let mut spans = Vec::new();
+        let mut state = self.initial_state();
+        for (offset, line) in lines(text) {
+            let line_spans = self.line_spans(line, &mut state);
+            spans.extend(
+                line_spans
+                    .into_iter()
+                    .map(|(range, scopes)| (offset + range.start..offset + range.end, scopes)),
+            );
+        }
+        spans
+    }
+
+    /// The scoped spans of a single line, see [`Grammar::tokenize_line`].
+    fn line_spans(&self, line: &[u8], state: &mut LineState) -> Vec<(Range<usize>, Vec<String>)> {
+        let len = line.len();
+        let mut line = line.to_vec();
+        if line.last() != Some(&b'\n') {
+            line.push(b'\n');
+        }
+
+        let mut out = Output { spans: Vec::new(), at: 0 };
+        self.scope_line(&line, state.first_line, 0, &mut state.stack, &mut out);
+        state.first_line = false;
+        out.spans
+            .into_iter()
+            .map(|(range, scopes)| (range.start.min(len)..range.end.min(len), scopes))
+            .filter(|(range, _)| !range.is_empty())
+            .collect()
+    }
+
+    /// Scope `line` from `pos` on with the rules on `stack`.
+    fn scope_line(
+        &self,
+        line: &[u8],
+        first_line: bool,
+        mut pos: usize,
+        stack: &mut Vec<Frame>,
+        out: &mut Output,
+    ) {
+        let mut anchor = None;
+        let context = |anchor| Context { anchor, first_line };
+
+        // The `while` rules of earlier lines go on if their patterns still match.
+        for depth in 1..stack.len() {
+            let frame = &stack[depth];
+            let RuleKind::Begin { is_while: true, ref end_captures, .. } =
+                self.rules[frame.rule].kind
+            else {
+                continue;
+            };
+            let groups = frame
+                .end_regex(&self.rules)
+                .and_then(|regex| regex.search(line, pos, context(Some(pos))));
+            let Some(groups) = groups else {
+                stack.truncate(depth);
+                break;
+            };
+            let scopes = frame.scopes(&stack[..depth]);
+            self.emit_captures(line, first_line, &scopes, &groups, end_captures, out);
+            pos = groups[0].as_ref().unwrap().end;
+            anchor = Some(pos);
+        }
+
+        for _ in 0..MAX_LINE_STEPS {
+            let top = stack.last().unwrap();
+            let (patterns, end, apply_end_pattern_last) = match self.rules[top.rule].kind {
+                RuleKind::Begin { is_while, apply_end_pattern_last, ref patterns, .. } => {
+                    let end = if is_while { None } else { top.end_regex(&self.rules) };
+                    (self.patterns(top.rule, patterns), end, apply_end_pattern_last)
+                }
+                RuleKind::Group { ref patterns } => {
+                    (self.patterns(top.rule, patterns), None, false)
+                }
+                _ => unreachable!("only begin and group rules are pushed"),
+            };
+
+            // The earliest match wins, and of those the first one tried.
+            let mut best: Option<(Option<usize>, Match)> = None;
+            if let Some(end) = end.filter(|_| !apply_end_pattern_last) {
+                consider(&mut best, None, end.search(line, pos, context(anchor)));
+            }
+            for &rule in patterns {
+                let regex = match self.rules[rule].kind {
+                    RuleKind::Match { ref regex, .. } => regex,
+                    RuleKind::Begin { ref begin, .. } => begin,
+                    _ => continue,
+                };
+                consider(&mut best, Some(rule), regex.search(line, pos, context(anchor)));
+                if best.as_ref().is_some_and(|(_, groups)| groups[0].as_ref().unwrap().start == pos)
+                {
+                    break;
+                }
+            }
+            if let Some(end) = end.filter(|_| apply_end_pattern_last) {
+                consider(&mut best, None, end.search(line, pos, context(anchor)));
+            }
+
+            let scopes = stack.last().unwrap().scopes(&stack[..stack.len() - 1]);
+            let Some((rule, groups)) = best else {
+                break;
+            };
+            let matched = groups[0].clone().unwrap();
+            out.produce(matched.start, &scopes);
+
+            match rule {
+                // The end of the rule on top.
+                None => {
+                    let frame = stack.pop().unwrap();
+                    if matched.is_empty() && frame.entered == Some(pos) {
+                        // The rule would end where it began, forever, so leave it be.
+                        stack.push(frame);
+                        break;
+                    }
+                    let RuleKind::Begin { ref end_captures, .. } = self.rules[frame.rule].kind
+                    else {
+                        unreachable!();
+                    };
+                    let scopes = frame.scopes(stack);
+                    let outer = scopes.len() - frame.content.len();
+                    self.emit_captures(
+                        line,
+                        first_line,
+                        &scopes[..outer],
+                        &groups,
+                        end_captures,
+                        out,
+                    );
+                    anchor = frame.anchor;
+                }
+                Some(rule) => {
+                    let name = self.rules[rule]
+                        .name
+                        .as_deref()
+                        .map(|name| substitute(name, line, &groups));
+                    let mut inner = scopes.clone();
+                    inner
+                        .extend(name.iter().flat_map(|n| n.split_whitespace()).map(str::to_string));
+                    match self.rules[rule].kind {
+                        RuleKind::Match { ref captures, .. } => {
+                            self.emit_captures(line, first_line, &inner, &groups, captures, out);
+                            if matched.is_empty() {
+                                break;
+                            }
+                        }
+                        RuleKind::Begin {
+                            ref begin_captures, ref end, ref content_name, ..
+                        } => {
+                            if matched.is_empty()
+                                && stack.last().is_some_and(|top| top.rule == rule)
+                            {
+                                // The rule would begin inside itself, forever.
+                                break;
+                            }
+                            self.emit_captures(
+                                line,
+                                first_line,
+                                &inner,
+                                &groups,
+                                begin_captures,
+                                out,
+                            );
+                            if stack.len() >= MAX_RULE_DEPTH {
+                                // Too deep to enter, so the match is all the rule scopes.
+                                if matched.is_empty() {
+                                    break;
+                                }
+                                pos = matched.end;
+                                continue;
+                            }
+                            let content =
+                                content_name.as_deref().map(|n| substitute(n, line, &groups));
+                            let content = content
+                                .iter()
+                                .flat_map(|n| n.split_whitespace())
+                                .map(str::to_string)
+                                .collect();
+                            let mut frame =
+                                Frame::new(rule, inner[scopes.len()..].to_vec(), content);
+                            frame.anchor = anchor;
+                            frame.entered = Some(matched.start);
+                            if let EndPattern::Dynamic(pattern) = end {
+                                let pattern = substitute_backrefs(pattern, line, &groups);
+                                frame.end = Regex::new(&pattern).ok().map(|regex| (pattern, regex));
+                            }
+                            stack.push(frame);
+                            anchor = Some(matched.end);
+                        }
+                        _ => unreachable!(),
+                    }
+                }
+            }
+            pos = matched.end;
+        }
+
+        let scopes = stack.last().unwrap().scopes(&stack[..stack.len() - 1]);
+        out.produce(line.len(), &scopes);
+        // Where rules began only matters for the line they began on.
+        for frame in stack.iter_mut() {
+            frame.entered = None;
+            frame.anchor = None;
+        }
+    }
+
+    /// Scope the match in `groups` with `scopes` and its `captures`.
+    fn emit_captures(
+        &self,
+        line: &[u8],
+        first_line: bool,
+        scopes: &[String],
+        groups: &[Option<Range<usize>>],
+        captures: &Captures,
+        out: &mut Output,
+    ) {
+        let matched = groups[0].clone().unwrap();
+        // The captures that haven't ended yet, innermost last.
+        let mut open: Vec<(Vec<String>, usize)> = Vec::new();
+        for (capture, group) in captures.iter().zip(groups) {
+            let (Some(capture), Some(group)) = (capture, group) else {
+                continue;
+            };
+            // Lookarounds can capture outside of the match.
+            let group = group.start.max(out.at)..group.end.min(matched.end);
+            if group.is_empty() {
+                continue;
+            }
+            while let Some((scopes, end)) = open.last_mut() {
+                if *end > group.start {
+                    break;
+                }
+                out.produce(*end, scopes);
+                open.pop();
+            }
+            let outer = open.last().map_or(scopes, |(scopes, _)| scopes);
+            out.produce(group.start, outer);
+
+            let mut inner = outer.to_vec();
+            if let Some(name) = &capture.name {
+                inner.extend(substitute(name, line, groups).split_whitespace().map(str::to_string));
+            }
+            match capture.patterns {
+                Some(rule) => {
+                    // Tokenize the captured text on its own, as if the line ended with it.
+                    let mut stack = vec![Frame::new(rule, inner, Vec::new())];
+                    self.scope_line(&line[..group.end], first_line, group.start, &mut stack, out);
+                }
+                None => open.push((inner, group.end)),
+            }
+        }
+        while let Some((scopes, end)) = open.pop() {
+            out.produce(end, &scopes);
+        }
+        out.produce(matched.end, scopes);
+    }
+
+    /// The match and begin rules among `patterns` of `rule`, with groups and includes
+    /// replaced by their patterns.
+    fn patterns(&self, rule: usize, patterns: &[usize]) -> &[usize] {
+        self.flattened[rule].get_or_init(|| {
+            let mut flat = Vec::new();
+            let mut seen = vec![false; self.rules.len()];
+            self.flatten(patterns, &mut seen, &mut flat);
+            flat
+        })
+    }
+
+    fn flatten(&self, patterns: &[usize], seen: &mut [bool], flat: &mut Vec<usize>) {
+        for &rule in patterns {
+            match self.rules[rule].kind {
+                RuleKind::Group { ref patterns } => {
+                    // A group included twice, or in itself, adds nothing the second time.
+                    if !std::mem::replace(&mut seen[rule], true) {
+                        self.flatten(patterns, seen, flat);
+                    }
+                }
+                _ => flat.push(rule),
+            }
+        }
+    }
+}
+
+impl Lexer for Grammar {
+    fn tokenize(&self, text: &[u8]) -> Vec<Token> {
+        let mut tokens = Vec::new();
+        let mut state = self.initial_state();
+        for (offset, line) in lines(text) {
+            let line_tokens = self.tokenize_line(line, &mut state);
+            tokens.extend(line_tokens.into_iter().map(|mut token| {
+                token.span = offset + token.span.start..offset + token.span.end;
+                token
+            }));
+        }
+        tokens
+    }
+}
+
+/// The lines of `text` and their offsets, each with its `\n`.
+fn lines(text: &[u8]) -> impl Iterator<Item = (usize, &[u8])> {
+    let mut offset = 0;
+    std::iter::from_fn(move || {
+        let start = offset;
+        (start < text.len()).then(|| {
+            offset = text[start..]
+                .iter()
+                .position(|&b| b == b'\n')
+                .map_or(text.len(), |i| start + i + 1);
+            (start, &text[start..offset])
+        })
+    })
+}
+
+/// Turn the scoped spans of `text` into tokens, by the kind of their innermost scope.
+/// Text without one is identifiers and operators, and whitespace is split off.
+fn line_tokens(text: &[u8], spans: Vec<(Range<usize>, Vec<String>)>) -> Vec<Token> {
+    let mut tokens: Vec<Token> = Vec::new();
+    let mut push = |kind, span: Range<usize>| match tokens.last_mut() {
+        Some(last) if last.kind == kind && kind != TokenKind::Whitespace => {
+            last.span.end = span.end
+        }
+        _ => tokens.push(Token::new(kind, span)),
+    };
+    for (span, scopes) in spans {
+        let kind = scopes.iter().rev().find_map(|scope| scope_kind(scope, &text[span.clone()]));
+        let mut pos = span.start;
+        while pos < span.end {
+            let b = text[pos];
+            let run = |pred: &dyn Fn(u8) -> bool| {
+                pos + text[pos..span.end].iter().position(|&b| !pred(b)).unwrap_or(span.end - pos)
+            };
+            let (end, kind) = match kind {
+                // Newlines are whitespace even in strings and comments.
+                _ if b == b'\n' || b == b'\r' => {
+                    (run(&|b| b == b'\n' || b == b'\r'), TokenKind::Whitespace)
+                }
+                Some(
+                    kind @ (TokenKind::Comment
+                    | TokenKind::DocComment
+                    | TokenKind::String
+                    | TokenKind::Char
+                    | TokenKind::Regex),
+                ) => (run(&|b| b != b'\n' && b != b'\r'), kind),
+                _ if is_whitespace(b) => (run(&is_whitespace), TokenKind::Whitespace),
+                Some(kind) => (run(&|b| !is_whitespace(b)), kind),
+                // Text without a scope we know is identifiers and operators.
+                None if b == b'_' || b.is_ascii_alphanumeric() || b >= 0x80 => (
+                    run(&|b| b == b'_' || b.is_ascii_alphanumeric() || b >= 0x80),
+                    TokenKind::Identifier,
+                ),
+                None => (
+                    run(&|b| {
+                        !is_whitespace(b) && b != b'_' && !b.is_ascii_alphanumeric() && b < 0x80
+                    }),
+                    TokenKind::Operator,
+                ),
+            };
+            push(kind, pos..end);
+            pos = end;
+        }
+    }
+    tokens
+}
+
+/// The kind of a token whose innermost scope we know is `scope`, or `None` if we don't
+/// know it, like the `meta.*` scopes that just group others.
+fn scope_kind(scope: &str, text: &[u8]) -> Option<TokenKind> {
+    let has = |prefix: &str| {
+        scope == prefix || scope.strip_prefix(prefix).is_some_and(|rest| rest.starts_with('.'))
+    };
+    Some(if has("comment.block.documentation") || has("comment.line.documentation") {
+        TokenKind::DocComment
+    } else if has("comment") {
+        TokenKind::Comment
+    } else if has("string.regexp") {
+        TokenKind::Regex
+    } else if has("string.quoted.rune")
+        || has("string.quoted.single.char")
+        || has("constant.character.rune")
+    {
+        TokenKind::Char
+    } else if has("string") {
+        TokenKind::String
+    } else if has("constant.character.escape") {
+        TokenKind::Escape
+    } else if has("constant.other.placeholder") {
+        TokenKind::FormatSpecifier
+    } else if has("constant.numeric") {
+        TokenKind::Number
+    } else if has("constant.language") {
+        match text {
+            b"true" | b"false" | b"True" | b"False" => TokenKind::Boolean,
+            b"nil" | b"null" | b"None" | b"NULL" | b"undefined" => TokenKind::Null,
+            _ => TokenKind::Keyword,
+        }
+    } else if has("keyword.control.import") {
+        TokenKind::KeywordImport
+    } else if has("keyword.control") {
+        TokenKind::KeywordControl
+    } else if has("keyword.operator.word") {
+        TokenKind::KeywordOperator
+    } else if has("keyword.operator") {
+        TokenKind::Operator
+    } else if has("keyword") {
+        TokenKind::Keyword
+    } else if has("storage.type.function") {
+        TokenKind::KeywordFunction
+    } else if has("storage.type.primitive")
+        || has("storage.type.numeric")
+        || has("storage.type.string")
+    {
+        TokenKind::TypeName
+    } else if has("storage.type") {
+        TokenKind::KeywordType
+    } else if has("storage.modifier") {
+        TokenKind::KeywordStorage
+    } else if has("entity.name.type") || has("support.type") {
+        TokenKind::TypeName
+    } else if has("entity.name.function") || has("support.function") {
+        TokenKind::FunctionName
+    } else if has("entity.name.tag") {
+        TokenKind::Keyword
+    } else if has("entity.other.attribute-name") {
+        TokenKind::Attribute
+    } else if has("entity.name.label") {
+        TokenKind::Label
+    } else if has("variable.parameter") {
+        TokenKind::ParameterName
+    } else if has("variable.other.property") || has("variable.other.member") {
+        TokenKind::PropertyName
+    } else if has("invalid") {
+        TokenKind::Error
+    } else if has("punctuation.section.embedded")
+        || has("punctuation.definition.template-expression")
+    {
+        TokenKind::Interpolation
+    } else if has("punctuation.definition") {
+        // Quotes and comment markers take the kind of what they delimit.
+        return None;
+    } else if has("punctuation") {
+        TokenKind::Operator
+    } else {
+        return None;
+    })
+}
+
+/// The groups of a match, the whole match first.
+type Match = Vec<Option<Range<usize>>>;
+
+/// Keep the match of `rule` in `best` if it starts earlier than the one there.
+fn consider(best: &mut Option<(Option<usize>, Match)>, rule: Option<usize>, groups: Option<Match>) {
+    let start = |groups: &Match| groups[0].as_ref().unwrap().start;
+    if let Some(groups) = groups
+        && best.as_ref().is_none_or(|(_, best)| start(&groups) < start(best))
+    {
+        *best = Some((rule, groups));
+    }
+}
+
+/// Replace `$1` and `${1:/downcase}` (or `upcase`) in `name` with the captured text.
+fn substitute(name: &str, line: &[u8], groups: &[Option<Range<usize>>]) -> String {
+    if !name.contains('$') {
+        return name.to_string();
+    }
+    let captured = |index: &str| {
+        let group = index.parse::<usize>().ok().and_then(|i| groups.get(i)?.clone());
+        let text =
+            group.map(|g| String::from_utf8_lossy(&line[g]).into_owned()).unwrap_or_default();
+        // Like `vscode-textmate`, so that a captured `.x` can't add an empty segment.
+        text.trim_start_matches('.').to_string()
+    };
+    let mut result = String::new();
+    let mut rest = name;
+    while let Some(i) = rest.find('$') {
+        result.push_str(&rest[..i]);
+        rest = &rest[i + 1..];
+        let digits = rest.len() - rest.trim_start_matches(|c: char| c.is_ascii_digit()).len();
+        if digits > 0 {
+            result.push_str(&captured(&rest[..digits]));
+            rest = &rest[digits..];
+        } else if let Some((index, case, after)) = rest
+            .strip_prefix('{')
+            .and_then(|r| r.split_once(':'))
+            .and_then(|(index, r)| r.split_once('}').map(|(case, after)| (index, case, after)))
+            .filter(|(index, _, _)| index.bytes().all(|b| b.is_ascii_digit()))
+        {
+            let text = captured(index);
+            result.push_str(&match case {
+                "/downcase" => text.to_lowercase(),
+                "/upcase" => text.to_uppercase(),
+                _ => text,
+            });
+            rest = after;
+        } else {
+            result.push('$');
+        }
+    }
+    result.push_str(rest);
+    result
+}
+
+/// Replace the backreferences `\1` in an `end` or `while` pattern with what `begin`
+/// captured, escaped.
+fn substitute_backrefs(pattern: &str, line: &[u8], groups: &[Option<Range<usize>>]) -> String {
+    let mut result = String::new();
+    let mut chars = pattern.char_indices().peekable();
+    while let Some((_, ch)) = chars.next() {
+        if ch != '\\' {
+            result.push(ch);
+            continue;
+        }
+        let digits: String =
+            std::iter::from_fn(|| chars.next_if(|(_, c)| c.is_ascii_digit()).map(|(_, c)| c))
+                .collect();
+        if digits.is_empty() {
+            // Keep other escapes as they are, including an escaped backslash.
+            result.push('\\');
+            if let Some((_, next)) = chars.next() {
+                result.push(next);
+            }
+            continue;
+        }
+        let group = digits.parse::<usize>().ok().and_then(|g| groups.get(g)?.clone());
+        let text =
+            group.map(|g| String::from_utf8_lossy(&line[g]).into_owned()).unwrap_or_default();
+        result.push_str(&regex::escape(&text));
+    }
+    result
+}
+
+/// Where a grammar is at the start of a line: in the `begin` rules that haven't ended yet,
+/// at most [`MAX_RULE_DEPTH`] of them.
+///
+/// Tokenizing a line only depends on the line and the state before it, and equal states
+/// tokenize any text the same. So after an edit, the lines after the first one whose state
+/// is the same as before keep their tokens, see
+/// [`IncrementalHighlighter`](crate::syntax::IncrementalHighlighter). States can be saved
+/// with [`LineState::snapshot`] and restored with [`Grammar::restore_state`].
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct LineState {
+    stack: Vec<Frame>,
+    /// Whether this is the start of the document, where `\A` matches.
+    first_line: bool,
+    /// The [`Grammar::fingerprint`] of the grammar.
+    grammar: u64,
+}
+
+/// A begin rule that hasn't ended yet, or the grammar at the bottom of the stack.
+#[derive(Debug, Clone)]
+struct Frame {
+    rule: usize,
+    /// The scopes of the rule's `name`.
+    name: Vec<String>,
+    /// The scopes of the rule's `contentName`.
+    content: Vec<String>,
+    /// The `end` or `while` regex and its pattern, if it has backreferences.
+    end: Option<(String, Regex)>,
+    /// Where `\G` matched before the rule began, to restore once it ends.
+    anchor: Option<usize>,
+    /// Where the rule began, while that's on the current line.
+    entered: Option<usize>,
+}
+
+// The regex is compiled from the pattern, and where the rule began and `\G` matched is
+// only set within a line, so frames at the start of a line are equal by their pattern.
+impl PartialEq for Frame {
+    fn eq(&self, other: &Self) -> bool {
+        self.rule == other.rule
+            && self.name == other.name
+            && self.content == other.content
+            && self.end.as_ref().map(|(pattern, _)| pattern)
+                == other.end.as_ref().map(|(pattern, _)| pattern)
+    }
+}
+
+impl Eq for Frame {}
+
+impl Frame {
+    fn new(rule: usize, name: Vec<String>, content: Vec<String>) -> Self {
+        Self { rule, name, content, end: None, anchor: None, entered: None }
+    }
+
+    /// The scopes inside this frame, given the frames below it.
+    fn scopes(&self, below: &[Frame]) -> Vec<String> {
+        below
+            .iter()
+            .chain([self])
+            .flat_map(|frame| frame.name.iter().chain(&frame.content))
+            .cloned()
+            .collect()
+    }
+
+    fn end_regex<'a>(&'a self, rules: &'a [Rule]) -> Option<&'a Regex> {
+        match rules[self.rule].kind {
+            RuleKind::Begin { end: EndPattern::Static(ref regex), .. } => Some(regex),
+            RuleKind::Begin { end: EndPattern::Dynamic(_), .. } => {
+                self.end.as_ref().map(|(_, regex)| regex)
+            }
+            _ => None,
+        }
+    }
+}
+
+/// The spans of a line so far.
+struct Output {
+    spans: Vec<(Range<usize>, Vec<String>)>,
+    /// Where the next span starts.
+    at: usize,
+}
+
+impl Output {
+    /// Scope the text up to `end` with `scopes`.
+    fn produce(&mut self, end: usize, scopes: &[String]) {
+        if end <= self.at {
+            return;
+        }
+        match self.spans.last_mut() {
+            Some((span, last)) if span.end == self.at && last == scopes => span.end = end,
+            _ => self.spans.push((self.at..end, scopes.to_vec())),
+        }
+        self.at = end;
+    }
+}
+
+struct Loader<'g> {
+    rules: Vec<Rule>,
+    /// The rules loaded so far by the address of their JSON, so that a repository entry
+    /// included in many places (or in itself) is loaded once.
+    ids: HashMap<*const Value<'g>, usize>,
+    scope_name: &'g str,
+}
+
+impl<'g> Loader<'g> {
+    /// Load the rule `value`, whose enclosing repositories are `repositories`, innermost
+    /// last. `path` says where it is, for errors.
+    fn load_rule(
+        &mut self,
+        value: &'g Value<'g>,
+        repositories: &[Object<'g>],
+        path: &str,
+    ) -> Result<usize, String> {
+        if let Some(&id) = self.ids.get(&(value as *const _)) {
+            return Ok(id);
+        }
+        let object =
+            value.as_object().ok_or_else(|| format!("{path}: a rule must be an object"))?;
+
+        if let Some(include) = object.get_str("include") {
+            return self.load_include(include, repositories, path);
+        }
+
+        let id = self.rules.len();
+        self.rules.push(Rule { name: None, kind: RuleKind::Loading });
+        self.ids.insert(value as *const _, id);
+
+        let mut scoped = repositories.to_vec();
+        if let Some(repository) = object.get("repository") {
+            scoped.push(
+                repository
+                    .as_object()
+                    .ok_or_else(|| format!("{path}.repository: must be an object"))?,
+            );
+        }
+        let repositories = &scoped[..];
+
+        let string = |key: &str| match object.get(key) {
+            None => Ok(None),
+            Some(Value::String(s)) => Ok(Some(*s)),
+            Some(_) => Err(format!("{path}.{key}: must be a string")),
+        };
+        let compile = |key: &str, pattern: &str| {
+            Regex::new(pattern).map_err(|e| format!("{path}.{key}: {e}"))
+        };
+        let name = string("name")?.map(str::to_string);
+
+        let kind = if let Some(pattern) = string("match")? {
+            let regex = compile("match", pattern)?;
+            let captures = self.load_captures(object, "captures", repositories, path)?;
+            RuleKind::Match { regex, captures }
+        } else if let Some(begin) = string("begin")? {
+            let begin = compile("begin", begin)?;
+            let (key, is_while) = match (string("end")?, string("while")?) {
+                (Some(_), Some(_)) => {
+                    return Err(format!("{path}: a rule can't have both end and while"));
+                }
+                (Some(end), None) => (("end", end), false),
+                (None, Some(end)) => (("while", end), true),
+                (None, None) => {
+                    return Err(format!("{path}: a begin rule needs an end or a while"));
+                }
+            };
+            let end = if has_backrefs(key.1) {
+                // Check that it compiles with any text in place of the backreferences.
+                compile(key.0, &substitute_backrefs(key.1, b"", &[]))?;
+                EndPattern::Dynamic(key.1.to_string())
+            } else {
+                EndPattern::Static(compile(key.0, key.1)?)
+            };
+            // `captures` applies to both ends, unless they have their own.
+            let captures_of =
+                |key: &'static str| if object.get(key).is_some() { key } else { "captures" };
+            let begin_captures =
+                self.load_captures(object, captures_of("beginCaptures"), repositories, path)?;
+            let end_captures = self.load_captures(
+                object,
+                captures_of(if is_while { "whileCaptures" } else { "endCaptures" }),
+                repositories,
+                path,
+            )?;
+            RuleKind::Begin {
+                begin,
+                begin_captures,
+                end,
+                end_captures,
+                is_while,
+                content_name: string("contentName")?.map(str::to_string),
+                patterns: self.load_patterns(object, repositories, path)?,
+                apply_end_pattern_last: match object.get("applyEndPatternLast") {
+                    Some(Value::Bool(b)) => *b,
+                    Some(Value::Number(n)) => *n != 0.0,
+                    _ => false,
+                },
+            }
+        } else if object.get("end").is_some() || object.get("while").is_some() {
+            return Err(format!("{path}: an end or while needs a begin"));
+        } else {
+            RuleKind::Group { patterns: self.load_patterns(object, repositories, path)? }
+        };
+        self.rules[id] = Rule { name, kind };
+        Ok(id)
+    }
+
+    fn load_include(
+        &mut self,
+        include: &str,
+        repositories: &[Object<'g>],
+        path: &str,
+    ) -> Result<usize, String> {
+        if include == "$self" || include == "$base" {
+            return Ok(0);
+        }
+        let Some(name) = include.strip_prefix('#') else {
+            if include == self.scope_name {
+                return Ok(0);
+            }
+            return Err(format!("{path}: including other grammars isn't supported: {include}"));
+        };
+        for (depth, repository) in repositories.iter().enumerate().rev() {
+            if let Some(value) = repository.get(name) {
+                return self.load_rule(
+                    value,
+                    &repositories[..=depth],
+                    &format!("repository.{name}"),
+                );
+            }
+        }
+        Err(format!("{path}: no repository entry named {name}"))
+    }
+
+    fn load_patterns(
+        &mut self,
+        object: Object<'g>,
+        repositories: &[Object<'g>],
+        path: &str,
+    ) -> Result<Vec<usize>, String> {
+        match object.get("patterns") {
+            None => Ok(Vec::new()),
+            Some(Value::Array(patterns)) => patterns
+                .iter()
+                .enumerate()
+                .map(|(i, pattern)| {
+                    self.load_rule(pattern, repositories, &format!("{path}.patterns[{i}]"))
+                })
+                .collect(),
+            Some(_) => Err(format!("{path}.patterns: must be an array")),
+        }
+    }
+
+    fn load_captures(
+        &mut self,
+        object: Object<'g>,
+        key: &str,
+        repositories: &[Object<'g>],
+        path: &str,
+    ) -> Result<Captures, String> {
+        let Some(value) = object.get(key) else {
+            return Ok(Vec::new());
+        };
+        let path = format!("{path}.{key}");
+        // Captures are usually an object by group number, but some grammars use arrays.
+        let entries: Vec<(usize, &'g Value<'g>)> = match value {
+            Value::Object(_) => value
+                .as_object()
+                .unwrap()
+                .iter()
+                .filter_map(|(group, value)| Some((group.parse().ok()?, value)))
+                .collect(),
+            Value::Array(values) => values.iter().enumerate().collect(),
+            _ => return Err(format!("{path}: must be an object")),
+        };
+        let mut captures = Vec::new();
+        for (group, value) in entries {
+            let capture =
+                value.as_object().ok_or_else(|| format!("{path}.{group}: must be an object"))?;
+            let patterns = match capture.get("patterns") {
+                Some(_) => Some(self.load_rule(value, repositories, &format!("{path}.{group}"))?),
+                None => None,
+            };
+            if captures.len() <= group {
+                captures.resize_with(group + 1, || None);
+            }
+            captures[group] =
+                Some(Capture { name: capture.get_str("name").map(str::to_string), patterns });
+        }
+        Ok(captures)
+    }
+}
+
+/// Whether an `end` or `while` pattern refers to what `begin` captured.
+fn has_backrefs(pattern: &str) -> bool {
+    let bytes = pattern.as_bytes();
+    let mut i = 0;
+    while i + 1 < bytes.len() {
+        if bytes[i] == b'\\' {
+            if bytes[i + 1].is_ascii_digit() {
+                return true;
+            }
+            i += 2;
+        } else {
+            i += 1;
+        }
+    }
+    false
+}
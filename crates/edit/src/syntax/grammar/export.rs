@@ -0,0 +1,337 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//! Our lexers as TextMate grammars, for editors that only read those.
+//!
+//! The lexers are code rather than rules, so a lexer that can be exported declares what
+//! a grammar can express of it as [`ExportRules`]: its string literals, escapes, numbers,
+//! word lists and operators. Comments, brackets and functions come from the language's
+//! [`GrammarMetadata`](crate::syntax::GrammarMetadata). What depends on more context
+//! than a grammar has, like Go's doc comments, is listed as a warning.
+//!
+//! The grammar has a repository entry per state of the lexer (comments, each kind of
+//! string, ...), and multi-line constructs like block comments and raw strings are
+//! `begin`/`end` rules. The scopes follow TextMate's naming conventions, so that
+//! `"text"` in Go is a `string.quoted.double.go`.
+
+use std::fmt::Write as _;
+
+use crate::syntax::Language;
+use crate::syntax::lexer::export_rules;
+
+/// A lexer's rules that a TextMate grammar can express.
+pub(crate) struct ExportRules {
+    pub strings: &'static [StringRule],
+    /// Escape sequences in strings that have them.
+    pub escapes: &'static str,
+    pub numbers: &'static str,
+    /// Words by scope, each with a lookahead they must be followed by, like `(?=\()`.
+    pub words: &'static [(&'static str, &'static str, &'static [&'static str])],
+    pub operators: &'static str,
+    /// What may stand between a function's keyword and its name, like Go's receivers.
+    pub receiver: &'static str,
+    /// What the lexer does that a grammar can't, for the warnings.
+    pub context_sensitive: &'static [&'static str],
+}
+
+/// A kind of string literal.
+pub(crate) struct StringRule {
+    pub open: &'static str,
+    pub close: &'static str,
+    /// The scope, without the language's suffix.
+    pub scope: &'static str,
+    pub escapes: bool,
+    /// Whether `%d` and the like are format verbs.
+    pub verbs: bool,
+    /// Whether the string goes on past the end of its line rather than ending there.
+    pub multi_line: bool,
+}
+
+/// A lexer exported as a TextMate grammar.
+#[derive(Debug, Clone)]
+pub struct ExportedGrammar {
+    /// The grammar, in the JSON form of `.tmLanguage.json` files.
+    pub json: String,
+    /// What the lexer highlights that the grammar doesn't.
+    pub warnings: Vec<String>,
+}
+
+/// `fmt`'s verbs, like `%-8.2f` and `%[1]d`.
+const FORMAT_VERB: &str = r"%(?:\[\d+\])?[-+# 0]*(?:\[\d+\])?(?:\d+|\*)?(?:\.(?:\[\d+\])?(?:\d+|\*)?)?(?:\[\d+\])?[a-zA-Z%]";
+
+/// Export the lexer of `language` as a TextMate grammar, or explain why it can't be.
+pub fn export_grammar(language: Language) -> Result<ExportedGrammar, String> {
+    let rules = export_rules(language).ok_or_else(|| {
+        format!("the {} lexer can't be exported as a TextMate grammar", language.name())
+    })?;
+    let metadata = language.metadata();
+    let suffix = language.id();
+    let scope = |name: &str| Json::String(format!("{name}.{suffix}"));
+    let mut warnings: Vec<String> = rules.context_sensitive.iter().map(|w| w.to_string()).collect();
+    let mut repository: Vec<(String, Json)> = Vec::new();
+
+    let comments = metadata.comments;
+    let mut comment_rules = Vec::new();
+    if let Some((open, close)) = comments.block {
+        comment_rules.push(Json::object([
+            ("name", scope("comment.block")),
+            ("begin", Json::regex(open)),
+            ("end", Json::regex(close)),
+            ("captures", captures([(0, "punctuation.definition.comment", suffix)])),
+        ]));
+        if comments.nested {
+            warnings.push("nested block comments, which end at the first close".to_string());
+        }
+    }
+    if let Some(open) = comments.line {
+        let kind = match open {
+            "//" => "double-slash",
+            "#" => "number-sign",
+            "--" => "double-dash",
+            _ => "other",
+        };
+        comment_rules.push(Json::object([
+            ("name", scope(&format!("comment.line.{kind}"))),
+            ("begin", Json::regex(open)),
+            ("beginCaptures", captures([(0, "punctuation.definition.comment", suffix)])),
+            ("end", Json::string("$")),
+        ]));
+    }
+    repository.push(("comments".to_string(), patterns(comment_rules)));
+
+    let mut string_includes = Vec::new();
+    for string in rules.strings {
+        let name = string.scope.rsplit('.').next().unwrap_or(string.scope);
+        let close = regex_escape(string.close);
+        let mut inner = Vec::new();
+        if string.escapes {
+            inner.push(include("escapes"));
+        }
+        if string.verbs {
+            inner.push(include("format_verbs"));
+        }
+        repository.push((
+            format!("string_{name}"),
+            Json::object([
+                ("name", scope(string.scope)),
+                ("begin", Json::regex(string.open)),
+                ("beginCaptures", captures([(0, "punctuation.definition.string.begin", suffix)])),
+                ("end", Json::String(if string.multi_line { close } else { format!("{close}|$") })),
+                ("endCaptures", captures([(0, "punctuation.definition.string.end", suffix)])),
+                ("patterns", Json::Array(inner)),
+            ]),
+        ));
+        string_includes.push(include(&format!("string_{name}")));
+    }
+    repository.push(("strings".to_string(), patterns(string_includes)));
+    repository.push((
+        "escapes".to_string(),
+        patterns(vec![
+            Json::object([
+                ("name", scope("constant.character.escape")),
+                ("match", Json::string(rules.escapes)),
+            ]),
+            Json::object([
+                ("name", scope("invalid.illegal.unknown-escape")),
+                ("match", Json::string(r"\\.")),
+            ]),
+        ]),
+    ));
+    if rules.strings.iter().any(|s| s.verbs) {
+        repository.push((
+            "format_verbs".to_string(),
+            Json::object([
+                ("name", scope("constant.other.placeholder")),
+                ("match", Json::string(FORMAT_VERB)),
+            ]),
+        ));
+    }
+    repository.push((
+        "numbers".to_string(),
+        Json::object([("name", scope("constant.numeric")), ("match", Json::string(rules.numbers))]),
+    ));
+
+    let mut word_rules = Vec::new();
+    for &(name, lookahead, words) in rules.words {
+        let alternatives: Vec<String> = words.iter().map(|w| regex_escape(w)).collect();
+        word_rules.push(Json::object([
+            ("name", scope(name)),
+            ("match", Json::String(format!(r"\b(?:{})\b{lookahead}", alternatives.join("|")))),
+        ]));
+    }
+    repository.push(("words".to_string(), patterns(word_rules)));
+
+    let functions = metadata.functions;
+    let mut function_rules = Vec::new();
+    const NAME: &str = r"[[:alpha:]_][[:alnum:]_]*";
+    if !functions.keywords.is_empty() {
+        let keywords: Vec<String> = functions.keywords.iter().map(|k| regex_escape(k)).collect();
+        let receiver = rules.receiver;
+        function_rules.push(Json::object([
+            ("match", Json::String(format!(r"\b({})\s+{receiver}({NAME})", keywords.join("|")))),
+            (
+                "captures",
+                captures([(1, "keyword.other", suffix), (2, "entity.name.function", suffix)]),
+            ),
+        ]));
+    }
+    if functions.calls {
+        // Keywords like `if (` and `func(` aren't calls.
+        let keywords: Vec<String> = rules
+            .words
+            .iter()
+            .filter(|(_, lookahead, _)| lookahead.is_empty())
+            .flat_map(|(_, _, words)| words.iter().map(|w| regex_escape(w)))
+            .collect();
+        function_rules.push(Json::object([
+            (
+                "match",
+                Json::String(format!(r"\b(?!(?:{})\b)({NAME})(?=\s*\()", keywords.join("|"))),
+            ),
+            ("captures", captures([(1, "entity.name.function", suffix)])),
+        ]));
+    }
+    if functions.body_follows {
+        warnings.push(
+            "function definitions without a keyword, which are told apart from calls by their body"
+                .to_string(),
+        );
+    }
+    repository.push(("functions".to_string(), patterns(function_rules)));
+
+    let brackets: String =
+        metadata.brackets.iter().flat_map(|&(open, close)| [open, close]).map(char::from).collect();
+    repository.push((
+        "operators".to_string(),
+        patterns(vec![
+            Json::object([
+                ("name", scope("keyword.operator")),
+                ("match", Json::string(rules.operators)),
+            ]),
+            Json::object([
+                ("name", scope("punctuation.section.brackets")),
+                ("match", Json::String(format!("[{}]", regex_escape(&brackets)))),
+            ]),
+            Json::object([
+                ("name", scope("punctuation.separator")),
+                ("match", Json::string(r"[,;:.]")),
+            ]),
+        ]),
+    ));
+
+    // Functions come before the words, so that `func` in `func name(` is part of its rule,
+    // and after them for built-in functions.
+    let order = ["comments", "strings", "numbers", "functions", "words", "operators"];
+    let grammar = Json::object([
+        ("name", Json::string(language.name())),
+        ("scopeName", Json::String(format!("source.{suffix}"))),
+        ("fileTypes", Json::Array(language.extensions().iter().map(|e| Json::string(e)).collect())),
+        ("patterns", Json::Array(order.iter().map(|name| include(name)).collect())),
+        ("repository", Json::Object(repository)),
+    ]);
+    let mut json = String::new();
+    grammar.write(&mut json, 0);
+    json.push('\n');
+    Ok(ExportedGrammar { json, warnings })
+}
+
+/// A JSON value to write.
+enum Json {
+    String(String),
+    Array(Vec<Json>),
+    Object(Vec<(String, Json)>),
+}
+
+impl Json {
+    fn string(s: &str) -> Self {
+        Json::String(s.to_string())
+    }
+
+    /// A regex that matches `text`.
+    fn regex(text: &str) -> Self {
+        Json::String(regex_escape(text))
+    }
+
+    fn object<const N: usize>(entries: [(&str, Json); N]) -> Self {
+        Json::Object(entries.into_iter().map(|(key, value)| (key.to_string(), value)).collect())
+    }
+
+    /// Write the value with tabs, like the grammars in VS Code's repository.
+    fn write(&self, out: &mut String, depth: usize) {
+        let indent = |out: &mut String, depth| out.extend(std::iter::repeat_n('\t', depth));
+        match self {
+            Json::String(s) => {
+                out.push('"');
+                for ch in s.chars() {
+                    match ch {
+                        '"' => out.push_str("\\\""),
+                        '\\' => out.push_str("\\\\"),
+                        '\n' => out.push_str("\\n"),
+                        '\t' => out.push_str("\\t"),
+                        ch if (ch as u32) < 0x20 => _ = write!(out, "\\u{:04x}", ch as u32),
+                        ch => out.push(ch),
+                    }
+                }
+                out.push('"');
+            }
+            Json::Array(items) if items.is_empty() => out.push_str("[]"),
+            Json::Array(items) => {
+                out.push_str("[\n");
+                for (i, item) in items.iter().enumerate() {
+                    indent(out, depth + 1);
+                    item.write(out, depth + 1);
+                    out.push_str(if i + 1 < items.len() { ",\n" } else { "\n" });
+                }
+                indent(out, depth);
+                out.push(']');
+            }
+            Json::Object(entries) => {
+                out.push_str("{\n");
+                for (i, (key, value)) in entries.iter().enumerate() {
+                    indent(out, depth + 1);
+                    Json::string(key).write(out, depth + 1);
+                    out.push_str(": ");
+                    value.write(out, depth + 1);
+                    out.push_str(if i + 1 < entries.len() { ",\n" } else { "\n" });
+                }
+                indent(out, depth);
+                out.push('}');
+            }
+        }
+    }
+}
+
+fn include(name: &str) -> Json {
+    Json::object([("include", Json::String(format!("#{name}")))])
+}
+
+fn patterns(rules: Vec<Json>) -> Json {
+    Json::object([("patterns", Json::Array(rules))])
+}
+
+/// Captures that scope groups, as `(group, scope, suffix)`.
+fn captures<const N: usize>(groups: [(usize, &str, &str); N]) -> Json {
+    Json::Object(
+        groups
+            .iter()
+            .map(|&(group, name, suffix)| {
+                (
+                    group.to_string(),
+                    Json::object([("name", Json::String(format!("{name}.{suffix}")))]),
+                )
+            })
+            .collect(),
+    )
+}
+
+/// Escape `text` so that an Oniguruma regex matches it literally.
+fn regex_escape(text: &str) -> String {
+    let mut escaped = String::new();
+    for ch in text.chars() {
+        if r"\^$.|?*+()[]{}-#".contains(ch) {
+            escaped.push('\\');
+        }
+        escaped.push(ch);
+    }
+    escaped
+}
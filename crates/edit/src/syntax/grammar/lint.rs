@@ -0,0 +1,460 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//! Static checks of TextMate grammars, for the problems hand-edited ones pick up.
+//!
+//! [`validate_grammar`] reports everything that keeps [`Grammar::parse`](super::Grammar::parse) from loading a
+//! grammar, all of it rather than the first, and what loads but doesn't work as meant:
+//! rules that can match the empty string, rules that never match because an earlier one
+//! matches the same text first, and scope names that don't follow TextMate's conventions.
+//! Unlike loading, it checks every rule, including repository entries nothing includes.
+//!
+//! Problems are reported by the path of the rule, like `repository.strings.patterns[2]`,
+//! in the same form as the errors of loading.
+
+use std::collections::HashSet;
+
+use stdext::arena::scratch_arena;
+
+use super::regex::Regex;
+use super::{has_backrefs, substitute_backrefs};
+use crate::json::{self, Object, Value};
+
+/// The path of the grammar itself, whose `patterns` are `grammar.patterns`.
+const ROOT: &str = "grammar";
+
+/// The scopes TextMate's naming conventions start with, which are what themes style.
+/// `source` and `text` are the roots of grammars, which embedded code gets scoped with.
+const STANDARD_SCOPES: &[&str] = &[
+    "comment",
+    "constant",
+    "entity",
+    "invalid",
+    "keyword",
+    "markup",
+    "meta",
+    "punctuation",
+    "source",
+    "storage",
+    "string",
+    "support",
+    "text",
+    "variable",
+];
+
+/// What a [`GrammarProblem`] is about.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Hash)]
+pub enum GrammarProblemKind {
+    /// Something [`Grammar::parse`](super::Grammar::parse) refuses, like a regex it can't compile.
+    Invalid,
+    /// A `begin` rule without an `end` or `while`, or one of those without a `begin`.
+    MissingEnd,
+    /// An `include` of a repository entry that doesn't exist, or of another grammar.
+    UndefinedInclude,
+    /// A `match` rule that can match the empty string, or a `begin` rule whose `begin`
+    /// and `end` both can, which make no progress.
+    EmptyMatch,
+    /// A rule that never matches, because an earlier one among the same patterns
+    /// matches the same text first.
+    Shadowed,
+    /// A scope name that doesn't follow the conventions, which themes won't style.
+    ScopeName,
+}
+
+impl GrammarProblemKind {
+    pub const ALL: &[GrammarProblemKind] = &[
+        GrammarProblemKind::Invalid,
+        GrammarProblemKind::MissingEnd,
+        GrammarProblemKind::UndefinedInclude,
+        GrammarProblemKind::EmptyMatch,
+        GrammarProblemKind::Shadowed,
+        GrammarProblemKind::ScopeName,
+    ];
+
+    /// The kind's name in reports, like `empty-match`.
+    pub fn code(self) -> &'static str {
+        match self {
+            GrammarProblemKind::Invalid => "invalid",
+            GrammarProblemKind::MissingEnd => "missing-end",
+            GrammarProblemKind::UndefinedInclude => "undefined-include",
+            GrammarProblemKind::EmptyMatch => "empty-match",
+            GrammarProblemKind::Shadowed => "shadowed",
+            GrammarProblemKind::ScopeName => "scope-name",
+        }
+    }
+
+    /// Get the kind with the given [`code`](Self::code).
+    pub fn from_code(code: &str) -> Option<Self> {
+        Self::ALL.iter().copied().find(|kind| kind.code() == code)
+    }
+
+    /// Whether the grammar can't work as meant, as opposed to a warning that it
+    /// might not, which a grammar may have reasons for.
+    pub fn is_error(self) -> bool {
+        !matches!(self, GrammarProblemKind::Shadowed | GrammarProblemKind::ScopeName)
+    }
+}
+
+/// A problem with a grammar.
+#[derive(Debug, Clone, PartialEq, Eq, Hash)]
+pub struct GrammarProblem {
+    pub kind: GrammarProblemKind,
+    /// Where the problem is, like `repository.strings.patterns[2].match`.
+    pub path: String,
+    /// A description of the problem, e.g. "no repository entry named strings".
+    pub message: String,
+}
+
+/// Check the grammar in `json`, the JSON form of `.tmLanguage.json` files, and return its
+/// problems, errors and warnings alike, in the order of the rules.
+pub fn validate_grammar(json: &str) -> Vec<GrammarProblem> {
+    let root_problem = |message: &str| {
+        vec![GrammarProblem {
+            kind: GrammarProblemKind::Invalid,
+            path: ROOT.to_string(),
+            message: message.to_string(),
+        }]
+    };
+    if json.trim_start().starts_with('<') {
+        return root_problem(
+            "grammars in the XML property list format aren't supported, convert them to JSON",
+        );
+    }
+    let arena = scratch_arena(None);
+    let root = match json::parse(&arena, json) {
+        Ok(root) => root,
+        Err(err) => return root_problem(&err.to_string()),
+    };
+    let Some(object) = root.as_object() else {
+        return root_problem("a grammar must be an object");
+    };
+    let Some(scope_name) = object.get_str("scopeName") else {
+        return root_problem("a grammar must have a scopeName");
+    };
+
+    let mut linter = Linter { problems: Vec::new(), root: &root, scope_name };
+    if !scope_name.starts_with("source.") && !scope_name.starts_with("text.") {
+        linter.problem(
+            GrammarProblemKind::ScopeName,
+            format!("{ROOT}.scopeName"),
+            format!("`{scope_name}` should start with source. or text."),
+        );
+    } else {
+        linter.scope_names(&format!("{ROOT}.scopeName"), scope_name);
+    }
+    linter.rule(&root, &[], ROOT);
+
+    // Rules included in several places are checked once per place.
+    let mut seen = HashSet::new();
+    linter.problems.retain(|problem| seen.insert(problem.clone()));
+    linter.problems
+}
+
+struct Linter<'g> {
+    problems: Vec<GrammarProblem>,
+    root: &'g Value<'g>,
+    scope_name: &'g str,
+}
+
+impl<'g> Linter<'g> {
+    fn problem(&mut self, kind: GrammarProblemKind, path: String, message: String) {
+        self.problems.push(GrammarProblem { kind, path, message });
+    }
+
+    /// Check the rule `value`, whose enclosing repositories are `repositories`, innermost
+    /// last, and the rules in it.
+    fn rule(&mut self, value: &'g Value<'g>, repositories: &[Object<'g>], path: &str) {
+        let Some(object) = value.as_object() else {
+            self.problem(
+                GrammarProblemKind::Invalid,
+                path.to_string(),
+                "a rule must be an object".to_string(),
+            );
+            return;
+        };
+        if let Some(include) = object.get_str("include") {
+            if let Err(message) = self.resolve(include, repositories) {
+                self.problem(GrammarProblemKind::UndefinedInclude, path.to_string(), message);
+            }
+            return;
+        }
+
+        let mut scoped = repositories.to_vec();
+        match object.get("repository") {
+            None => {}
+            Some(Value::Object(_)) => {
+                let repository = object.get_object("repository").unwrap();
+                scoped.push(repository);
+                for (name, entry) in repository.iter() {
+                    self.rule(entry, &scoped, &format!("repository.{name}"));
+                }
+            }
+            Some(_) => self.invalid(path, "repository", "must be an object"),
+        }
+        let repositories = &scoped[..];
+
+        let mut string = |key: &str| match object.get(key) {
+            Some(Value::String(s)) => Some(*s),
+            Some(_) => {
+                self.invalid(path, key, "must be a string");
+                None
+            }
+            None => None,
+        };
+        // The grammar's own name is its display name, like `Go`.
+        let name = if path == ROOT { None } else { string("name") };
+        let content_name = string("contentName");
+        let (pattern, begin) = (string("match"), string("begin"));
+        let (end, while_) = (string("end"), string("while"));
+        for (key, names) in [("name", name), ("contentName", content_name)] {
+            if let Some(names) = names {
+                self.scope_names(&format!("{path}.{key}"), names);
+            }
+        }
+
+        if let Some(pattern) = pattern {
+            if self.compile(path, "match", pattern).is_some_and(|regex| regex.matches_empty()) {
+                self.problem(
+                    GrammarProblemKind::EmptyMatch,
+                    format!("{path}.match"),
+                    format!("`{pattern}` can match the empty string, which makes no progress"),
+                );
+            }
+        } else if let Some(begin) = begin {
+            let begin_regex = self.compile(path, "begin", begin);
+            match (end, while_) {
+                (Some(_), Some(_)) => self.problem(
+                    GrammarProblemKind::Invalid,
+                    path.to_string(),
+                    "a rule can't have both end and while".to_string(),
+                ),
+                (None, None) => self.problem(
+                    GrammarProblemKind::MissingEnd,
+                    path.to_string(),
+                    "a begin rule needs an end or a while".to_string(),
+                ),
+                (Some(end), None) => {
+                    let end_regex = self.compile(path, "end", end);
+                    let empty = |regex: Option<Regex>| regex.is_some_and(|r| r.matches_empty());
+                    if empty(begin_regex) && empty(end_regex) {
+                        self.problem(
+                            GrammarProblemKind::EmptyMatch,
+                            path.to_string(),
+                            "both begin and end can match the empty string, so the rule can \
+                             begin and end without making progress"
+                                .to_string(),
+                        );
+                    }
+                }
+                (None, Some(while_)) => {
+                    self.compile(path, "while", while_);
+                }
+            }
+        } else if end.is_some() || while_.is_some() {
+            self.problem(
+                GrammarProblemKind::MissingEnd,
+                path.to_string(),
+                "an end or while needs a begin".to_string(),
+            );
+        }
+
+        for key in ["captures", "beginCaptures", "endCaptures", "whileCaptures"] {
+            self.captures(object, key, repositories, path);
+        }
+        match object.get("patterns") {
+            None => {}
+            Some(Value::Array(patterns)) => {
+                for (i, pattern) in patterns.iter().enumerate() {
+                    self.rule(pattern, repositories, &format!("{path}.patterns[{i}]"));
+                }
+                self.shadowing(patterns, repositories, path);
+            }
+            Some(_) => self.invalid(path, "patterns", "must be an array"),
+        }
+    }
+
+    fn invalid(&mut self, path: &str, key: &str, message: &str) {
+        self.problem(GrammarProblemKind::Invalid, format!("{path}.{key}"), message.to_string());
+    }
+
+    /// Compile the `key` pattern of the rule at `path`, like loading does.
+    fn compile(&mut self, path: &str, key: &str, pattern: &str) -> Option<Regex> {
+        let result = if has_backrefs(pattern) {
+            Regex::new(&substitute_backrefs(pattern, b"", &[]))
+        } else {
+            Regex::new(pattern)
+        };
+        result.map_err(|message| self.invalid(path, key, &message)).ok()
+    }
+
+    fn captures(&mut self, object: Object<'g>, key: &str, repositories: &[Object<'g>], path: &str) {
+        let entries: Vec<(String, &'g Value<'g>)> = match object.get(key) {
+            None => return,
+            Some(value @ Value::Object(_)) => value
+                .as_object()
+                .unwrap()
+                .iter()
+                .map(|(group, value)| (group.to_string(), value))
+                .collect(),
+            Some(Value::Array(values)) => {
+                values.iter().enumerate().map(|(group, value)| (group.to_string(), value)).collect()
+            }
+            Some(_) => return self.invalid(path, key, "must be an object"),
+        };
+        for (group, value) in entries {
+            // A capture is a rule with a name and maybe patterns, but no regex of its own.
+            self.rule(value, repositories, &format!("{path}.{key}.{group}"));
+        }
+    }
+
+    /// Resolve an `include` to the rule it refers to and that rule's repositories,
+    /// or explain why it doesn't refer to any.
+    fn resolve(
+        &self,
+        include: &str,
+        repositories: &[Object<'g>],
+    ) -> Result<(&'g Value<'g>, usize, String), String> {
+        if include == "$self" || include == "$base" || include == self.scope_name {
+            return Ok((self.root, 0, ROOT.to_string()));
+        }
+        let Some(name) = include.strip_prefix('#') else {
+            return Err(format!("including other grammars isn't supported: {include}"));
+        };
+        for (depth, repository) in repositories.iter().enumerate().rev() {
+            if let Some(value) = repository.get(name) {
+                return Ok((value, depth + 1, format!("repository.{name}")));
+            }
+        }
+        Err(format!("no repository entry named {name}"))
+    }
+
+    /// Warn about the rules among `patterns` that an earlier one always wins against,
+    /// with groups and includes replaced by their patterns, like when highlighting.
+    fn shadowing(&mut self, patterns: &'g [Value<'g>], repositories: &[Object<'g>], path: &str) {
+        let mut flat = Vec::new();
+        self.flatten(patterns, repositories, path, &mut HashSet::new(), &mut flat);
+        for (j, (later_path, later)) in flat.iter().enumerate() {
+            if let Some((earlier_path, _)) =
+                flat[..j].iter().find(|(_, earlier)| shadows(earlier, later))
+            {
+                let message = format!("never matches, {earlier_path} matches the same text first");
+                self.problem(GrammarProblemKind::Shadowed, later_path.clone(), message);
+            }
+        }
+    }
+
+    /// Collect the paths and regexes of the match and begin rules among `patterns`,
+    /// each once.
+    fn flatten(
+        &self,
+        patterns: &'g [Value<'g>],
+        repositories: &[Object<'g>],
+        path: &str,
+        seen: &mut HashSet<*const Value<'g>>,
+        flat: &mut Vec<(String, &'g str)>,
+    ) {
+        for (i, mut value) in patterns.iter().enumerate() {
+            let mut path = format!("{path}.patterns[{i}]");
+            let mut repositories = repositories;
+            // An include of an include is followed, up to a loop.
+            let mut followed = HashSet::new();
+            while let Some(include) = value.as_object().and_then(|o| o.get_str("include")) {
+                let Ok((included, depth, included_path)) = self.resolve(include, repositories)
+                else {
+                    break;
+                };
+                if !followed.insert(included as *const _) {
+                    break;
+                }
+                (value, repositories, path) = (included, &repositories[..depth], included_path);
+            }
+            let Some(object) = value.as_object().filter(|o| o.get("include").is_none()) else {
+                continue;
+            };
+            if !seen.insert(value as *const _) {
+                continue;
+            }
+            if let Some(regex) = object.get_str("match").or_else(|| object.get_str("begin")) {
+                flat.push((path, regex));
+            } else if let Some(patterns) = object.get_array("patterns") {
+                let mut scoped = repositories.to_vec();
+                scoped.extend(object.get_object("repository"));
+                self.flatten(patterns, &scoped, &path, seen, flat);
+            }
+        }
+    }
+
+    /// Warn about the scopes in `names`, a `name` or `contentName` that can have several,
+    /// that don't follow the conventions.
+    fn scope_names(&mut self, path: &str, names: &str) {
+        for scope in names.split_whitespace() {
+            // Captured text substituted for `$1` can be anything.
+            if scope.contains('$') {
+                continue;
+            }
+            let valid = scope.split('.').all(|part| {
+                !part.is_empty()
+                    && part.bytes().all(|b| {
+                        b.is_ascii_lowercase() || b.is_ascii_digit() || b"-_+".contains(&b)
+                    })
+            });
+            let message = if !valid {
+                format!("`{scope}` should be lowercase words separated by dots")
+            } else if !STANDARD_SCOPES.contains(&scope.split('.').next().unwrap()) {
+                format!(
+                    "`{scope}` should start with one of the standard scopes, like keyword or \
+                     string, for themes to style it"
+                )
+            } else {
+                continue;
+            };
+            self.problem(GrammarProblemKind::ScopeName, path.to_string(), message);
+        }
+    }
+}
+
+/// Whether the regex `earlier` matches wherever `later` does, and the same text, so that
+/// `later` never wins. That's known for the same regex, and for words like `\bif\b` that
+/// are in an earlier list like `\b(?:if|else)\b`.
+fn shadows(earlier: &str, later: &str) -> bool {
+    if earlier == later {
+        return true;
+    }
+    match (words(earlier), words(later)) {
+        (Some(earlier), Some(later)) => later.iter().all(|word| earlier.contains(word)),
+        _ => false,
+    }
+}
+
+/// The words of a regex that matches a list of them, like `\b(?:if|else)\b`.
+fn words(regex: &str) -> Option<Vec<&str>> {
+    let inner = regex.strip_prefix(r"\b")?.strip_suffix(r"\b")?;
+    let inner = match inner.strip_prefix("(?:").or_else(|| inner.strip_prefix('(')) {
+        Some(group) => group.strip_suffix(')')?,
+        None => inner,
+    };
+    let words: Vec<_> = inner.split('|').collect();
+    words
+        .iter()
+        .all(|w| !w.is_empty() && w.bytes().all(|b| b.is_ascii_alphanumeric() || b == b'_'))
+        .then_some(words)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_words() {
+        assert_eq!(words(r"\b(?:if|else)\b"), Some(vec!["if", "else"]));
+        assert_eq!(words(r"\b(if|else)\b"), Some(vec!["if", "else"]));
+        assert_eq!(words(r"\bfunc\b"), Some(vec!["func"]));
+        assert_eq!(words(r"\b(?:if|)\b"), None);
+        assert_eq!(words(r"\b(?:i.)\b"), None);
+        assert_eq!(words(r"(?:if|else)"), None);
+        assert!(shadows(r"\b(?:if|else)\b", r"\bif\b"));
+        assert!(!shadows(r"\bif\b", r"\b(?:if|else)\b"));
+        assert!(shadows("a+", "a+"));
+        assert!(!shadows("a+", "a"));
+    }
+}
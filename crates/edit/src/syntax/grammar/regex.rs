@@ -0,0 +1,1279 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//! A backtracking regex engine for the subset of Oniguruma that TextMate grammars use.
+//!
+//! Grammars are written against Oniguruma's Ruby syntax, which needs backtracking for its
+//! backreferences and lookbehinds, so this is a small backtracking VM rather than an
+//! automaton. It matches UTF-8 text character by character, and invalid bytes match
+//! nothing but `.` and negated classes, one byte at a time.
+//!
+//! Supported are
+//! - literals, `.`, classes like `[^a-z\d]` with nested classes and POSIX brackets
+//!   like `[[:alpha:]]`, and the escapes `\d \w \s \h` and their negations,
+//!   `\t \n \r \f \v \a \e \0`, `\xHH`, `\x{H...}` and `\uHHHH`,
+//! - the anchors `^ $ \A \z \Z \G \b \B`, where `^` and `$` match at line boundaries,
+//! - groups: capturing, named (`(?<name>...)`), non-capturing, atomic (`(?>...)`),
+//!   lookahead and lookbehind, the latter with a bounded length like in Oniguruma,
+//! - the quantifiers `* + ? {n} {n,} {,m} {n,m}`, lazy with `?` and possessive with `+`,
+//! - backreferences `\1`..`\9` and `\k<name>`,
+//! - the flags `i`, `x` and `m` (which lets `.` match a newline), inline like `(?i)`
+//!   or for a group like `(?i:...)`, and turned off with `-`.
+//!
+//! Anything else is an error when the regex is compiled, rather than matching something
+//! else than the grammar's author meant: Unicode properties (`\p{L}`), `\K`, `\R`, `\X`,
+//! subexpression calls (`\g<name>`), conditionals (`(?(1)...)`), absent operators
+//! (`(?~...)`), class intersections (`&&`) and quoting (`\Q...\E`).
+//!
+//! A search that backtracks too much gives up and reports no match, so that a
+//! pathological pattern can't hang the highlighter.
+
+use std::ops::Range;
+
+use crate::syntax::lexer::{decode, simple_fold, simple_fold_eq};
+
+/// How many instructions a single search may execute before it gives up.
+const FUEL: usize = 1 << 20;
+
+/// The most instructions a compiled regex may have, which bounds counted repetitions.
+const MAX_PROGRAM: usize = 1 << 16;
+
+/// A compiled regex.
+#[derive(Debug, Clone)]
+pub struct Regex {
+    program: Vec<Inst>,
+    classes: Vec<Class>,
+    /// The number of capture groups, including the whole match as group 0.
+    groups: usize,
+    /// The number of slots: a start and an end per group, then one per loop.
+    slots: usize,
+    /// An ASCII byte every match starts with, to skip ahead to.
+    first_byte: Option<u8>,
+    /// Whether some match is empty, like any match of `a*` or `(?=a)`.
+    matches_empty: bool,
+}
+
+/// Where a search runs.
+#[derive(Debug, Clone, Copy, Default)]
+pub struct Context {
+    /// Where `\G` matches, if anywhere.
+    pub anchor: Option<usize>,
+    /// Whether the text starts the document, which is where `\A` matches.
+    pub first_line: bool,
+}
+
+impl Regex {
+    /// Compile `pattern`, or explain why it can't be.
+    pub fn new(pattern: &str) -> Result<Self, String> {
+        let mut parser =
+            Parser { pattern, pos: 0, flags: Flags::default(), groups: 1, names: Vec::new() };
+        let node = parser.parse_alternation()?;
+        if parser.pos < pattern.len() {
+            return Err(parser.error("unmatched `)`"));
+        }
+
+        let mut compiler = Compiler { program: Vec::new(), classes: Vec::new(), loops: 0 };
+        compiler.push(Inst::Save(0));
+        compiler.compile(&node)?;
+        compiler.push(Inst::Save(1));
+        compiler.push(Inst::Match);
+        let groups = parser.groups;
+        let first_byte = match compiler.program.get(1) {
+            Some(&Inst::Char(ch)) if ch.is_ascii() => Some(ch as u8),
+            _ => None,
+        };
+        Ok(Self {
+            program: compiler.program,
+            classes: compiler.classes,
+            groups,
+            slots: 2 * groups + compiler.loops,
+            first_byte,
+            matches_empty: min_length(&node) == 0,
+        })
+    }
+
+    /// Whether the regex can match the empty string, at least in some places.
+    pub fn matches_empty(&self) -> bool {
+        self.matches_empty
+    }
+
+    /// Find the first match in `text` that starts at or after `start`, and return the
+    /// ranges of its groups, the whole match first. Groups that didn't take part in the
+    /// match are `None`.
+    pub fn search(
+        &self,
+        text: &[u8],
+        start: usize,
+        context: Context,
+    ) -> Option<Vec<Option<Range<usize>>>> {
+        let mut exec = Exec { regex: self, text, context, fuel: FUEL };
+        let mut slots = vec![None; self.slots];
+        let mut pos = start;
+        while pos <= text.len() {
+            if let Some(first) = self.first_byte {
+                pos += text[pos..].iter().position(|&b| b == first)?;
+            }
+            if exec.run(0, pos, &mut slots, None).is_some() {
+                return Some(
+                    (0..self.groups).map(|g| Some(slots[2 * g]?..slots[2 * g + 1]?)).collect(),
+                );
+            }
+            if exec.fuel == 0 || pos == text.len() {
+                return None;
+            }
+            pos += char_at(text, pos).map_or(1, |(_, len)| len);
+        }
+        None
+    }
+}
+
+/// Escape `text` so that it matches itself, to substitute captures into a pattern.
+pub fn escape(text: &str) -> String {
+    let mut escaped = String::with_capacity(text.len());
+    for ch in text.chars() {
+        if "\\^$.|?*+()[]{}#- \t\n".contains(ch) {
+            escaped.push('\\');
+        }
+        match ch {
+            '\t' => escaped.push('t'),
+            '\n' => escaped.push('n'),
+            _ => escaped.push(ch),
+        }
+    }
+    escaped
+}
+
+/// The character at `pos`, or `None` at the end of the text. Invalid UTF-8 decodes as
+/// U+FFFD, one byte at a time.
+fn char_at(text: &[u8], pos: usize) -> Option<(char, usize)> {
+    let b = *text.get(pos)?;
+    if b < 0x80 {
+        return Some((b as char, 1));
+    }
+    Some(decode(text, pos).unwrap_or((char::REPLACEMENT_CHARACTER, 1)))
+}
+
+/// The character before `pos` and where it starts, if there is one.
+fn char_before(text: &[u8], pos: usize) -> Option<(char, usize)> {
+    let start = (pos.saturating_sub(4)..pos).rev().find(|&i| (text[i] as i8) >= -0x40);
+    match start.and_then(|start| Some((char_at(text, start)?, start))) {
+        Some(((ch, len), start)) if start + len == pos => Some((ch, start)),
+        _ => pos.checked_sub(1).map(|start| (char::REPLACEMENT_CHARACTER, start)),
+    }
+}
+
+fn is_word(ch: char) -> bool {
+    ch.is_alphanumeric() || ch == '_'
+}
+
+#[derive(Debug, Clone, Copy, Default)]
+struct Flags {
+    ignore_case: bool,
+    extended: bool,
+    dot_all: bool,
+}
+
+#[derive(Debug, Clone)]
+enum Node {
+    Empty,
+    Char(char, bool),
+    Any(bool),
+    Class(Class),
+    Assert(Assertion),
+    Group(Box<Node>, Option<usize>),
+    Concat(Vec<Node>),
+    Alternation(Vec<Node>),
+    Repeat { node: Box<Node>, min: u32, max: Option<u32>, greedy: bool, possessive: bool },
+    Look(Box<Node>, Look),
+    Atomic(Box<Node>),
+    Backref(usize, bool),
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+enum Assertion {
+    LineStart,
+    LineEnd,
+    TextStart,
+    TextEnd,
+    TextEndNewline,
+    Anchor,
+    WordBoundary,
+    NotWordBoundary,
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+enum Look {
+    Ahead,
+    NotAhead,
+    Behind,
+    NotBehind,
+}
+
+#[derive(Debug, Clone, Default)]
+struct Class {
+    negated: bool,
+    ignore_case: bool,
+    items: Vec<ClassItem>,
+}
+
+#[derive(Debug, Clone)]
+enum ClassItem {
+    Range(char, char),
+    /// A shorthand like `\d` or `[:alpha:]`, negated or not.
+    Shorthand(Shorthand, bool),
+    Class(Class),
+}
+
+#[derive(Debug, Clone, Copy)]
+enum Shorthand {
+    Digit,
+    Word,
+    Space,
+    Hex,
+    Alpha,
+    Alnum,
+    Upper,
+    Lower,
+    Punct,
+    Blank,
+    Cntrl,
+    Print,
+    Graph,
+}
+
+impl Shorthand {
+    fn matches(self, ch: char) -> bool {
+        match self {
+            Shorthand::Digit => ch.is_ascii_digit(),
+            Shorthand::Word => is_word(ch),
+            Shorthand::Space => ch.is_whitespace(),
+            Shorthand::Hex => ch.is_ascii_hexdigit(),
+            Shorthand::Alpha => ch.is_alphabetic(),
+            Shorthand::Alnum => ch.is_alphanumeric(),
+            Shorthand::Upper => ch.is_uppercase(),
+            Shorthand::Lower => ch.is_lowercase(),
+            Shorthand::Punct => ch.is_ascii_punctuation(),
+            Shorthand::Blank => ch == ' ' || ch == '\t',
+            Shorthand::Cntrl => ch.is_control(),
+            Shorthand::Print => !ch.is_control(),
+            Shorthand::Graph => !ch.is_control() && !ch.is_whitespace(),
+        }
+    }
+}
+
+impl Class {
+    fn matches(&self, ch: char) -> bool {
+        let hit = self.items.iter().any(|item| match *item {
+            ClassItem::Range(lo, hi) => {
+                (lo..=hi).contains(&ch)
+                    || (self.ignore_case && {
+                        let folded = simple_fold(ch);
+                        let upper = ch.to_uppercase().next().unwrap_or(ch);
+                        (lo..=hi).contains(&folded) || (lo..=hi).contains(&upper)
+                    })
+            }
+            ClassItem::Shorthand(shorthand, negated) => shorthand.matches(ch) != negated,
+            ClassItem::Class(ref class) => class.matches(ch),
+        });
+        hit != self.negated
+    }
+}
+
+struct Parser<'a> {
+    pattern: &'a str,
+    pos: usize,
+    flags: Flags,
+    /// The number of groups so far, including group 0.
+    groups: usize,
+    names: Vec<(&'a str, usize)>,
+}
+
+impl<'a> Parser<'a> {
+    fn error(&self, message: &str) -> String {
+        format!("{message} at offset {} of `{}`", self.pos, self.pattern)
+    }
+
+    fn peek(&self) -> Option<char> {
+        self.pattern[self.pos..].chars().next()
+    }
+
+    fn next(&mut self) -> Option<char> {
+        let ch = self.peek()?;
+        self.pos += ch.len_utf8();
+        Some(ch)
+    }
+
+    fn eat(&mut self, s: &str) -> bool {
+        let found = self.pattern[self.pos..].starts_with(s);
+        if found {
+            self.pos += s.len();
+        }
+        found
+    }
+
+    /// Skip whitespace and comments in extended mode.
+    fn skip_extended(&mut self) {
+        if !self.flags.extended {
+            return;
+        }
+        loop {
+            match self.peek() {
+                Some(ch) if ch.is_whitespace() => self.pos += ch.len_utf8(),
+                Some('#') => {
+                    let rest = &self.pattern[self.pos..];
+                    self.pos += rest.find('\n').map_or(rest.len(), |i| i + 1);
+                }
+                _ => break,
+            }
+        }
+    }
+
+    fn parse_alternation(&mut self) -> Result<Node, String> {
+        // Inline flags like `(?i)` last until the end of the enclosing group.
+        let flags = self.flags;
+        let mut alternatives = vec![self.parse_concat()?];
+        while self.eat("|") {
+            alternatives.push(self.parse_concat()?);
+        }
+        self.flags = flags;
+        Ok(if alternatives.len() == 1 {
+            alternatives.pop().unwrap()
+        } else {
+            Node::Alternation(alternatives)
+        })
+    }
+
+    fn parse_concat(&mut self) -> Result<Node, String> {
+        let mut nodes = Vec::new();
+        loop {
+            self.skip_extended();
+            match self.peek() {
+                None | Some('|' | ')') => break,
+                _ => {}
+            }
+            let atom = self.parse_atom()?;
+            let atom = self.parse_quantifiers(atom)?;
+            nodes.push(atom);
+        }
+        Ok(match nodes.len() {
+            0 => Node::Empty,
+            1 => nodes.pop().unwrap(),
+            _ => Node::Concat(nodes),
+        })
+    }
+
+    fn parse_quantifiers(&mut self, mut atom: Node) -> Result<Node, String> {
+        loop {
+            self.skip_extended();
+            let start = self.pos;
+            let (min, max) = match self.peek() {
+                Some('*') => (0, None),
+                Some('+') => (1, None),
+                Some('?') => (0, Some(1)),
+                Some('{') => match self.parse_interval() {
+                    Some(interval) => interval,
+                    // A `{` that doesn't start an interval is a literal, like in Oniguruma.
+                    None => return Ok(atom),
+                },
+                _ => return Ok(atom),
+            };
+            if start == self.pos {
+                self.pos += 1;
+            }
+            if matches!(atom, Node::Empty | Node::Assert(_) | Node::Look(..)) {
+                return Err(self.error("nothing to repeat"));
+            }
+            let greedy = !self.eat("?");
+            let possessive = greedy && self.eat("+");
+            atom = Node::Repeat { node: Box::new(atom), min, max, greedy, possessive };
+        }
+    }
+
+    /// Parse `{n}`, `{n,}`, `{,m}` or `{n,m}`, or leave the position alone.
+    fn parse_interval(&mut self) -> Option<(u32, Option<u32>)> {
+        let rest = &self.pattern[self.pos..];
+        let end = rest.find('}')?;
+        let inner = &rest[1..end];
+        let number = |s: &str| if s.is_empty() { Some(None) } else { s.parse().ok().map(Some) };
+        let (min, max) = match inner.split_once(',') {
+            Some((min, max)) => (number(min)?, number(max)?),
+            None => {
+                let n = number(inner)??;
+                (Some(n), Some(n))
+            }
+        };
+        if min.is_none() && max.is_none() || max.is_some_and(|max| max < min.unwrap_or(0)) {
+            return None;
+        }
+        self.pos += end + 1;
+        Some((min.unwrap_or(0), max))
+    }
+
+    fn parse_atom(&mut self) -> Result<Node, String> {
+        let ch = self.next().unwrap();
+        let ignore_case = self.flags.ignore_case;
+        Ok(match ch {
+            '.' => Node::Any(self.flags.dot_all),
+            '^' => Node::Assert(Assertion::LineStart),
+            '$' => Node::Assert(Assertion::LineEnd),
+            '[' => Node::Class(self.parse_class()?),
+            '(' => self.parse_group()?,
+            '\\' => self.parse_escape()?,
+            '*' | '+' | '?' => return Err(self.error("nothing to repeat")),
+            _ => Node::Char(ch, ignore_case),
+        })
+    }
+
+    fn parse_group(&mut self) -> Result<Node, String> {
+        let node = if self.eat("?") {
+            let kind = self.next().ok_or_else(|| self.error("unterminated group"))?;
+            match kind {
+                ':' => Node::Group(Box::new(self.parse_alternation()?), None),
+                '>' => Node::Atomic(Box::new(self.parse_alternation()?)),
+                '=' => Node::Look(Box::new(self.parse_alternation()?), Look::Ahead),
+                '!' => Node::Look(Box::new(self.parse_alternation()?), Look::NotAhead),
+                '<' if self.eat("=") => {
+                    Node::Look(Box::new(self.parse_alternation()?), Look::Behind)
+                }
+                '<' if self.eat("!") => {
+                    Node::Look(Box::new(self.parse_alternation()?), Look::NotBehind)
+                }
+                '<' | '\'' | 'P' => {
+                    if kind == 'P' && !self.eat("<") {
+                        return Err(self.error("unsupported group"));
+                    }
+                    let close = if kind == '\'' { '\'' } else { '>' };
+                    let rest = &self.pattern[self.pos..];
+                    let end =
+                        rest.find(close).ok_or_else(|| self.error("unterminated group name"))?;
+                    let name = &rest[..end];
+                    if name.is_empty() || !name.chars().all(is_word) {
+                        return Err(self.error("invalid group name"));
+                    }
+                    self.pos += end + 1;
+                    let index = self.groups;
+                    self.groups += 1;
+                    self.names.push((name, index));
+                    Node::Group(Box::new(self.parse_alternation()?), Some(index))
+                }
+                '#' => {
+                    let rest = &self.pattern[self.pos..];
+                    let end = rest.find(')').ok_or_else(|| self.error("unterminated comment"))?;
+                    self.pos += end + 1;
+                    return Ok(Node::Empty);
+                }
+                '(' => return Err(self.error("conditionals aren't supported")),
+                '~' => return Err(self.error("absent operators aren't supported")),
+                _ => {
+                    self.pos -= kind.len_utf8();
+                    return self.parse_flags();
+                }
+            }
+        } else {
+            let index = self.groups;
+            self.groups += 1;
+            Node::Group(Box::new(self.parse_alternation()?), Some(index))
+        };
+        if !self.eat(")") {
+            return Err(self.error("unterminated group"));
+        }
+        Ok(node)
+    }
+
+    /// Parse `(?imx-imx)` or `(?imx-imx:...)`, after the `(?`.
+    fn parse_flags(&mut self) -> Result<Node, String> {
+        let mut flags = self.flags;
+        let mut on = true;
+        loop {
+            match self.next() {
+                Some('i') => flags.ignore_case = on,
+                Some('x') => flags.extended = on,
+                Some('m') => flags.dot_all = on,
+                Some('-') if on => on = false,
+                Some(')') => {
+                    // Until the end of the enclosing group, see `parse_alternation`.
+                    self.flags = flags;
+                    return Ok(Node::Empty);
+                }
+                Some(':') => {
+                    let outer = self.flags;
+                    self.flags = flags;
+                    let node = self.parse_alternation()?;
+                    self.flags = outer;
+                    if !self.eat(")") {
+                        return Err(self.error("unterminated group"));
+                    }
+                    return Ok(Node::Group(Box::new(node), None));
+                }
+                _ => return Err(self.error("unsupported group")),
+            }
+        }
+    }
+
+    fn parse_escape(&mut self) -> Result<Node, String> {
+        let ignore_case = self.flags.ignore_case;
+        let ch = self.next().ok_or_else(|| self.error("trailing backslash"))?;
+        let shorthand = |shorthand, negated| {
+            Node::Class(Class {
+                items: vec![ClassItem::Shorthand(shorthand, negated)],
+                ..Class::default()
+            })
+        };
+        Ok(match ch {
+            'A' => Node::Assert(Assertion::TextStart),
+            'z' => Node::Assert(Assertion::TextEnd),
+            'Z' => Node::Assert(Assertion::TextEndNewline),
+            'G' => Node::Assert(Assertion::Anchor),
+            'b' => Node::Assert(Assertion::WordBoundary),
+            'B' => Node::Assert(Assertion::NotWordBoundary),
+            'd' | 'D' => shorthand(Shorthand::Digit, ch == 'D'),
+            'w' | 'W' => shorthand(Shorthand::Word, ch == 'W'),
+            's' | 'S' => shorthand(Shorthand::Space, ch == 'S'),
+            'h' | 'H' => shorthand(Shorthand::Hex, ch == 'H'),
+            '1'..='9' => {
+                let mut index = ch.to_digit(10).unwrap() as usize;
+                while let Some(digit) = self.peek().and_then(|d| d.to_digit(10)) {
+                    if index * 10 + digit as usize >= self.groups {
+                        break;
+                    }
+                    index = index * 10 + digit as usize;
+                    self.pos += 1;
+                }
+                if index >= self.groups {
+                    return Err(self.error("backreference to a group that doesn't exist yet"));
+                }
+                Node::Backref(index, ignore_case)
+            }
+            'k' if self.eat("<") => {
+                let rest = &self.pattern[self.pos..];
+                let end = rest.find('>').ok_or_else(|| self.error("unterminated group name"))?;
+                let name = &rest[..end];
+                let index = match self.names.iter().rev().find(|(n, _)| *n == name) {
+                    Some(&(_, index)) => index,
+                    None => return Err(self.error("backreference to an unknown group")),
+                };
+                self.pos += end + 1;
+                Node::Backref(index, ignore_case)
+            }
+            'p' | 'P' => return Err(self.error("Unicode properties aren't supported")),
+            'K' | 'R' | 'X' | 'g' | 'Q' | 'E' | 'y' | 'Y' | 'O' | 'N' => {
+                return Err(self.error(&format!("`\\{ch}` isn't supported")));
+            }
+            _ => Node::Char(self.parse_char_escape(ch)?, ignore_case),
+        })
+    }
+
+    /// The character an escape like `\n` or `\x41` stands for, after the backslash and `ch`.
+    fn parse_char_escape(&mut self, ch: char) -> Result<char, String> {
+        Ok(match ch {
+            't' => '\t',
+            'n' => '\n',
+            'r' => '\r',
+            'f' => '\x0C',
+            'v' => '\x0B',
+            'a' => '\x07',
+            'e' => '\x1B',
+            '0' => '\0',
+            'x' | 'u' => {
+                let rest = &self.pattern[self.pos..];
+                let (digits, skip) = if ch == 'x' && rest.starts_with('{') {
+                    let end = rest.find('}').ok_or_else(|| self.error("unterminated escape"))?;
+                    (&rest[1..end], end + 1)
+                } else {
+                    let len = if ch == 'x' { 2 } else { 4 };
+                    let end = rest.char_indices().nth(len).map_or(rest.len(), |(i, _)| i);
+                    (&rest[..end], end)
+                };
+                let ch = u32::from_str_radix(digits, 16).ok().and_then(char::from_u32);
+                let ch = ch.ok_or_else(|| self.error("invalid escape"))?;
+                self.pos += skip;
+                ch
+            }
+            _ if ch.is_ascii_alphanumeric() => {
+                return Err(self.error(&format!("`\\{ch}` isn't supported")));
+            }
+            _ => ch,
+        })
+    }
+
+    /// Parse a class, after its `[`.
+    fn parse_class(&mut self) -> Result<Class, String> {
+        let mut class = Class {
+            negated: self.eat("^"),
+            ignore_case: self.flags.ignore_case,
+            items: Vec::new(),
+        };
+        let mut first = true;
+        loop {
+            let ch = self.next().ok_or_else(|| self.error("unterminated class"))?;
+            let lo = match ch {
+                ']' if !first => return Ok(class),
+                '[' if self.eat(":") => {
+                    let negated = self.eat("^");
+                    let rest = &self.pattern[self.pos..];
+                    let end =
+                        rest.find(":]").ok_or_else(|| self.error("unterminated POSIX bracket"))?;
+                    let shorthand = match &rest[..end] {
+                        "alpha" => Shorthand::Alpha,
+                        "digit" => Shorthand::Digit,
+                        "alnum" => Shorthand::Alnum,
+                        "upper" => Shorthand::Upper,
+                        "lower" => Shorthand::Lower,
+                        "space" => Shorthand::Space,
+                        "xdigit" => Shorthand::Hex,
+                        "word" => Shorthand::Word,
+                        "punct" => Shorthand::Punct,
+                        "blank" => Shorthand::Blank,
+                        "cntrl" => Shorthand::Cntrl,
+                        "print" => Shorthand::Print,
+                        "graph" => Shorthand::Graph,
+                        _ => return Err(self.error("unknown POSIX bracket")),
+                    };
+                    self.pos += end + 2;
+                    class.items.push(ClassItem::Shorthand(shorthand, negated));
+                    first = false;
+                    continue;
+                }
+                '[' => {
+                    let nested = self.parse_class()?;
+                    class.items.push(ClassItem::Class(nested));
+                    first = false;
+                    continue;
+                }
+                '&' if self.peek() == Some('&') => {
+                    return Err(self.error("class intersections aren't supported"));
+                }
+                '\\' => {
+                    let escaped = self.next().ok_or_else(|| self.error("unterminated class"))?;
+                    let shorthand = match escaped {
+                        'd' | 'D' => Some(Shorthand::Digit),
+                        'w' | 'W' => Some(Shorthand::Word),
+                        's' | 'S' => Some(Shorthand::Space),
+                        'h' | 'H' => Some(Shorthand::Hex),
+                        'p' | 'P' => return Err(self.error("Unicode properties aren't supported")),
+                        _ => None,
+                    };
+                    if let Some(shorthand) = shorthand {
+                        class
+                            .items
+                            .push(ClassItem::Shorthand(shorthand, escaped.is_ascii_uppercase()));
+                        first = false;
+                        continue;
+                    }
+                    // In a class, `\b` is a backspace.
+                    if escaped == 'b' { '\x08' } else { self.parse_char_escape(escaped)? }
+                }
+                _ => ch,
+            };
+            first = false;
+
+            // A range like `a-z`, unless the `-` is last, like in `[a-]`.
+            let rest = &self.pattern[self.pos..];
+            if rest.starts_with('-') && !rest.starts_with("-]") && rest.len() > 1 {
+                self.pos += 1;
+                let hi = match self.next().unwrap() {
+                    '\\' => {
+                        let escaped =
+                            self.next().ok_or_else(|| self.error("unterminated class"))?;
+                        self.parse_char_escape(escaped)?
+                    }
+                    '[' => return Err(self.error("invalid range")),
+                    hi => hi,
+                };
+                if hi < lo {
+                    return Err(self.error("invalid range"));
+                }
+                class.items.push(ClassItem::Range(lo, hi));
+            } else {
+                class.items.push(ClassItem::Range(lo, lo));
+            }
+        }
+    }
+}
+
+#[derive(Debug, Clone)]
+enum Inst {
+    Char(char),
+    CharFold(char),
+    Any,
+    AnyNewline,
+    Class(usize),
+    Assert(Assertion),
+    Save(usize),
+    /// Try the first branch, and the second if that fails.
+    Split(usize, usize),
+    Jump(usize),
+    /// Remember the position at the start of a loop's body in a slot...
+    Mark(usize),
+    /// ...and fail if the body didn't get anywhere, so that `(a*)*` can't loop forever.
+    Progress(usize),
+    Backref(usize, bool),
+    /// Run the instructions from `body` on to their `Match` on their own, and go on
+    /// at `after` depending on the result.
+    Sub {
+        kind: Sub,
+        body: usize,
+        after: usize,
+    },
+    Match,
+}
+
+#[derive(Debug, Clone, Copy)]
+enum Sub {
+    Look(Look, usize),
+    Atomic,
+}
+
+struct Compiler {
+    program: Vec<Inst>,
+    classes: Vec<Class>,
+    loops: usize,
+}
+
+impl Compiler {
+    fn push(&mut self, inst: Inst) -> usize {
+        self.program.push(inst);
+        self.program.len() - 1
+    }
+
+    fn compile(&mut self, node: &Node) -> Result<(), String> {
+        if self.program.len() > MAX_PROGRAM {
+            return Err("the regex is too large".to_string());
+        }
+        match node {
+            Node::Empty => {}
+            &Node::Char(ch, ignore_case) => {
+                let folded = simple_fold(ch);
+                let inst = if ignore_case && (folded != ch || ch.to_uppercase().ne([ch])) {
+                    Inst::CharFold(folded)
+                } else {
+                    Inst::Char(ch)
+                };
+                self.push(inst);
+            }
+            &Node::Any(dot_all) => {
+                self.push(if dot_all { Inst::AnyNewline } else { Inst::Any });
+            }
+            Node::Class(class) => {
+                self.classes.push(class.clone());
+                self.push(Inst::Class(self.classes.len() - 1));
+            }
+            &Node::Assert(assertion) => {
+                self.push(Inst::Assert(assertion));
+            }
+            Node::Group(node, index) => {
+                if let Some(index) = index {
+                    self.push(Inst::Save(2 * index));
+                }
+                self.compile(node)?;
+                if let Some(index) = index {
+                    self.push(Inst::Save(2 * index + 1));
+                }
+            }
+            Node::Concat(nodes) => {
+                for node in nodes {
+                    self.compile(node)?;
+                }
+            }
+            Node::Alternation(alternatives) => {
+                let mut jumps = Vec::new();
+                for (i, alternative) in alternatives.iter().enumerate() {
+                    if i + 1 < alternatives.len() {
+                        let split = self.push(Inst::Split(0, 0));
+                        self.compile(alternative)?;
+                        jumps.push(self.push(Inst::Jump(0)));
+                        let next = self.program.len();
+                        self.program[split] = Inst::Split(split + 1, next);
+                    } else {
+                        self.compile(alternative)?;
+                    }
+                }
+                let end = self.program.len();
+                for jump in jumps {
+                    self.program[jump] = Inst::Jump(end);
+                }
+            }
+            &Node::Repeat { ref node, min, max, greedy, possessive } => {
+                if possessive {
+                    let repeat =
+                        Node::Repeat { node: node.clone(), min, max, greedy, possessive: false };
+                    return self.compile_sub(Sub::Atomic, &repeat);
+                }
+                for _ in 0..min {
+                    self.compile(node)?;
+                }
+                match max {
+                    None => self.compile_star(node, greedy)?,
+                    Some(max) => {
+                        // `x{2,4}` is `xx(x(x)?)?`.
+                        let mut splits = Vec::new();
+                        for _ in min..max {
+                            splits.push(self.push(Inst::Split(0, 0)));
+                            self.compile(node)?;
+                            if self.program.len() > MAX_PROGRAM {
+                                return Err("the regex is too large".to_string());
+                            }
+                        }
+                        let end = self.program.len();
+                        for split in splits {
+                            self.program[split] = if greedy {
+                                Inst::Split(split + 1, end)
+                            } else {
+                                Inst::Split(end, split + 1)
+                            };
+                        }
+                    }
+                }
+            }
+            &Node::Look(ref node, look) => {
+                let length = match look {
+                    Look::Behind | Look::NotBehind => {
+                        max_length(node).ok_or("lookbehinds must have a bounded length")?
+                    }
+                    _ => 0,
+                };
+                self.compile_sub(Sub::Look(look, length), node)?;
+            }
+            Node::Atomic(node) => self.compile_sub(Sub::Atomic, node)?,
+            &Node::Backref(index, ignore_case) => {
+                self.push(Inst::Backref(index, ignore_case));
+            }
+        }
+        Ok(())
+    }
+
+    fn compile_star(&mut self, node: &Node, greedy: bool) -> Result<(), String> {
+        let slot = self.loops;
+        self.loops += 1;
+        // The loop slots come after the group slots, which aren't known yet,
+        // so they count down from the end, see `Exec::loop_slot`.
+        let split = self.push(Inst::Split(0, 0));
+        self.push(Inst::Mark(slot));
+        self.compile(node)?;
+        self.push(Inst::Progress(slot));
+        self.push(Inst::Jump(split));
+        let end = self.program.len();
+        self.program[split] =
+            if greedy { Inst::Split(split + 1, end) } else { Inst::Split(end, split + 1) };
+        Ok(())
+    }
+
+    fn compile_sub(&mut self, kind: Sub, node: &Node) -> Result<(), String> {
+        let sub = self.push(Inst::Sub { kind, body: 0, after: 0 });
+        self.compile(node)?;
+        self.push(Inst::Match);
+        let after = self.program.len();
+        self.program[sub] = Inst::Sub { kind, body: sub + 1, after };
+        Ok(())
+    }
+}
+
+/// The fewest characters `node` can match. A backreference can match an empty group.
+fn min_length(node: &Node) -> usize {
+    match node {
+        Node::Empty | Node::Assert(_) | Node::Look(..) | Node::Backref(..) => 0,
+        Node::Char(..) | Node::Any(_) | Node::Class(_) => 1,
+        Node::Group(node, _) | Node::Atomic(node) => min_length(node),
+        Node::Concat(nodes) => nodes.iter().map(min_length).sum(),
+        Node::Alternation(nodes) => nodes.iter().map(min_length).min().unwrap_or(0),
+        Node::Repeat { node, min, .. } => min_length(node) * *min as usize,
+    }
+}
+
+/// The most characters `node` can match, or `None` if that's unbounded.
+fn max_length(node: &Node) -> Option<usize> {
+    Some(match node {
+        Node::Empty | Node::Assert(_) | Node::Look(..) => 0,
+        Node::Char(..) | Node::Any(_) | Node::Class(_) => 1,
+        Node::Group(node, _) | Node::Atomic(node) => max_length(node)?,
+        Node::Concat(nodes) => nodes.iter().map(max_length).sum::<Option<usize>>()?,
+        Node::Alternation(nodes) => {
+            nodes.iter().map(max_length).collect::<Option<Vec<_>>>()?.into_iter().max()?
+        }
+        Node::Repeat { node, max, .. } => max_length(node)? * (*max)? as usize,
+        Node::Backref(..) => return None,
+    })
+}
+
+enum Frame {
+    Branch(usize, usize),
+    Restore(usize, Option<usize>),
+    RestoreAll(Vec<Option<usize>>),
+}
+
+struct Exec<'a> {
+    regex: &'a Regex,
+    text: &'a [u8],
+    context: Context,
+    fuel: usize,
+}
+
+impl Exec<'_> {
+    fn loop_slot(&self, slot: usize) -> usize {
+        2 * self.regex.groups + slot
+    }
+
+    /// Run the program from `pc` at `pos`, and return where it matched. If `end` is set,
+    /// the match has to end there. On success, `slots` holds the groups, otherwise
+    /// they're as before.
+    fn run(
+        &mut self,
+        mut pc: usize,
+        mut pos: usize,
+        slots: &mut [Option<usize>],
+        end: Option<usize>,
+    ) -> Option<usize> {
+        let text = self.text;
+        let mut stack: Vec<Frame> = Vec::new();
+        loop {
+            let ok = if self.fuel == 0 {
+                false
+            } else {
+                self.fuel -= 1;
+                match self.regex.program[pc] {
+                    Inst::Char(expected) => match char_at(text, pos) {
+                        Some((ch, len)) if ch == expected => {
+                            pos += len;
+                            pc += 1;
+                            true
+                        }
+                        _ => false,
+                    },
+                    Inst::CharFold(expected) => match char_at(text, pos) {
+                        Some((ch, len)) if simple_fold(ch) == expected => {
+                            pos += len;
+                            pc += 1;
+                            true
+                        }
+                        _ => false,
+                    },
+                    Inst::Any | Inst::AnyNewline => match char_at(text, pos) {
+                        Some((ch, len))
+                            if ch != '\n' || matches!(self.regex.program[pc], Inst::AnyNewline) =>
+                        {
+                            pos += len;
+                            pc += 1;
+                            true
+                        }
+                        _ => false,
+                    },
+                    Inst::Class(class) => match char_at(text, pos) {
+                        Some((ch, len)) if self.regex.classes[class].matches(ch) => {
+                            pos += len;
+                            pc += 1;
+                            true
+                        }
+                        _ => false,
+                    },
+                    Inst::Assert(assertion) => {
+                        pc += 1;
+                        self.assert(assertion, pos)
+                    }
+                    Inst::Save(slot) => {
+                        stack.push(Frame::Restore(slot, slots[slot]));
+                        slots[slot] = Some(pos);
+                        pc += 1;
+                        true
+                    }
+                    Inst::Split(first, second) => {
+                        stack.push(Frame::Branch(second, pos));
+                        pc = first;
+                        true
+                    }
+                    Inst::Jump(target) => {
+                        pc = target;
+                        true
+                    }
+                    Inst::Mark(slot) => {
+                        let slot = self.loop_slot(slot);
+                        stack.push(Frame::Restore(slot, slots[slot]));
+                        slots[slot] = Some(pos);
+                        pc += 1;
+                        true
+                    }
+                    Inst::Progress(slot) => {
+                        pc += 1;
+                        slots[self.loop_slot(slot)] != Some(pos)
+                    }
+                    Inst::Backref(group, ignore_case) => {
+                        match (slots[2 * group], slots[2 * group + 1]) {
+                            (Some(start), Some(stop)) => {
+                                let captured = &text[start..stop];
+                                let len = captured.len();
+                                let here = &text[pos..text.len().min(pos + len)];
+                                let same = if ignore_case {
+                                    simple_fold_eq(captured, here)
+                                } else {
+                                    captured == here
+                                };
+                                if same && here.len() == len {
+                                    pos += len;
+                                    pc += 1;
+                                }
+                                same && here.len() == len
+                            }
+                            // Oniguruma fails backreferences to groups that didn't match.
+                            _ => false,
+                        }
+                    }
+                    Inst::Sub { kind, body, after } => {
+                        let saved = slots.to_vec();
+                        let matched = match kind {
+                            Sub::Atomic => self
+                                .run(body, pos, slots, None)
+                                .inspect(|&stop| pos = stop)
+                                .is_some(),
+                            Sub::Look(Look::Ahead | Look::NotAhead, _) => {
+                                self.run(body, pos, slots, None).is_some()
+                            }
+                            Sub::Look(Look::Behind | Look::NotBehind, length) => {
+                                let mut start = pos;
+                                let mut found = false;
+                                for _ in 0..=length {
+                                    if self.run(body, start, slots, Some(pos)).is_some() {
+                                        found = true;
+                                        break;
+                                    }
+                                    if start == 0 {
+                                        break;
+                                    }
+                                    start = char_before(text, start).map_or(0, |(_, start)| start);
+                                }
+                                found
+                            }
+                        };
+                        let negated =
+                            matches!(kind, Sub::Look(Look::NotAhead | Look::NotBehind, _));
+                        if matched && negated {
+                            slots.copy_from_slice(&saved);
+                        } else if matched {
+                            stack.push(Frame::RestoreAll(saved));
+                        }
+                        pc = after;
+                        matched != negated && self.fuel > 0
+                    }
+                    Inst::Match => {
+                        if end.is_none_or(|end| end == pos) {
+                            return Some(pos);
+                        }
+                        false
+                    }
+                }
+            };
+            if ok {
+                continue;
+            }
+
+            // Backtrack to the last branch, undoing the captures since.
+            loop {
+                match stack.pop()? {
+                    Frame::Branch(branch, at) => {
+                        pc = branch;
+                        pos = at;
+                        break;
+                    }
+                    Frame::Restore(slot, value) => slots[slot] = value,
+                    Frame::RestoreAll(saved) => slots.copy_from_slice(&saved),
+                }
+            }
+            if self.fuel == 0 {
+                // Undo everything, then give up.
+                while let Some(frame) = stack.pop() {
+                    match frame {
+                        Frame::Branch(..) => {}
+                        Frame::Restore(slot, value) => slots[slot] = value,
+                        Frame::RestoreAll(saved) => slots.copy_from_slice(&saved),
+                    }
+                }
+                return None;
+            }
+        }
+    }
+
+    fn assert(&self, assertion: Assertion, pos: usize) -> bool {
+        let text = self.text;
+        match assertion {
+            Assertion::LineStart => pos == 0 || text[pos - 1] == b'\n',
+            Assertion::LineEnd => pos == text.len() || text[pos] == b'\n',
+            Assertion::TextStart => pos == 0 && self.context.first_line,
+            Assertion::TextEnd => pos == text.len(),
+            Assertion::TextEndNewline => {
+                pos == text.len() || (pos + 1 == text.len() && text[pos] == b'\n')
+            }
+            Assertion::Anchor => self.context.anchor == Some(pos),
+            Assertion::WordBoundary | Assertion::NotWordBoundary => {
+                let before = char_before(text, pos).is_some_and(|(ch, _)| is_word(ch));
+                let after = char_at(text, pos).is_some_and(|(ch, _)| is_word(ch));
+                (before != after) == (assertion == Assertion::WordBoundary)
+            }
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    /// The whole match and the groups of the first match of `pattern` in `text`, as text.
+    fn find(pattern: &str, text: &str) -> Option<Vec<Option<String>>> {
+        let regex = Regex::new(pattern).unwrap();
+        let groups =
+            regex.search(text.as_bytes(), 0, Context { anchor: Some(0), first_line: true })?;
+        Some(groups.into_iter().map(|g| g.map(|r| text[r].to_string())).collect())
+    }
+
+    fn matched(pattern: &str, text: &str) -> Option<String> {
+        find(pattern, text).map(|groups| groups[0].clone().unwrap())
+    }
+
+    #[test]
+    fn test_basics() {
+        assert_eq!(matched("b+", "abbbc").as_deref(), Some("bbb"));
+        assert_eq!(matched("a.c", "xa\u{e9}c").as_deref(), Some("a\u{e9}c"));
+        assert_eq!(matched("a.c", "a\nc"), None);
+        assert_eq!(matched("(?m)a.c", "a\nc").as_deref(), Some("a\nc"));
+        assert_eq!(matched("cat|dog", "hotdog").as_deref(), Some("dog"));
+        assert_eq!(matched("x{2,3}", "xxxx").as_deref(), Some("xxx"));
+        assert_eq!(matched("x{2,}?", "xxxx").as_deref(), Some("xx"));
+        assert_eq!(matched("x{,2}y", "xxxy").as_deref(), Some("xxy"));
+        assert_eq!(matched("a{b", "a{b").as_deref(), Some("a{b"));
+        assert_eq!(matched("<.+?>", "<a><b>").as_deref(), Some("<a>"));
+        assert_eq!(
+            matched(r"\x41é\x{1F600}\t", "A\u{e9}\u{1F600}\t").as_deref(),
+            Some("A\u{e9}\u{1F600}\t")
+        );
+        assert_eq!(matched("(?i)straße", "STRASSE"), None);
+        assert_eq!(matched("(?i)SELECT", "select").as_deref(), Some("select"));
+        assert_eq!(matched("(?i:a)a", "AA"), None);
+        assert_eq!(matched("(?i:a)a", "Aa").as_deref(), Some("Aa"));
+        assert_eq!(matched("(?x) a b # comment\n c", "abc").as_deref(), Some("abc"));
+        assert_eq!(matched("(a*)*b", "aaab").as_deref(), Some("aaab"));
+        assert_eq!(matched("(a|)+b", "b").as_deref(), Some("b"));
+    }
+
+    #[test]
+    fn test_classes() {
+        assert_eq!(matched(r"[a-c\d]+", "xab1c2z").as_deref(), Some("ab1c2"));
+        assert_eq!(matched(r"[^\s]+", "  word ").as_deref(), Some("word"));
+        assert_eq!(matched(r"[[:alpha:]_][[:alnum:]_]*", "1 _a1").as_deref(), Some("_a1"));
+        assert_eq!(matched(r"[a-]+", "x-a-").as_deref(), Some("-a-"));
+        assert_eq!(matched(r"[]a]+", "x]a").as_deref(), Some("]a"));
+        assert_eq!(matched(r"[a[0-9]]+", "xa1").as_deref(), Some("a1"));
+        assert_eq!(matched(r"(?i)[a-f]+", "xDEADbeefz").as_deref(), Some("DEADbeef"));
+        assert_eq!(matched(r"\h+", "0xBEEF").as_deref(), Some("0"));
+        assert_eq!(matched(r"\w+", "¿qué?").as_deref(), Some("qué"));
+        assert_eq!(matched(r"[\b]", "a\x08").as_deref(), Some("\x08"));
+    }
+
+    #[test]
+    fn test_anchors() {
+        assert_eq!(matched(r"\bis\b", "this is").as_deref(), Some("is"));
+        assert_eq!(find(r"\Bis", "this is").unwrap()[0].as_deref(), Some("is"));
+        assert_eq!(matched("^b", "a\nb").as_deref(), Some("b"));
+        assert_eq!(matched("a$", "a\nb").as_deref(), Some("a"));
+        assert_eq!(matched(r"\Ga", "ba"), None);
+        assert_eq!(matched(r"\Gb", "ba").as_deref(), Some("b"));
+        assert_eq!(matched(r"a\Z", "a\n").as_deref(), Some("a"));
+        assert_eq!(matched(r"a\z", "a\n"), None);
+
+        let regex = Regex::new(r"\Ax").unwrap();
+        assert!(regex.search(b"x", 0, Context { anchor: None, first_line: true }).is_some());
+        assert!(regex.search(b"x", 0, Context { anchor: None, first_line: false }).is_none());
+        // A search starting later still sees what's before it.
+        let regex = Regex::new(r"(?<=a)b|^c").unwrap();
+        assert_eq!(regex.search(b"abc", 1, Context::default()).unwrap()[0], Some(1..2));
+        assert_eq!(regex.search(b"abc", 2, Context::default()), None);
+    }
+
+    #[test]
+    fn test_groups() {
+        let groups = find(r"(\w+)@(?<host>\w+)(x)?", "me@example").unwrap();
+        assert_eq!(
+            groups,
+            [Some("me@example"), Some("me"), Some("example"), None].map(|g| g.map(String::from))
+        );
+        assert_eq!(matched(r"(\w)\1", "abccd").as_deref(), Some("cc"));
+        assert_eq!(
+            matched(r"(?<q>['\x22]).*?\k<q>", r#"x "it's" y"#).as_deref(),
+            Some(r#""it's""#)
+        );
+        assert_eq!(matched(r"(?i)(a)\1", "aA").as_deref(), Some("aA"));
+        assert_eq!(matched(r"(?:ab)+", "ababa").as_deref(), Some("abab"));
+        // Groups of a failed branch don't stick.
+        let groups = find(r"(?:(a)x|ab)", "ab").unwrap();
+        assert_eq!(groups[1], None);
+    }
+
+    #[test]
+    fn test_lookaround() {
+        assert_eq!(matched(r"\w+(?=\()", "f g(").as_deref(), Some("g"));
+        assert_eq!(matched(r"\d+(?!px)\b", "10px 20").as_deref(), Some("20"));
+        assert_eq!(matched(r"(?<=\$)\w+", "a $b").as_deref(), Some("b"));
+        assert_eq!(matched(r"(?<!\.)\b\w+", ".a b").as_deref(), Some("b"));
+        assert_eq!(matched(r"(?<=ab|c)d", "abd").as_deref(), Some("d"));
+        // Captures in a lookahead count, in a negative one they don't.
+        let groups = find(r"a(?=(b))", "ab").unwrap();
+        assert_eq!(groups[1].as_deref(), Some("b"));
+    }
+
+    #[test]
+    fn test_atomic() {
+        assert_eq!(matched(r"(?>a+)b", "aab").as_deref(), Some("aab"));
+        assert_eq!(matched(r"(?>a+)a", "aaa"), None);
+        assert_eq!(matched(r"a++a", "aaa"), None);
+        assert_eq!(matched(r#""(?>[^"\\]+|\\.)*""#, r#"x "a\"b" y"#).as_deref(), Some(r#""a\"b""#));
+    }
+
+    #[test]
+    fn test_unsupported() {
+        let error = |pattern| Regex::new(pattern).unwrap_err();
+        assert!(error(r"\p{L}").starts_with("Unicode properties aren't supported at offset 2 of"));
+        assert!(error(r"[\p{L}]").starts_with("Unicode properties aren't supported"));
+        assert!(error(r"a\Kb").starts_with("`\\K` isn't supported"));
+        assert!(error(r"(?<n>a)\g<n>").starts_with("`\\g` isn't supported"));
+        assert!(error(r"(a)?(?(1)b|c)").starts_with("conditionals aren't supported"));
+        assert!(error(r"(?~abc)").starts_with("absent operators aren't supported"));
+        assert!(error(r"[a-z&&[^aeiou]]").starts_with("class intersections aren't supported"));
+        assert_eq!(error(r"(?<=a+)b"), "lookbehinds must have a bounded length");
+        assert!(error(r"\1(a)").starts_with("backreference to a group that doesn't exist yet"));
+        assert!(error(r"(a").starts_with("unterminated group"));
+        assert!(error(r"a)").starts_with("unmatched `)`"));
+        assert!(error(r"[a").starts_with("unterminated class"));
+        assert!(error(r"*a").starts_with("nothing to repeat"));
+        assert!(error(r"[z-a]").starts_with("invalid range"));
+        assert!(error(r"(?u)a").starts_with("unsupported group"));
+        assert_eq!(error(r"(?:a{1000}){1000}"), "the regex is too large");
+    }
+
+    #[test]
+    fn test_pathological() {
+        // Catastrophic backtracking runs out of fuel instead of hanging.
+        let regex = Regex::new(r"(a|aa)+$").unwrap();
+        let text = format!("{}b", "a".repeat(64));
+        assert_eq!(regex.search(text.as_bytes(), 0, Context::default()), None);
+        // Invalid UTF-8 doesn't trip anything up.
+        let regex = Regex::new(r"[^a]b|.").unwrap();
+        assert_eq!(regex.search(b"\xFFb", 0, Context::default()).unwrap()[0], Some(0..2));
+    }
+
+    #[test]
+    fn test_escape() {
+        let text = "a.b*(c)[d] \\ $1 # x";
+        let regex = Regex::new(&format!("(?x){}", escape(text))).unwrap();
+        assert_eq!(
+            regex.search(text.as_bytes(), 0, Context::default()).unwrap()[0],
+            Some(0..text.len())
+        );
+    }
+
+    #[test]
+    fn test_matches_empty() {
+        let empty = |pattern| Regex::new(pattern).unwrap().matches_empty();
+        for pattern in ["", "a*", "a?", "(?=a)", r"\b", "^$", r"(a?)\1", "a|", "(?:a{0,3})+"] {
+            assert!(empty(pattern), "{pattern}");
+        }
+        for pattern in ["a", "a+", r"\w\b", "a|bc", "(?<=a)b", "[^a]", "(?:ab){2,}"] {
+            assert!(!empty(pattern), "{pattern}");
+        }
+    }
+}
@@ -0,0 +1,152 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//! Saving and restoring the [`LineState`] of a line, e.g. to cache highlighting.
+//!
+//! A snapshot starts with its format's version and the fingerprint of its grammar,
+//! followed by the `first_line` flag and the frames of the stack, each with its rule,
+//! scopes and `end` pattern. Numbers are LEB128 of up to 5 bytes and strings are prefixed by their length.
+//! Restoring checks everything against the grammar, so that corrupt snapshots, those of
+//! other grammars and those of future versions fail to restore rather than misbehave.
+
+use super::{EndPattern, Frame, Grammar, LineState, MAX_RULE_DEPTH, RuleKind};
+use crate::syntax::grammar::regex::Regex;
+
+/// The version of the snapshot format.
+const VERSION: u8 = 1;
+
+impl LineState {
+    /// Save the state, to restore it with [`Grammar::restore_state`] later.
+    pub fn snapshot(&self) -> Vec<u8> {
+        let mut out = vec![VERSION];
+        out.extend_from_slice(&self.grammar.to_le_bytes());
+        out.push(self.first_line as u8);
+        write_number(&mut out, self.stack.len());
+        for frame in &self.stack {
+            write_number(&mut out, frame.rule);
+            for scopes in [&frame.name, &frame.content] {
+                write_number(&mut out, scopes.len());
+                for scope in scopes {
+                    write_string(&mut out, scope);
+                }
+            }
+            match &frame.end {
+                Some((pattern, _)) => {
+                    out.push(1);
+                    write_string(&mut out, pattern);
+                }
+                None => out.push(0),
+            }
+        }
+        out
+    }
+}
+
+impl Grammar {
+    /// Restore a state saved with [`LineState::snapshot`], or explain why it can't be.
+    pub fn restore_state(&self, snapshot: &[u8]) -> Result<LineState, String> {
+        let mut reader = Reader { data: snapshot, pos: 0 };
+        let version = reader.byte()?;
+        if version != VERSION {
+            return Err(format!("unsupported snapshot version {version}, expected {VERSION}"));
+        }
+        let fingerprint = u64::from_le_bytes(reader.take(8)?.try_into().unwrap());
+        if fingerprint != self.fingerprint {
+            return Err("the snapshot is of a different grammar".to_string());
+        }
+        let first_line = match reader.byte()? {
+            0 => false,
+            1 => true,
+            b => return Err(format!("invalid flag {b}")),
+        };
+
+        let depth = reader.number()?;
+        if depth == 0 || depth > MAX_RULE_DEPTH {
+            return Err(format!("invalid stack depth {depth}"));
+        }
+        let mut stack = Vec::with_capacity(depth);
+        for i in 0..depth {
+            let rule = reader.number()?;
+            // The grammar is at the bottom of the stack, and `begin` rules above it.
+            let dynamic = match self.rules.get(rule).map(|r| &r.kind) {
+                _ if (i == 0) != (rule == 0) => return Err(format!("invalid rule {rule}")),
+                Some(RuleKind::Group { .. }) if rule == 0 => false,
+                Some(RuleKind::Begin { end, .. }) => matches!(end, EndPattern::Dynamic(_)),
+                _ => return Err(format!("invalid rule {rule}")),
+            };
+            let mut scopes = [Vec::new(), Vec::new()];
+            for scopes in &mut scopes {
+                let count = reader.number()?;
+                for _ in 0..count {
+                    scopes.push(reader.string()?.to_string());
+                }
+            }
+            let [name, content] = scopes;
+            let mut frame = Frame::new(rule, name, content);
+            match reader.byte()? {
+                0 => {}
+                1 if dynamic => {
+                    let pattern = reader.string()?.to_string();
+                    let regex = Regex::new(&pattern)?;
+                    frame.end = Some((pattern, regex));
+                }
+                _ => return Err(format!("invalid end pattern for rule {rule}")),
+            }
+            stack.push(frame);
+        }
+        if reader.pos != snapshot.len() {
+            return Err("the snapshot has trailing bytes".to_string());
+        }
+        Ok(LineState { stack, first_line, grammar: self.fingerprint })
+    }
+}
+
+fn write_number(out: &mut Vec<u8>, mut n: usize) {
+    while n >= 0x80 {
+        out.push(n as u8 | 0x80);
+        n >>= 7;
+    }
+    out.push(n as u8);
+}
+
+fn write_string(out: &mut Vec<u8>, s: &str) {
+    write_number(out, s.len());
+    out.extend_from_slice(s.as_bytes());
+}
+
+struct Reader<'a> {
+    data: &'a [u8],
+    pos: usize,
+}
+
+impl<'a> Reader<'a> {
+    fn take(&mut self, len: usize) -> Result<&'a [u8], String> {
+        let bytes = self
+            .data
+            .get(self.pos..self.pos.saturating_add(len))
+            .ok_or("the snapshot is truncated")?;
+        self.pos += len;
+        Ok(bytes)
+    }
+
+    fn byte(&mut self) -> Result<u8, String> {
+        Ok(self.take(1)?[0])
+    }
+
+    fn number(&mut self) -> Result<usize, String> {
+        let mut n = 0u64;
+        for shift in [0, 7, 14, 21, 28] {
+            let b = self.byte()?;
+            n |= u64::from(b & 0x7F) << shift;
+            if b < 0x80 {
+                return usize::try_from(n).map_err(|_| "invalid number".to_string());
+            }
+        }
+        Err("invalid number".to_string())
+    }
+
+    fn string(&mut self) -> Result<&'a str, String> {
+        let len = self.number()?;
+        str::from_utf8(self.take(len)?).map_err(|_| "invalid UTF-8 in a string".to_string())
+    }
+}
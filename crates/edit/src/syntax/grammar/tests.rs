@@ -0,0 +1,611 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+use std::fmt::Write as _;
+
+use super::*;
+use crate::syntax::{Language, LexerRegistry, classify_functions, split_escapes};
+
+/// Load a grammar whose `patterns` and `repository` are `rules`.
+fn grammar(rules: &str) -> Grammar {
+    Grammar::parse(&format!(r##"{{ "scopeName": "source.test", {rules} }}"##)).unwrap()
+}
+
+/// The spans of `text` as `text:scopes`, with the scopes inside `source.test` separated
+/// by spaces, so that `"a":string quote` is a quote inside a string.
+fn scopes(grammar: &Grammar, text: &str) -> Vec<String> {
+    grammar
+        .scoped_spans(text.as_bytes())
+        .into_iter()
+        .map(|(span, scopes)| format!("{}:{}", &text[span], scopes[1..].join(" ")))
+        .collect()
+}
+
+#[test]
+fn test_match_and_captures() {
+    let grammar = grammar(
+        r##""patterns": [{
+            "match": "(let) (\\w+)( =)?",
+            "name": "meta.let",
+            "captures": { "1": { "name": "keyword" }, "2": { "name": "variable.$2" } }
+        }]"##,
+    );
+    assert_eq!(
+        scopes(&grammar, "let x = 1\n"),
+        ["let:meta.let keyword", " :meta.let", "x:meta.let variable.x", " =:meta.let", " 1\n:"]
+    );
+}
+
+#[test]
+fn test_begin_end() {
+    let grammar = grammar(
+        r##""patterns": [{
+            "begin": "\"", "end": "\"",
+            "name": "string", "contentName": "content",
+            "captures": { "0": { "name": "quote" } },
+            "patterns": [{ "match": "\\\\.", "name": "escape" }]
+        }]"##,
+    );
+    assert_eq!(
+        scopes(&grammar, "a \"b\\\"c\nd\" e"),
+        [
+            "a :",
+            "\":string quote",
+            "b:string content",
+            "\\\":string content escape",
+            "c\n:string content",
+            "d:string content",
+            "\":string quote",
+            " e:",
+        ]
+    );
+}
+
+#[test]
+fn test_while() {
+    // Like Markdown's block quotes.
+    let grammar = grammar(
+        r##""patterns": [{
+            "begin": "^> ", "while": "^> ",
+            "name": "quote", "beginCaptures": { "0": { "name": "begin" } }, "whileCaptures": { "0": { "name": "while" } },
+            "patterns": [{ "match": "\\*\\w+\\*", "name": "bold" }]
+        }]"##,
+    );
+    assert_eq!(
+        scopes(&grammar, "> a\n> *b*\nc\n"),
+        ["> :quote begin", "a\n:quote", "> :quote while", "*b*:quote bold", "\n:quote", "c\n:"]
+    );
+}
+
+#[test]
+fn test_repository_and_self() {
+    // Nested repositories shadow outer entries, and `$self` recurses.
+    let grammar = grammar(
+        r##""patterns": [{ "include": "#parens" }, { "include": "#word" }],
+        "repository": {
+            "word": { "match": "\\w+", "name": "outer" },
+            "parens": {
+                "begin": "\\(", "end": "\\)", "name": "parens",
+                "patterns": [{ "include": "#word" }, { "include": "$self" }],
+                "repository": { "word": { "match": "\\w+", "name": "inner" } }
+            }
+        }"##,
+    );
+    assert_eq!(
+        scopes(&grammar, "a(b(c))"),
+        [
+            "a:outer",
+            "(:parens",
+            "b:parens inner",
+            "(:parens parens",
+            "c:parens parens inner",
+            "):parens parens",
+            "):parens"
+        ]
+    );
+}
+
+#[test]
+fn test_backreferences() {
+    // A heredoc ends with the word it began with.
+    let grammar = grammar(
+        r##""patterns": [{
+            "begin": "<<(\\w+)", "end": "^\\1$", "name": "heredoc.$1"
+        }]"##,
+    );
+    assert_eq!(
+        scopes(&grammar, "<<EOF\nEOX\nEOF\nx"),
+        ["<<EOF\n:heredoc.EOF", "EOX\n:heredoc.EOF", "EOF:heredoc.EOF", "\n:", "x:"]
+    );
+}
+
+#[test]
+fn test_capture_patterns() {
+    let grammar = grammar(
+        r##""patterns": [{
+            "match": "\\[(.*?)\\]", "name": "list",
+            "captures": { "1": { "name": "items", "patterns": [{ "match": "\\d+", "name": "number" }] } }
+        }]"##,
+    );
+    assert_eq!(
+        scopes(&grammar, "[1, 23]"),
+        ["[:list", "1:list items number", ", :list items", "23:list items number", "]:list"]
+    );
+}
+
+#[test]
+fn test_anchors_and_end_order() {
+    // `\G` matches where `begin` ended, and `applyEndPatternLast` lets patterns win ties.
+    let grammar = grammar(
+        r##""patterns": [
+            { "begin": "a", "end": "c", "name": "first", "patterns": [{ "match": "\\Gb", "name": "anchored" }] },
+            { "begin": "c", "end": "(?=d)", "applyEndPatternLast": 1, "name": "last", "patterns": [{ "match": "d", "name": "d" }] }
+        ]"##,
+    );
+    assert_eq!(scopes(&grammar, "abbc"), ["a:first", "b:first anchored", "bc:first"]);
+    assert_eq!(scopes(&grammar, "cd"), ["c:last", "d:last d"]);
+}
+
+#[test]
+fn test_no_progress() {
+    // Rules that match nothing give up on the line instead of looping.
+    let grammar = grammar(
+        r##""patterns": [
+            { "match": "(?=x)", "name": "empty" },
+            { "begin": "(?=y)", "end": "(?=y)", "name": "stuck", "patterns": [{ "include": "$self" }] }
+        ]"##,
+    );
+    assert_eq!(scopes(&grammar, "x y\nz"), ["x y\n:", "z:"]);
+}
+
+#[test]
+fn test_load_errors() {
+    let error = |json: &str| Grammar::parse(json).err().unwrap();
+    assert_eq!(
+        error("<?xml version=\"1.0\"?><plist/>"),
+        "grammars in the XML property list format aren't supported, convert them to JSON"
+    );
+    assert_eq!(error("[]"), "a grammar must be an object");
+    assert_eq!(error("{}"), "a grammar must have a scopeName");
+    let error = |rules: &str| error(&format!(r##"{{ "scopeName": "source.test", {rules} }}"##));
+    assert_eq!(
+        error(r##""patterns": [{ "include": "source.js" }]"##),
+        "grammar.patterns[0]: including other grammars isn't supported: source.js"
+    );
+    assert_eq!(
+        error(r##""patterns": [{ "include": "#nope" }]"##),
+        "grammar.patterns[0]: no repository entry named nope"
+    );
+    assert_eq!(
+        error(r##""patterns": [{ "begin": "a" }]"##),
+        "grammar.patterns[0]: a begin rule needs an end or a while"
+    );
+    assert_eq!(
+        error(r##""patterns": [{ "end": "a" }]"##),
+        "grammar.patterns[0]: an end or while needs a begin"
+    );
+    assert_eq!(
+        error(
+            r##""patterns": [{ "include": "#x" }], "repository": { "x": { "match": "\\p{L}" } }"##
+        ),
+        r"repository.x.match: Unicode properties aren't supported at offset 2 of `\p{L}`"
+    );
+    assert_eq!(
+        error(r##""patterns": [{ "begin": "(a)", "end": "\\1(?<=b+)" }]"##),
+        "grammar.patterns[0].end: lookbehinds must have a bounded length"
+    );
+}
+
+#[test]
+fn test_substitute() {
+    let line = b"Hello .world";
+    let groups = [Some(0..12), Some(0..5), Some(6..12)];
+    assert_eq!(
+        substitute("a.$1.${1:/downcase}.${1:/upcase}", line, &groups),
+        "a.Hello.hello.HELLO"
+    );
+    assert_eq!(substitute("b.$2.$3.$", line, &groups), "b.world..$");
+    assert_eq!(substitute_backrefs(r"^\1\\1\d", line, &groups), r"^Hello\\1\d");
+    assert!(has_backrefs(r"\2"));
+    assert!(!has_backrefs(r"\\2"));
+}
+
+/// The kinds a TextMate grammar and our lexers can be compared by, as the grammar
+/// can't tell apart what our lexers do, like calls from definitions.
+fn family(kind: TokenKind) -> &'static str {
+    match kind {
+        TokenKind::Keyword
+        | TokenKind::KeywordControl
+        | TokenKind::KeywordFunction
+        | TokenKind::KeywordImport
+        | TokenKind::KeywordStorage
+        | TokenKind::KeywordType
+        | TokenKind::KeywordOperator => "keyword",
+        TokenKind::Operator
+        | TokenKind::Punctuation
+        | TokenKind::Delimiter
+        | TokenKind::Separator => "operator",
+        TokenKind::FunctionName | TokenKind::FunctionDefinition | TokenKind::FunctionCall => {
+            "function"
+        }
+        TokenKind::Identifier | TokenKind::VariableName => "identifier",
+        TokenKind::Comment => "comment",
+        TokenKind::DocComment => "doc-comment",
+        TokenKind::String => "string",
+        TokenKind::Char => "char",
+        TokenKind::Number => "number",
+        TokenKind::Boolean => "boolean",
+        TokenKind::Null => "null",
+        TokenKind::Escape => "escape",
+        TokenKind::FormatSpecifier => "format-specifier",
+        TokenKind::TypeName => "type",
+        TokenKind::PropertyName => "property",
+        TokenKind::Label => "label",
+        TokenKind::ParameterName => "parameter",
+        _ => "other",
+    }
+}
+
+/// The kind families our lexer for `language` and a grammar give each byte of `text`,
+/// `None` for whitespace.
+fn kind_pairs(grammar: &Grammar, language: Language, text: &str) -> Vec<[Option<&'static str>; 2]> {
+    let bytes = text.as_bytes();
+    let mut native = LexerRegistry::get_lexer(language).tokenize(bytes);
+    split_escapes(language, bytes, &mut native);
+    classify_functions(language, bytes, &mut native);
+    let ours = grammar.tokenize(bytes);
+
+    let mut kinds = vec![[None; 2]; bytes.len()];
+    for (side, tokens) in [native, ours].iter().enumerate() {
+        for token in tokens.iter().filter(|t| t.kind != TokenKind::Whitespace) {
+            for kind in &mut kinds[token.span.clone()] {
+                kind[side] = Some(family(token.kind));
+            }
+        }
+    }
+    kinds
+}
+
+/// Tokenize `text` with a grammar and with our lexer for `language`, and list the
+/// runs of text where their kinds differ, whitespace aside.
+fn differences(grammar: &Grammar, language: Language, text: &str) -> String {
+    let kinds = kind_pairs(grammar, language, text);
+    let mut report = String::new();
+    let mut pos = 0;
+    while pos < text.len() {
+        let pair = kinds[pos];
+        let end = pos + kinds[pos..].iter().take_while(|&&k| k == pair).count();
+        if let [Some(native), Some(grammar)] = pair
+            && native != grammar
+        {
+            let line = text[..pos].matches('\n').count() + 1;
+            let column = pos - text[..pos].rfind('\n').map_or(0, |i| i + 1) + 1;
+            _ = writeln!(
+                report,
+                "{line}:{column} `{}` native={native} grammar={grammar}",
+                &text[pos..end]
+            );
+        }
+        pos = end;
+    }
+    report
+}
+
+#[test]
+fn test_go_grammar() {
+    // A Go grammar with the scopes of VS Code's, written for this test, against our Go lexer.
+    // The differences are recorded in a golden, so that changes to either side show up.
+    let grammar =
+        Grammar::parse(include_str!("../../../tests/grammars/go.tmLanguage.json")).unwrap();
+    assert_eq!(
+        (grammar.name(), grammar.scope_name(), grammar.file_types()),
+        ("Go", "source.go", &["go".to_string()][..])
+    );
+
+    let text = include_str!("../../../../../syntax-tests/test_syntax.go");
+    // Both tokenize every byte.
+    let tokens = grammar.tokenize(text.as_bytes());
+    assert_eq!(tokens.first().unwrap().span.start, 0);
+    assert_eq!(tokens.last().unwrap().span.end, text.len());
+    assert!(tokens.windows(2).all(|w| w[0].span.end == w[1].span.start));
+
+    let actual = differences(&grammar, Language::Go, text);
+    let path = concat!(env!("CARGO_MANIFEST_DIR"), "/tests/grammars/go.differences");
+    if std::env::var_os("UPDATE_GOLDENS").is_some_and(|v| !v.is_empty()) {
+        std::fs::write(path, &actual).unwrap();
+        return;
+    }
+    let expected = include_str!("../../../tests/grammars/go.differences");
+    assert!(
+        actual == expected,
+        "differences changed, rerun with UPDATE_GOLDENS=1 to accept them:\n{actual}"
+    );
+}
+
+#[test]
+fn test_export_round_trip() {
+    let exported = export_grammar(Language::Go).unwrap();
+    assert!(exported.warnings.iter().any(|w| w.starts_with("doc comments")));
+    let grammar = Grammar::parse(&exported.json).unwrap();
+    assert_eq!(
+        (grammar.name(), grammar.scope_name(), grammar.file_types()),
+        ("Go", "source.go", &["go".to_string()][..])
+    );
+    let scopes = |text: &str| scopes(&grammar, text);
+    assert_eq!(
+        scopes("/* a\nb */"),
+        [
+            "/*:comment.block.go punctuation.definition.comment.go",
+            " a\n:comment.block.go",
+            "b :comment.block.go",
+            "*/:comment.block.go punctuation.definition.comment.go"
+        ]
+    );
+    assert_eq!(scopes("`a\nb`")[1..3], ["a\n:string.quoted.raw.go", "b:string.quoted.raw.go"]);
+    assert_eq!(
+        scopes("\"%d\\n\"")[1..3],
+        [
+            "%d:string.quoted.double.go constant.other.placeholder.go",
+            "\\n:string.quoted.double.go constant.character.escape.go"
+        ]
+    );
+    assert_eq!(scopes("func (s *S) Len() {")[..2], ["func:keyword.other.go", " (s *S) :"]);
+
+    // Once re-imported, the grammar highlights the Go fixtures like our lexer, but for what
+    // the warnings list. Doc comments, the largest of those, are left out of the count.
+    let dir = concat!(env!("CARGO_MANIFEST_DIR"), "/../../syntax-tests");
+    let (mut differing, mut total) = (0, 0);
+    for entry in std::fs::read_dir(dir).unwrap() {
+        let path = entry.unwrap().path();
+        // Grammars match strings, so the fixtures of invalid UTF-8 are left out.
+        if path.extension().is_some_and(|ext| ext == "go")
+            && let Ok(text) = std::fs::read_to_string(&path)
+        {
+            for pair in kind_pairs(&grammar, Language::Go, &text) {
+                if let [Some(native), Some(grammar)] = pair
+                    && (native, grammar) != ("doc-comment", "comment")
+                {
+                    total += 1;
+                    differing += (native != grammar) as usize;
+                }
+            }
+        }
+    }
+    assert!(differing * 20 < total, "{differing} of {total} bytes are highlighted differently");
+}
+
+#[test]
+fn test_export_unsupported() {
+    assert_eq!(
+        export_grammar(Language::Json).unwrap_err(),
+        "the JSON lexer can't be exported as a TextMate grammar"
+    );
+}
+
+/// A grammar with heredocs, whose states have `end` patterns of their own.
+fn heredoc_grammar() -> Grammar {
+    grammar(
+        r##""patterns": [
+            { "begin": "<<-?'?(\\w+)'?", "end": "^\\s*\\1$", "name": "string.unquoted.heredoc" },
+            { "begin": "/\\*", "end": "\\*/", "name": "comment.block" },
+            { "match": "\\b(if|then|fi|func|return)\\b", "name": "keyword" }
+        ]"##,
+    )
+}
+
+#[test]
+fn test_state_snapshots() {
+    let go = Grammar::parse(include_str!("../../../tests/grammars/go.tmLanguage.json")).unwrap();
+    let heredoc = heredoc_grammar();
+    let dir = concat!(env!("CARGO_MANIFEST_DIR"), "/../../syntax-tests");
+    for entry in std::fs::read_dir(dir).unwrap() {
+        let path = entry.unwrap().path();
+        let text = std::fs::read(&path).unwrap();
+        let lines: Vec<&[u8]> = text.split_inclusive(|&b| b == b'\n').collect();
+        // The Go grammar for the Go fixtures, and the cheaper one with heredocs for all.
+        let is_go = path.extension().is_some_and(|ext| ext == "go");
+        for grammar in [&go, &heredoc].into_iter().skip(!is_go as usize) {
+            // The tokens of each line and the state after it, uninterrupted.
+            let mut state = grammar.initial_state();
+            let mut run = Vec::new();
+            for line in &lines {
+                let tokens = grammar.tokenize_line(line, &mut state);
+                run.push((tokens, state.clone()));
+            }
+
+            for (i, (_, state)) in run.iter().enumerate() {
+                let snapshot = state.snapshot();
+                let mut restored = grammar.restore_state(&snapshot).unwrap();
+                assert!(
+                    restored == *state,
+                    "{} line {}: restored a different state",
+                    path.display(),
+                    i + 1
+                );
+                // Equal states tokenize the rest the same, which halfway through we check
+                // all the way, and otherwise for the next line, which makes the next state.
+                let rest = if i == lines.len() / 2 {
+                    &lines[i + 1..]
+                } else {
+                    &lines[i + 1..(i + 2).min(lines.len())]
+                };
+                for (j, line) in rest.iter().enumerate() {
+                    let tokens = grammar.tokenize_line(line, &mut restored);
+                    let (expected, expected_state) = &run[i + 1 + j];
+                    assert!(
+                        tokens == *expected && restored == *expected_state,
+                        "{} line {}: tokenized differently after restoring the state of line {}",
+                        path.display(),
+                        i + j + 2,
+                        i + 1,
+                    );
+                }
+            }
+        }
+    }
+}
+
+#[test]
+fn test_corrupt_snapshots() {
+    let grammar = heredoc_grammar();
+    let mut state = grammar.initial_state();
+    grammar.tokenize_line(b"cat <<EOF /*\n", &mut state);
+    let snapshot = state.snapshot();
+    assert!(grammar.restore_state(&snapshot).unwrap() == state);
+
+    // Truncated, changed or extended snapshots fail to restore, or restore a state that's
+    // valid for the grammar, but never panic.
+    for len in 0..snapshot.len() {
+        assert!(grammar.restore_state(&snapshot[..len]).is_err());
+    }
+    for i in 0..snapshot.len() {
+        for flip in [0x01, 0x80, 0xFF] {
+            let mut corrupt = snapshot.clone();
+            corrupt[i] ^= flip;
+            if let Ok(mut state) = grammar.restore_state(&corrupt) {
+                grammar.tokenize_line(b"EOF */ if\n", &mut state);
+            }
+        }
+    }
+    let mut extended = snapshot.clone();
+    extended.push(0);
+    assert_eq!(grammar.restore_state(&extended).unwrap_err(), "the snapshot has trailing bytes");
+
+    let mut future = snapshot.clone();
+    future[0] = 2;
+    assert_eq!(
+        grammar.restore_state(&future).unwrap_err(),
+        "unsupported snapshot version 2, expected 1"
+    );
+    assert_eq!(
+        self::grammar(r#""patterns": []"#).restore_state(&snapshot).unwrap_err(),
+        "the snapshot is of a different grammar"
+    );
+}
+
+#[test]
+fn test_rule_depth() {
+    let grammar = grammar(
+        r##""patterns": [{ "begin": "\\(", "end": "\\)", "name": "paren", "patterns": [{ "include": "$self" }] }]"##,
+    );
+    let mut state = grammar.initial_state();
+    let text = "(".repeat(1000);
+    let tokens = grammar.tokenize_line(text.as_bytes(), &mut state);
+    assert_eq!(state.stack.len(), MAX_RULE_DEPTH);
+    assert_eq!(tokens.len(), 1);
+    assert!(state.snapshot().len() < 1000);
+    grammar.tokenize_line(")".repeat(1000).as_bytes(), &mut state);
+    assert_eq!(state.stack.len(), 1);
+}
+
+/// The problems `validate_grammar` finds in a grammar whose `patterns` and `repository`
+/// are `rules`, as `code path: message`.
+fn problems(rules: &str) -> Vec<String> {
+    validate_grammar(&format!(r##"{{ "scopeName": "source.test", {rules} }}"##))
+        .into_iter()
+        .map(|p| format!("{} {}: {}", p.kind.code(), p.path, p.message))
+        .collect()
+}
+
+#[test]
+fn test_validate() {
+    assert_eq!(problems(r##""patterns": [{ "match": "a", "name": "keyword" }]"##), [""; 0]);
+
+    // All of what keeps a grammar from loading, rather than the first of it, and in
+    // repository entries nothing includes too.
+    assert_eq!(
+        problems(
+            r##""patterns": [{ "begin": "a" }, { "end": "b" }, { "include": "#nope" }],
+            "repository": {
+                "unused": { "match": "\\p{L}" },
+                "js": { "patterns": [{ "include": "source.js" }] }
+            }"##
+        ),
+        [
+            r"invalid repository.unused.match: Unicode properties aren't supported at offset 2 of `\p{L}`",
+            "undefined-include repository.js.patterns[0]: including other grammars isn't supported: source.js",
+            "missing-end grammar.patterns[0]: a begin rule needs an end or a while",
+            "missing-end grammar.patterns[1]: an end or while needs a begin",
+            "undefined-include grammar.patterns[2]: no repository entry named nope",
+        ]
+    );
+    // Includes resolve in the enclosing repositories, innermost first.
+    assert_eq!(
+        problems(
+            r##""patterns": [{ "include": "#outer" }],
+            "repository": {
+                "outer": { "patterns": [{ "include": "#inner" }], "repository": { "inner": { "match": "a" } } },
+                "other": { "patterns": [{ "include": "#inner" }] }
+            }"##
+        ),
+        ["undefined-include repository.other.patterns[0]: no repository entry named inner"]
+    );
+
+    assert_eq!(
+        problems(
+            r##""patterns": [
+                { "match": "a*" },
+                { "begin": "(?=b)", "end": "$" },
+                { "begin": "c", "end": "(?=d)" }
+            ]"##
+        ),
+        [
+            "empty-match grammar.patterns[0].match: `a*` can match the empty string, which makes no progress",
+            "empty-match grammar.patterns[1]: both begin and end can match the empty string, so the rule can begin and end without making progress",
+        ]
+    );
+
+    // Identical regexes, and words in an earlier list of them, through includes and groups.
+    assert_eq!(
+        problems(
+            r##""patterns": [
+                { "match": "\\b(?:if|else)\\b", "name": "keyword.control" },
+                { "include": "#words" },
+                { "patterns": [{ "match": "x+" }, { "begin": "x+", "end": "y" }] }
+            ],
+            "repository": { "words": { "match": "\\belse\\b", "name": "keyword.other" } }"##
+        ),
+        [
+            "shadowed grammar.patterns[2].patterns[1]: never matches, grammar.patterns[2].patterns[0] matches the same text first",
+            "shadowed repository.words: never matches, grammar.patterns[0] matches the same text first",
+        ]
+    );
+
+    assert_eq!(
+        problems(
+            r##""name": "Test",
+            "patterns": [{
+                "match": "(a)(b)",
+                "name": "Keyword.control variable.$1",
+                "captures": { "1": { "name": "punctuation..x" }, "2": { "name": "mine.b" } }
+            }]"##
+        ),
+        [
+            "scope-name grammar.patterns[0].name: `Keyword.control` should be lowercase words separated by dots",
+            "scope-name grammar.patterns[0].captures.1.name: `punctuation..x` should be lowercase words separated by dots",
+            "scope-name grammar.patterns[0].captures.2.name: `mine.b` should start with one of the standard scopes, like keyword or string, for themes to style it",
+        ]
+    );
+
+    let root =
+        |json: &str| validate_grammar(json).into_iter().map(|p| p.message).collect::<Vec<_>>();
+    assert_eq!(root("{}"), ["a grammar must have a scopeName"]);
+    assert_eq!(root("[]"), ["a grammar must be an object"]);
+    assert_eq!(root(r#"{ "scopeName": "go" }"#), ["`go` should start with source. or text."]);
+    assert!(
+        GrammarProblemKind::ALL.iter().all(|&k| GrammarProblemKind::from_code(k.code()) == Some(k))
+    );
+}
+
+#[test]
+fn test_validate_bundled() {
+    // What ships has no problems, and loads since it has no errors.
+    let go = include_str!("../../../tests/grammars/go.tmLanguage.json");
+    assert_eq!(validate_grammar(go), []);
+    for &language in Language::ALL {
+        if let Ok(exported) = export_grammar(language) {
+            assert_eq!(validate_grammar(&exported.json), [], "{language:?}");
+            assert!(Grammar::parse(&exported.json).is_ok());
+        }
+    }
+}
@@ -0,0 +1,141 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//! Code that the C preprocessor leaves out.
+//!
+//! `#if 0` is the usual way to disable a block of C or C++, and unlike a comment it nests.
+//! [`mark_inactive_code`] turns such blocks into a single [`TokenKind::Inactive`] token,
+//! which themes dim. Other conditions depend on the build, so they're left alone.
+
+use crate::syntax::{Language, Token, TokenKind};
+
+/// Merge the tokens between an `#if 0` and its `#else`, `#elif` or `#endif` into one
+/// [`TokenKind::Inactive`] token. Conditionals nested in the block are skipped over,
+/// and a block that's never closed runs until the end of the text.
+pub fn mark_inactive_code(language: Language, text: &[u8], tokens: &mut Vec<Token>) {
+    if !matches!(language, Language::C | Language::Cpp) {
+        return;
+    }
+
+    let mut result: Option<Vec<Token>> = None;
+    let mut i = 0;
+    while i < tokens.len() {
+        let Some(start) = disabled_block(text, tokens, i) else {
+            if let Some(result) = &mut result {
+                result.push(tokens[i].clone());
+            }
+            i += 1;
+            continue;
+        };
+        let end = block_end(text, tokens, start);
+
+        let result = result.get_or_insert_with(|| tokens[..i].to_vec());
+        result.extend_from_slice(&tokens[i..start]);
+        // The whitespace before the closing directive stays, for its indentation.
+        let last = (start..end).rev().find(|&j| tokens[j].kind != TokenKind::Whitespace);
+        if let Some(last) = last {
+            let span = tokens[start].span.start..tokens[last].span.end;
+            result.push(Token::new(TokenKind::Inactive, span));
+            result.extend_from_slice(&tokens[last + 1..end]);
+        }
+        i = end;
+    }
+
+    if let Some(result) = result {
+        *tokens = result;
+    }
+}
+
+/// If the token at `i` is the `#if` of an `#if 0`, returns the index of the first token
+/// of the disabled block, after the newline that ends the directive.
+fn disabled_block(text: &[u8], tokens: &[Token], i: usize) -> Option<usize> {
+    if directive_name(text, &tokens[i]) != Some(b"if") {
+        return None;
+    }
+    let mut rest = tokens[i + 1..].iter().enumerate().map(|(j, t)| (i + 1 + j, t));
+    let mut next = || rest.find(|(_, t)| !is_blank(text, t));
+    let (_, zero) = next()?;
+    if zero.kind != TokenKind::Number || &text[zero.span.clone()] != b"0" {
+        return None;
+    }
+    // Anything but a comment after the `0`, like `#if 0 || X`, makes it a real condition.
+    loop {
+        match next() {
+            Some((j, t)) if t.kind == TokenKind::Whitespace => return Some(j + 1),
+            Some((_, t)) if t.kind == TokenKind::Comment => {}
+            Some(_) => return None,
+            None => return Some(tokens.len()),
+        }
+    }
+}
+
+/// Returns the index of the `#else`, `#elif` or `#endif` that ends the block starting
+/// at `start`, or the number of tokens if there's none.
+fn block_end(text: &[u8], tokens: &[Token], start: usize) -> usize {
+    let mut depth = 0usize;
+    for (i, token) in tokens.iter().enumerate().skip(start) {
+        match directive_name(text, token) {
+            Some(b"if" | b"ifdef" | b"ifndef") => depth += 1,
+            Some(b"endif") if depth > 0 => depth -= 1,
+            Some(b"endif" | b"else" | b"elif" | b"elifdef" | b"elifndef") if depth == 0 => {
+                return i;
+            }
+            _ => {}
+        }
+    }
+    tokens.len()
+}
+
+/// Returns the name of the directive if `token` is the `#name` the lexers emit for it.
+fn directive_name<'a>(text: &'a [u8], token: &Token) -> Option<&'a [u8]> {
+    if token.kind != TokenKind::Macro {
+        return None;
+    }
+    let name = text[token.span.clone()].strip_prefix(b"#")?;
+    Some(name.trim_ascii_start())
+}
+
+/// Whether `token` is whitespace without a newline, which doesn't end a directive.
+fn is_blank(text: &[u8], token: &Token) -> bool {
+    token.kind == TokenKind::Whitespace && !text[token.span.clone()].contains(&b'\n')
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::syntax::LexerRegistry;
+
+    /// Returns the text of the inactive tokens of `text`.
+    fn inactive(text: &str) -> Vec<&str> {
+        let mut tokens = LexerRegistry::get_lexer(Language::C).tokenize(text.as_bytes());
+        mark_inactive_code(Language::C, text.as_bytes(), &mut tokens);
+        tokens
+            .iter()
+            .filter(|t| t.kind == TokenKind::Inactive)
+            .map(|t| &text[t.span.clone()])
+            .collect()
+    }
+
+    #[test]
+    fn test_if_zero() {
+        assert_eq!(inactive("#if 0\nold();\n#endif\nnew();\n"), ["old();"]);
+        assert_eq!(
+            inactive("#if 0 // disabled\n  a();\n  b();\n#else\nc();\n#endif\n"),
+            ["a();\n  b();"]
+        );
+        assert_eq!(
+            inactive("#if 0\n#if X\na();\n#endif\nb();\n#elif Y\nc();\n#endif\n"),
+            ["#if X\na();\n#endif\nb();"]
+        );
+        assert_eq!(inactive("#if 0\nnever closed\n"), ["never closed"]);
+        assert_eq!(inactive("#if 0\n#endif\n"), [] as [&str; 0]);
+    }
+
+    #[test]
+    fn test_other_conditions() {
+        assert_eq!(inactive("#if 0 || X\na();\n#endif\n"), [] as [&str; 0]);
+        assert_eq!(inactive("#if 1\na();\n#endif\n"), [] as [&str; 0]);
+        assert_eq!(inactive("#ifdef X\na();\n#endif\n"), [] as [&str; 0]);
+        assert_eq!(inactive("x = 0;\n#if\n0\n#endif\n"), [] as [&str; 0]);
+    }
+}
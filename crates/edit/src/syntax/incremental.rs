@@ -0,0 +1,836 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//! Highlighting that keeps up with edits, without tokenizing the whole document again.
+//!
+//! A [`Grammar`] tokenizes line by line, where each line only depends on the
+//! [`LineState`] before it. The highlighter keeps the state after each line, so that after
+//! an edit it tokenizes the edited lines and then the lines below them, until one ends in
+//! the same state as before. Typing in a function tokenizes one line, but typing the `` ` ``
+//! that opens a raw string tokenizes the lines up to where the next one closed it.
+//!
+//! Our own lexers keep a state like that where they can, see [`Lexer::resume`], and
+//! [`IncrementalLexer`] lexes from the line an edit is on until the lexer gets to a line
+//! in the same state and after the same tokens as before. Only the tokens of those lines
+//! are finished again and put in place of the old ones, but what a lexer finds out about
+//! the document as a whole, like which of Go's comments document a declaration, is done
+//! again for all of it after every edit.
+
+use std::borrow::Cow;
+use std::ops::Range;
+
+use crate::syntax::{Checkpoint, Grammar, Lexer, LineState, Token};
+
+/// A document's tokens, which are updated line by line as it's edited.
+///
+/// The document is a list of lines, which are joined by `\n`s.
+/// Like in [`str::split`], a document ending in a `\n` ends in an empty line.
+pub struct IncrementalHighlighter<'g> {
+    grammar: &'g Grammar,
+    lines: Vec<Line>,
+}
+
+struct Line {
+    /// The text, without the `\n`.
+    text: Vec<u8>,
+    /// The tokens, relative to the start of the line, including the one of the `\n`.
+    tokens: Vec<Token>,
+    /// The state after the line.
+    state: LineState,
+}
+
+impl<'g> IncrementalHighlighter<'g> {
+    /// Create a highlighter for an empty document.
+    pub fn new(grammar: &'g Grammar) -> Self {
+        let mut highlighter = Self { grammar, lines: Vec::new() };
+        highlighter.highlight(b"");
+        highlighter
+    }
+
+    /// Tokenize a whole document, replacing the one before.
+    pub fn highlight(&mut self, text: &[u8]) {
+        self.lines = text.split(|&b| b == b'\n').map(|text| self.placeholder(text)).collect();
+        self.tokenize(0, usize::MAX, None);
+    }
+
+    /// Replace the lines `start..end` with `lines`, which don't contain `\n`s, and update
+    /// the tokens. Returns the lines whose tokens may have changed: the new lines, and
+    /// those below them that had to be tokenized again because the state before them did.
+    ///
+    /// # Panics
+    ///
+    /// If `start..end` isn't a range of the document's lines.
+    pub fn edit(&mut self, start: usize, end: usize, lines: &[&[u8]]) -> Range<usize> {
+        assert!(start <= end && end <= self.lines.len(), "lines {start}..{end} are out of bounds");
+
+        // The state before the line below the replaced ones, as it was.
+        let before = match end {
+            0 => self.grammar.initial_state(),
+            _ => self.lines[end - 1].state.clone(),
+        };
+        // An edit at the end adds or removes the `\n` of the line above it.
+        let first = if end == self.lines.len() { start.saturating_sub(1) } else { start };
+
+        let new_lines: Vec<Line> = lines.iter().map(|text| self.placeholder(text)).collect();
+        self.lines.splice(start..end, new_lines);
+        if self.lines.is_empty() {
+            self.lines.push(self.placeholder(b""));
+        }
+        let changed = self.tokenize(first, start + lines.len(), Some(before));
+        first..changed
+    }
+
+    fn placeholder(&self, text: &[u8]) -> Line {
+        Line { text: text.to_vec(), tokens: Vec::new(), state: self.grammar.initial_state() }
+    }
+
+    /// Tokenize the lines from `first` on. Once past `unchanged`, where the lines are the
+    /// ones from before the edit, stop at the first one whose state before it is `before`,
+    /// the one it had before. Returns the line it stopped at.
+    fn tokenize(&mut self, first: usize, unchanged: usize, mut before: Option<LineState>) -> usize {
+        let mut state = match first {
+            0 => self.grammar.initial_state(),
+            _ => self.lines[first - 1].state.clone(),
+        };
+        let mut text = Vec::new();
+        let mut i = first;
+        while i < self.lines.len() {
+            if i >= unchanged && before.as_ref() == Some(&state) {
+                break;
+            }
+            text.clear();
+            text.extend_from_slice(&self.lines[i].text);
+            if i + 1 < self.lines.len() {
+                text.push(b'\n');
+            }
+            let line = &mut self.lines[i];
+            line.tokens = self.grammar.tokenize_line(&text, &mut state);
+            let old = std::mem::replace(&mut line.state, state.clone());
+            if i >= unchanged {
+                before = Some(old);
+            }
+            i += 1;
+        }
+        i
+    }
+
+    /// The number of lines.
+    pub fn line_count(&self) -> usize {
+        self.lines.len()
+    }
+
+    /// The tokens of `line`, relative to its start. All but the last line end in the
+    /// token of their `\n`.
+    pub fn line_tokens(&self, line: usize) -> &[Token] {
+        &self.lines[line].tokens
+    }
+
+    /// The tokens of the whole document, which are the same as [`Lexer::tokenize`] gives.
+    ///
+    /// [`Lexer::tokenize`]: crate::syntax::Lexer::tokenize
+    pub fn tokens(&self) -> Vec<Token> {
+        let mut tokens = Vec::new();
+        let mut offset = 0;
+        for line in &self.lines {
+            tokens.extend(line.tokens.iter().map(|token| {
+                let span = offset + token.span.start..offset + token.span.end;
+                Token { span, ..token.clone() }
+            }));
+            offset += line.text.len() + 1;
+        }
+        tokens
+    }
+
+    /// The document, with its lines joined by `\n`s.
+    pub fn text(&self) -> Vec<u8> {
+        self.lines.iter().map(|line| &line.text[..]).collect::<Vec<_>>().join(&b'\n')
+    }
+}
+
+/// A document's tokens from one of our own lexers, which are updated from the line an
+/// edit is on as it's edited. Lexers that can't pick up lexing at a line, like the one
+/// for plain text, lex the whole document after each edit.
+pub struct IncrementalLexer {
+    lexer: Box<dyn Lexer>,
+    text: Vec<u8>,
+    /// The tokens before [`Lexer::finish`].
+    raw: Vec<Token>,
+    /// The lines the lexer can pick up lexing at, starting with the start of the text.
+    checkpoints: Vec<Checkpoint>,
+    tokens: Vec<Token>,
+}
+
+impl IncrementalLexer {
+    /// Create a highlighter for an empty document.
+    pub fn new(lexer: Box<dyn Lexer>) -> Self {
+        let mut highlighter = Self {
+            lexer,
+            text: Vec::new(),
+            raw: Vec::new(),
+            checkpoints: vec![Checkpoint::default()],
+            tokens: Vec::new(),
+        };
+        highlighter.highlight(b"");
+        highlighter
+    }
+
+    /// Lex a whole document, replacing the one before.
+    pub fn highlight(&mut self, text: &[u8]) {
+        self.text = text.to_vec();
+        self.raw.clear();
+        self.checkpoints.truncate(1);
+        self.tokens.clear();
+        self.lex(&[], 0, 0);
+    }
+
+    /// Replace `range` of the document with `replacement` and update the tokens. Returns the
+    /// range of the new document whose tokens changed, which includes the replacement.
+    ///
+    /// # Panics
+    ///
+    /// If `range` isn't a range of the document.
+    pub fn edit(&mut self, range: Range<usize>, replacement: &[u8]) -> Range<usize> {
+        assert!(
+            range.start <= range.end && range.end <= self.text.len(),
+            "bytes {range:?} are out of bounds"
+        );
+        let removed: Vec<u8> =
+            self.text.splice(range.clone(), replacement.iter().copied()).collect();
+        self.lex(&removed, range.start, replacement.len())
+    }
+
+    /// Replace the document with `text` like [`edit`](Self::edit), from where it starts
+    /// to differ to where it stops differing.
+    pub fn update(&mut self, text: &[u8]) -> Range<usize> {
+        let old = &self.text;
+        let prefix = old.iter().zip(text).take_while(|(a, b)| a == b).count();
+        let suffix = old[prefix..]
+            .iter()
+            .rev()
+            .zip(text[prefix..].iter().rev())
+            .take_while(|(a, b)| a == b)
+            .count();
+        self.edit(prefix..old.len() - suffix, &text[prefix..text.len() - suffix])
+    }
+
+    /// The lines around `range` of the document, from the start of the last line the lexer
+    /// can pick up at before it to the start of the first one after it, or the end of the
+    /// text. No token crosses either end, and the tokens of one line never depend on the
+    /// text of the others, but for what a lexer or filter finds out about the document as
+    /// a whole, like [`Lexer::needs_whole_text`].
+    pub(crate) fn lines_around(&self, range: Range<usize>) -> Range<usize> {
+        let before = self.checkpoints.partition_point(|c| c.pos <= range.start).max(1) - 1;
+        let after = self.checkpoints.partition_point(|c| c.pos < range.end.max(range.start + 1));
+        let end = self.checkpoints.get(after).map_or(self.text.len(), |c| c.pos);
+        self.checkpoints[before].pos..end
+    }
+
+    /// Lex the text from the last line the lexer can pick up at before the edit at `at`,
+    /// which replaced the `removed` bytes with `inserted` ones, until it gets to a line
+    /// after the edit in the same state and after the same tokens as before. Returns the
+    /// range whose tokens changed, like [`edit`](Self::edit).
+    fn lex(&mut self, removed: &[u8], at: usize, inserted: usize) -> Range<usize> {
+        let edit = at..at + removed.len();
+        let moved = |pos: usize| pos - edit.len() + inserted;
+        let restart = self.checkpoints.partition_point(|c| c.precedes(edit.start)).max(1) - 1;
+        let old_checkpoints = self.checkpoints.split_off(restart + 1);
+        let from = self.checkpoints[restart].clone();
+        let old_raw = self.raw.split_off(from.index);
+        let old_len = self.text.len() - inserted + removed.len();
+
+        // The text of the old document in `span`, which is only in `removed` where it
+        // overlaps the edit.
+        let text = &self.text;
+        let old_text = |span: Range<usize>| -> Cow<[u8]> {
+            if span.end <= edit.start {
+                Cow::Borrowed(&text[span])
+            } else if span.start >= edit.end {
+                Cow::Borrowed(&text[moved(span.start)..moved(span.end)])
+            } else {
+                let mut bytes = text[span.start.min(edit.start)..edit.start].to_vec();
+                bytes.extend_from_slice(
+                    &removed[span.start.max(edit.start) - edit.start
+                        ..span.end.min(edit.end) - edit.start],
+                );
+                bytes.extend_from_slice(&text[moved(edit.end)..moved(span.end.max(edit.end))]);
+                Cow::Owned(bytes)
+            }
+        };
+
+        let mut reported = Vec::new();
+        let mut stop = None;
+        let resumed =
+            self.lexer.resume(text, &from, &mut self.raw, &mut |checkpoint, text, tokens| {
+                reported.push(checkpoint.clone());
+                if checkpoint.pos < edit.start + inserted {
+                    return false;
+                }
+                let old_pos = checkpoint.pos - inserted + edit.len();
+                let Ok(i) = old_checkpoints.binary_search_by_key(&old_pos, |c| c.pos) else {
+                    return false;
+                };
+                let old = &old_checkpoints[i];
+                // The tokens before `from` are the same in both.
+                let old_token = |j: usize| match j.checked_sub(from.index) {
+                    Some(k) => (&old_raw[k], old_text(old_raw[k].span.clone())),
+                    None => (&tokens[j], Cow::Borrowed(&text[tokens[j].span.clone()])),
+                };
+                let new_token =
+                    |j: usize| (&tokens[j], Cow::Borrowed(&text[tokens[j].span.clone()]));
+                let lookbehind = old.lookbehind.max(checkpoint.lookbehind);
+                if old.state == checkpoint.state
+                    && same_tokens_before(
+                        old_token,
+                        old.index,
+                        new_token,
+                        checkpoint.index,
+                        lookbehind,
+                    )
+                {
+                    stop = Some(i);
+                }
+                stop.is_some()
+            });
+
+        // The tokens to finish again: those from `from` to where the lexer stopped, if
+        // finishing them only needs their lines, or else all of them.
+        let (start, end, old_end) = match stop {
+            _ if !resumed || self.lexer.needs_whole_text() => (0, self.text.len(), old_len),
+            Some(i) => (from.pos, reported.last().unwrap().pos, old_checkpoints[i].pos),
+            None => (from.pos, self.text.len(), old_len),
+        };
+        let finished = if resumed {
+            self.checkpoints.extend(reported);
+            if let Some(i) = stop {
+                // The old tokens and lines from there on, which have only moved.
+                let old = &old_checkpoints[i];
+                let new = self.checkpoints.last().unwrap().clone();
+                self.raw.extend(old_raw[old.index - from.index..].iter().map(|token| Token {
+                    span: moved(token.span.start)..moved(token.span.end),
+                    ..token.clone()
+                }));
+                self.checkpoints.extend(old_checkpoints[i + 1..].iter().map(|c| Checkpoint {
+                    pos: moved(c.pos),
+                    index: c.index - old.index + new.index,
+                    // Further than before only because of the tokens after `old`.
+                    lookahead: match c.lookahead {
+                        lookahead if lookahead <= old.lookahead => new.lookahead,
+                        usize::MAX => usize::MAX,
+                        lookahead => moved(lookahead).max(new.lookahead),
+                    },
+                    ..c.clone()
+                }));
+            }
+            let first = self.raw.partition_point(|t| t.span.start < start);
+            let last = self.raw.partition_point(|t| t.span.start < end);
+            let mut tokens = self.raw[first..last].to_vec();
+            shift_tokens(&mut tokens, |pos| pos - start);
+            self.lexer.finish(&self.text[start..end], &mut tokens);
+            shift_tokens(&mut tokens, |pos| pos + start);
+            tokens
+        } else {
+            self.raw.clear();
+            self.checkpoints.truncate(1);
+            self.lexer.tokenize(&self.text)
+        };
+
+        let first = self.tokens.partition_point(|t| t.span.start < start);
+        let last = self.tokens.partition_point(|t| t.span.start < old_end);
+        let changed = changed(&self.tokens[first..last], &finished, edit.clone(), inserted);
+        splice_tokens(&mut self.tokens, start..old_end, finished, moved);
+        changed
+    }
+
+    /// The tokens of the whole document, which are the same as [`Lexer::tokenize`] gives.
+    pub fn tokens(&self) -> &[Token] {
+        &self.tokens
+    }
+
+    /// The document.
+    pub fn text(&self) -> &[u8] {
+        &self.text
+    }
+}
+
+/// The range of the new document whose tokens changed, from the `old` tokens to the `new`
+/// ones in their place, after `edit` of the old document was replaced with `inserted`
+/// bytes. It includes the replacement.
+fn changed(old: &[Token], new: &[Token], edit: Range<usize>, inserted: usize) -> Range<usize> {
+    let moved = |token: &Token| token.span.start - edit.len() + inserted;
+    let prefix = old
+        .iter()
+        .zip(new)
+        .take_while(|(old, new)| old == new && old.span.end <= edit.start)
+        .count();
+    let suffix = old[prefix..]
+        .iter()
+        .rev()
+        .zip(new[prefix..].iter().rev())
+        .take_while(|(old, new)| {
+            old.span.start >= edit.end
+                && moved(old) == new.span.start
+                && old.span.len() == new.span.len()
+                && Token { span: new.span.clone(), ..(*old).clone() } == **new
+        })
+        .count();
+    let replaced = edit.start..edit.start + inserted;
+    match &new[prefix..new.len() - suffix] {
+        [] => replaced,
+        [first, .., last] => first.span.start.min(replaced.start)..last.span.end.max(replaced.end),
+        [only] => only.span.start.min(replaced.start)..only.span.end.max(replaced.end),
+    }
+}
+
+/// Moves the `tokens` to the offsets that `shift` gives for theirs.
+pub(crate) fn shift_tokens(tokens: &mut [Token], shift: impl Fn(usize) -> usize) {
+    for token in tokens {
+        token.span = shift(token.span.start)..shift(token.span.end);
+    }
+}
+
+/// Puts `new` in place of the `tokens` that start in `range` of the old document, whose
+/// tokens after it have only `moved` to where the new document has them.
+pub(crate) fn splice_tokens(
+    tokens: &mut Vec<Token>,
+    range: Range<usize>,
+    new: Vec<Token>,
+    moved: impl Fn(usize) -> usize,
+) {
+    let first = tokens.partition_point(|t| t.span.start < range.start);
+    let last = tokens.partition_point(|t| t.span.start < range.end);
+    let count = new.len();
+    tokens.splice(first..last, new);
+    shift_tokens(&mut tokens[first + count..], moved);
+}
+
+/// Whether the tokens before `a_end` of `a` and `b_end` of `b` are the same back to the
+/// `count`th significant one, going by their kinds, payloads, scopes and text.
+/// `a` and `b` give each token with its text.
+fn same_tokens_before<'a, 'b>(
+    a: impl Fn(usize) -> (&'a Token, Cow<'a, [u8]>),
+    a_end: usize,
+    b: impl Fn(usize) -> (&'b Token, Cow<'b, [u8]>),
+    b_end: usize,
+    count: usize,
+) -> bool {
+    let mut significant = 0;
+    for (i, j) in (0..a_end).rev().zip((0..b_end).rev()) {
+        let ((a, a_text), (b, b_text)) = (a(i), b(j));
+        if a.kind != b.kind {
+            return false;
+        }
+        if !a.kind.is_trivia() && significant == count {
+            return true;
+        }
+        if a.payload != b.payload || a.scopes != b.scopes || a_text != b_text {
+            return false;
+        }
+        if !a.kind.is_trivia() {
+            significant += 1;
+            if significant == count {
+                return true;
+            }
+        }
+    }
+    // The start of the text, if both got there.
+    a_end == b_end
+}
+
+#[cfg(test)]
+mod tests {
+    use std::sync::atomic::{AtomicUsize, Ordering};
+
+    use super::*;
+    use crate::syntax::{Language, LexerRegistry, ReportCheckpoint};
+
+    fn go_grammar() -> Grammar {
+        Grammar::parse(include_str!("../../tests/grammars/go.tmLanguage.json")).unwrap()
+    }
+
+    /// Edits a highlighter and checks its tokens against tokenizing the whole document.
+    struct Script<'g> {
+        highlighter: IncrementalHighlighter<'g>,
+        lines: Vec<Vec<u8>>,
+    }
+
+    impl<'g> Script<'g> {
+        fn new(grammar: &'g Grammar, text: &str) -> Self {
+            let mut highlighter = IncrementalHighlighter::new(grammar);
+            highlighter.highlight(text.as_bytes());
+            let lines = text.split('\n').map(|l| l.as_bytes().to_vec()).collect();
+            Self { highlighter, lines }
+        }
+
+        fn edit(&mut self, start: usize, end: usize, lines: &[&str]) -> Range<usize> {
+            let lines: Vec<&[u8]> = lines.iter().map(|l| l.as_bytes()).collect();
+            let changed = self.highlighter.edit(start, end, &lines);
+            self.lines.splice(start..end, lines.iter().map(|l| l.to_vec()));
+            if self.lines.is_empty() {
+                self.lines.push(Vec::new());
+            }
+
+            let text = self.lines.join(&b'\n');
+            assert_eq!(self.highlighter.text(), text);
+            assert_eq!(self.highlighter.line_count(), self.lines.len());
+            assert!(
+                self.highlighter.tokens() == self.highlighter.grammar.tokenize(&text),
+                "the tokens after replacing lines {start}..{end} differ",
+            );
+            changed
+        }
+
+        /// Replace a single line.
+        fn type_line(&mut self, line: usize, text: &str) -> Range<usize> {
+            self.edit(line, line + 1, &[text])
+        }
+
+        fn line(&self, line: usize) -> String {
+            String::from_utf8(self.lines[line].clone()).unwrap()
+        }
+    }
+
+    #[test]
+    fn test_edits() {
+        let grammar = go_grammar();
+        let fixture = include_str!("../../../../syntax-tests/test_syntax.go");
+        let mut script = Script::new(&grammar, fixture);
+
+        // Typing in a line only tokenizes that line.
+        let line = script.line(50);
+        assert_eq!(script.type_line(50, &format!("{line} // note")), 50..51);
+        assert_eq!(script.type_line(50, &line), 50..51);
+
+        // Typing the `/*` of a comment tokenizes up to the next `*/`, the `*/` and removing
+        // the `/*` again up to where the comment ended.
+        let line = script.line(20);
+        let opened = script.type_line(20, &format!("{line} /*"));
+        assert!(opened.start == 20 && opened.end > 21);
+        let closed = script.type_line(25, &format!("*/ {}", script.line(25)));
+        assert!(closed.start == 25 && closed.end > 26 && closed.end <= opened.end);
+        script.type_line(20, &line);
+
+        // Inserting, deleting and replacing lines.
+        assert_eq!(script.edit(30, 30, &["var inserted = 1", "", "// two"]), 30..33);
+        assert_eq!(script.edit(30, 33, &[]), 30..30);
+        script.edit(40, 45, &["func f() {", "\treturn", "}"]);
+        script.edit(0, 0, &["/* a header", " */"]);
+        script.edit(0, 2, &[]);
+
+        // At the end, where the line above gains or loses its `\n`.
+        let count_now = script.lines.len();
+        assert_eq!(
+            script.edit(count_now, count_now, &["var last = 1"]),
+            count_now - 1..count_now + 1
+        );
+        script.edit(count_now, count_now + 1, &[]);
+        script.edit(count_now - 1, count_now, &["}", "x := `open"]);
+
+        // Everything, and then nothing.
+        script.edit(0, script.lines.len(), &[]);
+        assert_eq!(script.highlighter.tokens(), []);
+        script.edit(0, 1, &["package main", "", "var s = `raw", "string`"]);
+    }
+
+    #[test]
+    fn test_raw_strings() {
+        let grammar = go_grammar();
+        let fixture = include_str!("../../../../syntax-tests/test_syntax.go");
+        let mut script = Script::new(&grammar, fixture);
+        let count = script.lines.len();
+
+        // Type a raw string over two lines, character by character. The opening backtick
+        // turns everything up to the next one into a string, and the closing one back.
+        let line = 100;
+        let indent = "\t";
+        script.edit(line, line, &[indent, indent]);
+        for (i, _) in "s := `one".char_indices().skip(1) {
+            script.type_line(line, &format!("{indent}{}", &"s := `one"[..=i]));
+        }
+        let mut widest = 0..0;
+        for (i, _) in "two` + x".char_indices() {
+            let changed = script.type_line(line + 1, &"two` + x"[..=i]);
+            if changed.len() > widest.len() {
+                widest = changed;
+            }
+        }
+        // Closing it went up to the backtick it had paired with before.
+        assert_eq!(widest.start, line + 1);
+        assert!(widest.end > line + 2 && widest.end < count);
+
+        // Removing the opening backtick turns it around again.
+        script.type_line(line, &format!("{indent}s := one"));
+        script.type_line(line, &format!("{indent}s := `one"));
+        script.edit(line, line + 2, &[]);
+    }
+
+    /// A lexer that counts the lines it lexes again.
+    struct Counting(Box<dyn Lexer>, &'static AtomicUsize);
+
+    impl Lexer for Counting {
+        fn tokenize(&self, text: &[u8]) -> Vec<Token> {
+            self.0.tokenize(text)
+        }
+
+        fn resume(
+            &self,
+            text: &[u8],
+            from: &Checkpoint,
+            tokens: &mut Vec<Token>,
+            report: &mut ReportCheckpoint,
+        ) -> bool {
+            self.0.resume(text, from, tokens, &mut |checkpoint, text, tokens| {
+                self.1.fetch_add(1, Ordering::Relaxed);
+                report(checkpoint, text, tokens)
+            })
+        }
+
+        fn finish(&self, text: &[u8], tokens: &mut Vec<Token>) {
+            self.0.finish(text, tokens);
+        }
+
+        fn needs_whole_text(&self) -> bool {
+            self.0.needs_whole_text()
+        }
+    }
+
+    /// Edits an [`IncrementalLexer`] and checks its tokens against lexing the whole document.
+    struct LexerScript {
+        highlighter: IncrementalLexer,
+        lexer: Box<dyn Lexer>,
+        text: Vec<u8>,
+        lines: &'static AtomicUsize,
+    }
+
+    impl LexerScript {
+        fn new(language: Language, text: &[u8]) -> Self {
+            let lines = Box::leak(Box::new(AtomicUsize::new(0)));
+            let counting = Counting(LexerRegistry::get_lexer(language), lines);
+            let mut highlighter = IncrementalLexer::new(Box::new(counting));
+            highlighter.highlight(text);
+            let lexer = LexerRegistry::get_lexer(language);
+            assert!(highlighter.tokens() == lexer.tokenize(text), "{language:?}");
+            Self { highlighter, lexer, text: text.to_vec(), lines }
+        }
+
+        /// Replace `range` and return the range whose tokens changed and the number of
+        /// lines lexed again.
+        fn edit(&mut self, range: Range<usize>, replacement: &str) -> (Range<usize>, usize) {
+            self.lines.store(0, Ordering::Relaxed);
+            let old = self.highlighter.tokens().to_vec();
+            let changed = self.highlighter.edit(range.clone(), replacement.as_bytes());
+            self.text.splice(range.clone(), replacement.bytes());
+
+            assert_eq!(self.highlighter.text(), self.text);
+            let tokens = self.highlighter.tokens();
+            assert!(
+                tokens == self.lexer.tokenize(&self.text),
+                "the tokens after replacing bytes {range:?} with {replacement:?} differ",
+            );
+            // Outside of `changed`, they're the ones from before, if moved.
+            let moved = |pos: usize| pos - range.len() + replacement.len();
+            let before = tokens.partition_point(|t| t.span.end <= changed.start);
+            let after = tokens.len()
+                - tokens.iter().rev().take_while(|t| t.span.start >= changed.end).count();
+            assert_eq!(tokens[..before], old[..before], "before {changed:?}");
+            let old_after = old.len() - (tokens.len() - after);
+            for (old, new) in old[old_after..].iter().zip(&tokens[after..]) {
+                assert_eq!(
+                    moved(old.span.start)..moved(old.span.end),
+                    new.span,
+                    "after {changed:?}"
+                );
+                assert!(old.kind == new.kind && old.payload == new.payload, "after {changed:?}");
+            }
+            (changed, self.lines.load(Ordering::Relaxed))
+        }
+
+        /// The range of `line`, without its `\n`.
+        fn line(&self, line: usize) -> Range<usize> {
+            let mut lines = self.text.split(|&b| b == b'\n');
+            let start: usize = lines.by_ref().take(line).map(|l| l.len() + 1).sum();
+            start..start + lines.next().unwrap().len()
+        }
+
+        /// Type `typed` at `pos` one character after the other, returning the widest range
+        /// any of them changed.
+        fn type_at(&mut self, pos: usize, typed: &str) -> Range<usize> {
+            let mut widest = 0..0;
+            for (i, ch) in typed.char_indices() {
+                let (changed, _) = self.edit(pos + i..pos + i, &typed[i..i + ch.len_utf8()]);
+                if changed.len() > widest.len() {
+                    widest = changed;
+                }
+            }
+            widest
+        }
+    }
+
+    #[test]
+    fn test_lexer_edits() {
+        let fixture = include_bytes!("../../../../syntax-tests/test_syntax.go");
+        let mut script = LexerScript::new(Language::Go, fixture);
+
+        // Typing in a line only lexes that line and the ones whose first tokens look at the
+        // last two tokens before them.
+        let line = script.line(50);
+        let (changed, lexed) = script.edit(line.end..line.end, " // note");
+        assert!(changed.start >= line.start && changed.end <= line.end + 8);
+        assert!(lexed <= 3, "{lexed}");
+        script.edit(line.end..line.end + 8, "");
+
+        // Typing the `/*` of a comment turns everything up to the next `*/` into a comment,
+        // and typing a `*/` before that turns the rest back.
+        let line = script.line(20);
+        let (opened, _) = script.edit(line.end..line.end, " /*");
+        assert!(opened.start >= line.start && opened.end > script.line(26).start);
+        let below = script.line(25);
+        let (closed, _) = script.edit(below.start..below.start, "*/ ");
+        assert!(closed.end > script.line(26).start && closed.end <= opened.end + 3);
+        script.edit(below.start..below.start + 3, "");
+        script.edit(line.end..line.end + 3, "");
+
+        // Inserting, deleting and replacing lines.
+        let at = script.line(30).start;
+        script.edit(at..at, "var inserted = 1\n\n// two\n");
+        script.edit(at..script.line(33).start, "");
+        script.edit(script.line(40).start..script.line(45).start, "func f() {\n\treturn\n}\n");
+        script.edit(0..0, "/* a header\n */\n");
+        script.edit(0..script.line(2).start, "");
+
+        // At the end, and at the start of a document with a byte order mark.
+        let end = script.text.len();
+        script.edit(end..end, "var last = 1");
+        script.edit(end..end + 12, "}\nx := `open");
+        script.edit(0..0, "\u{FEFF}");
+        script.type_at(script.line(3).start, "// package");
+        script.edit(0..3, "");
+
+        // Everything, and then nothing.
+        script.edit(0..script.text.len(), "");
+        assert_eq!(script.highlighter.tokens(), []);
+        script.edit(0..0, "package main\n\nvar s = `raw\nstring`\n");
+    }
+
+    #[test]
+    fn test_lexer_raw_strings() {
+        let fixture = include_bytes!("../../../../syntax-tests/test_syntax.go");
+        let mut script = LexerScript::new(Language::Go, fixture);
+
+        // Type a raw string over two lines, character by character. The opening backtick
+        // turns everything up to the next one into a string, and the closing one back.
+        let at = script.line(100).start;
+        script.edit(at..at, "\t\n\t\n");
+        let opened = script.type_at(at + 1, "s := `one");
+        assert!(opened.start <= at + 6 && opened.end > script.line(102).start);
+        let closed = script.type_at(script.line(101).start + 1, "two` + x");
+        assert!(closed.start >= at && closed.end > script.line(102).start);
+
+        // Removing the opening backtick turns it around again.
+        let backtick = script.line(100).start + 6;
+        let (changed, _) = script.edit(backtick..backtick + 1, "");
+        assert!(changed.end > script.line(102).start);
+        script.edit(backtick..backtick, "`");
+        script.edit(script.line(100).start..script.line(102).start, "");
+    }
+
+    #[test]
+    fn test_lexer_fixtures() {
+        let fixtures: &[(Language, &[u8])] = &[
+            (Language::Go, include_bytes!("../../../../syntax-tests/test_syntax.go")),
+            (Language::Go, include_bytes!("../../../../syntax-tests/test_syntax_generics.go")),
+            (Language::Go, include_bytes!("../../../../syntax-tests/test_cgo.go")),
+            (Language::Go, include_bytes!("../../../../syntax-tests/test_bom.go")),
+            (Language::Go, include_bytes!("../../../../syntax-tests/test_latin1_comment.go")),
+            (Language::Json, include_bytes!("../../../../syntax-tests/test_syntax.json")),
+            (Language::Toml, include_bytes!("../../../../syntax-tests/test_syntax.toml")),
+            (Language::Css, include_bytes!("../../../../syntax-tests/test_syntax.css")),
+            (Language::Java, include_bytes!("../../../../syntax-tests/test_syntax.java")),
+            (Language::CSharp, include_bytes!("../../../../syntax-tests/test_syntax.cs")),
+            (Language::Xml, include_bytes!("../../../../syntax-tests/test_syntax.xml")),
+            (Language::Html, include_bytes!("../../../../syntax-tests/test_syntax.html")),
+            (Language::C, include_bytes!("../../../../syntax-tests/test_syntax.c")),
+            (Language::C, include_bytes!("../../../../syntax-tests/test_syntax_preprocessor.c")),
+            (Language::C, include_bytes!("../../../../syntax-tests/test_syntax_latin1.c")),
+            (Language::Cpp, include_bytes!("../../../../syntax-tests/test_syntax.cpp")),
+            (Language::Rust, include_bytes!("../../../../syntax-tests/test_syntax.rs")),
+            (Language::Python, include_bytes!("../../../../syntax-tests/test_syntax.py")),
+            (Language::Python, include_bytes!("../../../../syntax-tests/test_fstrings.py")),
+            (Language::JavaScript, include_bytes!("../../../../syntax-tests/test_syntax.js")),
+            (
+                Language::JavaScript,
+                include_bytes!("../../../../syntax-tests/test_interpolation.js"),
+            ),
+            (Language::JavaScript, include_bytes!("../../../../syntax-tests/test_syntax_regex.js")),
+            (Language::Markdown, include_bytes!("../../../../syntax-tests/test_syntax.md")),
+            (Language::Yaml, include_bytes!("../../../../syntax-tests/test_syntax.yaml")),
+            (
+                Language::Yaml,
+                include_bytes!("../../../../syntax-tests/test_syntax_block_scalars.yaml"),
+            ),
+            (Language::Shell, include_bytes!("../../../../syntax-tests/test_syntax.sh")),
+            (Language::Shell, include_bytes!("../../../../syntax-tests/test_heredoc.sh")),
+            (Language::Sql, include_bytes!("../../../../syntax-tests/test_syntax.sql")),
+            (Language::Sql, include_bytes!("../../../../syntax-tests/test_syntax_mysql.sql")),
+            (Language::Sql, include_bytes!("../../../../syntax-tests/test_syntax_postgres.sql")),
+            (Language::Sql, include_bytes!("../../../../syntax-tests/test_syntax_mssql.sql")),
+            (Language::Sql, include_bytes!("../../../../syntax-tests/test_syntax_sqlite.sql")),
+            (Language::AsciiDoc, include_bytes!("../../../../syntax-tests/test_syntax.adoc")),
+        ];
+        // Insertions that open or close something, deletions and pieces of the text pasted
+        // elsewhere, at spots all over it, each kept for the next.
+        let typed = [
+            "\"",
+            "`",
+            "'",
+            "/*",
+            "*/",
+            "{",
+            "}",
+            "(",
+            "[",
+            "]",
+            ",",
+            "\n",
+            "#",
+            "<!--",
+            "```",
+            "'''",
+            "$(",
+            "x",
+            "\r\n",
+            "|\n",
+            "    ",
+            "<<EOF\n",
+            "\nEOF\n",
+            "</script>",
+            "-- dialect: mysql\n",
+        ];
+        for &(language, text) in fixtures {
+            let mut script = LexerScript::new(language, text);
+            let mut seed = 0x2545_F491u32;
+            let mut next = |n: usize| {
+                seed ^= seed << 13;
+                seed ^= seed >> 17;
+                seed ^= seed << 5;
+                seed as usize % n.max(1)
+            };
+            for i in 0..300 {
+                let pos = next(script.text.len() + 1);
+                match i % 3 {
+                    0 => {
+                        script.edit(pos..pos, typed[next(typed.len())]);
+                    }
+                    1 => {
+                        let end = (pos + next(12)).min(script.text.len());
+                        script.edit(pos..end, "");
+                    }
+                    _ => {
+                        let start = next(text.len());
+                        let piece = &text[start..(start + next(200)).min(text.len())];
+                        script.edit(pos..pos, &String::from_utf8_lossy(piece));
+                    }
+                }
+            }
+        }
+    }
+}
@@ -0,0 +1,332 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//! Indentation guides and auto-indent hints computed from the token stream.
+//!
+//! Both only look at bracket tokens and the first and last token of a line, so brackets
+//! in strings and comments don't count, and a hint only needs the tokens of two lines.
+//! Language-specific rules (Python's trailing `:`, Go's labels, ...) are declared in
+//! [`IndentRules`](crate::syntax::IndentRules).
+
+use crate::helpers::CoordType;
+use crate::syntax::brackets::bracket_byte;
+use crate::syntax::lines::LineIndex;
+use crate::syntax::{GrammarMetadata, Language, Token, TokenKind};
+use crate::unicode::display_width;
+
+/// How the indentation of a new line compares to the line it's inserted after.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum IndentHint {
+    Increase,
+    Keep,
+    Decrease,
+}
+
+/// Decides the [`IndentHint`] for a line from its tokens (without whitespace and comments)
+/// in cases [`IndentRules`](crate::syntax::IndentRules) can't express. See `IndentRules::hook`.
+pub type IndentHook = fn(text: &[u8], tokens: &[&Token]) -> Option<IndentHint>;
+
+/// Compute the number of indentation guides for each line of `text`.
+///
+/// This is the bracket nesting depth at the start of the line, not counting
+/// closing brackets the line starts with. Guides are drawn at multiples of the indentation width.
+pub fn indent_guides(language: Language, text: &[u8], tokens: &[Token]) -> Vec<usize> {
+    let metadata = language.metadata();
+    let lines = LineIndex::new(text);
+    let mut guides = Vec::with_capacity(lines.count());
+    let mut depth: usize = 0;
+    let mut idx = 0;
+
+    for line in 0..lines.count() {
+        let range = lines.range(line);
+        let mut line_depth = depth;
+        let mut leading = true;
+
+        while idx < tokens.len() && tokens[idx].span.start <= range.end {
+            let token = &tokens[idx];
+            idx += 1;
+            if token.span.start < range.start || is_insignificant(token) {
+                continue;
+            }
+            match bracket_byte(metadata, text, token) {
+                Some(b) if metadata.is_closer(b) => {
+                    depth = depth.saturating_sub(1);
+                    if leading {
+                        line_depth = depth;
+                    }
+                }
+                Some(_) => {
+                    depth += 1;
+                    leading = false;
+                }
+                None => leading = false,
+            }
+        }
+
+        guides.push(line_depth);
+    }
+
+    guides
+}
+
+/// Returns the width of the indentation of `line` in columns, with tabs advancing to the
+/// next multiple of `tab_size`.
+///
+/// This is the computation the editor lays out text with (see [`display_width`]),
+/// so that guides drawn at these columns line up with the text, wrapped or not.
+/// Token offsets are bytes and don't depend on the tab size.
+pub fn indent_width(line: &[u8], tab_size: CoordType) -> CoordType {
+    let indent = line.iter().take_while(|&&b| b == b' ' || b == b'\t').count();
+    display_width(&line[..indent], tab_size)
+}
+
+/// Determine how to indent the line that is created when pressing enter at `offset`.
+///
+/// Everything before `offset` on its line is the line that's being finished and
+/// everything after it moves to the new line.
+pub fn indent_hint(language: Language, text: &[u8], tokens: &[Token], offset: usize) -> IndentHint {
+    let metadata = language.metadata();
+    let rules = &metadata.indent;
+    let offset = offset.min(text.len());
+    let line_start = text[..offset].iter().rposition(|&b| b == b'\n').map_or(0, |i| i + 1);
+    let line_end =
+        text[offset..].iter().position(|&b| b == b'\n').map_or(text.len(), |i| offset + i);
+
+    let before = significant(tokens, line_start, offset);
+    let after = significant(tokens, offset, line_end);
+    let is = |token: Option<&Token>, list: &[&str]| {
+        token.is_some_and(|t| list.iter().any(|s| metadata.is_keyword(&text[t.span.clone()], s)))
+    };
+
+    let last = before.last().copied();
+    if last.is_some_and(|t| is_opener(metadata, text, t)) {
+        return IndentHint::Increase;
+    }
+    if after.first().is_some_and(|t| is_closer(metadata, text, t)) {
+        return IndentHint::Decrease;
+    }
+    if let Some(hint) = rules.hook.and_then(|hook| hook(text, &before)) {
+        return hint;
+    }
+    if is(last, rules.increase_after) {
+        return IndentHint::Increase;
+    }
+
+    // A continuation is indented once, no matter how many lines it spans.
+    let continued = line_start > 0 && {
+        let prev_start =
+            text[..line_start - 1].iter().rposition(|&b| b == b'\n').map_or(0, |i| i + 1);
+        is(significant(tokens, prev_start, line_start - 1).last().copied(), rules.continuations)
+    };
+    if is(last, rules.continuations) {
+        return if continued { IndentHint::Keep } else { IndentHint::Increase };
+    }
+    if continued || is(before.first().copied(), rules.decrease_after) {
+        return IndentHint::Decrease;
+    }
+
+    IndentHint::Keep
+}
+
+/// Indentation hook for YAML.
+///
+/// The content of a `- key: value` sequence item continues after the dash, and a key whose
+/// value is only an anchor or a tag (`key: &anchor`) is followed by an indented block.
+pub fn yaml_indent(text: &[u8], tokens: &[&Token]) -> Option<IndentHint> {
+    let is = |token: &Token, s: &[u8]| &text[token.span.clone()] == s;
+    match tokens {
+        [dash, rest @ ..] if is(dash, b"-") && rest.iter().any(|t| is(t, b":")) => {
+            Some(IndentHint::Increase)
+        }
+        [.., colon, last]
+            if is(colon, b":")
+                && (last.kind == TokenKind::Attribute || text[last.span.start] == b'&') =>
+        {
+            Some(IndentHint::Increase)
+        }
+        _ => None,
+    }
+}
+
+/// Returns the tokens in `start..end`, without whitespace and comments.
+fn significant(tokens: &[Token], start: usize, end: usize) -> Vec<&Token> {
+    let beg = tokens.partition_point(|t| t.span.start < start);
+    tokens[beg..]
+        .iter()
+        .take_while(|t| t.span.end <= end)
+        .filter(|t| !is_insignificant(t))
+        .collect()
+}
+
+fn is_insignificant(token: &Token) -> bool {
+    token.is_empty() || token.kind == TokenKind::Whitespace || token.kind.is_comment()
+}
+
+fn is_opener(metadata: &GrammarMetadata, text: &[u8], token: &Token) -> bool {
+    bracket_byte(metadata, text, token).is_some_and(|b| metadata.closer_of(b).is_some())
+}
+
+fn is_closer(metadata: &GrammarMetadata, text: &[u8], token: &Token) -> bool {
+    bracket_byte(metadata, text, token).is_some_and(|b| metadata.is_closer(b))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::syntax::LexerRegistry;
+
+    fn hint_at_end(language: Language, text: &[u8], line: &[u8]) -> IndentHint {
+        let tokens = LexerRegistry::get_lexer(language).tokenize(text);
+        let start = text.windows(line.len()).position(|w| w == line).unwrap();
+        indent_hint(language, text, &tokens, start + line.len())
+    }
+
+    fn indent_of(line: &[u8]) -> usize {
+        line.iter().take_while(|&&b| b == b' ' || b == b'\t').count()
+    }
+
+    /// Checks the hints against the indentation of a (well formatted) fixture and returns
+    /// the 1-based lines where they're contradicted: a line after an increase must be indented
+    /// deeper, one after a decrease less deep, and one after a keep must not be indented deeper.
+    /// Lines that start or end in the middle of a multi-line token are skipped.
+    fn contradictions(language: Language, text: &[u8]) -> Vec<usize> {
+        let tokens = LexerRegistry::get_lexer(language).tokenize(text);
+        let metadata = language.metadata();
+        let lines = LineIndex::new(text);
+        let inside_token = |offset: usize| {
+            let idx = tokens.partition_point(|t| t.span.end <= offset);
+            tokens.get(idx).is_some_and(|t| t.span.start < offset)
+        };
+        let blank = |line: usize| text[lines.range(line)].iter().all(|b| b.is_ascii_whitespace());
+        let mut result = Vec::new();
+
+        for line in 0..lines.count() {
+            let range = lines.range(line);
+            if blank(line) || inside_token(range.start) || inside_token(range.end) {
+                continue;
+            }
+            let next = (line + 1..lines.count()).find(|&l| !blank(l));
+            let Some(next) = next.filter(|&next| next == line + 1) else {
+                continue;
+            };
+            let next_range = lines.range(next);
+            if inside_token(next_range.start) {
+                continue;
+            }
+
+            let current = indent_of(&text[range.clone()]) as isize;
+            let mut delta = indent_of(&text[next_range.clone()]) as isize - current;
+            // A closer at the start of the next line is dedented on its own.
+            let first = significant(&tokens, next_range.start, next_range.end);
+            if first.first().is_some_and(|t| is_closer(metadata, text, t)) {
+                delta += 1;
+            }
+
+            let ok = match indent_hint(language, text, &tokens, range.end) {
+                IndentHint::Increase => delta > 0,
+                IndentHint::Keep => delta <= 0,
+                IndentHint::Decrease => delta < 0,
+            };
+            if !ok {
+                result.push(line + 1);
+            }
+        }
+
+        result
+    }
+
+    #[test]
+    fn test_indent_guides_go_fixture() {
+        let text = include_bytes!("../../../../syntax-tests/test_syntax.go");
+        let tokens = LexerRegistry::get_lexer(Language::Go).tokenize(text);
+        let guides = indent_guides(Language::Go, text, &tokens);
+        let lines = LineIndex::new(text);
+
+        // gofmt indents with one tab per nesting level, except for continuation lines
+        // and `case` clauses, which don't contain brackets and aren't checked here.
+        for (line, &depth) in guides.iter().enumerate() {
+            let content = &text[lines.range(line)];
+            if (content.starts_with(b"\t") && content.contains(&b'{')) || content.starts_with(b"}")
+            {
+                assert_eq!(depth, indent_of(content), "line {}", line + 1);
+            }
+        }
+    }
+
+    #[test]
+    fn test_indent_guides_closers() {
+        let text = b"f(func() {\n\tx\n})\n";
+        let tokens = LexerRegistry::get_lexer(Language::Go).tokenize(text);
+        assert_eq!(indent_guides(Language::Go, text, &tokens), vec![0, 2, 0, 0]);
+    }
+
+    #[test]
+    fn test_indent_width() {
+        use crate::helpers::Point;
+        use crate::unicode::{ColumnMap, MeasurementConfig};
+
+        let text = b"a\n  \tb\n\t  c\n \t \td\n";
+        let tokens = LexerRegistry::get_lexer(Language::Go).tokenize(text);
+        let lines = LineIndex::new(text);
+
+        for (tab_size, expected) in [(2, [0, 4, 4, 4]), (4, [0, 4, 6, 8]), (8, [0, 8, 10, 16])] {
+            let widths: Vec<_> =
+                (0..4).map(|line| indent_width(&text[lines.range(line)], tab_size)).collect();
+            assert_eq!(widths, expected, "tab size {tab_size}");
+
+            for (line, &width) in widths.iter().enumerate() {
+                let range = lines.range(line);
+                let indent = indent_of(&text[range.clone()]);
+                let map = ColumnMap::new(&text[range.clone()], tab_size);
+                assert_eq!(map.column(indent), width);
+
+                // The wrapped layout puts the text at the same column.
+                let cursor = MeasurementConfig::new(&&text[..])
+                    .with_tab_size(tab_size)
+                    .with_word_wrap_column(40)
+                    .goto_logical(Point { x: indent as CoordType, y: line as CoordType });
+                assert_eq!(cursor.visual_pos.x, width);
+            }
+
+            // The tab size doesn't affect the tokens.
+            assert_eq!(LexerRegistry::get_lexer(Language::Go).tokenize(text), tokens);
+        }
+    }
+
+    #[test]
+    fn test_indent_hint_go() {
+        let text = b"func f() {\n\tswitch x {\n\tcase 1:\n\t\ty := a +\n\t\t\tb\n\t}\n}\n";
+        assert_eq!(hint_at_end(Language::Go, text, b"func f() {"), IndentHint::Increase);
+        assert_eq!(hint_at_end(Language::Go, text, b"case 1:"), IndentHint::Increase);
+        assert_eq!(hint_at_end(Language::Go, text, b"y := a +"), IndentHint::Increase);
+        assert_eq!(hint_at_end(Language::Go, text, b"\t\t\tb"), IndentHint::Decrease);
+        assert_eq!(hint_at_end(Language::Go, text, b"\t}"), IndentHint::Keep);
+
+        // Pressing enter between `{` and `}`.
+        let text = b"x := T{}";
+        let tokens = LexerRegistry::get_lexer(Language::Go).tokenize(text);
+        assert_eq!(indent_hint(Language::Go, text, &tokens, 7), IndentHint::Increase);
+        assert_eq!(indent_hint(Language::Go, text, &tokens, 8), IndentHint::Keep);
+    }
+
+    #[test]
+    fn test_indent_hint_python_yaml() {
+        let text = b"def f(x):\n    return x  # done\n";
+        assert_eq!(hint_at_end(Language::Python, text, b"def f(x):"), IndentHint::Increase);
+        assert_eq!(hint_at_end(Language::Python, text, b"# done"), IndentHint::Decrease);
+
+        let text = b"server:\n  port: 8080\n";
+        assert_eq!(hint_at_end(Language::Yaml, text, b"server:"), IndentHint::Increase);
+        assert_eq!(hint_at_end(Language::Yaml, text, b"port: 8080"), IndentHint::Keep);
+    }
+
+    #[test]
+    fn test_indent_hints_match_fixtures() {
+        let go = include_bytes!("../../../../syntax-tests/test_syntax.go");
+        let python = include_bytes!("../../../../syntax-tests/test_syntax.py");
+        let yaml = include_bytes!("../../../../syntax-tests/test_syntax.yaml");
+        assert_eq!(contradictions(Language::Go, go), Vec::<usize>::new());
+        assert_eq!(contradictions(Language::Python, python), Vec::<usize>::new());
+        assert_eq!(contradictions(Language::Yaml, yaml), Vec::<usize>::new());
+    }
+}
@@ -0,0 +1,510 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//! Injections: lexing the content of a token with another language.
+//!
+//! An [`EmbeddedRegion`](crate::syntax::EmbeddedRegion) is found by the host's lexer as it
+//! goes. An injection is decided on the finished token stream instead: a predicate picks
+//! the host tokens, by their text and the containers they're in, and the content of each
+//! is lexed with the target language and spliced in its place. The injected tokens are
+//! subject to the injections of the target language in turn, so that JSON in a shell
+//! command in a Go directive works, up to [`MAX_EMBED_DEPTH`] levels deep.
+//!
+//! The content of a string can be lexed with its escape sequences decoded, so that the
+//! target sees `\"` as a quote. The injected tokens are mapped back over the escapes.
+
+use std::ops::Range;
+
+use crate::syntax::escapes::decode_escapes;
+use crate::syntax::{Language, LexerRegistry, MAX_EMBED_DEPTH, Token, TokenKind};
+
+/// Lexes the content of the host tokens it matches with another language.
+#[derive(Debug, Clone, Copy)]
+pub struct Injection {
+    /// The language of the tokens to inject into.
+    pub host: Language,
+    /// Whether to inject into `token`, given the whole text of the host.
+    /// The containers the token is in are its [`Token::scopes`].
+    pub matches: fn(text: &[u8], token: &Token) -> bool,
+    /// The name of the language to lex the content with, as for [`Language::from_name`].
+    /// If no lexer goes by that name, the token is left as it is.
+    pub target: &'static str,
+    /// The part of the token's text in the target language, relative to the token,
+    /// e.g. without the quotes. The rest of the token keeps its kind.
+    pub content: fn(token: &[u8]) -> Range<usize>,
+    /// Whether the token is a literal whose escape sequences the target should see
+    /// decoded, as the host's [`GrammarMetadata::escapes`](crate::syntax::GrammarMetadata::escapes) has them.
+    pub unescape: bool,
+}
+
+/// A set of injections, which [`Injections::apply`] applies to a token stream.
+#[derive(Debug, Clone, Default)]
+pub struct Injections {
+    list: Vec<Injection>,
+    /// Strings assigned to variables whose names end with the suffix, and their language.
+    suffixes: Vec<(String, Language)>,
+}
+
+impl Injections {
+    /// A set without any injections.
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// The built-in injections, which the highlighter applies if
+    /// [`HighlightOptions::injections`](crate::syntax::HighlightOptions::injections) is set.
+    pub fn builtin() -> Self {
+        Self { list: BUILTIN.to_vec(), suffixes: Vec::new() }
+    }
+
+    /// Add an injection. Of several that match a token, the first one added wins.
+    pub fn register(&mut self, injection: Injection) {
+        self.list.push(injection);
+    }
+
+    /// Lex the strings assigned to variables whose names end with `suffix` as `target`,
+    /// in any host, like `userQuery := "SELECT ..."` for `Query` and SQL. The string has
+    /// to follow the name and its `=` or `:=` right away. Injections added with
+    /// [`Injections::register`] win over these.
+    pub fn register_string_suffix(&mut self, suffix: impl Into<String>, target: Language) {
+        self.suffixes.push((suffix.into(), target));
+    }
+
+    /// Whether any of the injections may match tokens of `language`.
+    pub(crate) fn applies_to(&self, language: Language) -> bool {
+        !self.suffixes.is_empty() || self.list.iter().any(|i| i.host == language)
+    }
+
+    /// Replace the tokens of `language` that an injection matches with the tokens of
+    /// their content. The injected tokens are in the containers of the token they replace.
+    pub fn apply(&self, language: Language, text: &[u8], tokens: &mut Vec<Token>) {
+        self.apply_at(language, text, tokens, 0);
+    }
+
+    fn apply_at(&self, language: Language, text: &[u8], tokens: &mut Vec<Token>, depth: usize) {
+        if depth >= MAX_EMBED_DEPTH || !self.applies_to(language) {
+            return;
+        }
+
+        let mut result: Option<Vec<Token>> = None;
+        for (i, token) in tokens.iter().enumerate() {
+            let literal = &text[token.span.clone()];
+            let found = self
+                .list
+                .iter()
+                .find(|i| i.host == language && (i.matches)(text, token))
+                .map(|i| (Language::from_name(i.target), (i.content)(literal), i.unescape))
+                .or_else(|| {
+                    let target = self.suffix_target(text, tokens, i)?;
+                    Some((target, quoted(literal), true))
+                })
+                .filter(|&(target, ..)| target != Language::PlainText);
+            let Some((target, content, unescape)) = found else {
+                if let Some(result) = &mut result {
+                    result.push(token.clone());
+                }
+                continue;
+            };
+
+            // Only copy the token stream once the first injection shows up.
+            let result = result.get_or_insert_with(|| {
+                let mut result = Vec::with_capacity(tokens.len() + 16);
+                result.extend_from_slice(&tokens[..i]);
+                result
+            });
+            let end = (token.span.start + content.end).min(token.span.end);
+            let start = (token.span.start + content.start).min(end);
+
+            // The decoded content, and where each of its bytes is in the host.
+            let escapes = if unescape { decode_escapes(language, literal) } else { Vec::new() };
+            let (inner_text, offsets) = if escapes.is_empty() {
+                (text[start..end].to_vec(), None)
+            } else {
+                let escapes = escapes.into_iter().map(|(range, ch)| {
+                    (range.start + token.span.start..range.end + token.span.start, ch)
+                });
+                let (decoded, offsets) = unescaped(text, start..end, escapes);
+                (decoded, Some(offsets))
+            };
+            let offset = |pos: usize| offsets.as_ref().map_or(start + pos, |o| o[pos]);
+            let mut inner = LexerRegistry::get_lexer(target).tokenize(&inner_text);
+            self.apply_at(target, &inner_text, &mut inner, depth + 1);
+
+            let piece = |span: Range<usize>| Token { span, ..token.clone() };
+            if token.span.start < start {
+                result.push(piece(token.span.start..start));
+            }
+            result.extend(
+                inner
+                    .into_iter()
+                    .map(|t| Token {
+                        span: offset(t.span.start)..offset(t.span.end),
+                        scopes: token.scopes,
+                        ..t
+                    })
+                    .filter(|t| !t.span.is_empty()),
+            );
+            if end < token.span.end {
+                result.push(piece(end..token.span.end));
+            }
+        }
+
+        if let Some(result) = result {
+            *tokens = result;
+        }
+    }
+
+    /// The language of the string at `i` if it's assigned to a variable with one of the suffixes.
+    fn suffix_target(&self, text: &[u8], tokens: &[Token], i: usize) -> Option<Language> {
+        if self.suffixes.is_empty() || !tokens[i].kind.is_string() {
+            return None;
+        }
+        let mut before = tokens[..i].iter().rev().filter(|t| t.kind != TokenKind::Whitespace);
+        let assign = &text[before.next()?.span.clone()];
+        let name = &text[before.next()?.span.clone()];
+        if !matches!(assign, b"=" | b":=") {
+            return None;
+        }
+        let (_, target) = self.suffixes.iter().find(|(s, _)| name.ends_with(s.as_bytes()))?;
+        Some(*target)
+    }
+}
+
+/// The text in `range` with the `escapes` in it replaced by the characters they stand for,
+/// and the offset of every byte of it in `text`, followed by the end of `range`.
+fn unescaped(
+    text: &[u8],
+    range: Range<usize>,
+    escapes: impl Iterator<Item = (Range<usize>, char)>,
+) -> (Vec<u8>, Vec<usize>) {
+    let mut decoded = Vec::with_capacity(range.len());
+    let mut offsets = Vec::with_capacity(range.len() + 1);
+    let mut pos = range.start;
+    for (escape, ch) in escapes.filter(|(e, _)| range.start <= e.start && e.end <= range.end) {
+        decoded.extend_from_slice(&text[pos..escape.start]);
+        offsets.extend(pos..escape.start);
+        let mut buf = [0; 4];
+        for &b in ch.encode_utf8(&mut buf).as_bytes() {
+            decoded.push(b);
+            offsets.push(escape.start);
+        }
+        pos = escape.end;
+    }
+    decoded.extend_from_slice(&text[pos..range.end]);
+    offsets.extend(pos..=range.end);
+    (decoded, offsets)
+}
+
+/// The injections of [`Injections::builtin`].
+const BUILTIN: &[Injection] = &[
+    // `go generate` splits the command into words much like a shell does.
+    Injection {
+        host: Language::Go,
+        matches: is_go_generate_command,
+        target: "shell",
+        content: all,
+        unescape: false,
+    },
+    Injection {
+        host: Language::Go,
+        matches: is_go_sql_string,
+        target: "sql",
+        content: quoted,
+        unescape: true,
+    },
+];
+
+/// Whether `token` is the command of a `//go:generate` directive.
+fn is_go_generate_command(text: &[u8], token: &Token) -> bool {
+    let line = line_start(text, token.span.start);
+    token.kind == TokenKind::String
+        && text[line..token.span.start].trim_ascii_start().starts_with(b"//go:generate")
+}
+
+/// Whether `token` is a Go string marked as SQL, by a `/* sql */` right in front of it, or
+/// by a `//language=sql` line above its line as in GoLand. In the latter case the string
+/// has to be the value on its line: the first thing on it, or after an `=`, `:=` or `return`.
+fn is_go_sql_string(text: &[u8], token: &Token) -> bool {
+    if token.kind != TokenKind::String {
+        return false;
+    }
+    let before = text[..token.span.start].trim_ascii_end();
+    if let Some(comment) = before.strip_suffix(b"*/") {
+        return comment
+            .windows(2)
+            .rposition(|w| w == b"/*")
+            .is_some_and(|i| is_sql_marker(&comment[i + 2..]));
+    }
+
+    let line = line_start(text, token.span.start);
+    let lead = text[line..token.span.start].trim_ascii();
+    if !(lead.is_empty() || lead.ends_with(b"=") || lead == b"return") || line == 0 {
+        return false;
+    }
+    let above = &text[line_start(text, line - 1)..line];
+    above.trim_ascii().strip_prefix(b"//").is_some_and(is_sql_marker)
+}
+
+/// Whether a comment's text says that the code after it is SQL: `sql` or `language=sql`.
+fn is_sql_marker(comment: &[u8]) -> bool {
+    let comment = comment.trim_ascii();
+    let language = comment.strip_prefix(b"language=").unwrap_or(comment);
+    language.eq_ignore_ascii_case(b"sql")
+}
+
+/// The start of the line that `pos` is on.
+fn line_start(text: &[u8], pos: usize) -> usize {
+    text[..pos].iter().rposition(|&b| b == b'\n').map_or(0, |i| i + 1)
+}
+
+fn all(token: &[u8]) -> Range<usize> {
+    0..token.len()
+}
+
+/// The text of a string literal between its quotes, which are `"`, `'` or `` ` ``, up to three of them.
+fn quoted(token: &[u8]) -> Range<usize> {
+    let Some(&quote @ (b'"' | b'\'' | b'`')) = token.first() else {
+        return all(token);
+    };
+    let open = token.iter().take(3).take_while(|&&b| b == quote).count();
+    // `""` is an empty string rather than the start of a triple-quoted one.
+    let open = if open == 2 { 1 } else { open };
+    let close = token[open..].iter().rev().take(open).take_while(|&&b| b == quote).count();
+    open..token.len() - close
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::syntax::{Columns, LineIndex};
+
+    /// The tokens of `text` after applying `injections`, as `(line, column, kind, text)`,
+    /// without whitespace.
+    fn inject<'a>(
+        injections: &Injections,
+        language: Language,
+        text: &'a str,
+    ) -> Vec<(usize, usize, TokenKind, &'a str)> {
+        let mut tokens = LexerRegistry::get_lexer(language).tokenize(text.as_bytes());
+        injections.apply(language, text.as_bytes(), &mut tokens);
+
+        // The tokens still tile the text.
+        let mut pos = 0;
+        for token in &tokens {
+            assert_eq!(token.span.start, pos, "{tokens:?}");
+            pos = token.span.end;
+        }
+        assert_eq!(pos, text.len());
+
+        let lines = LineIndex::new(text.as_bytes());
+        tokens
+            .into_iter()
+            .filter(|t| t.kind != TokenKind::Whitespace)
+            .map(|t| {
+                let (line, column) = lines.position(text.as_bytes(), t.span.start, Columns::Bytes);
+                (line, column, t.kind, &text[t.span])
+            })
+            .collect()
+    }
+
+    /// A raw string in Go, lexed as `target` without its backticks.
+    fn raw_string(target: &'static str) -> Injection {
+        Injection {
+            host: Language::Go,
+            matches: |text, token| {
+                token.kind == TokenKind::String && text[token.span.start] == b'`'
+            },
+            target,
+            content: |token| 1..token.len() - 1,
+            unescape: false,
+        }
+    }
+
+    #[test]
+    fn test_go_generate() {
+        use TokenKind::*;
+
+        let text = "//go:generate sh gen.sh \"$GOPACKAGE\" $GOFILE\n";
+        assert_eq!(
+            inject(&Injections::builtin(), Language::Go, text),
+            [
+                (0, 0, Macro, "//go:generate"),
+                (0, 14, Identifier, "sh"),
+                (0, 17, Identifier, "gen"),
+                (0, 20, Operator, "."),
+                (0, 21, Identifier, "sh"),
+                (0, 24, String, "\"$GOPACKAGE\""),
+                (0, 37, VariableName, "$GOFILE"),
+            ]
+        );
+        // Not without the directive.
+        assert_eq!(
+            inject(&Injections::builtin(), Language::Go, "x := \"sh -c $X\"\n")[2],
+            (0, 5, String, "\"sh -c $X\"")
+        );
+    }
+
+    #[test]
+    fn test_multi_line_offsets() {
+        use TokenKind::*;
+
+        let mut injections = Injections::new();
+        injections.register(raw_string("json"));
+        let text = "x := `{\n  \"a\": [1,\n    2]\n}`\n";
+        assert_eq!(
+            inject(&injections, Language::Go, text),
+            [
+                (0, 0, Identifier, "x"),
+                (0, 2, Operator, ":="),
+                (0, 5, String, "`"),
+                (0, 6, JsonBrace, "{"),
+                (1, 2, String, "\"a\""),
+                (1, 5, JsonColon, ":"),
+                (1, 7, JsonBracket, "["),
+                (1, 8, Number, "1"),
+                (1, 9, JsonComma, ","),
+                (2, 4, Number, "2"),
+                (2, 5, JsonBracket, "]"),
+                (3, 0, JsonBrace, "}"),
+                (3, 1, String, "`"),
+            ]
+        );
+    }
+
+    #[test]
+    fn test_nested() {
+        use TokenKind::*;
+
+        // A JSON body in a shell command in a Go raw string.
+        let mut injections = Injections::new();
+        injections.register(raw_string("shell"));
+        injections.register(Injection {
+            host: Language::Shell,
+            matches: |text, token| {
+                token.kind == TokenKind::String && text[token.span.start] == b'\''
+            },
+            target: "json",
+            content: |token| 1..token.len() - 1,
+            unescape: false,
+        });
+        let text = "cmd := `curl -d '{\"a\": true}' $URL`";
+        assert_eq!(
+            inject(&injections, Language::Go, text),
+            [
+                (0, 0, Identifier, "cmd"),
+                (0, 4, Operator, ":="),
+                (0, 7, String, "`"),
+                (0, 8, Identifier, "curl"),
+                (0, 13, Operator, "-"),
+                (0, 14, Identifier, "d"),
+                (0, 16, String, "'"),
+                (0, 17, JsonBrace, "{"),
+                (0, 18, String, "\"a\""),
+                (0, 21, JsonColon, ":"),
+                (0, 23, Boolean, "true"),
+                (0, 27, JsonBrace, "}"),
+                (0, 28, String, "'"),
+                (0, 30, VariableName, "$URL"),
+                (0, 34, String, "`"),
+            ]
+        );
+    }
+
+    #[test]
+    fn test_sql_escaped_quotes() {
+        use TokenKind::*;
+
+        // The escaped quotes are one character each to SQL, but two bytes in Go.
+        let text = "q := /* sql */ \"SELECT a FROM t WHERE b = \\\"x\\\"\"";
+        assert_eq!(
+            inject(&Injections::builtin(), Language::Go, text),
+            [
+                (0, 0, Identifier, "q"),
+                (0, 2, Operator, ":="),
+                (0, 5, Comment, "/* sql */"),
+                (0, 15, String, "\""),
+                (0, 16, Keyword, "SELECT"),
+                (0, 23, Identifier, "a"),
+                (0, 25, Keyword, "FROM"),
+                (0, 30, Identifier, "t"),
+                (0, 32, Keyword, "WHERE"),
+                (0, 38, Identifier, "b"),
+                (0, 40, Operator, "="),
+                // A quoted identifier in SQL.
+                (0, 42, Identifier, "\\\"x\\\""),
+                (0, 47, String, "\""),
+            ]
+        );
+    }
+
+    #[test]
+    fn test_sql_markers() {
+        use TokenKind::*;
+
+        let text = "//language=sql\nq := `SELECT 1`\n";
+        assert_eq!(
+            inject(&Injections::builtin(), Language::Go, text)[3..],
+            [
+                (1, 5, String, "`"),
+                (1, 6, Keyword, "SELECT"),
+                (1, 13, Number, "1"),
+                (1, 14, String, "`"),
+            ]
+        );
+        let text = "return /* language=SQL */ `SELECT 1`";
+        assert_eq!(
+            inject(&Injections::builtin(), Language::Go, text)[2..],
+            [
+                (0, 26, String, "`"),
+                (0, 27, Keyword, "SELECT"),
+                (0, 34, Number, "1"),
+                (0, 35, String, "`"),
+            ]
+        );
+
+        // A marker in front of something other than a string is ignored.
+        let text = "q := /* sql */ build(\"SELECT 1\")";
+        assert_eq!(
+            inject(&Injections::builtin(), Language::Go, text)[5],
+            (0, 21, String, "\"SELECT 1\"")
+        );
+        let text = "// language=sql\nq := build(\"SELECT 1\")\n";
+        assert_eq!(
+            inject(&Injections::builtin(), Language::Go, text)[5],
+            (1, 11, String, "\"SELECT 1\"")
+        );
+    }
+
+    #[test]
+    fn test_string_suffix() {
+        use TokenKind::*;
+
+        let mut injections = Injections::new();
+        injections.register_string_suffix("Query", Language::Sql);
+        let text = "userQuery := \"SELECT 1\"\nuserName := \"SELECT 1\"\n";
+        assert_eq!(
+            inject(&injections, Language::Go, text),
+            [
+                (0, 0, Identifier, "userQuery"),
+                (0, 10, Operator, ":="),
+                (0, 13, String, "\""),
+                (0, 14, Keyword, "SELECT"),
+                (0, 21, Number, "1"),
+                (0, 22, String, "\""),
+                (1, 0, Identifier, "userName"),
+                (1, 9, Operator, ":="),
+                (1, 12, String, "\"SELECT 1\""),
+            ]
+        );
+    }
+
+    #[test]
+    fn test_unknown_target() {
+        let mut injections = Injections::new();
+        injections.register(raw_string("graphql"));
+        let text = "q := `{ user { name } }`";
+        let expected = inject(&Injections::new(), Language::Go, text);
+        assert_eq!(inject(&injections, Language::Go, text), expected);
+        assert_eq!(expected[2], (0, 5, TokenKind::String, "`{ user { name } }`"));
+    }
+}
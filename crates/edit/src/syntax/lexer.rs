@@ -3,26 +3,41 @@
 
 //! Lexer implementations for various programming languages.
 
-mod json;
-mod rust;
-mod python;
-mod markdown;
-mod javascript;
-mod toml;
-mod yaml;
+mod asciidoc;
 mod c;
 mod cpp;
 mod csharp;
+mod css;
 mod go;
+mod gotemplate;
+mod heredoc;
 mod html;
-mod css;
+mod interpolation;
 mod java;
-mod xml;
+mod javascript;
+mod json;
+mod markdown;
+mod normalize;
+mod preprocessor;
+mod python;
+mod resume;
+mod rust;
 mod shell;
 mod sql;
-mod asciidoc;
+mod toml;
+mod xml;
+mod yaml;
 
-use crate::syntax::{Token, TokenKind};
+#[cfg(test)]
+mod tests;
+
+pub use interpolation::MAX_INTERPOLATION_DEPTH;
+pub use resume::{Checkpoint, ReportCheckpoint};
+pub(crate) use resume::{Checkpoints, CommentLines, Resumable};
+pub use sql::SqlDialect;
+
+use crate::syntax::grammar::ExportRules;
+use crate::syntax::{Token, TokenKind, TokenPayload};
 
 /// Supported programming languages.
 #[derive(Debug, Clone, Copy, PartialEq, Eq, Hash)]
@@ -40,6 +55,7 @@ pub enum Language {
     Cpp,
     CSharp,
     Go,
+    GoTemplate,
     Html,
     Css,
     Java,
@@ -50,29 +66,127 @@ pub enum Language {
 }
 
 impl Language {
+    /// All supported languages.
+    pub const ALL: &[Language] = &[
+        Language::PlainText,
+        Language::Json,
+        Language::Rust,
+        Language::Python,
+        Language::JavaScript,
+        Language::TypeScript,
+        Language::Markdown,
+        Language::Toml,
+        Language::Yaml,
+        Language::C,
+        Language::Cpp,
+        Language::CSharp,
+        Language::Go,
+        Language::GoTemplate,
+        Language::Html,
+        Language::Css,
+        Language::Java,
+        Language::Xml,
+        Language::Shell,
+        Language::Sql,
+        Language::AsciiDoc,
+    ];
+
     /// Try to detect the language from a file extension.
     pub fn from_extension(ext: &str) -> Self {
-        match ext.to_lowercase().as_str() {
-            "json" | "jsonc" => Language::Json,
-            "rs" => Language::Rust,
-            "py" | "pyw" | "pyi" => Language::Python,
-            "js" | "mjs" | "cjs" => Language::JavaScript,
-            "ts" | "mts" | "cts" => Language::TypeScript,
-            "md" | "markdown" => Language::Markdown,
-            "toml" => Language::Toml,
-            "yaml" | "yml" => Language::Yaml,
-            "c" | "h" => Language::C,
-            "cpp" | "cc" | "cxx" | "hpp" | "hxx" => Language::Cpp,
-            "cs" => Language::CSharp,
-            "go" => Language::Go,
-            "html" | "htm" => Language::Html,
-            "css" => Language::Css,
-            "java" => Language::Java,
-            "xml" | "svg" | "xhtml" | "xsd" | "wsdl" => Language::Xml,
-            "sh" | "bash" | "zsh" => Language::Shell,
-            "sql" => Language::Sql,
-            "adoc" | "asciidoc" | "asc" => Language::AsciiDoc,
-            _ => Language::PlainText,
+        let ext = ext.to_lowercase();
+        Language::ALL
+            .iter()
+            .copied()
+            .find(|l| l.extensions().contains(&ext.as_str()))
+            .unwrap_or(Language::PlainText)
+    }
+
+    /// Try to detect the language from its name or a common alias, as used by
+    /// Markdown code fences for instance. Falls back to [`Language::from_extension`].
+    pub fn from_name(name: &str) -> Self {
+        let name = name.to_lowercase();
+        Language::ALL
+            .iter()
+            .copied()
+            .find(|l| l.id() == name || l.aliases().contains(&name.as_str()))
+            .unwrap_or_else(|| Language::from_extension(&name))
+    }
+
+    /// Try to detect the language of a document without a file name, like text piped
+    /// into a command, from the interpreter of a `#!` line, a modeline, or markers like
+    /// `<?xml` or `package main`. See [`detect_language`](crate::syntax::detect_language),
+    /// which also goes by the file name and says how sure it is.
+    pub fn from_content(text: &[u8]) -> Self {
+        crate::syntax::detect_language("", text).language
+    }
+
+    /// Get the canonical, lowercase name of the language, e.g. for settings or `--lang`.
+    pub fn id(self) -> &'static str {
+        match self {
+            Language::PlainText => "plaintext",
+            Language::Json => "json",
+            Language::Rust => "rust",
+            Language::Python => "python",
+            Language::JavaScript => "javascript",
+            Language::TypeScript => "typescript",
+            Language::Markdown => "markdown",
+            Language::Toml => "toml",
+            Language::Yaml => "yaml",
+            Language::C => "c",
+            Language::Cpp => "cpp",
+            Language::CSharp => "csharp",
+            Language::Go => "go",
+            Language::GoTemplate => "gotemplate",
+            Language::Html => "html",
+            Language::Css => "css",
+            Language::Java => "java",
+            Language::Xml => "xml",
+            Language::Shell => "shell",
+            Language::Sql => "sql",
+            Language::AsciiDoc => "asciidoc",
+        }
+    }
+
+    /// Get the other names [`Language::from_name`] accepts, besides [`Language::id`]
+    /// and the extensions.
+    pub fn aliases(self) -> &'static [&'static str] {
+        match self {
+            Language::PlainText => &["text", "plain"],
+            Language::Python => &["python3"],
+            Language::JavaScript => &["node"],
+            Language::Cpp => &["c++"],
+            Language::CSharp => &["c#"],
+            Language::Go => &["golang"],
+            Language::GoTemplate => &["go-template", "gotmpl"],
+            Language::Shell => &["shellscript"],
+            _ => &[],
+        }
+    }
+
+    /// Get the lowercase file extensions of the language, without the dot.
+    pub fn extensions(self) -> &'static [&'static str] {
+        match self {
+            Language::PlainText => &["txt"],
+            Language::Json => &["json", "jsonc"],
+            Language::Rust => &["rs"],
+            Language::Python => &["py", "pyw", "pyi"],
+            Language::JavaScript => &["js", "mjs", "cjs"],
+            Language::TypeScript => &["ts", "mts", "cts"],
+            Language::Markdown => &["md", "markdown"],
+            Language::Toml => &["toml"],
+            Language::Yaml => &["yaml", "yml"],
+            Language::C => &["c", "h"],
+            Language::Cpp => &["cpp", "cc", "cxx", "hpp", "hxx"],
+            Language::CSharp => &["cs"],
+            Language::Go => &["go"],
+            Language::GoTemplate => &["gohtml", "tmpl", "gotmpl"],
+            Language::Html => &["html", "htm"],
+            Language::Css => &["css"],
+            Language::Java => &["java"],
+            Language::Xml => &["xml", "svg", "xhtml", "xsd", "wsdl"],
+            Language::Shell => &["sh", "bash", "zsh"],
+            Language::Sql => &["sql", "psql", "pgsql", "mysql", "tsql"],
+            Language::AsciiDoc => &["adoc", "asciidoc", "asc"],
         }
     }
 
@@ -92,6 +206,7 @@ impl Language {
             Language::Cpp => "C++",
             Language::CSharp => "C#",
             Language::Go => "Go",
+            Language::GoTemplate => "Go Template",
             Language::Html => "HTML",
             Language::Css => "CSS",
             Language::Java => "Java",
@@ -106,38 +221,149 @@ impl Language {
 /// A trait for language lexers.
 pub trait Lexer: Send + Sync {
     /// Tokenize the given text into a sequence of tokens.
+    ///
+    /// The tokens tile the text: they're in order, each starts where the one before ended,
+    /// and the last ends with the text. Whitespace and newlines are [`TokenKind::Whitespace`]
+    /// tokens rather than gaps, so the tokens' slices concatenate back to the text byte for
+    /// byte, whatever it is. The post-processing filters keep that by only splitting tokens.
     fn tokenize(&self, text: &[u8]) -> Vec<Token>;
+
+    /// Lex `text` again from `from`, the start of the text or one of the checkpoints reported
+    /// before, after `tokens`, the tokens before it. Each line start after it is reported to
+    /// `report`, until that returns true, which stops the lexer there. Returns false without
+    /// lexing anything if the lexer can't pick up lexing in the middle of the text, and
+    /// [`tokenize`](Self::tokenize) has to lex it as a whole.
+    ///
+    /// The tokens become the ones [`tokenize`](Self::tokenize) gives once they're passed to
+    /// [`finish`](Self::finish) with the whole text.
+    fn resume(
+        &self,
+        _text: &[u8],
+        _from: &Checkpoint,
+        _tokens: &mut Vec<Token>,
+        _report: &mut ReportCheckpoint,
+    ) -> bool {
+        false
+    }
+
+    /// Finish the tokens of the whole text that [`resume`](Self::resume) lexed.
+    fn finish(&self, _text: &[u8], _tokens: &mut Vec<Token>) {}
+
+    /// Whether [`finish`](Self::finish) needs all of the text, like to find the
+    /// declarations below doc comments, rather than only the lines of the tokens it changes.
+    fn needs_whole_text(&self) -> bool {
+        false
+    }
+
+    /// End block comments that are never closed after `lines` lines rather than
+    /// [`UNTERMINATED_COMMENT_LINES`]. Lexers without them ignore it.
+    fn set_unterminated_comment_lines(&mut self, _lines: usize) {}
+}
+
+/// The rules of the lexer for `language` that a TextMate grammar can express, if it has
+/// declared them, see [`export_grammar`](crate::syntax::export_grammar).
+pub(crate) fn export_rules(language: Language) -> Option<&'static ExportRules> {
+    match language {
+        Language::Go => Some(&go::EXPORT_RULES),
+        _ => None,
+    }
+}
+
+/// Boxes a lexer of a language with `/* */` comments, whose cap on the lines of those that
+/// are never closed can be changed, see [`Lexer::set_unterminated_comment_lines`].
+fn with_block_comments<R: Resumable + 'static>(lexer: R) -> Box<dyn Lexer> {
+    Box::new(normalize::Normalized(CommentLines::new(lexer)))
 }
 
 /// Registry for language lexers.
 pub struct LexerRegistry;
 
 impl LexerRegistry {
-    /// Get a lexer for the given language.
+    /// Get a lexer for the given language. Its lines end at `\r\n`, `\n` and lone `\r`
+    /// alike, and a `\r` is never part of the token before it.
     pub fn get_lexer(language: Language) -> Box<dyn Lexer> {
+        use normalize::Normalized;
+
         match language {
-            Language::Json => Box::new(json::JsonLexer),
-            Language::Rust => Box::new(rust::RustLexer),
-            Language::Python => Box::new(python::PythonLexer),
-            Language::Markdown => Box::new(markdown::MarkdownLexer),
-            Language::JavaScript => Box::new(javascript::JavaScriptLexer),
-            Language::TypeScript => Box::new(javascript::JavaScriptLexer), // Use same lexer
-            Language::Toml => Box::new(toml::TomlLexer),
-            Language::Yaml => Box::new(yaml::YamlLexer),
-            Language::C => Box::new(c::CLexer),
-            Language::Cpp => Box::new(cpp::CppLexer),
-            Language::CSharp => Box::new(csharp::CSharpLexer),
-            Language::Go => Box::new(go::GoLexer),
-            Language::Html => Box::new(html::HtmlLexer),
-            Language::Css => Box::new(css::CssLexer),
-            Language::Java => Box::new(java::JavaLexer),
-            Language::Xml => Box::new(xml::XmlLexer),
-            Language::Shell => Box::new(shell::ShellLexer),
-            Language::Sql => Box::new(sql::SqlLexer),
-            Language::AsciiDoc => Box::new(asciidoc::AsciiDocLexer),
+            Language::Json => with_block_comments(json::JsonLexer),
+            Language::Rust => Box::new(Normalized(rust::RustLexer)),
+            Language::Python => Box::new(Normalized(python::PythonLexer)),
+            Language::Markdown => Box::new(Normalized(markdown::MarkdownLexer)),
+            Language::JavaScript => with_block_comments(javascript::JavaScriptLexer),
+            Language::TypeScript => with_block_comments(javascript::JavaScriptLexer), // Use same lexer
+            Language::Toml => Box::new(Normalized(toml::TomlLexer)),
+            Language::Yaml => Box::new(Normalized(yaml::YamlLexer)),
+            Language::C => with_block_comments(c::CLexer),
+            Language::Cpp => with_block_comments(cpp::CppLexer),
+            Language::CSharp => with_block_comments(csharp::CSharpLexer),
+            Language::Go => with_block_comments(go::GoLexer::default()),
+            Language::GoTemplate => Box::new(Normalized(gotemplate::GoTemplateLexer)),
+            Language::Html => Box::new(Normalized(html::HtmlLexer)),
+            Language::Css => with_block_comments(css::CssLexer),
+            Language::Java => with_block_comments(java::JavaLexer),
+            Language::Xml => Box::new(Normalized(xml::XmlLexer)),
+            Language::Shell => Box::new(Normalized(shell::ShellLexer)),
+            Language::Sql => with_block_comments(sql::SqlLexer { dialect: None, hinted: true }),
+            Language::AsciiDoc => Box::new(Normalized(asciidoc::AsciiDocLexer)),
             Language::PlainText => Box::new(PlainTextLexer),
         }
     }
+
+    /// Get a lexer for SQL in the given dialect, unless the text names another one.
+    pub fn get_sql_lexer(dialect: SqlDialect) -> Box<dyn Lexer> {
+        with_block_comments(sql::SqlLexer { dialect: Some(dialect), hinted: true })
+    }
+
+    /// Get a lexer for SQL in the given dialect, whatever the text names, for the parts of
+    /// a file after its top.
+    pub(crate) fn get_pinned_sql_lexer(dialect: SqlDialect) -> Box<dyn Lexer> {
+        with_block_comments(sql::SqlLexer { dialect: Some(dialect), hinted: false })
+    }
+
+    /// Get the versions of `language` whose keywords or builtins differ, oldest first,
+    /// like `1.17` for Go before `any`. Empty if they're the same in every version.
+    pub fn versions(language: Language) -> &'static [&'static str] {
+        match language {
+            Language::Go => go::GoVersion::NAMES,
+            _ => &[],
+        }
+    }
+
+    /// Get a lexer for `version` of `language`, which may also lie between two of its
+    /// [`versions`](Self::versions), like Go's `1.20`. A version the lexer doesn't know
+    /// gets the latest one, with a warning saying so. Languages without versions ignore it.
+    pub fn get_versioned_lexer(
+        language: Language,
+        version: &str,
+    ) -> (Box<dyn Lexer>, Option<String>) {
+        match language {
+            Language::Go => Self::get_go_lexer(Some(version), MAX_NESTING_DEPTH),
+            _ => (Self::get_lexer(language), None),
+        }
+    }
+
+    /// Get a lexer for Go that keeps track of up to `max_nesting_depth` levels of brackets,
+    /// in `version` like [`get_versioned_lexer`](Self::get_versioned_lexer), or the latest.
+    pub fn get_go_lexer(
+        version: Option<&str>,
+        max_nesting_depth: usize,
+    ) -> (Box<dyn Lexer>, Option<String>) {
+        let (version, warning) = match version.map(|v| (v, go::GoVersion::from_name(v))) {
+            None => (go::GoVersion::default(), None),
+            Some((_, Some(version))) => (version, None),
+            Some((name, None)) => {
+                let versions = Self::versions(Language::Go);
+                let latest = versions.last().copied().unwrap_or_default();
+                let warning = format!(
+                    "unknown {} version '{name}', using {latest}, expected one like {}",
+                    Language::Go.name(),
+                    versions.join(" or "),
+                );
+                (go::GoVersion::default(), Some(warning))
+            }
+        };
+        (with_block_comments(go::GoLexer { version, max_nesting_depth }), warning)
+    }
 }
 
 /// A simple plain text lexer that doesn't do any highlighting.
@@ -187,3 +413,311 @@ pub(crate) fn is_ident_start(b: u8) -> bool {
 pub(crate) fn is_ident_continue(b: u8) -> bool {
     is_ascii_alphanumeric(b) || b == b'_'
 }
+
+/// Which non-ASCII characters a language allows in identifiers.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub(crate) enum UnicodeIdents {
+    /// Letters, and after the first character also digits, like Go's
+    /// `unicode.IsLetter` and `unicode.IsDigit`: the Unicode categories L and Nd.
+    /// Unlike [`char::is_alphabetic`], this leaves out combining marks like the vowel
+    /// signs of Devanagari, letter numbers like `Ⅻ` and symbols like `Ⓐ`.
+    Letters,
+    /// Like [`UnicodeIdents::Letters`], but combining marks and joiners may continue
+    /// an identifier, too. This approximates `XID_Start` and `XID_Continue`.
+    Xid,
+}
+
+impl UnicodeIdents {
+    /// Whether the non-ASCII `ch` can start an identifier.
+    fn starts(self, ch: char) -> bool {
+        ch.is_alphabetic() && (self == UnicodeIdents::Xid || !is_outside_letters(ch))
+    }
+
+    /// Whether the non-ASCII `ch` can continue an identifier.
+    fn continues(self, ch: char) -> bool {
+        match self {
+            UnicodeIdents::Letters => ch.is_alphanumeric() && !is_outside_letters(ch),
+            UnicodeIdents::Xid => {
+                ch.is_alphanumeric()
+                    || is_combining_mark(ch)
+                    || matches!(ch, '\u{200C}' | '\u{200D}')
+            }
+        }
+    }
+}
+
+/// Helper function to check if the non-ASCII character at `pos` can start an identifier.
+#[inline]
+pub(crate) fn is_unicode_ident_start(text: &[u8], pos: usize, rules: UnicodeIdents) -> bool {
+    decode(text, pos).is_some_and(|(ch, _)| rules.starts(ch))
+}
+
+/// Helper function to find the end of an identifier, continuing at `pos`.
+///
+/// ASCII bytes continue the identifier if `ascii` says so,
+/// so that scanning ASCII identifiers doesn't need to decode anything.
+#[inline]
+pub(crate) fn ident_end(
+    text: &[u8],
+    mut pos: usize,
+    rules: UnicodeIdents,
+    ascii: impl Fn(u8) -> bool,
+) -> usize {
+    while pos < text.len() {
+        let b = text[pos];
+        if b < 0x80 {
+            if !ascii(b) {
+                break;
+            }
+            pos += 1;
+            continue;
+        }
+        let Some((ch, len)) = decode(text, pos) else {
+            break;
+        };
+        if !rules.continues(ch) {
+            break;
+        }
+        pos += len;
+    }
+    pos
+}
+
+/// Helper function to get the length of the character at `pos`, so that tokens
+/// for unexpected characters don't split them. Invalid UTF-8 is skipped byte by byte.
+#[inline]
+pub(crate) fn char_len(text: &[u8], pos: usize) -> usize {
+    decode(text, pos).map_or(1, |(_, len)| len)
+}
+
+/// How deeply brackets may nest before lexers stop keeping track of each level. Brackets
+/// past it are only counted, so that a file of nothing but `{` takes memory for this
+/// many levels rather than one per bracket. Highlighting that depends on the levels, like
+/// telling blocks from composite literals in Go, is lost until the depth drops below it.
+/// It's the default of [`HighlightOptions::max_nesting_depth`].
+///
+/// [`HighlightOptions::max_nesting_depth`]: crate::syntax::HighlightOptions::max_nesting_depth
+pub const MAX_NESTING_DEPTH: usize = 256;
+
+/// How many lines a block comment that's never closed may span. Lexers end it there,
+/// flagged [`TokenPayload::Invalid`], and lex the rest of the document as if it had been
+/// closed, so that typing `/*` above some code doesn't turn all of it into a comment.
+/// It's the default of [`HighlightOptions::unterminated_comment_lines`].
+///
+/// [`HighlightOptions::unterminated_comment_lines`]: crate::syntax::HighlightOptions::unterminated_comment_lines
+pub const UNTERMINATED_COMMENT_LINES: usize = 1;
+
+/// Helper function to push the `/* */` comment starting at `pos`, returning its end.
+/// A comment without a `*/` ends before the newline of its `max_lines`th line, or at
+/// the end of the text. With 0 lines, it's only the `/*`.
+pub(crate) fn block_comment(
+    text: &[u8],
+    pos: usize,
+    max_lines: usize,
+    tokens: &mut Vec<Token>,
+) -> usize {
+    let body = pos + 2;
+    if let Some(i) = text[body..].windows(2).position(|w| w == b"*/") {
+        tokens.push(Token::new(TokenKind::Comment, pos..body + i + 2));
+        return body + i + 2;
+    }
+
+    let mut end = body;
+    for line in 1..=max_lines {
+        match text[end..].iter().position(|&b| b == b'\n') {
+            Some(i) if line < max_lines => end += i + 1,
+            Some(i) => end += i,
+            None => end = text.len(),
+        }
+    }
+    tokens.push(Token::new(TokenKind::Comment, pos..end).with_payload(TokenPayload::Invalid));
+    end
+}
+
+/// Helper function to walk back over the tokens lexed so far, from the last one, skipping
+/// trivia, for rules that go by what comes before, like whether a `/` divides.
+pub(crate) fn preceding(tokens: &[Token]) -> impl Iterator<Item = &Token> {
+    tokens.iter().rev().filter(|t| !t.kind.is_trivia())
+}
+
+/// Words longer than this are never keywords of case-insensitive languages, see [`fold_keyword`].
+const MAX_KEYWORD_LEN: usize = 32;
+
+/// A word folded for matching the keywords of case-insensitive languages, see
+/// [`fold_keyword`]. It's kept on the stack, so that folding every word of a file
+/// doesn't allocate, and derefs to the folded `str`.
+#[derive(Clone, Copy)]
+pub(crate) struct FoldedKeyword {
+    buf: [u8; MAX_KEYWORD_LEN],
+    len: usize,
+}
+
+impl std::ops::Deref for FoldedKeyword {
+    type Target = str;
+
+    fn deref(&self) -> &str {
+        // Only ASCII is ever folded.
+        str::from_utf8(&self.buf[..self.len]).unwrap_or_default()
+    }
+}
+
+impl std::fmt::Debug for FoldedKeyword {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        std::fmt::Debug::fmt(&**self, f)
+    }
+}
+
+impl PartialEq<&str> for FoldedKeyword {
+    fn eq(&self, other: &&str) -> bool {
+        **self == **other
+    }
+}
+
+/// Helper function to fold a word for matching the keywords of case-insensitive
+/// languages like SQL, all of which are ASCII, see
+/// [`GrammarMetadata::case_insensitive_keywords`](crate::syntax::GrammarMetadata::case_insensitive_keywords).
+///
+/// This only lowercases `A`..=`Z` and doesn't depend on the locale, so that e.g.
+/// `İF` never matches `if`. Non-ASCII words and words longer than any keyword can't be
+/// keywords and fold to an empty string.
+/// Names compared by the user's intent, like in [`occurrences`](crate::syntax::occurrences),
+/// use [`simple_fold_eq`] instead.
+pub(crate) fn fold_keyword(word: &[u8]) -> FoldedKeyword {
+    let mut folded = FoldedKeyword { buf: [0; MAX_KEYWORD_LEN], len: 0 };
+    if word.is_ascii() && word.len() <= MAX_KEYWORD_LEN {
+        folded.buf[..word.len()].copy_from_slice(word);
+        folded.buf[..word.len()].make_ascii_lowercase();
+        folded.len = word.len();
+    }
+    folded
+}
+
+/// Helper function to compare two words regardless of case, with Unicode simple
+/// case folding: `É` equals `é` and `Σ` equals `ς`, but mappings to several characters
+/// like `ß` to `ss` and the Turkish `İ` and `ı` don't apply. Invalid UTF-8 is compared as is.
+pub(crate) fn simple_fold_eq(a: &[u8], b: &[u8]) -> bool {
+    if a.is_ascii() && b.is_ascii() {
+        return a.eq_ignore_ascii_case(b);
+    }
+    match (str::from_utf8(a), str::from_utf8(b)) {
+        (Ok(a), Ok(b)) => a.chars().map(simple_fold).eq(b.chars().map(simple_fold)),
+        _ => a == b,
+    }
+}
+
+/// Approximates the simple case folding of `ch`, which is its lowercase form,
+/// unless that's more than one character.
+pub(crate) fn simple_fold(ch: char) -> char {
+    match ch {
+        'ſ' => 's',
+        'ς' => 'σ',
+        _ => {
+            let mut lower = ch.to_lowercase();
+            match (lower.next(), lower.next()) {
+                (Some(lower), None) => lower,
+                _ => ch,
+            }
+        }
+    }
+}
+
+/// Decodes the UTF-8 character at `pos`, if it's valid.
+pub(crate) fn decode(text: &[u8], pos: usize) -> Option<(char, usize)> {
+    let len = match text[pos] {
+        0xC2..=0xDF => 2,
+        0xE0..=0xEF => 3,
+        0xF0..=0xF4 => 4,
+        _ => return None,
+    };
+    let s = std::str::from_utf8(text.get(pos..pos + len)?).ok()?;
+    s.chars().next().map(|ch| (ch, len))
+}
+
+/// Returns true for the characters which [`char::is_alphabetic`] or [`char::is_numeric`]
+/// accept, but which are neither letters nor decimal digits, see [`UnicodeIdents::Letters`].
+fn is_outside_letters(ch: char) -> bool {
+    let ch = ch as u32;
+    NOT_LETTERS_OR_DIGITS
+        .binary_search_by(|&(first, last)| {
+            if last < ch {
+                std::cmp::Ordering::Less
+            } else if first > ch {
+                std::cmp::Ordering::Greater
+            } else {
+                std::cmp::Ordering::Equal
+            }
+        })
+        .is_ok()
+}
+
+/// The sorted ranges of [`is_outside_letters`]: the alphabetic or numeric characters outside
+/// of the categories L and Nd, as of Unicode 14. Characters assigned since then are taken
+/// to be what [`char::is_alphabetic`] says.
+#[rustfmt::skip]
+const NOT_LETTERS_OR_DIGITS: [(u32, u32); 312] = [
+    (0x00B2, 0x00B3), (0x00B9, 0x00B9), (0x00BC, 0x00BE), (0x0345, 0x0345), (0x0363, 0x036F), (0x05B0, 0x05BD),
+    (0x05BF, 0x05BF), (0x05C1, 0x05C2), (0x05C4, 0x05C5), (0x05C7, 0x05C7), (0x0610, 0x061A), (0x064B, 0x0657),
+    (0x0659, 0x065F), (0x0670, 0x0670), (0x06D6, 0x06DC), (0x06E1, 0x06E4), (0x06E7, 0x06E8), (0x06ED, 0x06ED),
+    (0x0711, 0x0711), (0x0730, 0x073F), (0x07A6, 0x07B0), (0x0816, 0x0817), (0x081B, 0x0823), (0x0825, 0x0827),
+    (0x0829, 0x082C), (0x08D4, 0x08DF), (0x08E3, 0x08E9), (0x08F0, 0x0903), (0x093A, 0x093B), (0x093E, 0x094C),
+    (0x094E, 0x094F), (0x0955, 0x0957), (0x0962, 0x0963), (0x0981, 0x0983), (0x09BE, 0x09C4), (0x09C7, 0x09C8),
+    (0x09CB, 0x09CC), (0x09D7, 0x09D7), (0x09E2, 0x09E3), (0x09F4, 0x09F9), (0x0A01, 0x0A03), (0x0A3E, 0x0A42),
+    (0x0A47, 0x0A48), (0x0A4B, 0x0A4C), (0x0A51, 0x0A51), (0x0A70, 0x0A71), (0x0A75, 0x0A75), (0x0A81, 0x0A83),
+    (0x0ABE, 0x0AC5), (0x0AC7, 0x0AC9), (0x0ACB, 0x0ACC), (0x0AE2, 0x0AE3), (0x0AFA, 0x0AFC), (0x0B01, 0x0B03),
+    (0x0B3E, 0x0B44), (0x0B47, 0x0B48), (0x0B4B, 0x0B4C), (0x0B56, 0x0B57), (0x0B62, 0x0B63), (0x0B72, 0x0B77),
+    (0x0B82, 0x0B82), (0x0BBE, 0x0BC2), (0x0BC6, 0x0BC8), (0x0BCA, 0x0BCC), (0x0BD7, 0x0BD7), (0x0BF0, 0x0BF2),
+    (0x0C00, 0x0C04), (0x0C3E, 0x0C44), (0x0C46, 0x0C48), (0x0C4A, 0x0C4C), (0x0C55, 0x0C56), (0x0C62, 0x0C63),
+    (0x0C78, 0x0C7E), (0x0C81, 0x0C83), (0x0CBE, 0x0CC4), (0x0CC6, 0x0CC8), (0x0CCA, 0x0CCC), (0x0CD5, 0x0CD6),
+    (0x0CE2, 0x0CE3), (0x0D00, 0x0D03), (0x0D3E, 0x0D44), (0x0D46, 0x0D48), (0x0D4A, 0x0D4C), (0x0D57, 0x0D5E),
+    (0x0D62, 0x0D63), (0x0D70, 0x0D78), (0x0D81, 0x0D83), (0x0DCF, 0x0DD4), (0x0DD6, 0x0DD6), (0x0DD8, 0x0DDF),
+    (0x0DF2, 0x0DF3), (0x0E31, 0x0E31), (0x0E34, 0x0E3A), (0x0E4D, 0x0E4D), (0x0EB1, 0x0EB1), (0x0EB4, 0x0EB9),
+    (0x0EBB, 0x0EBC), (0x0ECD, 0x0ECD), (0x0F2A, 0x0F33), (0x0F71, 0x0F83), (0x0F8D, 0x0F97), (0x0F99, 0x0FBC),
+    (0x102B, 0x1036), (0x1038, 0x1038), (0x103B, 0x103E), (0x1056, 0x1059), (0x105E, 0x1060), (0x1062, 0x1064),
+    (0x1067, 0x106D), (0x1071, 0x1074), (0x1082, 0x108D), (0x108F, 0x108F), (0x109A, 0x109D), (0x1369, 0x137C),
+    (0x16EE, 0x16F0), (0x1712, 0x1713), (0x1732, 0x1733), (0x1752, 0x1753), (0x1772, 0x1773), (0x17B6, 0x17C8),
+    (0x17F0, 0x17F9), (0x1885, 0x1886), (0x18A9, 0x18A9), (0x1920, 0x192B), (0x1930, 0x1938), (0x19DA, 0x19DA),
+    (0x1A17, 0x1A1B), (0x1A55, 0x1A5E), (0x1A61, 0x1A74), (0x1ABF, 0x1AC0), (0x1ACC, 0x1ACE), (0x1B00, 0x1B04),
+    (0x1B35, 0x1B43), (0x1B80, 0x1B82), (0x1BA1, 0x1BA9), (0x1BAC, 0x1BAD), (0x1BE7, 0x1BF1), (0x1C24, 0x1C36),
+    (0x1DD3, 0x1DF4), (0x2070, 0x2070), (0x2074, 0x2079), (0x2080, 0x2089), (0x2150, 0x2182), (0x2185, 0x2189),
+    (0x2460, 0x249B), (0x24B6, 0x24FF), (0x2776, 0x2793), (0x2CFD, 0x2CFD), (0x2DE0, 0x2DFF), (0x3007, 0x3007),
+    (0x3021, 0x3029), (0x3038, 0x303A), (0x3192, 0x3195), (0x3220, 0x3229), (0x3248, 0x324F), (0x3251, 0x325F),
+    (0x3280, 0x3289), (0x32B1, 0x32BF), (0xA674, 0xA67B), (0xA69E, 0xA69F), (0xA6E6, 0xA6EF), (0xA802, 0xA802),
+    (0xA80B, 0xA80B), (0xA823, 0xA827), (0xA830, 0xA835), (0xA880, 0xA881), (0xA8B4, 0xA8C3), (0xA8C5, 0xA8C5),
+    (0xA8FF, 0xA8FF), (0xA926, 0xA92A), (0xA947, 0xA952), (0xA980, 0xA983), (0xA9B4, 0xA9BF), (0xA9E5, 0xA9E5),
+    (0xAA29, 0xAA36), (0xAA43, 0xAA43), (0xAA4C, 0xAA4D), (0xAA7B, 0xAA7D), (0xAAB0, 0xAAB0), (0xAAB2, 0xAAB4),
+    (0xAAB7, 0xAAB8), (0xAABE, 0xAABE), (0xAAEB, 0xAAEF), (0xAAF5, 0xAAF5), (0xABE3, 0xABEA), (0xFB1E, 0xFB1E),
+    (0x10107, 0x10133), (0x10140, 0x10178), (0x1018A, 0x1018B), (0x102E1, 0x102FB), (0x10320, 0x10323), (0x10341, 0x10341),
+    (0x1034A, 0x1034A), (0x10376, 0x1037A), (0x103D1, 0x103D5), (0x10858, 0x1085F), (0x10879, 0x1087F), (0x108A7, 0x108AF),
+    (0x108FB, 0x108FF), (0x10916, 0x1091B), (0x109BC, 0x109BD), (0x109C0, 0x109CF), (0x109D2, 0x109FF), (0x10A01, 0x10A03),
+    (0x10A05, 0x10A06), (0x10A0C, 0x10A0F), (0x10A40, 0x10A48), (0x10A7D, 0x10A7E), (0x10A9D, 0x10A9F), (0x10AEB, 0x10AEF),
+    (0x10B58, 0x10B5F), (0x10B78, 0x10B7F), (0x10BA9, 0x10BAF), (0x10CFA, 0x10CFF), (0x10D24, 0x10D27), (0x10E60, 0x10E7E),
+    (0x10EAB, 0x10EAC), (0x10F1D, 0x10F26), (0x10F51, 0x10F54), (0x10FC5, 0x10FCB), (0x11000, 0x11002), (0x11038, 0x11045),
+    (0x11052, 0x11065), (0x11073, 0x11074), (0x11080, 0x11082), (0x110B0, 0x110B8), (0x110C2, 0x110C2), (0x11100, 0x11102),
+    (0x11127, 0x11132), (0x11145, 0x11146), (0x11180, 0x11182), (0x111B3, 0x111BF), (0x111CE, 0x111CF), (0x111E1, 0x111F4),
+    (0x1122C, 0x11234), (0x11237, 0x11237), (0x1123E, 0x1123E), (0x112DF, 0x112E8), (0x11300, 0x11303), (0x1133E, 0x11344),
+    (0x11347, 0x11348), (0x1134B, 0x1134C), (0x11357, 0x11357), (0x11362, 0x11363), (0x11435, 0x11441), (0x11443, 0x11445),
+    (0x114B0, 0x114C1), (0x115AF, 0x115B5), (0x115B8, 0x115BE), (0x115DC, 0x115DD), (0x11630, 0x1163E), (0x11640, 0x11640),
+    (0x116AB, 0x116B5), (0x1171D, 0x1172A), (0x1173A, 0x1173B), (0x1182C, 0x11838), (0x118EA, 0x118F2), (0x11930, 0x11935),
+    (0x11937, 0x11938), (0x1193B, 0x1193C), (0x11940, 0x11940), (0x11942, 0x11942), (0x119D1, 0x119D7), (0x119DA, 0x119DF),
+    (0x119E4, 0x119E4), (0x11A01, 0x11A0A), (0x11A35, 0x11A39), (0x11A3B, 0x11A3E), (0x11A51, 0x11A5B), (0x11A8A, 0x11A97),
+    (0x11C2F, 0x11C36), (0x11C38, 0x11C3E), (0x11C5A, 0x11C6C), (0x11C92, 0x11CA7), (0x11CA9, 0x11CB6), (0x11D31, 0x11D36),
+    (0x11D3A, 0x11D3A), (0x11D3C, 0x11D3D), (0x11D3F, 0x11D41), (0x11D43, 0x11D43), (0x11D47, 0x11D47), (0x11D8A, 0x11D8E),
+    (0x11D90, 0x11D91), (0x11D93, 0x11D96), (0x11EF3, 0x11EF6), (0x11FC0, 0x11FD4), (0x12400, 0x1246E), (0x16B5B, 0x16B61),
+    (0x16E80, 0x16E96), (0x16F4F, 0x16F4F), (0x16F51, 0x16F87), (0x16F8F, 0x16F92), (0x16FF0, 0x16FF1), (0x1BC9E, 0x1BC9E),
+    (0x1D2E0, 0x1D2F3), (0x1D360, 0x1D378), (0x1E000, 0x1E006), (0x1E008, 0x1E018), (0x1E01B, 0x1E021), (0x1E023, 0x1E024),
+    (0x1E026, 0x1E02A), (0x1E8C7, 0x1E8CF), (0x1E947, 0x1E947), (0x1EC71, 0x1ECAB), (0x1ECAD, 0x1ECAF), (0x1ECB1, 0x1ECB4),
+    (0x1ED01, 0x1ED2D), (0x1ED2F, 0x1ED3D), (0x1F100, 0x1F10C), (0x1F130, 0x1F149), (0x1F150, 0x1F169), (0x1F170, 0x1F189),
+];
+
+/// Returns true for the combining marks which aren't letters themselves, like U+0301
+/// COMBINING ACUTE ACCENT. Marks of scripts like Devanagari are alphabetic already.
+fn is_combining_mark(ch: char) -> bool {
+    matches!(
+        ch,
+        '\u{0300}'..='\u{036F}'
+            | '\u{1AB0}'..='\u{1AFF}'
+            | '\u{1DC0}'..='\u{1DFF}'
+            | '\u{20D0}'..='\u{20FF}'
+            | '\u{FE20}'..='\u{FE2F}'
+    )
+}
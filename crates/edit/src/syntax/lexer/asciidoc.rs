@@ -3,22 +3,41 @@
 
 //! High-performance AsciiDoc lexer with full language support.
 
-use crate::syntax::lexer::{Lexer, is_whitespace, is_ident_continue, is_ascii_digit};
+use crate::syntax::lexer::{
+    Checkpoints, Resumable, char_len, is_ascii_digit, is_ident_continue, is_whitespace,
+};
 use crate::syntax::{Token, TokenKind};
 
 pub struct AsciiDocLexer;
 
-impl Lexer for AsciiDocLexer {
-    fn tokenize(&self, text: &[u8]) -> Vec<Token> {
-        let mut tokens = Vec::with_capacity(text.len() / 8);
-        let mut pos = 0;
+impl Resumable for AsciiDocLexer {
+    type State = ();
+
+    fn lex(
+        &self,
+        text: &[u8],
+        mut pos: usize,
+        _: (),
+        tokens: &mut Vec<Token>,
+        checkpoints: &mut Checkpoints<()>,
+    ) {
         let mut line_start = true;
+        // Where the search for the `}` of the last unclosed `{` gave up. The `{`s before
+        // it have none either, and a line full of them mustn't be searched for each.
+        let mut unclosed_until = pos;
 
         while pos < text.len() {
+            if line_start
+                && checkpoints.due(text, tokens, pos)
+                && checkpoints.report(text, pos, tokens, 0, ())
+            {
+                return;
+            }
             let start = pos;
             let b = text[pos];
 
-            // Check for line-start constructs (headings, lists, blocks)
+            // Check for line-start constructs (headings, lists, blocks). Those that take up
+            // the whole line end before its newline, which the newline arm below takes.
             if line_start {
                 // Document title (= Title)
                 if b == b'=' {
@@ -35,10 +54,7 @@ impl Lexer for AsciiDocLexer {
                         pos += 1;
                     }
                     tokens.push(Token::new(TokenKind::Keyword, heading_start..pos));
-                    line_start = text.get(pos) == Some(&b'\n');
-                    if line_start {
-                        pos += 1;
-                    }
+                    line_start = false;
                     continue;
                 }
 
@@ -52,15 +68,14 @@ impl Lexer for AsciiDocLexer {
                         pos += 1;
                     }
                     // Block delimiters are 4+ repeated characters
-                    if count >= 4 && (pos >= text.len() || text[pos] == b'\n' || is_whitespace(text[pos])) {
+                    if count >= 4
+                        && (pos >= text.len() || text[pos] == b'\n' || is_whitespace(text[pos]))
+                    {
                         while pos < text.len() && text[pos] != b'\n' {
                             pos += 1;
                         }
                         tokens.push(Token::new(TokenKind::Operator, delimiter_start..pos));
-                        line_start = text.get(pos) == Some(&b'\n');
-                        if line_start {
-                            pos += 1;
-                        }
+                        line_start = false;
                         continue;
                     } else {
                         // Not a block delimiter, reset
@@ -83,10 +98,7 @@ impl Lexer for AsciiDocLexer {
                             pos += 1;
                         }
                         tokens.push(Token::new(TokenKind::Attribute, attr_start..pos));
-                        line_start = text.get(pos) == Some(&b'\n');
-                        if line_start {
-                            pos += 1;
-                        }
+                        line_start = false;
                         continue;
                     } else {
                         pos = start;
@@ -94,21 +106,25 @@ impl Lexer for AsciiDocLexer {
                 }
 
                 // Block title (.Title)
-                if b == b'.' && pos + 1 < text.len() && !is_ascii_digit(text[pos + 1]) && text[pos + 1] != b' ' {
+                if b == b'.'
+                    && pos + 1 < text.len()
+                    && !is_ascii_digit(text[pos + 1])
+                    && text[pos + 1] != b' '
+                {
                     pos += 1;
                     while pos < text.len() && text[pos] != b'\n' {
                         pos += 1;
                     }
                     tokens.push(Token::new(TokenKind::PropertyName, start..pos));
-                    line_start = text.get(pos) == Some(&b'\n');
-                    if line_start {
-                        pos += 1;
-                    }
+                    line_start = false;
                     continue;
                 }
 
                 // Unordered list (* or **)
-                if b == b'*' && pos + 1 < text.len() && (text[pos + 1] == b' ' || text[pos + 1] == b'*') {
+                if b == b'*'
+                    && pos + 1 < text.len()
+                    && (text[pos + 1] == b' ' || text[pos + 1] == b'*')
+                {
                     while pos < text.len() && text[pos] == b'*' {
                         pos += 1;
                     }
@@ -118,7 +134,10 @@ impl Lexer for AsciiDocLexer {
                 }
 
                 // Ordered list (. or ..)
-                if b == b'.' && pos + 1 < text.len() && (text[pos + 1] == b' ' || text[pos + 1] == b'.') {
+                if b == b'.'
+                    && pos + 1 < text.len()
+                    && (text[pos + 1] == b' ' || text[pos + 1] == b'.')
+                {
                     let list_start = pos;
                     while pos < text.len() && text[pos] == b'.' {
                         pos += 1;
@@ -133,16 +152,16 @@ impl Lexer for AsciiDocLexer {
                 }
 
                 // Line comment (//)
-                if b == b'/' && pos + 1 < text.len() && text[pos + 1] == b'/' && 
-                   (pos + 2 >= text.len() || text[pos + 2] != b'/') {
+                if b == b'/'
+                    && pos + 1 < text.len()
+                    && text[pos + 1] == b'/'
+                    && (pos + 2 >= text.len() || text[pos + 2] != b'/')
+                {
                     while pos < text.len() && text[pos] != b'\n' {
                         pos += 1;
                     }
                     tokens.push(Token::new(TokenKind::Comment, start..pos));
-                    line_start = text.get(pos) == Some(&b'\n');
-                    if line_start {
-                        pos += 1;
-                    }
+                    line_start = false;
                     continue;
                 }
 
@@ -170,13 +189,13 @@ impl Lexer for AsciiDocLexer {
                     // Check for constrained or unconstrained formatting
                     let format_char = b;
                     let is_double = pos + 1 < text.len() && text[pos + 1] == format_char;
-                    
+
                     if is_double {
                         pos += 2;
                     } else {
                         pos += 1;
                     }
-                    
+
                     // Find matching delimiter
                     let mut found_end = false;
                     while pos < text.len() {
@@ -198,16 +217,17 @@ impl Lexer for AsciiDocLexer {
                         }
                         pos += 1;
                     }
-                    
+
                     tokens.push(Token::new(
                         if found_end { TokenKind::String } else { TokenKind::Identifier },
-                        start..pos
+                        start..pos,
                     ));
                 }
 
                 // Link syntax (https://example.com or link:url[text])
-                b'h' if pos + 7 < text.len() && &text[pos..pos + 7] == b"http://" ||
-                        pos + 8 < text.len() && &text[pos..pos + 8] == b"https://" => {
+                b'h' if pos + 7 < text.len() && &text[pos..pos + 7] == b"http://"
+                    || pos + 8 < text.len() && &text[pos..pos + 8] == b"https://" =>
+                {
                     while pos < text.len() && !is_whitespace(text[pos]) && text[pos] != b'[' {
                         pos += 1;
                     }
@@ -230,7 +250,7 @@ impl Lexer for AsciiDocLexer {
                     while pos < text.len() && (is_ident_continue(text[pos]) || text[pos] == b'-') {
                         pos += 1;
                     }
-                    
+
                     // Check for :: (macro syntax)
                     if pos + 1 < text.len() && text[pos] == b':' && text[pos + 1] == b':' {
                         pos += 2;
@@ -261,6 +281,7 @@ impl Lexer for AsciiDocLexer {
                 b'{' => {
                     pos += 1;
                     let attr_ref_start = pos;
+                    pos = pos.max(unclosed_until);
                     while pos < text.len() && text[pos] != b'}' && text[pos] != b'\n' {
                         pos += 1;
                     }
@@ -268,18 +289,19 @@ impl Lexer for AsciiDocLexer {
                         pos += 1;
                         tokens.push(Token::new(TokenKind::VariableName, start..pos));
                     } else {
-                        tokens.push(Token::new(TokenKind::Identifier, start..attr_ref_start));
+                        // Not a reference, so what's after the `{` is lexed as usual.
+                        unclosed_until = pos;
+                        pos = attr_ref_start;
+                        tokens.push(Token::new(TokenKind::Identifier, start..pos));
                     }
                 }
 
                 // Everything else
                 _ => {
-                    pos += 1;
+                    pos += char_len(text, pos);
                     tokens.push(Token::new(TokenKind::Identifier, start..pos));
                 }
             }
         }
-
-        tokens
     }
 }
@@ -3,17 +3,38 @@
 
 //! High-performance C lexer with full language support.
 
-use crate::syntax::lexer::{Lexer, is_whitespace, is_ident_start, is_ident_continue, is_ascii_digit};
+use crate::syntax::lexer::preprocessor::{
+    Directive, ends_directive, is_continuation, starts_directive,
+};
+use crate::syntax::lexer::{
+    Checkpoints, Resumable, UnicodeIdents, char_len, ident_end, is_ascii_digit, is_ident_continue,
+    is_ident_start, is_unicode_ident_start, is_whitespace,
+};
 use crate::syntax::{Token, TokenKind};
 
 pub struct CLexer;
 
-impl Lexer for CLexer {
-    fn tokenize(&self, text: &[u8]) -> Vec<Token> {
-        let mut tokens = Vec::with_capacity(text.len() / 8);
-        let mut pos = 0;
+impl Resumable for CLexer {
+    type State = ();
+
+    fn lex(
+        &self,
+        text: &[u8],
+        mut pos: usize,
+        _: (),
+        tokens: &mut Vec<Token>,
+        checkpoints: &mut Checkpoints<()>,
+    ) {
+        // The preprocessor directive the lexer is in, until its logical line ends.
+        let mut directive: Option<Directive> = None;
 
         while pos < text.len() {
+            if directive.is_none()
+                && checkpoints.due(text, tokens, pos)
+                && checkpoints.report(text, pos, tokens, 0, ())
+            {
+                return;
+            }
             let start = pos;
             let b = text[pos];
 
@@ -24,6 +45,9 @@ impl Lexer for CLexer {
                         pos += 1;
                     }
                     tokens.push(Token::new(TokenKind::Whitespace, start..pos));
+                    if directive.is_some() && ends_directive(text, start..pos) {
+                        directive = None;
+                    }
                 }
 
                 // Line comment
@@ -37,35 +61,26 @@ impl Lexer for CLexer {
 
                 // Block comment
                 b'/' if pos + 1 < text.len() && text[pos + 1] == b'*' => {
-                    pos += 2;
-                    while pos + 1 < text.len() {
-                        if text[pos] == b'*' && text[pos + 1] == b'/' {
-                            pos += 2;
-                            break;
-                        }
-                        pos += 1;
-                    }
-                    tokens.push(Token::new(TokenKind::Comment, start..pos));
+                    pos = checkpoints.block_comment(text, start, tokens);
                 }
 
-                // Preprocessor directive
-                b'#' => {
-                    pos += 1;
-                    while pos < text.len() && is_whitespace(text[pos]) {
-                        pos += 1;
+                // Preprocessor directive, or `#` and `##` inside of one
+                b'#' => match &directive {
+                    Some(directive) => pos = directive.hash(text, pos, tokens),
+                    None if starts_directive(text, pos) => {
+                        let (lexed, body) = Directive::lex(text, pos, tokens);
+                        directive = Some(lexed);
+                        pos = body;
                     }
-                    while pos < text.len() && (is_ident_continue(text[pos]) || text[pos] == b'_') {
-                        pos += 1;
-                    }
-                    // Continue to end of logical line (handles line continuation with \)
-                    while pos < text.len() {
-                        if text[pos] == b'\n' {
-                            if pos > 0 && text[pos - 1] != b'\\' {
-                                break;
-                            }
-                        }
+                    None => {
                         pos += 1;
+                        tokens.push(Token::new(TokenKind::Error, start..pos));
                     }
+                },
+
+                // Line continuation in a directive
+                b'\\' if directive.is_some() && is_continuation(text, pos) => {
+                    pos += 1;
                     tokens.push(Token::new(TokenKind::Macro, start..pos));
                 }
 
@@ -108,23 +123,39 @@ impl Lexer for CLexer {
                 // Number
                 b'0'..=b'9' => {
                     // Hex literal
-                    if b == b'0' && pos + 1 < text.len() && (text[pos + 1] == b'x' || text[pos + 1] == b'X') {
+                    if b == b'0'
+                        && pos + 1 < text.len()
+                        && (text[pos + 1] == b'x' || text[pos + 1] == b'X')
+                    {
                         pos += 2;
-                        while pos < text.len() && (is_ascii_digit(text[pos]) || matches!(text[pos], b'a'..=b'f' | b'A'..=b'F' | b'_')) {
+                        while pos < text.len()
+                            && (is_ascii_digit(text[pos])
+                                || matches!(text[pos], b'a'..=b'f' | b'A'..=b'F' | b'_'))
+                        {
                             pos += 1;
                         }
                     }
                     // Octal literal
-                    else if b == b'0' && pos + 1 < text.len() && matches!(text[pos + 1], b'0'..=b'7') {
+                    else if b == b'0'
+                        && pos + 1 < text.len()
+                        && matches!(text[pos + 1], b'0'..=b'7')
+                    {
                         pos += 1;
-                        while pos < text.len() && (matches!(text[pos], b'0'..=b'7') || text[pos] == b'_') {
+                        while pos < text.len()
+                            && (matches!(text[pos], b'0'..=b'7') || text[pos] == b'_')
+                        {
                             pos += 1;
                         }
                     }
                     // Binary literal (C23)
-                    else if b == b'0' && pos + 1 < text.len() && (text[pos + 1] == b'b' || text[pos + 1] == b'B') {
+                    else if b == b'0'
+                        && pos + 1 < text.len()
+                        && (text[pos + 1] == b'b' || text[pos + 1] == b'B')
+                    {
                         pos += 2;
-                        while pos < text.len() && (text[pos] == b'0' || text[pos] == b'1' || text[pos] == b'_') {
+                        while pos < text.len()
+                            && (text[pos] == b'0' || text[pos] == b'1' || text[pos] == b'_')
+                        {
                             pos += 1;
                         }
                     }
@@ -136,7 +167,9 @@ impl Lexer for CLexer {
                         // Float
                         if pos < text.len() && text[pos] == b'.' {
                             pos += 1;
-                            while pos < text.len() && (is_ascii_digit(text[pos]) || text[pos] == b'_') {
+                            while pos < text.len()
+                                && (is_ascii_digit(text[pos]) || text[pos] == b'_')
+                            {
                                 pos += 1;
                             }
                         }
@@ -152,61 +185,80 @@ impl Lexer for CLexer {
                         }
                     }
                     // Suffix (f, F, l, L, u, U, ll, LL, ul, UL, etc.)
-                    while pos < text.len() && matches!(text[pos], b'f' | b'F' | b'l' | b'L' | b'u' | b'U') {
+                    while pos < text.len()
+                        && matches!(text[pos], b'f' | b'F' | b'l' | b'L' | b'u' | b'U')
+                    {
                         pos += 1;
                     }
                     tokens.push(Token::new(TokenKind::Number, start..pos));
                 }
 
                 // Identifier or keyword
-                _ if is_ident_start(b) => {
-                    while pos < text.len() && (is_ident_continue(text[pos]) || text[pos] == b'_') {
-                        pos += 1;
-                    }
+                _ if is_ident_start(b) || is_unicode_ident_start(text, pos, UnicodeIdents::Xid) => {
+                    pos = ident_end(text, pos, UnicodeIdents::Xid, is_ident_continue);
                     let word = &text[start..pos];
                     let kind = match word {
                         // C keywords
-                        b"auto" | b"break" | b"case" | b"char" | b"const" | b"continue" |
-                        b"default" | b"do" | b"double" | b"else" | b"enum" | b"extern" |
-                        b"float" | b"for" | b"goto" | b"if" | b"inline" | b"int" | b"long" |
-                        b"register" | b"restrict" | b"return" | b"short" | b"signed" |
-                        b"sizeof" | b"static" | b"struct" | b"switch" | b"typedef" |
-                        b"union" | b"unsigned" | b"void" | b"volatile" | b"while" |
-                        b"_Alignas" | b"_Alignof" | b"_Atomic" | b"_Bool" | b"_Complex" |
-                        b"_Generic" | b"_Imaginary" | b"_Noreturn" | b"_Static_assert" |
-                        b"_Thread_local" => TokenKind::Keyword,
-                        
+                        b"auto" | b"break" | b"case" | b"char" | b"const" | b"continue"
+                        | b"default" | b"do" | b"double" | b"else" | b"enum" | b"extern"
+                        | b"float" | b"for" | b"goto" | b"if" | b"inline" | b"int" | b"long"
+                        | b"register" | b"restrict" | b"return" | b"short" | b"signed"
+                        | b"sizeof" | b"static" | b"struct" | b"switch" | b"typedef" | b"union"
+                        | b"unsigned" | b"void" | b"volatile" | b"while" | b"_Alignas"
+                        | b"_Alignof" | b"_Atomic" | b"_Bool" | b"_Complex" | b"_Generic"
+                        | b"_Imaginary" | b"_Noreturn" | b"_Static_assert" | b"_Thread_local" => {
+                            TokenKind::Keyword
+                        }
+
                         // C23 keywords
-                        b"_BitInt" | b"typeof" | b"typeof_unqual" |
-                        b"_Decimal128" | b"_Decimal32" | b"_Decimal64" => TokenKind::Keyword,
-                        
+                        b"_BitInt" | b"typeof" | b"typeof_unqual" | b"_Decimal128"
+                        | b"_Decimal32" | b"_Decimal64" => TokenKind::Keyword,
+
                         // Common constants
                         b"NULL" | b"true" | b"false" | b"TRUE" | b"FALSE" => TokenKind::Boolean,
-                        
+
                         // Type names (common standard types)
-                        b"size_t" | b"ssize_t" | b"ptrdiff_t" | b"intptr_t" | b"uintptr_t" |
-                        b"int8_t" | b"int16_t" | b"int32_t" | b"int64_t" |
-                        b"uint8_t" | b"uint16_t" | b"uint32_t" | b"uint64_t" |
-                        b"FILE" | b"DIR" | b"time_t" | b"clock_t" | b"pid_t" => TokenKind::TypeName,
-                        
+                        b"size_t" | b"ssize_t" | b"ptrdiff_t" | b"intptr_t" | b"uintptr_t"
+                        | b"int8_t" | b"int16_t" | b"int32_t" | b"int64_t" | b"uint8_t"
+                        | b"uint16_t" | b"uint32_t" | b"uint64_t" | b"FILE" | b"DIR"
+                        | b"time_t" | b"clock_t" | b"pid_t" => TokenKind::TypeName,
+
                         _ => TokenKind::Identifier,
                     };
+                    let kind = match &directive {
+                        Some(directive) => directive.identifier_kind(text, word, kind),
+                        None => kind,
+                    };
                     tokens.push(Token::new(kind, start..pos));
                 }
 
                 // Operators and punctuation
-                b'+' | b'-' | b'*' | b'/' | b'%' | b'=' | b'!' | b'<' | b'>' |
-                b'&' | b'|' | b'^' | b'~' | b'?' | b':' | b'.' | b',' | b';' |
-                b'(' | b')' | b'{' | b'}' | b'[' | b']' => {
+                b'+' | b'-' | b'*' | b'/' | b'%' | b'=' | b'!' | b'<' | b'>' | b'&' | b'|'
+                | b'^' | b'~' | b'?' | b':' | b'.' | b',' | b';' | b'(' | b')' | b'{' | b'}'
+                | b'[' | b']' => {
                     pos += 1;
                     // Handle multi-character operators
                     if pos < text.len() {
                         match (b, text[pos]) {
-                            (b'+', b'+') | (b'-', b'-') | (b'+', b'=') | (b'-', b'=') |
-                            (b'*', b'=') | (b'/', b'=') | (b'%', b'=') | (b'=', b'=') |
-                            (b'!', b'=') | (b'<', b'<') | (b'>', b'>') | (b'<', b'=') |
-                            (b'>', b'=') | (b'&', b'&') | (b'|', b'|') | (b'&', b'=') |
-                            (b'|', b'=') | (b'^', b'=') | (b'-', b'>') => {
+                            (b'+', b'+')
+                            | (b'-', b'-')
+                            | (b'+', b'=')
+                            | (b'-', b'=')
+                            | (b'*', b'=')
+                            | (b'/', b'=')
+                            | (b'%', b'=')
+                            | (b'=', b'=')
+                            | (b'!', b'=')
+                            | (b'<', b'<')
+                            | (b'>', b'>')
+                            | (b'<', b'=')
+                            | (b'>', b'=')
+                            | (b'&', b'&')
+                            | (b'|', b'|')
+                            | (b'&', b'=')
+                            | (b'|', b'=')
+                            | (b'^', b'=')
+                            | (b'-', b'>') => {
                                 pos += 1;
                                 // Handle three-character operators
                                 if pos < text.len() {
@@ -226,12 +278,10 @@ impl Lexer for CLexer {
 
                 // Unknown character
                 _ => {
-                    pos += 1;
+                    pos += char_len(text, pos);
                     tokens.push(Token::new(TokenKind::Error, start..pos));
                 }
             }
         }
-
-        tokens
     }
 }
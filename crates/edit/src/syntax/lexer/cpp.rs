@@ -3,17 +3,46 @@
 
 //! High-performance C++ lexer with full language support.
 
-use crate::syntax::lexer::{Lexer, is_whitespace, is_ident_start, is_ident_continue, is_ascii_digit};
+use crate::syntax::lexer::preprocessor::{
+    Directive, ends_directive, is_continuation, starts_directive,
+};
+use crate::syntax::lexer::{
+    Checkpoints, Resumable, UnicodeIdents, char_len, ident_end, is_ascii_digit, is_ident_continue,
+    is_ident_start, is_unicode_ident_start, is_whitespace,
+};
 use crate::syntax::{Token, TokenKind};
 
 pub struct CppLexer;
 
-impl Lexer for CppLexer {
-    fn tokenize(&self, text: &[u8]) -> Vec<Token> {
-        let mut tokens = Vec::with_capacity(text.len() / 8);
-        let mut pos = 0;
+/// Returns the length of the delimiter of a raw string, given the text after its `R"`.
+/// Delimiters are at most 16 characters, without spaces, parentheses and backslashes.
+fn raw_delimiter_len(text: &[u8]) -> Option<usize> {
+    let len = text.iter().take(17).position(|&b| b == b'(')?;
+    let invalid = |b: &u8| matches!(b, b' ' | b'\t' | b'\n' | b')' | b'\\' | b'"');
+    (!text[..len].iter().any(invalid)).then_some(len)
+}
+
+impl Resumable for CppLexer {
+    type State = ();
+
+    fn lex(
+        &self,
+        text: &[u8],
+        mut pos: usize,
+        _: (),
+        tokens: &mut Vec<Token>,
+        checkpoints: &mut Checkpoints<()>,
+    ) {
+        // The preprocessor directive the lexer is in, until its logical line ends.
+        let mut directive: Option<Directive> = None;
 
         while pos < text.len() {
+            if directive.is_none()
+                && checkpoints.due(text, tokens, pos)
+                && checkpoints.report(text, pos, tokens, 0, ())
+            {
+                return;
+            }
             let start = pos;
             let b = text[pos];
 
@@ -24,6 +53,9 @@ impl Lexer for CppLexer {
                         pos += 1;
                     }
                     tokens.push(Token::new(TokenKind::Whitespace, start..pos));
+                    if directive.is_some() && ends_directive(text, start..pos) {
+                        directive = None;
+                    }
                 }
 
                 // Line comment
@@ -37,68 +69,46 @@ impl Lexer for CppLexer {
 
                 // Block comment
                 b'/' if pos + 1 < text.len() && text[pos + 1] == b'*' => {
-                    pos += 2;
-                    while pos + 1 < text.len() {
-                        if text[pos] == b'*' && text[pos + 1] == b'/' {
-                            pos += 2;
-                            break;
-                        }
-                        pos += 1;
-                    }
-                    tokens.push(Token::new(TokenKind::Comment, start..pos));
+                    pos = checkpoints.block_comment(text, start, tokens);
                 }
 
-                // Preprocessor directive
-                b'#' => {
-                    pos += 1;
-                    while pos < text.len() && is_whitespace(text[pos]) {
-                        pos += 1;
-                    }
-                    while pos < text.len() && (is_ident_continue(text[pos]) || text[pos] == b'_') {
-                        pos += 1;
+                // Preprocessor directive, or `#` and `##` inside of one
+                b'#' => match &directive {
+                    Some(directive) => pos = directive.hash(text, pos, tokens),
+                    None if starts_directive(text, pos) => {
+                        let (lexed, body) = Directive::lex(text, pos, tokens);
+                        directive = Some(lexed);
+                        pos = body;
                     }
-                    // Continue to end of logical line (handles line continuation with \)
-                    while pos < text.len() {
-                        if text[pos] == b'\n' {
-                            if pos > 0 && text[pos - 1] != b'\\' {
-                                break;
-                            }
-                        }
+                    None => {
                         pos += 1;
+                        tokens.push(Token::new(TokenKind::Error, start..pos));
                     }
+                },
+
+                // Line continuation in a directive
+                b'\\' if directive.is_some() && is_continuation(text, pos) => {
+                    pos += 1;
                     tokens.push(Token::new(TokenKind::Macro, start..pos));
                 }
 
-                // Raw string literal (C++11)
-                b'R' if pos + 2 < text.len() && text[pos + 1] == b'"' && text[pos + 2] == b'(' => {
-                    pos += 3;
-                    // Find delimiter
-                    let delim_start = pos;
-                    while pos < text.len() && text[pos] != b')' {
-                        pos += 1;
-                    }
-                    let delimiter = &text[delim_start..pos];
-                    if pos < text.len() {
-                        pos += 1; // Skip ')'
-                    }
-                    
-                    // Find closing sequence: )delimiter"
-                    while pos < text.len() {
-                        if text[pos] == b')' {
-                            let mut match_pos = 0;
-                            let mut temp_pos = pos + 1;
-                            while match_pos < delimiter.len() && temp_pos < text.len() 
-                                  && text[temp_pos] == delimiter[match_pos] {
-                                match_pos += 1;
-                                temp_pos += 1;
-                            }
-                            if match_pos == delimiter.len() && temp_pos < text.len() && text[temp_pos] == b'"' {
-                                pos = temp_pos + 1;
-                                break;
-                            }
-                        }
-                        pos += 1;
-                    }
+                // Raw string literal (C++11): R"delim( ... )delim"
+                b'R' if pos + 1 < text.len()
+                    && text[pos + 1] == b'"'
+                    && raw_delimiter_len(&text[pos + 2..]).is_some() =>
+                {
+                    let delim_start = pos + 2;
+                    let delim_len = raw_delimiter_len(&text[delim_start..]).unwrap_or(0);
+                    let delim_end = delim_start + delim_len;
+                    let mut closing = vec![b')'];
+                    closing.extend_from_slice(&text[delim_start..delim_end]);
+                    closing.push(b'"');
+
+                    pos = delim_end + 1; // Skip '('
+                    pos = match text[pos..].windows(closing.len()).position(|w| w == closing) {
+                        Some(i) => pos + i + closing.len(),
+                        None => text.len(),
+                    };
                     tokens.push(Token::new(TokenKind::String, start..pos));
                 }
 
@@ -141,35 +151,64 @@ impl Lexer for CppLexer {
                 // Number
                 b'0'..=b'9' => {
                     // Hex literal
-                    if b == b'0' && pos + 1 < text.len() && (text[pos + 1] == b'x' || text[pos + 1] == b'X') {
+                    if b == b'0'
+                        && pos + 1 < text.len()
+                        && (text[pos + 1] == b'x' || text[pos + 1] == b'X')
+                    {
                         pos += 2;
-                        while pos < text.len() && (is_ascii_digit(text[pos]) || matches!(text[pos], b'a'..=b'f' | b'A'..=b'F' | b'_' | b'\'')) {
+                        while pos < text.len()
+                            && (is_ascii_digit(text[pos])
+                                || matches!(text[pos], b'a'..=b'f' | b'A'..=b'F' | b'_' | b'\''))
+                        {
                             pos += 1;
                         }
                     }
                     // Binary literal (C++14)
-                    else if b == b'0' && pos + 1 < text.len() && (text[pos + 1] == b'b' || text[pos + 1] == b'B') {
+                    else if b == b'0'
+                        && pos + 1 < text.len()
+                        && (text[pos + 1] == b'b' || text[pos + 1] == b'B')
+                    {
                         pos += 2;
-                        while pos < text.len() && (text[pos] == b'0' || text[pos] == b'1' || text[pos] == b'_' || text[pos] == b'\'') {
+                        while pos < text.len()
+                            && (text[pos] == b'0'
+                                || text[pos] == b'1'
+                                || text[pos] == b'_'
+                                || text[pos] == b'\'')
+                        {
                             pos += 1;
                         }
                     }
                     // Octal literal
-                    else if b == b'0' && pos + 1 < text.len() && matches!(text[pos + 1], b'0'..=b'7') {
+                    else if b == b'0'
+                        && pos + 1 < text.len()
+                        && matches!(text[pos + 1], b'0'..=b'7')
+                    {
                         pos += 1;
-                        while pos < text.len() && (matches!(text[pos], b'0'..=b'7') || text[pos] == b'_' || text[pos] == b'\'') {
+                        while pos < text.len()
+                            && (matches!(text[pos], b'0'..=b'7')
+                                || text[pos] == b'_'
+                                || text[pos] == b'\'')
+                        {
                             pos += 1;
                         }
                     }
                     // Decimal literal
                     else {
-                        while pos < text.len() && (is_ascii_digit(text[pos]) || text[pos] == b'_' || text[pos] == b'\'') {
+                        while pos < text.len()
+                            && (is_ascii_digit(text[pos])
+                                || text[pos] == b'_'
+                                || text[pos] == b'\'')
+                        {
                             pos += 1;
                         }
                         // Float
                         if pos < text.len() && text[pos] == b'.' {
                             pos += 1;
-                            while pos < text.len() && (is_ascii_digit(text[pos]) || text[pos] == b'_' || text[pos] == b'\'') {
+                            while pos < text.len()
+                                && (is_ascii_digit(text[pos])
+                                    || text[pos] == b'_'
+                                    || text[pos] == b'\'')
+                            {
                                 pos += 1;
                             }
                         }
@@ -179,80 +218,103 @@ impl Lexer for CppLexer {
                             if pos < text.len() && (text[pos] == b'+' || text[pos] == b'-') {
                                 pos += 1;
                             }
-                            while pos < text.len() && (is_ascii_digit(text[pos]) || text[pos] == b'\'') {
+                            while pos < text.len()
+                                && (is_ascii_digit(text[pos]) || text[pos] == b'\'')
+                            {
                                 pos += 1;
                             }
                         }
                     }
                     // Suffix (f, F, l, L, u, U, ll, LL, ul, UL, etc.)
-                    while pos < text.len() && matches!(text[pos], b'f' | b'F' | b'l' | b'L' | b'u' | b'U') {
+                    while pos < text.len()
+                        && matches!(text[pos], b'f' | b'F' | b'l' | b'L' | b'u' | b'U')
+                    {
                         pos += 1;
                     }
                     tokens.push(Token::new(TokenKind::Number, start..pos));
                 }
 
                 // Identifier or keyword
-                _ if is_ident_start(b) => {
-                    while pos < text.len() && (is_ident_continue(text[pos]) || text[pos] == b'_') {
-                        pos += 1;
-                    }
+                _ if is_ident_start(b) || is_unicode_ident_start(text, pos, UnicodeIdents::Xid) => {
+                    pos = ident_end(text, pos, UnicodeIdents::Xid, is_ident_continue);
                     let word = &text[start..pos];
                     let kind = match word {
                         // C++ keywords (includes all C keywords plus C++-specific)
-                        b"alignas" | b"alignof" | b"and" | b"and_eq" | b"asm" | b"auto" |
-                        b"bitand" | b"bitor" | b"bool" | b"break" | b"case" | b"catch" |
-                        b"char" | b"char8_t" | b"char16_t" | b"char32_t" | b"class" |
-                        b"compl" | b"concept" | b"const" | b"const_cast" | b"consteval" |
-                        b"constexpr" | b"constinit" | b"continue" | b"co_await" | b"co_return" |
-                        b"co_yield" | b"decltype" | b"default" | b"delete" | b"do" | b"double" |
-                        b"dynamic_cast" | b"else" | b"enum" | b"explicit" | b"export" |
-                        b"extern" | b"float" | b"for" | b"friend" | b"goto" |
-                        b"if" | b"inline" | b"int" | b"long" | b"mutable" | b"namespace" |
-                        b"new" | b"noexcept" | b"not" | b"not_eq" | b"operator" |
-                        b"or" | b"or_eq" | b"private" | b"protected" | b"public" | b"register" |
-                        b"reinterpret_cast" | b"requires" | b"return" | b"short" | b"signed" |
-                        b"sizeof" | b"static" | b"static_assert" | b"static_cast" | b"struct" |
-                        b"switch" | b"template" | b"this" | b"thread_local" | b"throw" |
-                        b"try" | b"typedef" | b"typeid" | b"typename" | b"union" |
-                        b"unsigned" | b"using" | b"virtual" | b"void" | b"volatile" |
-                        b"wchar_t" | b"while" | b"xor" | b"xor_eq" => TokenKind::Keyword,
-                        
+                        b"alignas" | b"alignof" | b"and" | b"and_eq" | b"asm" | b"auto"
+                        | b"bitand" | b"bitor" | b"bool" | b"break" | b"case" | b"catch"
+                        | b"char" | b"char8_t" | b"char16_t" | b"char32_t" | b"class"
+                        | b"compl" | b"concept" | b"const" | b"const_cast" | b"consteval"
+                        | b"constexpr" | b"constinit" | b"continue" | b"co_await"
+                        | b"co_return" | b"co_yield" | b"decltype" | b"default" | b"delete"
+                        | b"do" | b"double" | b"dynamic_cast" | b"else" | b"enum" | b"explicit"
+                        | b"export" | b"extern" | b"float" | b"for" | b"friend" | b"goto"
+                        | b"if" | b"inline" | b"int" | b"long" | b"mutable" | b"namespace"
+                        | b"new" | b"noexcept" | b"not" | b"not_eq" | b"operator" | b"or"
+                        | b"or_eq" | b"private" | b"protected" | b"public" | b"register"
+                        | b"reinterpret_cast" | b"requires" | b"return" | b"short" | b"signed"
+                        | b"sizeof" | b"static" | b"static_assert" | b"static_cast" | b"struct"
+                        | b"switch" | b"template" | b"this" | b"thread_local" | b"throw"
+                        | b"try" | b"typedef" | b"typeid" | b"typename" | b"union"
+                        | b"unsigned" | b"using" | b"virtual" | b"void" | b"volatile"
+                        | b"wchar_t" | b"while" | b"xor" | b"xor_eq" => TokenKind::Keyword,
+
                         // Boolean literals
                         b"true" | b"false" | b"TRUE" | b"FALSE" => TokenKind::Boolean,
-                        
+
                         // nullptr
                         b"nullptr" | b"NULL" => TokenKind::Boolean,
-                        
+
                         // Common STL types
-                        b"string" | b"vector" | b"map" | b"set" | b"list" | b"deque" |
-                        b"queue" | b"stack" | b"array" | b"pair" | b"tuple" | b"optional" |
-                        b"variant" | b"any" | b"function" | b"shared_ptr" | b"unique_ptr" |
-                        b"weak_ptr" | b"size_t" | b"ptrdiff_t" | b"nullptr_t" => TokenKind::TypeName,
-                        
+                        b"string" | b"vector" | b"map" | b"set" | b"list" | b"deque" | b"queue"
+                        | b"stack" | b"array" | b"pair" | b"tuple" | b"optional" | b"variant"
+                        | b"any" | b"function" | b"shared_ptr" | b"unique_ptr" | b"weak_ptr"
+                        | b"size_t" | b"ptrdiff_t" | b"nullptr_t" => TokenKind::TypeName,
+
                         _ => TokenKind::Identifier,
                     };
+                    let kind = match &directive {
+                        Some(directive) => directive.identifier_kind(text, word, kind),
+                        None => kind,
+                    };
                     tokens.push(Token::new(kind, start..pos));
                 }
 
                 // Operators and punctuation
-                b'+' | b'-' | b'*' | b'/' | b'%' | b'=' | b'!' | b'<' | b'>' |
-                b'&' | b'|' | b'^' | b'~' | b'?' | b':' | b'.' | b',' | b';' |
-                b'(' | b')' | b'{' | b'}' | b'[' | b']' => {
+                b'+' | b'-' | b'*' | b'/' | b'%' | b'=' | b'!' | b'<' | b'>' | b'&' | b'|'
+                | b'^' | b'~' | b'?' | b':' | b'.' | b',' | b';' | b'(' | b')' | b'{' | b'}'
+                | b'[' | b']' => {
                     pos += 1;
                     // Handle multi-character operators
                     if pos < text.len() {
                         match (b, text[pos]) {
-                            (b'+', b'+') | (b'-', b'-') | (b'+', b'=') | (b'-', b'=') |
-                            (b'*', b'=') | (b'/', b'=') | (b'%', b'=') | (b'=', b'=') |
-                            (b'!', b'=') | (b'<', b'<') | (b'>', b'>') | (b'<', b'=') |
-                            (b'>', b'=') | (b'&', b'&') | (b'|', b'|') | (b'&', b'=') |
-                            (b'|', b'=') | (b'^', b'=') | (b'-', b'>') | (b':', b':') => {
+                            (b'+', b'+')
+                            | (b'-', b'-')
+                            | (b'+', b'=')
+                            | (b'-', b'=')
+                            | (b'*', b'=')
+                            | (b'/', b'=')
+                            | (b'%', b'=')
+                            | (b'=', b'=')
+                            | (b'!', b'=')
+                            | (b'<', b'<')
+                            | (b'>', b'>')
+                            | (b'<', b'=')
+                            | (b'>', b'=')
+                            | (b'&', b'&')
+                            | (b'|', b'|')
+                            | (b'&', b'=')
+                            | (b'|', b'=')
+                            | (b'^', b'=')
+                            | (b'-', b'>')
+                            | (b':', b':') => {
                                 pos += 1;
                                 // Handle three-character operators
                                 if pos < text.len() {
                                     match (b, text[pos - 1], text[pos]) {
-                                        (b'<', b'<', b'=') | (b'>', b'>', b'=') | 
-                                        (b'-', b'>', b'*') | (b'.', b'.', b'.') => {
+                                        (b'<', b'<', b'=')
+                                        | (b'>', b'>', b'=')
+                                        | (b'-', b'>', b'*')
+                                        | (b'.', b'.', b'.') => {
                                             pos += 1;
                                         }
                                         _ => {}
@@ -267,12 +329,10 @@ impl Lexer for CppLexer {
 
                 // Unknown character
                 _ => {
-                    pos += 1;
+                    pos += char_len(text, pos);
                     tokens.push(Token::new(TokenKind::Error, start..pos));
                 }
             }
         }
-
-        tokens
     }
 }
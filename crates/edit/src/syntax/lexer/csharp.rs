@@ -3,17 +3,29 @@
 
 //! High-performance C# lexer with full language support.
 
-use crate::syntax::lexer::{Lexer, is_whitespace, is_ident_start, is_ident_continue, is_ascii_digit};
+use crate::syntax::lexer::{
+    Checkpoints, Resumable, UnicodeIdents, char_len, ident_end, is_ascii_digit, is_ident_continue,
+    is_ident_start, is_unicode_ident_start, is_whitespace,
+};
 use crate::syntax::{Token, TokenKind};
 
 pub struct CSharpLexer;
 
-impl Lexer for CSharpLexer {
-    fn tokenize(&self, text: &[u8]) -> Vec<Token> {
-        let mut tokens = Vec::with_capacity(text.len() / 8);
-        let mut pos = 0;
+impl Resumable for CSharpLexer {
+    type State = ();
 
+    fn lex(
+        &self,
+        text: &[u8],
+        mut pos: usize,
+        _: (),
+        tokens: &mut Vec<Token>,
+        checkpoints: &mut Checkpoints<()>,
+    ) {
         while pos < text.len() {
+            if checkpoints.due(text, tokens, pos) && checkpoints.report(text, pos, tokens, 0, ()) {
+                return;
+            }
             let start = pos;
             let b = text[pos];
 
@@ -37,15 +49,7 @@ impl Lexer for CSharpLexer {
 
                 // Block comment
                 b'/' if pos + 1 < text.len() && text[pos + 1] == b'*' => {
-                    pos += 2;
-                    while pos + 1 < text.len() {
-                        if text[pos] == b'*' && text[pos + 1] == b'/' {
-                            pos += 2;
-                            break;
-                        }
-                        pos += 1;
-                    }
-                    tokens.push(Token::new(TokenKind::Comment, start..pos));
+                    pos = checkpoints.block_comment(text, start, tokens);
                 }
 
                 // Preprocessor directive
@@ -90,8 +94,12 @@ impl Lexer for CSharpLexer {
                 }
 
                 // Interpolated string ($"..." or $@"...")
-                b'$' if pos + 1 < text.len() && (text[pos + 1] == b'"' || 
-                        (pos + 2 < text.len() && text[pos + 1] == b'@' && text[pos + 2] == b'"')) => {
+                b'$' if pos + 1 < text.len()
+                    && (text[pos + 1] == b'"'
+                        || (pos + 2 < text.len()
+                            && text[pos + 1] == b'@'
+                            && text[pos + 2] == b'"')) =>
+                {
                     pos += 1;
                     let verbatim = if text[pos] == b'@' {
                         pos += 1;
@@ -100,7 +108,7 @@ impl Lexer for CSharpLexer {
                         false
                     };
                     pos += 1; // Skip opening "
-                    
+
                     let mut brace_depth = 0;
                     let mut escaped = false;
                     while pos < text.len() {
@@ -196,16 +204,27 @@ impl Lexer for CSharpLexer {
                 // Number
                 b'0'..=b'9' => {
                     // Hex literal
-                    if b == b'0' && pos + 1 < text.len() && (text[pos + 1] == b'x' || text[pos + 1] == b'X') {
+                    if b == b'0'
+                        && pos + 1 < text.len()
+                        && (text[pos + 1] == b'x' || text[pos + 1] == b'X')
+                    {
                         pos += 2;
-                        while pos < text.len() && (is_ascii_digit(text[pos]) || matches!(text[pos], b'a'..=b'f' | b'A'..=b'F' | b'_')) {
+                        while pos < text.len()
+                            && (is_ascii_digit(text[pos])
+                                || matches!(text[pos], b'a'..=b'f' | b'A'..=b'F' | b'_'))
+                        {
                             pos += 1;
                         }
                     }
                     // Binary literal
-                    else if b == b'0' && pos + 1 < text.len() && (text[pos + 1] == b'b' || text[pos + 1] == b'B') {
+                    else if b == b'0'
+                        && pos + 1 < text.len()
+                        && (text[pos + 1] == b'b' || text[pos + 1] == b'B')
+                    {
                         pos += 2;
-                        while pos < text.len() && (text[pos] == b'0' || text[pos] == b'1' || text[pos] == b'_') {
+                        while pos < text.len()
+                            && (text[pos] == b'0' || text[pos] == b'1' || text[pos] == b'_')
+                        {
                             pos += 1;
                         }
                     }
@@ -215,9 +234,15 @@ impl Lexer for CSharpLexer {
                             pos += 1;
                         }
                         // Float
-                        if pos < text.len() && text[pos] == b'.' && pos + 1 < text.len() && is_ascii_digit(text[pos + 1]) {
+                        if pos < text.len()
+                            && text[pos] == b'.'
+                            && pos + 1 < text.len()
+                            && is_ascii_digit(text[pos + 1])
+                        {
                             pos += 1;
-                            while pos < text.len() && (is_ascii_digit(text[pos]) || text[pos] == b'_') {
+                            while pos < text.len()
+                                && (is_ascii_digit(text[pos]) || text[pos] == b'_')
+                            {
                                 pos += 1;
                             }
                         }
@@ -233,79 +258,100 @@ impl Lexer for CSharpLexer {
                         }
                     }
                     // Suffix (f, F, d, D, m, M, l, L, u, U, ul, UL, etc.)
-                    while pos < text.len() && matches!(text[pos], b'f' | b'F' | b'd' | b'D' | b'm' | b'M' | b'l' | b'L' | b'u' | b'U') {
+                    while pos < text.len()
+                        && matches!(
+                            text[pos],
+                            b'f' | b'F' | b'd' | b'D' | b'm' | b'M' | b'l' | b'L' | b'u' | b'U'
+                        )
+                    {
                         pos += 1;
                     }
                     tokens.push(Token::new(TokenKind::Number, start..pos));
                 }
 
                 // Identifier or keyword
-                _ if is_ident_start(b) || b == b'@' => {
+                _ if is_ident_start(b)
+                    || b == b'@'
+                    || is_unicode_ident_start(text, pos, UnicodeIdents::Xid) =>
+                {
                     if b == b'@' {
                         pos += 1; // Skip @ for verbatim identifier
                     }
-                    while pos < text.len() && (is_ident_continue(text[pos]) || text[pos] == b'_') {
-                        pos += 1;
-                    }
+                    pos = ident_end(text, pos, UnicodeIdents::Xid, is_ident_continue);
                     let word = &text[start..pos];
                     let kind = match word {
                         // C# keywords
-                        b"abstract" | b"as" | b"base" | b"bool" | b"break" | b"byte" |
-                        b"case" | b"catch" | b"char" | b"checked" | b"class" | b"const" |
-                        b"continue" | b"decimal" | b"default" | b"delegate" | b"do" |
-                        b"double" | b"else" | b"enum" | b"event" | b"explicit" | b"extern" |
-                        b"finally" | b"fixed" | b"float" | b"for" | b"foreach" |
-                        b"goto" | b"if" | b"implicit" | b"in" | b"int" | b"interface" |
-                        b"internal" | b"is" | b"lock" | b"long" | b"namespace" | b"new" |
-                        b"object" | b"operator" | b"out" | b"override" | b"params" |
-                        b"private" | b"protected" | b"public" | b"readonly" | b"ref" |
-                        b"return" | b"sbyte" | b"sealed" | b"short" | b"sizeof" | b"stackalloc" |
-                        b"static" | b"string" | b"struct" | b"switch" | b"this" | b"throw" |
-                        b"try" | b"typeof" | b"uint" | b"ulong" | b"unchecked" |
-                        b"unsafe" | b"ushort" | b"using" | b"virtual" | b"void" | b"volatile" |
-                        b"while" => TokenKind::Keyword,
-                        
+                        b"abstract" | b"as" | b"base" | b"bool" | b"break" | b"byte" | b"case"
+                        | b"catch" | b"char" | b"checked" | b"class" | b"const" | b"continue"
+                        | b"decimal" | b"default" | b"delegate" | b"do" | b"double" | b"else"
+                        | b"enum" | b"event" | b"explicit" | b"extern" | b"finally" | b"fixed"
+                        | b"float" | b"for" | b"foreach" | b"goto" | b"if" | b"implicit"
+                        | b"in" | b"int" | b"interface" | b"internal" | b"is" | b"lock"
+                        | b"long" | b"namespace" | b"new" | b"object" | b"operator" | b"out"
+                        | b"override" | b"params" | b"private" | b"protected" | b"public"
+                        | b"readonly" | b"ref" | b"return" | b"sbyte" | b"sealed" | b"short"
+                        | b"sizeof" | b"stackalloc" | b"static" | b"string" | b"struct"
+                        | b"switch" | b"this" | b"throw" | b"try" | b"typeof" | b"uint"
+                        | b"ulong" | b"unchecked" | b"unsafe" | b"ushort" | b"using"
+                        | b"virtual" | b"void" | b"volatile" | b"while" => TokenKind::Keyword,
+
                         // Contextual keywords
-                        b"add" | b"alias" | b"ascending" | b"async" | b"await" | b"by" |
-                        b"descending" | b"dynamic" | b"equals" | b"from" | b"get" | b"global" |
-                        b"group" | b"into" | b"join" | b"let" | b"nameof" | b"on" | b"orderby" |
-                        b"partial" | b"remove" | b"select" | b"set" | b"value" | b"var" |
-                        b"when" | b"where" | b"yield" => TokenKind::Keyword,
-                        
+                        b"add" | b"alias" | b"ascending" | b"async" | b"await" | b"by"
+                        | b"descending" | b"dynamic" | b"equals" | b"from" | b"get" | b"global"
+                        | b"group" | b"into" | b"join" | b"let" | b"nameof" | b"on"
+                        | b"orderby" | b"partial" | b"remove" | b"select" | b"set" | b"value"
+                        | b"var" | b"when" | b"where" | b"yield" => TokenKind::Keyword,
+
                         // C# 9.0+ keywords
                         b"record" | b"init" | b"with" | b"nint" | b"nuint" => TokenKind::Keyword,
-                        
+
                         // Boolean literals
                         b"true" | b"false" => TokenKind::Boolean,
-                        
+
                         // Null
                         b"null" => TokenKind::Boolean,
-                        
+
                         _ => TokenKind::Identifier,
                     };
                     tokens.push(Token::new(kind, start..pos));
                 }
 
                 // Operators and punctuation
-                b'+' | b'-' | b'*' | b'/' | b'%' | b'=' | b'!' | b'<' | b'>' |
-                b'&' | b'|' | b'^' | b'~' | b'?' | b':' | b'.' | b',' | b';' |
-                b'(' | b')' | b'{' | b'}' | b'[' | b']' => {
+                b'+' | b'-' | b'*' | b'/' | b'%' | b'=' | b'!' | b'<' | b'>' | b'&' | b'|'
+                | b'^' | b'~' | b'?' | b':' | b'.' | b',' | b';' | b'(' | b')' | b'{' | b'}'
+                | b'[' | b']' => {
                     pos += 1;
                     // Handle multi-character operators
                     if pos < text.len() {
                         match (b, text[pos]) {
-                            (b'+', b'+') | (b'-', b'-') | (b'+', b'=') | (b'-', b'=') |
-                            (b'*', b'=') | (b'/', b'=') | (b'%', b'=') | (b'=', b'=') |
-                            (b'!', b'=') | (b'<', b'<') | (b'>', b'>') | (b'<', b'=') |
-                            (b'>', b'=') | (b'&', b'&') | (b'|', b'|') | (b'&', b'=') |
-                            (b'|', b'=') | (b'^', b'=') | (b'=', b'>') | (b'?', b'?') |
-                            (b'?', b'.') => {
+                            (b'+', b'+')
+                            | (b'-', b'-')
+                            | (b'+', b'=')
+                            | (b'-', b'=')
+                            | (b'*', b'=')
+                            | (b'/', b'=')
+                            | (b'%', b'=')
+                            | (b'=', b'=')
+                            | (b'!', b'=')
+                            | (b'<', b'<')
+                            | (b'>', b'>')
+                            | (b'<', b'=')
+                            | (b'>', b'=')
+                            | (b'&', b'&')
+                            | (b'|', b'|')
+                            | (b'&', b'=')
+                            | (b'|', b'=')
+                            | (b'^', b'=')
+                            | (b'=', b'>')
+                            | (b'?', b'?')
+                            | (b'?', b'.') => {
                                 pos += 1;
                                 // Handle three-character operators
                                 if pos < text.len() {
                                     match (b, text[pos - 1], text[pos]) {
-                                        (b'<', b'<', b'=') | (b'>', b'>', b'=') |
-                                        (b'?', b'?', b'=') => {
+                                        (b'<', b'<', b'=')
+                                        | (b'>', b'>', b'=')
+                                        | (b'?', b'?', b'=') => {
                                             pos += 1;
                                         }
                                         _ => {}
@@ -320,12 +366,10 @@ impl Lexer for CSharpLexer {
 
                 // Unknown character
                 _ => {
-                    pos += 1;
+                    pos += char_len(text, pos);
                     tokens.push(Token::new(TokenKind::Error, start..pos));
                 }
             }
         }
-
-        tokens
     }
 }
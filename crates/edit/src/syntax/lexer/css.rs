@@ -3,17 +3,28 @@
 
 //! High-performance CSS lexer with full language support.
 
-use crate::syntax::lexer::{Lexer, is_whitespace, is_ident_start, is_ident_continue};
+use crate::syntax::lexer::{
+    Checkpoints, Resumable, char_len, is_ident_continue, is_ident_start, is_whitespace,
+};
 use crate::syntax::{Token, TokenKind};
 
 pub struct CssLexer;
 
-impl Lexer for CssLexer {
-    fn tokenize(&self, text: &[u8]) -> Vec<Token> {
-        let mut tokens = Vec::with_capacity(text.len() / 8);
-        let mut pos = 0;
-
+impl Resumable for CssLexer {
+    type State = ();
+
+    fn lex(
+        &self,
+        text: &[u8],
+        mut pos: usize,
+        _: (),
+        tokens: &mut Vec<Token>,
+        checkpoints: &mut Checkpoints<()>,
+    ) {
         while pos < text.len() {
+            if checkpoints.due(text, tokens, pos) && checkpoints.report(text, pos, tokens, 0, ()) {
+                return;
+            }
             let start = pos;
             let b = text[pos];
 
@@ -28,15 +39,7 @@ impl Lexer for CssLexer {
 
                 // Block comment
                 b'/' if pos + 1 < text.len() && text[pos + 1] == b'*' => {
-                    pos += 2;
-                    while pos + 1 < text.len() {
-                        if text[pos] == b'*' && text[pos + 1] == b'/' {
-                            pos += 2;
-                            break;
-                        }
-                        pos += 1;
-                    }
-                    tokens.push(Token::new(TokenKind::Comment, start..pos));
+                    pos = checkpoints.block_comment(text, start, tokens);
                 }
 
                 // At-rule (@media, @import, @keyframes, etc.)
@@ -58,7 +61,9 @@ impl Lexer for CssLexer {
                 }
 
                 // Class selector
-                b'.' if pos + 1 < text.len() && (is_ident_start(text[pos + 1]) || text[pos + 1] == b'-') => {
+                b'.' if pos + 1 < text.len()
+                    && (is_ident_start(text[pos + 1]) || text[pos + 1] == b'-') =>
+                {
                     pos += 1;
                     while pos < text.len() && (is_ident_continue(text[pos]) || text[pos] == b'-') {
                         pos += 1;
@@ -95,7 +100,9 @@ impl Lexer for CssLexer {
                     }
                     // Unit (px, em, rem, %, etc.)
                     if pos < text.len() && is_ident_start(text[pos]) {
-                        while pos < text.len() && (is_ident_continue(text[pos]) || text[pos] == b'%') {
+                        while pos < text.len()
+                            && (is_ident_continue(text[pos]) || text[pos] == b'%')
+                        {
                             pos += 1;
                         }
                     } else if pos < text.len() && text[pos] == b'%' {
@@ -109,30 +116,34 @@ impl Lexer for CssLexer {
                     while pos < text.len() && (is_ident_continue(text[pos]) || text[pos] == b'-') {
                         pos += 1;
                     }
-                    
+
                     let word = &text[start..pos];
                     let kind = match word {
                         // CSS keywords and values
-                        b"important" | b"inherit" | b"initial" | b"unset" | b"auto" |
-                        b"none" | b"normal" | b"bold" | b"italic" | b"block" | b"inline" |
-                        b"flex" | b"grid" | b"absolute" | b"relative" | b"fixed" | b"sticky" |
-                        b"left" | b"right" | b"center" | b"top" | b"bottom" |
-                        b"hidden" | b"visible" | b"scroll" | b"solid" | b"dashed" | b"dotted" |
-                        b"transparent" | b"currentColor" => TokenKind::Keyword,
-                        
+                        b"important" | b"inherit" | b"initial" | b"unset" | b"auto" | b"none"
+                        | b"normal" | b"bold" | b"italic" | b"block" | b"inline" | b"flex"
+                        | b"grid" | b"absolute" | b"relative" | b"fixed" | b"sticky" | b"left"
+                        | b"right" | b"center" | b"top" | b"bottom" | b"hidden" | b"visible"
+                        | b"scroll" | b"solid" | b"dashed" | b"dotted" | b"transparent"
+                        | b"currentColor" => TokenKind::Keyword,
+
                         _ => TokenKind::Identifier,
                     };
                     tokens.push(Token::new(kind, start..pos));
                 }
 
                 // Operators and punctuation
-                b'{' | b'}' | b'(' | b')' | b'[' | b']' | b':' | b';' | b',' |
-                b'>' | b'+' | b'~' | b'*' | b'=' | b'^' | b'$' | b'|' => {
+                b'{' | b'}' | b'(' | b')' | b'[' | b']' | b':' | b';' | b',' | b'>' | b'+'
+                | b'~' | b'*' | b'=' | b'^' | b'$' | b'|' => {
                     pos += 1;
                     // Handle multi-character operators
                     if pos < text.len() {
                         match (b, text[pos]) {
-                            (b':', b':') | (b'*', b'=') | (b'^', b'=') | (b'$', b'=') | (b'|', b'=') => {
+                            (b':', b':')
+                            | (b'*', b'=')
+                            | (b'^', b'=')
+                            | (b'$', b'=')
+                            | (b'|', b'=') => {
                                 pos += 1;
                             }
                             _ => {}
@@ -143,12 +154,10 @@ impl Lexer for CssLexer {
 
                 // Other characters
                 _ => {
-                    pos += 1;
+                    pos += char_len(text, pos);
                     tokens.push(Token::new(TokenKind::Operator, start..pos));
                 }
             }
         }
-
-        tokens
     }
 }
@@ -2,20 +2,1051 @@
 // Licensed under the MIT License.
 
 //! High-performance Go lexer with full language support.
+//!
+//! The type parameters of generic functions and types, like `T` in `func Map[T any]`,
+//! are type names from their `[` to the end of the declaration. A `[` only opens them
+//! right after the name, since gofmt separates array types like `type Buffer [Size]byte`.
+//! A declaration ends at the `}` of its body, or at the end of its line without one.
+//!
+//! Compiler directives like `//go:embed *.html` and build constraints like `// +build linux`
+//! look like comments, but are lexed as a macro with arguments, see [`directive`].
+//!
+//! A raw string after a field in a struct body is its tag, and is lexed into its keys,
+//! values and options, see [`struct_tag`]. Anywhere else it's a string.
+//!
+//! Labels like `outer:` are only labels where a statement starts in a block, which keeps
+//! the keys of composite literals like `Point{X: 1}` and the values of case clauses apart.
+//! The lexer tells blocks from literals by what comes before their `{`, see [`opens_block`].
+//!
+//! The comment right above `import "C"` is the cgo preamble, which is lexed as C,
+//! see [`cgo_preamble`].
+//!
+//! Tokens are put in the containers they're in, like function bodies, parameter lists,
+//! struct bodies and struct tags, see [`Container`]. Brackets are part of what they enclose.
+//!
+//! The predeclared names are those of the latest Go, unless the lexer is for an older
+//! [`GoVersion`], which doesn't have `any` or `min` yet.
 
-use crate::syntax::lexer::{Lexer, is_whitespace, is_ident_start, is_ident_continue, is_ascii_digit};
-use crate::syntax::{Token, TokenKind};
+use std::ops::Range;
 
-pub struct GoLexer;
+use crate::syntax::grammar::{ExportRules, StringRule};
+use crate::syntax::lexer::{
+    Checkpoints, Language, MAX_NESTING_DEPTH, Resumable, UnicodeIdents, char_len, ident_end,
+    is_ascii_digit, is_ident_continue, is_ident_start, is_unicode_ident_start, is_whitespace,
+    preceding,
+};
+use crate::syntax::{
+    Container, DocMarkup, EmbeddedRegion, RegionEnd, ScopeStack, Token, TokenKind, TokenPayload,
+};
 
-impl Lexer for GoLexer {
-    fn tokenize(&self, text: &[u8]) -> Vec<Token> {
-        let mut tokens = Vec::with_capacity(text.len() / 8);
-        let mut pos = 0;
+pub struct GoLexer {
+    /// The version whose predeclared names to highlight.
+    pub version: GoVersion,
+    /// How deeply brackets may nest before the lexer only counts them, see [`MAX_NESTING_DEPTH`].
+    pub max_nesting_depth: usize,
+}
+
+impl Default for GoLexer {
+    fn default() -> Self {
+        Self { version: GoVersion::default(), max_nesting_depth: MAX_NESTING_DEPTH }
+    }
+}
+
+/// The Go versions that predeclared names, each with the names it added.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, PartialOrd, Ord)]
+pub enum GoVersion {
+    /// Before generics, so `any` and `comparable` are names like any other.
+    Go1_17,
+    /// Generics, with the `any` and `comparable` constraints.
+    Go1_18,
+    /// The `min`, `max` and `clear` built-in functions.
+    #[default]
+    Go1_21,
+}
+
+impl GoVersion {
+    /// The names of the versions, oldest first.
+    pub const NAMES: &[&str] = &["1.17", "1.18", "1.21"];
+
+    /// Parse a version like `1.20`, `1.22.3` or `go1.19` as in `go.mod`, as the version
+    /// that predeclared the names it has: `1.20` is [`GoVersion::Go1_18`].
+    pub fn from_name(name: &str) -> Option<Self> {
+        let name = name.strip_prefix("go").unwrap_or(name);
+        let minor = name.strip_prefix("1.")?;
+        let minor = minor.split(|c: char| !c.is_ascii_digit()).next()?.parse::<u32>().ok()?;
+        Some(match minor {
+            ..18 => GoVersion::Go1_17,
+            18..21 => GoVersion::Go1_18,
+            _ => GoVersion::Go1_21,
+        })
+    }
+}
+
+/// The type parameters of the generic declaration the lexer is in.
+struct TypeParams<'a> {
+    names: Vec<&'a [u8]>,
+    /// The bracket depth around the declaration.
+    depth: usize,
+    /// The bracket depth in the list, and the index of its first token, while it's open.
+    list: Option<(usize, usize)>,
+}
+
+/// The header of an `if`, `for`, `switch` or `func` whose `{` is to come.
+#[derive(Clone, PartialEq)]
+struct Header {
+    /// The bracket depth around the header.
+    depth: usize,
+    /// Whether it's a `func`, whose `{` opens a function body rather than a block.
+    func: bool,
+    /// The containers of the lists in parentheses to come in a `func` header: the receiver
+    /// of a method, the parameters and the results.
+    lists: &'static [Container],
+}
+
+/// The stack of `containers`, which holds the bracket depth inside each, too.
+fn scope_stack(containers: &[(Container, usize)]) -> ScopeStack {
+    containers.iter().take(ScopeStack::MAX_DEPTH).map(|&(container, _)| container).collect()
+}
+
+/// Puts `tokens` in the containers `scopes`.
+fn set_scopes(tokens: &mut [Token], scopes: ScopeStack) {
+    for token in tokens {
+        token.scopes = scopes;
+    }
+}
+
+/// Whether the `[` at `pos` opens a list of type parameters, because it follows the name
+/// in `func Name[` or `type Name[`, or the type in a receiver like `func (s *Stack[`.
+/// Returns whether it's the latter, where the list is one bracket deeper.
+fn opens_type_params(text: &[u8], tokens: &[Token], pos: usize) -> Option<bool> {
+    let mut prev = preceding(tokens);
+    let name = prev.next()?;
+    if name.span.end != pos || name.kind != TokenKind::Identifier {
+        return None;
+    }
+    let mut prev = prev.map(|t| &text[t.span.clone()]);
+    let mut word = prev.next()?;
+    if matches!(word, b"func" | b"type") {
+        return Some(false);
+    }
+    if word == b"*" {
+        word = prev.next()?;
+    }
+    // The receiver's name is optional, as in `func (*Stack[T]) Len() int`.
+    if word != b"(" {
+        word = prev.next()?;
+    }
+    (word == b"(" && prev.next()? == b"func").then_some(true)
+}
+
+/// Lexes the compiler directive at `pos`, like `//go:generate stringer -type=Day`, and
+/// returns its end. `None` if the comment isn't one: it has to start its line, and the name
+/// has to follow `//go:` right away, so that `// go:embed` is an ordinary comment.
+///
+/// The arguments are the patterns of `go:embed` as strings, the command of `go:generate`
+/// as a string, the expression of `go:build` and `// +build` with its operators, and
+/// otherwise words, like the names of `go:linkname`.
+fn directive(text: &[u8], pos: usize, tokens: &mut Vec<Token>) -> Option<usize> {
+    if !text[..pos].iter().rev().take_while(|&&b| b != b'\n').all(|&b| matches!(b, b' ' | b'\t')) {
+        return None;
+    }
+    let end = text[pos..].iter().position(|&b| b == b'\n').map_or(text.len(), |i| pos + i);
+    let (name, mut args) = if text[pos..end].starts_with(b"//go:") {
+        let len = text[pos + 5..end].iter().take_while(|b| b.is_ascii_alphanumeric()).count();
+        (&text[pos + 5..pos + 5 + len], pos + 5 + len)
+    } else if text[pos..end].starts_with(b"// +build") {
+        (&b"build"[..], pos + 9)
+    } else {
+        return None;
+    };
+    if name.is_empty() || !matches!(text.get(args), None | Some(b' ' | b'\t' | b'\r' | b'\n')) {
+        return None;
+    }
+    tokens.push(Token::new(TokenKind::Macro, pos..args));
+
+    while args < end {
+        let start = args;
+        let b = text[args];
+        args += 1;
+        let kind = match b {
+            b' ' | b'\t' | b'\r' => {
+                while args < end && matches!(text[args], b' ' | b'\t' | b'\r') {
+                    args += 1;
+                }
+                TokenKind::Whitespace
+            }
+            // The rest of the line is the command, quotes and all.
+            _ if name == b"generate" => {
+                args = end;
+                while matches!(text[args - 1], b' ' | b'\t' | b'\r') {
+                    args -= 1;
+                }
+                TokenKind::String
+            }
+            b'&' | b'|' if name == b"build" && text.get(args) == Some(&b) => {
+                args += 1;
+                TokenKind::Operator
+            }
+            b'!' | b'(' | b')' | b',' if name == b"build" => TokenKind::Operator,
+            // A quoted pattern may contain spaces.
+            b'"' | b'`' if name == b"embed" => {
+                while args < end && text[args] != b {
+                    args += if text[args] == b'\\' && b == b'"' { 2 } else { 1 };
+                }
+                args = (args + 1).min(end);
+                TokenKind::String
+            }
+            _ if name == b"build" && !(is_ident_continue(b) || b == b'.') => TokenKind::Error,
+            _ => {
+                let stop = |b: u8| {
+                    matches!(b, b' ' | b'\t' | b'\r')
+                        || (name == b"build" && !(is_ident_continue(b) || b == b'.'))
+                };
+                while args < end && !stop(text[args]) {
+                    args += 1;
+                }
+                if name == b"embed" { TokenKind::String } else { TokenKind::Identifier }
+            }
+        };
+        tokens.push(Token::new(kind, start..args));
+    }
+    Some(end)
+}
+
+/// Lexes the cgo preamble at `pos` and returns its end. `None` if the comment isn't one:
+/// a block comment, or a run of line comments from the start of a line, right above an
+/// `import "C"` without a blank line between them.
+///
+/// The preamble is lexed as C with the comment delimiters as comments, except for `#cgo`
+/// lines like `#cgo linux LDFLAGS: -lm`, which are lexed by [`cgo_directive`].
+/// Whether a comment is one depends on the line after it, which `checkpoints` are told.
+fn cgo_preamble(
+    text: &[u8],
+    pos: usize,
+    tokens: &mut Vec<Token>,
+    checkpoints: &mut Checkpoints<GoState>,
+) -> Option<usize> {
+    let block = text[pos..].starts_with(b"/*");
+    let (close, end) = if block {
+        let close = pos + 2 + text[pos + 2..].windows(2).position(|w| w == b"*/")?;
+        (close, close + 2)
+    } else {
+        if pos > 0 && text[pos - 1] != b'\n' {
+            return None;
+        }
+        let mut end = pos;
+        while text[end..].starts_with(b"//") {
+            end = text[end..].iter().position(|&b| b == b'\n').map_or(text.len(), |i| end + i);
+            if end + 1 >= text.len() || !text[end + 1..].starts_with(b"//") {
+                break;
+            }
+            end += 1;
+        }
+        (end, end)
+    };
+
+    let line_end = |pos: usize| text[pos..].iter().position(|&b| b == b'\n').map(|i| pos + i + 1);
+    checkpoints.look_ahead(line_end(end).and_then(line_end).unwrap_or(usize::MAX));
+    let rest = &text[end..];
+    let blank = rest.iter().take_while(|&&b| matches!(b, b' ' | b'\t' | b'\r')).count();
+    let rest = rest[blank..].strip_prefix(b"\n")?.strip_prefix(b"import")?;
+    let quote = rest.iter().take_while(|&&b| matches!(b, b' ' | b'\t')).count();
+    if quote == 0 || !rest[quote..].starts_with(b"\"C\"") {
+        return None;
+    }
+
+    tokens.push(Token::new(TokenKind::Comment, pos..pos + 2));
+    let region = EmbeddedRegion::new(Language::C, pos + 2, RegionEnd::At(close))
+        .fallback(TokenKind::Comment)
+        .interpolation(b"#cgo", b"\n");
+    let region = if block { region } else { region.line_prefix(b"//", TokenKind::Comment) };
+    region.tokenize_with(text, tokens, |range, tokens| cgo_directive(text, range, tokens));
+    if block {
+        tokens.push(Token::new(TokenKind::Comment, close..end));
+    }
+    Some(end)
+}
+
+/// Lexes the `#cgo` directive `text[range]`, up to and including its newline: the optional
+/// build constraints before the variable as in `#cgo linux,!arm64 CFLAGS: -DPNG_DEBUG=1`,
+/// the variable as a property name and each of its flags as a string.
+fn cgo_directive(text: &[u8], range: Range<usize>, tokens: &mut Vec<Token>) {
+    tokens.push(Token::new(TokenKind::Macro, range.start..range.start + 4));
+    let mut pos = range.start + 4;
+    let mut flags = false;
+
+    while pos < range.end {
+        let start = pos;
+        let b = text[pos];
+        pos += 1;
+        let kind = match b {
+            b' ' | b'\t' | b'\r' | b'\n' => {
+                while pos < range.end && matches!(text[pos], b' ' | b'\t' | b'\r' | b'\n') {
+                    pos += 1;
+                }
+                TokenKind::Whitespace
+            }
+            // A quoted flag may contain spaces.
+            b'"' if flags => {
+                while pos < range.end && !matches!(text[pos], b'"' | b'\n') {
+                    pos += if text[pos] == b'\\' { 2 } else { 1 };
+                }
+                pos = (pos + 1).min(range.end);
+                TokenKind::String
+            }
+            b'!' | b',' | b':' if !flags => {
+                flags = b == b':';
+                TokenKind::Operator
+            }
+            _ => {
+                let stop = |b: u8| {
+                    matches!(b, b' ' | b'\t' | b'\r' | b'\n')
+                        || (!flags && matches!(b, b'!' | b',' | b':'))
+                };
+                while pos < range.end && !stop(text[pos]) {
+                    pos += 1;
+                }
+                if flags {
+                    TokenKind::String
+                } else if text.get(pos) == Some(&b':') {
+                    TokenKind::PropertyName
+                } else {
+                    TokenKind::Identifier
+                }
+            }
+        };
+        tokens.push(Token::new(kind, start..pos));
+    }
+}
+
+/// Whether a statement may start after `tokens`: after a brace, a `;`, or the `:` of a
+/// case clause or label, or on a new line after a token that ends a statement, where Go
+/// inserts a semicolon.
+fn starts_statement(text: &[u8], tokens: &[Token]) -> bool {
+    let mut newline = false;
+    for token in tokens.iter().rev() {
+        let s = &text[token.span.clone()];
+        if token.kind.is_trivia() {
+            newline |= s.contains(&b'\n');
+            continue;
+        }
+        return matches!(s, b"{" | b"}" | b";" | b":")
+            || newline
+                && match token.kind {
+                    TokenKind::Operator => matches!(s, b")" | b"]" | b"++" | b"--"),
+                    TokenKind::Keyword => {
+                        matches!(s, b"break" | b"continue" | b"fallthrough" | b"return")
+                    }
+                    _ => true,
+                };
+    }
+    false
+}
+
+/// Whether the identifier that ends at `pos`, after `tokens`, is a label: the target of a
+/// `break`, `continue` or `goto` on the same line, or followed by a `:` where a statement
+/// starts. `in_block` is whether the identifier is directly in a block.
+fn is_label(text: &[u8], tokens: &[Token], pos: usize, in_block: bool) -> bool {
+    if text[pos..].starts_with(b":") && !text[pos..].starts_with(b":=") {
+        return in_block && starts_statement(text, tokens);
+    }
+    let blank =
+        |t: &&Token| t.kind == TokenKind::Whitespace && !text[t.span.clone()].contains(&b'\n');
+    tokens.iter().rev().find(|t| !blank(t)).is_some_and(|t| {
+        t.kind == TokenKind::Keyword
+            && matches!(&text[t.span.clone()], b"break" | b"continue" | b"goto")
+    })
+}
+
+/// Whether the identifier that ends at `pos`, after `tokens`, is declared or assigned there,
+/// which shadows a predeclared name like `len` or `string`: the target of `:=` or `=` at the
+/// start of a statement or in the header of an `if`, `for` or `switch`, a name after `var`
+/// or `const`, or a parameter name if `params` says the identifier is directly in the
+/// parentheses of a `func`, like `len` in `func f(len int)` but not `string` in
+/// `func f(string)`. Names in lists like `a, len :=` count, too.
+fn declares(text: &[u8], tokens: &[Token], pos: usize, params: bool) -> bool {
+    let skip =
+        |pos: usize| pos + text[pos..].iter().take_while(|&&b| matches!(b, b' ' | b'\t')).count();
+    let mut after = skip(pos);
+    while text.get(after) == Some(&b',') {
+        let name = skip(after + 1);
+        if !text.get(name).is_some_and(|&b| is_ident_start(b))
+            && !is_unicode_ident_start(text, name, UnicodeIdents::Letters)
+        {
+            break;
+        }
+        after = skip(ident_end(text, name, UnicodeIdents::Letters, is_ident_continue));
+    }
+    let rest = &text[after..];
+    let assigned = rest.starts_with(b":=") || (rest.starts_with(b"=") && !rest.starts_with(b"=="));
+
+    // The token before the list the identifier is in.
+    let significant = |end: usize| tokens[..end].iter().rposition(|t| !t.kind.is_trivia());
+    let mut head = significant(tokens.len());
+    while let Some(comma) = head.filter(|&h| &text[tokens[h].span.clone()] == b",") {
+        match significant(comma) {
+            Some(name) if tokens[name].kind == TokenKind::Identifier => head = significant(name),
+            _ => break,
+        }
+    }
+    match head.map_or(&b""[..], |h| &text[tokens[h].span.clone()]) {
+        b"var" | b"const" => true,
+        b"if" | b"for" | b"switch" | b"case" => assigned,
+        b"(" | b"," if params => rest.first().is_some_and(|&b| {
+            is_ident_start(b) || b >= 0x80 || matches!(b, b'*' | b'[' | b'.' | b'<')
+        }),
+        _ => assigned && starts_statement(text, &tokens[..head.map_or(0, |h| h + 1)]),
+    }
+}
+
+/// Whether the `{` after `tokens` opens a block, rather than a composite literal or the body
+/// of a struct or interface type. The `{` that ends the header of an `if`, `for`, `switch` or
+/// `func` is handled by the caller, since `if x {` and `Point{` look alike otherwise.
+/// `in_block` is whether the `{` is directly in a block, where it may open a nested one.
+fn opens_block(text: &[u8], tokens: &[Token], in_block: bool) -> bool {
+    let mut newline = false;
+    let prev = tokens.iter().rev().find(|t| {
+        newline |= t.kind.is_trivia() && text[t.span.clone()].contains(&b'\n');
+        !t.kind.is_trivia()
+    });
+    let Some(prev) = prev else {
+        return false;
+    };
+    match &text[prev.span.clone()] {
+        b")" => true,
+        b"struct" | b"interface" => false,
+        b"{" | b";" | b":" => in_block,
+        // A nested block on a new line, but the literal in `struct{ A int }{A: 1}`.
+        b"}" => in_block && newline,
+        _ if prev.kind == TokenKind::Keyword => true,
+        _ => in_block && newline,
+    }
+}
+
+/// Lexes the struct tag `text[start..end]`, a closed raw string like
+/// `` `json:"name,omitempty" xml:"name,attr"` ``, into its keys as property names, the
+/// colons and commas as operators, the values as strings and the options after the first
+/// comma as keywords. From the first pair that isn't `key:"value"`, like one whose quote is
+/// never closed, the rest of the tag is a string, as the whole tag was before.
+fn struct_tag(text: &[u8], start: usize, end: usize, tokens: &mut Vec<Token>) {
+    tokens.push(Token::new(TokenKind::String, start..start + 1));
+    let close = end - 1;
+    let mut pos = start + 1;
+
+    while pos < close {
+        let blank = text[pos..close].iter().take_while(|&&b| b == b' ').count();
+        if blank > 0 {
+            tokens.push(Token::new(TokenKind::Whitespace, pos..pos + blank));
+            pos += blank;
+            continue;
+        }
+
+        let key =
+            text[pos..close].iter().take_while(|&&b| b > b' ' && !matches!(b, b':' | b'"')).count();
+        let colon = pos + key;
+        let mut value = colon + 2;
+        while value < close && text[value] != b'"' {
+            value += if text[value] == b'\\' { 2 } else { 1 };
+        }
+        if key == 0 || !text[colon..close].starts_with(b":\"") || value >= close {
+            break;
+        }
+        tokens.push(Token::new(TokenKind::PropertyName, pos..colon));
+        tokens.push(Token::new(TokenKind::Operator, colon..colon + 1));
+
+        // The name is the string up to the first comma, and the options follow it.
+        let quote = colon + 1;
+        let name =
+            text[quote..value].iter().position(|&b| b == b',').map_or(value + 1, |i| quote + i);
+        tokens.push(Token::new(TokenKind::String, quote..name));
+        let mut option = name;
+        while option < value {
+            tokens.push(Token::new(TokenKind::Operator, option..option + 1));
+            let next = text[option + 1..value]
+                .iter()
+                .position(|&b| b == b',')
+                .map_or(value, |i| option + 1 + i);
+            if next > option + 1 {
+                tokens.push(Token::new(TokenKind::Keyword, option + 1..next));
+            }
+            option = next;
+        }
+        if name < value {
+            tokens.push(Token::new(TokenKind::String, value..value + 1));
+        }
+        pos = value + 1;
+    }
+
+    // The closing backtick, or the rest of a malformed tag.
+    tokens.push(Token::new(TokenKind::String, pos..end));
+}
+
+/// Returns the end of the string or rune literal whose quote is at `pos`, and whether it's
+/// closed. Since literals can't span lines, one that isn't closed ends before the newline.
+fn quoted_end(text: &[u8], pos: usize) -> (usize, bool) {
+    let quote = text[pos];
+    let mut pos = pos + 1;
+    while pos < text.len() {
+        match text[pos] {
+            b'\n' => break,
+            b'\\' if text.get(pos + 1).is_some_and(|&b| b != b'\n') => pos += 1,
+            b if b == quote => return (pos + 1, true),
+            _ => {}
+        }
+        pos += 1;
+    }
+    (pos, false)
+}
+
+/// Whether the closed rune literal `literal` holds exactly one character or escape sequence,
+/// unlike `''` or `'ab'`.
+fn is_single_rune(literal: &[u8]) -> bool {
+    let body = &literal[1..literal.len() - 1];
+    let len = match body {
+        [] | [b'\\'] => return false,
+        [b'\\', b'x', ..] => 4,
+        [b'\\', b'u', ..] => 6,
+        [b'\\', b'U', ..] => 10,
+        [b'\\', b'0'..=b'7', ..] => 4,
+        [b'\\', ..] => 2,
+        _ => char_len(body, 0),
+    };
+    body.len() == len
+}
+
+/// Returns the end of the number literal starting at `pos`, and whether it's well-formed.
+/// Like Go's scanner, it takes all digits and underscores in the literal's way, so that
+/// `0b102` and `1__0` are single malformed numbers, but stops before any other letter:
+/// `0x1p2if` is the imaginary `0x1p2i` followed by the identifier `f`.
+fn number_end(text: &[u8], pos: usize) -> (usize, bool) {
+    let start = pos;
+    let mut pos = pos;
+    let mut valid = true;
+    // Returns the end of the digits and underscores at `pos`, and whether there are any
+    // digits, noting digits the base doesn't allow in `invalid_digit`.
+    let digits = |pos: usize, hex: bool, base: u8, invalid_digit: &mut bool| {
+        let end = pos
+            + text[pos..]
+                .iter()
+                .take_while(|&&b| b == b'_' || b.is_ascii_digit() || (hex && b.is_ascii_hexdigit()))
+                .count();
+        let span = &text[pos..end];
+        *invalid_digit |= !hex && span.iter().any(|&b| b != b'_' && b - b'0' >= base);
+        (end, span.iter().any(|&b| b != b'_'))
+    };
+
+    let prefix = match (text[pos], text.get(pos + 1).map(u8::to_ascii_lowercase)) {
+        (b'0', Some(p @ (b'x' | b'o' | b'b'))) => {
+            pos += 2;
+            p
+        }
+        (b'0', _) => b'0',
+        _ => 0,
+    };
+    let (hex, base) = match prefix {
+        b'x' => (true, 16),
+        b'o' | b'0' => (false, 8),
+        b'b' => (false, 2),
+        _ => (false, 10),
+    };
+    let mut invalid_digit = false;
+    let (end, mut has_digits) = digits(pos, hex, base, &mut invalid_digit);
+    pos = end;
+    let mut float = false;
+    if text.get(pos) == Some(&b'.') {
+        float = true;
+        valid &= !matches!(prefix, b'o' | b'b');
+        let (end, fraction) = digits(pos + 1, hex, base, &mut invalid_digit);
+        (pos, has_digits) = (end, has_digits || fraction);
+    }
+    valid &= has_digits;
+
+    match text.get(pos).map(u8::to_ascii_lowercase) {
+        Some(e @ (b'e' | b'p')) => {
+            // `e` needs a decimal mantissa and `p` a hexadecimal one.
+            valid &= if e == b'e' { matches!(prefix, 0 | b'0') } else { prefix == b'x' };
+            float = true;
+            pos += 1;
+            if matches!(text.get(pos), Some(b'+' | b'-')) {
+                pos += 1;
+            }
+            let (end, exponent) = digits(pos, false, 10, &mut false);
+            pos = end;
+            valid &= exponent;
+        }
+        _ => valid &= !(prefix == b'x' && float),
+    }
+    let imaginary = text.get(pos) == Some(&b'i');
+    if imaginary {
+        pos += 1;
+    }
+    // Only integers care about their base: `089` is invalid, but `089.5` and `089i` are fine.
+    valid &= float || imaginary || !invalid_digit;
+    (pos, valid && separated(&text[start..pos]))
+}
+
+/// Returns whether each `_` in the number literal separates two digits, counting the
+/// base prefix as a digit, as in `0x_FF`.
+fn separated(literal: &[u8]) -> bool {
+    let hex = literal.len() >= 2 && literal[0] == b'0' && matches!(literal[1], b'x' | b'X');
+    let prefixed = literal.len() >= 2
+        && literal[0] == b'0'
+        && matches!(literal[1].to_ascii_lowercase(), b'x' | b'o' | b'b');
+    let mut prev = if prefixed { b'0' } else { b'.' };
+    for &b in &literal[if prefixed { 2 } else { 0 }..] {
+        let class = match b {
+            b'_' if prev != b'0' => return false,
+            b'_' => b'_',
+            _ if b.is_ascii_digit() || (hex && b.is_ascii_hexdigit()) => b'0',
+            _ if prev == b'_' => return false,
+            _ => b'.',
+        };
+        prev = class;
+    }
+    prev != b'_'
+}
+
+/// The rules a TextMate grammar can express, for [`export_grammar`](crate::syntax::export_grammar).
+/// The word lists are matched inline in [`GoLexer::tokenize`] for speed, and a test keeps the two
+/// in sync.
+pub(crate) const EXPORT_RULES: ExportRules = ExportRules {
+    strings: &[
+        StringRule {
+            open: "\"",
+            close: "\"",
+            scope: "string.quoted.double",
+            escapes: true,
+            verbs: true,
+            multi_line: false,
+        },
+        StringRule {
+            open: "`",
+            close: "`",
+            scope: "string.quoted.raw",
+            escapes: false,
+            verbs: false,
+            multi_line: true,
+        },
+        StringRule {
+            open: "'",
+            close: "'",
+            scope: "string.quoted.rune",
+            escapes: true,
+            verbs: false,
+            multi_line: false,
+        },
+    ],
+    escapes: r#"\\(?:[abfnrtv\\'"]|[0-7]{3}|x\h{2}|u\h{4}|U\h{8})"#,
+    numbers: r"(?:\b0[xX](?:_?\h)*(?:\.(?:_?\h)*)?(?:[pP][-+]?\d(?:_?\d)*)?|\b0[bB](?:_?[01])+|\b0[oO](?:_?[0-7])+|(?:\b\d(?:_?\d)*(?:\.(?:\d(?:_?\d)*)?)?|(?<![\w.])\.\d(?:_?\d)*)(?:[eE][-+]?\d(?:_?\d)*)?)i?(?!\w)",
+    words: &[
+        ("keyword.control", "", CONTROL_KEYWORDS),
+        ("keyword.other", "", KEYWORDS),
+        ("constant.language", "", &["true", "false", "nil", "iota"]),
+        ("support.type.builtin", "", TYPES),
+        ("support.function.builtin", r"(?=\s*\()", BUILTINS),
+    ],
+    receiver: r"(?:\([^)]*\)\s*)?",
+    operators: r":=|\.\.\.|<<=?|>>=?|&\^=?|&&|\|\||<-|\+\+|--|[-+*/%&|^<>=!]=?|~",
+    context_sensitive: &[
+        "doc comments, which are the comments right above a declaration",
+        "compiler directives like //go:embed, which are comments unless they start a line",
+        "struct tags, which are raw strings after a field in a struct body",
+        "labels, which are only labels where a statement starts in a block",
+        "type parameters, which are type names up to the end of their declaration",
+        "the cgo preamble, which is C in the comment right above import \"C\"",
+        "predeclared names declared again, which are variables until the end of their block",
+        "invalid number literals and escapes, which need the whole literal to be flagged",
+    ],
+};
+
+/// Go's keywords that direct the flow of control.
+pub(crate) const CONTROL_KEYWORDS: &[&str] = &[
+    "break",
+    "case",
+    "continue",
+    "default",
+    "defer",
+    "else",
+    "fallthrough",
+    "for",
+    "go",
+    "goto",
+    "if",
+    "range",
+    "return",
+    "select",
+    "switch",
+];
+
+/// Go's other keywords.
+pub(crate) const KEYWORDS: &[&str] =
+    &["chan", "const", "func", "import", "interface", "map", "package", "struct", "type", "var"];
+
+/// Go's predeclared types and constraints.
+pub(crate) const TYPES: &[&str] = &[
+    "bool",
+    "byte",
+    "complex64",
+    "complex128",
+    "error",
+    "float32",
+    "float64",
+    "int",
+    "int8",
+    "int16",
+    "int32",
+    "int64",
+    "rune",
+    "string",
+    "uint",
+    "uint8",
+    "uint16",
+    "uint32",
+    "uint64",
+    "uintptr",
+    "any",
+    "comparable",
+];
+
+/// Go's built-in functions.
+pub(crate) const BUILTINS: &[&str] = &[
+    "append", "cap", "clear", "close", "complex", "copy", "delete", "imag", "len", "make", "max",
+    "min", "new", "panic", "print", "println", "real", "recover",
+];
+
+/// The keywords of the top-level declarations doc comments document.
+const DECLARATIONS: [&[u8]; 5] = [b"package", b"const", b"func", b"type", b"var"];
+
+/// Turn the comments right above top-level declarations into [`TokenKind::DocComment`]s and
+/// split the markup of Go's doc comments out of them, see [`doc_markup`]. Directives like
+/// `//go:noinline` may stand between a doc comment and its declaration, blank lines may not.
+fn mark_doc_comments(text: &[u8], tokens: &mut Vec<Token>) {
+    let at_line_start = |pos: usize| pos == 0 || text[pos - 1] == b'\n';
+    let mut groups = Vec::new();
+    for i in 0..tokens.len() {
+        let t = &tokens[i];
+        if t.kind != TokenKind::Keyword
+            || !at_line_start(t.span.start)
+            || !DECLARATIONS.contains(&&text[t.span.clone()])
+        {
+            continue;
+        }
+
+        // Walk up the lines above the declaration while each is a comment or a directive.
+        let mut group = Vec::new();
+        let mut next = i;
+        while let Some(newline) = next.checked_sub(1).filter(|&n| {
+            tokens[n].kind == TokenKind::Whitespace
+                && matches!(&text[tokens[n].span.clone()], b"\n" | b"\r\n")
+        }) {
+            let line_start = text[..tokens[newline].span.start]
+                .iter()
+                .rposition(|&b| b == b'\n')
+                .map_or(0, |p| p + 1);
+            let first = tokens.partition_point(|t| t.span.end <= line_start);
+            let t = &tokens[first];
+            if !at_line_start(t.span.start) {
+                break;
+            }
+            match t.kind {
+                TokenKind::Comment if first + 1 == newline => group.push(first),
+                TokenKind::Macro if text[t.span.clone()].starts_with(b"//") => {}
+                _ => break,
+            }
+            next = first;
+        }
+        group.reverse();
+        groups.push(group);
+    }
+
+    let mut marks = Vec::new();
+    for group in groups {
+        for &i in &group {
+            tokens[i].kind = TokenKind::DocComment;
+        }
+        doc_markup(text, tokens, &group, &mut marks);
+    }
+    if marks.is_empty() {
+        return;
+    }
+
+    marks
+        .sort_unstable_by_key(|(i, range, _): &(usize, Range<usize>, DocMarkup)| (*i, range.start));
+    let mut marks = marks.into_iter().peekable();
+    let mut result = Vec::with_capacity(tokens.len() + 2 * marks.len());
+    for (i, token) in tokens.drain(..).enumerate() {
+        if marks.peek().is_none_or(|(j, ..)| *j != i) {
+            result.push(token);
+            continue;
+        }
+        let mut pos = token.span.start;
+        while let Some((_, range, markup)) = marks.next_if(|(j, ..)| *j == i) {
+            if pos < range.start {
+                result.push(Token::new(token.kind, pos..range.start).with_scopes(token.scopes));
+            }
+            pos = range.end;
+            result.push(
+                Token::new(token.kind, range)
+                    .with_scopes(token.scopes)
+                    .with_payload(TokenPayload::DocMarkup(markup)),
+            );
+        }
+        if pos < token.span.end {
+            result.push(Token::new(token.kind, pos..token.span.end).with_scopes(token.scopes));
+        }
+    }
+    *tokens = result;
+}
+
+/// Collects the markup in the lines of the doc comment made of the comment tokens `group`
+/// as `(token, range, markup)`, following `go/doc/comment`:
+/// - a paragraph of one unindented line starting with `# ` is a heading,
+/// - a span of indented lines is a code block, unless it starts with a list marker,
+/// - a paragraph starting with `Deprecated:` is a deprecation notice, and
+/// - `[Name]`, `[pkg.Name]` or `[*path/to/pkg.Type.Method]` links to a declaration, just
+///   like `[text]` does if a line like `[text]: https://...` defines it.
+///
+/// Only `//` comments have markup, `/* */` ones merely end paragraphs.
+fn doc_markup(
+    text: &[u8],
+    tokens: &[Token],
+    group: &[usize],
+    marks: &mut Vec<(usize, Range<usize>, DocMarkup)>,
+) {
+    // The text of each line after the `//` and the one space that conventionally follows it.
+    let lines: Vec<Option<Range<usize>>> = group
+        .iter()
+        .map(|&i| {
+            let span = tokens[i].span.clone();
+            let start = span.start + 2;
+            let start = if text.get(start) == Some(&b' ') { start + 1 } else { start };
+            text[span.clone()].starts_with(b"//").then(|| start.min(span.end)..span.end)
+        })
+        .collect();
+    let line = |n: usize| lines.get(n).cloned().flatten().map(|r| &text[r]);
+    let blank = |n: usize| line(n).is_none_or(|l| l.iter().all(u8::is_ascii_whitespace));
+    let indented = |n: usize| !blank(n) && line(n).is_some_and(|l| matches!(l[0], b' ' | b'\t'));
+
+    let definitions: Vec<&[u8]> = (0..lines.len())
+        .filter(|&n| !indented(n))
+        .filter_map(|n| {
+            let l = line(n)?.strip_prefix(b"[")?;
+            let close = l.iter().position(|&b| b == b']')?;
+            l[close + 1..].starts_with(b": ").then(|| &l[..close])
+        })
+        .collect();
+
+    // Whether the current span of indented lines is a list rather than a code block.
+    let mut list = None;
+    for n in 0..lines.len() {
+        let Some(range) = lines[n].clone() else {
+            list = None;
+            continue;
+        };
+        if blank(n) {
+            continue;
+        }
+        let i = group[n];
+        let content = &text[range.clone()];
+        if indented(n) {
+            let trimmed = content.trim_ascii_start();
+            let is_list = *list.get_or_insert_with(|| is_list_marker(trimmed));
+            if is_list {
+                doc_links(text, range, &definitions, i, marks);
+            } else {
+                marks.push((i, range, DocMarkup::Code));
+            }
+            continue;
+        }
+        list = None;
+
+        let paragraph = n == 0 || blank(n - 1);
+        if paragraph
+            && blank(n + 1)
+            && content.starts_with(b"# ")
+            && !content[2..].trim_ascii().is_empty()
+        {
+            marks.push((
+                i,
+                range.start..range.start + content.trim_ascii_end().len(),
+                DocMarkup::Heading,
+            ));
+            continue;
+        }
+        if paragraph && content.starts_with(b"Deprecated:") {
+            marks.push((i, range.start..range.start + 11, DocMarkup::Deprecated));
+        }
+        doc_links(text, range, &definitions, i, marks);
+    }
+}
+
+/// Returns whether the line starts with the marker of a list item, like `-`, `*`, `+`, `•`,
+/// `1.` or `1)`, followed by a space.
+fn is_list_marker(line: &[u8]) -> bool {
+    let digits = line.iter().take_while(|b| b.is_ascii_digit()).count();
+    let rest = if digits > 0 {
+        match line[digits..].first() {
+            Some(b'.' | b')') => &line[digits + 1..],
+            _ => return false,
+        }
+    } else if let Some(rest) = line.strip_prefix("•".as_bytes()) {
+        rest
+    } else if matches!(line.first(), Some(b'-' | b'*' | b'+')) {
+        &line[1..]
+    } else {
+        return false;
+    };
+    rest.first().is_none_or(|&b| matches!(b, b' ' | b'\t'))
+}
+
+/// Collects the links in the doc comment line `range` of token `i`, see [`doc_markup`].
+fn doc_links(
+    text: &[u8],
+    range: Range<usize>,
+    definitions: &[&[u8]],
+    i: usize,
+    marks: &mut Vec<(usize, Range<usize>, DocMarkup)>,
+) {
+    // Unlike in `a[i]`, the brackets of a link must not touch a word.
+    let apart = |pos: Option<usize>| {
+        pos.filter(|p| range.contains(p)).is_none_or(|p| !is_ident_continue(text[p]))
+    };
+    let mut pos = range.start;
+    while let Some(offset) = text[pos..range.end].iter().position(|&b| b == b'[') {
+        let open = pos + offset;
+        pos = open + 1;
+        let Some(len) = text[pos..range.end].iter().position(|&b| matches!(b, b'[' | b']')) else {
+            break;
+        };
+        let close = pos + len;
+        if text[close] != b']' {
+            continue;
+        }
+        let label = &text[pos..close];
+        if (is_doc_link(label) || definitions.contains(&label))
+            && apart(open.checked_sub(1))
+            && apart(Some(close + 1))
+        {
+            marks.push((i, open..close + 1, DocMarkup::Link));
+            pos = close + 1;
+        }
+    }
+}
+
+/// Returns whether the text between the brackets of `[fmt.Printf]` looks like the name
+/// of a declaration. Since a link to one in the same package needs no qualifier but has
+/// to be exported, a lone name must be capitalized, which leaves out `[i]` and the like.
+fn is_doc_link(label: &[u8]) -> bool {
+    let name = label.strip_prefix(b"*").unwrap_or(label);
+    let qualified = name.iter().any(|&b| matches!(b, b'.' | b'/'));
+    name.first()
+        .is_some_and(|&b| if qualified { is_ident_start(b) } else { b.is_ascii_uppercase() })
+        && name.iter().all(|&b| is_ident_continue(b) || matches!(b, b'.' | b'/'))
+        && !matches!(name.last(), Some(b'.' | b'/'))
+}
+
+/// What the Go lexer knows at the start of a line, with the names it holds on to copied
+/// out of the text.
+#[derive(Clone, Default, PartialEq)]
+pub(crate) struct GoState {
+    depth: usize,
+    overflow: usize,
+    /// The type parameters' names and the bracket depth around their declaration, whose
+    /// list is closed, since its `]` may still change the tokens before it.
+    generic: Option<(Vec<Vec<u8>>, usize)>,
+    structs: Vec<usize>,
+    braces: Vec<(usize, bool)>,
+    headers: Vec<Header>,
+    containers: Vec<(Container, usize)>,
+    /// The names shadowed, whose declaring statements have all ended.
+    shadowed: Vec<(Vec<u8>, usize)>,
+    params: Vec<(Vec<u8>, usize)>,
+}
+
+impl Resumable for GoLexer {
+    type State = GoState;
+
+    fn lex(
+        &self,
+        text: &[u8],
+        mut pos: usize,
+        state: GoState,
+        tokens: &mut Vec<Token>,
+        checkpoints: &mut Checkpoints<GoState>,
+    ) {
+        // The number of open brackets of any kind, up to `max_nesting_depth`, and the ones past it.
+        let mut depth = state.depth;
+        let mut overflow = state.overflow;
+        let mut generic: Option<TypeParams> =
+            state.generic.as_ref().map(|(names, depth)| TypeParams {
+                names: names.iter().map(|name| &name[..]).collect(),
+                depth: *depth,
+                list: None,
+            });
+        // The bracket depths inside the struct bodies the lexer is in.
+        let mut structs: Vec<usize> = state.structs.clone();
+        // The bracket depths inside the open braces, and whether each opens a block.
+        let mut braces: Vec<(usize, bool)> = state.braces.clone();
+        // The `if`, `for`, `switch` and `func` headers whose `{` is to come.
+        let mut headers: Vec<Header> = state.headers.clone();
+        // The containers the lexer is in, with the bracket depth inside each, and the
+        // tokens before `assigned` that are already put in them.
+        let mut containers: Vec<(Container, usize)> = state.containers.clone();
+        let mut assigned = tokens.len();
+        // The predeclared names declared again, like `len` after `len := 5`, with the bracket
+        // depth they're declared at and the offset where the declaring statement ends, so
+        // that `len := len(s)` still calls the built-in, until the block they're in ends.
+        let mut shadowed: Vec<(&[u8], usize, usize)> =
+            state.shadowed.iter().map(|(name, d)| (&name[..], *d, 0)).collect();
+        // The predeclared names declared as parameters, with the bracket depth of their list,
+        // until the body of their function opens, since the signature still uses the originals.
+        let mut params: Vec<(&[u8], usize)> =
+            state.params.iter().map(|(name, d)| (&name[..], *d)).collect();
 
         while pos < text.len() {
             let start = pos;
             let b = text[pos];
+            let scopes = scope_stack(&containers);
+            set_scopes(&mut tokens[assigned..], scopes);
+            assigned = tokens.len();
+
+            // Not in a list of type parameters, whose names change the tokens before its `]`,
+            // or after a comma, before which `declares` looks for the start of a list.
+            if checkpoints.due(text, tokens, pos)
+                && generic.as_ref().is_none_or(|g| g.list.is_none())
+                && !preceding(tokens).take(2).any(|t| &text[t.span.clone()] == b",")
+            {
+                let owned = |names: &[(&[u8], usize)]| {
+                    names.iter().map(|&(name, d)| (name.to_vec(), d)).collect()
+                };
+                let state = GoState {
+                    depth,
+                    overflow,
+                    generic: generic
+                        .as_ref()
+                        .map(|g| (g.names.iter().map(|name| name.to_vec()).collect(), g.depth)),
+                    structs: structs.clone(),
+                    braces: braces.clone(),
+                    headers: headers.clone(),
+                    containers: containers.clone(),
+                    shadowed: owned(
+                        &shadowed.iter().map(|&(name, d, _)| (name, d)).collect::<Vec<_>>(),
+                    ),
+                    params: owned(&params),
+                };
+                // `declares` looks at two tokens, and `opens_type_params` as far back as a `func`
+                // or `type`, like in `func (s *Stack[`.
+                let lookbehind = preceding(tokens)
+                    .take(5)
+                    .position(|t| {
+                        t.kind == TokenKind::Keyword
+                            && matches!(&text[t.span.clone()], b"func" | b"type")
+                    })
+                    .map_or(2, |i| (i + 1).max(2));
+                if checkpoints.report(text, pos, tokens, lookbehind, state) {
+                    return;
+                }
+            }
 
             match b {
                 // Whitespace
@@ -24,10 +1055,27 @@ impl Lexer for GoLexer {
                         pos += 1;
                     }
                     tokens.push(Token::new(TokenKind::Whitespace, start..pos));
+                    if text[start..pos].contains(&b'\n') {
+                        // A generic declaration without a body, like `type List[T any] []T`.
+                        if generic.as_ref().is_some_and(|g| g.depth == depth && g.list.is_none()) {
+                            generic = None;
+                        }
+                        // A function type without one, like `var f func() error`.
+                        if headers.last().is_some_and(|h| h.depth == depth) {
+                            headers.pop();
+                            params.retain(|&(_, d)| d <= depth);
+                        }
+                    }
                 }
 
-                // Line comment
+                // Line comment, a compiler directive that looks like one, or the cgo preamble
                 b'/' if pos + 1 < text.len() && text[pos + 1] == b'/' => {
+                    if let Some(end) = directive(text, pos, tokens)
+                        .or_else(|| cgo_preamble(text, pos, tokens, checkpoints))
+                    {
+                        pos = end;
+                        continue;
+                    }
                     pos += 2;
                     while pos < text.len() && text[pos] != b'\n' {
                         pos += 1;
@@ -35,20 +1083,16 @@ impl Lexer for GoLexer {
                     tokens.push(Token::new(TokenKind::Comment, start..pos));
                 }
 
-                // Block comment
+                // Block comment, or the cgo preamble
                 b'/' if pos + 1 < text.len() && text[pos + 1] == b'*' => {
-                    pos += 2;
-                    while pos + 1 < text.len() {
-                        if text[pos] == b'*' && text[pos + 1] == b'/' {
-                            pos += 2;
-                            break;
-                        }
-                        pos += 1;
+                    if let Some(end) = cgo_preamble(text, pos, tokens, checkpoints) {
+                        pos = end;
+                        continue;
                     }
-                    tokens.push(Token::new(TokenKind::Comment, start..pos));
+                    pos = checkpoints.block_comment(text, start, tokens);
                 }
 
-                // Raw string literal (`...`)
+                // Raw string literal (`...`), or the tag of a struct field
                 b'`' => {
                     pos += 1;
                     while pos < text.len() && text[pos] != b'`' {
@@ -56,158 +1100,207 @@ impl Lexer for GoLexer {
                     }
                     if pos < text.len() {
                         pos += 1; // Skip closing backtick
-                    }
-                    tokens.push(Token::new(TokenKind::String, start..pos));
-                }
-
-                // String literal
-                b'"' => {
-                    pos += 1;
-                    let mut escaped = false;
-                    while pos < text.len() {
-                        if escaped {
-                            escaped = false;
-                        } else if text[pos] == b'\\' {
-                            escaped = true;
-                        } else if text[pos] == b'"' {
-                            pos += 1;
-                            break;
+                        if structs.last() == Some(&depth) {
+                            struct_tag(text, start, pos, tokens);
+                            set_scopes(&mut tokens[assigned..], scopes.push(Container::StructTag));
+                            assigned = tokens.len();
+                            continue;
                         }
-                        pos += 1;
                     }
                     tokens.push(Token::new(TokenKind::String, start..pos));
                 }
 
-                // Rune literal (character)
-                b'\'' => {
-                    pos += 1;
-                    let mut escaped = false;
-                    while pos < text.len() {
-                        if escaped {
-                            escaped = false;
-                        } else if text[pos] == b'\\' {
-                            escaped = true;
-                        } else if text[pos] == b'\'' {
-                            pos += 1;
-                            break;
-                        }
-                        pos += 1;
-                    }
-                    tokens.push(Token::new(TokenKind::Char, start..pos));
+                // String literal, or rune literal (character). Neither may span lines, so an
+                // unterminated one ends at the end of its line.
+                b'"' | b'\'' => {
+                    let closed;
+                    (pos, closed) = quoted_end(text, pos);
+                    let kind = if b == b'"' { TokenKind::String } else { TokenKind::Char };
+                    let valid = closed && (b == b'"' || is_single_rune(&text[start..pos]));
+                    let token = Token::new(kind, start..pos);
+                    tokens.push(if valid {
+                        token
+                    } else {
+                        token.with_payload(TokenPayload::Invalid)
+                    });
                 }
 
-                // Number
-                b'0'..=b'9' => {
-                    // Hex literal
-                    if b == b'0' && pos + 1 < text.len() && (text[pos + 1] == b'x' || text[pos + 1] == b'X') {
-                        pos += 2;
-                        while pos < text.len() && (is_ascii_digit(text[pos]) || matches!(text[pos], b'a'..=b'f' | b'A'..=b'F' | b'_')) {
-                            pos += 1;
-                        }
-                    }
-                    // Octal literal (0o prefix)
-                    else if b == b'0' && pos + 1 < text.len() && (text[pos + 1] == b'o' || text[pos + 1] == b'O') {
-                        pos += 2;
-                        while pos < text.len() && (matches!(text[pos], b'0'..=b'7') || text[pos] == b'_') {
-                            pos += 1;
-                        }
-                    }
-                    // Binary literal
-                    else if b == b'0' && pos + 1 < text.len() && (text[pos + 1] == b'b' || text[pos + 1] == b'B') {
-                        pos += 2;
-                        while pos < text.len() && (text[pos] == b'0' || text[pos] == b'1' || text[pos] == b'_') {
-                            pos += 1;
-                        }
-                    }
-                    // Decimal literal
-                    else {
-                        while pos < text.len() && (is_ascii_digit(text[pos]) || text[pos] == b'_') {
-                            pos += 1;
-                        }
-                        // Float
-                        if pos < text.len() && text[pos] == b'.' && pos + 1 < text.len() && is_ascii_digit(text[pos + 1]) {
-                            pos += 1;
-                            while pos < text.len() && (is_ascii_digit(text[pos]) || text[pos] == b'_') {
-                                pos += 1;
-                            }
-                        }
-                        // Exponent
-                        if pos < text.len() && (text[pos] == b'e' || text[pos] == b'E') {
-                            pos += 1;
-                            if pos < text.len() && (text[pos] == b'+' || text[pos] == b'-') {
-                                pos += 1;
-                            }
-                            while pos < text.len() && (is_ascii_digit(text[pos]) || text[pos] == b'_') {
-                                pos += 1;
-                            }
-                        }
-                    }
-                    // Imaginary suffix (i)
-                    if pos < text.len() && text[pos] == b'i' {
-                        pos += 1;
-                    }
-                    tokens.push(Token::new(TokenKind::Number, start..pos));
+                // Number, including ones that start with the decimal point, like `.5`
+                _ if is_ascii_digit(b)
+                    || (b == b'.' && text.get(pos + 1).is_some_and(|&b| is_ascii_digit(b))) =>
+                {
+                    let valid;
+                    (pos, valid) = number_end(text, pos);
+                    let token = Token::new(TokenKind::Number, start..pos);
+                    tokens.push(if valid {
+                        token
+                    } else {
+                        token.with_payload(TokenPayload::Invalid)
+                    });
                 }
 
                 // Identifier or keyword
-                _ if is_ident_start(b) => {
-                    while pos < text.len() && (is_ident_continue(text[pos]) || text[pos] == b'_') {
-                        pos += 1;
-                    }
+                _ if is_ident_start(b)
+                    || is_unicode_ident_start(text, pos, UnicodeIdents::Letters) =>
+                {
+                    pos = ident_end(text, pos, UnicodeIdents::Letters, is_ident_continue);
                     let word = &text[start..pos];
+                    let called =
+                        text[pos..].iter().find(|&&b| !matches!(b, b' ' | b'\t')) == Some(&b'(');
                     let kind = match word {
+                        // Predeclared by later versions than the one being lexed
+                        b"any" | b"comparable" if self.version < GoVersion::Go1_18 => {
+                            TokenKind::Identifier
+                        }
+                        b"clear" | b"max" | b"min" if self.version < GoVersion::Go1_21 => {
+                            TokenKind::Identifier
+                        }
+
                         // Go keywords
-                        b"break" | b"case" | b"chan" | b"const" | b"continue" |
-                        b"default" | b"defer" | b"else" | b"fallthrough" | b"for" |
-                        b"func" | b"go" | b"goto" | b"if" | b"import" | b"interface" |
-                        b"map" | b"package" | b"range" | b"return" | b"select" |
-                        b"struct" | b"switch" | b"type" | b"var" => TokenKind::Keyword,
-                        
+                        b"break" | b"case" | b"chan" | b"const" | b"continue" | b"default"
+                        | b"defer" | b"else" | b"fallthrough" | b"for" | b"func" | b"go"
+                        | b"goto" | b"if" | b"import" | b"interface" | b"map" | b"package"
+                        | b"range" | b"return" | b"select" | b"struct" | b"switch" | b"type"
+                        | b"var" => TokenKind::Keyword,
+
                         // Boolean literals
                         b"true" | b"false" => TokenKind::Boolean,
-                        
+
                         // Nil
                         b"nil" => TokenKind::Boolean,
-                        
+
                         // Built-in types
-                        b"bool" | b"byte" | b"complex64" | b"complex128" | b"error" |
-                        b"float32" | b"float64" | b"int" | b"int8" | b"int16" |
-                        b"int32" | b"int64" | b"rune" | b"string" | b"uint" |
-                        b"uint8" | b"uint16" | b"uint32" | b"uint64" | b"uintptr" => TokenKind::TypeName,
-                        
+                        b"bool" | b"byte" | b"complex64" | b"complex128" | b"error"
+                        | b"float32" | b"float64" | b"int" | b"int8" | b"int16" | b"int32"
+                        | b"int64" | b"rune" | b"string" | b"uint" | b"uint8" | b"uint16"
+                        | b"uint32" | b"uint64" | b"uintptr" => TokenKind::TypeName,
+
                         // Built-in functions
-                        b"append" | b"cap" | b"close" | b"complex" | b"copy" |
-                        b"delete" | b"imag" | b"len" | b"make" | b"new" |
-                        b"panic" | b"print" | b"println" | b"real" | b"recover" => TokenKind::FunctionName,
-                        
+                        b"append" | b"cap" | b"clear" | b"close" | b"complex" | b"copy"
+                        | b"delete" | b"imag" | b"len" | b"make" | b"max" | b"min" | b"new"
+                        | b"panic" | b"print" | b"println" | b"real" | b"recover" => {
+                            TokenKind::FunctionName
+                        }
+
                         // Special identifiers
                         b"iota" => TokenKind::Keyword,
-                        
+
+                        // Predeclared constraints
+                        b"any" | b"comparable" => TokenKind::TypeName,
+
                         _ => TokenKind::Identifier,
                     };
+                    // Predeclared names may be declared again, like `len := 5` or `func f(string string)`,
+                    // which turns them into variables until the end of the block. Built-in functions
+                    // can't be used as values, so one that isn't called is a variable, too.
+                    let prev = preceding(tokens).next();
+                    let predeclared = matches!(kind, TokenKind::TypeName | TokenKind::FunctionName)
+                        && prev.is_none_or(|t| &text[t.span.clone()] != b".");
+                    let in_params = headers.last().is_some_and(|h| h.depth + 1 == depth);
+                    let kind = if predeclared && declares(text, tokens, pos, in_params) {
+                        if in_params {
+                            params.push((word, depth));
+                        } else {
+                            let end = text[pos..]
+                                .iter()
+                                .position(|&b| matches!(b, b'\n' | b';'))
+                                .map_or(text.len(), |n| pos + n);
+                            shadowed.push((word, depth, end));
+                        }
+                        TokenKind::Identifier
+                    } else if (predeclared
+                        && shadowed
+                            .iter()
+                            .any(|&(name, d, end)| name == word && depth >= d && start >= end))
+                        || (kind == TokenKind::FunctionName && !called)
+                    {
+                        TokenKind::Identifier
+                    } else {
+                        kind
+                    };
+                    if matches!(word, b"if" | b"for" | b"switch" | b"func")
+                        && headers.len() < self.max_nesting_depth
+                    {
+                        let func = word == b"func";
+                        // A method's receiver comes first, as in `func (s *Stack) Push(`.
+                        let method = func
+                            && (start == 0 || text[start - 1] == b'\n')
+                            && text[pos..].iter().find(|&&b| !matches!(b, b' ' | b'\t'))
+                                == Some(&b'(');
+                        let lists: &[Container] = match (func, method) {
+                            (true, true) => {
+                                &[Container::Receiver, Container::Parameters, Container::Results]
+                            }
+                            (true, false) => &[Container::Parameters, Container::Results],
+                            _ => &[],
+                        };
+                        headers.push(Header { depth, func, lists });
+                    }
+                    let kind = match &mut generic {
+                        Some(params) if kind == TokenKind::Identifier => {
+                            let prev = preceding(tokens).next();
+                            let prev = prev.map_or(&b""[..], |t| &text[t.span.clone()]);
+                            // A name at the start of the list or after a comma declares one.
+                            if params.list.is_some_and(|(list, _)| list == depth)
+                                && matches!(prev, b"[" | b",")
+                            {
+                                params.names.push(word);
+                                TokenKind::TypeName
+                            } else if params.names.contains(&word) && prev != b"." {
+                                TokenKind::TypeName
+                            } else {
+                                kind
+                            }
+                        }
+                        _ => kind,
+                    };
+                    let in_block = braces.last() == Some(&(depth, true));
+                    let kind =
+                        if kind == TokenKind::Identifier && is_label(text, tokens, pos, in_block) {
+                            TokenKind::Label
+                        } else {
+                            kind
+                        };
                     tokens.push(Token::new(kind, start..pos));
                 }
 
                 // Operators and punctuation
-                b'+' | b'-' | b'*' | b'/' | b'%' | b'=' | b'!' | b'<' | b'>' |
-                b'&' | b'|' | b'^' | b'~' | b'?' | b':' | b'.' | b',' | b';' |
-                b'(' | b')' | b'{' | b'}' | b'[' | b']' => {
+                b'+' | b'-' | b'*' | b'/' | b'%' | b'=' | b'!' | b'<' | b'>' | b'&' | b'|'
+                | b'^' | b'~' | b'?' | b':' | b'.' | b',' | b';' | b'(' | b')' | b'{' | b'}'
+                | b'[' | b']' => {
                     pos += 1;
                     // Handle multi-character operators
                     if pos < text.len() {
                         match (b, text[pos]) {
-                            (b'+', b'+') | (b'-', b'-') | (b'+', b'=') | (b'-', b'=') |
-                            (b'*', b'=') | (b'/', b'=') | (b'%', b'=') | (b'=', b'=') |
-                            (b'!', b'=') | (b'<', b'<') | (b'>', b'>') | (b'<', b'=') |
-                            (b'>', b'=') | (b'&', b'&') | (b'|', b'|') | (b'&', b'=') |
-                            (b'|', b'=') | (b'^', b'=') | (b'<', b'-') | (b':', b'=') |
-                            (b'.', b'.') => {
+                            (b'+', b'+')
+                            | (b'-', b'-')
+                            | (b'+', b'=')
+                            | (b'-', b'=')
+                            | (b'*', b'=')
+                            | (b'/', b'=')
+                            | (b'%', b'=')
+                            | (b'=', b'=')
+                            | (b'!', b'=')
+                            | (b'<', b'<')
+                            | (b'>', b'>')
+                            | (b'<', b'=')
+                            | (b'>', b'=')
+                            | (b'&', b'&')
+                            | (b'|', b'|')
+                            | (b'&', b'=')
+                            | (b'|', b'=')
+                            | (b'^', b'=')
+                            | (b'<', b'-')
+                            | (b':', b'=')
+                            | (b'.', b'.') => {
                                 pos += 1;
                                 // Handle three-character operators
                                 if pos < text.len() {
                                     match (b, text[pos - 1], text[pos]) {
-                                        (b'<', b'<', b'=') | (b'>', b'>', b'=') |
-                                        (b'.', b'.', b'.') | (b'&', b'^', b'=') => {
+                                        (b'<', b'<', b'=')
+                                        | (b'>', b'>', b'=')
+                                        | (b'.', b'.', b'.')
+                                        | (b'&', b'^', b'=') => {
                                             pos += 1;
                                         }
                                         _ => {}
@@ -218,16 +1311,135 @@ impl Lexer for GoLexer {
                         }
                     }
                     tokens.push(Token::new(TokenKind::Operator, start..pos));
+
+                    match b {
+                        b'(' | b'[' | b'{' if depth >= self.max_nesting_depth => overflow += 1,
+                        b')' | b']' | b'}' if overflow > 0 => overflow -= 1,
+                        b'[' if generic.is_none() => {
+                            if let Some(receiver) =
+                                opens_type_params(text, &tokens[..tokens.len() - 1], start)
+                            {
+                                let outer = if receiver { depth - 1 } else { depth };
+                                generic = Some(TypeParams {
+                                    names: Vec::new(),
+                                    depth: outer,
+                                    list: Some((depth + 1, tokens.len())),
+                                });
+                                containers.push((Container::TypeParameters, depth + 1));
+                            }
+                            depth += 1;
+                        }
+                        b'{' => {
+                            let before = &tokens[..tokens.len() - 1];
+                            let prev = preceding(before).next();
+                            let prev = prev.map_or(&b""[..], |t| &text[t.span.clone()]);
+                            if prev == b"struct" {
+                                structs.push(depth + 1);
+                            }
+                            let (block, container) = match headers.pop_if(|h| h.depth == depth) {
+                                Some(header) => {
+                                    shadowed
+                                        .extend(params.drain(..).map(|(name, d)| (name, d, start)));
+                                    (
+                                        true,
+                                        Some(if header.func {
+                                            Container::FunctionBody
+                                        } else {
+                                            Container::Block
+                                        }),
+                                    )
+                                }
+                                None => {
+                                    let block = opens_block(
+                                        text,
+                                        before,
+                                        braces.last() == Some(&(depth, true)),
+                                    );
+                                    let container = match prev {
+                                        _ if block => Some(Container::Block),
+                                        b"struct" => Some(Container::StructBody),
+                                        b"interface" => Some(Container::InterfaceBody),
+                                        _ => None,
+                                    };
+                                    (block, container)
+                                }
+                            };
+                            if let Some(container) = container {
+                                containers.push((container, depth + 1));
+                            }
+                            braces.push((depth + 1, block));
+                            depth += 1;
+                        }
+                        b'(' => {
+                            if let Some(header) = headers.last_mut().filter(|h| h.depth == depth)
+                                && let Some((&list, rest)) = header.lists.split_first()
+                            {
+                                containers.push((list, depth + 1));
+                                header.lists = rest;
+                            }
+                            depth += 1;
+                        }
+                        b'[' => depth += 1,
+                        b')' | b']' | b'}' => {
+                            if b == b'}' && structs.last() == Some(&depth) {
+                                structs.pop();
+                            }
+                            if b == b'}'
+                                && braces.last().is_some_and(|&(inside, _)| inside == depth)
+                            {
+                                braces.pop();
+                            }
+                            depth = depth.saturating_sub(1);
+                            // The bracket is part of the container it closes.
+                            set_scopes(&mut tokens[assigned..], scopes);
+                            assigned = tokens.len();
+                            while containers.pop_if(|&mut (_, inside)| inside > depth).is_some() {}
+                            // A `func` type in parentheses, like the parameter in `func(f func()) {`.
+                            while let Some(header) = headers.pop_if(|header| header.depth > depth) {
+                                params.retain(|&(_, d)| d <= header.depth);
+                            }
+                            if b == b'}' {
+                                shadowed.retain(|&(_, d, _)| d <= depth);
+                            }
+                            if let Some(params) = &mut generic {
+                                match params.list {
+                                    // Constraints may use the names before they're declared,
+                                    // as in `[S ~[]E, E any]`.
+                                    Some((list, first)) if b == b']' && depth + 1 == list => {
+                                        for token in &mut tokens[first..] {
+                                            if token.kind == TokenKind::Identifier
+                                                && params.names.contains(&&text[token.span.clone()])
+                                            {
+                                                token.kind = TokenKind::TypeName;
+                                            }
+                                        }
+                                        params.list = None;
+                                    }
+                                    None if b == b'}' && depth == params.depth => generic = None,
+                                    _ => {}
+                                }
+                            }
+                        }
+                        _ => {}
+                    }
                 }
 
                 // Unknown character
                 _ => {
-                    pos += 1;
+                    pos += char_len(text, pos);
                     tokens.push(Token::new(TokenKind::Error, start..pos));
                 }
             }
         }
 
-        tokens
+        set_scopes(&mut tokens[assigned..], scope_stack(&containers));
+    }
+
+    fn finish(&self, text: &[u8], tokens: &mut Vec<Token>) {
+        mark_doc_comments(text, tokens);
+    }
+
+    fn needs_whole_text(&self) -> bool {
+        true
     }
 }
@@ -0,0 +1,202 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//! Go `text/template` and `html/template` lexer.
+//!
+//! Templates are HTML with `{{ ... }}` actions in between. The HTML is lexed as an
+//! [`EmbeddedRegion`] with the actions carved out, so an action in an attribute value
+//! like `<a href="/u/{{.ID}}">` splits the string around it, and the actions are lexed here:
+//! the trim markers `{{-` and `-}}`, keywords, the pipe, fields like `.User.Name`,
+//! variables like `$x`, literals and `{{/* comments */}}`.
+//!
+//! An action needs its `}}` before the next `{{`. If it hasn't got one, it ends with
+//! its line and its `{{` is flagged [`TokenPayload::Invalid`], so that the HTML after it
+//! is still HTML.
+
+use std::ops::Range;
+
+use crate::syntax::lexer::{
+    Language, Lexer, UnicodeIdents, char_len, ident_end, is_ident_continue, is_ident_start,
+    is_unicode_ident_start,
+};
+use crate::syntax::{EmbeddedRegion, RegionEnd, Token, TokenKind, TokenPayload};
+
+pub struct GoTemplateLexer;
+
+impl Lexer for GoTemplateLexer {
+    fn tokenize(&self, text: &[u8]) -> Vec<Token> {
+        let mut tokens = Vec::with_capacity(text.len() / 8);
+        EmbeddedRegion::new(Language::Html, 0, RegionEnd::At(text.len()))
+            .interpolation_with(b"{{", action_end)
+            .tokenize_with(text, &mut tokens, |range, tokens| action(text, range, tokens));
+        tokens
+    }
+}
+
+/// The keywords that control the flow of a template.
+const CONTROL_KEYWORDS: &[&[u8]] =
+    &[b"if", b"else", b"end", b"range", b"with", b"break", b"continue"];
+
+/// The keywords that define and call templates.
+const TEMPLATE_KEYWORDS: &[&[u8]] = &[b"define", b"template", b"block"];
+
+/// Returns the end of the action whose `{{` is at `pos`, after its `}}`, looking no further
+/// than `limit`. Without a `}}` before the next `{{`, the action ends with its line.
+fn action_end(text: &[u8], pos: usize, limit: usize) -> usize {
+    let line_end = text[pos..limit].iter().position(|&b| b == b'\n').map_or(limit, |i| pos + i);
+    let mut i = pos + 2;
+    while i < limit {
+        match text[i] {
+            b'}' if text.get(i + 1) == Some(&b'}') && i + 1 < limit => return i + 2,
+            b'{' if text.get(i + 1) == Some(&b'{') => return line_end,
+            b'/' if text.get(i + 1) == Some(&b'*') => {
+                i = text[i + 2..limit]
+                    .windows(2)
+                    .position(|w| w == b"*/")
+                    .map_or(limit, |j| i + j + 4);
+            }
+            quote @ (b'"' | b'\'' | b'`') => i = quoted_end(text, i, limit, quote),
+            _ => i += 1,
+        }
+    }
+    line_end
+}
+
+/// Returns the end of the string, raw string or character starting at `pos`.
+/// Only raw strings may span lines.
+fn quoted_end(text: &[u8], pos: usize, limit: usize, quote: u8) -> usize {
+    let mut i = pos + 1;
+    while i < limit {
+        match text[i] {
+            b if b == quote => return i + 1,
+            b'\\' if quote != b'`' => i += 2,
+            b'\n' if quote != b'`' => return i,
+            _ => i += 1,
+        }
+    }
+    limit
+}
+
+/// Lexes the action in `range`, delimiters and all.
+fn action(text: &[u8], range: Range<usize>, tokens: &mut Vec<Token>) {
+    let action = &text[..range.end];
+    let terminated = action[range.start + 2..].ends_with(b"}}");
+
+    // A `-` trims the whitespace around the action if a space separates it from the
+    // rest, so that `{{-3}}` is the number -3.
+    let mut open = range.start + 2;
+    if action[open..].starts_with(b"- ") {
+        open += 1;
+    }
+    let mut close = range.end;
+    if terminated {
+        close -= 2;
+        if close > open + 1 && action[close - 1] == b'-' && action[close - 2] == b' ' {
+            close -= 1;
+        }
+    }
+
+    let delimiter = Token::new(TokenKind::Punctuation, range.start..open);
+    tokens.push(if terminated { delimiter } else { delimiter.with_payload(TokenPayload::Invalid) });
+    pipeline(&text[..close], open, tokens);
+    if terminated {
+        tokens.push(Token::new(TokenKind::Punctuation, close..range.end));
+    }
+}
+
+/// Lexes the inside of an action, from `pos` to the end of `text`.
+fn pipeline(text: &[u8], mut pos: usize, tokens: &mut Vec<Token>) {
+    while pos < text.len() {
+        let start = pos;
+        let b = text[pos];
+        pos += 1;
+
+        let kind = match b {
+            b' ' | b'\t' | b'\r' | b'\n' => {
+                while pos < text.len() && matches!(text[pos], b' ' | b'\t' | b'\r' | b'\n') {
+                    pos += 1;
+                }
+                TokenKind::Whitespace
+            }
+            b'/' if text.get(pos) == Some(&b'*') => {
+                pos = text[pos + 1..]
+                    .windows(2)
+                    .position(|w| w == b"*/")
+                    .map_or(text.len(), |i| pos + i + 3);
+                TokenKind::Comment
+            }
+            b'"' | b'`' => {
+                pos = quoted_end(text, start, text.len(), b);
+                TokenKind::String
+            }
+            b'\'' => {
+                pos = quoted_end(text, start, text.len(), b);
+                TokenKind::Char
+            }
+            b'0'..=b'9' => {
+                pos = number_end(text, pos);
+                TokenKind::Number
+            }
+            b'-' | b'+' if text.get(pos).is_some_and(u8::is_ascii_digit) => {
+                pos = number_end(text, pos + 1);
+                TokenKind::Number
+            }
+            // A field or method, like `.Name` in `.User.Name`, or the dot on its own.
+            b'.' if is_word_start(text, pos) => {
+                pos = word_end(text, pos);
+                TokenKind::PropertyName
+            }
+            b'.' => TokenKind::VariableName,
+            b'$' => {
+                pos = word_end(text, pos);
+                TokenKind::VariableName
+            }
+            b':' if text.get(pos) == Some(&b'=') => {
+                pos += 1;
+                TokenKind::Operator
+            }
+            b'|' | b'=' | b'(' | b')' | b',' => TokenKind::Operator,
+            _ if is_word_start(text, start) => {
+                pos = word_end(text, start);
+                match &text[start..pos] {
+                    b"true" | b"false" => TokenKind::Boolean,
+                    b"nil" => TokenKind::Null,
+                    word if CONTROL_KEYWORDS.contains(&word) => TokenKind::KeywordControl,
+                    word if TEMPLATE_KEYWORDS.contains(&word) => TokenKind::Keyword,
+                    // Every other word names a function, like `len` or `printf`.
+                    _ => TokenKind::FunctionName,
+                }
+            }
+            _ => {
+                pos = start + char_len(text, start);
+                TokenKind::Error
+            }
+        };
+        tokens.push(Token::new(kind, start..pos));
+    }
+}
+
+/// Whether a word starts at `pos`. Words are Go identifiers, including non-ASCII letters.
+fn is_word_start(text: &[u8], pos: usize) -> bool {
+    text.get(pos).is_some_and(|&b| {
+        is_ident_start(b)
+            || (b >= 0x80 && is_unicode_ident_start(text, pos, UnicodeIdents::Letters))
+    })
+}
+
+fn word_end(text: &[u8], pos: usize) -> usize {
+    ident_end(text, pos, UnicodeIdents::Letters, is_ident_continue)
+}
+
+/// Returns the end of the number continuing at `pos`, like `0x1F`, `1_000`, `1.5e-3` or `2i`.
+fn number_end(text: &[u8], mut pos: usize) -> usize {
+    while pos < text.len() {
+        match text[pos] {
+            b'+' | b'-' if matches!(text[pos - 1], b'e' | b'E' | b'p' | b'P') => pos += 1,
+            b'.' if text.get(pos + 1).is_some_and(u8::is_ascii_digit) => pos += 1,
+            b if is_ident_continue(b) => pos += 1,
+            _ => break,
+        }
+    }
+    pos
+}
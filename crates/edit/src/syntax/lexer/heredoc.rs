@@ -0,0 +1,110 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//! Heredocs, strings whose delimiter is whatever word the code chose where they begin.
+//!
+//! In `cat <<EOF`, the `EOF` is captured and the string starts on the next line, running
+//! up to the first line that is just that word. A lexer [`push`](Heredocs::push)es a
+//! [`Heredoc`] with the captured delimiter when it sees one begin, goes on with the rest
+//! of the line, and calls [`Heredocs::bodies`] after the line's `\n`. Several heredocs can
+//! begin on one line, like `cat <<A <<B`, and their bodies follow one after the other.
+//!
+//! The bodies are [`TokenKind::String`] tokens, or whatever the [`Interpolation`] makes of
+//! them for heredocs that expand variables, and the delimiters ending them are
+//! [`TokenKind::Punctuation`] tokens. A heredoc that runs to the end of the text without
+//! its delimiter has the delimiter where it began flagged [`TokenPayload::Invalid`].
+
+use std::ops::Range;
+
+use crate::syntax::{Token, TokenKind, TokenPayload};
+
+/// Lexes the `range` of a heredoc's body that expands variables, like `$HOME` in an
+/// unquoted shell heredoc, pushing tokens that cover all of it.
+pub(crate) type Interpolation = fn(text: &[u8], range: Range<usize>, tokens: &mut Vec<Token>);
+
+/// A heredoc whose body has yet to be lexed.
+pub(crate) struct Heredoc {
+    /// The line that ends the heredoc, like `EOF` for `<<'EOF'`, without any quotes.
+    pub delimiter: Vec<u8>,
+    /// Whether tabs at the start of the ending line are ignored, like for shell's `<<-`.
+    pub strip_tabs: bool,
+    /// How the body expands variables, or `None` if it's all text, like for `<<'EOF'`.
+    pub interpolation: Option<Interpolation>,
+    /// The index of the token of the delimiter where the heredoc began.
+    pub opener: usize,
+}
+
+/// The heredocs that began on the current line, in order.
+#[derive(Default)]
+pub(crate) struct Heredocs(Vec<Heredoc>);
+
+impl Heredocs {
+    pub fn push(&mut self, heredoc: Heredoc) {
+        self.0.push(heredoc);
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.0.is_empty()
+    }
+
+    /// Lexes the bodies of the pending heredocs from `pos`, the start of the line after
+    /// the one they began on, and returns the end of the last one's ending delimiter,
+    /// leaving the `\n` after it to the lexer.
+    pub fn bodies(&mut self, text: &[u8], mut pos: usize, tokens: &mut Vec<Token>) -> usize {
+        let mut heredocs = std::mem::take(&mut self.0).into_iter().peekable();
+        while let Some(heredoc) = heredocs.next() {
+            pos = body(text, pos, &heredoc, tokens);
+            // The line ending after a delimiter, which is `\r\n` or `\n`.
+            if heredocs.peek().is_some() && pos < text.len() {
+                let end = pos + if text[pos..].starts_with(b"\r\n") { 2 } else { 1 };
+                tokens.push(Token::new(TokenKind::Whitespace, pos..end));
+                pos = end;
+            }
+        }
+        pos
+    }
+}
+
+/// Lexes the body of `heredoc` from `start` up to and including its ending delimiter, and
+/// returns the end of that.
+fn body(text: &[u8], start: usize, heredoc: &Heredoc, tokens: &mut Vec<Token>) -> usize {
+    // The line break at the end is whitespace, like it is after any other token, as are
+    // the tabs before the delimiter up to `delimiter`.
+    let push_body = |tokens: &mut Vec<Token>, end: usize, delimiter: usize| {
+        let body = start..end - text[start..end].ends_with(b"\n") as usize;
+        if !body.is_empty() {
+            match heredoc.interpolation {
+                Some(interpolation) => interpolation(text, body.clone(), tokens),
+                None => tokens.push(Token::new(TokenKind::String, body.clone())),
+            }
+        }
+        if body.end < delimiter {
+            tokens.push(Token::new(TokenKind::Whitespace, body.end..delimiter));
+        }
+    };
+
+    let mut line = start;
+    while line < text.len() {
+        let line_end =
+            text[line..].iter().position(|&b| b == b'\n').map_or(text.len(), |i| line + i);
+        let tabs = if heredoc.strip_tabs {
+            text[line..line_end].iter().take_while(|&&b| b == b'\t').count()
+        } else {
+            0
+        };
+        // Only the whole line ends the heredoc, not the delimiter somewhere in it.
+        let content = line_end - (text[line + tabs..line_end].ends_with(b"\r") as usize);
+        if text[line + tabs..content] == heredoc.delimiter[..] {
+            push_body(tokens, line, line + tabs);
+            tokens.push(Token::new(TokenKind::Punctuation, line + tabs..content));
+            return content;
+        }
+        line = line_end + 1;
+    }
+
+    push_body(tokens, text.len(), text.len());
+    if let Some(opener) = tokens.get_mut(heredoc.opener) {
+        opener.payload = Some(TokenPayload::Invalid);
+    }
+    text.len()
+}
@@ -3,17 +3,26 @@
 
 //! High-performance HTML lexer with full language support.
 
-use crate::syntax::lexer::{Lexer, is_whitespace};
-use crate::syntax::{Token, TokenKind};
+use crate::syntax::lexer::{Checkpoints, Language, Resumable, is_whitespace};
+use crate::syntax::{EmbeddedRegion, RegionEnd, Token, TokenKind};
 
 pub struct HtmlLexer;
 
-impl Lexer for HtmlLexer {
-    fn tokenize(&self, text: &[u8]) -> Vec<Token> {
-        let mut tokens = Vec::with_capacity(text.len() / 8);
-        let mut pos = 0;
+impl Resumable for HtmlLexer {
+    type State = ();
 
+    fn lex(
+        &self,
+        text: &[u8],
+        mut pos: usize,
+        _: (),
+        tokens: &mut Vec<Token>,
+        checkpoints: &mut Checkpoints<()>,
+    ) {
         while pos < text.len() {
+            if checkpoints.due(text, tokens, pos) && checkpoints.report(text, pos, tokens, 0, ()) {
+                return;
+            }
             let start = pos;
             let b = text[pos];
 
@@ -27,10 +36,10 @@ impl Lexer for HtmlLexer {
                 }
 
                 // HTML Comment
-                b'<' if pos + 3 < text.len() && &text[pos..pos+4] == b"<!--" => {
+                b'<' if pos + 3 < text.len() && &text[pos..pos + 4] == b"<!--" => {
                     pos += 4;
-                    while pos + 2 < text.len() {
-                        if &text[pos..pos+3] == b"-->" {
+                    while pos < text.len() {
+                        if text[pos..].starts_with(b"-->") {
                             pos += 3;
                             break;
                         }
@@ -55,7 +64,7 @@ impl Lexer for HtmlLexer {
                 b'<' if pos + 1 < text.len() && text[pos + 1] == b'/' => {
                     pos += 2;
                     tokens.push(Token::new(TokenKind::Operator, start..pos));
-                    
+
                     // Tag name
                     let tag_start = pos;
                     while pos < text.len() && !is_whitespace(text[pos]) && text[pos] != b'>' {
@@ -64,7 +73,7 @@ impl Lexer for HtmlLexer {
                     if pos > tag_start {
                         tokens.push(Token::new(TokenKind::Keyword, tag_start..pos));
                     }
-                    
+
                     // Skip whitespace
                     while pos < text.len() && is_whitespace(text[pos]) {
                         let ws_start = pos;
@@ -74,10 +83,10 @@ impl Lexer for HtmlLexer {
                         }
                         tokens.push(Token::new(TokenKind::Whitespace, ws_start..pos));
                     }
-                    
+
                     // Closing >
                     if pos < text.len() && text[pos] == b'>' {
-                        tokens.push(Token::new(TokenKind::Operator, pos..pos+1));
+                        tokens.push(Token::new(TokenKind::Operator, pos..pos + 1));
                         pos += 1;
                     }
                 }
@@ -86,16 +95,21 @@ impl Lexer for HtmlLexer {
                 b'<' => {
                     pos += 1;
                     tokens.push(Token::new(TokenKind::Operator, start..pos));
-                    
+
                     // Tag name
                     let tag_start = pos;
-                    while pos < text.len() && !is_whitespace(text[pos]) && text[pos] != b'>' && text[pos] != b'/' {
+                    while pos < text.len()
+                        && !is_whitespace(text[pos])
+                        && text[pos] != b'>'
+                        && text[pos] != b'/'
+                    {
                         pos += 1;
                     }
+                    let tag_end = pos;
                     if pos > tag_start {
                         tokens.push(Token::new(TokenKind::Keyword, tag_start..pos));
                     }
-                    
+
                     // Attributes
                     loop {
                         // Skip whitespace
@@ -106,21 +120,37 @@ impl Lexer for HtmlLexer {
                             }
                             tokens.push(Token::new(TokenKind::Whitespace, ws_start..pos));
                         }
-                        
+
                         // Check for end of tag
-                        if pos >= text.len() || text[pos] == b'>' || (text[pos] == b'/' && pos + 1 < text.len() && text[pos + 1] == b'>') {
+                        if pos >= text.len()
+                            || text[pos] == b'>'
+                            || (text[pos] == b'/' && pos + 1 < text.len() && text[pos + 1] == b'>')
+                        {
                             break;
                         }
-                        
+
+                        // A stray / that doesn't close the tag, as in `<a / b>`.
+                        // Without consuming it, this loop would never advance.
+                        if text[pos] == b'/' {
+                            tokens.push(Token::new(TokenKind::Operator, pos..pos + 1));
+                            pos += 1;
+                            continue;
+                        }
+
                         // Attribute name
                         let attr_start = pos;
-                        while pos < text.len() && !is_whitespace(text[pos]) && text[pos] != b'=' && text[pos] != b'>' && text[pos] != b'/' {
+                        while pos < text.len()
+                            && !is_whitespace(text[pos])
+                            && text[pos] != b'='
+                            && text[pos] != b'>'
+                            && text[pos] != b'/'
+                        {
                             pos += 1;
                         }
                         if pos > attr_start {
                             tokens.push(Token::new(TokenKind::PropertyName, attr_start..pos));
                         }
-                        
+
                         // Skip whitespace around =
                         while pos < text.len() && is_whitespace(text[pos]) {
                             let ws_start = pos;
@@ -130,12 +160,12 @@ impl Lexer for HtmlLexer {
                             }
                             tokens.push(Token::new(TokenKind::Whitespace, ws_start..pos));
                         }
-                        
+
                         // Equals sign
                         if pos < text.len() && text[pos] == b'=' {
-                            tokens.push(Token::new(TokenKind::Operator, pos..pos+1));
+                            tokens.push(Token::new(TokenKind::Operator, pos..pos + 1));
                             pos += 1;
-                            
+
                             // Skip whitespace after =
                             while pos < text.len() && is_whitespace(text[pos]) {
                                 let ws_start = pos;
@@ -145,7 +175,7 @@ impl Lexer for HtmlLexer {
                                 }
                                 tokens.push(Token::new(TokenKind::Whitespace, ws_start..pos));
                             }
-                            
+
                             // Attribute value
                             if pos < text.len() {
                                 let quote = text[pos];
@@ -163,16 +193,36 @@ impl Lexer for HtmlLexer {
                             }
                         }
                     }
-                    
+
                     // Self-closing />
                     if pos + 1 < text.len() && text[pos] == b'/' && text[pos + 1] == b'>' {
-                        tokens.push(Token::new(TokenKind::Operator, pos..pos+2));
+                        tokens.push(Token::new(TokenKind::Operator, pos..pos + 2));
                         pos += 2;
                     }
                     // Closing >
                     else if pos < text.len() && text[pos] == b'>' {
-                        tokens.push(Token::new(TokenKind::Operator, pos..pos+1));
+                        tokens.push(Token::new(TokenKind::Operator, pos..pos + 1));
                         pos += 1;
+
+                        // The contents of <script> and <style> are lexed as JavaScript and CSS.
+                        let tag = &text[tag_start..tag_end];
+                        let embedded = if tag.eq_ignore_ascii_case(b"script") {
+                            Some((Language::JavaScript, &b"</script"[..]))
+                        } else if tag.eq_ignore_ascii_case(b"style") {
+                            Some((Language::Css, &b"</style"[..]))
+                        } else {
+                            None
+                        };
+                        if let Some((language, terminator)) = embedded {
+                            pos = EmbeddedRegion::new(language, pos, RegionEnd::Before(terminator))
+                                .tokenize(text, tokens);
+                            // Where it ends depends on where the terminator is, if anywhere.
+                            checkpoints.look_ahead(if pos < text.len() {
+                                pos + terminator.len()
+                            } else {
+                                usize::MAX
+                            });
+                        }
                     }
                 }
 
@@ -185,7 +235,5 @@ impl Lexer for HtmlLexer {
                 }
             }
         }
-
-        tokens
     }
 }
@@ -0,0 +1,108 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//! Strings with interpolations, like JavaScript's template literals and Python's f-strings.
+//!
+//! A string is lexed up to the opener of an interpolation, like the `${` of `` `a ${b}` ``.
+//! The language's lexer then lexes the expression in there up to the bracket that closes
+//! it, and the string goes on after that. The expression may contain another interpolated
+//! string, whose interpolations contain expressions in turn. Each of these levels is a
+//! call: [`interpolated_string`] calls the language's [`Expression`], which calls
+//! [`interpolated_string`] for a string in the expression, up to
+//! [`MAX_INTERPOLATION_DEPTH`] levels deep. Past that, an opener is text.
+//!
+//! The delimiters of an interpolation are [`TokenKind::Interpolation`] tokens, and the
+//! text of the string around them is a [`TokenKind::String`] token per piece.
+//! An interpolation that isn't closed before the string has to end has its opener flagged
+//! [`TokenPayload::Invalid`], and ends the string.
+
+use crate::syntax::{Token, TokenKind, TokenPayload};
+
+/// How deeply interpolations may nest, like a template literal in the interpolation of
+/// another one. Past it, the opener of an interpolation is part of the string.
+pub const MAX_INTERPOLATION_DEPTH: usize = 8;
+
+/// Lexes the expression of an interpolation `depth` interpolations deep, from `pos`, and
+/// returns where it stopped: at the bracket that closes the interpolation, which it leaves
+/// to the string, or at the end of `text` without one. `text` ends where the string must,
+/// like at the end of the line for strings that can't span lines.
+pub(crate) type Expression =
+    fn(text: &[u8], pos: usize, depth: usize, tokens: &mut Vec<Token>) -> usize;
+
+/// The syntax of a string with interpolations.
+#[derive(Clone, Copy)]
+pub(crate) struct InterpolatedString<'a> {
+    /// The delimiter that ends the string, like `` ` `` or `"""`.
+    pub close: &'a [u8],
+    /// The delimiter that opens an interpolation, like `${`.
+    pub open: &'static [u8],
+    /// The bracket that closes an interpolation, like `}`.
+    pub end: u8,
+    /// Whether the string may span lines. Otherwise it ends with its line.
+    pub multiline: bool,
+    /// Whether a doubled opening or closing bracket is text, like `{{` in f-strings.
+    pub doubled: bool,
+    /// The lexer of the expressions in the interpolations.
+    pub expression: Expression,
+}
+
+/// Lexes the string starting at `start`, whose opening delimiter ends at `pos`, `depth`
+/// interpolations deep, and returns its end. A backslash keeps the character after it from
+/// ending the string or opening an interpolation, like in `` `\${x}` ``.
+pub(crate) fn interpolated_string(
+    text: &[u8],
+    start: usize,
+    mut pos: usize,
+    string: &InterpolatedString,
+    depth: usize,
+    tokens: &mut Vec<Token>,
+) -> usize {
+    let push_piece = |tokens: &mut Vec<Token>, piece: usize, pos: usize| {
+        if piece < pos {
+            tokens.push(Token::new(TokenKind::String, piece..pos));
+        }
+    };
+    let bracket = string.open[string.open.len() - 1];
+
+    let mut piece = start;
+    while let Some(&b) = text.get(pos) {
+        if text[pos..].starts_with(string.close) {
+            pos += string.close.len();
+            break;
+        }
+        match b {
+            b'\\' => pos = (pos + 2).min(text.len()),
+            b'\n' if !string.multiline => break,
+            _ if string.doubled
+                && (b == bracket || b == string.end)
+                && text.get(pos + 1) == Some(&b) =>
+            {
+                pos += 2
+            }
+            _ if depth < MAX_INTERPOLATION_DEPTH && text[pos..].starts_with(string.open) => {
+                push_piece(tokens, piece, pos);
+                let body = pos + string.open.len();
+                tokens.push(Token::new(TokenKind::Interpolation, pos..body));
+                let opener = tokens.len() - 1;
+
+                let limit = if string.multiline {
+                    text.len()
+                } else {
+                    text[body..].iter().position(|&b| b == b'\n').map_or(text.len(), |i| body + i)
+                };
+                pos = (string.expression)(&text[..limit], body, depth + 1, tokens);
+                if pos >= limit || text[pos] != string.end {
+                    tokens[opener].payload = Some(TokenPayload::Invalid);
+                    return pos;
+                }
+                tokens.push(Token::new(TokenKind::Interpolation, pos..pos + 1));
+                pos += 1;
+                piece = pos;
+            }
+            _ => pos += 1,
+        }
+    }
+
+    push_piece(tokens, piece, pos);
+    pos
+}
@@ -2,211 +2,387 @@
 // Licensed under the MIT License.
 
 //! JavaScript/TypeScript lexer with modern syntax support.
+//!
+//! A `/` either divides or starts a regular expression, which only the parser really knows.
+//! The lexer goes by the token before it, see [`regex_allowed`]. That's wrong in a few
+//! places, which take code nobody writes or automatic semicolon insertion to run into:
+//!
+//! - A newline doesn't matter, as in JavaScript itself, so `a` followed by `/re/g` on the
+//!   next line is two divisions, though it may have been meant as two statements.
+//! - `}` is taken to end a block, so in `x = {} / a / b` the `/ a /` is a regex.
+//! - Contextual keywords like `of` allow a regex even when they're used as variable names.
+//! - A `)` only lets a regex follow if it closes the condition of an `if`, `for`, `while`
+//!   or `with`, not `for await (...)`.
+//!
+//! A regex that doesn't end on its line is lexed as a division instead, so that a wrong
+//! guess can't swallow the rest of the text. The flags after a regex, like the `gi` of
+//! `/re/gi`, are a [`TokenKind::RegexFlags`] token of their own.
+//!
+//! Template literals are lexed with [`interpolated_string`], and the expressions in their
+//! `${ }` like the code around them, template literals and all.
 
-use crate::syntax::lexer::{Lexer, is_ident_start, is_ident_continue, is_ascii_digit};
+use crate::syntax::lexer::interpolation::{InterpolatedString, interpolated_string};
+use crate::syntax::lexer::{
+    Checkpoints, Resumable, UnicodeIdents, char_len, ident_end, is_ascii_digit, is_ident_continue,
+    is_ident_start, is_unicode_ident_start, preceding,
+};
 use crate::syntax::{Token, TokenKind};
 
 pub struct JavaScriptLexer;
 
-impl Lexer for JavaScriptLexer {
-    fn tokenize(&self, text: &[u8]) -> Vec<Token> {
-        let mut tokens = Vec::with_capacity(text.len() / 8);
-        let mut pos = 0;
+/// Template literals, like `` `Hello ${name}` ``.
+const TEMPLATE: InterpolatedString = InterpolatedString {
+    close: b"`",
+    open: b"${",
+    end: b'}',
+    multiline: true,
+    doubled: false,
+    expression: lex,
+};
 
-        while pos < text.len() {
-            let start = pos;
-            let b = text[pos];
+/// Whether a `/` after `tokens` starts a regular expression rather than dividing, see
+/// [`regex_may_follow`]. `++` and `--` don't decide: after `a++` comes a division, after
+/// `++` an operand.
+fn regex_allowed(text: &[u8], tokens: &[Token], condition: bool) -> bool {
+    preceding(tokens)
+        .find(|t| !matches!(&text[t.span.clone()], b"++" | b"--"))
+        .is_none_or(|t| regex_may_follow(text, t, condition))
+}
 
-            match b {
-                // Whitespace
-                b' ' | b'\t' | b'\n' | b'\r' => {
-                    while pos < text.len() && matches!(text[pos], b' ' | b'\t' | b'\n' | b'\r') {
-                        pos += 1;
-                    }
-                    tokens.push(Token::new(TokenKind::Whitespace, start..pos));
+/// Whether a `/` after `token` starts a regular expression rather than dividing, which is
+/// when `token` doesn't end an expression. `condition` is whether a `)` closes the condition
+/// of an `if`, `for`, `while` or `with`, which a statement follows.
+fn regex_may_follow(text: &[u8], token: &Token, condition: bool) -> bool {
+    match token.kind {
+        TokenKind::Identifier
+        | TokenKind::Number
+        | TokenKind::String
+        | TokenKind::Regex
+        | TokenKind::RegexFlags
+        | TokenKind::Boolean
+        | TokenKind::Null => false,
+        TokenKind::Keyword => !matches!(&text[token.span.clone()], b"this" | b"super"),
+        TokenKind::Delimiter => match text[token.span.start] {
+            b')' => condition,
+            b']' => false,
+            _ => true,
+        },
+        _ => true,
+    }
+}
+
+/// Returns the end of the regular expression at the `/` at `pos`, after its closing `/`,
+/// or `None` if it doesn't end on its line.
+fn regex_end(text: &[u8], mut pos: usize) -> Option<usize> {
+    pos += 1;
+    let mut class = false;
+    while pos < text.len() {
+        match text[pos] {
+            b'\n' | b'\r' => return None,
+            b'\\' if matches!(text.get(pos + 1), None | Some(b'\n' | b'\r')) => return None,
+            b'\\' => pos += 1,
+            // A `/` in a character class like `[/]` doesn't end the regex.
+            b'[' => class = true,
+            b']' => class = false,
+            b'/' if !class => return Some(pos + 1),
+            _ => {}
+        }
+        pos += 1;
+    }
+    None
+}
+
+/// What the JavaScript lexer knows at the start of a line.
+#[derive(Clone, Default, PartialEq)]
+pub(crate) struct JsState {
+    /// For each open `(`, whether it starts the condition of an `if`, `for`, `while` or `with`.
+    conditions: Vec<bool>,
+    /// Whether the last `)` closed such a condition.
+    closes_condition: bool,
+}
+
+impl Resumable for JavaScriptLexer {
+    type State = JsState;
+
+    fn lex(
+        &self,
+        text: &[u8],
+        pos: usize,
+        state: JsState,
+        tokens: &mut Vec<Token>,
+        checkpoints: &mut Checkpoints<JsState>,
+    ) {
+        lex_code(text, pos, 0, state, tokens, checkpoints);
+    }
+}
+
+/// Lexes the code from `pos`, `depth` interpolations deep, and returns where it stopped.
+/// In an interpolation, that's at the `}` which closes it, see
+/// [`Expression`](super::interpolation::Expression).
+fn lex(text: &[u8], pos: usize, depth: usize, tokens: &mut Vec<Token>) -> usize {
+    lex_code(text, pos, depth, JsState::default(), tokens, &mut Checkpoints::none())
+}
+
+/// Like [`lex`], from a line in `state`, reporting the lines of the code outside of any
+/// interpolation to `checkpoints`.
+fn lex_code(
+    text: &[u8],
+    mut pos: usize,
+    depth: usize,
+    state: JsState,
+    tokens: &mut Vec<Token>,
+    checkpoints: &mut Checkpoints<JsState>,
+) -> usize {
+    // The `{` that are open, which a `}` closes before it could close the interpolation.
+    let mut braces = 0usize;
+    let JsState { mut conditions, mut closes_condition } = state;
+
+    while pos < text.len() {
+        // `regex_allowed` looks at the token before the `/`, and past any `++` and `--`.
+        if depth == 0
+            && checkpoints.due(text, tokens, pos)
+            && preceding(tokens)
+                .next()
+                .is_none_or(|t| !matches!(&text[t.span.clone()], b"++" | b"--"))
+        {
+            let state = JsState { conditions: conditions.clone(), closes_condition };
+            if checkpoints.report(text, pos, tokens, 1, state) {
+                return pos;
+            }
+        }
+        let start = pos;
+        let b = text[pos];
+
+        match b {
+            // Whitespace
+            b' ' | b'\t' | b'\n' | b'\r' => {
+                while pos < text.len() && matches!(text[pos], b' ' | b'\t' | b'\n' | b'\r') {
+                    pos += 1;
                 }
+                tokens.push(Token::new(TokenKind::Whitespace, start..pos));
+            }
 
-                // Line comment
-                b'/' if pos + 1 < text.len() && text[pos + 1] == b'/' => {
-                    pos += 2;
-                    while pos < text.len() && text[pos] != b'\n' {
-                        pos += 1;
-                    }
-                    tokens.push(Token::new(TokenKind::Comment, start..pos));
+            // Line comment
+            b'/' if pos + 1 < text.len() && text[pos + 1] == b'/' => {
+                pos += 2;
+                while pos < text.len() && text[pos] != b'\n' {
+                    pos += 1;
                 }
+                tokens.push(Token::new(TokenKind::Comment, start..pos));
+            }
 
-                // Block comment
-                b'/' if pos + 1 < text.len() && text[pos + 1] == b'*' => {
-                    pos += 2;
-                    while pos + 1 < text.len() {
-                        if text[pos] == b'*' && text[pos + 1] == b'/' {
-                            pos += 2;
-                            break;
-                        }
+            // Block comment
+            b'/' if pos + 1 < text.len() && text[pos + 1] == b'*' => {
+                pos = checkpoints.block_comment(text, start, tokens);
+            }
+
+            // Regular expression, where an expression starts
+            b'/' if regex_allowed(text, tokens, closes_condition)
+                && regex_end(text, pos).is_some() =>
+            {
+                pos = regex_end(text, pos).unwrap_or(text.len());
+                tokens.push(Token::new(TokenKind::Regex, start..pos));
+                let flags = pos;
+                while pos < text.len() && is_ident_continue(text[pos]) {
+                    pos += 1;
+                }
+                if pos > flags {
+                    tokens.push(Token::new(TokenKind::RegexFlags, flags..pos));
+                }
+            }
+
+            // Template literals
+            b'`' => {
+                pos = interpolated_string(text, start, pos + 1, &TEMPLATE, depth, tokens);
+            }
+
+            // String literals
+            b'"' | b'\'' => {
+                let quote = b;
+                pos += 1;
+                let mut escaped = false;
+                while pos < text.len() {
+                    if escaped {
+                        escaped = false;
+                    } else if text[pos] == b'\\' {
+                        escaped = true;
+                    } else if text[pos] == quote {
                         pos += 1;
+                        break;
                     }
-                    tokens.push(Token::new(TokenKind::Comment, start..pos));
+                    pos += 1;
                 }
+                tokens.push(Token::new(TokenKind::String, start..pos));
+            }
+
+            // Numbers
+            b'0'..=b'9' => {
+                pos += 1;
 
-                // Template literals
-                b'`' => {
+                // Hex
+                if start + 1 < text.len()
+                    && text[start] == b'0'
+                    && matches!(text[start + 1], b'x' | b'X')
+                {
                     pos += 1;
-                    while pos < text.len() {
-                        if text[pos] == b'\\' {
-                            pos += 2;
-                        } else if text[pos] == b'`' {
-                            pos += 1;
-                            break;
-                        } else {
-                            pos += 1;
-                        }
+                    while pos < text.len()
+                        && (is_ascii_digit(text[pos])
+                            || matches!(text[pos], b'a'..=b'f' | b'A'..=b'F'))
+                    {
+                        pos += 1;
                     }
-                    tokens.push(Token::new(TokenKind::String, start..pos));
                 }
-
-                // String literals
-                b'"' | b'\'' => {
-                    let quote = b;
+                // Binary
+                else if start + 1 < text.len()
+                    && text[start] == b'0'
+                    && matches!(text[start + 1], b'b' | b'B')
+                {
                     pos += 1;
-                    let mut escaped = false;
-                    while pos < text.len() {
-                        if escaped {
-                            escaped = false;
-                        } else if text[pos] == b'\\' {
-                            escaped = true;
-                        } else if text[pos] == quote {
-                            pos += 1;
-                            break;
-                        }
+                    while pos < text.len() && matches!(text[pos], b'0' | b'1') {
                         pos += 1;
                     }
-                    tokens.push(Token::new(TokenKind::String, start..pos));
                 }
-
-                // Numbers
-                b'0'..=b'9' => {
+                // Octal
+                else if start + 1 < text.len()
+                    && text[start] == b'0'
+                    && matches!(text[start + 1], b'o' | b'O')
+                {
                     pos += 1;
-                    
-                    // Hex
-                    if start + 1 < text.len() && text[start] == b'0' && matches!(text[start + 1], b'x' | b'X') {
+                    while pos < text.len() && matches!(text[pos], b'0'..=b'7') {
                         pos += 1;
-                        while pos < text.len() && (is_ascii_digit(text[pos]) || matches!(text[pos], b'a'..=b'f' | b'A'..=b'F')) {
-                            pos += 1;
-                        }
                     }
-                    // Binary
-                    else if start + 1 < text.len() && text[start] == b'0' && matches!(text[start + 1], b'b' | b'B') {
+                }
+                // Decimal/Float
+                else {
+                    while pos < text.len() && is_ascii_digit(text[pos]) {
                         pos += 1;
-                        while pos < text.len() && matches!(text[pos], b'0' | b'1') {
-                            pos += 1;
-                        }
                     }
-                    // Octal
-                    else if start + 1 < text.len() && text[start] == b'0' && matches!(text[start + 1], b'o' | b'O') {
+
+                    // Float
+                    if pos < text.len()
+                        && text[pos] == b'.'
+                        && pos + 1 < text.len()
+                        && is_ascii_digit(text[pos + 1])
+                    {
                         pos += 1;
-                        while pos < text.len() && matches!(text[pos], b'0'..=b'7') {
-                            pos += 1;
-                        }
-                    }
-                    // Decimal/Float
-                    else {
                         while pos < text.len() && is_ascii_digit(text[pos]) {
                             pos += 1;
                         }
-                        
-                        // Float
-                        if pos < text.len() && text[pos] == b'.' && pos + 1 < text.len() && is_ascii_digit(text[pos + 1]) {
+                    }
+
+                    // Exponent
+                    if pos < text.len() && matches!(text[pos], b'e' | b'E') {
+                        pos += 1;
+                        if pos < text.len() && matches!(text[pos], b'+' | b'-') {
                             pos += 1;
-                            while pos < text.len() && is_ascii_digit(text[pos]) {
-                                pos += 1;
-                            }
                         }
-                        
-                        // Exponent
-                        if pos < text.len() && matches!(text[pos], b'e' | b'E') {
+                        while pos < text.len() && is_ascii_digit(text[pos]) {
                             pos += 1;
-                            if pos < text.len() && matches!(text[pos], b'+' | b'-') {
-                                pos += 1;
-                            }
-                            while pos < text.len() && is_ascii_digit(text[pos]) {
-                                pos += 1;
-                            }
                         }
                     }
-                    
-                    tokens.push(Token::new(TokenKind::Number, start..pos));
                 }
 
-                // Identifiers and keywords
-                _ if is_ident_start(b) || b == b'$' => {
-                    while pos < text.len() && (is_ident_continue(text[pos]) || text[pos] == b'$') {
-                        pos += 1;
-                    }
-                    
-                    let word = &text[start..pos];
-                    let kind = match word {
-                        b"in" | b"of" | b"instanceof" | b"typeof" | b"delete" | b"void" => TokenKind::KeywordOperator,
-                        b"if" | b"else" | b"switch" | b"case" | b"default" | b"for" | b"while" | b"do" | b"break" | b"continue" | b"return" | b"throw" | b"try" | b"catch" | b"finally" => TokenKind::KeywordControl,
-                        b"function" | b"async" | b"await" | b"yield" => TokenKind::KeywordFunction,
-                        b"import" | b"export" | b"from" | b"as" => TokenKind::KeywordImport,
-                        b"let" | b"const" | b"var" => TokenKind::KeywordStorage,
-                        b"class" | b"interface" | b"extends" | b"implements" | b"enum" | b"type" => TokenKind::KeywordType,
-                        b"new" | b"this" | b"super" | b"static" | b"public" | b"private" | b"protected" | b"readonly" => TokenKind::Keyword,
-                        b"true" | b"false" => TokenKind::Boolean,
-                        b"null" | b"undefined" => TokenKind::Null,
-                        _ => TokenKind::Identifier,
-                    };
-                    
-                    tokens.push(Token::new(kind, start..pos));
-                }
+                tokens.push(Token::new(TokenKind::Number, start..pos));
+            }
 
-                // Operators
-                b'+' | b'-' | b'*' | b'/' | b'%' | b'&' | b'|' | b'^' | b'!' | b'=' | b'<' | b'>' | b'?' | b':' | b'~' => {
-                    pos += 1;
-                    // Handle multi-character operators (==, ===, <=, >=, etc.)
-                    while pos < text.len() && matches!(text[pos], b'=' | b'&' | b'|' | b'<' | b'>') {
-                        pos += 1;
+            // Identifiers and keywords
+            _ if is_ident_start(b)
+                || b == b'$'
+                || is_unicode_ident_start(text, pos, UnicodeIdents::Xid) =>
+            {
+                pos =
+                    ident_end(text, pos, UnicodeIdents::Xid, |b| is_ident_continue(b) || b == b'$');
+
+                let word = &text[start..pos];
+                let kind = match word {
+                    b"in" | b"of" | b"instanceof" | b"typeof" | b"delete" | b"void" => {
+                        TokenKind::KeywordOperator
                     }
-                    tokens.push(Token::new(TokenKind::Operator, start..pos));
-                }
+                    b"if" | b"else" | b"switch" | b"case" | b"default" | b"for" | b"while"
+                    | b"do" | b"break" | b"continue" | b"return" | b"throw" | b"try" | b"catch"
+                    | b"finally" => TokenKind::KeywordControl,
+                    b"function" | b"async" | b"await" | b"yield" => TokenKind::KeywordFunction,
+                    b"import" | b"export" | b"from" | b"as" => TokenKind::KeywordImport,
+                    b"let" | b"const" | b"var" => TokenKind::KeywordStorage,
+                    b"class" | b"interface" | b"extends" | b"implements" | b"enum" | b"type" => {
+                        TokenKind::KeywordType
+                    }
+                    b"new" | b"this" | b"super" | b"static" | b"public" | b"private"
+                    | b"protected" | b"readonly" => TokenKind::Keyword,
+                    b"true" | b"false" => TokenKind::Boolean,
+                    b"null" | b"undefined" => TokenKind::Null,
+                    _ => TokenKind::Identifier,
+                };
+
+                tokens.push(Token::new(kind, start..pos));
+            }
 
-                // Delimiters
-                b'{' | b'}' | b'[' | b']' | b'(' | b')' => {
+            // Operators
+            b'+' | b'-' | b'*' | b'/' | b'%' | b'&' | b'|' | b'^' | b'!' | b'=' | b'<' | b'>'
+            | b'?' | b':' | b'~' => {
+                pos += 1;
+                // Increment and decrement
+                if matches!(b, b'+' | b'-') && text.get(pos) == Some(&b) {
                     pos += 1;
-                    tokens.push(Token::new(TokenKind::Delimiter, start..pos));
                 }
-
-                // Punctuation
-                b',' | b';' | b'.' => {
+                // Handle multi-character operators (==, ===, <=, >=, etc.)
+                while pos < text.len() && matches!(text[pos], b'=' | b'&' | b'|' | b'<' | b'>') {
                     pos += 1;
-                    tokens.push(Token::new(TokenKind::Punctuation, start..pos));
                 }
+                tokens.push(Token::new(TokenKind::Operator, start..pos));
+            }
 
-                // Unknown
-                _ => {
-                    pos += 1;
-                    tokens.push(Token::new(TokenKind::Error, start..pos));
+            // Delimiters
+            b'}' if depth > 0 && braces == 0 => return pos,
+            b'{' | b'}' | b'[' | b']' | b'(' | b')' => {
+                if b == b'{' {
+                    braces += 1;
+                } else if b == b'}' {
+                    braces = braces.saturating_sub(1);
+                } else if b == b'(' {
+                    let before = preceding(tokens).next();
+                    let keyword = before.is_some_and(|t| {
+                        matches!(&text[t.span.clone()], b"if" | b"for" | b"while" | b"with")
+                    });
+                    conditions.push(keyword);
+                } else if b == b')' {
+                    closes_condition = conditions.pop() == Some(true);
                 }
+                pos += 1;
+                tokens.push(Token::new(TokenKind::Delimiter, start..pos));
             }
-        }
 
-        tokens
+            // Punctuation
+            b',' | b';' | b'.' => {
+                pos += 1;
+                tokens.push(Token::new(TokenKind::Punctuation, start..pos));
+            }
+
+            // Unknown
+            _ => {
+                pos += char_len(text, pos);
+                tokens.push(Token::new(TokenKind::Error, start..pos));
+            }
+        }
     }
+
+    pos
 }
 
 #[cfg(test)]
 mod tests {
     use super::*;
+    use crate::syntax::Lexer;
 
     #[test]
     fn test_js_keywords() {
         let lexer = JavaScriptLexer;
         let text = b"const x = async () => { return await fetch(); }";
         let tokens = lexer.tokenize(text);
-        
+
         let has_const = tokens.iter().any(|t| t.kind == TokenKind::KeywordStorage);
         let has_async = tokens.iter().any(|t| t.kind == TokenKind::KeywordFunction);
-        
+
         assert!(has_const);
         assert!(has_async);
     }
@@ -216,7 +392,7 @@ mod tests {
         let lexer = JavaScriptLexer;
         let text = b"`Hello ${name}`";
         let tokens = lexer.tokenize(text);
-        
+
         let has_string = tokens.iter().any(|t| t.kind == TokenKind::String);
         assert!(has_string);
     }
@@ -3,7 +3,7 @@
 
 //! High-performance JSON lexer with JSONC (JSON with comments) support.
 
-use crate::syntax::lexer::{Lexer, is_ascii_digit};
+use crate::syntax::lexer::{Checkpoints, Resumable, char_len, is_ascii_digit};
 use crate::syntax::{Token, TokenKind};
 
 pub struct JsonLexer;
@@ -13,12 +13,21 @@ fn is_whitespace(b: u8) -> bool {
     matches!(b, b' ' | b'\t' | b'\n' | b'\r')
 }
 
-impl Lexer for JsonLexer {
-    fn tokenize(&self, text: &[u8]) -> Vec<Token> {
-        let mut tokens = Vec::with_capacity(text.len() / 8);
-        let mut pos = 0;
-
+impl Resumable for JsonLexer {
+    type State = ();
+
+    fn lex(
+        &self,
+        text: &[u8],
+        mut pos: usize,
+        _: (),
+        tokens: &mut Vec<Token>,
+        checkpoints: &mut Checkpoints<()>,
+    ) {
         while pos < text.len() {
+            if checkpoints.due(text, tokens, pos) && checkpoints.report(text, pos, tokens, 0, ()) {
+                return;
+            }
             let start = pos;
             let b = text[pos];
 
@@ -52,17 +61,17 @@ impl Lexer for JsonLexer {
                 // Numbers
                 b'-' | b'0'..=b'9' => {
                     pos += 1;
-                    
+
                     // Integer part
                     if text[start] == b'-' && pos < text.len() {
                         // negative number
                     }
-                    
+
                     // Skip digits
                     while pos < text.len() && is_ascii_digit(text[pos]) {
                         pos += 1;
                     }
-                    
+
                     // Decimal part
                     if pos < text.len() && text[pos] == b'.' {
                         pos += 1;
@@ -70,7 +79,7 @@ impl Lexer for JsonLexer {
                             pos += 1;
                         }
                     }
-                    
+
                     // Exponent
                     if pos < text.len() && (text[pos] == b'e' || text[pos] == b'E') {
                         pos += 1;
@@ -81,7 +90,7 @@ impl Lexer for JsonLexer {
                             pos += 1;
                         }
                     }
-                    
+
                     tokens.push(Token::new(TokenKind::Number, start..pos));
                 }
 
@@ -98,15 +107,7 @@ impl Lexer for JsonLexer {
                         }
                         // Block comment
                         b'*' => {
-                            pos += 2;
-                            while pos + 1 < text.len() {
-                                if text[pos] == b'*' && text[pos + 1] == b'/' {
-                                    pos += 2;
-                                    break;
-                                }
-                                pos += 1;
-                            }
-                            tokens.push(Token::new(TokenKind::Comment, start..pos));
+                            pos = checkpoints.block_comment(text, start, tokens);
                         }
                         _ => {
                             // Not a comment, treat as error
@@ -158,28 +159,27 @@ impl Lexer for JsonLexer {
 
                 // Error: unexpected character
                 _ => {
-                    pos += 1;
+                    pos += char_len(text, pos);
                     tokens.push(Token::new(TokenKind::Error, start..pos));
                 }
             }
         }
-
-        tokens
     }
 }
 
 #[cfg(test)]
 mod tests {
     use super::*;
+    use crate::syntax::Lexer;
 
     #[test]
     fn test_json_simple() {
         let lexer = JsonLexer;
         let text = br#"{"key": "value"}"#;
         let tokens = lexer.tokenize(text);
-        
+
         assert_eq!(tokens[0].kind, TokenKind::JsonBrace); // {
-        assert_eq!(tokens[1].kind, TokenKind::String);    // "key"
+        assert_eq!(tokens[1].kind, TokenKind::String); // "key"
         assert_eq!(tokens[2].kind, TokenKind::JsonColon); // :
     }
 
@@ -188,11 +188,9 @@ mod tests {
         let lexer = JsonLexer;
         let text = b"[42, -3.14, 1.5e-10]";
         let tokens = lexer.tokenize(text);
-        
-        let numbers: Vec<_> = tokens.iter()
-            .filter(|t| t.kind == TokenKind::Number)
-            .collect();
-        
+
+        let numbers: Vec<_> = tokens.iter().filter(|t| t.kind == TokenKind::Number).collect();
+
         assert_eq!(numbers.len(), 3);
     }
 
@@ -201,10 +199,10 @@ mod tests {
         let lexer = JsonLexer;
         let text = b"[true, false, null]";
         let tokens = lexer.tokenize(text);
-        
+
         let has_bool = tokens.iter().any(|t| t.kind == TokenKind::Boolean);
         let has_null = tokens.iter().any(|t| t.kind == TokenKind::Null);
-        
+
         assert!(has_bool);
         assert!(has_null);
     }
@@ -214,11 +212,9 @@ mod tests {
         let lexer = JsonLexer;
         let text = b"// line comment\n/* block comment */ {}";
         let tokens = lexer.tokenize(text);
-        
-        let comments: Vec<_> = tokens.iter()
-            .filter(|t| t.kind == TokenKind::Comment)
-            .collect();
-        
+
+        let comments: Vec<_> = tokens.iter().filter(|t| t.kind == TokenKind::Comment).collect();
+
         assert_eq!(comments.len(), 2);
     }
 }
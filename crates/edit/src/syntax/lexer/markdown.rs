@@ -3,17 +3,34 @@
 
 //! Markdown lexer with support for common formatting.
 
-use crate::syntax::lexer::Lexer;
-use crate::syntax::{Token, TokenKind};
+use crate::syntax::lexer::{Checkpoints, Language, Resumable};
+use crate::syntax::{EmbeddedRegion, RegionEnd, Token, TokenKind};
 
 pub struct MarkdownLexer;
 
-impl Lexer for MarkdownLexer {
-    fn tokenize(&self, text: &[u8]) -> Vec<Token> {
-        let mut tokens = Vec::with_capacity(text.len() / 16);
-        let mut pos = 0;
+/// Checks for a fence of 3+ backticks whose info string contains no backticks.
+/// Otherwise it's an inline code span like ```code```.
+fn is_fence_opener(line: &[u8]) -> bool {
+    let fence_len = line.iter().take_while(|&&b| b == b'`').count();
+    let line_end = line.iter().position(|&b| b == b'\n').unwrap_or(line.len());
+    fence_len >= 3 && !line[fence_len..line_end].contains(&b'`')
+}
 
+impl Resumable for MarkdownLexer {
+    type State = ();
+
+    fn lex(
+        &self,
+        text: &[u8],
+        mut pos: usize,
+        _: (),
+        tokens: &mut Vec<Token>,
+        checkpoints: &mut Checkpoints<()>,
+    ) {
         while pos < text.len() {
+            if checkpoints.due(text, tokens, pos) && checkpoints.report(text, pos, tokens, 0, ()) {
+                return;
+            }
             let start = pos;
             let b = text[pos];
 
@@ -35,12 +52,51 @@ impl Lexer for MarkdownLexer {
                     tokens.push(Token::new(TokenKind::MarkdownHeading, start..pos));
                 }
 
+                // Fenced code blocks at the start of a line: the body is lexed
+                // as the language named in the info string (```rust).
+                b'`' if at_line_start && is_fence_opener(&text[pos..]) => {
+                    let mut fence_len = 0;
+                    while pos < text.len() && text[pos] == b'`' {
+                        pos += 1;
+                        fence_len += 1;
+                    }
+                    let info_start = pos;
+                    while pos < text.len() && text[pos] != b'\n' {
+                        pos += 1;
+                    }
+                    let info = &text[info_start..pos];
+                    let name = info
+                        .split(|&b| b == b' ' || b == b'\t' || b == b'\r')
+                        .find(|word| !word.is_empty())
+                        .unwrap_or_default();
+                    let language = Language::from_name(&String::from_utf8_lossy(name));
+                    tokens.push(Token::new(TokenKind::MarkdownCode, start..pos));
+
+                    if pos < text.len() {
+                        tokens.push(Token::new(TokenKind::Whitespace, pos..pos + 1));
+                        pos += 1;
+                        let fence = &text[start..start + fence_len];
+                        pos = EmbeddedRegion::new(language, pos, RegionEnd::BeforeLine(fence))
+                            .fallback(TokenKind::MarkdownCode)
+                            .tokenize(text, tokens);
+
+                        // Closing fence
+                        let fence_start = pos;
+                        while pos < text.len() && text[pos] != b'\n' {
+                            pos += 1;
+                        }
+                        if pos > fence_start {
+                            tokens.push(Token::new(TokenKind::MarkdownCode, fence_start..pos));
+                        }
+                    }
+                }
+
                 // Code blocks with backticks
                 b'`' if pos + 2 < text.len() && text[pos + 1] == b'`' && text[pos + 2] == b'`' => {
                     pos += 3;
                     // Find the closing ```
-                    while pos + 2 < text.len() {
-                        if text[pos] == b'`' && text[pos + 1] == b'`' && text[pos + 2] == b'`' {
+                    while pos < text.len() {
+                        if text[pos..].starts_with(b"```") {
                             pos += 3;
                             break;
                         }
@@ -133,8 +189,15 @@ impl Lexer for MarkdownLexer {
                     tokens.push(Token::new(TokenKind::MarkdownLink, start..pos));
                 }
 
-                // Regular text - consume until next special character
+                b'\n' => {
+                    pos += 1;
+                    tokens.push(Token::new(TokenKind::Whitespace, start..pos));
+                }
+
+                // Regular text - consume until next special character. The first one is
+                // text even if it's special, like a `#` in the middle of a line.
                 _ => {
+                    pos += 1;
                     while pos < text.len() {
                         let ch = text[pos];
                         if matches!(ch, b'#' | b'`' | b'*' | b'_' | b'[' | b'\n') {
@@ -142,34 +205,27 @@ impl Lexer for MarkdownLexer {
                         }
                         pos += 1;
                     }
-                    // Don't create empty tokens
-                    if pos > start {
-                        tokens.push(Token::new(TokenKind::Identifier, start..pos));
-                    } else {
-                        pos += 1;
-                    }
+                    tokens.push(Token::new(TokenKind::Identifier, start..pos));
                 }
             }
         }
-
-        tokens
     }
 }
 
 #[cfg(test)]
 mod tests {
     use super::*;
+    use crate::syntax::Lexer;
 
     #[test]
     fn test_markdown_headings() {
         let lexer = MarkdownLexer;
         let text = b"# Heading 1\n## Heading 2";
         let tokens = lexer.tokenize(text);
-        
-        let headings: Vec<_> = tokens.iter()
-            .filter(|t| t.kind == TokenKind::MarkdownHeading)
-            .collect();
-        
+
+        let headings: Vec<_> =
+            tokens.iter().filter(|t| t.kind == TokenKind::MarkdownHeading).collect();
+
         assert_eq!(headings.len(), 2);
     }
 
@@ -178,11 +234,9 @@ mod tests {
         let lexer = MarkdownLexer;
         let text = b"`inline code` and ```block code```";
         let tokens = lexer.tokenize(text);
-        
-        let code: Vec<_> = tokens.iter()
-            .filter(|t| t.kind == TokenKind::MarkdownCode)
-            .collect();
-        
+
+        let code: Vec<_> = tokens.iter().filter(|t| t.kind == TokenKind::MarkdownCode).collect();
+
         assert_eq!(code.len(), 2);
     }
 
@@ -191,10 +245,10 @@ mod tests {
         let lexer = MarkdownLexer;
         let text = b"**bold** and *italic*";
         let tokens = lexer.tokenize(text);
-        
+
         let has_bold = tokens.iter().any(|t| t.kind == TokenKind::MarkdownBold);
         let has_italic = tokens.iter().any(|t| t.kind == TokenKind::MarkdownItalic);
-        
+
         assert!(has_bold);
         assert!(has_italic);
     }
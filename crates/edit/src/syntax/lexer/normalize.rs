@@ -0,0 +1,179 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//! What files have in them that the lexers don't expect, handled once for all of them.
+//!
+//! [`Normalized`] keeps three things from the lexers and gives them tokens of their own,
+//! so that the offsets of all tokens are still those of the file:
+//!
+//! - A byte order mark at the start, which would be part of the first word otherwise.
+//!   It's a [`TokenKind::Whitespace`] token with a [`TokenPayload::ByteOrderMark`].
+//! - `\r\n` and lone `\r` line endings. The lexers end lines at `\n` only, so the `\r` of a
+//!   `\r\n` would be part of whatever token ends the line, like a line comment, and a lone
+//!   `\r` wouldn't end the line at all. The lexers get a copy of the text whose lone `\r`
+//!   are `\n`, which keeps every offset, and the `\r` that tokens end with go to the
+//!   whitespace after them.
+//! - Invalid UTF-8, like the `é` of a file saved as Latin-1. Outside comments and strings,
+//!   each byte that isn't part of a character is a [`TokenKind::Error`] token of its own.
+
+use crate::syntax::lexer::{Checkpoint, ReportCheckpoint};
+use crate::syntax::{Lexer, Token, TokenKind, TokenPayload};
+
+/// The UTF-8 byte order mark, U+FEFF.
+const BOM: &[u8] = b"\xEF\xBB\xBF";
+
+/// A lexer for files as they are, see the [module docs](self).
+pub(crate) struct Normalized<L>(pub L);
+
+impl<L: Lexer> Lexer for Normalized<L> {
+    fn tokenize(&self, text: &[u8]) -> Vec<Token> {
+        let rest = text.strip_prefix(BOM).unwrap_or(text);
+        let tokens = if has_lone_cr(rest) {
+            let lone = |i: usize| rest[i] == b'\r' && rest.get(i + 1) != Some(&b'\n');
+            let copy: Vec<u8> =
+                (0..rest.len()).map(|i| if lone(i) { b'\n' } else { rest[i] }).collect();
+            self.0.tokenize(&copy)
+        } else {
+            self.0.tokenize(rest)
+        };
+        with_bom(text, normalize(rest, tokens))
+    }
+
+    fn resume(
+        &self,
+        text: &[u8],
+        from: &Checkpoint,
+        tokens: &mut Vec<Token>,
+        report: &mut ReportCheckpoint,
+    ) -> bool {
+        // The copy whose lone `\r` are `\n` would have to be made for every edit.
+        let Some(rest) = text.strip_prefix(BOM) else {
+            return !has_lone_cr(text) && self.0.resume(text, from, tokens, report);
+        };
+        if has_lone_cr(rest) {
+            return false;
+        }
+        let shift = |checkpoint: &Checkpoint, by: fn(usize, usize) -> usize| Checkpoint {
+            pos: by(checkpoint.pos, BOM.len()),
+            lookahead: by(checkpoint.lookahead, BOM.len()),
+            ..checkpoint.clone()
+        };
+        shift_tokens(tokens, |offset| offset - BOM.len());
+        let resumed = self.0.resume(
+            rest,
+            &shift(from, usize::saturating_sub),
+            tokens,
+            &mut |checkpoint, text, tokens| {
+                report(&shift(checkpoint, usize::saturating_add), text, tokens)
+            },
+        );
+        shift_tokens(tokens, |offset| offset + BOM.len());
+        resumed
+    }
+
+    fn finish(&self, text: &[u8], tokens: &mut Vec<Token>) {
+        let rest = text.strip_prefix(BOM).unwrap_or(text);
+        let offset = text.len() - rest.len();
+        shift_tokens(tokens, |o| o - offset);
+        self.0.finish(rest, tokens);
+        *tokens = with_bom(text, normalize(rest, std::mem::take(tokens)));
+    }
+
+    fn needs_whole_text(&self) -> bool {
+        self.0.needs_whole_text()
+    }
+
+    fn set_unterminated_comment_lines(&mut self, lines: usize) {
+        self.0.set_unterminated_comment_lines(lines);
+    }
+}
+
+/// Whether `text` has a `\r` that's not part of a `\r\n`.
+fn has_lone_cr(text: &[u8]) -> bool {
+    text.contains(&b'\r')
+        && (0..text.len()).any(|i| text[i] == b'\r' && text.get(i + 1) != Some(&b'\n'))
+}
+
+/// Moves the `tokens` to the offsets that `shift` gives for theirs.
+fn shift_tokens(tokens: &mut [Token], shift: impl Fn(usize) -> usize) {
+    for token in tokens {
+        token.span = shift(token.span.start)..shift(token.span.end);
+    }
+}
+
+/// Moves the `tokens` of the text after a byte order mark behind its token, if `text` has one.
+fn with_bom(text: &[u8], mut tokens: Vec<Token>) -> Vec<Token> {
+    if !text.starts_with(BOM) {
+        return tokens;
+    }
+    shift_tokens(&mut tokens, |offset| offset + BOM.len());
+    let bom = Token::new(TokenKind::Whitespace, 0..BOM.len());
+    tokens.insert(0, bom.with_payload(TokenPayload::ByteOrderMark));
+    tokens
+}
+
+/// Gives the `\r` that the `tokens` of `text` end with to the whitespace after them, and
+/// splits out invalid UTF-8.
+fn normalize(text: &[u8], tokens: Vec<Token>) -> Vec<Token> {
+    let tokens = if text.contains(&b'\r') { carry_carriage_returns(text, tokens) } else { tokens };
+    if std::str::from_utf8(text).is_ok() { tokens } else { split_invalid_bytes(text, tokens) }
+}
+
+/// Gives the `\r` that the `tokens` of `text` end with to the whitespace after them.
+fn carry_carriage_returns(text: &[u8], tokens: Vec<Token>) -> Vec<Token> {
+    let mut result = Vec::with_capacity(tokens.len());
+    // The start of a `\r` split off the token before, for the whitespace after it.
+    let mut carried = None;
+    for mut token in tokens {
+        if let Some(start) = carried.take() {
+            if token.kind == TokenKind::Whitespace && token.payload.is_none() {
+                token.span.start = start;
+            } else {
+                result.push(Token::new(TokenKind::Whitespace, start..start + 1));
+            }
+        }
+        let end = token.span.end;
+        if token.kind != TokenKind::Whitespace && !token.span.is_empty() && text[end - 1] == b'\r' {
+            if token.span.len() == 1 {
+                token = Token::new(TokenKind::Whitespace, token.span).with_scopes(token.scopes);
+            } else {
+                token.span.end -= 1;
+                carried = Some(end - 1);
+            }
+        }
+        result.push(token);
+    }
+    if let Some(start) = carried {
+        result.push(Token::new(TokenKind::Whitespace, start..start + 1));
+    }
+    result
+}
+
+/// Split the bytes that aren't part of a valid character out of the tokens other than
+/// comments and strings, one [`TokenKind::Error`] token each.
+fn split_invalid_bytes(text: &[u8], tokens: Vec<Token>) -> Vec<Token> {
+    let mut result = Vec::with_capacity(tokens.len());
+    for token in tokens {
+        let s = &text[token.span.clone()];
+        let is_text = token.kind.is_comment()
+            || token.kind.is_string()
+            || matches!(token.kind, TokenKind::Char | TokenKind::Regex);
+        if is_text || std::str::from_utf8(s).is_ok() {
+            result.push(token);
+            continue;
+        }
+        let mut pos = token.span.start;
+        for chunk in s.utf8_chunks() {
+            let valid = chunk.valid().len();
+            if valid > 0 {
+                result.push(Token { span: pos..pos + valid, ..token });
+                pos += valid;
+            }
+            for _ in chunk.invalid() {
+                result.push(Token::new(TokenKind::Error, pos..pos + 1).with_scopes(token.scopes));
+                pos += 1;
+            }
+        }
+    }
+    result
+}
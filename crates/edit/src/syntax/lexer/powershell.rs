@@ -1,4 +1,4 @@
-use super::Lexer;
+use super::{Lexer, char_len};
 use crate::syntax::token::{Token, TokenKind};
 
 pub struct PowerShellLexer;
@@ -16,13 +16,12 @@ impl Lexer for PowerShellLexer {
             match ch {
                 // Whitespace
                 ' ' | '\t' | '\r' | '\n' => {
-                    while pos < bytes.len() && matches!(bytes[pos] as char, ' ' | '\t' | '\r' | '\n') {
+                    while pos < bytes.len()
+                        && matches!(bytes[pos] as char, ' ' | '\t' | '\r' | '\n')
+                    {
                         pos += 1;
                     }
-                    tokens.push(Token {
-                        kind: TokenKind::Whitespace,
-                        span: start..pos,
-                    });
+                    tokens.push(Token { kind: TokenKind::Whitespace, span: start..pos });
                 }
 
                 // Comment
@@ -30,10 +29,7 @@ impl Lexer for PowerShellLexer {
                     while pos < bytes.len() && bytes[pos] != b'\n' {
                         pos += 1;
                     }
-                    tokens.push(Token {
-                        kind: TokenKind::Comment,
-                        span: start..pos,
-                    });
+                    tokens.push(Token { kind: TokenKind::Comment, span: start..pos });
                 }
 
                 // Block comment
@@ -46,10 +42,7 @@ impl Lexer for PowerShellLexer {
                         }
                         pos += 1;
                     }
-                    tokens.push(Token {
-                        kind: TokenKind::Comment,
-                        span: start..pos,
-                    });
+                    tokens.push(Token { kind: TokenKind::Comment, span: start..pos });
                 }
 
                 // Double-quoted string
@@ -62,17 +55,16 @@ impl Lexer for PowerShellLexer {
                                 pos += 1;
                                 break;
                             }
-                            '$' if pos + 1 < bytes.len() && matches!(bytes[pos + 1] as char, '{' | '(' | 'a'..='z' | 'A'..='Z' | '_') => {
+                            '$' if pos + 1 < bytes.len()
+                                && matches!(bytes[pos + 1] as char, '{' | '(' | 'a'..='z' | 'A'..='Z' | '_') =>
+                            {
                                 // Variable inside string
                                 pos += 1;
                             }
                             _ => pos += 1,
                         }
                     }
-                    tokens.push(Token {
-                        kind: TokenKind::String,
-                        span: start..pos,
-                    });
+                    tokens.push(Token { kind: TokenKind::String, span: start..pos });
                 }
 
                 // Single-quoted string
@@ -90,10 +82,7 @@ impl Lexer for PowerShellLexer {
                             pos += 1;
                         }
                     }
-                    tokens.push(Token {
-                        kind: TokenKind::String,
-                        span: start..pos,
-                    });
+                    tokens.push(Token { kind: TokenKind::String, span: start..pos });
                 }
 
                 // Here-string @" or @'
@@ -106,16 +95,17 @@ impl Lexer for PowerShellLexer {
                     }
                     // Read until closing quote on new line
                     while pos + 1 < bytes.len() {
-                        if bytes[pos] == b'\n' && bytes[pos + 1] == quote && pos + 2 < bytes.len() && bytes[pos + 2] == b'@' {
+                        if bytes[pos] == b'\n'
+                            && bytes[pos + 1] == quote
+                            && pos + 2 < bytes.len()
+                            && bytes[pos + 2] == b'@'
+                        {
                             pos += 3;
                             break;
                         }
                         pos += 1;
                     }
-                    tokens.push(Token {
-                        kind: TokenKind::String,
-                        span: start..pos,
-                    });
+                    tokens.push(Token { kind: TokenKind::String, span: start..pos });
                 }
 
                 // Variables
@@ -152,23 +142,25 @@ impl Lexer for PowerShellLexer {
                             }
                             // Regular variable
                             'a'..='z' | 'A'..='Z' | '_' => {
-                                while pos < bytes.len() && matches!(bytes[pos] as char, 'a'..='z' | 'A'..='Z' | '0'..='9' | '_' | ':') {
+                                while pos < bytes.len()
+                                    && matches!(bytes[pos] as char, 'a'..='z' | 'A'..='Z' | '0'..='9' | '_' | ':')
+                                {
                                     pos += 1;
                                 }
                             }
                             _ => {}
                         }
                     }
-                    tokens.push(Token {
-                        kind: TokenKind::VariableName,
-                        span: start..pos,
-                    });
+                    tokens.push(Token { kind: TokenKind::VariableName, span: start..pos });
                 }
 
                 // Numbers
                 '0'..='9' => {
                     // Hex
-                    if ch == '0' && pos + 1 < bytes.len() && matches!(bytes[pos + 1] as char, 'x' | 'X') {
+                    if ch == '0'
+                        && pos + 1 < bytes.len()
+                        && matches!(bytes[pos + 1] as char, 'x' | 'X')
+                    {
                         pos += 2;
                         while pos < bytes.len() && (bytes[pos] as char).is_ascii_hexdigit() {
                             pos += 1;
@@ -178,22 +170,28 @@ impl Lexer for PowerShellLexer {
                             pos += 1;
                         }
                         // Decimal point
-                        if pos < bytes.len() && bytes[pos] == b'.' && pos + 1 < bytes.len() && (bytes[pos + 1] as char).is_ascii_digit() {
+                        if pos < bytes.len()
+                            && bytes[pos] == b'.'
+                            && pos + 1 < bytes.len()
+                            && (bytes[pos + 1] as char).is_ascii_digit()
+                        {
                             pos += 1;
                             while pos < bytes.len() && (bytes[pos] as char).is_ascii_digit() {
                                 pos += 1;
                             }
                         }
                         // Type suffix (KB, MB, GB, TB, PB)
-                        if pos + 1 < bytes.len() && matches!(bytes[pos] as char, 'k' | 'K' | 'm' | 'M' | 'g' | 'G' | 't' | 'T' | 'p' | 'P') &&
-                           matches!(bytes[pos + 1] as char, 'b' | 'B') {
+                        if pos + 1 < bytes.len()
+                            && matches!(
+                                bytes[pos] as char,
+                                'k' | 'K' | 'm' | 'M' | 'g' | 'G' | 't' | 'T' | 'p' | 'P'
+                            )
+                            && matches!(bytes[pos + 1] as char, 'b' | 'B')
+                        {
                             pos += 2;
                         }
                     }
-                    tokens.push(Token {
-                        kind: TokenKind::Number,
-                        span: start..pos,
-                    });
+                    tokens.push(Token { kind: TokenKind::Number, span: start..pos });
                 }
 
                 // Keywords, cmdlets, and identifiers
@@ -204,22 +202,22 @@ impl Lexer for PowerShellLexer {
                             _ => break,
                         }
                     }
-                    
+
                     let word = std::str::from_utf8(&bytes[start..pos]).unwrap_or("");
                     let kind = match word.to_lowercase().as_str() {
                         // Keywords
-                        "begin" | "break" | "catch" | "class" | "continue" | "data" | "define" |
-                        "do" | "dynamicparam" | "else" | "elseif" | "end" | "exit" | "filter" |
-                        "finally" | "for" | "foreach" | "from" | "function" | "if" | "in" |
-                        "param" | "process" | "return" | "switch" | "throw" | "trap" | "try" |
-                        "until" | "using" | "var" | "while" | "workflow" | "parallel" | "sequence" |
-                        "inlinescript" => TokenKind::Keyword,
+                        "begin" | "break" | "catch" | "class" | "continue" | "data" | "define"
+                        | "do" | "dynamicparam" | "else" | "elseif" | "end" | "exit" | "filter"
+                        | "finally" | "for" | "foreach" | "from" | "function" | "if" | "in"
+                        | "param" | "process" | "return" | "switch" | "throw" | "trap" | "try"
+                        | "until" | "using" | "var" | "while" | "workflow" | "parallel"
+                        | "sequence" | "inlinescript" => TokenKind::Keyword,
 
                         // Operators (word-based)
-                        "and" | "or" | "not" | "xor" | "band" | "bor" | "bnot" | "bxor" |
-                        "eq" | "ne" | "gt" | "ge" | "lt" | "le" | "like" | "notlike" |
-                        "match" | "notmatch" | "contains" | "notcontains" | "notin" |
-                        "replace" | "is" | "isnot" | "as" | "split" | "join" | "f" => TokenKind::Operator,
+                        "and" | "or" | "not" | "xor" | "band" | "bor" | "bnot" | "bxor" | "eq"
+                        | "ne" | "gt" | "ge" | "lt" | "le" | "like" | "notlike" | "match"
+                        | "notmatch" | "contains" | "notcontains" | "notin" | "replace" | "is"
+                        | "isnot" | "as" | "split" | "join" | "f" => TokenKind::Operator,
 
                         // Boolean literals
                         "true" | "false" => TokenKind::Boolean,
@@ -229,7 +227,7 @@ impl Lexer for PowerShellLexer {
 
                         _ => TokenKind::Identifier,
                     };
-                    
+
                     tokens.push(Token { kind, span: start..pos });
                 }
 
@@ -237,33 +235,42 @@ impl Lexer for PowerShellLexer {
                 '-' if pos + 1 < bytes.len() && (bytes[pos + 1] as char).is_ascii_alphabetic() => {
                     // Parameter or operator starting with -
                     pos += 1;
-                    while pos < bytes.len() && matches!(bytes[pos] as char, 'a'..='z' | 'A'..='Z' | '0'..='9' | '_') {
+                    while pos < bytes.len()
+                        && matches!(bytes[pos] as char, 'a'..='z' | 'A'..='Z' | '0'..='9' | '_')
+                    {
                         pos += 1;
                     }
-                    tokens.push(Token {
-                        kind: TokenKind::Operator,
-                        span: start..pos,
-                    });
+                    tokens.push(Token { kind: TokenKind::Operator, span: start..pos });
                 }
 
-                '+' | '-' | '*' | '/' | '%' | '=' | '!' | '<' | '>' | '&' | '|' | '^' | '~' |
-                '?' | ':' | '.' | ',' | ';' | '(' | ')' | '[' | ']' | '{' | '}' | '@' => {
+                '+' | '-' | '*' | '/' | '%' | '=' | '!' | '<' | '>' | '&' | '|' | '^' | '~'
+                | '?' | ':' | '.' | ',' | ';' | '(' | ')' | '[' | ']' | '{' | '}' | '@' => {
                     pos += 1;
                     // Handle multi-character operators
                     if pos < bytes.len() {
                         let next = bytes[pos] as char;
-                        if matches!((ch, next),
-                            ('+', '+') | ('-', '-') | ('=', '=') | ('!', '=') |
-                            ('<', '=') | ('>', '=') | ('+', '=') | ('-', '=') |
-                            ('*', '=') | ('/', '=') | ('%', '=') | ('&', '&') | ('|', '|') |
-                            ('.', '.') | (':', ':')) {
+                        if matches!(
+                            (ch, next),
+                            ('+', '+')
+                                | ('-', '-')
+                                | ('=', '=')
+                                | ('!', '=')
+                                | ('<', '=')
+                                | ('>', '=')
+                                | ('+', '=')
+                                | ('-', '=')
+                                | ('*', '=')
+                                | ('/', '=')
+                                | ('%', '=')
+                                | ('&', '&')
+                                | ('|', '|')
+                                | ('.', '.')
+                                | (':', ':')
+                        ) {
                             pos += 1;
                         }
                     }
-                    tokens.push(Token {
-                        kind: TokenKind::Operator,
-                        span: start..pos,
-                    });
+                    tokens.push(Token { kind: TokenKind::Operator, span: start..pos });
                 }
 
                 // Backtick (escape or line continuation)
@@ -272,19 +279,13 @@ impl Lexer for PowerShellLexer {
                     if pos < bytes.len() {
                         pos += 1;
                     }
-                    tokens.push(Token {
-                        kind: TokenKind::Operator,
-                        span: start..pos,
-                    });
+                    tokens.push(Token { kind: TokenKind::Operator, span: start..pos });
                 }
 
                 // Unknown character
                 _ => {
-                    pos += 1;
-                    tokens.push(Token {
-                        kind: TokenKind::Error,
-                        span: start..pos,
-                    });
+                    pos += char_len(text, pos);
+                    tokens.push(Token { kind: TokenKind::Error, span: start..pos });
                 }
             }
         }
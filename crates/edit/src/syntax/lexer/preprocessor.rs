@@ -0,0 +1,219 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//! The C preprocessor, as far as the C and C++ lexers share it.
+//!
+//! A directive runs from a `#` at the start of a line to the end of its logical line,
+//! which a backslash before the newline continues. The lexers tokenize the body of a
+//! directive with their usual rules, so that `#if A && !defined(B)` gets operators and
+//! identifiers, and use [`Directive`] for what differs in there: the parameters of a
+//! macro, `defined` in conditions, `#` and `##` in macro bodies and where it all ends.
+
+use std::ops::Range;
+
+use crate::syntax::lexer::{is_ident_continue, is_ident_start};
+use crate::syntax::{Token, TokenKind};
+
+/// What a directive is about, as far as its body is lexed differently.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+enum DirectiveKind {
+    /// `#define`, whose body may contain the parameters, `#` and `##`.
+    Define,
+    /// `#if` and `#elif`, whose conditions may contain `defined`.
+    Condition,
+    Other,
+}
+
+/// The directive a lexer is in.
+pub(crate) struct Directive {
+    kind: DirectiveKind,
+    /// The parameters of a function-like macro.
+    params: Vec<Range<usize>>,
+    /// Whether the macro takes `...`, which the body refers to as `__VA_ARGS__`.
+    variadic: bool,
+}
+
+impl Directive {
+    /// Lexes the `#` at `pos` and the name of the directive, plus whatever depends
+    /// on the name: the name and parameters of a macro, the `<path>` of an `#include`
+    /// and the message of an `#error`. Returns the directive and where its body starts.
+    pub(crate) fn lex(text: &[u8], mut pos: usize, tokens: &mut Vec<Token>) -> (Self, usize) {
+        let start = pos;
+        pos = skip_blanks(text, pos + 1);
+        let name_start = pos;
+        while pos < text.len() && is_ident_continue(text[pos]) {
+            pos += 1;
+        }
+        tokens.push(Token::new(TokenKind::Macro, start..pos));
+
+        let mut directive =
+            Self { kind: DirectiveKind::Other, params: Vec::new(), variadic: false };
+        match &text[name_start..pos] {
+            b"define" => {
+                directive.kind = DirectiveKind::Define;
+                pos = blanks(text, pos, tokens);
+                let name = pos;
+                if pos < text.len() && is_ident_start(text[pos]) {
+                    while pos < text.len() && is_ident_continue(text[pos]) {
+                        pos += 1;
+                    }
+                    tokens.push(Token::new(TokenKind::Macro, name..pos));
+                    // Only a `(` right after the name makes it function-like.
+                    if text.get(pos) == Some(&b'(') {
+                        pos = directive.parameters(text, pos, tokens);
+                    }
+                }
+            }
+            b"if" | b"elif" => directive.kind = DirectiveKind::Condition,
+            b"include" | b"include_next" | b"import" | b"embed" => {
+                pos = blanks(text, pos, tokens);
+                if text.get(pos) == Some(&b'<') {
+                    let path = pos;
+                    while pos < text.len() && !matches!(text[pos], b'>' | b'\n') {
+                        pos += 1;
+                    }
+                    if text.get(pos) == Some(&b'>') {
+                        pos += 1;
+                    }
+                    tokens.push(Token::new(TokenKind::String, path..pos));
+                }
+            }
+            // The message is free text, where `'` doesn't start a character literal.
+            b"error" | b"warning" => {
+                pos = blanks(text, pos, tokens);
+                let message = pos;
+                pos = line_end(text, pos);
+                while pos > message && matches!(text[pos - 1], b' ' | b'\t' | b'\r') {
+                    pos -= 1;
+                }
+                if pos > message {
+                    tokens.push(Token::new(TokenKind::String, message..pos));
+                }
+            }
+            _ => {}
+        }
+        (directive, pos)
+    }
+
+    /// Lexes the parameter list of a function-like macro at the `(` at `pos`,
+    /// up to and including the `)`, and returns the position after it.
+    fn parameters(&mut self, text: &[u8], mut pos: usize, tokens: &mut Vec<Token>) -> usize {
+        tokens.push(Token::new(TokenKind::Operator, pos..pos + 1));
+        pos += 1;
+        loop {
+            pos = blanks(text, pos, tokens);
+            let start = pos;
+            match text.get(pos) {
+                Some(&b) if is_ident_start(b) => {
+                    while pos < text.len() && is_ident_continue(text[pos]) {
+                        pos += 1;
+                    }
+                    self.params.push(start..pos);
+                    tokens.push(Token::new(TokenKind::ParameterName, start..pos));
+                }
+                Some(b'.') if text[pos..].starts_with(b"...") => {
+                    self.variadic = true;
+                    pos += 3;
+                    tokens.push(Token::new(TokenKind::Operator, start..pos));
+                }
+                Some(b',') => {
+                    pos += 1;
+                    tokens.push(Token::new(TokenKind::Operator, start..pos));
+                }
+                Some(b')') => {
+                    pos += 1;
+                    tokens.push(Token::new(TokenKind::Operator, start..pos));
+                    return pos;
+                }
+                // Anything else, like a newline, is left to the lexer.
+                _ => return pos,
+            }
+        }
+    }
+
+    /// Returns the kind of the identifier `word` in the body of the directive,
+    /// where it would otherwise be `kind`.
+    pub(crate) fn identifier_kind(&self, text: &[u8], word: &[u8], kind: TokenKind) -> TokenKind {
+        match self.kind {
+            DirectiveKind::Define
+                if self.params.iter().any(|p| &text[p.clone()] == word)
+                    || (self.variadic && matches!(word, b"__VA_ARGS__" | b"__VA_OPT__")) =>
+            {
+                TokenKind::ParameterName
+            }
+            DirectiveKind::Condition
+                if matches!(
+                    word,
+                    b"defined"
+                        | b"__has_include"
+                        | b"__has_include_next"
+                        | b"__has_embed"
+                        | b"__has_c_attribute"
+                        | b"__has_cpp_attribute"
+                        | b"__has_builtin"
+                ) =>
+            {
+                TokenKind::KeywordOperator
+            }
+            _ => kind,
+        }
+    }
+
+    /// Lexes `#` or `##` at `pos` in the body of the directive and returns its end.
+    /// They stringize and paste tokens in macros, and are an error anywhere else.
+    pub(crate) fn hash(&self, text: &[u8], pos: usize, tokens: &mut Vec<Token>) -> usize {
+        let end = if text[pos..].starts_with(b"##") { pos + 2 } else { pos + 1 };
+        let kind = match self.kind {
+            DirectiveKind::Define => TokenKind::MacroOperator,
+            _ => TokenKind::Error,
+        };
+        tokens.push(Token::new(kind, pos..end));
+        end
+    }
+}
+
+/// Whether the `#` at `pos` starts a directive, because only blanks precede it on its line.
+pub(crate) fn starts_directive(text: &[u8], pos: usize) -> bool {
+    text[..pos].iter().rev().take_while(|&&b| b != b'\n').all(|&b| matches!(b, b' ' | b'\t'))
+}
+
+/// Whether the backslash at `pos` continues the directive on the next line.
+pub(crate) fn is_continuation(text: &[u8], pos: usize) -> bool {
+    matches!(&text[pos + 1..], [b'\n', ..] | [b'\r', b'\n', ..])
+}
+
+/// Whether the `whitespace` in a directive ends it with a newline that isn't
+/// preceded by a backslash.
+pub(crate) fn ends_directive(text: &[u8], whitespace: Range<usize>) -> bool {
+    whitespace.filter(|&i| text[i] == b'\n').any(|newline| {
+        let line = &text[..newline];
+        !line.strip_suffix(b"\r").unwrap_or(line).ends_with(b"\\")
+    })
+}
+
+/// Returns the end of the logical line at `pos`, before its newline.
+fn line_end(text: &[u8], mut pos: usize) -> usize {
+    while pos < text.len() {
+        if text[pos] == b'\n' && !text[..pos].ends_with(b"\\") && !text[..pos].ends_with(b"\\\r") {
+            break;
+        }
+        pos += 1;
+    }
+    pos
+}
+
+fn skip_blanks(text: &[u8], mut pos: usize) -> usize {
+    while pos < text.len() && matches!(text[pos], b' ' | b'\t') {
+        pos += 1;
+    }
+    pos
+}
+
+/// Lexes the spaces and tabs at `pos` as whitespace and returns their end.
+fn blanks(text: &[u8], pos: usize, tokens: &mut Vec<Token>) -> usize {
+    let end = skip_blanks(text, pos);
+    if end > pos {
+        tokens.push(Token::new(TokenKind::Whitespace, pos..end));
+    }
+    end
+}
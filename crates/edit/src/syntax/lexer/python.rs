@@ -2,90 +2,111 @@
 // Licensed under the MIT License.
 
 //! High-performance Python lexer.
+//!
+//! F-strings are lexed with [`interpolated_string`]. A replacement field holds an
+//! expression, lexed like the code around it, and optionally a conversion like `!r` and
+//! a format spec like `:>{width}`, which are [`TokenKind::FormatSpecifier`] tokens
+//! apart from the replacement fields nested in the spec.
 
-use crate::syntax::lexer::{Lexer, is_ident_start, is_ident_continue, is_ascii_digit};
-use crate::syntax::{Token, TokenKind};
+use crate::syntax::lexer::interpolation::{
+    InterpolatedString, MAX_INTERPOLATION_DEPTH, interpolated_string,
+};
+use crate::syntax::lexer::{
+    Checkpoints, Resumable, UnicodeIdents, char_len, ident_end, is_ascii_digit, is_ident_continue,
+    is_ident_start, is_unicode_ident_start,
+};
+use crate::syntax::{Token, TokenKind, TokenPayload};
 
 pub struct PythonLexer;
 
-impl Lexer for PythonLexer {
-    fn tokenize(&self, text: &[u8]) -> Vec<Token> {
-        let mut tokens = Vec::with_capacity(text.len() / 8);
-        let mut pos = 0;
+impl Resumable for PythonLexer {
+    type State = ();
 
-        while pos < text.len() {
-            let start = pos;
-            let b = text[pos];
+    fn lex(
+        &self,
+        text: &[u8],
+        pos: usize,
+        _: (),
+        tokens: &mut Vec<Token>,
+        checkpoints: &mut Checkpoints<()>,
+    ) {
+        lex(text, pos, 0, tokens, checkpoints);
+    }
 
-            match b {
-                // Whitespace
-                b' ' | b'\t' | b'\r' => {
-                    while pos < text.len() && matches!(text[pos], b' ' | b'\t' | b'\r') {
-                        pos += 1;
-                    }
-                    tokens.push(Token::new(TokenKind::Whitespace, start..pos));
-                }
+    fn finish(&self, text: &[u8], tokens: &mut Vec<Token>) {
+        mark_docstrings(text, tokens);
+    }
+
+    fn needs_whole_text(&self) -> bool {
+        true
+    }
+}
 
-                // Newline (significant in Python)
-                b'\n' => {
+/// Lexes the code from `pos`, `depth` replacement fields deep, and returns where it stopped.
+/// In a replacement field, that's at the `}`, `!` or `:` that ends its expression.
+/// Only the lines of the code outside of any are reported to `checkpoints`.
+fn lex(
+    text: &[u8],
+    mut pos: usize,
+    depth: usize,
+    tokens: &mut Vec<Token>,
+    checkpoints: &mut Checkpoints<()>,
+) -> usize {
+    // The brackets that are open, in which a `}`, `!` or `:` doesn't end the expression.
+    let mut brackets = 0usize;
+
+    while pos < text.len() {
+        if depth == 0
+            && checkpoints.due(text, tokens, pos)
+            && checkpoints.report(text, pos, tokens, 0, ())
+        {
+            return pos;
+        }
+        let start = pos;
+        let b = text[pos];
+
+        match b {
+            // Whitespace
+            b' ' | b'\t' | b'\r' => {
+                while pos < text.len() && matches!(text[pos], b' ' | b'\t' | b'\r') {
                     pos += 1;
-                    tokens.push(Token::new(TokenKind::Whitespace, start..pos));
                 }
+                tokens.push(Token::new(TokenKind::Whitespace, start..pos));
+            }
 
-                // Comments
-                b'#' => {
+            // Newline (significant in Python)
+            b'\n' => {
+                pos += 1;
+                tokens.push(Token::new(TokenKind::Whitespace, start..pos));
+            }
+
+            // Comments
+            b'#' => {
+                pos += 1;
+                while pos < text.len() && text[pos] != b'\n' {
                     pos += 1;
-                    while pos < text.len() && text[pos] != b'\n' {
-                        pos += 1;
-                    }
-                    tokens.push(Token::new(TokenKind::Comment, start..pos));
                 }
+                tokens.push(Token::new(TokenKind::Comment, start..pos));
+            }
 
-                // String literals
-                b'"' | b'\'' => {
-                    let quote = b;
-                    pos += 1;
-                    
-                    // Check for triple-quoted string
-                    let triple = pos + 1 < text.len() 
-                        && text[pos] == quote 
-                        && text[pos + 1] == quote;
-                    
-                    if triple {
-                        pos += 2;
-                        while pos + 2 < text.len() {
-                            if text[pos] == quote && text[pos + 1] == quote && text[pos + 2] == quote {
-                                pos += 3;
-                                break;
-                            }
-                            pos += 1;
-                        }
-                    } else {
-                        let mut escaped = false;
-                        while pos < text.len() {
-                            if escaped {
-                                escaped = false;
-                            } else if text[pos] == b'\\' {
-                                escaped = true;
-                            } else if text[pos] == quote {
-                                pos += 1;
-                                break;
-                            } else if text[pos] == b'\n' {
-                                break; // Unterminated string
-                            }
-                            pos += 1;
+            // String literals
+            b'"' | b'\'' => {
+                let quote = b;
+                pos += 1;
+
+                // Check for triple-quoted string
+                let triple = pos + 1 < text.len() && text[pos] == quote && text[pos + 1] == quote;
+
+                if triple {
+                    pos += 2;
+                    while pos < text.len() {
+                        if text[pos..].starts_with(&[quote; 3]) {
+                            pos += 3;
+                            break;
                         }
+                        pos += 1;
                     }
-                    
-                    tokens.push(Token::new(TokenKind::String, start..pos));
-                }
-
-                // F-strings
-                b'f' | b'F' if pos + 1 < text.len() && matches!(text[pos + 1], b'"' | b'\'') => {
-                    pos += 1;
-                    let quote = text[pos];
-                    pos += 1;
-                    
+                } else {
                     let mut escaped = false;
                     while pos < text.len() {
                         if escaped {
@@ -95,151 +116,315 @@ impl Lexer for PythonLexer {
                         } else if text[pos] == quote {
                             pos += 1;
                             break;
+                        } else if text[pos] == b'\n' {
+                            break; // Unterminated string
                         }
                         pos += 1;
                     }
-                    
-                    tokens.push(Token::new(TokenKind::String, start..pos));
                 }
 
-                // Numbers
-                b'0'..=b'9' => {
+                tokens.push(Token::new(TokenKind::String, start..pos));
+            }
+
+            // F-strings, with a prefix like `f` or `rf`
+            b'f' | b'F' | b'r' | b'R' if fstring_quote(text, pos).is_some() => {
+                pos = fstring_quote(text, pos).unwrap_or(pos);
+                let quote = text[pos];
+                let triple = text[pos..].starts_with(&[quote; 3]);
+                let open = pos + if triple { 3 } else { 1 };
+                let string = InterpolatedString {
+                    close: &text[pos..open],
+                    open: b"{",
+                    end: b'}',
+                    multiline: triple,
+                    doubled: true,
+                    expression: replacement_field,
+                };
+                pos = interpolated_string(text, start, open, &string, depth, tokens);
+            }
+
+            // Numbers
+            b'0'..=b'9' => {
+                pos += 1;
+
+                // Binary
+                if start + 1 < text.len()
+                    && text[start] == b'0'
+                    && matches!(text[start + 1], b'b' | b'B')
+                {
                     pos += 1;
-                    
-                    // Binary
-                    if start + 1 < text.len() && text[start] == b'0' && matches!(text[start + 1], b'b' | b'B') {
+                    while pos < text.len() && matches!(text[pos], b'0' | b'1' | b'_') {
                         pos += 1;
-                        while pos < text.len() && matches!(text[pos], b'0' | b'1' | b'_') {
-                            pos += 1;
-                        }
                     }
-                    // Octal
-                    else if start + 1 < text.len() && text[start] == b'0' && matches!(text[start + 1], b'o' | b'O') {
+                }
+                // Octal
+                else if start + 1 < text.len()
+                    && text[start] == b'0'
+                    && matches!(text[start + 1], b'o' | b'O')
+                {
+                    pos += 1;
+                    while pos < text.len() && matches!(text[pos], b'0'..=b'7' | b'_') {
                         pos += 1;
-                        while pos < text.len() && matches!(text[pos], b'0'..=b'7' | b'_') {
-                            pos += 1;
-                        }
                     }
-                    // Hexadecimal
-                    else if start + 1 < text.len() && text[start] == b'0' && matches!(text[start + 1], b'x' | b'X') {
+                }
+                // Hexadecimal
+                else if start + 1 < text.len()
+                    && text[start] == b'0'
+                    && matches!(text[start + 1], b'x' | b'X')
+                {
+                    pos += 1;
+                    while pos < text.len()
+                        && (is_ascii_digit(text[pos])
+                            || matches!(text[pos], b'a'..=b'f' | b'A'..=b'F' | b'_'))
+                    {
                         pos += 1;
-                        while pos < text.len() && (is_ascii_digit(text[pos]) || matches!(text[pos], b'a'..=b'f' | b'A'..=b'F' | b'_')) {
-                            pos += 1;
-                        }
                     }
-                    // Decimal or float
-                    else {
+                }
+                // Decimal or float
+                else {
+                    while pos < text.len() && (is_ascii_digit(text[pos]) || text[pos] == b'_') {
+                        pos += 1;
+                    }
+
+                    // Float
+                    if pos < text.len()
+                        && text[pos] == b'.'
+                        && pos + 1 < text.len()
+                        && is_ascii_digit(text[pos + 1])
+                    {
+                        pos += 1;
                         while pos < text.len() && (is_ascii_digit(text[pos]) || text[pos] == b'_') {
                             pos += 1;
                         }
-                        
-                        // Float
-                        if pos < text.len() && text[pos] == b'.' && pos + 1 < text.len() && is_ascii_digit(text[pos + 1]) {
+                    }
+
+                    // Exponent
+                    if pos < text.len() && matches!(text[pos], b'e' | b'E') {
+                        pos += 1;
+                        if pos < text.len() && matches!(text[pos], b'+' | b'-') {
                             pos += 1;
-                            while pos < text.len() && (is_ascii_digit(text[pos]) || text[pos] == b'_') {
-                                pos += 1;
-                            }
                         }
-                        
-                        // Exponent
-                        if pos < text.len() && matches!(text[pos], b'e' | b'E') {
+                        while pos < text.len() && (is_ascii_digit(text[pos]) || text[pos] == b'_') {
                             pos += 1;
-                            if pos < text.len() && matches!(text[pos], b'+' | b'-') {
-                                pos += 1;
-                            }
-                            while pos < text.len() && (is_ascii_digit(text[pos]) || text[pos] == b'_') {
-                                pos += 1;
-                            }
                         }
                     }
-                    
-                    tokens.push(Token::new(TokenKind::Number, start..pos));
                 }
 
-                // Identifiers and keywords
-                _ if is_ident_start(b) => {
-                    while pos < text.len() && is_ident_continue(text[pos]) {
-                        pos += 1;
+                tokens.push(Token::new(TokenKind::Number, start..pos));
+            }
+
+            // Identifiers and keywords
+            _ if is_ident_start(b) || is_unicode_ident_start(text, pos, UnicodeIdents::Xid) => {
+                pos = ident_end(text, pos, UnicodeIdents::Xid, is_ident_continue);
+
+                let word = &text[start..pos];
+                let kind = match word {
+                    b"and" | b"or" | b"not" | b"in" | b"is" => TokenKind::KeywordOperator,
+                    b"if" | b"elif" | b"else" | b"for" | b"while" | b"break" | b"continue"
+                    | b"return" | b"yield" | b"pass" | b"match" | b"case" => {
+                        TokenKind::KeywordControl
                     }
-                    
-                    let word = &text[start..pos];
-                    let kind = match word {
-                        b"and" | b"or" | b"not" | b"in" | b"is" => TokenKind::KeywordOperator,
-                        b"if" | b"elif" | b"else" | b"for" | b"while" | b"break" | b"continue" | b"return" | b"yield" | b"pass" | b"match" | b"case" => TokenKind::KeywordControl,
-                        b"def" | b"lambda" | b"async" | b"await" => TokenKind::KeywordFunction,
-                        b"import" | b"from" | b"as" => TokenKind::KeywordImport,
-                        b"class" => TokenKind::KeywordType,
-                        b"global" | b"nonlocal" | b"del" => TokenKind::KeywordStorage,
-                        b"try" | b"except" | b"finally" | b"raise" | b"assert" | b"with" => TokenKind::Keyword,
-                        b"True" | b"False" => TokenKind::Boolean,
-                        b"None" => TokenKind::Null,
-                        _ => TokenKind::Identifier,
-                    };
-                    
-                    tokens.push(Token::new(kind, start..pos));
-                }
+                    b"def" | b"lambda" | b"async" | b"await" => TokenKind::KeywordFunction,
+                    b"import" | b"from" | b"as" => TokenKind::KeywordImport,
+                    b"class" => TokenKind::KeywordType,
+                    b"global" | b"nonlocal" | b"del" => TokenKind::KeywordStorage,
+                    b"try" | b"except" | b"finally" | b"raise" | b"assert" | b"with" => {
+                        TokenKind::Keyword
+                    }
+                    b"True" | b"False" => TokenKind::Boolean,
+                    b"None" => TokenKind::Null,
+                    _ => TokenKind::Identifier,
+                };
+
+                tokens.push(Token::new(kind, start..pos));
+            }
 
-                // Decorators
-                b'@' if pos + 1 < text.len() && is_ident_start(text[pos + 1]) => {
+            // Decorators
+            b'@' if pos + 1 < text.len() && is_ident_start(text[pos + 1]) => {
+                pos += 1;
+                while pos < text.len() && (is_ident_continue(text[pos]) || text[pos] == b'.') {
                     pos += 1;
-                    while pos < text.len() && (is_ident_continue(text[pos]) || text[pos] == b'.') {
-                        pos += 1;
-                    }
-                    tokens.push(Token::new(TokenKind::Attribute, start..pos));
                 }
+                tokens.push(Token::new(TokenKind::Attribute, start..pos));
+            }
 
-                // Operators
-                b'+' | b'-' | b'*' | b'/' | b'%' | b'&' | b'|' | b'^' | b'~' | b'!' | b'=' | b'<' | b'>' => {
-                    pos += 1;
-                    // Handle multi-character operators
-                    if pos < text.len() {
-                        match text[pos] {
-                            b'=' | b'*' | b'/' | b'<' | b'>' => {
-                                pos += 1;
-                            }
-                            _ => {}
+            // The end of the expression in a replacement field, but not `!=`
+            b'}' | b':' | b'!' if depth > 0 && brackets == 0 && !text[pos..].starts_with(b"!=") => {
+                return pos;
+            }
+
+            // Operators
+            b'+' | b'-' | b'*' | b'/' | b'%' | b'&' | b'|' | b'^' | b'~' | b'!' | b'=' | b'<'
+            | b'>' => {
+                pos += 1;
+                // Handle multi-character operators
+                if pos < text.len() {
+                    match text[pos] {
+                        b'=' | b'*' | b'/' | b'<' | b'>' => {
+                            pos += 1;
                         }
+                        _ => {}
                     }
-                    tokens.push(Token::new(TokenKind::Operator, start..pos));
                 }
+                tokens.push(Token::new(TokenKind::Operator, start..pos));
+            }
 
-                // Delimiters
-                b'{' | b'}' | b'[' | b']' | b'(' | b')' => {
-                    pos += 1;
-                    tokens.push(Token::new(TokenKind::Delimiter, start..pos));
+            // Delimiters
+            b'{' | b'}' | b'[' | b']' | b'(' | b')' => {
+                if matches!(b, b'{' | b'[' | b'(') {
+                    brackets += 1;
+                } else {
+                    brackets = brackets.saturating_sub(1);
                 }
+                pos += 1;
+                tokens.push(Token::new(TokenKind::Delimiter, start..pos));
+            }
 
-                // Punctuation
-                b',' | b';' | b':' | b'.' => {
-                    pos += 1;
-                    tokens.push(Token::new(TokenKind::Punctuation, start..pos));
-                }
+            // Punctuation
+            b',' | b';' | b':' | b'.' => {
+                pos += 1;
+                tokens.push(Token::new(TokenKind::Punctuation, start..pos));
+            }
 
-                // Unknown
-                _ => {
-                    pos += 1;
-                    tokens.push(Token::new(TokenKind::Error, start..pos));
-                }
+            // Unknown
+            _ => {
+                pos += char_len(text, pos);
+                tokens.push(Token::new(TokenKind::Error, start..pos));
             }
         }
+    }
+
+    pos
+}
+
+/// Returns the position of the opening quote of the f-string whose prefix starts at `pos`.
+fn fstring_quote(text: &[u8], pos: usize) -> Option<usize> {
+    let prefix = match text.get(pos..pos + 2)? {
+        [b'f' | b'F', b'r' | b'R'] | [b'r' | b'R', b'f' | b'F'] => 2,
+        [b'f' | b'F', _] => 1,
+        _ => return None,
+    };
+    matches!(text.get(pos + prefix), Some(b'"' | b'\'')).then_some(pos + prefix)
+}
 
-        tokens
+/// Lexes a replacement field of an f-string from after its `{`, up to its `}`: the
+/// expression, a conversion like `!r` and a format spec, see [`Expression`](super::interpolation::Expression).
+fn replacement_field(text: &[u8], pos: usize, depth: usize, tokens: &mut Vec<Token>) -> usize {
+    let mut pos = lex(text, pos, depth, tokens, &mut Checkpoints::none());
+    if text.get(pos) == Some(&b'!') {
+        let start = pos;
+        pos += 1;
+        while pos < text.len() && is_ident_continue(text[pos]) {
+            pos += 1;
+        }
+        tokens.push(Token::new(TokenKind::FormatSpecifier, start..pos));
+    }
+    if text.get(pos) == Some(&b':') {
+        pos = format_spec(text, pos, depth, tokens);
+    }
+    pos
+}
+
+/// Lexes the format spec of a replacement field from its `:` up to the `}` that closes the
+/// field, which may hold replacement fields of its own, like `{width}` in `:>{width}`.
+fn format_spec(text: &[u8], mut pos: usize, depth: usize, tokens: &mut Vec<Token>) -> usize {
+    let mut piece = pos;
+    while pos < text.len() && !matches!(text[pos], b'}' | b'\n') {
+        if text[pos] != b'{' || depth >= MAX_INTERPOLATION_DEPTH {
+            pos += 1;
+            continue;
+        }
+        if piece < pos {
+            tokens.push(Token::new(TokenKind::FormatSpecifier, piece..pos));
+        }
+        tokens.push(Token::new(TokenKind::Interpolation, pos..pos + 1));
+        let opener = tokens.len() - 1;
+        pos = replacement_field(text, pos + 1, depth + 1, tokens);
+        if text.get(pos) != Some(&b'}') {
+            tokens[opener].payload = Some(TokenPayload::Invalid);
+            return pos;
+        }
+        tokens.push(Token::new(TokenKind::Interpolation, pos..pos + 1));
+        pos += 1;
+        piece = pos;
+    }
+    if piece < pos {
+        tokens.push(Token::new(TokenKind::FormatSpecifier, piece..pos));
+    }
+    pos
+}
+
+/// Turn the strings which are the first statement of the module, or of the body of
+/// a `def` or `class`, into [`TokenKind::DocString`]s.
+fn mark_docstrings(text: &[u8], tokens: &mut [Token]) {
+    let significant: Vec<usize> = (0..tokens.len())
+        .filter(|&i| !tokens[i].kind.is_trivia() && !tokens[i].is_empty())
+        .collect();
+    let text_of =
+        |n: usize| significant.get(n).map_or(&b""[..], |&i| &text[tokens[i].span.clone()]);
+
+    // The positions in `significant` where a body, and thus possibly a docstring, starts.
+    let mut starts = vec![0];
+    let mut header = false;
+    let mut depth = 0usize;
+    for n in 0..significant.len() {
+        match text_of(n) {
+            b"def" | b"class" if depth == 0 => header = true,
+            b"(" | b"[" | b"{" => depth += 1,
+            b")" | b"]" | b"}" => depth = depth.saturating_sub(1),
+            b":" if header && depth == 0 => {
+                header = false;
+                starts.push(n + 1);
+            }
+            _ => {}
+        }
+    }
+
+    let mut docstrings = Vec::new();
+    for n in starts {
+        // String prefixes like `r` in `r"""..."""` are lexed as identifiers.
+        let prefixed = matches!(text_of(n), b"r" | b"R" | b"u" | b"U")
+            && significant.get(n + 1).is_some_and(|&j| {
+                tokens[j].kind == TokenKind::String
+                    && tokens[j].span.start == tokens[significant[n]].span.end
+            });
+        let last = if prefixed { n + 1 } else { n };
+        let Some(&string) = significant.get(last) else {
+            continue;
+        };
+        if tokens[string].kind != TokenKind::String {
+            continue;
+        }
+
+        // The string must be the entire statement, not e.g. the start of `"a" + b`.
+        let statement_ends = significant.get(last + 1).is_none_or(|&next| {
+            text_of(last + 1) == b";"
+                || text[tokens[string].span.end..tokens[next].span.start].contains(&b'\n')
+        });
+        if statement_ends {
+            docstrings.extend_from_slice(&significant[n..=last]);
+        }
+    }
+
+    for i in docstrings {
+        tokens[i].kind = TokenKind::DocString;
     }
 }
 
 #[cfg(test)]
 mod tests {
     use super::*;
+    use crate::syntax::Lexer;
 
     #[test]
     fn test_python_keywords() {
         let lexer = PythonLexer;
         let text = b"def main(): pass";
         let tokens = lexer.tokenize(text);
-        
+
         let has_def = tokens.iter().any(|t| t.kind == TokenKind::KeywordFunction);
         let has_pass = tokens.iter().any(|t| t.kind == TokenKind::KeywordControl);
-        
+
         assert!(has_def);
         assert!(has_pass);
     }
@@ -249,20 +434,64 @@ mod tests {
         let lexer = PythonLexer;
         let text = br#"'single' "double" """triple""""#;
         let tokens = lexer.tokenize(text);
-        
-        let strings: Vec<_> = tokens.iter()
-            .filter(|t| t.kind == TokenKind::String)
-            .collect();
-        
+
+        let strings: Vec<_> = tokens.iter().filter(|t| t.kind == TokenKind::String).collect();
+
         assert_eq!(strings.len(), 3);
     }
 
+    #[test]
+    fn test_python_docstrings() {
+        let text = br#"
+"""Module docstring."""
+
+def area(r: float) -> dict[str, float]:
+    """Compute the area.
+
+    Spans several lines.
+    """
+    note = """Not a docstring."""
+    "Not a docstring either, since it isn't first."
+    return r
+
+class Shape(Base): r'''Raw docstring.'''
+
+def concat(): "a" + b
+x = {"key": "value"}
+"#;
+        let tokens = PythonLexer.tokenize(text);
+        let strings = |kind| {
+            tokens
+                .iter()
+                .filter(|t| t.kind == kind)
+                .map(|t| std::str::from_utf8(&text[t.span.clone()]).unwrap())
+                .collect::<Vec<_>>()
+        };
+
+        assert_eq!(
+            strings(TokenKind::DocString),
+            [
+                r#""""Module docstring.""""#,
+                "\"\"\"Compute the area.\n\n    Spans several lines.\n    \"\"\"",
+                "r",
+                "'''Raw docstring.'''",
+            ]
+        );
+        assert_eq!(strings(TokenKind::String).len(), 5);
+
+        let text = include_bytes!("../../../../../syntax-tests/test_syntax.py");
+        let tokens = PythonLexer.tokenize(text);
+        let docstring = tokens.iter().find(|t| t.kind == TokenKind::DocString).unwrap();
+        let docstring = &text[docstring.span.clone()];
+        assert!(docstring.starts_with(b"\"\"\"\n    Docstring with triple quotes"));
+    }
+
     #[test]
     fn test_python_decorator() {
         let lexer = PythonLexer;
         let text = b"@decorator\ndef foo(): pass";
         let tokens = lexer.tokenize(text);
-        
+
         let has_decorator = tokens.iter().any(|t| t.kind == TokenKind::Attribute);
         assert!(has_decorator);
     }
@@ -0,0 +1,309 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//! Lexing again from the start of a line, for [`IncrementalLexer`].
+//!
+//! A lexer that implements [`Resumable`] reports a [`Checkpoint`] at the start of each line
+//! where what it knows fits in a state of its own, like the brackets open in Go. Lexing
+//! from a checkpoint with its tokens before it gives the same tokens as lexing the whole
+//! text, as long as the text up to its [`lookahead`](Checkpoint::lookahead) is the same.
+//!
+//! Lines are where whitespace with a newline in it ends. Whatever a lexer finds out about
+//! the lines above a later one, other than from the tokens right before it, has to be in the
+//! state, and whatever it changes in the tokens before a checkpoint has to wait for
+//! [`Resumable::finish`], like marking Go's doc comments.
+//!
+//! [`IncrementalLexer`]: crate::syntax::IncrementalLexer
+
+use std::any::Any;
+use std::sync::Arc;
+
+use crate::syntax::lexer::UNTERMINATED_COMMENT_LINES;
+use crate::syntax::{Lexer, Token, TokenKind, TokenPayload};
+
+/// Where a lexer can pick up lexing again, see [`Lexer::resume`].
+#[derive(Clone, Default)]
+pub struct Checkpoint {
+    /// The offset of the first token of the line.
+    pub(crate) pos: usize,
+    /// The number of tokens before it.
+    pub(crate) index: usize,
+    /// The end of the text that the tokens before it depend on, which may be past `pos`,
+    /// like for a `/*` that's never closed. `usize::MAX` if it's the end of the text.
+    pub(crate) lookahead: usize,
+    /// How many significant tokens before it the lexer may look at after it.
+    pub(crate) lookbehind: usize,
+    /// What else the lexer knows there. The checkpoint at the start of the text has none.
+    pub(crate) state: LexerState,
+}
+
+impl Checkpoint {
+    /// Whether lexing may pick up again here after an edit at `offset`, since the tokens
+    /// before it and its state don't depend on the text from there on.
+    pub(crate) fn precedes(&self, offset: usize) -> bool {
+        self.index == 0 || (self.pos < offset && self.lookahead <= offset)
+    }
+}
+
+/// The state of a [`Resumable`] lexer, behind a pointer that's shared by the checkpoints
+/// of the lines it doesn't change on.
+#[derive(Clone, Default)]
+pub(crate) struct LexerState(Option<Arc<dyn AnyState>>);
+
+trait AnyState: Send + Sync {
+    fn as_any(&self) -> &dyn Any;
+    fn equals(&self, other: &dyn AnyState) -> bool;
+}
+
+impl<T: Any + PartialEq + Send + Sync> AnyState for T {
+    fn as_any(&self) -> &dyn Any {
+        self
+    }
+
+    fn equals(&self, other: &dyn AnyState) -> bool {
+        other.as_any().downcast_ref::<T>() == Some(self)
+    }
+}
+
+impl LexerState {
+    fn get<T: Any>(&self) -> Option<&T> {
+        self.0.as_ref().and_then(|state| state.as_any().downcast_ref())
+    }
+}
+
+impl PartialEq for LexerState {
+    fn eq(&self, other: &Self) -> bool {
+        match (&self.0, &other.0) {
+            (Some(a), Some(b)) => Arc::ptr_eq(a, b) || a.equals(&**b),
+            (None, None) => true,
+            _ => false,
+        }
+    }
+}
+
+/// The callback of [`Lexer::resume`] for each checkpoint, with the text and the tokens
+/// before it, whose offsets may be those of a part of the text the lexer was given.
+/// Returning true stops the lexer there.
+pub type ReportCheckpoint<'a> = dyn FnMut(&Checkpoint, &[u8], &[Token]) -> bool + 'a;
+
+/// Reports the checkpoints of a [`Resumable`] lexer, if anyone is asking.
+pub(crate) struct Checkpoints<'r, S> {
+    report: Option<&'r mut ReportCheckpoint<'r>>,
+    lookahead: usize,
+    last: LexerState,
+    /// How many lines a block comment that's never closed may span.
+    comment_lines: usize,
+    _state: std::marker::PhantomData<S>,
+}
+
+impl<'r, S: Clone + PartialEq + Send + Sync + 'static> Checkpoints<'r, S> {
+    fn new(
+        report: Option<&'r mut ReportCheckpoint<'r>>,
+        lookahead: usize,
+        comment_lines: usize,
+    ) -> Self {
+        Self {
+            report,
+            lookahead,
+            last: LexerState::default(),
+            comment_lines,
+            _state: std::marker::PhantomData,
+        }
+    }
+
+    /// Checkpoints that aren't reported, for lexing a part of a line on its own, like the
+    /// expression in one of Python's f-strings.
+    pub(crate) fn none() -> Self {
+        Self::new(None, 0, UNTERMINATED_COMMENT_LINES)
+    }
+
+    /// Whether `pos`, after `tokens`, starts a line that should be reported.
+    pub(crate) fn due(&self, text: &[u8], tokens: &[Token], pos: usize) -> bool {
+        self.report.is_some()
+            && tokens.last().is_some_and(|t| {
+                t.kind == TokenKind::Whitespace
+                    && t.payload.is_none()
+                    && t.span.end == pos
+                    && text[t.span.clone()].contains(&b'\n')
+            })
+    }
+
+    /// Notes that the tokens so far depend on the text up to `end`, past the line
+    /// they're on. `usize::MAX` is the end of the text, wherever it is.
+    pub(crate) fn look_ahead(&mut self, end: usize) {
+        self.lookahead = self.lookahead.max(end);
+    }
+
+    /// Pushes the `/* */` comment at `pos` like [`block_comment`](super::block_comment), up
+    /// to the lexer's [`unterminated_comment_lines`](Resumable::unterminated_comment_lines).
+    /// One that's never closed depends on the end of the text, since a `*/` anywhere
+    /// below would close it.
+    pub(crate) fn block_comment(
+        &mut self,
+        text: &[u8],
+        pos: usize,
+        tokens: &mut Vec<Token>,
+    ) -> usize {
+        let end = super::block_comment(text, pos, self.comment_lines, tokens);
+        if tokens.last().is_some_and(|t| t.payload == Some(TokenPayload::Invalid)) {
+            self.look_ahead(usize::MAX);
+        }
+        end
+    }
+
+    /// Reports the line at `pos` of `text`, after `tokens`, with `state`, after which the
+    /// lexer may look at up to `lookbehind` of the significant tokens before it, like
+    /// JavaScript at the token before a `/` to tell a regex from a division.
+    /// Returns true if the lexer should stop there.
+    pub(crate) fn report(
+        &mut self,
+        text: &[u8],
+        pos: usize,
+        tokens: &[Token],
+        lookbehind: usize,
+        state: S,
+    ) -> bool {
+        let Some(report) = &mut self.report else {
+            return false;
+        };
+        if self.last.get::<S>() != Some(&state) {
+            self.last = LexerState(Some(Arc::new(state)));
+        }
+        let checkpoint = Checkpoint {
+            pos,
+            index: tokens.len(),
+            lookahead: self.lookahead,
+            lookbehind,
+            state: self.last.clone(),
+        };
+        report(&checkpoint, text, tokens)
+    }
+}
+
+/// A lexer that can pick up lexing at the start of a line, see the [module docs](self).
+/// Every such lexer is a [`Lexer`].
+pub(crate) trait Resumable: Send + Sync {
+    /// What the lexer knows at the start of a line. The default is the start of the text.
+    type State: Clone + Default + PartialEq + Send + Sync + 'static;
+
+    /// Lex `text` from `pos` in `state`, after `tokens`, reporting each line to
+    /// `checkpoints` and returning when it says to stop.
+    fn lex(
+        &self,
+        text: &[u8],
+        pos: usize,
+        state: Self::State,
+        tokens: &mut Vec<Token>,
+        checkpoints: &mut Checkpoints<Self::State>,
+    );
+
+    /// Change the tokens of the whole text once it's lexed, like marking doc comments.
+    fn finish(&self, _text: &[u8], _tokens: &mut Vec<Token>) {}
+
+    /// Whether [`finish`](Self::finish) needs all of the text, see [`Lexer::needs_whole_text`].
+    fn needs_whole_text(&self) -> bool {
+        false
+    }
+
+    /// Whether lexing `text` may go on in `state`, which it may not if something
+    /// at its start that the lexer goes by has changed since. It's not asked at
+    /// the start of the text.
+    fn resumes(&self, _text: &[u8], _state: &Self::State) -> bool {
+        true
+    }
+
+    /// How many lines a block comment that's never closed may span, see
+    /// [`Lexer::set_unterminated_comment_lines`].
+    fn unterminated_comment_lines(&self) -> usize {
+        UNTERMINATED_COMMENT_LINES
+    }
+
+    /// See [`Lexer::set_unterminated_comment_lines`]. Only [`CommentLines`] keeps it.
+    fn set_unterminated_comment_lines(&mut self, _lines: usize) {}
+}
+
+impl<R: Resumable> Lexer for R {
+    fn tokenize(&self, text: &[u8]) -> Vec<Token> {
+        let mut tokens = Vec::with_capacity(text.len() / 8);
+        let mut checkpoints = Checkpoints::new(None, 0, self.unterminated_comment_lines());
+        self.lex(text, 0, R::State::default(), &mut tokens, &mut checkpoints);
+        Resumable::finish(self, text, &mut tokens);
+        tokens
+    }
+
+    fn resume(
+        &self,
+        text: &[u8],
+        from: &Checkpoint,
+        tokens: &mut Vec<Token>,
+        report: &mut ReportCheckpoint,
+    ) -> bool {
+        let state = from.state.get::<R::State>().cloned().unwrap_or_default();
+        if from.index > 0 && !self.resumes(text, &state) {
+            return false;
+        }
+        let mut checkpoints =
+            Checkpoints::new(Some(report), from.lookahead, self.unterminated_comment_lines());
+        self.lex(text, from.pos, state, tokens, &mut checkpoints);
+        true
+    }
+
+    fn finish(&self, text: &[u8], tokens: &mut Vec<Token>) {
+        Resumable::finish(self, text, tokens);
+    }
+
+    fn needs_whole_text(&self) -> bool {
+        Resumable::needs_whole_text(self)
+    }
+    fn set_unterminated_comment_lines(&mut self, lines: usize) {
+        Resumable::set_unterminated_comment_lines(self, lines);
+    }
+}
+
+/// A lexer with `/* */` comments, whose cap on the lines of those that are never closed
+/// can be changed, see [`Lexer::set_unterminated_comment_lines`].
+pub(crate) struct CommentLines<R> {
+    lexer: R,
+    lines: usize,
+}
+
+impl<R> CommentLines<R> {
+    pub(crate) fn new(lexer: R) -> Self {
+        Self { lexer, lines: UNTERMINATED_COMMENT_LINES }
+    }
+}
+
+impl<R: Resumable> Resumable for CommentLines<R> {
+    type State = R::State;
+
+    fn lex(
+        &self,
+        text: &[u8],
+        pos: usize,
+        state: R::State,
+        tokens: &mut Vec<Token>,
+        checkpoints: &mut Checkpoints<R::State>,
+    ) {
+        self.lexer.lex(text, pos, state, tokens, checkpoints);
+    }
+
+    fn finish(&self, text: &[u8], tokens: &mut Vec<Token>) {
+        Resumable::finish(&self.lexer, text, tokens);
+    }
+
+    fn needs_whole_text(&self) -> bool {
+        Resumable::needs_whole_text(&self.lexer)
+    }
+
+    fn resumes(&self, text: &[u8], state: &R::State) -> bool {
+        self.lexer.resumes(text, state)
+    }
+
+    fn unterminated_comment_lines(&self) -> usize {
+        self.lines
+    }
+
+    fn set_unterminated_comment_lines(&mut self, lines: usize) {
+        self.lines = lines;
+    }
+}
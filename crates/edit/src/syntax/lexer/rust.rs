@@ -3,17 +3,43 @@
 
 //! High-performance Rust lexer with full language support.
 
-use crate::syntax::lexer::{Lexer, is_whitespace, is_ident_start, is_ident_continue, is_ascii_digit};
+use crate::syntax::lexer::{
+    Checkpoints, Resumable, UnicodeIdents, char_len, ident_end, is_ascii_digit, is_ident_continue,
+    is_ident_start, is_unicode_ident_start, is_whitespace,
+};
 use crate::syntax::{Token, TokenKind};
 
 pub struct RustLexer;
 
-impl Lexer for RustLexer {
-    fn tokenize(&self, text: &[u8]) -> Vec<Token> {
-        let mut tokens = Vec::with_capacity(text.len() / 8);
-        let mut pos = 0;
+/// Returns the length of a raw string's opening, like `r#"` or `br"`, and its number of `#`.
+fn raw_string_start(text: &[u8]) -> Option<(usize, usize)> {
+    let prefix = match text {
+        [b'b' | b'c', b'r', ..] => 2,
+        [b'r', ..] => 1,
+        _ => return None,
+    };
+    let hashes = text[prefix..].iter().take_while(|&&b| b == b'#').count();
+    (text.get(prefix + hashes) == Some(&b'"')).then_some((prefix + hashes + 1, hashes))
+}
+
+impl Resumable for RustLexer {
+    /// How many `<` of a turbofish like `::<Vec<u8>>` are open.
+    type State = usize;
 
+    fn lex(
+        &self,
+        text: &[u8],
+        mut pos: usize,
+        mut turbofish: usize,
+        tokens: &mut Vec<Token>,
+        checkpoints: &mut Checkpoints<usize>,
+    ) {
         while pos < text.len() {
+            if checkpoints.due(text, tokens, pos)
+                && checkpoints.report(text, pos, tokens, 0, turbofish)
+            {
+                return;
+            }
             let start = pos;
             let b = text[pos];
 
@@ -35,7 +61,7 @@ impl Lexer for RustLexer {
                     tokens.push(Token::new(TokenKind::Comment, start..pos));
                 }
 
-                // Block comment
+                // Block comment, which nests: `/* a /* b */ c */` is one comment
                 b'/' if pos + 1 < text.len() && text[pos + 1] == b'*' => {
                     pos += 2;
                     let mut depth = 1;
@@ -50,11 +76,18 @@ impl Lexer for RustLexer {
                             pos += 1;
                         }
                     }
+                    // An unclosed comment runs to the end, including its last byte.
+                    if depth > 0 {
+                        pos = text.len();
+                    }
                     tokens.push(Token::new(TokenKind::Comment, start..pos));
                 }
 
-                // String literal
-                b'"' => {
+                // String literal, also byte and C strings (b"..", c"..")
+                b'"' | b'b' | b'c' if b == b'"' || text.get(pos + 1) == Some(&b'"') => {
+                    if b != b'"' {
+                        pos += 1;
+                    }
                     pos += 1;
                     let mut escaped = false;
                     while pos < text.len() {
@@ -71,20 +104,28 @@ impl Lexer for RustLexer {
                     tokens.push(Token::new(TokenKind::String, start..pos));
                 }
 
-                // Raw string literal
-                b'r' if pos + 1 < text.len() && text[pos + 1] == b'"' => {
-                    pos += 2;
-                    while pos < text.len() && text[pos] != b'"' {
-                        pos += 1;
-                    }
-                    if pos < text.len() {
+                // Raw string literal: r"..", r#".."# and the byte and C versions (br"..", cr"..")
+                b'r' | b'b' | b'c' if raw_string_start(&text[pos..]).is_some() => {
+                    let (open, hashes) = raw_string_start(&text[pos..]).unwrap_or_default();
+                    pos += open;
+                    while pos < text.len() {
+                        if text[pos] == b'"'
+                            && text[pos + 1..].iter().take_while(|&&b| b == b'#').count() >= hashes
+                        {
+                            pos += 1 + hashes;
+                            break;
+                        }
                         pos += 1;
                     }
                     tokens.push(Token::new(TokenKind::String, start..pos));
                 }
 
-                // Lifetime (must come before character literals)
-                b'\'' if pos + 1 < text.len() && is_ident_start(text[pos + 1]) => {
+                // Lifetime (must come before character literals), unless it's closed like `'a'`
+                b'\''
+                    if pos + 1 < text.len()
+                        && is_ident_start(text[pos + 1])
+                        && text.get(pos + 2) != Some(&b'\'') =>
+                {
                     pos += 1;
                     while pos < text.len() && is_ident_continue(text[pos]) {
                         pos += 1;
@@ -92,14 +133,19 @@ impl Lexer for RustLexer {
                     tokens.push(Token::new(TokenKind::RustLifetime, start..pos));
                 }
 
-                // Character literal
-                b'\'' => {
+                // Character literal, also byte characters (b'x')
+                b'\'' | b'b' if b == b'\'' || text.get(pos + 1) == Some(&b'\'') => {
+                    if b != b'\'' {
+                        pos += 1;
+                    }
                     pos += 1;
                     if pos < text.len() && text[pos] == b'\\' {
-                        pos += 1; // Skip escape character
-                    }
-                    if pos < text.len() {
-                        pos += 1; // Skip character
+                        pos = (pos + 2).min(text.len()); // Skip escape character, like `\u{1F600}`
+                        while pos < text.len() && !matches!(text[pos], b'\'' | b'\n') {
+                            pos += 1;
+                        }
+                    } else if pos < text.len() {
+                        pos += char_len(text, pos); // Skip character
                     }
                     if pos < text.len() && text[pos] == b'\'' {
                         pos += 1;
@@ -110,7 +156,7 @@ impl Lexer for RustLexer {
                 // Numbers
                 b'0'..=b'9' => {
                     pos += 1;
-                    
+
                     // Binary
                     if start + 1 < text.len() && text[start] == b'0' && text[start + 1] == b'b' {
                         pos += 1;
@@ -119,16 +165,25 @@ impl Lexer for RustLexer {
                         }
                     }
                     // Octal
-                    else if start + 1 < text.len() && text[start] == b'0' && text[start + 1] == b'o' {
+                    else if start + 1 < text.len()
+                        && text[start] == b'0'
+                        && text[start + 1] == b'o'
+                    {
                         pos += 1;
                         while pos < text.len() && matches!(text[pos], b'0'..=b'7' | b'_') {
                             pos += 1;
                         }
                     }
                     // Hexadecimal
-                    else if start + 1 < text.len() && text[start] == b'0' && text[start + 1] == b'x' {
+                    else if start + 1 < text.len()
+                        && text[start] == b'0'
+                        && text[start + 1] == b'x'
+                    {
                         pos += 1;
-                        while pos < text.len() && (is_ascii_digit(text[pos]) || matches!(text[pos], b'a'..=b'f' | b'A'..=b'F' | b'_')) {
+                        while pos < text.len()
+                            && (is_ascii_digit(text[pos])
+                                || matches!(text[pos], b'a'..=b'f' | b'A'..=b'F' | b'_'))
+                        {
                             pos += 1;
                         }
                     }
@@ -137,40 +192,56 @@ impl Lexer for RustLexer {
                         while pos < text.len() && (is_ascii_digit(text[pos]) || text[pos] == b'_') {
                             pos += 1;
                         }
-                        
+
                         // Float
-                        if pos < text.len() && text[pos] == b'.' && pos + 1 < text.len() && is_ascii_digit(text[pos + 1]) {
+                        if pos < text.len()
+                            && text[pos] == b'.'
+                            && pos + 1 < text.len()
+                            && is_ascii_digit(text[pos + 1])
+                        {
                             pos += 1;
-                            while pos < text.len() && (is_ascii_digit(text[pos]) || text[pos] == b'_') {
+                            while pos < text.len()
+                                && (is_ascii_digit(text[pos]) || text[pos] == b'_')
+                            {
                                 pos += 1;
                             }
                         }
-                        
+
                         // Exponent
                         if pos < text.len() && (text[pos] == b'e' || text[pos] == b'E') {
                             pos += 1;
                             if pos < text.len() && (text[pos] == b'+' || text[pos] == b'-') {
                                 pos += 1;
                             }
-                            while pos < text.len() && (is_ascii_digit(text[pos]) || text[pos] == b'_') {
+                            while pos < text.len()
+                                && (is_ascii_digit(text[pos]) || text[pos] == b'_')
+                            {
                                 pos += 1;
                             }
                         }
                     }
-                    
+
                     // Type suffix (i32, u64, f32, etc.)
                     if pos < text.len() && is_ident_start(text[pos]) {
                         while pos < text.len() && is_ident_continue(text[pos]) {
                             pos += 1;
                         }
                     }
-                    
+
                     tokens.push(Token::new(TokenKind::Number, start..pos));
                 }
 
-                // Attribute (before identifiers to avoid conflicts)
-                b'#' if pos + 1 < text.len() && text[pos + 1] == b'[' => {
-                    pos += 1;
+                // Raw identifier, like `r#type`
+                b'r' if text.get(pos + 1) == Some(&b'#')
+                    && text.get(pos + 2).is_some_and(|&b| is_ident_start(b)) =>
+                {
+                    pos = ident_end(text, pos + 2, UnicodeIdents::Xid, is_ident_continue);
+                    tokens.push(Token::new(TokenKind::Identifier, start..pos));
+                }
+
+                // Attribute (before identifiers to avoid conflicts), also inner ones (#![..])
+                b'#' if text[pos + 1..].starts_with(b"[") || text[pos + 1..].starts_with(b"![") => {
+                    pos += if text[pos + 1] == b'!' { 3 } else { 2 };
                     let mut depth = 0;
                     while pos < text.len() {
                         if text[pos] == b'[' {
@@ -188,29 +259,59 @@ impl Lexer for RustLexer {
                 }
 
                 // Identifiers and keywords
-                _ if is_ident_start(b) => {
-                    while pos < text.len() && is_ident_continue(text[pos]) {
-                        pos += 1;
-                    }
-                    
+                _ if is_ident_start(b) || is_unicode_ident_start(text, pos, UnicodeIdents::Xid) => {
+                    pos = ident_end(text, pos, UnicodeIdents::Xid, is_ident_continue);
+
                     let word = &text[start..pos];
                     let kind = match word {
                         b"as" | b"in" | b"is" => TokenKind::KeywordOperator,
-                        b"break" | b"continue" | b"else" | b"for" | b"if" | b"loop" | b"match" | b"return" | b"while" => TokenKind::KeywordControl,
+                        b"break" | b"continue" | b"else" | b"for" | b"if" | b"loop" | b"match"
+                        | b"return" | b"while" => TokenKind::KeywordControl,
                         b"fn" | b"async" | b"await" => TokenKind::KeywordFunction,
                         b"use" | b"mod" | b"extern" | b"crate" => TokenKind::KeywordImport,
                         b"let" | b"const" | b"static" | b"mut" => TokenKind::KeywordStorage,
-                        b"struct" | b"enum" | b"union" | b"trait" | b"type" | b"impl" => TokenKind::KeywordType,
-                        b"pub" | b"priv" | b"super" | b"self" | b"Self" | b"where" | b"unsafe" | b"ref" | b"move" => TokenKind::Keyword,
+                        b"struct" | b"enum" | b"union" | b"trait" | b"type" | b"impl" => {
+                            TokenKind::KeywordType
+                        }
+                        b"pub" | b"priv" | b"super" | b"self" | b"Self" | b"where" | b"unsafe"
+                        | b"ref" | b"move" | b"dyn" => TokenKind::Keyword,
                         b"true" | b"false" => TokenKind::Boolean,
+                        // A macro invocation like `println!` or `vec![]`, with its `!`, but not `a != b`
+                        _ if text.get(pos) == Some(&b'!') && text.get(pos + 1) != Some(&b'=') => {
+                            pos += 1;
+                            TokenKind::RustMacro
+                        }
                         _ => TokenKind::Identifier,
                     };
-                    
+
                     tokens.push(Token::new(kind, start..pos));
                 }
 
+                // Path separator, which opens a turbofish when `<` follows
+                b':' if text.get(pos + 1) == Some(&b':') => {
+                    pos += 2;
+                    tokens.push(Token::new(TokenKind::Punctuation, start..pos));
+                    if text.get(pos) == Some(&b'<') {
+                        turbofish = 1;
+                        tokens.push(Token::new(TokenKind::Operator, pos..pos + 1));
+                        pos += 1;
+                    }
+                }
+
+                // In a turbofish every `<` and `>` is one bracket, so that `>>` closes two
+                b'<' | b'>' if turbofish > 0 => {
+                    pos += 1;
+                    if b == b'<' {
+                        turbofish += 1;
+                    } else {
+                        turbofish -= 1;
+                    }
+                    tokens.push(Token::new(TokenKind::Operator, start..pos));
+                }
+
                 // Operators and punctuation
-                b'+' | b'-' | b'*' | b'/' | b'%' | b'&' | b'|' | b'^' | b'!' | b'=' | b'<' | b'>' => {
+                b'+' | b'-' | b'*' | b'/' | b'%' | b'&' | b'|' | b'^' | b'!' | b'=' | b'<'
+                | b'>' | b'?' => {
                     pos += 1;
                     // Handle multi-character operators
                     if pos < text.len() && matches!(text[pos], b'=' | b'&' | b'|' | b'<' | b'>') {
@@ -220,40 +321,46 @@ impl Lexer for RustLexer {
                 }
 
                 b'{' | b'}' | b'[' | b']' | b'(' | b')' => {
+                    if matches!(b, b'{' | b'}') {
+                        turbofish = 0;
+                    }
                     pos += 1;
                     tokens.push(Token::new(TokenKind::Delimiter, start..pos));
                 }
 
-                b',' | b';' | b':' | b'.' => {
+                // `@` binds patterns, `$` and `#` appear in macros
+                b',' | b';' | b':' | b'.' | b'@' | b'$' | b'#' => {
+                    if b == b';' {
+                        turbofish = 0;
+                    }
                     pos += 1;
                     tokens.push(Token::new(TokenKind::Punctuation, start..pos));
                 }
 
                 // Unknown
                 _ => {
-                    pos += 1;
+                    pos += char_len(text, pos);
                     tokens.push(Token::new(TokenKind::Error, start..pos));
                 }
             }
         }
-
-        tokens
     }
 }
 
 #[cfg(test)]
 mod tests {
     use super::*;
+    use crate::syntax::Lexer;
 
     #[test]
     fn test_rust_keywords() {
         let lexer = RustLexer;
         let text = b"fn main() { let x = 42; }";
         let tokens = lexer.tokenize(text);
-        
+
         let has_fn = tokens.iter().any(|t| t.kind == TokenKind::KeywordFunction);
         let has_let = tokens.iter().any(|t| t.kind == TokenKind::KeywordStorage);
-        
+
         assert!(has_fn);
         assert!(has_let);
     }
@@ -263,24 +370,162 @@ mod tests {
         let lexer = RustLexer;
         let text = b"fn foo<'a>(x: &'a str) {}";
         let tokens = lexer.tokenize(text);
-        
-        let lifetimes: Vec<_> = tokens.iter()
-            .filter(|t| t.kind == TokenKind::RustLifetime)
-            .collect();
-        
+
+        let lifetimes: Vec<_> =
+            tokens.iter().filter(|t| t.kind == TokenKind::RustLifetime).collect();
+
         assert_eq!(lifetimes.len(), 2);
     }
 
+    #[test]
+    fn test_rust_lifetimes_and_chars() {
+        let text = r"impl<'a, T: 'static> X<'a> { fn f(&'a self) -> char { 'a' } } 'b' '\n' '\u{1F600}' 'é' 'x".as_bytes();
+        let tokens: Vec<_> = RustLexer
+            .tokenize(text)
+            .into_iter()
+            .filter(|t| matches!(t.kind, TokenKind::RustLifetime | TokenKind::Char))
+            .map(|t| (t.kind, &text[t.span]))
+            .collect();
+        let expected: [(TokenKind, &[u8]); 10] = [
+            (TokenKind::RustLifetime, b"'a"),
+            (TokenKind::RustLifetime, b"'static"),
+            (TokenKind::RustLifetime, b"'a"),
+            (TokenKind::RustLifetime, b"'a"),
+            (TokenKind::Char, b"'a'"),
+            (TokenKind::Char, b"'b'"),
+            (TokenKind::Char, br"'\n'"),
+            (TokenKind::Char, br"'\u{1F600}'"),
+            (TokenKind::Char, "'é'".as_bytes()),
+            (TokenKind::RustLifetime, b"'x"),
+        ];
+        assert_eq!(tokens, expected);
+    }
+
+    #[test]
+    fn test_rust_raw_string_hashes() {
+        // Only a quote followed by as many hashes as the opening has closes the string.
+        let text = br####"r###"a "# b "## c"### br#"x"y"# r"\""####;
+        let strings: Vec<_> = RustLexer
+            .tokenize(text)
+            .into_iter()
+            .filter(|t| !t.kind.is_trivia())
+            .map(|t| &text[t.span])
+            .collect();
+        let expected: [&[u8]; 3] =
+            [br####"r###"a "# b "## c"###"####, br##"br#"x"y"#"##, br#"r"\""#];
+        assert_eq!(strings, expected);
+    }
+
     #[test]
     fn test_rust_string() {
         let lexer = RustLexer;
         let text = br#""hello" r"raw string""#;
         let tokens = lexer.tokenize(text);
-        
-        let strings: Vec<_> = tokens.iter()
-            .filter(|t| t.kind == TokenKind::String)
-            .collect();
-        
+
+        let strings: Vec<_> = tokens.iter().filter(|t| t.kind == TokenKind::String).collect();
+
         assert_eq!(strings.len(), 2);
     }
+
+    #[test]
+    fn test_rust_prefixed_literals() {
+        let text = br###"b"\"x" c"y" br"\d" r#"a "quoted" b"# cr##"#"## b'\'' b'a' 'a"###;
+        let strings: Vec<_> = RustLexer
+            .tokenize(text)
+            .into_iter()
+            .filter(|t| !t.kind.is_trivia())
+            .map(|t| (t.kind, &text[t.span]))
+            .collect();
+        let expected: [(TokenKind, &[u8]); 8] = [
+            (TokenKind::String, br#"b"\"x""#),
+            (TokenKind::String, br#"c"y""#),
+            (TokenKind::String, br#"br"\d""#),
+            (TokenKind::String, br##"r#"a "quoted" b"#"##),
+            (TokenKind::String, br###"cr##"#"##"###),
+            (TokenKind::Char, br"b'\''"),
+            (TokenKind::Char, b"b'a'"),
+            (TokenKind::RustLifetime, b"'a"),
+        ];
+        assert_eq!(strings, expected);
+    }
+
+    #[test]
+    fn test_rust_macros() {
+        let text = b"println!(\"{}\", a != b); vec![1]; macro_rules! m {} !x";
+        let tokens: Vec<_> = RustLexer
+            .tokenize(text)
+            .into_iter()
+            .filter(|t| matches!(t.kind, TokenKind::RustMacro | TokenKind::Operator))
+            .map(|t| (t.kind, &text[t.span]))
+            .collect();
+        let expected: [(TokenKind, &[u8]); 5] = [
+            (TokenKind::RustMacro, b"println!"),
+            (TokenKind::Operator, b"!="),
+            (TokenKind::RustMacro, b"vec!"),
+            (TokenKind::RustMacro, b"macro_rules!"),
+            (TokenKind::Operator, b"!"),
+        ];
+        assert_eq!(tokens, expected);
+    }
+
+    #[test]
+    fn test_rust_turbofish() {
+        // `>>` closes both generics of a turbofish, but stays a shift elsewhere.
+        let text = b"let v = iter.collect::<Vec<Vec<u8>>>(); x >> 2; f::<fn() -> u8>();";
+        let tokens: Vec<_> = RustLexer
+            .tokenize(text)
+            .into_iter()
+            .filter(|t| matches!(t.kind, TokenKind::Operator | TokenKind::Punctuation))
+            .map(|t| &text[t.span])
+            .collect();
+        let expected: [&[u8]; 17] = [
+            b"=", b".", b"::", b"<", b"<", b"<", b">", b">", b">", b";", b">>", b";", b"::", b"<",
+            b"->", b">", b";",
+        ];
+        assert_eq!(tokens, expected);
+    }
+
+    #[test]
+    fn test_rust_nested_comments() {
+        let text = b"/* a /* b */ c */ d /* e /* f */";
+        let tokens: Vec<_> = RustLexer
+            .tokenize(text)
+            .into_iter()
+            .filter(|t| !matches!(t.kind, TokenKind::Whitespace))
+            .map(|t| (t.kind, &text[t.span]))
+            .collect();
+        // The unclosed comment runs to the end, since its inner comment closed.
+        let expected: [(TokenKind, &[u8]); 3] = [
+            (TokenKind::Comment, b"/* a /* b */ c */"),
+            (TokenKind::Identifier, b"d"),
+            (TokenKind::Comment, b"/* e /* f */"),
+        ];
+        assert_eq!(tokens, expected);
+    }
+
+    #[test]
+    fn test_rust_raw_identifiers() {
+        let text = b"let r#type = r#\"x\"#; r#match";
+        let tokens: Vec<_> = RustLexer
+            .tokenize(text)
+            .into_iter()
+            .filter(|t| matches!(t.kind, TokenKind::Identifier | TokenKind::String))
+            .map(|t| (t.kind, &text[t.span]))
+            .collect();
+        let expected: [(TokenKind, &[u8]); 3] = [
+            (TokenKind::Identifier, b"r#type"),
+            (TokenKind::String, b"r#\"x\"#"),
+            (TokenKind::Identifier, b"r#match"),
+        ];
+        assert_eq!(tokens, expected);
+    }
+
+    #[test]
+    fn test_rust_no_errors() {
+        let text = b"#![allow(x)]\nmacro_rules! m { ($e:expr) => { $e? }; }\nlet a @ 1..=2 = f()?;";
+        let tokens = RustLexer.tokenize(text);
+        assert!(!tokens.iter().any(|t| t.kind.is_error()), "{tokens:?}");
+        assert_eq!(tokens[0].kind, TokenKind::RustAttribute);
+        assert_eq!(&text[tokens[0].span.clone()], b"#![allow(x)]");
+    }
 }
@@ -2,18 +2,42 @@
 // Licensed under the MIT License.
 
 //! High-performance Shell/Bash lexer with full language support.
+//!
+//! Heredocs (`<<EOF`, `<<-EOF`, `<<'EOF'`) capture their delimiter and have their bodies
+//! lexed after the line they begin on, see [`heredoc`](super::heredoc). Unquoted ones expand
+//! `$VAR` and `$(...)` in their bodies, quoted ones are all text.
 
-use crate::syntax::lexer::{Lexer, is_whitespace, is_ident_start, is_ident_continue, is_ascii_digit};
+use std::ops::Range;
+
+use crate::syntax::lexer::heredoc::{Heredoc, Heredocs, Interpolation};
+use crate::syntax::lexer::{
+    Checkpoints, Resumable, char_len, is_ascii_digit, is_ident_continue, is_ident_start,
+    is_whitespace,
+};
 use crate::syntax::{Token, TokenKind};
 
 pub struct ShellLexer;
 
-impl Lexer for ShellLexer {
-    fn tokenize(&self, text: &[u8]) -> Vec<Token> {
-        let mut tokens = Vec::with_capacity(text.len() / 8);
-        let mut pos = 0;
+impl Resumable for ShellLexer {
+    type State = ();
+
+    fn lex(
+        &self,
+        text: &[u8],
+        mut pos: usize,
+        _: (),
+        tokens: &mut Vec<Token>,
+        checkpoints: &mut Checkpoints<()>,
+    ) {
+        let mut heredocs = Heredocs::default();
 
         while pos < text.len() {
+            if heredocs.is_empty()
+                && checkpoints.due(text, tokens, pos)
+                && checkpoints.report(text, pos, tokens, 0, ())
+            {
+                return;
+            }
             let start = pos;
             let b = text[pos];
 
@@ -22,8 +46,15 @@ impl Lexer for ShellLexer {
                 b' ' | b'\t' | b'\n' | b'\r' => {
                     while pos < text.len() && is_whitespace(text[pos]) {
                         pos += 1;
+                        // The bodies of heredocs start on the line after them.
+                        if text[pos - 1] == b'\n' && !heredocs.is_empty() {
+                            break;
+                        }
                     }
                     tokens.push(Token::new(TokenKind::Whitespace, start..pos));
+                    if text[pos - 1] == b'\n' && !heredocs.is_empty() {
+                        pos = heredocs.bodies(text, pos, tokens);
+                    }
                 }
 
                 // Comment
@@ -36,48 +67,10 @@ impl Lexer for ShellLexer {
 
                 // Variable expansion ($VAR, ${VAR}, $(...), $((...)))
                 b'$' => {
-                    pos += 1;
-                    
-                    // Special variables ($?, $!, $$, $@, $*, $#, etc.)
-                    if pos < text.len() && matches!(text[pos], b'?' | b'!' | b'$' | b'@' | b'*' | b'#' | b'-' | b'0'..=b'9') {
-                        pos += 1;
-                        tokens.push(Token::new(TokenKind::VariableName, start..pos));
-                    }
-                    // Brace expansion ${VAR}
-                    else if pos < text.len() && text[pos] == b'{' {
-                        pos += 1;
-                        while pos < text.len() && text[pos] != b'}' {
-                            pos += 1;
-                        }
-                        if pos < text.len() {
-                            pos += 1;
-                        }
-                        tokens.push(Token::new(TokenKind::VariableName, start..pos));
-                    }
-                    // Command substitution $(...)
-                    else if pos < text.len() && text[pos] == b'(' {
-                        pos += 1;
-                        let mut depth = 1;
-                        while pos < text.len() && depth > 0 {
-                            if text[pos] == b'(' {
-                                depth += 1;
-                            } else if text[pos] == b')' {
-                                depth -= 1;
-                            }
-                            pos += 1;
-                        }
-                        tokens.push(Token::new(TokenKind::VariableName, start..pos));
-                    }
-                    // Regular variable $VAR
-                    else if pos < text.len() && (is_ident_start(text[pos]) || text[pos] == b'_') {
-                        while pos < text.len() && (is_ident_continue(text[pos]) || text[pos] == b'_') {
-                            pos += 1;
-                        }
-                        tokens.push(Token::new(TokenKind::VariableName, start..pos));
-                    }
-                    else {
-                        tokens.push(Token::new(TokenKind::Operator, start..pos));
-                    }
+                    pos = expansion(text, pos).unwrap_or(pos + 1);
+                    let kind =
+                        if pos - start > 1 { TokenKind::VariableName } else { TokenKind::Operator };
+                    tokens.push(Token::new(kind, start..pos));
                 }
 
                 // Single-quoted string (no expansion)
@@ -136,14 +129,52 @@ impl Lexer for ShellLexer {
                     tokens.push(Token::new(TokenKind::Number, start..pos));
                 }
 
+                // Here-strings, whose word is a string even unquoted
+                b'<' if text[pos..].starts_with(b"<<<") => {
+                    pos += 3;
+                    tokens.push(Token::new(TokenKind::Operator, start..pos));
+                    let word =
+                        pos + text[pos..].iter().take_while(|&&b| b == b' ' || b == b'\t').count();
+                    if word > pos {
+                        tokens.push(Token::new(TokenKind::Whitespace, pos..word));
+                        pos = word;
+                    }
+                    let end = word_end(text, pos);
+                    if end > pos && !matches!(text[pos], b'$' | b'\'' | b'"' | b'`') {
+                        tokens.push(Token::new(TokenKind::String, pos..end));
+                        pos = end;
+                    }
+                }
+
+                // Heredocs, whose delimiter is captured for the lines after this one
+                b'<' if text[pos..].starts_with(b"<<") => {
+                    let Some((heredoc, operator, delimiter)) = heredoc_start(text, pos) else {
+                        pos += 2;
+                        tokens.push(Token::new(TokenKind::Operator, start..pos));
+                        continue;
+                    };
+                    tokens.push(Token::new(TokenKind::Operator, start..operator));
+                    if delimiter.start > operator {
+                        tokens.push(Token::new(TokenKind::Whitespace, operator..delimiter.start));
+                    }
+                    heredocs.push(Heredoc { opener: tokens.len(), ..heredoc });
+                    tokens.push(Token::new(TokenKind::Punctuation, delimiter.clone()));
+                    pos = delimiter.end;
+                }
+
                 // Operators and redirections
                 b'>' | b'<' | b'|' | b'&' | b';' => {
                     pos += 1;
                     // Handle multi-character operators
                     if pos < text.len() {
                         match (b, text[pos]) {
-                            (b'>', b'>') | (b'<', b'<') | (b'&', b'&') | (b'|', b'|') |
-                            (b'>', b'&') | (b'<', b'&') | (b';', b';') => {
+                            (b'>', b'>')
+                            | (b'<', b'<')
+                            | (b'&', b'&')
+                            | (b'|', b'|')
+                            | (b'>', b'&')
+                            | (b'<', b'&')
+                            | (b';', b';') => {
                                 pos += 1;
                             }
                             _ => {}
@@ -153,15 +184,22 @@ impl Lexer for ShellLexer {
                 }
 
                 // Other operators
-                b'=' | b'+' | b'-' | b'*' | b'/' | b'%' | b'!' | b'~' | b'?' |
-                b'(' | b')' | b'{' | b'}' | b'[' | b']' | b',' | b':' | b'.' => {
+                b'=' | b'+' | b'-' | b'*' | b'/' | b'%' | b'!' | b'~' | b'?' | b'(' | b')'
+                | b'{' | b'}' | b'[' | b']' | b',' | b':' | b'.' => {
                     pos += 1;
                     // Handle multi-character operators
                     if pos < text.len() {
                         match (b, text[pos]) {
-                            (b'=', b'=') | (b'!', b'=') | (b'+', b'=') | (b'-', b'=') |
-                            (b'*', b'=') | (b'/', b'=') | (b'%', b'=') | (b'+', b'+') |
-                            (b'-', b'-') | (b'=', b'~') => {
+                            (b'=', b'=')
+                            | (b'!', b'=')
+                            | (b'+', b'=')
+                            | (b'-', b'=')
+                            | (b'*', b'=')
+                            | (b'/', b'=')
+                            | (b'%', b'=')
+                            | (b'+', b'+')
+                            | (b'-', b'-')
+                            | (b'=', b'~') => {
                                 pos += 1;
                             }
                             _ => {}
@@ -172,36 +210,38 @@ impl Lexer for ShellLexer {
 
                 // Identifier or keyword
                 _ if is_ident_start(b) || b == b'_' => {
-                    while pos < text.len() && (is_ident_continue(text[pos]) || text[pos] == b'_' || text[pos] == b'-') {
+                    while pos < text.len()
+                        && (is_ident_continue(text[pos]) || text[pos] == b'_' || text[pos] == b'-')
+                    {
                         pos += 1;
                     }
                     let word = &text[start..pos];
                     let kind = match word {
                         // Bash keywords
-                        b"if" | b"then" | b"else" | b"elif" | b"fi" |
-                        b"case" | b"esac" | b"for" | b"while" | b"until" | b"do" | b"done" |
-                        b"in" | b"select" | b"time" | b"function" |
-                        b"declare" | b"typeset" | b"local" | b"readonly" | b"export" |
-                        b"unset" | b"return" | b"break" | b"continue" | b"exit" |
-                        b"shift" | b"eval" | b"exec" | b"source" | b"alias" | b"unalias" => TokenKind::Keyword,
-                        
+                        b"if" | b"then" | b"else" | b"elif" | b"fi" | b"case" | b"esac"
+                        | b"for" | b"while" | b"until" | b"do" | b"done" | b"in" | b"select"
+                        | b"time" | b"function" | b"declare" | b"typeset" | b"local"
+                        | b"readonly" | b"export" | b"unset" | b"return" | b"break"
+                        | b"continue" | b"exit" | b"shift" | b"eval" | b"exec" | b"source"
+                        | b"alias" | b"unalias" => TokenKind::Keyword,
+
                         // Conditional expressions
                         b"test" => TokenKind::Keyword,
-                        
+
                         // Boolean values
                         b"true" | b"false" => TokenKind::Boolean,
-                        
+
                         // Common commands (builtins)
-                        b"echo" | b"printf" | b"read" | b"cd" | b"pwd" | b"pushd" | b"popd" |
-                        b"ls" | b"cat" | b"grep" | b"sed" | b"awk" | b"find" | b"sort" | b"uniq" |
-                        b"head" | b"tail" | b"cut" | b"paste" | b"tr" | b"wc" |
-                        b"chmod" | b"chown" | b"chgrp" | b"mkdir" | b"rm" | b"cp" | b"mv" |
-                        b"touch" | b"ln" | b"dirname" | b"basename" |
-                        b"tar" | b"gzip" | b"gunzip" | b"zip" | b"unzip" |
-                        b"ps" | b"top" | b"kill" | b"killall" | b"jobs" | b"bg" | b"fg" |
-                        b"man" | b"which" | b"whereis" | b"type" | b"command" |
-                        b"set" | b"shopt" | b"let" | b"wait" | b"sleep" | b"trap" => TokenKind::FunctionName,
-                        
+                        b"echo" | b"printf" | b"read" | b"cd" | b"pwd" | b"pushd" | b"popd"
+                        | b"ls" | b"cat" | b"grep" | b"sed" | b"awk" | b"find" | b"sort"
+                        | b"uniq" | b"head" | b"tail" | b"cut" | b"paste" | b"tr" | b"wc"
+                        | b"chmod" | b"chown" | b"chgrp" | b"mkdir" | b"rm" | b"cp" | b"mv"
+                        | b"touch" | b"ln" | b"dirname" | b"basename" | b"tar" | b"gzip"
+                        | b"gunzip" | b"zip" | b"unzip" | b"ps" | b"top" | b"kill" | b"killall"
+                        | b"jobs" | b"bg" | b"fg" | b"man" | b"which" | b"whereis" | b"type"
+                        | b"command" | b"set" | b"shopt" | b"let" | b"wait" | b"sleep"
+                        | b"trap" => TokenKind::FunctionName,
+
                         _ => TokenKind::Identifier,
                     };
                     tokens.push(Token::new(kind, start..pos));
@@ -209,12 +249,128 @@ impl Lexer for ShellLexer {
 
                 // Everything else
                 _ => {
-                    pos += 1;
+                    pos += char_len(text, pos);
                     tokens.push(Token::new(TokenKind::Operator, start..pos));
                 }
             }
         }
 
-        tokens
+        // Heredocs on the last line, which have no body and so no delimiter ending them.
+        heredocs.bodies(text, pos, tokens);
+    }
+}
+
+/// Returns the end of the expansion at `pos`, like `$HOME`, `${HOME}` or `$(pwd)`, or `None`
+/// for a `$` that doesn't expand anything.
+fn expansion(text: &[u8], mut pos: usize) -> Option<usize> {
+    pos += 1;
+    match *text.get(pos)? {
+        // Special variables ($?, $!, $$, $@, $*, $#, etc.)
+        b'?' | b'!' | b'$' | b'@' | b'*' | b'#' | b'-' | b'0'..=b'9' => Some(pos + 1),
+        // Brace expansion ${VAR}
+        b'{' => {
+            Some(text[pos..].iter().position(|&b| b == b'}').map_or(text.len(), |i| pos + i + 1))
+        }
+        // Command substitution $(...) and arithmetic $((...))
+        b'(' => {
+            pos += 1;
+            let mut depth = 1;
+            while pos < text.len() && depth > 0 {
+                if text[pos] == b'(' {
+                    depth += 1;
+                } else if text[pos] == b')' {
+                    depth -= 1;
+                }
+                pos += 1;
+            }
+            Some(pos)
+        }
+        // Regular variable $VAR
+        b if is_ident_start(b) || b == b'_' => {
+            while pos < text.len() && (is_ident_continue(text[pos]) || text[pos] == b'_') {
+                pos += 1;
+            }
+            Some(pos)
+        }
+        _ => None,
+    }
+}
+
+/// Returns the end of the shell word at `pos`, which ends at whitespace or an operator.
+fn word_end(text: &[u8], mut pos: usize) -> usize {
+    while pos < text.len()
+        && !is_whitespace(text[pos])
+        && !matches!(text[pos], b';' | b'|' | b'&' | b'<' | b'>' | b'(' | b')')
+    {
+        pos += 1;
+    }
+    pos
+}
+
+/// Parses the start of the heredoc at `pos`, like `<<-'EOF'`: returns the heredoc, the end
+/// of its operator, and the range of its delimiter word with any quotes. A quoted
+/// delimiter, even partly like `E"O"F` or `\EOF`, keeps the body from expanding anything.
+fn heredoc_start(text: &[u8], pos: usize) -> Option<(Heredoc, usize, Range<usize>)> {
+    let strip_tabs = text.get(pos + 2) == Some(&b'-');
+    let operator = pos + 2 + strip_tabs as usize;
+    let start =
+        operator + text[operator..].iter().take_while(|&&b| b == b' ' || b == b'\t').count();
+    let end = word_end(text, start);
+    let word = &text[start..end];
+    // `(( x << 2 ))` shifts, it doesn't start a heredoc.
+    if word.is_empty() || word.iter().all(|b| b.is_ascii_digit()) {
+        return None;
+    }
+
+    let mut delimiter = Vec::with_capacity(word.len());
+    let mut quoted = false;
+    let mut quote = None;
+    let mut i = 0;
+    while i < word.len() {
+        match (quote, word[i]) {
+            (None, b'\'' | b'"') => {
+                quote = Some(word[i]);
+                quoted = true;
+            }
+            (Some(q), b) if b == q => quote = None,
+            (None, b'\\') if i + 1 < word.len() => {
+                quoted = true;
+                i += 1;
+                delimiter.push(word[i]);
+            }
+            (_, b) => delimiter.push(b),
+        }
+        i += 1;
+    }
+
+    let interpolation = if quoted { None } else { Some(heredoc_body as Interpolation) };
+    Some((Heredoc { delimiter, strip_tabs, interpolation, opener: 0 }, operator, start..end))
+}
+
+/// Lexes the body of an unquoted heredoc: text, with `$VAR` and `$(...)` expanded, where a
+/// backslash escapes a `$`.
+fn heredoc_body(text: &[u8], range: Range<usize>, tokens: &mut Vec<Token>) {
+    let text = &text[..range.end];
+    let mut piece = range.start;
+    let mut pos = range.start;
+    while pos < text.len() {
+        match text[pos] {
+            b'\\' => pos += 2,
+            b'$' => match expansion(text, pos) {
+                Some(end) => {
+                    if piece < pos {
+                        tokens.push(Token::new(TokenKind::String, piece..pos));
+                    }
+                    tokens.push(Token::new(TokenKind::VariableName, pos..end));
+                    pos = end;
+                    piece = pos;
+                }
+                None => pos += 1,
+            },
+            _ => pos += 1,
+        }
+    }
+    if piece < text.len() {
+        tokens.push(Token::new(TokenKind::String, piece..text.len()));
     }
 }
@@ -2,18 +2,134 @@
 // Licensed under the MIT License.
 
 //! High-performance SQL lexer with full language support.
+//!
+//! Databases disagree on comments, quoting and keywords, see [`SqlDialect`]. A file can
+//! name its dialect in a comment at the top, like `-- dialect: postgres`.
 
-use crate::syntax::lexer::{Lexer, is_whitespace, is_ident_start, is_ident_continue, is_ascii_digit};
+use crate::syntax::lexer::{
+    Checkpoints, Resumable, char_len, fold_keyword, is_ascii_digit, is_ident_continue,
+    is_ident_start, is_whitespace,
+};
 use crate::syntax::{Token, TokenKind};
 
-pub struct SqlLexer;
+/// The SQL dialects whose differences the lexer knows about.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Hash)]
+pub enum SqlDialect {
+    /// Standard SQL, plus the quoting and comments of the others where they don't
+    /// conflict, for files whose dialect isn't known.
+    #[default]
+    Ansi,
+    /// PostgreSQL: `$tag$...$tag$` strings, `E'\n'` escapes, `::` casts and `#` as an operator.
+    Postgres,
+    /// MySQL and MariaDB: `` `identifiers` ``, `#` comments and `\'` escapes in strings,
+    /// which may also be double-quoted.
+    MySql,
+    /// SQLite, which takes every kind of quoted identifier, and `"x"` as a string
+    /// if there's no column called `x`. It's colored as an identifier.
+    Sqlite,
+    /// SQL Server: `[identifiers]`, `N'unicode'` strings and `#temp` tables.
+    MsSql,
+}
+
+impl SqlDialect {
+    /// All dialects.
+    pub const ALL: &[SqlDialect] = &[
+        SqlDialect::Ansi,
+        SqlDialect::Postgres,
+        SqlDialect::MySql,
+        SqlDialect::Sqlite,
+        SqlDialect::MsSql,
+    ];
 
-impl Lexer for SqlLexer {
-    fn tokenize(&self, text: &[u8]) -> Vec<Token> {
-        let mut tokens = Vec::with_capacity(text.len() / 8);
-        let mut pos = 0;
+    /// Get the lowercase name of the dialect, e.g. for settings.
+    pub fn id(self) -> &'static str {
+        match self {
+            SqlDialect::Ansi => "ansi",
+            SqlDialect::Postgres => "postgres",
+            SqlDialect::MySql => "mysql",
+            SqlDialect::Sqlite => "sqlite",
+            SqlDialect::MsSql => "mssql",
+        }
+    }
+
+    /// Find a dialect by its [`SqlDialect::id`] or a common alias, regardless of case.
+    pub fn from_name(name: &str) -> Option<Self> {
+        let dialect = match name.to_ascii_lowercase().as_str() {
+            "ansi" | "sql" => SqlDialect::Ansi,
+            "postgres" | "postgresql" | "pgsql" | "psql" => SqlDialect::Postgres,
+            "mysql" | "mariadb" => SqlDialect::MySql,
+            "sqlite" | "sqlite3" => SqlDialect::Sqlite,
+            "mssql" | "tsql" | "t-sql" | "sqlserver" => SqlDialect::MsSql,
+            _ => return None,
+        };
+        Some(dialect)
+    }
+
+    /// Detect the dialect from a file extension that implies it, like `psql`.
+    /// These are also among the extensions of [`Language::Sql`](crate::syntax::Language::Sql).
+    pub fn from_extension(ext: &str) -> Option<Self> {
+        match ext.to_ascii_lowercase().as_str() {
+            "psql" | "pgsql" => Some(SqlDialect::Postgres),
+            "mysql" => Some(SqlDialect::MySql),
+            "tsql" => Some(SqlDialect::MsSql),
+            _ => None,
+        }
+    }
+
+    /// Detect the dialect from a `-- dialect: NAME` comment in the comment lines
+    /// at the start of `text`.
+    pub fn from_hint(text: &[u8]) -> Option<Self> {
+        for line in text.split(|&b| b == b'\n') {
+            let line = line.trim_ascii();
+            if line.is_empty() {
+                continue;
+            }
+            let comment = line.strip_prefix(b"--")?.trim_ascii();
+            if let Some(name) = comment.strip_prefix(b"dialect:") {
+                return SqlDialect::from_name(str::from_utf8(name).ok()?.trim());
+            }
+        }
+        None
+    }
+}
+
+pub struct SqlLexer {
+    /// The dialect, unless the text names one, see [`SqlDialect::from_hint`].
+    /// `None` is [`SqlDialect::Ansi`].
+    pub dialect: Option<SqlDialect>,
+    /// Whether the text may name the dialect, which a part of one whose top isn't that
+    /// of the file may not.
+    pub hinted: bool,
+}
+
+impl SqlLexer {
+    /// The dialect `text` is lexed in.
+    fn dialect(&self, text: &[u8]) -> SqlDialect {
+        let hint = if self.hinted { SqlDialect::from_hint(text) } else { None };
+        hint.or(self.dialect).unwrap_or_default()
+    }
+}
+
+impl Resumable for SqlLexer {
+    /// The dialect, to tell when an edit to the hint at the top changes it.
+    type State = SqlDialect;
+
+    fn lex(
+        &self,
+        text: &[u8],
+        mut pos: usize,
+        _: SqlDialect,
+        tokens: &mut Vec<Token>,
+        checkpoints: &mut Checkpoints<SqlDialect>,
+    ) {
+        let dialect = self.dialect(text);
 
         while pos < text.len() {
+            if checkpoints.due(text, tokens, pos)
+                && checkpoints.report(text, pos, tokens, 0, dialect)
+            {
+                return;
+            }
             let start = pos;
             let b = text[pos];
 
@@ -26,16 +142,19 @@ impl Lexer for SqlLexer {
                     tokens.push(Token::new(TokenKind::Whitespace, start..pos));
                 }
 
-                // Line comment (-- or #)
-                b'-' if pos + 1 < text.len() && text[pos + 1] == b'-' => {
+                // Line comment (-- or #), which MySQL only takes with a space after the --
+                b'-' if text[pos..].starts_with(b"--")
+                    && (dialect != SqlDialect::MySql
+                        || text.get(pos + 2).is_none_or(|&b| is_whitespace(b))) =>
+                {
                     pos += 2;
                     while pos < text.len() && text[pos] != b'\n' {
                         pos += 1;
                     }
                     tokens.push(Token::new(TokenKind::Comment, start..pos));
                 }
-                
-                b'#' => {
+
+                b'#' if matches!(dialect, SqlDialect::Ansi | SqlDialect::MySql) => {
                     pos += 1;
                     while pos < text.len() && text[pos] != b'\n' {
                         pos += 1;
@@ -45,25 +164,30 @@ impl Lexer for SqlLexer {
 
                 // Block comment /* ... */
                 b'/' if pos + 1 < text.len() && text[pos + 1] == b'*' => {
-                    pos += 2;
-                    while pos + 1 < text.len() {
-                        if text[pos] == b'*' && text[pos + 1] == b'/' {
-                            pos += 2;
-                            break;
-                        }
-                        pos += 1;
-                    }
-                    tokens.push(Token::new(TokenKind::Comment, start..pos));
+                    pos = checkpoints.block_comment(text, start, tokens);
                 }
 
-                // Single-quoted string
-                b'\'' => {
+                // Single-quoted string, with a prefix like N'unicode' or E'escapes', and
+                // double-quoted strings in MySQL
+                b'\'' | b'N' | b'n' | b'E' | b'e' | b'X' | b'x' | b'B' | b'b' | b'"'
+                    if b == b'\''
+                        || (b == b'"' && dialect == SqlDialect::MySql)
+                        || text.get(pos + 1) == Some(&b'\'') =>
+                {
+                    let quote = if b == b'"' { b'"' } else { b'\'' };
+                    // Backslashes only escape in MySQL and E'...' strings.
+                    let backslashes = dialect == SqlDialect::MySql || matches!(b, b'E' | b'e');
+                    if quote != b {
+                        pos += 1;
+                    }
                     pos += 1;
                     while pos < text.len() {
-                        if text[pos] == b'\'' {
+                        if text[pos] == b'\\' && backslashes {
+                            pos = (pos + 2).min(text.len());
+                        } else if text[pos] == quote {
                             pos += 1;
-                            // Handle doubled single quotes (SQL escape)
-                            if pos < text.len() && text[pos] == b'\'' {
+                            // Handle doubled quotes (SQL escape)
+                            if pos < text.len() && text[pos] == quote {
                                 pos += 1;
                             } else {
                                 break;
@@ -94,8 +218,37 @@ impl Lexer for SqlLexer {
                     tokens.push(Token::new(TokenKind::Identifier, start..pos));
                 }
 
-                // Backtick-quoted identifier (MySQL)
-                b'`' => {
+                // Dollar-quoted string (PostgreSQL): $$...$$ or $tag$...$tag$
+                b'$' if matches!(dialect, SqlDialect::Ansi | SqlDialect::Postgres)
+                    && dollar_quote(&text[pos..]).is_some() =>
+                {
+                    let delimiter =
+                        &text[pos..pos + dollar_quote(&text[pos..]).unwrap_or_default()];
+                    pos += delimiter.len();
+                    pos = match text[pos..].windows(delimiter.len()).position(|w| w == delimiter) {
+                        Some(i) => pos + i + delimiter.len(),
+                        None => text.len(),
+                    };
+                    tokens.push(Token::new(TokenKind::String, start..pos));
+                }
+
+                // Positional parameter (PostgreSQL): $1
+                b'$' if matches!(dialect, SqlDialect::Ansi | SqlDialect::Postgres)
+                    && text.get(pos + 1).is_some_and(|&b| is_ascii_digit(b)) =>
+                {
+                    pos += 1;
+                    while pos < text.len() && is_ascii_digit(text[pos]) {
+                        pos += 1;
+                    }
+                    tokens.push(Token::new(TokenKind::VariableName, start..pos));
+                }
+
+                // Backtick-quoted identifier (MySQL, SQLite)
+                b'`' if matches!(
+                    dialect,
+                    SqlDialect::Ansi | SqlDialect::MySql | SqlDialect::Sqlite
+                ) =>
+                {
                     pos += 1;
                     while pos < text.len() && text[pos] != b'`' {
                         pos += 1;
@@ -106,8 +259,24 @@ impl Lexer for SqlLexer {
                     tokens.push(Token::new(TokenKind::Identifier, start..pos));
                 }
 
-                // Bracket-quoted identifier (SQL Server) [identifier]
-                b'[' => {
+                // Bracket-quoted identifier (SQL Server, SQLite) [identifier], where ]] is a ]
+                b'[' if matches!(dialect, SqlDialect::MsSql | SqlDialect::Sqlite) => {
+                    pos += 1;
+                    while pos < text.len() {
+                        if text[pos..].starts_with(b"]]") {
+                            pos += 2;
+                        } else if text[pos] == b']' {
+                            pos += 1;
+                            break;
+                        } else {
+                            pos += 1;
+                        }
+                    }
+                    tokens.push(Token::new(TokenKind::Identifier, start..pos));
+                }
+
+                // Bracket-quoted identifier, or an array subscript
+                b'[' if dialect == SqlDialect::Ansi => {
                     pos += 1;
                     let mut is_identifier = false;
                     while pos < text.len() && text[pos] != b']' {
@@ -121,16 +290,22 @@ impl Lexer for SqlLexer {
                     }
                     tokens.push(Token::new(
                         if is_identifier { TokenKind::Identifier } else { TokenKind::Operator },
-                        start..pos
+                        start..pos,
                     ));
                 }
 
                 // Number
                 b'0'..=b'9' => {
                     // Hex literal (0x...)
-                    if b == b'0' && pos + 1 < text.len() && (text[pos + 1] == b'x' || text[pos + 1] == b'X') {
+                    if b == b'0'
+                        && pos + 1 < text.len()
+                        && (text[pos + 1] == b'x' || text[pos + 1] == b'X')
+                    {
                         pos += 2;
-                        while pos < text.len() && (is_ascii_digit(text[pos]) || matches!(text[pos], b'a'..=b'f' | b'A'..=b'F')) {
+                        while pos < text.len()
+                            && (is_ascii_digit(text[pos])
+                                || matches!(text[pos], b'a'..=b'f' | b'A'..=b'F'))
+                        {
                             pos += 1;
                         }
                     }
@@ -160,6 +335,18 @@ impl Lexer for SqlLexer {
                     tokens.push(Token::new(TokenKind::Number, start..pos));
                 }
 
+                // Temporary table (SQL Server): #temp or ##global
+                b'#' if dialect == SqlDialect::MsSql => {
+                    pos += 1;
+                    if pos < text.len() && text[pos] == b'#' {
+                        pos += 1;
+                    }
+                    while pos < text.len() && is_ident_continue(text[pos]) {
+                        pos += 1;
+                    }
+                    tokens.push(Token::new(TokenKind::Identifier, start..pos));
+                }
+
                 // Identifier or keyword
                 _ if is_ident_start(b) || b == b'_' || b == b'@' => {
                     // Variable (T-SQL @variable or @@system_variable)
@@ -169,102 +356,104 @@ impl Lexer for SqlLexer {
                             pos += 1;
                         }
                     }
-                    
+
                     while pos < text.len() && (is_ident_continue(text[pos]) || text[pos] == b'_') {
                         pos += 1;
                     }
-                    
+
                     let word = &text[start..pos];
-                    
+
                     // Skip if it's a variable
                     if word.starts_with(b"@") {
                         tokens.push(Token::new(TokenKind::VariableName, start..pos));
                         continue;
                     }
-                    
-                    // Convert to uppercase for comparison (SQL is case-insensitive)
-                    let mut upper = Vec::with_capacity(word.len());
-                    for &byte in word {
-                        upper.push(byte.to_ascii_uppercase());
-                    }
-                    
-                    let kind = match upper.as_slice() {
+
+                    // SQL keywords are case-insensitive, see `GrammarMetadata::case_insensitive_keywords`
+                    let word = fold_keyword(word);
+                    let kind = dialect_keyword(dialect, &word).unwrap_or(match &*word {
                         // SQL Keywords - DDL
-                        b"CREATE" | b"ALTER" | b"DROP" | b"TRUNCATE" | b"RENAME" |
-                        b"TABLE" | b"VIEW" | b"INDEX" | b"DATABASE" | b"SCHEMA" |
-                        b"PROCEDURE" | b"FUNCTION" | b"TRIGGER" | b"SEQUENCE" => TokenKind::Keyword,
-                        
+                        "create" | "alter" | "drop" | "truncate" | "rename" | "table" | "view"
+                        | "index" | "database" | "schema" | "procedure" | "function"
+                        | "trigger" | "sequence" => TokenKind::Keyword,
+
                         // SQL Keywords - DML
-                        b"SELECT" | b"INSERT" | b"UPDATE" | b"DELETE" | b"MERGE" |
-                        b"FROM" | b"WHERE" | b"JOIN" | b"INNER" | b"LEFT" | b"RIGHT" | b"FULL" | b"CROSS" |
-                        b"ON" | b"USING" | b"GROUP" | b"HAVING" | b"ORDER" | b"BY" |
-                        b"LIMIT" | b"OFFSET" | b"FETCH" | b"TOP" |
-                        b"UNION" | b"INTERSECT" | b"EXCEPT" | b"MINUS" |
-                        b"INTO" | b"VALUES" | b"SET" => TokenKind::Keyword,
-                        
+                        "select" | "insert" | "update" | "delete" | "merge" | "from" | "where"
+                        | "join" | "inner" | "left" | "right" | "full" | "cross" | "on"
+                        | "using" | "group" | "having" | "order" | "by" | "limit" | "offset"
+                        | "fetch" | "top" | "union" | "intersect" | "except" | "minus" | "into"
+                        | "values" | "set" => TokenKind::Keyword,
+
                         // SQL Keywords - DCL
-                        b"GRANT" | b"REVOKE" | b"DENY" => TokenKind::Keyword,
-                        
+                        "grant" | "revoke" | "deny" => TokenKind::Keyword,
+
                         // SQL Keywords - TCL
-                        b"COMMIT" | b"ROLLBACK" | b"SAVEPOINT" | b"BEGIN" | b"END" |
-                        b"TRANSACTION" | b"START" => TokenKind::Keyword,
-                        
+                        "commit" | "rollback" | "savepoint" | "begin" | "end" | "transaction"
+                        | "start" => TokenKind::Keyword,
+
                         // SQL Keywords - Constraints
-                        b"PRIMARY" | b"FOREIGN" | b"KEY" | b"UNIQUE" | b"CHECK" |
-                        b"DEFAULT" | b"NOT" | b"NULL" | b"CONSTRAINT" | b"REFERENCES" => TokenKind::Keyword,
-                        
+                        "primary" | "foreign" | "key" | "unique" | "check" | "default" | "not"
+                        | "null" | "constraint" | "references" => TokenKind::Keyword,
+
                         // SQL Keywords - Other
-                        b"AS" | b"DISTINCT" | b"ALL" | b"ANY" | b"SOME" | b"EXISTS" |
-                        b"IN" | b"BETWEEN" | b"LIKE" | b"IS" | b"AND" | b"OR" |
-                        b"CASE" | b"WHEN" | b"THEN" | b"ELSE" |
-                        b"IF" | b"WHILE" | b"LOOP" | b"REPEAT" | b"GOTO" | b"RETURN" |
-                        b"DECLARE" | b"CURSOR" | b"OPEN" | b"CLOSE" |
-                        b"WITH" | b"RECURSIVE" | b"OVER" | b"PARTITION" |
-                        b"WINDOW" | b"ROWS" | b"RANGE" | b"PRECEDING" | b"FOLLOWING" |
-                        b"CURRENT" | b"ROW" | b"UNBOUNDED" => TokenKind::Keyword,
-                        
+                        "as" | "distinct" | "all" | "any" | "some" | "exists" | "in"
+                        | "between" | "like" | "is" | "and" | "or" | "case" | "when" | "then"
+                        | "else" | "if" | "while" | "loop" | "repeat" | "goto" | "return"
+                        | "declare" | "cursor" | "open" | "close" | "with" | "recursive"
+                        | "over" | "partition" | "window" | "rows" | "range" | "preceding"
+                        | "following" | "current" | "row" | "unbounded" => TokenKind::Keyword,
+
                         // Data types
-                        b"INT" | b"INTEGER" | b"BIGINT" | b"SMALLINT" | b"TINYINT" |
-                        b"DECIMAL" | b"NUMERIC" | b"FLOAT" | b"REAL" | b"DOUBLE" |
-                        b"CHAR" | b"VARCHAR" | b"TEXT" | b"NCHAR" | b"NVARCHAR" | b"NTEXT" |
-                        b"DATE" | b"TIME" | b"DATETIME" | b"TIMESTAMP" | b"YEAR" |
-                        b"BOOLEAN" | b"BOOL" | b"BIT" |
-                        b"BLOB" | b"CLOB" | b"BINARY" | b"VARBINARY" |
-                        b"JSON" | b"XML" | b"UUID" | b"SERIAL" | b"AUTO_INCREMENT" => TokenKind::TypeName,
-                        
+                        "int" | "integer" | "bigint" | "smallint" | "tinyint" | "decimal"
+                        | "numeric" | "float" | "real" | "double" | "char" | "varchar" | "text"
+                        | "nchar" | "nvarchar" | "ntext" | "date" | "time" | "datetime"
+                        | "timestamp" | "year" | "boolean" | "bool" | "bit" | "blob" | "clob"
+                        | "binary" | "varbinary" | "json" | "xml" | "uuid" | "serial"
+                        | "auto_increment" => TokenKind::TypeName,
+
                         // Boolean literals
-                        b"TRUE" | b"FALSE" => TokenKind::Boolean,
-                        
+                        "true" | "false" => TokenKind::Boolean,
+
                         // Aggregate functions
-                        b"COUNT" | b"SUM" | b"AVG" | b"MIN" | b"MAX" |
-                        b"STDDEV" | b"VARIANCE" | b"GROUP_CONCAT" | b"STRING_AGG" => TokenKind::FunctionName,
-                        
+                        "count" | "sum" | "avg" | "min" | "max" | "stddev" | "variance"
+                        | "group_concat" | "string_agg" => TokenKind::FunctionName,
+
                         // String functions
-                        b"CONCAT" | b"SUBSTRING" | b"SUBSTR" | b"LENGTH" | b"UPPER" | b"LOWER" |
-                        b"TRIM" | b"LTRIM" | b"RTRIM" | b"REPLACE" | b"COALESCE" => TokenKind::FunctionName,
-                        
+                        "concat" | "substring" | "substr" | "length" | "upper" | "lower"
+                        | "trim" | "ltrim" | "rtrim" | "replace" | "coalesce" => {
+                            TokenKind::FunctionName
+                        }
+
                         // Date functions
-                        b"NOW" | b"CURRENT_DATE" | b"CURRENT_TIME" | b"CURRENT_TIMESTAMP" |
-                        b"DATEADD" | b"DATEDIFF" | b"EXTRACT" => TokenKind::FunctionName,
-                        
+                        "now" | "current_date" | "current_time" | "current_timestamp"
+                        | "dateadd" | "datediff" | "extract" => TokenKind::FunctionName,
+
                         // Conversion functions
-                        b"CAST" | b"CONVERT" | b"TO_CHAR" | b"TO_DATE" | b"TO_NUMBER" => TokenKind::FunctionName,
-                        
+                        "cast" | "convert" | "to_char" | "to_date" | "to_number" => {
+                            TokenKind::FunctionName
+                        }
+
                         _ => TokenKind::Identifier,
-                    };
+                    });
                     tokens.push(Token::new(kind, start..pos));
                 }
 
                 // Operators and punctuation
-                b'=' | b'<' | b'>' | b'!' | b'+' | b'-' | b'*' | b'/' | b'%' |
-                b'(' | b')' | b',' | b';' | b'.' | b'|' | b'&' | b'^' | b'~' => {
+                b'=' | b'<' | b'>' | b'!' | b'+' | b'-' | b'*' | b'/' | b'%' | b':' | b'('
+                | b')' | b',' | b';' | b'.' | b'|' | b'&' | b'^' | b'~' => {
                     pos += 1;
                     // Handle multi-character operators
                     if pos < text.len() {
                         match (b, text[pos]) {
-                            (b'=', b'=') | (b'<', b'=') | (b'>', b'=') | (b'!', b'=') |
-                            (b'<', b'>') | (b'<', b'<') | (b'>', b'>') |
-                            (b'|', b'|') | (b':', b':') => {
+                            (b'=', b'=')
+                            | (b'<', b'=')
+                            | (b'>', b'=')
+                            | (b'!', b'=')
+                            | (b'<', b'>')
+                            | (b'<', b'<')
+                            | (b'>', b'>')
+                            | (b'|', b'|')
+                            | (b':', b':') => {
                                 pos += 1;
                             }
                             _ => {}
@@ -273,14 +462,111 @@ impl Lexer for SqlLexer {
                     tokens.push(Token::new(TokenKind::Operator, start..pos));
                 }
 
+                // Array subscripts (PostgreSQL) and JSON operators like #>> (PostgreSQL)
+                b'[' | b']' | b'#'
+                    if matches!(
+                        dialect,
+                        SqlDialect::Ansi | SqlDialect::Postgres | SqlDialect::MySql
+                    ) =>
+                {
+                    pos += 1;
+                    if b == b'#' {
+                        while pos < text.len() && matches!(text[pos], b'>' | b'-') {
+                            pos += 1;
+                        }
+                    }
+                    tokens.push(Token::new(TokenKind::Operator, start..pos));
+                }
+
                 // Unknown character
                 _ => {
-                    pos += 1;
+                    pos += char_len(text, pos);
                     tokens.push(Token::new(TokenKind::Error, start..pos));
                 }
             }
         }
+    }
 
-        tokens
+    fn resumes(&self, text: &[u8], dialect: &SqlDialect) -> bool {
+        *dialect == self.dialect(text)
     }
 }
+
+/// Returns the length of the `$tag$` at the start of `text`, where the tag may be empty.
+fn dollar_quote(text: &[u8]) -> Option<usize> {
+    let tag = text[1..].iter().take_while(|&&b| is_ident_continue(b)).count();
+    let starts_ident = text.get(1).is_none_or(|&b| !is_ascii_digit(b));
+    (starts_ident && text.get(1 + tag) == Some(&b'$')).then_some(tag + 2)
+}
+
+/// Returns the kind of the keyword, type or function `word`, in lowercase, if only
+/// `dialect` has it.
+fn dialect_keyword(dialect: SqlDialect, word: &str) -> Option<TokenKind> {
+    let kind = match (dialect, word) {
+        (
+            SqlDialect::Postgres,
+            "returning" | "ilike" | "similar" | "lateral" | "language" | "do" | "perform" | "raise"
+            | "notice" | "exception" | "declare" | "loop" | "foreach" | "array" | "only"
+            | "conflict" | "nothing" | "materialized" | "concurrently" | "extension",
+        ) => TokenKind::Keyword,
+        (
+            SqlDialect::Postgres,
+            "jsonb" | "bytea" | "bigserial" | "smallserial" | "interval" | "inet" | "cidr"
+            | "tsvector" | "tsquery" | "citext" | "regclass" | "oid",
+        ) => TokenKind::TypeName,
+        (
+            SqlDialect::Postgres,
+            "array_agg" | "jsonb_build_object" | "json_build_object" | "jsonb_agg"
+            | "generate_series" | "nextval" | "currval" | "unnest" | "to_tsvector" | "to_tsquery"
+            | "date_trunc",
+        ) => TokenKind::FunctionName,
+
+        (
+            SqlDialect::MySql,
+            "engine" | "unsigned" | "zerofill" | "ignore" | "duplicate" | "straight_join"
+            | "regexp" | "rlike" | "div" | "xor" | "delimiter" | "charset" | "collate" | "show"
+            | "describe" | "use",
+        ) => TokenKind::Keyword,
+        (
+            SqlDialect::MySql,
+            "mediumint" | "mediumtext" | "longtext" | "tinytext" | "mediumblob" | "longblob"
+            | "enum",
+        ) => TokenKind::TypeName,
+        (
+            SqlDialect::MySql,
+            "ifnull" | "date_format" | "last_insert_id" | "found_rows" | "unix_timestamp"
+            | "from_unixtime",
+        ) => TokenKind::FunctionName,
+
+        (
+            SqlDialect::Sqlite,
+            "pragma" | "autoincrement" | "glob" | "vacuum" | "attach" | "detach" | "rowid"
+            | "without" | "conflict" | "abort" | "fail" | "ignore" | "strict" | "indexed",
+        ) => TokenKind::Keyword,
+        (
+            SqlDialect::Sqlite,
+            "ifnull" | "instr" | "julianday" | "strftime" | "printf" | "randomblob"
+            | "last_insert_rowid" | "changes" | "json_extract",
+        ) => TokenKind::FunctionName,
+
+        (
+            SqlDialect::MsSql,
+            "go" | "identity" | "nocount" | "exec" | "execute" | "output" | "inserted" | "deleted"
+            | "try" | "catch" | "raiserror" | "throw" | "print" | "proc" | "tran" | "nolock"
+            | "clustered" | "nonclustered",
+        ) => TokenKind::Keyword,
+        (
+            SqlDialect::MsSql,
+            "uniqueidentifier" | "datetime2" | "datetimeoffset" | "smalldatetime" | "money"
+            | "smallmoney" | "image" | "sql_variant" | "rowversion" | "hierarchyid",
+        ) => TokenKind::TypeName,
+        (
+            SqlDialect::MsSql,
+            "getdate" | "getutcdate" | "isnull" | "newid" | "len" | "charindex" | "scope_identity"
+            | "iif" | "datepart" | "object_id",
+        ) => TokenKind::FunctionName,
+
+        _ => return None,
+    };
+    Some(kind)
+}
@@ -1,3 +1,6 @@
+use std::sync::{Arc, mpsc};
+use std::time::Duration;
+
 use crate::syntax::lexer::{Language, LexerRegistry};
 
 #[test]
@@ -5,12 +8,12 @@ fn test_c_lexer_basic() {
     let source = b"int main() { return 0; }";
     let lexer = LexerRegistry::get_lexer(Language::C);
     let tokens = lexer.tokenize(source);
-    
+
     println!("Tokens: {}", tokens.len());
     for token in &tokens {
         println!("{:?}", token);
     }
-    
+
     assert!(!tokens.is_empty(), "C lexer should produce tokens");
 }
 
@@ -19,7 +22,7 @@ fn test_java_lexer_basic() {
     let source = b"public class Test {}";
     let lexer = LexerRegistry::get_lexer(Language::Java);
     let tokens = lexer.tokenize(source);
-    
+
     println!("Tokens: {}", tokens.len());
     assert!(!tokens.is_empty(), "Java lexer should produce tokens");
 }
@@ -29,7 +32,7 @@ fn test_csharp_lexer_basic() {
     let source = b"public class Test {}";
     let lexer = LexerRegistry::get_lexer(Language::CSharp);
     let tokens = lexer.tokenize(source);
-    
+
     println!("Tokens: {}", tokens.len());
     assert!(!tokens.is_empty(), "C# lexer should produce tokens");
 }
@@ -39,7 +42,2204 @@ fn test_cpp_lexer_basic() {
     let source = b"int main() { return 0; }";
     let lexer = LexerRegistry::get_lexer(Language::Cpp);
     let tokens = lexer.tokenize(source);
-    
+
     println!("Tokens: {}", tokens.len());
     assert!(!tokens.is_empty(), "C++ lexer should produce tokens");
 }
+
+// Embedded region conformance: every lexer that delegates to an `EmbeddedRegion`
+// must produce tokens in document coordinates that stay within the region.
+
+use crate::syntax::{
+    DEFAULT_COMMENT_KEYWORDS, DiagnosticOptions, DocMarkup, EmbeddedRegion, HighlightOptions,
+    MAX_EMBED_DEPTH, MAX_INTERPOLATION_DEPTH, MAX_NESTING_DEPTH, RegionEnd, ScopeStack, SqlDialect,
+    SyntaxHighlighter, Theme, Token, TokenKind, TokenPayload, mark_inactive_code, split_escapes,
+    tokenize_long_lines,
+};
+
+fn token_text<'a>(text: &'a [u8], token: &Token) -> &'a [u8] {
+    &text[token.span.clone()]
+}
+
+fn assert_ordered(tokens: &[Token], len: usize) {
+    let mut last = 0;
+    for token in tokens {
+        assert!(token.span.start >= last, "token {:?} overlaps its predecessor", token);
+        assert!(token.span.end <= len, "token {:?} is out of bounds", token);
+        last = token.span.end;
+    }
+}
+
+#[test]
+fn test_embedded_markdown_fence() {
+    let text = b"Text\n```rust\nfn main() {}\n```\nMore";
+    let tokens = LexerRegistry::get_lexer(Language::Markdown).tokenize(text);
+    assert_ordered(&tokens, text.len());
+
+    let keyword = tokens.iter().find(|t| t.kind == TokenKind::KeywordFunction).expect("fn keyword");
+    assert_eq!(token_text(text, keyword), b"fn");
+    let fences: Vec<_> = tokens
+        .iter()
+        .filter(|t| t.kind == TokenKind::MarkdownCode)
+        .map(|t| token_text(text, t))
+        .collect();
+    assert_eq!(fences, vec![&b"```rust"[..], &b"```"[..]]);
+}
+
+#[test]
+fn test_embedded_markdown_fence_unknown_language() {
+    let text = b"```klingon\nqapla'\n```\n";
+    let tokens = LexerRegistry::get_lexer(Language::Markdown).tokenize(text);
+    let body = tokens.iter().find(|t| token_text(text, t) == b"qapla'\n").expect("fallback token");
+    assert_eq!(body.kind, TokenKind::MarkdownCode);
+}
+
+#[test]
+fn test_embedded_html_script_and_style() {
+    let text = b"<script>let a = 1;</script><style>p { color: red; }</STYLE>";
+    let tokens = LexerRegistry::get_lexer(Language::Html).tokenize(text);
+    assert_ordered(&tokens, text.len());
+
+    let storage = tokens.iter().find(|t| t.kind == TokenKind::KeywordStorage).expect("let keyword");
+    assert_eq!(token_text(text, storage), b"let");
+    let number = tokens.iter().find(|t| t.kind == TokenKind::Number).expect("number");
+    assert_eq!(token_text(text, number), b"1");
+    assert!(tokens.iter().any(|t| token_text(text, t) == b"STYLE" && t.kind == TokenKind::Keyword));
+}
+
+#[test]
+fn test_stray_slash_in_tag() {
+    // These used to hang the attribute loop, e.g. for Go's `<-ch` lexed as HTML.
+    for language in [Language::Html, Language::Xml] {
+        for text in [&b"<a / b>"[..], b"<-ch // x", b"<img src=/x />", b"<a /"] {
+            let tokens = LexerRegistry::get_lexer(language).tokenize(text);
+            assert_ordered(&tokens, text.len());
+            assert!(tokens.iter().any(|t| token_text(text, t) == b"/"), "{:?}", language);
+        }
+    }
+}
+
+/// Every fixture in `syntax-tests`, with the language it's lexed as.
+const FIXTURES: [(Language, &[u8]); 27] = [
+    (Language::C, include_bytes!("../../../../../syntax-tests/test_syntax.c")),
+    (Language::C, include_bytes!("../../../../../syntax-tests/test_syntax_preprocessor.c")),
+    (Language::Cpp, include_bytes!("../../../../../syntax-tests/test_syntax.cpp")),
+    (Language::CSharp, include_bytes!("../../../../../syntax-tests/test_syntax.cs")),
+    (Language::Go, include_bytes!("../../../../../syntax-tests/test_syntax.go")),
+    (Language::Go, include_bytes!("../../../../../syntax-tests/test_syntax_generics.go")),
+    (Language::Go, include_bytes!("../../../../../syntax-tests/test_cgo.go")),
+    (Language::Go, include_bytes!("../../../../../syntax-tests/test_syntax_test.go")),
+    (Language::Go, include_bytes!("../../../../../syntax-tests/test_sql_injection.go")),
+    (Language::GoTemplate, include_bytes!("../../../../../syntax-tests/test_template.gohtml")),
+    (Language::Java, include_bytes!("../../../../../syntax-tests/test_syntax.java")),
+    (Language::JavaScript, include_bytes!("../../../../../syntax-tests/test_syntax.js")),
+    (Language::JavaScript, include_bytes!("../../../../../syntax-tests/test_syntax_regex.js")),
+    (Language::JavaScript, include_bytes!("../../../../../syntax-tests/test_interpolation.js")),
+    (Language::Json, include_bytes!("../../../../../syntax-tests/test_syntax.json")),
+    (Language::Python, include_bytes!("../../../../../syntax-tests/test_syntax.py")),
+    (Language::Python, include_bytes!("../../../../../syntax-tests/test_fstrings.py")),
+    (Language::Rust, include_bytes!("../../../../../syntax-tests/test_syntax.rs")),
+    (Language::Shell, include_bytes!("../../../../../syntax-tests/test_heredoc.sh")),
+    (Language::Sql, include_bytes!("../../../../../syntax-tests/test_syntax.sql")),
+    (Language::Sql, include_bytes!("../../../../../syntax-tests/test_syntax_postgres.sql")),
+    (Language::Sql, include_bytes!("../../../../../syntax-tests/test_syntax_mysql.sql")),
+    (Language::Sql, include_bytes!("../../../../../syntax-tests/test_syntax_sqlite.sql")),
+    (Language::Sql, include_bytes!("../../../../../syntax-tests/test_syntax_mssql.sql")),
+    (Language::Toml, include_bytes!("../../../../../syntax-tests/test_syntax.toml")),
+    (Language::Yaml, include_bytes!("../../../../../syntax-tests/test_syntax.yaml")),
+    (Language::Yaml, include_bytes!("../../../../../syntax-tests/test_syntax_block_scalars.yaml")),
+];
+
+#[test]
+fn test_fixtures_have_no_errors() {
+    // `hl --check` reports every error token, so valid code must not produce any.
+    for (language, text) in FIXTURES {
+        let tokens = LexerRegistry::get_lexer(language).tokenize(text);
+        let errors: Vec<_> =
+            tokens.iter().filter(|t| t.kind.is_error()).map(|t| token_text(text, t)).collect();
+        assert!(errors.is_empty(), "{language:?}: {:?}", errors);
+    }
+}
+
+/// Token spans must cover the whole text without gaps or overlaps, so that the offsets
+/// in golden outputs are byte offsets anyone can slice the file with.
+/// Fails with the offending offsets unless `tokens` tile `text`: in order, each starting
+/// where the last one ended, from 0 to the end. Their slices then concatenate back to
+/// `text` byte for byte, which is what the renderers rely on.
+#[track_caller]
+fn assert_lossless(what: &str, text: &[u8], tokens: &[Token]) {
+    let mut end = 0;
+    for (i, token) in tokens.iter().enumerate() {
+        let span = &token.span;
+        assert!(
+            span.start <= span.end && span.end <= text.len(),
+            "{what}: token {i} at {span:?} is out of bounds 0..{}",
+            text.len()
+        );
+        assert!(
+            span.start >= end,
+            "{what}: token {i} at {span:?} overlaps the one before, which ends at {end}"
+        );
+        assert!(span.start == end, "{what}: gap at {end}..{} before token {i}", span.start);
+        end = span.end;
+    }
+    assert!(end == text.len(), "{what}: gap at {end}..{} after the last token", text.len());
+}
+
+/// The tokens of `text` after every post-processing step that splits or flags tokens.
+fn highlighted(language: Language, text: &[u8]) -> Vec<Token> {
+    let mut highlighter = SyntaxHighlighter::new(language, Theme::default());
+    highlighter.set_options(HighlightOptions {
+        rainbow_brackets: true,
+        links: true,
+        file_paths: true,
+        comment_keywords: DEFAULT_COMMENT_KEYWORDS.map(String::from).to_vec(),
+        colors: true,
+        string_colors: true,
+        whitespace: true,
+        diagnostics: DiagnosticOptions { javascript_var: true, strict_json: true },
+        escapes: true,
+        inactive_code: true,
+        sql_dialect: None,
+        language_version: None,
+        max_line_length: None,
+        max_nesting_depth: None,
+        unterminated_comment_lines: None,
+        injections: true,
+        string_injections: vec![("Query".to_string(), Language::Sql)],
+    });
+    highlighter.update(text, true);
+    highlighter.tokens().to_vec()
+}
+
+#[test]
+fn test_lossless_tokenization() {
+    // The whole directory, not just `FIXTURES`, so that new fixtures are covered too.
+    let dir = concat!(env!("CARGO_MANIFEST_DIR"), "/../../syntax-tests");
+    let mut paths: Vec<_> = std::fs::read_dir(dir).unwrap().map(|e| e.unwrap().path()).collect();
+    paths.sort();
+    for path in paths {
+        let name = path.file_name().unwrap().to_string_lossy().into_owned();
+        let language = Language::from_extension(path.extension().unwrap().to_str().unwrap());
+        let text = std::fs::read(&path).unwrap();
+        assert_lossless(&name, &text, &LexerRegistry::get_lexer(language).tokenize(&text));
+        assert_lossless(&format!("{name}, highlighted"), &text, &highlighted(language, &text));
+    }
+}
+
+/// A xorshift generator, so that the random inputs are the same on every run.
+struct Rng(u64);
+
+impl Rng {
+    fn below(&mut self, n: usize) -> usize {
+        self.0 ^= self.0 << 13;
+        self.0 ^= self.0 >> 7;
+        self.0 ^= self.0 << 17;
+        (self.0 % n as u64) as usize
+    }
+}
+
+/// What random inputs are made of: what opens and closes the constructs of the lexers,
+/// and chars of every UTF-8 length for them to end in the middle of.
+const PIECES: &[&str] = &[
+    "\"", "'", "`", "/", "*", "#", "-", "+", "<", ">", "!", "?", "=", ":", ";", ",", ".", "(", ")",
+    "[", "]", "{", "}", "\\", "$", "@", "%", "&", "|", "^", "~", "_", " ", "\t", "\n", "\r\n",
+    "\r", "x", "if", "fn", "0", "0x1F", "1.5e3", "r#", "\"\"\"", "'''", "```", "/*", "*/", "//",
+    "<!--", "-->", "${", "#{", "é", "€", "𝄞", "\u{2028}", "\u{FEFF}", "\u{200B}",
+];
+
+#[test]
+fn test_lossless_random_inputs() {
+    let mut rng = Rng(0x2545_F491_4F6C_DD1D);
+    for case in 0..400 {
+        let len = rng.below(48);
+        let text: String = (0..len).map(|_| PIECES[rng.below(PIECES.len())]).collect();
+        let lexers = Language::ALL
+            .iter()
+            .map(|&language| (format!("{language:?}"), LexerRegistry::get_lexer(language)))
+            .chain(
+                SqlDialect::ALL
+                    .iter()
+                    .map(|&d| (format!("{d:?}"), LexerRegistry::get_sql_lexer(d))),
+            );
+        // A panic names the input too, after the message of the panic itself.
+        let tokenize = |what: &str, f: &dyn Fn() -> Vec<Token>| {
+            let tokens = std::panic::catch_unwind(std::panic::AssertUnwindSafe(f));
+            let tokens = tokens.unwrap_or_else(|_| panic!("{what}: panicked"));
+            assert_lossless(what, text.as_bytes(), &tokens);
+        };
+        for (name, lexer) in lexers {
+            tokenize(&format!("{name}, case {case}: {text:?}"), &|| {
+                lexer.tokenize(text.as_bytes())
+            });
+            tokenize(&format!("{name} with long lines, case {case}: {text:?}"), &|| {
+                tokenize_long_lines(&*lexer, text.as_bytes(), 8)
+            });
+        }
+        for &language in Language::ALL {
+            let what = format!("{language:?} highlighted, case {case}: {text:?}");
+            tokenize(&what, &|| highlighted(language, text.as_bytes()));
+        }
+    }
+}
+
+/// Inputs lexers tend to get wrong, to fuzz besides the fixtures.
+fn nasty_seeds() -> Vec<(&'static str, Vec<u8>)> {
+    vec![
+        // UTF-8 can't encode surrogates, but they show up in files anyway.
+        ("lone surrogates", b"s := \"\xED\xA0\x80\" // \xED\xBF\xBF\n'\xED\xB0\x80'".to_vec()),
+        // Anything quadratic stands out at this size.
+        ("a megabyte of open braces", b"{".repeat(1 << 20)),
+        ("an escape at the end", b"s = \"\\".to_vec()),
+        ("nested block comments", [b"/*".repeat(1000), b"*/".repeat(999)].concat()),
+        ("only backticks", b"`".repeat(1000)),
+        (
+            "deeply nested composite literals",
+            [b"x := ".as_slice(), &b"[]map[string]func(){".repeat(1000), &b"}".repeat(1000)]
+                .concat(),
+        ),
+        ("open braces only", b"{".repeat(100_000)),
+    ]
+}
+
+/// The fixtures in `dir` with the languages they're lexed as, sorted by name.
+fn fixtures_in(dir: &str) -> Vec<(String, Language, Vec<u8>)> {
+    let mut paths: Vec<_> = std::fs::read_dir(dir).unwrap().map(|e| e.unwrap().path()).collect();
+    paths.sort();
+    paths
+        .into_iter()
+        .filter(|path| path.is_file() && path.extension().is_some_and(|ext| ext != "tokens"))
+        .map(|path| {
+            let language = Language::from_extension(path.extension().unwrap().to_str().unwrap());
+            (
+                path.file_name().unwrap().to_string_lossy().into_owned(),
+                language,
+                std::fs::read(&path).unwrap(),
+            )
+        })
+        .collect()
+}
+
+/// Changes `input` a few times like a fuzzer would: overwrites a byte, inserts one of
+/// [`PIECES`], deletes a slice, or repeats one.
+fn mutate(rng: &mut Rng, input: &mut Vec<u8>) {
+    for _ in 0..=rng.below(4) {
+        let pos = rng.below(input.len() + 1);
+        let end = (pos + rng.below(16)).min(input.len());
+        match rng.below(4) {
+            0 if pos < input.len() => input[pos] = rng.below(256) as u8,
+            1 => _ = input.splice(pos..pos, PIECES[rng.below(PIECES.len())].bytes()),
+            2 => _ = input.drain(pos..end),
+            _ => _ = input.splice(pos..pos, input[pos..end].to_vec()),
+        }
+    }
+}
+
+/// Lexes `text` as `language` on another thread and checks the tokens, failing if that
+/// panics or takes longer than a second and 10µs per byte, which only a hang would.
+#[track_caller]
+fn lex_with_deadline(what: &str, language: Language, text: Arc<[u8]>) {
+    let budget = Duration::from_secs(1) + Duration::from_micros(10 * text.len() as u64);
+    let (tx, rx) = mpsc::channel();
+    let input = text.clone();
+    std::thread::spawn(move || _ = tx.send(LexerRegistry::get_lexer(language).tokenize(&input)));
+    // Short inputs are printed, so that they can become crashers.
+    let input = if text.len() <= 256 {
+        format!(" {:?}", text.escape_ascii().to_string())
+    } else {
+        String::new()
+    };
+    match rx.recv_timeout(budget) {
+        Ok(tokens) => assert_lossless(&format!("{what}{input}"), &text, &tokens),
+        Err(mpsc::RecvTimeoutError::Timeout) => {
+            panic!("{what}{input}: still lexing after {budget:?}")
+        }
+        Err(mpsc::RecvTimeoutError::Disconnected) => panic!("{what}{input}: panicked"),
+    }
+}
+
+/// The fuzz target for all lexers: the first byte picks the language the rest is lexed as.
+#[track_caller]
+fn fuzz_lex_all(what: &str, input: &[u8]) {
+    let Some((&first, text)) = input.split_first() else { return };
+    let language = Language::ALL[first as usize % Language::ALL.len()];
+    lex_with_deadline(&format!("{what} as {language:?}"), language, text.into());
+}
+
+/// The mutated inputs per fuzz test. Set `FUZZ_CASES` for a longer run, like
+/// `FUZZ_CASES=100000 cargo test --release fuzz_lex`.
+fn fuzz_cases() -> usize {
+    std::env::var("FUZZ_CASES").ok().and_then(|n| n.parse().ok()).unwrap_or(300)
+}
+
+#[test]
+fn test_fuzz_lex_go() {
+    let mut seeds: Vec<_> = [
+        fixtures_in(concat!(env!("CARGO_MANIFEST_DIR"), "/../../syntax-tests")),
+        fixtures_in(concat!(env!("CARGO_MANIFEST_DIR"), "/../../syntax-tests-invalid")),
+        fixtures_in(concat!(env!("CARGO_MANIFEST_DIR"), "/../../syntax-tests-invalid/crashers")),
+    ]
+    .into_iter()
+    .flatten()
+    .filter(|(_, language, _)| *language == Language::Go)
+    .map(|(name, _, text)| (name, text))
+    .collect();
+    seeds.extend(nasty_seeds().into_iter().map(|(name, text)| (name.to_string(), text)));
+    for (name, text) in &seeds {
+        lex_with_deadline(name, Language::Go, text.as_slice().into());
+    }
+
+    let mut rng = Rng(0x9E37_79B9_7F4A_7C15);
+    for case in 0..fuzz_cases() {
+        let (name, seed) = &seeds[rng.below(seeds.len())];
+        let mut input = seed.clone();
+        mutate(&mut rng, &mut input);
+        lex_with_deadline(&format!("{name}, case {case}"), Language::Go, input.into());
+    }
+}
+
+#[test]
+fn test_fuzz_lex_all() {
+    let mut seeds: Vec<_> = [
+        fixtures_in(concat!(env!("CARGO_MANIFEST_DIR"), "/../../syntax-tests")),
+        fixtures_in(concat!(env!("CARGO_MANIFEST_DIR"), "/../../syntax-tests-invalid")),
+        fixtures_in(concat!(env!("CARGO_MANIFEST_DIR"), "/../../syntax-tests-invalid/crashers")),
+    ]
+    .into_iter()
+    .flatten()
+    .map(|(name, _, text)| (name, text))
+    .collect();
+    seeds.extend(nasty_seeds().into_iter().map(|(name, text)| (name.to_string(), text)));
+    // Every seed in every language first, then mutations in random ones.
+    for (name, text) in &seeds {
+        for &language in Language::ALL {
+            lex_with_deadline(&format!("{name} as {language:?}"), language, text.as_slice().into());
+        }
+    }
+
+    let mut rng = Rng(0xD1B5_4A32_D192_ED03);
+    for case in 0..fuzz_cases() {
+        let (name, seed) = &seeds[rng.below(seeds.len())];
+        // The megabyte is lexed above, and too slow to copy and mutate for every case.
+        if seed.len() > 1 << 16 {
+            continue;
+        }
+        let mut input = vec![rng.below(256) as u8];
+        input.extend_from_slice(seed);
+        mutate(&mut rng, &mut input);
+        fuzz_lex_all(&format!("{name}, case {case}"), &input);
+    }
+}
+
+/// Inputs of about 5 MB that a lexer could take quadratic time on, if it scanned ahead
+/// from each token or kept a stack it searched.
+fn pathological_inputs() -> Vec<(&'static str, Vec<u8>)> {
+    const LEN: usize = 5 << 20;
+    let repeat = |piece: &[u8]| piece.repeat(LEN / piece.len());
+    let fixture = include_bytes!("../../../../../syntax-tests/test_syntax.go");
+    vec![
+        ("nested parens", [repeat(b"("), repeat(b")")].concat()),
+        (
+            "only string escapes",
+            [b"s := \"".as_slice(), &repeat(b"\\n\\t\\x41\\u00e9\\\"\\\\"), b"\""].concat(),
+        ),
+        ("an unterminated raw string", [b"s := `".as_slice(), &repeat(fixture)].concat()),
+        (
+            "10k-column lines",
+            repeat(&[b"x := ".as_slice(), &b"f(a, \"b\", 1.5) + ".repeat(600), b"0\n"].concat()),
+        ),
+        ("many small tokens", repeat(b"a+b;")),
+        ("an unterminated block comment", [b"/*".as_slice(), &repeat(b"/* * / ")].concat()),
+    ]
+}
+
+#[test]
+fn test_linear_time() {
+    // Lexing is linear in the length of the text, so these take a fraction of the deadline,
+    // while anything quadratic would take hours.
+    for (name, text) in pathological_inputs() {
+        lex_with_deadline(name, Language::Go, text.into());
+    }
+}
+
+/// Checks the annotations in a fixture: a line like `//    ^^^ Macro`, or `--` in SQL and `#` in YAML,
+/// asserts that the characters above the carets are in tokens of that kind, which is
+/// `TokenKind`'s `Debug` name. Between continued lines, they're written as
+/// `/*    ^^^ Macro */ \` instead. Annotations refer to the last line that isn't one,
+/// and are removed before lexing.
+#[track_caller]
+fn assert_annotations(language: Language, fixture: &str) {
+    let mut text = String::new();
+    // The caret columns of each annotation, with the offset of its line in `text`.
+    let mut annotations = Vec::new();
+    let mut line_start = 0;
+    for (n, line) in fixture.lines().enumerate() {
+        let body =
+            ["//", "/*", "--", "#"].iter().find_map(|p| line.strip_prefix(p)).unwrap_or_default();
+        match body.trim_start().strip_prefix('^') {
+            Some(_) => {
+                let carets = line.find('^').unwrap();
+                let end = carets + line[carets..].find(|c| c != '^').unwrap_or(line.len() - carets);
+                let kind = line[end..].trim_end_matches(['\\', ' ']).trim_end_matches("*/").trim();
+                annotations.push((n + 1, line_start + carets..line_start + end, kind));
+            }
+            None => {
+                line_start = text.len();
+                text.push_str(line);
+                text.push('\n');
+            }
+        }
+    }
+
+    let mut tokens = LexerRegistry::get_lexer(language).tokenize(text.as_bytes());
+    mark_inactive_code(language, text.as_bytes(), &mut tokens);
+    for (n, range, kind) in annotations {
+        for pos in range {
+            let token = tokens.iter().find(|t| t.span.contains(&pos)).unwrap();
+            assert_eq!(
+                format!("{:?}", token.kind),
+                kind,
+                "line {n}: {:?} in {:?}",
+                &text[pos..pos + 1],
+                &text[token.span.clone()],
+            );
+        }
+    }
+}
+
+#[test]
+fn test_fixture_annotations() {
+    let preprocessor = include_str!("../../../../../syntax-tests/test_syntax_preprocessor.c");
+    assert_annotations(Language::C, preprocessor);
+    assert_annotations(Language::Cpp, preprocessor);
+    assert_annotations(Language::Rust, include_str!("../../../../../syntax-tests/test_syntax.rs"));
+    assert_annotations(
+        Language::Go,
+        include_str!("../../../../../syntax-tests/test_syntax_generics.go"),
+    );
+    assert_annotations(Language::Go, include_str!("../../../../../syntax-tests/test_cgo.go"));
+    assert_annotations(
+        Language::Go,
+        include_str!("../../../../../syntax-tests/test_syntax_test.go"),
+    );
+    let regex = include_str!("../../../../../syntax-tests/test_syntax_regex.js");
+    assert_annotations(Language::JavaScript, regex);
+    assert_annotations(Language::TypeScript, regex);
+    for sql in [
+        include_str!("../../../../../syntax-tests/test_syntax.sql"),
+        include_str!("../../../../../syntax-tests/test_syntax_postgres.sql"),
+        include_str!("../../../../../syntax-tests/test_syntax_mysql.sql"),
+        include_str!("../../../../../syntax-tests/test_syntax_sqlite.sql"),
+        include_str!("../../../../../syntax-tests/test_syntax_mssql.sql"),
+    ] {
+        assert_annotations(Language::Sql, sql);
+    }
+    let block_scalars = include_str!("../../../../../syntax-tests/test_syntax_block_scalars.yaml");
+    assert_annotations(Language::Yaml, block_scalars);
+}
+
+/// The tokens of the first line in `text` that starts with `prefix`, without whitespace.
+fn line_tokens<'a>(text: &'a str, tokens: &[Token], prefix: &str) -> Vec<(TokenKind, &'a str)> {
+    let start = text.find(&format!("\n{prefix}")).unwrap() + 1;
+    let end = start + text[start..].find('\n').unwrap();
+    tokens
+        .iter()
+        .filter(|t| t.kind != TokenKind::Whitespace)
+        .filter(|t| t.span.start >= start && t.span.end <= end)
+        .map(|t| (t.kind, &text[t.span.clone()]))
+        .collect()
+}
+
+#[test]
+fn test_go_directives() {
+    use TokenKind::{Comment, Identifier, Macro, Operator, String};
+
+    let text = include_str!("../../../../../syntax-tests/test_syntax.go");
+    let tokens = LexerRegistry::get_lexer(Language::Go).tokenize(text.as_bytes());
+    let line = |prefix| line_tokens(text, &tokens, prefix);
+
+    assert_eq!(
+        line("//go:build"),
+        [
+            (Macro, "//go:build"),
+            (Operator, "("),
+            (Identifier, "linux"),
+            (Operator, "&&"),
+            (Identifier, "amd64"),
+            (Operator, ")"),
+            (Operator, "||"),
+            (Operator, "!"),
+            (Identifier, "windows"),
+        ]
+    );
+    assert_eq!(
+        line("// +build"),
+        [
+            (Macro, "// +build"),
+            (Identifier, "linux"),
+            (Operator, ","),
+            (Identifier, "amd64"),
+            (Operator, "!"),
+            (Identifier, "windows"),
+        ]
+    );
+    assert_eq!(line("//go:generate"), [(Macro, "//go:generate"), (String, "stringer -type=Day")]);
+    assert_eq!(
+        line("//go:embed"),
+        [(Macro, "//go:embed"), (String, "static/*.html"), (String, "\"docs/read me.md\"")]
+    );
+    assert_eq!(
+        line("//go:linkname"),
+        [(Macro, "//go:linkname"), (Identifier, "nanotime"), (Identifier, "runtime.nanotime")]
+    );
+    assert_eq!(line("//go:noinline"), [(Macro, "//go:noinline")]);
+
+    // Only right after the slashes, and only at the start of a line. Being right above a
+    // declaration, the line is part of its doc comment.
+    assert_eq!(line("// go:embed"), [(TokenKind::DocComment, "// go:embed static/*.html")]);
+    assert_eq!(line("var x = 1")[4], (Comment, "//go:noinline"));
+}
+
+#[test]
+fn test_go_struct_tags() {
+    use TokenKind::{Identifier, Keyword, Operator, PropertyName, String, TypeName};
+
+    let text = include_str!("../../../../../syntax-tests/test_syntax.go");
+    let tokens = LexerRegistry::get_lexer(Language::Go).tokenize(text.as_bytes());
+    let line = |prefix| line_tokens(text, &tokens, prefix);
+
+    assert_eq!(
+        line("\tID "),
+        [
+            (Identifier, "ID"),
+            (TypeName, "int"),
+            (String, "`"),
+            (PropertyName, "json"),
+            (Operator, ":"),
+            (String, "\"id"),
+            (Operator, ","),
+            (Keyword, "omitempty"),
+            (String, "\""),
+            (PropertyName, "xml"),
+            (Operator, ":"),
+            (String, "\"id"),
+            (Operator, ","),
+            (Keyword, "attr"),
+            (String, "\""),
+            (String, "`"),
+        ]
+    );
+    assert_eq!(
+        line("\tOwner "),
+        [
+            (Identifier, "Owner"),
+            (TypeName, "string"),
+            (String, "`"),
+            (PropertyName, "json"),
+            (Operator, ":"),
+            (String, "\"owner\""),
+            (PropertyName, "db"),
+            (Operator, ":"),
+            (String, "\"owner_name\""),
+            (String, "`"),
+        ]
+    );
+    // Nested structs have tags, and so do their fields.
+    assert_eq!(
+        line("\t\tNote "),
+        [
+            (Identifier, "Note"),
+            (TypeName, "string"),
+            (String, "`"),
+            (PropertyName, "yaml"),
+            (Operator, ":"),
+            (String, "\""),
+            (Operator, ","),
+            (Keyword, "flow"),
+            (String, "\""),
+            (String, "`"),
+        ]
+    );
+    assert_eq!(
+        line("\t} `"),
+        [
+            (Operator, "}"),
+            (String, "`"),
+            (PropertyName, "json"),
+            (Operator, ":"),
+            (String, "\"nested\""),
+            (String, "`"),
+        ]
+    );
+
+    // A malformed pair ends the tag's pairs, and outside of structs there's no tag.
+    assert_eq!(
+        line("\tBroken "),
+        [
+            (Identifier, "Broken"),
+            (TypeName, "string"),
+            (String, "`"),
+            (PropertyName, "json"),
+            (Operator, ":"),
+            (String, "\"broken\""),
+            (String, "xml:\"name,attr`"),
+        ]
+    );
+    assert_eq!(
+        line("var pattern"),
+        [
+            (Keyword, "var"),
+            (Identifier, "pattern"),
+            (Operator, "="),
+            (String, "`json:\"not,a,tag\"`"),
+        ]
+    );
+}
+
+#[test]
+fn test_go_labels() {
+    use TokenKind::{Identifier, Keyword, Label, Operator, String, TypeName};
+
+    let text = include_str!("../../../../../syntax-tests/test_syntax.go");
+    let tokens = LexerRegistry::get_lexer(Language::Go).tokenize(text.as_bytes());
+    let line = |prefix| line_tokens(text, &tokens, prefix);
+
+    assert_eq!(line("outer:"), [(Label, "outer"), (Operator, ":")]);
+    assert_eq!(line("\t\t\t\tcontinue outer"), [(Keyword, "continue"), (Label, "outer")]);
+    assert_eq!(line("\t\t\tbreak outer"), [(Keyword, "break"), (Label, "outer")]);
+    assert_eq!(line("\t\t\t\tgoto found"), [(Keyword, "goto"), (Label, "found")]);
+    assert_eq!(
+        line("\t\t\tcase StatusOK:"),
+        [(Keyword, "case"), (Identifier, "StatusOK"), (Operator, ":")]
+    );
+
+    // A composite literal right after a label has keys, not labels.
+    assert_eq!(line("found:"), [(Label, "found"), (Operator, ":")]);
+    assert_eq!(
+        line("\tr := Rectangle{"),
+        [
+            (Identifier, "r"),
+            (Operator, ":="),
+            (Identifier, "Rectangle"),
+            (Operator, "{"),
+            (Identifier, "Width"),
+            (Operator, ":"),
+            (Identifier, "w"),
+            (Operator, ","),
+            (Identifier, "Height"),
+            (Operator, ":"),
+            (Identifier, "h"),
+            (Operator, "}"),
+        ]
+    );
+    assert_eq!(
+        line("\tnames := map"),
+        [
+            (Identifier, "names"),
+            (Operator, ":="),
+            (Keyword, "map"),
+            (Operator, "["),
+            (TypeName, "int"),
+            (Operator, "]"),
+            (TypeName, "string"),
+            (Operator, "{"),
+            (Identifier, "StatusOK"),
+            (Operator, ":"),
+            (String, "\"ok\""),
+            (Operator, ","),
+            (Identifier, "MaxSize"),
+            (Operator, ":"),
+            (String, "\"max\""),
+            (Operator, "}"),
+        ]
+    );
+
+    // Blocks and literals nest, and bare blocks are blocks too.
+    let text =
+        "func f() {\n\ts := struct{ A int }{A: 1}\n\t{\n\tbare:\n\t\tx := s.y[lo:hi]\n\t}\n}\n";
+    let tokens = LexerRegistry::get_lexer(Language::Go).tokenize(text.as_bytes());
+    let labels: Vec<_> =
+        tokens.iter().filter(|t| t.kind == Label).map(|t| &text[t.span.clone()]).collect();
+    assert_eq!(labels, ["bare"]);
+}
+
+#[test]
+fn test_go_builtins() {
+    use TokenKind::{FunctionName, Identifier, Keyword, Number, Operator};
+
+    let text = include_str!("../../../../../syntax-tests/test_syntax.go");
+    let tokens = LexerRegistry::get_lexer(Language::Go).tokenize(text.as_bytes());
+    let line = |prefix| line_tokens(text, &tokens, prefix);
+
+    assert_eq!(
+        line("\tlo, hi := min"),
+        [
+            (Identifier, "lo"),
+            (Operator, ","),
+            (Identifier, "hi"),
+            (Operator, ":="),
+            (FunctionName, "min"),
+            (Operator, "("),
+            (Number, "1"),
+            (Operator, ","),
+            (Number, "2"),
+            (Operator, ","),
+            (Number, "3"),
+            (Operator, ")"),
+            (Operator, ","),
+            (FunctionName, "max"),
+            (Operator, "("),
+            (Number, "4.0"),
+            (Operator, ","),
+            (Number, "5"),
+            (Operator, ")"),
+        ]
+    );
+    assert_eq!(
+        line("\tclear(cache)"),
+        [(FunctionName, "clear"), (Operator, "("), (Identifier, "cache"), (Operator, ")")]
+    );
+
+    // Builtins can't be values, so a builtin's name that isn't called is a variable.
+    assert_eq!(
+        line("\tclear := lo"),
+        [
+            (Identifier, "clear"),
+            (Operator, ":="),
+            (Identifier, "lo"),
+            (Operator, "+"),
+            (Identifier, "hi")
+        ]
+    );
+    assert_eq!(line("\tfmt.Println(clear")[4], (Identifier, "clear"));
+    assert_eq!(line("\tfmt.Println(clear")[6], (FunctionName, "len"));
+
+    // Range over an integer and over an iterator function.
+    assert_eq!(
+        line("\tfor i := range 10"),
+        [
+            (Keyword, "for"),
+            (Identifier, "i"),
+            (Operator, ":="),
+            (Keyword, "range"),
+            (Number, "10"),
+            (Operator, "{")
+        ]
+    );
+    assert_eq!(line("\tfor i, v := range All")[6], (Identifier, "All"));
+}
+
+#[test]
+fn test_go_versions() {
+    use TokenKind::{FunctionName, Identifier, TypeName};
+
+    let text = include_str!("../../../../../syntax-tests/test_syntax.go");
+    let kinds = |version| {
+        let (lexer, warning) = LexerRegistry::get_versioned_lexer(Language::Go, version);
+        assert_eq!(warning, None);
+        let tokens = lexer.tokenize(text.as_bytes());
+        let line = |prefix| line_tokens(text, &tokens, prefix);
+        (line("func Map[")[6].0, line("\tlo, hi := min")[4].0, line("\tclear(cache)")[0].0)
+    };
+
+    // `any` came with generics in 1.18 and `min`, `max` and `clear` in 1.21.
+    assert_eq!(kinds("1.17"), (Identifier, Identifier, Identifier));
+    assert_eq!(kinds("1.18"), (TypeName, Identifier, Identifier));
+    assert_eq!(kinds("go1.20"), (TypeName, Identifier, Identifier));
+    assert_eq!(kinds("1.21"), (TypeName, FunctionName, FunctionName));
+    assert_eq!(kinds("1.23.4"), (TypeName, FunctionName, FunctionName));
+
+    assert_eq!(LexerRegistry::versions(Language::Go), ["1.17", "1.18", "1.21"]);
+    assert!(LexerRegistry::versions(Language::Python).is_empty());
+
+    // A version that isn't one gets the latest, with a warning; other languages don't care.
+    let (_, warning) = LexerRegistry::get_versioned_lexer(Language::Go, "banana");
+    assert!(warning.is_some_and(|w| w.contains("'banana'") && w.contains("using 1.21")));
+    let (_, warning) = LexerRegistry::get_versioned_lexer(Language::Python, "3.12");
+    assert_eq!(warning, None);
+}
+
+#[test]
+fn test_go_escapes_and_raw_strings() {
+    use TokenKind::{Char, Escape, Identifier, Number, Operator, String};
+
+    let text = include_str!("../../../../../syntax-tests/test_syntax.go");
+    let mut tokens = LexerRegistry::get_lexer(Language::Go).tokenize(text.as_bytes());
+    split_escapes(Language::Go, text.as_bytes(), &mut tokens);
+    let line = |prefix| line_tokens(text, &tokens, prefix);
+
+    assert_eq!(
+        line("\tfmt.Println(\"tab")[4..],
+        [
+            (String, "\"tab"),
+            (Escape, r"\t"),
+            (String, "newline"),
+            (Escape, r"\n"),
+            (String, "\""),
+            (Operator, ","),
+            (String, "\"quote"),
+            (Escape, r#"\""#),
+            (String, "\""),
+            (Operator, ","),
+            (String, "\""),
+            (Escape, r"\x41"),
+            (Escape, r"\u4e16"),
+            (Escape, r"\U0001F600"),
+            (Escape, r"\377"),
+            (String, "\""),
+            (Operator, ","),
+            (String, "\""),
+            (Escape, r"\q"),
+            (String, " is invalid\""),
+            (Operator, ")"),
+        ]
+    );
+    let invalid: Vec<_> = tokens
+        .iter()
+        .filter(|t| t.kind == Escape && t.payload == Some(TokenPayload::Invalid))
+        .map(|t| &text[t.span.clone()])
+        .collect();
+    assert_eq!(invalid, [r"\q"]);
+    assert_eq!(
+        line("\tfmt.Println('")[4..],
+        [
+            (Char, "'"),
+            (Escape, r"\x41"),
+            (Char, "'"),
+            (Operator, ","),
+            (Char, "'"),
+            (Escape, r"\'"),
+            (Char, "'"),
+            (Operator, ","),
+            (Char, "'世'"),
+            (Operator, ","),
+            (Char, "'"),
+            (Escape, r"\\"),
+            (Char, "'"),
+            (Operator, ")"),
+        ]
+    );
+    // Comment markers and quotes don't end a raw string, which spans lines.
+    let raw = tokens.iter().find(|t| text[t.span.clone()].starts_with("`SELECT")).unwrap();
+    assert_eq!(
+        &text[raw.span.clone()],
+        "`SELECT 1 // not a comment,\n/* nor this */ \"and a quote\"`"
+    );
+
+    // Interpreted strings and runes can't span lines, so unterminated ones end with theirs.
+    let text = "s := \"open\nr := '\\\nn := 1\n";
+    let tokens = LexerRegistry::get_lexer(Language::Go).tokenize(text.as_bytes());
+    let significant: Vec<_> = tokens
+        .iter()
+        .filter(|t| t.kind != TokenKind::Whitespace)
+        .map(|t| (t.kind, &text[t.span.clone()], t.payload == Some(TokenPayload::Invalid)))
+        .collect();
+    assert_eq!(
+        significant,
+        [
+            (Identifier, "s", false),
+            (Operator, ":=", false),
+            (String, "\"open", true),
+            (Identifier, "r", false),
+            (Operator, ":=", false),
+            (Char, r"'\", true),
+            (Identifier, "n", false),
+            (Operator, ":=", false),
+            (Number, "1", false),
+        ]
+    );
+}
+
+#[test]
+fn test_go_numbers() {
+    use TokenKind::{Identifier, Number, Operator};
+
+    let text = include_str!("../../../../../syntax-tests/test_syntax.go");
+    let tokens = LexerRegistry::get_lexer(Language::Go).tokenize(text.as_bytes());
+    let line = |prefix| line_tokens(text, &tokens, prefix);
+    assert_eq!(line("\thalf, whole")[4..], [(Number, ".5"), (Operator, ","), (Number, "1.")]);
+    assert_eq!(line("\tseparated :=")[2], (Number, "1_000.000_1e1_0"));
+    assert_eq!(line("\thexFloat :=")[2], (Number, "0x1.fp-2"));
+    assert_eq!(line("\thexImag :=")[2], (Number, "0x1p2i"));
+    assert_eq!(line("\tbinaryImag :=")[2], (Number, "0b101i"));
+    assert_eq!(line("\thexSeparated :=")[2], (Number, "0x_FF_FF"));
+
+    // A number ends where Go's scanner ends it, even right before a letter, and takes
+    // all digits and underscores along, so that misplaced ones make it malformed.
+    let text =
+        "0x1p2if 12abc 0xABCDEFg 089i 089.5 0_7 0x 0b102 1__0 1_ 089 1e 0x1.f 0o1.5 0b1e1 0x1e";
+    let tokens = LexerRegistry::get_lexer(Language::Go).tokenize(text.as_bytes());
+    let numbers: Vec<_> = tokens
+        .iter()
+        .filter(|t| t.kind != TokenKind::Whitespace)
+        .map(|t| (t.kind, &text[t.span.clone()], t.payload == Some(TokenPayload::Invalid)))
+        .collect();
+    assert_eq!(
+        numbers,
+        [
+            (Number, "0x1p2i", false),
+            (Identifier, "f", false),
+            (Number, "12", false),
+            (Identifier, "abc", false),
+            (Number, "0xABCDEF", false),
+            (Identifier, "g", false),
+            (Number, "089i", false),
+            (Number, "089.5", false),
+            (Number, "0_7", false),
+            (Number, "0x", true),
+            (Number, "0b102", true),
+            (Number, "1__0", true),
+            (Number, "1_", true),
+            (Number, "089", true),
+            (Number, "1e", true),
+            (Number, "0x1.f", true),
+            (Number, "0o1.5", true),
+            (Number, "0b1e1", true),
+            (Number, "0x1e", false),
+        ]
+    );
+}
+
+#[test]
+fn test_go_shadowed_builtins() {
+    use TokenKind::{FunctionName, Identifier, Keyword, Number, Operator, TypeName};
+
+    let text = include_str!("../../../../../syntax-tests/test_syntax.go");
+    let tokens = LexerRegistry::get_lexer(Language::Go).tokenize(text.as_bytes());
+    let line = |prefix| line_tokens(text, &tokens, prefix);
+
+    // Parameters shadow from the body on, so the signature still uses the types.
+    assert_eq!(
+        line("func shadowing(")[2..],
+        [
+            (Operator, "("),
+            (Identifier, "string"),
+            (TypeName, "string"),
+            (Operator, ","),
+            (Identifier, "buf"),
+            (Operator, "["),
+            (Operator, "]"),
+            (TypeName, "byte"),
+            (Operator, ")"),
+            (Operator, "("),
+            (Identifier, "error"),
+            (TypeName, "error"),
+            (Operator, ")"),
+            (Operator, "{"),
+        ]
+    );
+    // A variable shadows from the end of its declaration on.
+    assert_eq!(
+        line("\tlen := len(buf)"),
+        [
+            (Identifier, "len"),
+            (Operator, ":="),
+            (FunctionName, "len"),
+            (Operator, "("),
+            (Identifier, "buf"),
+            (Operator, ")"),
+        ]
+    );
+    assert_eq!(line("\tlen = 6"), [(Identifier, "len"), (Operator, "="), (Number, "6")]);
+    assert_eq!(line("\tvar new =")[..2], [(Keyword, "var"), (Identifier, "new")]);
+    assert_eq!(line("\tvar new =")[9], (Identifier, "len"));
+    let uses = line("\tfmt.Println(string, new(), error)");
+    assert_eq!(
+        [uses[4], uses[6], uses[10]],
+        [(Identifier, "string"), (Identifier, "new"), (Identifier, "error")]
+    );
+
+    // Elsewhere, they're still predeclared.
+    assert_eq!(line("\tlength := len(slice)")[2], (FunctionName, "len"));
+    assert_eq!(line("\tscores := make(map[string]int)")[6], (TypeName, "string"));
+
+    // Only declarations and assignments shadow, not types in other places.
+    let text = "var x string = s\nfunc f(string, int) {}\nfunc g(len, cap int) { _ = len(s) }\ntype F func(new int)\nfunc h() { new(T) }\n";
+    let tokens = LexerRegistry::get_lexer(Language::Go).tokenize(text.as_bytes());
+    let kinds: Vec<_> = tokens
+        .iter()
+        .filter(|t| matches!(&text[t.span.clone()], "string" | "int" | "len" | "cap" | "new"))
+        .map(|t| (t.kind, &text[t.span.clone()]))
+        .collect();
+    assert_eq!(
+        kinds,
+        [
+            (TypeName, "string"),
+            (TypeName, "string"),
+            (TypeName, "int"),
+            (Identifier, "len"),
+            (Identifier, "cap"),
+            (TypeName, "int"),
+            (Identifier, "len"),
+            (Identifier, "new"),
+            (TypeName, "int"),
+            (FunctionName, "new"),
+        ]
+    );
+}
+
+#[test]
+fn test_go_keywords_in_names() {
+    let text = include_str!("../../../../../syntax-tests/test_syntax.go");
+    let tokens = LexerRegistry::get_lexer(Language::Go).tokenize(text.as_bytes());
+    let start = text.find("var (\n\tformat").unwrap();
+    let end = start + text[start..].find("\n)").unwrap();
+    let names: Vec<_> = tokens
+        .iter()
+        .filter(|t| t.span.start > start + 3 && t.span.end <= end)
+        .filter(|t| !matches!(&text[t.span.clone()], "(" | "," | "int") && !t.kind.is_trivia())
+        .map(|t| (t.kind, &text[t.span.clone()]))
+        .collect();
+
+    // Every Go keyword shows up in one of the names, and none of them are split.
+    let expected = [
+        "format",
+        "iface",
+        "deferredWork",
+        "gopher",
+        "rangefinder",
+        "selectAll",
+        "breakpoint",
+        "caseless",
+        "chanValue",
+        "constant",
+        "continued",
+        "defaulted",
+        "elsewhere",
+        "fallthroughs",
+        "forward",
+        "funcs",
+        "gotoEnd",
+        "ifaces",
+        "imports",
+        "packaged",
+        "interfaces",
+        "mapping",
+        "returned",
+        "structure",
+        "switchboard",
+        "typeName",
+        "variable",
+        "outerFor",
+        "isGo",
+        "selectedCase",
+        "hasDefault",
+        "myRangeEnd",
+        "lastReturn",
+        "userType",
+        "noElse",
+        "anyStructs",
+    ];
+    assert_eq!(names, expected.map(|name| (TokenKind::Identifier, name)));
+}
+
+/// An error only affects the construct it's in, and the lines after it are lexed as if
+/// it weren't there.
+#[test]
+fn test_go_error_recovery() {
+    use TokenKind::{Char, DocComment, Identifier, Keyword, Number, Operator, String};
+    let text = include_str!("../../../../../syntax-tests-invalid/test_recovery.go");
+    let tokens = LexerRegistry::get_lexer(Language::Go).tokenize(text.as_bytes());
+
+    let invalid: Vec<_> = tokens
+        .iter()
+        .filter(|t| t.payload == Some(TokenPayload::Invalid))
+        .map(|t| (t.kind, &text[t.span.clone()]))
+        .collect();
+    assert_eq!(
+        invalid,
+        [
+            (String, "\"hello, world"),
+            (Char, "'ab'"),
+            (DocComment, "/* TODO: explain what the helper is for"),
+        ]
+    );
+
+    let line = |prefix| line_tokens(text, &tokens, prefix);
+    assert_eq!(
+        line("var count"),
+        [(Keyword, "var"), (Identifier, "count"), (Operator, "="), (Number, "42")]
+    );
+    assert_eq!(line("var single")[5..], [(Char, "'a'"), (Operator, ","), (Char, "'\\n'")]);
+    assert_eq!(line("func helper")[..2], [(Keyword, "func"), (Identifier, "helper")]);
+    assert_eq!(
+        line("\treturn"),
+        [(Keyword, "return"), (Identifier, "count"), (Operator, "*"), (Number, "2")]
+    );
+}
+
+/// Nesting past [`MAX_NESTING_DEPTH`] is only counted, and the code after it is lexed
+/// like it would be on its own.
+#[test]
+fn test_go_deep_nesting() {
+    let after = "\nfunc main() {\n\tif len := 1; len > 0 {\n\t\tprintln(len)\n\t}\n\tx := []int{len(s)}\n}\n";
+    let lexer = LexerRegistry::get_lexer(Language::Go);
+    let expected = lexer.tokenize(after.as_bytes());
+
+    // Slices of maps of funcs, each three braces deeper than the one around it.
+    let level = "[]map[string]func() any{{\"k\": func() any { return ";
+    let levels = MAX_NESTING_DEPTH;
+    let nested = format!("var v = {}nil{}\n{after}", level.repeat(levels), " }}}".repeat(levels));
+    let tokens = lexer.tokenize(nested.as_bytes());
+    for prefix in ["func main", "\tif len", "\t\tprintln", "\tx :="] {
+        assert_eq!(
+            line_tokens(&nested, &tokens, prefix),
+            line_tokens(after, &expected, prefix),
+            "{prefix}"
+        );
+    }
+    // The innermost levels are past the limit, but their words are highlighted all the same.
+    let string = tokens.iter().rposition(|t| &nested[t.span.clone()] == "string").unwrap();
+    assert_eq!(tokens[string].kind, TokenKind::TypeName);
+    assert_eq!(tokens[string - 2].kind, TokenKind::Keyword);
+
+    // Lots of brackets, which take no more than the limit to keep track of.
+    for (open, close) in [("{", "}"), ("(", ")"), ("[", "]")] {
+        let nested = format!("{}{}\n{after}", open.repeat(100_000), close.repeat(100_000));
+        let tokens = lexer.tokenize(nested.as_bytes());
+        assert_eq!(
+            line_tokens(&nested, &tokens, "\tif len"),
+            line_tokens(after, &expected, "\tif len"),
+            "{open}"
+        );
+    }
+}
+
+/// A lower [`HighlightOptions::max_nesting_depth`] loses the levels past it sooner, and the
+/// code after them is lexed like it would be on its own all the same.
+#[test]
+fn test_go_nesting_limit() {
+    use crate::syntax::Container::*;
+
+    let text = "func main() {\n\tif ok {\n\t\tfor x {\n\t\t\tv := T{1}\n\t\t}\n\t}\n}\n\nfunc f() {\n\tif ok {\n\t\tg()\n\t}\n}\n";
+    let highlight = |max_nesting_depth| {
+        let mut highlighter = SyntaxHighlighter::new(Language::Go, Theme::default());
+        highlighter.set_options(HighlightOptions { max_nesting_depth, ..Default::default() });
+        highlighter.update(text.as_bytes(), true);
+        highlighter.tokens().to_vec()
+    };
+    let scopes = |tokens: &[Token], needle: &str| {
+        let start = text.find(needle).unwrap_or_else(|| panic!("{needle:?} not found"));
+        let token = tokens.iter().find(|t| t.span.start == start).unwrap();
+        token.scopes.iter().collect::<Vec<_>>()
+    };
+
+    let deep = highlight(None);
+    let shallow = highlight(Some(2));
+    assert_eq!(scopes(&deep, "v :="), [FunctionBody, Block, Block]);
+    // The `for` block is the third level, so it's only counted.
+    assert_eq!(scopes(&shallow, "for x"), [FunctionBody, Block]);
+    assert_eq!(scopes(&shallow, "v :="), [FunctionBody, Block]);
+    assert_eq!(line_tokens(text, &shallow, "\t\t\tv :="), line_tokens(text, &deep, "\t\t\tv :="));
+    // Once the depth drops below the limit, the levels are kept track of again.
+    assert_eq!(scopes(&shallow, "g()"), [FunctionBody, Block]);
+    let after = text.find("func f").unwrap();
+    let from = |tokens: &[Token]| tokens.iter().position(|t| t.span.start == after).unwrap();
+    assert_eq!(shallow[from(&shallow)..], deep[from(&deep)..]);
+}
+
+/// [`HighlightOptions::unterminated_comment_lines`] sets how far a `/*` that's never closed
+/// reaches, in every lexer with such comments, and the lines after it are lexed as usual.
+#[test]
+fn test_unterminated_comment_lines() {
+    let rest = "int x = 1;\nint y = 2;\nint z = 3;\n";
+    let text = format!("/* never closed\n{rest}");
+    let highlight = |language, text: &str, unterminated_comment_lines| {
+        let mut highlighter = SyntaxHighlighter::new(language, Theme::default());
+        highlighter
+            .set_options(HighlightOptions { unterminated_comment_lines, ..Default::default() });
+        highlighter.update(text.as_bytes(), true);
+        highlighter.tokens().to_vec()
+    };
+    let comment = |tokens: &[Token]| {
+        assert_eq!(tokens[0].kind, TokenKind::Comment);
+        assert_eq!(tokens[0].payload, Some(TokenPayload::Invalid));
+        &text[tokens[0].span.clone()]
+    };
+
+    for language in [Language::C, Language::Go, Language::Java, Language::JavaScript, Language::Sql]
+    {
+        assert_eq!(comment(&highlight(language, &text, None)), "/* never closed", "{language:?}");
+        let tokens = highlight(language, &text, Some(3));
+        assert_eq!(comment(&tokens), "/* never closed\nint x = 1;\nint y = 2;", "{language:?}");
+        let expected = highlight(language, rest, None);
+        assert_eq!(
+            line_tokens(&text, &tokens, "int z"),
+            line_tokens(rest, &expected, "int z"),
+            "{language:?}"
+        );
+        assert_eq!(comment(&highlight(language, &text, Some(0))), "/*", "{language:?}");
+    }
+}
+
+#[test]
+fn test_go_scopes() {
+    use crate::syntax::Container::*;
+
+    let text = "type Pair[K comparable] struct {\n\tKey K `json:\"key\"`\n\tNested struct{ X int }\n}\n\ntype Shape interface {\n\tArea() float64\n}\n\nfunc (p *Pair[K]) Get(key K) (v int, ok bool) {\n\tif ok {\n\t\tgo func(n int) {}(1)\n\t}\n\treturn Point{X: 1}.X, true\n}\n\nvar f func(a int) error\nvar g = func() {}\n";
+    let tokens = LexerRegistry::get_lexer(Language::Go).tokenize(text.as_bytes());
+    // The containers of the first token at `needle`.
+    let scopes = |needle: &str| {
+        let start = text.find(needle).unwrap_or_else(|| panic!("{needle:?} not found"));
+        let token = tokens.iter().find(|t| t.span.start == start).unwrap();
+        token.scopes.iter().collect::<Vec<_>>()
+    };
+
+    assert_eq!(scopes("type Pair"), []);
+    assert_eq!(scopes("[K comparable]"), [TypeParameters]);
+    assert_eq!(scopes("] struct"), [TypeParameters]);
+    assert_eq!(scopes("{\n\tKey"), [StructBody]);
+    assert_eq!(scopes("`json"), [StructBody, StructTag]);
+    assert_eq!(scopes("\"key\""), [StructBody, StructTag]);
+    assert_eq!(scopes("X int"), [StructBody, StructBody]);
+    assert_eq!(scopes("}\n\ntype Shape"), [StructBody]);
+    assert_eq!(scopes("Area"), [InterfaceBody]);
+    assert_eq!(scopes("(p *Pair"), [Receiver]);
+    assert_eq!(scopes("K]) Get"), [Receiver, TypeParameters]);
+    assert_eq!(scopes("Get"), []);
+    assert_eq!(scopes("key K)"), [Parameters]);
+    assert_eq!(scopes("v int"), [Results]);
+    assert_eq!(scopes("{\n\tif"), [FunctionBody]);
+    assert_eq!(scopes("if ok"), [FunctionBody]);
+    assert_eq!(scopes("go func"), [FunctionBody, Block]);
+    assert_eq!(scopes("n int"), [FunctionBody, Block, Parameters]);
+    assert_eq!(scopes("{}(1)"), [FunctionBody, Block, FunctionBody]);
+    assert_eq!(scopes("(1)"), [FunctionBody, Block]);
+    // Composite literals aren't containers.
+    assert_eq!(scopes("X: 1"), [FunctionBody]);
+    assert_eq!(scopes("}\n\nvar f"), [FunctionBody]);
+    // A function type has parameters, but no body.
+    assert_eq!(scopes("a int"), [Parameters]);
+    assert_eq!(scopes("error"), []);
+    assert_eq!(scopes("{}\n"), [FunctionBody]);
+
+    // The stack only records the outermost containers, but leaves them all again.
+    let nested =
+        format!("func f() {{\n{}{}}}\nvar x int\n", "if x {\n".repeat(20), "}\n".repeat(20));
+    let tokens = LexerRegistry::get_lexer(Language::Go).tokenize(nested.as_bytes());
+    let depths: Vec<usize> = tokens.iter().map(|t| t.scopes.len()).collect();
+    assert_eq!(depths.iter().max(), Some(&ScopeStack::MAX_DEPTH));
+    let var = nested.find("var").unwrap();
+    assert!(tokens.iter().filter(|t| t.span.start >= var).all(|t| t.scopes.is_empty()));
+}
+
+#[test]
+fn test_unterminated_block_comments() {
+    let text = b"/* open\n1\n";
+    let languages = [
+        Language::C,
+        Language::Cpp,
+        Language::CSharp,
+        Language::Css,
+        Language::Go,
+        Language::Java,
+        Language::JavaScript,
+        Language::Json,
+        Language::Sql,
+    ];
+    for language in languages {
+        let tokens = LexerRegistry::get_lexer(language).tokenize(text);
+        assert_eq!(tokens[0].span, 0..7, "{language:?}");
+        assert_eq!(tokens[0].payload, Some(TokenPayload::Invalid), "{language:?}");
+        let one = tokens.iter().find(|t| t.span.start == 8).unwrap();
+        assert!(!one.kind.is_comment(), "{language:?}: {one:?}");
+    }
+}
+
+/// The tokens other than whitespace, with their text as if its lines ended at `\n`.
+fn lf_tokens(text: &[u8], tokens: &[Token]) -> Vec<(TokenKind, Option<TokenPayload>, String)> {
+    let lf = |s: &[u8]| String::from_utf8_lossy(s).replace("\r\n", "\n").replace('\r', "\n");
+    tokens
+        .iter()
+        .filter(|t| t.kind != TokenKind::Whitespace)
+        .map(|t| (t.kind, t.payload, lf(&text[t.span.clone()])))
+        .collect()
+}
+
+#[test]
+fn test_line_endings() {
+    let go = "package main\n\n// Greet says hi.\nfunc Greet(name string) string {\n\ts := `raw\nstring`\n\treturn \"hi \" + name // trailing\n}\n\nvar open = \"unterminated\n/* open";
+    let mut files = vec![("small.go".to_string(), Language::Go, go.as_bytes().to_vec())];
+    files.extend(fixtures_in(concat!(env!("CARGO_MANIFEST_DIR"), "/../../syntax-tests")));
+    // Plain text is a single token, line endings and all.
+    for (name, language, text) in
+        files.into_iter().filter(|&(_, language, _)| language != Language::PlainText)
+    {
+        let lexer = LexerRegistry::get_lexer(language);
+        let expected = lf_tokens(&text, &lexer.tokenize(&text));
+        let lines: Vec<&[u8]> = text.split(|&b| b == b'\n').collect();
+        // The file with `\r\n`, lone `\r`, and all three in turn.
+        let variants: [(&str, [&[u8]; 3]); 3] = [
+            ("CRLF", [b"\r\n", b"\r\n", b"\r\n"]),
+            ("CR", [b"\r", b"\r", b"\r"]),
+            ("mixed", [b"\r\n", b"\n", b"\r"]),
+        ];
+        for (variant, endings) in variants {
+            let mut text = lines[0].to_vec();
+            for (i, line) in lines.iter().enumerate().skip(1) {
+                text.extend_from_slice(endings[i % 3]);
+                text.extend_from_slice(line);
+            }
+            let tokens = lexer.tokenize(&text);
+            assert_lossless(&format!("{name} with {variant}"), &text, &tokens);
+            for t in tokens.iter().filter(|t| t.kind != TokenKind::Whitespace) {
+                assert!(
+                    !text[..t.span.end].ends_with(b"\r"),
+                    "{name} with {variant}: {t:?} ends with \\r"
+                );
+            }
+            assert_eq!(lf_tokens(&text, &tokens), expected, "{name} with {variant}");
+        }
+    }
+}
+
+#[test]
+fn test_byte_order_mark() {
+    // The byte order mark is a token of its own, and the rest lexes as without it.
+    for language in Language::ALL.iter().copied().filter(|&l| l != Language::PlainText) {
+        let lexer = LexerRegistry::get_lexer(language);
+        let text = b"package main\n";
+        let tokens = lexer.tokenize(&[b"\xEF\xBB\xBF", &text[..]].concat());
+        let bom = Token::new(TokenKind::Whitespace, 0..3).with_payload(TokenPayload::ByteOrderMark);
+        assert_eq!(tokens[0], bom, "{language:?}");
+        let rest: Vec<_> =
+            tokens[1..].iter().map(|t| (t.kind, t.span.start - 3..t.span.end - 3)).collect();
+        let expected: Vec<_> = lexer.tokenize(text).into_iter().map(|t| (t.kind, t.span)).collect();
+        assert_eq!(rest, expected, "{language:?}");
+    }
+}
+
+#[test]
+fn test_invalid_utf8() {
+    // Bytes that aren't characters are errors of one byte each, except in comments and strings.
+    let lexer = LexerRegistry::get_lexer(Language::Go);
+    let check = |text: &[u8], expected: &[(TokenKind, &[u8])]| {
+        let tokens = lexer.tokenize(text);
+        let actual: Vec<_> = tokens
+            .iter()
+            .filter(|t| t.kind != TokenKind::Whitespace && t.kind != TokenKind::Number)
+            .map(|t| (t.kind, token_text(text, t)))
+            .collect();
+        assert_eq!(actual, expected, "{:?}", String::from_utf8_lossy(text));
+    };
+    check(
+        b"caf\xE9 := 1",
+        &[
+            (TokenKind::Identifier, b"caf"),
+            (TokenKind::Error, b"\xE9"),
+            (TokenKind::Operator, b":="),
+        ],
+    );
+    check(
+        b"x \xFF\xFE y",
+        &[
+            (TokenKind::Identifier, b"x"),
+            (TokenKind::Error, b"\xFF"),
+            (TokenKind::Error, b"\xFE"),
+            (TokenKind::Identifier, b"y"),
+        ],
+    );
+    check(b"// caf\xE9\nx", &[(TokenKind::Comment, b"// caf\xE9"), (TokenKind::Identifier, b"x")]);
+    check(
+        b"s := \"\xE2\x82",
+        &[
+            (TokenKind::Identifier, b"s"),
+            (TokenKind::Operator, b":="),
+            (TokenKind::String, b"\"\xE2\x82"),
+        ],
+    );
+
+    // Every lexer makes progress through invalid UTF-8, including a character cut off at the end.
+    for language in Language::ALL.iter().copied() {
+        for text in
+            [&b"\xE2\x82"[..], b"a \xC3", b"\x80\x80 b", b"x = \"\xF0\x9F\x98", b"<a \xE9>\xE9</a>"]
+        {
+            let tokens = LexerRegistry::get_lexer(language).tokenize(text);
+            assert_lossless(&format!("{language:?}: {text:?}"), text, &tokens);
+            assert!(
+                tokens.iter().all(|t| !t.span.is_empty()),
+                "{language:?}: {text:?}: {tokens:?}"
+            );
+        }
+    }
+}
+
+#[test]
+fn test_go_doc_comments() {
+    use TokenKind::{Comment, DocComment};
+
+    let text = include_str!("../../../../../syntax-tests/test_syntax.go");
+    let tokens = LexerRegistry::get_lexer(Language::Go).tokenize(text.as_bytes());
+    let line = |prefix| line_tokens(text, &tokens, prefix);
+    let markup = |markup| {
+        tokens
+            .iter()
+            .filter(|t| t.payload == Some(TokenPayload::DocMarkup(markup)))
+            .map(|t| &text[t.span.clone()])
+            .collect::<Vec<_>>()
+    };
+
+    // Comments right above top-level declarations document them, even with a directive
+    // in between, but neither comments separated by a blank line nor those in bodies do.
+    assert_eq!(line("// Ledger keeps")[0], (DocComment, "// Ledger keeps the entries of an "));
+    assert_eq!(line("// Close closes"), [(DocComment, "// Close closes the ledger.")]);
+    assert_eq!(line("// Testing Go")[0].0, Comment);
+    assert_eq!(
+        line("\t// An ordinary"),
+        [(Comment, "// An ordinary comment, where [Account] and")]
+    );
+    assert_eq!(line("\t//\tindented"), [(Comment, "//\tindented lines are no markup")]);
+
+    assert_eq!(
+        markup(DocMarkup::Link),
+        [
+            "[Account]",
+            "[fmt.Sprintf]",
+            "[*strings.Builder]",
+            "[the package docs]",
+            "[Ledger.Close]",
+            "[the package docs]",
+            "[Account]",
+        ]
+    );
+    assert_eq!(markup(DocMarkup::Heading), ["# Usage"]);
+    // Code blocks keep their indentation, but lists aren't code.
+    assert_eq!(markup(DocMarkup::Code), ["\tledger := Ledger{}", "\tdefer ledger.Close()"]);
+    assert_eq!(markup(DocMarkup::Deprecated), ["Deprecated:"]);
+    assert_eq!(
+        line("// Deprecated:"),
+        [
+            (DocComment, "// "),
+            (DocComment, "Deprecated:"),
+            (DocComment, " Ledgers no longer need closing, use an "),
+            (DocComment, "[Account]"),
+            (DocComment, " instead."),
+        ]
+    );
+
+    // Brackets touching a word are an index, and lone names must be exported.
+    let text = "// Get returns s[i], not [i], see [Set] and [Map.Get].\nfunc Get() {}\n";
+    let tokens = LexerRegistry::get_lexer(Language::Go).tokenize(text.as_bytes());
+    let links: Vec<_> = tokens
+        .iter()
+        .filter(|t| t.payload == Some(TokenPayload::DocMarkup(DocMarkup::Link)))
+        .map(|t| &text[t.span.clone()])
+        .collect();
+    assert_eq!(links, ["[Set]", "[Map.Get]"]);
+}
+
+#[test]
+fn test_go_cgo_preamble() {
+    use TokenKind::{Comment, Identifier, Keyword, Macro, Operator, PropertyName, String};
+
+    // A run of line comments works like a block comment, with the slashes as comments.
+    let text = "package main\n\n// #cgo LDFLAGS: -lm\n// #include <math.h>\n// int twice(int x);\nimport \"C\"\n";
+    let tokens = LexerRegistry::get_lexer(Language::Go).tokenize(text.as_bytes());
+    let line = |prefix| line_tokens(text, &tokens, prefix);
+    assert_eq!(
+        line("// #cgo"),
+        [
+            (Comment, "//"),
+            (Macro, "#cgo"),
+            (PropertyName, "LDFLAGS"),
+            (Operator, ":"),
+            (String, "-lm")
+        ]
+    );
+    assert_eq!(line("// #include"), [(Comment, "//"), (Macro, "#include"), (String, "<math.h>")]);
+    assert_eq!(line("// int")[..3], [(Comment, "//"), (Keyword, "int"), (Identifier, "twice")]);
+
+    // It has to be right above `import "C"`, and the run of comments has to start its lines.
+    for text in [
+        "// #include <math.h>\n\nimport \"C\"\n",
+        "/* #include <math.h> */\nimport \"fmt\"\n",
+        "x := 1 // #include <math.h>\nimport \"C\"\n",
+    ] {
+        let tokens = LexerRegistry::get_lexer(Language::Go).tokenize(text.as_bytes());
+        assert!(!tokens.iter().any(|t| t.kind == Macro), "{text:?}");
+    }
+}
+
+#[test]
+fn test_embedded_region_line_prefix() {
+    let text = b"// int x;\n// return x;\n";
+    let mut tokens = Vec::new();
+    let end = EmbeddedRegion::new(Language::C, 2, RegionEnd::At(text.len()))
+        .line_prefix(b"//", TokenKind::Comment)
+        .tokenize(text, &mut tokens);
+
+    assert_eq!(end, text.len());
+    assert_ordered(&tokens, text.len());
+    assert_eq!(tokens.last().map(|t| t.span.end), Some(text.len()));
+    let prefixes: Vec<_> =
+        tokens.iter().filter(|t| t.kind == TokenKind::Comment).map(|t| t.span.clone()).collect();
+    assert_eq!(prefixes, vec![10..12]);
+    let keywords: Vec<_> = tokens
+        .iter()
+        .filter(|t| t.kind == TokenKind::Keyword)
+        .map(|t| token_text(text, t))
+        .collect();
+    assert_eq!(keywords, vec![&b"int"[..], &b"return"[..]]);
+}
+
+#[test]
+fn test_embedded_region_interpolation() {
+    let text = b"let a = {{ .Value }};";
+    let mut tokens = Vec::new();
+    let mut interpolations = Vec::new();
+    EmbeddedRegion::new(Language::JavaScript, 0, RegionEnd::At(text.len()))
+        .interpolation(b"{{", b"}}")
+        .tokenize_with(text, &mut tokens, |range, tokens| {
+            interpolations.push(range.clone());
+            tokens.push(Token::new(TokenKind::Macro, range));
+        });
+
+    assert_eq!(interpolations, vec![8..20]);
+    assert_ordered(&tokens, text.len());
+    assert!(tokens.iter().any(|t| t.kind == TokenKind::KeywordStorage && t.span == (0..3)));
+    // The inner lexer never saw the braces, so they can't show up as delimiters.
+    assert!(!tokens.iter().any(|t| t.kind == TokenKind::Delimiter));
+}
+
+#[test]
+fn test_go_template() {
+    use TokenKind::{
+        Error, FunctionName, KeywordControl, Number, Operator, PropertyName, Punctuation, String,
+        VariableName,
+    };
+
+    let text = "<a href=\"/u/{{$u.ID}}\">{{- .Name | printf \"%q}}\" -}}</a>{{-3}}\n";
+    let tokens = LexerRegistry::get_lexer(Language::GoTemplate).tokenize(text.as_bytes());
+    assert_lossless(text, text.as_bytes(), &tokens);
+    let actual: Vec<_> = tokens
+        .iter()
+        .filter(|t| t.kind != TokenKind::Whitespace)
+        .map(|t| (t.kind, &text[t.span.clone()]))
+        .collect();
+    assert_eq!(
+        &actual[4..],
+        [
+            // The action splits the attribute value, which the HTML lexer saw as `"/u/"`.
+            (String, "\"/u/"),
+            (Punctuation, "{{"),
+            (VariableName, "$u"),
+            (PropertyName, ".ID"),
+            (Punctuation, "}}"),
+            (String, "\""),
+            (Operator, ">"),
+            // A `}}` in a string doesn't end the action, and `-` trims only when set apart.
+            (Punctuation, "{{-"),
+            (PropertyName, ".Name"),
+            (Operator, "|"),
+            (FunctionName, "printf"),
+            (String, "\"%q}}\""),
+            (Punctuation, "-}}"),
+            (Operator, "</"),
+            (TokenKind::Keyword, "a"),
+            (Operator, ">"),
+            (Punctuation, "{{"),
+            (Number, "-3"),
+            (Punctuation, "}}"),
+        ]
+    );
+
+    // An action without a `}}` before the next `{{` ends with its line.
+    let text = "{{if .X\n<p>{{end}}</p>\n";
+    let tokens = LexerRegistry::get_lexer(Language::GoTemplate).tokenize(text.as_bytes());
+    let open: Vec<_> = tokens
+        .iter()
+        .filter(|t| t.kind == Punctuation)
+        .map(|t| (&text[t.span.clone()], t.payload))
+        .collect();
+    assert_eq!(open, [("{{", Some(TokenPayload::Invalid)), ("{{", None), ("}}", None)]);
+    assert!(tokens.iter().any(|t| t.kind == KeywordControl && &text[t.span.clone()] == "end"));
+    assert!(!tokens.iter().any(|t| t.kind == Error));
+}
+
+#[test]
+fn test_embedded_region_depth_limit() {
+    // Markdown nested in Markdown, with each level using a shorter fence.
+    fn nested(levels: usize) -> Vec<u8> {
+        let mut text = Vec::new();
+        for i in 0..levels {
+            text.extend_from_slice(&b"`".repeat(3 + levels - i));
+            text.extend_from_slice(b"markdown\n");
+        }
+        text.extend_from_slice(b"**deep**\n");
+        for i in (0..levels).rev() {
+            text.extend_from_slice(&b"`".repeat(3 + levels - i));
+            text.push(b'\n');
+        }
+        text
+    }
+
+    let text = nested(MAX_EMBED_DEPTH);
+    let tokens = LexerRegistry::get_lexer(Language::Markdown).tokenize(&text);
+    assert_ordered(&tokens, text.len());
+    assert!(tokens.iter().any(|t| t.kind == TokenKind::MarkdownBold));
+
+    let text = nested(MAX_EMBED_DEPTH + 1);
+    let tokens = LexerRegistry::get_lexer(Language::Markdown).tokenize(&text);
+    assert_ordered(&tokens, text.len());
+    assert!(!tokens.iter().any(|t| t.kind == TokenKind::MarkdownBold));
+}
+
+#[test]
+fn test_interpolation_depth_limit() {
+    // Template literals in the interpolations of template literals, and f-strings in f-strings.
+    fn nested(levels: usize, open: &str, close: &str) -> String {
+        format!("x = {}deep{}\ny = 1\n", open.repeat(levels), close.repeat(levels))
+    }
+    fn interpolations(language: Language, text: &str) -> Vec<(&str, Option<TokenPayload>)> {
+        let tokens = LexerRegistry::get_lexer(language).tokenize(text.as_bytes());
+        assert_lossless(text, text.as_bytes(), &tokens);
+        assert!(
+            tokens.iter().any(|t| t.kind == TokenKind::Identifier && &text[t.span.clone()] == "y"),
+            "{text}"
+        );
+        tokens
+            .iter()
+            .filter(|t| t.kind == TokenKind::Interpolation)
+            .map(|t| (&text[t.span.clone()], t.payload))
+            .collect()
+    }
+
+    for (language, open, opener, close) in
+        [(Language::JavaScript, "`${", "${", "}`"), (Language::Python, "f'{", "{", "}'")]
+    {
+        let text = nested(MAX_INTERPOLATION_DEPTH, open, close);
+        let expected: Vec<_> = [(opener, None)]
+            .repeat(MAX_INTERPOLATION_DEPTH)
+            .into_iter()
+            .chain([("}", None)].repeat(MAX_INTERPOLATION_DEPTH))
+            .collect();
+        assert_eq!(interpolations(language, &text), expected, "{language:?}");
+
+        // The innermost string is past the limit, so its opener is text.
+        let text = nested(MAX_INTERPOLATION_DEPTH + 1, open, close);
+        let found = interpolations(language, &text);
+        assert_eq!(found.len(), 2 * MAX_INTERPOLATION_DEPTH, "{language:?}");
+        assert!(found.iter().all(|(_, payload)| payload.is_none()), "{language:?}");
+    }
+
+    // An interpolation that isn't closed flags its opener; f-strings end with their line.
+    let text = "a = f\"{b\"\nc = f\"{d}\"\ny = 1\n";
+    assert_eq!(
+        interpolations(Language::Python, text),
+        [("{", Some(TokenPayload::Invalid)), ("{", None), ("}", None)]
+    );
+    // Escaped openers are text, like a `}` in a string in the expression.
+    let text = "a = `\\${b} ${ \"}\" }`\ny = 1\n";
+    assert_eq!(interpolations(Language::JavaScript, text), [("${", None), ("}", None)]);
+}
+
+#[test]
+fn test_shell_heredocs() {
+    use TokenKind::{FunctionName, Number, Operator, Punctuation, String, VariableName};
+
+    fn lex(text: &str) -> Vec<(TokenKind, &str, Option<TokenPayload>)> {
+        let tokens = LexerRegistry::get_lexer(Language::Shell).tokenize(text.as_bytes());
+        assert_lossless(text, text.as_bytes(), &tokens);
+        tokens
+            .iter()
+            .filter(|t| t.kind != TokenKind::Whitespace)
+            .map(|t| (t.kind, &text[t.span.clone()], t.payload))
+            .collect()
+    }
+
+    // Stacked heredocs, with `\r\n` line endings, the second one quoted and stripping tabs.
+    assert_eq!(
+        lex("cat <<A <<-'B'\r\n$x A\r\nA\r\n$y\r\n\tB\r\necho\r\n"),
+        [
+            (FunctionName, "cat", None),
+            (Operator, "<<", None),
+            (Punctuation, "A", None),
+            (Operator, "<<-", None),
+            (Punctuation, "'B'", None),
+            (VariableName, "$x", None),
+            (String, " A", None),
+            (Punctuation, "A", None),
+            (String, "$y", None),
+            (Punctuation, "B", None),
+            (FunctionName, "echo", None),
+        ]
+    );
+
+    // A heredoc without its delimiter runs to the end, and flags where it began.
+    assert_eq!(
+        lex("cat <<EOF\nbody\n EOF\n"),
+        [
+            (FunctionName, "cat", None),
+            (Operator, "<<", None),
+            (Punctuation, "EOF", Some(TokenPayload::Invalid)),
+            (String, "body\n EOF", None),
+        ]
+    );
+    assert_eq!(
+        lex("cat <<EOF"),
+        [
+            (FunctionName, "cat", None),
+            (Operator, "<<", None),
+            (Punctuation, "EOF", Some(TokenPayload::Invalid))
+        ]
+    );
+
+    // Here-strings and shifts capture nothing.
+    assert_eq!(
+        lex("cat <<< word\necho $((1<<2))\n"),
+        [
+            (FunctionName, "cat", None),
+            (Operator, "<<<", None),
+            (String, "word", None),
+            (FunctionName, "echo", None),
+            (VariableName, "$((1<<2))", None),
+        ]
+    );
+    assert_eq!(lex("x << 2\n")[1..], [(Operator, "<<", None), (Number, "2", None)]);
+}
+
+/// Returns the text of the identifier tokens.
+fn identifiers(language: Language, text: &[u8]) -> Vec<String> {
+    LexerRegistry::get_lexer(language)
+        .tokenize(text)
+        .iter()
+        .filter(|t| t.kind == TokenKind::Identifier)
+        .map(|t| String::from_utf8_lossy(&text[t.span.clone()]).into_owned())
+        .collect()
+}
+
+#[test]
+fn test_unicode_identifiers() {
+    let fixtures: [(Language, &[u8], [&str; 3]); 3] = [
+        (
+            Language::Go,
+            include_bytes!("../../../../../syntax-tests/test_syntax.go"),
+            ["世界", "Δx", "x١"],
+        ),
+        (
+            Language::JavaScript,
+            include_bytes!("../../../../../syntax-tests/test_syntax.js"),
+            ["cafe\u{301}", "Δx", "数据١"],
+        ),
+        (
+            Language::Python,
+            include_bytes!("../../../../../syntax-tests/test_syntax.py"),
+            ["π", "re\u{301}sume\u{301}", "数据١"],
+        ),
+    ];
+    for (language, text, names) in fixtures {
+        let found = identifiers(language, text);
+        for name in names {
+            assert!(found.iter().any(|f| f == name), "{language:?}: {name} not found");
+        }
+    }
+
+    // Go only allows letters and digits, not combining marks.
+    assert_eq!(identifiers(Language::Go, "cafe\u{301} := 1".as_bytes()), ["cafe"]);
+    // Nor other alphabetic or numeric characters outside of L and Nd, like superscripts
+    // and Roman numerals.
+    assert_eq!(identifiers(Language::Go, "x\u{b2} + \u{216b}y".as_bytes()), ["x", "y"]);
+    let rust = identifiers(Language::Rust, "let e\u{301}t\u{e9} = 1;".as_bytes());
+    assert_eq!(rust, ["e\u{301}t\u{e9}"]);
+
+    // Non-ASCII digits can't start an identifier.
+    for language in [Language::Go, Language::JavaScript, Language::Python, Language::Java] {
+        assert_eq!(identifiers(language, "١x".as_bytes()), ["x"], "{language:?}");
+    }
+
+    // Keywords are still recognized next to Unicode identifiers.
+    let tokens = LexerRegistry::get_lexer(Language::Go).tokenize("func Δ() {}".as_bytes());
+    assert!(tokens[0].kind.is_keyword());
+    assert_eq!(tokens[2].span, 5..7);
+
+    // Languages with ASCII-only names stay strict.
+    assert_eq!(identifiers(Language::Toml, "数据 = 1".as_bytes()), Vec::<String>::new());
+}
+
+/// Keywords are matched against whole words, so a keyword inside of a name like
+/// `format` or `selectAll` leaves it a single identifier.
+#[test]
+fn test_keywords_need_word_boundaries() {
+    const CANDIDATES: [&str; 40] = [
+        "as",
+        "break",
+        "case",
+        "chan",
+        "class",
+        "const",
+        "continue",
+        "def",
+        "default",
+        "defer",
+        "do",
+        "else",
+        "enum",
+        "fn",
+        "for",
+        "from",
+        "func",
+        "function",
+        "go",
+        "goto",
+        "if",
+        "import",
+        "in",
+        "interface",
+        "let",
+        "map",
+        "match",
+        "new",
+        "package",
+        "range",
+        "return",
+        "select",
+        "static",
+        "struct",
+        "switch",
+        "then",
+        "type",
+        "var",
+        "while",
+        "with",
+    ];
+    for &language in Language::ALL {
+        let lexer = LexerRegistry::get_lexer(language);
+        let keywords = CANDIDATES.iter().filter(|k| {
+            let tokens = lexer.tokenize(k.as_bytes());
+            tokens.len() == 1 && tokens[0].kind.is_keyword()
+        });
+        for keyword in keywords {
+            for name in [format!("{keyword}x"), format!("x{keyword}"), format!("x{keyword}x")] {
+                let tokens = lexer.tokenize(name.as_bytes());
+                assert!(
+                    tokens.len() == 1 && !tokens[0].kind.is_keyword(),
+                    "{language:?}: {name} lexes as {tokens:?}"
+                );
+            }
+        }
+    }
+}
+
+#[test]
+fn test_tokens_on_char_boundaries() {
+    let samples = [
+        "😀 x = \"😀\" // 😀\n",
+        "s = '𠀀😀' # 𠀀 😀\n",
+        "/* 👩‍🔬 */ a😀b <p>😀</p> `😀` key: 😀\n",
+        "-- 😀\n[😀]\n<!-- 😀 --> &😀; $😀 @😀 #😀 \\😀\n",
+        "# 😀 *😀* **😀** [😀](😀) `😀`\n😀\n",
+    ];
+    for &language in Language::ALL {
+        for sample in samples {
+            let tokens = LexerRegistry::get_lexer(language).tokenize(sample.as_bytes());
+            assert_ordered(&tokens, sample.len());
+            for token in &tokens {
+                let (start, end) = (token.span.start, token.span.end);
+                assert!(
+                    sample.is_char_boundary(start) && sample.is_char_boundary(end),
+                    "{language:?}: {token:?} in {sample:?}"
+                );
+            }
+        }
+    }
+}
+
+#[test]
+fn test_astral_plane_fixtures() {
+    let fixtures: [(Language, &[u8], &str); 2] = [
+        (
+            Language::Go,
+            include_bytes!("../../../../../syntax-tests/test_syntax.go"),
+            "var 𠀀 = \"😀 \\U0001F600 👩‍🔬\"",
+        ),
+        (
+            Language::JavaScript,
+            include_bytes!("../../../../../syntax-tests/test_syntax.js"),
+            "const 𠀀 = '😀 \\u{1F600} 👩‍🔬';",
+        ),
+    ];
+    for (language, text, line) in fixtures {
+        let start = text.windows(line.len()).position(|w| w == line.as_bytes()).unwrap();
+        let tokens = LexerRegistry::get_lexer(language).tokenize(text);
+        let on_line: Vec<_> = tokens
+            .iter()
+            .filter(|t| t.span.start >= start && t.span.end <= start + line.len())
+            .filter(|t| t.kind != TokenKind::Whitespace)
+            .map(|t| (t.kind, &line[t.span.start - start..t.span.end - start]))
+            .collect();
+        let string = &line[line.find(['"', '\'']).unwrap()..line.rfind(['"', '\'']).unwrap() + 1];
+        assert_eq!(on_line[1], (TokenKind::Identifier, "𠀀"), "{language:?}");
+        assert_eq!(on_line[2].1, "=");
+        assert_eq!(on_line[3], (TokenKind::String, string));
+
+        // The escaped emoji is a single escape.
+        let mut split = tokens.clone();
+        split_escapes(language, text, &mut split);
+        let escape = split.iter().find(|t| t.kind == TokenKind::Escape && t.span.start > start);
+        let escape = &text[escape.unwrap().span.clone()];
+        assert!(escape == b"\\U0001F600" || escape == b"\\u{1F600}", "{language:?}");
+
+        // The comment before the line ends right before its newline.
+        let comment = tokens.iter().rev().find(|t| t.span.end <= start).unwrap();
+        let comment = tokens.iter().rev().find(|t| t.span.end < comment.span.end).unwrap();
+        assert!(comment.kind.is_comment(), "{language:?}");
+        assert!(text[comment.span.clone()].ends_with("in names".as_bytes()));
+    }
+
+    // A character literal holds a whole emoji, not its first byte.
+    let text = "let c = '😀';";
+    let tokens = LexerRegistry::get_lexer(Language::Rust).tokenize(text.as_bytes());
+    let c = tokens.iter().find(|t| t.kind == TokenKind::Char).unwrap();
+    assert_eq!(&text[c.span.clone()], "'😀'");
+}
+
+/// Spans are byte offsets, so a name like `变量` is six bytes wide though it's two
+/// characters, and an emoji with a skin tone is eight.
+#[test]
+fn test_go_unicode_byte_spans() {
+    let text = include_bytes!("../../../../../syntax-tests/test_syntax.go");
+    let lines = concat!(
+        "const π = 3.14159\n",
+        "var 变量 = 2 * π\n",
+        "var wave, accented, rocket = \"👋🏽 hello\", \"cafe\u{301}\", '🚀'\n",
+    );
+    let start = text.windows(lines.len()).position(|w| w == lines.as_bytes()).unwrap();
+    let tokens = LexerRegistry::get_lexer(Language::Go).tokenize(text);
+    let spans: Vec<_> = tokens
+        .iter()
+        .filter(|t| t.span.start >= start && t.span.end <= start + lines.len())
+        .filter(|t| t.kind != TokenKind::Whitespace)
+        .map(|t| (t.kind, t.span.start - start..t.span.end - start))
+        .collect();
+
+    use TokenKind::{Char, Identifier as Ident, Keyword, Number, Operator as Op, String};
+    #[rustfmt::skip]
+    let expected = [
+        (Keyword, 0..5), (Ident, 6..8), (Op, 9..10), (Number, 11..18),
+        (Keyword, 19..22), (Ident, 23..29), (Op, 30..31), (Number, 32..33),
+        (Op, 34..35), (Ident, 36..38),
+        (Keyword, 39..42), (Ident, 43..47), (Op, 47..48), (Ident, 49..57),
+        (Op, 57..58), (Ident, 59..65), (Op, 66..67), (String, 68..84), (Op, 84..85),
+        (String, 86..94), (Op, 94..95), (Char, 96..102),
+    ];
+    assert_eq!(spans, expected);
+}
+
+/// The precomposed Latin-1 letters and the combining mark each of them decomposes into.
+const DECOMPOSITIONS: [(char, &str, &str); 7] = [
+    ('\u{300}', "ÀÈÌÒÙàèìòù", "AEIOUaeiou"),
+    ('\u{301}', "ÁÉÍÓÚÝáéíóúý", "AEIOUYaeiouy"),
+    ('\u{302}', "ÂÊÎÔÛâêîôû", "AEIOUaeiou"),
+    ('\u{303}', "ÃÑÕãñõ", "ANOano"),
+    ('\u{308}', "ÄËÏÖÜäëïöüÿ", "AEIOUaeiouy"),
+    ('\u{30A}', "Åå", "Aa"),
+    ('\u{327}', "Çç", "Cc"),
+];
+
+/// Converts `text` to NFC (`compose`) or NFD. Only Latin-1 letters are handled,
+/// which is enough for the fixtures. Also returns the new offset of every char boundary.
+fn normalize(text: &str, compose: bool) -> (String, Vec<usize>) {
+    let mut out = String::with_capacity(text.len() + text.len() / 4);
+    let mut offsets = vec![0; text.len() + 1];
+    let mut chars = text.char_indices().peekable();
+
+    while let Some((i, ch)) = chars.next() {
+        offsets[i] = out.len();
+        let pair = DECOMPOSITIONS.iter().find_map(|&(mark, composed, bases)| {
+            if compose {
+                let (_, next) = chars.peek().copied()?;
+                let j = bases.chars().position(|b| b == ch && next == mark)?;
+                Some((composed.chars().nth(j)?, None))
+            } else {
+                let j = composed.chars().position(|c| c == ch)?;
+                Some((bases.chars().nth(j)?, Some(mark)))
+            }
+        });
+        match pair {
+            Some((ch, mark)) => {
+                out.push(ch);
+                match mark {
+                    Some(mark) => out.push(mark),
+                    None => {
+                        // The mark was composed into `ch` and starts inside of it.
+                        let (j, _) = chars.next().unwrap();
+                        offsets[j] = out.len();
+                    }
+                }
+            }
+            None => out.push(ch),
+        }
+    }
+
+    offsets[text.len()] = out.len();
+    (out, offsets)
+}
+
+/// Composed and decomposed text must lex to the same kinds of tokens,
+/// which only differ in the byte lengths of the characters.
+#[test]
+fn test_normalization_forms() {
+    let fixtures: [(Language, &[u8]); 4] = [
+        (Language::Go, include_bytes!("../../../../../syntax-tests/test_syntax.go")),
+        (Language::JavaScript, include_bytes!("../../../../../syntax-tests/test_syntax.js")),
+        (Language::Python, include_bytes!("../../../../../syntax-tests/test_syntax.py")),
+        (Language::Rust, include_bytes!("../../../../../syntax-tests/test_syntax.rs")),
+    ];
+    let samples = [
+        (Language::Python, "résumé = f\"naïve {café!r}\"  # Ångström\n"),
+        (Language::JavaScript, "const façade = 'piñata'; // crème brûlée\n"),
+        (Language::Rust, "let señor = \"Zoë\"; /* Übergröße */\n"),
+        (Language::Html, "<p title=\"déjà vu\">Noël</p>\n"),
+        (Language::Markdown, "# Café\n\n*crème* and `brûlée`\n"),
+    ];
+    let texts = fixtures
+        .iter()
+        .map(|&(language, text)| (language, str::from_utf8(text).unwrap()))
+        .chain(samples);
+
+    for (language, text) in texts {
+        let lexer = LexerRegistry::get_lexer(language);
+        let tokens = lexer.tokenize(text.as_bytes());
+        for compose in [true, false] {
+            let (variant, offsets) = normalize(text, compose);
+            let expected: Vec<_> = tokens
+                .iter()
+                .map(|t| (t.kind, offsets[t.span.start]..offsets[t.span.end]))
+                .collect();
+            let found: Vec<_> = lexer
+                .tokenize(variant.as_bytes())
+                .iter()
+                .map(|t| (t.kind, t.span.clone()))
+                .collect();
+            assert_eq!(found, expected, "{language:?}, compose: {compose}");
+        }
+    }
+
+    // The decomposed fixtures really change.
+    let (nfc, _) = normalize("re\u{301}sume\u{301}", true);
+    assert_eq!(nfc, "résumé");
+    assert_eq!(normalize(&nfc, false).0, "re\u{301}sume\u{301}");
+}
+
+#[test]
+fn test_case_insensitive_keywords() {
+    use crate::syntax::lexer::{fold_keyword, simple_fold_eq};
+
+    let kinds = |language, text: &str| -> Vec<TokenKind> {
+        let tokens = LexerRegistry::get_lexer(language).tokenize(text.as_bytes());
+        tokens.iter().filter(|t| t.kind != TokenKind::Whitespace).map(|t| t.kind).collect()
+    };
+    for select in ["SELECT", "Select", "select", "sElEcT"] {
+        assert_eq!(kinds(Language::Sql, select), [TokenKind::Keyword], "{select}");
+    }
+    // Keywords fold ASCII only, whatever the locale: `İF` isn't `IF`.
+    assert_ne!(kinds(Language::Sql, "\u{130}F")[..], [TokenKind::Keyword]);
+    assert_eq!(
+        kinds(Language::Sql, "Int True Count"),
+        [TokenKind::TypeName, TokenKind::Boolean, TokenKind::FunctionName,]
+    );
+
+    // Tokens keep the spelling and offsets of the text, and quoting makes any word a name.
+    let text = "SeLeCt \"SELECT\" FROM t";
+    let tokens = LexerRegistry::get_lexer(Language::Sql).tokenize(text.as_bytes());
+    let actual: Vec<_> = tokens
+        .iter()
+        .filter(|t| t.kind != TokenKind::Whitespace)
+        .map(|t| (t.kind, t.span.clone(), &text[t.span.clone()]))
+        .collect();
+    assert_eq!(
+        actual,
+        [
+            (TokenKind::Keyword, 0..6, "SeLeCt"),
+            (TokenKind::Identifier, 7..15, "\"SELECT\""),
+            (TokenKind::Keyword, 16..20, "FROM"),
+            (TokenKind::Identifier, 21..22, "t"),
+        ]
+    );
+
+    assert_eq!(fold_keyword(b"SeLeCt"), "select");
+    assert_eq!(fold_keyword("\u{130}F".as_bytes()), "");
+    assert_eq!(fold_keyword("\u{212A}EY".as_bytes()), "");
+    assert_eq!(fold_keyword(&b"X".repeat(1000)), "");
+
+    // The keywords of the metadata follow the language.
+    assert!(Language::Sql.metadata().is_keyword(b"Select", "select"));
+    assert!(!Language::Shell.metadata().is_keyword(b"If", "if"));
+
+    // Names use Unicode simple case folding instead.
+    assert!(simple_fold_eq("Straße".as_bytes(), "STRAẞE".as_bytes()));
+    assert!(simple_fold_eq("ΣΟΦΌΣ".as_bytes(), "σοφός".as_bytes()));
+    assert!(!simple_fold_eq("STRASSE".as_bytes(), "straße".as_bytes()));
+    assert!(!simple_fold_eq("\u{130}F".as_bytes(), b"if"));
+    assert!(!simple_fold_eq("\u{131}f".as_bytes(), b"IF"));
+}
+
+#[test]
+fn test_language_from_content() {
+    let cases: [(&str, Language); 14] = [
+        ("#!/usr/bin/env python3\nprint(1)\n", Language::Python),
+        ("#!/usr/bin/python3.12 -u\n", Language::Python),
+        ("#!/usr/bin/env -S node --no-warnings\n", Language::JavaScript),
+        ("#!/bin/bash\necho hi\n", Language::Shell),
+        ("#!/bin/sh\n", Language::Shell),
+        ("#! /usr/bin/env zsh\n", Language::Shell),
+        ("#![allow(dead_code)]\nfn main() {}\n", Language::Rust),
+        ("#!/usr/bin/perl\n", Language::PlainText),
+        ("\u{feff}<?xml version=\"1.0\"?>\n<a/>\n", Language::Xml),
+        ("<!DOCTYPE html>\n<html></html>\n", Language::Html),
+        ("\n  <html lang=\"en\">\n", Language::Html),
+        ("{\n  \"name\": \"edit\"\n}\n", Language::Json),
+        ("{}", Language::Json),
+        ("{ foo }\n", Language::PlainText),
+    ];
+    for (text, language) in cases {
+        assert_eq!(Language::from_content(text.as_bytes()), language, "{text:?}");
+    }
+    assert_eq!(Language::from_content(b""), Language::PlainText);
+}
+
+#[test]
+fn test_language_names() {
+    for &language in Language::ALL {
+        assert_eq!(Language::from_name(language.id()), language);
+        for &alias in language.aliases() {
+            assert_eq!(Language::from_name(alias), language, "{alias}");
+        }
+        for &ext in language.extensions() {
+            assert_eq!(Language::from_extension(ext), language, "{ext}");
+            assert_eq!(Language::from_extension(&ext.to_uppercase()), language, "{ext}");
+        }
+    }
+    assert_eq!(Language::from_name("C++"), Language::Cpp);
+    assert_eq!(Language::from_name("rs"), Language::Rust);
+    assert_eq!(Language::from_name("klingon"), Language::PlainText);
+}
+
+#[test]
+fn test_token_kind_all() {
+    // In declaration order without gaps, so that a kind added in between shows up here.
+    for (i, &kind) in TokenKind::ALL.iter().enumerate() {
+        assert_eq!(kind as usize, i, "{kind:?}");
+    }
+    assert_eq!(
+        TokenKind::ALL.last(),
+        Some(&TokenKind::MarkdownLink),
+        "a kind was added at the end"
+    );
+}
+
+#[test]
+fn test_go_export_words() {
+    // The word lists for exporting the Go lexer agree with what it does.
+    let lexer = LexerRegistry::get_lexer(Language::Go);
+    let kind = |text: &str| lexer.tokenize(text.as_bytes())[0].kind;
+    for word in super::go::CONTROL_KEYWORDS.iter().chain(super::go::KEYWORDS) {
+        assert_eq!(kind(word), TokenKind::Keyword, "{word}");
+    }
+    for word in super::go::TYPES {
+        assert_eq!(kind(word), TokenKind::TypeName, "{word}");
+    }
+    for word in super::go::BUILTINS {
+        assert_eq!(kind(&format!("{word}()")), TokenKind::FunctionName, "{word}");
+    }
+}
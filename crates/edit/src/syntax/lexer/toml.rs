@@ -3,17 +3,38 @@
 
 //! TOML configuration file lexer.
 
-use crate::syntax::lexer::{Lexer, is_ident_start, is_ident_continue, is_ascii_digit};
+use crate::syntax::lexer::{
+    Checkpoints, Resumable, char_len, is_ascii_digit, is_ident_continue, is_ident_start,
+};
 use crate::syntax::{Token, TokenKind};
 
 pub struct TomlLexer;
 
-impl Lexer for TomlLexer {
-    fn tokenize(&self, text: &[u8]) -> Vec<Token> {
-        let mut tokens = Vec::with_capacity(text.len() / 8);
-        let mut pos = 0;
+/// Checks whether `text` starts with a date (`1979-05-27`) or a time (`07:32:00`).
+fn is_datetime(text: &[u8]) -> bool {
+    let digits = text.iter().take_while(|&&b| is_ascii_digit(b)).count();
+    matches!((digits, text.get(digits)), (4, Some(b'-')) | (2, Some(b':')))
+}
+
+fn is_datetime_byte(b: u8) -> bool {
+    matches!(b.to_ascii_uppercase(), b'0'..=b'9' | b'-' | b':' | b'.' | b'+' | b'T' | b'Z')
+}
 
+impl Resumable for TomlLexer {
+    type State = ();
+
+    fn lex(
+        &self,
+        text: &[u8],
+        mut pos: usize,
+        _: (),
+        tokens: &mut Vec<Token>,
+        checkpoints: &mut Checkpoints<()>,
+    ) {
         while pos < text.len() {
+            if checkpoints.due(text, tokens, pos) && checkpoints.report(text, pos, tokens, 0, ()) {
+                return;
+            }
             let start = pos;
             let b = text[pos];
 
@@ -41,11 +62,11 @@ impl Lexer for TomlLexer {
                     if is_array {
                         pos += 1;
                     }
-                    
+
                     while pos < text.len() && text[pos] != b']' {
                         pos += 1;
                     }
-                    
+
                     if pos < text.len() {
                         pos += 1;
                         if is_array && pos < text.len() && text[pos] == b']' {
@@ -59,13 +80,14 @@ impl Lexer for TomlLexer {
                 b'"' | b'\'' => {
                     let quote = b;
                     pos += 1;
-                    
+
                     // Check for multi-line strings (""" or ''')
-                    let multiline = pos + 1 < text.len() && text[pos] == quote && text[pos + 1] == quote;
+                    let multiline =
+                        pos + 1 < text.len() && text[pos] == quote && text[pos + 1] == quote;
                     if multiline {
                         pos += 2;
-                        while pos + 2 < text.len() {
-                            if text[pos] == quote && text[pos + 1] == quote && text[pos + 2] == quote {
+                        while pos < text.len() {
+                            if text[pos..].starts_with(&[quote; 3]) {
                                 pos += 3;
                                 break;
                             }
@@ -90,16 +112,36 @@ impl Lexer for TomlLexer {
                     tokens.push(Token::new(TokenKind::String, start..pos));
                 }
 
+                // Dates and times, like 1979-05-27T07:32:00Z or 07:32:00
+                b'0'..=b'9' if is_datetime(&text[pos..]) => {
+                    while pos < text.len() && is_datetime_byte(text[pos]) {
+                        pos += 1;
+                    }
+                    // The date and time may also be separated by a space.
+                    if text[pos..].starts_with(b" ") && is_datetime(&text[pos + 1..]) {
+                        pos += 1;
+                        while pos < text.len() && is_datetime_byte(text[pos]) {
+                            pos += 1;
+                        }
+                    }
+                    tokens.push(Token::new(TokenKind::Number, start..pos));
+                }
+
                 // Numbers (integers and floats)
-                b'0'..=b'9' | b'+' | b'-' if matches!(b, b'+' | b'-') && pos + 1 < text.len() && is_ascii_digit(text[pos + 1]) || is_ascii_digit(b) => {
+                b'0'..=b'9' | b'+' | b'-'
+                    if matches!(b, b'+' | b'-')
+                        && pos + 1 < text.len()
+                        && is_ascii_digit(text[pos + 1])
+                        || is_ascii_digit(b) =>
+                {
                     if matches!(b, b'+' | b'-') {
                         pos += 1;
                     }
-                    
+
                     while pos < text.len() && (is_ascii_digit(text[pos]) || text[pos] == b'_') {
                         pos += 1;
                     }
-                    
+
                     // Float
                     if pos < text.len() && text[pos] == b'.' {
                         pos += 1;
@@ -107,7 +149,7 @@ impl Lexer for TomlLexer {
                             pos += 1;
                         }
                     }
-                    
+
                     // Exponent
                     if pos < text.len() && matches!(text[pos], b'e' | b'E') {
                         pos += 1;
@@ -118,7 +160,7 @@ impl Lexer for TomlLexer {
                             pos += 1;
                         }
                     }
-                    
+
                     tokens.push(Token::new(TokenKind::Number, start..pos));
                 }
 
@@ -156,26 +198,25 @@ impl Lexer for TomlLexer {
 
                 // Unknown
                 _ => {
-                    pos += 1;
+                    pos += char_len(text, pos);
                     tokens.push(Token::new(TokenKind::Error, start..pos));
                 }
             }
         }
-
-        tokens
     }
 }
 
 #[cfg(test)]
 mod tests {
     use super::*;
+    use crate::syntax::Lexer;
 
     #[test]
     fn test_toml_section() {
         let lexer = TomlLexer;
         let text = b"[package]\nname = \"test\"";
         let tokens = lexer.tokenize(text);
-        
+
         let has_section = tokens.iter().any(|t| t.kind == TokenKind::KeywordType);
         assert!(has_section);
     }
@@ -185,11 +226,27 @@ mod tests {
         let lexer = TomlLexer;
         let text = b"enabled = true\ncount = 42";
         let tokens = lexer.tokenize(text);
-        
+
         let has_bool = tokens.iter().any(|t| t.kind == TokenKind::Boolean);
         let has_number = tokens.iter().any(|t| t.kind == TokenKind::Number);
-        
+
         assert!(has_bool);
         assert!(has_number);
     }
+
+    #[test]
+    fn test_toml_datetimes() {
+        let text = b"a = 1979-05-27T07:32:00Z\nb = 1979-05-27 07:32:00.5-07:00\nc = 07:32:00\n\
+            d = 2000-01-01";
+        let tokens = TomlLexer.tokenize(text);
+        let numbers: Vec<_> = tokens
+            .iter()
+            .filter(|t| t.kind == TokenKind::Number)
+            .map(|t| &text[t.span.clone()])
+            .collect();
+        let expected: [&[u8]; 4] =
+            [b"1979-05-27T07:32:00Z", b"1979-05-27 07:32:00.5-07:00", b"07:32:00", b"2000-01-01"];
+        assert_eq!(numbers, expected);
+        assert!(!tokens.iter().any(|t| t.kind == TokenKind::Error));
+    }
 }
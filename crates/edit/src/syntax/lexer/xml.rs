@@ -3,17 +3,26 @@
 
 //! High-performance XML lexer with full language support.
 
-use crate::syntax::lexer::{Lexer, is_whitespace};
+use crate::syntax::lexer::{Checkpoints, Resumable, is_whitespace};
 use crate::syntax::{Token, TokenKind};
 
 pub struct XmlLexer;
 
-impl Lexer for XmlLexer {
-    fn tokenize(&self, text: &[u8]) -> Vec<Token> {
-        let mut tokens = Vec::with_capacity(text.len() / 8);
-        let mut pos = 0;
+impl Resumable for XmlLexer {
+    type State = ();
 
+    fn lex(
+        &self,
+        text: &[u8],
+        mut pos: usize,
+        _: (),
+        tokens: &mut Vec<Token>,
+        checkpoints: &mut Checkpoints<()>,
+    ) {
         while pos < text.len() {
+            if checkpoints.due(text, tokens, pos) && checkpoints.report(text, pos, tokens, 0, ()) {
+                return;
+            }
             let start = pos;
             let b = text[pos];
 
@@ -27,10 +36,10 @@ impl Lexer for XmlLexer {
                 }
 
                 // XML Comment
-                b'<' if pos + 3 < text.len() && &text[pos..pos+4] == b"<!--" => {
+                b'<' if pos + 3 < text.len() && &text[pos..pos + 4] == b"<!--" => {
                     pos += 4;
-                    while pos + 2 < text.len() {
-                        if &text[pos..pos+3] == b"-->" {
+                    while pos < text.len() {
+                        if text[pos..].starts_with(b"-->") {
                             pos += 3;
                             break;
                         }
@@ -40,10 +49,10 @@ impl Lexer for XmlLexer {
                 }
 
                 // CDATA section
-                b'<' if pos + 8 < text.len() && &text[pos..pos+9] == b"<![CDATA[" => {
+                b'<' if pos + 8 < text.len() && &text[pos..pos + 9] == b"<![CDATA[" => {
                     pos += 9;
-                    while pos + 2 < text.len() {
-                        if &text[pos..pos+3] == b"]]>" {
+                    while pos < text.len() {
+                        if text[pos..].starts_with(b"]]>") {
                             pos += 3;
                             break;
                         }
@@ -55,8 +64,8 @@ impl Lexer for XmlLexer {
                 // Processing instruction (<?xml ... ?> or other PIs)
                 b'<' if pos + 1 < text.len() && text[pos + 1] == b'?' => {
                     pos += 2;
-                    while pos + 1 < text.len() {
-                        if text[pos] == b'?' && text[pos + 1] == b'>' {
+                    while pos < text.len() {
+                        if text[pos..].starts_with(b"?>") {
                             pos += 2;
                             break;
                         }
@@ -84,7 +93,7 @@ impl Lexer for XmlLexer {
                 b'<' if pos + 1 < text.len() && text[pos + 1] == b'/' => {
                     pos += 2;
                     tokens.push(Token::new(TokenKind::Operator, start..pos));
-                    
+
                     // Tag name
                     let tag_start = pos;
                     while pos < text.len() && !is_whitespace(text[pos]) && text[pos] != b'>' {
@@ -93,7 +102,7 @@ impl Lexer for XmlLexer {
                     if pos > tag_start {
                         tokens.push(Token::new(TokenKind::Keyword, tag_start..pos));
                     }
-                    
+
                     // Skip whitespace
                     while pos < text.len() && is_whitespace(text[pos]) {
                         let ws_start = pos;
@@ -103,10 +112,10 @@ impl Lexer for XmlLexer {
                         }
                         tokens.push(Token::new(TokenKind::Whitespace, ws_start..pos));
                     }
-                    
+
                     // Closing >
                     if pos < text.len() && text[pos] == b'>' {
-                        tokens.push(Token::new(TokenKind::Operator, pos..pos+1));
+                        tokens.push(Token::new(TokenKind::Operator, pos..pos + 1));
                         pos += 1;
                     }
                 }
@@ -115,16 +124,20 @@ impl Lexer for XmlLexer {
                 b'<' => {
                     pos += 1;
                     tokens.push(Token::new(TokenKind::Operator, start..pos));
-                    
+
                     // Tag name (including namespace prefix)
                     let tag_start = pos;
-                    while pos < text.len() && !is_whitespace(text[pos]) && text[pos] != b'>' && text[pos] != b'/' {
+                    while pos < text.len()
+                        && !is_whitespace(text[pos])
+                        && text[pos] != b'>'
+                        && text[pos] != b'/'
+                    {
                         pos += 1;
                     }
                     if pos > tag_start {
                         tokens.push(Token::new(TokenKind::Keyword, tag_start..pos));
                     }
-                    
+
                     // Attributes
                     loop {
                         // Skip whitespace
@@ -135,21 +148,37 @@ impl Lexer for XmlLexer {
                             }
                             tokens.push(Token::new(TokenKind::Whitespace, ws_start..pos));
                         }
-                        
+
                         // Check for end of tag
-                        if pos >= text.len() || text[pos] == b'>' || (text[pos] == b'/' && pos + 1 < text.len() && text[pos + 1] == b'>') {
+                        if pos >= text.len()
+                            || text[pos] == b'>'
+                            || (text[pos] == b'/' && pos + 1 < text.len() && text[pos + 1] == b'>')
+                        {
                             break;
                         }
-                        
+
+                        // A stray / that doesn't close the tag. Without consuming it,
+                        // this loop would never advance.
+                        if text[pos] == b'/' {
+                            tokens.push(Token::new(TokenKind::Operator, pos..pos + 1));
+                            pos += 1;
+                            continue;
+                        }
+
                         // Attribute name (including namespace prefix)
                         let attr_start = pos;
-                        while pos < text.len() && !is_whitespace(text[pos]) && text[pos] != b'=' && text[pos] != b'>' && text[pos] != b'/' {
+                        while pos < text.len()
+                            && !is_whitespace(text[pos])
+                            && text[pos] != b'='
+                            && text[pos] != b'>'
+                            && text[pos] != b'/'
+                        {
                             pos += 1;
                         }
                         if pos > attr_start {
                             tokens.push(Token::new(TokenKind::PropertyName, attr_start..pos));
                         }
-                        
+
                         // Skip whitespace around =
                         while pos < text.len() && is_whitespace(text[pos]) {
                             let ws_start = pos;
@@ -159,12 +188,12 @@ impl Lexer for XmlLexer {
                             }
                             tokens.push(Token::new(TokenKind::Whitespace, ws_start..pos));
                         }
-                        
+
                         // Equals sign
                         if pos < text.len() && text[pos] == b'=' {
-                            tokens.push(Token::new(TokenKind::Operator, pos..pos+1));
+                            tokens.push(Token::new(TokenKind::Operator, pos..pos + 1));
                             pos += 1;
-                            
+
                             // Skip whitespace after =
                             while pos < text.len() && is_whitespace(text[pos]) {
                                 let ws_start = pos;
@@ -174,7 +203,7 @@ impl Lexer for XmlLexer {
                                 }
                                 tokens.push(Token::new(TokenKind::Whitespace, ws_start..pos));
                             }
-                            
+
                             // Attribute value
                             if pos < text.len() {
                                 let quote = text[pos];
@@ -184,7 +213,10 @@ impl Lexer for XmlLexer {
                                     while pos < text.len() && text[pos] != quote {
                                         // Handle entity references in attribute values
                                         if text[pos] == b'&' {
-                                            while pos < text.len() && text[pos] != b';' && text[pos] != quote {
+                                            while pos < text.len()
+                                                && text[pos] != b';'
+                                                && text[pos] != quote
+                                            {
                                                 pos += 1;
                                             }
                                             if pos < text.len() && text[pos] == b';' {
@@ -202,15 +234,15 @@ impl Lexer for XmlLexer {
                             }
                         }
                     }
-                    
+
                     // Self-closing />
                     if pos + 1 < text.len() && text[pos] == b'/' && text[pos + 1] == b'>' {
-                        tokens.push(Token::new(TokenKind::Operator, pos..pos+2));
+                        tokens.push(Token::new(TokenKind::Operator, pos..pos + 2));
                         pos += 2;
                     }
                     // Closing >
                     else if pos < text.len() && text[pos] == b'>' {
-                        tokens.push(Token::new(TokenKind::Operator, pos..pos+1));
+                        tokens.push(Token::new(TokenKind::Operator, pos..pos + 1));
                         pos += 1;
                     }
                 }
@@ -235,7 +267,5 @@ impl Lexer for XmlLexer {
                 }
             }
         }
-
-        tokens
     }
 }
@@ -2,18 +2,158 @@
 // Licensed under the MIT License.
 
 //! YAML configuration file lexer.
+//!
+//! Block scalars (`|` and `>`) are the one place where YAML's indentation decides what's
+//! a token: their content runs for as long as its lines are indented more than the key or
+//! dash they belong to, so that `key: value` in there is text, not a key.
 
-use crate::syntax::lexer::{Lexer, is_ident_start, is_ident_continue, is_ascii_digit};
+use std::ops::Range;
+
+use crate::syntax::lexer::{
+    Checkpoints, Resumable, char_len, is_ascii_digit, is_ident_continue, is_ident_start,
+};
 use crate::syntax::{Token, TokenKind};
 
 pub struct YamlLexer;
 
-impl Lexer for YamlLexer {
-    fn tokenize(&self, text: &[u8]) -> Vec<Token> {
-        let mut tokens = Vec::with_capacity(text.len() / 8);
-        let mut pos = 0;
+/// Checks whether a plain scalar ends before `text[pos]`: at whitespace,
+/// a flow indicator, or a `:` followed by whitespace.
+fn ends_plain_scalar(text: &[u8], pos: usize) -> bool {
+    match text[pos] {
+        b' ' | b'\t' | b'\r' | b'\n' | b',' | b'[' | b']' | b'{' | b'}' => true,
+        b':' => text.get(pos + 1).is_none_or(|b| b.is_ascii_whitespace()),
+        _ => false,
+    }
+}
+
+/// Returns the end of the block scalar header at `pos`, like `|`, `>-` or `|2+`, and its
+/// indentation indicator, if any. `None` if the indicators aren't followed by whitespace.
+fn block_scalar_header(text: &[u8], pos: usize) -> Option<(usize, Option<usize>)> {
+    let mut end = pos + 1;
+    let mut indent = None;
+    let mut chomping = false;
+    // The indentation and chomping indicators may come in either order.
+    for _ in 0..2 {
+        match text.get(end) {
+            Some(&b @ b'1'..=b'9') if indent.is_none() => indent = Some((b - b'0') as usize),
+            Some(b'+' | b'-') if !chomping => chomping = true,
+            _ => break,
+        }
+        end += 1;
+    }
+    match text.get(end) {
+        None | Some(b' ' | b'\t' | b'\r' | b'\n') => Some((end, indent)),
+        _ => None,
+    }
+}
+
+/// Returns the indentation that the content of a block scalar has to exceed, given the
+/// tokens before its header and the start of the header's line: that of the key in
+/// `key: |`, of the dash in `- |`, and -1 after `---`. A header on a line of its own may
+/// be as indented as its content. `None` if the `|` or `>` isn't where a value starts,
+/// like in `a > b`.
+fn block_scalar_parent(text: &[u8], tokens: &[Token], line_start: usize) -> Option<isize> {
+    let column = |pos: usize| (pos - line_start) as isize;
+    let prev = tokens.iter().rev().take_while(|t| t.span.start >= line_start).find(|t| {
+        !matches!(t.kind, TokenKind::Whitespace | TokenKind::Label | TokenKind::Attribute)
+    });
+
+    let Some(prev) = prev else {
+        let indent = text[line_start..].iter().take_while(|&&b| b == b' ').count();
+        return Some(indent as isize - 1);
+    };
+    match (prev.kind, &text[prev.span.clone()]) {
+        (TokenKind::Operator, b"-") => Some(column(prev.span.start)),
+        (TokenKind::Keyword, b"---") => Some(-1),
+        // The key comes after the indentation and the dashes of any sequences it's in.
+        (TokenKind::Punctuation, b":") => {
+            let mut key = line_start;
+            loop {
+                while matches!(text[key], b' ' | b'\t') {
+                    key += 1;
+                }
+                if text[key] != b'-' || !matches!(text[key + 1], b' ' | b'\t') {
+                    return Some(column(key));
+                }
+                key += 1;
+            }
+        }
+        _ => None,
+    }
+}
+
+/// Returns the content of a block scalar whose lines start at `pos`, without the
+/// indentation of its first line and the blank lines after its last one. The lines
+/// must be indented by the `explicit` indentation, or else by as much as the first
+/// line that isn't blank, and more than `parent`. `None` if the scalar is empty.
+/// Where it ends depends on the line after it, which `checkpoints` are told.
+fn block_scalar_content(
+    text: &[u8],
+    mut pos: usize,
+    parent: isize,
+    explicit: Option<usize>,
+    checkpoints: &mut Checkpoints<()>,
+) -> Option<Range<usize>> {
+    let mut indent = explicit.map(|m| (parent + m as isize).max(0) as usize);
+    let mut content: Option<Range<usize>> = None;
+
+    while pos < text.len() {
+        let spaces = text[pos..].iter().take_while(|&&b| b == b' ').count();
+        let eol = text[pos..].iter().position(|&b| b == b'\n').map_or(text.len(), |i| pos + i);
+        // Blank lines neither continue nor end the scalar, however indented they are.
+        if text[pos + spaces..eol].iter().all(|&b| matches!(b, b' ' | b'\t' | b'\r')) {
+            pos = eol + 1;
+            continue;
+        }
+        let indent = *indent.get_or_insert(spaces);
+        if spaces < indent || spaces as isize <= parent {
+            checkpoints.look_ahead(if eol < text.len() { eol + 1 } else { usize::MAX });
+            return content;
+        }
+        let end = if text[..eol].ends_with(b"\r") { eol - 1 } else { eol };
+        let start = content.map_or(pos + indent, |c| c.start);
+        content = Some(start..end);
+        pos = eol + 1;
+    }
+    checkpoints.look_ahead(usize::MAX);
+    content
+}
+
+/// Lexes the blank lines and indentation in `range` like the main loop would,
+/// with each newline on its own.
+fn push_whitespace(text: &[u8], range: Range<usize>, tokens: &mut Vec<Token>) {
+    let mut pos = range.start;
+    while pos < range.end {
+        let start = pos;
+        pos += 1;
+        if text[start] != b'\n' {
+            while pos < range.end && text[pos] != b'\n' {
+                pos += 1;
+            }
+        }
+        tokens.push(Token::new(TokenKind::Whitespace, start..pos));
+    }
+}
+
+impl Resumable for YamlLexer {
+    type State = ();
+
+    fn lex(
+        &self,
+        text: &[u8],
+        mut pos: usize,
+        _: (),
+        tokens: &mut Vec<Token>,
+        checkpoints: &mut Checkpoints<()>,
+    ) {
+        // The start of the line of the last `|` or `>`, and how far it's been searched for.
+        // Searching from the `|` each time would be quadratic in a line full of them.
+        let (mut line_start, mut searched) = (pos, pos);
 
         while pos < text.len() {
+            if checkpoints.due(text, tokens, pos) && checkpoints.report(text, pos, tokens, 0, ()) {
+                return;
+            }
             let start = pos;
             let b = text[pos];
 
@@ -70,15 +210,20 @@ impl Lexer for YamlLexer {
                 }
 
                 // Numbers
-                b'0'..=b'9' | b'+' | b'-' if (matches!(b, b'+' | b'-') && pos + 1 < text.len() && is_ascii_digit(text[pos + 1])) || is_ascii_digit(b) => {
+                b'0'..=b'9' | b'+' | b'-'
+                    if (matches!(b, b'+' | b'-')
+                        && pos + 1 < text.len()
+                        && is_ascii_digit(text[pos + 1]))
+                        || is_ascii_digit(b) =>
+                {
                     if matches!(b, b'+' | b'-') {
                         pos += 1;
                     }
-                    
+
                     while pos < text.len() && (is_ascii_digit(text[pos]) || text[pos] == b'_') {
                         pos += 1;
                     }
-                    
+
                     // Float
                     if pos < text.len() && text[pos] == b'.' {
                         pos += 1;
@@ -86,7 +231,7 @@ impl Lexer for YamlLexer {
                             pos += 1;
                         }
                     }
-                    
+
                     // Exponent
                     if pos < text.len() && matches!(text[pos], b'e' | b'E') {
                         pos += 1;
@@ -97,7 +242,7 @@ impl Lexer for YamlLexer {
                             pos += 1;
                         }
                     }
-                    
+
                     tokens.push(Token::new(TokenKind::Number, start..pos));
                 }
 
@@ -167,37 +312,91 @@ impl Lexer for YamlLexer {
                     tokens.push(Token::new(TokenKind::Punctuation, start..pos));
                 }
 
-                // Pipe and fold markers
+                // Block scalars, whose header is an operator and whose content is a string.
+                // Elsewhere, `|` and `>` are operators on their own.
                 b'|' | b'>' => {
-                    pos += 1;
+                    if let Some(i) = text[searched..pos].iter().rposition(|&b| b == b'\n') {
+                        line_start = searched + i + 1;
+                    }
+                    searched = pos;
+                    let header = block_scalar_header(text, pos);
+                    let parent = block_scalar_parent(text, tokens, line_start);
+                    let (Some((end, explicit)), Some(parent)) = (header, parent) else {
+                        pos += 1;
+                        tokens.push(Token::new(TokenKind::Operator, start..pos));
+                        continue;
+                    };
+                    pos = end;
                     tokens.push(Token::new(TokenKind::Operator, start..pos));
+
+                    // Only a comment may follow on the header's line.
+                    let eol = text[pos..]
+                        .iter()
+                        .position(|&b| b == b'\n')
+                        .map_or(text.len(), |i| pos + i);
+                    let blanks = pos;
+                    while pos < eol && matches!(text[pos], b' ' | b'\t' | b'\r') {
+                        pos += 1;
+                    }
+                    if pos > blanks {
+                        tokens.push(Token::new(TokenKind::Whitespace, blanks..pos));
+                    }
+                    if pos < eol {
+                        let kind =
+                            if text[pos] == b'#' { TokenKind::Comment } else { TokenKind::Error };
+                        tokens.push(Token::new(kind, pos..eol));
+                        pos = eol;
+                    }
+
+                    if let Some(content) =
+                        block_scalar_content(text, eol + 1, parent, explicit, checkpoints)
+                    {
+                        push_whitespace(text, pos..content.start, tokens);
+                        tokens.push(Token::new(TokenKind::String, content.clone()));
+                        pos = content.end;
+                    }
                 }
 
-                // Unknown
-                _ => {
+                // Merge key (<<: *defaults)
+                b'<' if text[pos..].starts_with(b"<<") => {
+                    pos += 2;
+                    tokens.push(Token::new(TokenKind::Operator, start..pos));
+                }
+
+                // Reserved indicators, which can't start a plain scalar
+                b'@' | b'`' => {
                     pos += 1;
                     tokens.push(Token::new(TokenKind::Error, start..pos));
                 }
+
+                // Other plain scalars, which may contain almost anything (cmd: echo $HOME).
+                // They end at a comment, flow indicator, or `: ` like a key.
+                _ => {
+                    pos += char_len(text, pos);
+                    while pos < text.len() && !ends_plain_scalar(text, pos) {
+                        pos += 1;
+                    }
+                    tokens.push(Token::new(TokenKind::Identifier, start..pos));
+                }
             }
         }
-
-        tokens
     }
 }
 
 #[cfg(test)]
 mod tests {
     use super::*;
+    use crate::syntax::Lexer;
 
     #[test]
     fn test_yaml_key_value() {
         let lexer = YamlLexer;
         let text = b"key: value\nnumber: 42";
         let tokens = lexer.tokenize(text);
-        
+
         let has_identifier = tokens.iter().any(|t| t.kind == TokenKind::Identifier);
         let has_number = tokens.iter().any(|t| t.kind == TokenKind::Number);
-        
+
         assert!(has_identifier);
         assert!(has_number);
     }
@@ -207,8 +406,56 @@ mod tests {
         let lexer = YamlLexer;
         let text = b"enabled: true\ndisabled: false";
         let tokens = lexer.tokenize(text);
-        
+
         let bools: Vec<_> = tokens.iter().filter(|t| t.kind == TokenKind::Boolean).collect();
         assert_eq!(bools.len(), 2);
     }
+
+    #[test]
+    fn test_yaml_plain_scalars() {
+        let text = b"base: &b {x: 1}\nmerged:\n  <<: *b\ncmd: echo $HOME/%s=;\nlist: [$a, $b]\n";
+        let tokens = YamlLexer.tokenize(text);
+        assert!(!tokens.iter().any(|t| t.kind == TokenKind::Error));
+        let texts: Vec<_> = tokens.iter().map(|t| &text[t.span.clone()]).collect();
+        assert!(texts.contains(&&b"<<"[..]));
+        assert!(texts.contains(&&b"$HOME/%s=;"[..]));
+        assert!(texts.contains(&&b"$a"[..]));
+
+        // Reserved indicators can't start one.
+        let tokens = YamlLexer.tokenize(b"a: @b");
+        assert_eq!(tokens[3], Token::new(TokenKind::Error, 3..4));
+    }
+
+    /// Returns the text of the string tokens of `text`.
+    fn strings(text: &str) -> Vec<&str> {
+        let tokens = YamlLexer.tokenize(text.as_bytes());
+        tokens
+            .iter()
+            .filter(|t| t.kind == TokenKind::String)
+            .map(|t| &text[t.span.clone()])
+            .collect()
+    }
+
+    #[test]
+    fn test_yaml_block_scalars() {
+        assert_eq!(strings("a: |\n  x: 1\n\n  y\n\nb: 2\n"), ["x: 1\n\n  y"]);
+        assert_eq!(strings("a: >-\r\n  x\r\n  y\r\nb: 2\r\n"), ["x\r\n  y"]);
+        assert_eq!(strings("- |\n x\n- y\n"), ["x"]);
+        assert_eq!(strings("- a: |\n    x\n  b: y\n"), ["x"]);
+        assert_eq!(strings("a:\n  |\n  x\nb: y\n"), ["x"]);
+        assert_eq!(strings("--- |\nx\n"), ["x"]);
+        assert_eq!(strings("a: !!str &anchor |\n  x\n"), ["x"]);
+
+        // Explicit indentation, with the indicators in either order.
+        assert_eq!(strings("a: |2\n    x\n  y\n z\n"), ["  x\n  y"]);
+        assert_eq!(strings("a: >+1 # c\n  x\n"), [" x"]);
+
+        // Empty scalars, and `|` and `>` that aren't block scalars.
+        assert_eq!(strings("a: |\nb: |\n\n"), [] as [&str; 0]);
+        assert_eq!(strings("a: |x\n  y\n"), [] as [&str; 0]);
+        assert_eq!(strings("a: b > c\n  d\n"), [] as [&str; 0]);
+
+        let tokens = YamlLexer.tokenize(b"a: | x\n  y\n");
+        assert!(tokens.contains(&Token::new(TokenKind::Error, 5..6)));
+    }
 }
@@ -0,0 +1,118 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//! Mapping between byte offsets and line numbers.
+
+use std::ops::Range;
+
+/// The UTF-8 byte order mark, U+FEFF.
+const BOM: &[u8] = b"\xEF\xBB\xBF";
+
+/// What the columns of [`LineIndex::position`] count.
+#[derive(Debug, Default, Clone, Copy, PartialEq, Eq)]
+pub enum Columns {
+    /// Bytes, like the offsets.
+    Bytes,
+    /// Characters, like editors show them, where a run of invalid UTF-8 is one `�`.
+    #[default]
+    Chars,
+}
+
+/// The lines of a document, which end at `\r\n`, `\n` or a lone `\r` alike.
+pub struct LineIndex {
+    /// The start of every line, and the end of its text before its line ending.
+    lines: Vec<Range<usize>>,
+}
+
+impl LineIndex {
+    pub fn new(text: &[u8]) -> Self {
+        let mut lines = Vec::with_capacity(text.len() / 32 + 1);
+        let mut start = 0;
+        let mut i = 0;
+        while i < text.len() {
+            let ending = match text[i] {
+                b'\r' if text.get(i + 1) == Some(&b'\n') => 2,
+                b'\r' | b'\n' => 1,
+                _ => {
+                    i += 1;
+                    continue;
+                }
+            };
+            lines.push(start..i);
+            i += ending;
+            start = i;
+        }
+        lines.push(start..text.len());
+        Self { lines }
+    }
+
+    /// The number of lines. A trailing line ending starts a new (empty) line.
+    pub fn count(&self) -> usize {
+        self.lines.len()
+    }
+
+    /// The 0-based line containing `offset`, where the line ending is part of the line.
+    pub fn line_of(&self, offset: usize) -> usize {
+        self.lines.partition_point(|line| line.start <= offset) - 1
+    }
+
+    /// The byte range of `line`, excluding its line ending.
+    pub fn range(&self, line: usize) -> Range<usize> {
+        self.lines[line].clone()
+    }
+
+    /// The 0-based line and column of `offset`, where the column counts what `columns` says.
+    pub fn position(&self, text: &[u8], offset: usize, columns: Columns) -> (usize, usize) {
+        let line = self.line_of(offset);
+        let start = self.lines[line].start;
+        let column = match columns {
+            Columns::Bytes => offset - start,
+            Columns::Chars => {
+                // Editors don't show the byte order mark.
+                let bom =
+                    if start == 0 && text.starts_with(BOM) { BOM.len().min(offset) } else { 0 };
+                String::from_utf8_lossy(&text[start + bom..offset]).chars().count()
+            }
+        };
+        (line, column)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_line_endings() {
+        // The same lines with every kind of line ending, and all of them mixed.
+        for text in ["a\nbé\n\nc", "a\r\nbé\r\n\r\nc", "a\rbé\r\rc", "a\r\nbé\n\rc"] {
+            let text = text.as_bytes();
+            let index = LineIndex::new(text);
+            let lines: Vec<_> = (0..index.count()).map(|l| &text[index.range(l)]).collect();
+            assert_eq!(lines, ["a".as_bytes(), "bé".as_bytes(), b"", b"c"], "{text:?}");
+
+            assert_eq!(index.position(text, text.len() - 1, Columns::Chars), (3, 0));
+            assert_eq!(index.position(text, index.range(1).end, Columns::Chars), (1, 2));
+            assert_eq!(index.position(text, index.range(1).end, Columns::Bytes), (1, 3));
+            // The line ending is part of its line.
+            assert_eq!(index.line_of(index.range(1).end), 1);
+            assert_eq!(index.line_of(index.range(2).start), 2);
+        }
+
+        let text = b"a\r\n\rb\n\r\nc\r";
+        let index = LineIndex::new(text);
+        assert_eq!(index.count(), 6);
+        let lines: Vec<_> = (0..index.count()).map(|l| index.range(l)).collect();
+        assert_eq!(lines, [0..1, 3..3, 4..5, 6..6, 8..9, 10..10]);
+        assert_eq!(index.position(text, 4, Columns::Chars), (2, 0));
+        assert_eq!(index.position(text, 10, Columns::Chars), (5, 0));
+
+        // The byte order mark takes no column, but three bytes.
+        let text = b"\xEF\xBB\xBFpackage \xE9\n";
+        let index = LineIndex::new(text);
+        assert_eq!(index.position(text, 3, Columns::Chars), (0, 0));
+        assert_eq!(index.position(text, 3, Columns::Bytes), (0, 3));
+        assert_eq!(index.position(text, 12, Columns::Chars), (0, 9));
+        assert_eq!(index.position(text, 12, Columns::Bytes), (0, 12));
+    }
+}
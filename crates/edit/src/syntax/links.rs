@@ -0,0 +1,274 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//! Detection of URLs and file paths inside comments and strings.
+//!
+//! Links are marked by splitting the comment or string token they're in: the link itself
+//! becomes a token of the same kind with a [`TokenPayload::Url`] or [`TokenPayload::FilePath`],
+//! so renderers that don't care about links keep working as before.
+
+use std::ops::Range;
+
+use crate::syntax::{Token, TokenKind, TokenPayload};
+
+const SCHEMES: &[&[u8]] = &[b"https://", b"http://", b"ftp://", b"www."];
+
+/// Mark the URLs (and if `paths` is set, the file paths) in the comment and string tokens.
+pub fn detect_links(text: &[u8], tokens: &mut Vec<Token>, paths: bool) {
+    let mut result: Option<Vec<Token>> = None;
+
+    for (i, token) in tokens.iter().enumerate() {
+        let links = match token.kind {
+            TokenKind::Comment
+            | TokenKind::DocComment
+            | TokenKind::String
+            | TokenKind::DocString
+                if token.payload.is_none() =>
+            {
+                find_links(text, token.span.clone(), paths)
+            }
+            _ => Vec::new(),
+        };
+        if links.is_empty() {
+            if let Some(result) = &mut result {
+                result.push(token.clone());
+            }
+            continue;
+        }
+
+        // Only copy the token stream once the first link shows up.
+        let result = result.get_or_insert_with(|| {
+            let mut v = Vec::with_capacity(tokens.len() + 2 * links.len());
+            v.extend_from_slice(&tokens[..i]);
+            v
+        });
+        let mut pos = token.span.start;
+        for (range, payload) in links {
+            if pos < range.start {
+                result.push(Token::new(token.kind, pos..range.start).with_scopes(token.scopes));
+            }
+            pos = range.end;
+            result.push(
+                Token::new(token.kind, range).with_scopes(token.scopes).with_payload(payload),
+            );
+        }
+        if pos < token.span.end {
+            result.push(Token::new(token.kind, pos..token.span.end).with_scopes(token.scopes));
+        }
+    }
+
+    if let Some(result) = result {
+        *tokens = result;
+    }
+}
+
+/// Split a file link like `src/main.rs:12:5` into the path, line and column.
+pub fn parse_file_link(link: &str) -> (&str, Option<usize>, Option<usize>) {
+    fn split_number(s: &str) -> Option<(&str, usize)> {
+        let (rest, num) = s.rsplit_once(':')?;
+        let num = num.parse().ok()?;
+        // Don't mistake the drive letter of `C:\foo` for anything.
+        (rest.len() > 1).then_some((rest, num))
+    }
+
+    match split_number(link) {
+        Some((rest, last)) => match split_number(rest) {
+            Some((path, line)) => (path, Some(line), Some(last)),
+            None => (rest, Some(last), None),
+        },
+        None => (link, None, None),
+    }
+}
+
+/// Find the links in `range`, in order.
+pub(crate) fn find_links(
+    text: &[u8],
+    range: Range<usize>,
+    paths: bool,
+) -> Vec<(Range<usize>, TokenPayload)> {
+    let mut links = Vec::new();
+    let mut pos = range.start;
+
+    while pos < range.end {
+        // Links start at the beginning of a word, possibly after an opening bracket or quote.
+        if is_word_break(text[pos]) || is_opening(text[pos]) {
+            pos += 1;
+            continue;
+        }
+        let start = pos;
+        while pos < range.end && !is_word_break(text[pos]) {
+            pos += 1;
+        }
+        let word = &text[start..pos];
+
+        if SCHEMES.iter().any(|s| word.len() > s.len() && word[..s.len()].eq_ignore_ascii_case(s)) {
+            let len = trim_trailing(word);
+            links.push((start..start + len, TokenPayload::Url));
+        } else if paths && !contains(word, b"://") {
+            let len = trim_trailing(word);
+            if is_path(&word[..len]) {
+                links.push((start..start + len, TokenPayload::FilePath));
+            }
+        }
+    }
+
+    links
+}
+
+/// Returns the length of `word` without the trailing punctuation which most likely
+/// belongs to the surrounding sentence. Closing brackets are kept if they're balanced,
+/// as in `https://en.wikipedia.org/wiki/Rust_(programming_language)`.
+fn trim_trailing(word: &[u8]) -> usize {
+    let mut len = word.len();
+    while len > 0 {
+        let b = word[len - 1];
+        let trim = match b {
+            b'.' | b',' | b';' | b':' | b'!' | b'?' | b'\'' | b'*' => true,
+            b')' => count(&word[..len], b'(') < count(&word[..len], b')'),
+            b']' => count(&word[..len], b'[') < count(&word[..len], b']'),
+            b'}' => count(&word[..len], b'{') < count(&word[..len], b'}'),
+            _ => false,
+        };
+        if !trim {
+            break;
+        }
+        len -= 1;
+    }
+    len
+}
+
+/// Checks whether `word` looks like a file path: it must be a Windows path (`C:\...`),
+/// start like a path (`/`, `./`, `../`, `~/`), or contain a `/` and end in a file name
+/// with an extension, optionally followed by `:line` or `:line:column`.
+fn is_path(word: &[u8]) -> bool {
+    if word.len() < 2 || contains(word, b"//") {
+        return false;
+    }
+    if word.len() > 3
+        && word[0].is_ascii_alphabetic()
+        && word[1] == b':'
+        && matches!(word[2], b'\\' | b'/')
+    {
+        return true;
+    }
+    let valid = |w: &[u8]| {
+        w.iter().all(|&b| {
+            b.is_ascii_alphanumeric()
+                || matches!(b, b'/' | b'.' | b'_' | b'-' | b'~' | b':' | b'@' | b'+')
+        })
+    };
+    if !valid(word) {
+        return false;
+    }
+    if [&b"/"[..], b"./", b"../", b"~/"].iter().any(|p| word.starts_with(p)) && word.len() > 2 {
+        return word[1..].iter().any(|b| b.is_ascii_alphanumeric());
+    }
+
+    let path = match parse_file_link(std::str::from_utf8(word).unwrap_or_default()) {
+        ("", ..) => return false,
+        (path, ..) => path.as_bytes(),
+    };
+    let Some(slash) = path.iter().rposition(|&b| b == b'/') else {
+        return false;
+    };
+    let name = &path[slash + 1..];
+    match name.iter().rposition(|&b| b == b'.') {
+        Some(dot) => {
+            dot > 0
+                && dot + 1 < name.len()
+                && name[dot + 1..].iter().all(|b| b.is_ascii_alphanumeric())
+        }
+        None => false,
+    }
+}
+
+fn is_word_break(b: u8) -> bool {
+    b.is_ascii_whitespace() || matches!(b, b'"' | b'\'' | b'`' | b'<' | b'>') || b < 0x20
+}
+
+fn is_opening(b: u8) -> bool {
+    matches!(b, b'(' | b'[' | b'{')
+}
+
+fn count(haystack: &[u8], needle: u8) -> usize {
+    haystack.iter().filter(|&&b| b == needle).count()
+}
+
+fn contains(haystack: &[u8], needle: &[u8]) -> bool {
+    haystack.windows(needle.len()).any(|w| w == needle)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::syntax::{Language, LexerRegistry};
+
+    fn links(language: Language, text: &str, paths: bool) -> Vec<(&str, TokenPayload)> {
+        let mut tokens = LexerRegistry::get_lexer(language).tokenize(text.as_bytes());
+        detect_links(text.as_bytes(), &mut tokens, paths);
+        tokens.iter().filter_map(|t| Some((&text[t.span.clone()], t.payload?))).collect()
+    }
+
+    #[test]
+    fn test_links_urls() {
+        let text = "// See https://example.com/search?q=rust&lang=en, or www.example.org.\n";
+        assert_eq!(
+            links(Language::Go, text, false),
+            vec![
+                ("https://example.com/search?q=rust&lang=en", TokenPayload::Url),
+                ("www.example.org", TokenPayload::Url),
+            ]
+        );
+    }
+
+    #[test]
+    fn test_links_parentheses() {
+        let text = "# (see https://en.wikipedia.org/wiki/Rust_(programming_language))\n";
+        assert_eq!(
+            links(Language::Python, text, false),
+            vec![("https://en.wikipedia.org/wiki/Rust_(programming_language)", TokenPayload::Url)]
+        );
+    }
+
+    #[test]
+    fn test_links_strings() {
+        let text = r#"url := "https://golang.org/pkg/" // comment"#;
+        assert_eq!(
+            links(Language::Go, text, false),
+            vec![("https://golang.org/pkg/", TokenPayload::Url)]
+        );
+    }
+
+    #[test]
+    fn test_links_wrapped_comment() {
+        // A URL broken across two comment lines is two separate things, not one glued link.
+        let text = "// https://example.com/a/very/long\n// /path/continuation\n";
+        assert_eq!(
+            links(Language::Go, text, false),
+            vec![("https://example.com/a/very/long", TokenPayload::Url)]
+        );
+    }
+
+    #[test]
+    fn test_links_paths() {
+        let text =
+            "// Fails in foo/bar.go:42, see C:\\Users\\me\\log.txt and ./run.sh or and/or.\n";
+        assert_eq!(
+            links(Language::Go, text, true),
+            vec![
+                ("foo/bar.go:42", TokenPayload::FilePath),
+                ("C:\\Users\\me\\log.txt", TokenPayload::FilePath),
+                ("./run.sh", TokenPayload::FilePath),
+            ]
+        );
+        assert_eq!(links(Language::Go, text, false), vec![]);
+    }
+
+    #[test]
+    fn test_parse_file_link() {
+        assert_eq!(parse_file_link("foo/bar.go:42"), ("foo/bar.go", Some(42), None));
+        assert_eq!(parse_file_link("src/main.rs:12:5"), ("src/main.rs", Some(12), Some(5)));
+        assert_eq!(parse_file_link("C:\\log.txt"), ("C:\\log.txt", None, None));
+        assert_eq!(parse_file_link("C:12"), ("C:12", None, None));
+    }
+}
@@ -0,0 +1,149 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//! Highlighting files with lines too long to highlight, like minified JavaScript.
+//!
+//! A line longer than the limit is only lexed up to it, and the rest of it is plain
+//! [`TokenKind::Text`].
+//! The lexer starts over after the line, as if the document began there, so that a string
+//! the cutoff left open doesn't run into the lines below.
+
+use crate::syntax::{Lexer, Token, TokenKind, TokenPayload};
+
+/// Tokenize `text` with `lexer`, but lines longer than `max_line_length` bytes only up to
+/// that length, see the [module docs](self).
+///
+/// The cutoff moves back to the start of the character it would split. A string or
+/// comment that reaches it is flagged [`TokenPayload::Invalid`], because it was cut off
+/// before it ended, as far as anyone can tell without lexing the rest of the line.
+pub fn tokenize_long_lines(lexer: &dyn Lexer, text: &[u8], max_line_length: usize) -> Vec<Token> {
+    let mut tokens = Vec::new();
+    // Where the lexer starts over.
+    let mut start = 0;
+    let mut line_start = 0;
+    while line_start < text.len() {
+        let line_end = text[line_start..]
+            .iter()
+            .position(|&b| b == b'\n')
+            .map_or(text.len(), |i| line_start + i);
+        if line_end - line_start > max_line_length {
+            let mut cutoff = line_start + max_line_length;
+            // Back to the lead byte, unless it's invalid UTF-8 without one.
+            let lead = (cutoff.saturating_sub(3).max(line_start)..=cutoff)
+                .rev()
+                .find(|&i| text[i] & 0xC0 != 0x80);
+            cutoff = lead.unwrap_or(cutoff);
+
+            lex_segment(lexer, text, start, cutoff, &mut tokens);
+            flag_cut_off(&mut tokens, cutoff);
+            tokens.push(Token::new(TokenKind::Text, cutoff..line_end));
+            start = line_end;
+        }
+        line_start = line_end + 1;
+    }
+    lex_segment(lexer, text, start, text.len(), &mut tokens);
+    tokens
+}
+
+/// Flag the last of the `tokens` [`TokenPayload::Invalid`] if it's a string or comment that
+/// runs up to the `cutoff` of its line.
+pub(crate) fn flag_cut_off(tokens: &mut [Token], cutoff: usize) {
+    if let Some(last) = tokens.last_mut()
+        && last.span.end == cutoff
+        && matches!(
+            last.kind,
+            TokenKind::String
+                | TokenKind::Char
+                | TokenKind::DocString
+                | TokenKind::Regex
+                | TokenKind::Comment
+                | TokenKind::DocComment
+        )
+    {
+        last.payload = Some(TokenPayload::Invalid);
+    }
+}
+
+/// Append the tokens of `text[start..end]`, lexed as a document of its own.
+fn lex_segment(lexer: &dyn Lexer, text: &[u8], start: usize, end: usize, tokens: &mut Vec<Token>) {
+    if start == end {
+        return;
+    }
+    tokens.extend(lexer.tokenize(&text[start..end]).into_iter().map(|mut token| {
+        token.span = start + token.span.start..start + token.span.end;
+        token
+    }));
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::syntax::{Language, LexerRegistry};
+
+    fn kinds<'a>(text: &'a [u8], tokens: &[Token]) -> Vec<(TokenKind, &'a str)> {
+        let token_text = |t: &Token| std::str::from_utf8(&text[t.span.clone()]).unwrap();
+        tokens
+            .iter()
+            .filter(|t| t.kind != TokenKind::Whitespace)
+            .map(|t| (t.kind, token_text(t)))
+            .collect()
+    }
+
+    #[test]
+    fn test_minified() {
+        // A megabyte of minified JavaScript on one line, between two short ones.
+        let lexer = LexerRegistry::get_lexer(Language::JavaScript);
+        let line = "var a=f(1,\"x\");".repeat((1 << 20) / 15);
+        let text = format!("let first = 1;\n{line}\nlet last = 2;\n");
+        let tokens = tokenize_long_lines(&*lexer, text.as_bytes(), 1000);
+
+        let cutoff = 15 + 1000;
+        let plain = tokens.iter().position(|t| t.span.start == cutoff).unwrap();
+        assert_eq!(tokens[plain], Token::new(TokenKind::Text, cutoff..15 + line.len()));
+        let last = 16 + line.len();
+        assert_eq!(
+            kinds(text.as_bytes(), &tokens[plain + 1..]),
+            kinds(&text.as_bytes()[last..], &lexer.tokenize(&text.as_bytes()[last..])),
+        );
+
+        // Short lines are lexed as usual.
+        let text = include_bytes!("../../../../syntax-tests/test_syntax.js");
+        assert_eq!(tokenize_long_lines(&*lexer, text, 1000), lexer.tokenize(text));
+    }
+
+    #[test]
+    fn test_characters() {
+        // The cutoff doesn't split the `€`, whose bytes are 4..7.
+        let lexer = LexerRegistry::get_lexer(Language::Go);
+        for max in 4..7 {
+            let tokens = tokenize_long_lines(&*lexer, "abc €€".as_bytes(), max);
+            assert_eq!(tokens.last().unwrap().span, 4..10, "at most {max} bytes");
+        }
+        let tokens = tokenize_long_lines(&*lexer, "abc €€".as_bytes(), 7);
+        assert_eq!(tokens.last().unwrap().span, 7..10);
+    }
+
+    #[test]
+    fn test_open_strings() {
+        // A raw string the cutoff leaves open doesn't run into the next line.
+        let lexer = LexerRegistry::get_lexer(Language::Go);
+        let text = b"x := `raw string that goes on and on\ny := 1\n";
+        let tokens = tokenize_long_lines(&*lexer, text, 20);
+        let string = tokens.iter().find(|t| t.kind == TokenKind::String).unwrap();
+        assert_eq!((string.span.clone(), string.payload), (5..20, Some(TokenPayload::Invalid)));
+        assert_eq!(
+            kinds(text, &tokens[tokens.iter().position(|t| t.span.start == 20).unwrap()..]),
+            [
+                (TokenKind::Text, "t goes on and on"),
+                (TokenKind::Identifier, "y"),
+                (TokenKind::Operator, ":="),
+                (TokenKind::Number, "1"),
+            ],
+        );
+
+        // A comment, too.
+        let tokens = tokenize_long_lines(&*lexer, b"a := 1 // comment\n", 12);
+        let comment = tokens.iter().find(|t| t.kind == TokenKind::Comment).unwrap();
+        assert_eq!((comment.span.clone(), comment.payload), (7..12, Some(TokenPayload::Invalid)));
+    }
+}
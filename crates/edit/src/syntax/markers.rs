@@ -0,0 +1,227 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//! Action markers like `TODO` and `FIXME` inside comments.
+//!
+//! Like links, markers are marked by splitting the comment token they're in: the marker
+//! becomes a token of the same kind with a [`TokenPayload::CommentKeyword`], so that it
+//! can stand out from a dimmed comment while everything else treats it as part of it.
+
+use std::ops::Range;
+
+use crate::syntax::{Token, TokenKind, TokenPayload};
+
+/// The markers [`HighlightOptions::comment_keywords`](crate::syntax::HighlightOptions::comment_keywords)
+/// usually holds.
+pub const DEFAULT_COMMENT_KEYWORDS: [&str; 5] = ["TODO", "FIXME", "XXX", "HACK", "NOTE"];
+
+/// Mark the `keywords` in the comment tokens, like `TODO` in `// TODO: ...`.
+///
+/// A keyword must be a word of its own: it's matched case-sensitively, and neither preceded
+/// nor followed by a letter, digit or `_`, so `TODOist` is no marker. An attribution like
+/// `(alice)` and a `:` directly after it belong to the marker, as in `TODO(alice):`.
+pub fn mark_comment_keywords(text: &[u8], tokens: &mut Vec<Token>, keywords: &[String]) {
+    if keywords.iter().all(|k| k.is_empty()) {
+        return;
+    }
+    let mut result: Option<Vec<Token>> = None;
+
+    for (i, token) in tokens.iter().enumerate() {
+        let markers = match token.kind {
+            TokenKind::Comment | TokenKind::DocComment if token.payload.is_none() => {
+                find_markers(text, token.span.clone(), keywords)
+            }
+            _ => Vec::new(),
+        };
+        if markers.is_empty() {
+            if let Some(result) = &mut result {
+                result.push(token.clone());
+            }
+            continue;
+        }
+
+        // Only copy the token stream once the first marker shows up.
+        let result = result.get_or_insert_with(|| {
+            let mut v = Vec::with_capacity(tokens.len() + 2 * markers.len());
+            v.extend_from_slice(&tokens[..i]);
+            v
+        });
+        let mut pos = token.span.start;
+        for range in markers {
+            if pos < range.start {
+                result.push(Token::new(token.kind, pos..range.start).with_scopes(token.scopes));
+            }
+            pos = range.end;
+            result.push(
+                Token::new(token.kind, range)
+                    .with_scopes(token.scopes)
+                    .with_payload(TokenPayload::CommentKeyword),
+            );
+        }
+        if pos < token.span.end {
+            result.push(Token::new(token.kind, pos..token.span.end).with_scopes(token.scopes));
+        }
+    }
+
+    if let Some(result) = result {
+        *tokens = result;
+    }
+}
+
+/// Find the markers in `range`, in order.
+fn find_markers(text: &[u8], range: Range<usize>, keywords: &[String]) -> Vec<Range<usize>> {
+    let mut markers = Vec::new();
+    let mut pos = range.start;
+
+    while pos < range.end {
+        let keyword = keywords.iter().map(|k| k.as_bytes()).find(|k| {
+            !k.is_empty()
+                && text[pos..range.end].starts_with(k)
+                && !is_word_char_before(text, range.start, pos)
+                && !is_word_char_at(text, pos + k.len(), range.end)
+        });
+        let Some(keyword) = keyword else {
+            pos += 1;
+            continue;
+        };
+
+        let start = pos;
+        pos += keyword.len();
+        pos += attribution_len(&text[pos..range.end]);
+        if text[pos..range.end].starts_with(b":") {
+            pos += 1;
+        }
+        markers.push(start..pos);
+    }
+
+    markers
+}
+
+/// Returns the length of the `(name)` at the start of `s`, or 0 if there's none.
+fn attribution_len(s: &[u8]) -> usize {
+    if !s.starts_with(b"(") {
+        return 0;
+    }
+    match s[1..].iter().position(|&b| matches!(b, b')' | b'(') || b.is_ascii_whitespace()) {
+        Some(len) if len > 0 && s[1 + len] == b')' => len + 2,
+        _ => 0,
+    }
+}
+
+/// Whether the char before `pos`, within the token starting at `start`, continues a word.
+fn is_word_char_before(text: &[u8], start: usize, pos: usize) -> bool {
+    // Step back over UTF-8 continuation bytes to the start of the char.
+    let mut begin = pos;
+    while begin > start {
+        begin -= 1;
+        if text[begin] & 0xC0 != 0x80 {
+            return is_word_char_at(text, begin, pos);
+        }
+    }
+    false
+}
+
+/// Whether the char at `pos`, which must be before `end`, continues a word.
+fn is_word_char_at(text: &[u8], pos: usize, end: usize) -> bool {
+    let len = text[pos..end].len().min(4);
+    let s = match std::str::from_utf8(&text[pos..pos + len]) {
+        Ok(s) => s,
+        Err(err) => std::str::from_utf8(&text[pos..pos + err.valid_up_to()]).unwrap_or_default(),
+    };
+    s.chars().next().is_some_and(|ch| ch.is_alphanumeric() || ch == '_')
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::syntax::{Language, LexerRegistry};
+
+    fn markers(language: Language, text: &str) -> Vec<&str> {
+        let keywords = DEFAULT_COMMENT_KEYWORDS.map(String::from);
+        let mut tokens = LexerRegistry::get_lexer(language).tokenize(text.as_bytes());
+        mark_comment_keywords(text.as_bytes(), &mut tokens, &keywords);
+        tokens
+            .iter()
+            .filter(|t| t.payload == Some(TokenPayload::CommentKeyword))
+            .map(|t| &text[t.span.clone()])
+            .collect()
+    }
+
+    #[test]
+    fn test_marker_boundaries() {
+        assert_eq!(markers(Language::Go, "// TODO: x"), ["TODO:"]);
+        assert_eq!(markers(Language::Go, "//TODO(bob): x"), ["TODO(bob):"]);
+        assert_eq!(markers(Language::Go, "// (FIXME) XXX, HACK."), ["FIXME", "XXX", "HACK"]);
+        assert_eq!(markers(Language::Go, "// TODOist TODO_ xTODO éTODO Todo todo"), [""; 0]);
+        // Without a closing parenthesis, or with spaces inside, there's no attribution.
+        assert_eq!(markers(Language::Go, "// TODO(bob x"), ["TODO"]);
+        assert_eq!(markers(Language::Go, "// TODO(a b): x"), ["TODO"]);
+        assert_eq!(markers(Language::Go, "// TODO(): x"), ["TODO"]);
+        // Markers only count in comments.
+        assert_eq!(markers(Language::Go, "x := \"TODO\" // NOTE"), ["NOTE"]);
+    }
+
+    #[test]
+    fn test_comment_styles() {
+        assert_eq!(markers(Language::C, "/* FIXME\n * TODO: y */"), ["FIXME", "TODO:"]);
+        assert_eq!(markers(Language::Rust, "/// NOTE: x\n//! HACK\n"), ["NOTE:", "HACK"]);
+        assert_eq!(markers(Language::Python, "# XXX: x\n"), ["XXX:"]);
+        assert_eq!(markers(Language::Sql, "-- TODO\n"), ["TODO"]);
+        assert_eq!(markers(Language::Html, "<!-- TODO -->"), ["TODO"]);
+    }
+
+    #[test]
+    fn test_custom_keywords() {
+        let text = b"// BUG: x TODO";
+        let mut tokens = LexerRegistry::get_lexer(Language::Go).tokenize(text);
+        let original = tokens.clone();
+        mark_comment_keywords(text, &mut tokens, &[]);
+        assert_eq!(tokens, original);
+
+        mark_comment_keywords(text, &mut tokens, &["BUG".to_string()]);
+        let spans: Vec<_> = tokens.iter().map(|t| (t.span.clone(), t.payload)).collect();
+        assert_eq!(
+            spans,
+            [(0..3, None), (3..7, Some(TokenPayload::CommentKeyword)), (7..14, None)]
+        );
+    }
+
+    #[test]
+    fn test_go_fixture() {
+        let text = include_bytes!("../../../../syntax-tests/test_syntax.go");
+        let keywords = DEFAULT_COMMENT_KEYWORDS.map(String::from);
+        let mut tokens = LexerRegistry::get_lexer(Language::Go).tokenize(text);
+        let comments = tokens.clone();
+        mark_comment_keywords(text, &mut tokens, &keywords);
+
+        let marked: Vec<_> = tokens
+            .iter()
+            .filter(|t| t.payload == Some(TokenPayload::CommentKeyword))
+            .map(|t| (t.kind, std::str::from_utf8(&text[t.span.clone()]).unwrap()))
+            .collect();
+        assert_eq!(
+            marked,
+            [
+                (TokenKind::DocComment, "TODO(alice):"),
+                (TokenKind::DocComment, "NOTE"),
+                (TokenKind::Comment, "FIXME:"),
+                (TokenKind::Comment, "XXX"),
+                (TokenKind::Comment, "HACK"),
+                (TokenKind::Comment, "NOTE:"),
+            ]
+        );
+
+        // Splitting leaves the comments where they were.
+        let covered = |tokens: &[Token]| -> Vec<(usize, usize)> {
+            let mut ranges: Vec<(usize, usize)> = Vec::new();
+            for t in tokens.iter().filter(|t| t.kind.is_comment()) {
+                match ranges.last_mut() {
+                    Some(last) if last.1 == t.span.start => last.1 = t.span.end,
+                    _ => ranges.push((t.span.start, t.span.end)),
+                }
+            }
+            ranges
+        };
+        assert_eq!(covered(&tokens), covered(&comments));
+    }
+}
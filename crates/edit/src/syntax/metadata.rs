@@ -0,0 +1,686 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//! Static per-language information that editor features build on top of the lexers.
+//!
+//! Lexers only describe what the text *is*. Everything else a feature needs to know
+//! about a language (which brackets it has, what folds, how to indent, ...) is declared
+//! here, so that adding a language doesn't require touching every feature.
+
+use crate::syntax::diagnostics::{
+    DiagnosticHook, javascript_diagnostics, json_diagnostics, python_diagnostics, yaml_diagnostics,
+};
+use crate::syntax::folding::{FoldingHook, indentation_folds};
+use crate::syntax::indent::{IndentHook, yaml_indent};
+use crate::syntax::outline::{OutlineHook, css_outline, go_outline, markdown_outline};
+use crate::syntax::selection::{SelectionHook, markdown_selection};
+use crate::syntax::{Language, TokenKind};
+
+/// Metadata describing a language's grammar.
+#[derive(Debug, Clone, Copy)]
+pub struct GrammarMetadata {
+    /// Bracket pairs as `(opener, closer)`.
+    ///
+    /// Only single-byte punctuation tokens are considered brackets, so brackets
+    /// inside strings, comments and character literals are never matched.
+    pub brackets: &'static [(u8, u8)],
+    /// Blocks delimited by keywords, e.g. `if ... fi`. They're matched, folded
+    /// and colored like brackets, but only keyword tokens count.
+    pub keyword_pairs: &'static [KeywordPair],
+    /// Whether keywords are the same whatever their ASCII case, like SQL's `SELECT` and
+    /// `select`. This applies to the keywords here, like [`keyword_pairs`](Self::keyword_pairs),
+    /// and lexers fold the words they look up among their own, like SQL's types and functions.
+    pub case_insensitive_keywords: bool,
+    /// Which constructs can be folded.
+    pub folding: FoldingRules,
+    /// How lines are indented.
+    pub indent: IndentRules,
+    /// Token kinds which contain prose, e.g. for spell checking.
+    pub prose: &'static [TokenKind],
+    /// Computes the symbol outline.
+    pub outline: Option<OutlineHook>,
+    /// Pairs which are closed automatically when typing the opening character.
+    pub auto_close: &'static [AutoClosePair],
+    /// Pairs a selection can be surrounded with, as `(open, close)`.
+    pub surround: &'static [(u8, u8)],
+    /// How to write comments, e.g. for toggling them.
+    pub comments: CommentSyntax,
+    /// How functions are defined and called, for telling the two apart.
+    pub functions: FunctionRules,
+    /// Adds ranges for "expand selection" beyond brackets, lines and folds.
+    pub selection: Option<SelectionHook>,
+    /// Flags invalid and deprecated constructs.
+    pub diagnostics: Option<DiagnosticHook>,
+    /// Backslash escapes in string and character literals, if the language has them.
+    pub escapes: Option<EscapeRules>,
+}
+
+/// How escape sequences are written in a language.
+///
+/// See [`split_escapes`](crate::syntax::split_escapes) for how the fields are used.
+#[derive(Debug, Clone, Copy)]
+pub struct EscapeRules {
+    /// Openers of literals without escapes, compared ignoring ASCII case,
+    /// e.g. `r"` for raw strings.
+    pub raw: &'static [&'static str],
+    /// Whether `%` starts a verb like `%d` in string literals, as in Go's `fmt` package.
+    pub format_verbs: bool,
+    /// The characters that escape on their own after a backslash, like the `n` of `\n`,
+    /// if the language rejects the others. Code points like `\x41` must then have all
+    /// their digits, and name a valid `char`.
+    pub single: Option<&'static str>,
+}
+
+/// How a language defines and calls functions.
+///
+/// See [`classify_functions`](crate::syntax::classify_functions) for how the fields are used.
+#[derive(Debug, Clone, Copy)]
+pub struct FunctionRules {
+    /// Keywords followed by the name of the function they define, e.g. `def`.
+    pub keywords: &'static [&'static str],
+    /// Whether `name(...) {` defines a function, as in C.
+    pub body_follows: bool,
+    /// Whether `name(` calls a function.
+    pub calls: bool,
+}
+
+/// How comments are written in a language.
+#[derive(Debug, Clone, Copy)]
+pub struct CommentSyntax {
+    /// The leader of line comments, e.g. `//`.
+    pub line: Option<&'static str>,
+    /// The delimiters of block comments, e.g. `("/*", "*/")`.
+    pub block: Option<(&'static str, &'static str)>,
+    /// Whether block comments nest, as in Rust.
+    pub nested: bool,
+}
+
+/// A pair of characters where typing the first one also inserts the second one.
+///
+/// See [`should_auto_close`](crate::syntax::should_auto_close) for how the fields are used.
+#[derive(Debug, Clone, Copy)]
+pub struct AutoClosePair {
+    pub open: u8,
+    pub close: u8,
+    /// Token kinds at the cursor in which the pair isn't closed, e.g. strings for quotes.
+    pub not_in: &'static [TokenKind],
+    /// Bytes right before the cursor after which the pair isn't closed,
+    /// e.g. `&` for Rust's lifetimes.
+    pub not_after: &'static [u8],
+    /// String prefixes after which a quote is still closed, e.g. `f` for `f"..."`.
+    /// Quotes aren't closed after any other word, so that typing `don't` doesn't add a `'`.
+    pub prefixes: &'static [&'static str],
+}
+
+/// A block delimited by keywords.
+#[derive(Debug, Clone, Copy)]
+pub struct KeywordPair {
+    /// Keywords which start the block, e.g. `if`.
+    pub open: &'static [&'static str],
+    /// Keywords which belong to the innermost enclosing block, e.g. `else`.
+    pub middle: &'static [&'static str],
+    /// The keyword which ends the block, e.g. `fi`.
+    pub close: &'static str,
+}
+
+/// Describes which constructs of a language can be folded.
+#[derive(Debug, Clone, Copy)]
+pub struct FoldingRules {
+    /// Fold bracket pairs spanning multiple lines.
+    pub brackets: bool,
+    /// Fold multi-line comments and runs of line comments.
+    pub comments: bool,
+    /// Fold multi-line strings.
+    pub strings: bool,
+    /// Keywords that start an import line, e.g. `import` or `#include`.
+    /// Runs of such lines are folded together.
+    pub imports: &'static [&'static str],
+    /// Start and end markers of explicit regions, e.g. `#pragma region`.
+    /// Whitespace is ignored when matching them, so `//#region` also matches `// #region`.
+    pub region_markers: Option<(&'static str, &'static str)>,
+    /// Fold Markdown-style sections from one heading to the next one of the same or a higher level.
+    pub headings: bool,
+    /// Computes additional ranges, e.g. for indentation based languages.
+    pub hook: Option<FoldingHook>,
+}
+
+/// Describes how the indentation changes from one line to the next.
+///
+/// Opening and closing brackets are always taken into account. The lists below
+/// are matched against the text of the first/last token of a line, ignoring comments.
+#[derive(Debug, Clone, Copy)]
+pub struct IndentRules {
+    /// Tokens which indent the next line when they end a line, e.g. `:` in Python.
+    pub increase_after: &'static [&'static str],
+    /// Operators which continue a statement on the next line when they end a line.
+    /// The continuation is indented once, and the line after it goes back.
+    pub continuations: &'static [&'static str],
+    /// Keywords which end a block when they start a line, e.g. `return` in Python.
+    pub decrease_after: &'static [&'static str],
+    /// Decides cases the lists above can't express. Runs before them.
+    pub hook: Option<IndentHook>,
+}
+
+/// The bracket pairs shared by virtually all languages.
+pub const DEFAULT_BRACKETS: &[(u8, u8)] = &[(b'(', b')'), (b'[', b']'), (b'{', b'}')];
+
+impl CommentSyntax {
+    /// The language has no comments.
+    pub const NONE: Self = Self { line: None, block: None, nested: false };
+
+    /// `//` and `/* */`, as in C.
+    pub const C: Self = Self { line: Some("//"), block: Some(("/*", "*/")), nested: false };
+
+    /// Only `#` line comments, as in shell scripts.
+    pub const HASH: Self = Self { line: Some("#"), block: None, nested: false };
+
+    /// Only `/* */` block comments, as in CSS.
+    pub const BLOCK: Self = Self { line: None, block: Some(("/*", "*/")), nested: false };
+
+    /// Only `<!-- -->` block comments, as in HTML.
+    pub const MARKUP: Self = Self { line: None, block: Some(("<!--", "-->")), nested: false };
+}
+
+impl AutoClosePair {
+    /// A bracket, which is closed everywhere.
+    pub const fn bracket(open: u8, close: u8) -> Self {
+        Self { open, close, not_in: &[], not_after: &[], prefixes: &[] }
+    }
+
+    /// A quote, which isn't closed inside comments and strings.
+    pub const fn quote(quote: u8) -> Self {
+        Self {
+            open: quote,
+            close: quote,
+            not_in: &[
+                TokenKind::Comment,
+                TokenKind::DocComment,
+                TokenKind::String,
+                TokenKind::DocString,
+            ],
+            not_after: &[],
+            prefixes: &[],
+        }
+    }
+
+    /// A character literal quote, which additionally isn't closed inside character literals.
+    pub const fn char_quote(quote: u8) -> Self {
+        Self {
+            not_in: &[
+                TokenKind::Comment,
+                TokenKind::DocComment,
+                TokenKind::String,
+                TokenKind::DocString,
+                TokenKind::Char,
+            ],
+            ..Self::quote(quote)
+        }
+    }
+}
+
+const PAREN: AutoClosePair = AutoClosePair::bracket(b'(', b')');
+const SQUARE: AutoClosePair = AutoClosePair::bracket(b'[', b']');
+const CURLY: AutoClosePair = AutoClosePair::bracket(b'{', b'}');
+const DOUBLE_QUOTE: AutoClosePair = AutoClosePair::quote(b'"');
+const SINGLE_QUOTE: AutoClosePair = AutoClosePair::quote(b'\'');
+const BACKTICK: AutoClosePair = AutoClosePair::quote(b'`');
+const CHAR_QUOTE: AutoClosePair = AutoClosePair::char_quote(b'\'');
+
+const DEFAULT_SURROUND: &[(u8, u8)] =
+    &[(b'(', b')'), (b'[', b']'), (b'{', b'}'), (b'"', b'"'), (b'\'', b'\'')];
+const BACKTICK_SURROUND: &[(u8, u8)] =
+    &[(b'(', b')'), (b'[', b']'), (b'{', b'}'), (b'"', b'"'), (b'\'', b'\''), (b'`', b'`')];
+const PROSE_SURROUND: &[(u8, u8)] = &[
+    (b'(', b')'),
+    (b'[', b']'),
+    (b'{', b'}'),
+    (b'"', b'"'),
+    (b'\'', b'\''),
+    (b'`', b'`'),
+    (b'*', b'*'),
+    (b'_', b'_'),
+];
+
+impl FoldingRules {
+    /// The folding rules used unless a language overrides them.
+    pub const DEFAULT: Self = Self {
+        brackets: true,
+        comments: true,
+        strings: true,
+        imports: &[],
+        region_markers: None,
+        headings: false,
+        hook: None,
+    };
+
+    /// Nothing folds.
+    pub const NONE: Self = Self {
+        brackets: false,
+        comments: false,
+        strings: false,
+        imports: &[],
+        region_markers: None,
+        headings: false,
+        hook: None,
+    };
+}
+
+impl FunctionRules {
+    /// Functions aren't told apart from other identifiers.
+    pub const NONE: Self = Self { keywords: &[], body_follows: false, calls: false };
+
+    /// Languages in which a definition is a call followed by a body.
+    pub const C: Self = Self { keywords: &[], body_follows: true, calls: true };
+}
+
+impl IndentRules {
+    /// Only brackets affect the indentation.
+    pub const DEFAULT: Self =
+        Self { increase_after: &[], continuations: &[], decrease_after: &[], hook: None };
+}
+
+impl EscapeRules {
+    /// Every literal has escapes, and any character can be escaped.
+    pub const DEFAULT: Self = Self { raw: &[], format_verbs: false, single: None };
+}
+
+/// Binary operators which continue an expression in C-like languages.
+const C_CONTINUATIONS: &[&str] = &["&&", "||", "+", "-", "*", "/", "%", "=", "?"];
+
+impl GrammarMetadata {
+    /// The metadata used unless a language overrides it.
+    pub const DEFAULT: Self = Self {
+        brackets: DEFAULT_BRACKETS,
+        keyword_pairs: &[],
+        case_insensitive_keywords: false,
+        folding: FoldingRules::DEFAULT,
+        indent: IndentRules::DEFAULT,
+        prose: &[
+            TokenKind::Comment,
+            TokenKind::DocComment,
+            TokenKind::String,
+            TokenKind::DocString,
+        ],
+        outline: None,
+        auto_close: &[PAREN, SQUARE, CURLY, DOUBLE_QUOTE, SINGLE_QUOTE],
+        surround: DEFAULT_SURROUND,
+        comments: CommentSyntax::C,
+        functions: FunctionRules::NONE,
+        selection: None,
+        diagnostics: None,
+        escapes: None,
+    };
+
+    /// Metadata for languages without any structure.
+    pub const PLAIN: Self = Self {
+        brackets: &[],
+        keyword_pairs: &[],
+        case_insensitive_keywords: false,
+        folding: FoldingRules::NONE,
+        indent: IndentRules::DEFAULT,
+        prose: &[TokenKind::Identifier],
+        outline: None,
+        auto_close: &[PAREN, SQUARE, CURLY, DOUBLE_QUOTE],
+        surround: DEFAULT_SURROUND,
+        comments: CommentSyntax::NONE,
+        functions: FunctionRules::NONE,
+        selection: None,
+        diagnostics: None,
+        escapes: None,
+    };
+
+    /// Returns the closer for `opener`, if it's an opening bracket.
+    pub fn closer_of(&self, opener: u8) -> Option<u8> {
+        self.brackets.iter().find(|&&(open, _)| open == opener).map(|&(_, close)| close)
+    }
+
+    /// Returns true if `b` is a closing bracket.
+    pub fn is_closer(&self, b: u8) -> bool {
+        self.brackets.iter().any(|&(_, close)| close == b)
+    }
+
+    /// Returns true if `word` is `keyword`, regardless of ASCII case if the language's
+    /// [`case_insensitive_keywords`](Self::case_insensitive_keywords) are.
+    pub fn is_keyword(&self, word: &[u8], keyword: &str) -> bool {
+        if self.case_insensitive_keywords {
+            word.eq_ignore_ascii_case(keyword.as_bytes())
+        } else {
+            word == keyword.as_bytes()
+        }
+    }
+}
+
+const C: GrammarMetadata = GrammarMetadata {
+    folding: FoldingRules {
+        imports: &["#include"],
+        region_markers: Some(("#pragma region", "#pragma endregion")),
+        ..FoldingRules::DEFAULT
+    },
+    indent: IndentRules {
+        increase_after: &[":"],
+        continuations: C_CONTINUATIONS,
+        ..IndentRules::DEFAULT
+    },
+    auto_close: &[
+        PAREN,
+        SQUARE,
+        CURLY,
+        AutoClosePair {
+            prefixes: &["L", "u", "U", "u8", "R", "LR", "uR", "UR", "u8R"],
+            ..DOUBLE_QUOTE
+        },
+        AutoClosePair { prefixes: &["L", "u", "U", "u8"], ..CHAR_QUOTE },
+    ],
+    functions: FunctionRules::C,
+    escapes: Some(EscapeRules { raw: &["r\"", "lr\"", "ur\"", "u8r\""], ..EscapeRules::DEFAULT }),
+    ..GrammarMetadata::DEFAULT
+};
+
+const CSHARP: GrammarMetadata = GrammarMetadata {
+    folding: FoldingRules {
+        imports: &["using"],
+        region_markers: Some(("#region", "#endregion")),
+        ..FoldingRules::DEFAULT
+    },
+    indent: IndentRules {
+        increase_after: &[":", "=>"],
+        continuations: C_CONTINUATIONS,
+        ..IndentRules::DEFAULT
+    },
+    auto_close: &[PAREN, SQUARE, CURLY, DOUBLE_QUOTE, CHAR_QUOTE],
+    functions: FunctionRules::C,
+    // Verbatim and raw string literals.
+    escapes: Some(EscapeRules { raw: &["@\"", "$@\"", "@$\"", "\"\"\""], ..EscapeRules::DEFAULT }),
+    ..GrammarMetadata::DEFAULT
+};
+
+const CSS: GrammarMetadata = GrammarMetadata {
+    folding: FoldingRules {
+        imports: &["@import"],
+        region_markers: Some(("/* #region", "/* #endregion")),
+        ..FoldingRules::DEFAULT
+    },
+    outline: Some(css_outline),
+    comments: CommentSyntax::BLOCK,
+    ..GrammarMetadata::DEFAULT
+};
+
+const GO: GrammarMetadata = GrammarMetadata {
+    folding: FoldingRules {
+        imports: &["import"],
+        region_markers: Some(("// #region", "// #endregion")),
+        ..FoldingRules::DEFAULT
+    },
+    // `case x:`, `default:` and labels are followed by an indented block.
+    indent: IndentRules {
+        increase_after: &[":"],
+        continuations: &["&&", "||", "+", "-", "*", "/", "%", "|", "&", "=", ":="],
+        ..IndentRules::DEFAULT
+    },
+    outline: Some(go_outline),
+    auto_close: &[PAREN, SQUARE, CURLY, DOUBLE_QUOTE, CHAR_QUOTE, BACKTICK],
+    surround: BACKTICK_SURROUND,
+    // Interface methods are found through the outline.
+    functions: FunctionRules { keywords: &["func"], body_follows: false, calls: true },
+    escapes: Some(EscapeRules { raw: &["`"], format_verbs: true, single: Some("abfnrtv\\'\"") }),
+    ..GrammarMetadata::DEFAULT
+};
+
+// Comments in HTML end up in the output, so templates comment out in actions.
+const GO_TEMPLATE: GrammarMetadata = GrammarMetadata {
+    comments: CommentSyntax { line: None, block: Some(("{{/*", "*/}}")), nested: false },
+    ..MARKUP
+};
+
+const JSON: GrammarMetadata = GrammarMetadata {
+    auto_close: &[PAREN, SQUARE, CURLY, DOUBLE_QUOTE],
+    surround: &[(b'[', b']'), (b'{', b'}'), (b'"', b'"')],
+    comments: CommentSyntax::NONE,
+    diagnostics: Some(json_diagnostics),
+    escapes: Some(EscapeRules::DEFAULT),
+    ..GrammarMetadata::DEFAULT
+};
+
+const JAVA: GrammarMetadata = GrammarMetadata {
+    folding: FoldingRules {
+        imports: &["import"],
+        region_markers: Some(("// #region", "// #endregion")),
+        ..FoldingRules::DEFAULT
+    },
+    indent: IndentRules {
+        increase_after: &[":"],
+        continuations: C_CONTINUATIONS,
+        ..IndentRules::DEFAULT
+    },
+    auto_close: &[PAREN, SQUARE, CURLY, DOUBLE_QUOTE, CHAR_QUOTE],
+    functions: FunctionRules::C,
+    escapes: Some(EscapeRules::DEFAULT),
+    ..GrammarMetadata::DEFAULT
+};
+
+const JAVASCRIPT: GrammarMetadata = GrammarMetadata {
+    folding: FoldingRules {
+        imports: &["import"],
+        region_markers: Some(("// #region", "// #endregion")),
+        ..FoldingRules::DEFAULT
+    },
+    indent: IndentRules {
+        increase_after: &[":", "=>"],
+        continuations: C_CONTINUATIONS,
+        ..IndentRules::DEFAULT
+    },
+    auto_close: &[PAREN, SQUARE, CURLY, DOUBLE_QUOTE, SINGLE_QUOTE, BACKTICK],
+    surround: BACKTICK_SURROUND,
+    // Class methods are followed by their body: `area() {`.
+    functions: FunctionRules { keywords: &["function"], ..FunctionRules::C },
+    diagnostics: Some(javascript_diagnostics),
+    escapes: Some(EscapeRules::DEFAULT),
+    ..GrammarMetadata::DEFAULT
+};
+
+const MARKDOWN: GrammarMetadata = GrammarMetadata {
+    brackets: &[],
+    keyword_pairs: &[],
+    case_insensitive_keywords: false,
+    folding: FoldingRules {
+        brackets: false,
+        strings: false,
+        region_markers: Some(("<!-- #region", "<!-- #endregion")),
+        headings: true,
+        ..FoldingRules::DEFAULT
+    },
+    indent: IndentRules::DEFAULT,
+    // Code spans and fenced code blocks aren't prose, even though the latter
+    // contain comments and strings of their own, see `spell_check_regions`.
+    prose: &[
+        TokenKind::Identifier,
+        TokenKind::MarkdownHeading,
+        TokenKind::MarkdownBold,
+        TokenKind::MarkdownItalic,
+        TokenKind::MarkdownLink,
+        TokenKind::Comment,
+    ],
+    outline: Some(markdown_outline),
+    // Apostrophes and quotes are too common in prose to be closed automatically.
+    auto_close: &[PAREN, SQUARE, CURLY, BACKTICK],
+    surround: PROSE_SURROUND,
+    comments: CommentSyntax::MARKUP,
+    functions: FunctionRules::NONE,
+    selection: Some(markdown_selection),
+    diagnostics: None,
+    escapes: None,
+};
+
+const ASCIIDOC: GrammarMetadata = GrammarMetadata {
+    auto_close: &[PAREN, SQUARE, CURLY, BACKTICK],
+    surround: PROSE_SURROUND,
+    // Block comments are delimited by `////` lines, which toggling doesn't support.
+    comments: CommentSyntax { line: Some("//"), block: None, nested: false },
+    ..GrammarMetadata::DEFAULT
+};
+
+const MARKUP: GrammarMetadata = GrammarMetadata {
+    folding: FoldingRules {
+        region_markers: Some(("<!-- #region", "<!-- #endregion")),
+        ..FoldingRules::DEFAULT
+    },
+    surround: &[
+        (b'(', b')'),
+        (b'[', b']'),
+        (b'{', b'}'),
+        (b'"', b'"'),
+        (b'\'', b'\''),
+        (b'<', b'>'),
+    ],
+    comments: CommentSyntax::MARKUP,
+    ..GrammarMetadata::DEFAULT
+};
+
+const PYTHON_PREFIXES: &[&str] = &["r", "u", "b", "f", "br", "rb", "fr", "rf"];
+
+const PYTHON: GrammarMetadata = GrammarMetadata {
+    folding: FoldingRules {
+        imports: &["import", "from"],
+        region_markers: Some(("# region", "# endregion")),
+        hook: Some(indentation_folds),
+        ..FoldingRules::DEFAULT
+    },
+    indent: IndentRules {
+        increase_after: &[":"],
+        continuations: &["\\"],
+        decrease_after: &["return", "pass", "break", "continue", "raise"],
+        hook: None,
+    },
+    auto_close: &[
+        PAREN,
+        SQUARE,
+        CURLY,
+        AutoClosePair { prefixes: PYTHON_PREFIXES, ..DOUBLE_QUOTE },
+        AutoClosePair { prefixes: PYTHON_PREFIXES, ..SINGLE_QUOTE },
+    ],
+    comments: CommentSyntax::HASH,
+    functions: FunctionRules { keywords: &["def"], body_follows: false, calls: true },
+    diagnostics: Some(python_diagnostics),
+    escapes: Some(EscapeRules {
+        raw: &["r\"", "r'", "br\"", "br'", "rb\"", "rb'", "fr\"", "fr'", "rf\"", "rf'"],
+        ..EscapeRules::DEFAULT
+    }),
+    ..GrammarMetadata::DEFAULT
+};
+
+const RUST: GrammarMetadata = GrammarMetadata {
+    folding: FoldingRules {
+        imports: &["use"],
+        region_markers: Some(("// #region", "// #endregion")),
+        ..FoldingRules::DEFAULT
+    },
+    indent: IndentRules {
+        increase_after: &["=>"],
+        continuations: &["&&", "||", "+", "-", "*", "/", "%", "="],
+        ..IndentRules::DEFAULT
+    },
+    // `'` also starts lifetimes and labels, which aren't closed: `&'a`, `<'a>`.
+    auto_close: &[
+        PAREN,
+        SQUARE,
+        CURLY,
+        AutoClosePair { prefixes: &["b", "r", "br", "c", "cr"], ..DOUBLE_QUOTE },
+        AutoClosePair {
+            not_in: &[
+                TokenKind::Comment,
+                TokenKind::String,
+                TokenKind::Char,
+                TokenKind::RustLifetime,
+            ],
+            not_after: b"&<",
+            prefixes: &["b"],
+            ..CHAR_QUOTE
+        },
+    ],
+    comments: CommentSyntax { nested: true, ..CommentSyntax::C },
+    functions: FunctionRules { keywords: &["fn"], body_follows: false, calls: true },
+    escapes: Some(EscapeRules {
+        raw: &["r\"", "r#", "br\"", "br#", "cr\"", "cr#"],
+        ..EscapeRules::DEFAULT
+    }),
+    ..GrammarMetadata::DEFAULT
+};
+
+// Backticks quote identifiers in MySQL.
+const SQL: GrammarMetadata = GrammarMetadata {
+    case_insensitive_keywords: true,
+    auto_close: &[PAREN, SQUARE, CURLY, DOUBLE_QUOTE, SINGLE_QUOTE, BACKTICK],
+    surround: BACKTICK_SURROUND,
+    comments: CommentSyntax { line: Some("--"), ..CommentSyntax::C },
+    ..GrammarMetadata::DEFAULT
+};
+
+const SHELL: GrammarMetadata = GrammarMetadata {
+    keyword_pairs: &[
+        KeywordPair { open: &["if"], middle: &["then", "elif", "else"], close: "fi" },
+        KeywordPair { open: &["case"], middle: &[], close: "esac" },
+        KeywordPair { open: &["do"], middle: &[], close: "done" },
+    ],
+    folding: FoldingRules {
+        imports: &["source"],
+        region_markers: Some(("# region", "# endregion")),
+        ..FoldingRules::DEFAULT
+    },
+    // Backticks are command substitution, which is rarely typed as a pair.
+    auto_close: &[PAREN, SQUARE, CURLY, DOUBLE_QUOTE, SINGLE_QUOTE],
+    surround: BACKTICK_SURROUND,
+    comments: CommentSyntax::HASH,
+    // Commands aren't called with parentheses, but functions may be defined as `name() {`.
+    functions: FunctionRules { keywords: &["function"], body_follows: true, calls: false },
+    ..GrammarMetadata::DEFAULT
+};
+
+// Literal strings are single-quoted.
+const TOML: GrammarMetadata = GrammarMetadata {
+    comments: CommentSyntax::HASH,
+    escapes: Some(EscapeRules { raw: &["'"], ..EscapeRules::DEFAULT }),
+    ..GrammarMetadata::DEFAULT
+};
+
+const YAML: GrammarMetadata = GrammarMetadata {
+    folding: FoldingRules {
+        region_markers: Some(("# region", "# endregion")),
+        hook: Some(indentation_folds),
+        ..FoldingRules::DEFAULT
+    },
+    // A key without a value and block scalar indicators are followed by an indented block.
+    indent: IndentRules {
+        increase_after: &[":", "|", ">"],
+        hook: Some(yaml_indent),
+        ..IndentRules::DEFAULT
+    },
+    comments: CommentSyntax::HASH,
+    diagnostics: Some(yaml_diagnostics),
+    ..GrammarMetadata::DEFAULT
+};
+
+impl Language {
+    /// Get the grammar metadata for this language.
+    pub fn metadata(self) -> &'static GrammarMetadata {
+        match self {
+            Language::PlainText => &GrammarMetadata::PLAIN,
+            Language::AsciiDoc => &ASCIIDOC,
+            Language::C | Language::Cpp => &C,
+            Language::CSharp => &CSHARP,
+            Language::Css => &CSS,
+            Language::Go => &GO,
+            Language::GoTemplate => &GO_TEMPLATE,
+            Language::Java => &JAVA,
+            Language::Json => &JSON,
+            Language::JavaScript | Language::TypeScript => &JAVASCRIPT,
+            Language::Markdown => &MARKDOWN,
+            Language::Html | Language::Xml => &MARKUP,
+            Language::Python => &PYTHON,
+            Language::Rust => &RUST,
+            Language::Shell => &SHELL,
+            Language::Sql => &SQL,
+            Language::Toml => &TOML,
+            Language::Yaml => &YAML,
+        }
+    }
+}
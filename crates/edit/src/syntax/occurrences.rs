@@ -0,0 +1,186 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//! Occurrences of the word under the cursor, e.g. to highlight them all.
+//!
+//! Matches are whole words inside identifier tokens, so keywords never match and
+//! neither do parts of longer identifiers, like the `for` in `forEach`. Words in
+//! strings and comments only match if asked for.
+
+use std::ops::Range;
+
+use crate::syntax::lexer::simple_fold_eq;
+use crate::syntax::{Token, TokenKind};
+
+/// Options for [`occurrences`].
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub struct OccurrenceOptions {
+    /// Also match words inside strings.
+    pub strings: bool,
+    /// Also match words inside comments.
+    pub comments: bool,
+    /// Only match words with the same case. Otherwise letters match regardless of case,
+    /// with Unicode simple case folding.
+    pub case_sensitive: bool,
+}
+
+/// Find all occurrences of the word at `offset`, including the word itself, in document order.
+///
+/// The cursor must be in or right after an identifier token, see [`TokenKind::is_identifier`].
+/// Within it, the word is the run of word characters around the cursor, which for
+/// code is the entire identifier and for plain text, which is lexed as a single
+/// identifier, is the word the cursor is on.
+pub fn occurrences(
+    text: &[u8],
+    tokens: &[Token],
+    offset: usize,
+    options: OccurrenceOptions,
+) -> Vec<Range<usize>> {
+    let Some(word) = word_at(text, tokens, offset) else {
+        return Vec::new();
+    };
+    let word = &text[word];
+    let eq = |s: &[u8]| {
+        if options.case_sensitive { s == word } else { simple_fold_eq(s, word) }
+    };
+
+    let mut result = Vec::new();
+    for token in tokens {
+        let searched = match token.kind {
+            TokenKind::String | TokenKind::DocString => options.strings,
+            TokenKind::Comment | TokenKind::DocComment => options.comments,
+            kind => kind.is_identifier(),
+        };
+        if !searched {
+            continue;
+        }
+
+        let mut pos = token.span.start;
+        while pos < token.span.end {
+            let start = pos;
+            if is_word_byte(text[pos]) {
+                while pos < token.span.end && is_word_byte(text[pos]) {
+                    pos += 1;
+                }
+                if eq(&text[start..pos]) {
+                    result.push(start..pos);
+                }
+            } else {
+                pos += 1;
+            }
+        }
+    }
+    result
+}
+
+/// Returns the range of the word at `offset`, if the cursor is on an identifier.
+fn word_at(text: &[u8], tokens: &[Token], offset: usize) -> Option<Range<usize>> {
+    let idx = tokens.partition_point(|t| t.span.end <= offset);
+    let token = tokens
+        .get(idx)
+        .filter(|t| t.span.start <= offset && t.kind.is_identifier())
+        .or_else(|| {
+            idx.checked_sub(1)
+                .map(|i| &tokens[i])
+                .filter(|t| t.span.end == offset && t.kind.is_identifier())
+        })?;
+
+    let span = token.span.clone();
+    let start =
+        offset - text[span.start..offset].iter().rev().take_while(|&&b| is_word_byte(b)).count();
+    let end = offset + text[offset..span.end].iter().take_while(|&&b| is_word_byte(b)).count();
+    (start < end).then_some(start..end)
+}
+
+fn is_word_byte(b: u8) -> bool {
+    b.is_ascii_alphanumeric() || b == b'_' || b >= 0x80
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::syntax::{Language, LexerRegistry};
+
+    /// Returns the line and text of each occurrence of the word at the first `needle`,
+    /// with the cursor `skip` bytes into the needle.
+    fn find(
+        language: Language,
+        text: &[u8],
+        needle: &str,
+        skip: usize,
+        options: OccurrenceOptions,
+    ) -> Vec<(usize, String)> {
+        let tokens = LexerRegistry::get_lexer(language).tokenize(text);
+        let offset = text.windows(needle.len()).position(|w| w == needle.as_bytes()).unwrap();
+        occurrences(text, &tokens, offset + skip, options)
+            .into_iter()
+            .map(|r| {
+                let line = text[..r.start].iter().filter(|&&b| b == b'\n').count() + 1;
+                (line, String::from_utf8_lossy(&text[r]).into_owned())
+            })
+            .collect()
+    }
+
+    #[test]
+    fn test_go_occurrences() {
+        let text = include_bytes!("../../../../syntax-tests/test_syntax.go");
+        let data = |options| find(Language::Go, text, "data []byte", 2, options);
+        let lines =
+            |found: Vec<(usize, String)>| found.into_iter().map(|(l, _)| l).collect::<Vec<_>>();
+
+        // `ProcessData` doesn't contain the word `data`.
+        assert_eq!(lines(data(OccurrenceOptions::default())), [435, 436]);
+        let strings = OccurrenceOptions { strings: true, ..Default::default() };
+        assert_eq!(lines(data(strings)), [435, 436, 437]);
+        let comments = OccurrenceOptions { comments: true, ..Default::default() };
+        assert_eq!(lines(data(comments)), [434, 435, 436]);
+    }
+
+    #[test]
+    fn test_case_sensitivity() {
+        let text = include_bytes!("../../../../syntax-tests/test_syntax.go");
+        let options = OccurrenceOptions { strings: true, ..Default::default() };
+        let value = |options| find(Language::Go, text, "value := range slice", 0, options);
+
+        let found = value(options);
+        assert!(found.contains(&(302, "Value".to_string())), "{found:?}");
+        let found = value(OccurrenceOptions { case_sensitive: true, ..options });
+        assert!(!found.iter().any(|(_, word)| word == "Value"), "{found:?}");
+        assert!(found.contains(&(302, "value".to_string())), "{found:?}");
+    }
+
+    #[test]
+    fn test_keywords_and_partial_words() {
+        let text = b"items.forEach(item => { for (const x of item) {} });";
+        let none = OccurrenceOptions::default();
+        assert_eq!(find(Language::JavaScript, text, "for ", 1, none), []);
+        assert_eq!(find(Language::JavaScript, text, "forEach", 0, none), [(1, "forEach".into())]);
+        assert_eq!(
+            find(Language::JavaScript, text, "item ", 4, none),
+            [(1, "item".into()), (1, "item".into())]
+        );
+    }
+
+    #[test]
+    fn test_plain_text_words() {
+        let text = b"foo bar foo-bar foobar Foo";
+        let sensitive = OccurrenceOptions { case_sensitive: true, ..Default::default() };
+        let found = find(Language::PlainText, text, "foo", 1, sensitive);
+        assert_eq!(found, [(1, "foo".into()), (1, "foo".into())]);
+        assert_eq!(find(Language::PlainText, text, "bar", 0, Default::default()).len(), 2);
+    }
+
+    #[test]
+    fn test_non_ascii_case() {
+        let text = "Été été ÉTÉ ete\u{301} STRASSE straße ıf if İF".as_bytes();
+        let words = |word| {
+            let found = find(Language::PlainText, text, word, 0, Default::default());
+            found.into_iter().map(|(_, w)| w).collect::<Vec<_>>()
+        };
+        assert_eq!(words("été"), ["Été", "été", "ÉTÉ"]);
+        // Neither normalization nor multi-character folds apply.
+        assert_eq!(words("straße"), ["straße"]);
+        assert_eq!(words("if"), ["if"]);
+        assert_eq!(words("ıf"), ["ıf"]);
+    }
+}
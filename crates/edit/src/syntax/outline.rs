@@ -0,0 +1,809 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//! Symbol outlines (for breadcrumbs and outline views) computed from the token stream.
+//!
+//! Outlines are lexical: only declarations that are spelled out in the text are found.
+//! Symbols generated by macros or code generation are missing, anonymous functions and
+//! `_` are skipped, and code that doesn't lex cleanly may produce a partial outline.
+//! Which languages have an outline is declared in
+//! [`GrammarMetadata::outline`](crate::syntax::GrammarMetadata::outline).
+
+use std::ops::Range;
+
+use crate::syntax::brackets::bracket_byte;
+use crate::syntax::{GrammarMetadata, Language, Token, TokenKind};
+
+/// What kind of declaration a [`Symbol`] is.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum SymbolKind {
+    Function,
+    Method,
+    Type,
+    Field,
+    Constant,
+    Variable,
+    Heading,
+    Selector,
+    AtRule,
+}
+
+/// A declaration in a document and the declarations nested in it.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Symbol {
+    pub name: String,
+    /// Additional information, like the receiver of a Go method (`*Stack[T]`)
+    /// or the type parameters of a generic function (`[T any]`).
+    pub detail: Option<String>,
+    pub kind: SymbolKind,
+    /// The range of the name, i.e. what to select when navigating to the symbol.
+    pub selection: Range<usize>,
+    /// The range of the entire declaration, including its body.
+    pub range: Range<usize>,
+    pub children: Vec<Symbol>,
+}
+
+/// Computes the outline of a document. See [`GrammarMetadata::outline`].
+pub type OutlineHook = fn(text: &[u8], tokens: &[Token]) -> Vec<Symbol>;
+
+/// Compute the outline of `text`, given its `tokens` in `language`.
+///
+/// Returns an empty outline for languages that don't declare an [`OutlineHook`].
+pub fn outline(language: Language, text: &[u8], tokens: &[Token]) -> Vec<Symbol> {
+    language.metadata().outline.map_or_else(Vec::new, |hook| hook(text, tokens))
+}
+
+impl Symbol {
+    fn new(name: String, kind: SymbolKind, selection: Range<usize>, range: Range<usize>) -> Self {
+        Self { name, detail: None, kind, selection, range, children: Vec::new() }
+    }
+}
+
+/// Walks the tokens of a brace-structured language, ignoring whitespace and comments.
+struct Cursor<'a> {
+    metadata: &'static GrammarMetadata,
+    text: &'a [u8],
+    tokens: Vec<&'a Token>,
+    pos: usize,
+}
+
+impl<'a> Cursor<'a> {
+    fn new(language: Language, text: &'a [u8], tokens: &'a [Token]) -> Self {
+        let tokens = tokens
+            .iter()
+            .filter(|t| !t.is_empty() && t.kind != TokenKind::Whitespace && !t.kind.is_comment())
+            .collect();
+        Self { metadata: language.metadata(), text, tokens, pos: 0 }
+    }
+
+    fn peek(&self) -> Option<&'a Token> {
+        self.tokens.get(self.pos).copied()
+    }
+
+    fn peek_text(&self) -> &'a [u8] {
+        self.nth_text(0)
+    }
+
+    fn nth_text(&self, n: usize) -> &'a [u8] {
+        self.tokens.get(self.pos + n).map_or(&[], |t| &self.text[t.span.clone()])
+    }
+
+    fn at(&self, s: &[u8]) -> bool {
+        self.peek_text() == s
+    }
+
+    fn bump(&mut self) -> Option<&'a Token> {
+        let token = self.peek()?;
+        self.pos += 1;
+        Some(token)
+    }
+
+    /// The end offset of the last consumed token.
+    fn prev_end(&self) -> usize {
+        self.pos.checked_sub(1).map_or(0, |i| self.tokens[i].span.end)
+    }
+
+    fn at_opener(&self) -> bool {
+        self.bracket().is_some_and(|b| self.metadata.closer_of(b).is_some())
+    }
+
+    fn at_closer(&self) -> bool {
+        self.bracket().is_some_and(|b| self.metadata.is_closer(b))
+    }
+
+    fn bracket(&self) -> Option<u8> {
+        bracket_byte(self.metadata, self.text, self.peek()?)
+    }
+
+    /// Checks whether there's a line break between the last consumed token and the next one.
+    fn at_line_start(&self) -> bool {
+        match (self.pos.checked_sub(1), self.peek()) {
+            (Some(prev), Some(next)) => {
+                self.text[self.tokens[prev].span.end..next.span.start].contains(&b'\n')
+            }
+            _ => true,
+        }
+    }
+
+    /// Consumes the next token, or if it's an opening bracket, everything up to and
+    /// including its closing bracket. Returns the end offset of what was consumed.
+    fn skip_balanced(&mut self) -> usize {
+        let mut depth = 0usize;
+        while self.peek().is_some() {
+            if self.at_opener() {
+                depth += 1;
+            } else if self.at_closer() {
+                depth = depth.saturating_sub(1);
+            }
+            self.bump();
+            if depth == 0 {
+                break;
+            }
+        }
+        self.prev_end()
+    }
+
+    /// Returns the text of the consumed tokens `from..self.pos`, with the
+    /// whitespace and comments between them collapsed into single spaces.
+    fn name(&self, from: usize) -> String {
+        let mut name = String::new();
+        for (i, token) in self.tokens[from..self.pos].iter().enumerate() {
+            if i > 0 && self.tokens[from + i - 1].span.end < token.span.start {
+                name.push(' ');
+            }
+            name.push_str(&String::from_utf8_lossy(&self.text[token.span.clone()]));
+        }
+        name
+    }
+}
+
+/// Outline hook for Go.
+///
+/// Finds functions, methods (with their receiver type as the detail), types (with
+/// their fields and interface methods as children), constants and variables.
+/// Methods aren't nested under their receiver's type, since they may be declared anywhere.
+pub fn go_outline(text: &[u8], tokens: &[Token]) -> Vec<Symbol> {
+    let mut c = Cursor::new(Language::Go, text, tokens);
+    let mut symbols = Vec::new();
+
+    while let Some(token) = c.peek() {
+        let start = token.span.start;
+        match c.peek_text() {
+            b"func" => {
+                c.bump();
+                symbols.extend(go_func(&mut c, start));
+            }
+            b"type" => {
+                c.bump();
+                go_group(&mut c, start, &mut symbols, |c, start, symbols| {
+                    symbols.extend(go_type_spec(c, start))
+                });
+            }
+            b"const" | b"var" => {
+                let kind = if c.at(b"const") { SymbolKind::Constant } else { SymbolKind::Variable };
+                c.bump();
+                go_group(&mut c, start, &mut symbols, |c, start, symbols| {
+                    go_value_spec(c, start, kind, symbols)
+                });
+            }
+            _ => {
+                c.skip_balanced();
+            }
+        }
+    }
+
+    symbols
+}
+
+/// Parses a single spec or a parenthesized group of specs after `type`, `const` or `var`.
+/// A single spec's range starts at the keyword, grouped ones at their name.
+fn go_group(
+    c: &mut Cursor,
+    start: usize,
+    symbols: &mut Vec<Symbol>,
+    spec: impl Fn(&mut Cursor, usize, &mut Vec<Symbol>),
+) {
+    if !c.at(b"(") {
+        spec(c, start, symbols);
+        return;
+    }
+    c.bump();
+    while let Some(token) = c.peek() {
+        if c.at_closer() {
+            c.bump();
+            break;
+        }
+        let pos = c.pos;
+        spec(c, token.span.start, symbols);
+        if c.pos == pos {
+            c.bump();
+        }
+    }
+}
+
+fn go_func(c: &mut Cursor, start: usize) -> Option<Symbol> {
+    let mut receiver = None;
+    if c.at(b"(") {
+        c.bump();
+        // `(r *T)` or just `(T)`.
+        if is_go_name(c.peek()) && !c.at_closer() && !matches!(c.nth_text(1), b")" | b"[" | b".") {
+            c.bump();
+        }
+        let from = c.pos;
+        while c.peek().is_some() && !c.at(b")") {
+            c.skip_balanced();
+        }
+        receiver = Some(c.name(from));
+        c.bump();
+    }
+
+    if !is_go_name(c.peek()) {
+        // An anonymous function, e.g. `func() { ... }()`.
+        go_skip_statement(c);
+        return None;
+    }
+    let name = c.bump()?.span.clone();
+    let mut symbol = Symbol::new(
+        String::from_utf8_lossy(&c.text[name.clone()]).into_owned(),
+        if receiver.is_some() { SymbolKind::Method } else { SymbolKind::Function },
+        name,
+        start..0,
+    );
+    symbol.detail = receiver.or_else(|| go_type_params(c));
+
+    // The parameters, the results and the body, if any.
+    let mut end = c.skip_balanced();
+    while c.peek().is_some() && !c.at_line_start() && !c.at_closer() {
+        // `{` is the body, unless it belongs to a `struct {}` or `interface {}` result.
+        let is_body = c.at(b"{")
+            && !matches!(&c.text[c.tokens[c.pos - 1].span.clone()], b"struct" | b"interface");
+        end = c.skip_balanced();
+        if is_body {
+            break;
+        }
+    }
+    symbol.range.end = end;
+    Some(symbol)
+}
+
+fn go_type_spec(c: &mut Cursor, start: usize) -> Option<Symbol> {
+    if !is_go_name(c.peek()) {
+        go_skip_statement(c);
+        return None;
+    }
+    let name = c.bump()?.span.clone();
+    let mut symbol = Symbol::new(
+        String::from_utf8_lossy(&c.text[name.clone()]).into_owned(),
+        SymbolKind::Type,
+        name,
+        start..0,
+    );
+    symbol.detail = go_type_params(c);
+
+    if c.at(b"=") {
+        c.bump();
+    }
+    if matches!(c.peek_text(), b"struct" | b"interface") && c.nth_text(1) == b"{" {
+        let interface = c.at(b"interface");
+        c.bump();
+        c.bump();
+        while c.peek().is_some() && !c.at_closer() {
+            let pos = c.pos;
+            go_field(c, interface, &mut symbol.children);
+            if c.pos == pos {
+                c.bump();
+            }
+        }
+        c.bump();
+    }
+    symbol.range.end = go_skip_statement(c).max(c.prev_end());
+    Some(symbol)
+}
+
+/// Parses a struct field (`a, b int`, an embedded `*pkg.T`) or an interface method.
+fn go_field(c: &mut Cursor, interface: bool, symbols: &mut Vec<Symbol>) {
+    let Some(first) = c.peek() else {
+        return;
+    };
+    let start = first.span.start;
+    let from = c.pos;
+
+    let mut names = Vec::new();
+    while is_go_name(c.peek()) {
+        names.push(c.bump().unwrap().span.clone());
+        if !c.at(b",") {
+            break;
+        }
+        c.bump();
+    }
+
+    let kind = if interface {
+        // Embedded interfaces and type sets aren't symbols.
+        if names.len() != 1 || !c.at(b"(") {
+            go_skip_statement(c);
+            return;
+        }
+        SymbolKind::Method
+    } else {
+        let embedded = names.is_empty() && c.at(b"*")
+            || names.len() == 1
+                && (c.at_line_start()
+                    || c.at_closer()
+                    || matches!(c.peek_text(), b"." | b";")
+                    || c.peek().is_some_and(|t| t.kind == TokenKind::String));
+        if embedded {
+            // An embedded field is named after its type, without the package.
+            c.pos = from;
+            if c.at(b"*") {
+                c.bump();
+            }
+            while c.nth_text(1) == b"." {
+                c.bump();
+                c.bump();
+            }
+            names.clear();
+            if is_go_name(c.peek()) {
+                names.push(c.bump().unwrap().span.clone());
+            }
+        }
+        SymbolKind::Field
+    };
+
+    let end = go_skip_statement(c);
+    for name in names {
+        symbols.push(Symbol::new(
+            String::from_utf8_lossy(&c.text[name.clone()]).into_owned(),
+            kind,
+            name,
+            start..end,
+        ));
+    }
+}
+
+/// Parses `a, b = 1, 2` or `a int` after `const` or `var`.
+fn go_value_spec(c: &mut Cursor, start: usize, kind: SymbolKind, symbols: &mut Vec<Symbol>) {
+    let mut names = Vec::new();
+    while is_go_name(c.peek()) {
+        names.push(c.bump().unwrap().span.clone());
+        if !c.at(b",") {
+            break;
+        }
+        c.bump();
+    }
+    let end = go_skip_statement(c).max(c.prev_end());
+
+    for name in names {
+        let text = &c.text[name.clone()];
+        if text != b"_" {
+            symbols.push(Symbol::new(
+                String::from_utf8_lossy(text).into_owned(),
+                kind,
+                name,
+                start..end,
+            ));
+        }
+    }
+}
+
+/// Consumes type parameters like `[K comparable, V any]` and returns them.
+/// `[N]T` in `type A [N]T` is an array type and is left alone.
+fn go_type_params(c: &mut Cursor) -> Option<String> {
+    let is_params = c.at(b"[")
+        && is_go_name(c.tokens.get(c.pos + 1).copied())
+        && !matches!(c.nth_text(2), b"]" | b"+" | b"-" | b"*" | b"/" | b"<<" | b">>");
+    if !is_params {
+        return None;
+    }
+    let from = c.pos;
+    c.skip_balanced();
+    Some(c.name(from))
+}
+
+/// Consumes the rest of a statement and returns its end offset.
+///
+/// Statements end at `;`, before a closing bracket, or at a line break where
+/// Go would insert a semicolon, so `x := a +\n b` is a single statement.
+fn go_skip_statement(c: &mut Cursor) -> usize {
+    while let Some(token) = c.peek() {
+        if c.at_closer() || c.pos > 0 && c.at_line_start() && ends_go_line(c) {
+            break;
+        }
+        if c.at(b";") {
+            c.bump();
+            return token.span.end;
+        }
+        c.skip_balanced();
+    }
+    c.prev_end()
+}
+
+/// Checks whether Go inserts a semicolon after the last consumed token if it ends the line.
+fn ends_go_line(c: &Cursor) -> bool {
+    let token = c.tokens[c.pos - 1];
+    match token.kind {
+        TokenKind::Operator => {
+            matches!(&c.text[token.span.clone()], b")" | b"]" | b"}" | b"++" | b"--")
+        }
+        TokenKind::Keyword => matches!(
+            &c.text[token.span.clone()],
+            b"break" | b"continue" | b"fallthrough" | b"return" | b"iota"
+        ),
+        _ => true,
+    }
+}
+
+fn is_go_name(token: Option<&Token>) -> bool {
+    // Built-in names like `len` or `string` may be redeclared.
+    token.is_some_and(|t| {
+        matches!(
+            t.kind,
+            TokenKind::Identifier
+                | TokenKind::TypeName
+                | TokenKind::FunctionName
+                | TokenKind::FunctionDefinition
+                | TokenKind::FunctionCall
+        )
+    })
+}
+
+/// Outline hook for Markdown: headings, nested by their level.
+///
+/// A heading's range extends up to the next heading of the same or a higher level.
+pub fn markdown_outline(text: &[u8], tokens: &[Token]) -> Vec<Symbol> {
+    let headings: Vec<_> = tokens
+        .iter()
+        .filter(|t| t.kind == TokenKind::MarkdownHeading)
+        .map(|t| {
+            let level = text[t.span.clone()].iter().take_while(|&&b| b == b'#').count();
+            let mut name = t.span.start + level..t.span.end;
+            while name.start < name.end && text[name.start].is_ascii_whitespace() {
+                name.start += 1;
+            }
+            while name.end > name.start && matches!(text[name.end - 1], b'#' | b' ' | b'\t' | b'\r')
+            {
+                name.end -= 1;
+            }
+            (level, t.span.start, name)
+        })
+        .collect();
+
+    let mut flat = Vec::with_capacity(headings.len());
+    for (i, (level, start, name)) in headings.iter().cloned().enumerate() {
+        let mut end = headings[i + 1..]
+            .iter()
+            .find(|&&(l, ..)| l <= level)
+            .map_or(text.len(), |&(_, start, _)| start);
+        while end > start && text[end - 1].is_ascii_whitespace() {
+            end -= 1;
+        }
+        let symbol = Symbol::new(
+            String::from_utf8_lossy(&text[name.clone()]).into_owned(),
+            SymbolKind::Heading,
+            name,
+            start..end,
+        );
+        flat.push((level, symbol));
+    }
+
+    nest(flat)
+}
+
+/// Turns a list of symbols and their levels into a tree: each symbol becomes
+/// a child of the closest preceding symbol with a lower level.
+fn nest(flat: Vec<(usize, Symbol)>) -> Vec<Symbol> {
+    let mut roots = Vec::new();
+    let mut stack: Vec<(usize, Symbol)> = Vec::new();
+
+    for (level, symbol) in flat {
+        while stack.last().is_some_and(|&(l, _)| l >= level) {
+            let (_, done) = stack.pop().unwrap();
+            match stack.last_mut() {
+                Some((_, parent)) => parent.children.push(done),
+                None => roots.push(done),
+            }
+        }
+        stack.push((level, symbol));
+    }
+    while let Some((_, done)) = stack.pop() {
+        match stack.last_mut() {
+            Some((_, parent)) => parent.children.push(done),
+            None => roots.push(done),
+        }
+    }
+
+    roots
+}
+
+/// Outline hook for CSS: rules (named after their selector) and at-rules,
+/// with nested rules as children, e.g. inside `@media`.
+pub fn css_outline(text: &[u8], tokens: &[Token]) -> Vec<Symbol> {
+    let mut c = Cursor::new(Language::Css, text, tokens);
+    let mut symbols = Vec::new();
+    while c.peek().is_some() {
+        css_block(&mut c, &mut symbols);
+        // Skip a stray `}`.
+        c.bump();
+    }
+    symbols
+}
+
+/// Parses rules, at-rules and declarations up to the end of the current block.
+fn css_block(c: &mut Cursor, symbols: &mut Vec<Symbol>) {
+    while let Some(first) = c.peek() {
+        if c.at(b"}") {
+            return;
+        }
+        let start = first.span.start;
+        let from = c.pos;
+
+        // The prelude: a selector, an at-rule or a declaration.
+        while c.peek().is_some() && !matches!(c.peek_text(), b";" | b"{" | b"}") {
+            c.skip_balanced();
+        }
+        let name = c.name(from);
+        let selection = start..c.prev_end();
+        let kind = if name.starts_with('@') { SymbolKind::AtRule } else { SymbolKind::Selector };
+
+        if c.at(b"{") {
+            c.bump();
+            let mut symbol = Symbol::new(name, kind, selection, start..0);
+            css_block(c, &mut symbol.children);
+            c.bump();
+            symbol.range.end = c.prev_end();
+            symbols.push(symbol);
+        } else {
+            if c.at(b";") {
+                c.bump();
+            }
+            // Only statement at-rules like `@import` are symbols, declarations aren't.
+            if kind == SymbolKind::AtRule {
+                symbols.push(Symbol::new(name, kind, selection, start..c.prev_end()));
+            }
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::syntax::LexerRegistry;
+
+    /// Renders an outline as one line per symbol: indentation for the nesting,
+    /// the kind, the name, the detail, and the 1-based lines the symbol spans.
+    fn render(language: Language, text: &[u8]) -> Vec<String> {
+        fn walk(text: &[u8], symbols: &[Symbol], depth: usize, out: &mut Vec<String>) {
+            let line = |offset: usize| text[..offset].iter().filter(|&&b| b == b'\n').count() + 1;
+            for s in symbols {
+                let name = String::from_utf8_lossy(&text[s.selection.clone()]);
+                assert_eq!(name.split_whitespace().collect::<Vec<_>>().join(" "), s.name);
+                let detail = s.detail.as_deref().map(|d| format!(" ({d})")).unwrap_or_default();
+                out.push(format!(
+                    "{}{:?} {}{} {}-{}",
+                    "  ".repeat(depth),
+                    s.kind,
+                    s.name,
+                    detail,
+                    line(s.range.start),
+                    line(s.range.end),
+                ));
+                walk(text, &s.children, depth + 1, out);
+            }
+        }
+
+        let tokens = LexerRegistry::get_lexer(language).tokenize(text);
+        let mut out = Vec::new();
+        walk(text, &outline(language, text, &tokens), 0, &mut out);
+        out
+    }
+
+    #[test]
+    fn test_outline_go_fixture() {
+        let text = include_bytes!("../../../../syntax-tests/test_syntax.go");
+        assert_eq!(
+            render(Language::Go, text),
+            vec![
+                "Constant MaxSize 17-17",
+                "Constant AppName 18-18",
+                "Constant Version 19-19",
+                "Constant Pi 20-20",
+                "Constant StatusOK 21-21",
+                "Constant StatusError 22-22",
+                "Constant Sunday 27-27",
+                "Constant Monday 28-28",
+                "Constant Tuesday 29-29",
+                "Constant Wednesday 30-30",
+                "Constant Thursday 31-31",
+                "Constant Friday 32-32",
+                "Constant Saturday 33-33",
+                "Type Person 44-48",
+                "  Field Name 45-45",
+                "  Field Age 46-46",
+                "  Field Salary 47-47",
+                "Type Employee 50-54",
+                "  Field Person 51-51",
+                "  Field Department 52-52",
+                "  Field Manager 53-53",
+                "Type Shape 57-60",
+                "  Method Area 58-58",
+                "  Method Perimeter 59-59",
+                "Type Rectangle 63-66",
+                "  Field Width 64-64",
+                "  Field Height 65-65",
+                "Method Area (Rectangle) 68-70",
+                "Method Perimeter (Rectangle) 72-74",
+                "Type Circle 77-79",
+                "  Field Radius 78-78",
+                "Method Area (Circle) 81-83",
+                "Method Perimeter (Circle) 85-87",
+                "Method UpdateAge (*Person) 90-92",
+                "Method GetInfo (Person) 94-96",
+                "Function divide 99-104",
+                "Function swap 107-111",
+                "Function sum 114-120",
+                "Function apply 123-125",
+                "Function makeAdder 128-132",
+                "Function main 135-432",
+                "Function ProcessData 435-440",
+                "Function helperFunction 443-445",
+                "Variable defaultTimeout 448-448",
+                "Type Stack ([T any]) 450-452",
+                "  Field items 451-451",
+                "Method Push (*Stack[T]) 454-456",
+                "Function Map ([T, U any]) 458-464",
+                "Variable 世界 467-467",
+                "Variable Δx 468-468",
+                "Variable x١ 468-468",
+                "Variable 𠀀 471-471",
+                "Constant π 475-475",
+                "Variable 变量 476-476",
+                "Variable wave 477-477",
+                "Variable accented 477-477",
+                "Variable rocket 477-477",
+                "Variable content 486-486",
+                "Function nanotime 490-490",
+                "Variable x 494-494",
+                "Type Account 497-505",
+                "  Field ID 498-498",
+                "  Field Owner 499-499",
+                "  Field Nested 500-502",
+                "  Field Broken 504-504",
+                "Variable pattern 508-508",
+                "Function find 512-536",
+                "Function All ([T any]) 540-548",
+                "Function iterate 550-562",
+                "Function report 565-572",
+                "Function escapes 575-581",
+                "Type Ledger 598-600",
+                "  Field entries 599-599",
+                "Method Close (*Ledger) 607-611",
+                "Function shadowing 614-620",
+                "Function markers 625-630",
+                "Variable format 634-634",
+                "Variable iface 634-634",
+                "Variable deferredWork 634-634",
+                "Variable gopher 634-634",
+                "Variable rangefinder 634-634",
+                "Variable selectAll 634-634",
+                "Variable breakpoint 635-635",
+                "Variable caseless 635-635",
+                "Variable chanValue 635-635",
+                "Variable constant 635-635",
+                "Variable continued 635-635",
+                "Variable defaulted 635-635",
+                "Variable elsewhere 636-636",
+                "Variable fallthroughs 636-636",
+                "Variable forward 636-636",
+                "Variable funcs 636-636",
+                "Variable gotoEnd 636-636",
+                "Variable ifaces 636-636",
+                "Variable imports 637-637",
+                "Variable packaged 637-637",
+                "Variable interfaces 637-637",
+                "Variable mapping 637-637",
+                "Variable returned 637-637",
+                "Variable structure 637-637",
+                "Variable switchboard 638-638",
+                "Variable typeName 638-638",
+                "Variable variable 638-638",
+                "Variable outerFor 638-638",
+                "Variable isGo 638-638",
+                "Variable selectedCase 638-638",
+                "Variable hasDefault 639-639",
+                "Variable myRangeEnd 639-639",
+                "Variable lastReturn 639-639",
+                "Variable userType 639-639",
+                "Variable noElse 639-639",
+                "Variable anyStructs 639-639",
+            ]
+        );
+    }
+
+    #[test]
+    fn test_outline_go_declarations() {
+        let text = b"package p\n\nvar a, _, b = 1, 2,\n\t3\n\nfunc New() interface{ M() } {\n\treturn nil\n}\n\nfunc (Stack[T]) Len() int { return 0 }\n\ntype A [N]int\n\nvar f = func() {\n}\n";
+        assert_eq!(
+            render(Language::Go, text),
+            vec![
+                "Variable a 3-4",
+                "Variable b 3-4",
+                "Function New 6-8",
+                "Method Len (Stack[T]) 10-10",
+                "Type A 12-12",
+                "Variable f 14-15",
+            ]
+        );
+    }
+
+    #[test]
+    fn test_outline_markdown_fixture() {
+        let text = include_bytes!("../../../../syntax-tests/test_syntax.md");
+        assert_eq!(
+            render(Language::Markdown, text),
+            vec![
+                "Heading Markdown Syntax Highlighting Demo 1-28",
+                "  Heading Features 5-28",
+                "    Heading Code Blocks 7-15",
+                "    Heading Formatting 17-22",
+                "    Heading Links 24-26",
+                "    Heading Headings 28-28",
+                "Heading H1 Heading 30-62",
+                "  Heading H2 Heading 31-62",
+                "    Heading H3 Heading 32-33",
+                "      Heading H4 Heading 33-33",
+                "    Heading Lists 35-43",
+                "    Heading Mixed Content 45-49",
+                "    Heading Code Examples 51-62",
+            ]
+        );
+    }
+
+    #[test]
+    fn test_outline_css_fixture() {
+        let text = include_bytes!("../../../../syntax-tests/test_syntax.css");
+        assert_eq!(
+            render(Language::Css, text),
+            vec![
+                "Selector :root 4-8",
+                "Selector * 11-15",
+                "Selector body 18-24",
+                "Selector h1, h2, h3 26-29",
+                "Selector .container 32-36",
+                "Selector .card 38-44",
+                "Selector .card:hover 46-49",
+                "Selector #header 52-57",
+                "Selector input[type=\"text\"], input[type=\"email\"] 60-66",
+                "Selector input[required] 68-70",
+                "Selector a[href^=\"https\"] 72-74",
+                "Selector a:link 77-77",
+                "Selector a:visited 78-78",
+                "Selector a:hover 79-79",
+                "Selector a:active 80-80",
+                "Selector button:disabled 82-85",
+                "Selector li:first-child 87-87",
+                "Selector li:last-child 88-88",
+                "Selector li:nth-child(odd) 89-89",
+                "Selector p::first-letter 92-96",
+                "Selector p::first-line 98-100",
+                "Selector .tooltip::after 102-109",
+                "Selector .flex-container 112-117",
+                "Selector .grid-container 120-124",
+                "AtRule @keyframes fadeIn 127-136",
+                "  Selector from 128-131",
+                "  Selector to 132-135",
+                "Selector .animate 138-140",
+                "AtRule @media screen and (max-width: 768px) 143-151",
+                "  Selector .container 144-146",
+                "  Selector .grid-container 148-150",
+                "AtRule @media print 153-157",
+                "  Selector .no-print 154-156",
+                "Selector .box 160-164",
+            ]
+        );
+    }
+
+    #[test]
+    fn test_outline_unsupported() {
+        let text = b"fn main() {}\n";
+        assert_eq!(render(Language::Rust, text), Vec::<String>::new());
+    }
+}
@@ -0,0 +1,313 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//! Enclosing scopes of a position, for breadcrumbs and sticky headers.
+//!
+//! Named scopes come from the [`outline`]. Anonymous blocks (`if`, `for`, closures, ...)
+//! come from the [`BracketMatcher`] in languages with braces, and from the
+//! [`folding_ranges`] in languages where structure is expressed through indentation,
+//! i.e. those with a [`FoldingRules::hook`](crate::syntax::FoldingRules::hook).
+//! A block is named after the keyword that introduces it, so blocks without one,
+//! like composite literals or YAML mappings, aren't scopes.
+
+use std::ops::Range;
+
+use crate::syntax::lines::LineIndex;
+use crate::syntax::{
+    BracketMatcher, FoldKind, Language, Symbol, SymbolKind, Token, TokenKind, folding_ranges,
+    outline,
+};
+
+/// Keywords that introduce blocks. A brace without one of these on its line, like the one
+/// of a composite literal, doesn't open a scope.
+const BLOCK_KEYWORDS: &[&[u8]] = &[
+    b"if",
+    b"else",
+    b"elif",
+    b"unless",
+    b"for",
+    b"foreach",
+    b"while",
+    b"until",
+    b"do",
+    b"loop",
+    b"switch",
+    b"match",
+    b"select",
+    b"case",
+    b"try",
+    b"catch",
+    b"except",
+    b"finally",
+    b"with",
+    b"using",
+    b"lock",
+    b"unsafe",
+    b"func",
+    b"function",
+    b"fn",
+    b"def",
+    b"lambda",
+    b"class",
+    b"struct",
+    b"enum",
+    b"union",
+    b"interface",
+    b"trait",
+    b"impl",
+    b"mod",
+    b"namespace",
+];
+
+/// What kind of scope a [`Scope`] is.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum ScopeKind {
+    /// A declaration from the outline.
+    Symbol(SymbolKind),
+    /// An anonymous block, named after its keyword.
+    Block,
+}
+
+/// A range of the document that is a scope of its own.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Scope {
+    /// The name of the declaration, or the keyword of a block (`if`, `func`, ...).
+    pub name: String,
+    /// See [`Symbol::detail`].
+    pub detail: Option<String>,
+    pub kind: ScopeKind,
+    /// The 0-based line the scope starts on, i.e. what a sticky header shows.
+    pub header_line: usize,
+    /// The range of the entire scope, starting at its declaration or keyword.
+    pub range: Range<usize>,
+}
+
+/// Indexes all scopes in a document and answers which ones contain a position.
+#[derive(Debug, Clone, Default)]
+pub struct ScopeIndex {
+    /// All scopes, ordered by their start. Outer scopes come before the scopes they contain.
+    scopes: Vec<Scope>,
+}
+
+impl ScopeIndex {
+    /// Index the scopes in `tokens`, which must be the tokens of `text` in `language`.
+    pub fn new(language: Language, text: &[u8], tokens: &[Token]) -> Self {
+        let lines = LineIndex::new(text);
+        let mut scopes = Vec::new();
+        add_symbols(&lines, outline(language, text, tokens), &mut scopes);
+        let symbols = scopes.len();
+
+        if language.metadata().folding.hook.is_some() {
+            for fold in folding_ranges(language, text, tokens) {
+                if fold.kind == FoldKind::Region {
+                    let header = lines.range(fold.start_line);
+                    let end = lines.range(fold.end_line).end;
+                    if let Some(scope) = indented_scope(text, tokens, fold.start_line, header, end)
+                    {
+                        scopes.push(scope);
+                    }
+                }
+            }
+        } else {
+            for pair in BracketMatcher::new(language, text, tokens).all_pairs() {
+                let opener = &text[pair.open.clone()];
+                let header = lines.range(lines.line_of(pair.open.start)).start..pair.open.start;
+                let keyword = if opener == b"{" {
+                    block_keyword(text, tokens, header)
+                } else if opener.iter().all(u8::is_ascii_alphabetic) {
+                    // Keyword pairs like `do`/`done` are named after the loop they belong to.
+                    block_keyword(text, tokens, header).or(Some(pair.open.clone()))
+                } else {
+                    None
+                };
+                let Some(keyword) = keyword else {
+                    continue;
+                };
+
+                // The body of a declaration is part of the declaration's scope.
+                let header_line = lines.line_of(keyword.start);
+                if scopes[..symbols].iter().any(|s: &Scope| {
+                    s.header_line == header_line && s.range.contains(&pair.open.start)
+                }) {
+                    continue;
+                }
+                scopes.push(Scope {
+                    name: String::from_utf8_lossy(&text[keyword.clone()]).into_owned(),
+                    detail: None,
+                    kind: ScopeKind::Block,
+                    header_line,
+                    range: keyword.start..pair.close.end,
+                });
+            }
+        }
+
+        scopes
+            .sort_by(|a, b| a.range.start.cmp(&b.range.start).then(b.range.end.cmp(&a.range.end)));
+
+        // Functions declared directly in a type are methods.
+        let mut stack: Vec<usize> = Vec::new();
+        for i in 0..scopes.len() {
+            stack.retain(|&j| scopes[j].range.end > scopes[i].range.start);
+            let parent =
+                stack.iter().rev().map(|&j| scopes[j].kind).find(|&k| k != ScopeKind::Block);
+            if scopes[i].kind == ScopeKind::Symbol(SymbolKind::Function)
+                && parent == Some(ScopeKind::Symbol(SymbolKind::Type))
+            {
+                scopes[i].kind = ScopeKind::Symbol(SymbolKind::Method);
+            }
+            stack.push(i);
+        }
+
+        Self { scopes }
+    }
+
+    /// The scopes containing `offset`, outermost first.
+    ///
+    /// Anonymous blocks are only included if `blocks` is set.
+    pub fn enclosing(&self, offset: usize, blocks: bool) -> Vec<&Scope> {
+        let end = self.scopes.partition_point(|s| s.range.start <= offset);
+        self.scopes[..end]
+            .iter()
+            .filter(|s| s.range.contains(&offset) && (blocks || s.kind != ScopeKind::Block))
+            .collect()
+    }
+
+    /// All scopes, ordered by where they start.
+    pub fn all_scopes(&self) -> &[Scope] {
+        &self.scopes
+    }
+}
+
+/// Adds the symbols that can contain other code, and their children, to `scopes`.
+fn add_symbols(lines: &LineIndex, symbols: Vec<Symbol>, scopes: &mut Vec<Scope>) {
+    for symbol in symbols {
+        if !matches!(symbol.kind, SymbolKind::Field | SymbolKind::Constant | SymbolKind::Variable) {
+            scopes.push(Scope {
+                name: symbol.name,
+                detail: symbol.detail,
+                kind: ScopeKind::Symbol(symbol.kind),
+                header_line: lines.line_of(symbol.range.start),
+                range: symbol.range,
+            });
+        }
+        add_symbols(lines, symbol.children, scopes);
+    }
+}
+
+/// Finds the keyword that names a block whose header spans `header`: the first keyword
+/// that introduces blocks, like `if`, or `func` in `go func() {`.
+fn block_keyword(text: &[u8], tokens: &[Token], header: Range<usize>) -> Option<Range<usize>> {
+    tokens_in(tokens, header)
+        .iter()
+        .find(|t| t.kind.is_keyword() && BLOCK_KEYWORDS.contains(&&text[t.span.clone()]))
+        .map(|t| t.span.clone())
+}
+
+/// Turns an indented block with the given header line into a scope.
+///
+/// `def` and `class` blocks become functions and types named after the identifier
+/// that follows them, other blocks are named after the keyword they start with.
+fn indented_scope(
+    text: &[u8],
+    tokens: &[Token],
+    header_line: usize,
+    header: Range<usize>,
+    end: usize,
+) -> Option<Scope> {
+    let tokens = tokens_in(tokens, header);
+    let first = tokens.iter().find(|t| !t.kind.is_trivia() && !t.is_empty())?;
+    let declaration = tokens.iter().enumerate().find(|(_, t)| {
+        matches!(t.kind, TokenKind::KeywordFunction | TokenKind::KeywordType)
+            && !matches!(&text[t.span.clone()], b"async" | b"await" | b"lambda")
+    });
+
+    let (name, kind) = match declaration {
+        Some((i, keyword)) => {
+            let name = tokens[i + 1..].iter().find(|t| !t.kind.is_trivia())?;
+            let kind = if keyword.kind == TokenKind::KeywordType {
+                SymbolKind::Type
+            } else {
+                SymbolKind::Function
+            };
+            (name.span.clone(), ScopeKind::Symbol(kind))
+        }
+        None => (block_keyword(text, tokens, first.span.clone())?, ScopeKind::Block),
+    };
+    Some(Scope {
+        name: String::from_utf8_lossy(&text[name]).into_owned(),
+        detail: None,
+        kind,
+        header_line,
+        range: first.span.start..end,
+    })
+}
+
+fn tokens_in(tokens: &[Token], range: Range<usize>) -> &[Token] {
+    let start = tokens.partition_point(|t| t.span.end <= range.start);
+    let end = tokens.partition_point(|t| t.span.start < range.end);
+    &tokens[start..end.max(start)]
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::syntax::LexerRegistry;
+
+    /// Renders the scopes around the first occurrence of `needle` as a breadcrumb.
+    fn breadcrumb(language: Language, text: &[u8], needle: &str, blocks: bool) -> String {
+        let tokens = LexerRegistry::get_lexer(language).tokenize(text);
+        let index = ScopeIndex::new(language, text, &tokens);
+        let offset = text
+            .windows(needle.len())
+            .position(|w| w == needle.as_bytes())
+            .unwrap_or_else(|| panic!("{needle:?} not found"));
+        let lines = LineIndex::new(text);
+        index
+            .enclosing(offset, blocks)
+            .iter()
+            .map(|s| {
+                assert_eq!(lines.line_of(s.range.start), s.header_line, "{s:?}");
+                match (&s.detail, s.kind) {
+                    (Some(detail), ScopeKind::Symbol(SymbolKind::Method)) => {
+                        format!("({detail}) {}", s.name)
+                    }
+                    (_, ScopeKind::Block) => format!("{} block", s.name),
+                    _ => s.name.clone(),
+                }
+            })
+            .collect::<Vec<_>>()
+            .join(" > ")
+    }
+
+    #[test]
+    fn test_go_breadcrumbs() {
+        let text = include_bytes!("../../../../syntax-tests/test_syntax.go");
+        let go = |needle, blocks| breadcrumb(Language::Go, text, needle, blocks);
+
+        assert_eq!(go("p.Age = newAge", true), "(*Person) UpdateAge");
+        assert_eq!(go("Radius float64", true), "Circle");
+        assert_eq!(go("package main", true), "");
+        assert_eq!(go("fmt.Println(\"Error:\", err)", true), "main > if block");
+        assert_eq!(go("fmt.Println(\"30 or less\")", true), "main > else block");
+        assert_eq!(go("fmt.Printf(\"Worker %d\\n\", id)", true), "main > for block > func block");
+        assert_eq!(go("fmt.Printf(\"Worker %d\\n\", id)", false), "main");
+        assert_eq!(go("fmt.Println(\"Recovered from:\", r)", true), "main > func block > if block");
+        assert_eq!(go("return a / b, nil", true), "divide");
+    }
+
+    #[test]
+    fn test_indented_breadcrumbs() {
+        let text = b"class Stack:\n    def push(self, x):\n        if x:\n            self.items.append(x)\n\n    def pop(self):\n        return 1\n";
+        let python = |needle| breadcrumb(Language::Python, text, needle, true);
+        assert_eq!(python("self.items"), "Stack > push > if block");
+        assert_eq!(python("return"), "Stack > pop");
+        assert_eq!(python("class"), "Stack");
+    }
+
+    #[test]
+    fn test_keyword_pair_breadcrumbs() {
+        let text = b"for f in *; do\n  if [ -d \"$f\" ]; then\n    echo dir\n  fi\ndone\n";
+        let shell = |needle| breadcrumb(Language::Shell, text, needle, true);
+        assert_eq!(shell("echo"), "for block > if block");
+    }
+}
@@ -0,0 +1,369 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//! Ranges for "expand selection".
+//!
+//! Starting at the cursor, the selection grows to the word, the contents of a string or
+//! comment, the entire string or comment, the contents of the enclosing brackets, the
+//! brackets themselves, the lines they're on, and so on up to the entire document.
+//! Languages may add ranges of their own through
+//! [`GrammarMetadata::selection`](crate::syntax::GrammarMetadata::selection).
+
+use std::ops::Range;
+
+use crate::syntax::lines::LineIndex;
+use crate::syntax::{BracketMatcher, FoldKind, Language, Token, TokenKind, folding_ranges};
+
+/// Adds language specific ranges around `offset` to `candidates`.
+/// See [`GrammarMetadata::selection`](crate::syntax::GrammarMetadata::selection).
+///
+/// Candidates which don't nest with the other ranges around the cursor are ignored.
+pub type SelectionHook =
+    fn(text: &[u8], tokens: &[Token], offset: usize, candidates: &mut Vec<Range<usize>>);
+
+/// Compute the ranges "expand selection" steps through from `offset`, innermost first.
+///
+/// Every range strictly contains the one before it and the last one is the entire document.
+/// The structural ranges are the bracket pairs (their contents and then the pair itself)
+/// and, for languages whose blocks are defined by indentation, the folding ranges.
+/// Before each of them the selection grows to the lines it's on, without their indentation.
+pub fn selection_ranges(
+    language: Language,
+    text: &[u8],
+    tokens: &[Token],
+    offset: usize,
+) -> Vec<Range<usize>> {
+    let metadata = language.metadata();
+    let lines = LineIndex::new(text);
+    let mut ranges = Vec::new();
+    token_ranges(text, tokens, offset, &mut ranges);
+
+    let mut candidates = Vec::new();
+    for pair in BracketMatcher::new(language, text, tokens).all_pairs() {
+        if pair.open.start <= offset && offset <= pair.close.end {
+            candidates.push(trim(text, pair.open.end..pair.close.start));
+            candidates.push(pair.open.start..pair.close.end);
+        }
+    }
+    if metadata.folding.hook.is_some() {
+        for fold in folding_ranges(language, text, tokens) {
+            if fold.kind == FoldKind::Region {
+                let start = lines.range(fold.start_line);
+                let end = lines.range(fold.end_line);
+                candidates.push(start.start + indentation(&text[start])..end.end);
+            }
+        }
+    }
+    if let Some(hook) = metadata.selection {
+        hook(text, tokens, offset, &mut candidates);
+    }
+    candidates.sort_by(|a, b| a.len().cmp(&b.len()).then(b.start.cmp(&a.start)));
+
+    for candidate in candidates {
+        let Some(last) = ranges.last() else {
+            // The cursor is in whitespace, so the first range is the innermost one around it.
+            if candidate.start <= offset && offset <= candidate.end {
+                ranges.push(candidate);
+            }
+            continue;
+        };
+        if !contains(&candidate, last) {
+            continue;
+        }
+        let line = trimmed_lines(text, &lines, last.clone());
+        if contains(&candidate, &line) {
+            push(&mut ranges, line);
+        }
+        push(&mut ranges, candidate);
+    }
+
+    if let Some(last) = ranges.last() {
+        let line = trimmed_lines(text, &lines, last.clone());
+        push(&mut ranges, line);
+    }
+    push(&mut ranges, 0..text.len());
+    ranges
+}
+
+/// Adds the ranges within the token at `offset`: the word, escape sequence or
+/// contents it's in, and the token itself.
+fn token_ranges(text: &[u8], tokens: &[Token], offset: usize, ranges: &mut Vec<Range<usize>>) {
+    let idx = tokens.partition_point(|t| t.span.end <= offset);
+    let containing = tokens.get(idx).filter(|t| t.span.start <= offset && !t.is_empty());
+    let before = idx.checked_sub(1).map(|i| &tokens[i]).filter(|t| t.span.end == offset);
+    // Between `x` and `)`, prefer the `x`.
+    let (idx, token) = match (containing, before) {
+        (Some(t), Some(b)) if is_punctuation(t.kind) && !is_punctuation(b.kind) => (idx - 1, b),
+        (Some(t), _) => (idx, t),
+        (None, Some(b)) => (idx - 1, b),
+        (None, None) => return,
+    };
+
+    match token.kind {
+        TokenKind::Whitespace => {}
+        TokenKind::String
+        | TokenKind::DocString
+        | TokenKind::Escape
+        | TokenKind::FormatSpecifier => {
+            // A string may be split into several tokens around its escape sequences and verbs.
+            let is_part = |t: &Token| {
+                t.kind.is_string()
+                    || matches!(t.kind, TokenKind::Escape | TokenKind::FormatSpecifier)
+            };
+            let mut first = idx;
+            while first > 0 && is_part(&tokens[first - 1]) {
+                first -= 1;
+            }
+            let mut last = idx;
+            while last + 1 < tokens.len() && is_part(&tokens[last + 1]) {
+                last += 1;
+            }
+            let string = tokens[first].span.start..tokens[last].span.end;
+
+            if !token.kind.is_string() {
+                push(ranges, token.span.clone());
+            } else {
+                push(ranges, word(text, token.span.clone(), offset));
+            }
+            push(ranges, string_contents(text, string.clone()));
+            push(ranges, string);
+        }
+        TokenKind::Comment | TokenKind::DocComment => {
+            push(ranges, word(text, token.span.clone(), offset));
+            push(ranges, comment_contents(text, token.span.clone()));
+            push(ranges, token.span.clone());
+        }
+        kind => {
+            // Plain text and prose are lexed as long identifiers.
+            if kind.is_identifier() {
+                push(ranges, word(text, token.span.clone(), offset));
+            }
+            push(ranges, token.span.clone());
+        }
+    }
+}
+
+/// The contents of a string without its prefix and quotes, e.g. `a` for `r#"a"#`.
+fn string_contents(text: &[u8], string: Range<usize>) -> Range<usize> {
+    let s = &text[string.clone()];
+    let Some(quote) = s.iter().position(|&b| matches!(b, b'"' | b'\'' | b'`')) else {
+        return string;
+    };
+    let q = s[quote];
+    let n = s[quote..].iter().take_while(|&&b| b == q).count().min(3);
+    // An empty string like `""` is a quote run of two.
+    let n = if n == 2 && s.len() == quote + 2 { 1 } else { n };
+
+    let mut end = s.len() - s.iter().rev().take_while(|&&b| b == b'#').count();
+    let closing = s[quote + n..end].iter().rev().take_while(|&&b| b == q).count().min(n);
+    end -= closing;
+    string.start + quote + n..string.start + end.max(quote + n)
+}
+
+/// The contents of a comment without its delimiters and the whitespace around them.
+fn comment_contents(text: &[u8], comment: Range<usize>) -> Range<usize> {
+    const OPENERS: &[&[u8]] = &[b"<!--", b"/**", b"/*", b"///", b"//!", b"//", b"--", b"#"];
+    const CLOSERS: &[&[u8]] = &[b"-->", b"*/"];
+
+    let s = &text[comment.clone()];
+    let open = OPENERS.iter().find(|o| s.starts_with(o)).map_or(0, |o| o.len());
+    let close = CLOSERS.iter().find(|c| s[open..].ends_with(c)).map_or(0, |c| c.len());
+    let inner = &s[open..s.len() - close];
+    let start = open + inner.iter().take_while(|b| b.is_ascii_whitespace()).count();
+    let end =
+        (s.len() - close - inner.iter().rev().take_while(|b| b.is_ascii_whitespace()).count())
+            .max(start);
+    comment.start + start..comment.start + end
+}
+
+/// The run of word characters around `offset` within `span`, or `span` if there's none.
+fn word(text: &[u8], span: Range<usize>, offset: usize) -> Range<usize> {
+    let is_word = |b: &u8| b.is_ascii_alphanumeric() || *b == b'_' || *b >= 0x80;
+    let start = offset - text[span.start..offset].iter().rev().take_while(|b| is_word(b)).count();
+    let end = offset + text[offset..span.end].iter().take_while(|b| is_word(b)).count();
+    if start < end { start..end } else { span }
+}
+
+/// The lines `range` is on, without the indentation of the first one
+/// and the whitespace at the end of the last one.
+fn trimmed_lines(text: &[u8], lines: &LineIndex, range: Range<usize>) -> Range<usize> {
+    let first = lines.range(lines.line_of(range.start));
+    let last = lines.range(lines.line_of(range.end));
+    let start = first.start + indentation(&text[first]);
+    let end = last.end - text[last].iter().rev().take_while(|b| b.is_ascii_whitespace()).count();
+    start.min(range.start)..end.max(range.end)
+}
+
+fn trim(text: &[u8], range: Range<usize>) -> Range<usize> {
+    let s = &text[range.clone()];
+    let start = s.iter().take_while(|b| b.is_ascii_whitespace()).count();
+    let end = s.len() - s[start..].iter().rev().take_while(|b| b.is_ascii_whitespace()).count();
+    range.start + start..range.start + end
+}
+
+fn indentation(line: &[u8]) -> usize {
+    line.iter().take_while(|&&b| b == b' ' || b == b'\t').count()
+}
+
+/// Adds `range` if it strictly contains the last range.
+fn push(ranges: &mut Vec<Range<usize>>, range: Range<usize>) {
+    match ranges.last() {
+        Some(last) if !contains(&range, last) || range == *last => {}
+        _ if range.is_empty() => {}
+        _ => ranges.push(range),
+    }
+}
+
+fn contains(outer: &Range<usize>, inner: &Range<usize>) -> bool {
+    outer.start <= inner.start && inner.end <= outer.end
+}
+
+fn is_punctuation(kind: TokenKind) -> bool {
+    matches!(
+        kind,
+        TokenKind::Whitespace
+            | TokenKind::Operator
+            | TokenKind::Punctuation
+            | TokenKind::Delimiter
+            | TokenKind::Separator
+            | TokenKind::JsonBrace
+            | TokenKind::JsonBracket
+            | TokenKind::JsonColon
+            | TokenKind::JsonComma
+    )
+}
+
+/// Selection hook for Markdown: the paragraph around the cursor.
+pub fn markdown_selection(
+    text: &[u8],
+    _tokens: &[Token],
+    offset: usize,
+    candidates: &mut Vec<Range<usize>>,
+) {
+    let lines = LineIndex::new(text);
+    let is_blank = |line| text[lines.range(line)].iter().all(u8::is_ascii_whitespace);
+    let line = lines.line_of(offset);
+    if is_blank(line) {
+        return;
+    }
+    let mut first = line;
+    while first > 0 && !is_blank(first - 1) {
+        first -= 1;
+    }
+    let mut last = line;
+    while last + 1 < lines.count() && !is_blank(last + 1) {
+        last += 1;
+    }
+    candidates.push(lines.range(first).start..lines.range(last).end);
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::syntax::LexerRegistry;
+
+    /// Expands from the `skip`th byte of the first `needle` and renders each range
+    /// as its first and last line.
+    fn expand(language: Language, text: &[u8], needle: &str, skip: usize) -> Vec<String> {
+        let tokens = LexerRegistry::get_lexer(language).tokenize(text);
+        let offset = text.windows(needle.len()).position(|w| w == needle.as_bytes()).unwrap();
+        let ranges = selection_ranges(language, text, &tokens, offset + skip);
+
+        for pair in ranges.windows(2) {
+            assert!(contains(&pair[1], &pair[0]) && pair[0] != pair[1], "{ranges:?}");
+        }
+        assert_eq!(ranges.last(), Some(&(0..text.len())));
+
+        ranges[..ranges.len() - 1]
+            .iter()
+            .map(|r| {
+                let s = String::from_utf8_lossy(&text[r.clone()]).into_owned();
+                match (s.find('\n'), s.rfind('\n')) {
+                    (Some(first), Some(last)) => format!("{} … {}", &s[..first], &s[last + 1..]),
+                    _ => s,
+                }
+            })
+            .collect()
+    }
+
+    #[test]
+    fn test_go_raw_string() {
+        let text = include_bytes!("../../../../syntax-tests/test_syntax.go");
+        assert_eq!(
+            expand(Language::Go, text, "span multiple", 1),
+            [
+                "span",
+                "This is a raw string … and include \"quotes\" or a lone ( without escaping",
+                "`This is a raw string … and include \"quotes\" or a lone ( without escaping`",
+                "rawStr := `This is a raw string … and include \"quotes\" or a lone ( without escaping`",
+                "// Number literals … \tfmt.Println(\"Program completed\")",
+                "{ … }",
+                "func main() { … }",
+            ]
+        );
+    }
+
+    #[test]
+    fn test_go_nested_function_literal() {
+        let text = include_bytes!("../../../../syntax-tests/test_syntax.go");
+        assert_eq!(
+            expand(Language::Go, text, "x + y", 4),
+            [
+                "y",
+                "return x + y",
+                "{ … \t}",
+                "return func(y int) int { … \t}",
+                "{ … }",
+                "func makeAdder(x int) func(int) int { … }",
+            ]
+        );
+    }
+
+    #[test]
+    fn test_strings_and_comments() {
+        let text = b"f(\"a b c\", x) // note this\n";
+        assert_eq!(
+            expand(Language::Rust, text, "b c", 0),
+            [
+                "b",
+                "a b c",
+                "\"a b c\"",
+                "\"a b c\", x",
+                "(\"a b c\", x)",
+                "f(\"a b c\", x) // note this",
+            ]
+        );
+        assert_eq!(
+            expand(Language::Rust, text, "this", 0)[..3],
+            ["this", "note this", "// note this"]
+        );
+    }
+
+    #[test]
+    fn test_string_contents() {
+        let contents = |s: &str| {
+            let r = string_contents(s.as_bytes(), 0..s.len());
+            s[r].to_string()
+        };
+        assert_eq!(contents("r#\"a\"b\"#"), "a\"b");
+        assert_eq!(contents("f'{x}'"), "{x}");
+        assert_eq!(contents("\"\"\"doc\"\"\""), "doc");
+        assert_eq!(contents("\"\""), "");
+        assert_eq!(contents("\"open"), "open");
+    }
+
+    #[test]
+    fn test_indented_and_markdown() {
+        let python = b"def f(x):\n    if x:\n        return g(x)\n    return 0\n";
+        assert_eq!(
+            expand(Language::Python, python, "g(x)", 2),
+            ["x", "(x)", "return g(x)", "if x: …         return g(x)", "def f(x): …     return 0"]
+        );
+
+        let markdown = b"# Title\n\nSome text\nmore text.\n\nNext.\n";
+        assert_eq!(
+            expand(Language::Markdown, markdown, "more", 0)[..],
+            ["more", "more text.", "Some text … more text."]
+        );
+    }
+}
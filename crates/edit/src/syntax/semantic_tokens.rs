@@ -0,0 +1,491 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//! The token stream as LSP semantic tokens, for `textDocument/semanticTokens`.
+//!
+//! The encoding is a flat array with five numbers per token: the line relative to the
+//! previous token, the start relative to the previous token if on the same line (or to
+//! the start of the line otherwise), the length, the token type and the modifier bits.
+//! Positions are in UTF-16 code units, as the LSP specifies by default, which is why
+//! the encoders need the text. Tokens spanning lines, like block comments, are encoded
+//! once per line, because clients can't be assumed to support multi-line tokens.
+
+use std::ops::Range;
+
+use crate::syntax::lines::LineIndex;
+use crate::syntax::{Token, TokenKind, TokenPayload};
+
+/// The LSP's standard token types, in the order it lists them.
+const STANDARD_TYPES: &[&str] = &[
+    "namespace",
+    "type",
+    "class",
+    "enum",
+    "interface",
+    "struct",
+    "typeParameter",
+    "parameter",
+    "variable",
+    "property",
+    "enumMember",
+    "event",
+    "function",
+    "method",
+    "macro",
+    "keyword",
+    "modifier",
+    "comment",
+    "string",
+    "number",
+    "regexp",
+    "operator",
+    "decorator",
+    "label",
+];
+
+/// The LSP's standard token modifiers, in the order it lists them.
+const STANDARD_MODIFIERS: &[&str] = &[
+    "declaration",
+    "definition",
+    "readonly",
+    "static",
+    "deprecated",
+    "abstract",
+    "async",
+    "modification",
+    "documentation",
+    "defaultLibrary",
+];
+
+/// The token types and modifiers of an encoding, and which our token kinds map to.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Legend {
+    /// The names of the token types, whose indices the encoding refers to.
+    pub token_types: Vec<String>,
+    /// The names of the token modifiers, whose bits the encoding refers to.
+    pub token_modifiers: Vec<String>,
+    /// The type of tokens whose kind isn't mapped, or `None` to leave them out.
+    pub fallback: Option<u32>,
+    /// The type and modifier bits of each token kind, by `TokenKind as usize`.
+    kinds: Vec<Option<(u32, u32)>>,
+}
+
+impl Legend {
+    /// Create a legend without token types, modifiers or mapped kinds.
+    pub fn new() -> Self {
+        Self {
+            token_types: Vec::new(),
+            token_modifiers: Vec::new(),
+            fallback: None,
+            kinds: vec![None; TokenKind::ALL.len()],
+        }
+    }
+
+    /// Map `kind` to a token type and modifiers, which are added to the legend if needed.
+    pub fn map(&mut self, kind: TokenKind, token_type: &str, modifiers: &[&str]) {
+        let token_type = Self::index(&mut self.token_types, token_type);
+        let modifiers = modifiers
+            .iter()
+            .fold(0, |bits, m| bits | 1 << Self::index(&mut self.token_modifiers, m));
+        self.kinds[kind as usize] = Some((token_type, modifiers));
+    }
+
+    /// Leave tokens of `kind` unmapped, so that they get the fallback type, if any.
+    pub fn unmap(&mut self, kind: TokenKind) {
+        self.kinds[kind as usize] = None;
+    }
+
+    /// The index of a token type, adding it to the legend if needed.
+    pub fn token_type(&mut self, name: &str) -> u32 {
+        Self::index(&mut self.token_types, name)
+    }
+
+    /// The type and modifier bits of `token`, if it's encoded at all.
+    fn lookup(&self, token: &Token) -> Option<(u32, u32)> {
+        if token.kind == TokenKind::Whitespace {
+            return None;
+        }
+        let (token_type, mut modifiers) = match self.kinds[token.kind as usize] {
+            Some(mapped) => mapped,
+            None => (self.fallback?, 0),
+        };
+        if token.payload == Some(TokenPayload::Deprecated)
+            && let Some(bit) = self.token_modifiers.iter().position(|m| m == "deprecated")
+        {
+            modifiers |= 1 << bit;
+        }
+        Some((token_type, modifiers))
+    }
+
+    fn index(names: &mut Vec<String>, name: &str) -> u32 {
+        let index = names.iter().position(|n| n == name).unwrap_or_else(|| {
+            names.push(name.to_string());
+            names.len() - 1
+        });
+        index as u32
+    }
+}
+
+impl Default for Legend {
+    /// The standard LSP token types and modifiers, with each token kind mapped to the
+    /// closest type. Kinds without one, like punctuation and escapes, are left out.
+    fn default() -> Self {
+        let mut legend = Self::new();
+        legend.token_types = STANDARD_TYPES.iter().map(|t| t.to_string()).collect();
+        legend.token_modifiers = STANDARD_MODIFIERS.iter().map(|m| m.to_string()).collect();
+
+        for (kinds, token_type, modifiers) in [
+            (&[TokenKind::Comment, TokenKind::Inactive][..], "comment", &[][..]),
+            (&[TokenKind::DocComment], "comment", &["documentation"]),
+            (&[TokenKind::String, TokenKind::Char], "string", &[]),
+            (&[TokenKind::DocString], "string", &["documentation"]),
+            (&[TokenKind::Number], "number", &[]),
+            (
+                &[
+                    TokenKind::Boolean,
+                    TokenKind::Null,
+                    TokenKind::Keyword,
+                    TokenKind::KeywordControl,
+                    TokenKind::KeywordFunction,
+                    TokenKind::KeywordImport,
+                    TokenKind::KeywordStorage,
+                    TokenKind::KeywordType,
+                    TokenKind::KeywordOperator,
+                ],
+                "keyword",
+                &[],
+            ),
+            (&[TokenKind::Identifier, TokenKind::VariableName], "variable", &[]),
+            (&[TokenKind::TypeName], "type", &[]),
+            (&[TokenKind::FunctionName, TokenKind::FunctionCall], "function", &[]),
+            (&[TokenKind::FunctionDefinition], "function", &["declaration"]),
+            (&[TokenKind::PropertyName, TokenKind::JsonKey], "property", &[]),
+            (&[TokenKind::ParameterName], "parameter", &[]),
+            (&[TokenKind::Operator, TokenKind::MacroOperator], "operator", &[]),
+            (&[TokenKind::Attribute, TokenKind::RustAttribute], "decorator", &[]),
+            (&[TokenKind::Macro, TokenKind::RustMacro], "macro", &[]),
+            (&[TokenKind::Label], "label", &[]),
+            (&[TokenKind::Regex, TokenKind::RegexFlags], "regexp", &[]),
+        ] {
+            for &kind in kinds {
+                legend.map(kind, token_type, modifiers);
+            }
+        }
+        legend
+    }
+}
+
+/// Encode the tokens of `text` as LSP semantic tokens.
+pub fn encode_semantic_tokens(text: &[u8], tokens: &[Token], legend: &Legend) -> Vec<u32> {
+    encode_semantic_tokens_range(text, tokens, legend, 0..usize::MAX)
+}
+
+/// Encode the tokens on the 0-based `lines` of `text`, for `textDocument/semanticTokens/range`.
+/// Like in a full encoding, the first token's line is relative to the start of the document.
+pub fn encode_semantic_tokens_range(
+    text: &[u8],
+    tokens: &[Token],
+    legend: &Legend,
+    lines: Range<usize>,
+) -> Vec<u32> {
+    let index = LineIndex::new(text);
+    let lines = lines.start..lines.end.min(index.count());
+    let mut data = Vec::new();
+    if lines.is_empty() {
+        return data;
+    }
+    let start = index.range(lines.start).start;
+    let end = index.range(lines.end - 1).end;
+    let first = tokens.partition_point(|t| t.span.end <= start);
+
+    // The previous token's line and start, and the line and UTF-16 column of `offset`.
+    let (mut previous_line, mut previous_column) = (0, 0);
+    let (mut line, mut offset, mut column) = (lines.start, start, 0);
+    for token in &tokens[first..] {
+        if token.span.start >= end {
+            break;
+        }
+        let Some((token_type, modifiers)) = legend.lookup(token) else { continue };
+
+        let span = token.span.start.max(start)..token.span.end.min(end);
+        let mut pos = span.start;
+        while pos < span.end {
+            if index.line_of(pos) != line {
+                line = index.line_of(pos);
+                (offset, column) = (index.range(line).start, 0);
+            }
+            // Up to the end of the line, without its line ending.
+            let piece_end = span.end.min(index.range(line).end);
+            if pos < piece_end {
+                column += utf16_len(&text[offset..pos]);
+                offset = pos;
+                let length = utf16_len(&text[pos..piece_end]);
+                let delta_line = line - previous_line;
+                let delta_column = if delta_line == 0 { column - previous_column } else { column };
+                data.extend([delta_line, delta_column, length].map(|n| n as u32));
+                data.extend([token_type, modifiers]);
+                (previous_line, previous_column) = (line, column);
+            }
+            // Skip the line ending.
+            pos = if line + 1 < index.count() { index.range(line + 1).start } else { span.end };
+        }
+    }
+    data
+}
+
+/// The length of `bytes` in UTF-16 code units. Invalid UTF-8 counts like the
+/// U+FFFD it would be replaced with.
+fn utf16_len(bytes: &[u8]) -> usize {
+    bytes
+        .utf8_chunks()
+        .map(|chunk| {
+            chunk.valid().chars().map(char::len_utf16).sum::<usize>()
+                + !chunk.invalid().is_empty() as usize
+        })
+        .sum()
+}
+
+/// One edit of a [`SemanticTokensDelta`]: replace `delete_count` numbers at `start`
+/// of the previous encoding with `data`.
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub struct SemanticTokensEdit {
+    pub start: u32,
+    pub delete_count: u32,
+    pub data: Vec<u32>,
+}
+
+/// The edits that turn a previous encoding into the current one, for
+/// `textDocument/semanticTokens/full/delta`.
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub struct SemanticTokensDelta {
+    /// Empty if the encodings are the same, and a single edit otherwise.
+    pub edits: Vec<SemanticTokensEdit>,
+}
+
+impl SemanticTokensDelta {
+    /// Diff two encodings. The edit replaces whole tokens, i.e. the numbers between the
+    /// longest common prefix and suffix of tokens, which clients handle best.
+    pub fn new(previous: &[u32], current: &[u32]) -> Self {
+        let prefix = previous
+            .chunks(5)
+            .zip(current.chunks(5))
+            .take_while(|(a, b)| a == b)
+            .map(|(a, _)| a.len())
+            .sum::<usize>();
+        let max_suffix = previous.len().min(current.len()) - prefix;
+        let suffix = previous
+            .rchunks(5)
+            .zip(current.rchunks(5))
+            .take_while(|(a, b)| a == b)
+            .map(|(a, _)| a.len())
+            .sum::<usize>()
+            .min(max_suffix / 5 * 5);
+        if prefix == previous.len() && prefix == current.len() {
+            return Self::default();
+        }
+        Self {
+            edits: vec![SemanticTokensEdit {
+                start: prefix as u32,
+                delete_count: (previous.len() - prefix - suffix) as u32,
+                data: current[prefix..current.len() - suffix].to_vec(),
+            }],
+        }
+    }
+
+    /// Apply the edits to the encoding they were made against.
+    pub fn apply(&self, previous: &[u32]) -> Vec<u32> {
+        let mut data = previous.to_vec();
+        // Edits refer to the previous encoding, so apply them from the back.
+        let mut edits: Vec<_> = self.edits.iter().collect();
+        edits.sort_by_key(|e| std::cmp::Reverse(e.start));
+        for edit in edits {
+            let start = edit.start as usize;
+            data.splice(start..start + edit.delete_count as usize, edit.data.iter().copied());
+        }
+        data
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::syntax::{Language, LexerRegistry};
+
+    fn encode(language: Language, text: &str) -> Vec<u32> {
+        let tokens = LexerRegistry::get_lexer(language).tokenize(text.as_bytes());
+        encode_semantic_tokens(text.as_bytes(), &tokens, &Legend::default())
+    }
+
+    /// The encoded tokens as `line:column text type`, with the text cut out of the
+    /// UTF-16 code units of its line.
+    fn decode(text: &str, data: &[u32], legend: &Legend) -> Vec<String> {
+        let lines: Vec<Vec<u16>> = text.split('\n').map(|l| l.encode_utf16().collect()).collect();
+        let (mut line, mut column) = (0, 0);
+        data.chunks(5)
+            .map(|t| {
+                line += t[0] as usize;
+                column = if t[0] == 0 { column + t[1] as usize } else { t[1] as usize };
+                let units = &lines[line][column..column + t[2] as usize];
+                let mut name = legend.token_types[t[3] as usize].clone();
+                for (bit, modifier) in legend.token_modifiers.iter().enumerate() {
+                    if t[4] & 1 << bit != 0 {
+                        name = format!("{name}.{modifier}");
+                    }
+                }
+                format!("{line}:{column} {} {name}", String::from_utf16(units).unwrap())
+            })
+            .collect()
+    }
+
+    #[test]
+    fn test_encoding() {
+        assert_eq!(
+            encode(Language::Go, "x := 1 // one"),
+            [0, 0, 1, 8, 0, 0, 2, 2, 21, 0, 0, 3, 1, 19, 0, 0, 2, 6, 17, 0]
+        );
+
+        // Tokens spanning lines are split, and `\r\n` isn't part of them.
+        let text = "/* a\r\n b */ f";
+        let legend = Legend::default();
+        let tokens = LexerRegistry::get_lexer(Language::Go).tokenize(text.as_bytes());
+        let data = encode_semantic_tokens(text.as_bytes(), &tokens, &legend);
+        assert_eq!(
+            decode(text, &data, &legend),
+            ["0:0 /* a comment", "1:0  b */ comment", "1:6 f variable"]
+        );
+
+        // Punctuation is left out, unless there's a fallback.
+        let text = r#"{"a": 1}"#;
+        let tokens = LexerRegistry::get_lexer(Language::Json).tokenize(text.as_bytes());
+        let mut legend = Legend::default();
+        let data = encode_semantic_tokens(text.as_bytes(), &tokens, &legend);
+        assert_eq!(decode(text, &data, &legend), [r#"0:1 "a" string"#, "0:6 1 number"]);
+        legend.fallback = Some(legend.token_type("punctuation"));
+        let data = encode_semantic_tokens(text.as_bytes(), &tokens, &legend);
+        assert_eq!(
+            decode(text, &data, &legend),
+            [
+                "0:0 { punctuation",
+                r#"0:1 "a" string"#,
+                "0:4 : punctuation",
+                "0:6 1 number",
+                "0:7 } punctuation"
+            ]
+        );
+    }
+
+    #[test]
+    fn test_legend() {
+        let mut legend = Legend::new();
+        legend.map(TokenKind::KeywordControl, "keyword", &["control"]);
+        legend.map(TokenKind::Keyword, "keyword", &[]);
+        legend.map(TokenKind::FunctionDefinition, "function", &["declaration", "control"]);
+        assert_eq!(legend.token_types, ["keyword", "function"]);
+        assert_eq!(legend.token_modifiers, ["control", "declaration"]);
+        assert_eq!(
+            encode_semantic_tokens(b"if", &[Token::new(TokenKind::KeywordControl, 0..2)], &legend),
+            [0, 0, 2, 0, 1]
+        );
+
+        legend.unmap(TokenKind::KeywordControl);
+        assert_eq!(
+            encode_semantic_tokens(b"if", &[Token::new(TokenKind::KeywordControl, 0..2)], &legend),
+            []
+        );
+
+        // Deprecated constructs get the modifier of the same name, if the legend has it.
+        let legend = Legend::default();
+        let token = Token::new(TokenKind::Identifier, 0..1).with_payload(TokenPayload::Deprecated);
+        assert_eq!(
+            decode("x", &encode_semantic_tokens(b"x", &[token], &legend), &legend),
+            ["0:0 x variable.deprecated"]
+        );
+    }
+
+    #[test]
+    fn test_unicode() {
+        // The fixture's section on Unicode identifiers, with astral-plane characters, emoji
+        // and combining marks, whose columns differ in bytes, chars and UTF-16 code units.
+        let fixture = include_str!("../../../../syntax-tests/test_syntax.go");
+        let start = fixture.find("// Unicode identifiers").unwrap();
+        let end = start + fixture[start..].find("\n\n// Compiler directives").unwrap();
+        let text = &fixture[start..end];
+
+        let legend = Legend::default();
+        let tokens = LexerRegistry::get_lexer(Language::Go).tokenize(text.as_bytes());
+        let data = encode_semantic_tokens(text.as_bytes(), &tokens, &legend);
+        let decoded = decode(text, &data, &legend);
+        assert!(decoded.contains(&"5:4 𠀀 variable".to_string()));
+        assert!(decoded.contains(&"5:9 \"😀 \\U0001F600 👩‍🔬\" string".to_string()));
+        assert!(decoded.contains(&"10:0 var keyword".to_string()));
+
+        // Every token decodes to its own text.
+        let expected: Vec<String> = tokens
+            .iter()
+            .filter(|t| legend.lookup(t).is_some())
+            .flat_map(|t| text[t.span.clone()].split('\n').filter(|s| !s.is_empty()))
+            .map(String::from)
+            .collect();
+        let texts: Vec<&str> = decoded
+            .iter()
+            .map(|d| d.split_once(' ').unwrap().1.rsplit_once(' ').unwrap().0)
+            .collect();
+        assert_eq!(texts, expected);
+
+        // Invalid UTF-8 counts like its replacement character.
+        let invalid = b"x\xFF\xFEy";
+        let tokens = [
+            Token::new(TokenKind::Identifier, 0..1),
+            Token::new(TokenKind::Error, 1..3),
+            Token::new(TokenKind::Identifier, 3..4),
+        ];
+        assert_eq!(
+            encode_semantic_tokens(invalid, &tokens, &legend),
+            [0, 0, 1, 8, 0, 0, 3, 1, 8, 0]
+        );
+    }
+
+    #[test]
+    fn test_range() {
+        let text = "a\n/* b\nc */\nd\ne";
+        let full = encode(Language::Go, text);
+        let tokens = LexerRegistry::get_lexer(Language::Go).tokenize(text.as_bytes());
+        let legend = Legend::default();
+        let range = |lines| encode_semantic_tokens_range(text.as_bytes(), &tokens, &legend, lines);
+
+        assert_eq!(range(0..usize::MAX), full);
+        assert_eq!(range(2..4), [2, 0, 4, 17, 0, 1, 0, 1, 8, 0]);
+        assert_eq!(decode(text, &range(2..4), &legend), ["2:0 c */ comment", "3:0 d variable"]);
+        assert_eq!(range(4..5), [4, 0, 1, 8, 0]);
+        assert_eq!(range(5..9), []);
+        assert_eq!(range(3..3), []);
+    }
+
+    #[test]
+    fn test_delta() {
+        let fixture = include_str!("../../../../syntax-tests/test_syntax.go");
+        let previous = encode(Language::Go, fixture);
+
+        let edits = [
+            fixture.to_string(),
+            fixture.replacen("package main", "package main\n\nvar x = 1", 1),
+            fixture.replacen("func main()", "func main() /* ☃ */", 1),
+            format!("{fixture}\nvar y = 2"),
+            fixture[fixture.len() / 2..].to_string(),
+            String::new(),
+        ];
+        for text in &edits {
+            let current = encode(Language::Go, text);
+            let delta = SemanticTokensDelta::new(&previous, &current);
+            assert_eq!(delta.apply(&previous), current);
+            assert!(delta.edits.iter().all(|e| e.start % 5 == 0 && e.delete_count % 5 == 0));
+        }
+        assert_eq!(SemanticTokensDelta::new(&previous, &previous).edits, []);
+
+        // An insertion only sends what changed.
+        let current = encode(Language::Go, &edits[1]);
+        let delta = SemanticTokensDelta::new(&previous, &current);
+        assert_eq!(delta.edits.len(), 1);
+        assert!(delta.edits[0].data.len() <= 6 * 5);
+    }
+}
@@ -0,0 +1,510 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//! Extraction of the prose in a document, i.e. the parts worth spell checking.
+//!
+//! Which token kinds are prose is declared per language in
+//! [`GrammarMetadata::prose`](crate::syntax::GrammarMetadata::prose). Within those tokens,
+//! markup (quotes, comment delimiters, `**`, ...), URLs and file paths are cut out.
+
+use std::ops::Range;
+
+use crate::syntax::links::find_links;
+use crate::syntax::{DocMarkup, Language, Token, TokenKind, TokenPayload};
+
+/// Compute the byte ranges of `text` that should be spell checked, in order.
+///
+/// String literals consisting of a single word that looks like an identifier, a path or
+/// a URL are skipped entirely. In Markdown, code spans and fenced code blocks are skipped.
+/// If `split_identifiers` is set, identifiers in comments (`camelCase`, `snake_case`)
+/// are split into one range per fragment, so that only the fragments get checked.
+pub fn spell_check_regions(
+    language: Language,
+    text: &[u8],
+    tokens: &[Token],
+    split_identifiers: bool,
+) -> Vec<Range<usize>> {
+    let prose = language.metadata().prose;
+    let mut regions = Vec::new();
+    let mut in_fence = false;
+
+    for token in tokens {
+        if language == Language::Markdown
+            && token.kind == TokenKind::MarkdownCode
+            && is_fence(text, token)
+        {
+            in_fence = !in_fence;
+            continue;
+        }
+        // Links were already marked by `detect_links`. Of a doc comment's markup,
+        // only headings are prose.
+        let markup =
+            token.payload.is_some_and(|p| p != TokenPayload::DocMarkup(DocMarkup::Heading));
+        if in_fence || markup || !prose.contains(&token.kind) {
+            continue;
+        }
+
+        let range = match token.kind {
+            TokenKind::String | TokenKind::DocString => {
+                let range = string_contents(text, token.span.clone());
+                if is_single_word(&text[range.clone()]) && !is_word(&text[range.clone()]) {
+                    continue;
+                }
+                range
+            }
+            TokenKind::Comment | TokenKind::DocComment => {
+                trim(text, token.span.clone(), b"/*#!-<", b"*/->")
+            }
+            TokenKind::MarkdownLink => {
+                let end = text[token.span.clone()].iter().position(|&b| b == b']');
+                token.span.start + 1..token.span.start + end.unwrap_or(token.len())
+            }
+            // Strip heading, emphasis, list and quote markers.
+            _ => trim(text, token.span.clone(), b"#*_-+>.0123456789", b"#*_"),
+        };
+        if range.is_empty() {
+            continue;
+        }
+
+        let mut pos = range.start;
+        for (link, _) in find_links(text, range.clone(), true) {
+            push(&mut regions, text, pos..link.start, split_identifiers && token.kind.is_comment());
+            pos = link.end;
+        }
+        push(&mut regions, text, pos..range.end, split_identifiers && token.kind.is_comment());
+    }
+
+    regions
+}
+
+/// Adds `range` to `regions` unless it contains no letters.
+fn push(regions: &mut Vec<Range<usize>>, text: &[u8], range: Range<usize>, split: bool) {
+    let range = trim(text, range, b"", b"");
+    if !text[range.clone()].iter().any(|&b| is_letter(b)) {
+        return;
+    }
+    if !split {
+        regions.push(range);
+        return;
+    }
+
+    // Cut out the identifiers and add their fragments separately.
+    let mut start = range.start;
+    let mut pos = range.start;
+    while pos < range.end {
+        if !is_ident_byte(text[pos]) {
+            pos += 1;
+            continue;
+        }
+        let word_start = pos;
+        while pos < range.end && is_ident_byte(text[pos]) {
+            pos += 1;
+        }
+        let fragments = fragments(text, word_start..pos);
+        if fragments.len() > 1 {
+            push(regions, text, start..word_start, false);
+            regions.extend(
+                fragments.into_iter().filter(|f| text[f.clone()].iter().any(|&b| is_letter(b))),
+            );
+            start = pos;
+        }
+    }
+    push(regions, text, start..range.end, false);
+}
+
+/// Splits an identifier into its `snake_case` and `camelCase` fragments.
+/// `HTTPServer` is split into `HTTP` and `Server`.
+fn fragments(text: &[u8], range: Range<usize>) -> Vec<Range<usize>> {
+    let mut fragments = Vec::new();
+    let mut start = range.start;
+
+    for i in range.clone() {
+        let b = text[i];
+        let prev = if i > range.start { text[i - 1] } else { b'_' };
+        let next = text.get(i + 1).copied().filter(|_| i + 1 < range.end).unwrap_or(b'_');
+        let boundary = b == b'_'
+            || (b.is_ascii_uppercase() && prev.is_ascii_lowercase())
+            || (b.is_ascii_uppercase() && prev.is_ascii_uppercase() && next.is_ascii_lowercase())
+            || (b.is_ascii_digit() != prev.is_ascii_digit() && prev != b'_');
+        if boundary && i > start {
+            fragments.push(start..i);
+            start = i;
+        }
+        if b == b'_' {
+            start = i + 1;
+        }
+    }
+    if start < range.end {
+        fragments.push(start..range.end);
+    }
+
+    fragments
+}
+
+/// Returns the contents of a string literal without its prefix (`r`, `b`, `f`, `@`, ...) and quotes.
+/// Lexers may split strings at escape sequences, so either quote may be missing.
+fn string_contents(text: &[u8], range: Range<usize>) -> Range<usize> {
+    let is_quote = |b: u8| matches!(b, b'"' | b'\'' | b'`');
+    let mut start = range.start;
+    let mut end = range.end;
+
+    let prefix = text[range.clone()]
+        .iter()
+        .take_while(|&&b| b.is_ascii_alphabetic() || matches!(b, b'@' | b'$' | b'#'))
+        .count();
+    if text[range.clone()].get(prefix).is_some_and(|&b| is_quote(b)) {
+        start += prefix;
+        while start < end && is_quote(text[start]) {
+            start += 1;
+        }
+    }
+    if text[range.start..start].contains(&b'#') {
+        while end > start && text[end - 1] == b'#' {
+            end -= 1;
+        }
+    }
+    while end > start && is_quote(text[end - 1]) {
+        end -= 1;
+    }
+
+    start..end
+}
+
+/// Trims whitespace and the given delimiter bytes from both ends of `range`.
+fn trim(text: &[u8], range: Range<usize>, leading: &[u8], trailing: &[u8]) -> Range<usize> {
+    let mut start = range.start;
+    let mut end = range.end;
+    while start < end && (text[start].is_ascii_whitespace() || leading.contains(&text[start])) {
+        start += 1;
+    }
+    while end > start && (text[end - 1].is_ascii_whitespace() || trailing.contains(&text[end - 1]))
+    {
+        end -= 1;
+    }
+    start..end
+}
+
+fn is_single_word(s: &[u8]) -> bool {
+    !s.iter().any(|b| b.is_ascii_whitespace())
+}
+
+/// Checks whether a single word is an ordinary word, as opposed to an identifier,
+/// a path or a URL: it may only contain letters, apostrophes and hyphens, followed by
+/// punctuation, and may only start with an uppercase letter.
+fn is_word(word: &[u8]) -> bool {
+    let len = word.len() - word.iter().rev().take_while(|b| b".,:;!?".contains(b)).count();
+    let word = &word[..len];
+    !word.is_empty()
+        && word.iter().all(|&b| is_letter(b) || b == b'\'' || b == b'-')
+        && (!word[1..].iter().any(|b| b.is_ascii_uppercase())
+            || word.iter().all(|b| b.is_ascii_uppercase()))
+}
+
+fn is_letter(b: u8) -> bool {
+    b.is_ascii_alphabetic() || b >= 0x80
+}
+
+fn is_ident_byte(b: u8) -> bool {
+    b.is_ascii_alphanumeric() || b == b'_'
+}
+
+/// Checks whether a Markdown code token is an opening or closing code fence (as opposed to
+/// a code span like ```` ```code``` ````). Only those start at the beginning of a line.
+fn is_fence(text: &[u8], token: &Token) -> bool {
+    let s = &text[token.span.clone()];
+    let fence = s.iter().take_while(|&&b| b == b'`').count();
+    (token.span.start == 0 || text[token.span.start - 1] == b'\n')
+        && fence >= 3
+        && !s[fence..].contains(&b'`')
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::syntax::LexerRegistry;
+
+    fn regions(language: Language, text: &[u8], split: bool) -> Vec<String> {
+        let tokens = LexerRegistry::get_lexer(language).tokenize(text);
+        spell_check_regions(language, text, &tokens, split)
+            .into_iter()
+            .map(|r| String::from_utf8_lossy(&text[r]).into_owned())
+            .collect()
+    }
+
+    #[test]
+    fn test_spelling_strings() {
+        let text = br#"a := []string{"Hello, World!", "parseFileLink", "utf-8", "foo/bar.go", "see https://example.com now", "OK"}"#;
+        assert_eq!(regions(Language::Go, text, false), vec!["Hello, World!", "see", "now", "OK"]);
+    }
+
+    #[test]
+    fn test_spelling_split_identifiers() {
+        let text = b"// parseFileLink calls HTTPServer.max_len twice.\n";
+        assert_eq!(
+            regions(Language::Go, text, false),
+            vec!["parseFileLink calls HTTPServer.max_len twice."]
+        );
+        assert_eq!(
+            regions(Language::Go, text, true),
+            vec!["parse", "File", "Link", "calls", "HTTP", "Server", "max", "len", "twice."]
+        );
+    }
+
+    #[test]
+    fn test_spelling_go_fixture() {
+        let text = include_bytes!("../../../../syntax-tests/test_syntax.go");
+        assert_eq!(
+            regions(Language::Go, text, false),
+            vec![
+                "Go Syntax Test File",
+                "Testing Go syntax highlighting with various language features",
+                "fmt",
+                "math",
+                "sync",
+                "time",
+                "region constants",
+                "Constants",
+                "iota enumeration",
+                "endregion",
+                "Type definitions follow. They cover structs,\nembedding, methods and interfaces.",
+                "Type definitions",
+                "Embedded struct",
+                "Interface",
+                "Rectangle implements Shape",
+                "Circle implements Shape",
+                "Methods",
+                "%s is %d years old",
+                "Function with multiple return values",
+                "division by zero",
+                "Named return values",
+                "Naked return",
+                "Variadic function",
+                "Higher-order function",
+                "Closure",
+                "Main function",
+                "Number literals",
+                "Floating point",
+                "Complex numbers",
+                "String literals",
+                "Hello, Go!",
+                "This is a raw string\nthat can span multiple lines\nand include \"quotes\" or a lone ( without escaping",
+                "Rune (character) literals",
+                "Boolean and nil",
+                "Type inference with :=",
+                "Type inferred",
+                "Multiple assignment",
+                "Swap",
+                "Array",
+                "Length inferred",
+                "Slice",
+                "Make slice",
+                "length 5, capacity 10",
+                "Append to slice",
+                "Map",
+                "Alice",
+                "Bob",
+                "Charlie",
+                "Make map",
+                "Check map key",
+                "Alice",
+                "Alice's age:",
+                "Struct initialization",
+                "Alice",
+                "Anonymous struct",
+                "Pointer",
+                "If statement",
+                "Greater than 40",
+                "Greater than 30",
+                "30 or less",
+                "If with short statement",
+                "Result:",
+                "Switch statement",
+                "Zero",
+                "The answer",
+                "Other number",
+                "Switch with no condition (like if-else chain)",
+                "Less than 10",
+                "Less than 50",
+                "50 or more",
+                "Type switch",
+                "hello",
+                "Integer:",
+                "String:",
+                "Unknown type",
+                "For loop (traditional)",
+                "For loop (while style)",
+                "Infinite loop",
+                "Range over slice",
+                "Index: %d, Value: %d\\n",
+                "Range over map",
+                "%s: %d\\n",
+                "Range with _ to ignore index",
+                "Defer statement",
+                "This executes last",
+                "Multiple defers (execute in LIFO order)",
+                "Third",
+                "Second",
+                "First",
+                "Goroutine",
+                "Running in goroutine",
+                "Channel",
+                "Send to channel",
+                "Receive from channel",
+                "Received:",
+                "Buffered channel",
+                "Select statement",
+                "Received from ch1:",
+                "Received from ch2:",
+                "Timeout",
+                "WaitGroup for synchronization",
+                "Worker %d\\n",
+                "Mutex",
+                "Error handling",
+                "Error:",
+                "Result:",
+                "Panic and recover",
+                "Recovered from:",
+                "Type assertion",
+                "hello",
+                "String:",
+                "Built-in functions",
+                "Length: %d, Capacity: %d\\n",
+                "Make and new",
+                "Copy",
+                "Delete from map",
+                "Alice",
+                "Closure example",
+                "Anonymous function",
+                "Result:",
+                "Program completed",
+                "Exported function (starts with capital letter) that validates its data",
+                "empty data",
+                "Unexported function (starts with lowercase letter)",
+                "Helper function",
+                "Generics",
+                "Unicode identifiers: letters anywhere, digits (even non-ASCII ones) after the first letter",
+                "world",
+                "Astral-plane characters: 😀 in comments and strings, 𠀀 (CJK Extension B) in names",
+                "😀 \\U0001F600 👩\u{200d}🔬",
+                "Non-ASCII names in declarations and uses, emoji with a skin tone, \"café\" with a",
+                "combining acute accent after the e, and a rune beyond the Basic Multilingual Plane",
+                "👋🏽 hello",
+                "cafe\u{301}",
+                "Compiler directives and build constraints, which belong above the package clause",
+                "and declarations, but are lexed the same anywhere at the start of a line",
+                "stringer -type=Day",
+                "docs/read me.md",
+                "With a space after the slashes, or after code, it's an ordinary comment",
+                "go:embed static/*.html",
+                "go:noinline",
+                "Struct tags are keys with quoted values, with options after the first comma",
+                "id",
+                "id",
+                "owner",
+                "nested",
+                "From a pair whose quote is never closed, the tag is a raw string",
+                "broken",
+                "Outside of a struct, a raw string is just a string",
+                "Labels are the targets of break, continue and goto, unlike the keys of composite",
+                "literals and the values of case clauses, which are also followed by a colon",
+                "ok",
+                "max",
+                "Since Go 1.21 and 1.22, min, max and clear are built-in functions, and range works",
+                "over integers and over iterator functions",
+                "a",
+                "b",
+                "a",
+                "Format verbs in interpreted strings, but not in raw strings",
+                "%+v %#v %T\\n",
+                "%08.2f%% done, %-*d left\\n",
+                "%[2]s before %[1]q, %6.[3]*[1]f\\n",
+                "b",
+                "%d stays raw",
+                "%y is no verb of fmt\\n",
+                "open %q: %w",
+                "Escapes in strings and runes, even invalid ones, and raw strings holding comment markers",
+                "\\q is invalid",
+                "SELECT 1 // not a comment,\n/* nor this */ \"and a quote",
+                "Ledger keeps the entries of an",
+                ", formatted with",
+                "into a",
+                ", as described in",
+                "Usage",
+                "Open a ledger and close it when done:",
+                "Entries are either",
+                "credits, see",
+                ", or",
+                "debits.",
+                "Close closes the ledger.",
+                "Ledgers no longer need closing, use an",
+                "instead.",
+                "An ordinary comment, where [Account] and",
+                "indented lines are no markup",
+                "Predeclared names may be declared again, after which they're ordinary variables",
+                "Action markers stand out in comments of every kind.",
+                "TODO(alice): Split the ledger into pages, see the NOTE below.",
+                "FIXME: Overflows with more than a billion entries.",
+                "XXX relies on the iteration order of maps, a HACK until they're sorted.",
+                "NOTE: Words like TODOist aren't markers, and neither is a lowercase todo.",
+                "TODOist",
+                "Names with a keyword as their prefix, suffix or infix are single identifiers",
+            ]
+        );
+    }
+
+    #[test]
+    fn test_spelling_markdown_fixture() {
+        let text = include_bytes!("../../../../syntax-tests/test_syntax.md");
+        assert_eq!(
+            regions(Language::Markdown, text, false),
+            vec![
+                "Markdown Syntax Highlighting Demo",
+                "This is a",
+                "demonstration",
+                "of",
+                "syntax highlighting",
+                "in",
+                "Markdown",
+                "Features",
+                "Code Blocks",
+                "Inline code:",
+                "Formatting",
+                "Bold text",
+                "with double asterisks",
+                "Italic text",
+                "with single asterisks",
+                "Bold with underscores",
+                "Italic with underscores",
+                "Links",
+                "Check out",
+                "GitHub",
+                "or",
+                "Rust",
+                "Headings",
+                "H1 Heading",
+                "H2 Heading",
+                "H3 Heading",
+                "H4 Heading",
+                "Lists",
+                "First item",
+                "Second item",
+                "Third item",
+                "Bullet point",
+                "Another bullet",
+                "Last one",
+                "Mixed Content",
+                "Here's some",
+                "bold",
+                "text with",
+                "italic",
+                "mixed in, plus",
+                "and a",
+                "link",
+                "You can also combine",
+                "bold and italic",
+                "together.",
+                "Code Examples",
+            ]
+        );
+    }
+}
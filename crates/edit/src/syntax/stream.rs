@@ -0,0 +1,637 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//! Highlighting text as it's read, for files too large to keep in memory.
+//!
+//! Like the [`IncrementalHighlighter`](crate::syntax::IncrementalHighlighter), this needs
+//! a [`Grammar`], whose state carries from line to line. Only the current line is kept:
+//! it's tokenized, handed to a callback and dropped, so the memory used is that of the
+//! reader's buffer and the longest line, up to [`StreamOptions::max_line_length`].
+//!
+//! Our own lexers are streamed a section of lines at a time instead, see
+//! [`SyntaxHighlighter::highlight_reader`](crate::syntax::SyntaxHighlighter::highlight_reader).
+//! The lexer picks up each section at the line where the one before ended, like
+//! [`IncrementalLexer`](crate::syntax::IncrementalLexer) does after an edit.
+
+use std::io::{self, BufRead};
+use std::sync::atomic::{AtomicBool, Ordering};
+
+use crate::syntax::long_lines::flag_cut_off;
+use crate::syntax::{Checkpoint, Grammar, Lexer, Token, TokenKind};
+
+/// How many bytes past the line it picks up at [`lex_reader`] reads before lexing again,
+/// unless it takes more to get to a line that's lexed for good, like after a long comment.
+const SECTION_LEN: usize = 64 * 1024;
+
+/// How many bytes past the line it picks up at [`lex_reader`] reads at most to get to a
+/// line that's lexed for good. A `/*` that isn't closed by then is taken to be never
+/// closed, and a token that's still longer is cut off, like at the end of the text.
+const MAX_WINDOW: usize = 4 * SECTION_LEN;
+
+/// How [`highlight_reader`] reads.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct StreamOptions {
+    /// The longest line to tokenize as a whole, in bytes and without its `\n`. Longer
+    /// lines are tokenized in pieces of at most this many bytes, as if each were a line,
+    /// so their tokens can differ from those of the whole line.
+    pub max_line_length: usize,
+}
+
+impl Default for StreamOptions {
+    fn default() -> Self {
+        Self { max_line_length: 1 << 20 }
+    }
+}
+
+/// A line of [`highlight_reader`], or a piece of one.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct LineTokens<'a> {
+    /// The 0-based number of the line. The pieces of a long line have the same one.
+    pub line: usize,
+    /// The text, with the `\n` at its end, if it has one.
+    pub text: &'a [u8],
+    /// The tokens, relative to the start of `text`.
+    pub tokens: &'a [Token],
+    /// Whether the line goes on in the next piece, because it's longer than
+    /// [`StreamOptions::max_line_length`].
+    pub partial: bool,
+}
+
+/// Tokenize what `reader` reads with `grammar`, line by line, and pass each line to `emit`.
+///
+/// Reading stops at the first error of the reader or `emit`, which is returned. It also
+/// stops once `cancel` is set, which is checked before each line and returns an error of
+/// the kind [`io::ErrorKind::Interrupted`].
+pub fn highlight_reader(
+    grammar: &Grammar,
+    mut reader: impl BufRead,
+    options: &StreamOptions,
+    cancel: &AtomicBool,
+    mut emit: impl FnMut(LineTokens) -> io::Result<()>,
+) -> io::Result<()> {
+    let max = options.max_line_length.max(4);
+    let mut state = grammar.initial_state();
+    let mut text = Vec::new();
+    // The start of a character that a piece of a long line ended in the middle of.
+    let mut carry = Vec::new();
+    let mut line = 0;
+    loop {
+        check(cancel)?;
+        let complete = next_line(&mut reader, &mut text, &mut carry, max)?;
+        if text.is_empty() {
+            return Ok(());
+        }
+        let tokens = grammar.tokenize_line(&text, &mut state);
+        emit(LineTokens { line, text: &text, tokens: &tokens, partial: !complete })?;
+        if complete {
+            line += 1;
+        }
+    }
+}
+
+/// Lex what `reader` reads with `lexer` and pass each line to `emit`, like
+/// [`highlight_reader`] does with a grammar, but a section of lines at a time, whose
+/// tokens `filter` may change first.
+///
+/// The tokens that the lexer may look back at are kept with the line it picks up at, so
+/// they're those of [`Lexer::tokenize`], as long as [`Lexer::finish`] doesn't
+/// [need all of the text](Lexer::needs_whole_text), since it sees each section on its
+/// own, like `filter` does. A lexer that can't pick up at all, or not in a file whose
+/// lines end in lone `\r`s, lexes the rest of the text at once. The lexer starts over
+/// after a line longer than `options.max_line_length`, which is cut off like by
+/// [`tokenize_long_lines`](crate::syntax::tokenize_long_lines), and after a token longer
+/// than [`MAX_WINDOW`], which is cut off the same way.
+pub(crate) fn lex_reader(
+    lexer: &dyn Lexer,
+    reader: impl BufRead,
+    options: &StreamOptions,
+    cancel: &AtomicBool,
+    filter: impl FnMut(&[u8], &mut Vec<Token>),
+    emit: impl FnMut(LineTokens) -> io::Result<()>,
+) -> io::Result<()> {
+    lex_sections(lexer, reader, options, SECTION_LEN, cancel, filter, emit)
+}
+
+/// [`lex_reader`] with sections of `section_len` bytes.
+fn lex_sections(
+    lexer: &dyn Lexer,
+    mut reader: impl BufRead,
+    options: &StreamOptions,
+    section_len: usize,
+    cancel: &AtomicBool,
+    mut filter: impl FnMut(&[u8], &mut Vec<Token>),
+    mut emit: impl FnMut(LineTokens) -> io::Result<()>,
+) -> io::Result<()> {
+    let max = options.max_line_length.max(4);
+    // The text from the lines of the tokens the lexer may look back at, the tokens up to
+    // the line it picks up at, where that is, and where the lines to emit start, which is
+    // before the indentation of that line.
+    let mut text = Vec::new();
+    let mut tokens = Vec::new();
+    let mut from = Checkpoint::default();
+    let mut emitted = 0;
+    let mut want = section_len;
+    let mut piece = Vec::new();
+    let mut carry = Vec::new();
+    let mut section = Vec::new();
+    let mut line = 0;
+    loop {
+        let (mut end_of_text, mut long) = (false, false);
+        while text.len() - from.pos < want {
+            check(cancel)?;
+            let complete = next_line(&mut reader, &mut piece, &mut carry, max)?;
+            if piece.is_empty() {
+                end_of_text = true;
+                break;
+            }
+            text.extend_from_slice(&piece);
+            if !complete {
+                long = true;
+                break;
+            }
+        }
+        if end_of_text && text.len() == emitted {
+            return Ok(());
+        }
+
+        // The last line whose tokens before it won't change, whatever comes after, or that
+        // are taken not to once the window is full.
+        let full = text.len() - from.pos >= MAX_WINDOW;
+        let mut end = None;
+        tokens.truncate(from.index);
+        let resumed = lexer.resume(&text, &from, &mut tokens, &mut |checkpoint, _, _| {
+            if checkpoint.pos > from.pos && (full || checkpoint.lookahead <= text.len()) {
+                end = Some(checkpoint.clone());
+            }
+            false
+        });
+        if !resumed {
+            // Lexed as a whole from the line it would pick up at, all of the rest of it.
+            if !end_of_text && !long {
+                want = usize::MAX;
+                continue;
+            }
+            tokens.truncate(from.index);
+            let start = from.pos;
+            tokens.extend(lexer.tokenize(&text[start..]).into_iter().map(|token| Token {
+                span: start + token.span.start..start + token.span.end,
+                ..token
+            }));
+        }
+        let cut_off = long || (full && end.is_none());
+        let flush = end_of_text || cut_off || !resumed;
+        if !flush && end.is_none() {
+            want = (want * 2).min(MAX_WINDOW);
+            continue;
+        }
+
+        let (cut, count) = match &end {
+            Some(end) if !flush => {
+                (text[..end.pos].iter().rposition(|&b| b == b'\n').unwrap() + 1, end.index)
+            }
+            _ => (text.len(), tokens.len()),
+        };
+        let first = tokens[..count].partition_point(|token| token.span.end <= emitted);
+        section.clear();
+        section.extend(tokens[first..count].iter().map(|token| Token {
+            span: token.span.start.max(emitted) - emitted..token.span.end.min(cut) - emitted,
+            ..token.clone()
+        }));
+        let lines = &text[emitted..cut];
+        if resumed {
+            lexer.finish(lines, &mut section);
+        }
+        if cut_off {
+            flag_cut_off(&mut section, lines.len());
+        }
+        filter(lines, &mut section);
+        line = emit_lines(lines, &section, line, long, cancel, &mut emit)?;
+
+        if !flush {
+            // Keep the tokens the lexer may look back at, with the text of their lines.
+            let end = end.unwrap();
+            tokens.truncate(end.index);
+            let mut keep = end.index - 1;
+            let mut significant = 0;
+            while significant < end.lookbehind && keep > 0 {
+                keep -= 1;
+                if !tokens[keep].kind.is_trivia() {
+                    significant += 1;
+                }
+            }
+            let start = text[..tokens[keep].span.start]
+                .iter()
+                .rposition(|&b| b == b'\n')
+                .map_or(0, |i| i + 1);
+            let first = tokens.partition_point(|token| token.span.start < start);
+            text.drain(..start);
+            tokens.drain(..first);
+            for token in &mut tokens {
+                token.span = token.span.start - start..token.span.end - start;
+            }
+            from = Checkpoint {
+                pos: end.pos - start,
+                index: end.index - first,
+                lookahead: end.lookahead.min(text.len()).saturating_sub(start),
+                ..end
+            };
+            emitted = cut - start;
+            want = section_len;
+            continue;
+        }
+
+        text.clear();
+        tokens.clear();
+        from = Checkpoint::default();
+        emitted = 0;
+        want = section_len;
+        if long {
+            // The rest of the line is plain text, and the lexer starts over after it.
+            loop {
+                check(cancel)?;
+                let complete = next_line(&mut reader, &mut piece, &mut carry, max)?;
+                if piece.is_empty() {
+                    return Ok(());
+                }
+                let len = piece.strip_suffix(b"\n").unwrap_or(&piece).len();
+                section.clear();
+                section.push(Token::new(TokenKind::Text, 0..len));
+                if len < piece.len() {
+                    section.push(Token::new(TokenKind::Whitespace, len..piece.len()));
+                }
+                emit(LineTokens { line, text: &piece, tokens: &section, partial: !complete })?;
+                if complete {
+                    line += 1;
+                    break;
+                }
+            }
+        } else if end_of_text {
+            return Ok(());
+        }
+    }
+}
+
+/// Pass each line of `text` to `emit` with its part of the `tokens`, numbered from `line`,
+/// and return the number of the next one. The last line is `partial`, if it's not complete.
+pub(crate) fn emit_lines(
+    text: &[u8],
+    tokens: &[Token],
+    mut line: usize,
+    partial: bool,
+    cancel: &AtomicBool,
+    emit: &mut impl FnMut(LineTokens) -> io::Result<()>,
+) -> io::Result<usize> {
+    let mut line_tokens = Vec::new();
+    let (mut start, mut i) = (0, 0);
+    for piece in text.split_inclusive(|&b| b == b'\n') {
+        check(cancel)?;
+        let end = start + piece.len();
+        let before = |token: &Token| token.span.end <= start && token.span.start < start;
+        while i < tokens.len() && before(&tokens[i]) {
+            i += 1;
+        }
+        // Tokens over several lines, like block comments, go to each of them.
+        line_tokens.clear();
+        for token in tokens[i..].iter().take_while(|token| token.span.start < end) {
+            if !before(token) {
+                let span = token.span.start.max(start) - start..token.span.end.min(end) - start;
+                line_tokens.push(Token { span, ..token.clone() });
+            }
+        }
+        let partial = partial && end == text.len();
+        emit(LineTokens { line, text: piece, tokens: &line_tokens, partial })?;
+        if !partial {
+            line += 1;
+        }
+        start = end;
+    }
+    Ok(line)
+}
+
+/// Returns an error of the kind [`io::ErrorKind::Interrupted`] once `cancel` is set.
+fn check(cancel: &AtomicBool) -> io::Result<()> {
+    if cancel.load(Ordering::Relaxed) {
+        return Err(io::Error::new(io::ErrorKind::Interrupted, "highlighting was cancelled"));
+    }
+    Ok(())
+}
+
+/// Read the next line into `line` like [`read_line`], after what's left in `carry` of
+/// the one before. A piece of a long line that ends in the middle of a character leaves
+/// the start of it in `carry` for the next piece.
+fn next_line(
+    reader: &mut impl BufRead,
+    line: &mut Vec<u8>,
+    carry: &mut Vec<u8>,
+    max: usize,
+) -> io::Result<bool> {
+    line.clear();
+    line.append(carry);
+    let complete = read_line(reader, line, max)?;
+    if !complete {
+        let start = line.iter().rposition(|&b| b & 0xC0 != 0x80).unwrap_or(0);
+        // Only split a character that's incomplete, not invalid UTF-8.
+        if start > 0 && start + utf8_len(line[start]) > line.len() {
+            carry.extend_from_slice(&line[start..]);
+            line.truncate(start);
+        }
+    }
+    Ok(complete)
+}
+
+/// Append the next line to `line`, with its `\n`, unless that would make it longer than
+/// `max` bytes. Returns whether the line is complete, i.e. ends in a `\n` or the text.
+fn read_line(reader: &mut impl BufRead, line: &mut Vec<u8>, max: usize) -> io::Result<bool> {
+    loop {
+        let available = match reader.fill_buf() {
+            Ok(available) => available,
+            Err(err) if err.kind() == io::ErrorKind::Interrupted => continue,
+            Err(err) => return Err(err),
+        };
+        if available.is_empty() {
+            return Ok(true);
+        }
+        // The `\n` after `max` bytes still belongs to the line.
+        let room = (max + 1 - line.len()).min(available.len());
+        if let Some(i) = available[..room].iter().position(|&b| b == b'\n') {
+            line.extend_from_slice(&available[..=i]);
+            reader.consume(i + 1);
+            return Ok(true);
+        }
+        let take = room.min(max - line.len());
+        line.extend_from_slice(&available[..take]);
+        reader.consume(take);
+        if line.len() >= max {
+            return Ok(false);
+        }
+    }
+}
+
+/// The length of the UTF-8 sequence that `lead` starts.
+fn utf8_len(lead: u8) -> usize {
+    match lead {
+        0xC0..=0xDF => 2,
+        0xE0..=0xEF => 3,
+        0xF0..=0xF7 => 4,
+        _ => 1,
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::syntax::{Language, LexerRegistry, SqlDialect, TokenPayload, detect_language};
+
+    fn go_grammar() -> Grammar {
+        Grammar::parse(include_str!("../../tests/grammars/go.tmLanguage.json")).unwrap()
+    }
+
+    /// Stream `text` and collect the lines and the tokens with absolute spans.
+    fn stream(
+        grammar: &Grammar,
+        reader: impl BufRead,
+        max: usize,
+    ) -> (Vec<(usize, bool)>, Vec<Token>) {
+        let (mut lines, mut tokens, mut offset) = (Vec::new(), Vec::new(), 0);
+        let options = StreamOptions { max_line_length: max };
+        highlight_reader(grammar, reader, &options, &AtomicBool::new(false), |line| {
+            lines.push((line.line, line.partial));
+            tokens.extend(
+                line.tokens.iter().map(|t| Token {
+                    span: offset + t.span.start..offset + t.span.end,
+                    ..t.clone()
+                }),
+            );
+            offset += line.text.len();
+            Ok(())
+        })
+        .unwrap();
+        (lines, tokens)
+    }
+
+    /// Stream what `reader` reads with `lexer` in sections of `section_len` bytes and
+    /// collect the lines.
+    fn lex(
+        lexer: &dyn Lexer,
+        reader: impl BufRead,
+        section_len: usize,
+        max: usize,
+    ) -> Vec<(usize, bool, Vec<Token>)> {
+        let mut lines = Vec::new();
+        let options = StreamOptions { max_line_length: max };
+        let cancel = AtomicBool::new(false);
+        lex_sections(
+            lexer,
+            reader,
+            &options,
+            section_len,
+            &cancel,
+            |_, _| {},
+            |line| {
+                lines.push((line.line, line.partial, line.tokens.to_vec()));
+                Ok(())
+            },
+        )
+        .unwrap();
+        lines
+    }
+
+    #[test]
+    fn test_corpus() {
+        // Streaming gives the same tokens as tokenizing all of the text, with and without
+        // a final `\n`, and even through a reader with a tiny buffer.
+        let grammar = go_grammar();
+        let dir = concat!(env!("CARGO_MANIFEST_DIR"), "/../../syntax-tests");
+        for entry in std::fs::read_dir(dir).unwrap() {
+            let path = entry.unwrap().path();
+            if path.extension().is_none_or(|ext| ext != "go") {
+                continue;
+            }
+            let text = std::fs::read(&path).unwrap();
+            let expected = grammar.tokenize(&text);
+            let (lines, tokens) = stream(&grammar, &text[..], 1 << 20);
+            assert!(tokens == expected, "{}", path.display());
+            assert_eq!(lines.len(), text.split_inclusive(|&b| b == b'\n').count());
+
+            let trimmed = text.strip_suffix(b"\n").unwrap_or(&text);
+            assert!(stream(&grammar, trimmed, 1 << 20).1 == grammar.tokenize(trimmed));
+
+            let reader = io::BufReader::with_capacity(7, &text[..]);
+            assert!(stream(&grammar, reader, 1 << 20).1 == expected);
+        }
+    }
+
+    #[test]
+    fn test_long_lines() {
+        let grammar = go_grammar();
+        let (lines, tokens) = stream(&grammar, &b"a := 1\nbcdefghij\nk"[..], 6);
+        assert_eq!(lines, [(0, false), (1, true), (1, false), (2, false)]);
+        assert_eq!(tokens.last().unwrap().span, 17..18);
+
+        // A line of exactly the maximum length is complete, and characters aren't split.
+        assert_eq!(stream(&grammar, &b"abcd\ne"[..], 4).0, [(0, false), (1, false)]);
+        let mut pieces = Vec::new();
+        let options = StreamOptions { max_line_length: 4 };
+        highlight_reader(
+            &grammar,
+            "ab€€".as_bytes(),
+            &options,
+            &AtomicBool::new(false),
+            |line| {
+                pieces.push(String::from_utf8(line.text.to_vec()).unwrap());
+                Ok(())
+            },
+        )
+        .unwrap();
+        assert_eq!(pieces, ["ab", "€", "€"]);
+    }
+
+    #[test]
+    fn test_errors() {
+        let grammar = go_grammar();
+        let text = b"a\nb\nc\n";
+        let options = StreamOptions::default();
+
+        // Errors of `emit` stop reading right away.
+        let mut calls = 0;
+        let err = highlight_reader(&grammar, &text[..], &options, &AtomicBool::new(false), |_| {
+            calls += 1;
+            Err(io::Error::other("full"))
+        })
+        .unwrap_err();
+        assert_eq!((err.to_string(), calls), ("full".to_string(), 1));
+
+        let cancel = AtomicBool::new(false);
+        let mut lines = 0;
+        let err = highlight_reader(&grammar, &text[..], &options, &cancel, |_| {
+            lines += 1;
+            cancel.store(true, Ordering::Relaxed);
+            Ok(())
+        })
+        .unwrap_err();
+        assert_eq!((err.kind(), lines), (io::ErrorKind::Interrupted, 1));
+
+        struct Failing;
+        impl io::Read for Failing {
+            fn read(&mut self, _: &mut [u8]) -> io::Result<usize> {
+                Err(io::Error::other("disk on fire"))
+            }
+        }
+        let reader = io::BufReader::new(Failing);
+        let err = highlight_reader(&grammar, reader, &options, &cancel, |_| Ok(())).unwrap_err();
+        assert_eq!(err.kind(), io::ErrorKind::Interrupted);
+        let reader = io::BufReader::new(Failing);
+        let err = highlight_reader(&grammar, reader, &options, &AtomicBool::new(false), |_| Ok(()))
+            .unwrap_err();
+        assert_eq!(err.to_string(), "disk on fire");
+    }
+
+    #[test]
+    fn test_lexer_corpus() {
+        // Lexing a section at a time gives the tokens of lexing all of the text, unless
+        // the lexer needs all of it, like to mark doc comments.
+        let dir = concat!(env!("CARGO_MANIFEST_DIR"), "/../../syntax-tests");
+        for entry in std::fs::read_dir(dir).unwrap() {
+            let path = entry.unwrap().path();
+            let name = path.file_name().unwrap().to_str().unwrap();
+            let text = std::fs::read(&path).unwrap();
+            let language = detect_language(name, &text).language;
+            let lexer = match language {
+                Language::Sql => LexerRegistry::get_pinned_sql_lexer(
+                    SqlDialect::from_hint(&text).unwrap_or_default(),
+                ),
+                _ => LexerRegistry::get_lexer(language),
+            };
+            let resumes =
+                lexer.resume(b"", &Checkpoint::default(), &mut Vec::new(), &mut |_, _, _| false);
+            if name.contains(".tokens")
+                || name.contains(".folds")
+                || !resumes
+                || lexer.needs_whole_text()
+            {
+                continue;
+            }
+
+            // With `\r\n`s, which the lexers don't see, and whose `\r` goes to the whitespace.
+            let crlf = String::from_utf8_lossy(&text).replace('\n', "\r\n").into_bytes();
+            for text in [text, crlf] {
+                let mut expected = Vec::new();
+                let cancel = AtomicBool::new(false);
+                emit_lines(&text, &lexer.tokenize(&text), 0, false, &cancel, &mut |line| {
+                    expected.push((line.line, line.partial, line.tokens.to_vec()));
+                    Ok(())
+                })
+                .unwrap();
+                for section_len in [1, 100, SECTION_LEN] {
+                    let reader = io::BufReader::with_capacity(7, &text[..]);
+                    let lines = lex(&*lexer, reader, section_len, 1 << 20);
+                    assert!(lines == expected, "{name} in sections of {section_len}");
+                }
+            }
+        }
+    }
+
+    #[test]
+    fn test_lexer_long_lines() {
+        // The rest of a long line is plain text, and the string it cut off doesn't go on
+        // after it.
+        let lexer = LexerRegistry::get_lexer(Language::Go);
+        let text = b"a := 1\nb := \"cdefgh\" + \"\nc := `d`\n";
+        let lines = lex(&*lexer, &text[..], 100, 8);
+        let shape: Vec<_> = lines.iter().map(|(line, partial, _)| (*line, *partial)).collect();
+        assert_eq!(shape, [(0, false), (1, true), (1, true), (1, false), (2, false)]);
+        let cut = lines[1].2.last().unwrap();
+        assert_eq!((cut.kind, cut.span.clone()), (TokenKind::String, 5..8));
+        assert_eq!(cut.payload, Some(TokenPayload::Invalid));
+        assert_eq!(lines[2].2, [Token::new(TokenKind::Text, 0..8)]);
+        assert_eq!(lines[4].2, lexer.tokenize(b"c := `d`\n"));
+    }
+
+    #[test]
+    fn test_lexer_unterminated_comment() {
+        // A `/*` that's never closed is only looked for so far, and the lines after it are
+        // lexed as if it ended on its line, like by `tokenize`.
+        struct Counted<'a>(&'a [u8], &'a std::cell::Cell<usize>);
+        impl io::Read for Counted<'_> {
+            fn read(&mut self, buf: &mut [u8]) -> io::Result<usize> {
+                let n = self.0.read(buf)?;
+                self.1.set(self.1.get() + n);
+                Ok(n)
+            }
+        }
+
+        let lexer = LexerRegistry::get_lexer(Language::Css);
+        let rule = b"a { color: red; }\n";
+        let mut text = b"/* never closed\n".to_vec();
+        while text.len() < 3 * MAX_WINDOW {
+            text.extend_from_slice(rule);
+        }
+        let read = std::cell::Cell::new(0);
+        let (mut lines, mut read_at_first) = (Vec::new(), None);
+        let reader = io::BufReader::new(Counted(&text, &read));
+        let options = StreamOptions::default();
+        let cancel = AtomicBool::new(false);
+        lex_sections(
+            &*lexer,
+            reader,
+            &options,
+            SECTION_LEN,
+            &cancel,
+            |_, _| {},
+            |line| {
+                read_at_first.get_or_insert(read.get());
+                lines.push(line.tokens.to_vec());
+                Ok(())
+            },
+        )
+        .unwrap();
+
+        assert!(read_at_first.unwrap() <= MAX_WINDOW + SECTION_LEN);
+        assert_eq!(lines.len(), text.split_inclusive(|&b| b == b'\n').count());
+        let comment = &lines[0][0];
+        assert_eq!((comment.kind, comment.span.clone()), (TokenKind::Comment, 0..15));
+        assert_eq!(comment.payload, Some(TokenPayload::Invalid));
+        let expected = lexer.tokenize(rule);
+        assert!(lines[1..].iter().all(|tokens| *tokens == expected));
+    }
+}
@@ -0,0 +1,679 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//! Color themes in the VS Code / TextMate format.
+//!
+//! A VS Code color theme is a JSON(C) file whose `tokenColors` are rules like
+//! `{ "scope": "keyword.control", "settings": { "foreground": "#C586C0" } }`.
+//! TextMate grammars give every token a stack of scopes, from the outermost
+//! (`source.go`) to the innermost (`constant.character.escape.go`), and a rule applies
+//! to a token if its selector matches that stack:
+//!
+//! - `keyword` matches `keyword` and `keyword.control.go`, but not `keywords`,
+//!   because selectors are prefixes of whole dot-separated segments,
+//! - `string, comment` has two alternatives and matches either,
+//! - `string constant.character.escape` is a descendant selector, which matches an
+//!   escape nested anywhere inside a string, and `string > constant` a child selector,
+//!   which only matches directly inside it.
+//!
+//! When several rules match the same scope, the most specific one wins, see
+//! [`TextMateTheme::resolve`]. Exclusions (`string - comment`) aren't supported;
+//! a selector ends where its exclusion starts.
+//!
+//! Our lexers give tokens a kind and the containers they're in, like a function body,
+//! rather than scopes. [`token_scopes`] maps each [`TokenKind`] to the scopes a TextMate
+//! grammar would give it, and [`scope_stack`] puts those and the containers' scopes
+//! together, which [`TextMateTheme::resolve_token`] matches the rules against.
+//! [`TextMateTheme::to_theme`] turns the rules into a [`Theme`] the formatters can use,
+//! which only looks at the kind.
+
+use stdext::arena::scratch_arena;
+
+use crate::json::{self, Object, Value};
+use crate::oklab::StraightRgba;
+use crate::syntax::{Language, Theme, Token, TokenKind, TokenStyle, parse_color};
+
+/// A color theme loaded from a VS Code color theme file.
+#[derive(Debug, Clone)]
+pub struct TextMateTheme {
+    name: String,
+    dark: bool,
+    foreground: Option<StraightRgba>,
+    background: Option<StraightRgba>,
+    rules: Vec<Rule>,
+}
+
+/// One alternative of a rule's selector, with the rule's settings.
+#[derive(Debug, Clone)]
+struct Rule {
+    /// The scopes of a descendant selector, outermost first. The last one is the
+    /// scope the rule styles, the others are the ancestors it must be nested in.
+    path: Vec<Segment>,
+    settings: Settings,
+    /// The position of the rule in the file, later rules win ties.
+    index: usize,
+}
+
+#[derive(Debug, Clone)]
+struct Segment {
+    scope: String,
+    /// Whether the scope must be the direct parent of the next one (`>`).
+    child: bool,
+}
+
+#[derive(Debug, Clone, Copy, Default)]
+struct Settings {
+    foreground: Option<StraightRgba>,
+    background: Option<StraightRgba>,
+    /// `Some` if the rule sets a `fontStyle`, even an empty one, which resets it.
+    font_style: Option<FontStyle>,
+}
+
+#[derive(Debug, Clone, Copy, Default)]
+struct FontStyle {
+    bold: bool,
+    italic: bool,
+    underline: bool,
+}
+
+/// How specific a match is: the number of segments of the matched scope, the number
+/// of ancestors, the number of segments in them, and the rule's position.
+type Specificity = (usize, usize, usize, usize);
+
+impl TextMateTheme {
+    /// Parse a VS Code color theme. Rules without a valid selector are skipped,
+    /// like VS Code does, but the file must have the expected structure.
+    ///
+    /// `include`s of other theme files aren't followed.
+    pub fn parse(json: &str) -> Result<Self, String> {
+        let arena = scratch_arena(None);
+        let root = json::parse(&arena, json).map_err(|e| e.to_string())?;
+        let root = root.as_object().ok_or("a theme must be an object")?;
+
+        let colors = match root.get("colors") {
+            None => None,
+            Some(colors) => Some(colors.as_object().ok_or("colors must be an object")?),
+        };
+        let color = |key: &str| colors.and_then(|c| c.get_str(key)).and_then(parse_hex);
+        let mut theme = Self {
+            name: root.get_str("name").unwrap_or_default().to_string(),
+            // VS Code's types are `dark`, `light`, `hcDark` and `hcLight`.
+            dark: !root.get_str("type").unwrap_or("dark").to_ascii_lowercase().ends_with("light"),
+            foreground: color("editor.foreground"),
+            background: color("editor.background"),
+            rules: Vec::new(),
+        };
+
+        let token_colors = match root.get("tokenColors") {
+            None => &[][..],
+            Some(Value::Array(rules)) => rules,
+            Some(_) => return Err("tokenColors must be an array".to_string()),
+        };
+        for (index, rule) in token_colors.iter().enumerate() {
+            let rule = rule.as_object().ok_or("tokenColors must contain objects")?;
+            let settings = match rule.get_object("settings") {
+                Some(settings) => parse_settings(settings),
+                None => continue,
+            };
+            let selectors: Vec<&str> = match rule.get("scope") {
+                // A rule without a scope sets the defaults, like an older `editor.foreground`.
+                None => {
+                    theme.foreground = theme.foreground.or(settings.foreground);
+                    theme.background = theme.background.or(settings.background);
+                    continue;
+                }
+                Some(Value::String(scope)) => vec![scope],
+                Some(Value::Array(scopes)) => scopes.iter().filter_map(Value::as_str).collect(),
+                Some(_) => continue,
+            };
+            for alternative in selectors.iter().flat_map(|s| s.split(',')) {
+                if let Some(path) = parse_selector(alternative) {
+                    theme.rules.push(Rule { path, settings, index });
+                }
+            }
+        }
+        Ok(theme)
+    }
+
+    /// The theme's `name`, or an empty string if it has none.
+    pub fn name(&self) -> &str {
+        &self.name
+    }
+
+    /// Whether the theme is made for a dark background, i.e. its `type` isn't `light`.
+    pub fn is_dark(&self) -> bool {
+        self.dark
+    }
+
+    /// The default text color, from `editor.foreground` or a rule without a scope.
+    pub fn foreground(&self) -> Option<StraightRgba> {
+        self.foreground
+    }
+
+    /// The background color, from `editor.background` or a rule without a scope.
+    pub fn background(&self) -> Option<StraightRgba> {
+        self.background
+    }
+
+    /// Get the style of a token with the given scope stack, outermost scope first.
+    ///
+    /// Each scope in the stack is styled by the rules matching it. Among those, a rule
+    /// that matches more segments of the scope wins (`keyword.control` over `keyword`),
+    /// then one with more ancestors (`string constant` over `constant`), then the one
+    /// that comes later in the file. A scope only overrides the properties its rules
+    /// set, so an escape in a string keeps the string's color if only its font style
+    /// is themed. Colors that no rule sets fall back to the theme's foreground.
+    pub fn resolve(&self, scopes: &[&str]) -> TokenStyle {
+        let settings = self.settings(scopes);
+        let default = if self.dark {
+            StraightRgba::from_le(0xFFD4D4D4)
+        } else {
+            StraightRgba::from_le(0xFF000000)
+        };
+        let font_style = settings.font_style.unwrap_or_default();
+        TokenStyle {
+            fg: settings.foreground.or(self.foreground).unwrap_or(default),
+            bg: settings.background,
+            bold: font_style.bold,
+            italic: font_style.italic,
+            underline: font_style.underline,
+        }
+    }
+
+    /// Get the style of `token` in a document in `language`, by resolving its [`scope_stack`].
+    pub fn resolve_token(&self, language: Language, token: &Token) -> TokenStyle {
+        let scopes = scope_stack(language, token);
+        let scopes: Vec<&str> = scopes.iter().map(String::as_str).collect();
+        self.resolve(&scopes)
+    }
+
+    /// Turn the theme into a [`Theme`] by resolving the [`token_scopes`] of each kind
+    /// inside a generic `source` scope. Rules for a specific language, like
+    /// `source.go keyword`, therefore don't apply.
+    ///
+    /// Rainbow brackets, diff and search colors aren't part of the format and come
+    /// from the built-in theme of the same brightness. So do the styles for invalid
+    /// (`invalid.illegal`) and deprecated (`invalid.deprecated`) code, unless the
+    /// theme has rules for them.
+    pub fn to_theme(&self) -> Theme {
+        let mut theme = if self.dark { Theme::default_dark() } else { Theme::default_light() };
+        let mut scopes = Vec::new();
+        for &kind in TokenKind::ALL {
+            scopes.clear();
+            scopes.push("source");
+            scopes.extend_from_slice(token_scopes(kind));
+            theme.set_style(kind, self.resolve(&scopes));
+        }
+
+        let themed = |scope| self.rules.iter().any(|r| r.matches(&["source", scope]).is_some());
+        if themed("invalid.illegal") {
+            theme.set_invalid_style(self.resolve(&["source", "invalid.illegal"]));
+        }
+        if themed("invalid.deprecated") {
+            theme.set_deprecated_style(self.resolve(&["source", "invalid.deprecated"]));
+        }
+        theme
+    }
+
+    /// Merge the settings of the rules matching each scope of the stack.
+    fn settings(&self, scopes: &[&str]) -> Settings {
+        let mut merged = Settings::default();
+        let mut matches = Vec::new();
+        for depth in 1..=scopes.len() {
+            matches.clear();
+            matches.extend(
+                self.rules.iter().filter_map(|r| Some((r.matches(&scopes[..depth])?, &r.settings))),
+            );
+            // Most specific first, so the first rule to set a property decides it.
+            matches.sort_unstable_by(|a, b| b.0.cmp(&a.0));
+            let mut scope = Settings::default();
+            for (_, settings) in &matches {
+                scope.foreground = scope.foreground.or(settings.foreground);
+                scope.background = scope.background.or(settings.background);
+                scope.font_style = scope.font_style.or(settings.font_style);
+            }
+            merged.foreground = scope.foreground.or(merged.foreground);
+            merged.background = scope.background.or(merged.background);
+            merged.font_style = scope.font_style.or(merged.font_style);
+        }
+        merged
+    }
+}
+
+impl Rule {
+    /// Whether the rule styles the last scope of `scopes`, nested in the ones before it.
+    fn matches(&self, scopes: &[&str]) -> Option<Specificity> {
+        let (target, ancestors) = self.path.split_last()?;
+        let (scope, mut parents) = scopes.split_last()?;
+        if !prefix_matches(&target.scope, scope) {
+            return None;
+        }
+
+        // Match the ancestors innermost first, each as close to the target as possible.
+        for ancestor in ancestors.iter().rev() {
+            loop {
+                let (parent, rest) = parents.split_last()?;
+                parents = rest;
+                if prefix_matches(&ancestor.scope, parent) {
+                    break;
+                }
+                if ancestor.child {
+                    return None;
+                }
+            }
+        }
+
+        let segments = |scope: &str| scope.split('.').count();
+        let ancestor_segments = ancestors.iter().map(|a| segments(&a.scope)).sum();
+        Some((segments(&target.scope), ancestors.len(), ancestor_segments, self.index))
+    }
+}
+
+/// Get the TextMate scopes of a token of the given kind, outermost first, without
+/// the language suffix (`.go`) a grammar would add. Tokens that grammars leave
+/// unscoped, like whitespace and plain identifiers, have none.
+///
+/// The scopes follow the conventions of the grammars bundled with VS Code, so that
+/// existing themes style them like they would there. Escapes and format specifiers
+/// are nested in a string, regex flags in the regex, function names in the definition or
+/// call they're part of.
+pub fn token_scopes(kind: TokenKind) -> &'static [&'static str] {
+    match kind {
+        TokenKind::Whitespace | TokenKind::Text | TokenKind::Identifier => &[],
+        TokenKind::Comment => &["comment.line"],
+        TokenKind::DocComment => &["comment.block.documentation"],
+        TokenKind::Error => &["invalid.illegal"],
+        TokenKind::String => &["string.quoted.double"],
+        TokenKind::Number => &["constant.numeric"],
+        TokenKind::Boolean => &["constant.language.boolean"],
+        TokenKind::Null => &["constant.language.null"],
+        TokenKind::Char => &["string.quoted.single"],
+        TokenKind::DocString => &["string.quoted.docstring"],
+        TokenKind::Keyword => &["keyword.other"],
+        TokenKind::KeywordControl => &["keyword.control"],
+        TokenKind::KeywordFunction => &["storage.type.function"],
+        TokenKind::KeywordImport => &["keyword.control.import"],
+        TokenKind::KeywordStorage => &["storage.modifier"],
+        TokenKind::KeywordType => &["storage.type"],
+        TokenKind::KeywordOperator => &["keyword.operator.expression"],
+        TokenKind::TypeName => &["entity.name.type"],
+        TokenKind::FunctionName => &["entity.name.function"],
+        TokenKind::FunctionDefinition => &["meta.definition.function", "entity.name.function"],
+        TokenKind::FunctionCall => &["meta.function-call", "entity.name.function"],
+        TokenKind::VariableName => &["variable.other"],
+        TokenKind::PropertyName => &["variable.other.property"],
+        TokenKind::ParameterName => &["variable.parameter"],
+        TokenKind::Operator => &["keyword.operator"],
+        TokenKind::Punctuation => &["punctuation.other"],
+        TokenKind::Delimiter => &["punctuation.section.brackets"],
+        TokenKind::Separator => &["punctuation.separator"],
+        TokenKind::Attribute => &["storage.type.annotation"],
+        TokenKind::Macro => &["entity.name.function.preprocessor"],
+        TokenKind::MacroOperator => &["keyword.operator.preprocessor"],
+        TokenKind::Label => &["entity.name.label"],
+        TokenKind::Escape => &["string.quoted.double", "constant.character.escape"],
+        TokenKind::Interpolation => &["string.quoted.double", "punctuation.section.embedded"],
+        TokenKind::FormatSpecifier => &["string.quoted.double", "constant.other.placeholder"],
+        TokenKind::Regex => &["string.regexp"],
+        TokenKind::RegexFlags => &["string.regexp", "keyword.other"],
+        TokenKind::Inactive => &["comment.block.preprocessor"],
+        TokenKind::JsonKey => &["support.type.property-name"],
+        TokenKind::JsonBrace => &["punctuation.definition.dictionary"],
+        TokenKind::JsonBracket => &["punctuation.definition.array"],
+        TokenKind::JsonColon => &["punctuation.separator.dictionary.key-value"],
+        TokenKind::JsonComma => &["punctuation.separator.dictionary.pair"],
+        TokenKind::RustLifetime => &["storage.modifier.lifetime"],
+        TokenKind::RustMacro => &["entity.name.function.macro"],
+        TokenKind::RustAttribute => &["meta.attribute"],
+        TokenKind::MarkdownHeading => &["markup.heading"],
+        TokenKind::MarkdownBold => &["markup.bold"],
+        TokenKind::MarkdownItalic => &["markup.italic"],
+        TokenKind::MarkdownCode => &["markup.inline.raw"],
+        TokenKind::MarkdownLink => &["markup.underline.link"],
+    }
+}
+
+/// Get the full TextMate scope stack of `token` in a document in `language`, outermost
+/// first: the language's root scope like `source.go`, the scopes of the containers the
+/// token is in, and its [`token_scopes`], each with the language's suffix, like
+/// `["source.go", "meta.struct.body.go", "meta.struct-tag.go", "string.quoted.double.go"]`.
+pub fn scope_stack(language: Language, token: &Token) -> Vec<String> {
+    let suffix = language.id();
+    let mut scopes = vec![format!("source.{suffix}")];
+    let containers = token.scopes.iter().map(|c| c.scope());
+    scopes.extend(
+        containers
+            .chain(token_scopes(token.kind).iter().copied())
+            .map(|scope| format!("{scope}.{suffix}")),
+    );
+    scopes
+}
+
+/// Create the bundled dark theme, see `themes/dusk.json`.
+pub(super) fn dusk() -> Theme {
+    bundled(include_str!("themes/dusk.json"))
+}
+
+/// Create the bundled light theme, see `themes/paper.json`.
+pub(super) fn paper() -> Theme {
+    bundled(include_str!("themes/paper.json"))
+}
+
+fn bundled(json: &str) -> Theme {
+    TextMateTheme::parse(json).expect("bundled themes are valid").to_theme()
+}
+
+/// Whether `selector` is `scope` or a prefix of it that ends at a dot.
+fn prefix_matches(selector: &str, scope: &str) -> bool {
+    scope.strip_prefix(selector).is_some_and(|rest| rest.is_empty() || rest.starts_with('.'))
+}
+
+/// Split one alternative of a selector into its scopes, or `None` if it has none.
+fn parse_selector(selector: &str) -> Option<Vec<Segment>> {
+    let mut path: Vec<Segment> = Vec::new();
+    for word in selector.split_whitespace() {
+        match word {
+            "-" => break,
+            ">" => {
+                path.last_mut()?.child = true;
+            }
+            _ => path.push(Segment { scope: word.to_string(), child: false }),
+        }
+    }
+    // A `>` must be followed by a scope.
+    if path.last()?.child { None } else { Some(path) }
+}
+
+fn parse_settings(settings: Object) -> Settings {
+    let font_style = settings.get_str("fontStyle").map(|style| {
+        let mut font_style = FontStyle::default();
+        for word in style.split_whitespace() {
+            match word {
+                "bold" => font_style.bold = true,
+                "italic" => font_style.italic = true,
+                "underline" => font_style.underline = true,
+                _ => {}
+            }
+        }
+        font_style
+    });
+    Settings {
+        foreground: settings.get_str("foreground").and_then(parse_hex),
+        background: settings.get_str("background").and_then(parse_hex),
+        font_style,
+    }
+}
+
+/// Themes only use hex colors, and VS Code ignores anything else.
+fn parse_hex(color: &str) -> Option<StraightRgba> {
+    color.starts_with('#').then(|| parse_color(color.as_bytes())).flatten()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::syntax::{Container, LexerRegistry, ScopeStack};
+
+    fn hex(color: &str) -> StraightRgba {
+        parse_color(color.as_bytes()).unwrap()
+    }
+
+    fn theme(rules: &str) -> TextMateTheme {
+        let json = format!(
+            r##"{{ "colors": {{ "editor.foreground": "#111111" }}, "tokenColors": [{rules}] }}"##
+        );
+        TextMateTheme::parse(&json).unwrap()
+    }
+
+    #[test]
+    fn test_prefix_matches() {
+        assert!(prefix_matches("keyword", "keyword"));
+        assert!(prefix_matches("keyword", "keyword.control.go"));
+        assert!(prefix_matches("keyword.control", "keyword.control.go"));
+        assert!(!prefix_matches("keyword", "keywords.go"));
+        assert!(!prefix_matches("keyword.control.go", "keyword.control"));
+        assert!(!prefix_matches("control", "keyword.control"));
+    }
+
+    #[test]
+    fn test_selectors() {
+        let theme = theme(
+            r##"
+            { "scope": "string, comment", "settings": { "foreground": "#222222" } },
+            { "scope": ["constant", "variable.parameter"], "settings": { "foreground": "#333333" } },
+            { "scope": "string constant.character.escape", "settings": { "foreground": "#444444" } },
+            { "scope": "meta.function-call > entity.name", "settings": { "foreground": "#555555" } },
+            { "scope": "comment - comment.block", "settings": { "fontStyle": "italic" } },
+            { "scope": ">", "settings": { "foreground": "#666666" } },
+            { "scope": 42, "settings": { "foreground": "#666666" } }
+            "##,
+        );
+        let fg = |scopes: &[&str]| theme.resolve(scopes).fg;
+        assert_eq!(fg(&["source.go", "string.quoted.double.go"]), hex("#222222"));
+        assert_eq!(fg(&["source.go", "comment.line.double-slash.go"]), hex("#222222"));
+        assert_eq!(fg(&["source.go", "variable.parameter.go"]), hex("#333333"));
+        assert_eq!(fg(&["source.go", "variable.other.go"]), hex("#111111"));
+
+        // Descendant selectors skip scopes in between.
+        assert_eq!(fg(&["source.go", "constant.character.escape.go"]), hex("#333333"));
+        assert_eq!(
+            fg(&["source.go", "string.quoted.go", "constant.character.escape.go"]),
+            hex("#444444")
+        );
+        assert_eq!(
+            fg(&["string.quoted.go", "meta.embedded", "constant.character.escape.go"]),
+            hex("#444444")
+        );
+
+        // Child selectors don't.
+        assert_eq!(fg(&["meta.function-call.go", "entity.name.function.go"]), hex("#555555"));
+        assert_eq!(
+            fg(&["meta.function-call.go", "meta.x", "entity.name.function.go"]),
+            hex("#111111")
+        );
+
+        // Exclusions are cut off, so this is `comment`.
+        assert!(theme.resolve(&["source.go", "comment.block.go"]).italic);
+        assert_eq!(theme.rules.len(), 7);
+    }
+
+    #[test]
+    fn test_specificity() {
+        let theme = theme(
+            r##"
+            { "scope": "keyword.control", "settings": { "foreground": "#222222" } },
+            { "scope": "keyword", "settings": { "foreground": "#333333", "fontStyle": "bold" } },
+            { "scope": "source keyword.operator", "settings": { "foreground": "#444444" } },
+            { "scope": "keyword.operator", "settings": { "foreground": "#555555" } },
+            { "scope": "storage", "settings": { "foreground": "#666666" } },
+            { "scope": "storage", "settings": { "foreground": "#777777" } },
+            { "scope": "string", "settings": { "foreground": "#888888", "fontStyle": "italic" } },
+            { "scope": "constant.character.escape", "settings": { "fontStyle": "bold" } },
+            { "scope": "markup.bold", "settings": { "fontStyle": "" } },
+            { "scope": "markup", "settings": { "fontStyle": "underline" } }
+            "##,
+        );
+        // The longer prefix wins, even if it comes first, but only sets what it sets.
+        let control = theme.resolve(&["source.go", "keyword.control.go"]);
+        assert_eq!((control.fg, control.bold), (hex("#222222"), true));
+        // Then the one with more ancestors...
+        assert_eq!(theme.resolve(&["source.go", "keyword.operator.go"]).fg, hex("#444444"));
+        // ...then the later one.
+        assert_eq!(theme.resolve(&["source.go", "storage.type.go"]).fg, hex("#777777"));
+
+        // Inner scopes override the properties they set.
+        let escape =
+            theme.resolve(&["source.go", "string.quoted.go", "constant.character.escape.go"]);
+        assert_eq!((escape.fg, escape.bold, escape.italic), (hex("#888888"), true, false));
+        // An empty font style resets it.
+        let bold = theme.resolve(&["text.md", "markup.bold.md"]);
+        assert!(!bold.bold && !bold.italic && !bold.underline);
+    }
+
+    #[test]
+    fn test_parse() {
+        let theme = TextMateTheme::parse(
+            r##"{
+                // VS Code themes are JSONC.
+                "name": "Test",
+                "type": "light",
+                "tokenColors": [
+                    { "settings": { "foreground": "#123456", "background": "#FFFFFF" } },
+                    { "scope": "comment", "settings": { "foreground": "rgb(1, 2, 3)" } },
+                    { "scope": "string" },
+                ],
+            }"##,
+        )
+        .unwrap();
+        assert_eq!(theme.name(), "Test");
+        assert!(!theme.is_dark());
+        assert_eq!(theme.foreground(), Some(hex("#123456")));
+        assert_eq!(theme.background(), Some(hex("#FFFFFF")));
+        // Only hex colors count.
+        assert_eq!(theme.resolve(&["source", "comment"]).fg, hex("#123456"));
+        assert!(TextMateTheme::parse(r#"{ "type": "hcDark" }"#).unwrap().is_dark());
+
+        let error = |json| TextMateTheme::parse(json).unwrap_err();
+        assert_eq!(error("[]"), "a theme must be an object");
+        assert_eq!(error(r#"{ "tokenColors": "theme.tmTheme" }"#), "tokenColors must be an array");
+        assert_eq!(error(r#"{ "tokenColors": [1] }"#), "tokenColors must contain objects");
+        assert_eq!(error(r#"{ "colors": [] }"#), "colors must be an object");
+        assert_eq!(error("{"), "1:2: Invalid JSON");
+    }
+
+    #[test]
+    fn test_to_theme() {
+        let theme = theme(
+            r##"
+            { "scope": "keyword", "settings": { "foreground": "#222222" } },
+            { "scope": "meta.function-call entity.name.function", "settings": { "foreground": "#333333" } },
+            { "scope": "invalid.deprecated", "settings": { "foreground": "#444444" } },
+            { "scope": "source.go keyword", "settings": { "foreground": "#555555" } }
+            "##,
+        );
+        let styled = theme.to_theme();
+        assert_eq!(styled.get_style(TokenKind::KeywordControl).fg, hex("#222222"));
+        assert_eq!(styled.get_style(TokenKind::FunctionCall).fg, hex("#333333"));
+        assert_eq!(styled.get_style(TokenKind::FunctionDefinition).fg, hex("#111111"));
+        assert_eq!(styled.get_style(TokenKind::Identifier).fg, hex("#111111"));
+
+        let token = crate::syntax::Token::new(TokenKind::Keyword, 0..3);
+        let deprecated = token.clone().with_payload(crate::syntax::TokenPayload::Deprecated);
+        assert_eq!(styled.token_style(&deprecated).fg, hex("#444444"));
+        let invalid = token.with_payload(crate::syntax::TokenPayload::Invalid);
+        assert_eq!(styled.token_style(&invalid), Theme::default_dark().token_style(&invalid));
+    }
+
+    #[test]
+    fn test_scope_stack() {
+        let scopes = ScopeStack::default().push(Container::StructBody).push(Container::StructTag);
+        let token = Token::new(TokenKind::String, 0..3).with_scopes(scopes);
+        assert_eq!(
+            scope_stack(Language::Go, &token),
+            ["source.go", "meta.struct.body.go", "meta.struct-tag.go", "string.quoted.double.go"]
+        );
+        let plain = Token::new(TokenKind::Identifier, 0..3);
+        assert_eq!(scope_stack(Language::Python, &plain), ["source.python"]);
+
+        // Rules for containers only apply to the tokens inside them.
+        let theme = theme(
+            r##"
+            { "scope": "string", "settings": { "foreground": "#222222" } },
+            { "scope": "meta.struct-tag string", "settings": { "foreground": "#333333" } },
+            { "scope": "meta.function.parameters > variable", "settings": { "fontStyle": "italic" } }
+            "##,
+        );
+        assert_eq!(theme.resolve_token(Language::Go, &token).fg, hex("#333333"));
+        let string = Token::new(TokenKind::String, 0..3);
+        assert_eq!(theme.resolve_token(Language::Go, &string).fg, hex("#222222"));
+        let scopes = ScopeStack::default().push(Container::Parameters);
+        let param = Token::new(TokenKind::VariableName, 0..1).with_scopes(scopes);
+        assert!(theme.resolve_token(Language::Go, &param).italic);
+        let nested = param.clone().with_scopes(scopes.push(Container::FunctionBody));
+        assert!(!theme.resolve_token(Language::Go, &nested).italic);
+    }
+
+    /// A foreground color and a `fontStyle`.
+    type Style = (&'static str, &'static str);
+
+    /// The Go fixture's scope stacks, as a TextMate grammar would produce them,
+    /// resolved against both bundled themes: `(scopes, dusk, paper)`, each as
+    /// `(foreground, font style)`.
+    #[test]
+    fn test_bundled_themes() {
+        let dusk = TextMateTheme::parse(include_str!("themes/dusk.json")).unwrap();
+        let paper = TextMateTheme::parse(include_str!("themes/paper.json")).unwrap();
+        assert!(dusk.is_dark() && !paper.is_dark());
+
+        #[rustfmt::skip]
+        let expected: &[(&[&str], Style, Style)] = &[
+            (&["source.go"], ("#C8CCD4", ""), ("#24292F", "")),
+            (&["source.go", "comment.line.double-slash.go"], ("#6B7489", "italic"), ("#6E7781", "italic")),
+            (&["source.go", "comment.block.go"], ("#6B7489", "italic"), ("#6E7781", "italic")),
+            (&["source.go", "comment.block.documentation.go"], ("#7F8CA3", "italic"), ("#57606A", "italic")),
+            (&["source.go", "keyword.package.go"], ("#C792EA", ""), ("#8250DF", "")),
+            (&["source.go", "keyword.control.import.go"], ("#C792EA", ""), ("#8250DF", "")),
+            (&["source.go", "keyword.control.go"], ("#C792EA", "bold"), ("#CF222E", "bold")),
+            (&["source.go", "keyword.function.go"], ("#C792EA", ""), ("#8250DF", "")),
+            (&["source.go", "keyword.operator.go"], ("#89DDFF", ""), ("#24292F", "")),
+            (&["source.go", "keyword.operator.expression.go"], ("#C792EA", ""), ("#CF222E", "")),
+            (&["source.go", "keyword.operator.assignment.go"], ("#89DDFF", ""), ("#24292F", "")),
+            (&["source.go", "storage.type.function.go"], ("#C792EA", "bold"), ("#CF222E", "bold")),
+            (&["source.go", "storage.type.go"], ("#82AAFF", ""), ("#0550AE", "")),
+            (&["source.go", "storage.modifier.go"], ("#82AAFF", ""), ("#0550AE", "")),
+            (&["source.go", "entity.name.type.go"], ("#FFCB6B", ""), ("#953800", "")),
+            (&["source.go", "entity.name.type.package.go"], ("#FFCB6B", ""), ("#953800", "")),
+            (&["source.go", "meta.definition.function.go", "entity.name.function.go"], ("#82AAFF", "bold"), ("#6639BA", "bold")),
+            (&["source.go", "meta.function-call.go", "entity.name.function.go"], ("#82AAFF", ""), ("#6639BA", "")),
+            (&["source.go", "meta.function-call.go", "support.function.builtin.go"], ("#F78C6C", ""), ("#0550AE", "")),
+            (&["source.go", "variable.other.go"], ("#C8CCD4", ""), ("#24292F", "")),
+            (&["source.go", "variable.other.property.go"], ("#F07178", ""), ("#0A3069", "")),
+            (&["source.go", "variable.parameter.go"], ("#F07178", "italic"), ("#953800", "italic")),
+            (&["source.go", "string.quoted.double.go"], ("#C3E88D", ""), ("#0A3069", "")),
+            (&["source.go", "string.quoted.raw.go"], ("#C3E88D", ""), ("#0A3069", "")),
+            (&["source.go", "string.quoted.rune.go"], ("#C3E88D", ""), ("#0A3069", "")),
+            (&["source.go", "string.quoted.double.go", "constant.character.escape.go"], ("#89DDFF", ""), ("#0550AE", "bold")),
+            (&["source.go", "string.quoted.double.go", "constant.other.placeholder.go"], ("#89DDFF", "italic"), ("#0550AE", "")),
+            (&["source.go", "constant.character.escape.go"], ("#89DDFF", ""), ("#0550AE", "")),
+            (&["source.go", "constant.numeric.decimal.go"], ("#F78C6C", ""), ("#0550AE", "")),
+            (&["source.go", "constant.numeric.hex.go"], ("#F78C6C", ""), ("#0550AE", "")),
+            (&["source.go", "constant.language.boolean.go"], ("#FF9CAC", "bold"), ("#CF222E", "bold")),
+            (&["source.go", "constant.language.null.go"], ("#FF9CAC", "bold"), ("#CF222E", "bold")),
+            (&["source.go", "punctuation.section.brackets.go"], ("#C8CCD4", ""), ("#24292F", "")),
+            (&["source.go", "punctuation.separator.go"], ("#89DDFF", ""), ("#24292F", "")),
+            (&["source.go", "entity.name.label.go"], ("#FFCB6B", "italic"), ("#953800", "italic")),
+            (&["source.go", "invalid.illegal.go"], ("#FF5370", "underline"), ("#CF222E", "underline")),
+            (&["source.go", "invalid.deprecated.go"], ("#FFCB6B", "underline"), ("#9A6700", "underline")),
+        ];
+        let style = |(fg, font): Style| TokenStyle {
+            fg: hex(fg),
+            bg: None,
+            bold: font.contains("bold"),
+            italic: font.contains("italic"),
+            underline: font.contains("underline"),
+        };
+        for &(scopes, in_dusk, in_paper) in expected {
+            assert_eq!(dusk.resolve(scopes), style(in_dusk), "dusk {scopes:?}");
+            assert_eq!(paper.resolve(scopes), style(in_paper), "paper {scopes:?}");
+        }
+
+        // Resolving each token of the fixture in its language's scopes gives the same
+        // style as the converted theme, since the bundled themes have no Go-specific rules.
+        let text = include_bytes!("../../../../syntax-tests/test_syntax.go");
+        let tokens = LexerRegistry::get_lexer(Language::Go).tokenize(text);
+        for textmate in [&dusk, &paper] {
+            let theme = textmate.to_theme();
+            for token in &tokens {
+                let mut scopes = vec!["source.go".to_string()];
+                scopes.extend(token_scopes(token.kind).iter().map(|s| format!("{s}.go")));
+                let scopes: Vec<&str> = scopes.iter().map(String::as_str).collect();
+                assert_eq!(
+                    textmate.resolve(&scopes),
+                    theme.get_style(token.kind),
+                    "{:?}",
+                    token.kind
+                );
+            }
+        }
+    }
+}
@@ -4,12 +4,39 @@
 //! Color themes for syntax highlighting.
 
 use crate::oklab::StraightRgba;
-use crate::syntax::TokenKind;
+use crate::syntax::{DocMarkup, Token, TokenKind, TokenPayload, WhitespacePosition, textmate};
 
 /// A complete color theme for syntax highlighting.
 #[derive(Clone)]
 pub struct Theme {
     styles: Vec<TokenStyle>,
+    /// Rainbow bracket styles, one per nesting depth (cycled)
+    brackets: Vec<TokenStyle>,
+    /// Style for brackets without a partner
+    unbalanced_bracket: TokenStyle,
+    /// Style for trailing whitespace, if it should stand out
+    trailing_whitespace: Option<TokenStyle>,
+    /// Style for constructs the language doesn't allow
+    invalid: TokenStyle,
+    /// Style for obsolete or discouraged constructs
+    deprecated: TokenStyle,
+    /// Background for emphasized text, like search matches
+    emphasis: StraightRgba,
+    /// Backgrounds for added lines in a diff, and for the changed words in them
+    added: [StraightRgba; 2],
+    /// Backgrounds for removed lines in a diff, and for the changed words in them
+    removed: [StraightRgba; 2],
+}
+
+/// A built-in theme, see [`Theme::BUILTIN`].
+#[derive(Clone, Copy)]
+pub struct ThemeEntry {
+    /// The name to pick the theme by, e.g. `dark`.
+    pub name: &'static str,
+    /// Whether the theme is made for a dark background.
+    pub dark: bool,
+    /// Creates the theme.
+    pub create: fn() -> Theme,
 }
 
 /// The visual style for a token.
@@ -30,13 +57,7 @@ pub struct TokenStyle {
 impl TokenStyle {
     /// Create a new style with just a foreground color.
     pub const fn new(fg: StraightRgba) -> Self {
-        Self {
-            fg,
-            bg: None,
-            bold: false,
-            italic: false,
-            underline: false,
-        }
+        Self { fg, bg: None, bold: false, italic: false, underline: false }
     }
 
     /// Set the bold flag.
@@ -65,17 +86,36 @@ impl TokenStyle {
 }
 
 impl Theme {
+    /// All built-in themes.
+    pub const BUILTIN: &[ThemeEntry] = &[
+        ThemeEntry { name: "dark", dark: true, create: Theme::default_dark },
+        ThemeEntry { name: "light", dark: false, create: Theme::default_light },
+        ThemeEntry { name: "dusk", dark: true, create: textmate::dusk },
+        ThemeEntry { name: "paper", dark: false, create: textmate::paper },
+    ];
+
+    /// Create the built-in theme called `name`, see [`Theme::BUILTIN`].
+    pub fn by_name(name: &str) -> Option<Self> {
+        Self::BUILTIN.iter().find(|t| t.name.eq_ignore_ascii_case(name)).map(|t| (t.create)())
+    }
+
     /// Create a new theme with default dark colors (inspired by VS Code Dark+).
     pub fn default_dark() -> Self {
         let mut styles = vec![TokenStyle::new(rgb(0xD4D4D4)); 256];
 
         // Comments - green
         styles[TokenKind::Comment as usize] = TokenStyle::new(rgb(0x6A9955)).italic();
+        styles[TokenKind::DocComment as usize] = TokenStyle::new(rgb(0x6A9955)).italic();
+        styles[TokenKind::DocString as usize] = TokenStyle::new(rgb(0x6A9955)).italic();
 
         // Strings - orange/brown
         styles[TokenKind::String as usize] = TokenStyle::new(rgb(0xCE9178));
         styles[TokenKind::Char as usize] = TokenStyle::new(rgb(0xCE9178));
         styles[TokenKind::Escape as usize] = TokenStyle::new(rgb(0xD7BA7D));
+        styles[TokenKind::FormatSpecifier as usize] = TokenStyle::new(rgb(0x9CDCFE));
+        styles[TokenKind::Interpolation as usize] = TokenStyle::new(rgb(0x569CD6));
+        styles[TokenKind::Regex as usize] = TokenStyle::new(rgb(0xD16969));
+        styles[TokenKind::RegexFlags as usize] = TokenStyle::new(rgb(0x569CD6));
 
         // Numbers - light green
         styles[TokenKind::Number as usize] = TokenStyle::new(rgb(0xB5CEA8));
@@ -97,6 +137,8 @@ impl Theme {
         styles[TokenKind::Identifier as usize] = TokenStyle::new(rgb(0xD4D4D4));
         styles[TokenKind::TypeName as usize] = TokenStyle::new(rgb(0x4EC9B0));
         styles[TokenKind::FunctionName as usize] = TokenStyle::new(rgb(0xDCDCAA));
+        styles[TokenKind::FunctionDefinition as usize] = TokenStyle::new(rgb(0xDCDCAA)).bold();
+        styles[TokenKind::FunctionCall as usize] = TokenStyle::new(rgb(0xDCDCAA));
         styles[TokenKind::VariableName as usize] = TokenStyle::new(rgb(0x9CDCFE));
         styles[TokenKind::PropertyName as usize] = TokenStyle::new(rgb(0x9CDCFE));
         styles[TokenKind::ParameterName as usize] = TokenStyle::new(rgb(0x9CDCFE));
@@ -110,6 +152,8 @@ impl Theme {
         // Special
         styles[TokenKind::Attribute as usize] = TokenStyle::new(rgb(0x4EC9B0));
         styles[TokenKind::Macro as usize] = TokenStyle::new(rgb(0x4EC9B0));
+        styles[TokenKind::MacroOperator as usize] = TokenStyle::new(rgb(0x4EC9B0)).bold();
+        styles[TokenKind::Inactive as usize] = TokenStyle::new(rgb(0x7A7A7A));
         styles[TokenKind::Label as usize] = TokenStyle::new(rgb(0xDCDCAA));
 
         // JSON specific
@@ -134,7 +178,27 @@ impl Theme {
         // Errors - red
         styles[TokenKind::Error as usize] = TokenStyle::new(rgb(0xF44747)).underline();
 
-        Self { styles }
+        // Rainbow brackets - gold, orchid, blue
+        let brackets = vec![
+            TokenStyle::new(rgb(0xFFD700)),
+            TokenStyle::new(rgb(0xDA70D6)),
+            TokenStyle::new(rgb(0x179FFF)),
+        ];
+        let unbalanced_bracket = TokenStyle::new(rgb(0xF44747)).underline();
+        let invalid = TokenStyle::new(rgb(0xF44747)).underline();
+        let deprecated = TokenStyle::new(rgb(0xCCA700)).underline();
+
+        Self {
+            styles,
+            brackets,
+            unbalanced_bracket,
+            trailing_whitespace: None,
+            invalid,
+            deprecated,
+            emphasis: rgb(0x515C6A),
+            added: [rgb(0x203A27), rgb(0x2E6B3C)],
+            removed: [rgb(0x4B2124), rgb(0x7D2E34)],
+        }
     }
 
     /// Create a new theme with default light colors (inspired by VS Code Light+).
@@ -143,10 +207,15 @@ impl Theme {
 
         // Comments - green
         styles[TokenKind::Comment as usize] = TokenStyle::new(rgb(0x008000)).italic();
+        styles[TokenKind::DocComment as usize] = TokenStyle::new(rgb(0x008000)).italic();
+        styles[TokenKind::DocString as usize] = TokenStyle::new(rgb(0x008000)).italic();
 
         // Strings - brown/red
         styles[TokenKind::String as usize] = TokenStyle::new(rgb(0xA31515));
         styles[TokenKind::Char as usize] = TokenStyle::new(rgb(0xA31515));
+        styles[TokenKind::Interpolation as usize] = TokenStyle::new(rgb(0x0000FF));
+        styles[TokenKind::Regex as usize] = TokenStyle::new(rgb(0x811F3F));
+        styles[TokenKind::RegexFlags as usize] = TokenStyle::new(rgb(0x0000FF));
 
         // Numbers - green
         styles[TokenKind::Number as usize] = TokenStyle::new(rgb(0x098658));
@@ -168,12 +237,37 @@ impl Theme {
         styles[TokenKind::Identifier as usize] = TokenStyle::new(rgb(0x000000));
         styles[TokenKind::TypeName as usize] = TokenStyle::new(rgb(0x267F99));
         styles[TokenKind::FunctionName as usize] = TokenStyle::new(rgb(0x795E26));
+        styles[TokenKind::FunctionDefinition as usize] = TokenStyle::new(rgb(0x795E26)).bold();
+        styles[TokenKind::FunctionCall as usize] = TokenStyle::new(rgb(0x795E26));
         styles[TokenKind::VariableName as usize] = TokenStyle::new(rgb(0x001080));
 
+        // Code disabled by the preprocessor - gray
+        styles[TokenKind::Inactive as usize] = TokenStyle::new(rgb(0xA0A0A0));
+
         // Errors - red
         styles[TokenKind::Error as usize] = TokenStyle::new(rgb(0xFF0000)).underline();
 
-        Self { styles }
+        // Rainbow brackets - blue, green, brown
+        let brackets = vec![
+            TokenStyle::new(rgb(0x0431FA)),
+            TokenStyle::new(rgb(0x319331)),
+            TokenStyle::new(rgb(0x7B3814)),
+        ];
+        let unbalanced_bracket = TokenStyle::new(rgb(0xFF0000)).underline();
+        let invalid = TokenStyle::new(rgb(0xFF0000)).underline();
+        let deprecated = TokenStyle::new(rgb(0xBF8803)).underline();
+
+        Self {
+            styles,
+            brackets,
+            unbalanced_bracket,
+            trailing_whitespace: None,
+            invalid,
+            deprecated,
+            emphasis: rgb(0xA8AC94),
+            added: [rgb(0xE6FFEC), rgb(0xACF2BD)],
+            removed: [rgb(0xFFEBE9), rgb(0xFDB8C0)],
+        }
     }
 
     /// Get the style for a given token kind.
@@ -182,11 +276,120 @@ impl Theme {
     }
 
     /// Set the style for a given token kind.
+    ///
+    /// [`TokenKind::Text`] only takes the foreground color, because it's
+    /// unstyled text that should look like the rest of the document.
     pub fn set_style(&mut self, kind: TokenKind, style: TokenStyle) {
+        let style = match kind {
+            TokenKind::Text => TokenStyle::new(style.fg),
+            _ => style,
+        };
         if (kind as usize) < self.styles.len() {
             self.styles[kind as usize] = style;
         }
     }
+
+    /// Get the style for a token, taking its payload (e.g. rainbow bracket depth) into account.
+    pub fn token_style(&self, token: &Token) -> TokenStyle {
+        match token.payload {
+            Some(TokenPayload::BracketDepth(depth)) => self.bracket_style(depth as usize),
+            Some(TokenPayload::UnbalancedBracket) => self.unbalanced_bracket,
+            Some(
+                TokenPayload::Invalid
+                | TokenPayload::BidiControl { .. }
+                | TokenPayload::ControlCharacter,
+            ) => self.invalid,
+            Some(TokenPayload::Deprecated | TokenPayload::DocMarkup(DocMarkup::Deprecated)) => {
+                self.deprecated
+            }
+            Some(TokenPayload::DocMarkup(DocMarkup::Link)) => {
+                self.get_style(token.kind).underline()
+            }
+            Some(TokenPayload::DocMarkup(DocMarkup::Heading)) => self.get_style(token.kind).bold(),
+            // Code stands upright in the italic prose around it.
+            Some(TokenPayload::DocMarkup(DocMarkup::Code)) => {
+                TokenStyle { italic: false, ..self.get_style(token.kind) }
+            }
+            Some(TokenPayload::Url | TokenPayload::FilePath) => {
+                self.get_style(token.kind).underline()
+            }
+            // Comments are dimmed, but the markers in them should catch the eye.
+            Some(TokenPayload::CommentKeyword) => {
+                TokenStyle { italic: false, ..self.get_style(TokenKind::KeywordControl).bold() }
+            }
+            Some(TokenPayload::Whitespace { position: WhitespacePosition::Trailing, .. }) => {
+                self.trailing_whitespace.unwrap_or_else(|| self.get_style(token.kind))
+            }
+            Some(
+                TokenPayload::Color(_)
+                | TokenPayload::Whitespace { .. }
+                | TokenPayload::ByteOrderMark,
+            )
+            | None => self.get_style(token.kind),
+        }
+    }
+
+    /// Get the rainbow bracket style for a given nesting depth.
+    pub fn bracket_style(&self, depth: usize) -> TokenStyle {
+        match self.brackets.len() {
+            0 => self.get_style(TokenKind::Punctuation),
+            len => self.brackets[depth % len],
+        }
+    }
+
+    /// The number of rainbow bracket styles, i.e. after how many levels the colors repeat.
+    pub fn bracket_cycle(&self) -> usize {
+        self.brackets.len()
+    }
+
+    /// Set the rainbow bracket styles, one per nesting depth.
+    pub fn set_bracket_styles(&mut self, styles: Vec<TokenStyle>) {
+        self.brackets = styles;
+    }
+
+    /// Set the style for brackets without a partner.
+    pub fn set_unbalanced_bracket_style(&mut self, style: TokenStyle) {
+        self.unbalanced_bracket = style;
+    }
+
+    /// Set the style for trailing whitespace, or `None` to style it like any other whitespace.
+    pub fn set_trailing_whitespace_style(&mut self, style: Option<TokenStyle>) {
+        self.trailing_whitespace = style;
+    }
+
+    /// Set the style for constructs the language doesn't allow.
+    pub fn set_invalid_style(&mut self, style: TokenStyle) {
+        self.invalid = style;
+    }
+
+    /// Set the style for obsolete or discouraged constructs.
+    pub fn set_deprecated_style(&mut self, style: TokenStyle) {
+        self.deprecated = style;
+    }
+
+    /// Get `style` emphasized, e.g. for a search match. It keeps its colors, so that
+    /// a match in a comment still looks like a comment, but gets a background.
+    pub fn emphasize(&self, style: TokenStyle) -> TokenStyle {
+        style.bg(self.emphasis).bold()
+    }
+
+    /// Set the background of emphasized text.
+    pub fn set_emphasis_background(&mut self, bg: StraightRgba) {
+        self.emphasis = bg;
+    }
+
+    /// Get `style` on an added or removed line of a diff. The `changed` words of a line
+    /// that was edited, rather than replaced, get a stronger background.
+    pub fn diff_style(&self, style: TokenStyle, added: bool, changed: bool) -> TokenStyle {
+        let backgrounds = if added { self.added } else { self.removed };
+        style.bg(backgrounds[changed as usize])
+    }
+
+    /// Set the backgrounds of added and removed lines, each as `[line, changed words]`.
+    pub fn set_diff_backgrounds(&mut self, added: [StraightRgba; 2], removed: [StraightRgba; 2]) {
+        self.added = added;
+        self.removed = removed;
+    }
 }
 
 impl Default for Theme {
@@ -209,6 +412,20 @@ const fn rgb(hex: u32) -> StraightRgba {
 mod tests {
     use super::*;
 
+    #[test]
+    fn test_builtin_themes() {
+        let dark = Theme::by_name("Dark").unwrap();
+        let keyword = dark.get_style(TokenKind::Keyword);
+        assert_eq!(keyword, Theme::default_dark().get_style(TokenKind::Keyword));
+        assert!(Theme::by_name("solarized").is_none());
+
+        // A dark theme has light text, and the other way around.
+        for entry in Theme::BUILTIN {
+            let fg = (entry.create)().get_style(TokenKind::Identifier).fg;
+            assert_eq!(fg.red() + fg.green() + fg.blue() > 3 * 0x80, entry.dark, "{}", entry.name);
+        }
+    }
+
     #[test]
     fn test_theme_default() {
         let theme = Theme::default();
@@ -216,6 +433,116 @@ mod tests {
         assert!(style.fg.red() > 0 || style.fg.green() > 0 || style.fg.blue() > 0);
     }
 
+    #[test]
+    fn test_theme_text() {
+        // Text only takes a color, and built-in themes give it the one of the document.
+        let mut theme = Theme::default();
+        assert_eq!(theme.get_style(TokenKind::Text), TokenStyle::new(rgb(0xD4D4D4)));
+        theme.set_style(TokenKind::Text, TokenStyle::new(rgb(0x808080)).bold().bg(rgb(0x000000)));
+        assert_eq!(theme.get_style(TokenKind::Text), TokenStyle::new(rgb(0x808080)));
+    }
+
+    #[test]
+    fn test_theme_bracket_styles() {
+        let theme = Theme::default();
+        let bracket = Token::new(TokenKind::Delimiter, 0..1);
+        assert_eq!(theme.token_style(&bracket), theme.get_style(TokenKind::Delimiter));
+
+        let cycle = theme.bracket_cycle();
+        let nested = bracket.clone().with_payload(TokenPayload::BracketDepth(1));
+        assert_eq!(theme.token_style(&nested), theme.bracket_style(cycle + 1));
+
+        let unbalanced = bracket.with_payload(TokenPayload::UnbalancedBracket);
+        assert!(theme.token_style(&unbalanced).underline);
+    }
+
+    #[test]
+    fn test_theme_trailing_whitespace() {
+        let mut theme = Theme::default();
+        let whitespace = |position| {
+            Token::new(TokenKind::Whitespace, 0..1)
+                .with_payload(TokenPayload::Whitespace { position, tabs: false })
+        };
+        let plain = theme.get_style(TokenKind::Whitespace);
+        assert_eq!(theme.token_style(&whitespace(WhitespacePosition::Trailing)), plain);
+
+        let flagged = TokenStyle::new(rgb(0xF44747)).underline();
+        theme.set_trailing_whitespace_style(Some(flagged));
+        assert_eq!(theme.token_style(&whitespace(WhitespacePosition::Trailing)), flagged);
+        assert_eq!(theme.token_style(&whitespace(WhitespacePosition::Leading)), plain);
+    }
+
+    #[test]
+    fn test_theme_diagnostics() {
+        let mut theme = Theme::default();
+        let var = Token::new(TokenKind::KeywordStorage, 0..3);
+        let invalid = theme.token_style(&var.clone().with_payload(TokenPayload::Invalid));
+        let deprecated = theme.token_style(&var.clone().with_payload(TokenPayload::Deprecated));
+        assert_ne!(invalid, deprecated);
+        assert_ne!(deprecated, theme.get_style(TokenKind::KeywordStorage));
+        let bidi = TokenPayload::BidiControl { unterminated: false };
+        assert_eq!(theme.token_style(&var.clone().with_payload(bidi)), invalid);
+        let control = TokenPayload::ControlCharacter;
+        assert_eq!(theme.token_style(&var.clone().with_payload(control)), invalid);
+
+        let struck = TokenStyle::new(rgb(0x808080)).italic();
+        theme.set_deprecated_style(struck);
+        assert_eq!(theme.token_style(&var.with_payload(TokenPayload::Deprecated)), struck);
+    }
+
+    #[test]
+    fn test_theme_doc_markup() {
+        let theme = Theme::default();
+        let doc = Token::new(TokenKind::DocComment, 0..3);
+        let style =
+            |markup| theme.token_style(&doc.clone().with_payload(TokenPayload::DocMarkup(markup)));
+        let plain = theme.get_style(TokenKind::DocComment);
+        assert_eq!(theme.token_style(&doc), plain);
+        assert_eq!(style(DocMarkup::Link), plain.underline());
+        assert_eq!(style(DocMarkup::Heading), plain.bold());
+        assert!(plain.italic && !style(DocMarkup::Code).italic);
+        assert_eq!(
+            style(DocMarkup::Deprecated),
+            theme.token_style(&doc.with_payload(TokenPayload::Deprecated))
+        );
+    }
+
+    #[test]
+    fn test_theme_comment_keyword() {
+        let theme = Theme::default();
+        let marker =
+            Token::new(TokenKind::Comment, 3..7).with_payload(TokenPayload::CommentKeyword);
+        let style = theme.token_style(&marker);
+        assert_eq!(style.fg, theme.get_style(TokenKind::KeywordControl).fg);
+        assert!(style.bold && !style.italic);
+    }
+
+    #[test]
+    fn test_theme_emphasis() {
+        let mut theme = Theme::default();
+        let comment = theme.get_style(TokenKind::Comment);
+        let emphasized = theme.emphasize(comment);
+        assert_eq!((emphasized.fg, emphasized.italic), (comment.fg, comment.italic));
+        assert!(emphasized.bold && emphasized.bg.is_some());
+
+        theme.set_emphasis_background(rgb(0x00FF00));
+        assert_eq!(theme.emphasize(comment).bg, Some(rgb(0x00FF00)));
+    }
+
+    #[test]
+    fn test_theme_diff() {
+        let mut theme = Theme::default();
+        let string = theme.get_style(TokenKind::String);
+        let added = theme.diff_style(string, true, false);
+        assert_eq!((added.fg, added.bold), (string.fg, string.bold));
+        assert_ne!(added.bg, theme.diff_style(string, false, false).bg);
+        assert_ne!(added.bg, theme.diff_style(string, true, true).bg);
+
+        let green = [rgb(0x00FF00), rgb(0x00AA00)];
+        theme.set_diff_backgrounds(green, [rgb(0xFF0000), rgb(0xAA0000)]);
+        assert_eq!(theme.diff_style(string, true, true).bg, Some(rgb(0x00AA00)));
+    }
+
     #[test]
     fn test_rgb_helper() {
         let color = rgb(0xFF0000);
@@ -5,6 +5,8 @@
 
 use std::ops::Range;
 
+use crate::oklab::StraightRgba;
+
 /// A single token from the lexer.
 #[derive(Debug, Clone, PartialEq, Eq)]
 pub struct Token {
@@ -12,6 +14,188 @@ pub struct Token {
     pub kind: TokenKind,
     /// The byte span in the source text
     pub span: TokenSpan,
+    /// Extra information attached by post-processing filters
+    pub payload: Option<TokenPayload>,
+    /// The containers the token is in, like a function body
+    pub scopes: ScopeStack,
+}
+
+/// Extra information attached to a token.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum TokenPayload {
+    /// A bracket with a partner, at the given nesting depth (modulo the rainbow cycle length).
+    BracketDepth(u8),
+    /// A bracket without a partner.
+    UnbalancedBracket,
+    /// A URL inside a comment or string.
+    Url,
+    /// A file path inside a comment or string, possibly followed by `:line` or `:line:column`.
+    FilePath,
+    /// A color literal and its value. For functional notations like `rgb(...)`
+    /// the payload is attached to the function name.
+    Color(StraightRgba),
+    /// A run of either spaces or tabs, see [`split_whitespace`](crate::syntax::split_whitespace).
+    Whitespace {
+        /// Where on its line the run is.
+        position: WhitespacePosition,
+        /// Whether the run consists of tabs rather than spaces.
+        tabs: bool,
+    },
+    /// A construct the language doesn't allow, see [`flag_diagnostics`](crate::syntax::flag_diagnostics).
+    Invalid,
+    /// A construct that is obsolete or discouraged, see [`flag_diagnostics`](crate::syntax::flag_diagnostics).
+    Deprecated,
+    /// A bidirectional control character, see [`flag_bidi_controls`](crate::syntax::flag_bidi_controls).
+    BidiControl {
+        /// Whether the token or line ends before the control is terminated.
+        unterminated: bool,
+    },
+    /// A C0 control character like NUL or ESC, see
+    /// [`flag_control_characters`](crate::syntax::flag_control_characters).
+    ControlCharacter,
+    /// The byte order mark at the start of a file, in a [`TokenKind::Whitespace`] token.
+    ByteOrderMark,
+    /// Markup inside a [`TokenKind::DocComment`].
+    DocMarkup(DocMarkup),
+    /// An action marker like `TODO` inside a comment, see
+    /// [`mark_comment_keywords`](crate::syntax::mark_comment_keywords).
+    CommentKeyword,
+}
+
+/// The markup of documentation comments, like that of Go's doc comments.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum DocMarkup {
+    /// A link including its brackets, like `[fmt.Printf]`.
+    Link,
+    /// A heading including its marker, like `# Examples`.
+    Heading,
+    /// A line of an indented code block, without the comment leader.
+    Code,
+    /// The `Deprecated:` that starts a paragraph.
+    Deprecated,
+}
+
+/// A construct that contains other tokens, see [`ScopeStack`].
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Hash)]
+pub enum Container {
+    /// The body of a function or method, braces included.
+    FunctionBody = 1,
+    /// The receiver of a method, like `(s *Stack)`.
+    Receiver,
+    /// The parameters of a function or function type, parentheses included.
+    Parameters,
+    /// The results of a function in parentheses, like `(int, error)`.
+    Results,
+    /// The type parameters of a generic declaration, like `[T any]`.
+    TypeParameters,
+    /// The body of a struct type.
+    StructBody,
+    /// The body of an interface type.
+    InterfaceBody,
+    /// The tag of a struct field, like `` `json:"name"` ``.
+    StructTag,
+    /// Any other block of statements, like the body of an `if`.
+    Block,
+}
+
+impl Container {
+    /// All containers, in the order they're declared in.
+    pub const ALL: &[Container] = &[
+        Container::FunctionBody,
+        Container::Receiver,
+        Container::Parameters,
+        Container::Results,
+        Container::TypeParameters,
+        Container::StructBody,
+        Container::InterfaceBody,
+        Container::StructTag,
+        Container::Block,
+    ];
+
+    /// The TextMate scope of the container, without the language suffix.
+    pub fn scope(self) -> &'static str {
+        match self {
+            Container::FunctionBody => "meta.function.body",
+            Container::Receiver => "meta.function.receiver",
+            Container::Parameters => "meta.function.parameters",
+            Container::Results => "meta.function.results",
+            Container::TypeParameters => "meta.type-parameters",
+            Container::StructBody => "meta.struct.body",
+            Container::InterfaceBody => "meta.interface.body",
+            Container::StructTag => "meta.struct-tag",
+            Container::Block => "meta.block",
+        }
+    }
+}
+
+/// The containers a token is in, outermost first, like the parameters of a function
+/// literal in a function body.
+///
+/// Together with the scopes of its kind, they make up the scope stack a TextMate grammar
+/// would give the token, see [`scope_stack`](crate::syntax::scope_stack). To keep tokens
+/// small, the stack is packed into four bits per container, which limits it to
+/// [`ScopeStack::MAX_DEPTH`] containers. Containers nested deeper than that aren't recorded.
+#[derive(Default, Clone, Copy, PartialEq, Eq, Hash)]
+pub struct ScopeStack(u32);
+
+impl ScopeStack {
+    /// The most containers a stack records.
+    pub const MAX_DEPTH: usize = 8;
+
+    /// The number of containers in the stack.
+    pub fn len(self) -> usize {
+        (32 - self.0.leading_zeros() as usize).div_ceil(4)
+    }
+
+    /// Whether the token isn't in any container.
+    pub fn is_empty(self) -> bool {
+        self.0 == 0
+    }
+
+    /// The stack with `container` inside the others, or the same stack if it's full.
+    pub fn push(self, container: Container) -> Self {
+        let len = self.len();
+        if len == Self::MAX_DEPTH { self } else { Self(self.0 | (container as u32) << (4 * len)) }
+    }
+
+    /// The innermost container.
+    pub fn last(self) -> Option<Container> {
+        self.iter().last()
+    }
+
+    /// The containers, outermost first.
+    pub fn iter(self) -> impl Iterator<Item = Container> {
+        let mut bits = self.0;
+        std::iter::from_fn(move || {
+            let container = (bits & 0xF) as usize;
+            bits >>= 4;
+            container.checked_sub(1).map(|i| Container::ALL[i])
+        })
+    }
+}
+
+impl FromIterator<Container> for ScopeStack {
+    fn from_iter<I: IntoIterator<Item = Container>>(iter: I) -> Self {
+        iter.into_iter().fold(Self::default(), Self::push)
+    }
+}
+
+impl std::fmt::Debug for ScopeStack {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.debug_list().entries(self.iter()).finish()
+    }
+}
+
+/// Where on its line a run of whitespace is.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum WhitespacePosition {
+    /// Indentation at the start of a line.
+    Leading,
+    /// Between two other tokens on the same line.
+    Interior,
+    /// At the end of a line, followed by the newline.
+    /// Blank lines that only consist of spaces and tabs count as trailing, too.
+    Trailing,
 }
 
 /// A byte range in the source text.
@@ -23,7 +207,9 @@ pub enum TokenKind {
     // Generic
     Whitespace,
     Comment,
+    DocComment, // a comment documenting the declaration after it, like Go's doc comments
     Error,
+    Text, // plain text without highlighting, like the rest of a line too long to lex
 
     // Literals
     String,
@@ -31,20 +217,23 @@ pub enum TokenKind {
     Boolean,
     Null,
     Char,
+    DocString, // a string documenting its module, class or function, e.g. Python's docstrings
 
     // Keywords
     Keyword,
-    KeywordControl,   // if, else, while, for, loop, match
-    KeywordFunction,  // fn, function, def
-    KeywordImport,    // import, use, require
-    KeywordStorage,   // let, const, var, mut
-    KeywordType,      // type, struct, enum, class, interface
-    KeywordOperator,  // as, in, is, sizeof
+    KeywordControl,  // if, else, while, for, loop, match
+    KeywordFunction, // fn, function, def
+    KeywordImport,   // import, use, require
+    KeywordStorage,  // let, const, var, mut
+    KeywordType,     // type, struct, enum, class, interface
+    KeywordOperator, // as, in, is, sizeof
 
     // Identifiers
     Identifier,
     TypeName,
     FunctionName,
+    FunctionDefinition, // the name in `fn name(`, see `classify_functions`
+    FunctionCall,       // the name in `name(`
     VariableName,
     PropertyName,
     ParameterName,
@@ -52,14 +241,20 @@ pub enum TokenKind {
     // Operators and Punctuation
     Operator,
     Punctuation,
-    Delimiter,       // {}, [], ()
-    Separator,       // ,, ;
+    Delimiter, // {}, [], ()
+    Separator, // ,, ;
 
     // Special
     Attribute,       // #[derive(...)] in Rust
     Macro,           // macros
+    MacroOperator,   // `#` and `##` in C macro bodies, which stringize and paste tokens
     Label,           // loop labels
     Escape,          // escape sequences in strings
+    Interpolation,   // the delimiters of an interpolation in a string, like `${` and `}`
+    FormatSpecifier, // verbs in format strings, like `%d` for Go's `fmt`
+    Regex,           // regular expression literals, like `/re/` in JavaScript
+    RegexFlags,      // the flags after a regular expression literal, like the `g` of `/re/g`
+    Inactive, // code the preprocessor leaves out, like `#if 0` blocks, see `mark_inactive_code`
 
     // JSON specific
     JsonKey,
@@ -82,9 +277,77 @@ pub enum TokenKind {
 }
 
 impl TokenKind {
-    /// Returns true if this token is a whitespace or comment.
+    /// All kinds, in the order they're declared in.
+    pub const ALL: &[TokenKind] = &[
+        TokenKind::Whitespace,
+        TokenKind::Comment,
+        TokenKind::DocComment,
+        TokenKind::Error,
+        TokenKind::Text,
+        TokenKind::String,
+        TokenKind::Number,
+        TokenKind::Boolean,
+        TokenKind::Null,
+        TokenKind::Char,
+        TokenKind::DocString,
+        TokenKind::Keyword,
+        TokenKind::KeywordControl,
+        TokenKind::KeywordFunction,
+        TokenKind::KeywordImport,
+        TokenKind::KeywordStorage,
+        TokenKind::KeywordType,
+        TokenKind::KeywordOperator,
+        TokenKind::Identifier,
+        TokenKind::TypeName,
+        TokenKind::FunctionName,
+        TokenKind::FunctionDefinition,
+        TokenKind::FunctionCall,
+        TokenKind::VariableName,
+        TokenKind::PropertyName,
+        TokenKind::ParameterName,
+        TokenKind::Operator,
+        TokenKind::Punctuation,
+        TokenKind::Delimiter,
+        TokenKind::Separator,
+        TokenKind::Attribute,
+        TokenKind::Macro,
+        TokenKind::MacroOperator,
+        TokenKind::Label,
+        TokenKind::Escape,
+        TokenKind::Interpolation,
+        TokenKind::FormatSpecifier,
+        TokenKind::Regex,
+        TokenKind::RegexFlags,
+        TokenKind::Inactive,
+        TokenKind::JsonKey,
+        TokenKind::JsonBrace,
+        TokenKind::JsonBracket,
+        TokenKind::JsonColon,
+        TokenKind::JsonComma,
+        TokenKind::RustLifetime,
+        TokenKind::RustMacro,
+        TokenKind::RustAttribute,
+        TokenKind::MarkdownHeading,
+        TokenKind::MarkdownBold,
+        TokenKind::MarkdownItalic,
+        TokenKind::MarkdownCode,
+        TokenKind::MarkdownLink,
+    ];
+
+    /// Returns true if this token is whitespace, a comment or inactive code.
     pub fn is_trivia(self) -> bool {
-        matches!(self, TokenKind::Whitespace | TokenKind::Comment)
+        matches!(
+            self,
+            TokenKind::Whitespace
+                | TokenKind::Comment
+                | TokenKind::DocComment
+                | TokenKind::Inactive
+        )
+    }
+
+    /// Returns true if this token is a comment, including documentation comments.
+    pub fn is_comment(self) -> bool {
+        matches!(self, TokenKind::Comment | TokenKind::DocComment)
     }
 
     /// Returns true if this token represents an error.
@@ -106,11 +369,32 @@ impl TokenKind {
         )
     }
 
+    /// Returns true if this token is an identifier, including the names of types and functions.
+    pub fn is_identifier(self) -> bool {
+        matches!(
+            self,
+            TokenKind::Identifier
+                | TokenKind::TypeName
+                | TokenKind::FunctionName
+                | TokenKind::FunctionDefinition
+                | TokenKind::FunctionCall
+                | TokenKind::VariableName
+                | TokenKind::PropertyName
+                | TokenKind::ParameterName
+        )
+    }
+
+    /// Returns true if this token is a string, including documentation strings.
+    pub fn is_string(self) -> bool {
+        matches!(self, TokenKind::String | TokenKind::DocString)
+    }
+
     /// Returns true if this token is a literal.
     pub fn is_literal(self) -> bool {
         matches!(
             self,
             TokenKind::String
+                | TokenKind::DocString
                 | TokenKind::Number
                 | TokenKind::Boolean
                 | TokenKind::Null
@@ -122,7 +406,19 @@ impl TokenKind {
 impl Token {
     /// Create a new token.
     pub fn new(kind: TokenKind, span: TokenSpan) -> Self {
-        Self { kind, span }
+        Self { kind, span, payload: None, scopes: ScopeStack::default() }
+    }
+
+    /// Attach a payload to the token.
+    pub fn with_payload(mut self, payload: TokenPayload) -> Self {
+        self.payload = Some(payload);
+        self
+    }
+
+    /// Put the token in the given containers.
+    pub fn with_scopes(mut self, scopes: ScopeStack) -> Self {
+        self.scopes = scopes;
+        self
     }
 
     /// Get the length of the token in bytes.
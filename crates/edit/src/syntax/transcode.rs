@@ -0,0 +1,400 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//! Transcoding UTF-16 input to UTF-8, so that it can be lexed.
+//!
+//! The lexers work on UTF-8. Lexing UTF-16 as is turns every other byte into a NUL,
+//! so [`transcode`] detects UTF-16, converts it, and keeps an [`OffsetMap`] to express
+//! token positions in either the original or the transcoded coordinates.
+//!
+//! Files in legacy single-byte encodings aren't detected by default, since any byte
+//! sequence is valid in them. Hosts can opt into [`transcode_legacy`] for those.
+
+use std::ops::Range;
+
+/// The encoding of the input to [`transcode`].
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum SourceEncoding {
+    Utf8,
+    Utf16Le,
+    Utf16Be,
+    /// Windows-1252, which is also a superset of the printable characters of ISO-8859-1.
+    /// It's only detected by [`transcode_legacy`].
+    Windows1252,
+}
+
+/// The result of [`transcode`].
+#[derive(Debug, Clone)]
+pub struct Transcoded {
+    /// The UTF-8 text, without the byte order mark.
+    pub text: Vec<u8>,
+    /// The detected encoding of the input.
+    pub encoding: SourceEncoding,
+    /// Whether the input started with a byte order mark.
+    pub bom: bool,
+    /// The offsets in the input of the unpaired surrogates and trailing odd bytes
+    /// which were replaced with U+FFFD. If this isn't empty, the round-trip is lossy.
+    pub replacements: Vec<usize>,
+    /// Maps between offsets in the input and in [`Transcoded::text`].
+    pub offsets: OffsetMap,
+}
+
+/// Maps offsets between the input of [`transcode`] and its UTF-8 output.
+///
+/// The text is stored as runs of characters which have the same length in both
+/// encodings, so ASCII-only text needs a single run.
+#[derive(Debug, Clone, Default)]
+pub struct OffsetMap {
+    runs: Vec<Run>,
+}
+
+#[derive(Debug, Clone, Copy)]
+struct Run {
+    transcoded: usize,
+    original: usize,
+    transcoded_len: usize,
+    original_len: usize,
+}
+
+impl OffsetMap {
+    /// Convert an offset in the transcoded text to an offset in the input.
+    /// Offsets inside a character map to the start of that character.
+    pub fn to_original(&self, offset: usize) -> usize {
+        let idx = self.runs.partition_point(|r| r.transcoded <= offset);
+        let Some(run) = idx.checked_sub(1).map(|i| self.runs[i]) else {
+            return offset;
+        };
+        run.original + (offset - run.transcoded) / run.transcoded_len * run.original_len
+    }
+
+    /// Convert an offset in the input to an offset in the transcoded text.
+    /// Offsets inside a character map to the start of that character.
+    pub fn to_transcoded(&self, offset: usize) -> usize {
+        let idx = self.runs.partition_point(|r| r.original <= offset);
+        let Some(run) = idx.checked_sub(1).map(|i| self.runs[i]) else {
+            return 0;
+        };
+        run.transcoded + (offset - run.original) / run.original_len * run.transcoded_len
+    }
+
+    /// Convert a range in the transcoded text, like a token's span, to a range in the input.
+    pub fn range_to_original(&self, range: Range<usize>) -> Range<usize> {
+        self.to_original(range.start)..self.to_original(range.end)
+    }
+
+    fn push(
+        &mut self,
+        transcoded: usize,
+        original: usize,
+        transcoded_len: usize,
+        original_len: usize,
+    ) {
+        if let Some(last) = self.runs.last()
+            && last.transcoded_len == transcoded_len
+            && last.original_len == original_len
+        {
+            return;
+        }
+        self.runs.push(Run { transcoded, original, transcoded_len, original_len });
+    }
+}
+
+/// Detect the encoding of `input` by its byte order mark or, without one, by where its
+/// NUL bytes are: UTF-16 text that's mostly ASCII has a NUL in every other byte.
+/// Returns the encoding and the length of the byte order mark.
+pub fn detect_encoding(input: &[u8]) -> (SourceEncoding, usize) {
+    if input.starts_with(b"\xEF\xBB\xBF") {
+        return (SourceEncoding::Utf8, 3);
+    }
+    if input.starts_with(b"\xFF\xFE") {
+        return (SourceEncoding::Utf16Le, 2);
+    }
+    if input.starts_with(b"\xFE\xFF") {
+        return (SourceEncoding::Utf16Be, 2);
+    }
+
+    // Only the start of the input is sampled, which is plenty for a heuristic.
+    let sample = &input[..input.len().min(4096)];
+    let units = sample.len() / 2;
+    let (mut even, mut odd) = (0, 0);
+    for pair in sample.chunks_exact(2) {
+        match (pair[0], pair[1]) {
+            (0, 0) => {}
+            (_, 0) => odd += 1,
+            (0, _) => even += 1,
+            _ => {}
+        }
+    }
+    let encoding = if units > 0 && odd * 2 >= units && even == 0 {
+        SourceEncoding::Utf16Le
+    } else if units > 0 && even * 2 >= units && odd == 0 {
+        SourceEncoding::Utf16Be
+    } else {
+        SourceEncoding::Utf8
+    };
+    (encoding, 0)
+}
+
+/// Detect the encoding of `input` and transcode it to UTF-8 for lexing.
+///
+/// UTF-8 input is copied as is, minus its byte order mark. In UTF-16 input, unpaired
+/// surrogates and a trailing odd byte are replaced with U+FFFD and reported in
+/// [`Transcoded::replacements`].
+pub fn transcode(input: &[u8]) -> Transcoded {
+    let (encoding, bom_len) = detect_encoding(input);
+    let mut offsets = OffsetMap::default();
+    let mut replacements = Vec::new();
+
+    let text = match encoding {
+        SourceEncoding::Utf8 => {
+            offsets.push(0, bom_len, 1, 1);
+            input[bom_len..].to_vec()
+        }
+        SourceEncoding::Windows1252 => decode_windows1252(input, &mut offsets),
+        SourceEncoding::Utf16Le | SourceEncoding::Utf16Be => {
+            let unit = |i: usize| {
+                let pair = [input[i], input[i + 1]];
+                if encoding == SourceEncoding::Utf16Le {
+                    u16::from_le_bytes(pair)
+                } else {
+                    u16::from_be_bytes(pair)
+                }
+            };
+
+            let mut text = Vec::with_capacity(input.len() / 2 * 3 / 2);
+            let mut pos = bom_len;
+            while pos < input.len() {
+                let start = pos;
+                let ch = if pos + 1 >= input.len() {
+                    pos += 1;
+                    None
+                } else {
+                    let hi = unit(pos);
+                    pos += 2;
+                    match hi {
+                        0xD800..=0xDBFF if pos + 1 < input.len() => {
+                            let lo = unit(pos);
+                            if (0xDC00..=0xDFFF).contains(&lo) {
+                                pos += 2;
+                                char::from_u32(
+                                    0x10000 + ((hi as u32 - 0xD800) << 10) + (lo as u32 - 0xDC00),
+                                )
+                            } else {
+                                None
+                            }
+                        }
+                        _ => char::from_u32(hi as u32),
+                    }
+                };
+                let ch = ch.unwrap_or_else(|| {
+                    replacements.push(start);
+                    char::REPLACEMENT_CHARACTER
+                });
+
+                let mut buf = [0; 4];
+                let utf8 = ch.encode_utf8(&mut buf).as_bytes();
+                offsets.push(text.len(), start, utf8.len(), pos - start);
+                text.extend_from_slice(utf8);
+            }
+            text
+        }
+    };
+
+    Transcoded { text, encoding, bom: bom_len > 0, replacements, offsets }
+}
+
+/// Transcode `input` from Windows-1252 to UTF-8, if it isn't valid UTF-8 or UTF-16 but
+/// plausibly is Windows-1252 text, like a source file with accented names in its comments.
+///
+/// This is opt-in because it's a guess: the input must decode without undefined bytes
+/// or control characters, and its non-ASCII bytes must be sparse, like accented letters
+/// and typographic quotes in otherwise ASCII text.
+pub fn transcode_legacy(input: &[u8]) -> Option<Transcoded> {
+    if str::from_utf8(input).is_ok() || detect_encoding(input).0 != SourceEncoding::Utf8 {
+        return None;
+    }
+
+    let mut high = 0;
+    let mut run = 0;
+    for &b in input {
+        if b < 0x80 {
+            if b < 0x20 && !matches!(b, b'\t' | b'\n' | b'\r' | b'\x0C') {
+                return None;
+            }
+            run = 0;
+            continue;
+        }
+        windows1252_char(b)?;
+        high += 1;
+        run += 1;
+        // Words rarely have more than a few accented letters in a row.
+        if run > 3 {
+            return None;
+        }
+    }
+    if high * 4 > input.len() {
+        return None;
+    }
+
+    let mut offsets = OffsetMap::default();
+    let text = decode_windows1252(input, &mut offsets);
+    Some(Transcoded {
+        text,
+        encoding: SourceEncoding::Windows1252,
+        bom: false,
+        replacements: Vec::new(),
+        offsets,
+    })
+}
+
+fn decode_windows1252(input: &[u8], offsets: &mut OffsetMap) -> Vec<u8> {
+    let mut text = Vec::with_capacity(input.len() + input.len() / 8);
+    for (pos, &b) in input.iter().enumerate() {
+        let ch = windows1252_char(b).unwrap_or(char::REPLACEMENT_CHARACTER);
+        let mut buf = [0; 4];
+        let utf8 = ch.encode_utf8(&mut buf).as_bytes();
+        offsets.push(text.len(), pos, utf8.len(), 1);
+        text.extend_from_slice(utf8);
+    }
+    text
+}
+
+/// Decodes a Windows-1252 byte. The bytes it leaves undefined return `None`.
+fn windows1252_char(b: u8) -> Option<char> {
+    const C1: [u16; 32] = [
+        0x20AC, 0, 0x201A, 0x0192, 0x201E, 0x2026, 0x2020, 0x2021, //
+        0x02C6, 0x2030, 0x0160, 0x2039, 0x0152, 0, 0x017D, 0, //
+        0, 0x2018, 0x2019, 0x201C, 0x201D, 0x2022, 0x2013, 0x2014, //
+        0x02DC, 0x2122, 0x0161, 0x203A, 0x0153, 0, 0x017E, 0x0178,
+    ];
+    match b {
+        0x80..=0x9F => char::from_u32(C1[b as usize - 0x80] as u32).filter(|&c| c != '\0'),
+        _ => Some(b as char),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::syntax::{Language, LexerRegistry, TokenKind};
+
+    const SOURCE: &str = "// Grüße 🌍\nfunc main() { s := \"wörld\" }\n";
+
+    fn utf16(s: &str, le: bool, bom: bool) -> Vec<u8> {
+        let mut out = Vec::new();
+        for unit in bom.then_some(0xFEFF).into_iter().chain(s.encode_utf16()) {
+            out.extend_from_slice(&if le { unit.to_le_bytes() } else { unit.to_be_bytes() });
+        }
+        out
+    }
+
+    #[test]
+    fn test_transcode_utf16() {
+        for (le, bom) in [(true, true), (true, false), (false, true), (false, false)] {
+            let input = utf16(SOURCE, le, bom);
+            let result = transcode(&input);
+            let expected = if le { SourceEncoding::Utf16Le } else { SourceEncoding::Utf16Be };
+            assert_eq!(result.encoding, expected, "le: {le}, bom: {bom}");
+            assert_eq!(result.bom, bom);
+            assert_eq!(result.text, SOURCE.as_bytes());
+            assert!(result.replacements.is_empty());
+
+            // The lexer sees the same tokens as for the UTF-8 text, without NUL errors.
+            let tokens = LexerRegistry::get_lexer(Language::Go).tokenize(&result.text);
+            assert!(!tokens.iter().any(|t| t.kind == TokenKind::Error));
+
+            // `"wörld"` is 8 UTF-8 bytes, but 7 UTF-16 units.
+            let string = tokens.iter().find(|t| t.kind == TokenKind::String).unwrap();
+            let original = result.offsets.range_to_original(string.span.clone());
+            let units: Vec<u16> = "\"wörld\"".encode_utf16().collect();
+            assert_eq!(original.len(), units.len() * 2);
+            assert_eq!(input[original], utf16("\"wörld\"", le, false));
+        }
+    }
+
+    #[test]
+    fn test_offset_round_trip() {
+        let input = utf16(SOURCE, true, true);
+        let result = transcode(&input);
+        for (offset, _) in SOURCE.char_indices().chain([(SOURCE.len(), ' ')]) {
+            let original = result.offsets.to_original(offset);
+            assert_eq!(result.offsets.to_transcoded(original), offset);
+        }
+        // The BOM maps to the start of the text, the emoji is a surrogate pair.
+        assert_eq!(result.offsets.to_original(0), 2);
+        let emoji = SOURCE.find('🌍').unwrap();
+        assert_eq!(result.offsets.to_original(emoji + 4) - result.offsets.to_original(emoji), 4);
+        assert_eq!(result.offsets.to_transcoded(result.offsets.to_original(emoji) + 2), emoji);
+    }
+
+    #[test]
+    fn test_lossy_transcode() {
+        // An unpaired high surrogate, an unpaired low surrogate and a trailing odd byte.
+        let mut input = b"\xFF\xFEa\x00".to_vec();
+        input.extend_from_slice(&0xD800u16.to_le_bytes());
+        input.extend_from_slice(b"b\x00");
+        input.extend_from_slice(&0xDC00u16.to_le_bytes());
+        input.push(b'c');
+
+        let result = transcode(&input);
+        assert_eq!(String::from_utf8(result.text).unwrap(), "a\u{FFFD}b\u{FFFD}\u{FFFD}");
+        assert_eq!(result.replacements, [4, 8, 10]);
+    }
+
+    #[test]
+    fn test_transcode_legacy() {
+        let input = include_bytes!("../../../../syntax-tests/test_syntax_latin1.c");
+
+        // The default path leaves the bytes alone.
+        let plain = transcode(input);
+        assert_eq!(plain.encoding, SourceEncoding::Utf8);
+        assert_eq!(plain.text, input);
+
+        let result = transcode_legacy(input).unwrap();
+        assert_eq!(result.encoding, SourceEncoding::Windows1252);
+        let text = str::from_utf8(&result.text).unwrap();
+        assert!(text.contains("René Lefèvre – “café”"));
+        assert!(text.contains("résumé (© 1998)"));
+
+        // The accents are part of the comments.
+        let tokens = LexerRegistry::get_lexer(Language::C).tokenize(&result.text);
+        let comments: Vec<_> = tokens.iter().filter(|t| t.kind == TokenKind::Comment).collect();
+        assert_eq!(comments.len(), 2);
+        assert!(text[comments[1].span.clone()].ends_with("résumé (© 1998)"));
+
+        // Both `é` map to their single byte in the input, and back.
+        let e = text.find("René").unwrap() + 3;
+        let original = result.offsets.to_original(e);
+        assert_eq!(input[original], 0xE9);
+        assert_eq!(result.offsets.range_to_original(e..e + 2), original..original + 1);
+        assert_eq!(result.offsets.to_transcoded(original + 1), e + 2);
+        let comment = result.offsets.range_to_original(comments[1].span.clone());
+        assert!(input[comment].ends_with(b"r\xE9sum\xE9 (\xA9 1998)"));
+    }
+
+    #[test]
+    fn test_transcode_legacy_rejects() {
+        // Valid UTF-8 and UTF-16 are left to `transcode`.
+        assert!(transcode_legacy("café".as_bytes()).is_none());
+        assert!(transcode_legacy(&utf16(SOURCE, true, true)).is_none());
+        // Undefined bytes, control characters and dense non-ASCII aren't text.
+        assert!(transcode_legacy(b"caf\xE9 \x81").is_none());
+        assert!(transcode_legacy(b"caf\xE9\x00\x01").is_none());
+        assert!(transcode_legacy(b"\xE9\xE8\xE0\xF9\xEA").is_none());
+        assert!(transcode_legacy(b"x\xE9\xE8").is_none());
+        assert!(transcode_legacy(b"caf\xE9").is_some());
+    }
+
+    #[test]
+    fn test_utf8_passes_through() {
+        let result = transcode("\u{FEFF}x := 1".as_bytes());
+        assert_eq!(result.encoding, SourceEncoding::Utf8);
+        assert!(result.bom);
+        assert_eq!(result.text, b"x := 1");
+        assert_eq!(result.offsets.to_original(2), 5);
+        assert_eq!(result.offsets.to_transcoded(5), 2);
+
+        // Binary data with scattered NULs isn't mistaken for UTF-16.
+        assert_eq!(detect_encoding(b"\x00\x01ab\x00\x00cd\x05\x00").0, SourceEncoding::Utf8);
+    }
+}
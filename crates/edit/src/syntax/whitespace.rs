@@ -0,0 +1,162 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//! Whitespace tokens for editors that render whitespace or flag trailing whitespace.
+//!
+//! The lexers already cover every byte of the document, including whitespace, but lump
+//! spaces, tabs and newlines together. [`split_whitespace`] splits those tokens into runs
+//! of a single kind of whitespace and tags the spaces and tabs with where on the line they
+//! are. The tokens stay [`TokenKind::Whitespace`] tokens, so renderers that don't care
+//! about the distinction pass them through untouched.
+
+use crate::syntax::{Token, TokenKind, TokenPayload, WhitespacePosition};
+
+/// Split the whitespace tokens into runs of newlines, spaces and tabs, and attach a
+/// [`TokenPayload::Whitespace`] to the runs of spaces and tabs.
+///
+/// Whitespace inside other tokens, like the spaces at the end of a line in a raw string,
+/// is content of that token and isn't touched.
+pub fn split_whitespace(text: &[u8], tokens: &mut Vec<Token>) {
+    let mut result = Vec::with_capacity(tokens.len() + tokens.len() / 2);
+    // Whether only spaces and tabs were seen since the start of the line.
+    let mut leading = true;
+    // The end of the current stretch of spaces and tabs and whether a newline follows it.
+    let mut blank_end = 0;
+    let mut trailing = false;
+
+    for token in tokens.drain(..) {
+        if token.payload == Some(TokenPayload::ByteOrderMark) {
+            // Indentation after it is still leading.
+            result.push(token);
+            continue;
+        }
+        if token.kind != TokenKind::Whitespace || token.payload.is_some() {
+            let s = &text[token.span.clone()];
+            leading = match s.iter().rposition(|&b| b == b'\n') {
+                Some(i) => s[i + 1..].iter().all(|&b| is_blank(b)),
+                None => leading && s.iter().all(|&b| is_blank(b)),
+            };
+            result.push(token);
+            continue;
+        }
+
+        let run_token = |range| Token::new(TokenKind::Whitespace, range).with_scopes(token.scopes);
+        let mut pos = token.span.start;
+        while pos < token.span.end {
+            let start = pos;
+            let b = text[pos];
+            let run = |pos: usize, f: &dyn Fn(u8) -> bool| {
+                pos + text[pos..token.span.end].iter().take_while(|&&b| f(b)).count()
+            };
+
+            if is_blank(b) {
+                pos = run(pos, &|c| c == b);
+                if start >= blank_end {
+                    blank_end = pos + text[pos..].iter().take_while(|&&b| is_blank(b)).count();
+                    trailing = matches!(text.get(blank_end), Some(b'\n' | b'\r'));
+                }
+                let position = if trailing {
+                    WhitespacePosition::Trailing
+                } else if leading {
+                    WhitespacePosition::Leading
+                } else {
+                    WhitespacePosition::Interior
+                };
+                let payload = TokenPayload::Whitespace { position, tabs: b == b'\t' };
+                result.push(run_token(start..pos).with_payload(payload));
+            } else if is_newline(b) {
+                pos = run(pos, &is_newline);
+                leading = true;
+                result.push(run_token(start..pos));
+            } else {
+                // Form feeds and the like.
+                pos = run(pos, &|c| !is_blank(c) && !is_newline(c));
+                leading = false;
+                result.push(run_token(start..pos));
+            }
+        }
+    }
+
+    *tokens = result;
+}
+
+fn is_blank(b: u8) -> bool {
+    b == b' ' || b == b'\t'
+}
+
+fn is_newline(b: u8) -> bool {
+    b == b'\n' || b == b'\r'
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::syntax::{Language, LexerRegistry};
+
+    /// Renders the whitespace runs as `<position><char><len>`, e.g. `L\t1` for one tab
+    /// of indentation, and checks that the tokens still cover the whole text.
+    fn runs(language: Language, text: &str) -> Vec<String> {
+        let mut tokens = LexerRegistry::get_lexer(language).tokenize(text.as_bytes());
+        split_whitespace(text.as_bytes(), &mut tokens);
+
+        let mut pos = 0;
+        for token in &tokens {
+            assert_eq!(token.span.start, pos, "{tokens:?}");
+            pos = token.span.end;
+        }
+        assert_eq!(pos, text.len());
+
+        tokens
+            .iter()
+            .filter_map(|t| match t.payload {
+                Some(TokenPayload::Whitespace { position, tabs }) => {
+                    let position = match position {
+                        WhitespacePosition::Leading => 'L',
+                        WhitespacePosition::Interior => 'I',
+                        WhitespacePosition::Trailing => 'T',
+                    };
+                    let ch = if tabs { '\t' } else { ' ' };
+                    Some(format!("{position}{ch}{}", t.len()))
+                }
+                _ => None,
+            })
+            .collect()
+    }
+
+    #[test]
+    fn test_mixed_indentation() {
+        let text = "func f() {\n\t  x := 1\n  \tif x {\n\t\t}\n}\n";
+        assert_eq!(
+            runs(Language::Go, text),
+            ["I 1", "I 1", "L\t1", "L 2", "I 1", "I 1", "L 2", "L\t1", "I 1", "I 1", "L\t2"]
+        );
+    }
+
+    #[test]
+    fn test_trailing_whitespace() {
+        let text = "x := 1 \t\n\t\ny := 2  \r\nz := 3  ";
+        assert_eq!(
+            runs(Language::Go, text),
+            [
+                "I 1", "I 1", "T 1", "T\t1", // x := 1
+                "T\t1", // blank line
+                "I 1", "I 1", "T 2", // y := 2 with CRLF
+                "I 1", "I 1", "I 2", // z := 3 at the end of the file
+            ]
+        );
+    }
+
+    #[test]
+    fn test_raw_string_content() {
+        // The spaces inside the raw string are string content, but the ones after it are trailing.
+        let text = "s := `a  \n  b  \n`  \nt := 1\n";
+        assert_eq!(runs(Language::Go, text), ["I 1", "I 1", "T 2", "I 1", "I 1"]);
+    }
+
+    #[test]
+    fn test_after_multiline_tokens() {
+        // Indentation after a block comment that ends a line.
+        let text = "/* a\n */\n  x()\n/* b */  y()\n";
+        assert_eq!(runs(Language::C, text), ["L 2", "I 2"]);
+    }
+}
@@ -477,6 +477,64 @@ impl<'doc> MeasurementConfig<'doc> {
     }
 }
 
+/// Returns the display width of `text` in columns, with tabs expanded to multiples of `tab_size`.
+///
+/// Like the editor's own layout, this counts grapheme clusters, not characters: emoji
+/// sequences and wide characters take 2 columns, combining marks take none.
+/// `text` should be a single line, because the column starts over after a newline.
+pub fn display_width(text: &[u8], tab_size: CoordType) -> CoordType {
+    MeasurementConfig::new(&text).with_tab_size(tab_size).goto_offset(text.len()).column
+}
+
+/// Maps between byte offsets and display columns within a single line,
+/// for renderers which lay out text without a [`MeasurementConfig`] of their own.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct ColumnMap {
+    /// The offset of each grapheme cluster, followed by the length of the line.
+    offsets: Vec<usize>,
+    /// The column each grapheme cluster starts at, followed by the width of the line.
+    columns: Vec<CoordType>,
+}
+
+impl ColumnMap {
+    /// Measures `line`, with tabs expanded to multiples of `tab_size`.
+    /// A trailing newline is ignored.
+    pub fn new(line: &[u8], tab_size: CoordType) -> Self {
+        let line = strip_newline(line);
+        let mut cfg = MeasurementConfig::new(&line).with_tab_size(tab_size);
+        let mut offsets = vec![0];
+        let mut columns = vec![0];
+
+        while *offsets.last().unwrap() < line.len() {
+            let x = cfg.cursor().logical_pos.x + 1;
+            let cursor = cfg.goto_logical(Point { x, y: 0 });
+            offsets.push(cursor.offset);
+            columns.push(cursor.column);
+        }
+
+        Self { offsets, columns }
+    }
+
+    /// Returns the width of the line in columns.
+    pub fn width(&self) -> CoordType {
+        *self.columns.last().unwrap()
+    }
+
+    /// Returns the column at which the grapheme cluster containing `offset` starts.
+    /// Offsets past the end of the line map to its width.
+    pub fn column(&self, offset: usize) -> CoordType {
+        let i = self.offsets.partition_point(|&o| o <= offset);
+        self.columns[i - 1]
+    }
+
+    /// Returns the offset of the grapheme cluster which covers `column`.
+    /// Columns past the end of the line map to its length.
+    pub fn offset(&self, column: CoordType) -> usize {
+        let i = self.columns.partition_point(|&c| c <= column);
+        self.offsets[i - 1]
+    }
+}
+
 /// Returns an offset past a newline.
 ///
 /// If `offset` is right in front of a newline,
@@ -1053,6 +1111,47 @@ mod test {
         );
     }
 
+    #[test]
+    fn test_display_width() {
+        // `世` as in the Go fixture, a flag, a ZWJ sequence and a combining accent.
+        assert_eq!(display_width("var 世界 = 1".as_bytes(), 4), 12);
+        assert_eq!(display_width("🇩🇪".as_bytes(), 4), 2);
+        assert_eq!(display_width("👩‍🔬".as_bytes(), 4), 2);
+        assert_eq!(display_width("cafe\u{301}".as_bytes(), 4), 4);
+        // Composed and decomposed forms are one column, nothing gets normalized.
+        assert_eq!(display_width("caf\u{e9}".as_bytes(), 4), 4);
+        let composed = ColumnMap::new("\u{e9}x".as_bytes(), 4);
+        let decomposed = ColumnMap::new("e\u{301}x".as_bytes(), 4);
+        assert_eq!((composed.column(2), decomposed.column(3)), (1, 1));
+        assert_eq!((composed.offset(1), decomposed.offset(1)), (2, 3));
+        // Tab stops are counted in columns, not characters.
+        assert_eq!(display_width("世\tx".as_bytes(), 4), 5);
+        assert_eq!(display_width("世界\tx".as_bytes(), 4), 9);
+    }
+
+    #[test]
+    fn test_column_map() {
+        let line = "a\u{301}世\t🇩🇪b\n";
+        let map = ColumnMap::new(line.as_bytes(), 4);
+        assert_eq!(map.width(), 7);
+
+        let offsets = [0, 3, 6, 7, 15, 16];
+        let columns = [0, 1, 3, 4, 6, 7];
+        for (&offset, &column) in offsets.iter().zip(&columns) {
+            assert_eq!(map.column(offset), column);
+            assert_eq!(map.offset(column), offset);
+        }
+
+        // The combining accent belongs to the `a`, the second column of `世` to `世`.
+        assert_eq!(map.column(1), 0);
+        assert_eq!(map.offset(2), 3);
+        // The tab covers columns 3..4, the flag 4..6.
+        assert_eq!(map.offset(5), 7);
+        assert_eq!(map.column(11), 4);
+        assert_eq!(map.offset(100), 16);
+        assert_eq!(map.column(100), 7);
+    }
+
     #[test]
     fn test_strip_newline() {
         assert_eq!(strip_newline(b"hello\n"), b"hello");
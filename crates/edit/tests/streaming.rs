@@ -0,0 +1,131 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//! The memory that streaming a large file takes, counted by a global allocator, which is
+//! why this is a test of its own.
+
+use std::alloc::{GlobalAlloc, Layout, System};
+use std::io::{self, BufReader, Read};
+use std::sync::atomic::{AtomicBool, AtomicUsize, Ordering};
+
+use edit::syntax::{Grammar, Language, StreamOptions, SyntaxHighlighter, Theme, highlight_reader};
+
+struct Counting;
+
+static ALLOCATED: AtomicUsize = AtomicUsize::new(0);
+static PEAK: AtomicUsize = AtomicUsize::new(0);
+
+unsafe impl GlobalAlloc for Counting {
+    unsafe fn alloc(&self, layout: Layout) -> *mut u8 {
+        let ptr = unsafe { System.alloc(layout) };
+        if !ptr.is_null() {
+            let now = ALLOCATED.fetch_add(layout.size(), Ordering::Relaxed) + layout.size();
+            PEAK.fetch_max(now, Ordering::Relaxed);
+        }
+        ptr
+    }
+
+    unsafe fn dealloc(&self, ptr: *mut u8, layout: Layout) {
+        unsafe { System.dealloc(ptr, layout) };
+        ALLOCATED.fetch_sub(layout.size(), Ordering::Relaxed);
+    }
+}
+
+#[global_allocator]
+static GLOBAL: Counting = Counting;
+
+/// A file of `len` bytes, made of the fixture over and over, which is never all in memory.
+struct Repeated {
+    fixture: &'static [u8],
+    offset: usize,
+    left: usize,
+}
+
+impl Read for Repeated {
+    fn read(&mut self, buf: &mut [u8]) -> io::Result<usize> {
+        let n = buf.len().min(self.left).min(self.fixture.len() - self.offset);
+        buf[..n].copy_from_slice(&self.fixture[self.offset..self.offset + n]);
+        self.offset = (self.offset + n) % self.fixture.len();
+        self.left -= n;
+        Ok(n)
+    }
+}
+
+/// Stream `len` bytes of Go and return the most memory it took on top of what was
+/// allocated before.
+fn stream_peak(len: usize) -> usize {
+    let grammar = Grammar::parse(include_str!("grammars/go.tmLanguage.json")).unwrap();
+    let fixture = include_bytes!("../../../syntax-tests/test_syntax.go");
+    let reader = BufReader::new(Repeated { fixture, offset: 0, left: len });
+
+    // Highlight a line first, so that what the grammar compiles and caches on first use
+    // isn't counted.
+    grammar.tokenize_line(b"package main\n", &mut grammar.initial_state());
+    let before = ALLOCATED.load(Ordering::Relaxed);
+    PEAK.store(before, Ordering::Relaxed);
+
+    let (mut bytes, mut tokens) = (0, 0);
+    let options = StreamOptions::default();
+    highlight_reader(&grammar, reader, &options, &AtomicBool::new(false), |line| {
+        bytes += line.text.len();
+        tokens += line.tokens.len();
+        Ok(())
+    })
+    .unwrap();
+    assert_eq!(bytes, len);
+    assert!(tokens > len / 16);
+    PEAK.load(Ordering::Relaxed) - before
+}
+
+/// Stream `len` bytes of SQL after a `/*` that's never closed with our own lexer, and
+/// return the most memory it took on top of what was allocated before.
+fn lex_peak(len: usize) -> usize {
+    let fixture = include_bytes!("../../../syntax-tests/test_syntax_postgres.sql");
+    let open = &b"/* never closed\n"[..];
+    let reader = BufReader::new(open.chain(Repeated { fixture, offset: 0, left: len }));
+    let mut highlighter = SyntaxHighlighter::new(Language::Sql, Theme::default());
+    assert!(highlighter.streams());
+
+    let before = ALLOCATED.load(Ordering::Relaxed);
+    PEAK.store(before, Ordering::Relaxed);
+
+    let (mut bytes, mut tokens) = (0, 0);
+    let options = StreamOptions::default();
+    highlighter
+        .highlight_reader(reader, &options, &AtomicBool::new(false), |line| {
+            bytes += line.text.len();
+            tokens += line.tokens.len();
+            Ok(())
+        })
+        .unwrap();
+    assert_eq!(bytes, open.len() + len);
+    assert!(tokens > len / 16);
+    PEAK.load(Ordering::Relaxed) - before
+}
+
+/// Tests in this file run one after another, so that they count only their own memory.
+static SERIAL: std::sync::Mutex<()> = std::sync::Mutex::new(());
+
+#[test]
+fn test_bounded_memory() {
+    let _serial = SERIAL.lock().unwrap();
+    let peak = stream_peak(256 << 10);
+    assert!(peak < 64 << 10, "streaming 256 KiB took {peak} bytes");
+}
+
+#[test]
+#[ignore = "takes minutes, even in release builds"]
+fn test_bounded_memory_100mb() {
+    let _serial = SERIAL.lock().unwrap();
+    let peak = stream_peak(100 << 20);
+    assert!(peak < 64 << 10, "streaming 100 MiB took {peak} bytes");
+}
+
+#[test]
+fn test_bounded_memory_lexer() {
+    // Only a window of lines is kept, even while looking for the end of a comment.
+    let _serial = SERIAL.lock().unwrap();
+    let small = lex_peak(1 << 20);
+    let large = lex_peak(8 << 20);
+    assert!(large < small + (64 << 10), "streaming 8 MiB took {large} bytes, 1 MiB {small}");
+}
@@ -0,0 +1,310 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//! `hl bench`: how fast the lexers are on real code.
+//!
+//! Every file with a detected language is highlighted a few times, one after another
+//! and without output, and the fastest times are summed up per language. Only the
+//! highlighting is timed, not reading the files. Small trees give noisy numbers: compare
+//! runs over the same large tree, on the same machine, and with a release build.
+//!
+//! The JSON report is documented in the README. Keep it backwards compatible
+//! and bump [`SCHEMA_VERSION`] if that's impossible.
+
+use std::ffi::OsString;
+use std::fs;
+use std::io::{self, BufWriter, Write};
+use std::path::Path;
+use std::time::{Duration, Instant};
+
+use edit::helpers::MetricFormatter;
+use edit::json;
+use edit::syntax::{Language, SyntaxHighlighter, transcode};
+use stdext::arena::Arena;
+
+use crate::format::json_escape;
+use crate::list::write_columns;
+use crate::tree::{is_binary, walk};
+use crate::{Args, detect_language};
+
+/// The `version` field of the JSON report.
+const SCHEMA_VERSION: u32 = 1;
+/// How many of the slowest files are reported.
+const SLOWEST: usize = 5;
+/// How often each file is highlighted. The fastest run counts, which leaves out the
+/// first run's cache misses and whatever else the machine was busy with.
+const RUNS: usize = 3;
+
+/// One highlighted file.
+struct Sample {
+    path: String,
+    language: Language,
+    bytes: usize,
+    tokens: usize,
+    time: Duration,
+}
+
+/// The sums for one language, or all of them.
+#[derive(Default, Clone, Copy)]
+struct Totals {
+    files: usize,
+    bytes: usize,
+    tokens: usize,
+    time: Duration,
+}
+
+impl Totals {
+    fn add(&mut self, sample: &Sample) {
+        self.files += 1;
+        self.bytes += sample.bytes;
+        self.tokens += sample.tokens;
+        self.time += sample.time;
+    }
+
+    fn mb_per_second(&self) -> f64 {
+        self.bytes as f64 / 1e6 / self.time.as_secs_f64().max(1e-9)
+    }
+
+    fn tokens_per_second(&self) -> f64 {
+        self.tokens as f64 / self.time.as_secs_f64().max(1e-9)
+    }
+}
+
+/// Highlights every file below the directories, and the files, and prints the report.
+/// `compare` is an earlier JSON report to print the changes against.
+/// Returns whether all of the files could be read.
+pub fn run(args: &Args, compare: Option<&Path>) -> io::Result<bool> {
+    // A broken baseline is reported before spending time on the files.
+    let baseline = compare.map(read_report).transpose()?;
+
+    let dot = [OsString::from(".")];
+    let paths = if args.paths.is_empty() { &dot[..] } else { &args.paths[..] };
+    let mut samples = Vec::new();
+    let mut all_read = true;
+
+    for path in paths {
+        let path = Path::new(path);
+        let sources = if path.is_dir() {
+            walk(path, args.gitignore, None)?
+                .into_iter()
+                .map(|source| (path.join(&source.rel), source.rel))
+                .collect()
+        } else {
+            vec![(path.to_path_buf(), path.to_string_lossy().into_owned())]
+        };
+        for (file, rel) in sources {
+            let display = file.to_string_lossy().into_owned();
+            match fs::read(&file) {
+                Ok(input) => samples.extend(sample(args, display, Path::new(&rel), &input)),
+                Err(err) => {
+                    eprintln!("hl: {display}: {err}");
+                    all_read = false;
+                }
+            }
+        }
+    }
+
+    let mut languages: Vec<(Language, Totals)> = Vec::new();
+    let mut total = Totals::default();
+    for s in &samples {
+        match languages.iter_mut().find(|(l, _)| *l == s.language) {
+            Some((_, totals)) => totals.add(s),
+            None => {
+                let mut totals = Totals::default();
+                totals.add(s);
+                languages.push((s.language, totals));
+            }
+        }
+        total.add(s);
+    }
+    languages.sort_by_key(|(l, _)| l.id());
+    samples.sort_by(|a, b| b.time.cmp(&a.time));
+    samples.truncate(SLOWEST);
+
+    let mut out = BufWriter::new(io::stdout().lock());
+    if args.json {
+        write_json(&mut out, &languages, &total, &samples)?;
+    } else {
+        write_text(&mut out, &languages, &total, &samples, baseline.as_deref())?;
+    }
+    out.flush()?;
+    Ok(all_read)
+}
+
+/// Highlights one file, unless it's binary or its language isn't detected.
+fn sample(args: &Args, path: String, rel: &Path, input: &[u8]) -> Option<Sample> {
+    let text = transcode(input).text;
+    let language = args.language.unwrap_or_else(|| detect_language(args, rel, &text));
+    if is_binary(&text) || language == Language::PlainText {
+        return None;
+    }
+
+    let mut tokens = 0;
+    let mut time = Duration::MAX;
+    for _ in 0..RUNS {
+        let start = Instant::now();
+        let mut highlighter = SyntaxHighlighter::new(language, args.theme.create());
+        highlighter.update(&text, true);
+        tokens = highlighter.tokens().len();
+        time = time.min(start.elapsed());
+    }
+
+    Some(Sample { path, language, bytes: text.len(), tokens, time })
+}
+
+fn write_text(
+    out: &mut impl Write,
+    languages: &[(Language, Totals)],
+    total: &Totals,
+    slowest: &[Sample],
+    baseline: Option<&[(String, Totals)]>,
+) -> io::Result<()> {
+    let row = |name: &str, totals: &Totals| {
+        let mut row = vec![
+            name.to_string(),
+            totals.files.to_string(),
+            MetricFormatter(totals.bytes).to_string(),
+            format!("{:.2}ms", totals.time.as_secs_f64() * 1e3),
+            format!("{:.1}", totals.mb_per_second()),
+            format!("{:.0}", totals.tokens_per_second()),
+        ];
+        if let Some(baseline) = baseline {
+            match baseline.iter().find(|(n, _)| n == name) {
+                Some((_, before)) => {
+                    let change = totals.mb_per_second() / before.mb_per_second() - 1.0;
+                    row.push(format!("{:.1}", before.mb_per_second()));
+                    row.push(format!("{:+.1}%", change * 1e2));
+                }
+                None => row.extend(["-".to_string(), "new".to_string()]),
+            }
+        }
+        row
+    };
+
+    let mut rows: Vec<_> = languages.iter().map(|(l, totals)| row(l.id(), totals)).collect();
+    if let Some(baseline) = baseline {
+        // Languages that were benchmarked before, but aren't anymore.
+        for (name, before) in baseline {
+            if name != "total" && !languages.iter().any(|(l, _)| l.id() == name) {
+                let mut row = vec![name.clone(), "0".to_string()];
+                row.resize(6, String::new());
+                row.extend([format!("{:.1}", before.mb_per_second()), "gone".to_string()]);
+                rows.push(row);
+            }
+        }
+        rows.sort_by(|a, b| a[0].cmp(&b[0]));
+    }
+    rows.push(row("total", total));
+    if baseline.is_some() {
+        let rows: Vec<[String; 8]> = rows.into_iter().map(|row| row.try_into().unwrap()).collect();
+        let header = ["LANGUAGE", "FILES", "BYTES", "TIME", "MB/S", "TOKENS/S", "BEFORE", "CHANGE"];
+        write_columns(out, header, &rows)?;
+    } else {
+        let rows: Vec<[String; 6]> = rows.into_iter().map(|row| row.try_into().unwrap()).collect();
+        write_columns(out, ["LANGUAGE", "FILES", "BYTES", "TIME", "MB/S", "TOKENS/S"], &rows)?;
+    }
+
+    if !slowest.is_empty() {
+        writeln!(out, "\nSlowest files:")?;
+        for s in slowest {
+            writeln!(
+                out,
+                "{:>9.2}ms  {} ({}, {})",
+                s.time.as_secs_f64() * 1e3,
+                s.path,
+                s.language.name(),
+                MetricFormatter(s.bytes)
+            )?;
+        }
+    }
+    Ok(())
+}
+
+fn write_json(
+    out: &mut impl Write,
+    languages: &[(Language, Totals)],
+    total: &Totals,
+    slowest: &[Sample],
+) -> io::Result<()> {
+    let totals = |totals: &Totals| {
+        format!(
+            "\"files\":{},\"bytes\":{},\"tokens\":{},\"nanos\":{}",
+            totals.files,
+            totals.bytes,
+            totals.tokens,
+            totals.time.as_nanos()
+        )
+    };
+
+    write!(out, "{{\"version\":{SCHEMA_VERSION},\"languages\":[")?;
+    for (i, (l, t)) in languages.iter().enumerate() {
+        let comma = if i > 0 { "," } else { "" };
+        write!(out, "{comma}{{\"name\":\"{}\",{}}}", json_escape(l.id()), totals(t))?;
+    }
+    write!(out, "],\"total\":{{{}}},\"slowest\":[", totals(total))?;
+    for (i, s) in slowest.iter().enumerate() {
+        write!(
+            out,
+            "{}{{\"path\":\"{}\",\"language\":\"{}\",\"bytes\":{},\"tokens\":{},\"nanos\":{}}}",
+            if i > 0 { "," } else { "" },
+            json_escape(&s.path),
+            json_escape(s.language.id()),
+            s.bytes,
+            s.tokens,
+            s.time.as_nanos()
+        )?;
+    }
+    writeln!(out, "]}}")
+}
+
+/// Reads the totals per language, and as `total`, from a JSON report.
+fn read_report(path: &Path) -> io::Result<Vec<(String, Totals)>> {
+    let err = |message: String| {
+        io::Error::new(io::ErrorKind::InvalidInput, format!("{}: {message}", path.display()))
+    };
+    let text = fs::read_to_string(path).map_err(|e| err(e.to_string()))?;
+    let arena = Arena::new(16 * 1024 * 1024).map_err(|e| err(e.to_string()))?;
+    let value = json::parse(&arena, &text).map_err(|e| err(e.to_string()))?;
+    let report = value.as_object().ok_or_else(|| err("not a bench report".to_string()))?;
+    if report.get_number("version") != Some(SCHEMA_VERSION as f64) {
+        return Err(err(format!("expected a version {SCHEMA_VERSION} bench report")));
+    }
+
+    let totals = |object: json::Object| {
+        let number = |key| object.get_number(key).map(|n| n as u64);
+        Some(Totals {
+            files: number("files")? as usize,
+            bytes: number("bytes")? as usize,
+            tokens: number("tokens")? as usize,
+            time: Duration::from_nanos(number("nanos")?),
+        })
+    };
+    let mut result = Vec::new();
+    for language in report.get_array("languages").unwrap_or_default() {
+        let parsed =
+            language.as_object().and_then(|l| Some((l.get_str("name")?.to_string(), totals(l)?)));
+        result.push(parsed.ok_or_else(|| err("invalid entry in languages".to_string()))?);
+    }
+    let total = report.get_object("total").and_then(totals);
+    result.push(("total".to_string(), total.ok_or_else(|| err("no total".to_string()))?));
+    Ok(result)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_rates() {
+        let totals = Totals {
+            files: 2,
+            bytes: 3_000_000,
+            tokens: 500_000,
+            time: Duration::from_millis(500),
+        };
+        assert_eq!(totals.mb_per_second(), 6.0);
+        assert_eq!(totals.tokens_per_second(), 1e6);
+        // Files too small to measure don't divide by zero.
+        assert!(Totals::default().mb_per_second().is_finite());
+    }
+}
@@ -0,0 +1,205 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//! `--check`: reports what the lexers couldn't make sense of, for CI.
+//!
+//! This is not a parser. It finds characters no lexer rule accepts, the constructs the
+//! diagnostic hooks flag as invalid, and strings or comments that never end. Code
+//! with those is almost certainly broken, but code without them can still be.
+
+use std::ffi::OsStr;
+use std::fs;
+use std::io::{self, BufWriter, Read, Write};
+use std::ops::Range;
+use std::path::Path;
+
+use edit::syntax::{
+    Columns, Language, LineIndex, ProblemKind, SyntaxHighlighter, TokenKind, TokenPayload,
+    transcode,
+};
+
+use crate::tree::{is_binary, walk};
+use crate::{Args, EXIT_CHECK_FAILED, EXIT_UNREADABLE, detect_language};
+
+/// How many errors are printed per file. The rest are only counted.
+const MAX_REPORTED_PER_FILE: usize = 20;
+/// How many characters of the offending line are printed.
+const MAX_EXCERPT_LEN: usize = 80;
+
+/// Something the lexers flagged.
+#[derive(Debug, PartialEq, Eq)]
+pub struct Finding {
+    offset: usize,
+    message: String,
+}
+
+/// Checks every file, and every file below the directories, and prints the errors.
+/// Returns the exit status: whether a file couldn't be read, or there were too many errors.
+pub fn run(args: &Args) -> io::Result<u8> {
+    let stdin = [OsStr::new("-")];
+    let paths: Vec<&OsStr> = if args.paths.is_empty() {
+        stdin.to_vec()
+    } else {
+        args.paths.iter().map(|p| p.as_os_str()).collect()
+    };
+    let mut out = BufWriter::new(io::stdout().lock());
+    let mut all_read = true;
+    let mut errors = 0;
+    let mut files_with_errors = 0;
+
+    // Files found in directories are skipped unless their language is detected,
+    // unlike the ones that were named.
+    let mut check = |out: &mut BufWriter<_>, display: &str, path: &Path, input: &[u8], found| {
+        let text = transcode(input).text;
+        let language = args.language.unwrap_or_else(|| detect_language(args, path, &text));
+        if found && (is_binary(&text) || language == Language::PlainText) {
+            return Ok(());
+        }
+        let findings = find(language, args, &text);
+        if !findings.is_empty() {
+            errors += findings.len();
+            files_with_errors += 1;
+        }
+        report(out, display, &text, &findings, args.columns)
+    };
+
+    for path in paths {
+        let input = if path == "-" {
+            let mut input = Vec::new();
+            io::stdin().read_to_end(&mut input).map(|_| input)
+        } else if Path::new(path).is_dir() {
+            let root = Path::new(path);
+            for source in walk(root, args.gitignore, None)? {
+                let display = root.join(&source.rel);
+                let display = display.to_string_lossy();
+                match fs::read(&source.path) {
+                    Ok(input) => check(&mut out, &display, Path::new(&source.rel), &input, true)?,
+                    Err(err) => {
+                        eprintln!("hl: {display}: {err}");
+                        all_read = false;
+                    }
+                }
+            }
+            continue;
+        } else {
+            fs::read(path)
+        };
+
+        let display = if path == "-" { "(standard input)".into() } else { path.to_string_lossy() };
+        match input {
+            Ok(input) => check(&mut out, &display, Path::new(path), &input, false)?,
+            Err(err) => {
+                eprintln!("hl: {display}: {err}");
+                all_read = false;
+            }
+        }
+    }
+
+    if errors > 0 {
+        let s = |n| if n == 1 { "" } else { "s" };
+        writeln!(
+            out,
+            "{errors} error{} in {files_with_errors} file{}",
+            s(errors),
+            s(files_with_errors)
+        )?;
+    }
+    out.flush()?;
+
+    Ok(if !all_read {
+        EXIT_UNREADABLE
+    } else if errors > args.max_errors {
+        EXIT_CHECK_FAILED
+    } else {
+        0
+    })
+}
+
+/// Returns the errors in `text`, ordered by offset.
+pub fn find(language: Language, args: &Args, text: &[u8]) -> Vec<Finding> {
+    let mut highlighter = SyntaxHighlighter::new(language, args.theme.create());
+    highlighter.update(text, true);
+
+    let quoted = |span: &Range<usize>| {
+        let s = String::from_utf8_lossy(&text[span.clone()]);
+        truncate(&s.lines().next().unwrap_or_default().escape_debug().to_string())
+    };
+    let mut findings: Vec<_> = highlighter
+        .tokens()
+        .iter()
+        .filter_map(|token| {
+            let message = if token.kind.is_error() {
+                format!("unexpected `{}`", quoted(&token.span))
+            } else if token.payload != Some(TokenPayload::Invalid) {
+                return None;
+            } else if token.kind == TokenKind::Whitespace {
+                // Like tabs in YAML.
+                "invalid indentation".to_string()
+            } else {
+                format!("invalid `{}`", quoted(&token.span))
+            };
+            Some(Finding { offset: token.span.start, message })
+        })
+        .collect();
+
+    // Brackets aren't reported: lexers don't know about generics like `a < b`,
+    // and Markdown or shell scripts have unbalanced ones all the time.
+    findings.extend(
+        highlighter
+            .balance_problems(text)
+            .into_iter()
+            .filter(|problem| problem.kind == ProblemKind::Unterminated)
+            .map(|problem| Finding { offset: problem.range.start, message: problem.message }),
+    );
+    findings.sort_by_key(|finding| finding.offset);
+    findings
+}
+
+/// Prints the findings as `path:line:column: message` with the line below it.
+/// Columns count `columns` and start at 1, like the lines.
+pub fn report(
+    out: &mut impl Write,
+    display: &str,
+    text: &[u8],
+    findings: &[Finding],
+    columns: Columns,
+) -> io::Result<()> {
+    let lines = LineIndex::new(text);
+    for finding in findings.iter().take(MAX_REPORTED_PER_FILE) {
+        let (line, column) = lines.position(text, finding.offset, columns);
+        let excerpt = String::from_utf8_lossy(&text[lines.range(line)]);
+        let (line, column) = (line + 1, column + 1);
+        writeln!(out, "{display}:{line}:{column}: {}", finding.message)?;
+        writeln!(out, "    {}", truncate(excerpt.trim()))?;
+    }
+    if findings.len() > MAX_REPORTED_PER_FILE {
+        writeln!(out, "{display}: {} more errors", findings.len() - MAX_REPORTED_PER_FILE)?;
+    }
+    Ok(())
+}
+
+/// Shortens `s` to [`MAX_EXCERPT_LEN`] characters.
+pub fn truncate(s: &str) -> String {
+    match s.char_indices().nth(MAX_EXCERPT_LEN) {
+        Some((i, _)) => format!("{}…", &s[..i]),
+        None => s.to_string(),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_report() {
+        let text = "a\n\t\"é\" $ b\n".as_bytes();
+        let findings = [Finding { offset: 8, message: "unexpected `$`".to_string() }];
+        let mut out = Vec::new();
+        report(&mut out, "x.sh", text, &findings, Columns::Chars).unwrap();
+        assert_eq!(String::from_utf8(out).unwrap(), "x.sh:2:6: unexpected `$`\n    \"é\" $ b\n");
+
+        let long = "x".repeat(MAX_EXCERPT_LEN + 1);
+        assert_eq!(truncate(&long), format!("{}…", &long[1..]));
+        assert_eq!(truncate("short"), "short");
+    }
+}
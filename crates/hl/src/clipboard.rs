@@ -0,0 +1,99 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//! `--clipboard`: puts the output of `--copy` into the clipboard with OSC 52,
+//! which the terminal handles, so it works over SSH too.
+//!
+//! Terminals may ignore the sequence, ask first, or only accept it when they're
+//! configured to, which is why it's never sent without asking for it.
+
+use std::{env, io};
+
+use edit::base64;
+use stdext::arena::{Arena, ArenaString};
+
+/// GNU screen drops DCS strings beyond 768 bytes, so the base64 is split into
+/// strings this long. It's what other OSC 52 tools use.
+const SCREEN_CHUNK: usize = 76;
+
+/// What's between `hl` and the terminal, which has to pass the sequence on.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Multiplexer {
+    /// Nothing, the terminal gets the sequence as is.
+    Terminal,
+    /// tmux, which passes on DCS strings prefixed with `tmux;`.
+    Tmux,
+    /// GNU screen, which passes on DCS strings.
+    Screen,
+}
+
+impl Multiplexer {
+    /// Detects the multiplexer from the variables tmux and screen set.
+    pub fn detect() -> Self {
+        if env::var_os("TMUX").is_some() {
+            Self::Tmux
+        } else if env::var_os("STY").is_some() {
+            Self::Screen
+        } else {
+            Self::Terminal
+        }
+    }
+}
+
+/// Returns the sequence that sets the clipboard to `data`.
+pub fn osc52(data: &[u8], multiplexer: Multiplexer) -> io::Result<Vec<u8>> {
+    let arena = Arena::new(base64::encode_len(data.len()))?;
+    let mut encoded = ArenaString::new_in(&arena);
+    base64::encode(&mut encoded, data);
+    let encoded = encoded.as_bytes();
+
+    let mut out = Vec::with_capacity(encoded.len() + encoded.len() / SCREEN_CHUNK * 4 + 32);
+    match multiplexer {
+        Multiplexer::Terminal => {
+            out.extend_from_slice(b"\x1b]52;c;");
+            out.extend_from_slice(encoded);
+            out.extend_from_slice(b"\x1b\\");
+        }
+        // In a DCS string, the OSC ends with BEL, since an ST would end the DCS string.
+        Multiplexer::Tmux => {
+            // tmux wants the ESCs inside of it doubled.
+            out.extend_from_slice(b"\x1bPtmux;\x1b\x1b]52;c;");
+            out.extend_from_slice(encoded);
+            out.extend_from_slice(b"\x07\x1b\\");
+        }
+        Multiplexer::Screen => {
+            out.extend_from_slice(b"\x1bP\x1b]52;c;");
+            for (i, chunk) in encoded.chunks(SCREEN_CHUNK).enumerate() {
+                if i > 0 {
+                    out.extend_from_slice(b"\x1b\\\x1bP");
+                }
+                out.extend_from_slice(chunk);
+            }
+            out.extend_from_slice(b"\x07\x1b\\");
+        }
+    }
+    Ok(out)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_osc52() {
+        let osc52 = |data: &[u8], multiplexer| String::from_utf8(osc52(data, multiplexer).unwrap());
+        assert_eq!(osc52(b"hello", Multiplexer::Terminal).unwrap(), "\x1b]52;c;aGVsbG8=\x1b\\");
+        assert_eq!(
+            osc52(b"hello", Multiplexer::Tmux).unwrap(),
+            "\x1bPtmux;\x1b\x1b]52;c;aGVsbG8=\x07\x1b\\"
+        );
+        assert_eq!(osc52(b"", Multiplexer::Terminal).unwrap(), "\x1b]52;c;\x1b\\");
+
+        // 60 bytes are 80 base64 characters, one chunk of 76 and one of 4.
+        let screen = osc52(&[0; 60], Multiplexer::Screen).unwrap();
+        let chunks: Vec<_> = screen.split("\x1b\\\x1bP").collect();
+        assert_eq!(chunks.len(), 2);
+        assert_eq!(chunks[0], format!("\x1bP\x1b]52;c;{}", "A".repeat(76)));
+        assert_eq!(chunks[1], "AAAA\x07\x1b\\");
+    }
+}
@@ -0,0 +1,487 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//! The config file, with defaults for the flags that would otherwise be passed every time.
+//!
+//! ```toml
+//! theme = "light"
+//! formatter = "truecolor"
+//! color = "always"
+//! tab_width = 4
+//! sql_dialect = "postgres"
+//! region_start = "#region {}"
+//! region_end = "#endregion"
+//! comment_keywords = ["TODO", "FIXME", "SAFETY"]
+//!
+//! # Extensions to highlight as another language than the one they're detected as.
+//! [languages]
+//! h = "cpp"
+//! ```
+//!
+//! It's parsed by hand, like the arguments. Only the part of TOML needed for
+//! settings like these is supported: tables, comments, and keys with string,
+//! integer and one-line string array values. Anything else is an error, not ignored.
+
+use std::io::{self, Write};
+use std::path::{Path, PathBuf};
+use std::sync::Arc;
+use std::{env, fs};
+
+use edit::helpers::CoordType;
+use edit::syntax::{Language, SqlDialect};
+
+use crate::format::Format;
+use crate::{Args, Color, ThemeChoice};
+
+/// The settings in a config file. `None` if the file doesn't set it.
+#[derive(Default)]
+pub struct Config {
+    pub theme: Option<Arc<ThemeChoice>>,
+    pub format: Option<Format>,
+    pub color: Option<Color>,
+    pub tab_width: Option<CoordType>,
+    pub sql_dialect: Option<SqlDialect>,
+    pub region_start: Option<String>,
+    pub region_end: Option<String>,
+    /// The markers to highlight in comments, instead of
+    /// [`DEFAULT_COMMENT_KEYWORDS`](edit::syntax::DEFAULT_COMMENT_KEYWORDS).
+    pub comment_keywords: Option<Vec<String>>,
+    /// Lowercase extensions with the language to use for them instead.
+    pub languages: Vec<(String, Language)>,
+}
+
+/// `$HL_CONFIG` if it's set, and otherwise `hl/config.toml` in the user's config
+/// directory, e.g. `~/.config/hl/config.toml`. `None` if there's no config file to read.
+pub fn default_path() -> Option<PathBuf> {
+    if let Some(path) = env::var_os("HL_CONFIG") {
+        return if path.is_empty() { None } else { Some(path.into()) };
+    }
+    let dir = if cfg!(windows) {
+        env::var_os("APPDATA").map(PathBuf::from)
+    } else {
+        env::var_os("XDG_CONFIG_HOME")
+            .filter(|dir| !dir.is_empty())
+            .map(PathBuf::from)
+            .or_else(|| env::var_os("HOME").map(|home| Path::new(&home).join(".config")))
+    };
+    dir.map(|dir| dir.join("hl").join("config.toml"))
+}
+
+/// Reads the config file at `path`. Returns `None` if it doesn't exist,
+/// which is only an error if it was `required`, i.e. passed with `--config`.
+pub fn load(path: &Path, required: bool) -> Result<Option<Config>, String> {
+    let text = match fs::read_to_string(path) {
+        Ok(text) => text,
+        Err(err) if err.kind() == io::ErrorKind::NotFound && !required => return Ok(None),
+        Err(err) => return Err(format!("{}: {err}", path.display())),
+    };
+    parse(&text).map(Some).map_err(|(line, err)| format!("{}:{line}: {err}", path.display()))
+}
+
+/// Prints the settings that result from the defaults, the config file and the flags.
+/// The output is a valid config file itself.
+pub fn dump(args: &Args) -> io::Result<()> {
+    let mut out = io::stdout().lock();
+    match &args.config {
+        Some(path) => {
+            writeln!(out, "# The defaults, with {} and the flags applied", path.display())?
+        }
+        None => writeln!(out, "# The defaults, with the flags applied")?,
+    }
+    let color = match args.color {
+        Color::Auto => "auto",
+        Color::Always => "always",
+        Color::Never => "never",
+    };
+    writeln!(out, "theme = \"{}\"", args.theme.name)?;
+    writeln!(out, "formatter = \"{}\"", args.format.name())?;
+    writeln!(out, "color = \"{color}\"")?;
+    writeln!(out, "tab_width = {}", args.tab_width)?;
+    if let Some(dialect) = args.sql_dialect {
+        writeln!(out, "sql_dialect = \"{}\"", dialect.id())?;
+    }
+    writeln!(out, "region_start = {}", quote(&args.region_start))?;
+    writeln!(out, "region_end = {}", quote(&args.region_end))?;
+    let keywords: Vec<_> = args.comment_keywords.iter().map(|k| quote(k)).collect();
+    writeln!(out, "comment_keywords = [{}]", keywords.join(", "))?;
+    if !args.languages.is_empty() {
+        writeln!(out, "\n[languages]")?;
+        for (ext, language) in &args.languages {
+            writeln!(out, "{} = \"{}\"", key(ext), language.id())?;
+        }
+    }
+    out.flush()
+}
+
+/// A value on the right of a `=`.
+#[derive(Debug, PartialEq, Eq)]
+enum Value {
+    String(String),
+    Integer(i64),
+    Array(Vec<String>),
+}
+
+/// Parses a config file. Errors come with their 1-based line number.
+fn parse(text: &str) -> Result<Config, (usize, String)> {
+    let mut config = Config::default();
+    let mut table = None;
+    let mut seen: Vec<(Option<String>, String)> = Vec::new();
+
+    for (i, line) in text.lines().enumerate() {
+        let line_number = i + 1;
+        let err = |message: String| (line_number, message);
+        let mut p = Parser { rest: line.trim_start() };
+
+        if p.rest.is_empty() || p.rest.starts_with('#') {
+            continue;
+        }
+        if p.eat('[') {
+            if p.rest.starts_with('[') {
+                return Err(err("arrays of tables aren't supported".to_string()));
+            }
+            let name = p.key().map_err(err)?;
+            if !p.eat(']') {
+                return Err(err("expected ']' after the table name".to_string()));
+            }
+            p.end().map_err(err)?;
+            if name != "languages" {
+                return Err(err(format!("unknown table [{name}]")));
+            }
+            table = Some(name);
+            continue;
+        }
+
+        let key = p.key().map_err(err)?;
+        if !p.eat('=') {
+            return Err(err(format!("expected '=' after '{key}'")));
+        }
+        let value = p.value().map_err(|e| err(format!("{key}: {e}")))?;
+        p.end().map_err(err)?;
+
+        if seen.iter().any(|(t, k)| *t == table && *k == key) {
+            return Err(err(format!("duplicate key '{key}'")));
+        }
+        seen.push((table.clone(), key.clone()));
+
+        let apply = || -> Result<(), String> {
+            match (table.as_deref(), key.as_str()) {
+                (None, "theme") => config.theme = Some(crate::parse_theme(&string(value)?)?),
+                (None, "formatter") => config.format = Some(crate::parse_format(&string(value)?)?),
+                (None, "color") => config.color = Some(crate::parse_color(&string(value)?)?),
+                (None, "tab_width") => match value {
+                    Value::Integer(width) => config.tab_width = Some(crate::tab_width(width)?),
+                    _ => return Err("expected an integer".to_string()),
+                },
+                (None, "sql_dialect") => {
+                    config.sql_dialect = Some(crate::parse_sql_dialect(&string(value)?)?)
+                }
+                (None, "region_start") => config.region_start = Some(string(value)?),
+                (None, "region_end") => config.region_end = Some(string(value)?),
+                (None, "comment_keywords") => {
+                    let keywords = strings(value)?;
+                    if keywords.iter().any(|k| k.is_empty()) {
+                        return Err("keywords can't be empty".to_string());
+                    }
+                    config.comment_keywords = Some(keywords);
+                }
+                (None, _) => return Err("unknown key".to_string()),
+                (Some(_), ext) => {
+                    let name = string(value)?;
+                    let language = crate::parse_language(&name)
+                        .ok_or_else(|| format!("unknown language '{name}'"))?;
+                    let ext = ext.strip_prefix('.').unwrap_or(ext).to_lowercase();
+                    config.languages.push((ext, language));
+                }
+            }
+            Ok(())
+        };
+        apply().map_err(|e| err(format!("{key}: {e}")))?;
+    }
+
+    Ok(config)
+}
+
+fn string(value: Value) -> Result<String, String> {
+    match value {
+        Value::String(s) => Ok(s),
+        _ => Err("expected a string".to_string()),
+    }
+}
+
+fn strings(value: Value) -> Result<Vec<String>, String> {
+    match value {
+        Value::Array(strings) => Ok(strings),
+        _ => Err("expected an array of strings".to_string()),
+    }
+}
+
+/// Quotes `key` if it isn't a valid bare key, like `"c++"`.
+fn key(key: &str) -> String {
+    if !key.is_empty() && key.bytes().all(is_bare_key) { key.to_string() } else { quote(key) }
+}
+
+fn quote(s: &str) -> String {
+    format!("\"{}\"", s.replace('\\', "\\\\").replace('"', "\\\""))
+}
+
+fn is_bare_key(b: u8) -> bool {
+    b.is_ascii_alphanumeric() || b == b'_' || b == b'-'
+}
+
+/// Parses a single line, skipping whitespace between its parts.
+struct Parser<'a> {
+    rest: &'a str,
+}
+
+impl Parser<'_> {
+    fn skip_whitespace(&mut self) {
+        self.rest = self.rest.trim_start_matches([' ', '\t']);
+    }
+
+    /// Consumes `ch` and the whitespace after it, if `ch` is next.
+    fn eat(&mut self, ch: char) -> bool {
+        self.skip_whitespace();
+        let Some(rest) = self.rest.strip_prefix(ch) else {
+            return false;
+        };
+        self.rest = rest;
+        self.skip_whitespace();
+        true
+    }
+
+    /// Checks that only whitespace and a comment are left.
+    fn end(&mut self) -> Result<(), String> {
+        self.skip_whitespace();
+        if self.rest.is_empty() || self.rest.starts_with('#') {
+            Ok(())
+        } else {
+            Err(format!("unexpected '{}'", self.rest))
+        }
+    }
+
+    fn key(&mut self) -> Result<String, String> {
+        self.skip_whitespace();
+        let key = match self.rest.as_bytes().first() {
+            Some(b'"' | b'\'') => self.string()?,
+            _ => {
+                let len = self.rest.bytes().take_while(|&b| is_bare_key(b)).count();
+                let (key, rest) = self.rest.split_at(len);
+                self.rest = rest;
+                key.to_string()
+            }
+        };
+        self.skip_whitespace();
+        if key.is_empty() {
+            Err("expected a key".to_string())
+        } else if self.rest.starts_with('.') {
+            Err("dotted keys aren't supported".to_string())
+        } else {
+            Ok(key)
+        }
+    }
+
+    fn value(&mut self) -> Result<Value, String> {
+        let word_len = self.rest.find([' ', '\t', '#']).unwrap_or(self.rest.len());
+        let (word, rest) = self.rest.split_at(word_len);
+        let value = match self.rest.as_bytes().first() {
+            Some(b'"' | b'\'') => return self.string().map(Value::String),
+            Some(b'[') => return self.array().map(Value::Array),
+            Some(b'0'..=b'9' | b'+' | b'-') => word
+                .replace('_', "")
+                .parse()
+                .map(Value::Integer)
+                .map_err(|_| format!("unsupported value '{word}'"))?,
+            None => return Err("expected a value".to_string()),
+            // Booleans, arrays, inline tables, floats and dates.
+            _ => return Err(format!("unsupported value '{}'", self.rest.trim_end())),
+        };
+        self.rest = rest;
+        Ok(value)
+    }
+
+    /// Parses an array of strings on one line, like `["TODO", 'FIXME']`.
+    fn array(&mut self) -> Result<Vec<String>, String> {
+        let array = self.rest.trim_end();
+        self.eat('[');
+        let mut strings = Vec::new();
+        let mut separated = true;
+        while !self.eat(']') {
+            match self.rest.as_bytes().first() {
+                None | Some(b'#') => return Err("unterminated array".to_string()),
+                Some(b'"' | b'\'') if separated => strings.push(self.string()?),
+                _ => return Err(format!("unsupported value '{array}'")),
+            }
+            separated = self.eat(',');
+        }
+        Ok(strings)
+    }
+
+    /// Parses a basic `"string"` with escapes, or a literal `'string'` without.
+    fn string(&mut self) -> Result<String, String> {
+        if self.rest.starts_with("\"\"\"") || self.rest.starts_with("'''") {
+            return Err("multi-line strings aren't supported".to_string());
+        }
+        let quote = self.rest.chars().next().unwrap_or_default();
+        let mut result = String::new();
+        let mut chars = self.rest[1..].char_indices();
+
+        while let Some((i, ch)) = chars.next() {
+            match ch {
+                _ if ch == quote => {
+                    self.rest = &self.rest[1 + i + 1..];
+                    return Ok(result);
+                }
+                '\\' if quote == '"' => {
+                    let escaped = match chars.next().map(|(_, ch)| ch) {
+                        Some('"') => '"',
+                        Some('\\') => '\\',
+                        Some('n') => '\n',
+                        Some('t') => '\t',
+                        Some('r') => '\r',
+                        Some(u @ ('u' | 'U')) => {
+                            let len = if u == 'u' { 4 } else { 8 };
+                            let hex: String = chars.by_ref().take(len).map(|(_, ch)| ch).collect();
+                            u32::from_str_radix(&hex, 16)
+                                .ok()
+                                .filter(|_| hex.len() == len)
+                                .and_then(char::from_u32)
+                                .ok_or_else(|| format!("invalid escape '\\{u}{hex}'"))?
+                        }
+                        Some(ch) => return Err(format!("invalid escape '\\{ch}'")),
+                        None => break,
+                    };
+                    result.push(escaped);
+                }
+                _ => result.push(ch),
+            }
+        }
+        Err("unterminated string".to_string())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn error(text: &str) -> String {
+        match parse(text) {
+            Ok(_) => panic!("{text:?} parsed"),
+            Err((line, err)) => format!("{line}: {err}"),
+        }
+    }
+
+    #[test]
+    fn test_theme_file() {
+        let dir = std::env::temp_dir().join(format!("hl-config-theme-{}", std::process::id()));
+        std::fs::create_dir_all(&dir).unwrap();
+        let json = r##"{ "type": "light", "colors": { "editor.foreground": "#111111" } }"##;
+        std::fs::write(dir.join("theme.json"), json).unwrap();
+
+        // Each file is loaded once, however often and however its path is spelled.
+        let path = dir.join("theme.json").display().to_string();
+        let other = dir.join(".").join("theme.json").display().to_string();
+        let first = parse(&format!("theme = '{path}'")).unwrap().theme.unwrap();
+        for path in [&path, &other, &path, &other, &path] {
+            let theme = parse(&format!("theme = '{path}'")).unwrap().theme.unwrap();
+            assert!(Arc::ptr_eq(&theme, &first));
+        }
+        assert_eq!(first.name, path);
+        assert!(!first.dark);
+
+        // Until it changes.
+        let json = r##"{ "type": "dark", "colors": { "editor.foreground": "#eeeeee" } }"##;
+        std::fs::write(dir.join("theme.json"), json).unwrap();
+        // Later than the first write even where file times are coarse.
+        let file = std::fs::File::options().write(true).open(dir.join("theme.json")).unwrap();
+        let modified = file.metadata().unwrap().modified().unwrap();
+        file.set_modified(modified + std::time::Duration::from_secs(2)).unwrap();
+        let second = parse(&format!("theme = '{other}'")).unwrap().theme.unwrap();
+        assert!(!Arc::ptr_eq(&second, &first));
+        assert!(second.dark);
+        let theme = parse(&format!("theme = '{path}'")).unwrap().theme.unwrap();
+        assert!(Arc::ptr_eq(&theme, &second));
+        _ = std::fs::remove_dir_all(&dir);
+    }
+
+    #[test]
+    fn test_parse() {
+        let config = parse(concat!(
+            "# hl settings\n",
+            "theme = 'light'  # for the beamer\n",
+            "\n",
+            "formatter=\"true\\u0063olor\"\n",
+            "  color = \"never\"\n",
+            "tab_width = 4\n",
+            "sql_dialect = \"PostgreSQL\"\n",
+            "region_start = \"#region {}\"\n",
+            "comment_keywords = [ \"TODO\", 'SAFETY', ]  # and no FIXME\n",
+            "[ languages ]\n",
+            "h = \"c++\"\n",
+            "\".TPL\" = \"html\"\n",
+        ))
+        .unwrap();
+        assert_eq!(config.theme.unwrap().name, "light");
+        assert_eq!(config.format, Some(Format::TrueColor));
+        assert!(config.color == Some(Color::Never));
+        assert_eq!(config.tab_width, Some(4));
+        assert_eq!(config.sql_dialect, Some(SqlDialect::Postgres));
+        assert_eq!(config.region_start.as_deref(), Some("#region {}"));
+        assert!(config.region_end.is_none());
+        assert_eq!(config.comment_keywords.unwrap(), ["TODO", "SAFETY"]);
+        assert_eq!(
+            config.languages,
+            [("h".to_string(), Language::Cpp), ("tpl".to_string(), Language::Html)]
+        );
+
+        let empty = parse("").unwrap();
+        assert!(empty.theme.is_none() && empty.format.is_none() && empty.languages.is_empty());
+        assert_eq!(parse("comment_keywords = []").unwrap().comment_keywords.unwrap(), [""; 0]);
+    }
+
+    #[test]
+    fn test_parse_errors() {
+        assert_eq!(error("colour = \"never\""), "1: colour: unknown key");
+        assert_eq!(
+            error("\n\ntheme = \"solarized\""),
+            "3: theme: unknown theme 'solarized', expected dark, light, dusk, paper or a .json file"
+        );
+        assert_eq!(error("tab_width = \"4\""), "1: tab_width: expected an integer");
+        assert_eq!(error("tab_width = 4.5"), "1: tab_width: unsupported value '4.5'");
+        assert_eq!(error("theme = [\"dark\"]"), "1: theme: expected a string");
+        assert_eq!(
+            error("comment_keywords = \"TODO\""),
+            "1: comment_keywords: expected an array of strings"
+        );
+        assert_eq!(
+            error("comment_keywords = [\"TODO\", 1]"),
+            "1: comment_keywords: unsupported value '[\"TODO\", 1]'"
+        );
+        assert_eq!(
+            error("comment_keywords = [\"TODO\" # FIXME"),
+            "1: comment_keywords: unterminated array"
+        );
+        assert_eq!(
+            error("comment_keywords = [\"\"]"),
+            "1: comment_keywords: keywords can't be empty"
+        );
+        assert_eq!(
+            error("sql_dialect = \"oracle\""),
+            "1: sql_dialect: unknown SQL dialect 'oracle', expected ansi, postgres, mysql, sqlite, mssql"
+        );
+        assert_eq!(error("color = 1"), "1: color: expected a string");
+        assert_eq!(error("theme = \"dark"), "1: theme: unterminated string");
+        assert_eq!(error("theme = \"dark\" light"), "1: unexpected 'light'");
+        assert_eq!(error("theme"), "1: expected '=' after 'theme'");
+        assert_eq!(error("theme = \"dark\"\ntheme = \"light\""), "2: duplicate key 'theme'");
+        assert_eq!(error("[fonts]"), "1: unknown table [fonts]");
+        assert_eq!(error("[languages]\nh = \"klingon\""), "2: h: unknown language 'klingon'");
+        assert_eq!(error("hl.theme = \"dark\""), "1: dotted keys aren't supported");
+    }
+
+    #[test]
+    fn test_key() {
+        assert_eq!(key("tsx"), "tsx");
+        assert_eq!(key("c++"), "\"c++\"");
+        assert_eq!(key("a\"b"), "\"a\\\"b\"");
+    }
+}
@@ -0,0 +1,293 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//! `hl coverage`: which lexer rules and scopes the fixtures never exercise.
+//!
+//! Every file with a detected language is highlighted, and its tokens are counted per
+//! language, see [`Coverage`]. The report lists each language's rules without hits, every
+//! scope with its hits, and the lines of the rare scopes, since those lines are all that
+//! guards them. Languages without any file are listed at the end.
+//!
+//! `--baseline` takes an earlier `--json` report and fails if a language in it has fewer of
+//! its rules hit, or fewer scopes, than it had then. The JSON report is documented in the
+//! README. Keep it backwards compatible and bump [`SCHEMA_VERSION`] if that's impossible.
+
+use std::ffi::OsString;
+use std::fs;
+use std::io::{self, BufWriter, Write};
+use std::path::Path;
+
+use edit::json;
+use edit::syntax::{Coverage, Language, SyntaxHighlighter, transcode};
+use stdext::arena::Arena;
+
+use crate::format::json_escape;
+use crate::list::write_columns;
+use crate::tree::{is_binary, walk};
+use crate::{Args, EXIT_CHECK_FAILED, EXIT_UNREADABLE, detect_language, highlight_options};
+
+/// The `version` field of the JSON report.
+const SCHEMA_VERSION: u32 = 1;
+
+/// A language's numbers in an earlier report.
+struct Baseline {
+    name: String,
+    rules: usize,
+    rules_hit: usize,
+    scopes: usize,
+}
+
+/// Highlights every file below the directories, and the files, and prints the report.
+/// `baseline` is an earlier JSON report that the coverage mustn't drop below.
+/// Returns the exit status: whether a file couldn't be read, or the coverage dropped.
+pub fn run(args: &Args, baseline: Option<&Path>) -> io::Result<u8> {
+    // A broken baseline is reported before spending time on the files.
+    let baseline = baseline.map(read_report).transpose()?;
+
+    let dot = [OsString::from(".")];
+    let paths = if args.paths.is_empty() { &dot[..] } else { &args.paths[..] };
+    let mut coverages: Vec<Coverage> = Language::ALL
+        .iter()
+        .filter(|&&l| l != Language::PlainText)
+        .map(|&l| Coverage::new(l))
+        .collect();
+    let mut all_read = true;
+
+    for path in paths {
+        let path = Path::new(path);
+        let sources = if path.is_dir() {
+            walk(path, args.gitignore, None)?
+                .into_iter()
+                .map(|source| (path.join(&source.rel), source.rel))
+                .collect()
+        } else {
+            vec![(path.to_path_buf(), path.to_string_lossy().into_owned())]
+        };
+        for (file, rel) in sources {
+            let display = file.to_string_lossy().into_owned();
+            match fs::read(&file) {
+                Ok(input) => record(args, &mut coverages, &display, Path::new(&rel), &input),
+                Err(err) => {
+                    eprintln!("hl: {display}: {err}");
+                    all_read = false;
+                }
+            }
+        }
+    }
+    coverages.sort_by_key(|c| c.language.id());
+
+    let mut out = BufWriter::new(io::stdout().lock());
+    if args.json {
+        write_json(&mut out, &coverages)?;
+    } else {
+        write_text(&mut out, &coverages)?;
+    }
+    out.flush()?;
+
+    let dropped = baseline.is_some_and(|baseline| !compare(&coverages, &baseline).is_empty());
+    Ok(if !all_read {
+        EXIT_UNREADABLE
+    } else if dropped {
+        EXIT_CHECK_FAILED
+    } else {
+        0
+    })
+}
+
+/// Highlights one file and counts its tokens, unless it's binary or its language isn't
+/// detected.
+fn record(args: &Args, coverages: &mut [Coverage], display: &str, rel: &Path, input: &[u8]) {
+    let text = transcode(input).text;
+    let language = args.language.unwrap_or_else(|| detect_language(args, rel, &text));
+    if is_binary(&text) || language == Language::PlainText {
+        return;
+    }
+
+    let mut highlighter = SyntaxHighlighter::new(language, args.theme.create());
+    highlighter.set_options(highlight_options(args, rel));
+    highlighter.update(&text, true);
+    if let Some(coverage) = coverages.iter_mut().find(|c| c.language == language) {
+        coverage.record(display, &text, highlighter.tokens());
+    }
+}
+
+/// The `path:line` of each place a rare scope was hit, with the line counted from 1.
+fn locations(coverage: &Coverage, lines: &[(usize, usize)]) -> Vec<String> {
+    lines.iter().map(|&(file, line)| format!("{}:{}", coverage.files[file], line + 1)).collect()
+}
+
+fn write_text(out: &mut impl Write, coverages: &[Coverage]) -> io::Result<()> {
+    let mut first = true;
+    for coverage in coverages.iter().filter(|c| !c.files.is_empty()) {
+        if !first {
+            writeln!(out)?;
+        }
+        first = false;
+
+        let files = coverage.files.len();
+        writeln!(
+            out,
+            "{} ({files} file{}): {} of {} rules hit, {} scopes",
+            coverage.language.id(),
+            if files == 1 { "" } else { "s" },
+            coverage.rules_hit(),
+            coverage.rules.len(),
+            coverage.scopes.len(),
+        )?;
+        for rule in coverage.missed_rules() {
+            writeln!(out, "  never hit: {}", rule.name)?;
+        }
+
+        let rows: Vec<[String; 3]> = coverage
+            .scopes
+            .iter()
+            .map(|scope| {
+                let lines = if scope.hits <= edit::syntax::RARE_HITS {
+                    locations(coverage, &scope.lines).join(", ")
+                } else {
+                    String::new()
+                };
+                [scope.scope.clone(), scope.hits.to_string(), lines]
+            })
+            .collect();
+        if !rows.is_empty() {
+            write_columns(out, ["SCOPE", "HITS", "RARE ON"], &rows)?;
+        }
+    }
+
+    let without: Vec<_> =
+        coverages.iter().filter(|c| c.files.is_empty()).map(|c| c.language.id()).collect();
+    if !without.is_empty() {
+        if !first {
+            writeln!(out)?;
+        }
+        writeln!(out, "No files for: {}", without.join(", "))?;
+    }
+    Ok(())
+}
+
+/// Languages without files are left out, so that a report of one fixture is a baseline
+/// for just that fixture's language.
+fn write_json(out: &mut impl Write, coverages: &[Coverage]) -> io::Result<()> {
+    let strings = |strings: &mut dyn Iterator<Item = &str>| {
+        let quoted: Vec<_> = strings.map(|s| format!("\"{}\"", json_escape(s))).collect();
+        quoted.join(",")
+    };
+
+    write!(out, "{{\"version\":{SCHEMA_VERSION},\"languages\":[")?;
+    for (i, coverage) in coverages.iter().filter(|c| !c.files.is_empty()).enumerate() {
+        write!(
+            out,
+            "{}{{\"name\":\"{}\",\"files\":{},\"rules\":{},\"rules_hit\":{},\"missed_rules\":[{}],\"scopes\":[",
+            if i > 0 { "," } else { "" },
+            json_escape(coverage.language.id()),
+            coverage.files.len(),
+            coverage.rules.len(),
+            coverage.rules_hit(),
+            strings(&mut coverage.missed_rules().map(|rule| rule.name.as_str())),
+        )?;
+        for (j, scope) in coverage.scopes.iter().enumerate() {
+            let comma = if j > 0 { "," } else { "" };
+            write!(
+                out,
+                "{comma}{{\"name\":\"{}\",\"hits\":{}",
+                json_escape(&scope.scope),
+                scope.hits
+            )?;
+            if scope.hits <= edit::syntax::RARE_HITS {
+                let lines = locations(coverage, &scope.lines);
+                write!(out, ",\"lines\":[{}]", strings(&mut lines.iter().map(String::as_str)))?;
+            }
+            write!(out, "}}")?;
+        }
+        write!(out, "]}}")?;
+    }
+    writeln!(out, "]}}")
+}
+
+/// Prints how each language in `baseline` dropped, and returns their names.
+fn compare(coverages: &[Coverage], baseline: &[Baseline]) -> Vec<String> {
+    let mut dropped = Vec::new();
+    for before in baseline {
+        let coverage = coverages.iter().find(|c| c.language.id() == before.name);
+        let (rules, rules_hit, scopes) =
+            coverage.map_or((0, 0, 0), |c| (c.rules.len(), c.rules_hit(), c.scopes.len()));
+        // Compared as fractions, so that a lexer gaining rules doesn't fail until the
+        // fixtures had a chance to catch up.
+        let ratio = |hit: usize, all: usize| if all == 0 { 1.0 } else { hit as f64 / all as f64 };
+        let mut problems = Vec::new();
+        if ratio(rules_hit, rules) < ratio(before.rules_hit, before.rules) {
+            problems.push(format!(
+                "{rules_hit} of {rules} rules hit, down from {} of {}",
+                before.rules_hit, before.rules
+            ));
+        }
+        if scopes < before.scopes {
+            problems.push(format!("{scopes} scopes, down from {}", before.scopes));
+        }
+        if !problems.is_empty() {
+            eprintln!("hl: coverage of {} dropped: {}", before.name, problems.join(", "));
+            dropped.push(before.name.clone());
+        }
+    }
+    dropped
+}
+
+/// Reads the numbers per language from a JSON report.
+fn read_report(path: &Path) -> io::Result<Vec<Baseline>> {
+    let err = |message: String| {
+        io::Error::new(io::ErrorKind::InvalidInput, format!("{}: {message}", path.display()))
+    };
+    let text = fs::read_to_string(path).map_err(|e| err(e.to_string()))?;
+    let arena = Arena::new(16 * 1024 * 1024).map_err(|e| err(e.to_string()))?;
+    let value = json::parse(&arena, &text).map_err(|e| err(e.to_string()))?;
+    let report = value.as_object().ok_or_else(|| err("not a coverage report".to_string()))?;
+    if report.get_number("version") != Some(SCHEMA_VERSION as f64) {
+        return Err(err(format!("expected a version {SCHEMA_VERSION} coverage report")));
+    }
+
+    let mut result = Vec::new();
+    for language in report.get_array("languages").unwrap_or_default() {
+        let parsed = language.as_object().and_then(|l| {
+            let number = |key| l.get_number(key).map(|n| n as usize);
+            Some(Baseline {
+                name: l.get_str("name")?.to_string(),
+                rules: number("rules")?,
+                rules_hit: number("rules_hit")?,
+                scopes: l.get_array("scopes")?.len(),
+            })
+        });
+        result.push(parsed.ok_or_else(|| err("invalid entry in languages".to_string()))?);
+    }
+    Ok(result)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_compare() {
+        let mut go = Coverage::new(Language::Go);
+        let text = b"package a // b\n";
+        let tokens = edit::syntax::LexerRegistry::get_lexer(Language::Go).tokenize(text);
+        go.record("a.go", text, &tokens);
+        let (rules, rules_hit, scopes) = (go.rules.len(), go.rules_hit(), go.scopes.len());
+        let baseline = |name: &str, rules, rules_hit, scopes| Baseline {
+            name: name.to_string(),
+            rules,
+            rules_hit,
+            scopes,
+        };
+        let coverages = [go, Coverage::new(Language::Python)];
+
+        assert!(compare(&coverages, &[baseline("go", rules, rules_hit, scopes)]).is_empty());
+        // More rules at the same fraction, or fewer scopes than now, are fine.
+        assert!(compare(&coverages, &[baseline("go", rules * 2, rules_hit * 2, 1)]).is_empty());
+        assert_eq!(compare(&coverages, &[baseline("go", rules, rules_hit + 1, 0)]), ["go"]);
+        assert_eq!(compare(&coverages, &[baseline("go", rules, 0, scopes + 1)]), ["go"]);
+        // A language without files has nothing hit.
+        assert_eq!(compare(&coverages, &[baseline("python", 1, 1, 0)]), ["python"]);
+        assert!(compare(&coverages, &[baseline("python", 1, 0, 0)]).is_empty());
+    }
+}
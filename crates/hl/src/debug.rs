@@ -0,0 +1,365 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//! `hl debug`: what the lexers made of a file, for working on them.
+//!
+//! `tokens` prints every token with its offsets, and `states` what's still open at the
+//! start of each line. `ndjson` prints the tokens for other tools, see [`crate::ndjson`]. The lexers see the whole document at once and carry no state
+//! from line to line, so the latter is derived from the tokens: the multi-line token a
+//! line starts in, like a block comment, and the brackets around it.
+//!
+//! `--filter` narrows `tokens` down to some kinds or payloads, and `-C` adds the lines
+//! around each token. `--strict` fails with the report of `--check` if it finds
+//! anything, so that scripts can tell.
+
+use std::ffi::OsString;
+use std::io::{self, BufWriter, Read, Write};
+use std::path::Path;
+
+use edit::syntax::{
+    BracketMatcher, Columns, Language, LineIndex, SyntaxHighlighter, Token, TokenKind, transcode,
+};
+
+use crate::check::{self, truncate};
+use crate::format::kind_name;
+use crate::{Args, EXIT_CHECK_FAILED, EXIT_UNREADABLE, detect_language, highlight_options, ndjson};
+
+/// What `hl debug` prints.
+#[derive(Clone, Copy, PartialEq, Eq)]
+pub enum Debug {
+    Tokens,
+    States,
+    Ndjson,
+}
+
+impl Debug {
+    pub const NAMES: &[&str] = &["tokens", "states", "ndjson"];
+
+    pub fn from_name(name: &str) -> Option<Self> {
+        match name {
+            "tokens" => Some(Self::Tokens),
+            "states" => Some(Self::States),
+            "ndjson" => Some(Self::Ndjson),
+            _ => None,
+        }
+    }
+}
+
+/// A `--filter` of `hl debug tokens`, like `kind=string` or `payload=invalid`.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum Filter {
+    /// The kind as printed, like `keyword_control`.
+    Kind(String),
+    /// The payload as printed, like `DocMarkup(Link)`, or just its name, like `docmarkup`.
+    Payload(String),
+}
+
+impl Filter {
+    pub fn parse(s: &str) -> Result<Self, String> {
+        match s.split_once('=') {
+            Some(("kind", kind)) if !kind.is_empty() => Ok(Self::Kind(kind.to_string())),
+            Some(("payload", name)) if !name.is_empty() => Ok(Self::Payload(name.to_string())),
+            _ => Err(format!("invalid filter '{s}', expected kind=KIND or payload=NAME")),
+        }
+    }
+
+    /// Case doesn't matter, since the kinds are printed in snake case and the payloads aren't.
+    fn matches(&self, token: &Token) -> bool {
+        match self {
+            Self::Kind(kind) => kind_name(token.kind).eq_ignore_ascii_case(kind),
+            Self::Payload(name) => token.payload.is_some_and(|payload| {
+                let printed = format!("{payload:?}");
+                let variant = printed.split(|c: char| !c.is_alphanumeric()).next();
+                printed.eq_ignore_ascii_case(name)
+                    || variant.is_some_and(|v| v.eq_ignore_ascii_case(name))
+            }),
+        }
+    }
+}
+
+/// Prints the view of every file to stdout. Returns the exit status: whether a file
+/// couldn't be read, or `--strict` found errors.
+pub fn run(debug: Debug, args: &Args) -> io::Result<u8> {
+    let stdin = [OsString::from("-")];
+    let paths = if args.paths.is_empty() { &stdin[..] } else { &args.paths[..] };
+    let headers = args.headers.unwrap_or(paths.len() > 1);
+    let mut out = BufWriter::new(io::stdout().lock());
+    let mut all_read = true;
+    let mut errors = 0;
+
+    for path in paths {
+        let display = if path == "-" { "(standard input)".into() } else { path.to_string_lossy() };
+        let input = if path == "-" {
+            let mut input = Vec::new();
+            io::stdin().read_to_end(&mut input).map(|_| input)
+        } else {
+            std::fs::read(path)
+        };
+        let input = match input {
+            Ok(input) => input,
+            Err(err) => {
+                eprintln!("hl: {display}: {err}");
+                all_read = false;
+                continue;
+            }
+        };
+
+        let text = transcode(&input).text;
+        let language =
+            args.language.unwrap_or_else(|| detect_language(args, Path::new(path), &text));
+        // The same tokens as the highlighted output.
+        let mut highlighter = SyntaxHighlighter::new(language, args.theme.create());
+        highlighter.set_options(highlight_options(args, Path::new(path)));
+        highlighter.update(&text, true);
+
+        // The header records of NDJSON name the file already.
+        if headers && debug != Debug::Ndjson {
+            writeln!(out, "{display} ({})", language.name())?;
+        }
+        match debug {
+            Debug::Tokens => {
+                let (filters, context) = (&args.token_filters, args.token_context);
+                tokens(&mut out, &text, highlighter.tokens(), filters, context, args.columns)?
+            }
+            Debug::States => states(&mut out, language, &text, highlighter.tokens())?,
+            Debug::Ndjson => {
+                let file = path.to_string_lossy();
+                let tokens = highlighter.tokens();
+                ndjson::encode(&mut out, language, &file, &text, tokens, args.columns)?;
+            }
+        }
+
+        if args.strict {
+            let findings = check::find(language, args, &text);
+            if !findings.is_empty() {
+                // After the view, which is most likely what the report is about.
+                out.flush()?;
+                check::report(&mut io::stderr().lock(), &display, &text, &findings, args.columns)?;
+                errors += findings.len();
+            }
+        }
+    }
+
+    out.flush()?;
+    Ok(if !all_read {
+        EXIT_UNREADABLE
+    } else if errors > 0 {
+        EXIT_CHECK_FAILED
+    } else {
+        0
+    })
+}
+
+/// Prints one token per line: its byte range, `line:column` (1-based, in `columns`),
+/// kind, payload if any, and text. Only the tokens matching all `filters` are printed,
+/// each followed by its lines and as many lines before and after as `context` asks for.
+fn tokens(
+    out: &mut impl Write,
+    text: &[u8],
+    tokens: &[Token],
+    filters: &[Filter],
+    context: Option<(usize, usize)>,
+    columns: Columns,
+) -> io::Result<()> {
+    let index = LineIndex::new(text);
+    for token in tokens.iter().filter(|t| filters.iter().all(|f| f.matches(t))) {
+        let (line, column) = index.position(text, token.span.start, columns);
+        let (line, column) = (line + 1, column + 1);
+        let mut kind = kind_name(token.kind);
+        if let Some(payload) = token.payload {
+            kind = format!("{kind} {payload:?}");
+        }
+        writeln!(
+            out,
+            "{:<12} {:<9} {kind:<24} \"{}\"",
+            format!("{}..{}", token.span.start, token.span.end),
+            format!("{line}:{column}"),
+            excerpt(&text[token.span.clone()]),
+        )?;
+
+        if let Some((before, after)) = context {
+            // The line of the last byte, so that a newline doesn't drag in the next line.
+            let end = token.span.end.saturating_sub(1).max(token.span.start);
+            let last = index.line_of(end);
+            let lines = line - 1..=last;
+            for n in (line - 1).saturating_sub(before)..=(last + after).min(index.count() - 1) {
+                let source = String::from_utf8_lossy(&text[index.range(n)]);
+                // Like grep, `:` marks the token's lines and `-` the others.
+                let marker = if lines.contains(&n) { ':' } else { '-' };
+                writeln!(out, "{:>8}{marker} {}", n + 1, escape_controls(&source))?;
+            }
+        }
+    }
+    Ok(())
+}
+
+/// Escapes the control characters in a line of source but tabs, so that it can't mess
+/// with the terminal.
+fn escape_controls(s: &str) -> String {
+    s.chars()
+        .map(
+            |c| {
+                if c.is_control() && c != '\t' {
+                    c.escape_debug().to_string()
+                } else {
+                    c.to_string()
+                }
+            },
+        )
+        .collect()
+}
+
+/// Prints one line per line of `text`: the token it starts in, if the token began on
+/// an earlier line, and the brackets that are open at its start, outermost first.
+fn states(
+    out: &mut impl Write,
+    language: Language,
+    text: &[u8],
+    tokens: &[Token],
+) -> io::Result<()> {
+    let brackets = BracketMatcher::new(language, text, tokens);
+    // Every opener with where it's closed, or `usize::MAX` if it isn't.
+    let mut openers: Vec<_> = brackets
+        .all_pairs()
+        .iter()
+        .map(|pair| (pair.open.clone(), pair.close.start))
+        .chain(brackets.unclosed().map(|open| (open, usize::MAX)))
+        .collect();
+    openers.sort_by_key(|(open, _)| open.start);
+
+    let mut token = 0;
+    let mut line_start = 0;
+    for line in 1.. {
+        while token < tokens.len() && tokens[token].span.end <= line_start {
+            token += 1;
+        }
+        let inside = tokens
+            .get(token)
+            .filter(|t| t.span.start < line_start && t.kind != TokenKind::Whitespace)
+            .map_or_else(|| "-".to_string(), |t| kind_name(t.kind));
+
+        let open: Vec<_> = openers
+            .iter()
+            .take_while(|(open, _)| open.end <= line_start)
+            .filter(|&&(_, close)| close >= line_start)
+            .map(|(open, _)| String::from_utf8_lossy(&text[open.clone()]))
+            .collect();
+        let open = if open.is_empty() { "-".to_string() } else { open.join(" ") };
+        writeln!(out, "{line:<5} {inside:<16} {open}")?;
+
+        match text[line_start..].iter().position(|&b| b == b'\n') {
+            Some(i) => line_start += i + 1,
+            None => break,
+        }
+    }
+    Ok(())
+}
+
+/// The text of a token, escaped and shortened to fit on one line.
+fn excerpt(text: &[u8]) -> String {
+    truncate(&String::from_utf8_lossy(text).escape_debug().to_string())
+}
+
+#[cfg(test)]
+mod tests {
+    use edit::syntax::TokenPayload;
+
+    use super::*;
+
+    fn view(debug: Debug, language: Language, text: &str) -> String {
+        let mut highlighter = SyntaxHighlighter::new(language, Default::default());
+        highlighter.update(text.as_bytes(), true);
+        let mut out = Vec::new();
+        match debug {
+            Debug::Tokens => {
+                tokens(&mut out, text.as_bytes(), highlighter.tokens(), &[], None, Columns::Chars)
+            }
+            Debug::States => states(&mut out, language, text.as_bytes(), highlighter.tokens()),
+            Debug::Ndjson => unreachable!(),
+        }
+        .unwrap();
+        String::from_utf8(out).unwrap()
+    }
+
+    #[test]
+    fn test_tokens() {
+        let out = view(Debug::Tokens, Language::Go, "x := \"é\\n\"\n\ty");
+        let lines: Vec<_> = out.lines().collect();
+        assert_eq!(
+            lines[0].split_whitespace().collect::<Vec<_>>(),
+            ["0..1", "1:1", "identifier", "\"x\""]
+        );
+        assert!(lines[4].starts_with("5..11        1:6       string"), "{out}");
+        assert!(lines[4].ends_with(" \"\\\"é\\\\n\\\"\""), "{out}");
+        assert!(lines.last().unwrap().starts_with("13..14       2:2 "), "{out}");
+    }
+
+    #[test]
+    fn test_filters() {
+        assert_eq!(Filter::parse("kind=string"), Ok(Filter::Kind("string".to_string())));
+        assert_eq!(Filter::parse("payload=Url"), Ok(Filter::Payload("Url".to_string())));
+        assert!(Filter::parse("string").is_err());
+        assert!(Filter::parse("kind=").is_err());
+        assert!(Filter::parse("scope=string").is_err());
+
+        let token = Token::new(TokenKind::KeywordControl, 0..2);
+        assert!(Filter::Kind("keyword_control".to_string()).matches(&token));
+        assert!(!Filter::Kind("keyword".to_string()).matches(&token));
+        assert!(!Filter::Payload("invalid".to_string()).matches(&token));
+        let token = Token::new(TokenKind::DocComment, 0..2)
+            .with_payload(TokenPayload::DocMarkup(edit::syntax::DocMarkup::Link));
+        assert!(Filter::Payload("docmarkup".to_string()).matches(&token));
+        assert!(Filter::Payload("DocMarkup(Link)".to_string()).matches(&token));
+        assert!(!Filter::Payload("DocMarkup(Code)".to_string()).matches(&token));
+    }
+
+    #[test]
+    fn test_token_context() {
+        let text = "a := 1\n/* b\n\tc */\nd\x1b\ne\n";
+        let mut highlighter = SyntaxHighlighter::new(Language::Go, Default::default());
+        highlighter.update(text.as_bytes(), true);
+        let view = |filters: &[Filter], context| {
+            let mut out = Vec::new();
+            let columns = Columns::Chars;
+            tokens(&mut out, text.as_bytes(), highlighter.tokens(), filters, context, columns)
+                .unwrap();
+            String::from_utf8(out).unwrap()
+        };
+
+        let comments = [Filter::Kind("comment".to_string())];
+        let out = view(&comments, Some((1, 1)));
+        let lines: Vec<_> = out.lines().collect();
+        assert!(lines[0].starts_with("7..17        2:1       comment "), "{out}");
+        assert_eq!(
+            lines[1..],
+            ["       1- a := 1", "       2: /* b", "       3: \tc */", "       4- d\\u{1b}"]
+        );
+
+        // The newline at the end of a line doesn't bring in the next one.
+        let newline = [Filter::Kind("whitespace".to_string())];
+        let out = view(&newline, Some((0, 0)));
+        let lines: Vec<_> = out.lines().collect();
+        let i = lines.iter().position(|l| l.starts_with("6..7 ")).unwrap();
+        assert_eq!(lines[i + 1], "       1: a := 1");
+        assert!(!lines[i + 2].starts_with(' '), "{out}");
+
+        // The empty line after the last newline has a number too.
+        let out = view(&[Filter::Kind("identifier".to_string())], Some((0, 9)));
+        assert!(out.ends_with("       5: e\n       6- \n"), "{out}");
+        assert_eq!(view(&comments, None).lines().count(), 1);
+    }
+
+    #[test]
+    fn test_states() {
+        let text = "func f() {\n\t/* a\n\tb */\n\tg(x,\n\t\ty)\n}\n";
+        let out = view(Debug::States, Language::Go, text);
+        let lines: Vec<_> = out.lines().map(|l| l.split_whitespace().collect::<Vec<_>>()).collect();
+        assert_eq!(lines[0], ["1", "-", "-"]);
+        assert_eq!(lines[1], ["2", "-", "{"]);
+        assert_eq!(lines[2], ["3", "comment", "{"]);
+        assert_eq!(lines[4], ["5", "-", "{", "("]);
+        assert_eq!(lines[5], ["6", "-", "{"]);
+        assert_eq!(lines[6], ["7", "-", "-"]);
+        assert_eq!(lines.len(), 7);
+    }
+}
@@ -0,0 +1,762 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//! `hl diff`: unified diffs with the code in them highlighted.
+//!
+//! The diff is read from stdin, like `git diff | hl diff`, or computed from two files.
+//! Every hunk is highlighted with the language of its file, once with the old lines and
+//! once with the new ones, so that a line in the middle of a block comment still looks like
+//! one. A hunk only has a few lines of context though, so one that starts inside a comment
+//! or string is colored as if it didn't. Lines that were edited rather than replaced get
+//! the words that changed emphasized.
+
+use std::ffi::OsStr;
+use std::io::{self, BufWriter, Read, Write};
+use std::ops::Range;
+use std::path::Path;
+use std::{env, fs};
+
+use edit::helpers::CoordType;
+use edit::syntax::{
+    HighlightOptions, Language, SyntaxHighlighter, Theme, Token, TokenKind, TokenStyle, transcode,
+};
+use edit::unicode::ColumnMap;
+
+use crate::format::Formatter;
+use crate::myers::{self, Edit};
+use crate::tree::is_binary;
+use crate::{Args, detect_language};
+
+/// The lines of context around the changes in the diffs `hl diff` computes, like `diff -u`.
+const CONTEXT: usize = 3;
+/// The width of `--side-by-side` when neither `$COLUMNS` nor the terminal know better.
+const DEFAULT_WIDTH: usize = 120;
+/// Lines with less than this share of their text in common count as replaced, not
+/// edited, and aren't compared word by word. Emphasizing most of a line is just noise.
+const MIN_SIMILARITY: f64 = 0.5;
+
+/// A line of a diff, or a hunk of them.
+enum Item {
+    /// Anything outside of the hunks, like `diff --git`, `index` or a commit message.
+    Meta(Vec<u8>),
+    /// `--- a/path` or `+++ b/path`.
+    File(Vec<u8>),
+    Hunk(Hunk),
+}
+
+struct Hunk {
+    /// The `@@ -1,2 +1,3 @@` line.
+    header: Vec<u8>,
+    /// The numbers of the first old and new line.
+    old_start: usize,
+    new_start: usize,
+    language: Language,
+    lines: Vec<Line>,
+}
+
+#[derive(Clone, Copy, PartialEq, Eq)]
+enum Change {
+    Context,
+    Removed,
+    Added,
+}
+
+struct Line {
+    change: Change,
+    /// The text without the ` `, `-` or `+` in front and the newline.
+    text: Vec<u8>,
+    /// The `\ No newline at end of file` line after this one, if any.
+    no_newline: Option<Vec<u8>>,
+}
+
+/// Prints the diff on stdin, or the one between the two files, to stdout.
+/// Returns whether all of the input could be read.
+pub fn run(args: &Args) -> io::Result<bool> {
+    let language = |path: &Path, text: &[u8]| {
+        args.language.unwrap_or_else(|| detect_language(args, path, text))
+    };
+    let items = if let [old, new] = &args.paths[..] {
+        let (Some(old_input), Some(new_input)) = (read(old), read(new)) else {
+            return Ok(false);
+        };
+        compute(old, &old_input, new, &new_input, language)
+    } else {
+        let Some(input) = read(OsStr::new("-")) else {
+            return Ok(false);
+        };
+        parse(&transcode(&input).text, language)
+    };
+
+    let theme = args.theme.create();
+    let options = HighlightOptions {
+        escapes: true,
+        inactive_code: true,
+        comment_keywords: args.comment_keywords.clone(),
+        ..Default::default()
+    };
+    let out = BufWriter::new(io::stdout().lock());
+    if args.side_by_side {
+        let tab_width = if args.tab_width > 0 { args.tab_width } else { 8 };
+        let mut out = Formatter::new(out, args.format);
+        write_side_by_side(&mut out, &items, &theme, &options, terminal_width(), tab_width)?;
+        out.end_file()?;
+    } else {
+        let mut out =
+            Formatter::new(out, args.format).with_tab_width(args.tab_width).with_tabs(args.tabs);
+        write_unified(&mut out, &items, &theme, &options)?;
+        out.end_file()?;
+    }
+    Ok(true)
+}
+
+/// Reads a file, or stdin for `-`, and reports errors.
+fn read(path: &OsStr) -> Option<Vec<u8>> {
+    let result = if path == "-" {
+        let mut input = Vec::new();
+        io::stdin().read_to_end(&mut input).map(|_| input)
+    } else {
+        fs::read(path)
+    };
+    result
+        .inspect_err(|err| {
+            let display =
+                if path == "-" { "(standard input)".into() } else { path.to_string_lossy() };
+            eprintln!("hl: {display}: {err}");
+        })
+        .ok()
+}
+
+/// Parses a unified diff, like the output of `git diff`, `git log -p` or `diff -u`.
+/// Everything that isn't part of a hunk or a file header is kept as [`Item::Meta`].
+/// `language` detects the language of a file from its path.
+fn parse(input: &[u8], language: impl Fn(&Path, &[u8]) -> Language) -> Vec<Item> {
+    let mut items = Vec::new();
+    let mut old_path = None;
+    let mut hunk_language = Language::PlainText;
+    // The lines the current hunk still has, from its header. Without them, a removed
+    // `-- comment` line would look like the next file's `--- a/path`.
+    let (mut old_left, mut new_left) = (0, 0);
+
+    let input = input.strip_suffix(b"\n").unwrap_or(input);
+    for line in input.split(|&b| b == b'\n').filter(|_| !input.is_empty()) {
+        let change = match line.first() {
+            // Some tools strip the trailing space of empty context lines.
+            Some(b' ') | None if old_left > 0 && new_left > 0 => Some(Change::Context),
+            Some(b'-') if old_left > 0 => Some(Change::Removed),
+            Some(b'+') if new_left > 0 => Some(Change::Added),
+            _ => None,
+        };
+        if let Some(change) = change
+            && let Some(Item::Hunk(hunk)) = items.last_mut()
+        {
+            old_left -= usize::from(change != Change::Added);
+            new_left -= usize::from(change != Change::Removed);
+            let text = line.get(1..).unwrap_or_default().to_vec();
+            hunk.lines.push(Line { change, text, no_newline: None });
+            continue;
+        }
+        if line.starts_with(b"\\")
+            && let Some(Item::Hunk(hunk)) = items.last_mut()
+            && let Some(last) = hunk.lines.last_mut()
+        {
+            last.no_newline = Some(line.to_vec());
+            continue;
+        }
+
+        (old_left, new_left) = (0, 0);
+        if let Some([old_start, old_len, new_start, new_len]) = hunk_header(line) {
+            (old_left, new_left) = (old_len, new_len);
+            let header = line.to_vec();
+            let language = hunk_language;
+            items.push(Item::Hunk(Hunk { header, old_start, new_start, language, lines: vec![] }));
+        } else if let Some(path) = line.strip_prefix(b"--- ") {
+            old_path = file_path(path);
+            items.push(Item::File(line.to_vec()));
+        } else if let Some(path) = line.strip_prefix(b"+++ ") {
+            // New files come from /dev/null, and deleted files go there.
+            let path = file_path(path).or(old_path.take());
+            hunk_language =
+                path.map_or(Language::PlainText, |path| language(Path::new(&path), b""));
+            items.push(Item::File(line.to_vec()));
+        } else {
+            items.push(Item::Meta(line.to_vec()));
+        }
+    }
+    items
+}
+
+/// Parses `@@ -1,2 +3,4 @@` into `[1, 2, 3, 4]`. A missing length is 1.
+fn hunk_header(line: &[u8]) -> Option<[usize; 4]> {
+    let line = String::from_utf8_lossy(line);
+    let (ranges, _) = line.strip_prefix("@@ -")?.split_once(" @@")?;
+    let (old, new) = ranges.split_once(" +")?;
+    let range = |range: &str| match range.split_once(',') {
+        Some((start, len)) => Some((start.parse().ok()?, len.parse().ok()?)),
+        None => Some((range.parse().ok()?, 1)),
+    };
+    let ((old_start, old_len), (new_start, new_len)) = (range(old)?, range(new)?);
+    Some([old_start, old_len, new_start, new_len])
+}
+
+/// The path in a `---` or `+++` line, without the timestamp `diff -u` adds,
+/// or `None` for `/dev/null`.
+fn file_path(path: &[u8]) -> Option<String> {
+    let path = String::from_utf8_lossy(path);
+    let path = path.split('\t').next().unwrap_or_default().trim_matches('"');
+    (path != "/dev/null").then(|| path.to_string())
+}
+
+/// Computes the diff between two files, like `diff -u`.
+fn compute(
+    old_path: &OsStr,
+    old: &[u8],
+    new_path: &OsStr,
+    new: &[u8],
+    language: impl Fn(&Path, &[u8]) -> Language,
+) -> Vec<Item> {
+    let (old, new) = (transcode(old).text, transcode(new).text);
+    let (old_name, new_name) = (old_path.to_string_lossy(), new_path.to_string_lossy());
+    if old == new {
+        return Vec::new();
+    }
+    if is_binary(&old) || is_binary(&new) {
+        return vec![Item::Meta(format!("Binary files {old_name} and {new_name} differ").into())];
+    }
+
+    let language = language(Path::new(new_path), &new);
+    // The newlines are compared too, so that adding one to the last line is a change.
+    let old_lines: Vec<_> = old.split_inclusive(|&b| b == b'\n').collect();
+    let new_lines: Vec<_> = new.split_inclusive(|&b| b == b'\n').collect();
+    let edits = myers::diff(&old_lines, &new_lines);
+
+    // Where each edit starts in the old and the new file.
+    let mut positions = Vec::with_capacity(edits.len());
+    let (mut i, mut j) = (0, 0);
+    for edit in &edits {
+        positions.push((i, j));
+        match edit {
+            Edit::Keep(..) => (i, j) = (i + 1, j + 1),
+            Edit::Remove(_) => i += 1,
+            Edit::Add(_) => j += 1,
+        }
+    }
+
+    let mut items = vec![
+        Item::File(format!("--- {old_name}").into()),
+        Item::File(format!("+++ {new_name}").into()),
+    ];
+    for range in myers::hunks(&edits, CONTEXT) {
+        let (old_start, new_start) = positions[range.start];
+        let mut lines = Vec::new();
+        for edit in &edits[range] {
+            let (change, line) = match *edit {
+                Edit::Keep(_, j) => (Change::Context, new_lines[j]),
+                Edit::Remove(i) => (Change::Removed, old_lines[i]),
+                Edit::Add(j) => (Change::Added, new_lines[j]),
+            };
+            let text = line.strip_suffix(b"\n");
+            let no_newline = text.is_none().then(|| b"\\ No newline at end of file".to_vec());
+            lines.push(Line { change, text: text.unwrap_or(line).to_vec(), no_newline });
+        }
+
+        // Like `diff -u`, an empty side starts at the line before it.
+        let count = |change| lines.iter().filter(|l| l.change != change).count();
+        let range = |start: usize, len: usize| match len {
+            0 => format!("{start},0"),
+            1 => format!("{}", start + 1),
+            _ => format!("{},{len}", start + 1),
+        };
+        let (old_len, new_len) = (count(Change::Added), count(Change::Removed));
+        let header = format!("@@ -{} +{} @@", range(old_start, old_len), range(new_start, new_len));
+        let (old_start, new_start) = (old_start + 1, new_start + 1);
+        items.push(Item::Hunk(Hunk {
+            header: header.into(),
+            old_start,
+            new_start,
+            language,
+            lines,
+        }));
+    }
+    items
+}
+
+/// Returns the styled pieces of each line of `hunk`, as ranges of its text.
+fn highlight(
+    hunk: &Hunk,
+    theme: &Theme,
+    options: &HighlightOptions,
+) -> Vec<Vec<(Range<usize>, TokenStyle)>> {
+    let mut pieces = vec![Vec::new(); hunk.lines.len()];
+    let changed = changed_words(hunk);
+
+    // Both sides need the context to be lexed right, but its colors come from the new one.
+    for side in [Change::Removed, Change::Added] {
+        let mut text = Vec::new();
+        let mut starts = Vec::new();
+        for (i, line) in hunk.lines.iter().enumerate() {
+            if line.change == side || line.change == Change::Context {
+                starts.push((i, text.len()));
+                text.extend_from_slice(&line.text);
+                text.push(b'\n');
+            }
+        }
+        let mut highlighter = SyntaxHighlighter::new(hunk.language, theme.clone());
+        highlighter.set_options(options.clone());
+        highlighter.update(&text, true);
+        let tokens = highlighter.tokens();
+
+        for (i, start) in starts {
+            let line = &hunk.lines[i];
+            if side == Change::Removed && line.change == Change::Context {
+                continue;
+            }
+            let line_pieces = &mut pieces[i];
+            let mut write = |range: Range<usize>, token: &Token| {
+                let style = theme.token_style(token);
+                let range = range.start - start..range.end - start;
+                split(line_pieces, range, style, line.change, &changed[i], theme);
+            };
+
+            // Gaps between tokens are whitespace, like in the other outputs.
+            let end = start + line.text.len();
+            let mut pos = start;
+            let first = tokens.partition_point(|t| t.span.end <= start);
+            for token in tokens[first..].iter().take_while(|t| t.span.start < end) {
+                if pos < token.span.start {
+                    write(pos..token.span.start, &Token::new(TokenKind::Whitespace, 0..0));
+                }
+                let range = token.span.start.max(pos)..token.span.end.min(end);
+                if !range.is_empty() {
+                    write(range.clone(), token);
+                    pos = range.end;
+                }
+            }
+            if pos < end {
+                write(pos..end, &Token::new(TokenKind::Whitespace, 0..0));
+            }
+        }
+    }
+    pieces
+}
+
+/// Adds `range` of a line in `style` to `pieces`, with the diff's background for
+/// its `change` and split where the `changed` words start and end.
+fn split(
+    pieces: &mut Vec<(Range<usize>, TokenStyle)>,
+    range: Range<usize>,
+    style: TokenStyle,
+    change: Change,
+    changed: &[Range<usize>],
+    theme: &Theme,
+) {
+    // Neighbors in the same style are merged, which keeps the escapes down.
+    let mut push = |range: Range<usize>, style: TokenStyle| match pieces.last_mut() {
+        Some((last, last_style)) if last.end == range.start && *last_style == style => {
+            last.end = range.end
+        }
+        _ => pieces.push((range, style)),
+    };
+    if change == Change::Context {
+        push(range, style);
+        return;
+    }
+    let added = change == Change::Added;
+    let mut pos = range.start;
+    let first = changed.partition_point(|c| c.end <= pos);
+    for c in changed[first..].iter().take_while(|c| c.start < range.end) {
+        if c.start > pos {
+            push(pos..c.start, theme.diff_style(style, added, false));
+        }
+        let end = c.end.min(range.end);
+        push(pos.max(c.start)..end, theme.diff_style(style, added, true));
+        pos = end;
+    }
+    if pos < range.end {
+        push(pos..range.end, theme.diff_style(style, added, false));
+    }
+}
+
+/// Returns the changed words of each line of `hunk`. Removed lines that are directly
+/// followed by added ones are compared to them in order, the first with the first.
+fn changed_words(hunk: &Hunk) -> Vec<Vec<Range<usize>>> {
+    let lines = &hunk.lines;
+    let mut changed = vec![Vec::new(); lines.len()];
+    let mut i = 0;
+    while i < lines.len() {
+        let removed = i..i + lines[i..].iter().take_while(|l| l.change == Change::Removed).count();
+        let added = removed.end
+            ..removed.end
+                + lines[removed.end..].iter().take_while(|l| l.change == Change::Added).count();
+        for (r, a) in removed.clone().zip(added.clone()) {
+            if let Some([old, new]) = compare(&lines[r].text, &lines[a].text) {
+                changed[r] = old;
+                changed[a] = new;
+            }
+        }
+        i = added.end.max(i + 1);
+    }
+    changed
+}
+
+/// Compares two lines word by word and returns the changed ranges of each,
+/// or `None` if they have too little in common.
+fn compare(old: &[u8], new: &[u8]) -> Option<[Vec<Range<usize>>; 2]> {
+    let (old_words, new_words) = (words(old), words(new));
+    let edits = myers::diff(
+        &old_words.iter().map(|w| &old[w.clone()]).collect::<Vec<_>>(),
+        &new_words.iter().map(|w| &new[w.clone()]).collect::<Vec<_>>(),
+    );
+
+    let mut kept = 0;
+    let (mut old_changed, mut new_changed) = (Vec::new(), Vec::new());
+    let push = |ranges: &mut Vec<Range<usize>>, word: &Range<usize>| match ranges.last_mut() {
+        Some(last) if last.end == word.start => last.end = word.end,
+        _ => ranges.push(word.clone()),
+    };
+    for edit in edits {
+        match edit {
+            Edit::Keep(i, _) => kept += old_words[i].len(),
+            Edit::Remove(i) => push(&mut old_changed, &old_words[i]),
+            Edit::Add(j) => push(&mut new_changed, &new_words[j]),
+        }
+    }
+
+    let similarity = 2.0 * kept as f64 / (old.len() + new.len()).max(1) as f64;
+    (similarity >= MIN_SIMILARITY).then_some([old_changed, new_changed])
+}
+
+/// Splits a line into words, runs of whitespace and single punctuation characters.
+fn words(line: &[u8]) -> Vec<Range<usize>> {
+    // Non-ASCII bytes count as word characters, which keeps UTF-8 sequences whole.
+    let class = |b: u8| match b {
+        b' ' | b'\t' | b'\r' => 0,
+        b'_' | b'0'..=b'9' | b'a'..=b'z' | b'A'..=b'Z' | 0x80.. => 1,
+        _ => 2,
+    };
+    let mut words: Vec<Range<usize>> = Vec::new();
+    for (i, &b) in line.iter().enumerate() {
+        match words.last_mut() {
+            Some(word) if class(b) != 2 && class(line[word.start]) == class(b) => word.end = i + 1,
+            _ => words.push(i..i + 1),
+        }
+    }
+    words
+}
+
+/// The style of everything that isn't code.
+fn text_style(theme: &Theme) -> TokenStyle {
+    theme.get_style(TokenKind::Whitespace)
+}
+
+/// Writes the lines that aren't part of a hunk's code: [`Item::Meta`], [`Item::File`]
+/// and hunk headers, like git colors them.
+fn write_line<W: Write>(out: &mut Formatter<W>, item: &Item, theme: &Theme) -> io::Result<()> {
+    let (text, style) = match item {
+        Item::Meta(text) if text.starts_with(b"diff ") => (text, text_style(theme).bold()),
+        Item::Meta(text) => (text, text_style(theme)),
+        Item::File(text) => (text, text_style(theme).bold()),
+        Item::Hunk(hunk) => (&hunk.header, theme.get_style(TokenKind::Comment)),
+    };
+    let token = Token::new(TokenKind::Whitespace, 0..text.len());
+    out.token(text, &token, style)?;
+    out.token(b"\n", &token, text_style(theme))
+}
+
+fn write_unified<W: Write>(
+    out: &mut Formatter<W>,
+    items: &[Item],
+    theme: &Theme,
+    options: &HighlightOptions,
+) -> io::Result<()> {
+    let token = Token::new(TokenKind::Whitespace, 0..0);
+    for item in items {
+        write_line(out, item, theme)?;
+        let Item::Hunk(hunk) = item else {
+            continue;
+        };
+
+        for (line, pieces) in hunk.lines.iter().zip(highlight(hunk, theme, options)) {
+            let (prefix, style) = match line.change {
+                Change::Context => (b" ", text_style(theme)),
+                Change::Removed => (b"-", theme.diff_style(text_style(theme), false, false)),
+                Change::Added => (b"+", theme.diff_style(text_style(theme), true, false)),
+            };
+            out.token(prefix, &token, style)?;
+            for (range, style) in pieces {
+                out.token(&line.text[range], &token, style)?;
+            }
+            out.token(b"\n", &token, text_style(theme))?;
+            if let Some(no_newline) = &line.no_newline {
+                out.token(no_newline, &token, theme.get_style(TokenKind::Comment))?;
+                out.token(b"\n", &token, text_style(theme))?;
+            }
+        }
+    }
+    Ok(())
+}
+
+/// Writes the hunks with the old lines on the left and the new ones on the right,
+/// in `width` columns. Lines that don't fit are cut off.
+fn write_side_by_side<W: Write>(
+    out: &mut Formatter<W>,
+    items: &[Item],
+    theme: &Theme,
+    options: &HighlightOptions,
+    width: usize,
+    tab_width: CoordType,
+) -> io::Result<()> {
+    let token = Token::new(TokenKind::Whitespace, 0..0);
+    // Wide enough for the largest line number of all hunks.
+    let last_line = items
+        .iter()
+        .filter_map(|item| match item {
+            Item::Hunk(hunk) => Some(hunk.old_start.max(hunk.new_start) + hunk.lines.len()),
+            _ => None,
+        })
+        .max()
+        .unwrap_or(0);
+    let digits = last_line.to_string().len();
+    // Each half is the line number, a space and the text, with a 3 column gutter between them.
+    let column = (width.saturating_sub(3) / 2).saturating_sub(digits + 1).max(8);
+    let number_style = TokenStyle { italic: false, ..theme.get_style(TokenKind::Comment) };
+
+    for item in items {
+        write_line(out, item, theme)?;
+        let Item::Hunk(hunk) = item else {
+            continue;
+        };
+
+        let pieces = highlight(hunk, theme, options);
+        let (mut old_number, mut new_number) = (hunk.old_start, hunk.new_start);
+        let half = |out: &mut Formatter<W>, i: Option<usize>, number: &mut usize| match i {
+            Some(i) => {
+                let line = &hunk.lines[i];
+                let pad = match line.change {
+                    Change::Context => text_style(theme),
+                    change => theme.diff_style(text_style(theme), change == Change::Added, false),
+                };
+                let text = format!("{number:>digits$} ");
+                out.token(text.as_bytes(), &token, number_style)?;
+                *number += 1;
+                write_fitted(out, &line.text, &pieces[i], column, tab_width, pad)
+            }
+            None => {
+                let blank = " ".repeat(digits + 1 + column);
+                out.token(blank.as_bytes(), &token, text_style(theme))
+            }
+        };
+
+        let lines = &hunk.lines;
+        let mut i = 0;
+        while i < lines.len() {
+            let mut rows = Vec::new();
+            if lines[i].change == Change::Context {
+                rows.push((Some(i), Some(i)));
+                i += 1;
+            } else {
+                let removed = lines[i..].iter().take_while(|l| l.change == Change::Removed);
+                let removed: Vec<_> = (i..).take(removed.count()).collect();
+                i += removed.len();
+                let added = lines[i..].iter().take_while(|l| l.change == Change::Added);
+                let added: Vec<_> = (i..).take(added.count()).collect();
+                i += added.len();
+                for row in 0..removed.len().max(added.len()) {
+                    rows.push((removed.get(row).copied(), added.get(row).copied()));
+                }
+            }
+            for (old, new) in rows {
+                // Like `diff -y`, so that changes show without colors, too.
+                let gutter = match (old, new) {
+                    (Some(i), _) if lines[i].change == Change::Context => " │ ",
+                    (Some(_), Some(_)) => " | ",
+                    (Some(_), None) => " < ",
+                    _ => " > ",
+                };
+                half(out, old, &mut old_number)?;
+                out.token(gutter.as_bytes(), &token, number_style)?;
+                half(out, new, &mut new_number)?;
+                out.token(b"\n", &token, text_style(theme))?;
+            }
+        }
+    }
+    Ok(())
+}
+
+/// Writes the `pieces` of `text` in exactly `width` columns: tabs expanded, cut off
+/// with `…` if they're too long, and otherwise padded with spaces in `pad`.
+fn write_fitted<W: Write>(
+    out: &mut Formatter<W>,
+    text: &[u8],
+    pieces: &[(Range<usize>, TokenStyle)],
+    width: usize,
+    tab_width: CoordType,
+    pad: TokenStyle,
+) -> io::Result<()> {
+    let token = Token::new(TokenKind::Whitespace, 0..0);
+    let map = ColumnMap::new(text, tab_width);
+    let width = width as CoordType;
+    let (end, cut) =
+        if map.width() > width { (map.offset(width - 1), true) } else { (text.len(), false) };
+
+    let mut last = pad;
+    for (range, style) in pieces {
+        let range = range.start..range.end.min(end);
+        if range.is_empty() {
+            continue;
+        }
+        // Tabs become as many spaces as they're wide at their column.
+        let mut expanded = Vec::with_capacity(range.len());
+        for i in range.clone() {
+            match text[i] {
+                b'\t' => {
+                    let spaces = map.column(i + 1) - map.column(i);
+                    expanded.resize(expanded.len() + spaces as usize, b' ');
+                }
+                // The `\r` of CRLF lines would send the cursor back to the left.
+                b'\r' if i + 1 == text.len() => {}
+                b => expanded.push(b),
+            }
+        }
+        out.token(&expanded, &token, *style)?;
+        last = *style;
+    }
+
+    let used = map.column(end);
+    if cut {
+        out.token("…".as_bytes(), &token, last)?;
+    }
+    let left = width - used - CoordType::from(cut);
+    out.token(" ".repeat(left.max(0) as usize).as_bytes(), &token, pad)
+}
+
+/// The width of the terminal for `--side-by-side`: `$COLUMNS`, then the size
+/// of the terminal on stdout, and otherwise [`DEFAULT_WIDTH`].
+fn terminal_width() -> usize {
+    if let Some(columns) = env::var("COLUMNS").ok().and_then(|c| c.parse().ok()) {
+        return columns;
+    }
+    #[cfg(unix)]
+    unsafe {
+        let mut size: libc::winsize = std::mem::zeroed();
+        if libc::ioctl(libc::STDOUT_FILENO, libc::TIOCGWINSZ, &mut size) == 0 && size.ws_col > 0 {
+            return size.ws_col as usize;
+        }
+    }
+    DEFAULT_WIDTH
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn language(path: &Path, _: &[u8]) -> Language {
+        let ext = path.extension().and_then(|ext| ext.to_str()).unwrap_or_default();
+        Language::from_extension(ext)
+    }
+
+    fn lines(items: &[Item]) -> Vec<String> {
+        let mut result = Vec::new();
+        for item in items {
+            match item {
+                Item::Meta(text) => result.push(format!("meta {}", String::from_utf8_lossy(text))),
+                Item::File(text) => result.push(format!("file {}", String::from_utf8_lossy(text))),
+                Item::Hunk(hunk) => {
+                    let header = String::from_utf8_lossy(&hunk.header);
+                    result.push(format!("hunk {header} {:?}", hunk.language));
+                    for line in &hunk.lines {
+                        let prefix = match line.change {
+                            Change::Context => ' ',
+                            Change::Removed => '-',
+                            Change::Added => '+',
+                        };
+                        result.push(format!("{prefix}{}", String::from_utf8_lossy(&line.text)));
+                    }
+                }
+            }
+        }
+        result
+    }
+
+    #[test]
+    fn test_parse() {
+        let diff = "\
+diff --git a/x.go b/x.go
+--- a/x.go
++++ b/x.go
+@@ -1,3 +1,3 @@ func f() {
+ a
+--- removed
++++ added
+
+diff --git a/new.py b/new.py
+--- /dev/null
++++ b/new.py
+@@ -0,0 +1 @@
++x = 1
+\\ No newline at end of file
+";
+        let items = parse(diff.as_bytes(), language);
+        assert_eq!(
+            lines(&items),
+            [
+                "meta diff --git a/x.go b/x.go",
+                "file --- a/x.go",
+                "file +++ b/x.go",
+                "hunk @@ -1,3 +1,3 @@ func f() { Go",
+                " a",
+                "--- removed",
+                "+++ added",
+                " ",
+                "meta diff --git a/new.py b/new.py",
+                "file --- /dev/null",
+                "file +++ b/new.py",
+                "hunk @@ -0,0 +1 @@ Python",
+                "+x = 1",
+            ]
+        );
+        let Item::Hunk(hunk) = &items[7] else { panic!() };
+        assert!(hunk.lines[0].no_newline.is_some());
+    }
+
+    #[test]
+    fn test_compute() {
+        let old = "a\nb\nc\nd\ne\nf\ng\nh\ni";
+        let new = "a\nb\nc\nD\ne\nf\ng\nh\ni\n";
+        let (old_path, new_path) = (OsStr::new("old.go"), OsStr::new("new.go"));
+        let items = compute(old_path, old.as_bytes(), new_path, new.as_bytes(), language);
+        assert_eq!(
+            lines(&items),
+            [
+                "file --- old.go",
+                "file +++ new.go",
+                "hunk @@ -1,9 +1,9 @@ Go",
+                " a",
+                " b",
+                " c",
+                "-d",
+                "+D",
+                " e",
+                " f",
+                " g",
+                " h",
+                "-i",
+                "+i",
+            ]
+        );
+        // Only the old file lacks the last newline.
+        let Item::Hunk(hunk) = &items[2] else { panic!() };
+        let no_newline: Vec<_> = hunk.lines.iter().map(|l| l.no_newline.is_some()).collect();
+        assert_eq!(no_newline.iter().filter(|&&n| n).count(), 1);
+        assert!(no_newline[9]);
+        assert!(compute(old_path, b"x", new_path, b"x", language).is_empty());
+    }
+
+    #[test]
+    fn test_compare() {
+        let [old, new] = compare(b"let x = foo(1);", b"let x = bar(1);").unwrap();
+        assert_eq!((old.len(), new.len()), (1, 1));
+        assert_eq!((old[0].clone(), new[0].clone()), (8..11, 8..11));
+        assert!(compare(b"return a + b;", b"panic!(\"nope\")").is_none());
+        assert_eq!(words(b"a_b  c.d"), [0..3, 3..5, 5..6, 6..7, 7..8]);
+    }
+}
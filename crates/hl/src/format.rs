@@ -0,0 +1,918 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//! Output formats for highlighted files.
+//!
+//! A [`Formatter`] writes each token as soon as it gets it, so that the output
+//! streams instead of being collected per file.
+
+use std::fmt::Write as _;
+use std::io::{self, Write};
+
+use edit::helpers::CoordType;
+use edit::oklab::StraightRgba;
+use edit::syntax::{
+    DocMarkup, Language, Theme, Token, TokenKind, TokenPayload, TokenStyle, WhitespacePosition,
+};
+use edit::unicode::display_width;
+
+/// The output format, as picked with `--formatter`.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Format {
+    /// SGR escapes with the 16 standard terminal colors.
+    Ansi,
+    /// SGR escapes with the xterm 256-color palette.
+    Ansi256,
+    /// SGR escapes with 24-bit colors.
+    TrueColor,
+    /// The text as is, which is what the terminal formats turn into
+    /// when the output isn't colored.
+    Plain,
+    /// `<pre>` elements with inline styles, or classes, see [`Formatter::with_classes`].
+    Html,
+    /// An RTF document per file, for `--copy rtf`. It's not in [`Format::NAMES`],
+    /// since it makes no sense to look at.
+    Rtf,
+    /// One JSON object per token and line, for tooling.
+    Json,
+}
+
+impl Format {
+    pub const NAMES: &[&str] = &["ansi", "ansi256", "truecolor", "plain", "html", "json"];
+
+    pub fn from_name(name: &str) -> Option<Self> {
+        match name {
+            "ansi" => Some(Self::Ansi),
+            "ansi256" => Some(Self::Ansi256),
+            "truecolor" | "24bit" => Some(Self::TrueColor),
+            "plain" => Some(Self::Plain),
+            "html" => Some(Self::Html),
+            "json" => Some(Self::Json),
+            _ => None,
+        }
+    }
+
+    pub fn name(self) -> &'static str {
+        match self {
+            Self::Ansi => "ansi",
+            Self::Ansi256 => "ansi256",
+            Self::TrueColor => "truecolor",
+            Self::Plain => "plain",
+            Self::Html => "html",
+            Self::Rtf => "rtf",
+            Self::Json => "json",
+        }
+    }
+
+    /// Whether this is one of the formats with terminal colors.
+    pub fn is_ansi(self) -> bool {
+        matches!(self, Self::Ansi | Self::Ansi256 | Self::TrueColor)
+    }
+}
+
+/// What `--tab-width` does to the tabs in HTML, as picked with `--tabs`.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Tabs {
+    /// Replace them with spaces, like in the other formats.
+    Expand,
+    /// Keep them and set the `tab-size` of the `<pre>`, so that copied code keeps them.
+    Css,
+}
+
+/// Writes highlighted files in a [`Format`].
+pub struct Formatter<W: Write> {
+    out: W,
+    format: Format,
+    /// The path of the current file, for [`Format::Json`].
+    path: String,
+    /// Whether the last byte written was a newline, or nothing was written yet.
+    at_line_start: bool,
+    /// Expand tabs to this many columns, unless it's 0.
+    tab_width: CoordType,
+    /// Whether HTML keeps the tabs, see [`Formatter::with_tabs`].
+    tabs: Tabs,
+    /// The column in the current line, when expanding tabs.
+    column: CoordType,
+    /// The number of the next line, if lines are numbered, see [`Formatter::number_lines`].
+    line_number: Option<usize>,
+    /// How many digits the line numbers are padded to.
+    line_number_width: usize,
+    /// Whether the current line got its number.
+    numbered: bool,
+    /// The background and text color of the whole file, see [`Formatter::with_page_colors`].
+    page: Option<[StraightRgba; 2]>,
+    /// Whether HTML gets classes instead of inline styles, see [`Formatter::with_classes`].
+    classes: bool,
+    /// The SGR parameters in effect in the terminal, and whether they show on whitespace.
+    /// Tokens in the same style share them instead of each setting and resetting them.
+    open_sgr: Option<(String, bool)>,
+    /// The RTF of the current file, which is written once its color table is complete.
+    rtf: Vec<u8>,
+    /// The color table of the current RTF file.
+    rtf_colors: Vec<StraightRgba>,
+}
+
+impl<W: Write> Formatter<W> {
+    pub fn new(out: W, format: Format) -> Self {
+        Self {
+            out,
+            format,
+            path: String::new(),
+            at_line_start: true,
+            tab_width: 0,
+            tabs: Tabs::Expand,
+            column: 0,
+            line_number: None,
+            line_number_width: 0,
+            numbered: false,
+            page: None,
+            classes: false,
+            open_sgr: None,
+            rtf: Vec::new(),
+            rtf_colors: Vec::new(),
+        }
+    }
+
+    /// Expand tabs to spaces up to the next multiple of `tab_width` columns.
+    /// JSON keeps the tabs, because its text has to match the offsets.
+    pub fn with_tab_width(mut self, tab_width: CoordType) -> Self {
+        self.tab_width = if self.format == Format::Json { 0 } else { tab_width };
+        self
+    }
+
+    /// With [`Tabs::Css`], HTML keeps the tabs and sizes them with CSS instead.
+    pub fn with_tabs(mut self, tabs: Tabs) -> Self {
+        self.tabs = tabs;
+        self
+    }
+
+    /// Give HTML and RTF the background and text color of a page in a dark or light theme,
+    /// so that they can be pasted into documents, see `--copy`.
+    pub fn with_page_colors(mut self, dark: bool) -> Self {
+        self.page = Some(page_colors(dark));
+        self
+    }
+
+    /// Give HTML tokens `tok-*` classes instead of inline styles, like `tok-keyword`,
+    /// for the rules of [`stylesheet`].
+    pub fn with_classes(mut self, classes: bool) -> Self {
+        self.classes = classes;
+        self
+    }
+
+    /// Start a file, preceded by a line with its `path` if `header` is set.
+    pub fn begin_file(&mut self, path: &str, language: Language, header: bool) -> io::Result<()> {
+        self.path = path.to_string();
+        self.line_number = None;
+        self.close_sgr()?;
+
+        // Like `cat`, files are concatenated as is, but a header always gets a line of its own.
+        if header && !self.at_line_start {
+            self.write(b"\n")?;
+        }
+        match self.format {
+            // grep prints file names in magenta.
+            _ if self.format.is_ansi() && header => {
+                writeln!(self.out, "\x1b[35m{path}\x1b[0m")?;
+                self.at_line_start = true;
+            }
+            Format::Plain if header => writeln!(self.out, "{path}")?,
+            Format::Html => {
+                if header {
+                    writeln!(self.out, "<div class=\"hl-file\">{}</div>", html_escape(path))?;
+                }
+                write!(self.out, "<pre class=\"hl\" data-language=\"{}\"", language.name())?;
+                let mut style = Vec::new();
+                if let Some([bg, fg]) = self.page {
+                    let (bg, fg) = (css_color(bg), css_color(fg));
+                    style.push(format!("background-color:{bg};color:{fg}"));
+                }
+                if self.tabs == Tabs::Css && self.tab_width > 0 {
+                    style.push(format!("tab-size:{}", self.tab_width));
+                }
+                if !style.is_empty() {
+                    write!(self.out, " style=\"{}\"", style.join(";"))?;
+                }
+                self.out.write_all(b">")?;
+            }
+            Format::Rtf if header => self.write(format!("{path}\n").as_bytes())?,
+            _ => {}
+        }
+        if header {
+            self.column = 0;
+        }
+        Ok(())
+    }
+
+    /// Number the lines of the current file from `first` on. `last` is the largest number,
+    /// which the others are padded to. JSON has no room for them, since its tokens have offsets.
+    pub fn number_lines(&mut self, first: usize, last: usize) {
+        if self.format != Format::Json {
+            self.line_number = Some(first);
+            self.line_number_width = last.to_string().len();
+            self.numbered = !self.at_line_start;
+        }
+    }
+
+    /// Continue numbering at `number` with the next line, e.g. after lines that were left out.
+    pub fn set_line_number(&mut self, number: usize) {
+        if let Some(line_number) = &mut self.line_number {
+            *line_number = number;
+        }
+    }
+
+    /// Write the text of a token in its style.
+    pub fn token(&mut self, text: &[u8], token: &Token, style: TokenStyle) -> io::Result<()> {
+        if text.is_empty() {
+            return Ok(());
+        }
+        if self.line_number.is_some() {
+            for line in text.split_inclusive(|&b| b == b'\n') {
+                if !self.numbered {
+                    self.write_line_number()?;
+                }
+                self.numbered = !line.ends_with(b"\n");
+                self.styled_token(line, token, style)?;
+            }
+            return Ok(());
+        }
+        self.styled_token(text, token, style)
+    }
+
+    fn styled_token(&mut self, text: &[u8], token: &Token, style: TokenStyle) -> io::Result<()> {
+        let expanded;
+        let keep_tabs = self.format == Format::Html && self.tabs == Tabs::Css;
+        let text = if self.tab_width > 0 && !keep_tabs {
+            expanded = self.expand_tabs(text);
+            &expanded[..]
+        } else {
+            text
+        };
+        match self.format {
+            Format::Ansi | Format::Ansi256 | Format::TrueColor => self.ansi_token(text, style),
+            Format::Plain => self.write(text),
+            Format::Html => self.html_token(text, token, style),
+            Format::Rtf => self.rtf_token(text, style),
+            Format::Json => self.json_token(text, token),
+        }
+    }
+
+    /// End the current file.
+    pub fn end_file(&mut self) -> io::Result<()> {
+        self.close_sgr()?;
+        match self.format {
+            Format::Html => self.out.write_all(b"</pre>\n")?,
+            Format::Rtf => self.write_rtf()?,
+            _ => return self.out.flush(),
+        }
+        self.at_line_start = true;
+        self.out.flush()
+    }
+
+    /// Returns the writer, e.g. to finish a page after the last file.
+    pub fn into_inner(self) -> W {
+        self.out
+    }
+
+    /// Clear the terminal, including its scrollback, and move to the top left.
+    pub fn clear_screen(&mut self) -> io::Result<()> {
+        self.close_sgr()?;
+        self.write(b"\x1b[H\x1b[2J\x1b[3J")?;
+        self.at_line_start = true;
+        self.column = 0;
+        Ok(())
+    }
+
+    /// Separate the next file from the previous one, like grep's `--` between matches.
+    pub fn separator(&mut self) -> io::Result<()> {
+        self.close_sgr()?;
+        if !self.at_line_start {
+            self.write(b"\n")?;
+        }
+        match self.format {
+            _ if self.format.is_ansi() => self.write(b"\x1b[36m--\x1b[0m\n")?,
+            Format::Plain | Format::Rtf => self.write(b"--\n")?,
+            Format::Html => self.write(b"<hr>\n")?,
+            // JSON lines need no separator, every token names its file.
+            _ => {}
+        }
+        self.column = 0;
+        self.numbered = false;
+        Ok(())
+    }
+
+    /// Replaces the tabs in `text` with spaces. The column carries over from
+    /// the previous token, so this has to see all of the text.
+    fn expand_tabs(&mut self, text: &[u8]) -> Vec<u8> {
+        let mut result = Vec::with_capacity(text.len());
+        let mut start = 0;
+        for (i, &b) in text.iter().enumerate() {
+            match b {
+                b'\n' => {
+                    result.extend_from_slice(&text[start..=i]);
+                    self.column = 0;
+                }
+                b'\t' => {
+                    result.extend_from_slice(&text[start..i]);
+                    self.column += display_width(&text[start..i], self.tab_width);
+                    let spaces = self.tab_width - self.column % self.tab_width;
+                    result.resize(result.len() + spaces as usize, b' ');
+                    self.column += spaces;
+                }
+                _ => continue,
+            }
+            start = i + 1;
+        }
+        result.extend_from_slice(&text[start..]);
+        self.column += display_width(&text[start..], self.tab_width);
+        result
+    }
+
+    /// Writes the number of the line that starts here, dimmed, and moves on to the next one.
+    fn write_line_number(&mut self) -> io::Result<()> {
+        let Some(number) = self.line_number else {
+            return Ok(());
+        };
+        let text = format!("{number:>width$} ", width = self.line_number_width);
+        self.close_sgr()?;
+        match self.format {
+            _ if self.format.is_ansi() => write!(self.out, "\x1b[90m{text}\x1b[0m")?,
+            // Not selectable, so that copying the code leaves the numbers behind.
+            Format::Html if self.page.is_some() => write!(
+                self.out,
+                "<span class=\"hl-ln\" style=\"opacity:0.5;user-select:none\">{text}</span>"
+            )?,
+            // Outside of pasted documents, the numbers are links to `#L42`.
+            Format::Html => {
+                let style = if self.classes {
+                    ""
+                } else {
+                    " style=\"opacity:0.5;user-select:none;color:inherit;text-decoration:none\""
+                };
+                write!(
+                    self.out,
+                    "<a class=\"hl-ln\" id=\"L{number}\" href=\"#L{number}\"{style}>{text}</a>"
+                )?;
+            }
+            // The gray of `\x1b[90m`.
+            Format::Rtf => {
+                let gray = TokenStyle::new(StraightRgba::from_be(0x808080ff));
+                self.rtf_token(text.as_bytes(), gray)?;
+            }
+            _ => self.out.write_all(text.as_bytes())?,
+        }
+        self.at_line_start = false;
+        self.line_number = Some(number + 1);
+        self.numbered = true;
+        Ok(())
+    }
+
+    fn write(&mut self, bytes: &[u8]) -> io::Result<()> {
+        if let Some(&last) = bytes.last() {
+            self.at_line_start = last == b'\n';
+        }
+        if self.format == Format::Rtf {
+            let text = rtf_escape(&String::from_utf8_lossy(bytes));
+            self.rtf.extend_from_slice(text.as_bytes());
+            return Ok(());
+        }
+        self.out.write_all(bytes)
+    }
+
+    fn ansi_token(&mut self, text: &[u8], style: TokenStyle) -> io::Result<()> {
+        let sgr = self.sgr(style);
+        // Backgrounds and underlines show on whitespace, colors, bold and italic don't.
+        let shows = style.bg.is_some() || style.underline;
+        let blank = text.iter().all(|&b| matches!(b, b' ' | b'\t' | b'\n' | b'\r'));
+
+        // Reset before every newline, so that pagers like `less -R` and the
+        // lines after a file don't inherit the style.
+        for (i, line) in text.split(|&b| b == b'\n').enumerate() {
+            if i > 0 {
+                self.close_sgr()?;
+                self.write(b"\n")?;
+            }
+            if line.is_empty() {
+                continue;
+            }
+            // Whitespace looks the same in the style before it, unless that shows on it,
+            // which saves switching the style back and forth around every space.
+            if blank && !shows {
+                if self.open_sgr.as_ref().is_some_and(|&(_, shows)| shows) {
+                    self.close_sgr()?;
+                }
+                self.write(line)?;
+                continue;
+            }
+            if self.open_sgr.as_ref().is_none_or(|(open, _)| *open != sgr) {
+                let reset = if self.open_sgr.is_some() { "0;" } else { "" };
+                write!(self.out, "\x1b[{reset}{sgr}m")?;
+                self.open_sgr = Some((sgr.clone(), shows));
+            }
+            self.write_visible(line)?;
+        }
+        Ok(())
+    }
+
+    /// Resets the style of the terminal, if it isn't already.
+    fn close_sgr(&mut self) -> io::Result<()> {
+        if self.open_sgr.take().is_some() {
+            self.out.write_all(b"\x1b[0m")?;
+        }
+        Ok(())
+    }
+
+    fn write_visible(&mut self, text: &[u8]) -> io::Result<()> {
+        let mut start = 0;
+        for (i, &b) in text.iter().enumerate() {
+            let picture = match b {
+                b'\t' | b'\r' => continue,
+                0x00..0x20 => 0x2400 + b as u32,
+                0x7F => 0x2421,
+                _ => continue,
+            };
+            self.write(&text[start..i])?;
+            let picture = char::from_u32(picture).unwrap_or(char::REPLACEMENT_CHARACTER);
+            write!(self.out, "{picture}")?;
+            start = i + 1;
+        }
+        self.write(&text[start..])
+    }
+
+    fn sgr(&self, style: TokenStyle) -> String {
+        let mut sgr = self.color(style.fg, false);
+        if let Some(bg) = style.bg {
+            sgr.push(';');
+            sgr.push_str(&self.color(bg, true));
+        }
+        if style.bold {
+            sgr.push_str(";1");
+        }
+        if style.italic {
+            sgr.push_str(";3");
+        }
+        if style.underline {
+            sgr.push_str(";4");
+        }
+        sgr
+    }
+
+    fn color(&self, color: StraightRgba, bg: bool) -> String {
+        let (r, g, b) = (color.red(), color.green(), color.blue());
+        let base = if bg { 48 } else { 38 };
+        match self.format {
+            Format::Ansi => {
+                let i = nearest(&ANSI_COLORS, (r, g, b));
+                let code = if i < 8 { 30 + i } else { 90 + i - 8 };
+                (code + if bg { 10 } else { 0 }).to_string()
+            }
+            Format::Ansi256 => format!("{base};5;{}", xterm_256(r, g, b)),
+            _ => format!("{base};2;{r};{g};{b}"),
+        }
+    }
+
+    fn html_token(&mut self, text: &[u8], token: &Token, style: TokenStyle) -> io::Result<()> {
+        let text = html_escape(&String::from_utf8_lossy(text));
+        if self.classes {
+            return write!(self.out, "<span class=\"{}\">{text}</span>", html_classes(token));
+        }
+        write!(self.out, "<span style=\"color:{}", css_color(style.fg))?;
+        if let Some(bg) = style.bg {
+            write!(self.out, ";background-color:{}", css_color(bg))?;
+        }
+        if style.bold {
+            self.out.write_all(b";font-weight:bold")?;
+        }
+        if style.italic {
+            self.out.write_all(b";font-style:italic")?;
+        }
+        if style.underline {
+            self.out.write_all(b";text-decoration:underline")?;
+        }
+        write!(self.out, "\">{text}</span>")
+    }
+
+    fn rtf_token(&mut self, text: &[u8], style: TokenStyle) -> io::Result<()> {
+        let fg = self.rtf_color(style.fg);
+        write!(self.rtf, "{{\\cf{fg}")?;
+        if let Some(bg) = style.bg.or(self.page.map(|[bg, _]| bg)) {
+            // Word only reads `\chcbpat`, most other readers only `\cb`.
+            let bg = self.rtf_color(bg);
+            write!(self.rtf, "\\chshdng0\\chcbpat{bg}\\cb{bg}")?;
+        }
+        if style.bold {
+            self.rtf.extend_from_slice(b"\\b");
+        }
+        if style.italic {
+            self.rtf.extend_from_slice(b"\\i");
+        }
+        if style.underline {
+            self.rtf.extend_from_slice(b"\\ul");
+        }
+        self.rtf.push(b' ');
+        self.write(text)?;
+        self.rtf.push(b'}');
+        Ok(())
+    }
+
+    /// Returns the index of `color` in the color table, adding it if it's new.
+    /// Index 0 is the reader's default color.
+    fn rtf_color(&mut self, color: StraightRgba) -> usize {
+        let index = self.rtf_colors.iter().position(|&c| c == color).unwrap_or_else(|| {
+            self.rtf_colors.push(color);
+            self.rtf_colors.len() - 1
+        });
+        index + 1
+    }
+
+    /// Writes the RTF document of the current file, now that its colors are known.
+    fn write_rtf(&mut self) -> io::Result<()> {
+        self.out
+            .write_all(b"{\\rtf1\\ansi\\deff0{\\fonttbl{\\f0\\fmodern Consolas;}}\n{\\colortbl;")?;
+        for color in &self.rtf_colors {
+            write!(
+                self.out,
+                "\\red{}\\green{}\\blue{};",
+                color.red(),
+                color.green(),
+                color.blue()
+            )?;
+        }
+        self.out.write_all(b"}\n\\f0\\fs20 ")?;
+        self.out.write_all(&self.rtf)?;
+        self.out.write_all(b"}\n")?;
+        self.rtf.clear();
+        self.rtf_colors.clear();
+        Ok(())
+    }
+
+    fn json_token(&mut self, text: &[u8], token: &Token) -> io::Result<()> {
+        let kind = json_escape(&kind_name(token.kind));
+        let text = json_escape(&String::from_utf8_lossy(text));
+        let path = json_escape(&self.path);
+        writeln!(
+            self.out,
+            "{{\"file\":\"{path}\",\"kind\":\"{kind}\",\"start\":{},\"end\":{},\"text\":\"{text}\"}}",
+            token.span.start, token.span.end
+        )?;
+        self.at_line_start = true;
+        Ok(())
+    }
+}
+
+/// The default xterm colors for the 16 standard colors.
+const ANSI_COLORS: [(u32, u32, u32); 16] = [
+    (0x00, 0x00, 0x00),
+    (0xcd, 0x00, 0x00),
+    (0x00, 0xcd, 0x00),
+    (0xcd, 0xcd, 0x00),
+    (0x00, 0x00, 0xee),
+    (0xcd, 0x00, 0xcd),
+    (0x00, 0xcd, 0xcd),
+    (0xe5, 0xe5, 0xe5),
+    (0x7f, 0x7f, 0x7f),
+    (0xff, 0x00, 0x00),
+    (0x00, 0xff, 0x00),
+    (0xff, 0xff, 0x00),
+    (0x5c, 0x5c, 0xff),
+    (0xff, 0x00, 0xff),
+    (0x00, 0xff, 0xff),
+    (0xff, 0xff, 0xff),
+];
+
+/// The levels of the 6x6x6 color cube in the xterm 256-color palette.
+const CUBE_LEVELS: [u32; 6] = [0x00, 0x5f, 0x87, 0xaf, 0xd7, 0xff];
+
+fn distance((r1, g1, b1): (u32, u32, u32), (r2, g2, b2): (u32, u32, u32)) -> u32 {
+    r1.abs_diff(r2).pow(2) + g1.abs_diff(g2).pow(2) + b1.abs_diff(b2).pow(2)
+}
+
+fn nearest(palette: &[(u32, u32, u32)], color: (u32, u32, u32)) -> u32 {
+    (0..palette.len()).min_by_key(|&i| distance(palette[i], color)).unwrap_or(0) as u32
+}
+
+/// Returns the closest color of the 6x6x6 cube or the gray ramp of the xterm palette.
+fn xterm_256(r: u32, g: u32, b: u32) -> u32 {
+    let level = |c: u32| nearest(&CUBE_LEVELS.map(|l| (l, l, l)), (c, c, c));
+    let (ri, gi, bi) = (level(r), level(g), level(b));
+    let cube = (CUBE_LEVELS[ri as usize], CUBE_LEVELS[gi as usize], CUBE_LEVELS[bi as usize]);
+
+    // The gray ramp is 232..=255 with the values 8, 18, ..., 238.
+    let avg = (r + g + b) / 3;
+    let gray = (avg.saturating_sub(3) / 10).min(23);
+    let gray_value = 8 + 10 * gray;
+
+    if distance((gray_value, gray_value, gray_value), (r, g, b)) < distance(cube, (r, g, b)) {
+        232 + gray
+    } else {
+        16 + 36 * ri + 6 * gi + bi
+    }
+}
+
+/// The background and text color of HTML pages, and of `--copy`, in a dark or light theme.
+pub fn page_colors(dark: bool) -> [StraightRgba; 2] {
+    let colors = if dark { [0x1e1e1eff, 0xd4d4d4ff] } else { [0xffffffff, 0x000000ff] };
+    colors.map(StraightRgba::from_be)
+}
+
+/// Formats a color for CSS, like `#1e1e1e`.
+pub fn css_color(color: StraightRgba) -> String {
+    format!("#{:02x}{:02x}{:02x}", color.red(), color.green(), color.blue())
+}
+
+/// The classes of a token with [`Formatter::with_classes`]: `tok-` and the kind, like
+/// `tok-keyword_control`, and another one for a payload that changes the style.
+fn html_classes(token: &Token) -> String {
+    let mut classes = format!("tok-{}", kind_name(token.kind));
+    let payload = match token.payload {
+        Some(TokenPayload::BracketDepth(depth)) => format!("bracket-{depth}"),
+        Some(TokenPayload::UnbalancedBracket) => "unbalanced".to_string(),
+        Some(
+            TokenPayload::Invalid
+            | TokenPayload::BidiControl { .. }
+            | TokenPayload::ControlCharacter,
+        ) => "invalid".to_string(),
+        Some(TokenPayload::Deprecated | TokenPayload::DocMarkup(DocMarkup::Deprecated)) => {
+            "deprecated".to_string()
+        }
+        Some(
+            TokenPayload::DocMarkup(DocMarkup::Link) | TokenPayload::Url | TokenPayload::FilePath,
+        ) => "link".to_string(),
+        Some(TokenPayload::DocMarkup(DocMarkup::Heading)) => "heading".to_string(),
+        Some(TokenPayload::DocMarkup(DocMarkup::Code)) => "code".to_string(),
+        Some(TokenPayload::CommentKeyword) => "comment-keyword".to_string(),
+        Some(TokenPayload::Whitespace { position: WhitespacePosition::Trailing, .. }) => {
+            "trailing".to_string()
+        }
+        _ => return classes,
+    };
+    _ = write!(classes, " tok-{payload}");
+    classes
+}
+
+/// The rules for the classes of [`Formatter::with_classes`] in `theme`, which make the same
+/// output as inline styles. `dark` picks the page colors of `.hl`, like for inline styles.
+pub fn stylesheet(theme: &Theme, dark: bool) -> String {
+    let [background, foreground] = page_colors(dark).map(css_color);
+    let mut css = format!(".hl {{ background-color: {background}; color: {foreground}; }}\n");
+    css.push_str(
+        ".hl-ln { opacity: 0.5; user-select: none; color: inherit; text-decoration: none; }\n",
+    );
+    for &kind in TokenKind::ALL {
+        _ = writeln!(
+            css,
+            ".tok-{} {{ {} }}",
+            kind_name(kind),
+            css_declarations(theme.get_style(kind))
+        );
+    }
+
+    // The payloads come after the kinds, so that they win. Like in `Theme::token_style`,
+    // most replace the style of the kind, but a few only change one property of it.
+    let style = |kind, payload| theme.token_style(&Token::new(kind, 0..0).with_payload(payload));
+    let mut rule = |class: &str, style: TokenStyle| {
+        _ = writeln!(css, ".tok-{class} {{ {} }}", css_declarations(style));
+    };
+    for depth in 0..theme.bracket_cycle() {
+        rule(&format!("bracket-{depth}"), theme.bracket_style(depth));
+    }
+    rule("unbalanced", style(TokenKind::Punctuation, TokenPayload::UnbalancedBracket));
+    rule("invalid", style(TokenKind::Error, TokenPayload::Invalid));
+    rule("deprecated", style(TokenKind::Identifier, TokenPayload::Deprecated));
+    rule("comment-keyword", style(TokenKind::Comment, TokenPayload::CommentKeyword));
+    let trailing = TokenPayload::Whitespace { position: WhitespacePosition::Trailing, tabs: false };
+    let trailing = style(TokenKind::Whitespace, trailing);
+    if trailing != theme.get_style(TokenKind::Whitespace) {
+        rule("trailing", trailing);
+    }
+    css.push_str(".tok-link { text-decoration: underline; }\n");
+    css.push_str(".tok-heading { font-weight: bold; }\n");
+    css.push_str(".tok-code { font-style: normal; }\n");
+    css
+}
+
+/// All properties of a style, so that a rule replaces the one of the kind entirely.
+fn css_declarations(style: TokenStyle) -> String {
+    let background = style.bg.map_or_else(|| "transparent".to_string(), css_color);
+    format!(
+        "color: {}; background-color: {background}; font-weight: {}; font-style: {}; \
+         text-decoration: {};",
+        css_color(style.fg),
+        if style.bold { "bold" } else { "normal" },
+        if style.italic { "italic" } else { "normal" },
+        if style.underline { "underline" } else { "none" },
+    )
+}
+
+/// The name of a token kind in JSON output, e.g. `keyword_control` for `KeywordControl`.
+pub fn kind_name(kind: TokenKind) -> String {
+    let mut name = String::new();
+    for (i, ch) in format!("{kind:?}").chars().enumerate() {
+        if ch.is_ascii_uppercase() {
+            if i > 0 {
+                name.push('_');
+            }
+            name.push(ch.to_ascii_lowercase());
+        } else {
+            name.push(ch);
+        }
+    }
+    name
+}
+
+pub fn html_escape(text: &str) -> String {
+    let mut escaped = String::with_capacity(text.len());
+    for ch in text.chars() {
+        match ch {
+            '<' => escaped.push_str("&lt;"),
+            '>' => escaped.push_str("&gt;"),
+            '&' => escaped.push_str("&amp;"),
+            '"' => escaped.push_str("&quot;"),
+            _ => escaped.push(ch),
+        }
+    }
+    escaped
+}
+
+/// Escapes text for RTF, which is 7-bit. Everything else is written as UTF-16 code units,
+/// each followed by a `?` for readers that don't know `\u`.
+pub fn rtf_escape(text: &str) -> String {
+    let mut escaped = String::with_capacity(text.len());
+    for ch in text.chars() {
+        match ch {
+            '\\' | '{' | '}' => {
+                escaped.push('\\');
+                escaped.push(ch);
+            }
+            '\n' => escaped.push_str("\\par\n"),
+            '\t' => escaped.push_str("\\tab "),
+            '\r' => {}
+            ' '..='~' => escaped.push(ch),
+            _ => {
+                // Control characters get their pictures, like in the terminal formats.
+                let ch = match ch {
+                    '\0'..='\x1f' => char::from_u32(0x2400 + ch as u32).unwrap_or(ch),
+                    '\x7f' => '\u{2421}',
+                    _ => ch,
+                };
+                for unit in ch.encode_utf16(&mut [0; 2]) {
+                    escaped.push_str(&format!("\\u{}?", *unit as i16));
+                }
+            }
+        }
+    }
+    escaped
+}
+
+pub fn json_escape(text: &str) -> String {
+    let mut escaped = String::with_capacity(text.len());
+    for ch in text.chars() {
+        match ch {
+            '"' => escaped.push_str("\\\""),
+            '\\' => escaped.push_str("\\\\"),
+            '\n' => escaped.push_str("\\n"),
+            '\r' => escaped.push_str("\\r"),
+            '\t' => escaped.push_str("\\t"),
+            '\0'..='\x1f' | '\x7f' => escaped.push_str(&format!("\\u{:04x}", ch as u32)),
+            _ => escaped.push(ch),
+        }
+    }
+    escaped
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_xterm_256() {
+        assert_eq!(xterm_256(0, 0, 0), 16);
+        assert_eq!(xterm_256(255, 255, 255), 231);
+        assert_eq!(xterm_256(0xff, 0x00, 0x00), 196);
+        assert_eq!(xterm_256(0x80, 0x80, 0x80), 244);
+        assert_eq!(xterm_256(0x56, 0x9c, 0xd6), 74);
+    }
+
+    #[test]
+    fn test_kind_name() {
+        assert_eq!(kind_name(TokenKind::Keyword), "keyword");
+        assert_eq!(kind_name(TokenKind::FunctionName), "function_name");
+    }
+
+    #[test]
+    fn test_rtf_escape() {
+        assert_eq!(rtf_escape("if {a\\b}\n"), "if \\{a\\\\b\\}\\par\n");
+        assert_eq!(rtf_escape("\tä\r\n"), "\\tab \\u228?\\par\n");
+        // Beyond the BMP, a surrogate pair, as signed 16-bit numbers.
+        assert_eq!(rtf_escape("😀"), "\\u-10179?\\u-8704?");
+        assert_eq!(rtf_escape("\x1b"), "\\u9243?");
+    }
+
+    #[test]
+    fn test_ansi_coalescing() {
+        let red = TokenStyle::new(StraightRgba::from_be(0xff0000ff));
+        let blue = TokenStyle::new(StraightRgba::from_be(0x0000ffff));
+        let token = Token::new(TokenKind::Identifier, 0..0);
+        let mut f = Formatter::new(Vec::new(), Format::TrueColor);
+        for (text, style) in [
+            ("a", red),
+            (" ", blue),
+            ("b", red),
+            ("c\nd", red),
+            ("e", blue),
+            (" ", red.underline()),
+            ("\n", red),
+        ] {
+            f.token(text.as_bytes(), &token, style).unwrap();
+        }
+        f.end_file().unwrap();
+        assert_eq!(
+            String::from_utf8(f.into_inner()).unwrap(),
+            concat!(
+                "\x1b[38;2;255;0;0ma bc\x1b[0m\n",
+                "\x1b[38;2;255;0;0md\x1b[0;38;2;0;0;255me\x1b[0;38;2;255;0;0;4m \x1b[0m\n",
+            )
+        );
+    }
+
+    #[test]
+    fn test_html_classes() {
+        let token = Token::new(TokenKind::KeywordControl, 0..2);
+        assert_eq!(html_classes(&token), "tok-keyword_control");
+        let token =
+            Token::new(TokenKind::Delimiter, 0..1).with_payload(TokenPayload::BracketDepth(2));
+        assert_eq!(html_classes(&token), "tok-delimiter tok-bracket-2");
+        let token = Token::new(TokenKind::Comment, 0..3).with_payload(TokenPayload::Url);
+        assert_eq!(html_classes(&token), "tok-comment tok-link");
+        let token = Token::new(TokenKind::Number, 0..1)
+            .with_payload(TokenPayload::Color(StraightRgba::from_be(0xff0000ff)));
+        assert_eq!(html_classes(&token), "tok-number");
+    }
+
+    #[test]
+    fn test_stylesheet() {
+        let theme = Theme::default_dark();
+        let css = stylesheet(&theme, true);
+        for &kind in TokenKind::ALL {
+            assert!(css.contains(&format!("\n.tok-{} {{ color: ", kind_name(kind))), "{kind:?}");
+        }
+        assert!(css.contains(&format!(
+            "\n.tok-keyword {{ {} }}\n",
+            css_declarations(theme.get_style(TokenKind::Keyword))
+        )));
+        assert!(css.contains(&format!("\n.tok-bracket-{} {{ ", theme.bracket_cycle() - 1)));
+        // Payloads come after the kinds, so that they win.
+        assert!(css.find(".tok-invalid ").unwrap() > css.find(".tok-markdown_link ").unwrap());
+    }
+
+    #[test]
+    fn test_css_declarations() {
+        let style = TokenStyle::new(StraightRgba::from_be(0x569cd6ff)).bold();
+        assert_eq!(
+            css_declarations(style),
+            "color: #569cd6; background-color: transparent; font-weight: bold; \
+             font-style: normal; text-decoration: none;"
+        );
+    }
+
+    #[test]
+    fn test_css_tabs() {
+        let (token, style) = (
+            Token::new(TokenKind::Identifier, 0..2),
+            TokenStyle::new(StraightRgba::from_be(0xd4d4d4ff)),
+        );
+        let html = |tabs| {
+            let mut f = Formatter::new(Vec::new(), Format::Html).with_tab_width(4).with_tabs(tabs);
+            f.begin_file("a.go", Language::Go, false).unwrap();
+            f.token(b"\tx", &token, style).unwrap();
+            f.end_file().unwrap();
+            String::from_utf8(f.into_inner()).unwrap()
+        };
+        let css = html(Tabs::Css);
+        assert!(css.starts_with("<pre class=\"hl\" data-language=\"Go\" style=\"tab-size:4\">"));
+        assert!(css.contains(">\tx</span>"), "{css}");
+        let expanded = html(Tabs::Expand);
+        assert!(expanded.starts_with("<pre class=\"hl\" data-language=\"Go\">"));
+        assert!(expanded.contains(">    x</span>"), "{expanded}");
+
+        // The other formats still expand them.
+        let mut f =
+            Formatter::new(Vec::new(), Format::Plain).with_tab_width(4).with_tabs(Tabs::Css);
+        f.token(b"\tx", &token, style).unwrap();
+        assert_eq!(f.into_inner(), b"    x");
+    }
+
+    #[test]
+    fn test_expand_tabs() {
+        let mut f = Formatter::new(io::sink(), Format::Plain).with_tab_width(4);
+        assert_eq!(f.expand_tabs(b"\ta\tbc"), b"    a   bc");
+        // The column carries over between tokens and starts over after a newline.
+        assert_eq!(f.expand_tabs(b"d\t"), b"d ");
+        assert_eq!(f.expand_tabs(b"\n12345\t"), b"\n12345   ");
+        // Wide characters take 2 columns.
+        assert_eq!(f.expand_tabs("\n日\t".as_bytes()), "\n日  ".as_bytes());
+
+        let f = Formatter::new(io::sink(), Format::Json).with_tab_width(4);
+        assert_eq!(f.tab_width, 0);
+    }
+}
@@ -0,0 +1,251 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//! Golden files for the tokens of the fixtures, to catch lexer changes nobody meant to make.
+//!
+//! A fixture like `test_syntax.go` is covered once it has a sibling `test_syntax.go.tokens`,
+//! which holds one `line:column length kind` record per token: the 1-based position in
+//! characters, the length in bytes, and the kind as in `hl debug tokens`, followed by the
+//! scopes of the containers the token is in like `meta.function.body>meta.block`, if any,
+//! and its payload. Brackets have their depth as with `--rainbow-brackets`, so that a
+//! bracket that stops pairing up shows. Whitespace isn't recorded. A mismatch fails with a unified diff of the records.
+//!
+//! A sibling `test_syntax.go.folds` likewise holds its folding ranges, one `start-end kind`
+//! record per range with 1-based lines and the kind as the LSP calls it.
+//!
+//! A golden like `test_syntax.go@1.17.tokens` holds the records of `test_syntax.go` with
+//! `--lang-version 1.17`, for languages whose versions highlight differently.
+//!
+//! Run the tests with `UPDATE_GOLDENS=1` to rewrite the goldens instead. To cover another
+//! fixture, create its empty golden and do that. A `no-golden` in the first line of a
+//! fixture skips it regardless, e.g. while its lexer is being rewritten.
+
+use std::fmt::Write as _;
+use std::fs;
+use std::path::Path;
+
+use edit::syntax::{Columns, Language, LineIndex, SyntaxHighlighter, TokenKind, folding_ranges};
+
+use crate::format::kind_name;
+use crate::myers::{self, Edit};
+use crate::{Args, detect_language, highlight_options};
+
+/// Computes the golden records of a fixture from its path, text and `--lang-version`.
+type Records = fn(&Path, &[u8], Option<&str>) -> String;
+
+/// The extensions of the golden files, and how to compute their records.
+const GOLDENS: &[(&str, Records)] = &[("tokens", records), ("folds", folds)];
+/// The lines of context around each change in a diff.
+const CONTEXT: usize = 3;
+
+/// Compares every covered fixture in `dir` against its golden, or rewrites the goldens
+/// if `UPDATE_GOLDENS` is set. Panics with the diffs of all the fixtures that differ.
+pub fn run_golden(dir: &Path) {
+    let update = std::env::var_os("UPDATE_GOLDENS").is_some_and(|v| !v.is_empty());
+    let mut paths: Vec<_> = fs::read_dir(dir).unwrap().map(|e| e.unwrap().path()).collect();
+    // The same order on every platform, so that the failures are too.
+    paths.sort();
+
+    let mut failures = String::new();
+    for golden in &paths {
+        let Some(&(extension, records)) =
+            GOLDENS.iter().find(|(ext, _)| golden.extension().is_some_and(|e| e == *ext))
+        else {
+            continue;
+        };
+        let stem = golden.with_extension("");
+        let name = stem.file_name().unwrap().to_string_lossy();
+        let (fixture, version) = match name.split_once('@') {
+            Some((fixture, version)) => (stem.with_file_name(fixture), Some(version)),
+            None => (stem.clone(), None),
+        };
+        let Ok(text) = fs::read(&fixture) else {
+            _ = writeln!(failures, "{}: no fixture for this golden", golden.display());
+            continue;
+        };
+        if is_opted_out(&text) {
+            continue;
+        }
+
+        let actual = records(&fixture, &text, version);
+        if update {
+            fs::write(golden, &actual).unwrap();
+            continue;
+        }
+        let expected = fs::read_to_string(golden).unwrap();
+        if expected != actual {
+            let old = format!("{name}.{extension}");
+            failures.push_str(&unified_diff(
+                &format!("a/{old}"),
+                &format!("b/{old}"),
+                &expected,
+                &actual,
+            ));
+        }
+    }
+
+    assert!(
+        failures.is_empty(),
+        "tokens or folds differ from the goldens, rerun with UPDATE_GOLDENS=1 to accept them\n\n{failures}"
+    );
+}
+
+/// Whether the first line of a fixture asks to be left out, in whatever comment it has.
+fn is_opted_out(text: &[u8]) -> bool {
+    let first = text.split(|&b| b == b'\n').next().unwrap_or_default();
+    first.windows(b"no-golden".len()).any(|w| w == b"no-golden")
+}
+
+/// The golden records of the fixture at `path`, with the language and options `hl` would use,
+/// and `--inject-strings Query=sql`.
+fn records(path: &Path, text: &[u8], version: Option<&str>) -> String {
+    let args = Args {
+        rainbow_brackets: true,
+        string_injections: vec![("Query".to_string(), Language::Sql)],
+        language_version: version.map(str::to_string),
+        ..Args::default()
+    };
+    let language = detect_language(&args, path, text);
+    let mut highlighter = SyntaxHighlighter::new(language, args.theme.create());
+    highlighter.set_options(highlight_options(&args, path));
+    highlighter.update(text, true);
+
+    let mut tokens: Vec<_> =
+        highlighter.tokens().iter().filter(|t| t.kind != TokenKind::Whitespace).collect();
+    tokens.sort_by_key(|t| t.span.start);
+
+    let mut out = String::new();
+    let lines = LineIndex::new(text);
+    for token in tokens {
+        let (line, column) = lines.position(text, token.span.start, Columns::Chars);
+        let (line, column) = (line + 1, column + 1);
+        _ = write!(out, "{line}:{column} {} {}", token.span.len(), kind_name(token.kind));
+        if !token.scopes.is_empty() {
+            let scopes: Vec<_> = token.scopes.iter().map(|c| c.scope()).collect();
+            _ = write!(out, " {}", scopes.join(">"));
+        }
+        if let Some(payload) = token.payload {
+            _ = write!(out, " {payload:?}");
+        }
+        out.push('\n');
+    }
+    out
+}
+
+/// The golden records of the folding ranges of the fixture at `path`.
+fn folds(path: &Path, text: &[u8], version: Option<&str>) -> String {
+    let args = Args { language_version: version.map(str::to_string), ..Args::default() };
+    let language = detect_language(&args, path, text);
+    let mut highlighter = SyntaxHighlighter::new(language, args.theme.create());
+    highlighter.set_options(highlight_options(&args, path));
+    highlighter.update(text, true);
+
+    let mut tokens = highlighter.tokens().to_vec();
+    tokens.sort_by_key(|t| t.span.start);
+
+    let mut out = String::new();
+    for range in folding_ranges(language, text, &tokens) {
+        let (start, end) = (range.start_line + 1, range.end_line + 1);
+        _ = writeln!(out, "{start}-{end} {}", range.kind.name());
+    }
+    out
+}
+
+/// `diff -u` of two texts whose lines all end in a newline.
+fn unified_diff(old_name: &str, new_name: &str, old: &str, new: &str) -> String {
+    let old_lines: Vec<_> = old.lines().collect();
+    let new_lines: Vec<_> = new.lines().collect();
+    let edits = myers::diff(&old_lines, &new_lines);
+
+    // Where each edit starts in the old and the new text.
+    let mut positions = Vec::with_capacity(edits.len());
+    let (mut i, mut j) = (0, 0);
+    for edit in &edits {
+        positions.push((i, j));
+        match edit {
+            Edit::Keep(..) => (i, j) = (i + 1, j + 1),
+            Edit::Remove(_) => i += 1,
+            Edit::Add(_) => j += 1,
+        }
+    }
+
+    let mut out = format!("--- {old_name}\n+++ {new_name}\n");
+    for range in myers::hunks(&edits, CONTEXT) {
+        let (old_start, new_start) = positions[range.start];
+        let hunk = &edits[range];
+        let old_len = hunk.iter().filter(|e| !matches!(e, Edit::Add(_))).count();
+        let new_len = hunk.iter().filter(|e| !matches!(e, Edit::Remove(_))).count();
+        // Like `diff -u`, an empty side starts at the line before it.
+        let range = |start: usize, len: usize| match len {
+            0 => format!("{start},0"),
+            1 => format!("{}", start + 1),
+            _ => format!("{},{len}", start + 1),
+        };
+        _ = writeln!(out, "@@ -{} +{} @@", range(old_start, old_len), range(new_start, new_len));
+        for edit in hunk {
+            _ = match *edit {
+                Edit::Keep(_, j) => writeln!(out, " {}", new_lines[j]),
+                Edit::Remove(i) => writeln!(out, "-{}", old_lines[i]),
+                Edit::Add(j) => writeln!(out, "+{}", new_lines[j]),
+            };
+        }
+    }
+    out
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_syntax_tests() {
+        run_golden(Path::new(concat!(env!("CARGO_MANIFEST_DIR"), "/../../syntax-tests")));
+        run_golden(Path::new(concat!(env!("CARGO_MANIFEST_DIR"), "/../../syntax-tests-invalid")));
+    }
+
+    #[test]
+    fn test_records() {
+        let text = "x := \"é\\n\" // TODO\n\ty\nfunc f(a int) {}";
+        let records = records(Path::new("a.go"), text.as_bytes(), None);
+        assert_eq!(
+            records.lines().collect::<Vec<_>>(),
+            [
+                "1:1 1 identifier",
+                "1:3 2 operator",
+                "1:6 3 string",
+                "1:8 2 escape",
+                "1:10 1 string",
+                "1:12 3 comment",
+                "1:15 4 comment CommentKeyword",
+                "2:2 1 identifier",
+                "3:1 4 keyword",
+                "3:6 1 function_definition",
+                "3:7 1 operator meta.function.parameters BracketDepth(0)",
+                "3:8 1 identifier meta.function.parameters",
+                "3:10 3 type_name meta.function.parameters",
+                "3:13 1 operator meta.function.parameters BracketDepth(0)",
+                "3:15 1 operator meta.function.body BracketDepth(0)",
+                "3:16 1 operator meta.function.body BracketDepth(0)",
+            ]
+        );
+    }
+
+    #[test]
+    fn test_opted_out() {
+        assert!(is_opted_out(b"// no-golden: the lexer is being rewritten\npackage main\n"));
+        assert!(is_opted_out(b"# no-golden\n"));
+        assert!(!is_opted_out(b"package main\n// no-golden\n"));
+        assert!(!is_opted_out(b""));
+    }
+
+    #[test]
+    fn test_unified_diff() {
+        let old = "1\n2\n3\n4\n5\n6\n7\n8\n9\n";
+        let new = "1\n2\n3\n4\nfive\n6\n7\n8\n9\n";
+        assert_eq!(
+            unified_diff("a/x", "b/x", old, new),
+            "--- a/x\n+++ b/x\n@@ -2,7 +2,7 @@\n 2\n 3\n 4\n-5\n+five\n 6\n 7\n 8\n"
+        );
+        assert_eq!(unified_diff("a/x", "b/x", "", "1\n"), "--- a/x\n+++ b/x\n@@ -0,0 +1 @@\n+1\n");
+    }
+}
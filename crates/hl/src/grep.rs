@@ -0,0 +1,162 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//! `--grep`: prints only the lines that match a pattern and the lines around them.
+//!
+//! The file is still highlighted from the top, so that a match inside a block comment
+//! or multi-line string looks like one. Only the output is limited to the selected lines.
+
+use std::io::{self, Write};
+use std::ops::Range;
+
+use edit::syntax::{Theme, Token};
+
+use crate::format::Formatter;
+use crate::pattern::Pattern;
+
+/// The pattern and context of `--grep`.
+pub struct Grep {
+    pub pattern: Pattern,
+    /// How many lines before each match are printed, as set with `-B` or `-C`.
+    pub before: usize,
+    /// How many lines after each match are printed, as set with `-A` or `-C`.
+    pub after: usize,
+}
+
+impl Grep {
+    /// Finds the matches in `text` and the lines to print around them.
+    pub fn select(&self, text: &[u8]) -> Selection {
+        let mut lines = Vec::new();
+        let mut matches = Vec::new();
+        let mut matched_lines = Vec::new();
+
+        let mut start = 0;
+        while start < text.len() {
+            let end = text[start..]
+                .iter()
+                .position(|&b| b == b'\n')
+                .map_or(text.len(), |i| start + i + 1);
+            // The pattern is matched against the raw text, without the newline.
+            let line = text[start..end].strip_suffix(b"\n").unwrap_or(&text[start..end]);
+            let line = line.strip_suffix(b"\r").unwrap_or(line);
+            if let Ok(line) = str::from_utf8(line) {
+                let found = self.pattern.find_all(line);
+                if !found.is_empty() {
+                    matched_lines.push(lines.len());
+                    matches.extend(found.into_iter().map(|m| start + m.start..start + m.end));
+                }
+            }
+            lines.push(start..end);
+            start = end;
+        }
+
+        // Adjacent and overlapping contexts are merged into one chunk.
+        let mut chunks: Vec<Range<usize>> = Vec::new();
+        let mut line_numbers = Vec::new();
+        for i in matched_lines {
+            let first_line = i.saturating_sub(self.before);
+            let first = &lines[first_line];
+            let last = &lines[(i + self.after).min(lines.len() - 1)];
+            match chunks.last_mut() {
+                Some(chunk) if chunk.end >= first.start => chunk.end = last.end,
+                _ => {
+                    chunks.push(first.start..last.end);
+                    line_numbers.push(first_line + 1);
+                }
+            }
+        }
+
+        Selection { chunks, line_numbers, matches, started: 0 }
+    }
+}
+
+/// The parts of a file that [`Grep`] selected.
+pub struct Selection {
+    /// The runs of adjacent lines to print, including their newlines.
+    chunks: Vec<Range<usize>>,
+    /// The number of the first line of each chunk.
+    line_numbers: Vec<usize>,
+    matches: Vec<Range<usize>>,
+    /// How many chunks have been written to, to put separators between them.
+    started: usize,
+}
+
+impl Selection {
+    /// Whether there are no matches, and so nothing to print.
+    pub fn is_empty(&self) -> bool {
+        self.chunks.is_empty()
+    }
+
+    /// Writes the parts of `token` that are in the selected lines, with the matches emphasized.
+    /// Tokens must be written in order.
+    pub fn token<W: Write>(
+        &mut self,
+        out: &mut Formatter<W>,
+        text: &[u8],
+        token: &Token,
+        theme: &Theme,
+    ) -> io::Result<()> {
+        let first = self.chunks.partition_point(|chunk| chunk.end <= token.span.start);
+        for (i, chunk) in self.chunks.iter().enumerate().skip(first) {
+            if chunk.start >= token.span.end {
+                break;
+            }
+            if i >= self.started {
+                if i > 0 {
+                    out.separator()?;
+                }
+                out.set_line_number(self.line_numbers[i]);
+                self.started = i + 1;
+            }
+
+            let range = token.span.start.max(chunk.start)..token.span.end.min(chunk.end);
+            let mut write = |span: Range<usize>, emphasized: bool| {
+                let mut piece = token.clone();
+                piece.span = span;
+                let style = theme.token_style(&piece);
+                let style = if emphasized { theme.emphasize(style) } else { style };
+                out.token(&text[piece.span.clone()], &piece, style)
+            };
+
+            // Split the token where matches start and end.
+            let mut pos = range.start;
+            let m = self.matches.partition_point(|m| m.end <= pos);
+            for m in self.matches[m..].iter().take_while(|m| m.start < range.end) {
+                if m.start > pos {
+                    write(pos..m.start, false)?;
+                }
+                let end = m.end.min(range.end);
+                write(pos.max(m.start)..end, true)?;
+                pos = end;
+            }
+            if pos < range.end {
+                write(pos..range.end, false)?;
+            }
+        }
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn chunks<'a>(pattern: &str, before: usize, after: usize, text: &'a str) -> Vec<&'a str> {
+        let grep = Grep { pattern: Pattern::new(pattern).unwrap(), before, after };
+        grep.select(text.as_bytes()).chunks.into_iter().map(|c| &text[c]).collect()
+    }
+
+    #[test]
+    fn test_select() {
+        let text = "a\nb\nc\nd\ne\nf\ng";
+        assert_eq!(chunks("c|f", 0, 0, text), ["c\n", "f\n"]);
+        assert_eq!(chunks("c", 1, 2, text), ["b\nc\nd\ne\n"]);
+        // Contexts that touch or overlap are merged.
+        assert_eq!(chunks("b|e", 1, 1, text), ["a\nb\nc\nd\ne\nf\n"]);
+        assert_eq!(chunks("a|g", 2, 2, text), ["a\nb\nc\n", "e\nf\ng"]);
+        assert_eq!(chunks("a|g", 3, 2, text), ["a\nb\nc\nd\ne\nf\ng"]);
+        assert!(chunks("x", 9, 9, text).is_empty());
+        // `$` matches before a CRLF.
+        assert_eq!(chunks("b$", 0, 0, "a\r\nb\r\n"), ["b\r\n"]);
+    }
+}
@@ -0,0 +1,168 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//! `hl lint`: the problems of TextMate grammars, for CI of hand-edited ones.
+//!
+//! Every grammar is checked with [`validate_grammar`], or with `-l LANG` the grammar the
+//! lexer exports. Errors, like an `include` of nothing or a rule that can match the empty
+//! string, fail the run. Warnings, like a rule that an earlier one shadows, don't, and the
+//! ones a grammar has reasons for can be allowed with `--allow FILE`, whose lines are like
+//! `shadowed repository.keywords.patterns[3]`.
+
+use std::fs;
+use std::io::{self, BufWriter, Read, Write};
+use std::path::Path;
+
+use edit::syntax::{GrammarProblem, GrammarProblemKind, export_grammar, validate_grammar};
+
+use crate::{Args, EXIT_CHECK_FAILED, EXIT_UNREADABLE};
+
+/// A warning that `--allow` suppresses: its kind and rule path.
+type Allowed = (GrammarProblemKind, String);
+
+/// Checks every grammar and prints its problems. `allow` lists the warnings not to print.
+/// Returns the exit status: whether a file couldn't be read, or there were errors.
+pub fn run(args: &Args, allow: Option<&Path>) -> io::Result<u8> {
+    let allowed = allow.map(read_allowlist).transpose()?.unwrap_or_default();
+
+    let mut grammars = Vec::new();
+    let mut all_read = true;
+    if let Some(language) = args.language {
+        let exported = export_grammar(language)
+            .map_err(|err| io::Error::new(io::ErrorKind::InvalidInput, err))?;
+        grammars.push((format!("{} (exported)", language.id()), exported.json));
+    } else {
+        let stdin = [std::ffi::OsString::from("-")];
+        let paths = if args.paths.is_empty() { &stdin[..] } else { &args.paths[..] };
+        for path in paths {
+            let (display, input) = if path == "-" {
+                let mut input = String::new();
+                let read = io::stdin().read_to_string(&mut input).map(|_| input);
+                ("(standard input)".to_string(), read)
+            } else {
+                (path.to_string_lossy().into_owned(), fs::read_to_string(path))
+            };
+            match input {
+                Ok(input) => grammars.push((display, input)),
+                Err(err) => {
+                    eprintln!("hl: {display}: {err}");
+                    all_read = false;
+                }
+            }
+        }
+    }
+
+    let mut out = BufWriter::new(io::stdout().lock());
+    let (mut errors, mut warnings) = (0, 0);
+    for (display, json) in &grammars {
+        for problem in validate_grammar(json) {
+            if !problem.kind.is_error() && allowed.contains(&(problem.kind, problem.path.clone())) {
+                continue;
+            }
+            report(&mut out, display, &problem)?;
+            if problem.kind.is_error() {
+                errors += 1;
+            } else {
+                warnings += 1;
+            }
+        }
+    }
+    if errors + warnings > 0 {
+        let s = |n| if n == 1 { "" } else { "s" };
+        writeln!(out, "{errors} error{} and {warnings} warning{}", s(errors), s(warnings))?;
+    }
+    out.flush()?;
+
+    Ok(if !all_read {
+        EXIT_UNREADABLE
+    } else if errors > 0 {
+        EXIT_CHECK_FAILED
+    } else {
+        0
+    })
+}
+
+fn report(out: &mut impl Write, display: &str, problem: &GrammarProblem) -> io::Result<()> {
+    writeln!(
+        out,
+        "{display}: {}: {}: {} [{}]",
+        if problem.kind.is_error() { "error" } else { "warning" },
+        problem.path,
+        problem.message,
+        problem.kind.code()
+    )
+}
+
+/// Reads the warnings to allow, a `CODE RULE-PATH` per line, with `#` starting comments.
+fn read_allowlist(path: &Path) -> io::Result<Vec<Allowed>> {
+    let text = fs::read_to_string(path)
+        .map_err(|e| io::Error::new(e.kind(), format!("{}: {e}", path.display())))?;
+    parse_allowlist(&text).map_err(|(line, message)| {
+        let message = format!("{}:{line}: {message}", path.display());
+        io::Error::new(io::ErrorKind::InvalidInput, message)
+    })
+}
+
+/// Parses the lines of an allowlist, or returns the 1-based line of the first bad one.
+fn parse_allowlist(text: &str) -> Result<Vec<Allowed>, (usize, String)> {
+    let mut allowed = Vec::new();
+    for (i, line) in text.lines().enumerate() {
+        let line = line.split('#').next().unwrap_or_default().trim();
+        if line.is_empty() {
+            continue;
+        }
+        let err = |message: String| (i + 1, message);
+        let Some((code, rule)) = line.split_once(char::is_whitespace) else {
+            return Err(err(format!("expected a problem and a rule path, got '{line}'")));
+        };
+        let warnings: Vec<_> = GrammarProblemKind::ALL
+            .iter()
+            .filter(|kind| !kind.is_error())
+            .map(|kind| kind.code())
+            .collect();
+        let kind = match GrammarProblemKind::from_code(code) {
+            Some(kind) if !kind.is_error() => kind,
+            Some(_) => return Err(err(format!("{code} is an error, which can't be allowed"))),
+            None => {
+                return Err(err(format!(
+                    "unknown problem '{code}', expected {}",
+                    warnings.join(" or ")
+                )));
+            }
+        };
+        allowed.push((kind, rule.trim().to_string()));
+    }
+    Ok(allowed)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_parse_allowlist() {
+        let text = "# Keywords listed twice on purpose.\n\
+                    shadowed repository.keywords.patterns[3]\n\
+                    \n\
+                    scope-name  grammar.patterns[0].name  # our own scope\n";
+        assert_eq!(
+            parse_allowlist(text).unwrap(),
+            [
+                (GrammarProblemKind::Shadowed, "repository.keywords.patterns[3]".to_string()),
+                (GrammarProblemKind::ScopeName, "grammar.patterns[0].name".to_string()),
+            ]
+        );
+        assert_eq!(
+            parse_allowlist("shadowed a\nempty-match b\n").unwrap_err(),
+            (2, "empty-match is an error, which can't be allowed".to_string())
+        );
+        assert_eq!(
+            parse_allowlist("nope a").unwrap_err(),
+            (1, "unknown problem 'nope', expected shadowed or scope-name".to_string())
+        );
+        assert_eq!(
+            parse_allowlist("shadowed").unwrap_err(),
+            (1, "expected a problem and a rule path, got 'shadowed'".to_string())
+        );
+    }
+}
@@ -0,0 +1,121 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//! `--list-languages` and `--list-themes`.
+//!
+//! Both come straight from [`Language::ALL`] and [`Theme::BUILTIN`], so new
+//! languages and themes show up without changes here. The JSON schema is
+//! documented in the README. Keep it backwards compatible and bump
+//! [`SCHEMA_VERSION`] if that's impossible.
+
+use std::io::{self, BufWriter, Write};
+
+use edit::syntax::{Language, Theme};
+
+use crate::format::json_escape;
+
+/// The `version` field of the JSON listings.
+const SCHEMA_VERSION: u32 = 1;
+
+/// What to list.
+#[derive(Clone, Copy, PartialEq, Eq)]
+pub enum List {
+    Languages,
+    Themes,
+}
+
+/// Print the listing to stdout, as aligned columns or as JSON.
+pub fn print(list: List, json: bool) -> io::Result<()> {
+    let mut out = BufWriter::new(io::stdout().lock());
+    match (list, json) {
+        (List::Languages, false) => {
+            let rows: Vec<[String; 4]> = Language::ALL
+                .iter()
+                .map(|l| {
+                    let extensions: Vec<_> =
+                        l.extensions().iter().map(|e| format!(".{e}")).collect();
+                    [
+                        l.id().to_string(),
+                        l.name().to_string(),
+                        l.aliases().join(", "),
+                        extensions.join(" "),
+                    ]
+                })
+                .collect();
+            write_columns(&mut out, ["NAME", "DISPLAY NAME", "ALIASES", "EXTENSIONS"], &rows)?;
+        }
+        (List::Themes, false) => {
+            let rows: Vec<[String; 2]> = Theme::BUILTIN
+                .iter()
+                .map(|t| [t.name.to_string(), appearance(t.dark).to_string()])
+                .collect();
+            write_columns(&mut out, ["NAME", "APPEARANCE"], &rows)?;
+        }
+        (List::Languages, true) => {
+            write!(out, "{{\"version\":{SCHEMA_VERSION},\"languages\":[")?;
+            for (i, l) in Language::ALL.iter().enumerate() {
+                write!(
+                    out,
+                    "{}{{\"name\":\"{}\",\"display_name\":\"{}\",\"aliases\":{},\"extensions\":{}}}",
+                    if i > 0 { "," } else { "" },
+                    json_escape(l.id()),
+                    json_escape(l.name()),
+                    json_array(l.aliases()),
+                    json_array(l.extensions()),
+                )?;
+            }
+            writeln!(out, "]}}")?;
+        }
+        (List::Themes, true) => {
+            write!(out, "{{\"version\":{SCHEMA_VERSION},\"themes\":[")?;
+            for (i, t) in Theme::BUILTIN.iter().enumerate() {
+                write!(
+                    out,
+                    "{}{{\"name\":\"{}\",\"appearance\":\"{}\"}}",
+                    if i > 0 { "," } else { "" },
+                    json_escape(t.name),
+                    appearance(t.dark),
+                )?;
+            }
+            writeln!(out, "]}}")?;
+        }
+    }
+    out.flush()
+}
+
+fn appearance(dark: bool) -> &'static str {
+    if dark { "dark" } else { "light" }
+}
+
+fn json_array(items: &[&str]) -> String {
+    let items: Vec<_> = items.iter().map(|s| format!("\"{}\"", json_escape(s))).collect();
+    format!("[{}]", items.join(","))
+}
+
+/// Writes a header and rows, with each column padded to its widest cell.
+pub fn write_columns<const N: usize>(
+    out: &mut impl Write,
+    header: [&str; N],
+    rows: &[[String; N]],
+) -> io::Result<()> {
+    let mut widths = header.map(str::len);
+    for row in rows {
+        for (width, cell) in widths.iter_mut().zip(row) {
+            *width = (*width).max(cell.chars().count());
+        }
+    }
+
+    let header = header.map(str::to_string);
+    for row in std::iter::once(&header).chain(rows) {
+        let mut line = String::new();
+        for (i, cell) in row.iter().enumerate() {
+            if i + 1 < N {
+                line.push_str(&format!("{cell:<width$}  ", width = widths[i]));
+            } else {
+                line.push_str(cell);
+            }
+        }
+        writeln!(out, "{}", line.trim_end())?;
+    }
+    Ok(())
+}
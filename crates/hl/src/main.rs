@@ -0,0 +1,1227 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//! `hl` prints files with syntax highlighting, like a colorful `cat`.
+
+mod bench;
+mod check;
+mod clipboard;
+mod config;
+mod coverage;
+mod debug;
+mod diff;
+mod format;
+#[cfg(test)]
+mod golden;
+mod grep;
+mod lint;
+mod list;
+mod myers;
+mod ndjson;
+mod pattern;
+mod serve;
+mod snippet;
+mod tree;
+mod watch;
+
+use std::ffi::{OsStr, OsString};
+use std::fs::File;
+use std::io::{self, BufReader, BufWriter, IsTerminal, Read, Write};
+use std::path::{Path, PathBuf};
+use std::sync::atomic::AtomicBool;
+use std::sync::{Arc, LazyLock, Mutex};
+use std::time::SystemTime;
+use std::{env, fs, process};
+
+use edit::helpers::CoordType;
+use edit::syntax::{
+    Columns, DEFAULT_COMMENT_KEYWORDS, HighlightOptions, Language, SourceEncoding, SqlDialect,
+    StreamOptions, SyntaxHighlighter, TextMateTheme, Theme, Token, TokenKind, detect_encoding,
+    transcode,
+};
+
+use crate::clipboard::Multiplexer;
+use crate::debug::{Debug, Filter};
+use crate::format::{Format, Formatter, Tabs};
+use crate::grep::Grep;
+use crate::list::List;
+use crate::pattern::Pattern;
+use crate::snippet::{Select, Snippet};
+
+/// Bad arguments, like an unknown `--lang`.
+const EXIT_USAGE: u8 = 1;
+/// At least one file couldn't be read. The others are still printed.
+const EXIT_UNREADABLE: u8 = 2;
+/// `--check` found more errors than `--max-errors` allows.
+const EXIT_CHECK_FAILED: u8 = 3;
+/// Something else failed, like writing the output or `hl serve` listening on its port.
+const EXIT_FAILED: u8 = 4;
+
+/// The port `hl serve` listens on without `--port`.
+const DEFAULT_PORT: u16 = 8000;
+
+/// How much of the start of a file tells how to highlight the rest of it as it's read.
+const HEAD_LEN: u64 = 64 * 1024;
+
+/// The largest `--tab-width`.
+const MAX_TAB_WIDTH: CoordType = 32;
+
+/// When to color the output, as picked with `--color`.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+enum Color {
+    /// If stdout is a terminal and `NO_COLOR` isn't set.
+    Auto,
+    Always,
+    Never,
+}
+
+struct Args {
+    language: Option<Language>,
+    theme: Arc<ThemeChoice>,
+    format: Format,
+    color: Color,
+    /// Expand tabs to this many columns. 0 keeps them as they are.
+    tab_width: CoordType,
+    /// Whether HTML expands the tabs or sizes them with CSS.
+    tabs: Tabs,
+    /// Extensions to highlight as another language, from the config file.
+    languages: Vec<(String, Language)>,
+    /// The SQL dialect of SQL files whose extension or first lines don't name one.
+    sql_dialect: Option<SqlDialect>,
+    /// The version of the language whose keywords and builtins to highlight, like `1.17` for Go.
+    language_version: Option<String>,
+    /// Strings assigned to variables whose names end with the suffix, to highlight as the language.
+    string_injections: Vec<(String, Language)>,
+    /// The config file that was read, if any.
+    config: Option<PathBuf>,
+    /// Print a header line with the path before each file.
+    /// Defaults to whether there's more than one file, like grep.
+    headers: Option<bool>,
+    paths: Vec<OsString>,
+    /// Write to this file instead of stdout.
+    output: Option<OsString>,
+    /// Highlight the file again whenever it changes.
+    watch: bool,
+    /// Clear the screen between renders in watch mode, instead of printing a separator.
+    clear: bool,
+    /// Only print the lines matching the pattern, and the lines around them.
+    grep: Option<Grep>,
+    /// Only print these lines, or this region.
+    snippet: Option<Snippet>,
+    /// The marker that starts a region, with `{}` for its name.
+    region_start: String,
+    /// The marker that ends a region.
+    region_end: String,
+    /// The markers to highlight in comments, like `TODO`.
+    comment_keywords: Vec<String>,
+    /// Print the number of each line in front of it.
+    line_numbers: bool,
+    /// Color brackets by how deeply they're nested, and flag the ones without a partner.
+    rainbow_brackets: bool,
+    /// Print HTML or RTF with the page colors, to paste into documents and chats.
+    copy: Option<Format>,
+    /// Send the output of `copy` to the terminal's clipboard with OSC 52, instead of printing it.
+    clipboard: bool,
+    /// Give HTML classes instead of inline styles, for the rules that `css` prints.
+    html_classes: bool,
+    /// Print the stylesheet for `html_classes` in the theme instead of highlighting anything.
+    css: bool,
+    /// Highlight a directory into a tree of HTML pages in `output`.
+    recursive: bool,
+    /// Skip the files that `.gitignore` files ignore in recursive mode.
+    gitignore: bool,
+    /// Report the errors the lexers find instead of highlighting anything.
+    check: bool,
+    /// How many errors `--check` tolerates.
+    max_errors: usize,
+    /// Print what the lexers made of the files instead of highlighting them.
+    debug: Option<Debug>,
+    /// Only print the tokens matching all of these with `hl debug tokens`.
+    token_filters: Vec<Filter>,
+    /// Print the lines of each token with `hl debug tokens`, and this many lines before
+    /// and after them.
+    token_context: Option<(usize, usize)>,
+    /// Fail `hl debug` with the report of `--check` if it finds anything.
+    strict: bool,
+    /// What the columns of `hl debug` and `--check` count.
+    columns: Columns,
+    /// Print a unified diff, from stdin or between two files, with the code highlighted.
+    diff: bool,
+    /// Print the diff in two columns, old and new.
+    side_by_side: bool,
+    /// Time the highlighting of every file instead of printing it.
+    bench: bool,
+    /// The JSON report of an earlier `hl bench` to compare against.
+    compare: Option<PathBuf>,
+    /// Report which lexer rules and scopes the files exercise instead of highlighting them.
+    coverage: bool,
+    /// The JSON report of an earlier `hl coverage` that the coverage mustn't drop below.
+    baseline: Option<PathBuf>,
+    /// Check grammars for problems instead of highlighting anything.
+    lint: bool,
+    /// The warnings `hl lint` doesn't print.
+    allow: Option<PathBuf>,
+    /// Serve the directory over HTTP instead of highlighting anything.
+    serve: bool,
+    /// The port to serve on. 0 picks a free one.
+    port: u16,
+    /// Print a listing instead of highlighting anything.
+    list: Option<List>,
+    /// Print the listing or benchmark report as JSON.
+    json: bool,
+    /// Print the settings after applying the config file and flags.
+    dump_config: bool,
+}
+
+fn main() -> process::ExitCode {
+    let args = match parse_args() {
+        Ok(Some(args)) => args,
+        Ok(None) => return process::ExitCode::SUCCESS,
+        Err(message) => {
+            eprintln!("hl: {message}");
+            eprintln!("Try 'hl --help' for more information.");
+            return process::ExitCode::from(EXIT_USAGE);
+        }
+    };
+
+    let status = |all_read| if all_read { 0 } else { EXIT_UNREADABLE };
+    let result = match (args.list, args.debug) {
+        (Some(list), _) => list::print(list, args.json).map(|_| 0),
+        _ if args.dump_config => config::dump(&args).map(|_| 0),
+        _ if args.css => print_css(&args).map(|_| 0),
+        (None, Some(debug)) => debug::run(debug, &args),
+        _ if args.diff => diff::run(&args).map(status),
+        _ if args.serve => run_serve(args).map(status),
+        _ if args.bench => bench::run(&args, args.compare.as_deref()).map(status),
+        _ if args.coverage => coverage::run(&args, args.baseline.as_deref()),
+        _ if args.lint => lint::run(&args, args.allow.as_deref()),
+        _ if args.check => check::run(&args),
+        _ if args.watch => run_watch(args).map(status),
+        _ if args.recursive => run_tree(args).map(status),
+        _ => run(args).map(status),
+    };
+    match result {
+        Ok(status) => process::ExitCode::from(status),
+        // Someone piped the output into `head`.
+        Err(err) if err.kind() == io::ErrorKind::BrokenPipe => process::ExitCode::SUCCESS,
+        Err(err) => {
+            eprintln!("hl: {err}");
+            // Like a --region that isn't in the file, or a --compare report that isn't one.
+            let bad_arguments = err.kind() == io::ErrorKind::InvalidInput;
+            process::ExitCode::from(if bad_arguments { EXIT_USAGE } else { EXIT_FAILED })
+        }
+    }
+}
+
+impl Default for Args {
+    /// The settings without any flags or config file.
+    fn default() -> Self {
+        Self {
+            language: None,
+            theme: BUILTIN_THEMES[0].clone(),
+            format: default_format(),
+            color: Color::Auto,
+            tab_width: 0,
+            tabs: Tabs::Expand,
+            languages: Vec::new(),
+            sql_dialect: None,
+            language_version: None,
+            string_injections: Vec::new(),
+            config: None,
+            headers: None,
+            paths: Vec::new(),
+            output: None,
+            watch: false,
+            clear: true,
+            grep: None,
+            snippet: None,
+            region_start: snippet::DEFAULT_REGION_START.to_string(),
+            region_end: snippet::DEFAULT_REGION_END.to_string(),
+            comment_keywords: DEFAULT_COMMENT_KEYWORDS.map(String::from).to_vec(),
+            line_numbers: false,
+            rainbow_brackets: false,
+            copy: None,
+            clipboard: false,
+            html_classes: false,
+            css: false,
+            recursive: false,
+            gitignore: false,
+            check: false,
+            max_errors: 0,
+            debug: None,
+            token_filters: Vec::new(),
+            token_context: None,
+            strict: false,
+            columns: Columns::Chars,
+            diff: false,
+            side_by_side: false,
+            bench: false,
+            compare: None,
+            coverage: false,
+            baseline: None,
+            lint: false,
+            allow: None,
+            serve: false,
+            port: DEFAULT_PORT,
+            list: None,
+            json: false,
+            dump_config: false,
+        }
+    }
+}
+
+/// Returns `None` if the arguments asked for the help or version to be printed.
+///
+/// Flags win over the config file, which wins over the defaults.
+fn parse_args() -> Result<Option<Args>, String> {
+    let mut args = Args::default();
+    let mut theme = None;
+    let mut format = None;
+    let mut color = None;
+    let mut tab_width = None;
+    let mut sql_dialect = None;
+    let mut config_path = None;
+    let mut pattern = None;
+    let mut port = None;
+    let mut before = None;
+    let mut after = None;
+    let mut select = None;
+    let mut dedent = false;
+    let mut preserve_line_numbers = false;
+    let mut region_start = None;
+    let mut region_end = None;
+    let mut parse_args = true;
+    let mut it = env::args_os().skip(1).peekable();
+
+    // `hl debug VIEW`, `hl diff`, `hl serve`, `hl bench`, `hl coverage` and `hl lint` are
+    // subcommands, and so have to come first.
+    if it.peek().is_some_and(|arg| arg == "debug") {
+        it.next();
+        let view = it.next().and_then(|v| v.into_string().ok()).unwrap_or_default();
+        args.debug = Some(Debug::from_name(&view).ok_or_else(|| {
+            format!("unknown debug view '{view}', expected {}", Debug::NAMES.join(" or "))
+        })?);
+    } else if it.peek().is_some_and(|arg| arg == "diff") {
+        it.next();
+        args.diff = true;
+    } else if it.peek().is_some_and(|arg| arg == "serve") {
+        it.next();
+        args.serve = true;
+    } else if it.peek().is_some_and(|arg| arg == "bench") {
+        it.next();
+        args.bench = true;
+    } else if it.peek().is_some_and(|arg| arg == "coverage") {
+        it.next();
+        args.coverage = true;
+    } else if it.peek().is_some_and(|arg| arg == "lint") {
+        it.next();
+        args.lint = true;
+    }
+
+    while let Some(arg) = it.next() {
+        let Some(s) = arg.to_str().filter(|s| parse_args && s.starts_with('-') && s.len() > 1)
+        else {
+            args.paths.push(arg);
+            continue;
+        };
+
+        // Both `--lang go` and `--lang=go` work.
+        let (flag, inline) = match s.split_once('=') {
+            Some((flag, value)) if flag.starts_with("--") => (flag, Some(value.to_string())),
+            _ => (s, None),
+        };
+        let mut value = |name: &str| {
+            inline
+                .clone()
+                .or_else(|| it.next().and_then(|v| v.into_string().ok()))
+                .ok_or_else(|| format!("option '{name}' requires a value"))
+        };
+
+        match flag {
+            "--" => parse_args = false,
+            "-h" | "--help" => {
+                print_help();
+                return Ok(None);
+            }
+            "-v" | "--version" => {
+                let version = concat!("hl version ", env!("CARGO_PKG_VERSION"), "\n");
+                _ = io::stdout().write_all(version.as_bytes());
+                return Ok(None);
+            }
+            "-l" | "--lang" => {
+                let name = value(flag)?;
+                args.language = Some(
+                    parse_language(&name).ok_or_else(|| format!("unknown language '{name}'"))?,
+                );
+            }
+            "-t" | "--theme" => theme = Some(parse_theme(&value(flag)?)?),
+            "-f" | "--formatter" | "--format" => format = Some(parse_format(&value(flag)?)?),
+            "--color" => color = Some(parse_color(&value(flag)?)?),
+            "--tab-width" => {
+                let width = value(flag)?;
+                let width = width.parse().map_err(|_| format!("invalid tab width '{width}'"))?;
+                tab_width = Some(self::tab_width(width)?);
+            }
+            "--tabs" => args.tabs = parse_tabs(&value(flag)?)?,
+            "--sql-dialect" => sql_dialect = Some(parse_sql_dialect(&value(flag)?)?),
+            "--lang-version" => args.language_version = Some(value(flag)?),
+            "--inject-strings" => {
+                args.string_injections.push(parse_string_injection(&value(flag)?)?);
+            }
+            "--config" => config_path = Some(PathBuf::from(value(flag)?)),
+            "--dump-config" => args.dump_config = true,
+            "-o" | "--output" => args.output = Some(value(flag)?.into()),
+            "-w" | "--watch" => args.watch = true,
+            "--no-clear" => args.clear = false,
+            "--grep" => {
+                let value = value(flag)?;
+                let parsed = Pattern::new(&value)
+                    .map_err(|err| format!("invalid pattern '{value}': {err}"))?;
+                pattern = Some(parsed);
+            }
+            "-A" | "--after-context" => after = Some(context(&value(flag)?)?),
+            "-B" | "--before-context" => before = Some(context(&value(flag)?)?),
+            "-C" | "--context" => {
+                let lines = context(&value(flag)?)?;
+                before = before.or(Some(lines));
+                after = after.or(Some(lines));
+            }
+            "--lines" => {
+                let range = Select::parse_lines(&value(flag)?)?;
+                if matches!(select.replace(range), Some(Select::Region(_))) {
+                    return Err("--lines and --region can't be combined".to_string());
+                }
+            }
+            "--region" => {
+                if let Some(Select::Lines(..)) = select.replace(Select::Region(value(flag)?)) {
+                    return Err("--lines and --region can't be combined".to_string());
+                }
+            }
+            "--region-start" => region_start = Some(value(flag)?),
+            "--region-end" => region_end = Some(value(flag)?),
+            "--dedent" => dedent = true,
+            "-n" | "--line-numbers" => args.line_numbers = true,
+            "--preserve-line-numbers" => preserve_line_numbers = true,
+            "--rainbow-brackets" => args.rainbow_brackets = true,
+            "--copy" => args.copy = Some(parse_copy(&value(flag)?)?),
+            "--clipboard" => args.clipboard = true,
+            "--html-classes" => args.html_classes = true,
+            "--css" => args.css = true,
+            "-r" | "--recursive" => args.recursive = true,
+            "--gitignore" => args.gitignore = true,
+            "--check" => args.check = true,
+            "-y" | "--side-by-side" => args.side_by_side = true,
+            "--port" => {
+                let value = value(flag)?;
+                port = Some(value.parse().map_err(|_| format!("invalid port '{value}'"))?);
+            }
+            "--filter" => args.token_filters.push(Filter::parse(&value(flag)?)?),
+            "--strict" => args.strict = true,
+            "--byte-columns" => args.columns = Columns::Bytes,
+            "--max-errors" => {
+                let max = value(flag)?;
+                args.max_errors =
+                    max.parse().map_err(|_| format!("invalid error count '{max}'"))?;
+            }
+            "-H" | "--with-filename" => args.headers = Some(true),
+            "--no-filename" => args.headers = Some(false),
+            "--list-languages" => args.list = Some(List::Languages),
+            "--list-themes" => args.list = Some(List::Themes),
+            "--json" => args.json = true,
+            "--compare" => args.compare = Some(PathBuf::from(value(flag)?)),
+            "--baseline" => args.baseline = Some(PathBuf::from(value(flag)?)),
+            "--allow" => args.allow = Some(PathBuf::from(value(flag)?)),
+            _ => return Err(format!("unknown option '{s}'")),
+        }
+    }
+
+    // A missing config file is only an error if it was asked for.
+    let required = config_path.is_some();
+    if let Some(path) = config_path.or_else(config::default_path)
+        && let Some(config) = config::load(&path, required)?
+    {
+        args.theme = config.theme.unwrap_or(args.theme);
+        args.format = config.format.unwrap_or(args.format);
+        args.color = config.color.unwrap_or(args.color);
+        args.tab_width = config.tab_width.unwrap_or(args.tab_width);
+        args.region_start = config.region_start.unwrap_or(args.region_start);
+        args.region_end = config.region_end.unwrap_or(args.region_end);
+        args.comment_keywords = config.comment_keywords.unwrap_or(args.comment_keywords);
+        args.languages = config.languages;
+        args.sql_dialect = config.sql_dialect;
+        args.config = Some(path);
+    }
+    args.theme = theme.unwrap_or(args.theme);
+    args.format = format.unwrap_or(args.format);
+    args.color = color.unwrap_or(args.color);
+    args.tab_width = tab_width.unwrap_or(args.tab_width);
+    args.sql_dialect = sql_dialect.or(args.sql_dialect);
+    args.region_start = region_start.unwrap_or(args.region_start);
+    args.region_end = region_end.unwrap_or(args.region_end);
+
+    if args.list.is_some() || args.dump_config || args.css {
+        return Ok(Some(args));
+    }
+    if args.html_classes
+        && (args.format != Format::Html || args.copy.is_some() || args.recursive || args.serve)
+    {
+        return Err(
+            "--html-classes only applies to -f html, without --copy, --recursive or hl serve"
+                .to_string(),
+        );
+    }
+    match pattern {
+        Some(pattern) => {
+            let (before, after) = (before.unwrap_or(0), after.unwrap_or(0));
+            args.grep = Some(Grep { pattern, before, after });
+        }
+        None if args.debug == Some(Debug::Tokens) && (before.is_some() || after.is_some()) => {
+            args.token_context = Some((before.unwrap_or(0), after.unwrap_or(0)));
+        }
+        None if before.is_some() || after.is_some() => {
+            return Err("-A, -B and -C only apply to --grep and hl debug tokens".to_string());
+        }
+        None => {}
+    }
+    if args.grep.is_some() && (args.check || args.recursive) {
+        return Err("--grep can't be combined with --check or --recursive".to_string());
+    }
+    if !args.region_start.contains("{}") {
+        let start = &args.region_start;
+        return Err(format!("invalid region start '{start}', expected {{}} for the name"));
+    }
+    match select {
+        Some(select) => {
+            if args.grep.is_some() || args.check || args.recursive {
+                return Err(
+                    "--lines and --region can't be combined with --grep, --check or --recursive"
+                        .to_string(),
+                );
+            }
+            if dedent && args.format == Format::Json {
+                return Err(
+                    "--dedent doesn't apply to -f json, whose offsets are the file's".to_string()
+                );
+            }
+            // Numbers like in the file are only worth asking for if they're printed.
+            args.line_numbers |= preserve_line_numbers;
+            args.snippet = Some(Snippet { select, dedent, preserve_line_numbers });
+        }
+        None if dedent || preserve_line_numbers => {
+            return Err("--dedent and --preserve-line-numbers only apply to --lines and --region"
+                .to_string());
+        }
+        None => {}
+    }
+    if args.serve {
+        exclusive("serve", &args)?;
+        if args.paths.len() > 1 {
+            return Err("serve takes at most one DIR".to_string());
+        }
+        args.port = port.unwrap_or(args.port);
+        return Ok(Some(args));
+    }
+    if args.bench {
+        exclusive("bench", &args)?;
+        if args.json && args.compare.is_some() {
+            return Err("--compare only applies to the report without --json".to_string());
+        }
+        return Ok(Some(args));
+    } else if args.compare.is_some() {
+        return Err("--compare only applies to hl bench".to_string());
+    }
+    if args.coverage {
+        exclusive("coverage", &args)?;
+        return Ok(Some(args));
+    } else if args.baseline.is_some() {
+        return Err("--baseline only applies to hl coverage".to_string());
+    }
+    if args.lint {
+        exclusive("lint", &args)?;
+        if args.language.is_some() && !args.paths.is_empty() {
+            return Err("lint checks either GRAMMAR files or the grammar of -l LANG".to_string());
+        }
+        if args.language.is_none() && args.paths.is_empty() && io::stdin().is_terminal() {
+            return Err("no input, pass a GRAMMAR file or -l LANG".to_string());
+        }
+        return Ok(Some(args));
+    } else if args.allow.is_some() {
+        return Err("--allow only applies to hl lint".to_string());
+    }
+    if port.is_some() {
+        return Err("--port only applies to hl serve".to_string());
+    }
+    if args.debug.is_some() {
+        exclusive("debug", &args)?;
+    } else if args.strict {
+        return Err("--strict only applies to hl debug".to_string());
+    }
+    if args.columns == Columns::Bytes && args.debug.is_none() && !args.check {
+        return Err("--byte-columns only applies to hl debug and --check".to_string());
+    }
+    if !args.token_filters.is_empty() && args.debug != Some(Debug::Tokens) {
+        return Err("--filter only applies to hl debug tokens".to_string());
+    }
+    if args.diff {
+        exclusive("diff", &args)?;
+        let stdin = args.paths.is_empty() || args.paths.len() == 1 && args.paths[0] == "-";
+        if !stdin && args.paths.len() != 2 {
+            return Err("diff takes two FILEs, or a diff on stdin".to_string());
+        }
+        if matches!(args.format, Format::Html | Format::Json) {
+            return Err("diff only prints to terminals, pass -f ansi, ansi256, truecolor or plain"
+                .to_string());
+        }
+    } else if args.side_by_side {
+        return Err("--side-by-side only applies to hl diff".to_string());
+    }
+    match args.copy {
+        Some(copy) => {
+            if format.is_some() {
+                return Err("--copy picks the format, so it can't be combined with -f".to_string());
+            }
+            if args.paths.len() > 1 || args.watch || args.recursive || args.check {
+                return Err("--copy takes at most one FILE and can't be combined with --watch, \
+                     --recursive or --check"
+                    .to_string());
+            }
+            if args.clipboard && args.output.is_some() {
+                return Err("--clipboard and --output can't be combined".to_string());
+            }
+            args.format = copy;
+        }
+        None if args.clipboard => return Err("--clipboard only applies to --copy".to_string()),
+        None => {}
+    }
+    if args.json && !args.bench {
+        return Err(
+            "--json only applies to --list-languages, --list-themes, hl bench and hl coverage"
+                .to_string(),
+        );
+    }
+    if args.check && (args.watch || args.recursive || args.output.is_some()) {
+        return Err("--check can't be combined with --watch, --recursive or --output".to_string());
+    }
+    if args.watch && (args.paths.len() != 1 || args.paths[0] == "-") {
+        return Err("--watch needs exactly one FILE".to_string());
+    }
+    if args.recursive {
+        if args.watch {
+            return Err("--recursive and --watch can't be combined".to_string());
+        }
+        if args.paths.len() != 1 || args.output.is_none() {
+            return Err("--recursive needs exactly one DIR and an --output directory".to_string());
+        }
+        if args.format != Format::Html {
+            return Err("--recursive only writes HTML, pass -f html".to_string());
+        }
+    }
+    if args.paths.is_empty() && io::stdin().is_terminal() {
+        return Err("no input, pass a FILE or pipe text into hl".to_string());
+    }
+
+    let colored = match args.color {
+        Color::Always => true,
+        Color::Never => false,
+        Color::Auto => {
+            args.output.is_none()
+                && io::stdout().is_terminal()
+                && env::var_os("NO_COLOR").is_none_or(|v| v.is_empty())
+        }
+    };
+    if !colored && args.format.is_ansi() {
+        args.format = Format::Plain;
+    }
+
+    Ok(Some(args))
+}
+
+/// Subcommands print something else than the highlighted files,
+/// so the flags for printing them don't apply.
+fn exclusive(subcommand: &str, args: &Args) -> Result<(), String> {
+    if args.watch
+        || args.recursive
+        || args.check
+        || args.grep.is_some()
+        || args.copy.is_some()
+        || args.output.is_some()
+    {
+        return Err(format!(
+            "{subcommand} can't be combined with --watch, --recursive, --check, --grep, --copy \
+             or --output"
+        ));
+    }
+    Ok(())
+}
+
+fn print_help() {
+    let help = concat!(
+        "Usage: hl [OPTIONS] [FILE]...\n",
+        "       hl --recursive -f html -o OUT [OPTIONS] DIR\n",
+        "       hl --check [OPTIONS] [FILE|DIR]...\n",
+        "       hl debug tokens|states|ndjson [OPTIONS] [FILE]...\n",
+        "       hl diff [--side-by-side] [OPTIONS] [OLD NEW]\n",
+        "       hl serve [--port N] [OPTIONS] [DIR]\n",
+        "       hl bench [--json | --compare OLD.json] [OPTIONS] [FILE|DIR]...\n",
+        "       hl coverage [--json] [--baseline OLD.json] [OPTIONS] [FILE|DIR]...\n",
+        "       hl lint [--allow FILE] [GRAMMAR.json... | -l LANG]\n",
+        "Print FILEs with syntax highlighting. With no FILE, or when FILE is -, read stdin.\n",
+        "hl debug prints every token, or what's open at the start of every line.\n",
+        "hl diff highlights the unified diff on stdin, or the diff between OLD and NEW.\n",
+        "hl serve highlights the files in DIR (default: .) on http://127.0.0.1:8000/.\n",
+        "hl bench times highlighting every file in the DIRs (default: .) per language.\n",
+        "hl coverage prints the lexer rules and scopes those files do and don't exercise.\n",
+        "hl lint checks TextMate grammars, or the one LANG's lexer exports, for problems.\n",
+        "\n",
+        "Options:\n",
+        "    -l, --lang LANG          Highlight as LANG instead of detecting it from the extension\n",
+        "    -t, --theme THEME        dark (default), light, dusk, paper or a VS Code theme.json\n",
+        "    -f, --formatter FORMAT   ansi, ansi256, truecolor, plain, html or json\n",
+        "                             (default: truecolor if $COLORTERM says so, otherwise ansi256)\n",
+        "        --color WHEN         auto (default), always or never. auto colors the output\n",
+        "                             if stdout is a terminal and $NO_COLOR isn't set\n",
+        "    -o, --output FILE        Write to FILE instead of stdout\n",
+        "    -w, --watch              Print FILE again whenever it changes, until it's deleted\n",
+        "        --no-clear           Print a separator between renders instead of clearing the screen\n",
+        "        --grep PATTERN       Only print the lines matching the regular expression PATTERN\n",
+        "    -C, --context N          Also print N lines before and after each match, or the\n",
+        "                             lines of each token and N around them with hl debug tokens\n",
+        "    -A, --after-context N    Also print N lines after each match or token\n",
+        "    -B, --before-context N   Also print N lines before each match or token\n",
+        "    -n, --line-numbers       Print the number of each line in front of it\n",
+        "        --lines FIRST-LAST   Only print these lines, like 40-72 or 40-\n",
+        "        --region NAME        Only print the lines between the comments with\n",
+        "                             [region:NAME] and [endregion]\n",
+        "        --region-start TEXT  The marker that starts a region, with {} for NAME\n",
+        "        --region-end TEXT    The marker that ends a region\n",
+        "        --dedent             Strip the indentation of --lines or --region\n",
+        "        --preserve-line-numbers\n",
+        "                             Number --lines or --region like in the file, not from 1\n",
+        "        --rainbow-brackets   Color brackets by how deeply they're nested\n",
+        "        --copy html|rtf      Print HTML or RTF with the theme's background, to paste\n",
+        "                             into documents and chats\n",
+        "        --clipboard          Put the output of --copy into the clipboard with OSC 52,\n",
+        "                             if the terminal allows it\n",
+        "        --html-classes       Give -f html tok-KIND classes instead of inline styles\n",
+        "        --css                Print the stylesheet for --html-classes in the --theme\n",
+        "        --sql-dialect NAME   Lex SQL as ansi, postgres, mysql, sqlite or mssql\n",
+        "        --lang-version VERSION\n",
+        "                             Highlight the keywords and builtins of that version of\n",
+        "                             the language, like 1.17 for Go before generics\n",
+        "        --inject-strings SUFFIX=LANG\n",
+        "                             Highlight the strings assigned to variables whose names\n",
+        "                             end with SUFFIX as LANG, like Query=sql. Repeatable\n",
+        "        --tab-width N        Expand tabs to N columns (default: 0, which keeps them)\n",
+        "        --tabs MODE          expand (default), or css to keep the tabs in HTML and\n",
+        "                             size them to --tab-width with CSS\n",
+        "        --config FILE        Read defaults from FILE instead of ~/.config/hl/config.toml\n",
+        "        --dump-config        Print the settings from the config file and flags\n",
+        "    -r, --recursive          Write an HTML page per file in DIR and an index per\n",
+        "                             directory into the --output directory\n",
+        "        --gitignore          Skip the files ignored by .gitignore with --recursive\n",
+        "                             or --check\n",
+        "    -y, --side-by-side       Print hl diff in two columns, as wide as the terminal\n",
+        "        --check              Print what the lexers can't make sense of in the FILEs\n",
+        "                             and DIRs instead of highlighting them. Not a parser!\n",
+        "        --max-errors N       Let --check pass with up to N errors (default: 0)\n",
+        "        --filter kind=KIND|payload=NAME\n",
+        "                             Only print the tokens with this kind, like string, or\n",
+        "                             payload, like invalid, with hl debug tokens. Repeatable\n",
+        "        --strict             Fail hl debug, printing what --check would, if that\n",
+        "                             finds anything\n",
+        "        --byte-columns       Count columns in bytes instead of characters with\n",
+        "                             hl debug and --check\n",
+        "    -H, --with-filename      Print a header line with the path before each file\n",
+        "        --no-filename        Never print header lines (default for a single file)\n",
+        "        --list-languages     List the languages with their aliases and extensions\n",
+        "        --list-themes        List the themes and whether they're dark or light\n",
+        "        --json               Print the lists or the bench or coverage report as JSON,\n",
+        "                             see the README\n",
+        "        --compare OLD.json   Print the change from an earlier hl bench --json report\n",
+        "        --baseline OLD.json  Fail hl coverage if a language in an earlier\n",
+        "                             hl coverage --json report lost coverage since\n",
+        "        --allow FILE         Don't print the hl lint warnings FILE lists, a\n",
+        "                             'shadowed|scope-name RULE-PATH' per line\n",
+        "    -h, --help               Print this help message\n",
+        "    -v, --version            Print the version number\n",
+        "\n",
+        "Exit status is 0 on success, 1 for bad arguments, 2 if a file couldn't be read,\n",
+        "3 if --check, --strict or hl coverage --baseline failed, or hl lint found errors,\n",
+        "and 4 if anything else failed, like writing the output or opening hl serve's port.\n",
+    );
+    _ = io::stdout().write_all(help.as_bytes());
+}
+
+fn default_format() -> Format {
+    match env::var("COLORTERM").as_deref() {
+        Ok("truecolor" | "24bit") => Format::TrueColor,
+        _ => Format::Ansi256,
+    }
+}
+
+fn parse_sql_dialect(name: &str) -> Result<SqlDialect, String> {
+    SqlDialect::from_name(name).ok_or_else(|| {
+        let names: Vec<_> = SqlDialect::ALL.iter().map(|d| d.id()).collect();
+        format!("unknown SQL dialect '{name}', expected {}", names.join(", "))
+    })
+}
+
+/// Parses the `SUFFIX=LANG` of `--inject-strings`.
+fn parse_string_injection(value: &str) -> Result<(String, Language), String> {
+    let Some((suffix, name)) = value.split_once('=').filter(|(suffix, _)| !suffix.is_empty())
+    else {
+        return Err(format!("invalid string injection '{value}', expected SUFFIX=LANG"));
+    };
+    let language = parse_language(name).ok_or_else(|| format!("unknown language '{name}'"))?;
+    Ok((suffix.to_string(), language))
+}
+
+fn parse_theme(name: &str) -> Result<Arc<ThemeChoice>, String> {
+    if Path::new(name).extension().is_some_and(|e| e.eq_ignore_ascii_case("json")) {
+        return load_theme_file(name);
+    }
+    builtin_theme(name).ok_or_else(|| {
+        let names: Vec<_> = Theme::BUILTIN.iter().map(|t| t.name).collect();
+        format!("unknown theme '{name}', expected {} or a .json file", names.join(", "))
+    })
+}
+
+/// A theme to highlight with: a builtin one, or one loaded from a VS Code color theme file.
+pub struct ThemeChoice {
+    /// The name of a builtin theme, or the path of a file as it was given,
+    /// so that `--dump-config` writes it back as it was.
+    pub name: String,
+    pub dark: bool,
+    source: ThemeSource,
+}
+
+enum ThemeSource {
+    Builtin(fn() -> Theme),
+    File(Theme),
+}
+
+impl ThemeChoice {
+    pub fn create(&self) -> Theme {
+        match &self.source {
+            ThemeSource::Builtin(create) => create(),
+            ThemeSource::File(theme) => theme.clone(),
+        }
+    }
+
+    /// Returns the theme as it is now: loaded again if it came from a file
+    /// that has changed since, or else this one.
+    pub fn reload(self: &Arc<Self>) -> Result<Arc<Self>, String> {
+        match self.source {
+            ThemeSource::Builtin(_) => Ok(self.clone()),
+            ThemeSource::File(_) => load_theme_file(&self.name),
+        }
+    }
+}
+
+/// [`Theme::BUILTIN`], as choices.
+static BUILTIN_THEMES: LazyLock<Vec<Arc<ThemeChoice>>> = LazyLock::new(|| {
+    Theme::BUILTIN
+        .iter()
+        .map(|t| {
+            let source = ThemeSource::Builtin(t.create);
+            Arc::new(ThemeChoice { name: t.name.to_string(), dark: t.dark, source })
+        })
+        .collect()
+});
+
+/// Returns the builtin theme called `name`, ignoring case.
+fn builtin_theme(name: &str) -> Option<Arc<ThemeChoice>> {
+    BUILTIN_THEMES.iter().find(|t| t.name.eq_ignore_ascii_case(name)).cloned()
+}
+
+/// A theme loaded from a file, and when the file was last modified at the time.
+struct ThemeFile {
+    /// The canonical path, so that each file has one entry however it's spelled.
+    path: PathBuf,
+    modified: SystemTime,
+    theme: Arc<ThemeChoice>,
+}
+
+/// The themes loaded from files, so that each is parsed again only once it has changed.
+static THEME_FILES: Mutex<Vec<ThemeFile>> = Mutex::new(Vec::new());
+
+/// Loads a VS Code color theme for `--theme FILE.json`, or returns the one loaded before
+/// if the file hasn't been modified since.
+fn load_theme_file(path: &str) -> Result<Arc<ThemeChoice>, String> {
+    let canonical = fs::canonicalize(path).map_err(|e| format!("{path}: {e}"))?;
+    let modified =
+        fs::metadata(&canonical).and_then(|m| m.modified()).map_err(|e| format!("{path}: {e}"))?;
+    let mut themes = THEME_FILES.lock().unwrap();
+    let cached = themes.iter().position(|f| f.path == canonical);
+    if let Some(i) = cached
+        && themes[i].modified == modified
+    {
+        return Ok(themes[i].theme.clone());
+    }
+    let json = fs::read_to_string(&canonical).map_err(|e| format!("{path}: {e}"))?;
+    let theme = TextMateTheme::parse(&json).map_err(|e| format!("{path}: {e}"))?;
+    let theme = Arc::new(ThemeChoice {
+        name: path.to_string(),
+        dark: theme.is_dark(),
+        source: ThemeSource::File(theme.to_theme()),
+    });
+    let file = ThemeFile { path: canonical, modified, theme: theme.clone() };
+    match cached {
+        Some(i) => themes[i] = file,
+        None => themes.push(file),
+    }
+    Ok(theme)
+}
+
+fn parse_format(name: &str) -> Result<Format, String> {
+    Format::from_name(name)
+        .ok_or_else(|| format!("unknown formatter '{name}', expected {}", Format::NAMES.join(", ")))
+}
+
+fn parse_copy(name: &str) -> Result<Format, String> {
+    match name {
+        "html" => Ok(Format::Html),
+        "rtf" => Ok(Format::Rtf),
+        _ => Err(format!("unknown --copy format '{name}', expected html or rtf")),
+    }
+}
+
+fn parse_color(when: &str) -> Result<Color, String> {
+    match when {
+        "auto" => Ok(Color::Auto),
+        "always" => Ok(Color::Always),
+        "never" => Ok(Color::Never),
+        _ => Err(format!("unknown color mode '{when}', expected auto, always or never")),
+    }
+}
+
+fn parse_tabs(mode: &str) -> Result<Tabs, String> {
+    match mode {
+        "expand" => Ok(Tabs::Expand),
+        "css" => Ok(Tabs::Css),
+        _ => Err(format!("unknown tab mode '{mode}', expected expand or css")),
+    }
+}
+
+fn tab_width(width: i64) -> Result<CoordType, String> {
+    match CoordType::try_from(width) {
+        Ok(width @ 0..=MAX_TAB_WIDTH) => Ok(width),
+        _ => Err(format!("invalid tab width {width}, expected 0 to {MAX_TAB_WIDTH}")),
+    }
+}
+
+fn context(lines: &str) -> Result<usize, String> {
+    lines.parse().map_err(|_| format!("invalid context length '{lines}'"))
+}
+
+/// Resolves `--lang` by display name, name, alias or extension. Unlike
+/// [`Language::from_name`], unknown names are an error instead of plain text.
+fn parse_language(name: &str) -> Option<Language> {
+    let lower = name.to_lowercase();
+    Language::ALL.iter().copied().find(|l| {
+        l.name().eq_ignore_ascii_case(name)
+            || l.id() == lower
+            || l.aliases().contains(&lower.as_str())
+            || l.extensions().contains(&lower.as_str())
+    })
+}
+
+/// Highlights every file to stdout or `--output`. Returns whether all of them could be read.
+fn run(args: Args) -> io::Result<bool> {
+    let stdin = [OsString::from("-")];
+    let paths = if args.paths.is_empty() { &stdin[..] } else { &args.paths[..] };
+    let headers = args.headers.unwrap_or(paths.len() > 1);
+
+    // With --clipboard, the output is sent to the terminal as a whole at the end.
+    let mut clipboard = Vec::new();
+    let out: Box<dyn Write> = match &args.output {
+        Some(output) => Box::new(create(output)?),
+        None if args.clipboard => Box::new(&mut clipboard),
+        None => Box::new(io::stdout().lock()),
+    };
+    let mut out = Formatter::new(BufWriter::new(out), args.format)
+        .with_tab_width(args.tab_width)
+        .with_tabs(args.tabs)
+        .with_classes(args.html_classes);
+    if args.copy.is_some() {
+        out = out.with_page_colors(args.theme.dark);
+    }
+    let mut all_read = true;
+
+    for path in paths {
+        all_read &= highlight_input(&mut out, &args, path, headers)?;
+    }
+
+    if args.clipboard {
+        out.into_inner().flush()?;
+        let mut stdout = io::stdout().lock();
+        stdout.write_all(&clipboard::osc52(&clipboard, Multiplexer::detect())?)?;
+        stdout.flush()?;
+    }
+    Ok(all_read)
+}
+
+/// Highlights the file at `path`, or stdin for `-`, as it's read, unless the output needs
+/// all of it at once, see [`streams`]. Returns whether it could be read, after saying why
+/// not if it couldn't.
+fn highlight_input<W: Write>(
+    out: &mut Formatter<W>,
+    args: &Args,
+    path: &OsStr,
+    header: bool,
+) -> io::Result<bool> {
+    let display = if path == "-" { "(standard input)".into() } else { path.to_string_lossy() };
+    let unreadable = |err: io::Error| {
+        eprintln!("hl: {display}: {err}");
+        Ok(false)
+    };
+    let mut input: Box<dyn Read> = if path == "-" {
+        Box::new(io::stdin().lock())
+    } else {
+        match File::open(path) {
+            Ok(file) => Box::new(file),
+            Err(err) => return unreadable(err),
+        }
+    };
+
+    // The start tells the encoding and, unless the name does, the language,
+    // and it's all there is of most files.
+    let mut head = Vec::new();
+    if let Err(err) = input.by_ref().take(HEAD_LEN).read_to_end(&mut head) {
+        return unreadable(err);
+    }
+    let (encoding, bom) = detect_encoding(&head);
+    let language = args.language.unwrap_or_else(|| detect_language(args, Path::new(path), &head));
+    let theme = args.theme.create();
+    let mut highlighter = SyntaxHighlighter::new(language, theme.clone());
+    highlighter.set_options(highlight_options(args, Path::new(path)));
+    if !streams(args) || encoding != SourceEncoding::Utf8 || !highlighter.streams() {
+        if let Err(err) = input.read_to_end(&mut head) {
+            return unreadable(err);
+        }
+        highlight(out, args, &args.theme, path, header, &head)?;
+        return Ok(true);
+    }
+
+    out.begin_file(&display, language, header)?;
+    let reader = BufReader::new(head[bom..].chain(input));
+    // Whether the error that stopped it, if any, was one of the output.
+    let mut written = true;
+    let (options, cancel) = (StreamOptions::default(), AtomicBool::new(false));
+    let read = highlighter.highlight_reader(reader, &options, &cancel, |line| {
+        for_each_token(line.text, line.tokens, |token| {
+            out.token(&line.text[token.span.clone()], token, theme.token_style(token))
+        })
+        .inspect_err(|_| written = false)
+    });
+    for warning in highlighter.warnings() {
+        eprintln!("hl: {display}: warning: {warning}");
+    }
+    match read {
+        Err(err) if !written => Err(err),
+        read => {
+            out.end_file()?;
+            read.map_or_else(unreadable, |_| Ok(true))
+        }
+    }
+}
+
+/// Whether files can be highlighted as they're read, for plain and ANSI output. HTML, RTF
+/// and JSON are written as a whole, and `--grep`, `--snippet` and `--line-numbers` need to
+/// know about all the lines first. So do rainbow brackets and other filters that need all
+/// of the text, which the highlighter [tells](SyntaxHighlighter::streams).
+fn streams(args: &Args) -> bool {
+    matches!(args.format, Format::Ansi | Format::Ansi256 | Format::TrueColor | Format::Plain)
+        && args.grep.is_none()
+        && args.snippet.is_none()
+        && !args.line_numbers
+}
+
+/// Highlights the one file again whenever it changes. The screen is cleared between
+/// renders, and `--output` is replaced, so that there's only ever the latest version.
+fn run_watch(args: Args) -> io::Result<bool> {
+    let path = Path::new(&args.paths[0]);
+    if let Err(err) = fs::metadata(path) {
+        eprintln!("hl: {}: {err}", path.display());
+        return Ok(false);
+    }
+
+    let headers = args.headers.unwrap_or(false);
+    let clear = args.clear && io::stdout().is_terminal();
+    let stdout = BufWriter::new(io::stdout().lock());
+    let mut stdout = Formatter::new(stdout, args.format)
+        .with_tab_width(args.tab_width)
+        .with_tabs(args.tabs)
+        .with_classes(args.html_classes);
+    let mut renders = 0;
+
+    watch::watch(path, |input| {
+        if let Some(output) = &args.output {
+            // Written next to the output and then renamed over it, so that a browser
+            // reloading the page never sees half of it.
+            let mut temp = output.clone();
+            temp.push(".tmp");
+            let out = BufWriter::new(create(&temp)?);
+            let mut out = Formatter::new(out, args.format)
+                .with_tab_width(args.tab_width)
+                .with_tabs(args.tabs)
+                .with_classes(args.html_classes);
+            highlight(&mut out, &args, &args.theme, path.as_os_str(), headers, input)?;
+            drop(out);
+            return fs::rename(&temp, output);
+        }
+
+        if renders > 0 {
+            if clear { stdout.clear_screen()? } else { stdout.separator()? }
+        }
+        renders += 1;
+        highlight(&mut stdout, &args, &args.theme, path.as_os_str(), headers, input)
+    })?;
+
+    Ok(true)
+}
+
+/// Prints the rules for `--html-classes` in the colors of `--theme`.
+fn print_css(args: &Args) -> io::Result<()> {
+    let css = format::stylesheet(&args.theme.create(), args.theme.dark);
+    io::stdout().lock().write_all(css.as_bytes())
+}
+
+/// Highlights the one directory into a tree of HTML pages.
+fn run_tree(args: Args) -> io::Result<bool> {
+    let output = args.output.as_deref().unwrap_or_default();
+    tree::run(&args, Path::new(&args.paths[0]), Path::new(output))
+}
+
+/// Serves the one directory, or the current one, until the process is stopped.
+fn run_serve(args: Args) -> io::Result<bool> {
+    let root = args.paths.first().map_or(Path::new("."), Path::new);
+    serve::run(&args, root, args.port)?;
+    Ok(true)
+}
+
+/// Like [`File::create`], but the error mentions the path.
+fn create(path: &OsStr) -> io::Result<File> {
+    File::create(path)
+        .map_err(|err| io::Error::new(err.kind(), format!("{}: {err}", path.to_string_lossy())))
+}
+
+/// Highlights the contents of one file, which were read from `path`.
+/// `theme` is usually `args.theme`, except where a request picks its own.
+fn highlight<W: Write>(
+    out: &mut Formatter<W>,
+    args: &Args,
+    theme: &ThemeChoice,
+    path: &OsStr,
+    header: bool,
+    input: &[u8],
+) -> io::Result<()> {
+    let display = if path == "-" { "(standard input)".into() } else { path.to_string_lossy() };
+    let text = transcode(input).text;
+    let language = args.language.unwrap_or_else(|| detect_language(args, Path::new(path), &text));
+    let theme = theme.create();
+    let mut highlighter = SyntaxHighlighter::new(language, theme.clone());
+    highlighter.set_options(highlight_options(args, Path::new(path)));
+    highlighter.update(&text, true);
+    for warning in highlighter.warnings() {
+        eprintln!("hl: {display}: warning: {warning}");
+    }
+    write_tokens(out, args, &theme, &display, language, header, &text, highlighter.tokens())
+}
+
+/// Writes the `tokens` of `text`, as [`highlight`] highlighted them,
+/// with the `--grep`, `--snippet` and `--line-numbers` of `args`.
+#[allow(clippy::too_many_arguments)]
+fn write_tokens<W: Write>(
+    out: &mut Formatter<W>,
+    args: &Args,
+    theme: &Theme,
+    display: &str,
+    language: Language,
+    header: bool,
+    text: &[u8],
+    tokens: &[Token],
+) -> io::Result<()> {
+    // With --grep, files without a match are left out entirely, header and all.
+    let mut selection = args.grep.as_ref().map(|grep| grep.select(text));
+    if selection.as_ref().is_some_and(|selection| selection.is_empty()) {
+        return Ok(());
+    }
+    let markers = [args.region_start.as_str(), args.region_end.as_str()];
+    let mut extract = match &args.snippet {
+        Some(snippet) => Some(snippet.extract(text, markers).map_err(|err| {
+            io::Error::new(io::ErrorKind::InvalidInput, format!("{display}: {err}"))
+        })?),
+        None => None,
+    };
+
+    out.begin_file(display, language, header)?;
+    if args.line_numbers {
+        let lines = match &extract {
+            Some(extract) => extract.line_numbers(),
+            None => 1..=text.split(|&b| b == b'\n').count(),
+        };
+        out.number_lines(*lines.start(), *lines.end());
+    }
+    let mut write = |out: &mut Formatter<W>, token: &Token| match (&mut selection, &mut extract) {
+        (Some(selection), _) => selection.token(out, text, token, theme),
+        (None, Some(extract)) => extract.token(out, text, token, theme),
+        (None, None) => out.token(&text[token.span.clone()], token, theme.token_style(token)),
+    };
+    for_each_token(text, tokens, |token| write(out, token))?;
+    out.end_file()
+}
+
+/// Calls `write` with each of the `tokens` of `text`, and with the gaps between them as
+/// whitespace, so no text gets lost.
+fn for_each_token(
+    text: &[u8],
+    tokens: &[Token],
+    mut write: impl FnMut(&Token) -> io::Result<()>,
+) -> io::Result<()> {
+    let mut pos = 0;
+    for token in tokens {
+        if pos < token.span.start {
+            write(&Token::new(TokenKind::Whitespace, pos..token.span.start))?;
+        }
+        write(token)?;
+        pos = pos.max(token.span.end);
+    }
+    if pos < text.len() {
+        write(&Token::new(TokenKind::Whitespace, pos..text.len()))?;
+    }
+    Ok(())
+}
+
+/// The post-processing `hl` wants, and the SQL dialect from the extension, like `.psql`,
+/// or else `--sql-dialect`. A `-- dialect:` comment in the file beats both.
+fn highlight_options(args: &Args, path: &Path) -> HighlightOptions {
+    let ext = path.extension().and_then(|ext| ext.to_str());
+    HighlightOptions {
+        rainbow_brackets: args.rainbow_brackets,
+        escapes: true,
+        inactive_code: true,
+        comment_keywords: args.comment_keywords.clone(),
+        sql_dialect: ext.and_then(SqlDialect::from_extension).or(args.sql_dialect),
+        language_version: args.language_version.clone(),
+        injections: true,
+        string_injections: args.string_injections.clone(),
+        ..Default::default()
+    }
+}
+
+/// Detects the language from the file name, and otherwise from the content,
+/// e.g. for stdin or scripts without an extension, see `edit::syntax::detect_language`.
+/// The config file's `[languages]` come first.
+fn detect_language(args: &Args, path: &Path, text: &[u8]) -> Language {
+    configured_language(args, path).unwrap_or_else(|| {
+        let name = path.file_name().and_then(|name| name.to_str()).unwrap_or_default();
+        edit::syntax::detect_language(name, text).language
+    })
+}
+
+/// The language the config file's `[languages]` give the extension of `path`, if any.
+fn configured_language(args: &Args, path: &Path) -> Option<Language> {
+    let ext = path.extension().and_then(|ext| ext.to_str())?;
+    args.languages.iter().find(|(e, _)| e.eq_ignore_ascii_case(ext)).map(|&(_, language)| language)
+}
@@ -0,0 +1,191 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//! The shortest edit script between two sequences, after Eugene Myers'
+//! "An O(ND) Difference Algorithm and Its Variations".
+//!
+//! `hl diff` uses it for the lines of two files and for the words of two lines.
+//! The common prefix and suffix are split off first, since that's all most edits are.
+
+use std::ops::Range;
+
+/// Beyond this many differences, the rest is treated as replaced wholesale. The search
+/// keeps every round to walk back through, which takes quadratic memory in this number.
+const MAX_DIFFERENCES: usize = 2000;
+
+/// One step of turning `a` into `b`.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Edit {
+    /// `a[i]` and `b[j]` are the same.
+    Keep(usize, usize),
+    /// `a[i]` is removed.
+    Remove(usize),
+    /// `b[j]` is added.
+    Add(usize),
+}
+
+impl Edit {
+    pub fn is_keep(self) -> bool {
+        matches!(self, Self::Keep(..))
+    }
+}
+
+/// Returns the steps to turn `a` into `b`, in order, with as few removes and adds as possible.
+pub fn diff<T: PartialEq>(a: &[T], b: &[T]) -> Vec<Edit> {
+    let prefix = a.iter().zip(b).take_while(|(x, y)| x == y).count();
+    let suffix =
+        a[prefix..].iter().rev().zip(b[prefix..].iter().rev()).take_while(|(x, y)| x == y).count();
+
+    let mut edits: Vec<_> = (0..prefix).map(|i| Edit::Keep(i, i)).collect();
+    let (a_end, b_end) = (a.len() - suffix, b.len() - suffix);
+    let middle = shortest(&a[prefix..a_end], &b[prefix..b_end]);
+    edits.extend(middle.into_iter().map(|edit| match edit {
+        Edit::Keep(i, j) => Edit::Keep(prefix + i, prefix + j),
+        Edit::Remove(i) => Edit::Remove(prefix + i),
+        Edit::Add(j) => Edit::Add(prefix + j),
+    }));
+    edits.extend((0..suffix).map(|i| Edit::Keep(a_end + i, b_end + i)));
+    edits
+}
+
+/// Groups `edits` into hunks: the ranges of edits with changes, each with up to
+/// `context` kept steps around them. Hunks whose contexts would touch are merged.
+pub fn hunks(edits: &[Edit], context: usize) -> Vec<Range<usize>> {
+    let mut hunks: Vec<Range<usize>> = Vec::new();
+    for (i, _) in edits.iter().enumerate().filter(|(_, edit)| !edit.is_keep()) {
+        match hunks.last_mut() {
+            Some(hunk) if hunk.end + 2 * context >= i => hunk.end = i + 1,
+            _ => hunks.push(i..i + 1),
+        }
+    }
+    for hunk in &mut hunks {
+        *hunk = hunk.start.saturating_sub(context)..(hunk.end + context).min(edits.len());
+    }
+    hunks
+}
+
+/// The forward search of the paper, for sequences without a common prefix or suffix.
+fn shortest<T: PartialEq>(a: &[T], b: &[T]) -> Vec<Edit> {
+    let (n, m) = (a.len() as isize, b.len() as isize);
+    let max = (a.len() + b.len()).min(MAX_DIFFERENCES) as isize;
+    // `v[k + max]` is the furthest `x` reached on diagonal `k = x - y`.
+    let mut v = vec![0isize; 2 * max as usize + 2];
+    let index = |k: isize| (k + max) as usize;
+    // The state before each round, to walk back through.
+    let mut trace = Vec::new();
+    let mut found = None;
+
+    'search: for d in 0..=max {
+        trace.push(v[index(-d)..=index(d)].to_vec());
+        for k in (-d..=d).step_by(2) {
+            let mut x = if k == -d || (k != d && v[index(k - 1)] < v[index(k + 1)]) {
+                v[index(k + 1)]
+            } else {
+                v[index(k - 1)] + 1
+            };
+            let mut y = x - k;
+            while x < n && y < m && a[x as usize] == b[y as usize] {
+                x += 1;
+                y += 1;
+            }
+            v[index(k)] = x;
+            if x >= n && y >= m {
+                found = Some(d);
+                break 'search;
+            }
+        }
+    }
+    let Some(distance) = found else {
+        let mut edits: Vec<_> = (0..a.len()).map(Edit::Remove).collect();
+        edits.extend((0..b.len()).map(Edit::Add));
+        return edits;
+    };
+
+    let mut edits = Vec::new();
+    let (mut x, mut y) = (n, m);
+    for d in (0..=distance).rev() {
+        // `trace[d]` covers the diagonals `-d..=d`.
+        let v = |k: isize| trace[d as usize][(k + d) as usize];
+        let k = x - y;
+        let previous = if k == -d || (k != d && v(k - 1) < v(k + 1)) { k + 1 } else { k - 1 };
+        let (px, py) = if d == 0 { (0, 0) } else { (v(previous), v(previous) - previous) };
+        while x > px && y > py {
+            x -= 1;
+            y -= 1;
+            edits.push(Edit::Keep(x as usize, y as usize));
+        }
+        if d > 0 {
+            if x == px {
+                y -= 1;
+                edits.push(Edit::Add(y as usize));
+            } else {
+                x -= 1;
+                edits.push(Edit::Remove(x as usize));
+            }
+        }
+    }
+    edits.reverse();
+    edits
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    /// Applies `edits` to `a` and checks that they make `b`, then counts the changes.
+    fn changes(a: &str, b: &str) -> usize {
+        let (a, b): (Vec<_>, Vec<_>) = (a.chars().collect(), b.chars().collect());
+        let edits = diff(&a, &b);
+        let mut result = Vec::new();
+        let (mut i, mut j) = (0, 0);
+        for edit in &edits {
+            match *edit {
+                Edit::Keep(x, y) => {
+                    assert_eq!((x, y, a[x]), (i, j, b[y]));
+                    result.push(a[x]);
+                    (i, j) = (i + 1, j + 1);
+                }
+                Edit::Remove(x) => {
+                    assert_eq!(x, i);
+                    i += 1;
+                }
+                Edit::Add(y) => {
+                    assert_eq!(y, j);
+                    result.push(b[y]);
+                    j += 1;
+                }
+            }
+        }
+        assert_eq!((result, i), (b, a.len()));
+        edits.iter().filter(|edit| !edit.is_keep()).count()
+    }
+
+    #[test]
+    fn test_diff() {
+        assert_eq!(changes("", ""), 0);
+        assert_eq!(changes("abc", "abc"), 0);
+        assert_eq!(changes("", "abc"), 3);
+        assert_eq!(changes("abc", ""), 3);
+        // The example from the paper.
+        assert_eq!(changes("abcabba", "cbabac"), 5);
+        assert_eq!(changes("xaxbxcx", "yaybycy"), 8);
+        assert_eq!(changes("kitten", "sitting"), 5);
+    }
+
+    #[test]
+    fn test_hunks() {
+        let a: Vec<_> = (0..20).collect();
+        let mut b = a.clone();
+        b[2] = 100;
+        b[9] = 101;
+        b[18] = 102;
+        let edits = diff(&a, &b);
+        // The first two changes are 6 apart, so their contexts of 3 touch.
+        let hunks = hunks(&edits, 3);
+        assert_eq!(hunks.len(), 2);
+        assert!(edits[hunks[0].start].is_keep() && hunks[0].start == 0);
+        assert_eq!(hunks[1].end, edits.len());
+        assert_eq!(hunks[1].clone().filter(|&i| !edits[i].is_keep()).count(), 2);
+        assert!(super::hunks(&diff(&a, &a), 3).is_empty());
+    }
+}
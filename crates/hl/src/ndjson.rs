@@ -0,0 +1,401 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//! `hl debug ndjson`: the tokens as newline-delimited JSON, for tools that aren't written in Rust.
+//!
+//! Every file starts with a header record, `{"version":1,"language":"go","file":"main.go"}`,
+//! followed by one record per token:
+//!
+//! ```text
+//! {"line":3,"start_col":5,"end_col":11,"scope":"keyword"}
+//! {"line":7,"start_col":1,"end_line":9,"end_col":3,"scope":"comment"}
+//! {"line":12,"start_col":14,"end_col":16,"scope":"escape","mods":["Invalid"]}
+//! ```
+//!
+//! Lines and columns are 1-based, and columns count characters, or bytes with
+//! `--byte-columns`. `end_col` is the column after the
+//! token, on `end_line` if the token ends on another line than it starts. `scope` is the
+//! kind as in `hl debug tokens`, and `mods` the payload, if there is one. Whitespace is
+//! included, so that the records cover the whole file.
+//!
+//! The schema is documented in the README. Keep it backwards compatible and bump
+//! [`SCHEMA_VERSION`] if that's impossible. New optional fields need no bump.
+
+use std::io::{self, Write};
+
+use edit::syntax::{Columns, Language, LineIndex, Token};
+
+use crate::format::{json_escape, kind_name};
+
+/// The `version` field of the header records.
+pub const SCHEMA_VERSION: u32 = 1;
+
+/// The record of a token.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct TokenRecord {
+    pub line: usize,
+    pub start_col: usize,
+    /// The line the token ends on, `line` if that's the same.
+    pub end_line: usize,
+    /// The column after the token on `end_line`.
+    pub end_col: usize,
+    /// The kind, like `keyword` or `string`.
+    pub scope: String,
+    /// The payload, like `Invalid` or `DocMarkup(Link)`.
+    pub mods: Vec<String>,
+}
+
+/// Writes the records of one file, token by token, so that they don't have to be
+/// collected first.
+pub struct Encoder<'a, W: Write> {
+    out: W,
+    text: &'a [u8],
+    lines: LineIndex,
+    columns: Columns,
+}
+
+impl<'a, W: Write> Encoder<'a, W> {
+    /// Writes the header of the file `text` is the content of.
+    pub fn new(
+        mut out: W,
+        language: Language,
+        file: &str,
+        text: &'a [u8],
+        columns: Columns,
+    ) -> io::Result<Self> {
+        writeln!(
+            out,
+            "{{\"version\":{SCHEMA_VERSION},\"language\":\"{}\",\"file\":\"{}\"}}",
+            json_escape(language.id()),
+            json_escape(file)
+        )?;
+        Ok(Self { out, text, lines: LineIndex::new(text), columns })
+    }
+
+    /// Writes the record of the next token. Tokens must come in the order of the text.
+    pub fn token(&mut self, token: &Token) -> io::Result<()> {
+        let (line, start_col) = self.lines.position(self.text, token.span.start, self.columns);
+        let (end_line, end_col) = self.lines.position(self.text, token.span.end, self.columns);
+        let record = TokenRecord {
+            line: line + 1,
+            start_col: start_col + 1,
+            end_line: end_line + 1,
+            end_col: end_col + 1,
+            scope: kind_name(token.kind),
+            mods: token.payload.iter().map(|p| format!("{p:?}")).collect(),
+        };
+        write_token(&mut self.out, &record)
+    }
+
+    /// Returns the writer, e.g. for the next file.
+    pub fn into_inner(self) -> W {
+        self.out
+    }
+}
+
+/// Writes all `tokens` of `text` with the header before them.
+pub fn encode<'t, W: Write>(
+    out: W,
+    language: Language,
+    file: &str,
+    text: &[u8],
+    tokens: impl IntoIterator<Item = &'t Token>,
+    columns: Columns,
+) -> io::Result<W> {
+    let mut encoder = Encoder::new(out, language, file, text, columns)?;
+    for token in tokens {
+        encoder.token(token)?;
+    }
+    Ok(encoder.into_inner())
+}
+
+fn write_token(out: &mut impl Write, record: &TokenRecord) -> io::Result<()> {
+    write!(out, "{{\"line\":{},\"start_col\":{}", record.line, record.start_col)?;
+    if record.end_line != record.line {
+        write!(out, ",\"end_line\":{}", record.end_line)?;
+    }
+    write!(out, ",\"end_col\":{},\"scope\":\"{}\"", record.end_col, json_escape(&record.scope))?;
+    if !record.mods.is_empty() {
+        let mods: Vec<_> = record.mods.iter().map(|m| format!("\"{}\"", json_escape(m))).collect();
+        write!(out, ",\"mods\":[{}]", mods.join(","))?;
+    }
+    writeln!(out, "}}")
+}
+
+#[cfg(test)]
+mod tests {
+    use std::fs;
+    use std::io::BufRead;
+    use std::path::Path;
+
+    use edit::json;
+    use edit::syntax::SyntaxHighlighter;
+    use stdext::arena::Arena;
+
+    use super::*;
+    use crate::{Args, detect_language, highlight_options};
+
+    // Only the tests read the records back. Other tools have JSON parsers of their own.
+
+    /// The space for parsing one line. Records are short, so this only runs out for garbage.
+    const LINE_ARENA_SIZE: usize = 1024 * 1024;
+
+    /// The record that starts every file.
+    #[derive(Debug, Clone, PartialEq, Eq)]
+    struct Header {
+        pub version: u32,
+        /// The id of the language, like `go`, see [`Language::id`].
+        pub language: String,
+        /// The path as given, or `-` for stdin.
+        pub file: String,
+    }
+
+    /// A line of the stream.
+    #[derive(Debug, Clone, PartialEq, Eq)]
+    enum Record {
+        Header(Header),
+        Token(TokenRecord),
+    }
+
+    /// Reads the records back one line at a time. Fails on the first line that isn't a record,
+    /// a header with another version, and tokens before the first header.
+    struct Decoder<R: BufRead> {
+        input: R,
+        line: String,
+        line_number: usize,
+        seen_header: bool,
+        arena: Arena,
+    }
+
+    impl<R: BufRead> Decoder<R> {
+        fn new(input: R) -> io::Result<Self> {
+            Ok(Self {
+                input,
+                line: String::new(),
+                line_number: 0,
+                seen_header: false,
+                arena: Arena::new(LINE_ARENA_SIZE)?,
+            })
+        }
+
+        fn record(&mut self) -> Result<Record, String> {
+            let offset = self.arena.offset();
+            let record = json::parse(&self.arena, &self.line)
+                .map_err(|e| e.to_string())
+                .and_then(|value| parse_record(value.as_object().ok_or("not an object")?));
+            // SAFETY: The record was copied out of the JSON value, so nothing points into the
+            // arena past `offset` anymore.
+            unsafe { self.arena.reset(offset) };
+
+            let record = record?;
+            match &record {
+                Record::Header(header) if header.version != SCHEMA_VERSION => {
+                    Err(format!("expected version {SCHEMA_VERSION}, found {}", header.version))
+                }
+                Record::Token(_) if !self.seen_header => Err("token before the header".to_string()),
+                _ => {
+                    self.seen_header = true;
+                    Ok(record)
+                }
+            }
+        }
+    }
+
+    impl<R: BufRead> Iterator for Decoder<R> {
+        type Item = io::Result<Record>;
+
+        fn next(&mut self) -> Option<Self::Item> {
+            self.line.clear();
+            match self.input.read_line(&mut self.line) {
+                Ok(0) => return None,
+                Ok(_) => self.line_number += 1,
+                Err(err) => return Some(Err(err)),
+            }
+            Some(self.record().map_err(|message| {
+                io::Error::new(
+                    io::ErrorKind::InvalidData,
+                    format!("line {}: {message}", self.line_number),
+                )
+            }))
+        }
+    }
+
+    /// Headers are told apart by their `version`.
+    fn parse_record(object: json::Object) -> Result<Record, String> {
+        let number = |key| -> Result<usize, String> {
+            let n = object.get_number(key).ok_or_else(|| format!("no number `{key}`"))?;
+            if n < 0.0 || n.fract() != 0.0 {
+                return Err(format!("`{key}` is not a count"));
+            }
+            Ok(n as usize)
+        };
+        let string = |key| -> Result<String, String> {
+            Ok(object.get_str(key).ok_or_else(|| format!("no string `{key}`"))?.to_string())
+        };
+
+        if object.get("version").is_some() {
+            return Ok(Record::Header(Header {
+                version: number("version")?.try_into().map_err(|_| "`version` is too large")?,
+                language: string("language")?,
+                file: string("file")?,
+            }));
+        }
+
+        let line = number("line")?;
+        let mut mods = Vec::new();
+        if let Some(value) = object.get("mods") {
+            for m in value.as_array().ok_or("`mods` is not an array")? {
+                mods.push(m.as_str().ok_or("`mods` has a non-string")?.to_string());
+            }
+        }
+        Ok(Record::Token(TokenRecord {
+            line,
+            start_col: number("start_col")?,
+            end_line: if object.get("end_line").is_some() { number("end_line")? } else { line },
+            end_col: number("end_col")?,
+            scope: string("scope")?,
+            mods,
+        }))
+    }
+
+    fn decode(input: &str) -> io::Result<Vec<Record>> {
+        Decoder::new(input.as_bytes())?.collect()
+    }
+
+    fn token(line: usize, start_col: usize, end_col: usize, scope: &str) -> Record {
+        Record::Token(TokenRecord {
+            line,
+            start_col,
+            end_line: line,
+            end_col,
+            scope: scope.to_string(),
+            mods: Vec::new(),
+        })
+    }
+
+    /// The field names are what other tools parse. Changing one breaks them, so this
+    /// test may only change along with [`SCHEMA_VERSION`].
+    #[test]
+    fn test_schema() {
+        assert_eq!(SCHEMA_VERSION, 1);
+
+        let text = b"/* a\n */ \"\\q\"";
+        let mut highlighter = SyntaxHighlighter::new(Language::Go, Default::default());
+        highlighter.set_options(highlight_options(&Args::default(), Path::new("a.go")));
+        highlighter.update(text, true);
+        let out =
+            encode(Vec::new(), Language::Go, "a\"b.go", text, highlighter.tokens(), Columns::Chars)
+                .unwrap();
+        assert_eq!(
+            String::from_utf8(out).unwrap(),
+            concat!(
+                "{\"version\":1,\"language\":\"go\",\"file\":\"a\\\"b.go\"}\n",
+                "{\"line\":1,\"start_col\":1,\"end_line\":2,\"end_col\":4,\"scope\":\"comment\"}\n",
+                "{\"line\":2,\"start_col\":4,\"end_col\":5,\"scope\":\"whitespace\"}\n",
+                "{\"line\":2,\"start_col\":5,\"end_col\":6,\"scope\":\"string\"}\n",
+                "{\"line\":2,\"start_col\":6,\"end_col\":8,\"scope\":\"escape\",\"mods\":[\"Invalid\"]}\n",
+                "{\"line\":2,\"start_col\":8,\"end_col\":9,\"scope\":\"string\"}\n",
+            )
+        );
+    }
+
+    #[test]
+    fn test_decode() {
+        // Any order of the fields, unknown fields, and a missing trailing newline are fine.
+        let records = decode(concat!(
+            "{\"file\":\"-\",\"language\":\"rust\",\"version\":1,\"generator\":\"hl\"}\n",
+            "{\"scope\":\"keyword\",\"end_col\":3,\"start_col\":1,\"line\":1}\n",
+            "{\"line\":1,\"start_col\":3,\"end_line\":2,\"end_col\":1,\"scope\":\"whitespace\"}",
+        ))
+        .unwrap();
+        assert_eq!(records.len(), 3);
+        assert_eq!(
+            records[0],
+            Record::Header(Header {
+                version: 1,
+                language: "rust".to_string(),
+                file: "-".to_string()
+            })
+        );
+        assert_eq!(records[1], token(1, 1, 3, "keyword"));
+        let Record::Token(whitespace) = &records[2] else { panic!() };
+        assert_eq!((whitespace.end_line, whitespace.end_col), (2, 1));
+    }
+
+    #[test]
+    fn test_decode_errors() {
+        let error = |input: &str| decode(input).unwrap_err().to_string();
+        let header = "{\"version\":1,\"language\":\"go\",\"file\":\"-\"}\n";
+        assert_eq!(
+            error("{\"line\":1,\"start_col\":1,\"end_col\":2,\"scope\":\"string\"}\n"),
+            "line 1: token before the header"
+        );
+        assert_eq!(
+            error("{\"version\":2,\"language\":\"go\",\"file\":\"-\"}\n"),
+            "line 1: expected version 1, found 2"
+        );
+        assert_eq!(
+            error(&format!("{header}{{\"line\":1,\"start_col\":1,\"scope\":\"string\"}}\n")),
+            "line 2: no number `end_col`"
+        );
+        assert_eq!(
+            error(&format!(
+                "{header}{{\"line\":-1,\"start_col\":1,\"end_col\":2,\"scope\":\"x\"}}\n"
+            )),
+            "line 2: `line` is not a count"
+        );
+        assert_eq!(error(&format!("{header}[1]\n")), "line 2: not an object");
+        assert!(error(&format!("{header}{{\"line\":\n")).starts_with("line 2: "));
+    }
+
+    #[test]
+    fn test_round_trip() {
+        let dir = Path::new(concat!(env!("CARGO_MANIFEST_DIR"), "/../../syntax-tests"));
+        let args = Args::default();
+        let mut fixtures = 0;
+        for entry in fs::read_dir(dir).unwrap() {
+            let path = entry.unwrap().path();
+            if path.extension().is_some_and(|ext| ext == "tokens") {
+                continue;
+            }
+            let text = fs::read(&path).unwrap();
+            let language = detect_language(&args, &path, &text);
+            let mut highlighter = SyntaxHighlighter::new(language, args.theme.create());
+            highlighter.set_options(highlight_options(&args, &path));
+            highlighter.update(&text, true);
+            let tokens = highlighter.tokens();
+
+            let file = path.to_string_lossy();
+            let encoded =
+                encode(Vec::new(), language, &file, &text, tokens, Columns::Chars).unwrap();
+            let encoded = String::from_utf8(encoded).unwrap();
+            let records = decode(&encoded).unwrap();
+            assert_eq!(records.len(), tokens.len() + 1, "{file}");
+            assert_eq!(
+                records[0],
+                Record::Header(Header {
+                    version: SCHEMA_VERSION,
+                    language: language.id().to_string(),
+                    file: file.to_string(),
+                })
+            );
+
+            // Writing the decoded records again gives the same bytes, and the scopes and
+            // positions are those of the tokens.
+            let mut rewritten = encoded.lines().next().unwrap().to_string() + "\n";
+            let lines = LineIndex::new(&text);
+            for (record, token) in records[1..].iter().zip(tokens) {
+                let Record::Token(record) = record else { panic!("{file}: a second header") };
+                let mut out = Vec::new();
+                write_token(&mut out, record).unwrap();
+                rewritten.push_str(&String::from_utf8(out).unwrap());
+                assert_eq!(record.scope, kind_name(token.kind), "{file}");
+                let (line, column) = lines.position(&text, token.span.start, Columns::Chars);
+                assert_eq!((record.line, record.start_col), (line + 1, column + 1), "{file}");
+            }
+            assert_eq!(rewritten, encoded, "{file}");
+            fixtures += 1;
+        }
+        assert!(fixtures > 20);
+    }
+}
@@ -0,0 +1,571 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//! The regular expressions for `--grep`.
+//!
+//! The editor searches with ICU, which needs a text buffer and a runtime library,
+//! so `hl` brings its own matcher for the common part of the syntax: `.`, `[a-z]`,
+//! `[^...]`, `\d`, `\w`, `\s`, `\b`, `^`, `$`, `*`, `+`, `?`, `{n,m}`, `(...)` and `|`.
+//! Any other escaped character matches itself, like `\.`.
+//!
+//! Patterns are compiled to a program for a Pike VM, which runs all the ways of matching
+//! at once instead of backtracking, so that no pattern takes more than time linear in the
+//! length of the line, and no stack, even `(a*)*b` on a long line of `a`s. The threads are
+//! kept in priority order, so the match is the one a backtracking matcher would find.
+
+use std::ops::Range;
+
+/// The largest count in `{n,m}`.
+const MAX_REPEAT: usize = 1000;
+/// How many instructions a pattern may compile to, since `{n,m}` copies what it repeats.
+const MAX_PROGRAM_LEN: usize = 100_000;
+
+/// A compiled pattern.
+#[derive(Debug)]
+pub struct Pattern {
+    program: Vec<Inst>,
+}
+
+/// An instruction of the Pike VM.
+#[derive(Debug, Clone)]
+enum Inst {
+    Char(char),
+    Any,
+    Class {
+        ranges: Vec<(char, char)>,
+        negated: bool,
+    },
+    Start,
+    End,
+    WordBoundary,
+    /// Continue at both, preferring the first.
+    Split(usize, usize),
+    Jump(usize),
+    Match,
+}
+
+#[derive(Debug, Clone)]
+enum Node {
+    Char(char),
+    /// `.`, which doesn't match a newline.
+    Any,
+    Class {
+        ranges: Vec<(char, char)>,
+        negated: bool,
+    },
+    /// `^`
+    Start,
+    /// `$`
+    End,
+    /// `\b`
+    WordBoundary,
+    Group(Vec<Vec<Node>>),
+    Repeat {
+        node: Box<Node>,
+        min: usize,
+        /// `None` for `*`, `+` and `{n,}`.
+        max: Option<usize>,
+    },
+}
+
+impl Pattern {
+    pub fn new(pattern: &str) -> Result<Self, String> {
+        let chars: Vec<char> = pattern.chars().collect();
+        let mut parser = Parser { chars: &chars, pos: 0 };
+        let alternatives = parser.alternatives()?;
+        if parser.pos < chars.len() {
+            return Err("unmatched `)`".to_string());
+        }
+        if program_len(&alternatives) > MAX_PROGRAM_LEN {
+            return Err("the pattern repeats too much".to_string());
+        }
+        let mut program = Vec::new();
+        compile_alternatives(&alternatives, &mut program);
+        program.push(Inst::Match);
+        Ok(Self { program })
+    }
+
+    /// Returns the byte ranges of the matches in `line`, leftmost first and without overlaps.
+    pub fn find_all(&self, line: &str) -> Vec<Range<usize>> {
+        let chars: Vec<char> = line.chars().collect();
+        let offsets: Vec<usize> = line.char_indices().map(|(i, _)| i).chain([line.len()]).collect();
+        let mut vm = Vm::new(&self.program, &chars);
+        let mut matches = Vec::new();
+        let mut from = 0;
+
+        while from <= chars.len() {
+            let Some((start, end)) = vm.find(from) else { break };
+            if end > start {
+                matches.push(offsets[start]..offsets[end]);
+                from = end;
+                continue;
+            }
+            // An empty match, like `^`, still selects the line.
+            if matches.is_empty() {
+                matches.push(offsets[start]..offsets[start]);
+            }
+            from = start + 1;
+        }
+        matches
+    }
+}
+
+struct Parser<'a> {
+    chars: &'a [char],
+    pos: usize,
+}
+
+impl Parser<'_> {
+    fn peek(&self) -> Option<char> {
+        self.chars.get(self.pos).copied()
+    }
+
+    fn next(&mut self) -> Option<char> {
+        let c = self.peek()?;
+        self.pos += 1;
+        Some(c)
+    }
+
+    fn alternatives(&mut self) -> Result<Vec<Vec<Node>>, String> {
+        let mut alternatives = vec![self.sequence()?];
+        while self.peek() == Some('|') {
+            self.pos += 1;
+            alternatives.push(self.sequence()?);
+        }
+        Ok(alternatives)
+    }
+
+    fn sequence(&mut self) -> Result<Vec<Node>, String> {
+        let mut nodes = Vec::new();
+        while let Some(c) = self.peek()
+            && c != '|'
+            && c != ')'
+        {
+            self.pos += 1;
+            let node = match c {
+                '.' => Node::Any,
+                '^' => Node::Start,
+                '$' => Node::End,
+                '(' => {
+                    let group = self.alternatives()?;
+                    if self.next() != Some(')') {
+                        return Err("unclosed `(`".to_string());
+                    }
+                    Node::Group(group)
+                }
+                '[' => self.class()?,
+                '\\' => self.escape()?,
+                '*' | '+' | '?' | '{' => return Err(format!("nothing to repeat before `{c}`")),
+                c => Node::Char(c),
+            };
+            nodes.push(self.repeat(node)?);
+        }
+        Ok(nodes)
+    }
+
+    /// Parses the quantifiers after `node`, if any.
+    fn repeat(&mut self, mut node: Node) -> Result<Node, String> {
+        loop {
+            let (min, max) = match self.peek() {
+                Some('*') => (0, None),
+                Some('+') => (1, None),
+                Some('?') => (0, Some(1)),
+                Some('{') => {
+                    self.pos += 1;
+                    let min = self.number()?.unwrap_or(0);
+                    let max = if self.peek() == Some(',') {
+                        self.pos += 1;
+                        self.number()?
+                    } else {
+                        Some(min)
+                    };
+                    if self.peek() != Some('}') || max.is_some_and(|max| min > max) {
+                        return Err("invalid `{n,m}`".to_string());
+                    }
+                    (min, max)
+                }
+                _ => return Ok(node),
+            };
+            self.pos += 1;
+            if matches!(node, Node::Start | Node::End | Node::WordBoundary) {
+                return Err("nothing to repeat".to_string());
+            }
+            node = Node::Repeat { node: Box::new(node), min, max };
+        }
+    }
+
+    /// Parses a count of `{n,m}`, which is `None` if it's left out.
+    fn number(&mut self) -> Result<Option<usize>, String> {
+        let start = self.pos;
+        while self.peek().is_some_and(|c| c.is_ascii_digit()) {
+            self.pos += 1;
+        }
+        if start == self.pos {
+            return Ok(None);
+        }
+        let digits: String = self.chars[start..self.pos].iter().collect();
+        match digits.parse() {
+            Ok(n) if n <= MAX_REPEAT => Ok(Some(n)),
+            _ => Err(format!("`{{n,m}}` counts can be at most {MAX_REPEAT}, not {digits}")),
+        }
+    }
+
+    /// Parses what follows a `\` outside of a class.
+    fn escape(&mut self) -> Result<Node, String> {
+        let c = self.next().ok_or("trailing `\\`")?;
+        Ok(match c {
+            'b' => Node::WordBoundary,
+            'd' | 'w' | 's' => Node::Class { ranges: shorthand(c).to_vec(), negated: false },
+            'D' | 'W' | 'S' => {
+                Node::Class { ranges: shorthand(c.to_ascii_lowercase()).to_vec(), negated: true }
+            }
+            c => Node::Char(unescape(c)),
+        })
+    }
+
+    /// Parses a class after its `[`.
+    fn class(&mut self) -> Result<Node, String> {
+        let negated = self.peek() == Some('^');
+        if negated {
+            self.pos += 1;
+        }
+        let mut ranges = Vec::new();
+        // A `]` right at the start is a literal, like in `[]a]`.
+        let mut first = true;
+
+        loop {
+            let c = self.next().ok_or("unclosed `[`")?;
+            let lo = match c {
+                ']' if !first => break,
+                '\\' => match self.next().ok_or("unclosed `[`")? {
+                    c @ ('d' | 'w' | 's') => {
+                        ranges.extend_from_slice(shorthand(c));
+                        first = false;
+                        continue;
+                    }
+                    c => unescape(c),
+                },
+                c => c,
+            };
+            first = false;
+
+            let hi = if self.peek() == Some('-') && self.chars.get(self.pos + 1) != Some(&']') {
+                self.pos += 1;
+                match self.next().ok_or("unclosed `[`")? {
+                    '\\' => unescape(self.next().ok_or("unclosed `[`")?),
+                    c => c,
+                }
+            } else {
+                lo
+            };
+            if hi < lo {
+                return Err(format!("invalid range `{lo}-{hi}`"));
+            }
+            ranges.push((lo, hi));
+        }
+        Ok(Node::Class { ranges, negated })
+    }
+}
+
+/// The ranges of `\d`, `\w` and `\s`.
+fn shorthand(c: char) -> &'static [(char, char)] {
+    match c {
+        'd' => &[('0', '9')],
+        'w' => &[('0', '9'), ('A', 'Z'), ('_', '_'), ('a', 'z')],
+        _ => &[(' ', ' '), ('\t', '\r')],
+    }
+}
+
+fn unescape(c: char) -> char {
+    match c {
+        't' => '\t',
+        'n' => '\n',
+        'r' => '\r',
+        c => c,
+    }
+}
+
+fn is_word(c: Option<&char>) -> bool {
+    c.is_some_and(|&c| c.is_alphanumeric() || c == '_')
+}
+
+/// How many instructions `alternatives` compile to, saturating.
+fn program_len(alternatives: &[Vec<Node>]) -> usize {
+    let sequences = alternatives.iter().map(|sequence| {
+        sequence.iter().fold(0usize, |len, node| len.saturating_add(node_len(node)))
+    });
+    // A split and a jump for each alternative but the last.
+    sequences.fold(2 * (alternatives.len() - 1), usize::saturating_add)
+}
+
+fn node_len(node: &Node) -> usize {
+    match node {
+        Node::Group(group) => program_len(group),
+        Node::Repeat { node, min, max } => {
+            let len = node_len(node);
+            let optional = match max {
+                None => len.saturating_add(2),
+                Some(max) => (max - min).saturating_mul(len.saturating_add(1)),
+            };
+            len.saturating_mul(*min).saturating_add(optional)
+        }
+        _ => 1,
+    }
+}
+
+fn compile_alternatives(alternatives: &[Vec<Node>], program: &mut Vec<Inst>) {
+    let mut jumps = Vec::new();
+    for (i, sequence) in alternatives.iter().enumerate() {
+        let last = i + 1 == alternatives.len();
+        let split = program.len();
+        if !last {
+            program.push(Inst::Split(0, 0));
+        }
+        for node in sequence {
+            compile(node, program);
+        }
+        if !last {
+            jumps.push(program.len());
+            program.push(Inst::Jump(0));
+            program[split] = Inst::Split(split + 1, program.len());
+        }
+    }
+    for jump in jumps {
+        program[jump] = Inst::Jump(program.len());
+    }
+}
+
+fn compile(node: &Node, program: &mut Vec<Inst>) {
+    match node {
+        Node::Char(c) => program.push(Inst::Char(*c)),
+        Node::Any => program.push(Inst::Any),
+        Node::Class { ranges, negated } => {
+            program.push(Inst::Class { ranges: ranges.clone(), negated: *negated })
+        }
+        Node::Start => program.push(Inst::Start),
+        Node::End => program.push(Inst::End),
+        Node::WordBoundary => program.push(Inst::WordBoundary),
+        Node::Group(group) => compile_alternatives(group, program),
+        Node::Repeat { node, min, max } => {
+            for _ in 0..*min {
+                compile(node, program);
+            }
+            match max {
+                // Greedy: another repetition is preferred over leaving.
+                None => {
+                    let split = program.len();
+                    program.push(Inst::Split(0, 0));
+                    compile(node, program);
+                    program.push(Inst::Jump(split));
+                    program[split] = Inst::Split(split + 1, program.len());
+                }
+                Some(max) => {
+                    let mut splits = Vec::new();
+                    for _ in *min..*max {
+                        splits.push(program.len());
+                        program.push(Inst::Split(0, 0));
+                        compile(node, program);
+                    }
+                    for split in splits {
+                        program[split] = Inst::Split(split + 1, program.len());
+                    }
+                }
+            }
+        }
+    }
+}
+
+/// The threads at one position: where in the program they are and where their match
+/// started, in priority order.
+struct Threads {
+    threads: Vec<(usize, usize)>,
+    /// The instructions this position already reached, threads or not, since reaching
+    /// one again has lower priority and can't lead anywhere new.
+    reached: Vec<bool>,
+    reached_list: Vec<usize>,
+}
+
+impl Threads {
+    fn new(len: usize) -> Self {
+        Self { threads: Vec::new(), reached: vec![false; len], reached_list: Vec::new() }
+    }
+
+    fn clear(&mut self) {
+        for &pc in &self.reached_list {
+            self.reached[pc] = false;
+        }
+        self.reached_list.clear();
+        self.threads.clear();
+    }
+
+    /// Adds the thread at `pc` at position `i`, following the splits, jumps and assertions
+    /// in priority order, without recursing.
+    fn add(
+        &mut self,
+        program: &[Inst],
+        chars: &[char],
+        stack: &mut Vec<usize>,
+        pc: usize,
+        i: usize,
+        start: usize,
+    ) {
+        stack.push(pc);
+        while let Some(pc) = stack.pop() {
+            if self.reached[pc] {
+                continue;
+            }
+            self.reached[pc] = true;
+            self.reached_list.push(pc);
+            let holds = match &program[pc] {
+                Inst::Split(first, second) => {
+                    stack.push(*second);
+                    stack.push(*first);
+                    continue;
+                }
+                Inst::Jump(target) => {
+                    stack.push(*target);
+                    continue;
+                }
+                Inst::Start => i == 0,
+                Inst::End => i == chars.len(),
+                Inst::WordBoundary => {
+                    let before = i.checked_sub(1).and_then(|j| chars.get(j));
+                    is_word(before) != is_word(chars.get(i))
+                }
+                _ => {
+                    self.threads.push((pc, start));
+                    continue;
+                }
+            };
+            if holds {
+                stack.push(pc + 1);
+            }
+        }
+    }
+}
+
+struct Vm<'a> {
+    program: &'a [Inst],
+    chars: &'a [char],
+    current: Threads,
+    next: Threads,
+    stack: Vec<usize>,
+}
+
+impl<'a> Vm<'a> {
+    fn new(program: &'a [Inst], chars: &'a [char]) -> Self {
+        let (current, next) = (Threads::new(program.len()), Threads::new(program.len()));
+        Self { program, chars, current, next, stack: Vec::new() }
+    }
+
+    /// Finds the leftmost match at or after `from`, as a range of characters.
+    fn find(&mut self, from: usize) -> Option<(usize, usize)> {
+        let (program, chars) = (self.program, self.chars);
+        self.current.clear();
+        let mut found = None;
+        for i in from..=chars.len() {
+            // Matches starting further left win, so a new start is the last resort.
+            if found.is_none() {
+                self.current.add(program, chars, &mut self.stack, 0, i, i);
+            } else if self.current.threads.is_empty() {
+                break;
+            }
+
+            self.next.clear();
+            let c = chars.get(i);
+            for &(pc, start) in &self.current.threads {
+                let step = match &program[pc] {
+                    Inst::Match => {
+                        // The threads after this one have lower priority.
+                        found = Some((start, i));
+                        break;
+                    }
+                    Inst::Char(expected) => c == Some(expected),
+                    Inst::Any => c.is_some_and(|&c| c != '\n'),
+                    Inst::Class { ranges, negated } => c.is_some_and(|c| {
+                        ranges.iter().any(|(lo, hi)| (lo..=hi).contains(&c)) != *negated
+                    }),
+                    _ => unreachable!("only characters and matches are threads"),
+                };
+                if step {
+                    self.next.add(program, chars, &mut self.stack, pc + 1, i + 1, start);
+                }
+            }
+            std::mem::swap(&mut self.current, &mut self.next);
+        }
+        found
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn find(pattern: &str, line: &str) -> Vec<String> {
+        let pattern = Pattern::new(pattern).unwrap();
+        pattern.find_all(line).into_iter().map(|r| line[r].to_string()).collect()
+    }
+
+    #[test]
+    fn test_find_all() {
+        assert_eq!(find("func.*Handler", "func (s *S) Handler() {"), ["func (s *S) Handler"]);
+        assert_eq!(find("a+", "baaab aa"), ["aaa", "aa"]);
+        assert_eq!(find("colou?r", "color colour colouur"), ["color", "colour"]);
+        assert_eq!(find(r"\bis\b", "this is it"), ["is"]);
+        assert_eq!(find(r"\d{2,3}", "1 22 4444"), ["22", "444"]);
+        assert_eq!(find("(get|set)_[a-z]+", "get_x set_yz put_w"), ["get_x", "set_yz"]);
+        assert_eq!(find("[^ ]+$", "a bc"), ["bc"]);
+        assert_eq!(find(r"^\s*//", "  // x // y"), ["  //"]);
+        assert_eq!(find(r"\.\*", "a.*b"), [".*"]);
+        assert_eq!(find("[]a-]", "]-a"), ["]", "-", "a"]);
+        assert_eq!(find("ö+", "schön"), ["ö"]);
+        assert_eq!(find("(a*)*b", "aaab"), ["aaab"]);
+        assert!(find("x", "abc").is_empty());
+        // An empty match selects the line, but isn't emphasized.
+        assert_eq!(find("^", "abc"), [""]);
+    }
+
+    #[test]
+    fn test_errors() {
+        for pattern in ["(a", "a)", "[a", "*a", "a{3,2}", "[z-a]", "\\", "^*", "a{1001}"] {
+            assert!(Pattern::new(pattern).is_err(), "{pattern}");
+        }
+        // Outside of a class, `]` and `-` are just characters.
+        assert_eq!(find("z-a]", "z-a]"), ["z-a]"]);
+    }
+
+    #[test]
+    fn test_counts() {
+        // `*` and `+` have no upper bound, `{n,}` neither.
+        let long = "a".repeat(5000);
+        assert_eq!(find("a*", &long), [long.as_str()]);
+        assert_eq!(find("a{1000,}", &long), [long.as_str()]);
+        assert_eq!(find("a{2,3}", "aaaaa"), ["aaa", "aa"]);
+        assert_eq!(find("a{,2}b", "aaab"), ["aab"]);
+        // Counts out of range are errors rather than clamped.
+        assert_eq!(
+            Pattern::new("a{99999999999}").unwrap_err(),
+            "`{n,m}` counts can be at most 1000, not 99999999999"
+        );
+        assert_eq!(
+            Pattern::new("a{1,5000}").unwrap_err(),
+            "`{n,m}` counts can be at most 1000, not 5000"
+        );
+        assert_eq!(Pattern::new("(a{1000}){1000}").unwrap_err(), "the pattern repeats too much");
+    }
+
+    #[test]
+    fn test_linear_time() {
+        // Each of these takes exponential time, or a stack frame per character, when
+        // backtracking.
+        let line = "a".repeat(40);
+        assert!(find("(a*)*b", &line).is_empty());
+        let line = "abcdefghij".repeat(20_000);
+        assert!(find("([a-z]+)+x", &line).is_empty());
+        assert!(find(".*x", &line).is_empty());
+        // Still the match of a backtracking matcher: the first alternative that works,
+        // not the longest.
+        assert_eq!(find("a|ab", "ab"), ["a"]);
+        assert_eq!(find("(a|ab)(c|bcd)", "abcd"), ["abcd"]);
+    }
+}
@@ -0,0 +1,434 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//! `hl serve`: highlights the files of a directory on request, for working on themes
+//! and lexers without rerunning `hl` after every change.
+//!
+//! This is a minimal HTTP/1.1 server on top of [`TcpListener`], bound to localhost.
+//! Every request is answered on a thread of its own and then the connection is closed.
+//! Files are read and highlighted anew for each request, and a `--theme` file is parsed
+//! again once it has changed, so a reload always shows the file, lexers and theme as they
+//! are now.
+
+use std::fmt::Write as _;
+use std::io::{self, Read, Write};
+use std::net::{Ipv4Addr, TcpListener, TcpStream};
+use std::path::{Path, PathBuf};
+use std::sync::Arc;
+use std::time::Duration;
+use std::{fs, thread};
+
+use edit::syntax::{Language, transcode};
+
+use crate::format::{Format, Formatter, html_escape};
+use crate::tree::{is_binary, page_body, page_head, url_escape};
+use crate::{Args, BUILTIN_THEMES, ThemeChoice, detect_language};
+
+/// The longest request head that is read, which is plenty for a `GET`.
+const MAX_HEAD_LEN: usize = 16 * 1024;
+/// How long a client may take to send its request.
+const READ_TIMEOUT: Duration = Duration::from_secs(10);
+
+/// An HTTP response. Errors are plain text.
+struct Response {
+    /// The status code and reason, like `404 Not Found`.
+    status: &'static str,
+    content_type: &'static str,
+    body: Vec<u8>,
+}
+
+impl Response {
+    fn html(body: Vec<u8>) -> Self {
+        Self { status: "200 OK", content_type: "text/html; charset=utf-8", body }
+    }
+
+    fn error(status: &'static str) -> Self {
+        Self {
+            status,
+            content_type: "text/plain; charset=utf-8",
+            body: format!("{status}\n").into(),
+        }
+    }
+}
+
+/// Serves the pages for one directory.
+struct Server<'a> {
+    args: &'a Args,
+    /// The canonical path of the directory. Nothing outside of it is served.
+    root: PathBuf,
+    /// The name of the directory, for titles and breadcrumbs.
+    name: String,
+}
+
+/// Serves `root` on `port` of localhost until the process is stopped.
+pub fn run(args: &Args, root: &Path, port: u16) -> io::Result<()> {
+    let err = |err: io::Error| io::Error::new(err.kind(), format!("{}: {err}", root.display()));
+    let canonical = fs::canonicalize(root).map_err(err)?;
+    if !canonical.is_dir() {
+        return Err(io::Error::new(
+            io::ErrorKind::NotADirectory,
+            format!("{}: not a directory", root.display()),
+        ));
+    }
+    let name = canonical
+        .file_name()
+        .map_or_else(|| root.display().to_string(), |name| name.to_string_lossy().into_owned());
+    let server = Server { args, root: canonical, name };
+
+    let listener = TcpListener::bind((Ipv4Addr::LOCALHOST, port))?;
+    println!("Serving {} at http://{}/", root.display(), listener.local_addr()?);
+
+    thread::scope(|scope| {
+        for stream in listener.incoming() {
+            match stream {
+                Ok(stream) => {
+                    let server = &server;
+                    scope.spawn(move || {
+                        if let Err(err) = server.handle(stream) {
+                            eprintln!("hl: {err}");
+                        }
+                    });
+                }
+                Err(err) => eprintln!("hl: {err}"),
+            }
+        }
+    });
+    Ok(())
+}
+
+impl Server<'_> {
+    /// The themes a request can pick with `?theme=`: the builtin ones, and the one `hl`
+    /// was started with. A request never gets to load a theme file of its own.
+    fn themes(&self) -> impl Iterator<Item = Arc<ThemeChoice>> {
+        let started = self.started_theme();
+        let builtin = BUILTIN_THEMES.iter().any(|t| Arc::ptr_eq(t, &started));
+        BUILTIN_THEMES.iter().cloned().chain((!builtin).then_some(started))
+    }
+
+    /// The theme `hl` was started with, as its file is now. If the file can't be
+    /// loaded anymore, like halfway through saving it, the one from the start is used.
+    fn started_theme(&self) -> Arc<ThemeChoice> {
+        self.args.theme.reload().unwrap_or_else(|err| {
+            eprintln!("hl: {err}");
+            self.args.theme.clone()
+        })
+    }
+
+    /// Returns the theme `?theme=name` picks, if it's one of [`Self::themes`].
+    fn theme(&self, name: &str) -> Option<Arc<ThemeChoice>> {
+        self.themes().find(|t| t.name.eq_ignore_ascii_case(name))
+    }
+
+    /// Reads one request from `stream` and answers it.
+    fn handle(&self, mut stream: TcpStream) -> io::Result<()> {
+        stream.set_read_timeout(Some(READ_TIMEOUT))?;
+        let mut head = Vec::new();
+        let mut buf = [0; 1024];
+        while !head.windows(4).any(|w| w == b"\r\n\r\n") && head.len() < MAX_HEAD_LEN {
+            match stream.read(&mut buf)? {
+                0 => break,
+                n => head.extend_from_slice(&buf[..n]),
+            }
+        }
+
+        let head = String::from_utf8_lossy(&head);
+        let request_line = head.lines().next().unwrap_or_default();
+        let response = self.respond(request_line);
+        eprintln!("{request_line} -> {}", response.status);
+
+        write!(
+            stream,
+            "HTTP/1.1 {}\r\nContent-Type: {}\r\nContent-Length: {}\r\n\
+             Cache-Control: no-store\r\nConnection: close\r\n\r\n",
+            response.status,
+            response.content_type,
+            response.body.len()
+        )?;
+        if !request_line.starts_with("HEAD ") {
+            stream.write_all(&response.body)?;
+        }
+        stream.flush()
+    }
+
+    /// Answers a request line like `GET /src/main.go?theme=light HTTP/1.1`.
+    fn respond(&self, request_line: &str) -> Response {
+        let mut parts = request_line.split(' ');
+        let (Some(method), Some(target), Some(_version), None) =
+            (parts.next(), parts.next(), parts.next(), parts.next())
+        else {
+            return Response::error("400 Bad Request");
+        };
+        if method != "GET" && method != "HEAD" {
+            return Response::error("405 Method Not Allowed");
+        }
+
+        let (path, query) = target.split_once('?').unwrap_or((target, ""));
+        let theme = match query_param(query, "theme") {
+            Some(name) => match self.theme(&name) {
+                Some(theme) => Some(theme),
+                None => return Response::error("400 Bad Request"),
+            },
+            None => None,
+        };
+        let (rel, path) = match self.resolve(path) {
+            Ok(resolved) => resolved,
+            Err(response) => return response,
+        };
+
+        let page = Page { server: self, rel: &rel, theme };
+        let body = if path.is_dir() { page.index(&path) } else { page.file(&path) };
+        match body {
+            Ok(body) => Response::html(body),
+            Err(err) => {
+                eprintln!("hl: {}: {err}", path.display());
+                Response::error("500 Internal Server Error")
+            }
+        }
+    }
+
+    /// Maps the path of a URL to a path below the root, relative and canonical.
+    /// Hidden files, like in `--recursive`, and anything outside the root aren't found.
+    fn resolve(&self, path: &str) -> Result<(String, PathBuf), Response> {
+        let path = percent_decode(path)
+            .and_then(|path| String::from_utf8(path).ok())
+            .ok_or_else(|| Response::error("400 Bad Request"))?;
+        let mut names = Vec::new();
+        for name in path.split('/') {
+            match name {
+                "" | "." => {}
+                ".." => return Err(Response::error("403 Forbidden")),
+                // Drive letters and the other separator.
+                _ if cfg!(windows) && name.contains(['\\', ':']) => {
+                    return Err(Response::error("403 Forbidden"));
+                }
+                _ if name.starts_with('.') => return Err(Response::error("404 Not Found")),
+                _ => names.push(name),
+            }
+        }
+
+        let rel = names.join("/");
+        let path =
+            fs::canonicalize(self.root.join(&rel)).map_err(|_| Response::error("404 Not Found"))?;
+        // Symlinks may still point elsewhere.
+        if !path.starts_with(&self.root) {
+            return Err(Response::error("403 Forbidden"));
+        }
+        Ok((rel, path))
+    }
+}
+
+/// One page, for a directory or a file.
+struct Page<'a> {
+    server: &'a Server<'a>,
+    /// The path relative to the root, with `/` as the separator. Empty for the root.
+    rel: &'a str,
+    /// The theme picked with `?theme=`, which the links keep.
+    theme: Option<Arc<ThemeChoice>>,
+}
+
+impl Page<'_> {
+    /// Lists the subdirectories and files of `dir`.
+    fn index(&self, dir: &Path) -> io::Result<Vec<u8>> {
+        let mut dirs = Vec::new();
+        let mut files = Vec::new();
+        for entry in fs::read_dir(dir)? {
+            let entry = entry?;
+            let Ok(name) = entry.file_name().into_string() else {
+                continue;
+            };
+            if name.starts_with('.') {
+                continue;
+            }
+            if entry.path().is_dir() { dirs.push(name) } else { files.push(name) }
+        }
+        dirs.sort();
+        files.sort();
+
+        let mut w = self.head()?;
+        w.extend_from_slice(b"<table>\n<tr><th>Name</th><th>Language</th></tr>\n");
+        for name in dirs {
+            let href = self.href(&format!("{name}/"));
+            let name = html_escape(&name);
+            writeln!(w, "<tr><td><a href=\"{href}\">{name}/</a></td><td></td></tr>")?;
+        }
+        for name in files {
+            // Only by extension, so that listing a directory doesn't read every file.
+            let language = detect_language(self.server.args, Path::new(&name), b"");
+            let language = if language == Language::PlainText { "" } else { language.name() };
+            let href = self.href(&name);
+            let name = html_escape(&name);
+            writeln!(w, "<tr><td><a href=\"{href}\">{name}</a></td><td>{language}</td></tr>")?;
+        }
+        w.extend_from_slice(b"</table>\n</body>\n</html>\n");
+        Ok(w)
+    }
+
+    /// Highlights the file at `path`.
+    fn file(&self, path: &Path) -> io::Result<Vec<u8>> {
+        let args = self.server.args;
+        let input = fs::read(path)?;
+        let mut w = self.head()?;
+        let text = transcode(&input).text;
+        if is_binary(&text) {
+            w.extend_from_slice(b"<p>This is a binary file.</p>\n</body>\n</html>\n");
+            return Ok(w);
+        }
+
+        let language =
+            args.language.unwrap_or_else(|| detect_language(args, Path::new(self.rel), &text));
+        let mut out =
+            Formatter::new(w, Format::Html).with_tab_width(args.tab_width).with_tabs(args.tabs);
+        page_body(&mut out, args, &self.theme(), self.rel, &input, language)?;
+        let mut w = out.into_inner();
+        w.extend_from_slice(b"</body>\n</html>\n");
+        Ok(w)
+    }
+
+    fn theme(&self) -> Arc<ThemeChoice> {
+        self.theme.clone().unwrap_or_else(|| self.server.started_theme())
+    }
+
+    /// Starts a page with the breadcrumbs and links to switch the theme.
+    fn head(&self) -> io::Result<Vec<u8>> {
+        let server = self.server;
+        let title = if self.rel.is_empty() {
+            server.name.clone()
+        } else {
+            format!("{}/{}", server.name, self.rel)
+        };
+        let mut w = Vec::new();
+        page_head(&mut w, &title, self.theme().dark)?;
+
+        let mut nav =
+            format!("<nav><a href=\"{}\">{}</a>", self.href("/"), html_escape(&server.name));
+        let names: Vec<_> =
+            if self.rel.is_empty() { Vec::new() } else { self.rel.split('/').collect() };
+        for (i, name) in names.iter().enumerate() {
+            if i + 1 == names.len() {
+                _ = write!(nav, " / {}", html_escape(name));
+            } else {
+                let href = self.href(&format!("/{}/", names[..=i].join("/")));
+                _ = write!(nav, " / <a href=\"{href}\">{}</a>", html_escape(name));
+            }
+        }
+        nav.push_str("</nav>\n<p>Theme:");
+        let current = self.theme();
+        for theme in server.themes() {
+            let name = html_escape(&theme.name);
+            if Arc::ptr_eq(&theme, &current) {
+                _ = write!(nav, " {name}");
+            } else {
+                _ = write!(nav, " <a href=\"?theme={}\">{name}</a>", url_escape(&theme.name));
+            }
+        }
+        nav.push_str("</p>\n");
+        w.extend_from_slice(nav.as_bytes());
+        Ok(w)
+    }
+
+    /// The link to `path`, which is absolute or relative to this page's directory,
+    /// with the theme of this page.
+    fn href(&self, path: &str) -> String {
+        let mut href = if path.starts_with('/') {
+            url_escape(path)
+        } else if self.rel.is_empty() {
+            url_escape(&format!("/{path}"))
+        } else {
+            url_escape(&format!("/{}/{path}", self.rel))
+        };
+        if let Some(theme) = &self.theme {
+            _ = write!(href, "?theme={}", url_escape(&theme.name));
+        }
+        href
+    }
+}
+
+/// Returns the value of `name` in a query string like `a=1&theme=light`.
+fn query_param(query: &str, name: &str) -> Option<String> {
+    query.split('&').find_map(|pair| {
+        let (key, value) = pair.split_once('=').unwrap_or((pair, ""));
+        let value = value.replace('+', " ");
+        (key == name).then(|| percent_decode(&value).and_then(|v| String::from_utf8(v).ok()))?
+    })
+}
+
+/// Decodes `%XX` escapes. Returns `None` if one is malformed.
+fn percent_decode(s: &str) -> Option<Vec<u8>> {
+    let mut bytes = Vec::with_capacity(s.len());
+    let mut rest = s.as_bytes();
+    while let Some((&b, tail)) = rest.split_first() {
+        if b == b'%' {
+            let hex = tail.get(..2).and_then(|hex| str::from_utf8(hex).ok())?;
+            bytes.push(u8::from_str_radix(hex, 16).ok()?);
+            rest = &tail[2..];
+        } else {
+            bytes.push(b);
+            rest = tail;
+        }
+    }
+    Some(bytes)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_percent_decode() {
+        assert_eq!(percent_decode("/src/a%20b.go").unwrap(), b"/src/a b.go");
+        assert_eq!(percent_decode("%2e%2E/x").unwrap(), b"../x");
+        assert_eq!(percent_decode("%C3%A4").unwrap(), "ä".as_bytes());
+        assert!(percent_decode("%2").is_none());
+        assert!(percent_decode("%zz").is_none());
+    }
+
+    #[test]
+    fn test_theme() {
+        let args = Args::default();
+        let server = Server { args: &args, root: PathBuf::from("."), name: String::new() };
+        assert_eq!(server.theme("LIGHT").map(|t| t.name.clone()).as_deref(), Some("light"));
+        assert!(server.theme("/etc/passwd.json").is_none());
+        assert!(server.theme("../theme.json").is_none());
+    }
+
+    #[test]
+    fn test_theme_file() {
+        let dir = std::env::temp_dir().join(format!("hl-serve-theme-{}", std::process::id()));
+        fs::create_dir_all(&dir).unwrap();
+        let file = dir.join("theme.json");
+        let write = |json: &str, later: u64| {
+            fs::write(&file, json).unwrap();
+            // Later than the write before even where file times are coarse.
+            let f = fs::File::options().write(true).open(&file).unwrap();
+            let modified = f.metadata().unwrap().modified().unwrap();
+            f.set_modified(modified + Duration::from_secs(later)).unwrap();
+        };
+        write(r##"{ "type": "light", "colors": { "editor.foreground": "#111111" } }"##, 0);
+
+        let path = file.display().to_string();
+        let args = Args { theme: crate::parse_theme(&path).unwrap(), ..Args::default() };
+        let server = Server { args: &args, root: dir.clone(), name: String::new() };
+        assert!(!server.theme(&path).unwrap().dark);
+
+        // An edit shows on the next request, ...
+        write(r##"{ "type": "dark", "colors": { "editor.foreground": "#eeeeee" } }"##, 2);
+        assert!(server.theme(&path).unwrap().dark);
+        let page = Page { server: &server, rel: "", theme: None };
+        assert!(page.theme().dark);
+        assert!(Arc::ptr_eq(&server.themes().last().unwrap(), &page.theme()));
+
+        // ... but one that breaks the file doesn't break the page.
+        write("{", 4);
+        assert!(!page.theme().dark);
+        _ = fs::remove_dir_all(&dir);
+    }
+
+    #[test]
+    fn test_query_param() {
+        assert_eq!(query_param("theme=light", "theme").as_deref(), Some("light"));
+        assert_eq!(query_param("a=1&theme=dark&b", "theme").as_deref(), Some("dark"));
+        assert_eq!(query_param("x=a+b%21", "x").as_deref(), Some("a b!"));
+        assert_eq!(query_param("themes=light", "theme"), None);
+        assert_eq!(query_param("", "theme"), None);
+    }
+}
@@ -0,0 +1,275 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//! `--lines` and `--region`: print a part of a file, e.g. to embed it in documentation.
+//!
+//! The file is still highlighted from the top, so that a snippet from the middle of a
+//! multi-line string looks like one. Regions are delimited by marker lines, which can be
+//! any comment that contains the markers:
+//!
+//! ```go
+//! // [region:init]
+//! func init() { ... }
+//! // [endregion]
+//! ```
+
+use std::io::{self, Write};
+use std::ops::{Range, RangeInclusive};
+
+use edit::syntax::{Theme, Token};
+
+use crate::format::Formatter;
+
+/// The marker that starts a region, with `{}` standing for its name.
+pub const DEFAULT_REGION_START: &str = "[region:{}]";
+/// The marker that ends the innermost region.
+pub const DEFAULT_REGION_END: &str = "[endregion]";
+
+/// Which lines of a file to print.
+pub enum Select {
+    /// The first and last line, 1-based. `usize::MAX` for the end of the file.
+    Lines(usize, usize),
+    /// The lines between the markers of the region with this name.
+    Region(String),
+}
+
+impl Select {
+    /// Parses the range of `--lines`: `40-72`, `40-` or just `40`.
+    pub fn parse_lines(range: &str) -> Result<Self, String> {
+        let (first, last) = range.split_once('-').unwrap_or((range, range));
+        let last = if last.is_empty() { Ok(usize::MAX) } else { last.parse() };
+        match (first.parse(), last) {
+            (Ok(first @ 1..), Ok(last)) if first <= last => Ok(Self::Lines(first, last)),
+            _ => Err(format!("invalid line range '{range}', expected FIRST-LAST like 40-72")),
+        }
+    }
+}
+
+/// `--lines` or `--region`, and how to print the lines.
+pub struct Snippet {
+    pub select: Select,
+    /// Strip the indentation all of the lines have in common.
+    pub dedent: bool,
+    /// Number the lines like in the file, instead of from 1.
+    pub preserve_line_numbers: bool,
+}
+
+impl Snippet {
+    /// Finds the lines to print in `text`. `markers` are the start and end of a region,
+    /// as in [`DEFAULT_REGION_START`] and [`DEFAULT_REGION_END`].
+    pub fn extract(&self, text: &[u8], markers: [&str; 2]) -> Result<Extract, String> {
+        let mut lines = Vec::new();
+        let mut start = 0;
+        while start < text.len() {
+            let end = text[start..]
+                .iter()
+                .position(|&b| b == b'\n')
+                .map_or(text.len(), |i| start + i + 1);
+            lines.push(start..end);
+            start = end;
+        }
+
+        // The indices of the lines to print.
+        let selected: Vec<usize> = match &self.select {
+            Select::Lines(first, _) if *first > lines.len() => {
+                return Err(format!("--lines {first}: the file has {} lines", lines.len()));
+            }
+            Select::Lines(first, last) => (first - 1..(*last).min(lines.len())).collect(),
+            Select::Region(name) => region(text, &lines, name, markers)?,
+        };
+
+        let indent = |i: usize| {
+            let line = &text[lines[i].clone()];
+            &line[..line.iter().take_while(|&&b| b == b' ' || b == b'\t').count()]
+        };
+        let blank = |i: usize| text[lines[i].clone()].trim_ascii().is_empty();
+        // Tabs and spaces aren't interchangeable, so only the same characters count.
+        let common = |a: &[u8], b: &[u8]| a.iter().zip(b).take_while(|(x, y)| x == y).count();
+        let strip = if self.dedent {
+            let mut indents = selected.iter().filter(|&&i| !blank(i)).map(|&i| indent(i));
+            let first = indents.next().unwrap_or_default();
+            indents.fold(first.len(), |len, indent| common(&first[..len], indent))
+        } else {
+            0
+        };
+
+        let mut extract = Extract { lines: Vec::new(), numbers: Vec::new(), started: 0 };
+        for (n, &i) in selected.iter().enumerate() {
+            let start = lines[i].start + strip.min(indent(i).len());
+            extract.lines.push(start..lines[i].end);
+            extract.numbers.push(if self.preserve_line_numbers { i + 1 } else { n + 1 });
+        }
+        Ok(extract)
+    }
+}
+
+/// Returns the indices of the lines inside of the region called `name`,
+/// without the markers of the regions nested in it.
+fn region(
+    text: &[u8],
+    lines: &[Range<usize>],
+    name: &str,
+    [start, end]: [&str; 2],
+) -> Result<Vec<usize>, String> {
+    let line = |i: usize| String::from_utf8_lossy(&text[lines[i].clone()]);
+    let mut names: Vec<_> = Vec::new();
+    for name in (0..lines.len()).filter_map(|i| region_name(&line(i), start)) {
+        if !names.contains(&name) {
+            names.push(name);
+        }
+    }
+    let Some(first) =
+        (0..lines.len()).find(|&i| region_name(&line(i), start).as_deref() == Some(name))
+    else {
+        return Err(if names.is_empty() {
+            format!("unknown region '{name}', the file has no {start} markers")
+        } else {
+            format!("unknown region '{name}', expected {}", names.join(", "))
+        });
+    };
+
+    let mut selected = Vec::new();
+    let mut depth = 0;
+    for i in first + 1..lines.len() {
+        let line = line(i);
+        if region_name(&line, start).is_some() {
+            depth += 1;
+        } else if line.contains(end) {
+            if depth == 0 {
+                return Ok(selected);
+            }
+            depth -= 1;
+        } else {
+            selected.push(i);
+        }
+    }
+    Err(format!("region '{name}' isn't closed with {end}"))
+}
+
+/// The name of the region that `line` starts, if it contains the `start` marker.
+fn region_name(line: &str, start: &str) -> Option<String> {
+    let (prefix, suffix) = start.split_once("{}")?;
+    let rest = &line[line.find(prefix)? + prefix.len()..];
+    let name = match suffix.trim() {
+        "" => rest.split_whitespace().next()?,
+        suffix => &rest[..rest.find(suffix)?],
+    };
+    let name = name.trim();
+    (!name.is_empty()).then(|| name.to_string())
+}
+
+/// The lines of a file that [`Snippet`] selected.
+pub struct Extract {
+    /// The part of each line to print, including its newline.
+    lines: Vec<Range<usize>>,
+    /// The number of each line, as it's printed with `--line-numbers`.
+    numbers: Vec<usize>,
+    /// How many lines have been written to, to number them.
+    started: usize,
+}
+
+impl Extract {
+    /// The numbers of the first and last line.
+    pub fn line_numbers(&self) -> RangeInclusive<usize> {
+        let first = self.numbers.first().copied().unwrap_or(1);
+        first..=self.numbers.last().copied().unwrap_or(first)
+    }
+
+    /// Writes the parts of `token` that are in the selected lines. Tokens must be written in order.
+    pub fn token<W: Write>(
+        &mut self,
+        out: &mut Formatter<W>,
+        text: &[u8],
+        token: &Token,
+        theme: &Theme,
+    ) -> io::Result<()> {
+        let first = self.lines.partition_point(|line| line.end <= token.span.start);
+        for (i, line) in self.lines.iter().enumerate().skip(first) {
+            if line.start >= token.span.end {
+                break;
+            }
+            let mut piece = token.clone();
+            piece.span = token.span.start.max(line.start)..token.span.end.min(line.end);
+            if piece.span.is_empty() {
+                continue;
+            }
+            if i >= self.started {
+                out.set_line_number(self.numbers[i]);
+                self.started = i + 1;
+            }
+            out.token(&text[piece.span.clone()], &piece, theme.token_style(&piece))?;
+        }
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn extract(select: Select, dedent: bool, text: &str) -> Result<Vec<String>, String> {
+        let snippet = Snippet { select, dedent, preserve_line_numbers: true };
+        let extract =
+            snippet.extract(text.as_bytes(), [DEFAULT_REGION_START, DEFAULT_REGION_END])?;
+        let lines = extract.lines.iter().zip(&extract.numbers);
+        Ok(lines.map(|(line, n)| format!("{n}:{}", &text[line.clone()])).collect())
+    }
+
+    #[test]
+    fn test_parse_lines() {
+        assert!(matches!(Select::parse_lines("40-72"), Ok(Select::Lines(40, 72))));
+        assert!(matches!(Select::parse_lines("40-"), Ok(Select::Lines(40, usize::MAX))));
+        assert!(matches!(Select::parse_lines("7"), Ok(Select::Lines(7, 7))));
+        for invalid in ["0-3", "5-4", "-3", "a-b", ""] {
+            assert!(Select::parse_lines(invalid).is_err(), "{invalid}");
+        }
+    }
+
+    #[test]
+    fn test_region() {
+        let text = "\
+func main() {
+\t// [region:init]
+\tx := 1
+\t// [region:inner]
+\t\ty := 2
+\t// [endregion]
+\t// [endregion]
+}
+";
+        let init = extract(Select::Region("init".to_string()), false, text).unwrap();
+        assert_eq!(init, ["3:\tx := 1\n", "5:\t\ty := 2\n"]);
+        let inner = extract(Select::Region("inner".to_string()), true, text).unwrap();
+        assert_eq!(inner, ["5:y := 2\n"]);
+
+        let err = extract(Select::Region("main".to_string()), false, text).unwrap_err();
+        assert_eq!(err, "unknown region 'main', expected init, inner");
+        let err = extract(Select::Region("init".to_string()), false, "x\n").unwrap_err();
+        assert_eq!(err, "unknown region 'init', the file has no [region:{}] markers");
+        let err = extract(Select::Region("a".to_string()), false, "// [region:a]\nx\n");
+        assert_eq!(err.unwrap_err(), "region 'a' isn't closed with [endregion]");
+
+        // Other markers work too, like `#region` in C#.
+        let csharp = Snippet {
+            select: Select::Region("Fields".to_string()),
+            dedent: false,
+            preserve_line_numbers: false,
+        };
+        let extract =
+            csharp.extract(b"#region Fields\nint x;\n#endregion\n", ["#region {}", "#endregion"]);
+        let lines = extract.unwrap().lines;
+        assert_eq!((lines.len(), lines[0].clone()), (1, 15..22));
+    }
+
+    #[test]
+    fn test_dedent() {
+        let text = "\tif x {\n\t\ty()\n\n\t}\n";
+        let lines = extract(Select::Lines(1, 4), true, text).unwrap();
+        assert_eq!(lines, ["1:if x {\n", "2:\ty()\n", "3:\n", "4:}\n"]);
+        // A tab and spaces have nothing in common, so nothing is stripped.
+        let text = "\tx\n    y\n";
+        assert_eq!(extract(Select::Lines(1, 2), true, text).unwrap(), ["1:\tx\n", "2:    y\n"]);
+        assert_eq!(extract(Select::Lines(2, usize::MAX), true, text).unwrap(), ["2:y\n"]);
+        assert!(extract(Select::Lines(3, 4), true, text).is_err());
+    }
+}
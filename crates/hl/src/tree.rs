@@ -0,0 +1,464 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//! `--recursive`: highlights a directory into a tree of HTML pages, with an index
+//! page per directory, as a browsable snapshot of the code.
+//!
+//! All links are relative, so that the output works from `file://` and any static host.
+
+use std::collections::{BTreeMap, BTreeSet};
+use std::fmt::Write as _;
+use std::fs;
+use std::io::{self, BufWriter, Write};
+use std::path::{Path, PathBuf};
+use std::sync::Mutex;
+use std::sync::atomic::{AtomicBool, Ordering};
+
+use edit::glob::glob_match;
+use edit::syntax::{
+    FileInput, FileResult, HighlightOptions, Language, SyntaxHighlighter, highlight_all, transcode,
+};
+
+use crate::format::{Format, Formatter, css_color, html_escape, page_colors};
+use crate::{Args, ThemeChoice, configured_language, create, highlight_options, write_tokens};
+
+/// Lines longer than this are only highlighted up to it, so that a minified
+/// or generated file doesn't stall the whole run.
+const MAX_LINE_LENGTH: usize = 10_000;
+/// Files with a NUL byte in this many leading bytes are binary.
+const BINARY_SNIFF_LEN: usize = 8000;
+
+/// A file found by [`walk`].
+pub struct Source {
+    /// The path relative to the root, with `/` as the separator.
+    pub rel: String,
+    pub path: PathBuf,
+}
+
+/// What was written for a [`Source`].
+struct Page {
+    language: Language,
+    lines: usize,
+}
+
+/// Writes a page for every file below `root` with a detected language into `out`,
+/// at the same relative path plus `.html`, and an `index.html` into every directory.
+/// Returns whether all of the files could be read.
+pub fn run(args: &Args, root: &Path, out: &Path) -> io::Result<bool> {
+    fs::create_dir_all(out)
+        .map_err(|err| io::Error::new(err.kind(), format!("{}: {err}", out.display())))?;
+    // Don't descend into the output, as in `hl -r -o html .`.
+    let sources = walk(root, args.gitignore, Some(out))?;
+
+    let name = fs::canonicalize(root)
+        .ok()
+        .and_then(|root| root.file_name().map(|name| name.to_string_lossy().into_owned()))
+        .unwrap_or_else(|| root.display().to_string());
+    let site = Site { args, name, out };
+
+    let files: Vec<_> = sources
+        .iter()
+        .map(|source| FileInput {
+            path: source.path.clone(),
+            text: None,
+            language: args.language.or_else(|| configured_language(args, &source.path)),
+            options: Some(page_options(args, &source.rel)),
+        })
+        .collect();
+    let pages: Vec<_> = sources.iter().map(|_| Mutex::new(None)).collect();
+    let all_written = AtomicBool::new(true);
+    let result = highlight_all(
+        &files,
+        0,
+        &args.theme.create(),
+        &HighlightOptions::default(),
+        &AtomicBool::new(false),
+        |file| {
+            let index = file.index;
+            match site.page(&sources[index], file) {
+                Ok(page) => *pages[index].lock().unwrap() = page,
+                Err(err) => {
+                    eprintln!("hl: {err}");
+                    all_written.store(false, Ordering::Relaxed);
+                }
+            }
+        },
+    );
+    let mut all_read = all_written.into_inner();
+    if let Err(err) = result {
+        for file in err.files {
+            eprintln!("hl: {}: {}", file.path.display(), file.error);
+        }
+        all_read = false;
+    }
+
+    let pages: Vec<_> = pages.into_iter().map(|page| page.into_inner().unwrap()).collect();
+    site.indexes(&sources, &pages)?;
+    Ok(all_read)
+}
+
+/// Returns the files below `root` sorted by path, without hidden files and directories,
+/// the ones ignored by `.gitignore` files if `gitignore` is set, and anything in `skip`.
+pub fn walk(root: &Path, gitignore: bool, skip: Option<&Path>) -> io::Result<Vec<Source>> {
+    let walk = Walk { gitignore, skip: skip.and_then(|skip| fs::canonicalize(skip).ok()) };
+    let mut sources = Vec::new();
+    walk.dir(root, "", &mut Vec::new(), &mut sources)?;
+    Ok(sources)
+}
+
+/// Returns whether `text` looks binary, like git decides it.
+pub fn is_binary(text: &[u8]) -> bool {
+    text[..text.len().min(BINARY_SNIFF_LEN)].contains(&0)
+}
+
+/// Finds the files to highlight.
+struct Walk {
+    gitignore: bool,
+    skip: Option<PathBuf>,
+}
+
+impl Walk {
+    /// Collects the files below `dir` sorted by path. Hidden files and directories,
+    /// like `.git`, are skipped, and so are the ones ignored by `.gitignore` files.
+    fn dir(
+        &self,
+        dir: &Path,
+        rel: &str,
+        ignores: &mut Vec<Ignore>,
+        sources: &mut Vec<Source>,
+    ) -> io::Result<()> {
+        let err = |err: io::Error| io::Error::new(err.kind(), format!("{}: {err}", dir.display()));
+        let gitignore =
+            if self.gitignore { fs::read_to_string(dir.join(".gitignore")).ok() } else { None };
+        if let Some(text) = &gitignore {
+            ignores.push(Ignore::parse(rel, text));
+        }
+
+        let mut entries: Vec<_> = fs::read_dir(dir).and_then(|d| d.collect()).map_err(err)?;
+        entries.sort_by_key(|entry| entry.file_name());
+        for entry in entries {
+            // Names that aren't UTF-8 can't be linked to reliably.
+            let Ok(name) = entry.file_name().into_string() else {
+                continue;
+            };
+            if name.starts_with('.') {
+                continue;
+            }
+            let path = entry.path();
+            // Symlinks are followed for files, but not for directories, which might loop.
+            let is_dir = entry.file_type().map_err(err)?.is_dir();
+            let rel = if rel.is_empty() { name } else { format!("{rel}/{name}") };
+            if ignores.iter().rev().find_map(|ignore| ignore.matches(&rel, is_dir)) == Some(true) {
+                continue;
+            }
+
+            if is_dir {
+                if self.skip.is_none() || fs::canonicalize(&path).ok() != self.skip {
+                    self.dir(&path, &rel, ignores, sources)?;
+                }
+            } else if path.is_file() {
+                sources.push(Source { rel, path });
+            }
+        }
+
+        if gitignore.is_some() {
+            ignores.pop();
+        }
+        Ok(())
+    }
+}
+
+/// The patterns of a `.gitignore` file, with the parts of the syntax that are
+/// common in practice: `#` comments, `!` to negate, a trailing `/` for directories,
+/// and a `/` anywhere else to match relative to the `.gitignore` instead of by name.
+struct Ignore {
+    /// The directory of the `.gitignore` relative to the root, with a trailing `/`.
+    base: String,
+    rules: Vec<IgnoreRule>,
+}
+
+struct IgnoreRule {
+    glob: String,
+    negated: bool,
+    dir_only: bool,
+    /// Whether the glob matches the path relative to the `.gitignore` instead of the name.
+    anchored: bool,
+}
+
+impl Ignore {
+    fn parse(dir: &str, text: &str) -> Self {
+        let base = if dir.is_empty() { String::new() } else { format!("{dir}/") };
+        let rules = text
+            .lines()
+            .map(|line| line.trim_end())
+            .filter(|line| !line.is_empty() && !line.starts_with('#'))
+            .map(|line| {
+                let (negated, line) = match line.strip_prefix('!') {
+                    Some(line) => (true, line),
+                    None => (false, line),
+                };
+                let (dir_only, line) = match line.strip_suffix('/') {
+                    Some(line) => (true, line),
+                    None => (false, line),
+                };
+                let anchored = line.contains('/');
+                let glob = line.strip_prefix('/').unwrap_or(line).to_string();
+                IgnoreRule { glob, negated, dir_only, anchored }
+            })
+            .collect();
+        Self { base, rules }
+    }
+
+    /// Returns whether the last pattern matching `rel` ignores it,
+    /// or `None` if none of them match.
+    fn matches(&self, rel: &str, is_dir: bool) -> Option<bool> {
+        let rel = rel.strip_prefix(&self.base)?;
+        let name = rel.rsplit('/').next().unwrap_or(rel);
+        self.rules
+            .iter()
+            .rev()
+            .find(|rule| {
+                (is_dir || !rule.dir_only)
+                    && glob_match(&rule.glob, if rule.anchored { rel } else { name })
+            })
+            .map(|rule| !rule.negated)
+    }
+}
+
+/// Writes the pages.
+struct Site<'a> {
+    args: &'a Args,
+    /// The name of the root directory, for titles and breadcrumbs.
+    name: String,
+    out: &'a Path,
+}
+
+impl Site<'_> {
+    /// Writes the page for `source`, as `file` was highlighted,
+    /// unless it's binary or its language isn't detected.
+    fn page(&self, source: &Source, file: FileResult) -> io::Result<Option<Page>> {
+        let text = file.text;
+        if is_binary(&text) || file.language == Language::PlainText {
+            return Ok(None);
+        }
+        for warning in &file.warnings {
+            eprintln!("hl: {}: warning: {warning}", source.rel);
+        }
+
+        let page = self.out.join(format!("{}.html", source.rel));
+        if let Some(dir) = page.parent() {
+            fs::create_dir_all(dir)?;
+        }
+        let mut w = BufWriter::new(create(page.as_os_str())?);
+        self.head(&mut w, &source.rel)?;
+        self.breadcrumbs(&mut w, &source.rel, false)?;
+
+        let args = self.args;
+        let mut out =
+            Formatter::new(w, Format::Html).with_tab_width(args.tab_width).with_tabs(args.tabs);
+        let theme = args.theme.create();
+        write_tokens(
+            &mut out,
+            args,
+            &theme,
+            &source.rel,
+            file.language,
+            false,
+            &text,
+            &file.tokens,
+        )?;
+
+        let mut w = out.into_inner();
+        w.write_all(b"</body>\n</html>\n")?;
+        w.flush()?;
+
+        let lines = text.iter().filter(|&&b| b == b'\n').count();
+        let lines = lines + usize::from(text.last().is_some_and(|&b| b != b'\n'));
+        Ok(Some(Page { language: file.language, lines }))
+    }
+
+    /// Writes an `index.html` for every directory with pages in it, or below it.
+    fn indexes(&self, sources: &[Source], pages: &[Option<Page>]) -> io::Result<()> {
+        // The subdirectories and files of each directory, by its relative path.
+        let mut dirs: BTreeMap<&str, (BTreeSet<&str>, Vec<usize>)> = BTreeMap::new();
+        dirs.entry("").or_default();
+        for (i, source) in sources.iter().enumerate() {
+            if pages[i].is_none() {
+                continue;
+            }
+            let (mut dir, _) = split(&source.rel);
+            dirs.entry(dir).or_default().1.push(i);
+            while !dir.is_empty() {
+                let (parent, name) = split(dir);
+                dirs.entry(parent).or_default().0.insert(name);
+                dir = parent;
+            }
+        }
+
+        for (dir, (subdirs, files)) in dirs {
+            let path = self.out.join(dir).join("index.html");
+            fs::create_dir_all(path.parent().unwrap_or(self.out))?;
+            let mut w = BufWriter::new(create(path.as_os_str())?);
+            self.head(&mut w, dir)?;
+            self.breadcrumbs(&mut w, dir, true)?;
+
+            w.write_all(b"<table>\n<tr><th>Name</th><th>Language</th><th>Lines</th></tr>\n")?;
+            for name in subdirs {
+                let href = url_escape(&format!("{name}/index.html"));
+                let name = html_escape(name);
+                writeln!(w, "<tr><td><a href=\"{href}\">{name}/</a></td><td></td><td></td></tr>")?;
+            }
+            for i in files {
+                let (_, name) = split(&sources[i].rel);
+                let Some(page) = &pages[i] else { continue };
+                let href = url_escape(&format!("{name}.html"));
+                writeln!(
+                    w,
+                    "<tr><td><a href=\"{href}\">{}</a></td><td>{}</td><td class=\"lines\">{}</td></tr>",
+                    html_escape(name),
+                    page.language.name(),
+                    page.lines,
+                )?;
+            }
+            w.write_all(b"</table>\n</body>\n</html>\n")?;
+            w.flush()?;
+        }
+        Ok(())
+    }
+
+    fn head(&self, w: &mut impl Write, rel: &str) -> io::Result<()> {
+        let title = if rel.is_empty() { self.name.clone() } else { format!("{}/{rel}", self.name) };
+        page_head(w, &title, self.args.theme.dark)
+    }
+
+    /// Writes links to the indexes of the root and every directory down to `rel`.
+    /// `rel` is the page's directory if `is_index`, and its file otherwise.
+    fn breadcrumbs(&self, w: &mut impl Write, rel: &str, is_index: bool) -> io::Result<()> {
+        let dir = if is_index { rel } else { split(rel).0 };
+        let names: Vec<_> = if rel.is_empty() { Vec::new() } else { rel.split('/').collect() };
+        // How many directories below the root the page is.
+        let depth = if dir.is_empty() { 0 } else { dir.split('/').count() };
+
+        let mut nav = String::from("<nav>");
+        for (level, name) in
+            [self.name.as_str()].into_iter().chain(names.iter().copied()).enumerate()
+        {
+            if level > 0 {
+                nav.push_str(" / ");
+            }
+            if level == names.len() {
+                // The page itself.
+                nav.push_str(&html_escape(name));
+            } else {
+                let href = "../".repeat(depth - level) + "index.html";
+                _ = write!(nav, "<a href=\"{href}\">{}</a>", html_escape(name));
+            }
+        }
+        nav.push_str("</nav>\n");
+        w.write_all(nav.as_bytes())
+    }
+}
+
+/// Writes the start of an HTML page up to and including `<body>`,
+/// in the colors of a dark or light theme.
+pub fn page_head(w: &mut impl Write, title: &str, dark: bool) -> io::Result<()> {
+    let [background, foreground] = page_colors(dark).map(css_color);
+    write!(
+        w,
+        concat!(
+            "<!DOCTYPE html>\n",
+            "<html>\n",
+            "<head>\n",
+            "<meta charset=\"utf-8\">\n",
+            "<title>{title}</title>\n",
+            "<style>\n",
+            "body {{ background: {background}; color: {foreground}; font-family: sans-serif; }}\n",
+            "a {{ color: inherit; }}\n",
+            "th, td {{ padding: 0.1em 1em 0.1em 0; text-align: left; }}\n",
+            "td.lines {{ text-align: right; }}\n",
+            "</style>\n",
+            "</head>\n",
+            "<body>\n",
+        ),
+        title = html_escape(title),
+        background = background,
+        foreground = foreground,
+    )
+}
+
+/// Writes the highlighted `<pre>` of a page for the file at `rel`.
+pub fn page_body<W: Write>(
+    out: &mut Formatter<W>,
+    args: &Args,
+    theme: &ThemeChoice,
+    rel: &str,
+    input: &[u8],
+    language: Language,
+) -> io::Result<()> {
+    let text = transcode(input).text;
+    let theme = theme.create();
+    let mut highlighter = SyntaxHighlighter::new(language, theme.clone());
+    highlighter.set_options(page_options(args, rel));
+    highlighter.update(&text, true);
+    for warning in highlighter.warnings() {
+        eprintln!("hl: {rel}: warning: {warning}");
+    }
+    write_tokens(out, args, &theme, rel, language, false, &text, highlighter.tokens())
+}
+
+/// The options for the page of the file at `rel`.
+fn page_options(args: &Args, rel: &str) -> HighlightOptions {
+    HighlightOptions {
+        max_line_length: Some(MAX_LINE_LENGTH),
+        ..highlight_options(args, Path::new(rel))
+    }
+}
+
+/// Splits a relative path into its directory and name.
+fn split(rel: &str) -> (&str, &str) {
+    rel.rsplit_once('/').unwrap_or(("", rel))
+}
+
+/// Percent-encodes `path` for an `href`, keeping the `/` separators.
+pub fn url_escape(path: &str) -> String {
+    let mut result = String::with_capacity(path.len());
+    for b in path.bytes() {
+        if b.is_ascii_alphanumeric() || matches!(b, b'-' | b'.' | b'_' | b'~' | b'/') {
+            result.push(b as char);
+        } else {
+            _ = write!(result, "%{b:02X}");
+        }
+    }
+    result
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_ignore() {
+        let ignore = Ignore::parse("", "# build output\ntarget/\n*.log\n!keep.log\n/docs/*.tmp\n");
+        assert_eq!(ignore.matches("target", true), Some(true));
+        assert_eq!(ignore.matches("src/target", true), Some(true));
+        assert_eq!(ignore.matches("target", false), None);
+        assert_eq!(ignore.matches("a/b/debug.log", false), Some(true));
+        assert_eq!(ignore.matches("keep.log", false), Some(false));
+        assert_eq!(ignore.matches("docs/a.tmp", false), Some(true));
+        assert_eq!(ignore.matches("src/docs/a.tmp", false), None);
+        assert_eq!(ignore.matches("main.go", false), None);
+
+        // Patterns are relative to the directory of their `.gitignore`.
+        let ignore = Ignore::parse("src", "/gen.go\n");
+        assert_eq!(ignore.matches("src/gen.go", false), Some(true));
+        assert_eq!(ignore.matches("gen.go", false), None);
+        assert_eq!(ignore.matches("src/sub/gen.go", false), None);
+    }
+
+    #[test]
+    fn test_url_escape() {
+        assert_eq!(url_escape("src/main.go.html"), "src/main.go.html");
+        assert_eq!(url_escape("a b/#1?.html"), "a%20b/%231%3F.html");
+        assert_eq!(url_escape("ä.html"), "%C3%A4.html");
+    }
+}
@@ -0,0 +1,107 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//! `--watch`: highlights a file again whenever it changes.
+//!
+//! The file is polled instead of using inotify & co. That keeps `hl` free of
+//! dependencies, works the same on every platform and on network drives,
+//! and a file that's replaced by a rename simply looks like a changed file.
+
+use std::path::Path;
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::time::{Duration, Instant, SystemTime};
+use std::{fs, io, thread};
+
+/// How often the file is checked for changes.
+const POLL_INTERVAL: Duration = Duration::from_millis(100);
+/// How long a change has to settle before it's rendered, so that an editor
+/// writing a file in several chunks doesn't cause a render for each of them.
+const DEBOUNCE: Duration = Duration::from_millis(100);
+/// How long the file may be missing before watching stops. Some editors
+/// delete the file before writing the new one instead of renaming over it.
+const GONE_TIMEOUT: Duration = Duration::from_secs(1);
+
+static INTERRUPTED: AtomicBool = AtomicBool::new(false);
+
+/// The file as it was when it was last polled.
+#[derive(Clone, Copy, PartialEq, Eq)]
+struct Stamp {
+    len: u64,
+    modified: Option<SystemTime>,
+}
+
+impl Stamp {
+    fn of(path: &Path) -> io::Result<Self> {
+        let metadata = fs::metadata(path)?;
+        Ok(Self { len: metadata.len(), modified: metadata.modified().ok() })
+    }
+}
+
+/// Calls `render` with the contents of the file at `path`, and then again
+/// after every change, until the file is gone for good or Ctrl-C is pressed.
+///
+/// Files that can't be read are reported and skipped until they change again.
+/// Errors from `render` stop the watch and are returned.
+pub fn watch(path: &Path, mut render: impl FnMut(&[u8]) -> io::Result<()>) -> io::Result<()> {
+    catch_interrupt();
+
+    // The first render isn't debounced.
+    let mut rendered = None;
+    let mut pending: Option<(Stamp, Instant)> = Stamp::of(path).ok().map(|s| (s, Instant::now()));
+    let mut gone_since = None;
+
+    loop {
+        if let Some((stamp, since)) = pending
+            && (rendered.is_none() || since.elapsed() >= DEBOUNCE)
+        {
+            match fs::read(path) {
+                Ok(text) => render(&text)?,
+                Err(err) => eprintln!("hl: {}: {err}", path.display()),
+            }
+            rendered = Some(stamp);
+            pending = None;
+        }
+
+        thread::sleep(POLL_INTERVAL);
+        if INTERRUPTED.load(Ordering::Relaxed) {
+            return Ok(());
+        }
+
+        match Stamp::of(path) {
+            Ok(stamp) => {
+                gone_since = None;
+                // Every new stamp restarts the debounce.
+                if Some(stamp) != rendered && pending.is_none_or(|(s, _)| s != stamp) {
+                    pending = Some((stamp, Instant::now()));
+                }
+            }
+            Err(err) if err.kind() == io::ErrorKind::NotFound => {
+                pending = None;
+                if gone_since.get_or_insert_with(Instant::now).elapsed() >= GONE_TIMEOUT {
+                    eprintln!("hl: {}: file is gone, stopped watching", path.display());
+                    return Ok(());
+                }
+            }
+            Err(err) => return Err(err),
+        }
+    }
+}
+
+/// Turns Ctrl-C into a flag that [`watch`] polls, so that it stops between
+/// renders instead of in the middle of an escape sequence or output file.
+#[cfg(unix)]
+fn catch_interrupt() {
+    extern "C" fn sigint_handler(_: libc::c_int) {
+        INTERRUPTED.store(true, Ordering::Relaxed);
+    }
+
+    unsafe {
+        let mut action: libc::sigaction = std::mem::zeroed();
+        action.sa_sigaction = sigint_handler as *const () as libc::sighandler_t;
+        libc::sigaction(libc::SIGINT, &action, std::ptr::null_mut());
+    }
+}
+
+/// Ctrl-C keeps its default behavior of ending the process.
+#[cfg(not(unix))]
+fn catch_interrupt() {}
@@ -0,0 +1,1373 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+//! Runs the `hl` binary like a user would.
+
+use std::io::{Read, Write};
+use std::process::{Command, Output, Stdio};
+
+const GO_FIXTURE: &str = concat!(env!("CARGO_MANIFEST_DIR"), "/../../syntax-tests/test_syntax.go");
+const JS_FIXTURE: &str = concat!(env!("CARGO_MANIFEST_DIR"), "/../../syntax-tests/test_syntax.js");
+
+fn hl(args: &[&str]) -> Output {
+    Command::new(env!("CARGO_BIN_EXE_hl"))
+        .args(args)
+        .env_remove("COLORTERM")
+        .env_remove("NO_COLOR")
+        .env_remove("TMUX")
+        .env_remove("STY")
+        .env("HL_CONFIG", "")
+        .stdin(Stdio::null())
+        .output()
+        .expect("failed to run hl")
+}
+
+/// Runs `hl` with `input` piped into it.
+fn hl_stdin(args: &[&str], input: &[u8]) -> Output {
+    let mut child = Command::new(env!("CARGO_BIN_EXE_hl"))
+        .args(args)
+        .env_remove("NO_COLOR")
+        .env("HL_CONFIG", "")
+        .stdin(Stdio::piped())
+        .stdout(Stdio::piped())
+        .stderr(Stdio::piped())
+        .spawn()
+        .unwrap();
+    child.stdin.take().unwrap().write_all(input).unwrap();
+    child.wait_with_output().unwrap()
+}
+
+fn stdout(output: &Output) -> String {
+    String::from_utf8(output.stdout.clone()).unwrap()
+}
+
+/// Strips SGR escapes, which must leave the input.
+fn strip_sgr(s: &str) -> String {
+    let mut result = String::new();
+    let mut rest = s;
+    while let Some(i) = rest.find("\x1b[") {
+        result.push_str(&rest[..i]);
+        let end = rest[i..].find('m').unwrap();
+        rest = &rest[i + end + 1..];
+    }
+    result.push_str(rest);
+    result
+}
+
+/// Strips the tags of `hl -f html` and undoes its escapes, which must leave the input.
+/// The line numbers and the text between elements are left out. Panics unless every tag is closed in the right order.
+fn strip_html(s: &str) -> String {
+    let mut result = String::new();
+    let mut open: Vec<(&str, bool)> = Vec::new();
+    let mut rest = s;
+    while let Some(i) = rest.find('<') {
+        let text = &rest[..i];
+        assert!(!text.contains('>'), "unescaped > in {text:?}");
+        if open.last().is_some_and(|&(_, number)| !number) {
+            result.push_str(text);
+        }
+        let end = rest[i..].find('>').expect("unclosed tag") + i;
+        let tag = &rest[i + 1..end];
+        if let Some(name) = tag.strip_prefix('/') {
+            assert_eq!(open.pop().map(|(name, _)| name), Some(name), "mismatched </{name}>");
+        } else {
+            let name = tag.split(' ').next().unwrap();
+            assert!(matches!(name, "pre" | "span" | "a"), "unexpected <{tag}>");
+            open.push((name, tag.contains("class=\"hl-ln\"")));
+        }
+        rest = &rest[end + 1..];
+    }
+    assert!(open.is_empty(), "unclosed {open:?}");
+    result.replace("&lt;", "<").replace("&gt;", ">").replace("&quot;", "\"").replace("&amp;", "&")
+}
+
+#[test]
+fn test_formatters() {
+    let fixture = std::fs::read_to_string(GO_FIXTURE).unwrap();
+
+    for (formatter, color) in
+        [("ansi", "\x1b[3"), ("ansi256", "\x1b[38;5;"), ("truecolor", "\x1b[38;2;")]
+    {
+        let output = hl(&["--formatter", formatter, "--color=always", GO_FIXTURE]);
+        assert!(output.status.success(), "{formatter}");
+        let out = stdout(&output);
+        assert!(out.contains(color), "{formatter}");
+        assert_eq!(strip_sgr(&out), fixture, "{formatter}");
+    }
+
+    let html = stdout(&hl(&["-f", "html", GO_FIXTURE]));
+    assert!(html.starts_with("<pre class=\"hl\" data-language=\"Go\"><span style=\"color:#"));
+    assert!(html.ends_with("</pre>\n"));
+    assert!(html.contains("&lt;-"), "channel operators are escaped");
+
+    let json = stdout(&hl(&["--formatter=json", GO_FIXTURE]));
+    let lines: Vec<_> = json.lines().collect();
+    assert!(lines[0].starts_with("{\"file\":\""));
+    assert!(lines[0].ends_with(
+        "\"kind\":\"comment\",\"start\":0,\"end\":22,\"text\":\"// Go Syntax Test File\"}"
+    ));
+    assert!(
+        lines[1].ends_with("\"kind\":\"whitespace\",\"start\":22,\"end\":23,\"text\":\"\\n\"}")
+    );
+    assert!(lines.iter().any(|l| l.contains("\"kind\":\"keyword\"") && l.contains("package")));
+}
+
+#[test]
+fn test_ansi_snapshots() {
+    let fixture = std::fs::read_to_string(GO_FIXTURE).unwrap();
+    let json = stdout(&hl(&["-f", "json", GO_FIXTURE]));
+    let tokens = json.lines().filter(|l| !l.contains("\"kind\":\"whitespace\"")).count();
+
+    for formatter in ["ansi", "ansi256", "truecolor"] {
+        let output = hl(&["-f", formatter, "--color=always", "-t", "dark", GO_FIXTURE]);
+        assert!(output.status.success());
+        let ansi = stdout(&output);
+        let snapshot =
+            format!("{}/tests/ansi/test_syntax.go.{formatter}", env!("CARGO_MANIFEST_DIR"));
+        if std::env::var_os("UPDATE_SNAPSHOTS").is_some() {
+            std::fs::write(&snapshot, &ansi).unwrap();
+        }
+        assert!(
+            ansi == std::fs::read_to_string(&snapshot).unwrap(),
+            "the output changed, rerun with UPDATE_SNAPSHOTS=1 and review the diff of {snapshot}"
+        );
+        assert_eq!(strip_sgr(&ansi), fixture, "{formatter}");
+
+        // No style carries over into the next line, for `less -R`.
+        for line in ansi.lines() {
+            let last = line.rfind("\x1b[").map(|i| &line[i..]);
+            assert!(last.is_none_or(|l| l.starts_with("\x1b[0m")), "{formatter}: {line:?}");
+        }
+        // Tokens in the same style share their escapes. Without that, it's two per token.
+        let escapes = ansi.matches("\x1b[").count();
+        assert!(escapes < tokens, "{formatter}: {escapes} escapes for {tokens} tokens");
+    }
+}
+
+#[test]
+fn test_languages() {
+    let output = hl_stdin(&["-f", "json", "--lang", "golang"], b"func main() {}\n");
+    assert!(output.status.success());
+    let out = stdout(&output);
+    assert!(out.contains("\"file\":\"(standard input)\""));
+    assert!(out.contains("\"kind\":\"keyword\",\"start\":0,\"end\":4"), "{out}");
+
+    // Without `--lang`, stdin is sniffed.
+    let output = hl_stdin(&["-f", "html", "-"], b"#!/usr/bin/env python3\nprint(1)\n");
+    assert!(stdout(&output).starts_with("<pre class=\"hl\" data-language=\"Python\">"));
+    let output = hl_stdin(&["-f", "html"], b"<?xml version=\"1.0\"?>\n");
+    assert!(stdout(&output).starts_with("<pre class=\"hl\" data-language=\"XML\">"));
+
+    let output = hl(&["--lang", "klingon", GO_FIXTURE]);
+    assert_eq!(output.status.code(), Some(1));
+    assert!(output.stdout.is_empty());
+    assert!(String::from_utf8_lossy(&output.stderr).contains("unknown language 'klingon'"));
+
+    assert_eq!(hl(&["--formatter", "svg", GO_FIXTURE]).status.code(), Some(1));
+    assert_eq!(hl(&["--theme", "solarized", GO_FIXTURE]).status.code(), Some(1));
+    assert_eq!(hl(&["--frobnicate", GO_FIXTURE]).status.code(), Some(1));
+    assert!(hl(&["--lang", "Plain Text", "--theme", "light", GO_FIXTURE]).status.success());
+}
+
+#[test]
+fn test_sql_dialect() {
+    let query = b"SELECT \"a\" FROM t;\n";
+    let kind_of_a = |args: &[&str], input: &[u8]| {
+        let out = stdout(&hl_stdin(&[&["-f", "json", "-l", "sql"], args].concat(), input));
+        let line = out.lines().find(|l| l.contains("\"text\":\"\\\"a\\\"\"")).unwrap().to_string();
+        line.split("\"kind\":\"").nth(1).unwrap().split('"').next().unwrap().to_string()
+    };
+
+    // MySQL quotes strings with `"`, where the others quote identifiers.
+    assert_eq!(kind_of_a(&[], query), "identifier");
+    assert_eq!(kind_of_a(&["--sql-dialect", "mysql"], query), "string");
+    assert_eq!(kind_of_a(&["--sql-dialect=postgres"], query), "identifier");
+    // A hint in the file wins over the flag.
+    let hinted = b"-- dialect: mariadb\nSELECT \"a\" FROM t;\n";
+    assert_eq!(kind_of_a(&["--sql-dialect", "postgres"], hinted), "string");
+
+    let output = hl(&["--sql-dialect", "oracle", GO_FIXTURE]);
+    assert_eq!(output.status.code(), Some(1));
+    assert!(String::from_utf8_lossy(&output.stderr).contains("unknown SQL dialect 'oracle'"));
+}
+
+#[test]
+fn test_lang_version() {
+    let source = b"package main\n\nfunc F[T any](a T) T { return a }\n";
+    let kind_of_any = |args: &[&str]| {
+        let out = stdout(&hl_stdin(&[&["-f", "json", "-l", "go"], args].concat(), source));
+        let line = out.lines().find(|l| l.contains("\"any\"")).unwrap().to_string();
+        line.split("\"kind\":\"").nth(1).unwrap().split('"').next().unwrap().to_string()
+    };
+
+    assert_eq!(kind_of_any(&[]), "type_name");
+    assert_eq!(kind_of_any(&["--lang-version", "1.17"]), "identifier");
+    assert_eq!(kind_of_any(&["--lang-version=1.20"]), "type_name");
+
+    // An unknown version only warns, and other languages ignore the flag.
+    let output = hl(&["--lang-version", "banana", GO_FIXTURE]);
+    assert_eq!(output.status.code(), Some(0));
+    assert!(
+        String::from_utf8_lossy(&output.stderr).contains("warning: unknown Go version 'banana'")
+    );
+    let output = hl(&["--lang-version", "banana", JS_FIXTURE]);
+    assert_eq!(output.status.code(), Some(0));
+    assert!(output.stderr.is_empty());
+}
+
+#[test]
+fn test_inject_strings() {
+    let source = b"package main\n\nvar userQuery = \"SELECT 1\"\n";
+    let kind_of_select = |args: &[&str]| {
+        let out = stdout(&hl_stdin(&[&["-f", "json", "-l", "go"], args].concat(), source));
+        let line = out.lines().find(|l| l.contains("SELECT")).unwrap().to_string();
+        line.split("\"kind\":\"").nth(1).unwrap().split('"').next().unwrap().to_string()
+    };
+
+    assert_eq!(kind_of_select(&[]), "string");
+    assert_eq!(kind_of_select(&["--inject-strings", "Query=sql"]), "keyword");
+    assert_eq!(kind_of_select(&["--inject-strings=Name=sql"]), "string");
+
+    for (value, error) in [("Query", "expected SUFFIX=LANG"), ("Query=cobol", "unknown language")] {
+        let output = hl(&["--inject-strings", value, GO_FIXTURE]);
+        assert_eq!(output.status.code(), Some(1));
+        assert!(String::from_utf8_lossy(&output.stderr).contains(error));
+    }
+}
+
+#[test]
+fn test_multiple_files() {
+    let go = std::fs::read_to_string(GO_FIXTURE).unwrap();
+    let js = std::fs::read_to_string(JS_FIXTURE).unwrap();
+
+    // Files are concatenated, with a header line each.
+    let output = hl(&["-f", "ansi", GO_FIXTURE, JS_FIXTURE]);
+    assert!(output.status.success());
+    let out = strip_sgr(&stdout(&output));
+    assert_eq!(out, format!("{GO_FIXTURE}\n{go}{JS_FIXTURE}\n{js}"));
+
+    let output = hl(&["-f", "ansi", "--no-filename", GO_FIXTURE, JS_FIXTURE]);
+    assert_eq!(strip_sgr(&stdout(&output)), format!("{go}{js}"));
+    let output = hl(&["-f", "ansi", "-H", GO_FIXTURE]);
+    assert_eq!(strip_sgr(&stdout(&output)), format!("{GO_FIXTURE}\n{go}"));
+
+    // An unreadable file is reported, but doesn't stop the others.
+    let output = hl(&["-f", "ansi", "/nonexistent/file.go", JS_FIXTURE]);
+    assert_eq!(output.status.code(), Some(2));
+    assert!(String::from_utf8_lossy(&output.stderr).contains("/nonexistent/file.go"));
+    assert_eq!(strip_sgr(&stdout(&output)), format!("{JS_FIXTURE}\n{js}"));
+}
+
+#[test]
+fn test_control_characters() {
+    // Escape sequences in a file must not reach the terminal.
+    let input = b"// \x1b]0;pwned\x07\n";
+    let out = stdout(&hl_stdin(&["-f", "truecolor", "--color", "always", "-l", "go"], input));
+    assert!(!out.contains("\x1b]"));
+    assert!(strip_sgr(&out).contains("\u{241B}]0;pwned\u{2407}"));
+}
+
+#[test]
+fn test_color_choice() {
+    let fixture = std::fs::read(GO_FIXTURE).unwrap();
+    let colored = |output: &Output| output.stdout.windows(2).any(|w| w == b"\x1b[");
+
+    // Piped output isn't colored, and is then the input as is.
+    let output = hl(&["-f", "truecolor", GO_FIXTURE]);
+    assert!(output.status.success());
+    assert_eq!(output.stdout, fixture);
+    let output = hl_stdin(&["-l", "go"], &fixture);
+    assert_eq!(output.stdout, fixture);
+    let output = hl(&["-f", "plain", "--color=always", GO_FIXTURE]);
+    assert_eq!(output.stdout, fixture);
+
+    assert!(colored(&hl(&["--color=always", GO_FIXTURE])));
+    assert!(!colored(&hl(&["--color=never", GO_FIXTURE])));
+    assert_eq!(hl(&["--color=sometimes", GO_FIXTURE]).status.code(), Some(1));
+
+    // NO_COLOR only changes the default, `--color=always` still wins.
+    let no_color = |args: &[&str]| {
+        let mut command = Command::new(env!("CARGO_BIN_EXE_hl"));
+        command.args(args).env("NO_COLOR", "1").env("HL_CONFIG", "").output().unwrap()
+    };
+    assert!(!colored(&no_color(&[GO_FIXTURE])));
+    assert!(colored(&no_color(&["--color=always", GO_FIXTURE])));
+    // HTML and JSON have no terminal colors to turn off.
+    assert!(stdout(&no_color(&["-f", "html", GO_FIXTURE])).contains("<span style="));
+}
+
+#[test]
+fn test_broken_pipe() {
+    // Like `hl big.go | head -1`: the reader goes away before hl is done.
+    let args: Vec<_> = std::iter::repeat_n(GO_FIXTURE, 200).collect();
+    let mut child = Command::new(env!("CARGO_BIN_EXE_hl"))
+        .args(["--color=always"])
+        .args(&args)
+        .stdout(Stdio::piped())
+        .stderr(Stdio::piped())
+        .spawn()
+        .unwrap();
+    let mut stdout = child.stdout.take().unwrap();
+    let mut first = [0; 64];
+    stdout.read_exact(&mut first).unwrap();
+    drop(stdout);
+
+    let output = child.wait_with_output().unwrap();
+    assert!(output.status.success());
+    assert_eq!(String::from_utf8_lossy(&output.stderr), "");
+}
+
+#[test]
+fn test_streaming() {
+    // Like `tail -f dump.sql | hl`: lines come out before the input ends. Go's doc comments
+    // need all of the file, SQL's tokens don't.
+    let sql = concat!(env!("CARGO_MANIFEST_DIR"), "/../../syntax-tests/test_syntax.sql");
+    let input = std::fs::read_to_string(sql).unwrap().repeat(40);
+    let mut child = Command::new(env!("CARGO_BIN_EXE_hl"))
+        .args(["-l", "sql", "-f", "truecolor", "--color=always"])
+        .env("HL_CONFIG", "")
+        .stdin(Stdio::piped())
+        .stdout(Stdio::piped())
+        .stderr(Stdio::piped())
+        .spawn()
+        .unwrap();
+
+    // Keep stdin open until the test has seen the output, without blocking on either pipe.
+    let (close, closed) = std::sync::mpsc::channel();
+    let writer = {
+        let mut stdin = child.stdin.take().unwrap();
+        let input = input.clone();
+        std::thread::spawn(move || {
+            stdin.write_all(input.as_bytes()).unwrap();
+            closed.recv().unwrap();
+        })
+    };
+    let out = std::sync::Arc::new(std::sync::Mutex::new(Vec::new()));
+    let reader = {
+        let out = out.clone();
+        let mut stdout = child.stdout.take().unwrap();
+        std::thread::spawn(move || {
+            let mut buf = [0; 4096];
+            while let Ok(n @ 1..) = stdout.read(&mut buf) {
+                out.lock().unwrap().extend_from_slice(&buf[..n]);
+            }
+        })
+    };
+
+    let lines = input.lines().count();
+    eventually("the output", || {
+        out.lock().unwrap().iter().filter(|&&b| b == b'\n').count() > lines / 2
+    });
+    close.send(()).unwrap();
+    writer.join().unwrap();
+    let output = child.wait_with_output().unwrap();
+    reader.join().unwrap();
+    assert!(output.status.success());
+
+    // Spanning many sections of the lexer doesn't lose or garble any of it.
+    let out = String::from_utf8(out.lock().unwrap().clone()).unwrap();
+    assert_eq!(strip_sgr(&out), input);
+    let (first, last) = out.split_at(out.len() / 2);
+    assert!(first.contains("\x1b[") && last.contains("\x1b["));
+
+    // Rainbow brackets and doc comments are the same far down a file as at the top.
+    let go = std::fs::read_to_string(GO_FIXTURE).unwrap();
+    let args = ["-l", "go", "--rainbow-brackets", "-f", "truecolor", "--color=always"];
+    let once = stdout(&hl_stdin(&args, go.as_bytes()));
+    assert_eq!(stdout(&hl_stdin(&args, go.repeat(10).as_bytes())), once.repeat(10));
+}
+
+#[test]
+fn test_list_languages() {
+    use edit::syntax::Language;
+
+    let output = hl(&["--list-languages", "--json"]);
+    assert!(output.status.success());
+    let arena = stdext::arena::Arena::new(1 << 20).unwrap();
+    let json = edit::json::parse(&arena, &stdout(&output)).unwrap();
+    let json = json.as_object().unwrap();
+    assert_eq!(json.get_number("version"), Some(1.0));
+
+    let strings = |value: &[edit::json::Value]| -> Vec<String> {
+        value.iter().map(|v| v.as_str().unwrap().to_string()).collect()
+    };
+    let languages = json.get_array("languages").unwrap();
+    assert_eq!(languages.len(), Language::ALL.len());
+    for (entry, &language) in languages.iter().zip(Language::ALL) {
+        let entry = entry.as_object().unwrap();
+        assert_eq!(entry.get_str("name"), Some(language.id()));
+        assert_eq!(entry.get_str("display_name"), Some(language.name()));
+        assert_eq!(strings(entry.get_array("aliases").unwrap()), language.aliases());
+        assert_eq!(strings(entry.get_array("extensions").unwrap()), language.extensions());
+    }
+
+    // Every listed name, alias and extension works for `--lang`.
+    for &language in Language::ALL {
+        let names = [language.id(), language.name()].into_iter();
+        for name in names.chain(language.aliases().iter().copied()) {
+            let output = hl(&["-f", "html", "--lang", name, GO_FIXTURE]);
+            let pre = format!("<pre class=\"hl\" data-language=\"{}\">", language.name());
+            assert!(stdout(&output).starts_with(&pre), "{name}");
+        }
+    }
+
+    // The columns are aligned.
+    let out = stdout(&hl(&["--list-languages"]));
+    let lines: Vec<_> = out.lines().collect();
+    assert_eq!(lines.len(), Language::ALL.len() + 1);
+    let column = lines[0].find("EXTENSIONS").unwrap();
+    assert_eq!(&lines[3][column..], ".rs");
+    assert!(lines[1..].iter().zip(Language::ALL).all(|(l, lang)| l.starts_with(lang.id())));
+}
+
+#[test]
+fn test_list_themes() {
+    use edit::syntax::Theme;
+
+    let output = hl(&["--list-themes", "--json"]);
+    assert!(output.status.success());
+    let arena = stdext::arena::Arena::new(1 << 20).unwrap();
+    let json = edit::json::parse(&arena, &stdout(&output)).unwrap();
+    let json = json.as_object().unwrap();
+    assert_eq!(json.get_number("version"), Some(1.0));
+
+    let themes = json.get_array("themes").unwrap();
+    assert_eq!(themes.len(), Theme::BUILTIN.len());
+    for (entry, theme) in themes.iter().zip(Theme::BUILTIN) {
+        let entry = entry.as_object().unwrap();
+        assert_eq!(entry.get_str("name"), Some(theme.name));
+        let appearance = if theme.dark { "dark" } else { "light" };
+        assert_eq!(entry.get_str("appearance"), Some(appearance));
+        assert!(hl(&["--theme", theme.name, GO_FIXTURE]).status.success());
+    }
+
+    assert_eq!(
+        stdout(&hl(&["--list-themes"])),
+        "NAME   APPEARANCE\ndark   dark\nlight  light\ndusk   dark\npaper  light\n"
+    );
+    // `--json` is only for the listings.
+    assert_eq!(hl(&["--json", GO_FIXTURE]).status.code(), Some(1));
+}
+
+/// A directory for a test's files, removed again when dropped.
+struct TempDir(std::path::PathBuf);
+
+impl TempDir {
+    fn new(name: &str) -> Self {
+        let path = std::env::temp_dir().join(format!("hl-{name}-{}", std::process::id()));
+        _ = std::fs::remove_dir_all(&path);
+        std::fs::create_dir(&path).unwrap();
+        Self(path)
+    }
+
+    fn path(&self, name: &str) -> String {
+        self.0.join(name).to_str().unwrap().to_string()
+    }
+}
+
+impl Drop for TempDir {
+    fn drop(&mut self) {
+        _ = std::fs::remove_dir_all(&self.0);
+    }
+}
+
+/// Waits up to 10 seconds for `done` to be true.
+fn eventually(what: &str, mut done: impl FnMut() -> bool) {
+    let start = std::time::Instant::now();
+    while !done() {
+        assert!(start.elapsed().as_secs() < 10, "timed out waiting for {what}");
+        std::thread::sleep(std::time::Duration::from_millis(20));
+    }
+}
+
+#[test]
+fn test_watch() {
+    let dir = TempDir::new("watch");
+    let file = dir.path("main.go");
+    std::fs::write(&file, "package main\n").unwrap();
+
+    let mut child = Command::new(env!("CARGO_BIN_EXE_hl"))
+        .args(["--watch", "-f", "plain", &file])
+        .stdout(Stdio::piped())
+        .stderr(Stdio::piped())
+        .spawn()
+        .unwrap();
+
+    // Collect stdout on another thread, so that the test can't block on it.
+    let out = std::sync::Arc::new(std::sync::Mutex::new(String::new()));
+    let reader = {
+        let out = out.clone();
+        let mut stdout = child.stdout.take().unwrap();
+        std::thread::spawn(move || {
+            let mut buf = [0; 1024];
+            while let Ok(n @ 1..) = stdout.read(&mut buf) {
+                out.lock().unwrap().push_str(std::str::from_utf8(&buf[..n]).unwrap());
+            }
+        })
+    };
+    let printed = |s: &str| out.lock().unwrap().ends_with(s);
+
+    eventually("the first render", || printed("package main\n"));
+
+    // Without a terminal, renders are separated instead of clearing the screen.
+    std::fs::write(&file, "package main\n\nfunc main() {}\n").unwrap();
+    eventually("the second render", || printed("--\npackage main\n\nfunc main() {}\n"));
+
+    // Like editors that write a temp file and rename it over the original.
+    let temp = dir.path("main.go.swp");
+    std::fs::write(&temp, "package renamed\n").unwrap();
+    std::fs::rename(&temp, &file).unwrap();
+    eventually("the third render", || printed("--\npackage renamed\n"));
+
+    // Deleting the file ends the watch.
+    std::fs::remove_file(&file).unwrap();
+    let output = child.wait_with_output().unwrap();
+    reader.join().unwrap();
+    assert!(output.status.success());
+    assert!(String::from_utf8_lossy(&output.stderr).contains("stopped watching"));
+    assert_eq!(out.lock().unwrap().matches("--\n").count(), 2);
+
+    assert_eq!(hl(&["--watch"]).status.code(), Some(1));
+    assert_eq!(hl(&["--watch", GO_FIXTURE, JS_FIXTURE]).status.code(), Some(1));
+    assert_eq!(hl(&["--watch", "/nonexistent/file.go"]).status.code(), Some(2));
+}
+
+#[test]
+fn test_watch_output() {
+    let dir = TempDir::new("watch-output");
+    let file = dir.path("main.go");
+    let html = dir.path("main.html");
+    std::fs::write(&file, "package first\n").unwrap();
+
+    let child = Command::new(env!("CARGO_BIN_EXE_hl"))
+        .args(["--watch", "-f", "html", "--output", &html, &file])
+        .stdout(Stdio::piped())
+        .stderr(Stdio::piped())
+        .spawn()
+        .unwrap();
+    let contains = |s: &str| std::fs::read_to_string(&html).is_ok_and(|h| h.contains(s));
+
+    // The output file is replaced, not appended to.
+    eventually("the first render", || contains("first"));
+    std::fs::write(&file, "package second\n").unwrap();
+    eventually("the second render", || contains("second"));
+    let out = std::fs::read_to_string(&html).unwrap();
+    assert!(out.starts_with("<pre class=\"hl\" data-language=\"Go\">"));
+    assert_eq!(out.matches("<pre").count(), 1);
+
+    std::fs::remove_file(&file).unwrap();
+    let output = child.wait_with_output().unwrap();
+    assert!(output.status.success());
+    assert!(output.stdout.is_empty());
+    assert!(!std::path::Path::new(&dir.path("main.html.tmp")).exists());
+
+    // An output that can't be written isn't a bad argument.
+    let missing = dir.path("missing/main.html");
+    assert_eq!(hl(&["--output", &missing, GO_FIXTURE]).status.code(), Some(4));
+}
+
+#[test]
+fn test_config() {
+    let dir = TempDir::new("config");
+    let config = dir.path("config.toml");
+    let file = dir.path("main.h");
+    std::fs::write(&file, "\tint x;\n").unwrap();
+    std::fs::write(
+        &config,
+        "theme = \"light\"\nformatter = \"html\"\ntab_width = 2\ncomment_keywords = [\"SAFETY\"]\n\n\
+         [languages]\nh = \"c++\"\n",
+    )
+    .unwrap();
+
+    // The config wins over the defaults...
+    let html = stdout(&hl(&["--config", &config, &file]));
+    assert!(html.starts_with("<pre class=\"hl\" data-language=\"C++\">"), "{html}");
+    assert!(html.contains(">  </span>"), "tabs are expanded: {html}");
+    // ...and flags win over the config.
+    let out = stdout(&hl(&["--config", &config, "-f", "plain", "--tab-width=0", "-l", "c", &file]));
+    assert_eq!(out, "\tint x;\n");
+    // The comment keywords replace the default ones.
+    let comment = "// SAFETY: fine, TODO\n".as_bytes();
+    let html = stdout(&hl_stdin(&["--config", &config, "-l", "go", "--html-classes"], comment));
+    assert!(html.contains("<span class=\"tok-comment tok-comment-keyword\">SAFETY:</span>"));
+    assert!(html.contains("<span class=\"tok-comment\"> fine, TODO</span>"), "{html}");
+
+    // The config is found through $HL_CONFIG, too.
+    let mut command = Command::new(env!("CARGO_BIN_EXE_hl"));
+    let output = command.args(["--dump-config", "-t", "dark"]).env("HL_CONFIG", &config).output();
+    assert_eq!(
+        stdout(&output.unwrap()),
+        format!(
+            "# The defaults, with {config} and the flags applied\n\
+             theme = \"dark\"\nformatter = \"html\"\ncolor = \"auto\"\ntab_width = 2\n\
+             region_start = \"[region:{{}}]\"\nregion_end = \"[endregion]\"\n\
+             comment_keywords = [\"SAFETY\"]\n\n\
+             [languages]\nh = \"cpp\"\n"
+        )
+    );
+    let dump = stdout(&hl(&["--dump-config", "--formatter", "json"]));
+    assert_eq!(
+        dump,
+        "# The defaults, with the flags applied\n\
+         theme = \"dark\"\nformatter = \"json\"\ncolor = \"auto\"\ntab_width = 0\n\
+         region_start = \"[region:{}]\"\nregion_end = \"[endregion]\"\n\
+         comment_keywords = [\"TODO\", \"FIXME\", \"XXX\", \"HACK\", \"NOTE\"]\n"
+    );
+
+    // An invalid config is an error that names the key, even if a flag overrides it.
+    std::fs::write(&config, "theme = \"light\"\ncolour = \"never\"\n").unwrap();
+    let output = hl(&["--config", &config, "--color=never", &file]);
+    assert_eq!(output.status.code(), Some(1));
+    assert!(output.stdout.is_empty());
+    let stderr = String::from_utf8_lossy(&output.stderr);
+    assert!(stderr.starts_with(&format!("hl: {config}:2: colour: unknown key\n")), "{stderr}");
+
+    // A missing config is only an error if it was asked for.
+    let missing = dir.path("missing.toml");
+    assert_eq!(hl(&["--config", &missing, &file]).status.code(), Some(1));
+    let mut command = Command::new(env!("CARGO_BIN_EXE_hl"));
+    assert!(command.arg(&file).env("HL_CONFIG", &missing).output().unwrap().status.success());
+}
+
+#[test]
+fn test_theme_file() {
+    let dir = TempDir::new("theme-file");
+    let theme = |name: &str, keyword: &str| {
+        let path = dir.path(name);
+        let json = format!(
+            "{{ \"type\": \"light\", \"tokenColors\": [\n\
+             {{ \"scope\": \"keyword\", \"settings\": {{ \"foreground\": \"{keyword}\" }} }}\n] }}\n"
+        );
+        std::fs::write(&path, json).unwrap();
+        path
+    };
+    let (first, second) = (theme("first.json", "#123456"), theme("second.json", "#654321"));
+    let html = |args: &[&str]| {
+        stdout(&hl_stdin(&[&["-l", "go", "-f", "html"], args].concat(), b"package main\n"))
+    };
+    assert!(html(&["--theme", &first]).contains("<span style=\"color:#123456\">package</span>"));
+
+    // A theme file in the config and another one on the command line don't get mixed up.
+    let config = dir.path("config.toml");
+    std::fs::write(&config, format!("theme = \"{second}\"\n")).unwrap();
+    assert!(html(&["--config", &config]).contains("color:#654321"));
+    assert!(html(&["--config", &config, "--theme", &first]).contains("color:#123456"));
+    let dump = stdout(&hl(&["--dump-config", "--config", &config]));
+    assert!(dump.contains(&format!("theme = \"{second}\"\n")), "{dump}");
+
+    let error = |path: &str| {
+        let output = hl(&["--theme", path, GO_FIXTURE]);
+        assert_eq!(output.status.code(), Some(1));
+        String::from_utf8_lossy(&output.stderr).into_owned()
+    };
+    assert!(error(&dir.path("missing.json")).contains("missing.json: "));
+    std::fs::write(dir.path("bad.json"), "{ \"tokenColors\": {} }").unwrap();
+    assert!(error(&dir.path("bad.json")).contains("bad.json: tokenColors must be an array"));
+}
+
+#[test]
+fn test_recursive() {
+    let fixtures = concat!(env!("CARGO_MANIFEST_DIR"), "/../../syntax-tests");
+    let dir = TempDir::new("recursive");
+    let out = dir.path("out");
+    let read = |path: &str| std::fs::read_to_string(format!("{out}/{path}")).unwrap();
+
+    let output = hl(&["--recursive", "-f", "html", "-o", &out, fixtures]);
+    assert!(output.status.success(), "{}", String::from_utf8_lossy(&output.stderr));
+    let index = read("index.html");
+    assert!(index.contains("<title>syntax-tests</title>"));
+    assert!(index.contains(
+        "<tr><td><a href=\"test_syntax.go.html\">test_syntax.go</a></td><td>Go</td><td class=\"lines\">640</td></tr>"
+    ));
+    // Every fixture but PowerShell, which has no lexer, is listed. Goldens aren't fixtures.
+    let fixture_count = std::fs::read_dir(fixtures)
+        .unwrap()
+        .filter(|e| {
+            e.as_ref()
+                .unwrap()
+                .path()
+                .extension()
+                .is_none_or(|ext| ext != "tokens" && ext != "folds")
+        })
+        .count();
+    assert_eq!(index.matches("<tr><td><a href=").count(), fixture_count - 1);
+    assert!(!index.contains("test_syntax.ps1"));
+    let go = read("test_syntax.go.html");
+    assert!(go.contains("<nav><a href=\"index.html\">syntax-tests</a> / test_syntax.go</nav>"));
+    assert!(go.contains("<pre class=\"hl\" data-language=\"Go\"><span style="));
+    assert!(go.ends_with("</pre>\n</body>\n</html>\n"));
+}
+
+#[test]
+fn test_recursive_tree() {
+    let dir = TempDir::new("recursive-tree");
+    let root = dir.path("tree");
+    let out = dir.path("out");
+    let files = [
+        ("src/main.go", &b"package main\n"[..]),
+        ("src/lexer/a b.rs", b"fn main() {}\n"),
+        ("notes.txt", b"no language\n"),
+        ("blob.c", b"\x7fELF\0\0\0"),
+        (".hidden/x.go", b"package x\n"),
+        (".gitignore", b"gen/\n"),
+        ("gen/out.go", b"package gen\n"),
+    ];
+    for (path, contents) in files {
+        let path = format!("{root}/{path}");
+        std::fs::create_dir_all(std::path::Path::new(&path).parent().unwrap()).unwrap();
+        std::fs::write(path, contents).unwrap();
+    }
+    // Large, and its last line is too long to highlight all of.
+    let big = "let a = 1;\n".repeat(100_000) + &"let b = 2;".repeat(2_000);
+    std::fs::write(format!("{root}/big.js"), big).unwrap();
+    let read = |path: &str| std::fs::read_to_string(format!("{out}/{path}")).unwrap();
+
+    let output = hl(&["-r", "-f", "html", "-o", &out, &root]);
+    assert!(output.status.success(), "{}", String::from_utf8_lossy(&output.stderr));
+    let index = read("index.html");
+    assert!(index.contains("<nav>tree</nav>"));
+    assert!(index.contains("<a href=\"gen/index.html\">gen/</a>"));
+    assert!(index.contains("<a href=\"src/index.html\">src/</a>"));
+    assert!(index.contains(
+        "<a href=\"big.js.html\">big.js</a></td><td>JavaScript</td><td class=\"lines\">100001</td>"
+    ));
+    for skipped in ["notes.txt", "blob.c", ".hidden", ".gitignore"] {
+        assert!(!index.contains(skipped), "{skipped}");
+    }
+    assert!(!std::path::Path::new(&format!("{out}/blob.c.html")).exists());
+    let big = read("big.js.html");
+    assert_eq!(big.matches(">let</span>").count(), 100_000 + 1_000);
+    assert!(big.ends_with("let b = 2;let b = 2;</span></pre>\n</body>\n</html>\n"));
+
+    // Directories link to their subdirectories and back up to the root.
+    let src = read("src/index.html");
+    assert!(src.contains("<nav><a href=\"../index.html\">tree</a> / src</nav>"));
+    assert!(src.contains("<a href=\"lexer/index.html\">lexer/</a>"));
+    assert!(src.contains(
+        "<a href=\"main.go.html\">main.go</a></td><td>Go</td><td class=\"lines\">1</td>"
+    ));
+    assert!(read("src/lexer/index.html").contains("<a href=\"a%20b.rs.html\">a b.rs</a>"));
+    assert!(read("src/lexer/a b.rs.html").contains(
+        "<nav><a href=\"../../index.html\">tree</a> / <a href=\"../index.html\">src</a> / \
+         <a href=\"index.html\">lexer</a> / a b.rs</nav>"
+    ));
+
+    // All links are relative, so that the tree works from anywhere.
+    for page in ["index.html", "src/index.html", "src/lexer/index.html", "src/main.go.html"] {
+        for href in read(page).split("href=\"").skip(1) {
+            assert!(!href.starts_with('/') && !href[..href.find('"').unwrap()].contains(':'));
+        }
+    }
+
+    // With --gitignore, gen/ is ignored.
+    std::fs::remove_dir_all(&out).unwrap();
+    assert!(hl(&["-r", "-f", "html", "--gitignore", "-o", &out, &root]).status.success());
+    assert!(!read("index.html").contains("gen/"));
+    assert!(!std::path::Path::new(&format!("{out}/gen")).exists());
+
+    assert_eq!(hl(&["-r", "-f", "html", &root]).status.code(), Some(1));
+    assert_eq!(hl(&["-r", "-f", "plain", "-o", &out, &root]).status.code(), Some(1));
+}
+
+#[test]
+fn test_check() {
+    let fixtures = concat!(env!("CARGO_MANIFEST_DIR"), "/../../syntax-tests");
+    let output = hl(&["--check", fixtures]);
+    assert!(output.status.success(), "{}", stdout(&output));
+    assert_eq!(stdout(&output), "");
+
+    let dir = TempDir::new("check");
+    let root = dir.path("tree");
+    std::fs::create_dir_all(format!("{root}/src")).unwrap();
+    std::fs::write(format!("{root}/src/ok.go"), "package main\n").unwrap();
+    std::fs::write(format!("{root}/src/broken.go"), "package main\n\nvar x = 1 § 2\n").unwrap();
+    std::fs::write(format!("{root}/open.py"), "s = \"\"\"never closed\n").unwrap();
+
+    let output = hl(&["--check", &root]);
+    assert_eq!(output.status.code(), Some(3));
+    assert_eq!(
+        stdout(&output),
+        format!(
+            "{root}/open.py:1:5: unterminated string\n    s = \"\"\"never closed\n\
+             {root}/src/broken.go:3:11: unexpected `§`\n    var x = 1 § 2\n\
+             2 errors in 2 files\n"
+        )
+    );
+
+    // --max-errors lets a known number of errors pass.
+    assert_eq!(hl(&["--check", "--max-errors", "2", &root]).status.code(), Some(0));
+    assert_eq!(hl(&["--check", "--max-errors=1", &root]).status.code(), Some(3));
+
+    // So is stdin, and only JSON with comments allows trailing commas.
+    let output = hl_stdin(&["--check", "-l", "json"], b"{\"a\": 1,}");
+    assert_eq!(output.status.code(), Some(0));
+    let output = hl_stdin(&["--check", "-l", "json"], b"{\"a\": 1 = }");
+    assert!(stdout(&output).starts_with("(standard input):1:9: unexpected `=`\n"));
+    let output = hl_stdin(&["--check", "-l", "yaml"], b"a:\n\tb: 1\n");
+    assert!(stdout(&output).starts_with("(standard input):2:1: invalid indentation\n"));
+}
+
+#[test]
+fn test_grep() {
+    let dir = TempDir::new("grep");
+    let server = dir.path("server.go");
+    let other = dir.path("other.go");
+    std::fs::write(
+        &server,
+        "package main\n\n/*\nTODO: rename Handler\n*/\nfunc Handler() {}\n\nfunc other() {}\n",
+    )
+    .unwrap();
+    std::fs::write(&other, "package other\n").unwrap();
+
+    // Only the matching lines, with a separator between the ones that aren't adjacent.
+    let output = hl(&["--grep", "Handler", "-f", "plain", &server]);
+    assert!(output.status.success());
+    assert_eq!(stdout(&output), "TODO: rename Handler\n--\nfunc Handler() {}\n");
+    let output = hl(&["--grep", "^func", "-C", "1", "-f", "plain", &server]);
+    assert_eq!(stdout(&output), "*/\nfunc Handler() {}\n\nfunc other() {}\n");
+    let output = hl(&["--grep", "rename", "-A", "2", "-B", "0", "-f", "plain", &server]);
+    assert_eq!(stdout(&output), "TODO: rename Handler\n*/\nfunc Handler() {}\n");
+
+    // The file is highlighted from the top, so the match is still in a comment,
+    // and emphasized on top of that. The `TODO:` marker stands out of the comment.
+    let html = stdout(&hl(&["--grep", "rename", "-f", "html", &server]));
+    assert_eq!(
+        html,
+        "<pre class=\"hl\" data-language=\"Go\">\
+         <span style=\"color:#c586c0;font-weight:bold\">TODO:</span>\
+         <span style=\"color:#6a9955;font-style:italic\"> </span>\
+         <span style=\"color:#6a9955;background-color:#515c6a;font-weight:bold;font-style:italic\">rename</span>\
+         <span style=\"color:#6a9955;font-style:italic\"> Handler\n</span></pre>\n"
+    );
+
+    // Only files with a match get a header.
+    let output = hl(&["--grep", "package", "-f", "plain", &server, &other]);
+    assert_eq!(stdout(&output), format!("{server}\npackage main\n{other}\npackage other\n"));
+    let output = hl(&["--grep", "Handler", "-f", "plain", &server, &other]);
+    assert!(stdout(&output).starts_with(&format!("{server}\nTODO")));
+    assert!(!stdout(&output).contains(&other));
+
+    assert_eq!(hl(&["--grep", "(", &server]).status.code(), Some(1));
+    assert_eq!(hl(&["-C", "2", &server]).status.code(), Some(1));
+}
+
+#[test]
+fn test_debug() {
+    let fixture = std::fs::read_to_string(GO_FIXTURE).unwrap();
+
+    // One token per line, with the same offsets as the JSON output.
+    let output = hl(&["debug", "tokens", GO_FIXTURE]);
+    assert!(output.status.success());
+    let tokens = stdout(&output);
+    let lines: Vec<_> = tokens.lines().collect();
+    assert_eq!(
+        lines[0].split_whitespace().collect::<Vec<_>>(),
+        ["0..22", "1:1", "comment", "\"//", "Go", "Syntax", "Test", "File\""]
+    );
+    assert!(lines[1].starts_with("22..23       1:23      whitespace "));
+    assert!(lines[1].ends_with(" \"\\n\""));
+    let json = stdout(&hl(&["-f", "json", GO_FIXTURE]));
+    assert_eq!(lines.len(), json.lines().count());
+    let last = lines.last().unwrap().split_whitespace().next().unwrap();
+    assert!(last.ends_with(&format!("..{}", fixture.len())));
+
+    // One line per line, with the block comment and raw string carried over.
+    let output = hl(&["debug", "states", GO_FIXTURE]);
+    assert!(output.status.success());
+    let states = stdout(&output);
+    let lines: Vec<_> = states.lines().map(|l| l.split_whitespace().collect::<Vec<_>>()).collect();
+    assert_eq!(lines.len(), fixture.lines().count() + 1);
+    assert_eq!(lines[0], ["1", "-", "-"]);
+    assert_eq!(lines[7], ["8", "-", "("]);
+    assert_eq!(lines[38], ["39", "comment", "-"]);
+    assert_eq!(lines[162], ["163", "string", "{"]);
+    assert_eq!(lines.last().unwrap()[1..], ["-", "-"]);
+
+    // A header per file, even without -H, and then a record per token.
+    let output = hl(&["debug", "ndjson", GO_FIXTURE, JS_FIXTURE]);
+    assert!(output.status.success());
+    let ndjson = stdout(&output);
+    let headers: Vec<_> = ndjson.lines().filter(|l| l.starts_with("{\"version\":")).collect();
+    assert_eq!(
+        headers,
+        [
+            format!("{{\"version\":1,\"language\":\"go\",\"file\":\"{GO_FIXTURE}\"}}"),
+            format!("{{\"version\":1,\"language\":\"javascript\",\"file\":\"{JS_FIXTURE}\"}}"),
+        ]
+    );
+    let go = stdout(&hl(&["debug", "ndjson", GO_FIXTURE]));
+    assert_eq!(go.lines().count(), json.lines().count() + 1);
+    assert_eq!(
+        go.lines().nth(1).unwrap(),
+        "{\"line\":1,\"start_col\":1,\"end_col\":23,\"scope\":\"comment\"}"
+    );
+
+    // Several files get a header each, and stdin works like for highlighting.
+    let output = hl(&["debug", "states", GO_FIXTURE, JS_FIXTURE]);
+    assert!(stdout(&output).starts_with(&format!("{GO_FIXTURE} (Go)\n1 ")));
+    let output = hl_stdin(&["debug", "tokens", "-l", "go"], b"x");
+    assert_eq!(stdout(&output), "0..1         1:1       identifier               \"x\"\n");
+
+    // Only the tokens matching every filter, each with its line and the ones around it.
+    let output = hl(&["debug", "tokens", "--filter", "kind=string", "-C", "1", GO_FIXTURE]);
+    assert!(output.status.success());
+    let lines: Vec<_> = stdout(&output).lines().map(str::to_string).collect();
+    assert!(lines[0].starts_with("113..118     7:2       string "), "{}", lines[0]);
+    assert_eq!(lines[1..4], ["       6- import (", "       7: \t\"fmt\"", "       8- \t\"math\""]);
+    let output = hl(&[
+        "debug",
+        "tokens",
+        "--filter=kind=doc_comment",
+        "--filter=payload=docmarkup",
+        GO_FIXTURE,
+    ]);
+    let tokens = stdout(&output);
+    assert!(!tokens.is_empty() && tokens.lines().all(|l| l.contains(" doc_comment DocMarkup(")));
+
+    // --strict fails with the report of --check, but prints the tokens all the same.
+    let output = hl_stdin(&["debug", "tokens", "-l", "go", "--strict"], "x := 1 § 2\n".as_bytes());
+    assert_eq!(output.status.code(), Some(3));
+    assert!(stdout(&output).contains(" error "));
+    assert_eq!(
+        String::from_utf8_lossy(&output.stderr),
+        "(standard input):1:8: unexpected `§`\n    x := 1 § 2\n"
+    );
+    assert!(hl(&["debug", "states", "--strict", GO_FIXTURE]).status.success());
+
+    assert_eq!(hl(&["debug", "trace", GO_FIXTURE]).status.code(), Some(1));
+    assert_eq!(hl(&["debug", "tokens", "--check", GO_FIXTURE]).status.code(), Some(1));
+    assert_eq!(hl(&["debug", "tokens", "--filter", "string", GO_FIXTURE]).status.code(), Some(1));
+    assert_eq!(
+        hl(&["debug", "states", "--filter", "kind=string", GO_FIXTURE]).status.code(),
+        Some(1)
+    );
+    assert_eq!(hl(&["debug", "states", "-C", "1", GO_FIXTURE]).status.code(), Some(1));
+    assert_eq!(hl(&["--strict", GO_FIXTURE]).status.code(), Some(1));
+}
+
+/// An `hl serve` for a test, stopped again when dropped.
+struct Server {
+    child: std::process::Child,
+    addr: String,
+}
+
+impl Server {
+    fn start(dir: &str) -> Self {
+        let mut child = Command::new(env!("CARGO_BIN_EXE_hl"))
+            .args(["serve", "--port", "0", dir])
+            .env("HL_CONFIG", "")
+            .stdout(Stdio::piped())
+            .stderr(Stdio::null())
+            .spawn()
+            .unwrap();
+        let mut line = String::new();
+        let mut stdout = std::io::BufReader::new(child.stdout.take().unwrap());
+        std::io::BufRead::read_line(&mut stdout, &mut line).unwrap();
+        let addr = line.trim_end().rsplit_once("http://").unwrap().1.trim_end_matches('/');
+        Self { child, addr: addr.to_string() }
+    }
+
+    /// Sends a request and returns the status line and the body.
+    fn get(&self, target: &str) -> (String, String) {
+        let mut stream = std::net::TcpStream::connect(&self.addr).unwrap();
+        write!(stream, "GET {target} HTTP/1.1\r\nHost: {}\r\n\r\n", self.addr).unwrap();
+        let mut response = String::new();
+        stream.read_to_string(&mut response).unwrap();
+        let (head, body) = response.split_once("\r\n\r\n").unwrap();
+        (head.lines().next().unwrap().to_string(), body.to_string())
+    }
+}
+
+impl Drop for Server {
+    fn drop(&mut self) {
+        _ = self.child.kill();
+        _ = self.child.wait();
+    }
+}
+
+#[test]
+fn test_serve() {
+    let dir = TempDir::new("serve");
+    let root = dir.path("root");
+    std::fs::create_dir_all(format!("{root}/src")).unwrap();
+    std::fs::write(format!("{root}/src/main.go"), "package main\n").unwrap();
+    std::fs::write(format!("{root}/a b.py"), "x = 1\n").unwrap();
+    std::fs::write(format!("{root}/.secret"), "hidden\n").unwrap();
+    std::fs::write(dir.path("outside.txt"), "outside\n").unwrap();
+    let server = Server::start(&root);
+
+    // The index lists directories first and links to them and the files.
+    let (status, body) = server.get("/");
+    assert_eq!(status, "HTTP/1.1 200 OK");
+    let src = body.find("<a href=\"/src/\">src/</a>").unwrap();
+    let py = body.find("<a href=\"/a%20b.py\">a b.py</a></td><td>Python</td>").unwrap();
+    assert!(src < py);
+    assert!(!body.contains(".secret"));
+    let (_, body) = server.get("/src/");
+    assert!(body.contains("<nav><a href=\"/\">root</a> / src</nav>"));
+
+    // Files are highlighted like with -f html, in the theme of the request.
+    let (status, body) = server.get("/src/main.go");
+    assert_eq!(status, "HTTP/1.1 200 OK");
+    assert!(
+        body.contains("<nav><a href=\"/\">root</a> / <a href=\"/src/\">src</a> / main.go</nav>")
+    );
+    assert!(body.contains("<pre class=\"hl\" data-language=\"Go\">"));
+    assert!(body.contains("background: #1e1e1e"));
+    let (status, light) = server.get("/src/main.go?theme=light");
+    assert_eq!(status, "HTTP/1.1 200 OK");
+    assert!(light.contains("background: #ffffff"));
+    assert_ne!(body.split("<pre").nth(1), light.split("<pre").nth(1));
+    // The links keep the theme.
+    let (_, body) = server.get("/?theme=light");
+    assert!(body.contains("<a href=\"/src/?theme=light\">src/</a>"));
+    assert_eq!(server.get("/?theme=nope").0, "HTTP/1.1 400 Bad Request");
+
+    // Nothing outside of the root, or hidden, is served.
+    assert_eq!(server.get("/../outside.txt").0, "HTTP/1.1 403 Forbidden");
+    assert_eq!(server.get("/src/%2e%2e/%2E%2E/outside.txt").0, "HTTP/1.1 403 Forbidden");
+    assert_eq!(server.get("/src/..%2f..%2foutside.txt").0, "HTTP/1.1 403 Forbidden");
+    assert_eq!(server.get("/.secret").0, "HTTP/1.1 404 Not Found");
+    assert_eq!(server.get("/missing.go").0, "HTTP/1.1 404 Not Found");
+    #[cfg(unix)]
+    {
+        std::os::unix::fs::symlink(dir.path("outside.txt"), format!("{root}/link.txt")).unwrap();
+        assert_eq!(server.get("/link.txt").0, "HTTP/1.1 403 Forbidden");
+    }
+
+    assert_eq!(hl(&["--port", "0", GO_FIXTURE]).status.code(), Some(1));
+    assert_eq!(hl(&["serve", "--check", &root]).status.code(), Some(1));
+    // A port that is taken isn't a bad argument.
+    let port = server.addr.rsplit_once(':').unwrap().1;
+    assert_eq!(hl(&["serve", "--port", port, &root]).status.code(), Some(4));
+}
+
+#[test]
+fn test_bench() {
+    let fixtures = concat!(env!("CARGO_MANIFEST_DIR"), "/../../syntax-tests");
+    let dir = TempDir::new("bench");
+
+    // The numbers differ from run to run, so only the structure is checked.
+    let output = hl(&["bench", "--json", fixtures]);
+    assert!(output.status.success());
+    let report = stdout(&output);
+    let arena = stdext::arena::Arena::new(1 << 20).unwrap();
+    let json = edit::json::parse(&arena, &report).unwrap();
+    let json = json.as_object().unwrap();
+    assert_eq!(json.get_number("version"), Some(1.0));
+    let languages = json.get_array("languages").unwrap();
+    let names: Vec<_> =
+        languages.iter().map(|l| l.as_object().unwrap().get_str("name").unwrap()).collect();
+    assert!(names.contains(&"go") && names.contains(&"rust"));
+    assert!(names.is_sorted());
+    let total = json.get_object("total").unwrap();
+    let sum = |key| {
+        languages.iter().map(|l| l.as_object().unwrap().get_number(key).unwrap()).sum::<f64>()
+    };
+    for key in ["files", "bytes", "tokens", "nanos"] {
+        assert_eq!(total.get_number(key), Some(sum(key)), "{key}");
+    }
+    let fixture = std::fs::metadata(GO_FIXTURE).unwrap().len() as f64;
+    assert!(total.get_number("bytes").unwrap() > fixture);
+    assert!(total.get_number("tokens").unwrap() > 0.0);
+    let slowest = json.get_array("slowest").unwrap();
+    assert_eq!(slowest.len(), 5);
+    let nanos: Vec<_> =
+        slowest.iter().map(|s| s.as_object().unwrap().get_number("nanos").unwrap()).collect();
+    assert!(nanos.is_sorted_by(|a, b| a >= b));
+
+    // The table has a row per language and a total, and compares against a report.
+    let output = hl(&["bench", GO_FIXTURE]);
+    let table = stdout(&output);
+    let lines: Vec<_> = table.lines().collect();
+    assert!(lines[0].starts_with("LANGUAGE  FILES  BYTES"));
+    assert!(lines[1].starts_with("go        1      13kB"));
+    assert!(lines[2].starts_with("total     1      13kB"));
+    assert_eq!(lines[4], "Slowest files:");
+    assert!(lines[5].ends_with(&format!("ms  {GO_FIXTURE} (Go, 13kB)")));
+
+    let old = dir.path("old.json");
+    std::fs::write(&old, &report).unwrap();
+    let output = hl(&["bench", "--compare", &old, GO_FIXTURE]);
+    assert!(output.status.success());
+    let table = stdout(&output);
+    assert!(table.starts_with("LANGUAGE    FILES  BYTES  TIME"));
+    assert!(table.lines().next().unwrap().ends_with("BEFORE  CHANGE"));
+    let go = table.lines().find(|l| l.starts_with("go ")).unwrap();
+    assert!(go.ends_with('%'), "{go}");
+    let rust = table.lines().find(|l| l.starts_with("rust ")).unwrap();
+    assert!(rust.starts_with("rust        0 ") && rust.ends_with(" gone"), "{rust}");
+
+    std::fs::write(&old, "{\"version\":2}").unwrap();
+    assert_eq!(hl(&["bench", "--compare", &old, GO_FIXTURE]).status.code(), Some(1));
+    assert_eq!(hl(&["--compare", &old, GO_FIXTURE]).status.code(), Some(1));
+    assert_eq!(hl(&["bench", "--json", "--compare", &old, GO_FIXTURE]).status.code(), Some(1));
+}
+
+#[test]
+fn test_coverage() {
+    let baseline = concat!(env!("CARGO_MANIFEST_DIR"), "/tests/coverage.json");
+    let dir = TempDir::new("coverage");
+
+    // The checked-in baseline holds, like CI checks it.
+    let output = hl(&["coverage", "--baseline", baseline, GO_FIXTURE]);
+    assert!(output.status.success(), "{}", String::from_utf8_lossy(&output.stderr));
+    let report = stdout(&output);
+    let lines: Vec<_> = report.lines().collect();
+    assert!(lines[0].starts_with("go (1 file): "), "{}", lines[0]);
+    assert!(lines.contains(&"  never hit: keyword.control fallthrough"));
+    assert!(lines.iter().any(|l| l.starts_with("SCOPE ") && l.ends_with("HITS  RARE ON")));
+    assert!(lines.iter().any(|l| l.starts_with("string.quoted.double.go ")));
+    assert!(lines.last().unwrap().starts_with("No files for: asciidoc, c, "));
+
+    // Rare scopes are reported with their lines.
+    let rare = dir.path("rare.go");
+    std::fs::write(&rare, "package a\n\nvar c = 1 // b\n").unwrap();
+    let output = hl(&["coverage", "--json", &rare]);
+    assert!(output.status.success());
+    let json = stdout(&output);
+    assert!(json.starts_with("{\"version\":1,\"languages\":[{\"name\":\"go\",\"files\":1,"));
+    assert!(json.contains(&format!(
+        "{{\"name\":\"comment.line.go\",\"hits\":1,\"lines\":[\"{rare}:3\"]}}"
+    )));
+
+    // Less coverage than the baseline's fails.
+    let output = hl(&["coverage", "--baseline", baseline, &rare]);
+    assert_eq!(output.status.code(), Some(3));
+    assert!(String::from_utf8_lossy(&output.stderr).contains("hl: coverage of go dropped: "));
+
+    let old = dir.path("old.json");
+    std::fs::write(&old, "{\"version\":2}").unwrap();
+    assert_eq!(hl(&["coverage", "--baseline", &old, GO_FIXTURE]).status.code(), Some(1));
+    assert_eq!(hl(&["--baseline", baseline, GO_FIXTURE]).status.code(), Some(1));
+    assert_eq!(hl(&["coverage", "--check", GO_FIXTURE]).status.code(), Some(1));
+}
+
+#[test]
+fn test_lint() {
+    let bundled = concat!(env!("CARGO_MANIFEST_DIR"), "/../edit/tests/grammars/go.tmLanguage.json");
+    let dir = TempDir::new("lint");
+
+    // What ships is clean, and so is what the Go lexer exports.
+    let output = hl(&["lint", bundled]);
+    assert!(output.status.success(), "{}", stdout(&output));
+    assert_eq!(stdout(&output), "");
+    assert!(hl(&["lint", "-l", "go"]).status.success());
+
+    let broken = dir.path("broken.tmLanguage.json");
+    std::fs::write(
+        &broken,
+        r##"{ "scopeName": "source.b", "patterns": [
+            { "match": "\\bif\\b", "name": "keyword.control" },
+            { "match": "\\bif\\b", "name": "Keyword" },
+            { "include": "#nope" }
+        ] }"##,
+    )
+    .unwrap();
+    let output = hl(&["lint", &broken]);
+    assert_eq!(output.status.code(), Some(3));
+    assert_eq!(
+        stdout(&output),
+        format!(
+            "{broken}: warning: grammar.patterns[1].name: `Keyword` should be lowercase words \
+             separated by dots [scope-name]\n\
+             {broken}: error: grammar.patterns[2]: no repository entry named nope \
+             [undefined-include]\n\
+             {broken}: warning: grammar.patterns[1]: never matches, grammar.patterns[0] matches \
+             the same text first [shadowed]\n\
+             1 error and 2 warnings\n"
+        )
+    );
+
+    // Allowed warnings aren't printed, and warnings alone pass.
+    let allow = dir.path("allow.txt");
+    std::fs::write(&allow, "# On purpose.\nshadowed grammar.patterns[1]\n").unwrap();
+    std::fs::write(
+        &broken,
+        std::fs::read_to_string(&broken).unwrap().replace(
+            r##",
+            { "include": "#nope" }"##,
+            "",
+        ),
+    )
+    .unwrap();
+    let output = hl(&["lint", "--allow", &allow, &broken]);
+    assert!(output.status.success());
+    assert!(stdout(&output).ends_with("[scope-name]\n0 errors and 1 warning\n"));
+
+    std::fs::write(&allow, "empty-match grammar.patterns[0]\n").unwrap();
+    assert_eq!(hl(&["lint", "--allow", &allow, &broken]).status.code(), Some(1));
+    assert_eq!(hl(&["--allow", &allow, &broken]).status.code(), Some(1));
+    assert_eq!(hl(&["lint", "-l", "json"]).status.code(), Some(1));
+    assert_eq!(hl(&["lint", "-l", "go", &broken]).status.code(), Some(1));
+}
+
+#[test]
+fn test_diff() {
+    // `git diff` of a Go file, a new Rust file and a Python file.
+    let fixtures = concat!(env!("CARGO_MANIFEST_DIR"), "/tests/diff");
+    let diff = std::fs::read_to_string(format!("{fixtures}/multi.diff")).unwrap();
+
+    // Each hunk is highlighted in its file's language, and the edited words stand out.
+    let output =
+        hl_stdin(&["diff", "--color=always", "-f", "truecolor", "-t", "dark"], diff.as_bytes());
+    assert!(output.status.success());
+    let ansi = stdout(&output);
+    let snapshot = format!("{fixtures}/multi.ansi");
+    if std::env::var_os("UPDATE_SNAPSHOTS").is_some() {
+        std::fs::write(&snapshot, &ansi).unwrap();
+    }
+    assert!(
+        ansi == std::fs::read_to_string(&snapshot).unwrap(),
+        "the output changed, rerun with UPDATE_SNAPSHOTS=1 and review the diff of {snapshot}"
+    );
+    assert_eq!(strip_sgr(&ansi), diff);
+
+    // Without colors, the diff is printed as is.
+    assert_eq!(stdout(&hl_stdin(&["diff", "--color=never"], diff.as_bytes())), diff);
+
+    // Two files are diffed like `diff -u`.
+    let dir = TempDir::new("diff");
+    let (old, new) = (dir.path("old.py"), dir.path("new.py"));
+    std::fs::write(&old, "def f():\n    return 1\n").unwrap();
+    std::fs::write(&new, "def f():\n    return 2\n").unwrap();
+    let output = hl(&["diff", "--color=never", &old, &new]);
+    assert_eq!(
+        stdout(&output),
+        format!("--- {old}\n+++ {new}\n@@ -1,2 +1,2 @@\n def f():\n-    return 1\n+    return 2\n")
+    );
+
+    let output = Command::new(env!("CARGO_BIN_EXE_hl"))
+        .args(["diff", "--side-by-side", "--color=never", &old, &new])
+        .env("COLUMNS", "40")
+        .env("HL_CONFIG", "")
+        .output()
+        .unwrap();
+    let out = stdout(&output);
+    let lines: Vec<_> = out.lines().collect();
+    assert_eq!(lines[3], "1 def f():         │ 1 def f():        ");
+    assert_eq!(lines[4], "2     return 1     | 2     return 2    ");
+
+    assert_eq!(hl(&["diff", &old]).status.code(), Some(1));
+    assert_eq!(hl(&["diff", "-f", "html", &old, &new]).status.code(), Some(1));
+    assert_eq!(hl(&["--side-by-side", &old]).status.code(), Some(1));
+    assert_eq!(hl(&["diff", &old, "missing.py"]).status.code(), Some(2));
+}
+
+#[test]
+fn test_snippet() {
+    let dir = TempDir::new("snippet");
+    let file = dir.path("main.go");
+    let go = "package main\n\nfunc main() {\n\ts := `one\n\ttwo`\n\t// [region:loop]\n\
+              \tfor i := range 3 {\n\t\tprintln(s, i)\n\t}\n\t// [endregion]\n}\n";
+    std::fs::write(&file, go).unwrap();
+
+    // The file is lexed from the top, so the second line of the raw string is still one.
+    let full = stdout(&hl(&["--color=always", "-f", "truecolor", &file]));
+    let lines = stdout(&hl(&["--color=always", "-f", "truecolor", "--lines", "5-6", &file]));
+    assert_eq!(lines, full.split_inclusive('\n').skip(4).take(2).collect::<String>());
+
+    let region = stdout(&hl(&["--region", "loop", "--dedent", "-n", &file]));
+    assert_eq!(region, "1 for i := range 3 {\n2 \tprintln(s, i)\n3 }\n");
+    let region = stdout(&hl(&["--region", "loop", "--preserve-line-numbers", &file]));
+    assert_eq!(region, "7 \tfor i := range 3 {\n8 \t\tprintln(s, i)\n9 \t}\n");
+    // Dedenting happens before the tabs are expanded, so the rest keep their width.
+    let region = stdout(&hl(&["--region", "loop", "--dedent", "--tab-width", "4", &file]));
+    assert_eq!(region, "for i := range 3 {\n    println(s, i)\n}\n");
+
+    let output = hl(&["--region", "init", &file]);
+    assert_eq!(output.status.code(), Some(1));
+    let stderr = String::from_utf8(output.stderr).unwrap();
+    assert_eq!(stderr, format!("hl: {file}: unknown region 'init', expected loop\n"));
+    assert_eq!(hl(&["--lines", "5-6", "--region", "loop", &file]).status.code(), Some(1));
+    assert_eq!(hl(&["--lines", "20-", &file]).status.code(), Some(1));
+    assert_eq!(hl(&["--dedent", &file]).status.code(), Some(1));
+}
+
+/// Decodes standard base64 with padding.
+fn base64_decode(text: &str) -> Vec<u8> {
+    const CHARSET: &[u8] = b"ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/";
+    let mut bits = 0u32;
+    let mut count = 0;
+    let mut out = Vec::new();
+    for b in text.bytes().filter(|&b| b != b'=') {
+        bits = bits << 6 | CHARSET.iter().position(|&c| c == b).unwrap() as u32;
+        count += 6;
+        if count >= 8 {
+            count -= 8;
+            out.push((bits >> count) as u8);
+        }
+    }
+    out
+}
+
+#[test]
+fn test_copy() {
+    let html = hl(&["--copy", "html", "-t", "light", GO_FIXTURE]);
+    assert!(html.status.success());
+    let html = stdout(&html);
+    assert!(html.starts_with(concat!(
+        "<pre class=\"hl\" data-language=\"Go\" ",
+        "style=\"background-color:#ffffff;color:#000000\"><span style=\"color:#"
+    )));
+
+    let rtf = hl(&["--copy", "rtf", GO_FIXTURE]);
+    assert!(rtf.status.success());
+    let rtf = stdout(&rtf);
+    assert!(rtf.starts_with("{\\rtf1\\ansi"));
+    assert!(rtf.contains("{\\colortbl;\\red"));
+    assert!(rtf.ends_with("}\n"));
+    assert!(rtf.is_ascii());
+
+    // The clipboard gets exactly what would have been printed.
+    for format in ["html", "rtf"] {
+        let printed = hl(&["--copy", format, "--lines", "10-20", "-n", GO_FIXTURE]).stdout;
+        let sent =
+            stdout(&hl(&["--copy", format, "--clipboard", "--lines", "10-20", "-n", GO_FIXTURE]));
+        let payload = sent.strip_prefix("\x1b]52;c;").unwrap().strip_suffix("\x1b\\").unwrap();
+        assert_eq!(base64_decode(payload), printed, "{format}");
+    }
+
+    assert_eq!(hl(&["--clipboard", GO_FIXTURE]).status.code(), Some(1));
+    assert_eq!(hl(&["--copy", "pdf", GO_FIXTURE]).status.code(), Some(1));
+    assert_eq!(hl(&["--copy", "html", "-f", "ansi", GO_FIXTURE]).status.code(), Some(1));
+    assert_eq!(hl(&["--copy", "html", GO_FIXTURE, JS_FIXTURE]).status.code(), Some(1));
+}
+
+#[test]
+fn test_html() {
+    let fixture = std::fs::read_to_string(GO_FIXTURE).unwrap();
+
+    // Inline styles or classes, with or without line numbers, it's the exact text.
+    for flags in [&[][..], &["--html-classes"], &["-n"], &["-n", "--html-classes"]] {
+        let output = hl(&[&["-f", "html"], flags, &[GO_FIXTURE]].concat());
+        assert!(output.status.success(), "{flags:?}");
+        assert_eq!(strip_html(&stdout(&output)), fixture, "{flags:?}");
+    }
+
+    let html = stdout(&hl(&["-f", "html", "--html-classes", "-n", GO_FIXTURE]));
+    assert!(html.contains("<span class=\"tok-keyword\">package</span>"));
+    assert!(html.contains("<span class=\"tok-escape tok-invalid\">\\q</span>"));
+    assert!(html.contains("<a class=\"hl-ln\" id=\"L42\" href=\"#L42\"> 42 </a>"));
+    assert!(!html.contains(" style="));
+
+    // A slice of the file, with anchors for the lines as they are in the file.
+    let html =
+        stdout(&hl(&["-f", "html", "--lines", "40-42", "--preserve-line-numbers", GO_FIXTURE]));
+    assert!(html.contains(" id=\"L40\" ") && html.contains(" id=\"L42\" "));
+    assert!(!html.contains(" id=\"L43\" "));
+    let lines: String = fixture.split_inclusive('\n').skip(39).take(3).collect();
+    assert_eq!(strip_html(&html), lines);
+
+    // The stylesheet has a rule for every class.
+    let output = hl(&["--css", "--theme", "light"]);
+    assert!(output.status.success());
+    let css = stdout(&output);
+    assert!(css.starts_with(".hl { background-color: #ffffff; color: #000000; }\n"));
+    for class in ["tok-keyword", "tok-escape", "tok-invalid", "hl-ln"] {
+        assert!(css.contains(&format!("\n.{class} {{ ")), "{class}");
+    }
+
+    assert_eq!(hl(&["--html-classes", GO_FIXTURE]).status.code(), Some(1));
+    assert_eq!(hl(&["--copy", "html", "--html-classes", GO_FIXTURE]).status.code(), Some(1));
+}
@@ -0,0 +1,2 @@
+// Used to panic: the escape at the end ran past it, and so did the token.
+`\
\ No newline at end of file
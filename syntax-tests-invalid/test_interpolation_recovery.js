@@ -0,0 +1,7 @@
+// JavaScript Template Literal Recovery Test File
+// An interpolation without its `}` flags its `${`, and runs to the end of the file,
+// as it does for JavaScript itself.
+
+const fine = `nested ${`inner ${x}`} done`;
+const broken = `Hello, ${name
+const after = 1;
@@ -0,0 +1,7 @@
+# Python F-String Recovery Test File
+# A replacement field without its `}` flags its `{`, and the next line is code again.
+
+unclosed = f"Hello, {name"
+after = f"fine {name}"
+spec = f"{value:>{width"
+also_after = 1
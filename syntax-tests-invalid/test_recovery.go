@@ -0,0 +1,27 @@
+// Testing how Go syntax highlighting recovers from errors. Each one should only affect
+// the construct it's in, so the lines after it look like they would without the error.
+// The valid fixtures are in syntax-tests, which `hl --check` keeps free of errors.
+package recovery
+
+import "fmt"
+
+// A string missing its closing quote ends with its line
+var greeting = "hello, world
+var count = 42
+
+// A rune literal holds exactly one character or escape sequence
+var pair = 'ab'
+var single, escaped = 'a', '\n'
+
+func main() {
+	fmt.Println(greeting, count, pair, single, escaped)
+}
+
+// A bracket without a partner is flagged, and the brackets around it still pair up
+var sizes = []int{len(greeting)], count}
+
+// A block comment that's never closed only covers its first line
+/* TODO: explain what the helper is for
+func helper() int {
+	return count * 2
+}
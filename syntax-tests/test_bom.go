@@ -0,0 +1,8 @@
+﻿package main
+
+// Saved by an editor that writes a byte order mark.
+import "fmt"
+
+func main() {
+	fmt.Println("hello")
+}
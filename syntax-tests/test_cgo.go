@@ -0,0 +1,68 @@
+// cgo Test File
+// The comment right above `import "C"` is C code, with `#cgo` directives for the build.
+
+package main
+
+/*
+#cgo CFLAGS: -O2 -DPNG_DEBUG=1 "-I/opt/my lib/include"
+//^^ Macro
+//   ^^^^^^ PropertyName
+//         ^ Operator
+//           ^^^ String
+//                             ^^^^^^^^^^^^^^^^^^^^^^^ String
+#cgo linux,!arm64 LDFLAGS: -lm
+//   ^^^^^ Identifier
+//        ^ Operator
+//         ^ Operator
+//          ^^^^^ Identifier
+//                ^^^^^^^ PropertyName
+//                         ^^^ String
+#include <stdio.h>
+//^^^^^^ Macro
+//       ^^^^^^^^^ String
+#include <stdlib.h>
+
+typedef struct {
+//^^^^^ Keyword
+//      ^^^^^^ Keyword
+    int width, height;
+} size;
+
+// Returns the area, or 0 for negative sizes.
+//^^^^^^^^ Comment
+static int area(size s) {
+//^^^^ Keyword
+//     ^^^ Keyword
+//              ^^^^ Identifier
+    if (s.width < 0 || s.height < 0) {
+        return 0;
+    }
+    return s.width * s.height;
+//  ^^^^^^ Keyword
+//                 ^ Operator
+}
+*/
+import "C"
+//^^^^ Keyword
+//     ^^^ String
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+func main() {
+	s := C.size{width: 3, height: 4}
+	fmt.Println(int(C.area(s)))
+
+	cs := C.CString("hello from Go")
+//     ^ Identifier
+//       ^^^^^^^ Identifier
+//               ^^^^^^^^^^^^^^^ String
+	defer C.free(unsafe.Pointer(cs))
+	C.puts(cs)
+	var n C.int = C.int(len("hello"))
+//     ^ Identifier
+//       ^^^ TypeName
+	_ = n
+}
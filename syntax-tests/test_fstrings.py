@@ -0,0 +1,31 @@
+# Python F-String Test File
+# Replacement fields hold expressions, conversions and format specs.
+
+name = "world"
+greeting = f"Hello, {name}!"
+shout = F'{name.upper()!r}'
+
+# Format specs, with replacement fields of their own
+width, precision = 10, 2
+row = f"{obj['key']:>{width}}|{value:{width}.{precision}f}|{count:,d}"
+when = f"{stamp:%Y-%m-%d %H:%M}"
+debug = f"{width=} {width = !s:>4}"
+
+# Two levels of nesting
+cells = f"{', '.join(f'<{tag}>{text!s:^{width}}</{tag}>' for tag, text in pairs)}"
+quoted = f"""{f'{f"{deep}"}'}"""
+
+# Brackets, comparisons and lambdas in the expression
+table = f"{ {'a': 1, 'b': 2}['a'] } {items[1:3]} {a != b} {(lambda x: x * 2)(3)}"
+
+# Doubled braces and escapes are text
+literal = f"{{not a field}} {{{name}}}"
+escaped = f"tab\t{name}\n"
+pattern = rf"\d+{sep}\w+"
+raw = fR'{path}\n'
+
+# Triple-quoted f-strings span lines
+report = f"""
+Name:  {name:<{width}}
+Total: {sum(values):>{width},.2f}
+"""
@@ -0,0 +1,49 @@
+#!/bin/bash
+# Heredoc Test File
+# Heredocs capture their delimiter, and their bodies run up to a line of just that word.
+
+name="world"
+
+# Unquoted heredocs expand variables and command substitutions
+cat <<EOF
+Hello, $name! Today is $(date +%A), and ${HOME} is home.
+Prices stay \$5, and a lone $ is text.
+EOF
+
+# Quoted delimiters keep the body as it is
+cat <<'EOF'
+No $expansion or $(substitution) here.
+EOF
+cat <<"END_OF_TEXT" | grep -v skip
+Still $literal text.
+END_OF_TEXT
+
+# The delimiter in the middle of a line, or indented without <<-, does not end it
+cat <<EOF > notes.txt
+This line mentions EOF, and so does EOF_MARKER.
+  EOF
+EOF
+
+# <<- strips leading tabs, including those of the delimiter
+if true; then
+	cat <<-EOF
+		Indented body for $name
+	EOF
+fi
+
+# Stacked heredocs follow one after the other
+paste /dev/fd/3 /dev/fd/4 3<<A 4<<\B
+first $name
+A
+second $name
+B
+
+# Here-strings
+read -r first rest <<< "$name and more"
+grep -c world <<< plain_word
+tr a-z A-Z <<<$name
+
+# Shifts are not heredocs
+echo $(( 1 << 4 ))
+(( mask = 1 << 2 ))
+echo done
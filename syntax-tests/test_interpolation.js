@@ -0,0 +1,31 @@
+// JavaScript Template Literal Test File
+// Interpolations hold expressions, which may hold template literals in turn.
+
+const name = "world";
+const greeting = `Hello, ${name}!`;
+const empty = `${""}${''}`;
+
+// Two levels of nesting, and braces of the expression's own
+const nested = `outer ${ok ? `inner ${items.map((x) => `<${x}>`).join("")}` : "none"} done`;
+const object = `${JSON.stringify({ a: 1, b: { c: [2, 3] } })}`;
+const fn = `${(() => { return `block ${1 + 2}`; })()}`;
+
+// Escaped delimiters are text
+const price = `costs \${amount} or \` backticks`;
+const dollar = `$ {not} $${value} {also not}`;
+
+// Regexes and divisions go by what precedes them, even in an interpolation
+const regex = `${/a{2}/.test(s)} and ${total / count / 2}`;
+
+// Templates span lines
+const html = `
+  <ul>
+    ${rows.map((row) => `
+      <li class="${row.active ? "on" : "off"}">${row.label}</li>
+    `).join("\n")}
+  </ul>
+`;
+
+// Tagged templates
+const query = sql`SELECT * FROM users WHERE id = ${id}`;
+const raw = String.raw`C:\path\${file}`;
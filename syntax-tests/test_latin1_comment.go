@@ -0,0 +1,7 @@
+package main
+
+// Caf au lait, saved as Latin-1 by an old editor.
+func main() {
+	s := "nave" // nave
+	_ = s
+}
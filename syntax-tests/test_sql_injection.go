@@ -0,0 +1,70 @@
+// SQL in Go strings: after a /* sql */ comment, on the line after a //language=sql
+// comment as in GoLand, and assigned to variables ending in Query (hl --inject-strings).
+package store
+
+import (
+	"context"
+	"database/sql"
+)
+
+const countQuery = "SELECT count(*) FROM users WHERE deleted_at IS NULL"
+
+var listQuery = `SELECT id, name FROM users ORDER BY name LIMIT $1`
+
+// Not a query, despite the SQL in it.
+var greeting = "SELECT your seat"
+
+type User struct {
+	ID    int64
+	Name  string
+	Email string
+}
+
+func FindByName(ctx context.Context, db *sql.DB, name string) (*User, error) {
+	// Escaped quotes are one character to SQL but two bytes in Go.
+	row := db.QueryRowContext(ctx, /* sql */ "SELECT id, name, email FROM \"users\" WHERE name = $1\t-- by name", name)
+	var u User
+	if err := row.Scan(&u.ID, &u.Name, &u.Email); err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+func Migrate(ctx context.Context, db *sql.DB) error {
+	//language=sql
+	schema := `
+		CREATE TABLE IF NOT EXISTS users (
+			id         BIGSERIAL PRIMARY KEY,
+			name       TEXT NOT NULL,
+			email      TEXT UNIQUE,
+			deleted_at TIMESTAMP
+		);
+		CREATE INDEX users_name ON users (name);
+	`
+	_, err := db.ExecContext(ctx, schema)
+	return err
+}
+
+func Rename(ctx context.Context, db *sql.DB, id int64, name string) error {
+	_, err := db.ExecContext(ctx,
+		// language=SQL
+		`UPDATE users SET name = $2 WHERE id = $1`,
+		id, name)
+	return err
+}
+
+func Deleted() string {
+	return /* language=sql */ `SELECT id FROM users WHERE deleted_at IS NOT NULL`
+}
+
+func Search(term string) string {
+	// A marker in front of something other than a string does nothing.
+	q := /* sql */ pattern("name LIKE ?")
+	//language=sql
+	where := pattern("email LIKE ?")
+	return q + " OR " + where + term
+}
+
+func pattern(s string) string {
+	return s
+}
@@ -10,6 +10,8 @@ import (
 	"time"
 )
 
+// #region constants
+
 // Constants
 const (
 	MaxSize     = 1024
@@ -31,6 +33,13 @@ const (
 	Saturday
 )
 
+// #endregion
+
+/*
+Type definitions follow. They cover structs,
+embedding, methods and interfaces.
+*/
+
 // Type definitions
 type Person struct {
 	Name   string
@@ -130,11 +139,19 @@ func main() {
 	octal := 0o77
 	binary := 0b1010_1011
 	bigNum := 1234567890
+	legacyOctal := 0755
+	hexSeparated := 0x_FF_FF
+	binaryImag := 0b101i
 	
 	// Floating point
 	pi := 3.14159
 	e := 2.718281828
 	scientific := 1.23e10
+	half, whole := .5, 1.
+	separated := 1_000.000_1e1_0
+	hexFloat := 0x1.fp-2
+	hexPower := 0X1p10
+	hexImag := 0x1p2i
 	
 	// Complex numbers
 	complex1 := 3 + 4i
@@ -144,12 +161,13 @@ func main() {
 	str := "Hello, Go!"
 	rawStr := `This is a raw string
 that can span multiple lines
-and include "quotes" without escaping`
+and include "quotes" or a lone ( without escaping`
 	
 	// Rune (character) literals
 	ch := 'A'
 	unicode := '世'
 	escape := '\n'
+	paren := '('
 	
 	// Boolean and nil
 	flag := true
@@ -413,7 +431,7 @@ and include "quotes" without escaping`
 	fmt.Println("Program completed")
 }
 
-// Exported function (starts with capital letter)
+// Exported function (starts with capital letter) that validates its data
 func ProcessData(data []byte) error {
 	if len(data) == 0 {
 		return fmt.Errorf("empty data")
@@ -425,3 +443,198 @@ func ProcessData(data []byte) error {
 func helperFunction() {
 	fmt.Println("Helper function")
 }
+
+// Generics
+var defaultTimeout = 5 * time.Second
+
+type Stack[T any] struct {
+	items []T
+}
+
+func (s *Stack[T]) Push(v T) {
+	s.items = append(s.items, v)
+}
+
+func Map[T, U any](items []T, fn func(T) U) []U {
+	result := make([]U, 0, len(items))
+	for _, item := range items {
+		result = append(result, fn(item))
+	}
+	return result
+}
+
+// Unicode identifiers: letters anywhere, digits (even non-ASCII ones) after the first letter
+var 世界 = "world"
+var Δx, x١ = 1.5, 2
+
+// Astral-plane characters: 😀 in comments and strings, 𠀀 (CJK Extension B) in names
+var 𠀀 = "😀 \U0001F600 👩‍🔬"
+
+// Non-ASCII names in declarations and uses, emoji with a skin tone, "café" with a
+// combining acute accent after the e, and a rune beyond the Basic Multilingual Plane
+const π = 3.14159
+var 变量 = 2 * π
+var wave, accented, rocket = "👋🏽 hello", "café", '🚀'
+
+// Compiler directives and build constraints, which belong above the package clause
+// and declarations, but are lexed the same anywhere at the start of a line
+//go:build (linux && amd64) || !windows
+// +build linux,amd64 !windows
+
+//go:generate stringer -type=Day
+//go:embed static/*.html "docs/read me.md"
+var content embed.FS
+
+//go:linkname nanotime runtime.nanotime
+//go:noinline
+func nanotime() int64
+
+// With a space after the slashes, or after code, it's an ordinary comment
+// go:embed static/*.html
+var x = 1 //go:noinline
+
+// Struct tags are keys with quoted values, with options after the first comma
+type Account struct {
+	ID     int    `json:"id,omitempty" xml:"id,attr"`
+	Owner  string `json:"owner" db:"owner_name"`
+	Nested struct {
+		Note string `yaml:",flow"`
+	} `json:"nested"`
+	// From a pair whose quote is never closed, the tag is a raw string
+	Broken string `json:"broken" xml:"name,attr`
+}
+
+// Outside of a struct, a raw string is just a string
+var pattern = `json:"not,a,tag"`
+
+// Labels are the targets of break, continue and goto, unlike the keys of composite
+// literals and the values of case clauses, which are also followed by a colon
+func find(grid [][]float64, target float64) (Rectangle, bool) {
+	var w, h float64
+outer:
+	for y, row := range grid {
+		for x, cell := range row {
+			switch int(cell) {
+			case StatusError:
+				continue outer
+			case StatusOK:
+				w, h = float64(x), float64(y)
+				goto found
+			}
+		}
+		if y > MaxSize {
+			break outer
+		}
+	}
+	return Rectangle{}, false
+
+found:
+	r := Rectangle{Width: w, Height: h}
+	names := map[int]string{StatusOK: "ok", MaxSize: "max"}
+	fmt.Println(names)
+	return r, true
+}
+
+// Since Go 1.21 and 1.22, min, max and clear are built-in functions, and range works
+// over integers and over iterator functions
+func All[T any](s []T) func(yield func(int, T) bool) {
+	return func(yield func(int, T) bool) {
+		for i, v := range s {
+			if !yield(i, v) {
+				return
+			}
+		}
+	}
+}
+
+func iterate() {
+	for i := range 10 {
+		fmt.Println(i)
+	}
+	for i, v := range All([]string{"a", "b"}) {
+		fmt.Println(i, v)
+	}
+	lo, hi := min(1, 2, 3), max(4.0, 5)
+	cache := map[string]int{"a": 1}
+	clear(cache)
+	clear := lo + hi
+	fmt.Println(clear, len(cache))
+}
+
+// Format verbs in interpreted strings, but not in raw strings
+func report(path string, err error, ratio float64) error {
+	fmt.Printf("%+v %#v %T\n", ratio, path, err)
+	fmt.Printf("%08.2f%% done, %-*d left\n", ratio, 8, 3)
+	fmt.Printf("%[2]s before %[1]q, %6.[3]*[1]f\n", path, "b", 2)
+	fmt.Println(`%d stays raw`)
+	fmt.Printf("%y is no verb of fmt\n", ratio)
+	return fmt.Errorf("open %q: %w", path, err)
+}
+
+// Escapes in strings and runes, even invalid ones, and raw strings holding comment markers
+func escapes() {
+	fmt.Println("tab\tnewline\n", "quote\"", "\x41\u4e16\U0001F600\377", "\q is invalid")
+	fmt.Println('\x41', '\'', '世', '\\')
+	query := `SELECT 1 // not a comment,
+/* nor this */ "and a quote"`
+	fmt.Println(query)
+}
+
+// Ledger keeps the entries of an [Account], formatted with [fmt.Sprintf] into a
+// [*strings.Builder], as described in [the package docs].
+//
+// # Usage
+//
+// Open a ledger and close it when done:
+//
+//	ledger := Ledger{}
+//	defer ledger.Close()
+//
+// Entries are either
+//   - credits, see [Ledger.Close], or
+//   - debits.
+//
+// [the package docs]: https://pkg.go.dev/fmt
+type Ledger struct {
+	entries []string
+}
+
+// Close closes the ledger.
+//
+// Deprecated: Ledgers no longer need closing, use an [Account] instead.
+//
+//go:noinline
+func (l *Ledger) Close() {
+	// An ordinary comment, where [Account] and
+	//	indented lines are no markup
+	l.entries = nil
+}
+
+// Predeclared names may be declared again, after which they're ordinary variables
+func shadowing(string string, buf []byte) (error error) {
+	len := len(buf)
+	len = 6
+	var new = func() int { return len }
+	fmt.Println(string, new(), error)
+	return nil
+}
+
+// Action markers stand out in comments of every kind.
+//
+// TODO(alice): Split the ledger into pages, see the NOTE below.
+func markers() {
+	// FIXME: Overflows with more than a billion entries.
+	/* XXX relies on the iteration order of maps, a HACK until they're sorted. */
+	// NOTE: Words like TODOist aren't markers, and neither is a lowercase todo.
+	// TODOist
+}
+
+// Names with a keyword as their prefix, suffix or infix are single identifiers
+var (
+	format, iface, deferredWork, gopher, rangefinder, selectAll      int
+	breakpoint, caseless, chanValue, constant, continued, defaulted  int
+	elsewhere, fallthroughs, forward, funcs, gotoEnd, ifaces         int
+	imports, packaged, interfaces, mapping, returned, structure      int
+	switchboard, typeName, variable, outerFor, isGo, selectedCase    int
+	hasDefault, myRangeEnd, lastReturn, userType, noElse, anyStructs int
+)
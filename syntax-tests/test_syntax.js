@@ -89,3 +89,10 @@ const nullish = value ?? 'default';
 // Export
 export default Counter;
 export { greeting, Counter as MyCounter };
+
+// Unicode identifiers, including a combining accent and a non-ASCII digit
+const café = 'coffee';
+let Δx = 0.5, 数据١ = café;
+
+// Astral-plane characters: 😀 in comments and strings, 𠀀 (CJK Extension B) in names
+const 𠀀 = '😀 \u{1F600} 👩‍🔬';
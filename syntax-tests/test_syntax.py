@@ -43,3 +43,8 @@ class ExampleClass:
 if __name__ == "__main__":
     example = example_function("test", 10)
     print(example)
+
+# Unicode identifiers, including a combining accent and a non-ASCII digit
+π = 3.14159
+résumé = "CV"
+数据١ = [π, résumé]
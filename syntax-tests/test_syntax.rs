@@ -1,40 +1,367 @@
-// Rust Syntax Highlighting Demo
+//! Rust Syntax Test File
+//! Testing Rust syntax highlighting with various language features
 
+#![allow(dead_code, unused_variables)]
+// ^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^ RustAttribute
+#![cfg_attr(docsrs, feature(doc_cfg))]
+
+// #region imports
+use std::borrow::Cow;
+use std::collections::{BTreeMap, HashMap};
+use std::fmt::{self, Display, Write as _};
+use std::sync::atomic::{AtomicUsize, Ordering};
+// #endregion
+
+// Constants and statics, with suffixes, separators and every base
+const MAX_DEPTH: usize = 1_000;
+const MASK: u32 = 0xDEAD_BEEF;
+const FLAGS: u8 = 0b1010_0101;
+const MODE: u16 = 0o755;
+const EPSILON: f64 = 1e-9;
+const RATIO: f32 = 2.5_f32;
+static COUNTER: AtomicUsize = AtomicUsize::new(0);
+static mut SCRATCH: [u8; 4] = [0; 4];
+
+/* Block comment */
+/* Rust's block comments nest: /* this is still inside */ and so is this */
+// ^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^ Comment
+/*
+ * /* Nested over
+ *    /* several */ lines */
+ */
+/** A doc comment in block form */
+
+// Type definitions
 #[derive(Debug, Clone)]
+//^^^^^^^^^^^^^^^^^^^^^ RustAttribute
 pub struct Example<'a> {
+//                 ^^ RustLifetime
     name: &'a str,
     count: i32,
 }
 
+/// A point in the plane.
+#[derive(Debug, Clone, Copy, PartialEq, Default)]
+pub struct Point {
+    pub x: f64,
+    pub y: f64,
+}
+
+pub struct Meters(pub f64);
+
+pub struct Unit;
+
+#[repr(u8)]
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Hash)]
+pub enum Shape {
+    Circle { radius: f64 },
+    Rectangle { width: f64, height: f64 },
+    Triangle(Point, Point, Point),
+    Empty,
+}
+
+pub union IntOrFloat {
+    i: u32,
+    f: f32,
+}
+
+type Result<T, E = Box<dyn std::error::Error + Send + Sync + 'static>> = std::result::Result<T, E>;
+//                     ^^^ Keyword
+//                                                           ^^^^^^^ RustLifetime
+
+// Traits, with associated types and constants, and default methods
+pub trait Area {
+    const SIDES: u32;
+    type Output: Display;
+
+    fn area(&self) -> f64;
+
+    fn describe(&self) -> String {
+        format!("{} with an area of {:.2}", std::any::type_name::<Self>(), self.area())
+//      ^^^^^^^ RustMacro
+    }
+}
+
+impl Area for Shape {
+    const SIDES: u32 = 0;
+    type Output = String;
+
+    fn area(&self) -> f64 {
+        match *self {
+            Shape::Circle { radius } => std::f64::consts::PI * radius * radius,
+            Shape::Rectangle { width, height } => width * height,
+            Shape::Triangle(a, b, c) => {
+                ((a.x * (b.y - c.y) + b.x * (c.y - a.y) + c.x * (a.y - b.y)) / 2.0).abs()
+            }
+            Shape::Empty => 0.0,
+        }
+    }
+}
+
 impl<'a> Example<'a> {
     /// Creates a new example
     pub fn new(name: &'a str) -> Self {
         Self { name, count: 0 }
     }
-    
+
     pub async fn process(&mut self) -> Result<(), String> {
         // Line comment
         let x = 42;
         let hex = 0xFF;
         let bin = 0b1010;
         let float = 3.14e-10;
-        
+
         /* Block comment */
         for i in 0..10 {
             self.count += i;
         }
-        
+
         match self.count {
             0 => println!("zero"),
             n if n > 0 => println!("positive: {}", n),
             _ => println!("negative"),
         }
-        
+
         Ok(())
     }
 }
 
+// Lifetimes versus char literals, and raw strings with as many hashes as needed
+fn longest<'a, T>(x: &'a str, y: &'a str, _t: T) -> &'a str
+//         ^^ RustLifetime
+where
+    T: Into<&'a str> + 'static,
+//           ^^ RustLifetime
+//                     ^^^^^^^ RustLifetime
+{
+    let hash = '#';
+//             ^^^ Char
+    let (a, quote, newline) = ('a', '\'', b'\n');
+//                             ^^^ Char
+//                                  ^^^^ Char
+//                                        ^^^^^ Char
+    let raw = r##"a "# doesn't end it"##;
+//            ^^^^^^^^^^^^^^^^^^^^^^^^^^ String
+    let bytes = br#"
+        "raw" bytes, over 'several' lines
+    "#;
+//  ^^ String
+    if x.len() > y.len() { x } else { y }
+}
+
+// Every kind of character: escapes, quotes, unicode, and bytes
+fn characters() {
+    let backslash = '\\';
+//                  ^^^^ Char
+    let double = '"';
+//               ^^^ Char
+    let ascii = '\x7f';
+    let crab = '\u{1F980}';
+//             ^^^^^^^^^^^ Char
+    let byte = b'a';
+    let tab = b'\t';
+    // A lifetime right after a reference, and a char right after a paren
+    let s: &'static str = "static";
+//          ^^^^^^^ RustLifetime
+    let c = ('x');
+//           ^^^ Char
+}
+
+// Strings: escapes, bytes, C strings, and raw strings of every prefix
+fn strings() {
+    let plain = "tab\tnewline\nquote\"unicode\u{263A}";
+    let multiline = "first line
+        second line, with a continuation \
+        and no newline";
+    let bytes = b"GET / HTTP/1.1\r\n";
+    let c_string = c"null-terminated";
+    let raw = r"C:\Users\no\escapes";
+    let one = r#"a "quoted" word"#;
+    let two = r##"a "# that doesn't close it"##;
+//            ^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^ String
+    let raw_bytes = br"\d+";
+    let raw_c = cr#"raw "C""#;
+    let comment_markers = "// not a comment /* nor this */";
+//                        ^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^ String
+}
+
+// Macros: invocations with every bracket, and declarations
+macro_rules! square {
+//    ^^^^^^ RustMacro
+    ($e:expr) => {
+        $e * $e
+    };
+    ($e:expr, $($rest:expr),+ $(,)?) => {
+        square!($e) + square!($($rest),+)
+    };
+}
+
+fn macros() -> std::io::Result<()> {
+    let v = vec![1, 2, 3];
+//          ^^^^ RustMacro
+    let m: HashMap<&str, i32> = HashMap::new();
+    println!("{v:?} {}", square!(4));
+//  ^^^^^^^^ RustMacro
+//                       ^^^^^^^ RustMacro
+    assert_eq!(v.len(), 3, "expected {} items", 3);
+    assert!(v != vec![]);
+//            ^^ Operator
+    debug_assert!(!v.is_empty());
+    let mut out = String::new();
+    write!(out, "{}", 1).unwrap();
+    eprintln!("{}", out);
+    let _ = include_str!("test_syntax.rs");
+    if v.is_empty() {
+        unreachable!()
+    } else {
+        todo!{}
+    }
+}
+
+// The turbofish: generic arguments of paths in expressions
+fn turbofish() {
+    let numbers = "1 2 3".split(' ').map(str::parse::<i32>).collect::<Vec<_>>();
+//                                          ^^ Punctuation
+//                                                   ^ Operator
+    let nested = Vec::<Vec<u8>>::with_capacity(4);
+//                           ^^ Operator
+    let parsed = "42".parse::<u64>().unwrap_or_default();
+    let size = std::mem::size_of::<Option<Box<dyn Fn(u8) -> u8>>>();
+    let shifted = 1u32 << 4 >> 2;
+//                     ^^ Operator
+//                          ^^ Operator
+}
+
+// Generics, bounds, higher-ranked lifetimes and where clauses
+pub fn apply<F, T>(items: &[T], f: F) -> Vec<T>
+where
+    F: for<'b> Fn(&'b T) -> T,
+//         ^^ RustLifetime
+    T: Clone + fmt::Debug,
+{
+    items.iter().map(|item| f(item)).collect()
+}
+
+pub struct Wrapper<'a, T: ?Sized + 'a> {
+    inner: &'a T,
+}
+
+impl<'a, T: ?Sized + Display> Display for Wrapper<'a, T> {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+//                                       ^^ RustLifetime
+        write!(f, "[{}]", self.inner)
+    }
+}
+
+// Closures, labeled loops, and patterns
+fn control_flow(grid: &[Vec<i32>]) -> Option<(usize, usize)> {
+    let add = |a: i32, b: i32| -> i32 { a + b };
+    let owned = move || add(1, 2);
+    'outer: for (row, cells) in grid.iter().enumerate() {
+//  ^^^^^^ RustLifetime
+        'inner: for (col, &cell) in cells.iter().enumerate() {
+            if cell < 0 {
+                continue 'outer;
+//                       ^^^^^^ RustLifetime
+            }
+            if cell == 0 {
+                break 'inner;
+            }
+            if cell > 100 {
+                return Some((row, col));
+            }
+        }
+    }
+    let value = loop {
+        break 42;
+    };
+    while let Some(top) = Some(value) {
+        break;
+    }
+    match value {
+        0 => None,
+        1..=9 => Some((0, 0)),
+        n @ 10..=99 if n % 2 == 0 => Some((1, 0)),
+        _ => None,
+    }
+}
+
+// Raw identifiers can be keywords
+fn r#match(r#type: &str) -> bool {
+// ^^^^^^^ Identifier
+//         ^^^^^^ Identifier
+    r#type.is_empty()
+}
+
+// Unsafe, extern and const functions
+extern "C" {
+    fn abs(input: i32) -> i32;
+}
+
+pub const fn double(x: u32) -> u32 {
+    x * 2
+}
+
+unsafe fn scratch() -> u8 {
+    unsafe { SCRATCH[0] }
+}
+
+// Async, modules and visibility
+pub mod network {
+    pub(crate) async fn fetch(url: &str) -> Result<Vec<u8>> {
+        let _ = url;
+        Ok(Vec::new())
+    }
+
+    pub(super) fn helper() {}
+
+    #[cfg(test)]
+    mod tests {
+        use super::*;
+
+        #[test]
+        fn test_helper() {
+            helper();
+        }
+    }
+}
+
+// Unicode identifiers and strings
+fn unicode() {
+    let größe = 1.5;
+    let 数字 = "数字 😀";
+    let wave = '👋';
+}
+
+// Attributes with arguments over several lines
+#[cfg_attr(
+    feature = "serde",
+    derive(serde::Serialize, serde::Deserialize)
+)]
+#[doc = "A documented [type]"]
+pub struct Config {
+    #[cfg_attr(feature = "serde", serde(default))]
+    pub depth: usize,
+}
+
+// Names with a keyword as their prefix or suffix are single identifiers
+fn keyword_like() {
+    let iffy = 1;
+    let format = 2;
+    let r#fn = 3;
+    let matches = iffy + format + r#fn;
+}
+
 fn main() {
     let mut example = Example::new("test");
     println!("Example: {:?}", example);
+    let shape = Shape::Circle { radius: 1.0 };
+    let point = Point { x: 1.0, ..Default::default() };
+    let counted = COUNTER.fetch_add(1, Ordering::SeqCst);
+    let cow: Cow<'_, str> = Cow::Borrowed("borrowed");
+    let map: BTreeMap<_, _> = [(1, "one")].into_iter().collect();
+    let text = match shape.area() as i64 {
+        0 => "none",
+        _ => "some",
+    };
 }
@@ -150,3 +150,24 @@ DROP TABLE IF EXISTS comments;
 DROP TABLE IF EXISTS posts;
 DROP TABLE IF EXISTS users;
 DROP DATABASE IF EXISTS demo_db;
+
+-- Keywords are keywords in any case, but quoted identifiers are names whatever they spell.
+-- A line like `--   ^^^ Kind` asserts the token kind of the characters above the carets.
+Select "SELECT", "from", Count(*) From users wHeRe "Where" Is Not Null;
+--^^^^ Keyword
+--     ^^^^^^^^ Identifier
+--               ^^^^^^ Identifier
+--                       ^^^^^ FunctionName
+--                                ^^^^ Keyword
+--                                           ^^^^^ Keyword
+--                                                 ^^^^^^^ Identifier
+--                                                         ^^ Keyword
+--                                                            ^^^ Keyword
+--                                                                ^^^^ Keyword
+select cast(1 AS Integer), TRUE, False;
+--^^^^ Keyword
+--     ^^^^ FunctionName
+--            ^^ Keyword
+--               ^^^^^^^ TypeName
+--                         ^^^^ Boolean
+--                               ^^^^^ Boolean
@@ -0,0 +1,109 @@
+// Go Generics Test File
+// A line like `//   ^^^ Kind` asserts the token kind of the characters above the carets.
+
+package generics
+
+import "fmt"
+
+// Constraint interfaces with union elements and the tilde operator
+type Number interface {
+	~int | ~int64 | ~float64
+//    ^ Operator
+//      ^ Operator
+//       ^^^^^ TypeName
+}
+
+type Stringish interface {
+	~string
+	fmt.Stringer
+}
+
+// Generic functions, whose type parameters are types until the end of the body
+func Map[T, U any](s []T, f func(T) U) []U {
+//       ^ TypeName
+//          ^ TypeName
+//            ^^^ TypeName
+//                     ^ TypeName
+//                               ^ TypeName
+//                                  ^ TypeName
+//                                       ^ TypeName
+	result := make([]U, 0, len(s))
+//                ^ TypeName
+	for _, v := range s {
+		result = append(result, f(v))
+	}
+	return result
+}
+
+func Sum[T Number](xs []T) (total T) {
+//       ^ TypeName
+//         ^^^^^^ Identifier
+//                                ^ TypeName
+	for _, x := range xs {
+		total += x
+	}
+	return
+}
+
+// Constraints may refer to type parameters declared after them
+func Compact[S ~[]E, E comparable](s S) S {
+//           ^ TypeName
+//             ^ Operator
+//                ^ TypeName
+//                   ^ TypeName
+//                     ^^^^^^^^^^ TypeName
+//                                   ^ TypeName
+	return s
+}
+
+// Generic types, and methods with type parameters in their receiver
+type Stack[T comparable] struct {
+//   ^^^^^ Identifier
+//         ^ TypeName
+//           ^^^^^^^^^^ TypeName
+	items []T
+//       ^ TypeName
+}
+
+func (s *Stack[T]) Push(v T) {
+//             ^ TypeName
+//                        ^ TypeName
+	s.items = append(s.items, v)
+}
+
+type Pair[K comparable, V any] struct {
+	Key   K
+//     ^ TypeName
+	Value V
+//     ^ TypeName
+}
+
+func (p Pair[K, V]) String() string {
+//           ^ TypeName
+//              ^ TypeName
+	return fmt.Sprint(p.Key, p.Value)
+}
+
+type List[T any] []T
+//                 ^ TypeName
+
+// Outside their declaration, the same names are ordinary identifiers again
+var T = 1
+//  ^ Identifier
+
+// Index expressions aren't type parameters, and neither are array types
+func index(values []int, K int) int {
+	return values[K]
+//             ^ Identifier
+}
+
+type Buffer [K]byte
+//           ^ Identifier
+
+// Explicit instantiations
+var strs = Map[int, string]([]int{1, 2}, func(i int) string { return fmt.Sprint(i) })
+//             ^^^ TypeName
+//                  ^^^^^^ TypeName
+var total = Sum[float64]([]float64{1.5, 2.5})
+var stack Stack[string]
+//              ^^^^^^ TypeName
@@ -0,0 +1,10 @@
+/* Legacy source file saved as Windows-1252, not UTF-8.
+ * Auteur : Ren Lefvre  caf edition
+ */
+#include <stdio.h>
+
+// Affiche le rsum ( 1998)
+int main(void) {
+    printf("Hello\n");
+    return 0;
+}
@@ -0,0 +1,25 @@
+-- dialect: mssql
+-- SQL Server Syntax Test File
+-- A line like `--   ^^^ Kind` asserts the token kind of the characters above the carets.
+
+SET NOCOUNT ON;
+--  ^^^^^^^ Keyword
+GO
+
+CREATE TABLE #recent ([Order ID] INT IDENTITY(1, 1), [Name]]s] NVARCHAR(50));
+--           ^^^^^^^ Identifier
+--                    ^^^^^^^^^^ Identifier
+--                                   ^^^^^^^^ Keyword
+--                                                   ^^^^^^^^^ Identifier
+
+DECLARE @name NVARCHAR(50) = N'Zoë';
+--      ^^^^^ VariableName
+--                           ^^^^^^ String
+
+SELECT TOP 10 ISNULL([Name]]s], 'none'), GETDATE(), @@ROWCOUNT
+--            ^^^^^^ FunctionName
+--                                       ^^^^^^^ FunctionName
+--                                                  ^^^^^^^^^^ VariableName
+FROM ##shared WITH (NOLOCK);
+--   ^^^^^^^^ Identifier
+--                  ^^^^^^ Keyword
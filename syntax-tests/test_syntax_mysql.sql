@@ -0,0 +1,28 @@
+-- dialect: mysql
+-- MySQL Syntax Test File
+-- A line like `--   ^^^ Kind` asserts the token kind of the characters above the carets.
+
+# Hash comments are comments in MySQL
+-- ^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^ Comment
+
+CREATE TABLE `order items` (
+--           ^^^^^^^^^^^^^ Identifier
+    id INT UNSIGNED NOT NULL AUTO_INCREMENT,
+--         ^^^^^^^^ Keyword
+    status ENUM('new', 'done') DEFAULT 'new',
+--         ^^^^ TypeName
+    note MEDIUMTEXT
+--       ^^^^^^^^^^ TypeName
+)  ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+-- ^^^^^^ Keyword
+
+SELECT 'it\'s', "double quoted", IFNULL(note, '') FROM `order items`
+--     ^^^^^^^ String
+--              ^^^^^^^^^^^^^^^ String
+--                               ^^^^^^ FunctionName
+WHERE note REGEXP '^a' AND 5 DIV 2 = 2;
+--         ^^^^^^ Keyword
+--                           ^^^ Keyword
+
+SELECT 10--1;
+--       ^^ Operator
@@ -0,0 +1,35 @@
+-- dialect: postgres
+-- PostgreSQL Syntax Test File
+-- A line like `--   ^^^ Kind` asserts the token kind of the characters above the carets.
+
+CREATE FUNCTION add_tax(price numeric) RETURNS numeric LANGUAGE plpgsql AS $body$
+DECLARE
+    rate numeric := 0.2;
+BEGIN
+    -- Inside a dollar-quoted body, quotes and $$ don't end the string
+    RAISE NOTICE 'it''s $$ and $1';
+    RETURN price * (1 + rate);
+END;
+$body$;
+--^^^^ String
+
+DO $$ BEGIN PERFORM 1; END $$;
+-- ^^^^^^^^^^^^^^^^^^^^^^^^^^ String
+
+SELECT id::text, data #>> '{a,b}', tags[1], $1
+--       ^^ Operator
+--                    ^^^ Operator
+--                                     ^ Operator
+--                                          ^^ VariableName
+FROM items
+WHERE name ILIKE E'%\'quoted\'%' AND payload @> '{"a": 1}'::jsonb
+--         ^^^^^ Keyword
+--               ^^^^^^^^^^^^^^^ String
+--                                                          ^^^^^ TypeName
+RETURNING array_agg(id);
+--^^^^^^^ Keyword
+--        ^^^^^^^^^ FunctionName
+
+SELECT 'C:\path\' AS standard_strings, "Quoted Column" FROM t;
+--     ^^^^^^^^^^ String
+--                                     ^^^^^^^^^^^^^^^ Identifier
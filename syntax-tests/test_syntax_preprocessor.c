@@ -0,0 +1,100 @@
+// C Preprocessor Test File
+// A line like `//   ^^^ Kind` asserts the token kind of the characters above the carets.
+// Between continued lines, they're block comments that continue the line themselves.
+
+#include <stdio.h>
+//       ^^^^^^^^^ String
+#include "config.h"
+//       ^^^^^^^^^^ String
+
+#define BUFFER_SIZE 1024
+// ^^^^ Macro
+//      ^^^^^^^^^^^ Macro
+//                  ^^^^ Number
+
+// A function-like macro over several lines, with its parameters in the body
+#define SWAP(type, a, b) \
+/* ^^^^ Macro */ \
+/*      ^^^^ Macro */ \
+/*           ^^^^ ParameterName */ \
+/*                 ^ ParameterName */ \
+/*                       ^ Macro */ \
+    do {                 \
+/*  ^^ Keyword */ \
+        type tmp = (a);  \
+/*      ^^^^ ParameterName */ \
+/*           ^^^ Identifier */ \
+/*                  ^ ParameterName */ \
+        (a) = (b);       \
+/*       ^ ParameterName */ \
+        (b) = tmp;       \
+/*            ^^^ Identifier */ \
+    } while (0)
+//    ^^^^^ Keyword
+
+// Stringizing, token pasting and variadic arguments
+#define STR(x) #x
+//             ^ MacroOperator
+//              ^ ParameterName
+#define CONCAT(a, b) a ## b
+//                   ^ ParameterName
+//                     ^^ MacroOperator
+//                        ^ ParameterName
+#define LOG(fmt, ...) \
+    fprintf(stderr, "[%s] " fmt "\n", __func__, ##__VA_ARGS__)
+//                          ^^^ ParameterName
+//                                              ^^ MacroOperator
+//                                                ^^^^^^^^^^^ ParameterName
+
+// Conditions get operators and identifiers, with `defined` as an operator
+#if defined(FOO) && !defined(BAR)
+//^ Macro
+//  ^^^^^^^ KeywordOperator
+//         ^ Operator
+//          ^^^ Identifier
+//               ^^ Operator
+//                  ^ Operator
+//                   ^^^^^^^ KeywordOperator
+#  if VERSION >= 2 || \
+/*^^^ Macro */ \
+/*    ^^^^^^^ Identifier */ \
+/*            ^^ Operator */ \
+/*                    ^ Macro */ \
+      __has_include(<threads.h>)
+//    ^^^^^^^^^^^^^ KeywordOperator
+#    define HAVE_THREADS 1
+//   ^^^^^^ Macro
+//          ^^^^^^^^^^^^ Macro
+#  elif defined VERSION
+//      ^^^^^^^ KeywordOperator
+#    error "VERSION is too old, can't continue"
+//   ^^^^^ Macro
+//         ^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^ String
+#  endif
+#else
+// ^^ Macro
+#  pragma once
+#endif
+
+// Code in `#if 0` is inactive, up to its `#else`, and nests
+#if 0
+    legacy_init();
+//  ^^^^^^^^^^^^^^ Inactive
+#  ifdef DEBUG
+// ^^^^^^^^^^^^ Inactive
+    dump_state(stderr);
+//  ^^^^^^^^^^^^^^^^^^^ Inactive
+#  endif
+//^^^^^^ Inactive
+#else
+// ^^ Macro
+    init();
+//  ^^^^ Identifier
+#endif
+
+int main(void) {
+    char buffer[BUFFER_SIZE];
+    SWAP(int, buffer[0], buffer[1]);
+    LOG("%s", STR(main));
+    return CONCAT(0, );
+}
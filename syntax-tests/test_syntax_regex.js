@@ -0,0 +1,115 @@
+// JavaScript Regex Versus Division Test File
+// A line like `//   ^^^ Kind` asserts the token kind of the characters above the carets.
+
+// After an expression, `/` divides
+x = a /b/ c;
+//    ^ Operator
+//      ^ Operator
+x = a /b/ g;
+//    ^ Operator
+//      ^ Operator
+//        ^ Identifier
+y = (a + b) / 2 / c;
+//          ^ Operator
+//              ^ Operator
+z = arr[0] / arr[1];
+//         ^ Operator
+w = a++ /b/ c;
+//      ^ Operator
+//        ^ Operator
+v = a-- / 2;
+//      ^ Operator
+u = 10 / 2;
+//     ^ Operator
+t = "a" / "b";
+//      ^ Operator
+s = this / 2;
+//       ^ Operator
+p = super.size / 2;
+//             ^ Operator
+n = null / 2 + true / 2;
+//       ^ Operator
+//                  ^ Operator
+r = total /= 2;
+//        ^^ Operator
+q = `${a}` / b;
+//         ^ Operator
+
+// Where an expression starts, `/` starts a regex
+const re = /ab+c/gi;
+//         ^^^^^^ Regex
+//               ^^ RegexFlags
+const sticky = /a/dgimsuvy;
+//             ^^^ Regex
+//                ^^^^^^^^ RegexFlags
+function f(s) {
+    return /re/.test(s);
+//         ^^^^ Regex
+}
+if (x) /re/.test(s);
+//     ^^^^ Regex
+while (i--) /a/g.exec(s);
+//          ^^^ Regex
+//             ^ RegexFlags
+const m = s.match(/\d+/);
+//                ^^^^^ Regex
+const parts = [/a/, /b/];
+//             ^^^ Regex
+//                  ^^^ Regex
+const t2 = typeof /x/;
+//                ^^^ Regex
+const t3 = void /x/, t4 = x instanceof /x/.constructor;
+//              ^^^ Regex
+//                                     ^^^ Regex
+function* gen() { yield /x/; }
+//                      ^^^ Regex
+async function run() { await /x/; }
+//                           ^^^ Regex
+const ok = cond ? /yes/ : /no/;
+//                ^^^^^ Regex
+//                        ^^^^ Regex
+const not = !/x/.test(s);
+//           ^^^ Regex
+const arrow = (s) => /^\s*$/.test(s);
+//                   ^^^^^^^ Regex
+switch (c) {
+    case /a/.test(c):
+//       ^^^ Regex
+}
+for (const p of /a/g[Symbol.matchAll](s)) {}
+//              ^^^ Regex
+//                 ^ RegexFlags
+const inc = ++/a/.lastIndex;
+//            ^^^ Regex
+
+// Inside a regex, `/` in a class or escaped doesn't end it
+const path = /[/\\]+/;
+//           ^^^^^^^^ Regex
+const url = /https?:\/\/\S+/u;
+//          ^^^^^^^^^^^^^^^^ Regex
+//                          ^ RegexFlags
+const slashes = /\//g;
+//              ^^^^ Regex
+//                  ^ RegexFlags
+const bracket = /[/\]]/g;
+//              ^^^^^^^ Regex
+//                     ^ RegexFlags
+const classes = /[[\]/]+/ / 2;
+//              ^^^^^^^^^ Regex
+//                        ^ Operator
+
+// At the start of a statement, `/` starts a regex
+if (shebang) {
+    /^#!/.test(source) && strip();
+//  ^^^^^ Regex
+}
+
+// Comments between don't change the decision
+const after = value /* half */ / 2;
+//                             ^ Operator
+const before = /* start */ /re/;
+//                         ^^^^ Regex
+
+// A regex that doesn't end on its line is a division after all
+const half = { } / 2;
+//               ^ Operator
@@ -0,0 +1,24 @@
+-- dialect: sqlite
+-- SQLite Syntax Test File
+-- A line like `--   ^^^ Kind` asserts the token kind of the characters above the carets.
+
+PRAGMA foreign_keys = ON;
+--^^^^ Keyword
+
+CREATE TABLE IF NOT EXISTS "notes" (
+--                         ^^^^^^^ Identifier
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+--                         ^^^^^^^^^^^^^ Keyword
+    [body text] TEXT,
+--  ^^^^^^^^^^^ Identifier
+    `created` TEXT DEFAULT (strftime('%s', 'now'))
+--  ^^^^^^^^^ Identifier
+--                          ^^^^^^^^ FunctionName
+) STRICT;
+
+-- "x" is a string if there's no column x, which only the database knows
+SELECT rowid, "title" FROM notes WHERE body GLOB '*sql*';
+--     ^^^^^ Keyword
+--            ^^^^^^^ Identifier
+--                                          ^^^^ Keyword
+--                                               ^^^^^^^ String
@@ -0,0 +1,138 @@
+// Go Test File
+// A line like `//   ^^^ Kind` asserts the token kind of the characters above the carets.
+// Tests, benchmarks and fuzz targets are ordinary functions: neither their name prefixes
+// nor the identifiers of the testing package get any special treatment.
+
+package calc
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+)
+
+var errDivideByZero = errors.New("division by zero")
+
+func divide(a, b int) (int, error) {
+	if b == 0 {
+		return 0, errDivideByZero
+	}
+	return a / b, nil
+}
+
+// Table-driven tests with subtests
+func TestDivide(t *testing.T) {
+//   ^^^^^^^^^^ Identifier
+//              ^ Identifier
+//                ^ Operator
+//                 ^^^^^^^ Identifier
+//                        ^ Operator
+//                         ^ Identifier
+	t.Parallel()
+// ^^^^^^^^ Identifier
+	tests := []struct {
+		name    string
+//^^^^ Identifier
+//        ^^^^^^ TypeName
+		a, b    int
+		want    int
+		wantErr error
+//        ^^^^^ TypeName
+	}{
+		{"positive", 10, 2, 5, nil},
+// ^^^^^^^^^^ String
+//                       ^^^ Boolean
+		{"negative", -9, 3, -3, nil},
+		{name: "by zero", a: 1, wantErr: errDivideByZero},
+// ^^^^ Identifier
+//     ^ Operator
+	}
+	for _, tt := range tests {
+//            ^^^^^ Keyword
+		t.Run(tt.name, func(t *testing.T) {
+//  ^^^ Identifier
+//               ^^^^ Keyword
+			t.Parallel()
+			got, err := divide(tt.a, tt.b)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("divide(%d, %d) error = %v, want %v", tt.a, tt.b, err, tt.wantErr)
+//           ^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^ String
+			}
+			if got != tt.want {
+				t.Errorf("divide(%d, %d) = %d, want %d", tt.a, tt.b, got, tt.want)
+			}
+		})
+	}
+}
+
+// Helpers mark themselves, and cleanups run after the test
+func newTempValue(t testing.TB) string {
+	t.Helper()
+	dir := t.TempDir()
+	t.Cleanup(func() { t.Log("cleaned up", dir) })
+	t.Setenv("CALC_DEBUG", "1")
+	return dir
+}
+
+// Benchmarks loop b.N times, after resetting the timer for the setup
+func BenchmarkDivide(b *testing.B) {
+//   ^^^^^^^^^^^^^^^ Identifier
+//                      ^^^^^^^ Identifier
+//                              ^ Identifier
+	values := make([]int, 1000)
+	for i := range values {
+		values[i] = i + 1
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+// ^^^^^^^^^^ Identifier
+	for i := 0; i < b.N; i++ {
+//               ^ Identifier
+//                 ^ Identifier
+		_, _ = divide(1<<20, values[i%len(values)])
+	}
+}
+
+// Sub-benchmarks and parallel benchmarks
+func BenchmarkParse(b *testing.B) {
+	for _, size := range []int{10, 1000} {
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					_, _ = strconv.Atoi(strconv.Itoa(size))
+				}
+			})
+		})
+	}
+}
+
+// Fuzz targets seed the corpus with f.Add and fuzz a function of the same arguments
+func FuzzDivide(f *testing.F) {
+//   ^^^^^^^^^^ Identifier
+//                         ^ Identifier
+	f.Add(10, 2)
+// ^^^ Identifier
+	f.Add(-7, 0)
+//     ^ Operator
+//      ^ Number
+	f.Fuzz(func(t *testing.T, a, b int) {
+		if b == 0 {
+			t.Skip("division by zero")
+		}
+		if _, err := divide(a, b); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// Examples compare their output with the comment at their end
+func ExampleDivide() {
+	q, _ := divide(10, 2)
+	println(q)
+	// Output: 5
+}
+
+// TestMain wraps the tests of the package
+func TestMain(m *testing.M) {
+	m.Run()
+}
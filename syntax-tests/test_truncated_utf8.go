@@ -0,0 +1,5 @@
+package main
+
+func main() {}
+
+// The file was cut off in the middle of a character: 
\ No newline at end of file